@@ -21,6 +21,15 @@ type Server struct {
 	Cmd       *exec.Cmd
 }
 
+// ServerRef stands in for a server's main.go in a directory of servers,
+// in a server.json, to run a server kept elsewhere with flags of its own:
+//
+//	{"server": "../../v1/uber", "args": ["--profile", "v2"]}
+type ServerRef struct {
+	Server string   `json:"server"` // Its directory, if relative then to the server.json's
+	Args   []string `json:"args"`
+}
+
 type ServerManager struct {
 	Servers   []*Server
 	ctx       context.Context
@@ -112,12 +121,26 @@ func (sm *ServerManager) runServer(server *Server) {
 		sm.errChan <- fmt.Errorf("failed to get absolute path for %s: %v", server.LocalPath, err)
 		return
 	}
+	args := []string{"--port", fmt.Sprintf("%d", server.Port)}
+	if data, err := os.ReadFile(filepath.Join(absPath, "server.json")); err == nil {
+		var ref ServerRef
+		if err := json.Unmarshal(data, &ref); err != nil {
+			sm.errChan <- fmt.Errorf("failed to read server.json in %s: %v", absPath, err)
+			return
+		}
+		if filepath.IsAbs(ref.Server) {
+			absPath = ref.Server
+		} else {
+			absPath = filepath.Join(absPath, ref.Server)
+		}
+		args = append(ref.Args, args...)
+	}
 	mainFile := filepath.Join(absPath, "main.go")
 	if _, err := os.Stat(mainFile); os.IsNotExist(err) {
 		sm.errChan <- fmt.Errorf("main.go not found in %s: %v", absPath, err)
 		return
 	}
-	cmd := exec.CommandContext(sm.ctx, "go", "run", mainFile, "--port", fmt.Sprintf("%d", server.Port))
+	cmd := exec.CommandContext(sm.ctx, "go", append([]string{"run", mainFile}, args...)...)
 	cmd.Dir = absPath
 	cmd.Stdout = nil
 	cmd.Stderr = os.Stderr
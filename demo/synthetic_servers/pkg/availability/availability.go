@@ -0,0 +1,321 @@
+// Package availability keeps the synthetic servers' calendars: when a tax
+// professional takes appointments, when a store's vans deliver, when a
+// studio's recurring classes meet and when a caregiver works. A Schedule
+// is weekly Rules, each a time of day, or a window cut into slots, on some
+// days of the week, kept in a time zone; it takes a Capacity of
+// reservations in each slot, and none on the dates it is closed.
+//
+// A Reservation takes spots in a resource's schedule, such as a
+// professional's or a store's, for a party, such as a user. One with an
+// expiry is a hold, which keeps its spots for a while, say through
+// checkout, and lapses unless it is confirmed. Check says whether a
+// reservation fits a schedule alongside those already made, and Conflict
+// whether its party is already somewhere else at the time.
+package availability
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rule is when a schedule is open each week: at Start on Days, or, if it
+// has an End, from Start to End, cut into slots.
+type Rule struct {
+	Days  []string `json:"days"`          // "mon" or "monday", ...
+	Start string   `json:"start"`         // "15:04", where the schedule keeps time
+	End   string   `json:"end,omitempty"` // "15:04"; a single slot at Start if empty
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// weekday reads a day of the week, abbreviated or in full, in any case.
+func weekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(name)
+	if len(name) < 3 {
+		return 0, false
+	}
+	day, ok := weekdays[name[:3]]
+	return day, ok && strings.HasPrefix(strings.ToLower(day.String()), name)
+}
+
+// clock reads an HH:MM time of day as an offset from midnight.
+func clock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Validate returns an error naming what is wrong with r, if anything.
+func (r Rule) Validate() error {
+	if len(r.Days) == 0 {
+		return errors.New("must include at least one day")
+	}
+	for _, day := range r.Days {
+		if _, ok := weekday(day); !ok {
+			return fmt.Errorf("invalid day %q", day)
+		}
+	}
+	start, err := clock(r.Start)
+	if err != nil {
+		return fmt.Errorf("invalid time %q, expected HH:MM", r.Start)
+	}
+	if r.End == "" {
+		return nil
+	}
+	end, err := clock(r.End)
+	if err != nil {
+		return fmt.Errorf("invalid time %q, expected HH:MM", r.End)
+	}
+	if end <= start {
+		return fmt.Errorf("ends at %s, before it starts at %s", r.End, r.Start)
+	}
+	return nil
+}
+
+// meets reports whether r is open on day.
+func (r Rule) meets(day time.Weekday) bool {
+	for _, name := range r.Days {
+		if d, ok := weekday(name); ok && d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Slot is a stretch of a schedule that can be reserved.
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Opening is a slot with spots left, and how many.
+type Opening struct {
+	Slot
+	Remaining int `json:"remaining"`
+}
+
+// Schedule is when a resource can be reserved, and how much.
+type Schedule struct {
+	Rules []Rule
+	// Length is how long each slot is: a rule with an End is cut into
+	// slots this long, and one without has a single slot this long.
+	Length time.Duration
+	// Capacity is how many spots each slot has; 1 if 0.
+	Capacity int
+	// Closed are the dates, as 2006-01-02, it has no slots, such as
+	// holidays and time off.
+	Closed []string
+	// Location is where its rules keep time; UTC if nil.
+	Location *time.Location
+}
+
+func (s Schedule) location() *time.Location {
+	if s.Location == nil {
+		return time.UTC
+	}
+	return s.Location
+}
+
+func (s Schedule) capacity() int {
+	if s.Capacity <= 0 {
+		return 1
+	}
+	return s.Capacity
+}
+
+// On returns the slots s has on day's date, as written, whether
+// reserved or not, earliest first. Rules that overlap give a slot once.
+func (s Schedule) On(day time.Time) []Slot {
+	y, m, d := day.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, s.location())
+	date := midnight.Format(time.DateOnly)
+	for _, closed := range s.Closed {
+		if closed == date {
+			return nil
+		}
+	}
+	if s.Length <= 0 {
+		return nil
+	}
+
+	var slots []Slot
+	at := func(offset time.Duration) time.Time {
+		// Whole hours and minutes on the date, so that days on which
+		// clocks change keep their times of day.
+		return time.Date(y, m, d, int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, s.location())
+	}
+	for _, rule := range s.Rules {
+		if !rule.meets(midnight.Weekday()) {
+			continue
+		}
+		open, err := clock(rule.Start)
+		if err != nil {
+			continue
+		}
+		if rule.End == "" {
+			start := at(open)
+			slots = append(slots, Slot{Start: start, End: start.Add(s.Length)})
+			continue
+		}
+		closing, err := clock(rule.End)
+		if err != nil {
+			continue
+		}
+		for offset := open; offset+s.Length <= closing; offset += s.Length {
+			start := at(offset)
+			slots = append(slots, Slot{Start: start, End: start.Add(s.Length)})
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Start.Before(slots[j].Start) })
+	return slices.CompactFunc(slots, func(a, b Slot) bool { return a.Start.Equal(b.Start) })
+}
+
+// Between returns the slots s has on the days dates from from's, earliest
+// first.
+func (s Schedule) Between(from time.Time, days int) []Slot {
+	var slots []Slot
+	for i := 0; i < days; i++ {
+		slots = append(slots, s.On(from.AddDate(0, 0, i))...)
+	}
+	return slots
+}
+
+// Offers returns the slot of s that starts at start, if there is one.
+func (s Schedule) Offers(start time.Time) (Slot, bool) {
+	for _, slot := range s.On(start.In(s.location())) {
+		if slot.Start.Equal(start) {
+			return slot, true
+		}
+	}
+	return Slot{}, false
+}
+
+// Reservation takes spots in a resource's schedule for a party. One that
+// Expires is a hold, which lapses then unless it is confirmed.
+type Reservation struct {
+	ID       string     `json:"id"`
+	Resource string     `json:"resource"` // Whose schedule it is in, such as a professional's or store's ID
+	Party    string     `json:"party"`    // Whom it is for, such as a user's email
+	Start    time.Time  `json:"start"`
+	End      time.Time  `json:"end"`
+	Spots    int        `json:"spots,omitempty"`      // How many it takes; 1 if 0
+	Expires  *time.Time `json:"expires_at,omitempty"` // When a hold lapses; nil once confirmed
+}
+
+func (r Reservation) spots() int {
+	if r.Spots <= 0 {
+		return 1
+	}
+	return r.Spots
+}
+
+// Lapsed reports whether r is a hold that has expired by now.
+func (r Reservation) Lapsed(now time.Time) bool {
+	return r.Expires != nil && !now.Before(*r.Expires)
+}
+
+// Confirm makes a hold a reservation that doesn't lapse.
+func (r *Reservation) Confirm() {
+	r.Expires = nil
+}
+
+// Overlaps reports whether r and other share any time.
+func (r Reservation) Overlaps(other Reservation) bool {
+	return r.Start.Before(other.End) && other.Start.Before(r.End)
+}
+
+// Errors Check and Hold return.
+var (
+	ErrPast        = errors.New("that time has already passed")
+	ErrUnavailable = errors.New("that time is not on the schedule")
+	ErrFull        = errors.New("that time is fully booked")
+)
+
+// Errors for a reservation whose party is elsewhere at the time, and for
+// confirming a hold that has lapsed.
+var (
+	ErrConflict = errors.New("already booked at that time")
+	ErrLapsed   = errors.New("the hold has expired")
+)
+
+// Taken returns how many spots of resource's schedule the reservations
+// other than r's ID take during r, leaving out lapsed holds.
+func Taken(r Reservation, reservations []Reservation, now time.Time) int {
+	taken := 0
+	for _, other := range reservations {
+		if other.ID != r.ID && other.Resource == r.Resource && !other.Lapsed(now) && r.Overlaps(other) {
+			taken += other.spots()
+		}
+	}
+	return taken
+}
+
+// Check returns nil if r, which starts after now, is one of s's slots with
+// room for it alongside reservations, and ErrPast, ErrUnavailable or ErrFull
+// if not. Reservations of other resources, lapsed holds and one with r's ID,
+// which r replaces, are no matter.
+func (s Schedule) Check(r Reservation, reservations []Reservation, now time.Time) error {
+	if !r.Start.After(now) {
+		return ErrPast
+	}
+	slot, ok := s.Offers(r.Start)
+	if !ok || !slot.End.Equal(r.End) {
+		return ErrUnavailable
+	}
+	if Taken(r, reservations, now)+r.spots() > s.capacity() {
+		return ErrFull
+	}
+	return nil
+}
+
+// Conflict returns the reservation of r's party, other than r's ID and
+// lapsed holds, that r overlaps, if there is one.
+func Conflict(r Reservation, reservations []Reservation, now time.Time) (Reservation, bool) {
+	for _, other := range reservations {
+		if other.ID != r.ID && strings.EqualFold(other.Party, r.Party) && !other.Lapsed(now) && r.Overlaps(other) {
+			return other, true
+		}
+	}
+	return Reservation{}, false
+}
+
+// Open returns the slots of resource's schedule s in the days dates from
+// from's that start after now and have spots left, with how many.
+func (s Schedule) Open(resource string, from time.Time, days int, reservations []Reservation, now time.Time) []Opening {
+	openings := []Opening{}
+	for _, slot := range s.Between(from, days) {
+		if !slot.Start.After(now) {
+			continue
+		}
+		r := Reservation{Resource: resource, Start: slot.Start, End: slot.End}
+		if left := s.capacity() - Taken(r, reservations, now); left > 0 {
+			openings = append(openings, Opening{Slot: slot, Remaining: left})
+		}
+	}
+	return openings
+}
+
+// Hold checks r against s and reservations and, if it fits, returns it as
+// a hold that lapses after keep.
+func (s Schedule) Hold(r Reservation, reservations []Reservation, keep time.Duration, now time.Time) (Reservation, error) {
+	if err := s.Check(r, reservations, now); err != nil {
+		return Reservation{}, err
+	}
+	expires := now.Add(keep)
+	r.Expires = &expires
+	return r, nil
+}
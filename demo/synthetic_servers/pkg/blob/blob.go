@@ -0,0 +1,182 @@
+// Package blob keeps the files the synthetic servers take and make, such
+// as uploaded tax forms or rendered boarding passes, on local disk. Each is
+// stored under the SHA-256 of its content, its ID, so the same bytes are
+// only ever stored once and an ID always names the same bytes:
+//
+//	<dir>/3a/3a7bd3e2360a3d29eea436fcfb7e44c735d117c42d1c1835420b6b9942dd4f1b
+//	<dir>/3a/3a7bd3e2360a3d29eea436fcfb7e44c735d117c42d1c1835420b6b9942dd4f1b.json
+//
+// the content and, beside it, what it is. Blobs are never changed, and
+// only taken out by Delete.
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrNotFound is returned for IDs the store has no blob for, including
+// those that aren't IDs at all.
+var ErrNotFound = errors.New("blob not found")
+
+// Blob describes stored content.
+type Blob struct {
+	ID          string `json:"id"` // The SHA-256 of its content, in hex
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+// Store is a directory of blobs. It is safe for concurrent use, by
+// processes as well as goroutines: blobs are written to a temporary file
+// and renamed into place.
+type Store struct {
+	dir string
+}
+
+// Open opens the store in dir, making the directory if need be, or in a
+// new temporary directory if dir is empty.
+func Open(dir string) (*Store, error) {
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "blobs-")
+		if err != nil {
+			return nil, fmt.Errorf("blobs: %w", err)
+		}
+		dir = tmp
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("blobs: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir returns the directory the store keeps its blobs in.
+func (s *Store) Dir() string { return s.dir }
+
+// Put stores what r reads, of contentType, and describes it. Content
+// already in the store keeps the type it was first stored with.
+func (s *Store) Put(r io.Reader, contentType string) (Blob, error) {
+	tmp, err := os.CreateTemp(s.dir, ".put-*")
+	if err != nil {
+		return Blob{}, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+
+	id := hex.EncodeToString(h.Sum(nil))
+	if b, err := s.Stat(id); err == nil {
+		return b, nil
+	}
+	b := Blob{ID: id, Size: size, ContentType: contentType}
+	path := s.path(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return Blob{}, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return Blob{}, err
+	}
+	meta, err := json.Marshal(b)
+	if err != nil {
+		return Blob{}, err
+	}
+	if err := writeFile(path+".json", meta); err != nil {
+		return Blob{}, err
+	}
+	return b, nil
+}
+
+// Stat describes the blob id names.
+func (s *Store) Stat(id string) (Blob, error) {
+	if !valid(id) {
+		return Blob{}, ErrNotFound
+	}
+	meta, err := os.ReadFile(s.path(id) + ".json")
+	if errors.Is(err, os.ErrNotExist) {
+		return Blob{}, ErrNotFound
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+	var b Blob
+	if err := json.Unmarshal(meta, &b); err != nil {
+		return Blob{}, fmt.Errorf("blob %s: %w", id, err)
+	}
+	return b, nil
+}
+
+// Open opens the content of the blob id names, which the caller closes.
+func (s *Store) Open(id string) (*os.File, Blob, error) {
+	b, err := s.Stat(id)
+	if err != nil {
+		return nil, Blob{}, err
+	}
+	f, err := os.Open(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, Blob{}, ErrNotFound
+	}
+	return f, b, err
+}
+
+// Delete takes the blob id names out of the store, if it is there.
+func (s *Store) Delete(id string) error {
+	if !valid(id) {
+		return ErrNotFound
+	}
+	if err := os.Remove(s.path(id) + ".json"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(s.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path is where the content of blob id is kept, in a directory named for
+// its first two digits so that no directory gets too big.
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id[:2], id)
+}
+
+// valid reports whether id is a SHA-256 in lowercase hex, and so safe to
+// make a path of.
+func valid(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	for _, r := range id {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFile writes data to path through a temporary file, so readers see
+// all of it or none.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pkg/contract"
+	"pkg/registry"
+)
+
+// scaffold gives a server without cases a smoke case that GETs each of its
+// JSON endpoints that takes no parameters it must be given, as the first
+// user with a token in its fixture. It reports whether it wrote one.
+func scaffold(svc registry.Service) (bool, error) {
+	cases, err := contract.LoadCases(svc.Dir)
+	if err != nil || len(cases) > 0 {
+		return false, err
+	}
+	spec, err := svc.Spec()
+	if err != nil || spec == nil {
+		return false, err
+	}
+	token, _, err := contract.FirstToken(contract.Fixture(svc.Dir))
+	if err != nil {
+		return false, err
+	}
+
+	c := contract.Case{
+		Description: "GET each endpoint that needs no parameters, as the seed's first user",
+		Unordered:   []string{"data"}, // Pages of entities kept in maps
+	}
+	paths, _ := spec["paths"].(map[string]any)
+	for _, path := range sortedKeys(paths) {
+		item, _ := paths[path].(map[string]any)
+		op, ok := item["get"].(map[string]any)
+		if !ok || strings.Contains(path, "{") || hasRequiredParam(op) || !returnsJSON(op) {
+			continue
+		}
+		r := contract.Request{Method: "GET", Path: path}
+		if token != "" {
+			r.Headers = map[string]string{"Authorization": "Bearer " + token}
+		}
+		c.Requests = append(c.Requests, r)
+	}
+	if len(c.Requests) == 0 {
+		return false, nil
+	}
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	dir := filepath.Join(svc.Dir, contract.Dir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, err
+	}
+	return true, os.WriteFile(filepath.Join(dir, "smoke.json"), append(data, '\n'), 0o644)
+}
+
+func hasRequiredParam(op map[string]any) bool {
+	params, _ := op["parameters"].([]any)
+	for _, p := range params {
+		if p, _ := p.(map[string]any); p["required"] == true {
+			return true
+		}
+	}
+	return false
+}
+
+func returnsJSON(op map[string]any) bool {
+	responses, _ := op["responses"].(map[string]any)
+	ok, _ := responses["200"].(map[string]any)
+	content, _ := ok["content"].(map[string]any)
+	_, found := content["application/json"]
+	return found
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,167 @@
+// Command contract runs the synthetic servers' contract tests: it boots
+// each server on its fixture database, replays the recorded requests in
+// its testdata/contract directory, and compares the responses with the
+// golden ones there; see package contract. Run it from pkg:
+//
+//	go run ./cmd/contract -servers ../v1
+//	go run ./cmd/contract -only chase,hilton
+//
+// It prints which servers passed and how the others' responses differ,
+// field by field, and exits with status 1 if any failed. After changing a
+// server on purpose, record its new responses with -update and review the
+// golden files' diff. -init gives servers without cases a smoke case,
+// smoke.json, that GETs each endpoint of theirs without parameters as the
+// seed's first user.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+
+	"pkg/contract"
+	"pkg/registry"
+)
+
+// result is how a server's cases went.
+type result struct {
+	svc      registry.Service
+	cases    int
+	passed   int
+	failures []contract.Failure
+	err      error
+	log      string // The server's log, if it failed to start
+}
+
+func main() {
+	dir := flag.String("servers", "../v1", "Directory of servers to test")
+	only := flag.String("only", "", "Comma-separated services to test, instead of all of them")
+	update := flag.Bool("update", false, "Record the responses as the golden ones instead of comparing them")
+	initCases := flag.Bool("init", false, "Give servers without cases a smoke case first")
+	jobs := flag.Int("j", runtime.NumCPU(), "Servers to test at once")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("contract: ")
+
+	services, err := registry.Discover(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *only != "" {
+		var picked []registry.Service
+		for _, name := range strings.Split(*only, ",") {
+			svc, ok := registry.Find(services, strings.TrimSpace(name))
+			if !ok {
+				log.Fatalf("-only: no server %q in %s", name, *dir)
+			}
+			picked = append(picked, svc)
+		}
+		services = picked
+	}
+	if *initCases {
+		for _, svc := range services {
+			created, err := scaffold(svc)
+			if err != nil {
+				log.Printf("%s: %v", svc.Name, err)
+			} else if created {
+				log.Printf("%s: wrote %s/smoke.json", svc.Name, contract.Dir)
+			}
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	bin, err := os.MkdirTemp("", "contract")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+
+	results := make(chan result)
+	go func() {
+		sem := make(chan struct{}, max(*jobs, 1))
+		var wg sync.WaitGroup
+		for _, svc := range services {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				results <- run(ctx, svc, bin, *update)
+			}()
+		}
+		wg.Wait()
+		close(results)
+	}()
+
+	var tested, failed int
+	for r := range results {
+		if r.cases == 0 && r.err == nil {
+			continue
+		}
+		tested++
+		switch {
+		case r.err != nil:
+			failed++
+			fmt.Printf("FAIL %s: %v\n", r.svc.Name, r.err)
+			if r.log != "" {
+				fmt.Printf("\t%s\n", strings.ReplaceAll(strings.TrimSpace(r.log), "\n", "\n\t"))
+			}
+		case len(r.failures) > 0:
+			failed++
+			fmt.Printf("FAIL %s: %d of %d cases\n", r.svc.Name, r.cases-r.passed, r.cases)
+			for _, f := range r.failures {
+				fmt.Printf("    %s\n", strings.ReplaceAll(f.String(), "\n", "\n    "))
+			}
+		case *update:
+			fmt.Printf("ok   %s: recorded %d cases\n", r.svc.Name, r.cases)
+		default:
+			fmt.Printf("ok   %s: %d cases\n", r.svc.Name, r.cases)
+		}
+	}
+	if ctx.Err() != nil {
+		os.Exit(1)
+	}
+	if tested == 0 {
+		log.Fatalf("no cases in %s; add some, or scaffold them with -init", *dir)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d servers failed\n", failed, tested)
+		os.Exit(1)
+	}
+}
+
+// run builds a server, boots it, and checks its cases.
+func run(ctx context.Context, svc registry.Service, bin string, update bool) result {
+	r := result{svc: svc}
+	cases, err := contract.LoadCases(svc.Dir)
+	if err != nil || len(cases) == 0 {
+		r.err = err
+		return r
+	}
+	r.cases = len(cases)
+
+	path, err := contract.Build(ctx, svc.Dir, bin)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	var out bytes.Buffer
+	s, err := contract.Start(path, svc.Dir, &out)
+	if err != nil {
+		r.err, r.log = err, out.String()
+		return r
+	}
+	defer s.Stop()
+	r.passed, r.failures, r.err = contract.Check(s, svc.Dir, cases, update)
+	return r
+}
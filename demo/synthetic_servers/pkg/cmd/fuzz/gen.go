@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"pkg/contract"
+)
+
+// operation is a route in a server's spec.
+type operation struct {
+	method string
+	path   string // With its parameters as {name}
+	params []map[string]any
+	body   map[string]any // Its JSON body's schema, if it takes one
+}
+
+func (op operation) String() string {
+	return strings.ToUpper(op.method) + " " + op.path
+}
+
+// methods are the methods fuzzed, in the order they are.
+var methods = []string{"get", "post", "put", "patch", "delete"}
+
+// operations returns the routes in a spec, in order of their paths, but
+// for event streams, which don't end.
+func operations(spec map[string]any) []operation {
+	paths, _ := spec["paths"].(map[string]any)
+	keys := make([]string, 0, len(paths))
+	for path := range paths {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+
+	var ops []operation
+	for _, path := range keys {
+		item, _ := paths[path].(map[string]any)
+		for _, method := range methods {
+			op, ok := item[method].(map[string]any)
+			if !ok || streams(op) {
+				continue
+			}
+			o := operation{method: method, path: path}
+			params, _ := op["parameters"].([]any)
+			for _, p := range params {
+				if p, ok := p.(map[string]any); ok {
+					o.params = append(o.params, p)
+				}
+			}
+			body, _ := op["requestBody"].(map[string]any)
+			content, _ := body["content"].(map[string]any)
+			media, _ := content["application/json"].(map[string]any)
+			o.body, _ = media["schema"].(map[string]any)
+			ops = append(ops, o)
+		}
+	}
+	return ops
+}
+
+func streams(op map[string]any) bool {
+	responses, _ := op["responses"].(map[string]any)
+	ok, _ := responses["200"].(map[string]any)
+	content, _ := ok["content"].(map[string]any)
+	_, found := content["text/event-stream"]
+	return found
+}
+
+// seedIDs returns the keys and IDs of the entities in a database's
+// collections, in order, for path parameters and fields that name one.
+func seedIDs(database string) ([]string, error) {
+	data, err := os.ReadFile(database)
+	if err != nil {
+		return nil, err
+	}
+	var db map[string]any
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	add := func(id any) {
+		if s, ok := id.(string); ok && s != "" {
+			seen[s] = true
+		}
+	}
+	for name, coll := range db {
+		if name == "auth" {
+			continue
+		}
+		switch coll := coll.(type) {
+		case map[string]any:
+			for key, entity := range coll {
+				add(key)
+				if e, ok := entity.(map[string]any); ok {
+					add(e["id"])
+				}
+			}
+		case []any:
+			for _, entity := range coll {
+				if e, ok := entity.(map[string]any); ok {
+					add(e["id"])
+				}
+			}
+		}
+	}
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// generator makes requests for a server's routes.
+type generator struct {
+	rnd   *rand.Rand
+	spec  map[string]any
+	ids   []string // Of the fixture's entities
+	token string   // The fixture's first user's
+	email string   // Whose token it is
+}
+
+// request is a request the generator made.
+type request struct {
+	method string
+	target string // Its path and query
+	auth   string // Its Authorization header, if any
+	header http.Header
+	body   []byte // nil for none
+}
+
+// String shows the request as the report quotes it.
+func (r request) String() string {
+	s := strings.ToUpper(r.method) + " " + shorten(r.target)
+	switch r.auth {
+	case "":
+		s += " (no token)"
+	case "Bearer tok_fuzz":
+		s += " (unknown token)"
+	}
+	if r.body != nil {
+		s += " " + shorten(string(r.body))
+	}
+	return s
+}
+
+// shorten cuts s down to the size of a line of the report.
+func shorten(s string) string {
+	if len(s) > 300 {
+		return s[:300] + "..."
+	}
+	return s
+}
+
+// send sends the request to s.
+func (r request) send(s *contract.Server) (int, any, error) {
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequest(strings.ToUpper(r.method), s.URL+r.target, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header = r.header.Clone()
+	if r.auth != "" {
+		req.Header.Set("Authorization", r.auth)
+	}
+	if r.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return s.Do(req)
+}
+
+// malformed are strings that no parameter or field expects.
+var malformed = []string{
+	"", " ", "-1", "0", "null", "true", "NaN", "1e309", "2024-13-45",
+	"../../etc/passwd", "%00", "\x00", "🙂", "'; DROP TABLE users;--",
+	"<script>alert(1)</script>", "{{id}}", strings.Repeat("a", 1000),
+}
+
+// words make up strings for fields that aren't IDs, emails or dates.
+var words = []string{"test", "Casey", "red", "large", "San Francisco", "premium", "A", "x1"}
+
+func (g *generator) pick(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[g.rnd.IntN(len(list))]
+}
+
+func (g *generator) chance(p float64) bool {
+	return g.rnd.Float64() < p
+}
+
+// request makes a request for op: its path parameters filled in, some of
+// its query parameters, its body and a token, each well formed or not.
+func (g *generator) request(op operation) request {
+	r := request{method: op.method, header: make(http.Header)}
+	path := op.path
+	query := url.Values{}
+	for _, p := range op.params {
+		name, _ := p["name"].(string)
+		schema, _ := p["schema"].(map[string]any)
+		switch p["in"] {
+		case "path":
+			v := g.pathValue(name)
+			path = strings.ReplaceAll(path, "{"+name+"}", url.PathEscape(v))
+		case "query":
+			if p["required"] == true || g.chance(0.5) {
+				query.Set(name, g.paramValue(name, schema))
+			}
+		case "header":
+			if v := g.paramValue(name, schema); g.chance(0.5) && !strings.ContainsFunc(v, unicode.IsControl) {
+				r.header.Set(name, v) // Those HTTP can carry
+			}
+		}
+	}
+	r.target = path
+	if len(query) > 0 {
+		r.target += "?" + query.Encode()
+	}
+
+	switch {
+	case g.token != "" && g.chance(0.85):
+		r.auth = "Bearer " + g.token
+	case g.chance(0.5):
+		r.auth = "Bearer tok_fuzz"
+	}
+
+	if op.body != nil {
+		r.body = g.body(op.body)
+	}
+	return r
+}
+
+func (g *generator) pathValue(name string) string {
+	switch {
+	case g.chance(0.25):
+		return g.pick(malformed[1:]) // Not empty, which routes elsewhere
+	case strings.Contains(strings.ToLower(name), "email"):
+		return g.email
+	default:
+		return g.pick(g.ids)
+	}
+}
+
+func (g *generator) paramValue(name string, schema map[string]any) string {
+	if g.chance(0.3) {
+		return g.pick(malformed)
+	}
+	v := g.scalar(name, g.resolve(schema))
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// body makes a request body from schema: usually JSON of a value of it
+// with some fields gone wrong, and sometimes none, a truncated or invalid
+// document, or the wrong kind of value altogether.
+func (g *generator) body(schema map[string]any) []byte {
+	valid, _ := json.Marshal(g.value("", schema, 0))
+	switch n := g.rnd.Float64(); {
+	case n < 0.05:
+		return []byte{}
+	case n < 0.10:
+		return valid[:len(valid)/2]
+	case n < 0.15:
+		return []byte("not json")
+	case n < 0.20:
+		return []byte(g.pick([]string{`[]`, `"x"`, `1`, `null`, `[{}]`, `{"":{}}`}))
+	default:
+		return valid
+	}
+}
+
+// resolve follows a schema's $ref into the spec's components.
+func (g *generator) resolve(schema map[string]any) map[string]any {
+	ref, ok := schema["$ref"].(string)
+	if !ok {
+		return schema
+	}
+	components, _ := g.spec["components"].(map[string]any)
+	schemas, _ := components["schemas"].(map[string]any)
+	resolved, _ := schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]any)
+	return resolved
+}
+
+// value makes a value of schema for the field name, or of the wrong type
+// now and then.
+func (g *generator) value(name string, schema map[string]any, depth int) any {
+	schema = g.resolve(schema)
+	if schema == nil || depth > 6 {
+		return nil
+	}
+	if depth > 0 && g.chance(0.1) {
+		return g.wrong(schema)
+	}
+	switch schema["type"] {
+	case "object":
+		obj := make(map[string]any)
+		props, _ := schema["properties"].(map[string]any)
+		keys := make([]string, 0, len(props))
+		for key := range props {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if g.chance(0.85) {
+				prop, _ := props[key].(map[string]any)
+				obj[key] = g.value(key, prop, depth+1)
+			}
+		}
+		if extra, ok := schema["additionalProperties"].(map[string]any); ok {
+			for range g.rnd.IntN(3) {
+				obj[g.pick(g.ids)] = g.value("", extra, depth+1)
+			}
+		}
+		if g.chance(0.1) {
+			obj["unexpected"] = g.pick(malformed)
+		}
+		return obj
+	case "array":
+		items, _ := schema["items"].(map[string]any)
+		list := make([]any, g.rnd.IntN(4))
+		for i := range list {
+			list[i] = g.value(name, items, depth+1)
+		}
+		return list
+	default:
+		return g.scalar(name, schema)
+	}
+}
+
+// scalar makes a string, number or boolean of schema for the field name.
+// Most are plausible, from its enum or the fixture's IDs, and the rest are
+// at the edges: negative, zero, huge or malformed.
+func (g *generator) scalar(name string, schema map[string]any) any {
+	if enum, ok := schema["enum"].([]any); ok && len(enum) > 0 && g.chance(0.8) {
+		return enum[g.rnd.IntN(len(enum))]
+	}
+	lower := strings.ToLower(name)
+	switch schema["type"] {
+	case "integer":
+		return []any{0, 1, 2, 5, 10, -1, -100, 1 << 31, int64(1)<<53 + 1, 999999999}[g.rnd.IntN(10)]
+	case "number":
+		return []any{0, 0.01, 1.5, 19.99, 100, -0.01, -50, 1e15, 1e308, 0.005}[g.rnd.IntN(10)]
+	case "boolean":
+		return g.chance(0.5)
+	}
+	if g.chance(0.2) {
+		return g.pick(malformed)
+	}
+	now := contract.DefaultClock.Add(time.Duration(g.rnd.IntN(24*60)-12*60) * time.Hour)
+	switch {
+	case schema["format"] == "email" || strings.Contains(lower, "email"):
+		return g.email
+	case schema["format"] == "date-time" || strings.HasSuffix(lower, "_at") || strings.Contains(lower, "time"):
+		return now.Format(time.RFC3339)
+	case schema["format"] == "date" || strings.Contains(lower, "date"):
+		return now.Format(time.DateOnly)
+	case lower == "id" || strings.HasSuffix(lower, "_id") || strings.HasSuffix(lower, "id"):
+		return g.pick(g.ids)
+	default:
+		return g.pick(words)
+	}
+}
+
+// wrong makes a value that isn't of schema's type.
+func (g *generator) wrong(schema map[string]any) any {
+	switch schema["type"] {
+	case "string":
+		return []any{42, -1, true, nil, []any{}, map[string]any{}}[g.rnd.IntN(6)]
+	case "integer", "number":
+		return []any{"12", "", "ten", nil, true, []any{1}}[g.rnd.IntN(6)]
+	case "boolean":
+		return []any{"yes", 1, nil}[g.rnd.IntN(3)]
+	case "array":
+		return []any{"x", 1, map[string]any{}, nil}[g.rnd.IntN(4)]
+	default:
+		return []any{"x", 1, []any{}, nil}[g.rnd.IntN(4)]
+	}
+}
+
+// fuzzRoute sends n requests to op, from a snapshot it then restores, and
+// records what went wrong in found. It returns how many it sent, and an
+// error if the server stopped answering.
+func fuzzRoute(s *contract.Server, g *generator, op operation, n int, found map[string]*problem) (int, error) {
+	status, snap, err := s.Admin("POST", "/admin/snapshots", nil)
+	if err != nil || status != http.StatusCreated {
+		return 0, fmt.Errorf("snapshot: status %d, %v", status, err)
+	}
+	id, _ := snap.(map[string]any)["id"].(string)
+	defer s.Admin("DELETE", "/admin/snapshots/"+id, nil)
+
+	sent := 0
+	for range n {
+		r := g.request(op)
+		status, body, err := r.send(s)
+		sent++
+		if err != nil {
+			return sent, fmt.Errorf("%s: %w", r, err)
+		}
+		if status >= http.StatusInternalServerError {
+			record(found, op, fmt.Sprintf("status %d: %s", status, errorMessage(body)), r.String())
+		}
+	}
+
+	status, diff, err := s.Admin("GET", "/admin/diff?since="+id, nil)
+	if err != nil || status != http.StatusOK {
+		return sent, fmt.Errorf("diff: status %d, %v", status, err)
+	}
+	for _, v := range violations(diff) {
+		record(found, op, v, "")
+	}
+	if status, _, err := s.Admin("POST", "/admin/snapshots/"+id+"/restore", nil); err != nil || status != http.StatusOK {
+		return sent, fmt.Errorf("restore: status %d, %v", status, err)
+	}
+	return sent, nil
+}
+
+// errorMessage returns the message of an error envelope.
+func errorMessage(body any) string {
+	envelope, _ := body.(map[string]any)
+	e, _ := envelope["error"].(map[string]any)
+	if msg, ok := e["message"].(string); ok {
+		return msg
+	}
+	return fmt.Sprint(body)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// problem is something a route did wrong, however many times.
+type problem struct {
+	route   string
+	what    string
+	example string // A request that did it, if one request did
+	times   int
+}
+
+func (p *problem) String() string {
+	s := p.route + ": " + p.what
+	if p.times > 1 {
+		s += fmt.Sprintf(" (%d times)", p.times)
+	}
+	if p.example != "" {
+		s += "\n\te.g. " + p.example
+	}
+	return s
+}
+
+// record adds a problem of op's to found, or counts it again.
+func record(found map[string]*problem, op operation, what, example string) {
+	key := op.String() + "\x00" + what
+	if p, ok := found[key]; ok {
+		p.times++
+		return
+	}
+	found[key] = &problem{route: op.String(), what: what, example: example, times: 1}
+}
+
+func sortedProblems(found map[string]*problem) []*problem {
+	problems := make([]*problem, 0, len(found))
+	for _, p := range found {
+		problems = append(problems, p)
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].route != problems[j].route {
+			return problems[i].route < problems[j].route
+		}
+		return problems[i].what < problems[j].what
+	})
+	return problems
+}
+
+// nonNegative are the last words of the names of fields no request should
+// take below zero, such as available_balance or stock_quantity.
+var nonNegative = map[string]bool{
+	"balance": true, "quantity": true, "qty": true, "stock": true,
+	"inventory": true, "points": true, "stars": true, "seats": true,
+	"credits": true, "count": true, "remaining": true, "capacity": true,
+	"available": true, "left": true,
+}
+
+func isNonNegative(name string) bool {
+	words := strings.Split(strings.ToLower(name), "_")
+	return nonNegative[words[len(words)-1]]
+}
+
+// violations returns the invariants the entities in an /admin/diff
+// response break: fields that should stay zero or more that are now
+// negative, having not been before. The numbers in a field such as
+// inventory, a map of them, count as its own.
+func violations(diff any) []string {
+	body, _ := diff.(map[string]any)
+	collections, _ := body["collections"].(map[string]any)
+	var found []string
+	report := func(path string, before any, after float64) {
+		if before == nil {
+			found = append(found, fmt.Sprintf("%s is %v", path, after))
+		} else {
+			found = append(found, fmt.Sprintf("%s went from %v to %v", path, before, after))
+		}
+	}
+	for name, c := range collections {
+		c, _ := c.(map[string]any)
+		created, _ := c["created"].([]any)
+		for i, entity := range created {
+			key := fmt.Sprint(i)
+			if e, ok := entity.(map[string]any); ok && e["id"] != nil {
+				key = fmt.Sprint(e["id"])
+			}
+			walk(name+"."+key, "", nil, entity, report)
+		}
+		updated, _ := c["updated"].([]any)
+		for _, u := range updated {
+			u, _ := u.(map[string]any)
+			walk(name+"."+fmt.Sprint(u["key"]), "", u["before"], u["after"], report)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// walk reports the numbers in after, at path, that are negative in fields
+// that shouldn't be, unless they were negative in before already.
+func walk(path, name string, before, after any, report func(path string, before any, after float64)) {
+	switch after := after.(type) {
+	case map[string]any:
+		old, _ := before.(map[string]any)
+		for key, v := range after {
+			child := key
+			if isNonNegative(name) {
+				child = name
+			}
+			walk(path+"."+key, child, old[key], v, report)
+		}
+	case []any:
+		old, _ := before.([]any)
+		for i, v := range after {
+			var was any
+			if i < len(old) {
+				was = old[i]
+			}
+			walk(fmt.Sprintf("%s[%d]", path, i), name, was, v, report)
+		}
+	case float64:
+		if after >= 0 || !isNonNegative(name) {
+			return
+		}
+		if was, ok := before.(float64); ok && was < 0 {
+			return
+		}
+		report(path, before, after)
+	}
+}
@@ -0,0 +1,306 @@
+// Command gateway puts every synthetic server behind one base URL, so an
+// agent needs only that. A request for /{service}/... goes to the service's
+// server, on its port from the servers' ports.json, with the service's
+// name taken off the path:
+//
+//	GET localhost:8080/amazon/api/v1/products -> GET localhost:8105/api/v1/products
+//
+// Start the servers first, for instance with runall, then run the gateway
+// from pkg:
+//
+//	go run ./cmd/gateway -servers ../v1 -keys agent=s3cret
+//
+// With -ports, it takes the servers' ports from another manifest, such as
+// the one runall's -ports-file writes when they run on free ports.
+//
+// GET / and /openapi.json serve every service's OpenAPI spec combined into
+// one, with each path under its service's prefix, and GET /registry lists
+// the services with their descriptions, versions, URLs through the gateway
+// and seed datasets. With -keys, every other
+// request must carry one of the keys in an X-API-Key header, which isn't
+// passed on; the servers' own Authorization is. Each request is logged as a
+// JSON line with its service, status, latency and client, and its
+// X-Request-ID is passed on so the server's log lines match.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"pkg/registry"
+	"pkg/server"
+)
+
+// Gateway headers.
+const (
+	HeaderAPIKey    = "X-API-Key"
+	HeaderRequestID = "X-Request-ID"
+)
+
+func main() {
+	dir := flag.String("servers", "../v1", "Directory of the servers to route to, with their ports in "+registry.Manifest)
+	addr := flag.String("addr", ":8080", "Address to listen on")
+	ports := flag.String("ports", "", "Ports manifest to take the servers' ports from instead, such as the one runall's -ports-file writes (default: the servers' own "+registry.Manifest+")")
+	host := flag.String("upstream-host", "localhost", "Host the servers run on")
+	keys := flag.String("keys", os.Getenv("GATEWAY_KEYS"), "Comma-separated API keys clients must send in X-API-Key, each optionally named as name=key for the logs; anyone may call if empty (default: $GATEWAY_KEYS)")
+	flag.Parse()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+
+	services, err := registry.Discover(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *ports != "" {
+		if err := registry.UsePorts(services, *ports); err != nil {
+			log.Fatalf("-ports: %v", err)
+		}
+	}
+	clients, err := parseKeys(*keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spec, err := combineSpecs(services, len(clients) > 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The entries' URLs are relative until a request says which host the
+	// gateway is reached at.
+	entries, errs := registry.Describe(services, func(svc registry.Service) string { return "/" + svc.Name })
+	for _, err := range errs {
+		log.Printf("Describing the services: %v", err)
+	}
+	g := &gateway{
+		proxies: make(map[string]*httputil.ReverseProxy),
+		clients: clients,
+		spec:    spec,
+		entries: entries,
+	}
+	for _, svc := range services {
+		g.proxies[svc.Name] = newProxy(svc, *host)
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: g}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	log.Printf("Gateway for %d services listening on %s", len(services), *addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// gateway routes requests to the servers by the service their path starts
+// with.
+type gateway struct {
+	proxies map[string]*httputil.ReverseProxy
+	clients map[string]string // API key -> client name; anyone may call if empty
+	spec    []byte
+	entries []registry.Entry
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := requestID(r.Header.Get(HeaderRequestID))
+	r.Header.Set(HeaderRequestID, id)
+	w.Header().Set(HeaderRequestID, id)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+	service, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	client := g.serve(rec, r, service)
+
+	level := slog.LevelInfo
+	if rec.status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", id),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", rec.status),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+	}
+	if _, ok := g.proxies[service]; ok {
+		attrs = append(attrs, slog.String("service", service))
+	}
+	if client != "" {
+		attrs = append(attrs, slog.String("client", client))
+	}
+	slog.LogAttrs(r.Context(), level, "request", attrs...)
+}
+
+// serve answers a request, returning the client it came from.
+func (g *gateway) serve(w http.ResponseWriter, r *http.Request, service string) string {
+	switch r.URL.Path {
+	case "/healthz":
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return ""
+	}
+
+	client, ok := g.authenticate(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, server.CodeUnauthorized, "missing or invalid "+HeaderAPIKey)
+		return ""
+	}
+	r.Header.Del(HeaderAPIKey)
+
+	switch r.URL.Path {
+	case "/", "/openapi.json":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(g.spec)
+		return client
+	case "/registry":
+		writeJSON(w, http.StatusOK, g.registry(r))
+		return client
+	}
+	proxy, ok := g.proxies[service]
+	if !ok {
+		writeError(w, http.StatusNotFound, server.CodeNotFound, fmt.Sprintf("no service %q; see /openapi.json for those there are", service))
+		return client
+	}
+	proxy.ServeHTTP(w, r)
+	return client
+}
+
+// registry returns the services' entries, with their URLs on the host the
+// request was made to.
+func (g *gateway) registry(r *http.Request) []registry.Entry {
+	base := "http://" + r.Host
+	if r.TLS != nil {
+		base = "https://" + r.Host
+	}
+	entries := make([]registry.Entry, len(g.entries))
+	for i, e := range g.entries {
+		e.URL, e.SpecURL = base+e.URL, base+e.SpecURL
+		entries[i] = e
+	}
+	return entries
+}
+
+// authenticate returns the name of the client whose key the request
+// carries, and whether the gateway lets it in.
+func (g *gateway) authenticate(r *http.Request) (string, bool) {
+	if len(g.clients) == 0 {
+		return "", true
+	}
+	got := r.Header.Get(HeaderAPIKey)
+	for key, name := range g.clients {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// parseKeys parses -keys: keys, each optionally named as name=key. An
+// unnamed key goes by its position, like client2.
+func parseKeys(s string) (map[string]string, error) {
+	clients := make(map[string]string)
+	if s == "" {
+		return clients, nil
+	}
+	for i, item := range strings.Split(s, ",") {
+		name, key, named := strings.Cut(strings.TrimSpace(item), "=")
+		if !named {
+			name, key = fmt.Sprintf("client%d", i+1), name
+		}
+		if key == "" || name == "" {
+			return nil, fmt.Errorf("-keys: %q: want a key, or a name and a key like agent=s3cret", item)
+		}
+		clients[key] = name
+	}
+	return clients, nil
+}
+
+// newProxy returns the proxy to a service's server, which takes the
+// service's name off the path and puts it back on redirects.
+func newProxy(svc registry.Service, host string) *httputil.ReverseProxy {
+	prefix := "/" + svc.Name
+	target := &url.URL{Scheme: "http", Host: fmt.Sprintf("%s:%d", host, svc.Port)}
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.URL.Path = strings.TrimPrefix(pr.In.URL.Path, prefix)
+			pr.Out.URL.RawPath = strings.TrimPrefix(pr.In.URL.RawPath, prefix)
+			if pr.Out.URL.Path == "" {
+				pr.Out.URL.Path = "/"
+			}
+			pr.SetXForwarded()
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Del(HeaderRequestID) // The gateway sets it
+			if loc := resp.Header.Get("Location"); strings.HasPrefix(loc, "/") {
+				resp.Header.Set("Location", prefix+loc)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Error("Proxying", "service", svc.Name, "request_id", r.Header.Get(HeaderRequestID), "error", err.Error())
+			writeError(w, http.StatusBadGateway, server.CodeUnavailable, fmt.Sprintf("%s is unavailable", svc.Name))
+		},
+	}
+}
+
+// requestID returns the ID a client sent, if it is reasonable, or a new
+// one, as the servers do.
+func requestID(sent string) string {
+	if sent != "" && len(sent) <= 128 && !strings.ContainsFunc(sent, func(r rune) bool { return r < ' ' || r > '~' }) {
+		return sent
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// writeError responds with an error in the envelope the servers answer
+// errors in.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]any{"error": map[string]string{
+		"code":       code,
+		"message":    message,
+		"request_id": w.Header().Get(HeaderRequestID),
+	}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// statusRecorder remembers the status a response was sent with, for the
+// log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets the proxy flush event streams through.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"pkg/registry"
+)
+
+// combineSpecs merges the services' OpenAPI specs into one for the
+// gateway. Each service's paths go under its prefix and its operations
+// under a tag named for it, and its components are renamed service.Name,
+// so that services' User schemas, say, don't collide. Security schemes are
+// shared. With keys set, every operation also requires the gateway's API
+// key.
+func combineSpecs(services []registry.Service, keys bool) ([]byte, error) {
+	paths := make(map[string]any)
+	components := map[string]map[string]any{"securitySchemes": {}}
+	var tags []any
+	for _, svc := range services {
+		spec, err := svc.Spec()
+		if err != nil {
+			return nil, err
+		}
+		if spec == nil {
+			log.Printf("%s has no OpenAPI spec; leaving it out of the combined one", svc.Name)
+			continue
+		}
+		renameRefs(spec, svc.Name)
+
+		tag := map[string]any{"name": svc.Name}
+		if info, ok := spec["info"].(map[string]any); ok {
+			title, _ := info["title"].(string)
+			if description, _ := info["description"].(string); description != "" {
+				title += ": " + description
+			}
+			tag["description"] = title
+		}
+		tags = append(tags, tag)
+
+		security, _ := spec["security"].([]any)
+		specPaths, _ := spec["paths"].(map[string]any)
+		for path, item := range specPaths {
+			ops, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			for method, op := range ops {
+				op, ok := op.(map[string]any)
+				if !ok || method == "parameters" {
+					continue
+				}
+				op["tags"] = append([]any{svc.Name}, sliceOf(op["tags"])...)
+				if id, ok := op["operationId"].(string); ok {
+					op["operationId"] = svc.Name + "." + id
+				}
+				if _, ok := op["security"]; !ok && security != nil {
+					op["security"] = security
+				}
+				if keys {
+					op["security"] = withAPIKey(sliceOf(op["security"]))
+				}
+			}
+			paths["/"+svc.Name+path] = ops
+		}
+
+		specComponents, _ := spec["components"].(map[string]any)
+		for kind, named := range specComponents {
+			named, ok := named.(map[string]any)
+			if !ok {
+				continue
+			}
+			if components[kind] == nil {
+				components[kind] = make(map[string]any)
+			}
+			for name, v := range named {
+				if kind == "securitySchemes" {
+					if _, ok := components[kind][name]; !ok {
+						components[kind][name] = v
+					}
+					continue
+				}
+				components[kind][svc.Name+"."+name] = v
+			}
+		}
+	}
+	if keys {
+		components["securitySchemes"]["apiKey"] = map[string]any{
+			"type":        "apiKey",
+			"in":          "header",
+			"name":        HeaderAPIKey,
+			"description": "The gateway's API key, on every request",
+		}
+	}
+
+	return json.MarshalIndent(map[string]any{
+		"openapi": "3.0.0",
+		"info": map[string]any{
+			"title":       "Synthetic APIs",
+			"version":     "1.0.0",
+			"description": "Every synthetic server behind one gateway. Each service's paths are under /{service}, as its tag names it.",
+		},
+		"tags":       tags,
+		"paths":      paths,
+		"components": components,
+	}, "", "  ")
+}
+
+// renameRefs points the component references in v at the components as
+// combineSpecs renames them for service.
+func renameRefs(v any, service string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, child := range v {
+			ref, ok := child.(string)
+			if key == "$ref" && ok && strings.HasPrefix(ref, "#/components/") {
+				kind, name, _ := strings.Cut(strings.TrimPrefix(ref, "#/components/"), "/")
+				v[key] = "#/components/" + kind + "/" + service + "." + name
+				continue
+			}
+			renameRefs(child, service)
+		}
+	case []any:
+		for _, child := range v {
+			renameRefs(child, service)
+		}
+	}
+}
+
+// withAPIKey adds the gateway's API key to each of an operation's security
+// requirements, or makes it the only one.
+func withAPIKey(security []any) []any {
+	if len(security) == 0 {
+		return []any{map[string]any{"apiKey": []any{}}}
+	}
+	out := make([]any, len(security))
+	for i, req := range security {
+		combined := map[string]any{"apiKey": []any{}}
+		if req, ok := req.(map[string]any); ok {
+			for name, scopes := range req {
+				combined[name] = scopes
+			}
+		}
+		out[i] = combined
+	}
+	return out
+}
+
+func sliceOf(v any) []any {
+	s, _ := v.([]any)
+	return s
+}
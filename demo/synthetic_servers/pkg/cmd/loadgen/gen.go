@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// seedData is what the requests are filled in from: the keys and IDs of
+// the seed's entities, by collection, and the strings in their fields, by
+// field name, such as the products' names and categories.
+type seedData struct {
+	ids    map[string][]string
+	all    []string // Every collection's
+	values map[string][]string
+}
+
+func loadSeed(database string) (*seedData, error) {
+	data, err := os.ReadFile(database)
+	if err != nil {
+		return nil, err
+	}
+	var db map[string]any
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("%s: %w", database, err)
+	}
+	s := &seedData{ids: make(map[string][]string), values: make(map[string][]string)}
+	seen := make(map[string]bool)
+	add := func(coll string, entity any, key string) {
+		e, _ := entity.(map[string]any)
+		if id, ok := e["id"].(string); ok && id != "" {
+			key = id
+		}
+		if key != "" {
+			s.ids[coll] = append(s.ids[coll], key)
+			s.all = append(s.all, key)
+		}
+		for field, v := range e {
+			if v, ok := v.(string); ok && v != "" && len(v) <= 100 && !seen[field+"\x00"+v] {
+				seen[field+"\x00"+v] = true
+				s.values[field] = append(s.values[field], v)
+			}
+		}
+	}
+	for name, coll := range db {
+		if name == "auth" {
+			continue
+		}
+		switch coll := coll.(type) {
+		case map[string]any:
+			for key, entity := range coll {
+				add(name, entity, key)
+			}
+		case []any:
+			for _, entity := range coll {
+				add(name, entity, "")
+			}
+		}
+	}
+	// In order, so that the same -seed sends the same requests.
+	for _, ids := range s.ids {
+		sort.Strings(ids)
+	}
+	for _, values := range s.values {
+		sort.Strings(values)
+	}
+	sort.Strings(s.all)
+	return s, nil
+}
+
+// collectionIDs returns the IDs of the collection a parameter or field
+// names an entity of: for accountId or account_id, accounts, and for the
+// {id} in /products/{id}, products, the segment before it.
+func (s *seedData) collectionIDs(name, segment string) []string {
+	base := strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "Id"), "_id"), "ID"))
+	for _, coll := range []string{base + "s", base + "es", strings.TrimSuffix(base, "y") + "ies", base, segment} {
+		if ids := s.ids[coll]; len(ids) > 0 {
+			return ids
+		}
+	}
+	return s.all
+}
+
+// searchParams are the names of query parameters that take search terms.
+var searchParams = map[string]bool{"q": true, "query": true, "search": true, "keyword": true, "keywords": true, "term": true, "text": true}
+
+// searchFields are the fields whose words make search terms.
+var searchFields = []string{"name", "title", "category", "brand", "city", "cuisine", "genre"}
+
+// words are search terms and strings for servers whose seeds have none to
+// offer.
+var words = []string{"red", "large", "premium", "San Francisco", "organic", "classic"}
+
+// generator makes requests for a server's routes.
+type generator struct {
+	rnd   *rand.Rand
+	spec  map[string]any
+	seed  *seedData
+	email string // The token's user's
+}
+
+// request is a request the generator made.
+type request struct {
+	method string
+	target string // Its path and query
+	body   []byte // nil for none
+}
+
+func (g *generator) pick(list []string) string {
+	if len(list) == 0 {
+		return g.pick(words)
+	}
+	return list[g.rnd.IntN(len(list))]
+}
+
+func (g *generator) chance(p float64) bool {
+	return g.rnd.Float64() < p
+}
+
+// request makes a request for op as a shopper would send it: its path
+// parameters naming the seed's entities, a search term if it takes one,
+// its required query parameters and some of the others, and a body of the
+// shape its schema gives.
+func (g *generator) request(op operation) request {
+	r := request{method: op.method}
+	path := op.path
+	query := url.Values{}
+	for _, p := range op.params {
+		name, _ := p["name"].(string)
+		schema, _ := p["schema"].(map[string]any)
+		switch p["in"] {
+		case "path":
+			segment := ""
+			if before, _, ok := strings.Cut(path, "/{"+name+"}"); ok {
+				segment = before[strings.LastIndex(before, "/")+1:]
+			}
+			path = strings.ReplaceAll(path, "{"+name+"}", url.PathEscape(g.pick(g.seed.collectionIDs(name, segment))))
+		case "query":
+			switch {
+			case searchParams[strings.ToLower(name)]:
+				query.Set(name, g.searchTerm())
+			case strings.Contains(strings.ToLower(name), "email"):
+				query.Set(name, g.email)
+			case p["required"] == true:
+				query.Set(name, fmt.Sprint(g.value(name, schema, 0)))
+			case len(g.seed.values[name]) > 0 && g.chance(0.3):
+				query.Set(name, g.pick(g.seed.values[name])) // A filter, such as category
+			}
+		}
+	}
+	r.target = path
+	if len(query) > 0 {
+		r.target += "?" + query.Encode()
+	}
+	if op.body != nil {
+		r.body, _ = json.Marshal(g.value("", op.body, 0))
+	}
+	return r
+}
+
+// searchTerm returns a word from a name, title or the like in the seed.
+func (g *generator) searchTerm() string {
+	var terms []string
+	for _, field := range searchFields {
+		terms = append(terms, g.seed.values[field]...)
+	}
+	fields := strings.Fields(g.pick(terms))
+	if len(fields) == 0 {
+		return g.pick(words)
+	}
+	return fields[g.rnd.IntN(len(fields))]
+}
+
+// resolve follows a schema's $ref into the spec's components.
+func (g *generator) resolve(schema map[string]any) map[string]any {
+	ref, ok := schema["$ref"].(string)
+	if !ok {
+		return schema
+	}
+	components, _ := g.spec["components"].(map[string]any)
+	schemas, _ := components["schemas"].(map[string]any)
+	resolved, _ := schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]any)
+	return resolved
+}
+
+// value makes a plausible value of schema for the field name: its
+// required fields and most of the others, IDs of the seed's entities,
+// small quantities and dates in the coming weeks.
+func (g *generator) value(name string, schema map[string]any, depth int) any {
+	schema = g.resolve(schema)
+	if schema == nil || depth > 6 {
+		return nil
+	}
+	if enum, ok := schema["enum"].([]any); ok && len(enum) > 0 {
+		return enum[g.rnd.IntN(len(enum))]
+	}
+	lower := strings.ToLower(name)
+	switch schema["type"] {
+	case "object":
+		obj := make(map[string]any)
+		props, _ := schema["properties"].(map[string]any)
+		required := make(map[string]bool)
+		list, _ := schema["required"].([]any)
+		for _, key := range list {
+			if key, ok := key.(string); ok {
+				required[key] = true
+			}
+		}
+		keys := make([]string, 0, len(props))
+		for key := range props {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if required[key] || g.chance(0.8) {
+				prop, _ := props[key].(map[string]any)
+				obj[key] = g.value(key, prop, depth+1)
+			}
+		}
+		return obj
+	case "array":
+		items, _ := schema["items"].(map[string]any)
+		list := make([]any, 1+g.rnd.IntN(2))
+		for i := range list {
+			list[i] = g.value(name, items, depth+1)
+		}
+		return list
+	case "integer":
+		return 1 + g.rnd.IntN(3)
+	case "number":
+		return float64(5+g.rnd.IntN(96)) - 0.01
+	case "boolean":
+		return g.chance(0.5)
+	}
+	soon := time.Now().Add(time.Duration(1+g.rnd.IntN(30)) * 24 * time.Hour)
+	switch {
+	case schema["format"] == "email" || strings.Contains(lower, "email"):
+		return g.email
+	case schema["format"] == "date-time" || strings.HasSuffix(lower, "_at") || strings.Contains(lower, "time"):
+		return soon.Format(time.RFC3339)
+	case schema["format"] == "date" || strings.Contains(lower, "date"):
+		return soon.Format(time.DateOnly)
+	case lower == "id" || strings.HasSuffix(lower, "_id") || strings.HasSuffix(name, "Id"):
+		return g.pick(g.seed.collectionIDs(name, ""))
+	default:
+		return g.pick(g.seed.values[name])
+	}
+}
+
+// send sends the request to the server at url and returns the status of
+// its response, having read it through.
+func (r request) send(client *http.Client, url, auth string) (int, error) {
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequest(strings.ToUpper(r.method), url+r.target, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", auth)
+	if r.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,195 @@
+// Command loadgen drives a running synthetic server with a steady mix of
+// traffic, as shoppers would send it, and reports how fast it answered.
+// Start the server, for instance with runall, then run it from pkg:
+//
+//	go run ./cmd/runall -- --admin-token secret
+//	go run ./cmd/loadgen -service amazon -rps 200 -duration 30s
+//	go run ./cmd/loadgen -service hilton -mix search=3,checkout=1 -c 64
+//
+// The traffic comes from the server's OpenAPI spec and seed: searches and
+// lists, reads of single entities, changes to the cart and checkouts, such
+// as orders and bookings, each filled in with the seed's IDs, names and
+// categories and sent as the seed's first user. -mix weighs the kinds
+// against each other; kinds the server has no routes for are left out.
+//
+// Requests go out at -rps whether or not earlier ones have been answered,
+// so a server that slows down falls behind rather than being given more
+// time, up to -c requests in flight; those that would go beyond it are
+// dropped and counted. At the end it prints the latency percentiles of
+// each kind of request and of the slowest routes, and exits with status 1
+// if any request failed or got a 5xx, or, with -p99, if a kind's 99th
+// percentile was slower than that.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"pkg/contract"
+	"pkg/registry"
+)
+
+func main() {
+	dir := flag.String("servers", "../v1", "Directory of servers, with their ports in "+registry.Manifest)
+	ports := flag.String("ports", "", "Ports manifest to take the servers' ports from instead, such as the one runall's -ports-file writes (default: the servers' own "+registry.Manifest+")")
+	name := flag.String("service", "", "The service to load")
+	url := flag.String("url", "", "Base URL of the server, instead of its port from "+registry.Manifest)
+	token := flag.String("token", "", "Bearer token to send, instead of the seed's first")
+	rps := flag.Float64("rps", 50, "Requests to send a second")
+	duration := flag.Duration("duration", 30*time.Second, "How long to send them for")
+	inflight := flag.Int("c", 256, "Requests in flight at most; more are dropped")
+	mixFlag := flag.String("mix", defaultMix, "Weights of the kinds of request, as kind=weight,...")
+	seed := flag.Uint64("seed", 1, "Seed for the requests; the same seed sends the same ones")
+	p99 := flag.Duration("p99", 0, "Fail if a kind's 99th percentile latency is above this")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("loadgen: ")
+
+	if *name == "" {
+		log.Fatal("-service is required")
+	}
+	if *rps <= 0 || *inflight < 1 {
+		log.Fatal("-rps and -c must be positive")
+	}
+	weights, err := parseMix(*mixFlag)
+	if err != nil {
+		log.Fatalf("-mix: %v", err)
+	}
+	services, err := registry.Discover(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *ports != "" {
+		if err := registry.UsePorts(services, *ports); err != nil {
+			log.Fatalf("-ports: %v", err)
+		}
+	}
+	svc, ok := registry.Find(services, *name)
+	if !ok {
+		log.Fatalf("-service: no server %q in %s", *name, *dir)
+	}
+	if *url == "" {
+		*url = fmt.Sprintf("http://localhost:%d", svc.Port)
+	}
+	*url = strings.TrimSuffix(*url, "/")
+
+	spec, err := svc.Spec()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if spec == nil {
+		log.Fatalf("%s has no OpenAPI spec", svc.Name)
+	}
+	seedFile := filepath.Join(svc.Dir, registry.SeedFile)
+	first, email, err := contract.FirstToken(seedFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *token == "" {
+		*token = first
+	}
+	data, err := loadSeed(seedFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mix := newMix(routes(spec), weights)
+	if len(mix.kinds) == 0 {
+		log.Fatalf("%s has no routes for %s", svc.Name, *mixFlag)
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConns:        *inflight,
+			MaxIdleConnsPerHost: *inflight,
+		},
+	}
+	resp, err := client.Get(*url + "/healthz")
+	if err != nil {
+		log.Fatalf("%s isn't up at %s: %v", svc.Name, *url, err)
+	}
+	resp.Body.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	g := &generator{
+		rnd:   rand.New(rand.NewPCG(*seed, 0)),
+		spec:  spec,
+		seed:  data,
+		email: email,
+	}
+	fmt.Printf("%s at %s: %g requests/s for %s, %s\n", svc.Name, *url, *rps, *duration, mix)
+	s := drive(ctx, client, *url, "Bearer "+*token, g, mix, *rps, *duration, *inflight)
+	s.report(os.Stdout)
+
+	if s.failed() {
+		os.Exit(1)
+	}
+	if *p99 > 0 {
+		if slow := s.slowerThan(*p99); len(slow) > 0 {
+			fmt.Printf("99th percentile above %s: %s\n", *p99, strings.Join(slow, ", "))
+			os.Exit(1)
+		}
+	}
+	if ctx.Err() != nil {
+		os.Exit(1)
+	}
+}
+
+// drive sends requests at rps for d, or until ctx is done, and waits for
+// those in flight.
+func drive(ctx context.Context, client *http.Client, url, auth string, g *generator, mix *mix, rps float64, d time.Duration, inflight int) *stats {
+	s := &stats{}
+	sem := make(chan struct{}, inflight)
+	var wg sync.WaitGroup
+	interval := time.Duration(float64(time.Second) / rps)
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+loop:
+	for i := 0; ; i++ {
+		at := start.Add(time.Duration(i) * interval)
+		if at.Sub(start) >= d {
+			break
+		}
+		timer.Reset(time.Until(at))
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-timer.C:
+		}
+
+		kind, op := mix.pick(g.rnd)
+		r := g.request(op)
+		select {
+		case sem <- struct{}{}:
+		default:
+			s.drop()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			began := time.Now()
+			status, err := r.send(client, url, auth)
+			s.add(sample{kind: kind, route: op.String(), latency: time.Since(began), status: status, err: err})
+		}()
+	}
+	s.elapsed = time.Since(start)
+	wg.Wait()
+	return s
+}
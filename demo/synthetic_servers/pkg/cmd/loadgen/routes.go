@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The kinds of request, in the order they are reported.
+var kinds = []string{"search", "browse", "cart", "checkout"}
+
+// defaultMix is how often each kind of request is sent, as a shopper
+// would: mostly looking, now and then buying.
+const defaultMix = "search=50,browse=25,cart=15,checkout=10"
+
+// operation is a route in a server's spec.
+type operation struct {
+	method string
+	path   string // With its parameters as {name}
+	params []map[string]any
+	body   map[string]any // Its JSON body's schema, if it takes one
+}
+
+func (op operation) String() string {
+	return strings.ToUpper(op.method) + " " + op.path
+}
+
+// skipped are the parts of paths whose routes aren't shoppers' traffic:
+// signing in and out, which would end the session, and the plumbing every
+// server has.
+var skipped = []string{"/auth", "/admin", "/events", "/webhooks", "/batch", "/graphql"}
+
+// carts and checkouts are the parts of paths whose routes fill a cart, and
+// whose POSTs buy something.
+var (
+	carts     = []string{"cart", "basket", "bag"}
+	checkouts = []string{"checkout", "order", "book", "reserv", "purchase", "pay", "transfer", "ride", "appointment", "enroll", "subscri", "trip"}
+)
+
+// routes returns the routes in a spec by the kind of request they take,
+// each in order of their paths.
+func routes(spec map[string]any) map[string][]operation {
+	paths, _ := spec["paths"].(map[string]any)
+	keys := make([]string, 0, len(paths))
+	for path := range paths {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+
+	byKind := make(map[string][]operation)
+	for _, path := range keys {
+		if containsAny(path, skipped) {
+			continue
+		}
+		item, _ := paths[path].(map[string]any)
+		for _, method := range []string{"get", "post", "put", "patch", "delete"} {
+			op, ok := item[method].(map[string]any)
+			if !ok || streams(op) {
+				continue
+			}
+			o := operation{method: method, path: path}
+			params, _ := op["parameters"].([]any)
+			for _, p := range params {
+				if p, ok := p.(map[string]any); ok {
+					o.params = append(o.params, p)
+				}
+			}
+			body, _ := op["requestBody"].(map[string]any)
+			content, _ := body["content"].(map[string]any)
+			media, _ := content["application/json"].(map[string]any)
+			o.body, _ = media["schema"].(map[string]any)
+			if kind := kindOf(o); kind != "" {
+				byKind[kind] = append(byKind[kind], o)
+			}
+		}
+	}
+	return byKind
+}
+
+// kindOf returns the kind of request op takes, or "" if it isn't one
+// loadgen sends.
+func kindOf(op operation) string {
+	path := strings.ToLower(op.path)
+	switch {
+	case containsAny(path, carts):
+		return "cart"
+	case op.method == "post" && containsAny(path, checkouts):
+		return "checkout"
+	case op.method != "get":
+		return ""
+	case strings.Contains(path, "{"):
+		return "browse"
+	default:
+		return "search"
+	}
+}
+
+func containsAny(s string, parts []string) bool {
+	for _, part := range parts {
+		if strings.Contains(s, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func streams(op map[string]any) bool {
+	responses, _ := op["responses"].(map[string]any)
+	ok, _ := responses["200"].(map[string]any)
+	content, _ := ok["content"].(map[string]any)
+	_, found := content["text/event-stream"]
+	return found
+}
+
+// parseMix parses -mix: weights by kind.
+func parseMix(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		kind, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't kind=weight", part)
+		}
+		if !slices.Contains(kinds, kind) {
+			return nil, fmt.Errorf("no kind of request %q; there are %s", kind, strings.Join(kinds, ", "))
+		}
+		n, err := strconv.Atoi(weight)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s: weight %q isn't a whole number", kind, weight)
+		}
+		weights[kind] = n
+	}
+	return weights, nil
+}
+
+// mix picks requests' routes: a kind by its weight, then one of its
+// routes.
+type mix struct {
+	kinds   []string // Those with routes and weight, in order
+	weights []int
+	total   int
+	routes  map[string][]operation
+}
+
+func newMix(routes map[string][]operation, weights map[string]int) *mix {
+	m := &mix{routes: routes}
+	for _, kind := range kinds {
+		if weights[kind] > 0 && len(routes[kind]) > 0 {
+			m.kinds = append(m.kinds, kind)
+			m.weights = append(m.weights, weights[kind])
+			m.total += weights[kind]
+		}
+	}
+	return m
+}
+
+func (m *mix) pick(rnd *rand.Rand) (string, operation) {
+	n := rnd.IntN(m.total)
+	for i, kind := range m.kinds {
+		if n < m.weights[i] {
+			ops := m.routes[kind]
+			return kind, ops[rnd.IntN(len(ops))]
+		}
+		n -= m.weights[i]
+	}
+	panic("unreachable")
+}
+
+// String describes the mix, as the share and number of routes of each
+// kind.
+func (m *mix) String() string {
+	parts := make([]string, len(m.kinds))
+	for i, kind := range m.kinds {
+		parts[i] = fmt.Sprintf("%s %.0f%% (%d routes)", kind, 100*float64(m.weights[i])/float64(m.total), len(m.routes[kind]))
+	}
+	return strings.Join(parts, ", ")
+}
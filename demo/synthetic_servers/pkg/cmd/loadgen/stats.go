@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// slowestRoutes is how many routes the report lists, slowest first.
+const slowestRoutes = 5
+
+// sample is how one request went.
+type sample struct {
+	kind    string
+	route   string
+	latency time.Duration
+	status  int   // 0 if it got no response
+	err     error // Why it didn't
+}
+
+// stats collects the samples of a run.
+type stats struct {
+	mu      sync.Mutex
+	samples []sample
+	dropped int
+	elapsed time.Duration // Sending the requests, not waiting for the last
+}
+
+func (s *stats) add(x sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, x)
+}
+
+func (s *stats) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped++
+}
+
+// summary is the latencies and outcomes of a group of requests.
+type summary struct {
+	name      string
+	latencies []time.Duration // Sorted
+	clientErr int             // 4xx
+	serverErr int             // 5xx, or no response
+	failure   string          // The first request's to fail, if one did
+}
+
+func (s *summary) add(x sample) {
+	s.latencies = append(s.latencies, x.latency)
+	switch {
+	case x.err != nil || x.status >= 500:
+		s.serverErr++
+		switch {
+		case s.failure != "":
+		case x.err != nil:
+			s.failure = fmt.Sprintf("%s: %v", x.route, x.err)
+		default:
+			s.failure = fmt.Sprintf("%s: status %d", x.route, x.status)
+		}
+	case x.status >= 400:
+		s.clientErr++
+	}
+}
+
+// percentile returns the latency p of the requests took at most, by the
+// nearest rank.
+func (s *summary) percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(s.latencies))+0.5) - 1
+	return s.latencies[min(max(i, 0), len(s.latencies)-1)]
+}
+
+// summarize groups the samples by key, in the order the keys first come
+// up, along with a group of them all.
+func (s *stats) summarize(key func(sample) string) (groups []*summary, all *summary) {
+	byKey := make(map[string]*summary)
+	all = &summary{name: "all"}
+	for _, x := range s.samples {
+		k := key(x)
+		if byKey[k] == nil {
+			byKey[k] = &summary{name: k}
+			groups = append(groups, byKey[k])
+		}
+		byKey[k].add(x)
+		all.add(x)
+	}
+	for _, g := range append(groups, all) {
+		slices.Sort(g.latencies)
+	}
+	return groups, all
+}
+
+// report prints the run's throughput and the latencies of each kind of
+// request and of the slowest routes.
+func (s *stats) report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kindGroups, all := s.summarize(func(x sample) string { return x.kind })
+	sort.Slice(kindGroups, func(i, j int) bool {
+		return slices.Index(kinds, kindGroups[i].name) < slices.Index(kinds, kindGroups[j].name)
+	})
+	routeGroups, _ := s.summarize(func(x sample) string { return x.route })
+	sort.Slice(routeGroups, func(i, j int) bool {
+		if a, b := routeGroups[i].percentile(0.99), routeGroups[j].percentile(0.99); a != b {
+			return a > b
+		}
+		return routeGroups[i].name < routeGroups[j].name
+	})
+
+	rate := 0.0
+	if s.elapsed > 0 {
+		rate = float64(len(s.samples)) / s.elapsed.Seconds()
+	}
+	fmt.Fprintf(w, "%d requests in %s, %.1f/s, %d dropped\n\n", len(s.samples), s.elapsed.Round(time.Millisecond), rate, s.dropped)
+
+	table(w, "", append(kindGroups, all))
+	fmt.Fprintln(w)
+	table(w, "slowest routes", routeGroups[:min(slowestRoutes, len(routeGroups))])
+
+	for _, g := range kindGroups {
+		if g.failure != "" {
+			fmt.Fprintf(w, "\nfirst %s failure: %s\n", g.name, g.failure)
+		}
+	}
+}
+
+// table prints a row for each group under a header naming them title.
+func table(w io.Writer, title string, groups []*summary) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\trequests\t4xx\t5xx\tp50\tp90\tp99\tmax\n", title)
+	for _, g := range groups {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n", g.name, len(g.latencies), g.clientErr, g.serverErr,
+			ms(g.percentile(0.5)), ms(g.percentile(0.9)), ms(g.percentile(0.99)), ms(g.percentile(1)))
+	}
+	tw.Flush()
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
+
+// failed reports whether any request failed or got a 5xx.
+func (s *stats) failed() bool {
+	for _, x := range s.samples {
+		if x.err != nil || x.status >= 500 {
+			return true
+		}
+	}
+	return false
+}
+
+// slowerThan returns the kinds of request whose 99th percentile latency
+// was above limit.
+func (s *stats) slowerThan(limit time.Duration) []string {
+	groups, _ := s.summarize(func(x sample) string { return x.kind })
+	var slow []string
+	for _, g := range groups {
+		if p := g.percentile(0.99); p > limit {
+			slow = append(slow, fmt.Sprintf("%s (%s)", g.name, ms(p)))
+		}
+	}
+	sort.Strings(slow)
+	return slow
+}
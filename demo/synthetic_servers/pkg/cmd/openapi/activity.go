@@ -0,0 +1,45 @@
+package main
+
+// activityRoutes describes the activity log pkg/server serves for every
+// server's database.
+func (s *source) activityRoutes() []route {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	fields := func(description string) *Schema {
+		return &Schema{Type: "object", Description: description, AdditionalProperties: &Schema{}}
+	}
+	s.schemas["ActivityEntry"] = &Schema{
+		Type:        "object",
+		Description: "One change to an entity in the audit trail.",
+		Properties: map[string]*Schema{
+			"id":         {Type: "integer"},
+			"timestamp":  {Type: "string", Format: "date-time"},
+			"actor":      {Type: "string", Description: "The user whose request made the change; absent for background changes"},
+			"action":     {Type: "string", Enum: []string{"created", "updated", "deleted"}},
+			"collection": str(),
+			"entity_id":  str(),
+			"owner":      {Type: "string", Description: "The user the entity belongs to"},
+			"summary":    str(),
+			"before":     fields("The fields an update changed, as they were, or the deleted entity"),
+			"after":      fields("The fields an update changed, as they are, or the created entity"),
+		},
+	}
+	params := []Parameter{
+		{Name: "collection", In: "query", Description: "Only changes to this collection", Schema: str()},
+		{Name: "action", In: "query", Description: "Only this kind of change", Schema: &Schema{Type: "string", Enum: []string{"created", "updated", "deleted"}}},
+		{Name: "actor", In: "query", Description: "Only changes this user made; admins only", Schema: str()},
+		{Name: "owner", In: "query", Description: "Only changes to this user's entities; admins only", Schema: str()},
+	}
+	return []route{
+		{method: "get", path: "/api/v1/activity", operation: &Operation{
+			Summary:     "List your activity: the changes you made and those to your entities, newest first",
+			Description: "Admins see everyone's, and can filter by actor or owner.",
+			Parameters:  append(params, listParams...),
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(pageSchema(&Schema{Ref: "#/components/schemas/ActivityEntry"}))},
+				"400": {Description: statusText(400), Content: jsonContent(errorSchema)},
+				"401": {Description: statusText(401), Content: jsonContent(errorSchema)},
+				"403": {Description: statusText(403), Content: jsonContent(errorSchema)},
+			},
+		}},
+	}
+}
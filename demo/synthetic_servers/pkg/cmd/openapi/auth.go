@@ -0,0 +1,82 @@
+package main
+
+// authRoutes describes the routes pkg/server serves for servers whose
+// Database embeds server.Auth.
+func (s *source) authRoutes() []route {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	dateTime := func() *Schema { return &Schema{Type: "string", Format: "date-time"} }
+	s.schemas["AuthSession"] = &Schema{
+		Type:        "object",
+		Description: "A login session.",
+		Properties: map[string]*Schema{
+			"token_type":         str(),
+			"access_token":       str(),
+			"expires_at":         dateTime(),
+			"refresh_token":      str(),
+			"refresh_expires_at": dateTime(),
+		},
+	}
+	s.schemas["AuthUser"] = &Schema{
+		Type:        "object",
+		Description: "An authenticated user.",
+		Properties: map[string]*Schema{
+			"email":      str(),
+			"name":       str(),
+			"role":       str(),
+			"created_at": dateTime(),
+		},
+	}
+	ref := func(name string) *Schema { return &Schema{Ref: "#/components/schemas/" + name} }
+	object := func(props ...string) *Schema {
+		o := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		for _, p := range props {
+			o.Properties[p] = str()
+		}
+		return o
+	}
+	body := func(s *Schema) *RequestBody { return &RequestBody{Required: true, Content: jsonContent(s)} }
+	ok := func(s *Schema) Response { return Response{Description: "Success", Content: jsonContent(s)} }
+	fail := func(status int) Response {
+		return Response{Description: statusText(status), Content: jsonContent(errorSchema)}
+	}
+	public := []map[string][]string{}
+	private := []map[string][]string{{bearerAuth: {}}}
+
+	return []route{
+		{method: "post", path: "/api/v1/auth/register", operation: &Operation{
+			Summary:     "Register a user and start a session",
+			Security:    public,
+			RequestBody: body(object("email", "password", "name")),
+			Responses: map[string]Response{
+				"201": ok(&Schema{Type: "object", Properties: map[string]*Schema{
+					"user":    ref("AuthUser"),
+					"session": ref("AuthSession"),
+				}}),
+				"400": fail(400),
+				"409": fail(409),
+			},
+		}},
+		{method: "post", path: "/api/v1/auth/login", operation: &Operation{
+			Summary:     "Log in with email and password",
+			Security:    public,
+			RequestBody: body(object("email", "password")),
+			Responses:   map[string]Response{"200": ok(ref("AuthSession")), "401": fail(401)},
+		}},
+		{method: "post", path: "/api/v1/auth/refresh", operation: &Operation{
+			Summary:     "Trade a refresh token for a new session",
+			Security:    public,
+			RequestBody: body(object("refresh_token")),
+			Responses:   map[string]Response{"200": ok(ref("AuthSession")), "401": fail(401)},
+		}},
+		{method: "post", path: "/api/v1/auth/logout", operation: &Operation{
+			Summary:   "Revoke the current session",
+			Security:  private,
+			Responses: map[string]Response{"204": {Description: "Success"}, "401": fail(401)},
+		}},
+		{method: "get", path: "/api/v1/me", operation: &Operation{
+			Summary:   "Get the authenticated user",
+			Security:  private,
+			Responses: map[string]Response{"200": ok(ref("AuthUser")), "401": fail(401)},
+		}},
+	}
+}
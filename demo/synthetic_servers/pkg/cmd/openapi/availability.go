@@ -0,0 +1,32 @@
+package main
+
+// availabilitySchema refers to the schema of the pkg/availability type
+// name, adding it to the components as Slot or SlotOpening.
+func (s *source) availabilitySchema(name string) *Schema {
+	dateTime := func() *Schema { return &Schema{Type: "string", Format: "date-time"} }
+	ref := func(name string) *Schema { return &Schema{Ref: "#/components/schemas/" + name} }
+	switch name {
+	case "Slot":
+		s.schemas["Slot"] = &Schema{
+			Type:        "object",
+			Description: "A stretch of a schedule that can be booked, such as a delivery window or an interview.",
+			Properties: map[string]*Schema{
+				"start": dateTime(),
+				"end":   dateTime(),
+			},
+		}
+		return ref("Slot")
+	case "Opening":
+		s.schemas["SlotOpening"] = &Schema{
+			Type:        "object",
+			Description: "A slot with room left.",
+			Properties: map[string]*Schema{
+				"start":     dateTime(),
+				"end":       dateTime(),
+				"remaining": {Type: "integer", Description: "How many more bookings it takes"},
+			},
+		}
+		return ref("SlotOpening")
+	}
+	return &Schema{}
+}
@@ -0,0 +1,51 @@
+package main
+
+// batchRoutes describes the batch endpoint pkg/server serves for every
+// server's database.
+func (s *source) batchRoutes() []route {
+	s.schemas["BatchOperation"] = &Schema{
+		Type:        "object",
+		Description: "One API request in a batch, sent with the batch's headers.",
+		Required:    []string{"method", "path"},
+		Properties: map[string]*Schema{
+			"method": {Type: "string", Enum: []string{"GET", "POST", "PUT", "PATCH", "DELETE"}},
+			"path":   {Type: "string", Description: "A path under /api/, with any query, such as /api/v1/orders?status=pending"},
+			"body":   {Description: "The request's JSON body"},
+		},
+	}
+	s.schemas["BatchResult"] = &Schema{
+		Type:        "object",
+		Description: "An operation's response.",
+		Properties: map[string]*Schema{
+			"status": {Type: "integer"},
+			"body":   {Description: "The response's JSON body, or a string if it isn't JSON"},
+		},
+	}
+	return []route{
+		{method: "post", path: "/api/v1/batch", operation: &Operation{
+			Summary:     "Send a batch of API requests, carried out in order",
+			Description: "An atomic batch, the default, runs with the database to itself and is undone whole if an operation fails, in which case the operations after it aren't carried out. A batch that isn't atomic carries out every operation on its own.",
+			RequestBody: &RequestBody{Required: true, Content: jsonContent(&Schema{
+				Type:     "object",
+				Required: []string{"operations"},
+				Properties: map[string]*Schema{
+					"operations": {Type: "array", Items: &Schema{Ref: "#/components/schemas/BatchOperation"}, MinItems: ptr(1.0), MaxItems: ptr(50.0)},
+					"atomic":     {Type: "boolean", Description: "Undo the whole batch if an operation fails; true by default"},
+				},
+			})},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(&Schema{
+					Type:     "object",
+					Required: []string{"results", "rolled_back"},
+					Properties: map[string]*Schema{
+						"results":     {Type: "array", Items: &Schema{Ref: "#/components/schemas/BatchResult"}},
+						"rolled_back": {Type: "boolean", Description: "Whether an operation of an atomic batch failed, undoing those before it; it is the last result"},
+					},
+				})},
+				"400": {Description: statusText(400), Content: jsonContent(errorSchema)},
+				"404": {Description: statusText(404), Content: jsonContent(errorSchema)},
+				"422": {Description: statusText(422), Content: jsonContent(validationErrorSchema)},
+			},
+		}},
+	}
+}
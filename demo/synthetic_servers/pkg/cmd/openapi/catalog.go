@@ -0,0 +1,30 @@
+package main
+
+// catalogRoutes describes the route catalog pkg/server serves for every
+// server.
+func (s *source) catalogRoutes() []route {
+	s.schemas["Route"] = &Schema{
+		Type:        "object",
+		Description: "A method and path the server serves.",
+		Properties: map[string]*Schema{
+			"method":      {Type: "string", Enum: []string{"GET", "POST", "PUT", "PATCH", "DELETE"}},
+			"path":        {Type: "string", Description: "With its parameters in braces, as in this spec"},
+			"description": {Type: "string", Description: "What it does, when known"},
+		},
+	}
+	return []route{
+		{method: "get", path: "/api/routes", operation: &Operation{
+			Summary:     "List the routes the server serves, in order of path",
+			Description: "A request for one of these paths with a method it isn't served with gets 405, with an Allow header naming those it is.",
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(&Schema{
+					Type:     "object",
+					Required: []string{"routes"},
+					Properties: map[string]*Schema{
+						"routes": {Type: "array", Items: &Schema{Ref: "#/components/schemas/Route"}},
+					},
+				})},
+			},
+		}},
+	}
+}
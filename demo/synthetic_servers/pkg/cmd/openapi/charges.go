@@ -0,0 +1,53 @@
+package main
+
+// chargeRoutes describes the routes pkg/server serves users the charges to
+// their cards from, for databases that embed server.Payments.
+func (s *source) chargeRoutes() []route {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	num := func() *Schema { return &Schema{Type: "number"} }
+	s.schemas["Charge"] = &Schema{
+		Type:        "object",
+		Description: "A charge to one of your cards, from its authorization on.",
+		Properties: map[string]*Schema{
+			"id":                str(),
+			"user_email":        str(),
+			"payment_method_id": str(),
+			"last4":             {Type: "string", Description: "The last four digits of the card"},
+			"description":       {Type: "string", Description: "What it pays for"},
+			"amount":            {Type: "number", Description: "Authorized"},
+			"amount_captured":   num(),
+			"amount_refunded":   num(),
+			"currency":          {Type: "string", Description: "ISO 4217; USD if not given"},
+			"status": {Type: "string", Enum: []string{
+				"authorized", "captured", "partially_refunded", "refunded", "voided", "declined",
+			}},
+			"decline_code": {Type: "string", Description: "Why it was declined, such as insufficient_funds"},
+			"created_at":   {Type: "string", Format: "date-time"},
+			"updated_at":   {Type: "string", Format: "date-time"},
+		},
+	}
+	ref := &Schema{Ref: "#/components/schemas/Charge"}
+	fail := func(status int) Response {
+		return Response{Description: statusText(status), Content: jsonContent(errorSchema)}
+	}
+	return []route{
+		{method: "get", path: "/api/v1/charges", operation: &Operation{
+			Summary:    "List the charges to your cards, newest first",
+			Parameters: listParams,
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(pageSchema(ref))},
+				"400": fail(400),
+				"401": fail(401),
+			},
+		}},
+		{method: "get", path: "/api/v1/charges/:id", operation: &Operation{
+			Summary:    "Get a charge to one of your cards",
+			Parameters: []Parameter{{Name: "id", In: "path", Required: true, Schema: str()}},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(ref)},
+				"401": fail(401),
+				"404": fail(404),
+			},
+		}},
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+// eventRoutes describes the event stream pkg/server serves for every
+// server's database.
+func (s *source) eventRoutes() []route {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	s.schemas["ChangeEvent"] = &Schema{
+		Type:        "object",
+		Description: "A change to an entity. Server-sent events carry it as data, named by its type.",
+		Properties: map[string]*Schema{
+			"id":         {Type: "integer"},
+			"type":       str(),
+			"collection": str(),
+			"action":     {Type: "string", Enum: []string{"created", "updated", "deleted"}},
+			"key":        str(),
+			"owner":      str(),
+			"actor":      str(),
+			"entity":     {Description: "The entity as it is now, or as it was before deletion"},
+			"before":     {Description: "The entity as it was before an update"},
+			"time":       {Type: "string", Format: "date-time"},
+		},
+	}
+	return []route{
+		{method: "get", path: "/api/v1/events/stream", operation: &Operation{
+			Summary:     "Stream changes to entities as server-sent events",
+			Description: "Each event is named by its type, such as orders.updated, with the ChangeEvent as data. Changes to entities that belong to a user only reach that user. Reconnect with Last-Event-ID to catch up on missed events.",
+			Parameters: []Parameter{
+				{Name: "type", In: "query", Description: "Comma-separated collections, or collection.action types, to stream", Schema: str()},
+				{Name: "key", In: "query", Description: "Comma-separated keys of the entities to stream, such as a ride to track", Schema: str()},
+				{Name: "Last-Event-ID", In: "header", Description: "Resume after this event", Schema: str()},
+			},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: map[string]MediaType{
+					"text/event-stream": {Schema: &Schema{Ref: "#/components/schemas/ChangeEvent"}},
+				}},
+				"400": {Description: statusText(400), Content: jsonContent(errorSchema)},
+			},
+		}},
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"go/ast"
+	"strings"
+)
+
+// binarySchema is a file's content, as the responses of handlers that
+// serve files with server.ServeFile have.
+var binarySchema = &Schema{Type: "string", Format: "binary"}
+
+// binaryContent is the content of a response with a file, whatever its
+// type.
+func binaryContent() map[string]MediaType {
+	return map[string]MediaType{"application/octet-stream": {Schema: binarySchema}}
+}
+
+// mediaSchema is the schema of a response body of media type t: text for
+// text types, such as a text/calendar feed, and binary otherwise.
+func mediaSchema(t string) *Schema {
+	if strings.HasPrefix(t, "text/") {
+		return &Schema{Type: "string"}
+	}
+	return binarySchema
+}
+
+// multipartContent is the content of a request that uploads files, with
+// form.
+func multipartContent(form *Schema) map[string]MediaType {
+	return map[string]MediaType{"multipart/form-data": {Schema: form}}
+}
+
+// storesFiles reports whether main gives the server a blob store with
+// server.WithFiles, in which case it serves the blob routes.
+func (s *source) storesFiles() bool {
+	fn, ok := s.funcs["main"]
+	if !ok {
+		return false
+	}
+	found := false
+	ast.Inspect(fn, func(n ast.Node) bool {
+		if pkg, method, _ := call(asExpr(n)); pkg == "server" && method == "WithFiles" {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// storedFileSchema refers to the schema of server.StoredFile, adding it to
+// the components.
+func (s *source) storedFileSchema() *Schema {
+	s.schemas["StoredFile"] = &Schema{
+		Type:        "object",
+		Description: "A file in the server's blob store, uploaded or generated.",
+		Required:    []string{"id", "size", "content_type", "url"},
+		Properties: map[string]*Schema{
+			"id":           {Type: "string", Description: "The SHA-256 of its content, in hex"},
+			"name":         {Type: "string", Description: "As uploaded, or as it downloads"},
+			"size":         {Type: "integer", Format: "int64"},
+			"content_type": {Type: "string"},
+			"url":          {Type: "string", Description: "Where to download it"},
+		},
+	}
+	return &Schema{Ref: "#/components/schemas/StoredFile"}
+}
+
+// fileRoutes describes the blob store's routes, which pkg/server serves
+// for servers with server.WithFiles.
+func (s *source) fileRoutes() []route {
+	fail := func(status int) Response {
+		return Response{Description: statusText(status), Content: jsonContent(errorSchema)}
+	}
+	return []route{
+		{method: "post", path: "/api/v1/blobs", operation: &Operation{
+			Summary:     "Upload a file",
+			Description: "Stores a document or picture, such as a scanned form, to attach to what takes files. The same content is stored once, under the same ID, however often it is uploaded.",
+			RequestBody: &RequestBody{Required: true, Content: multipartContent(&Schema{
+				Type:       "object",
+				Required:   []string{"file"},
+				Properties: map[string]*Schema{"file": binarySchema},
+			})},
+			Responses: map[string]Response{
+				"201": {Description: "Success", Content: jsonContent(s.storedFileSchema())},
+				"413": fail(413),
+				"415": fail(415),
+				"422": {Description: statusText(422), Content: jsonContent(validationErrorSchema)},
+			},
+		}},
+		{method: "get", path: "/api/v1/blobs/:id", operation: &Operation{
+			Summary:     "Download a file",
+			Description: "The content of an uploaded or generated file, by its ID, with its content type.",
+			Parameters:  []Parameter{{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "string"}}},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: binaryContent()},
+				"404": fail(404),
+			},
+		}},
+	}
+}
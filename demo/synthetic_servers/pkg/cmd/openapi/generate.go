@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"strings"
+)
+
+const bearerAuth = "bearerAuth"
+
+// generate builds the spec for a server's source.
+func generate(src *source, info Info) (*Spec, error) {
+	routes := src.routes()
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no routes found in setupRoutes")
+	}
+
+	spec := &Spec{
+		OpenAPI: "3.0.0",
+		Info:    info,
+		Paths:   make(map[string]PathItem),
+	}
+	auth := src.embeds("Auth")
+	if auth {
+		// Requests may carry a token; those that name a user must.
+		spec.Security = []map[string][]string{{bearerAuth: {}}, {}}
+		spec.Components.SecuritySchemes = map[string]SecurityScheme{
+			bearerAuth: {
+				Type:        "http",
+				Scheme:      "bearer",
+				Description: "Per-user token, seeded under auth.tokens in database.json or returned by login. Required on user-scoped requests, which identify the user by it.",
+			},
+		}
+		routes = append(src.authRoutes(), routes...)
+	}
+	routes = append(routes, src.eventRoutes()...)
+	routes = append(routes, src.webhookRoutes()...)
+	routes = append(routes, src.activityRoutes()...)
+	routes = append(routes, src.batchRoutes()...)
+	routes = append(routes, src.catalogRoutes()...)
+	if src.embeds("Inbox") {
+		routes = append(routes, src.notificationRoutes()...)
+	}
+	if src.embeds("Payments") {
+		routes = append(routes, src.chargeRoutes()...)
+	}
+	if src.embeds("Promotions") {
+		routes = append(routes, src.promotionRoutes()...)
+	}
+	if src.embeds("Reviews") {
+		routes = append(routes, src.reviewRoutes()...)
+	}
+	if src.embeds("Messaging") {
+		routes = append(routes, src.conversationRoutes()...)
+	}
+	if collections := src.searchCollections(); len(collections) > 0 {
+		routes = append(routes, src.searchRoutes(collections)...)
+	}
+	if src.storesFiles() {
+		routes = append(routes, src.fileRoutes()...)
+	}
+
+	for _, r := range routes {
+		path, pathParams := openAPIPath(r.path)
+		op := r.operation
+		if op == nil {
+			op = src.operation(r, pathParams)
+		}
+		item, ok := spec.Paths[path]
+		if !ok {
+			item = make(PathItem)
+			spec.Paths[path] = item
+		}
+		item[r.method] = op
+	}
+
+	spec.Components.Schemas = src.schemas
+	for name, s := range errorComponents() {
+		spec.Components.Schemas[name] = s
+	}
+	return spec, nil
+}
+
+func (s *source) operation(r route, pathParams []string) *Operation {
+	h := s.handler(r.handler)
+	op := &Operation{
+		Summary:   h.summary,
+		Responses: make(map[string]Response),
+	}
+	if op.Summary == "" {
+		path, _ := openAPIPath(strings.TrimPrefix(r.path, "/api/v1"))
+		op.Summary = strings.ToUpper(r.method) + " " + path
+	}
+	if len(r.roles) > 0 {
+		op.Description = fmt.Sprintf("Requires the %s role.", strings.Join(r.roles, " or "))
+		op.Security = []map[string][]string{{bearerAuth: {}}}
+	}
+
+	for _, name := range pathParams {
+		op.Parameters = append(op.Parameters, Parameter{
+			Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"},
+		})
+	}
+	op.Parameters = append(op.Parameters, h.query...)
+	op.Parameters = append(op.Parameters, h.headers...)
+	if r.method == "post" {
+		op.Parameters = append(op.Parameters, Parameter{
+			Name: "Idempotency-Key", In: "header", Schema: &Schema{Type: "string"},
+			Description: "Retries with the same key within 24 hours get the first response again instead of repeating the request",
+		})
+	}
+	if r.method != "get" && len(pathParams) > 0 {
+		// pkg/server versions the entities paths name.
+		op.Parameters = append(op.Parameters, Parameter{
+			Name: "If-Match", In: "header", Schema: &Schema{Type: "string"},
+			Description: "Only make the change if the entity is still at this ETag, from a GET for it; 412 if not",
+		})
+		h.responses[412] = errorSchema
+	}
+
+	if h.form != nil {
+		op.RequestBody = &RequestBody{Required: true, Content: multipartContent(h.form)}
+	} else if h.body != nil {
+		op.RequestBody = &RequestBody{Required: true, Content: jsonContent(h.body)}
+	}
+	for _, status := range h.sortedStatuses() {
+		resp := Response{Description: statusText(status)}
+		if schema := h.responses[status]; schema != nil {
+			resp.Content = jsonContent(schema)
+		}
+		if status == 200 && (h.file || len(h.media) > 0) {
+			if resp.Content == nil {
+				resp.Content = make(map[string]MediaType)
+			}
+			for _, t := range h.media {
+				resp.Content[t] = MediaType{Schema: mediaSchema(t)}
+			}
+			if h.file {
+				resp.Content["application/octet-stream"] = MediaType{Schema: binarySchema}
+			}
+		}
+		op.Responses[fmt.Sprint(status)] = resp
+	}
+	if len(op.Responses) == 0 {
+		op.Responses["200"] = Response{Description: statusText(200)}
+	}
+	return op
+}
+
+func statusText(status int) string {
+	switch {
+	case status < 300:
+		return "Success"
+	case status == 400:
+		return "Invalid request"
+	case status == 401:
+		return "Not authenticated"
+	case status == 402:
+		return "Payment declined"
+	case status == 403:
+		return "Not allowed"
+	case status == 404:
+		return "Not found"
+	case status == 409:
+		return "Conflict"
+	case status == 412:
+		return "Changed since read"
+	case status == 422:
+		return "Validation failed"
+	case status < 500:
+		return "Request rejected"
+	}
+	return "Server error"
+}
+
+// embeds reports whether the Database embeds the pkg/server type name, such
+// as Auth, in which case the server also serves that type's shared routes.
+func (s *source) embeds(name string) bool {
+	ts, ok := s.types["Database"]
+	if !ok {
+		return false
+	}
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok {
+		return false
+	}
+	for _, f := range st.Fields.List {
+		if sel, ok := f.Type.(*ast.SelectorExpr); ok && len(f.Names) == 0 && sel.Sel.Name == name {
+			return true
+		}
+	}
+	return false
+}
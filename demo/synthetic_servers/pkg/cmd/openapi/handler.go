@@ -0,0 +1,480 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"pkg/money"
+	"pkg/pdf"
+	"pkg/server"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// handler is what the generator learns about a route's handler.
+type handler struct {
+	summary   string
+	query     []Parameter
+	headers   []Parameter
+	body      *Schema
+	form      *Schema         // A multipart body, for handlers that take uploads
+	file      bool            // Responds with a file of any type, besides any JSON
+	media     []string        // Other media types the 200 has, like text/calendar
+	responses map[int]*Schema // Nil schema: no body
+}
+
+var queryTypes = map[string]string{
+	"Query": "string", "QueryInt": "integer", "QueryBool": "boolean", "QueryFloat": "number",
+}
+
+var statusCodes = map[string]int{
+	"StatusOK": 200, "StatusCreated": 201, "StatusAccepted": 202, "StatusNoContent": 204,
+	"StatusBadRequest": 400, "StatusUnauthorized": 401, "StatusPaymentRequired": 402,
+	"StatusForbidden": 403, "StatusNotFound": 404, "StatusConflict": 409, "StatusGone": 410,
+	"StatusUnprocessableEntity": 422, "StatusTooManyRequests": 429,
+	"StatusInternalServerError": 500, "StatusServiceUnavailable": 503,
+}
+
+// handler analyzes a route's handler: a function name, a method value of
+// the server's handler state, like h.getOrder, a function literal, or a
+// call to a function or method that returns a literal, like
+// h.setCardLock(true).
+func (s *source) handler(e ast.Expr) *handler {
+	h := &handler{responses: make(map[int]*Schema)}
+	var body *ast.BlockStmt
+	var doc *ast.CommentGroup
+	name := ""
+	switch e := e.(type) {
+	case *ast.Ident:
+		if fn, ok := s.funcs[e.Name]; ok {
+			body, doc, name = fn.Body, fn.Doc, e.Name
+		}
+	case *ast.SelectorExpr:
+		if fn, ok := s.handlers[e.Sel.Name]; ok {
+			body, doc, name = fn.Body, fn.Doc, e.Sel.Name
+		}
+	case *ast.FuncLit:
+		body = e.Body
+	case *ast.CallExpr:
+		var fn *ast.FuncDecl
+		switch f := e.Fun.(type) {
+		case *ast.Ident:
+			fn = s.funcs[f.Name]
+		case *ast.SelectorExpr:
+			fn = s.handlers[f.Sel.Name]
+		}
+		if fn != nil {
+			body, doc, name = fn.Body, fn.Doc, fn.Name.Name
+		}
+	}
+	if body == nil {
+		return h
+	}
+
+	vars := s.locals(body)
+	seen := map[string]bool{}
+	var formValues, stored []string
+	ast.Inspect(body, func(n ast.Node) bool {
+		pkg, method, args := call(asExpr(n))
+		switch {
+		case queryTypes[method] != "" && len(args) > 0:
+			if name := stringLit(args[0]); name != "" && !seen["q:"+name] {
+				seen["q:"+name] = true
+				h.query = append(h.query, Parameter{Name: name, In: "query", Schema: &Schema{Type: queryTypes[method]}})
+			}
+		case method == "Get" && len(args) == 1:
+			if name := stringLit(args[0]); strings.HasPrefix(name, "X-") && !seen["h:"+name] {
+				seen["h:"+name] = true
+				h.headers = append(h.headers, Parameter{Name: name, In: "header", Schema: &Schema{Type: "string"}})
+			}
+		case method == "BodyParser" && len(args) == 1:
+			if u, ok := args[0].(*ast.UnaryExpr); ok && h.body == nil {
+				if t := vars.typeOf(u.X); t != nil {
+					h.body = s.schema(t)
+				}
+			}
+		case pkg == "server" && method == "Bind" && len(args) == 2:
+			if u, ok := args[1].(*ast.UnaryExpr); ok && h.body == nil {
+				if t := vars.typeOf(u.X); t != nil {
+					h.body = s.schema(t)
+				}
+			}
+			h.responses[400] = errorSchema
+			h.responses[422] = validationErrorSchema
+		case pkg == "server" && method == "List" && len(args) >= 2:
+			var items *Schema
+			if t := vars.typeOf(args[1]); t != nil {
+				items = s.schema(elem(s.underlying(t)))
+			}
+			h.responses[200] = pageSchema(items)
+			h.responses[400] = errorSchema
+			for _, p := range listParams {
+				if !seen["q:"+p.Name] {
+					seen["q:"+p.Name] = true
+					h.query = append(h.query, p)
+				}
+			}
+		case pkg == "server" && method == "Paginate" && len(args) == 2:
+			h.responses[400] = errorSchema
+			for _, p := range listParams[:2] {
+				if !seen["q:"+p.Name] {
+					seen["q:"+p.Name] = true
+					h.query = append(h.query, p)
+				}
+			}
+		case pkg == "server" && method == "Upload" && len(args) == 2:
+			if name := stringLit(args[1]); name != "" {
+				if h.form == nil {
+					h.form = &Schema{Type: "object", Properties: map[string]*Schema{}}
+				}
+				h.form.Properties[name] = binarySchema
+				h.form.Required = append(h.form.Required, name)
+			}
+			h.responses[413] = errorSchema
+			h.responses[415] = errorSchema
+			h.responses[422] = validationErrorSchema
+		case method == "FormValue" && len(args) > 0:
+			if name := stringLit(args[0]); name != "" {
+				formValues = append(formValues, name)
+			}
+		case pkg == "server" && method == "StoreFile" && len(args) == 3:
+			if t := mediaType(constString(args[1])); t != "" {
+				stored = append(stored, t)
+			}
+		case pkg == "server" && method == "ServeFile":
+			h.file = true
+			if _, ok := h.responses[200]; !ok {
+				h.responses[200] = nil
+			}
+			h.responses[404] = errorSchema
+		case method == "Set" && len(args) == 2 && isContentType(args[0]):
+			if t := mediaType(constString(args[1])); t != "" && t != fiber.MIMEApplicationJSON && !slices.Contains(h.media, t) {
+				h.media = append(h.media, t)
+				if _, ok := h.responses[200]; !ok {
+					h.responses[200] = nil
+				}
+			}
+		case pkg == "server" && method == "ExportFormat":
+			if !seen["q:format"] {
+				seen["q:format"] = true
+				h.query = append(h.query, formatParam)
+			}
+		case pkg == "server" && method == "Currency":
+			if !seen["q:currency"] {
+				seen["q:currency"] = true
+				h.query = append(h.query, currencyParam)
+			}
+			h.responses[400] = errorSchema
+		case method == "JSON" && len(args) == 1:
+			status := 200
+			if _, m, sargs := call(n.(*ast.CallExpr).Fun.(*ast.SelectorExpr).X); m == "Status" && len(sargs) == 1 {
+				status = statusCode(sargs[0])
+			}
+			if _, ok := h.responses[status]; !ok || h.responses[status] == nil {
+				if status >= 400 {
+					h.responses[status] = errorSchema
+				} else if t := vars.typeOf(args[0]); t != nil {
+					h.responses[status] = s.schema(t)
+				} else {
+					h.responses[status] = &Schema{}
+				}
+			}
+		case method == "SendStatus" && len(args) == 1:
+			if status := statusCode(args[0]); status > 0 {
+				if _, ok := h.responses[status]; !ok {
+					h.responses[status] = nil
+				}
+			}
+		case pkg == "fiber" && method == "NewError" && len(args) > 0:
+			if status := statusCode(args[0]); status >= 400 {
+				h.responses[status] = errorSchema
+			}
+		case pkg == "server" && method == "NewError" && len(args) > 0:
+			if status := errorCodeStatus(args[0]); status > 0 {
+				h.responses[status] = errorSchema
+			}
+		case pkg == "server" && (method == "Fail" || method == "FailWith") && len(args) > 1:
+			if status := statusCode(args[1]); status >= 400 {
+				h.responses[status] = errorSchema
+			}
+		}
+		return true
+	})
+	if h.file && len(stored) > 0 {
+		// Files the handler stores and then serves have the type it stored
+		// them with, like a generated PDF, rather than any type.
+		for _, t := range stored {
+			if !slices.Contains(h.media, t) {
+				h.media = append(h.media, t)
+			}
+		}
+		h.file = false
+	}
+	if h.form != nil {
+		for _, name := range formValues {
+			if _, ok := h.form.Properties[name]; !ok {
+				h.form.Properties[name] = &Schema{Type: "string"}
+			}
+		}
+	}
+
+	h.summary = summary(doc, name)
+	s.annotate(h, doc)
+	return h
+}
+
+// errorSchema is the envelope the servers answer every error in, and
+// validationErrorSchema how server.ErrorHandler reports a
+// *server.ValidationError. generate adds the components they refer to.
+var (
+	errorSchema           = &Schema{Ref: "#/components/schemas/ErrorResponse"}
+	validationErrorSchema = &Schema{Ref: "#/components/schemas/ValidationErrorResponse"}
+)
+
+// errorComponents are the schemas errorSchema and validationErrorSchema
+// refer to.
+func errorComponents() map[string]*Schema {
+	return map[string]*Schema{
+		"ErrorResponse": errorEnvelope(&Schema{Description: "More about the error, if there is more to say"}),
+		"ValidationErrorResponse": errorEnvelope(&Schema{
+			Type:        "array",
+			Description: "The fields that failed validation",
+			Items: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"field":   {Type: "string", Description: "The field's JSON name, with a path into nested objects and arrays"},
+					"message": {Type: "string"},
+				},
+			},
+		}),
+	}
+}
+
+func errorEnvelope(details *Schema) *Schema {
+	codes := &Schema{Type: "string", Description: "What went wrong, from the catalog of error codes:"}
+	for _, ec := range server.ErrorCodes {
+		codes.Enum = append(codes.Enum, ec.Code)
+		codes.Description += fmt.Sprintf("\n- %s: %s", ec.Code, ec.Description)
+	}
+	return &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{"error": {
+			Type:     "object",
+			Required: []string{"code", "message"},
+			Properties: map[string]*Schema{
+				"code":       codes,
+				"message":    {Type: "string", Description: "For people; may change"},
+				"details":    details,
+				"request_id": {Type: "string", Description: "The request's X-Request-ID, to find it in the server's log"},
+			},
+		}},
+		Required: []string{"error"},
+	}
+}
+
+// errorCodeStatus returns the status a server.Code constant is answered
+// with by default, or 0 if it isn't one.
+func errorCodeStatus(e ast.Expr) int {
+	sel, ok := e.(*ast.SelectorExpr)
+	if !ok || !strings.HasPrefix(sel.Sel.Name, "Code") {
+		return 0
+	}
+	var code strings.Builder // CodeNotFound -> NOT_FOUND
+	for i, r := range strings.TrimPrefix(sel.Sel.Name, "Code") {
+		if i > 0 && unicode.IsUpper(r) {
+			code.WriteByte('_')
+		}
+		code.WriteRune(unicode.ToUpper(r))
+	}
+	for _, ec := range server.ErrorCodes {
+		if ec.Code == code.String() {
+			return ec.Status
+		}
+	}
+	return 0
+}
+
+// listParams are the query parameters server.List reads; server.Paginate
+// reads the first two.
+var listParams = []Parameter{
+	{Name: "limit", In: "query", Description: "Page size, at most 200", Schema: &Schema{Type: "integer", Minimum: ptr(1.0), Maximum: ptr(200.0)}},
+	{Name: "offset", In: "query", Description: "Items to skip", Schema: &Schema{Type: "integer", Minimum: ptr(0.0)}},
+	{Name: "cursor", In: "query", Description: "Page by cursor instead, newest first: empty for the first page, then the previous page's next_cursor", Schema: &Schema{Type: "string"}},
+	{Name: "sort", In: "query", Description: "Comma-separated fields to order by; prefix one with - for descending order. Other query parameters naming a field filter on it.", Schema: &Schema{Type: "string"}},
+	formatParam,
+}
+
+// formatParam asks for an export, as server.ExportFormat reads it.
+var formatParam = Parameter{Name: "format", In: "query", Description: "Export every matching item as CSV or JSON lines instead; Accept: text/csv or application/x-ndjson does the same", Schema: &Schema{Type: "string", Enum: []string{"csv", "jsonl"}}}
+
+// currencyParam asks for prices in a currency, as server.Currency reads it.
+var currencyParam = Parameter{Name: "currency", In: "query", Description: "Currency to give prices in; by default that of the Accept-Language locale, or USD", Schema: &Schema{Type: "string", Enum: money.Currencies()}}
+
+// pageSchema is the server.Page envelope around items, or with a cursor
+// the server.CursorPage one.
+func pageSchema(items *Schema) *Schema {
+	if items == nil {
+		items = &Schema{}
+	}
+	return &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"data":        {Type: "array", Items: items},
+			"total":       {Type: "integer", Description: "Matching items across all pages"},
+			"limit":       {Type: "integer"},
+			"offset":      {Type: "integer", Description: "Only when paging by offset"},
+			"next_cursor": {Type: "string", Nullable: true, Description: "Only when paging by cursor: the cursor for the next page, or null on the last"},
+		},
+		Required: []string{"data", "total", "limit"},
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func asExpr(n ast.Node) ast.Expr {
+	if e, ok := n.(ast.Expr); ok {
+		return e
+	}
+	return nil
+}
+
+// mediaConstants are the media types packages name, so handlers that use
+// them are described as precisely as ones that spell the type out.
+var mediaConstants = map[string]string{
+	"pdf.MIMEApplicationPDF":         pdf.MIMEApplicationPDF,
+	"fiber.MIMETextPlain":            fiber.MIMETextPlain,
+	"fiber.MIMETextPlainCharsetUTF8": fiber.MIMETextPlainCharsetUTF8,
+	"fiber.MIMETextHTML":             fiber.MIMETextHTML,
+	"fiber.MIMETextHTMLCharsetUTF8":  fiber.MIMETextHTMLCharsetUTF8,
+}
+
+// constString is the string e is, as a literal or one of mediaConstants.
+func constString(e ast.Expr) string {
+	if sel, ok := e.(*ast.SelectorExpr); ok {
+		if x, ok := sel.X.(*ast.Ident); ok {
+			return mediaConstants[x.Name+"."+sel.Sel.Name]
+		}
+	}
+	return stringLit(e)
+}
+
+// isContentType reports whether e names the Content-Type header.
+func isContentType(e ast.Expr) bool {
+	if sel, ok := e.(*ast.SelectorExpr); ok {
+		return sel.Sel.Name == "HeaderContentType"
+	}
+	return strings.EqualFold(stringLit(e), fiber.HeaderContentType)
+}
+
+// mediaType is a Content-Type without its parameters, such as a charset.
+func mediaType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.TrimSpace(t)
+}
+
+func statusCode(e ast.Expr) int {
+	switch e := e.(type) {
+	case *ast.SelectorExpr:
+		return statusCodes[e.Sel.Name]
+	case *ast.BasicLit:
+		code, _ := strconv.Atoi(e.Value)
+		return code
+	}
+	return 0
+}
+
+// summary is the first sentence of a handler's doc comment, or its name
+// spelled out: getUserAccounts becomes "Get user accounts". Comments that
+// don't start with the name, such as section headings, don't count.
+func summary(doc *ast.CommentGroup, name string) string {
+	if name == "" {
+		return ""
+	}
+	if text, ok := strings.CutPrefix(firstSentence(doc), name+" "); ok && text != "" {
+		return strings.ToUpper(text[:1]) + text[1:]
+	}
+	var words []string
+	start := 0
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) {
+			words = append(words, strings.ToLower(name[start:i]))
+			start = i
+		}
+	}
+	words = append(words, strings.ToLower(name[start:]))
+	text := strings.Join(words, " ")
+	if text == "" {
+		return ""
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+// annotate applies the @query, @body and @response lines of a handler's
+// doc comment.
+func (s *source) annotate(h *handler, doc *ast.CommentGroup) {
+	if doc == nil {
+		return
+	}
+	for _, line := range strings.Split(doc.Text(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "@query":
+			p := Parameter{Name: fields[1], In: "query", Schema: &Schema{Type: "string"}}
+			if len(fields) > 2 {
+				p.Schema = &Schema{Type: fields[2]}
+				p.Description = strings.Join(fields[3:], " ")
+			}
+			h.query = append(removeParam(h.query, p.Name), p)
+		case "@body":
+			h.body = s.schema(typeExpr(fields[1]))
+		case "@response":
+			if status, err := strconv.Atoi(fields[1]); err == nil {
+				h.responses[status] = nil
+				if len(fields) > 2 {
+					h.responses[status] = s.schema(typeExpr(fields[2]))
+				}
+			}
+		}
+	}
+}
+
+func removeParam(params []Parameter, name string) []Parameter {
+	out := params[:0]
+	for _, p := range params {
+		if p.Name != name {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// typeExpr parses an annotation's type: Name, []Name or map[string]Name.
+func typeExpr(t string) ast.Expr {
+	switch {
+	case strings.HasPrefix(t, "[]"):
+		return &ast.ArrayType{Elt: typeExpr(t[2:])}
+	case strings.HasPrefix(t, "map[string]"):
+		return &ast.MapType{Key: ast.NewIdent("string"), Value: typeExpr(t[len("map[string]"):])}
+	}
+	return ast.NewIdent(t)
+}
+
+// sortedStatuses returns a handler's response codes in order.
+func (h *handler) sortedStatuses() []int {
+	codes := make([]int, 0, len(h.responses))
+	for code := range h.responses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	return codes
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"go/ast"
+)
+
+// locals is the static type, as written in the source, of the variables
+// a handler declares.
+type locals struct {
+	src   *source
+	types map[string]ast.Expr
+}
+
+func (s *source) locals(body *ast.BlockStmt) *locals {
+	l := &locals{src: s, types: make(map[string]ast.Expr)}
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ValueSpec:
+			for i, name := range n.Names {
+				switch {
+				case n.Type != nil:
+					l.set(name, n.Type)
+				case i < len(n.Values):
+					l.set(name, l.typeOf(n.Values[i]))
+				}
+			}
+		case *ast.AssignStmt:
+			if len(n.Rhs) == 1 && len(n.Lhs) > 1 {
+				for i, lhs := range n.Lhs {
+					l.set(lhs, l.result(n.Rhs[0], i))
+				}
+				break
+			}
+			for i, lhs := range n.Lhs {
+				if i < len(n.Rhs) {
+					l.set(lhs, l.typeOf(n.Rhs[i]))
+				}
+			}
+		case *ast.RangeStmt:
+			if t := l.typeOf(n.X); t != nil && n.Value != nil {
+				l.set(n.Value, elem(l.src.underlying(t)))
+			}
+		}
+		return true
+	})
+	return l
+}
+
+// set records the first type seen for a variable.
+func (l *locals) set(e ast.Expr, t ast.Expr) {
+	id, ok := e.(*ast.Ident)
+	if !ok || id.Name == "_" || t == nil {
+		return
+	}
+	if _, ok := l.types[id.Name]; !ok {
+		l.types[id.Name] = t
+	}
+}
+
+// typeOf returns the type of e, or nil if it can't tell.
+func (l *locals) typeOf(e ast.Expr) ast.Expr {
+	switch e := e.(type) {
+	case *ast.Ident:
+		return l.types[e.Name]
+	case *ast.ParenExpr:
+		return l.typeOf(e.X)
+	case *ast.CompositeLit:
+		return e.Type
+	case *ast.UnaryExpr:
+		return l.typeOf(e.X)
+	case *ast.StarExpr:
+		return l.typeOf(e.X)
+	case *ast.IndexExpr:
+		if t := l.typeOf(e.X); t != nil {
+			return elem(l.src.underlying(t))
+		}
+	case *ast.SliceExpr:
+		return l.typeOf(e.X)
+	case *ast.SelectorExpr:
+		// db.Field, or a field of a local struct.
+		if id, ok := e.X.(*ast.Ident); ok && id.Name == "db" {
+			return l.src.field("Database", e.Sel.Name)
+		}
+		if t := l.typeOf(e.X); t != nil {
+			if id, ok := deref(t).(*ast.Ident); ok {
+				return l.src.field(id.Name, e.Sel.Name)
+			}
+		}
+	case *ast.CallExpr:
+		if id, ok := e.Fun.(*ast.Ident); ok && (id.Name == "make" || id.Name == "new") && len(e.Args) > 0 {
+			return e.Args[0]
+		}
+		return l.result(e, 0)
+	}
+	return nil
+}
+
+// result returns the type of the i-th value e yields: a function's result,
+// or the value of a comma-ok map index.
+func (l *locals) result(e ast.Expr, i int) ast.Expr {
+	switch e := e.(type) {
+	case *ast.IndexExpr:
+		if i == 0 {
+			return l.typeOf(e)
+		}
+		return nil
+	case *ast.CallExpr:
+		var fn *ast.FuncDecl
+		switch f := e.Fun.(type) {
+		case *ast.Ident:
+			fn = l.src.funcs[f.Name]
+		case *ast.SelectorExpr:
+			if t := repositoryElem(l.typeOf(f.X)); t != nil {
+				return repositoryResult(f.Sel.Name, t, i)
+			}
+			if x, ok := f.X.(*ast.Ident); ok && x.Name == "h" {
+				fn = l.src.handlers[f.Sel.Name]
+			} else {
+				fn = l.src.methods[f.Sel.Name]
+			}
+			if fn == nil && l.src.embeds("Reviews") {
+				return reviewsResult(f.Sel.Name, i)
+			}
+		}
+		if fn == nil || fn.Type.Results == nil || fn.Type.TypeParams != nil {
+			return nil
+		}
+		n := 0
+		for _, field := range fn.Type.Results.List {
+			count := max(len(field.Names), 1)
+			if i < n+count {
+				return field.Type
+			}
+			n += count
+		}
+	}
+	return nil
+}
+
+// field returns the type of a struct type's field.
+func (s *source) field(typeName, fieldName string) ast.Expr {
+	ts, ok := s.types[typeName]
+	if !ok {
+		return nil
+	}
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok {
+		return nil
+	}
+	for _, f := range st.Fields.List {
+		for _, name := range f.Names {
+			if name.Name == fieldName {
+				return f.Type
+			}
+		}
+	}
+	return nil
+}
+
+// underlying resolves named non-struct types, like type Cart []CartItem,
+// and takes a server.Repository[T] for the map[string]T it stands in for.
+func (s *source) underlying(t ast.Expr) ast.Expr {
+	t = deref(t)
+	if elem := repositoryElem(t); elem != nil {
+		return &ast.MapType{Key: ast.NewIdent("string"), Value: elem}
+	}
+	if id, ok := t.(*ast.Ident); ok {
+		if ts, ok := s.types[id.Name]; ok {
+			if _, isStruct := ts.Type.(*ast.StructType); !isStruct {
+				return s.underlying(ts.Type)
+			}
+		}
+	}
+	return t
+}
+
+func deref(t ast.Expr) ast.Expr {
+	if star, ok := t.(*ast.StarExpr); ok {
+		return star.X
+	}
+	return t
+}
+
+// elem returns the element type of a slice or map type.
+func elem(t ast.Expr) ast.Expr {
+	switch t := t.(type) {
+	case *ast.ArrayType:
+		return t.Elt
+	case *ast.MapType:
+		return t.Value
+	}
+	return nil
+}
+
+// repositoryElem returns T of a server.Repository[T], or nil for other
+// types.
+func repositoryElem(t ast.Expr) ast.Expr {
+	index, ok := deref(t).(*ast.IndexExpr)
+	if !ok {
+		return nil
+	}
+	sel, ok := index.X.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Repository" {
+		return nil
+	}
+	if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "server" {
+		return nil
+	}
+	return index.Index
+}
+
+// repositoryResult returns the type of the i-th value a
+// server.Repository[T]'s method yields.
+func repositoryResult(method string, t ast.Expr, i int) ast.Expr {
+	switch method {
+	case "Get", "Delete":
+		if i == 0 {
+			return t
+		}
+	case "List", "Query", "By":
+		if i == 0 {
+			return &ast.ArrayType{Elt: t}
+		}
+	}
+	return nil
+}
+
+// reviewsResult returns the type of the i-th result of a method a database
+// has from embedding server.Reviews.
+func reviewsResult(method string, i int) ast.Expr {
+	review := &ast.SelectorExpr{X: ast.NewIdent("reviews"), Sel: ast.NewIdent("Review")}
+	switch {
+	case method == "ReviewsOf" && i == 0:
+		return &ast.ArrayType{Elt: review}
+	case method == "AddReview" && i == 0:
+		return review
+	case method == "ReviewSummary" && i == 0:
+		return &ast.SelectorExpr{X: ast.NewIdent("reviews"), Sel: ast.NewIdent("Summary")}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Command openapi generates a server's OpenAPI 3 spec from its source. Run
+// it in the server's directory, usually through go generate:
+//
+//	//go:generate go run pkg/cmd/openapi
+//
+// Paths come from the routes registered in setupRoutes; parameters, request
+// bodies and responses from what the handlers read and return; schemas from
+// the model structs and their json tags. A handler's doc comment gives its
+// summary and may carry annotations for what the source doesn't show:
+//
+//	// getStatements lists a card's statements, newest first.
+//	//
+//	// @query status string Only statements with this status
+//	// @body PaymentRequest
+//	// @response 200 []Statement
+//
+// The title and description are kept from an existing api_spec.json.
+//
+// Routes registered under if server.Profile() == "v2" are a profile's own,
+// and only in the spec of that profile, which -profile picks:
+//
+//	//go:generate go run pkg/cmd/openapi -profile v2 -o openapi.v2.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"pkg/server"
+)
+
+func main() {
+	out := flag.String("o", "openapi.json", "Where to write the spec")
+	profile := flag.String("profile", server.ProfileDefault, "The server profile to describe")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("openapi: ")
+
+	dir, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := load(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	src.profile = *profile
+	spec, err := generate(src, info(dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, append(data, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// info describes the server, keeping what api_spec.json says about it.
+func info(dir string) Info {
+	i := Info{Title: filepath.Base(dir), Version: "1.0.0"}
+	data, err := os.ReadFile(filepath.Join(dir, "api_spec.json"))
+	if err != nil {
+		return i
+	}
+	var legacy struct {
+		Info Info `json:"info"`
+	}
+	if json.Unmarshal(data, &legacy) == nil && legacy.Info.Title != "" {
+		i = legacy.Info
+	}
+	return i
+}
@@ -0,0 +1,129 @@
+package main
+
+// conversationRoutes describes the routes pkg/server serves users their
+// conversations, and the messages in them, from, for databases that embed
+// server.Messaging.
+func (s *source) conversationRoutes() []route {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	dateTime := func() *Schema { return &Schema{Type: "string", Format: "date-time"} }
+	ref := func(name string) *Schema { return &Schema{Ref: "#/components/schemas/" + name} }
+	s.schemas["Message"] = &Schema{
+		Type:        "object",
+		Description: "One participant's say in a conversation.",
+		Properties: map[string]*Schema{
+			"id":              str(),
+			"conversation_id": str(),
+			"seq":             {Type: "integer", Description: "Its place in the conversation, from 1"},
+			"from":            {Type: "string", Description: "The participant's ID"},
+			"role":            {Type: "string", Description: "The participant's role"},
+			"body":            str(),
+			"sent_at":         dateTime(),
+		},
+	}
+	s.schemas["Conversation"] = &Schema{
+		Type:        "object",
+		Description: "Messages between you and someone serving you, such as your driver, about something, such as a ride.",
+		Properties: map[string]*Schema{
+			"id": str(),
+			"about": {Type: "object", Description: "What it is about", Properties: map[string]*Schema{
+				"kind": {Type: "string", Description: "Such as ride or application"},
+				"id":   str(),
+			}},
+			"participants": {Type: "array", Items: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"id":           {Type: "string", Description: "A user's email, or the ID of someone the server plays, such as a driver"},
+					"role":         {Type: "string", Description: "Such as passenger or driver"},
+					"name":         str(),
+					"read_through": {Type: "integer", Description: "The seq of the last message they have read"},
+					"unread":       {Type: "integer", Description: "How many messages from others they haven't read"},
+				},
+			}},
+			"messages":     {Type: "integer", Description: "How many there are, and the seq of the last"},
+			"last_message": ref("Message"),
+			"closed":       {Type: "boolean", Description: "Takes no more messages"},
+			"created_at":   dateTime(),
+			"updated_at":   dateTime(),
+		},
+	}
+	fail := func(status int) Response {
+		return Response{Description: statusText(status), Content: jsonContent(errorSchema)}
+	}
+	id := Parameter{Name: "id", In: "path", Required: true, Schema: str()}
+	return []route{
+		{method: "get", path: "/api/v1/conversations", operation: &Operation{
+			Summary: "List your conversations, the most recently active first",
+			Parameters: append([]Parameter{
+				{Name: "unread", In: "query", Description: "Only conversations with messages you haven't read", Schema: &Schema{Type: "boolean"}},
+			}, listParams...),
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(pageSchema(ref("Conversation")))},
+				"400": fail(400),
+				"401": fail(401),
+			},
+		}},
+		{method: "get", path: "/api/v1/conversations/:id", operation: &Operation{
+			Summary:    "Get one of your conversations",
+			Parameters: []Parameter{id},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(ref("Conversation"))},
+				"401": fail(401),
+				"404": fail(404),
+			},
+		}},
+		{method: "get", path: "/api/v1/conversations/:id/messages", operation: &Operation{
+			Summary:    "List a conversation's messages, oldest first",
+			Parameters: append([]Parameter{id}, listParams...),
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(pageSchema(ref("Message")))},
+				"400": fail(400),
+				"401": fail(401),
+				"404": fail(404),
+			},
+		}},
+		{method: "post", path: "/api/v1/conversations/:id/messages", operation: &Operation{
+			Summary:    "Send a message in a conversation",
+			Parameters: []Parameter{id},
+			RequestBody: &RequestBody{Required: true, Content: jsonContent(&Schema{
+				Type:       "object",
+				Required:   []string{"body"},
+				Properties: map[string]*Schema{"body": {Type: "string", MaxLength: ptr(2000.0)}},
+			})},
+			Responses: map[string]Response{
+				"201": {Description: "Success", Content: jsonContent(ref("Message"))},
+				"400": fail(400),
+				"401": fail(401),
+				"403": fail(403),
+				"404": fail(404),
+				"409": {Description: "The conversation is closed", Content: jsonContent(errorSchema)},
+				"422": {Description: statusText(422), Content: jsonContent(validationErrorSchema)},
+			},
+		}},
+		{method: "post", path: "/api/v1/conversations/:id/read", operation: &Operation{
+			Summary:    "Mark a conversation read through its last message",
+			Parameters: []Parameter{id},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(ref("Conversation"))},
+				"401": fail(401),
+				"403": fail(403),
+				"404": fail(404),
+			},
+		}},
+		{method: "get", path: "/api/v1/conversations/:id/stream", operation: &Operation{
+			Summary:     "Stream a conversation's messages as server-sent events",
+			Description: "Each message sent is a messages.created event, and each change to the conversation, such as someone reading it, a conversations.updated event, with the ChangeEvent as data. Reconnect with Last-Event-ID to catch up on missed events.",
+			Parameters: []Parameter{
+				id,
+				{Name: "Last-Event-ID", In: "header", Description: "Resume after this event", Schema: str()},
+			},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: map[string]MediaType{
+					"text/event-stream": {Schema: ref("ChangeEvent")},
+				}},
+				"400": fail(400),
+				"401": fail(401),
+				"404": fail(404),
+			},
+		}},
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import "pkg/i18n"
+
+// notificationRoutes describes the in-app notification routes pkg/server
+// serves for databases that embed server.Inbox.
+func (s *source) notificationRoutes() []route {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	s.schemas["Notification"] = &Schema{
+		Type:        "object",
+		Description: "An in-app notification that something happened to one of your entities, such as an order shipping.",
+		Properties: map[string]*Schema{
+			"id":         str(),
+			"user_email": str(),
+			"type":       {Type: "string", Description: "What happened, such as order_shipped"},
+			"message":    str(),
+			"collection": {Type: "string", Description: "The collection of the entity it is about, such as orders"},
+			"entity_id":  str(),
+			"read":       {Type: "boolean"},
+			"read_at":    {Type: "string", Format: "date-time"},
+			"created_at": {Type: "string", Format: "date-time"},
+		},
+	}
+	ref := &Schema{Ref: "#/components/schemas/Notification"}
+	fail := func(status int) Response {
+		return Response{Description: statusText(status), Content: jsonContent(errorSchema)}
+	}
+	language := &Schema{
+		Type:       "object",
+		Required:   []string{"language"},
+		Properties: map[string]*Schema{"language": {Type: "string", Enum: i18n.Languages, Description: "The language your notifications, texts and emails are sent in"}},
+	}
+	params := []Parameter{
+		{Name: "unread", In: "query", Description: "Only notifications not yet read", Schema: &Schema{Type: "boolean"}},
+		{Name: "type", In: "query", Description: "Only notifications of this type", Schema: str()},
+	}
+	return []route{
+		{method: "get", path: "/api/v1/notifications", operation: &Operation{
+			Summary:    "List your notifications, newest first",
+			Parameters: append(params, listParams...),
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(pageSchema(ref))},
+				"400": fail(400),
+				"401": fail(401),
+			},
+		}},
+		{method: "post", path: "/api/v1/notifications/:id/read", operation: &Operation{
+			Summary:    "Mark a notification read",
+			Parameters: []Parameter{{Name: "id", In: "path", Required: true, Schema: str()}},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(ref)},
+				"401": fail(401),
+				"404": fail(404),
+			},
+		}},
+		{method: "post", path: "/api/v1/notifications/read", operation: &Operation{
+			Summary: "Mark all your notifications read",
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(&Schema{
+					Type:       "object",
+					Properties: map[string]*Schema{"marked": {Type: "integer", Description: "How many were unread"}},
+				})},
+				"401": fail(401),
+			},
+		}},
+		{method: "get", path: "/api/v1/notifications/language", operation: &Operation{
+			Summary: "Get your notification language",
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(language)},
+				"401": fail(401),
+			},
+		}},
+		{method: "put", path: "/api/v1/notifications/language", operation: &Operation{
+			Summary:     "Set your notification language",
+			RequestBody: &RequestBody{Required: true, Content: jsonContent(language)},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(language)},
+				"401": fail(401),
+				"422": fail(422),
+			},
+		}},
+	}
+}
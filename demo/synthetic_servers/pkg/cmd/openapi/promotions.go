@@ -0,0 +1,73 @@
+package main
+
+// promotionRoutes describes the routes pkg/server serves users promo codes
+// and the codes they have used from, for databases that embed
+// server.Promotions.
+func (s *source) promotionRoutes() []route {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	integer := func() *Schema { return &Schema{Type: "integer"} }
+	s.schemas["Promotion"] = &Schema{
+		Type:        "object",
+		Description: "A promo code, and what it takes off an order before tax.",
+		Properties: map[string]*Schema{
+			"code":              {Type: "string", Description: "In upper case"},
+			"description":       str(),
+			"kind":              {Type: "string", Enum: []string{"percent_off", "amount_off"}},
+			"percent_off":       {Type: "number", Description: "For percent_off, such as 10 for 10%"},
+			"amount_off":        {Type: "number", Description: "For amount_off"},
+			"min_subtotal":      {Type: "number", Description: "The least an order's subtotal may be"},
+			"starts_at":         {Type: "string", Format: "date-time"},
+			"expires_at":        {Type: "string", Format: "date-time"},
+			"max_uses":          {Type: "integer", Description: "In all; unlimited if not given"},
+			"max_uses_per_user": {Type: "integer", Description: "Unlimited if not given"},
+			"uses":              integer(),
+			"stackable":         {Type: "boolean", Description: "May be used along with other codes"},
+		},
+	}
+	s.schemas["Redemption"] = &Schema{
+		Type:        "object",
+		Description: "A promo code's use on one of your orders.",
+		Properties: map[string]*Schema{
+			"id":         str(),
+			"code":       str(),
+			"user_email": str(),
+			"order_id":   str(),
+			"amount":     {Type: "number", Description: "What it took off"},
+			"created_at": {Type: "string", Format: "date-time"},
+		},
+	}
+	ref := func(name string) *Schema { return &Schema{Ref: "#/components/schemas/" + name} }
+	fail := func(status int) Response {
+		return Response{Description: statusText(status), Content: jsonContent(errorSchema)}
+	}
+	return []route{
+		{method: "get", path: "/api/v1/promotions/:code", operation: &Operation{
+			Summary: "Check a promo code for an order, and what it would take off",
+			Parameters: []Parameter{
+				{Name: "code", In: "path", Required: true, Schema: str()},
+				{Name: "subtotal", In: "query", Description: "The order's subtotal; 0 if not given", Schema: &Schema{Type: "number"}},
+			},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(&Schema{
+					Type: "object",
+					Properties: map[string]*Schema{
+						"promotion": ref("Promotion"),
+						"discount":  {Type: "number", Description: "What it would take off the order"},
+					},
+				})},
+				"401": fail(401),
+				"404": fail(404),
+				"422": {Description: "The code can't be used on the order, and why", Content: jsonContent(validationErrorSchema)},
+			},
+		}},
+		{method: "get", path: "/api/v1/redemptions", operation: &Operation{
+			Summary:    "List the promo codes you have used, newest first",
+			Parameters: listParams,
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(pageSchema(ref("Redemption")))},
+				"400": fail(400),
+				"401": fail(401),
+			},
+		}},
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+// reviewRoutes describes the routes pkg/server serves users the reviews
+// they have written, and flags others' at, for databases that embed
+// server.Reviews. The servers' own review routes are described from their
+// handlers, with reviewSchema for pkg/reviews' types.
+func (s *source) reviewRoutes() []route {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	fail := func(status int) Response {
+		return Response{Description: statusText(status), Content: jsonContent(errorSchema)}
+	}
+	return []route{
+		{method: "get", path: "/api/v1/reviews", operation: &Operation{
+			Summary:    "List the reviews you have written, newest first",
+			Parameters: listParams,
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(pageSchema(s.reviewSchema("Review")))},
+				"400": fail(400),
+				"401": fail(401),
+			},
+		}},
+		{method: "post", path: "/api/v1/reviews/:id/flags", operation: &Operation{
+			Summary:    "Flag a review for moderation",
+			Parameters: []Parameter{{Name: "id", In: "path", Required: true, Schema: str()}},
+			RequestBody: &RequestBody{Required: true, Content: jsonContent(&Schema{
+				Type:       "object",
+				Required:   []string{"reason"},
+				Properties: map[string]*Schema{"reason": {Type: "string", Enum: []string{"spam", "offensive", "off_topic", "fake", "other"}}},
+			})},
+			Responses: map[string]Response{
+				"201": {Description: "Success", Content: jsonContent(s.reviewSchema("Flag"))},
+				"400": fail(400),
+				"401": fail(401),
+				"403": fail(403),
+				"404": fail(404),
+				"409": fail(409),
+				"422": {Description: statusText(422), Content: jsonContent(validationErrorSchema)},
+			},
+		}},
+	}
+}
+
+// reviewSchema refers to the schema of the pkg/reviews type name, adding
+// it, and those it refers to, to the components as Review, ReviewFlag and
+// ReviewSummary.
+func (s *source) reviewSchema(name string) *Schema {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	dateTime := func() *Schema { return &Schema{Type: "string", Format: "date-time"} }
+	ref := func(name string) *Schema { return &Schema{Ref: "#/components/schemas/" + name} }
+	switch name {
+	case "Review":
+		s.schemas["Review"] = &Schema{
+			Type:        "object",
+			Description: "A user's rating of something, and what they say about it.",
+			Properties: map[string]*Schema{
+				"id": str(),
+				"target": {Type: "object", Description: "What is reviewed", Properties: map[string]*Schema{
+					"kind": {Type: "string", Description: "Such as product or movie"},
+					"id":   str(),
+				}},
+				"user_email":  str(),
+				"rating":      {Type: "number"},
+				"title":       str(),
+				"body":        str(),
+				"verified":    {Type: "boolean", Description: "The reviewer bought, booked, hired or saw what they review"},
+				"verified_by": {Type: "string", Description: "What shows it, such as an order or ticket ID"},
+				"hidden":      {Type: "boolean", Description: "Flagged by too many users, and awaiting moderation"},
+				"created_at":  dateTime(),
+			},
+		}
+		return ref("Review")
+	case "Flag":
+		s.schemas["ReviewFlag"] = &Schema{
+			Type:        "object",
+			Description: "A user's report of a review.",
+			Properties: map[string]*Schema{
+				"user_email": str(),
+				"reason":     str(),
+				"created_at": dateTime(),
+			},
+		}
+		return ref("ReviewFlag")
+	case "Summary":
+		s.schemas["ReviewSummary"] = &Schema{
+			Type:        "object",
+			Description: "What something's ratings add up to.",
+			Properties: map[string]*Schema{
+				"count":   {Type: "integer"},
+				"average": {Type: "number", Description: "To two decimal places; 0 with no reviews"},
+				"stars":   {Type: "array", Items: &Schema{Type: "integer"}, Description: "How many are of 1 to 5 stars, half stars rounded up"},
+			},
+		}
+		return ref("ReviewSummary")
+	}
+	return &Schema{}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// route is one registration in setupRoutes, such as
+// api.Get("/accounts/:accountId", getAccount).
+type route struct {
+	method  string
+	path    string // In Fiber syntax
+	handler ast.Expr
+	roles   []string // From server.RequireRole middleware
+
+	operation *Operation // Prebuilt, for routes pkg/server serves
+}
+
+var routeMethods = map[string]bool{
+	"Get": true, "Post": true, "Put": true, "Patch": true, "Delete": true,
+}
+
+// routes lists what setupRoutes registers, in order, following the
+// prefixes of the groups it creates, and leaving out the routes of other
+// profiles than the source's.
+func (s *source) routes() []route {
+	fn, ok := s.funcs["setupRoutes"]
+	if !ok {
+		return nil
+	}
+	prefixes := map[string]string{fn.Type.Params.List[0].Names[0].Name: ""}
+	groupRoles := map[string][]string{}
+
+	var routes []route
+	var visit func(n ast.Node) bool
+	visit = func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.IfStmt:
+			name, ok := profileCond(n.Cond)
+			if !ok {
+				return true
+			}
+			if n.Init != nil {
+				ast.Inspect(n.Init, visit)
+			}
+			if name == s.profile {
+				ast.Inspect(n.Body, visit)
+			} else if n.Else != nil {
+				ast.Inspect(n.Else, visit)
+			}
+			return false
+		case *ast.AssignStmt:
+			if len(n.Lhs) != 1 || len(n.Rhs) != 1 {
+				return true
+			}
+			lhs, _ := n.Lhs[0].(*ast.Ident)
+			parent, method, args := call(n.Rhs[0])
+			if lhs == nil || method != "Group" || len(args) == 0 {
+				return true
+			}
+			if prefix, ok := prefixes[parent]; ok {
+				prefixes[lhs.Name] = prefix + stringLit(args[0])
+				groupRoles[lhs.Name] = concat(groupRoles[parent], requiredRoles(args[1:]))
+			}
+			return false
+		case *ast.CallExpr:
+			parent, method, args := call(n)
+			prefix, ok := prefixes[parent]
+			if !ok || !routeMethods[method] || len(args) < 2 {
+				return true
+			}
+			routes = append(routes, route{
+				method:  strings.ToLower(method),
+				path:    prefix + stringLit(args[0]),
+				handler: args[len(args)-1],
+				roles:   concat(groupRoles[parent], requiredRoles(args[1:len(args)-1])),
+			})
+			return false
+		}
+		return true
+	}
+	ast.Inspect(fn.Body, visit)
+	return routes
+}
+
+// profileCond returns the profile a condition like
+// server.Profile() == "v2" checks for, if it is one.
+func profileCond(e ast.Expr) (string, bool) {
+	bin, ok := e.(*ast.BinaryExpr)
+	if !ok || bin.Op != token.EQL {
+		return "", false
+	}
+	for _, pair := range [][2]ast.Expr{{bin.X, bin.Y}, {bin.Y, bin.X}} {
+		pkg, method, args := call(pair[0])
+		if pkg == "server" && method == "Profile" && len(args) == 0 {
+			if name := stringLit(pair[1]); name != "" {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// call splits x.method(args...) into its parts, if e is such a call on a
+// plain identifier.
+func call(e ast.Expr) (x, method string, args []ast.Expr) {
+	ce, ok := e.(*ast.CallExpr)
+	if !ok {
+		return "", "", nil
+	}
+	sel, ok := ce.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return "", "", nil
+	}
+	id, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return "", sel.Sel.Name, ce.Args
+	}
+	return id.Name, sel.Sel.Name, ce.Args
+}
+
+// requiredRoles finds server.RequireRole(server.RoleX, ...) among
+// middleware and returns the roles, such as "partner".
+func requiredRoles(middleware []ast.Expr) []string {
+	var roles []string
+	for _, m := range middleware {
+		pkg, method, args := call(m)
+		if pkg != "server" || method != "RequireRole" {
+			continue
+		}
+		for _, arg := range args {
+			if sel, ok := arg.(*ast.SelectorExpr); ok {
+				roles = append(roles, strings.ToLower(strings.TrimPrefix(sel.Sel.Name, "Role")))
+			}
+		}
+	}
+	return roles
+}
+
+func concat(a, b []string) []string {
+	return append(append([]string(nil), a...), b...)
+}
+
+func stringLit(e ast.Expr) string {
+	if lit, ok := e.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+		if s, err := strconv.Unquote(lit.Value); err == nil {
+			return s
+		}
+	}
+	return ""
+}
+
+// openAPIPath converts a Fiber path to OpenAPI syntax and returns its
+// parameters: /users/:email/cart becomes /users/{email}/cart.
+func openAPIPath(path string) (string, []string) {
+	var params []string
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if name, ok := strings.CutPrefix(seg, ":"); ok {
+			name = strings.TrimSuffix(name, "?")
+			params = append(params, name)
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
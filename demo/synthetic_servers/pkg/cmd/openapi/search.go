@@ -0,0 +1,86 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+)
+
+// searchCollections returns the collections the server.Database in main
+// lists as Search, which pkg/server searches across, or nil.
+func (s *source) searchCollections() []string {
+	fn, ok := s.funcs["main"]
+	if !ok {
+		return nil
+	}
+	var collections []string
+	ast.Inspect(fn, func(n ast.Node) bool {
+		lit, ok := n.(*ast.CompositeLit)
+		if !ok {
+			return true
+		}
+		if sel, ok := lit.Type.(*ast.SelectorExpr); !ok || sel.Sel.Name != "Database" {
+			return true
+		}
+		for _, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if key, isIdent := kv.Key.(*ast.Ident); !ok || !isIdent || key.Name != "Search" {
+				continue
+			}
+			list, ok := kv.Value.(*ast.CompositeLit)
+			if !ok {
+				continue
+			}
+			for _, e := range list.Elts {
+				if b, ok := e.(*ast.BasicLit); ok && b.Kind == token.STRING {
+					if name, err := strconv.Unquote(b.Value); err == nil {
+						collections = append(collections, name)
+					}
+				}
+			}
+		}
+		return false
+	})
+	return collections
+}
+
+// searchRoutes describes the search pkg/server serves across collections,
+// for databases that list them as Search.
+func (s *source) searchRoutes(collections []string) []route {
+	s.schemas["SearchGroup"] = &Schema{
+		Type:        "object",
+		Description: "The entities of one collection a search found, best first.",
+		Required:    []string{"type", "total", "data"},
+		Properties: map[string]*Schema{
+			"type":  {Type: "string", Enum: collections, Description: "The collection"},
+			"total": {Type: "integer", Description: "Matching entities of the type, across pages"},
+			"data":  {Type: "array", Items: &Schema{Type: "object"}, Description: "As the collection's own endpoints serve them"},
+		},
+	}
+	fail := func(status int) Response {
+		return Response{Description: statusText(status), Content: jsonContent(errorSchema)}
+	}
+	return []route{
+		{method: "get", path: "/api/v1/search", operation: &Operation{
+			Summary:     "Search across collections",
+			Description: "Finds entities whose text has every word of the query, or words starting with them, grouped by collection. Your own entities are among them, but not other users'.",
+			Parameters: []Parameter{
+				{Name: "q", In: "query", Required: true, Description: "Words to search for", Schema: &Schema{Type: "string"}},
+				{Name: "type", In: "query", Description: "Comma-separated collections to search, instead of all of them", Schema: &Schema{Type: "string"}},
+				{Name: "limit", In: "query", Description: "Results of each type to respond with, 10 by default and at most 100", Schema: &Schema{Type: "integer"}},
+			},
+			Responses: map[string]Response{
+				"200": {Description: "Success", Content: jsonContent(&Schema{
+					Type:     "object",
+					Required: []string{"query", "total", "groups"},
+					Properties: map[string]*Schema{
+						"query":  {Type: "string"},
+						"total":  {Type: "integer", Description: "Matching entities of every type"},
+						"groups": {Type: "array", Items: &Schema{Ref: "#/components/schemas/SearchGroup"}, Description: "One for each type with results, in the server's order"},
+					},
+				})},
+				"400": fail(400),
+			},
+		}},
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// source is a server's package main, indexed by declaration name.
+type source struct {
+	funcs    map[string]*ast.FuncDecl // Top-level functions
+	methods  map[string]*ast.FuncDecl // Methods, by name, preferring *Database's
+	handlers map[string]*ast.FuncDecl // Methods of the server's handlers, by name
+	types    map[string]*ast.TypeSpec
+	enums    map[string][]string // String constants, by their named type
+	profile  string              // The server profile whose routes to describe
+
+	schemas map[string]*Schema // Components built so far
+}
+
+func load(dir string) (*source, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &source{
+		funcs:    make(map[string]*ast.FuncDecl),
+		methods:  make(map[string]*ast.FuncDecl),
+		handlers: make(map[string]*ast.FuncDecl),
+		types:    make(map[string]*ast.TypeSpec),
+		enums:    make(map[string][]string),
+		schemas:  make(map[string]*Schema),
+	}
+	pkg, ok := pkgs["main"]
+	if !ok {
+		return nil, &os.PathError{Op: "load", Path: filepath.Join(dir, "*.go"), Err: os.ErrNotExist}
+	}
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					src.funcs[decl.Name.Name] = decl
+				} else if receiver(decl) == "handlers" {
+					src.handlers[decl.Name.Name] = decl
+				} else if _, seen := src.methods[decl.Name.Name]; !seen || receiver(decl) == "Database" {
+					src.methods[decl.Name.Name] = decl
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						if spec.Doc == nil && len(decl.Specs) == 1 {
+							spec.Doc = decl.Doc
+						}
+						src.types[spec.Name.Name] = spec
+					case *ast.ValueSpec:
+						if decl.Tok == token.CONST {
+							src.addEnum(spec)
+						}
+					}
+				}
+			}
+		}
+	}
+	return src, nil
+}
+
+// addEnum records the values of string constants of a named type, such
+// as RideStatusRequested RideStatus = "requested", as the values of that
+// type.
+func (s *source) addEnum(spec *ast.ValueSpec) {
+	typ, ok := spec.Type.(*ast.Ident)
+	if !ok {
+		return
+	}
+	for _, v := range spec.Values {
+		if lit, ok := v.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			if value, err := strconv.Unquote(lit.Value); err == nil {
+				s.enums[typ.Name] = append(s.enums[typ.Name], value)
+			}
+		}
+	}
+}
+
+func receiver(fn *ast.FuncDecl) string {
+	t := fn.Recv.List[0].Type
+	if star, ok := t.(*ast.StarExpr); ok {
+		t = star.X
+	}
+	if id, ok := t.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// schema describes values of the Go type t.
+func (s *source) schema(t ast.Expr) *Schema {
+	switch t := t.(type) {
+	case *ast.Ident:
+		return s.named(t.Name)
+	case *ast.StarExpr:
+		return s.schema(t.X)
+	case *ast.ParenExpr:
+		return s.schema(t.X)
+	case *ast.ArrayType:
+		if id, ok := t.Elt.(*ast.Ident); ok && id.Name == "byte" {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: s.schema(t.Elt)}
+	case *ast.MapType:
+		return &Schema{Type: "object", AdditionalProperties: s.schema(t.Value)}
+	case *ast.IndexExpr:
+		if elem := repositoryElem(t); elem != nil {
+			return &Schema{Type: "object", AdditionalProperties: s.schema(elem)}
+		}
+	case *ast.StructType:
+		return s.object(t)
+	case *ast.SelectorExpr:
+		pkg, _ := t.X.(*ast.Ident)
+		switch pkg.Name + "." + t.Sel.Name {
+		case "time.Time":
+			return &Schema{Type: "string", Format: "date-time"}
+		case "time.Duration":
+			return &Schema{Type: "integer", Format: "int64"}
+		case "money.Money":
+			return &Schema{Type: "number"}
+		case "fiber.Map":
+			return &Schema{Type: "object"}
+		case "server.StoredFile":
+			return s.storedFileSchema()
+		}
+		switch pkg.Name {
+		case "reviews":
+			return s.reviewSchema(t.Sel.Name)
+		case "availability":
+			return s.availabilitySchema(t.Sel.Name)
+		case "statemachine":
+			return s.statemachineSchema(t.Sel.Name)
+		}
+	}
+	return &Schema{}
+}
+
+func (s *source) named(name string) *Schema {
+	switch name {
+	case "string":
+		return &Schema{Type: "string"}
+	case "bool":
+		return &Schema{Type: "boolean"}
+	case "int", "int8", "int16", "int32", "uint", "uint8", "uint16", "uint32":
+		return &Schema{Type: "integer"}
+	case "int64", "uint64":
+		return &Schema{Type: "integer", Format: "int64"}
+	case "float32", "float64":
+		return &Schema{Type: "number"}
+	}
+
+	ts, ok := s.types[name]
+	if !ok || ts.TypeParams != nil {
+		return &Schema{}
+	}
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok {
+		schema := s.schema(ts.Type)
+		if schema.Type == "string" {
+			schema.Enum = s.enums[name] // Its constants, if it has any
+		}
+		return schema
+	}
+	if _, ok := s.schemas[name]; !ok {
+		s.schemas[name] = nil // Breaks cycles
+		obj := s.object(st)
+		obj.Description = firstSentence(ts.Doc)
+		s.schemas[name] = obj
+	}
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// object describes a struct as encoding/json marshals it.
+func (s *source) object(st *ast.StructType) *Schema {
+	obj := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for _, field := range st.Fields.List {
+		name, _ := jsonName(field)
+		if name == "-" {
+			continue
+		}
+		if len(field.Names) == 0 && name == "" {
+			// Embedded structs are flattened.
+			if id, ok := field.Type.(*ast.Ident); ok {
+				if ts, ok := s.types[id.Name]; ok {
+					if est, ok := ts.Type.(*ast.StructType); ok {
+						embedded := s.object(est)
+						for k, v := range embedded.Properties {
+							obj.Properties[k] = v
+						}
+						obj.Required = append(obj.Required, embedded.Required...)
+					}
+				}
+			}
+			if sel, ok := field.Type.(*ast.SelectorExpr); ok && sel.Sel.Name == "SoftDelete" {
+				obj.Properties["deleted_at"] = &Schema{Type: "string", Format: "date-time", Nullable: true}
+			}
+			continue
+		}
+		if len(field.Names) > 0 && !field.Names[0].IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Names[0].Name
+		}
+
+		prop := s.schema(field.Type)
+		if _, ok := field.Type.(*ast.StarExpr); ok && prop.Ref == "" {
+			prop.Nullable = true
+		}
+		if field.Comment != nil && prop.Ref == "" {
+			prop.Description = strings.TrimSpace(field.Comment.Text())
+		}
+		if constrain(prop, field) {
+			obj.Required = append(obj.Required, name)
+		}
+		obj.Properties[name] = prop
+	}
+	return obj
+}
+
+// constrain adds the rules in a field's validate tag, as checked by
+// server.Validate, to its schema and reports whether the field is required.
+func constrain(prop *Schema, field *ast.Field) bool {
+	if field.Tag == nil {
+		return false
+	}
+	tag, ok := reflect.StructTag(strings.Trim(field.Tag.Value, "`")).Lookup("validate")
+	if !ok {
+		return false
+	}
+
+	required := false
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		if name == "required" {
+			required = true
+		}
+		if prop.Ref != "" {
+			continue // Siblings of $ref are ignored
+		}
+		bound, _ := strconv.ParseFloat(arg, 64)
+		switch name {
+		case "email":
+			prop.Format = "email"
+		case "date":
+			prop.Format = "date"
+		case "datetime":
+			prop.Format = "date-time"
+		case "oneof":
+			prop.Enum = strings.Fields(arg)
+		case "min", "gte", "gt":
+			switch prop.Type {
+			case "string":
+				prop.MinLength = &bound
+			case "array":
+				prop.MinItems = &bound
+			default:
+				prop.Minimum = &bound
+				prop.ExclusiveMinimum = name == "gt"
+			}
+		case "max":
+			switch prop.Type {
+			case "string":
+				prop.MaxLength = &bound
+			case "array":
+				prop.MaxItems = &bound
+			default:
+				prop.Maximum = &bound
+			}
+		}
+	}
+	return required
+}
+
+// jsonName returns a field's json tag name and whether it is omitempty.
+func jsonName(field *ast.Field) (string, bool) {
+	if field.Tag == nil {
+		return "", false
+	}
+	tag := reflect.StructTag(strings.Trim(field.Tag.Value, "`")).Get("json")
+	name, opts, _ := strings.Cut(tag, ",")
+	return name, strings.Contains(opts, "omitempty")
+}
+
+// firstSentence returns the first sentence of a doc comment.
+func firstSentence(doc *ast.CommentGroup) string {
+	if doc == nil {
+		return ""
+	}
+	text := doc.Text()
+	if i := strings.Index(text, "\n\n"); i >= 0 {
+		text = text[:i]
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if i := strings.Index(text, ". "); i >= 0 {
+		text = text[:i+1]
+	}
+	return text
+}
@@ -0,0 +1,20 @@
+package main
+
+// statemachineSchema refers to the schema of the pkg/statemachine type
+// name, adding it to the components as StatusTransition.
+func (s *source) statemachineSchema(name string) *Schema {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	if name != "Transition" {
+		return &Schema{}
+	}
+	s.schemas["StatusTransition"] = &Schema{
+		Type:        "object",
+		Description: "A change of status, and when it was made.",
+		Properties: map[string]*Schema{
+			"from": str(),
+			"to":   str(),
+			"at":   {Type: "string", Format: "date-time"},
+		},
+	}
+	return &Schema{Ref: "#/components/schemas/StatusTransition"}
+}
@@ -0,0 +1,77 @@
+package main
+
+// webhookRoutes describes the webhook routes pkg/server serves for every
+// server's database.
+func (s *source) webhookRoutes() []route {
+	str := func() *Schema { return &Schema{Type: "string"} }
+	dateTime := func() *Schema { return &Schema{Type: "string", Format: "date-time"} }
+	events := &Schema{Type: "array", Items: str(), MinItems: ptr(1.0)}
+	s.schemas["Webhook"] = &Schema{
+		Type:        "object",
+		Description: "A callback URL subscribed to events, named by type (orders.updated), entity and action (order.updated) or entity and new status (booking.cancelled); * subscribes to all. Deliveries are signed in X-Webhook-Signature as sha256=hex(HMAC-SHA256(secret, X-Webhook-Timestamp + \".\" + body)).",
+		Properties: map[string]*Schema{
+			"id":         str(),
+			"url":        str(),
+			"events":     events,
+			"secret":     {Type: "string", Description: "Signing secret, only returned on creation"},
+			"owner":      str(),
+			"created_at": dateTime(),
+		},
+	}
+	s.schemas["WebhookDelivery"] = &Schema{
+		Type:        "object",
+		Description: "The sending of one event to a webhook, retried with exponential backoff.",
+		Properties: map[string]*Schema{
+			"id":              str(),
+			"event":           str(),
+			"event_id":        {Type: "integer"},
+			"status":          {Type: "string", Enum: []string{"pending", "succeeded", "failed"}},
+			"attempts":        {Type: "integer"},
+			"response_code":   {Type: "integer"},
+			"error":           str(),
+			"next_attempt_at": dateTime(),
+			"created_at":      dateTime(),
+		},
+	}
+	ref := func(name string) *Schema { return &Schema{Ref: "#/components/schemas/" + name} }
+	ok := func(s *Schema) Response { return Response{Description: "Success", Content: jsonContent(s)} }
+	fail := func(status int) Response {
+		return Response{Description: statusText(status), Content: jsonContent(errorSchema)}
+	}
+	id := []Parameter{{Name: "id", In: "path", Required: true, Schema: str()}}
+
+	return []route{
+		{method: "post", path: "/api/v1/webhooks", operation: &Operation{
+			Summary: "Register a webhook",
+			RequestBody: &RequestBody{Required: true, Content: jsonContent(&Schema{
+				Type:     "object",
+				Required: []string{"url", "events"},
+				Properties: map[string]*Schema{
+					"url":    str(),
+					"events": events,
+					"secret": {Type: "string", Description: "Signing secret; generated if omitted"},
+				},
+			})},
+			Responses: map[string]Response{"201": ok(ref("Webhook")), "400": fail(400), "401": fail(401), "422": {Description: statusText(422), Content: jsonContent(validationErrorSchema)}},
+		}},
+		{method: "get", path: "/api/v1/webhooks", operation: &Operation{
+			Summary:   "List your webhooks",
+			Responses: map[string]Response{"200": ok(&Schema{Type: "array", Items: ref("Webhook")}), "400": fail(400), "401": fail(401)},
+		}},
+		{method: "get", path: "/api/v1/webhooks/:id", operation: &Operation{
+			Summary:    "Get a webhook",
+			Parameters: id,
+			Responses:  map[string]Response{"200": ok(ref("Webhook")), "404": fail(404)},
+		}},
+		{method: "delete", path: "/api/v1/webhooks/:id", operation: &Operation{
+			Summary:    "Unregister a webhook",
+			Parameters: id,
+			Responses:  map[string]Response{"204": {Description: "Success"}, "404": fail(404)},
+		}},
+		{method: "get", path: "/api/v1/webhooks/:id/deliveries", operation: &Operation{
+			Summary:    "List a webhook's recent deliveries, newest first",
+			Parameters: id,
+			Responses:  map[string]Response{"200": ok(&Schema{Type: "array", Items: ref("WebhookDelivery")}), "404": fail(404)},
+		}},
+	}
+}
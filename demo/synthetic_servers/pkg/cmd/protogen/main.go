@@ -0,0 +1,41 @@
+// Command protogen writes a server's gRPC API, as a .proto file, from its
+// OpenAPI spec. Run it in the server's directory after openapi, usually
+// through go generate:
+//
+//	//go:generate go run pkg/cmd/openapi
+//	//go:generate go run pkg/cmd/protogen
+//
+// The file describes what the server serves on --grpc-port; see package
+// grpcapi for how the spec maps to it.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"pkg/grpcapi"
+)
+
+func main() {
+	in := flag.String("spec", "openapi.json", "OpenAPI spec to describe")
+	out := flag.String("o", "api.proto", "Where to write the .proto file")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("protogen: ")
+
+	spec, err := os.ReadFile(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	api, err := grpcapi.New(spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := api.Descriptor(); err != nil {
+		log.Fatalf("invalid API: %v", err)
+	}
+	if err := os.WriteFile(*out, api.Proto(), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,283 @@
+// Command runall runs every synthetic server in a directory at once, each
+// on its port from the directory's ports.json. Run it from pkg, passing
+// the servers any flags of their own after --:
+//
+//	go run ./cmd/runall -servers ../v1 -- --admin-token secret
+//
+// It builds the servers, starts each as a subprocess in its directory, and
+// restarts any that exit, backing off while one keeps crashing. Once they
+// are up it prints which service is on which port, and serves the same map
+// as JSON at GET /services on -addr, with each server's state and restart
+// count. GET /registry there lists the services for harnesses to
+// enumerate: each one's description and version from its OpenAPI spec, its
+// URL and spec URL, and the collections in its seed dataset. With
+// -grpc-offset, each server also serves its API over gRPC, on its port
+// plus the offset. An interrupt stops the servers gracefully.
+//
+// A server whose port is taken, by another copy of it perhaps, runs on a
+// free port instead, and with -any-port they all do, so that several sets
+// of servers can run side by side. The service map and the registry give
+// the ports they got, and -ports-file writes them out as a ports.json for
+// the gateway's and loadgen's -ports.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"pkg/registry"
+)
+
+func main() {
+	dir := flag.String("servers", "../v1", "Directory of servers to run, with their ports in "+registry.Manifest)
+	only := flag.String("only", "", "Comma-separated services to run, instead of all of them")
+	addr := flag.String("addr", ":8100", "Address to serve the service map on; empty to not serve it")
+	logs := flag.String("logs", "", "Directory to write each server's log to, as <service>.log; the servers log to standard error, prefixed with their name, if empty")
+	jobs := flag.Int("j", runtime.NumCPU(), "Servers to build at once")
+	anyPort := flag.Bool("any-port", false, "Run every server on a free port, rather than its own from "+registry.Manifest)
+	portsFile := flag.String("ports-file", "", "File to write the ports the servers got to, in the form of "+registry.Manifest+", whenever one starts (default: none)")
+	grpcOffset := flag.Int("grpc-offset", 0, "Serve each server's API over gRPC too, on its port plus this, e.g. 1000 for 9101 alongside 8101 (default: off)")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("runall: ")
+	log.SetOutput(&prefixWriter{w: os.Stderr}) // So as not to break up the servers' lines
+
+	services, err := registry.Discover(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *only != "" {
+		var picked []registry.Service
+		for _, name := range strings.Split(*only, ",") {
+			svc, ok := registry.Find(services, strings.TrimSpace(name))
+			if !ok {
+				log.Fatalf("-only: no server %q in %s", name, *dir)
+			}
+			picked = append(picked, svc)
+		}
+		services = picked
+	}
+	if len(services) == 0 {
+		log.Fatalf("no servers in %s", *dir)
+	}
+	for _, svc := range services {
+		if svc.Assigned {
+			log.Printf("%s isn't in %s; giving it port %d", svc.Name, registry.Manifest, svc.Port)
+		}
+	}
+	if *logs != "" {
+		if err := os.MkdirAll(*logs, 0o755); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	bin, err := os.MkdirTemp("", "runall")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	log.Printf("Building %d servers", len(services))
+	procs := buildAll(ctx, services, bin, *jobs)
+	if ctx.Err() != nil {
+		return
+	}
+
+	writePorts := func() {}
+	if *portsFile != "" {
+		var mu sync.Mutex
+		writePorts = func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if err := savePorts(*portsFile, procs); err != nil {
+				log.Printf("-ports-file: %v", err)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	for _, p := range procs {
+		if p.bin == "" {
+			continue
+		}
+		p.onReady = writePorts
+		switch {
+		case *anyPort:
+			p.anyPort = true
+		case !portFree(p.svc.Port):
+			log.Printf("Port %d is taken; running %s on a free one", p.svc.Port, p.svc.Name)
+			p.anyPort = true
+		}
+		p.portFile = filepath.Join(bin, p.svc.Name+".port")
+		out, err := p.output(*logs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		args := flag.Args()
+		if *grpcOffset != 0 && p.anyPort {
+			log.Printf("%s has no port of its own to serve gRPC beside; serving it over REST only", p.svc.Name)
+		} else if *grpcOffset != 0 {
+			args = append([]string{"--grpc-port", strconv.Itoa(p.svc.Port + *grpcOffset)}, args...)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer out.Close()
+			p.supervise(ctx, args, out)
+		}()
+	}
+	if *addr != "" {
+		entries, errs := registry.Describe(services, func(svc registry.Service) string {
+			return fmt.Sprintf("http://localhost:%d", svc.Port)
+		})
+		for _, err := range errs {
+			log.Printf("Describing the services: %v", err)
+		}
+		go serve(ctx, *addr, procs, entries)
+	}
+	waitReady(ctx, procs)
+	printMap(procs, *addr)
+
+	<-ctx.Done()
+	log.Printf("Stopping the servers")
+	wg.Wait()
+	if *portsFile != "" {
+		os.Remove(*portsFile) // Its ports are free again
+	}
+}
+
+// buildAll builds the services' binaries into bin, jobs at a time. Those
+// that fail to build are logged and left without a binary.
+func buildAll(ctx context.Context, services []registry.Service, bin string, jobs int) []*process {
+	procs := make([]*process, len(services))
+	sem := make(chan struct{}, max(jobs, 1))
+	var wg sync.WaitGroup
+	for i, svc := range services {
+		procs[i] = &process{svc: svc, state: stateFailed}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			path, err := build(ctx, svc, bin)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Print(err)
+				}
+				return
+			}
+			procs[i].bin, procs[i].state = path, stateStarting
+		}()
+	}
+	wg.Wait()
+	return procs
+}
+
+// waitReady waits until every server that built is ready, or a minute has
+// passed.
+func waitReady(ctx context.Context, procs []*process) {
+	deadline := time.Now().Add(time.Minute)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		pending := 0
+		for _, p := range procs {
+			if s := p.status(); s.State == stateStarting || s.State == stateRestarting {
+				pending++
+			}
+		}
+		if pending == 0 {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// printMap prints which service is on which port.
+func printMap(procs []*process, addr string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tURL\tSTATE")
+	for _, p := range procs {
+		s := p.status()
+		fmt.Fprintf(w, "%s\thttp://localhost:%d\t%s\n", s.Name, s.Port, s.State)
+	}
+	w.Flush()
+	if addr != "" {
+		host, port, _ := strings.Cut(addr, ":")
+		if host == "" {
+			host = "localhost"
+		}
+		fmt.Printf("\nThe service map is at http://%s:%s/services\n", host, port)
+	}
+}
+
+// savePorts writes the ports the servers that built are on, as far as they
+// are known, to path as a ports manifest, replacing it whole so readers
+// never see it half written.
+func savePorts(path string, procs []*process) error {
+	ports := make(map[string]int)
+	for _, p := range procs {
+		if s := p.status(); p.bin != "" && (!p.anyPort || s.State == stateReady) { // Else its port isn't known yet
+			ports[s.Name] = s.Port
+		}
+	}
+	data, err := json.MarshalIndent(ports, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// serve serves the service map at GET /services, and the registry at GET
+// /registry, until ctx is done.
+func serve(ctx context.Context, addr string, procs []*process, entries []registry.Entry) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /services", func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]status, len(procs))
+		for i, p := range procs {
+			statuses[i] = p.status()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	})
+	mux.HandleFunc("GET /registry", func(w http.ResponseWriter, r *http.Request) {
+		current := make([]registry.Entry, len(entries))
+		for i, e := range entries {
+			current[i] = e
+			for _, p := range procs {
+				if s := p.status(); s.Name == e.Name && s.Port != e.Port { // Running on a free port
+					current[i].Port, current[i].URL = s.Port, s.URL
+					current[i].SpecURL = s.URL + "/openapi.json"
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(current)
+	})
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Serving the service map: %v", err)
+	}
+}
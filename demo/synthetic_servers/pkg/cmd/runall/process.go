@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"pkg/registry"
+)
+
+// Server states.
+const (
+	stateStarting   = "starting"
+	stateReady      = "ready"
+	stateRestarting = "restarting" // Exited, and waiting to start again
+	stateFailed     = "failed"     // Didn't build
+	stateStopped    = "stopped"
+)
+
+const (
+	// minBackoff and maxBackoff bound how long a crashed server waits to
+	// restart; the wait doubles while it keeps crashing.
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+	// stableAfter is how long a server must run for its next crash to
+	// restart it without delay again.
+	stableAfter = time.Minute
+	// stopTimeout is how long a server gets to shut down before it is
+	// killed.
+	stopTimeout = 15 * time.Second
+)
+
+// process runs a server, restarting it whenever it exits.
+type process struct {
+	svc      registry.Service // Its Port is the one it's on, once it's ready
+	bin      string           // Its binary; empty if it didn't build
+	anyPort  bool             // Run it on a free port, which it writes to portFile, rather than its own
+	portFile string
+	onReady  func() // Called whenever it's ready; may be nil
+
+	mu       sync.Mutex
+	state    string
+	pid      int
+	restarts int
+	since    time.Time // When it entered its state
+}
+
+// status is what the service map says about a server.
+type status struct {
+	Name     string    `json:"name"`
+	Port     int       `json:"port"`
+	URL      string    `json:"url"`
+	State    string    `json:"state"`
+	PID      int       `json:"pid,omitempty"`
+	Restarts int       `json:"restarts"`
+	Since    time.Time `json:"since"`
+}
+
+func (p *process) status() status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return status{
+		Name:     p.svc.Name,
+		Port:     p.svc.Port,
+		URL:      fmt.Sprintf("http://localhost:%d", p.svc.Port),
+		State:    p.state,
+		PID:      p.pid,
+		Restarts: p.restarts,
+		Since:    p.since,
+	}
+}
+
+func (p *process) setState(state string, pid int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state, p.pid, p.since = state, pid, time.Now()
+}
+
+// build compiles a server into bin, returning the binary's path.
+func build(ctx context.Context, svc registry.Service, bin string) (string, error) {
+	path := filepath.Join(bin, svc.Name)
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", path, ".")
+	cmd.Dir = svc.Dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("building %s: %v\n%s", svc.Name, err, bytes.TrimSpace(out))
+	}
+	return path, nil
+}
+
+// output returns where the server's log goes: a file in dir, or standard
+// error with each line prefixed by the service's name.
+func (p *process) output(dir string) (io.WriteCloser, error) {
+	if dir != "" {
+		return os.OpenFile(filepath.Join(dir, p.svc.Name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	}
+	return &prefixWriter{prefix: p.svc.Name + " | ", w: os.Stderr}, nil
+}
+
+// supervise runs the server with args until ctx is done, restarting it
+// whenever it exits, and then stops it.
+func (p *process) supervise(ctx context.Context, args []string, out io.Writer) {
+	backoff := minBackoff
+	for {
+		port := []string{"--port", strconv.Itoa(p.svc.Port)}
+		if p.anyPort {
+			os.Remove(p.portFile) // The last run's
+			port = []string{"--port", "0", "--port-file", p.portFile}
+		}
+		cmd := exec.Command(p.bin, append(port, args...)...)
+		cmd.Dir = p.svc.Dir // For its database.json and openapi.json
+		cmd.Stdout, cmd.Stderr = out, out
+		started := time.Now()
+		err := cmd.Start()
+		if err == nil {
+			p.setState(stateStarting, cmd.Process.Pid)
+			done := make(chan error, 1)
+			go func() { done <- cmd.Wait() }()
+			go p.awaitReady(ctx, cmd.Process.Pid)
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				stop(cmd, done)
+				p.setState(stateStopped, 0)
+				return
+			}
+		}
+
+		if time.Since(started) > stableAfter {
+			backoff = minBackoff
+		}
+		log.Printf("%s exited (%v); restarting in %s", p.svc.Name, err, backoff)
+		p.setState(stateRestarting, 0)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			p.setState(stateStopped, 0)
+			return
+		}
+		backoff = min(2*backoff, maxBackoff)
+		p.mu.Lock()
+		p.restarts++
+		p.mu.Unlock()
+	}
+}
+
+// stop asks a server to shut down, and kills it if it hasn't within
+// stopTimeout.
+func stop(cmd *exec.Cmd, done <-chan error) {
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		cmd.Process.Kill()
+		<-done
+	}
+}
+
+// awaitReady polls the server's /readyz until it answers 200, then marks
+// it ready, unless it has been restarted since as another pid. A server on
+// a free port is polled once it has written the port to its port file.
+func (p *process) awaitReady(ctx context.Context, pid int) {
+	port := p.status().Port
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		p.mu.Lock()
+		current := p.pid == pid && p.state == stateStarting
+		p.mu.Unlock()
+		if !current {
+			return
+		}
+		if p.anyPort {
+			var err error
+			if port, err = readPort(p.portFile); err != nil {
+				continue // Not listening yet
+			}
+		}
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/readyz", port))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			p.mu.Lock()
+			ready := p.pid == pid && p.state == stateStarting
+			if ready {
+				p.state, p.since, p.svc.Port = stateReady, time.Now(), port
+			}
+			p.mu.Unlock()
+			if ready && p.onReady != nil {
+				p.onReady()
+			}
+			return
+		}
+	}
+}
+
+// readPort reads the port a server wrote to its --port-file.
+func readPort(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// portFree reports whether nothing is listening on port yet.
+func portFree(port int) bool {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+// prefixWriter writes whole lines to w, each after prefix. Lines from
+// several servers may interleave, but aren't broken up.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	buf    []byte
+}
+
+var outputMu sync.Mutex // Serializes prefixWriters' writes to their w
+
+func (pw *prefixWriter) Write(data []byte) (int, error) {
+	pw.buf = append(pw.buf, data...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		outputMu.Lock()
+		_, err := io.WriteString(pw.w, pw.prefix+string(pw.buf[:i+1]))
+		outputMu.Unlock()
+		pw.buf = pw.buf[i+1:]
+		if err != nil {
+			return len(data), err
+		}
+	}
+}
+
+func (pw *prefixWriter) Close() error {
+	if len(pw.buf) > 0 {
+		pw.Write([]byte("\n"))
+	}
+	return nil
+}
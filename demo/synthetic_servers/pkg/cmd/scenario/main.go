@@ -0,0 +1,104 @@
+// Command scenario runs scenarios, scripts that set up and check the
+// synthetic servers' state step by step, against servers that are already
+// running with an admin token; see package scenario. Start the servers, for
+// instance with runall, then run scenarios from pkg:
+//
+//	go run ./cmd/runall -- --admin-token secret
+//	go run ./cmd/scenario -admin-token secret ../scenarios/pending_order.yaml
+//
+// It finds each server on its port from the servers' ports.json, or through
+// a gateway with -gateway. -var name=value sets a variable, over the
+// scenario's own. It prints each step that passes, and the one that
+// failed, and exits with status 1 if any scenario failed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"pkg/registry"
+	"pkg/scenario"
+)
+
+// varFlags collects -var name=value flags.
+type varFlags map[string]string
+
+func (v varFlags) String() string { return "" }
+
+func (v varFlags) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("%q isn't name=value", s)
+	}
+	v[name] = value
+	return nil
+}
+
+func main() {
+	dir := flag.String("servers", "../v1", "Directory of servers, with their ports in "+registry.Manifest)
+	gateway := flag.String("gateway", "", "Base URL of a gateway to reach the servers through, instead of their ports")
+	key := flag.String("key", "", "The gateway's API key, if it has -keys")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "The servers' admin token (default: $ADMIN_TOKEN)")
+	given := varFlags{}
+	flag.Var(given, "var", "A variable, as name=value; repeatable")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("scenario: ")
+
+	if flag.NArg() == 0 {
+		log.Fatal("give the scenario files to run")
+	}
+	if *adminToken == "" {
+		log.Fatal("-admin-token is required, as the servers' --admin-token")
+	}
+	services, err := registry.Discover(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := &scenario.Runner{
+		Servers:    make(map[string]string, len(services)),
+		AdminToken: *adminToken,
+		Log:        os.Stdout,
+	}
+	for _, svc := range services {
+		if *gateway != "" {
+			r.Servers[svc.Name] = strings.TrimSuffix(*gateway, "/") + "/" + svc.Name
+		} else {
+			r.Servers[svc.Name] = fmt.Sprintf("http://localhost:%d", svc.Port)
+		}
+	}
+	if *key != "" {
+		r.Header = http.Header{}
+		r.Header.Set("X-API-Key", *key)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var failed int
+	for _, path := range flag.Args() {
+		s, err := scenario.Load(path)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %v\n", err)
+			continue
+		}
+		if _, err := r.Run(ctx, s, given); err != nil {
+			failed++
+			fmt.Printf("FAIL %s\n", strings.ReplaceAll(err.Error(), "\n", "\n    "))
+			continue
+		}
+		fmt.Printf("ok   %s\n", s.Name)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d scenarios failed\n", failed, flag.NArg())
+		os.Exit(1)
+	}
+}
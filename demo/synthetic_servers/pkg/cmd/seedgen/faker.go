@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// place is a city that entities' addresses and coordinates are drawn
+// around.
+type place struct {
+	city, state, zip string
+	lat, lon         float64
+}
+
+var places = []place{
+	{"New York", "NY", "10001", 40.7128, -74.0060},
+	{"Los Angeles", "CA", "90012", 34.0522, -118.2437},
+	{"Chicago", "IL", "60601", 41.8781, -87.6298},
+	{"Houston", "TX", "77002", 29.7604, -95.3698},
+	{"Phoenix", "AZ", "85004", 33.4484, -112.0740},
+	{"Philadelphia", "PA", "19103", 39.9526, -75.1652},
+	{"San Diego", "CA", "92101", 32.7157, -117.1611},
+	{"Dallas", "TX", "75201", 32.7767, -96.7970},
+	{"San Francisco", "CA", "94103", 37.7749, -122.4194},
+	{"Seattle", "WA", "98101", 47.6062, -122.3321},
+	{"Denver", "CO", "80202", 39.7392, -104.9903},
+	{"Boston", "MA", "02108", 42.3601, -71.0589},
+	{"Atlanta", "GA", "30303", 33.7490, -84.3880},
+	{"Miami", "FL", "33131", 25.7617, -80.1918},
+	{"Portland", "OR", "97204", 45.5152, -122.6784},
+	{"Austin", "TX", "78701", 30.2672, -97.7431},
+	{"Nashville", "TN", "37203", 36.1627, -86.7816},
+	{"Minneapolis", "MN", "55401", 44.9778, -93.2650},
+}
+
+var streets = []string{"Main St", "Oak Ave", "Maple Dr", "Pine St", "Cedar Ln", "Elm St", "Washington Ave", "Lake Rd", "Park Blvd", "Hill St", "River Rd", "Sunset Blvd", "Market St", "Broadway", "2nd Ave"}
+
+// point is a spot within a few miles of a place's center.
+type point struct {
+	lat, lon float64
+}
+
+// near returns a point within about five miles of p.
+func (g *generator) near(p place) point {
+	const spread = 0.07 // Degrees of latitude, about five miles
+	return point{
+		lat: round(p.lat+spread*(2*g.rand.Float64()-1), 6),
+		lon: round(p.lon+spread*(2*g.rand.Float64()-1)/math.Cos(p.lat*math.Pi/180), 6),
+	}
+}
+
+func (g *generator) street() string {
+	return fmt.Sprintf("%d %s", 1+g.rand.IntN(9899), pick(g, streets))
+}
+
+// address fakes the address fields of the entity being generated, all in
+// its city; ok is false for other fields.
+func (g *generator) address(field string) (s string, ok bool) {
+	p := g.place
+	switch field {
+	case "street", "street_address", "address_line1", "address1", "line1":
+		return g.street(), true
+	case "city":
+		return p.city, true
+	case "state":
+		return p.state, true
+	case "zip", "zip_code", "zipcode", "postal_code":
+		return p.zip, true
+	case "country":
+		return "US", true
+	case "location", "neighborhood":
+		return p.city + ", " + p.state, true
+	}
+	if field == "address" || strings.HasSuffix(field, "_address") {
+		return fmt.Sprintf("%s, %s, %s %s", g.street(), p.city, p.state, p.zip), true
+	}
+	return "", false
+}
+
+// coordinate fakes latitude and longitude fields, at one point per object
+// near the entity's city; ok is false for other fields.
+func (g *generator) coordinate(field string) (f float64, ok bool) {
+	switch field {
+	case "latitude", "lat", "longitude", "lng", "lon":
+	default:
+		return 0, false
+	}
+	if g.point == nil {
+		pt := g.near(g.place)
+		g.point = &pt
+	}
+	if field == "latitude" || field == "lat" {
+		return g.point.lat, true
+	}
+	return g.point.lon, true
+}
+
+// priceRange is what things cost in a domain, recognized by words in the
+// names of the entity's type and collection.
+type priceRange struct {
+	words  []string
+	lo, hi float64
+}
+
+var priceRanges = []priceRange{
+	{[]string{"flight", "fare", "airline"}, 79, 899},
+	{[]string{"ride", "trip"}, 8, 65},
+	{[]string{"hotel", "room", "stay", "rental"}, 89, 450},
+	{[]string{"menu", "meal", "dish", "food", "drink", "grocery", "recipe", "coffee"}, 3, 35},
+	{[]string{"plan", "subscription", "membership"}, 5, 30},
+	{[]string{"course", "class", "lesson", "workout"}, 10, 200},
+	{[]string{"vehicle", "car"}, 8000, 60000},
+	{[]string{"property", "home", "house", "listing"}, 150000, 1200000},
+	{[]string{"ticket", "event", "show"}, 25, 300},
+}
+
+// defaultPrices is what other things cost.
+var defaultPrices = priceRange{lo: 5, hi: 250}
+
+// price fakes a price for the entity being generated: cheap things more
+// often than dear ones, and under $1,000 ending in .99.
+func (g *generator) price() float64 {
+	r := defaultPrices
+	for i := len(g.context) - 1; i >= 0 && r.words == nil; i-- {
+		for _, pr := range priceRanges {
+			if containsWord(g.context[i], pr.words) {
+				r = pr
+				break
+			}
+		}
+	}
+	f := g.rand.Float64()
+	v := r.lo + (r.hi-r.lo)*f*f
+	if r.hi < 1000 {
+		return math.Floor(v) + 0.99
+	}
+	return math.Round(v/10) * 10
+}
+
+// containsWord reports whether name, in snake or camel case, has one of
+// the words in it, singular or plural.
+func containsWord(name string, words []string) bool {
+	for _, part := range strings.Split(snake(name), "_") {
+		if slices.Contains(words, singular(part)) {
+			return true
+		}
+	}
+	return false
+}
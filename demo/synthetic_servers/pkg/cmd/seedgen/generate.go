@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"math"
+	"math/rand/v2"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"pkg/identity"
+	"pkg/payments"
+	"pkg/server"
+)
+
+// seedPassword is every seeded user's password.
+const seedPassword = "password123"
+
+// maxDepth is how deep lists and maps nest before they come out empty, so
+// recursive models end.
+const maxDepth = 3
+
+// Collections sized by the -users, -products and -orders flags.
+var (
+	userCollections    = []string{"users", "customers", "passengers", "members", "patients", "clients", "guests", "riders", "students"}
+	productCollections = []string{"products", "items", "listings", "menu_items", "catalog"}
+	orderCollections   = []string{"orders", "bookings", "reservations", "rides", "deliveries", "purchases", "appointments", "rentals", "shipments"}
+)
+
+// generator builds a database from a server's models.
+type generator struct {
+	src   *source
+	rand  *rand.Rand
+	start time.Time
+	sizes sizes
+
+	people []person
+	person *person // The user being generated, if any
+
+	// Where the entity being generated is, and the point the object being
+	// generated is at, if it has coordinates.
+	place place
+	point *point
+	// Names of the collection and types being generated, outermost first.
+	context []string
+	// Whether the object being generated is a person, by its fields.
+	someone bool
+
+	collectionOf map[string]string // Collections, by their entities' type
+
+	seq        map[string]int    // IDs handed out, by type
+	keys       map[string]string // Fields keying collections, from the existing seed
+	emailKeyed map[string]bool   // Collections keyed by users' emails
+}
+
+// person is a user; their details recur wherever they're referenced.
+type person struct {
+	first, last, email, phone string
+	home                      place
+}
+
+func newGenerator(src *source, seed uint64, start time.Time, sizes sizes) *generator {
+	g := &generator{
+		src:          src,
+		rand:         rand.New(rand.NewPCG(seed, 0)),
+		start:        start,
+		sizes:        sizes,
+		seq:          make(map[string]int),
+		keys:         make(map[string]string),
+		emailKeyed:   make(map[string]bool),
+		collectionOf: make(map[string]string),
+	}
+	// The directory's people come first, so that generated seeds share
+	// them with the hand-written ones.
+	seen := make(map[string]bool)
+	for _, known := range identity.People() {
+		if len(g.people) == sizes.users {
+			break
+		}
+		a := known.Address
+		g.people = append(g.people, person{
+			first: known.First, last: known.Last, email: known.Email, phone: known.Phone,
+			home: place{a.City, a.State, a.Zip, known.Home.Lat, known.Home.Lon},
+		})
+		seen[strings.TrimSuffix(known.Email, "@email.com")] = true
+	}
+	for i := len(g.people); i < sizes.users; i++ {
+		p := person{first: pick(g, firstNames), last: pick(g, lastNames)}
+		p.email = strings.ToLower(p.first + "." + p.last)
+		if seen[p.email] {
+			p.email += fmt.Sprint(i + 1)
+		}
+		seen[p.email] = true
+		p.email += "@example.com"
+		p.phone = g.phone()
+		p.home = pick(g, places)
+		g.people = append(g.people, p)
+	}
+	return g
+}
+
+// seedKeys learns how the seed at path keys its collections: by which
+// field of their entities, or by users' emails.
+func seedKeys(path string) (keys map[string]string, emailKeyed map[string]bool) {
+	keys, emailKeyed = make(map[string]string), make(map[string]bool)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return keys, emailKeyed
+	}
+	var db map[string]json.RawMessage
+	if json.Unmarshal(data, &db) != nil {
+		return keys, emailKeyed
+	}
+	for name, raw := range db {
+		// Collections that are maps, by their first entity.
+		var coll map[string]any
+		if json.Unmarshal(raw, &coll) != nil || len(coll) == 0 {
+			continue
+		}
+		key := sortedKeys(coll)[0]
+		if fields, ok := coll[key].(map[string]any); ok {
+			for _, field := range sortedKeys(fields) {
+				if fields[field] == key {
+					keys[name] = field
+					break
+				}
+			}
+		}
+		if keys[name] == "" && strings.Contains(key, "@") {
+			emailKeyed[name] = true
+		}
+	}
+	return keys, emailKeyed
+}
+
+// database generates every collection in the Database struct, and tokens
+// for the users if it embeds server.Auth.
+func (g *generator) database() (*object, error) {
+	st, ok := g.src.structType("Database")
+	if !ok {
+		return nil, fmt.Errorf("no Database struct found")
+	}
+	db := newObject()
+	auth := false
+	for _, field := range st.Fields.List {
+		if embedsAuth(field) {
+			auth = true
+			continue
+		}
+		t := collectionType(field.Type)
+		for _, name := range fieldNames(field) {
+			if typ := entityType(t); typ != "" {
+				g.collectionOf[typ] = name
+			}
+			db.set(name, g.collection(name, t))
+		}
+	}
+	if auth {
+		db.set("auth", g.auth())
+	}
+	return db, nil
+}
+
+// collectionType takes a server.Repository[T] for the map[string]T it
+// stands in for, and other collections' types as they are.
+func collectionType(t ast.Expr) ast.Expr {
+	index, ok := t.(*ast.IndexExpr)
+	if !ok {
+		return t
+	}
+	if sel, ok := index.X.(*ast.SelectorExpr); ok && sel.Sel.Name == "Repository" {
+		if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "server" {
+			return &ast.MapType{Key: ast.NewIdent("string"), Value: index.Index}
+		}
+	}
+	return t
+}
+
+// collection generates the entities of a collection, keyed as its entities
+// are if it is a map.
+func (g *generator) collection(name string, t ast.Expr) any {
+	n := g.size(name)
+	switch t := t.(type) {
+	case *ast.MapType:
+		coll := newObject()
+		for i := 0; i < n; i++ {
+			entity := g.entity(name, t.Value, i)
+			coll.set(g.key(name, entity, i), entity)
+		}
+		return coll
+	case *ast.ArrayType:
+		if isByte(t.Elt) {
+			break
+		}
+		list := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			list = append(list, g.entity(name, t.Elt, i))
+		}
+		return list
+	}
+	return g.value(t, singular(name), 0)
+}
+
+func (g *generator) size(name string) int {
+	if n, ok := g.sizes.collections[name]; ok {
+		return n
+	}
+	switch {
+	case slices.Contains(userCollections, name):
+		return g.sizes.users
+	case slices.Contains(productCollections, name):
+		return g.sizes.products
+	case slices.Contains(orderCollections, name):
+		return g.sizes.orders
+	}
+	return g.sizes.other
+}
+
+// entity generates the i'th entity of a collection, somewhere in one
+// city; those of user collections are the i'th person, at home.
+func (g *generator) entity(collection string, t ast.Expr, i int) any {
+	g.place = pick(g, places)
+	if slices.Contains(userCollections, collection) && len(g.people) > 0 {
+		g.person = &g.people[i%len(g.people)]
+		g.place = g.person.home
+		defer func() { g.person = nil }()
+	}
+	g.context = append(g.context, collection)
+	defer func() { g.context = g.context[:len(g.context)-1] }()
+	return g.value(t, singular(collection), 0)
+}
+
+// key returns the key of a collection's i'th entity: the field the
+// existing seed keys it by, else its id or email.
+func (g *generator) key(collection string, entity any, i int) string {
+	if o, ok := entity.(*object); ok {
+		fields := []string{"id", "email"}
+		if f := g.keys[collection]; f != "" {
+			fields = append([]string{f}, fields...)
+		}
+		for _, f := range fields {
+			if s, ok := o.values[f].(string); ok && s != "" {
+				return s
+			}
+		}
+	}
+	if g.emailKeyed[collection] && len(g.people) > 0 {
+		return g.people[i%len(g.people)].email
+	}
+	return fmt.Sprintf("%s_%d", singular(collection), i+1)
+}
+
+// value generates a value of the Go type t for a field.
+func (g *generator) value(t ast.Expr, field string, depth int) any {
+	switch t := t.(type) {
+	case *ast.Ident:
+		return g.named(t.Name, field, depth)
+	case *ast.StarExpr:
+		if depth > 0 && g.rand.IntN(5) == 0 {
+			return nil
+		}
+		return g.value(t.X, field, depth)
+	case *ast.ParenExpr:
+		return g.value(t.X, field, depth)
+	case *ast.ArrayType:
+		if isByte(t.Elt) {
+			return nil
+		}
+		list := []any{}
+		for range g.count(depth) {
+			list = append(list, g.value(t.Elt, singular(field), depth+1))
+		}
+		return list
+	case *ast.MapType:
+		m := newObject()
+		for i := range g.count(depth) {
+			v := g.value(t.Value, singular(field), depth+1)
+			m.set(g.key(field, v, i), v)
+		}
+		return m
+	case *ast.StructType:
+		o := newObject()
+		g.fields(o, t, "", depth)
+		return o
+	case *ast.SelectorExpr:
+		switch pkg, _ := t.X.(*ast.Ident); pkg.Name + "." + t.Sel.Name {
+		case "time.Time":
+			return g.time()
+		case "time.Duration":
+			return time.Duration(1+g.rand.IntN(120)) * time.Minute
+		case "money.Money":
+			return g.float(field)
+		}
+	}
+	return nil
+}
+
+// count is how many entries a nested list or map gets.
+func (g *generator) count(depth int) int {
+	if depth >= maxDepth {
+		return 0
+	}
+	return 1 + g.rand.IntN(3)
+}
+
+func (g *generator) named(name, field string, depth int) any {
+	switch name {
+	case "string":
+		return g.str(field, depth)
+	case "bool":
+		return g.rand.IntN(2) == 0
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64":
+		return g.integer(field)
+	case "float32", "float64":
+		return g.float(field)
+	}
+	if values := g.src.consts[name]; len(values) > 0 {
+		return pick(g, values)
+	}
+	if st, ok := g.src.structType(name); ok {
+		o := newObject()
+		o.typ = name
+		g.fields(o, st, name, depth)
+		return o
+	}
+	if ts, ok := g.src.types[name]; ok {
+		return g.value(ts.Type, field, depth)
+	}
+	return nil
+}
+
+// fields sets the fields of a struct on o, as encoding/json marshals them.
+// Its id, if it is a named type's, is the type's name and a number.
+func (g *generator) fields(o *object, st *ast.StructType, typeName string, depth int) {
+	if typeName != "" {
+		g.context = append(g.context, typeName)
+		defer func() { g.context = g.context[:len(g.context)-1] }()
+	}
+	// Each object is at a point of its own.
+	outer, someone := g.point, g.someone
+	g.point, g.someone = nil, hasField(st, "phone", "email", "first_name")
+	defer func() { g.point, g.someone = outer, someone }()
+	defer inOrder(o)
+
+	for _, field := range st.Fields.List {
+		if len(field.Names) == 0 && jsonName(field) == "" {
+			// Embedded structs are flattened.
+			if id, ok := field.Type.(*ast.Ident); ok {
+				if est, ok := g.src.structType(id.Name); ok {
+					g.fields(o, est, typeName, depth)
+				}
+			}
+			continue
+		}
+		for _, name := range fieldNames(field) {
+			switch values := oneOf(field); {
+			case name == "id" && typeName != "" && g.isString(field.Type):
+				g.seq[typeName]++
+				o.set(name, fmt.Sprintf("%s_%d", snake(typeName), g.seq[typeName]))
+			case len(values) > 0:
+				o.set(name, pick(g, values))
+			default:
+				o.set(name, g.value(field.Type, name, depth+1))
+			}
+		}
+	}
+}
+
+// timePairs are fields that come in order: what's created is updated
+// later, what starts ends later.
+var timePairs = [][2]string{
+	{"created_at", "updated_at"},
+	{"start_date", "end_date"},
+	{"start_time", "end_time"},
+	{"starts_at", "ends_at"},
+	{"departure_time", "arrival_time"},
+	{"check_in", "check_out"},
+	{"check_in_date", "check_out_date"},
+}
+
+// inOrder swaps the times of pairs of fields that came out backward.
+func inOrder(o *object) {
+	for _, pair := range timePairs {
+		first, ok1 := o.values[pair[0]].(time.Time)
+		second, ok2 := o.values[pair[1]].(time.Time)
+		if ok1 && ok2 && second.Before(first) {
+			o.values[pair[0]], o.values[pair[1]] = second, first
+		}
+	}
+}
+
+// hasField reports whether a struct has a field with one of the JSON
+// names.
+func hasField(st *ast.StructType, names ...string) bool {
+	for _, field := range st.Fields.List {
+		for _, name := range fieldNames(field) {
+			if slices.Contains(names, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// entityType returns the name of the type of a collection's entities.
+func entityType(t ast.Expr) string {
+	switch t := t.(type) {
+	case *ast.MapType:
+		return entityType(t.Value)
+	case *ast.ArrayType:
+		return entityType(t.Elt)
+	case *ast.StarExpr:
+		return entityType(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+func (g *generator) isString(t ast.Expr) bool {
+	id, ok := t.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	if id.Name == "string" {
+		return true
+	}
+	ts, ok := g.src.types[id.Name]
+	return ok && g.isString(ts.Type)
+}
+
+// str generates a string that suits the field's name.
+func (g *generator) str(field string, depth int) string {
+	// The user being generated, at their top level.
+	p := g.person
+	if depth != 1 {
+		p = nil
+	}
+	if !strings.Contains(field, "email") && !strings.HasPrefix(field, "ip_") {
+		if s, ok := g.address(field); ok {
+			return s
+		}
+	}
+	switch {
+	case field == "email" && p != nil:
+		return p.email
+	case field == "email" || strings.HasSuffix(field, "_email"):
+		if len(g.people) == 0 {
+			return fmt.Sprintf("user%d@example.com", 1+g.rand.IntN(100))
+		}
+		return g.people[g.rand.IntN(len(g.people))].email
+	case field == "name" && p != nil:
+		return p.first + " " + p.last
+	case field == "first_name" && p != nil:
+		return p.first
+	case field == "last_name" && p != nil:
+		return p.last
+	case field == "name" && g.someone:
+		return pick(g, firstNames) + " " + pick(g, lastNames)
+	case field == "first_name":
+		return pick(g, firstNames)
+	case field == "last_name":
+		return pick(g, lastNames)
+	case strings.Contains(field, "phone") && p != nil:
+		return p.phone
+	case strings.Contains(field, "phone"):
+		return g.phone()
+	case strings.HasSuffix(field, "_id"):
+		return fmt.Sprintf("%s_%d", strings.TrimSuffix(field, "_id"), 1+g.rand.IntN(max(g.size(strings.TrimSuffix(field, "_id")+"s"), 1)))
+	case field == "status":
+		return pick(g, statuses)
+	case field == "make":
+		return pick(g, makes)
+	case field == "model":
+		return pick(g, models)
+	case field == "color":
+		return pick(g, colors)
+	case strings.Contains(field, "plate"):
+		return fmt.Sprintf("%c%c%c%04d", 'A'+g.rand.IntN(26), 'A'+g.rand.IntN(26), 'A'+g.rand.IntN(26), g.rand.IntN(10000))
+	case field == "currency":
+		return "USD"
+	case field == "last4":
+		for {
+			// Not a test card, which always declines
+			last4 := fmt.Sprintf("%04d", g.rand.IntN(10000))
+			if _, ok := payments.TestCards[last4]; !ok {
+				return last4
+			}
+		}
+	case field == "url" || strings.HasSuffix(field, "_url"):
+		return fmt.Sprintf("https://example.com/%s/%d", pick(g, nouns), 1+g.rand.IntN(1000))
+	case field == "description" || field == "bio" || field == "notes" || field == "comment":
+		return g.sentence()
+	}
+	return g.title()
+}
+
+func (g *generator) integer(field string) int {
+	switch {
+	case strings.Contains(field, "quantity") || strings.Contains(field, "count"):
+		return 1 + g.rand.IntN(5)
+	case strings.Contains(field, "month") || strings.HasSuffix(field, "_mm"):
+		return 1 + g.rand.IntN(12)
+	case strings.HasSuffix(field, "_yy"):
+		return g.start.Year()%100 + 1 + g.rand.IntN(5)
+	case strings.Contains(field, "year"):
+		return g.start.Year() - 5 + g.rand.IntN(6)
+	}
+	return g.rand.IntN(100)
+}
+
+func (g *generator) float(field string) float64 {
+	if f, ok := g.coordinate(field); ok {
+		return f
+	}
+	if strings.Contains(field, "price") || strings.Contains(field, "fare") || strings.Contains(field, "cost") {
+		return g.price()
+	}
+	for _, money := range []string{"amount", "total", "balance", "fee", "tax", "tip"} {
+		if strings.Contains(field, money) {
+			return round(1+499*g.rand.Float64(), 2)
+		}
+	}
+	if strings.Contains(field, "rating") {
+		return round(1+4*g.rand.Float64(), 1)
+	}
+	return round(100*g.rand.Float64(), 2)
+}
+
+// time returns a time in the year from the start, to the second.
+func (g *generator) time() time.Time {
+	return g.start.Add(time.Duration(g.rand.Int64N(365*24*60*60)) * time.Second).UTC()
+}
+
+func (g *generator) phone() string {
+	return fmt.Sprintf("555-%03d-%04d", g.rand.IntN(1000), g.rand.IntN(10000))
+}
+
+// title is a couple of capitalized words, like Bright Lantern.
+func (g *generator) title() string {
+	return capitalize(pick(g, adjectives)) + " " + capitalize(pick(g, nouns))
+}
+
+func (g *generator) sentence() string {
+	words := make([]string, 6+g.rand.IntN(6))
+	for i := range words {
+		words[i] = pick(g, lorem)
+	}
+	return capitalize(strings.Join(words, " ")) + "."
+}
+
+// auth gives every user a bearer token, and a login with the seeds'
+// password. They share a salt, which would be bad practice anywhere but
+// here, since hashing is slow.
+func (g *generator) auth() *object {
+	salt := make([]byte, 16)
+	for i := range salt {
+		salt[i] = byte(g.rand.IntN(256))
+	}
+	hash := server.HashPassword(seedPassword, salt)
+
+	tokens, credentials := newObject(), newObject()
+	for _, p := range g.people {
+		tokens.set(fmt.Sprintf("tok_%016x%016x", g.rand.Uint64(), g.rand.Uint64()), p.email)
+		credentials.set(p.email, server.Credential{
+			Email:        p.email,
+			Name:         p.first + " " + p.last,
+			PasswordHash: hash,
+			CreatedAt:    g.start,
+		})
+	}
+	auth := newObject()
+	auth.set("tokens", tokens)
+	auth.set("credentials", credentials)
+	auth.set("sessions", newObject())
+	return auth
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func pick[T any](g *generator, values []T) T {
+	return values[g.rand.IntN(len(values))]
+}
+
+// object is a JSON object that keeps its keys in the order they were set,
+// as encoding/json does a struct's fields.
+type object struct {
+	keys   []string
+	values map[string]any
+	typ    string          // The Go type it was generated from, if any
+	spans  map[string]span // Where decoded values were, by key
+}
+
+func newObject() *object {
+	return &object{values: make(map[string]any)}
+}
+
+func (o *object) set(key string, value any) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// clone copies the object, and the objects and lists in it.
+func (o *object) clone() *object {
+	c := &object{keys: slices.Clone(o.keys), values: make(map[string]any, len(o.values)), typ: o.typ}
+	for k, v := range o.values {
+		c.values[k] = cloneValue(v)
+	}
+	return c
+}
+
+func cloneValue(v any) any {
+	switch v := v.(type) {
+	case *object:
+		return v.clone()
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = cloneValue(item)
+		}
+		return list
+	}
+	return v
+}
+
+func (o *object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// fieldNames returns the JSON names of a struct field's exported names,
+// none if it is skipped or embedded.
+func fieldNames(field *ast.Field) []string {
+	tag := jsonName(field)
+	if tag == "-" {
+		return nil
+	}
+	var names []string
+	for _, name := range field.Names {
+		if !name.IsExported() {
+			continue
+		}
+		if tag != "" {
+			names = append(names, tag)
+		} else {
+			names = append(names, name.Name)
+		}
+	}
+	return names
+}
+
+// oneOf returns the values a field's validate tag allows, if it lists
+// them.
+func oneOf(field *ast.Field) []string {
+	if field.Tag == nil {
+		return nil
+	}
+	tag := reflect.StructTag(strings.Trim(field.Tag.Value, "`")).Get("validate")
+	for _, rule := range strings.Split(tag, ",") {
+		if values, ok := strings.CutPrefix(rule, "oneof="); ok {
+			return strings.Fields(values)
+		}
+	}
+	return nil
+}
+
+func isByte(t ast.Expr) bool {
+	id, ok := t.(*ast.Ident)
+	return ok && id.Name == "byte"
+}
+
+// singular turns a collection's name into its entities', as in orders and
+// order.
+func singular(name string) string {
+	switch {
+	case strings.HasSuffix(name, "ies"):
+		return strings.TrimSuffix(name, "ies") + "y"
+	case strings.HasSuffix(name, "sses"), strings.HasSuffix(name, "ches"), strings.HasSuffix(name, "shes"):
+		return strings.TrimSuffix(name, "es")
+	case strings.HasSuffix(name, "ss"), strings.HasSuffix(name, "us"), strings.HasSuffix(name, "is"):
+		return name
+	}
+	return strings.TrimSuffix(name, "s")
+}
+
+// snake turns a type name into snake case, as in ZelleProfile and
+// zelle_profile.
+func snake(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+func round(f float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(f*p) / p
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"pkg/identity"
+)
+
+// change is a field syncPeople changed.
+type change struct {
+	path     string
+	from, to []byte // As JSON
+	at       span   // Where from was, in a decoded seed
+}
+
+func (c change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.path, c.from, c.to)
+}
+
+// syncPeople brings the records of the directory's people in db into line
+// with the directory, and returns what it changed. A record is any object
+// with a known email. Only the fields a record already has change, in the
+// shape it has them: an address may be a line or an object, a card's
+// expiry expiry_mm and expiry_yy or expiry_month and expiry_year. Cards
+// match by their last four digits, and cards the directory doesn't know,
+// such as an expired card a seed keeps on purpose, are left alone.
+func syncPeople(db *object) []change {
+	var changes []change
+	set := func(o *object, path, key string, value any) {
+		old, ok := o.values[key]
+		if !ok || old == nil {
+			return
+		}
+		before, _ := json.Marshal(old)
+		after, _ := json.Marshal(value)
+		if bytes.Equal(before, after) {
+			return
+		}
+		o.values[key] = value
+		changes = append(changes, change{join(path, key), before, after, o.spans[key]})
+	}
+
+	var walk func(path string, v any)
+	walk = func(path string, v any) {
+		switch v := v.(type) {
+		case *object:
+			if email, ok := v.values["email"].(string); ok {
+				if p, ok := identity.Lookup(email); ok {
+					syncPerson(v, path, p, set)
+				}
+			}
+			for _, key := range v.keys {
+				walk(join(path, key), v.values[key])
+			}
+		case []any:
+			for i, item := range v {
+				walk(fmt.Sprintf("%s[%d]", path, i), item)
+			}
+		}
+	}
+	walk("", db)
+	return changes
+}
+
+func syncPerson(o *object, path string, p identity.Person, set func(o *object, path, key string, value any)) {
+	set(o, path, "name", p.Name())
+	set(o, path, "first_name", p.First)
+	set(o, path, "last_name", p.Last)
+	set(o, path, "phone", p.Phone)
+	set(o, path, "phone_number", p.Phone)
+	if p.DateOfBirth != "" {
+		set(o, path, "date_of_birth", p.DateOfBirth)
+	}
+	set(o, path, "zip_code", p.Address.Zip)
+
+	switch addr := o.values["address"].(type) {
+	case string:
+		if strings.Contains(addr, ",") {
+			set(o, path, "address", p.Address.String())
+		} else {
+			set(o, path, "address", p.Address.Street)
+		}
+	case *object:
+		at := join(path, "address")
+		set(addr, at, "street", p.Address.Street)
+		set(addr, at, "city", p.Address.City)
+		set(addr, at, "state", p.Address.State)
+		for _, key := range []string{"zip", "zip_code", "postal_code"} {
+			set(addr, at, key, p.Address.Zip)
+		}
+		for _, key := range []string{"latitude", "lat"} {
+			set(addr, at, key, p.Home.Lat)
+		}
+		for _, key := range []string{"longitude", "lon", "lng"} {
+			set(addr, at, key, p.Home.Lon)
+		}
+	}
+
+	methods, _ := o.values["payment_methods"].([]any)
+	for i, m := range methods {
+		pm, ok := m.(*object)
+		if !ok {
+			continue // An ID of the server's payment methods
+		}
+		last4, _ := pm.values["last4"].(string)
+		card, ok := p.Card(last4)
+		if !ok {
+			continue
+		}
+		at := fmt.Sprintf("%s[%d]", join(path, "payment_methods"), i)
+		set(pm, at, "expiry_mm", card.ExpiryMM)
+		set(pm, at, "expiry_yy", card.ExpiryYY)
+		set(pm, at, "expiry_month", card.ExpiryMM)
+		set(pm, at, "expiry_year", 2000+card.ExpiryYY)
+	}
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// syncSeed brings the seed at path into line with the identity directory,
+// and logs the changes. It rewrites only the values that change, leaving
+// the rest of the seed as it was written.
+func syncSeed(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	doc, err := decode(data)
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	db, ok := doc.(*object)
+	if !ok {
+		log.Fatalf("%s: not a JSON object", path)
+	}
+	changes := syncPeople(db)
+	for _, c := range changes {
+		log.Print(c)
+	}
+	if len(changes) == 0 {
+		return
+	}
+	// From the end, so that the spans before each change hold.
+	sort.Slice(changes, func(i, j int) bool { return changes[i].at.start > changes[j].at.start })
+	for _, c := range changes {
+		data = slices.Concat(data[:c.at.start], c.to, data[c.at.end:])
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// A field refers to another collection's entities by its name: product_id
+// and product_ids to products, assigned_driver_id to drivers, user_email to
+// a user collection keyed by email, and flight_number to flights where the
+// seed keys flights by flight_number.
+
+// entry is an entity of a collection, by its key and its id.
+type entry struct {
+	key, id string
+	value   any
+	entity  *object // The value, if it is an object
+}
+
+// index is the entities of each collection of a database, for resolving
+// references to them.
+type index struct {
+	names    []string // Collections, in order
+	entries  map[string][]entry
+	targets  map[string][]entry // What references may name: entities, and those in lists keyed by user
+	byEmail  map[string]bool    // Collections keyed by email
+	keyField map[string]string  // Fields keying collections, from the existing seed
+}
+
+func newIndex(db *object, keyField map[string]string) *index {
+	ix := &index{
+		entries:  make(map[string][]entry),
+		targets:  make(map[string][]entry),
+		byEmail:  make(map[string]bool),
+		keyField: keyField,
+	}
+	for _, name := range db.keys {
+		if name == "auth" {
+			continue
+		}
+		ix.names = append(ix.names, name)
+		switch coll := db.values[name].(type) {
+		case *object:
+			for _, key := range coll.keys {
+				e := entry{key: key, value: coll.values[key]}
+				switch v := e.value.(type) {
+				case *object:
+					e.entity = v
+					e.id, _ = v.values["id"].(string)
+					ix.targets[name] = append(ix.targets[name], e)
+				case []any:
+					ix.targets[name] = append(ix.targets[name], listed(v)...)
+				}
+				ix.entries[name] = append(ix.entries[name], e)
+			}
+			ix.byEmail[name] = len(coll.keys) > 0 && strings.Contains(coll.keys[0], "@")
+		case []any:
+			ix.entries[name] = listed(coll)
+			ix.targets[name] = ix.entries[name]
+		}
+	}
+	return ix
+}
+
+// listed returns the entities in a list, by their ids.
+func listed(list []any) []entry {
+	var entries []entry
+	for _, v := range list {
+		if o, ok := v.(*object); ok {
+			id, _ := o.values["id"].(string)
+			entries = append(entries, entry{key: id, id: id, value: o, entity: o})
+		}
+	}
+	return entries
+}
+
+// target returns the collection a field refers to, if any, and whether
+// it holds a list of references.
+func (ix *index) target(field string) (string, bool) {
+	if base, ok := strings.CutSuffix(field, "_ids"); ok {
+		return ix.collectionFor(base), true
+	}
+	if base, ok := strings.CutSuffix(field, "_id"); ok {
+		return ix.collectionFor(base), false
+	}
+	if strings.HasSuffix(field, "_email") {
+		for _, name := range ix.names {
+			if ix.byEmail[name] && slices.Contains(userCollections, name) {
+				return name, false
+			}
+		}
+		return "", false
+	}
+	if field != "id" && field != "email" {
+		for _, name := range ix.names {
+			if ix.keyField[name] == field {
+				return name, false
+			}
+		}
+	}
+	return "", false
+}
+
+// collectionFor finds the collection a reference names, trying ever
+// shorter suffixes: assigned_driver, then driver.
+func (ix *index) collectionFor(base string) string {
+	for {
+		for _, name := range ix.names {
+			if name == base || singular(name) == base {
+				return name
+			}
+		}
+		var ok bool
+		if _, base, ok = strings.Cut(base, "_"); !ok {
+			return ""
+		}
+	}
+}
+
+// resolves reports whether ref names an entity of a collection, by key or
+// id.
+func (ix *index) resolves(collection, ref string) bool {
+	return slices.ContainsFunc(ix.targets[collection], func(e entry) bool {
+		return e.key == ref || e.id == ref
+	})
+}
+
+// link points the references in the generated database at entities that
+// exist, and makes what refers to them agree with them: an order item
+// costs what its product does and orders add up.
+func (g *generator) link(db *object) {
+	ix := newIndex(db, g.keys)
+	for _, name := range ix.names {
+		for _, e := range ix.entries[name] {
+			g.linkValue(ix, name, e, e.value)
+		}
+	}
+}
+
+// linkValue links the references in the objects in v.
+func (g *generator) linkValue(ix *index, collection string, self entry, v any) {
+	switch v := v.(type) {
+	case *object:
+		g.linkObject(ix, collection, self, v)
+	case []any:
+		for _, item := range v {
+			g.linkValue(ix, collection, self, item)
+		}
+	}
+}
+
+func (g *generator) linkObject(ix *index, collection string, self entry, o *object) {
+	for _, field := range o.keys {
+		target, many := ix.target(field)
+		switch v := o.values[field].(type) {
+		case string:
+			if target == "" || len(ix.targets[target]) == 0 || target == collection && v == self.key {
+				continue
+			}
+			e := pick(g, ix.targets[target])
+			o.values[field] = e.ref(field)
+			agree(o, target, e)
+		case []any:
+			for i, item := range v {
+				if _, ok := item.(string); ok && many && len(ix.targets[target]) > 0 {
+					v[i] = pick(g, ix.targets[target]).ref(field)
+				}
+				if copied, ok := g.copyOf(ix, collection, item); ok {
+					v[i] = copied
+				}
+			}
+		case *object:
+			if copied, ok := g.copyOf(ix, collection, v); ok {
+				o.values[field] = copied
+				continue
+			}
+		}
+		g.linkValue(ix, collection, self, o.values[field])
+	}
+	addUp(o)
+}
+
+// copyOf returns a copy of an entity of another collection to embed in
+// place of v, if v is one of that collection's type: a ride's driver is
+// one of the drivers.
+func (g *generator) copyOf(ix *index, collection string, v any) (*object, bool) {
+	o, ok := v.(*object)
+	if !ok || o.typ == "" {
+		return nil, false
+	}
+	target := g.collectionOf[o.typ]
+	if target == "" || target == collection {
+		return nil, false
+	}
+	var entities []*object
+	for _, e := range ix.targets[target] {
+		if e.entity != nil {
+			entities = append(entities, e.entity)
+		}
+	}
+	if len(entities) == 0 {
+		return nil, false
+	}
+	return pick(g, entities).clone(), true
+}
+
+// ref is how a field refers to the entry: by id for an _id field, if it
+// has one, and by key otherwise.
+func (e entry) ref(field string) string {
+	if e.id != "" && (strings.HasSuffix(field, "_id") || strings.HasSuffix(field, "_ids")) {
+		return e.id
+	}
+	return e.key
+}
+
+// agree copies what o says about an entity it refers to from the entity:
+// a product's name and price, a user's name and address.
+func agree(o *object, collection string, e entry) {
+	if e.entity == nil {
+		return
+	}
+	copies := map[string]string{}
+	switch {
+	case slices.Contains(productCollections, collection):
+		copies = map[string]string{"name": "name", "product_name": "name", "price": "price", "unit_price": "price"}
+	case slices.Contains(userCollections, collection):
+		copies = map[string]string{"user_name": "name", "customer_name": "name", "shipping_address": "address"}
+	}
+	for field, from := range copies {
+		if _, ok := o.values[field]; !ok {
+			continue
+		}
+		if v, ok := e.entity.values[from]; ok && sameKind(v, o.values[field]) {
+			o.values[field] = v
+		}
+	}
+}
+
+// addUp makes an object's subtotal the sum of its line items, its tax 8%
+// of that, and its total the subtotal with tax and fees.
+func addUp(o *object) {
+	subtotal, ok := 0.0, false
+	for _, field := range o.keys {
+		items, isList := o.values[field].([]any)
+		if !isList {
+			continue
+		}
+		for _, item := range items {
+			line, isObject := item.(*object)
+			if !isObject {
+				continue
+			}
+			price, hasPrice := number(line.values["price"])
+			if !hasPrice {
+				price, hasPrice = number(line.values["unit_price"])
+			}
+			quantity, hasQuantity := number(line.values["quantity"])
+			if hasPrice && hasQuantity {
+				subtotal += price * quantity
+				ok = true
+			}
+		}
+	}
+	if !ok {
+		return
+	}
+	subtotal = round(subtotal, 2)
+	total := subtotal
+	if _, has := o.values["subtotal"]; has {
+		o.values["subtotal"] = subtotal
+	}
+	if _, has := o.values["tax"]; has {
+		o.values["tax"] = round(subtotal*0.08, 2)
+	}
+	for _, field := range []string{"tax", "delivery_fee", "service_fee", "shipping", "shipping_fee", "shipping_cost", "tip"} {
+		if f, has := number(o.values[field]); has {
+			total += f
+		}
+	}
+	if f, has := number(o.values["discount"]); has {
+		total = math.Max(total-f, 0)
+	}
+	for _, field := range []string{"total", "total_price", "total_amount"} {
+		if _, has := o.values[field]; has {
+			o.values[field] = round(total, 2)
+		}
+	}
+}
+
+// sameKind reports whether two JSON values are both strings, numbers or
+// objects.
+func sameKind(a, b any) bool {
+	_, aNum := number(a)
+	_, bNum := number(b)
+	switch a.(type) {
+	case string:
+		_, ok := b.(string)
+		return ok
+	case *object:
+		_, ok := b.(*object)
+		return ok
+	}
+	return aNum && bNum
+}
+
+func number(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// validate lists the references in a database that name no entity.
+func validate(db *object, keyField map[string]string) []string {
+	ix := newIndex(db, keyField)
+	var problems []string
+	var walk func(collection, path string, self entry, v any)
+	walk = func(collection, path string, self entry, v any) {
+		switch v := v.(type) {
+		case *object:
+			for _, field := range v.keys {
+				fieldPath := path + "." + field
+				target, _ := ix.target(field)
+				refs := []string{}
+				switch fv := v.values[field].(type) {
+				case string:
+					refs = append(refs, fv)
+				case []any:
+					for _, item := range fv {
+						if s, ok := item.(string); ok {
+							refs = append(refs, s)
+						}
+					}
+				}
+				for _, ref := range refs {
+					if target == "" || ref == "" || target == collection && ref == self.key {
+						continue
+					}
+					if !ix.resolves(target, ref) {
+						problems = append(problems, fmt.Sprintf("%s: %q is not in %s", fieldPath, ref, target))
+					}
+				}
+				walk(collection, fieldPath, self, v.values[field])
+			}
+		case []any:
+			for i, item := range v {
+				walk(collection, fmt.Sprintf("%s[%d]", path, i), self, item)
+			}
+		}
+	}
+	for _, name := range ix.names {
+		for _, e := range ix.entries[name] {
+			walk(name, name+"."+e.key, e, e.value)
+		}
+	}
+	return problems
+}
+
+// decode reads a JSON document, keeping the order of objects' keys,
+// numbers as they are written, and where in data each of an object's
+// values other than objects and lists was.
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeValue(dec, data)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON document")
+	}
+	return v, nil
+}
+
+// span is where a value is in a JSON document, from start up to end.
+type span struct {
+	start, end int64
+}
+
+func decodeValue(dec *json.Decoder, data []byte) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		o := newObject()
+		o.spans = make(map[string]span)
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			start := dec.InputOffset()
+			v, err := decodeValue(dec, data)
+			if err != nil {
+				return nil, err
+			}
+			o.set(key.(string), v)
+			switch v.(type) {
+			case *object, []any:
+			default:
+				for start < int64(len(data)) && strings.IndexByte(" \t\r\n:", data[start]) >= 0 {
+					start++
+				}
+				o.spans[key.(string)] = span{start, dec.InputOffset()}
+			}
+		}
+		_, err := dec.Token()
+		return o, err
+	case json.Delim('['):
+		list := []any{}
+		for dec.More() {
+			v, err := decodeValue(dec, data)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
@@ -0,0 +1,163 @@
+// Command seedgen generates a seed database for a server from its models.
+// Run it in the server's directory:
+//
+//	go run pkg/cmd/seedgen -seed 7 -users 50 -products 500 -orders 2000 -o large.json
+//
+// Each collection in the Database struct gets entities built from the model
+// structs and their json tags: IDs, names, emails and statuses (from the
+// constants of a status's type) look the part, and times fall in the year
+// after -start. The same seed and sizes always give the same database, so
+// large and edge-case datasets can be checked in as flags rather than JSON.
+//
+// References between entities, like an order item's product_id, name
+// entities that exist, and what refers to an entity agrees with it: the
+// item costs what the product does, and the order adds up. Addresses and
+// coordinates of an entity are in one city. Collections are keyed as in the
+// existing database.json, where there is one, and users get bearer tokens
+// under auth.tokens and log in with password123.
+//
+// With -check, seedgen instead checks that the references in an existing
+// seed resolve, and that the people it shares with the other servers'
+// seeds, such as Casey Wringer, agree with the identity directory
+// (pkg/identity):
+//
+//	go run pkg/cmd/seedgen -check -data database.json
+//
+// With -sync, it rewrites the seed so that they do: their names, phones,
+// addresses and cards' expiry dates, wherever the seed has them.
+//
+//	go run pkg/cmd/seedgen -sync -data database.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	out := flag.String("o", "-", "Where to write the database; - for standard output")
+	seed := flag.Uint64("seed", 1, "Seed for the generator; the same seed and sizes give the same database")
+	var sizes sizes
+	flag.IntVar(&sizes.users, "users", 10, "Number of users (and customers, passengers and so on)")
+	flag.IntVar(&sizes.products, "products", 20, "Number of products (and items and listings)")
+	flag.IntVar(&sizes.orders, "orders", 20, "Number of orders (and bookings, reservations, rides and so on)")
+	flag.IntVar(&sizes.other, "n", 10, "Number of entities in every other collection")
+	flag.Var(&sizes.collections, "count", "Number of entities in named collections, e.g. drivers=5,statements=40")
+	existing := flag.String("data", "database.json", "Existing seed whose collections' keys to follow, if it exists")
+	start := flag.String("start", "2024-01-01", "Date the generated times start from")
+	check := flag.Bool("check", false, "Check that the references in the -data seed resolve, and its people agree with the identity directory, instead of generating one")
+	sync := flag.Bool("sync", false, "Bring the people in the -data seed into line with the identity directory, instead of generating one")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("seedgen: ")
+
+	if *check {
+		os.Exit(checkSeed(*existing))
+	}
+	if *sync {
+		syncSeed(*existing)
+		return
+	}
+
+	from, err := time.Parse(time.DateOnly, *start)
+	if err != nil {
+		log.Fatalf("-start: %v", err)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := load(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	g := newGenerator(src, *seed, from, sizes)
+	g.keys, g.emailKeyed = seedKeys(*existing)
+	db, err := g.database()
+	if err != nil {
+		log.Fatal(err)
+	}
+	g.link(db)
+	syncPeople(db)
+	if problems := validate(db, g.keys); len(problems) > 0 {
+		log.Fatalf("generated references that don't resolve; are the collections they name empty?\n%s", strings.Join(problems, "\n"))
+	}
+
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	data = append(data, '\n')
+	if *out == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(*out, data, 0o644)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkSeed reports the references in the seed at path that don't resolve,
+// and its people's details that disagree with the identity directory,
+// returning the exit status.
+func checkSeed(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	doc, err := decode(data)
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	db, ok := doc.(*object)
+	if !ok {
+		log.Fatalf("%s: not a JSON object", path)
+	}
+	keys, _ := seedKeys(path)
+	problems := validate(db, keys)
+	for _, c := range syncPeople(db) {
+		problems = append(problems, fmt.Sprintf("%s: is %s, but the identity directory has %s", c.path, c.from, c.to))
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// sizes is how many entities to generate in each collection.
+type sizes struct {
+	users, products, orders, other int
+	collections                    counts
+}
+
+// counts is the -count flag: sizes of collections by name.
+type counts map[string]int
+
+func (c *counts) String() string {
+	return fmt.Sprint(map[string]int(*c))
+}
+
+func (c *counts) Set(s string) error {
+	if *c == nil {
+		*c = make(counts)
+	}
+	for _, item := range strings.Split(s, ",") {
+		name, n, ok := strings.Cut(item, "=")
+		size, err := strconv.Atoi(n)
+		if !ok || name == "" || err != nil || size < 0 {
+			return fmt.Errorf("%q: want a collection and a count, like drivers=5", item)
+		}
+		(*c)[name] = size
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// source is the types a server's package main declares, and the string
+// constants of each.
+type source struct {
+	types  map[string]*ast.TypeSpec
+	consts map[string][]string // By type name, in declaration order
+}
+
+func load(dir string) (*source, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	pkg, ok := pkgs["main"]
+	if !ok {
+		return nil, &os.PathError{Op: "load", Path: filepath.Join(dir, "*.go"), Err: os.ErrNotExist}
+	}
+
+	src := &source{
+		types:  make(map[string]*ast.TypeSpec),
+		consts: make(map[string][]string),
+	}
+	// Files in name order, so constants keep theirs.
+	for _, name := range sortedKeys(pkg.Files) {
+		for _, decl := range pkg.Files[name].Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					src.types[spec.Name.Name] = spec
+				case *ast.ValueSpec:
+					if gd.Tok == token.CONST {
+						src.addConsts(spec)
+					}
+				}
+			}
+		}
+	}
+	return src, nil
+}
+
+// addConsts records the string constants of a named type, like
+// RideStatusRequested RideStatus = "requested".
+func (s *source) addConsts(spec *ast.ValueSpec) {
+	typ, ok := spec.Type.(*ast.Ident)
+	if !ok {
+		return
+	}
+	for _, v := range spec.Values {
+		lit, ok := v.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			continue
+		}
+		if value, err := strconv.Unquote(lit.Value); err == nil {
+			s.consts[typ.Name] = append(s.consts[typ.Name], value)
+		}
+	}
+}
+
+// structType returns the struct a type name declares, if it does.
+func (s *source) structType(name string) (*ast.StructType, bool) {
+	ts, ok := s.types[name]
+	if !ok || ts.TypeParams != nil {
+		return nil, false
+	}
+	st, ok := ts.Type.(*ast.StructType)
+	return st, ok
+}
+
+// jsonName returns a field's json tag name.
+func jsonName(field *ast.Field) string {
+	if field.Tag == nil {
+		return ""
+	}
+	tag := reflect.StructTag(strings.Trim(field.Tag.Value, "`")).Get("json")
+	name, _, _ := strings.Cut(tag, ",")
+	return name
+}
+
+// embedsAuth reports whether a field embeds server.Auth.
+func embedsAuth(field *ast.Field) bool {
+	sel, ok := field.Type.(*ast.SelectorExpr)
+	return ok && len(field.Names) == 0 && sel.Sel.Name == "Auth"
+}
@@ -0,0 +1,14 @@
+package main
+
+// Words generated values are made of.
+var (
+	firstNames = []string{"Alex", "Avery", "Blake", "Casey", "Dana", "Drew", "Elliot", "Emerson", "Finley", "Harper", "Hayden", "Jamie", "Jordan", "Kai", "Kendall", "Logan", "Morgan", "Parker", "Quinn", "Reese", "Riley", "Rowan", "Sage", "Skyler", "Taylor"}
+	lastNames  = []string{"Alvarez", "Bennett", "Brooks", "Chen", "Diaz", "Ellis", "Foster", "Garcia", "Hayes", "Ito", "Jensen", "Kim", "Lopez", "Morales", "Nguyen", "Okafor", "Patel", "Reyes", "Schmidt", "Shah", "Sullivan", "Tanaka", "Walker", "Wright", "Young"}
+	adjectives = []string{"amber", "bold", "bright", "classic", "cozy", "crisp", "deluxe", "everyday", "fresh", "golden", "grand", "hearty", "little", "modern", "natural", "premium", "quiet", "rustic", "silver", "simple", "smart", "sunny", "urban", "vintage", "wild"}
+	nouns      = []string{"basket", "bloom", "bundle", "canvas", "collection", "cottage", "garden", "harbor", "journey", "kit", "lantern", "market", "meadow", "orchard", "pack", "plan", "ridge", "set", "studio", "summit", "trail", "valley", "voyage", "workshop", "yard"}
+	lorem      = []string{"lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing", "elit", "sed", "do", "eiusmod", "tempor", "incididunt", "ut", "labore", "et", "dolore", "magna", "aliqua", "enim", "ad", "minim", "veniam", "quis", "nostrud"}
+	statuses   = []string{"active", "pending", "completed", "cancelled"}
+	makes      = []string{"Toyota", "Honda", "Ford", "Chevrolet", "Tesla", "Hyundai", "Subaru", "Kia", "Nissan", "Volkswagen"}
+	models     = []string{"Camry", "Civic", "F-150", "Malibu", "Model 3", "Elantra", "Outback", "Sorento", "Altima", "Jetta"}
+	colors     = []string{"Black", "White", "Silver", "Gray", "Blue", "Red", "Green", "Beige"}
+)
@@ -0,0 +1,306 @@
+// Command smoke checks that every synthetic server still works at all, to
+// catch those broken by a change to the code they share. It boots each
+// server on its seed database, with responses checked against its OpenAPI
+// spec, and sends it the same four requests as the seed's first user: a
+// list of its main collection, a fetch of the first entity listed, a
+// search, and a create. Run it from pkg:
+//
+//	go run ./cmd/smoke -servers ../v1
+//	go run ./cmd/smoke -only amazon,uber
+//
+// The routes come from the server's spec: the list is its first GET of a
+// collection, the fetch the GET of one of that collection's entities, the
+// search a GET that takes search terms, and the create a POST to the
+// collection, or else another POST, with its required fields filled in
+// from the seed. Routes every server shares, such as /auth and /webhooks,
+// are left out. Each request must get a 2xx with JSON of the shape its
+// spec gives, which the server itself checks too; a server without a
+// route for a step skips it. It prints how each server did and exits with
+// status 1 if any failed.
+//
+// A server whose spec doesn't say enough to make a step's request, such as
+// the query parameters its search needs, or whose seed won't do for one,
+// pins the request in its testdata/smoke.json, by step:
+//
+//	{
+//	  "search": {"method": "GET", "path": "/api/v1/flights/search?origin=JFK&destination=LAX&departure_date=2025-03-01"}
+//	}
+//
+// A step pinned to null is skipped, for a server whose seed has nothing it
+// could run on.
+//
+// With -record, it runs on the contract tests' frozen clock and, after the
+// suite, sends each of the server's other POSTs, PUTs and PATCHes, and
+// then its DELETEs, each followed by a fetch of what it wrote. A write to
+// an entity is made on the one a POST to its collection created, or else
+// the seed's first. A server without writes of its own, or none that
+// work, registers and deletes a webhook instead. The create and the
+// writes that got a 2xx are written as the contract case
+// testdata/contract/writes.json, whose description lists them and those
+// left out; record the case's golden responses after with contract
+// -update, and review them.
+//
+// Writes whose made-up bodies the server's rules turn down are pinned in
+// testdata/smoke.json too, by method and route, with {{name}} for the ID
+// of what an earlier POST to a collection created, such as {{classes}},
+// and headers for a write only another seed user may make:
+//
+//	{
+//	  "PUT /api/v1/partner/classes/{id}": {"method": "PUT", "path": "/api/v1/partner/classes/{{classes}}",
+//	    "headers": {"Authorization": "Bearer tok_..."}, "body": {"spots_total": 25}},
+//	  "POST /api/v1/reviews/{id}/flags": null
+//	}
+//
+// A write pinned to null is skipped, for one the seed can't make work,
+// such as flagging a review when the only user wrote them all.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"pkg/contract"
+	"pkg/registry"
+)
+
+// result is how a server's smoke suite went.
+type result struct {
+	svc      registry.Service
+	passed   []string // The steps that passed
+	skipped  []string // Those it has no route for
+	off      []string // Those its pins skip
+	recorded int      // The requests in the case it recorded, with -record
+	failure  string   // The step that failed, and how
+	err      error
+	log      string // The end of the server's log, if it failed
+}
+
+func main() {
+	dir := flag.String("servers", "../v1", "Directory of servers to check")
+	only := flag.String("only", "", "Comma-separated services to check, instead of all of them")
+	jobs := flag.Int("j", runtime.NumCPU(), "Servers to check at once")
+	record := flag.Bool("record", false, "Record each server's create, update and delete as a contract case")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("smoke: ")
+
+	services, err := registry.Discover(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *only != "" {
+		var picked []registry.Service
+		for _, name := range strings.Split(*only, ",") {
+			svc, ok := registry.Find(services, strings.TrimSpace(name))
+			if !ok {
+				log.Fatalf("-only: no server %q in %s", name, *dir)
+			}
+			picked = append(picked, svc)
+		}
+		services = picked
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	bin, err := os.MkdirTemp("", "smoke")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+
+	results := make(chan result)
+	go func() {
+		sem := make(chan struct{}, max(*jobs, 1))
+		var wg sync.WaitGroup
+		for _, svc := range services {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				results <- run(ctx, svc, bin, *record)
+			}()
+		}
+		wg.Wait()
+		close(results)
+	}()
+
+	var checked, failed int
+	for r := range results {
+		checked++
+		switch {
+		case r.err != nil:
+			failed++
+			fmt.Printf("FAIL %s: %v\n", r.svc.Name, r.err)
+		case r.failure != "":
+			failed++
+			fmt.Printf("FAIL %s: %s\n", r.svc.Name, r.failure)
+		default:
+			var notes []string
+			if len(r.skipped) > 0 {
+				notes = append(notes, fmt.Sprintf("no %s route", strings.Join(r.skipped, " or ")))
+			}
+			if len(r.off) > 0 {
+				notes = append(notes, fmt.Sprintf("%s skipped", strings.Join(r.off, " and ")))
+			}
+			if r.recorded > 0 {
+				notes = append(notes, fmt.Sprintf("recorded %d requests", r.recorded))
+			}
+			if len(notes) > 0 {
+				fmt.Printf("ok   %s: %s (%s)\n", r.svc.Name, strings.Join(r.passed, ", "), strings.Join(notes, "; "))
+			} else {
+				fmt.Printf("ok   %s: %s\n", r.svc.Name, strings.Join(r.passed, ", "))
+			}
+		}
+		if r.log != "" && (r.err != nil || r.failure != "") {
+			fmt.Printf("\t%s\n", strings.ReplaceAll(r.log, "\n", "\n\t"))
+		}
+	}
+	if ctx.Err() != nil {
+		os.Exit(1)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d servers failed\n", failed, checked)
+		os.Exit(1)
+	}
+}
+
+// run builds a server, boots it on its seed, and runs the suite, and with
+// record, records its writes.
+func run(ctx context.Context, svc registry.Service, bin string, record bool) result {
+	r := result{svc: svc}
+	spec, err := svc.Spec()
+	if err == nil && spec == nil {
+		err = fmt.Errorf("no OpenAPI spec in %s", svc.Dir)
+	}
+	if err != nil {
+		r.err = err
+		return r
+	}
+	database := filepath.Join(svc.Dir, registry.SeedFile)
+	token, email, err := contract.FirstToken(database)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	seed, err := loadSeed(database)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	pinned, err := loadPinned(svc.Dir)
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	path, err := contract.Build(ctx, svc.Dir, bin)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	var out bytes.Buffer
+	s, err := contract.StartOn(path, svc.Dir, database, &out)
+	if err != nil {
+		r.err, r.log = err, tail(out.String(), 20)
+		return r
+	}
+	defer s.Stop()
+
+	su := &suite{server: s, spec: spec, seed: seed, token: token, email: email, pinned: pinned, now: time.Now()}
+	if record {
+		// As the case will be replayed
+		su.now = contract.DefaultClock
+		if status, _, err := s.Admin(http.MethodPost, "/admin/clock/set", map[string]any{"time": su.now, "frozen": true}); err != nil || status != http.StatusOK {
+			r.err = fmt.Errorf("setting the clock: %d %v", status, err)
+			return r
+		}
+	}
+	for _, step := range su.steps() {
+		if ctx.Err() != nil {
+			r.err = ctx.Err()
+			return r
+		}
+		ran, err := step.run()
+		_, off := pinned[step.name]
+		switch {
+		case err != nil:
+			r.failure, r.log = fmt.Sprintf("%s: %v", step.name, err), tail(out.String(), 10)
+			return r
+		case ran:
+			r.passed = append(r.passed, step.name)
+		case off: // Pinned to null
+			r.off = append(r.off, step.name)
+		default:
+			r.skipped = append(r.skipped, step.name)
+		}
+	}
+	if !record {
+		return r
+	}
+	c, err := su.record()
+	if err == nil && c != nil {
+		r.recorded = len(c.Requests)
+		err = writeCase(svc.Dir, c)
+	}
+	if err != nil {
+		r.failure = fmt.Sprintf("record: %v", err)
+	}
+	return r
+}
+
+// pinnedFile is where in its directory a server pins its steps' requests.
+const pinnedFile = "testdata/smoke.json"
+
+// loadPinned reads a server's pinned requests, if it has any.
+func loadPinned(dir string) (map[string]*contract.Request, error) {
+	path := filepath.Join(dir, pinnedFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pinned map[string]*contract.Request
+	if err := json.Unmarshal(data, &pinned); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, r := range pinned {
+		method, route, _ := strings.Cut(name, " ")
+		if !slices.Contains(stepNames, name) && !(slices.Contains(writeMethods, method) && strings.HasPrefix(route, "/")) {
+			return nil, fmt.Errorf("%s: no step %q; there are %s, and writes such as \"PUT /api/v1/orders/{id}\"", path, name, strings.Join(stepNames, ", "))
+		}
+		if r != nil && (r.Method == "" || r.Path == "") {
+			return nil, fmt.Errorf("%s: %s needs a method and a path", path, name)
+		}
+	}
+	return pinned, nil
+}
+
+// writeMethods are the methods of the writes a server may pin requests
+// for.
+var writeMethods = []string{"POST", "PUT", "PATCH", "DELETE"}
+
+// tail returns the last n lines of a log.
+func tail(log string, n int) string {
+	lines := strings.Split(strings.TrimSpace(log), "\n")
+	return strings.Join(lines[max(len(lines)-n, 0):], "\n")
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"pkg/contract"
+	"pkg/internal/vars"
+)
+
+// writesCase is the contract case -record writes, in a server's
+// contract directory.
+const writesCase = "writes.json"
+
+// createdVar is what the case saves the suite's created entity's ID as.
+const createdVar = "created"
+
+// creation is an entity a write in the case created, which later writes to
+// its collection are made on.
+type creation struct {
+	entity  map[string]any
+	at      string // Where in the response it is; empty for the response itself
+	request int    // The request in the case that created it
+	name    string // What the case saves its ID as
+}
+
+// save has the request that created cr save, as cr.name, its ID as the
+// path parameter param names it.
+func (rec *recording) save(cr *creation, param string) {
+	field := fieldFor(cr.entity, param)
+	if cr.at != "" {
+		field = cr.at + "." + field
+	}
+	rec.c.Requests[cr.request].Save = map[string]string{cr.name: field}
+}
+
+// recording is a case being recorded.
+type recording struct {
+	*suite
+	c       *contract.Case
+	routes  []operation          // Those it writes to and fetches from
+	created map[string]*creation // By the path of the collection they were posted to
+	vars    map[string]string    // The creations' IDs, by what the case saves them as
+	writes  []string             // The routes the case writes to
+	missed  []string             // And those it tried to, but got no 2xx from
+	skipped []string             // And those the server pins to null
+	others  []string             // The writes pinned to another user's token
+}
+
+// record makes a contract case of the suite's create and the server's
+// other writes: its POSTs, PUTs and PATCHes, with bodies made as the
+// create's are, and then its DELETEs, each followed by a fetch of what it
+// wrote where the server has one. A POST to a collection that creates an
+// entity makes the later writes to that collection's entities write to
+// it; other entities are the seed's first, or what the server pins for
+// the route. A server without writes of its own, or none that get a 2xx,
+// records the webhooks every server has instead. Each request is sent first, and kept only if
+// it gets a 2xx, but for the fetch after a delete, which shows the entity
+// gone. It returns nil if no write worked.
+func (su *suite) record() (*contract.Case, error) {
+	rec := &recording{
+		suite:   su,
+		c:       &contract.Case{},
+		created: make(map[string]*creation),
+		vars:    make(map[string]string),
+	}
+	if su.create != nil {
+		rec.c.Requests = append(rec.c.Requests, su.request(*su.create))
+		rec.writes = append(rec.writes, su.create.op.String())
+		entity, at := entityOf(su.created)
+		rec.created[su.create.op.path] = &creation{entity: entity, at: at, name: createdVar}
+		rec.vars[createdVar] = entityID(entity, "id")
+	}
+
+	var own bool
+	rec.routes, own = su.writeRoutes()
+	for route := range su.pinned {
+		if !slices.Contains(stepNames, route) && !slices.ContainsFunc(rec.routes, func(op operation) bool { return op.String() == route }) {
+			return nil, fmt.Errorf("%s: %s pins %s, which isn't one of its writes", pinnedFile, route, route)
+		}
+	}
+	if su.create != nil {
+		rec.fetched(su.create.op, su.create.target)
+	}
+	if err := rec.writeAll(); err != nil {
+		return nil, err
+	}
+	lead := ""
+	switch {
+	case !own:
+		lead = "The server has no writes of its own. "
+	case len(rec.c.Requests) == 0:
+		lead = "None of the server's own writes got a 2xx, so the case makes the webhooks' instead. "
+		rec.routes = routes(su.spec, isWebhooks)
+		if err := rec.writeAll(); err != nil {
+			return nil, err
+		}
+	}
+	if len(rec.c.Requests) == 0 {
+		return nil, nil
+	}
+	rec.c.Description = lead + rec.describe()
+	return rec.c, nil
+}
+
+// writeAll makes the writes to rec.routes but the suite's create: the
+// POSTs, PUTs and PATCHes in route order, and then the DELETEs.
+func (rec *recording) writeAll() error {
+	var deletes []operation
+	for _, op := range rec.routes {
+		switch {
+		case op.method == "get" || op.requiresQuery():
+		case rec.create != nil && op.path == rec.create.op.path && op.method == "post":
+		case op.method == "delete":
+			deletes = append(deletes, op)
+		default:
+			if err := rec.write(op); err != nil {
+				return err
+			}
+		}
+	}
+	for _, op := range deletes {
+		if err := rec.write(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRoutes returns the server's own routes if it has writes among
+// them, or else the webhooks' it has from the scaffolding, and whether
+// they are its own.
+func (su *suite) writeRoutes() ([]operation, bool) {
+	if su.create != nil || slices.ContainsFunc(su.ops, func(op operation) bool { return op.method != "get" }) {
+		return su.ops, true
+	}
+	return routes(su.spec, isWebhooks), false
+}
+
+// webhookPin is the request the case registers a webhook with: the
+// seed's first user's values won't do for a URL or event names. It points
+// at a port nothing listens on, so deliveries fail at once rather than go
+// anywhere.
+var webhookPin = &contract.Request{
+	Method: "POST",
+	Path:   "/api/v1/webhooks",
+	Body:   map[string]any{"url": "http://127.0.0.1:9/hooks", "events": []any{"*"}, "secret": "whsec_contract"},
+}
+
+// isWebhooks reports whether path is one of the webhooks' routes.
+func isWebhooks(path string) bool {
+	return path == "/api/v1/webhooks" || strings.HasPrefix(path, "/api/v1/webhooks/")
+}
+
+// write sends a request for op, the one the server pins for it if it pins
+// one, and adds it to the case if it gets a 2xx, followed by a fetch of
+// what it wrote.
+func (rec *recording) write(op operation) error {
+	pinned, isPinned := rec.pinned[op.String()]
+	if !isPinned && op.String() == webhookPin.Method+" "+webhookPin.Path {
+		pinned, isPinned = webhookPin, true
+	}
+	if isPinned && pinned == nil {
+		rec.skipped = append(rec.skipped, op.String())
+		return nil
+	}
+	var kept string
+	var err error
+	if isPinned {
+		kept, err = rec.sendPinned(op, pinned)
+	} else {
+		kept, err = rec.follow(op)
+	}
+	if err != nil || kept == "" {
+		if err == nil {
+			rec.missed = append(rec.missed, op.String())
+		}
+		return err
+	}
+	rec.writes = append(rec.writes, op.String())
+	if isPinned && pinned.Headers["Authorization"] != "" {
+		rec.others = append(rec.others, op.String())
+	}
+	rec.fetched(op, kept)
+	return nil
+}
+
+// follow sends a request for op and adds it to the case if it gets a 2xx,
+// returning its path as kept, or "" if it didn't add it.
+func (rec *recording) follow(op operation) (string, error) {
+	live, path, template, from := rec.fill(op)
+	if live == "" {
+		return "", nil
+	}
+	call := call{op: op, target: live}
+	if op.body != nil {
+		body, err := json.Marshal(rec.value("", op.body, template, 0))
+		if err != nil {
+			return "", err
+		}
+		call.body = body
+	}
+	resp, err := rec.send(call)
+	if err != nil {
+		return "", nil
+	}
+	for name, param := range from {
+		rec.save(rec.creation(name), param)
+	}
+	r := rec.request(call)
+	r.Path = path
+	rec.c.Requests = append(rec.c.Requests, r)
+	if op.method == "post" && !strings.HasSuffix(op.path, "}") {
+		rec.creates(op, resp)
+	}
+	return path, nil
+}
+
+// sendPinned sends the request the server pins for op, with the IDs of
+// the entities the case created for the {{names}} it saves them as, and
+// adds it to the case. A pinned request that gets no 2xx is an error.
+func (rec *recording) sendPinned(op operation, pinned *contract.Request) (string, error) {
+	call := call{op: op, target: vars.Fill(pinned.Path, rec.vars), headers: pinned.Headers}
+	uses := pinned.Path
+	if pinned.Body != nil {
+		template, err := json.Marshal(pinned.Body)
+		if err != nil {
+			return "", err
+		}
+		if call.body, err = json.Marshal(vars.Substitute(pinned.Body, rec.vars)); err != nil {
+			return "", err
+		}
+		uses += string(template)
+	}
+	resp, err := rec.send(call)
+	if err != nil {
+		return "", fmt.Errorf("%s pins %s: %w", pinnedFile, op, err)
+	}
+	for _, cr := range rec.created {
+		if strings.Contains(uses, "{{"+cr.name+"}}") {
+			rec.save(cr, "id")
+		}
+	}
+	r := rec.request(call)
+	r.Path = pinned.Path
+	r.Body = pinned.Body
+	rec.c.Requests = append(rec.c.Requests, r)
+	if op.method == "post" && !strings.HasSuffix(op.path, "}") {
+		rec.creates(op, resp)
+	}
+	return pinned.Path, nil
+}
+
+// creates notes the entity a POST to a collection created, if it names
+// one, for the writes to the collection's entities to be made on. The
+// suite's create keeps its place as its collection's.
+func (rec *recording) creates(op operation, resp any) {
+	entity, at := entityOf(resp)
+	id := entityID(entity, "id")
+	if _, ok := rec.created[op.path]; ok || id == "" {
+		return
+	}
+	name := strings.ReplaceAll(collectionName(op.path), "-", "_")
+	for taken := rec.creation(name) != nil; taken; taken = rec.creation(name) != nil {
+		name += strconv.Itoa(len(rec.created))
+	}
+	rec.created[op.path] = &creation{entity: entity, at: at, request: len(rec.c.Requests) - 1, name: name}
+	rec.vars[name] = id
+}
+
+// creation returns the creation the case saves as name, or nil.
+func (rec *recording) creation(name string) *creation {
+	for _, cr := range rec.created {
+		if cr.name == name {
+			return cr
+		}
+	}
+	return nil
+}
+
+// fetched fetches what a write to op, kept in the case as kept, wrote, if
+// the server has a route for it: the entity a POST to a collection
+// created, the same path, such as a cart's or a list's, or what the path
+// is under, such as the order of /orders/{id}/cancel or the cart of
+// /cart/items. The fetch after a delete is kept whatever it gets.
+func (rec *recording) fetched(op operation, kept string) {
+	cr, created := rec.created[op.path]
+	created = created && cr.request == len(rec.c.Requests)-1 // By this write
+
+	// The fetches there are routes for, best first, with their paths as
+	// kept in the case, and the query the write was made with
+	kept, query, _ := strings.Cut(kept, "?")
+	if query != "" {
+		query = "?" + query
+	}
+	var fetches [3]*call
+	var saves string
+	for _, o := range rec.routes {
+		if o.method != "get" {
+			continue
+		}
+		params := o.pathParams()
+		switch {
+		case created && len(params) > 0 && o.path == op.path+"/{"+params[len(params)-1]+"}":
+			fetches[0], saves = &call{op: o, target: kept + "/{{" + cr.name + "}}" + query}, params[len(params)-1]
+		case o.path == op.path:
+			fetches[1] = &call{op: o, target: kept + query}
+		case !strings.HasSuffix(op.path, "}") && o.path == op.path[:strings.LastIndex(op.path, "/")]:
+			fetches[2] = &call{op: o, target: kept[:strings.LastIndex(kept, "/")] + query}
+		}
+	}
+	i := slices.IndexFunc(fetches[:], func(c *call) bool { return c != nil })
+	if i < 0 {
+		return
+	}
+	f := fetches[i]
+	call := call{op: f.op, target: vars.Fill(f.target, rec.vars)}
+	resp, err := rec.send(call)
+	if err != nil && op.method != "delete" {
+		return
+	}
+	if i == 0 {
+		rec.save(cr, saves)
+	}
+	r := rec.request(call)
+	r.Path = f.target
+	// A page's entities made at the same frozen moment come in no set order
+	if data, ok := vars.Lookup(resp, "data"); ok {
+		if _, ok := data.([]any); ok {
+			r.Unordered = []string{"data"}
+		}
+	}
+	rec.c.Requests = append(rec.c.Requests, r)
+}
+
+// fill returns the target of a request for op, as sent and as kept in the
+// case, the entity to make its body after, and the path parameters that
+// name entities the case created, by what the case saves those as. A
+// parameter naming an entity of a collection the case created one in is
+// that one; others are the seed's first of theirs, or the user's own
+// email. The targets are empty if a created entity is wanted but has no
+// ID.
+func (rec *recording) fill(op operation) (live, kept string, template any, from map[string]string) {
+	live, kept = op.path, op.path
+	template = rec.seed.first[collectionName(op.path)]
+	for _, name := range op.pathParams() {
+		param := "{" + name + "}"
+		before := op.path[:strings.Index(op.path, param)-1]
+		id := rec.seed.id(name, collectionName(before))
+		if strings.Contains(strings.ToLower(name), "email") {
+			id = rec.email // Users may only see themselves
+		}
+		saved := url.PathEscape(id)
+		if cr, ok := rec.created[before]; ok {
+			if id = entityID(cr.entity, name); id == "" {
+				return "", "", nil, nil
+			}
+			if from == nil {
+				from = make(map[string]string)
+			}
+			saved, template, from[cr.name] = "{{"+cr.name+"}}", cr.entity, name
+		} else {
+			template = rec.seed.first[collectionName(before)]
+		}
+		live = strings.Replace(live, param, url.PathEscape(id), 1)
+		kept = strings.Replace(kept, param, saved, 1)
+	}
+	return live, kept, template, from
+}
+
+// describe says what the case does: the writes it makes, those it makes
+// as another user, and those of the server's it leaves out, for want of a 2xx or because the server skips
+// them.
+func (rec *recording) describe() string {
+	var b strings.Builder
+	each := "each "
+	if len(rec.writes) == 1 {
+		each = ""
+	}
+	b.WriteString("As the seed's first user, " + joinAnd(rec.writes) + ", " + each + "followed by a fetch of what it wrote where there is a route for it")
+	if len(rec.others) > 0 {
+		b.WriteString(". Made with another user's token, as the server's testdata/smoke.json pins: " + joinAnd(rec.others))
+	}
+	if len(rec.missed) > 0 {
+		b.WriteString(". Left out, as they got no 2xx: " + joinAnd(rec.missed))
+	}
+	if len(rec.skipped) > 0 {
+		b.WriteString(". Skipped, as the server's testdata/smoke.json says: " + joinAnd(rec.skipped))
+	}
+	return b.String()
+}
+
+// joinAnd joins items as a list in a sentence, such as "a, b and c".
+func joinAnd(items []string) string {
+	if len(items) < 2 {
+		return strings.Join(items, "")
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1]
+}
+
+// entityOf returns the entity in a write's response, and where in it it
+// is: the response itself, or, for a response that wraps it, such as
+// {"webhook": {...}}, the one object in it with an ID.
+func entityOf(resp any) (map[string]any, string) {
+	obj, _ := resp.(map[string]any)
+	if entityID(obj, "id") != "" {
+		return obj, ""
+	}
+	var found map[string]any
+	var at string
+	for key, v := range obj {
+		if inner, ok := v.(map[string]any); ok && entityID(inner, "id") != "" {
+			if found != nil {
+				return obj, ""
+			}
+			found, at = inner, key
+		}
+	}
+	if found == nil {
+		return obj, ""
+	}
+	return found, at
+}
+
+// fieldFor returns the field entityID finds an entity's ID in.
+func fieldFor(entity map[string]any, name string) string {
+	if _, ok := entity[name]; ok {
+		return name
+	}
+	return "id"
+}
+
+// collectionName returns the last segment of a collection's path, such as
+// orders for /api/v1/orders.
+func collectionName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// request returns a call as a contract case's request, as the suite sends
+// it.
+func (su *suite) request(c call) contract.Request {
+	r := contract.Request{Method: strings.ToUpper(c.op.method), Path: c.target}
+	if su.token != "" {
+		r.Headers = map[string]string{"Authorization": "Bearer " + su.token}
+	}
+	for name, v := range c.headers {
+		if r.Headers == nil {
+			r.Headers = make(map[string]string)
+		}
+		r.Headers[name] = v
+	}
+	if c.body != nil {
+		r.Body = json.RawMessage(c.body)
+	}
+	return r
+}
+
+// writeCase writes c as the server's writes case, keeping the fields an
+// earlier one masked or sorted, for the golden responses to be recorded
+// with contract -update.
+func writeCase(dir string, c *contract.Case) error {
+	path := filepath.Join(dir, contract.Dir, writesCase)
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var old contract.Case
+		if err := json.Unmarshal(data, &old); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		c.Ignore, c.Unordered = old.Ignore, old.Unordered
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // For the queries' &
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"pkg/contract"
+)
+
+// operation is a route in a server's spec.
+type operation struct {
+	method   string
+	path     string // With its parameters as {name}
+	params   []map[string]any
+	body     map[string]any // Its JSON body's schema, if it takes one
+	response map[string]any // Its 2xx JSON response's schema, if it has one
+}
+
+func (op operation) String() string {
+	return strings.ToUpper(op.method) + " " + op.path
+}
+
+// shared are the first segments, after /api/v1, of the routes every server
+// has from the scaffolding, which tell nothing about the server's own.
+var shared = []string{"activity", "auth", "batch", "blobs", "charges", "events", "me", "notifications", "routes", "webhooks"}
+
+// operations returns the server's own routes in a spec, in order of their
+// paths and methods, but for event streams, which don't end.
+func operations(spec map[string]any) []operation {
+	return routes(spec, func(path string) bool { return !isShared(path) })
+}
+
+// routes returns the routes in a spec whose paths keep accepts, as
+// operations does.
+func routes(spec map[string]any, keep func(path string) bool) []operation {
+	paths, _ := spec["paths"].(map[string]any)
+	keys := make([]string, 0, len(paths))
+	for path := range paths {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+
+	var ops []operation
+	for _, path := range keys {
+		if !keep(path) {
+			continue
+		}
+		item, _ := paths[path].(map[string]any)
+		for _, method := range []string{"get", "post", "put", "patch", "delete"} {
+			op, ok := item[method].(map[string]any)
+			if !ok {
+				continue
+			}
+			o := operation{method: method, path: path}
+			params, _ := op["parameters"].([]any)
+			for _, p := range params {
+				if p, ok := p.(map[string]any); ok {
+					o.params = append(o.params, p)
+				}
+			}
+			o.body = jsonSchema(op["requestBody"])
+			responses, _ := op["responses"].(map[string]any)
+			codes := make([]string, 0, len(responses))
+			for code := range responses {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			streams := false
+			for _, code := range codes {
+				if strings.HasPrefix(code, "2") && o.response == nil {
+					resp, _ := responses[code].(map[string]any)
+					content, _ := resp["content"].(map[string]any)
+					_, streams = content["text/event-stream"]
+					o.response = jsonSchema(resp)
+				}
+			}
+			if !streams {
+				ops = append(ops, o)
+			}
+		}
+	}
+	return ops
+}
+
+func isShared(path string) bool {
+	rest, ok := strings.CutPrefix(path, "/api/v1/")
+	if !ok {
+		return path == "/api/routes" || !strings.HasPrefix(path, "/api/")
+	}
+	first, _, _ := strings.Cut(rest, "/")
+	for _, s := range shared {
+		if first == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonSchema returns the schema of a request body's or response's JSON.
+func jsonSchema(v any) map[string]any {
+	withContent, _ := v.(map[string]any)
+	content, _ := withContent["content"].(map[string]any)
+	media, _ := content["application/json"].(map[string]any)
+	schema, _ := media["schema"].(map[string]any)
+	return schema
+}
+
+// pathParams returns the names of op's path parameters.
+func (op operation) pathParams() []string {
+	var names []string
+	for _, p := range op.params {
+		if p["in"] == "path" {
+			name, _ := p["name"].(string)
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// requiresQuery reports whether op has required query parameters.
+func (op operation) requiresQuery() bool {
+	for _, p := range op.params {
+		if p["in"] == "query" && p["required"] == true {
+			return true
+		}
+	}
+	return false
+}
+
+// searchParam returns the name of op's query parameter for search terms,
+// if it has one.
+func (op operation) searchParam() string {
+	for _, p := range op.params {
+		if name, _ := p["name"].(string); p["in"] == "query" && searchParams[strings.ToLower(name)] {
+			return name
+		}
+	}
+	return ""
+}
+
+// searchParams are the names of query parameters that take search terms.
+var searchParams = map[string]bool{"q": true, "query": true, "search": true, "keyword": true, "keywords": true, "term": true, "text": true}
+
+// seedData is what requests are filled in from: the keys and IDs of the
+// seed's entities, by collection, and the strings and numbers in their
+// fields, by field name, each in order, and each collection's first
+// entity. Lists of objects or IDs in entities count as collections too.
+type seedData struct {
+	ids    map[string][]string
+	values map[string][]string
+	first  map[string]map[string]any
+}
+
+func loadSeed(database string) (*seedData, error) {
+	data, err := os.ReadFile(database)
+	if err != nil {
+		return nil, err
+	}
+	var db map[string]any
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("%s: %w", database, err)
+	}
+	s := &seedData{ids: make(map[string][]string), values: make(map[string][]string), first: make(map[string]map[string]any)}
+	firstKeys := make(map[string]string)
+	var add func(coll string, entity any, key string)
+	add = func(coll string, entity any, key string) {
+		e, _ := entity.(map[string]any)
+		if id, ok := e["id"].(string); ok && id != "" {
+			key = id
+		}
+		if key != "" {
+			s.ids[coll] = append(s.ids[coll], key)
+		}
+		if first, ok := firstKeys[coll]; e != nil && (!ok || key < first) {
+			firstKeys[coll], s.first[coll] = key, e
+		}
+		for field, v := range e {
+			switch v := v.(type) {
+			case string:
+				if v != "" && len(v) <= 100 {
+					s.values[field] = append(s.values[field], v)
+				}
+			case float64:
+				s.values[field] = append(s.values[field], strconv.FormatFloat(v, 'f', -1, 64))
+			case []any: // Such as a user's payment methods, their own collection
+				for _, item := range v {
+					switch item := item.(type) {
+					case map[string]any:
+						add(field, item, "")
+					case string: // Or just their IDs
+						s.ids[field] = append(s.ids[field], item)
+					}
+				}
+			}
+		}
+	}
+	// In order, for the first of the lists in entities to be the same
+	// every time
+	for _, name := range sortedKeys(db) {
+		if name == "auth" {
+			continue
+		}
+		switch coll := db[name].(type) {
+		case map[string]any:
+			for _, key := range sortedKeys(coll) {
+				add(name, coll[key], key)
+			}
+		case []any:
+			for _, entity := range coll {
+				add(name, entity, "")
+			}
+		}
+	}
+	for _, ids := range s.ids {
+		sort.Strings(ids)
+	}
+	for _, values := range s.values {
+		sort.Strings(values)
+	}
+	return s, nil
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// id returns the first ID of the collection a parameter or field names an
+// entity of: for accountId or account_id, accounts, and for the {id} in
+// /tax-returns/{id}, tax_returns, the segment before it. Failing that, it
+// is the first value of a field of the same name, such as another
+// entity's account_id or a shipment's tracking_number for trackingNumber,
+// or of the segment's name, as for /barcode/{code}, or "1".
+func (s *seedData) id(name, segment string) string {
+	base := strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "Id"), "_id"), "ID"))
+	segment = strings.ReplaceAll(segment, "-", "_")
+	for _, coll := range []string{base + "s", base + "es", strings.TrimSuffix(base, "y") + "ies", base, segment} {
+		if ids := s.ids[coll]; len(ids) > 0 {
+			return ids[0]
+		}
+	}
+	fields := []string{segment}
+	if name != "id" {
+		fields = []string{name, snakeCase(name), segment}
+	}
+	for _, field := range fields {
+		if v := s.value(field, ""); v != "" {
+			return v
+		}
+	}
+	return "1"
+}
+
+// snakeCase returns a camelCase name in snake_case.
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// value returns the first of the seed's values of the field name, or def.
+func (s *seedData) value(name, def string) string {
+	if values := s.values[name]; len(values) > 0 {
+		return values[0]
+	}
+	return def
+}
+
+// step is a request of the suite, run by a function that reports whether
+// the server had a route for it.
+type step struct {
+	name string
+	run  func() (bool, error)
+}
+
+// suite is the smoke suite, run against one server.
+type suite struct {
+	server *contract.Server
+	spec   map[string]any
+	seed   *seedData
+	token  string                       // The seed's first user's, if it has one
+	email  string                       // Whose token it is
+	pinned map[string]*contract.Request // Steps' requests, by step, that the server gives itself; nil to skip one
+	now    time.Time                    // What dates in requests are made from
+
+	ops     []operation
+	listed  operation      // The list step's route
+	first   map[string]any // The first entity it listed
+	create  *call          // The create step's request that worked
+	created any            // And its response
+}
+
+// call is a request for a route.
+type call struct {
+	op      operation
+	target  string            // Its path and query
+	body    []byte            // nil for none
+	headers map[string]string // Besides the user's token, or in place of it
+}
+
+// stepNames are the names of the suite's steps, in the order they run.
+var stepNames = []string{"list", "detail", "search", "create"}
+
+// steps returns the suite's steps, in the order they run: the list first,
+// for the fetch to fetch what it listed, and the create last, so that the
+// rest see the seed as it is.
+func (su *suite) steps() []step {
+	su.ops = operations(su.spec)
+	return []step{
+		{"list", func() (bool, error) { return su.run("list", su.lists()) }},
+		{"detail", func() (bool, error) { return su.run("detail", su.details()) }},
+		{"search", func() (bool, error) { return su.run("search", su.searches()) }},
+		{"create", func() (bool, error) { return su.run("create", su.creates()) }},
+	}
+}
+
+// run sends the step's calls, or the request the server pins for it, until
+// one gets a 2xx of the right shape, and returns the first's error if none
+// does. It reports whether there was a call to send.
+func (su *suite) run(name string, calls []call) (bool, error) {
+	if r, ok := su.pinned[name]; ok {
+		if r == nil {
+			return false, nil
+		}
+		c := call{op: su.operation(r.Method, r.Path), target: r.Path}
+		if r.Body != nil {
+			body, err := json.Marshal(r.Body)
+			if err != nil {
+				return true, err
+			}
+			c.body = body
+		}
+		calls = []call{c}
+	}
+	var first error
+	for _, c := range calls {
+		body, err := su.send(c)
+		if err == nil {
+			switch name {
+			case "list":
+				su.listed, su.first = c.op, firstListed(body)
+			case "create":
+				su.create, su.created = &c, body
+			}
+			return true, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return len(calls) > 0, first
+}
+
+// operation returns the route a request for target is for, to check its
+// response's shape by; one without a response schema if there is none.
+func (su *suite) operation(method, target string) operation {
+	path, _, _ := strings.Cut(target, "?")
+	segments := strings.Split(path, "/")
+	for _, op := range su.ops {
+		if op.method != strings.ToLower(method) {
+			continue
+		}
+		pattern := strings.Split(op.path, "/")
+		if len(pattern) != len(segments) {
+			continue
+		}
+		matched := true
+		for i, seg := range pattern {
+			if seg != segments[i] && !strings.HasPrefix(seg, "{") {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return op
+		}
+	}
+	return operation{method: strings.ToLower(method), path: path}
+}
+
+// lists are GETs of collections: paths without parameters, or search
+// terms, whose responses are or hold lists.
+func (su *suite) lists() []call {
+	var calls []call
+	for _, op := range su.ops {
+		if op.method == "get" && len(op.pathParams()) == 0 && !op.requiresQuery() && op.searchParam() == "" && !strings.Contains(op.path, "search") && su.holdsList(op.response) {
+			calls = append(calls, call{op: op, target: op.path})
+		}
+	}
+	return calls
+}
+
+// details are GETs of entities: the first one listed, from the route
+// beneath the list's, and then the seed's first of the collection each
+// other such route is beneath.
+func (su *suite) details() []call {
+	var calls []call
+	for _, op := range su.ops {
+		params := op.pathParams()
+		if op.method != "get" || len(params) != 1 || op.requiresQuery() || !strings.HasSuffix(op.path, "/{"+params[0]+"}") {
+			continue
+		}
+		name := params[0]
+		collection := strings.TrimSuffix(op.path, "/{"+name+"}")
+		id := su.seed.id(name, collection[strings.LastIndex(collection, "/")+1:])
+		if strings.Contains(strings.ToLower(name), "email") {
+			id = su.email // Users may only see themselves
+		}
+		if collection == su.listed.path && su.first != nil {
+			if listed := entityID(su.first, name); listed != "" {
+				id = listed
+			}
+		}
+		c := call{op: op, target: strings.ReplaceAll(op.path, "{"+name+"}", url.PathEscape(id))}
+		if collection == su.listed.path {
+			calls = append([]call{c}, calls...)
+		} else {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// searchPath is where pkg/server searches across a server's collections.
+const searchPath = "/api/v1/search"
+
+// searches are GETs that take search terms, with a word from the seed's
+// names or titles, their required query parameters, and the others the
+// seed has values of, such as a flight's origin, or that are dates.
+func (su *suite) searches() []call {
+	var calls []call
+	for _, op := range su.ops {
+		if op.method != "get" || len(op.pathParams()) > 0 || (op.searchParam() == "" && !strings.Contains(op.path, "search")) {
+			continue
+		}
+		query := url.Values{}
+		for _, p := range op.params {
+			name, _ := p["name"].(string)
+			schema, _ := p["schema"].(map[string]any)
+			lower := strings.ToLower(name)
+			switch {
+			case p["in"] != "query":
+			case name == op.searchParam():
+				query.Set(name, su.searchTerm())
+			case name == "type" && op.path == searchPath && p["required"] != true:
+				// The search across collections takes collection names as
+				// its type, not a value from the seed.
+			case p["required"] == true || len(su.seed.values[name]) > 0 || strings.Contains(lower, "date"):
+				query.Set(name, fmt.Sprint(su.value(name, schema, nil, 0)))
+			}
+		}
+		target := op.path
+		if len(query) > 0 {
+			target += "?" + query.Encode()
+		}
+		calls = append(calls, call{op: op, target: target})
+	}
+	return calls
+}
+
+// searchTerm returns the first word of the seed's first name or title.
+func (su *suite) searchTerm() string {
+	for _, field := range []string{"name", "title", "category", "brand", "city"} {
+		if words := strings.Fields(su.seed.value(field, "")); len(words) > 0 {
+			return words[0]
+		}
+	}
+	return "a"
+}
+
+// creates are POSTs of new entities, to the listed collection first, with
+// the bodies' fields filled in after the entity listed, or else the seed's
+// first of the collection.
+func (su *suite) creates() []call {
+	var calls []call
+	for _, op := range su.ops {
+		if op.method != "post" || len(op.pathParams()) > 0 || op.requiresQuery() || op.body == nil {
+			continue
+		}
+		template := su.seed.first[op.path[strings.LastIndex(op.path, "/")+1:]]
+		if op.path == su.listed.path && su.first != nil {
+			template = su.first
+		}
+		body, err := json.Marshal(su.value("", op.body, template, 0))
+		if err != nil {
+			continue
+		}
+		c := call{op: op, target: op.path, body: body}
+		if op.path == su.listed.path {
+			calls = append([]call{c}, calls...)
+		} else {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// resolve follows a schema's $ref into the spec's components.
+func (su *suite) resolve(schema map[string]any) map[string]any {
+	ref, ok := schema["$ref"].(string)
+	if !ok {
+		return schema
+	}
+	components, _ := su.spec["components"].(map[string]any)
+	schemas, _ := components["schemas"].(map[string]any)
+	resolved, _ := schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]any)
+	return resolved
+}
+
+// holdsList reports whether a response of schema is a list, or an object
+// with one, as pages are.
+func (su *suite) holdsList(schema map[string]any) bool {
+	schema = su.resolve(schema)
+	if schema["type"] == "array" {
+		return true
+	}
+	props, _ := schema["properties"].(map[string]any)
+	for _, prop := range props {
+		if prop, _ := prop.(map[string]any); su.resolve(prop)["type"] == "array" {
+			return true
+		}
+	}
+	return false
+}
+
+// value makes a value of schema for the field name, the same every time:
+// an object's required fields, or all of them if it names none, as in the
+// template entity where it has them, and otherwise the seed's IDs and
+// values for fields of the same name. Dates are a week from now, and those
+// that end something a few days later.
+func (su *suite) value(name string, schema map[string]any, template any, depth int) any {
+	schema = su.resolve(schema)
+	if schema == nil || depth > 6 {
+		return nil
+	}
+	lower := strings.ToLower(name)
+	dated := schema["format"] == "date" || schema["format"] == "date-time" || strings.Contains(lower, "date") || strings.HasSuffix(lower, "_at")
+	if _, nested := template.(map[string]any); template != nil && !dated && (!nested || schema["type"] != "object") {
+		if jsonType(template) == schema["type"] || jsonType(template) == "integer" && schema["type"] == "number" {
+			return template
+		}
+	}
+	if enum, ok := schema["enum"].([]any); ok && len(enum) > 0 {
+		return enum[0]
+	}
+	switch schema["type"] {
+	case "object":
+		obj := make(map[string]any)
+		props, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		if len(required) == 0 {
+			for key := range props {
+				required = append(required, key)
+			}
+		}
+		fields, _ := template.(map[string]any)
+		for _, key := range required {
+			if key, ok := key.(string); ok {
+				prop, _ := props[key].(map[string]any)
+				obj[key] = su.value(key, prop, fields[key], depth+1)
+			}
+		}
+		return obj
+	case "array":
+		items, _ := schema["items"].(map[string]any)
+		var item any
+		if list, _ := template.([]any); len(list) > 0 {
+			item = list[0]
+		}
+		return []any{su.value(name, items, item, depth+1)}
+	case "integer":
+		return max(1, int(number(schema["minimum"])))
+	case "number":
+		return max(10, number(schema["minimum"]))
+	case "boolean":
+		return true
+	}
+	soon := su.now.AddDate(0, 0, 7)
+	if strings.Contains(lower, "out") || strings.Contains(lower, "end") || strings.Contains(lower, "return") || strings.Contains(lower, "until") {
+		soon = soon.AddDate(0, 0, 3)
+	}
+	switch {
+	case schema["format"] == "email" || strings.Contains(lower, "email"):
+		return su.email
+	case lower == "id" || strings.HasSuffix(lower, "_id") || strings.HasSuffix(name, "Id"):
+		return su.seed.id(name, "")
+	case schema["format"] == "date" || strings.Contains(lower, "date") && schema["format"] != "date-time":
+		return soon.Format(time.DateOnly)
+	case dated || strings.Contains(lower, "time"):
+		return soon.Format(time.RFC3339)
+	default:
+		if ids := su.seed.ids[snakeCase(name)+"s"]; len(ids) > 0 {
+			return ids[0] // Such as a payment_method, by its ID
+		}
+		return su.seed.value(name, "Smoke test")
+	}
+}
+
+func number(v any) float64 {
+	f, _ := v.(float64)
+	return f
+}
+
+// firstListed returns the first entity in a list response: the response
+// itself, or the first list in it.
+func firstListed(body any) map[string]any {
+	list, ok := body.([]any)
+	if obj, isObj := body.(map[string]any); isObj {
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if list, ok = obj[key].([]any); ok {
+				break
+			}
+		}
+	}
+	if !ok || len(list) == 0 {
+		return nil
+	}
+	first, _ := list[0].(map[string]any)
+	return first
+}
+
+// entityID returns the ID of an entity, for a path parameter name.
+func entityID(entity map[string]any, name string) string {
+	for _, field := range []string{name, "id"} {
+		switch v := entity[field].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return ""
+}
+
+// send sends the call as the seed's first user, and returns its
+// response's decoded body if it is a 2xx of the shape its route's spec
+// gives.
+func (su *suite) send(c call) (any, error) {
+	var r io.Reader
+	if c.body != nil {
+		r = bytes.NewReader(c.body)
+	}
+	req, err := http.NewRequest(strings.ToUpper(c.op.method), su.server.URL+c.target, r)
+	if err != nil {
+		return nil, err
+	}
+	if su.token != "" {
+		req.Header.Set("Authorization", "Bearer "+su.token)
+	}
+	if c.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, v := range c.headers {
+		req.Header.Set(name, v)
+	}
+	status, resp, err := su.server.Do(req)
+	request := strings.ToUpper(c.op.method) + " " + c.target
+	if c.body != nil {
+		request += " " + string(c.body)
+	}
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("%s: %w", request, err)
+	case status < 200 || status > 299:
+		return nil, fmt.Errorf("%s: %d %s", request, status, errorMessage(resp))
+	}
+	if want := su.resolve(c.op.response); want != nil {
+		if got := jsonType(resp); want["type"] != nil && got != want["type"] && !(got == "integer" && want["type"] == "number") {
+			return nil, fmt.Errorf("%s: got %s, want %s", request, got, want["type"])
+		}
+	}
+	return resp, nil
+}
+
+// jsonType returns the JSON Schema type of a decoded value.
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+// errorMessage returns the message of an error envelope.
+func errorMessage(body any) string {
+	envelope, _ := body.(map[string]any)
+	e, _ := envelope["error"].(map[string]any)
+	if msg, ok := e["message"].(string); ok {
+		return msg
+	}
+	return fmt.Sprint(body)
+}
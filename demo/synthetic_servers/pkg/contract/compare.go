@@ -0,0 +1,220 @@
+package contract
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Placeholders for the values that change from run to run.
+const (
+	placeholderTimestamp = "<timestamp>"
+	placeholderUUID      = "<uuid>"
+	placeholderID        = "<id>"
+	placeholderIgnored   = "<ignored>"
+)
+
+// maxDiffs is how many differences are reported for a response.
+const maxDiffs = 10
+
+var (
+	timestampPattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})`)
+	uuidPattern      = regexp.MustCompile(`(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+	// hexIDPattern matches the random hex in tokens and IDs, like
+	// tok_2e3a4b77e3ab63f87a1766ccfac606ef.
+	hexIDPattern = regexp.MustCompile(`[0-9a-f]{32,}`)
+	// messageIDPattern matches the shorter random hex after the prefix of
+	// a charge's, message's or the like's ID, like ch_12aaa08edbc9c034.
+	messageIDPattern = regexp.MustCompile(`\b([a-z]+_)[0-9a-f]{16}\b`)
+)
+
+// normalize masks the values in a response body that change from run to
+// run: the fields at the ignore paths, and timestamps, UUIDs and random
+// hex IDs in strings. It then sorts the lists at the unordered paths.
+func normalize(v any, ignore, unordered []string) any {
+	v = scrub(v)
+	for _, path := range ignore {
+		v = mask(v, split(path))
+	}
+	for _, path := range unordered {
+		v = reorder(v, split(path))
+	}
+	return v
+}
+
+// split splits a dotted path into its keys; the empty path is the body
+// itself.
+func split(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+func scrub(v any) any {
+	switch v := v.(type) {
+	case string:
+		v = timestampPattern.ReplaceAllString(v, placeholderTimestamp)
+		v = uuidPattern.ReplaceAllString(v, placeholderUUID)
+		v = hexIDPattern.ReplaceAllString(v, placeholderID)
+		return messageIDPattern.ReplaceAllString(v, "${1}"+placeholderID)
+	case map[string]any:
+		for k, e := range v {
+			v[k] = scrub(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = scrub(e)
+		}
+	}
+	return v
+}
+
+// mask replaces the values at path in v, where * matches any key or
+// index.
+func mask(v any, path []string) any {
+	if len(path) == 0 {
+		return placeholderIgnored
+	}
+	key, rest := path[0], path[1:]
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if key == "*" || key == k {
+				v[k] = mask(e, rest)
+			}
+		}
+	case []any:
+		for i, e := range v {
+			if key == "*" || key == strconv.Itoa(i) {
+				v[i] = mask(e, rest)
+			}
+		}
+	}
+	return v
+}
+
+// reorder sorts the lists at path in v, where * matches any key or index,
+// by their items' JSON.
+func reorder(v any, path []string) any {
+	if len(path) == 0 {
+		list, ok := v.([]any)
+		if !ok {
+			return v
+		}
+		type item struct {
+			json string
+			v    any
+		}
+		items := make([]item, len(list))
+		for i, e := range list {
+			data, _ := json.Marshal(e) // Objects' keys come out sorted
+			items[i] = item{string(data), e}
+		}
+		sort.SliceStable(items, func(a, b int) bool { return items[a].json < items[b].json })
+		for i := range items {
+			list[i] = items[i].v
+		}
+		return list
+	}
+	key, rest := path[0], path[1:]
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if key == "*" || key == k {
+				v[k] = reorder(e, rest)
+			}
+		}
+	case []any:
+		for i, e := range v {
+			if key == "*" || key == strconv.Itoa(i) {
+				v[i] = reorder(e, rest)
+			}
+		}
+	}
+	return v
+}
+
+// diff describes how got differs from golden, field by field, down from
+// path.
+func diff(path string, golden, got any) []string {
+	var diffs []string
+	walk(path, golden, got, &diffs)
+	if len(diffs) > maxDiffs {
+		diffs = append(diffs[:maxDiffs], fmt.Sprintf("and %d more", len(diffs)-maxDiffs))
+	}
+	return diffs
+}
+
+func walk(path string, golden, got any, diffs *[]string) {
+	switch g := golden.(type) {
+	case map[string]any:
+		o, ok := got.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(g)+len(o))
+		for k := range g {
+			keys = append(keys, k)
+		}
+		for k := range o {
+			if _, ok := g[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			gv, inGolden := g[k]
+			ov, inGot := o[k]
+			switch {
+			case !inGot:
+				*diffs = append(*diffs, fmt.Sprintf("%s.%s: missing, golden %s", path, k, show(gv)))
+			case !inGolden:
+				*diffs = append(*diffs, fmt.Sprintf("%s.%s: unexpected, got %s", path, k, show(ov)))
+			default:
+				walk(path+"."+k, gv, ov, diffs)
+			}
+		}
+		return
+	case []any:
+		o, ok := got.([]any)
+		if !ok {
+			break
+		}
+		if len(g) != len(o) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: golden %d items, got %d", path, len(g), len(o)))
+		}
+		for i := 0; i < min(len(g), len(o)); i++ {
+			walk(path+"."+strconv.Itoa(i), g[i], o[i], diffs)
+		}
+		return
+	}
+	// Either scalars, or values of different types.
+	if golden != got {
+		*diffs = append(*diffs, fmt.Sprintf("%s: golden %s, got %s", path, show(golden), show(got)))
+	}
+}
+
+// show renders a JSON value in a diff, cut short if it's long.
+func show(v any) string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		s = "null"
+	case string:
+		s = strconv.Quote(v)
+	case map[string]any:
+		s = fmt.Sprintf("an object of %d fields", len(v))
+	case []any:
+		s = fmt.Sprintf("a list of %d items", len(v))
+	default:
+		s = fmt.Sprint(v)
+	}
+	if len(s) > 80 {
+		s = s[:77] + "..."
+	}
+	return s
+}
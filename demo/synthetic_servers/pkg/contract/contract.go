@@ -0,0 +1,264 @@
+// Package contract checks that a synthetic server still answers as it
+// did: it replays recorded requests against the server, booted on a
+// fixture database, and compares the responses with golden ones.
+//
+// A server's cases are JSON files in its testdata/contract directory, each
+// a run of requests against a fresh copy of the fixture, with the clock
+// frozen:
+//
+//	{
+//	  "description": "Adding a travel notice shows it on the account",
+//	  "ignore": ["data.*.balance"],
+//	  "requests": [
+//	    {"method": "POST", "path": "/api/v1/accounts/acc_checking_1/travel-notices",
+//	     "headers": {"Authorization": "Bearer tok_..."},
+//	     "body": {"destinations": ["Peru"], "start_date": "2026-11-01", "end_date": "2026-11-09"},
+//	     "save": {"notice": "id"}},
+//	    {"method": "GET", "path": "/api/v1/accounts/acc_checking_1/travel-notices/{{notice}}",
+//	     "headers": {"Authorization": "Bearer tok_..."}}
+//	  ]
+//	}
+//
+// save keeps fields of a response for later requests to use as
+// {{name}}. Each case's responses are kept in its golden file, like
+// notices.golden.json for notices.json, with the fields that change from
+// run to run masked: timestamps, UUIDs, random hex IDs, and those the case
+// or request lists under ignore, as dotted paths in which * matches any
+// key or index. Lists a case or request names under unordered, like the
+// data of a page of entities kept in a map, are sorted, so the order they
+// come in doesn't matter; "" names the body itself.
+//
+// The fixture is testdata/contract/database.json if there is one, and
+// otherwise the server's seed.
+package contract
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dir is where a server's cases are, in its directory.
+const Dir = "testdata/contract"
+
+// FixtureFile is the fixture database a server's cases run on, in Dir,
+// if it has its own.
+const FixtureFile = "database.json"
+
+// DefaultClock is where the clock stands for cases that don't set it.
+var DefaultClock = time.Date(2025, time.January, 15, 12, 0, 0, 0, time.UTC)
+
+// Case is a run of requests against a fresh copy of the fixture.
+type Case struct {
+	Name        string     `json:"-"` // Its file's, without .json
+	Description string     `json:"description,omitempty"`
+	Clock       *time.Time `json:"clock,omitempty"`     // Where the clock stands, frozen; DefaultClock if nil
+	Ignore      []string   `json:"ignore,omitempty"`    // Fields to mask in every response
+	Unordered   []string   `json:"unordered,omitempty"` // Lists in every response whose order doesn't matter
+	Requests    []Request  `json:"requests"`
+}
+
+// Request is a request in a case. Its path, header values and body strings
+// may use what earlier requests saved, as {{name}}.
+type Request struct {
+	Method    string            `json:"method"`
+	Path      string            `json:"path"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      any               `json:"body,omitempty"`
+	Ignore    []string          `json:"ignore,omitempty"`    // Fields to mask in its response
+	Unordered []string          `json:"unordered,omitempty"` // Lists in its response whose order doesn't matter
+	Save      map[string]string `json:"save,omitempty"`      // Name -> field of the response to keep as it
+}
+
+// String identifies the request in golden files and failures.
+func (r Request) String() string {
+	return r.Method + " " + r.Path
+}
+
+// Response is a response as kept in a golden file.
+type Response struct {
+	Request string `json:"request"`
+	Status  int    `json:"status"`
+	Body    any    `json:"body,omitempty"`
+}
+
+// LoadCases reads the cases in a server's directory, in name order.
+func LoadCases(serverDir string) ([]*Case, error) {
+	files, err := filepath.Glob(filepath.Join(serverDir, Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var cases []*Case
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		if strings.HasSuffix(name, ".golden") || filepath.Base(file) == FixtureFile {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		c := &Case{Name: name}
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+// goldenFile is where a case's golden responses are kept.
+func goldenFile(serverDir string, c *Case) string {
+	return filepath.Join(serverDir, Dir, c.Name+".golden.json")
+}
+
+func readGolden(serverDir string, c *Case) ([]Response, error) {
+	data, err := os.ReadFile(goldenFile(serverDir, c))
+	if err != nil {
+		return nil, err
+	}
+	var golden []Response
+	if err := json.Unmarshal(data, &golden); err != nil {
+		return nil, fmt.Errorf("%s: %w", goldenFile(serverDir, c), err)
+	}
+	return golden, nil
+}
+
+func writeGolden(serverDir string, c *Case, responses []Response) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // For the placeholders' <>
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(responses); err != nil {
+		return err
+	}
+	return os.WriteFile(goldenFile(serverDir, c), buf.Bytes(), 0o644)
+}
+
+// Fixture returns the fixture database for a server's cases.
+func Fixture(serverDir string) string {
+	path := filepath.Join(serverDir, Dir, FixtureFile)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	return filepath.Join(serverDir, "database.json")
+}
+
+// FirstToken returns the first seed token in a database's auth.tokens, in
+// the file's order, and the email of the user it belongs to, or "" if it
+// has none.
+func FirstToken(database string) (token, email string, err error) {
+	data, err := os.ReadFile(database)
+	if err != nil {
+		return "", "", err
+	}
+	var db struct {
+		Auth struct {
+			Tokens json.RawMessage `json:"tokens"`
+		} `json:"auth"`
+	}
+	if err := json.Unmarshal(data, &db); err != nil || db.Auth.Tokens == nil {
+		return "", "", err
+	}
+	dec := json.NewDecoder(bytes.NewReader(db.Auth.Tokens))
+	if _, err := dec.Token(); err != nil { // {
+		return "", "", err
+	}
+	if !dec.More() {
+		return "", "", nil
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return "", "", err
+	}
+	token, ok := tok.(string)
+	if !ok {
+		return "", "", errors.New("auth.tokens isn't an object")
+	}
+	if err := dec.Decode(&email); err != nil {
+		return "", "", err
+	}
+	return token, email, nil
+}
+
+// Failure is a response that differs from its golden one.
+type Failure struct {
+	Case    string
+	Request string // Empty if the whole case failed
+	Diffs   []string
+}
+
+func (f Failure) String() string {
+	where := f.Case
+	if f.Request != "" {
+		where += ": " + f.Request
+	}
+	return where + "\n\t" + strings.Join(f.Diffs, "\n\t")
+}
+
+// Check replays a server's cases against it and compares the responses
+// with the golden ones, or with update, writes them as the golden ones.
+// It returns how many cases passed and how the others failed.
+func Check(s *Server, serverDir string, cases []*Case, update bool) (passed int, failures []Failure, err error) {
+	for _, c := range cases {
+		responses, err := s.Replay(c)
+		if err != nil {
+			return passed, failures, fmt.Errorf("%s: %w", c.Name, err)
+		}
+		if update {
+			if err := writeGolden(serverDir, c, responses); err != nil {
+				return passed, failures, err
+			}
+			passed++
+			continue
+		}
+
+		golden, err := readGolden(serverDir, c)
+		if os.IsNotExist(err) {
+			failures = append(failures, Failure{Case: c.Name, Diffs: []string{"no golden responses; record them with -update"}})
+			continue
+		}
+		if err != nil {
+			return passed, failures, err
+		}
+		caseFailures := compare(c.Name, golden, responses)
+		if len(caseFailures) == 0 {
+			passed++
+		}
+		failures = append(failures, caseFailures...)
+	}
+	return passed, failures, nil
+}
+
+// compare returns how a case's responses differ from the golden ones.
+func compare(name string, golden, got []Response) []Failure {
+	var failures []Failure
+	for i := 0; i < max(len(golden), len(got)); i++ {
+		switch {
+		case i >= len(golden):
+			failures = append(failures, Failure{Case: name, Request: got[i].Request, Diffs: []string{"not in the golden responses"}})
+		case i >= len(got):
+			failures = append(failures, Failure{Case: name, Request: golden[i].Request, Diffs: []string{"not replayed"}})
+		default:
+			var diffs []string
+			if golden[i].Request != got[i].Request {
+				diffs = append(diffs, fmt.Sprintf("request: golden %s, got %s", golden[i].Request, got[i].Request))
+			}
+			if golden[i].Status != got[i].Status {
+				diffs = append(diffs, fmt.Sprintf("status: golden %d, got %d", golden[i].Status, got[i].Status))
+			}
+			diffs = append(diffs, diff("body", golden[i].Body, got[i].Body)...)
+			if len(diffs) > 0 {
+				failures = append(failures, Failure{Case: name, Request: got[i].Request, Diffs: diffs})
+			}
+		}
+	}
+	return failures
+}
@@ -0,0 +1,250 @@
+package contract
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"pkg/internal/vars"
+)
+
+// readyTimeout is how long a server gets to become ready.
+const readyTimeout = 30 * time.Second
+
+// Server is a synthetic server booted for its cases.
+type Server struct {
+	URL        string
+	adminToken string
+	cmd        *exec.Cmd
+	exited     chan struct{}
+	client     *http.Client
+}
+
+// Build builds the server in dir into the directory bin.
+func Build(ctx context.Context, dir, bin string) (string, error) {
+	path := filepath.Join(bin, filepath.Base(dir))
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", path, ".")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("building %s: %v\n%s", filepath.Base(dir), err, bytes.TrimSpace(out))
+	}
+	return path, nil
+}
+
+// Start boots the server binary bin from its directory dir on a free port,
+// with the fixture database, lifecycles off so entities only change on
+// request, and responses checked against its spec, and waits for it to be
+// ready. Its log goes to log.
+func Start(bin, dir string, log io.Writer) (*Server, error) {
+	return StartOn(bin, dir, Fixture(dir), log)
+}
+
+// StartOn boots the server as Start does, but on the database given.
+func StartOn(bin, dir, database string, log io.Writer) (*Server, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	fixture, err := filepath.Abs(database)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		URL:        "http://127.0.0.1:" + strconv.Itoa(port),
+		adminToken: hex.EncodeToString(token),
+		exited:     make(chan struct{}),
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+	s.cmd = exec.Command(bin,
+		"--port", strconv.Itoa(port),
+		"--database", fixture,
+		"--admin-token", s.adminToken,
+		"--lifecycles=false",
+		"--validate-responses", "fail",
+	)
+	s.cmd.Dir = dir // For its openapi.json
+	s.cmd.Stdout, s.cmd.Stderr = log, log
+	if err := s.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		s.cmd.Wait()
+		close(s.exited)
+	}()
+
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		resp, err := s.client.Get(s.URL + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return s, nil
+			}
+		}
+		select {
+		case <-s.exited:
+			return nil, fmt.Errorf("exited before it was ready: %v", s.cmd.ProcessState)
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			s.Stop()
+			return nil, fmt.Errorf("not ready after %s", readyTimeout)
+		}
+	}
+}
+
+// Stop shuts the server down.
+func (s *Server) Stop() {
+	s.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-s.exited:
+	case <-time.After(10 * time.Second):
+		s.cmd.Process.Kill()
+		<-s.exited
+	}
+}
+
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Replay resets the server to the fixture, sets its clock for c, and sends
+// c's requests, returning their responses as kept in golden files.
+func (s *Server) Replay(c *Case) ([]Response, error) {
+	if _, _, err := s.admin("/admin/reset", nil); err != nil {
+		return nil, err
+	}
+	if _, _, err := s.admin("/admin/clock/set", map[string]any{"time": c.clock(), "frozen": true}); err != nil {
+		return nil, err
+	}
+
+	saved := make(map[string]string)
+	responses := make([]Response, 0, len(c.Requests))
+	for _, r := range c.Requests {
+		status, body, err := s.send(r, saved)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r, err)
+		}
+		for name, path := range r.Save {
+			v, ok := vars.Lookup(body, path)
+			if !ok {
+				return nil, fmt.Errorf("%s: no %s in the response to save as %s", r, path, name)
+			}
+			saved[name] = fmt.Sprint(v)
+		}
+		responses = append(responses, Response{
+			Request: r.String(),
+			Status:  status,
+			Body:    normalize(body, slices.Concat(c.Ignore, r.Ignore), slices.Concat(c.Unordered, r.Unordered)),
+		})
+	}
+	return responses, nil
+}
+
+func (c *Case) clock() time.Time {
+	if c.Clock == nil {
+		return DefaultClock
+	}
+	return *c.Clock
+}
+
+// send sends a case's request with the saved variables filled in, and
+// returns the status and decoded body of its response.
+func (s *Server) send(r Request, saved map[string]string) (int, any, error) {
+	var body io.Reader
+	if r.Body != nil {
+		data, err := json.Marshal(vars.Substitute(r.Body, saved))
+		if err != nil {
+			return 0, nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(r.Method, s.URL+vars.Fill(r.Path, saved), body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if r.Body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range r.Headers {
+		req.Header.Set(k, vars.Fill(v, saved))
+	}
+	return s.Do(req)
+}
+
+// admin POSTs to an admin endpoint.
+func (s *Server) admin(path string, body any) (int, any, error) {
+	status, resp, err := s.Admin(http.MethodPost, path, body)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("%s: status %d", path, status)
+	}
+	return status, resp, err
+}
+
+// Admin sends a request to one of the server's admin endpoints, with body
+// as JSON unless it is nil, and returns the status and decoded body of the
+// response.
+func (s *Server) Admin(method, path string, body any) (int, any, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.URL+path, r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+s.adminToken)
+	return s.Do(req)
+}
+
+// Do sends req to the server and returns the status and body of its
+// response, decoded from JSON, or as a string if it isn't JSON.
+func (s *Server) Do(req *http.Request) (int, any, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return resp.StatusCode, nil, nil
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		// Not JSON; compare it as text.
+		v = string(data)
+	}
+	return resp.StatusCode, v, nil
+}
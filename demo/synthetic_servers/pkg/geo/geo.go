@@ -0,0 +1,167 @@
+// Package geo measures distances on the Earth's surface and finds the
+// places near a point, for the synthetic servers' store, restaurant and
+// theater locators. It also knows the time zones venues keep, so that
+// their showtimes, flights and classes fall on the dates they do there.
+package geo
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// EarthRadiusKm is the Earth's mean radius.
+const EarthRadiusKm = 6371.0
+
+// KmPerMile converts miles to kilometers.
+const KmPerMile = 1.609344
+
+// kmPerDegree is the length of a degree of latitude, and of longitude at
+// the equator.
+const kmPerDegree = EarthRadiusKm * math.Pi / 180
+
+// Point is a place, in degrees.
+type Point struct {
+	Lat, Lon float64
+}
+
+// DistanceKm returns the great-circle distance between a and b, by the
+// haversine formula.
+func DistanceKm(a, b Point) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLat := lat2 - lat1
+	dLon := radians(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// DistanceMiles returns the great-circle distance between a and b in miles.
+func DistanceMiles(a, b Point) float64 {
+	return DistanceKm(a, b) / KmPerMile
+}
+
+func radians(deg float64) float64 { return deg * math.Pi / 180 }
+
+// cellDegrees is the size of an Index's grid cells, about 28 km of
+// latitude: a city's places share a few.
+const cellDegrees = 0.25
+
+// lonCells is the number of cells around a parallel.
+const lonCells = int(360 / cellDegrees)
+
+type cell struct{ lat, lon int }
+
+func cellOf(p Point) cell {
+	lon := int(math.Floor(p.Lon/cellDegrees)) % lonCells
+	if lon < 0 {
+		lon += lonCells
+	}
+	return cell{int(math.Floor(p.Lat / cellDegrees)), lon}
+}
+
+// Result is a place near a point, and how far it is from it.
+type Result struct {
+	ID         string
+	DistanceKm float64
+}
+
+// Index finds the places within a radius of a point by looking only in the
+// cells of a grid of latitude and longitude that the radius reaches. It is
+// safe for concurrent use.
+type Index struct {
+	mu     sync.RWMutex
+	cells  map[cell]map[string]Point
+	places map[string]Point
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{cells: make(map[cell]map[string]Point), places: make(map[string]Point)}
+}
+
+// Add puts the place id at p, moving it if it was elsewhere.
+func (ix *Index) Add(id string, p Point) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(id)
+	c := cellOf(p)
+	if ix.cells[c] == nil {
+		ix.cells[c] = make(map[string]Point)
+	}
+	ix.cells[c][id] = p
+	ix.places[id] = p
+}
+
+// Remove takes the place id out of the index.
+func (ix *Index) Remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(id)
+}
+
+func (ix *Index) remove(id string) {
+	p, ok := ix.places[id]
+	if !ok {
+		return
+	}
+	c := cellOf(p)
+	delete(ix.cells[c], id)
+	if len(ix.cells[c]) == 0 {
+		delete(ix.cells, c)
+	}
+	delete(ix.places, id)
+}
+
+// Len returns the number of places indexed.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.places)
+}
+
+// Within returns the places at most radiusKm from p, nearest first and
+// then by ID.
+func (ix *Index) Within(p Point, radiusKm float64) []Result {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	var results []Result
+	visit := func(places map[string]Point) {
+		for id, q := range places {
+			if d := DistanceKm(p, q); d <= radiusKm {
+				results = append(results, Result{ID: id, DistanceKm: d})
+			}
+		}
+	}
+
+	// The cells the radius reaches, unless that's more than there are.
+	latSpan := radiusKm / kmPerDegree
+	lonSpan := 180.0
+	if cos := math.Cos(radians(math.Min(90, math.Abs(p.Lat)+latSpan))); cos > 0 {
+		lonSpan = math.Min(180, latSpan/cos)
+	}
+	lo, hi := cellOf(Point{p.Lat - latSpan, p.Lon - lonSpan}), cellOf(Point{p.Lat + latSpan, p.Lon + lonSpan})
+	lats := hi.lat - lo.lat + 1
+	lons := (hi.lon-lo.lon+lonCells)%lonCells + 1
+	if lonSpan >= 180 {
+		lo.lon, lons = 0, lonCells
+	}
+	if lats*lons > len(ix.cells) {
+		for _, places := range ix.cells {
+			visit(places)
+		}
+	} else {
+		for lat := lo.lat; lat <= hi.lat; lat++ {
+			for i := 0; i < lons; i++ {
+				visit(ix.cells[cell{lat, (lo.lon + i) % lonCells}])
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].DistanceKm != results[j].DistanceKm {
+			return results[i].DistanceKm < results[j].DistanceKm
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
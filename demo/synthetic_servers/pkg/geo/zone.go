@@ -0,0 +1,117 @@
+package geo
+
+import (
+	"sync"
+	"time"
+
+	// The zones are built in, so that venues keep their local times on
+	// hosts without a zoneinfo database.
+	_ "time/tzdata"
+)
+
+// zoneCities are places whose time zones venues near them keep: the
+// nearest one answers for a point. The table is coarse, but right for the
+// metro areas the seeds' venues are in.
+var zoneCities = []struct {
+	Point
+	zone string
+}{
+	{Point{40.7128, -74.0060}, "America/New_York"},
+	{Point{42.3601, -71.0589}, "America/New_York"},
+	{Point{38.9072, -77.0369}, "America/New_York"},
+	{Point{33.7490, -84.3880}, "America/New_York"},
+	{Point{25.7617, -80.1918}, "America/New_York"},
+	{Point{28.5383, -81.3792}, "America/New_York"},
+	{Point{35.2271, -80.8431}, "America/New_York"},
+	{Point{39.9526, -75.1652}, "America/New_York"},
+	{Point{42.3314, -83.0458}, "America/Detroit"},
+	{Point{39.7684, -86.1581}, "America/Indiana/Indianapolis"},
+	{Point{41.8781, -87.6298}, "America/Chicago"},
+	{Point{32.7767, -96.7970}, "America/Chicago"},
+	{Point{29.7604, -95.3698}, "America/Chicago"},
+	{Point{30.2672, -97.7431}, "America/Chicago"},
+	{Point{44.9778, -93.2650}, "America/Chicago"},
+	{Point{29.9511, -90.0715}, "America/Chicago"},
+	{Point{36.1627, -86.7816}, "America/Chicago"},
+	{Point{39.0997, -94.5786}, "America/Chicago"},
+	{Point{39.7392, -104.9903}, "America/Denver"},
+	{Point{40.7608, -111.8910}, "America/Denver"},
+	{Point{33.4484, -112.0740}, "America/Phoenix"},
+	{Point{36.1699, -115.1398}, "America/Los_Angeles"},
+	{Point{34.0522, -118.2437}, "America/Los_Angeles"},
+	{Point{32.7157, -117.1611}, "America/Los_Angeles"},
+	{Point{37.7749, -122.4194}, "America/Los_Angeles"},
+	{Point{47.6062, -122.3321}, "America/Los_Angeles"},
+	{Point{45.5152, -122.6784}, "America/Los_Angeles"},
+	{Point{61.2181, -149.9003}, "America/Anchorage"},
+	{Point{21.3069, -157.8583}, "Pacific/Honolulu"},
+	{Point{43.6532, -79.3832}, "America/Toronto"},
+	{Point{49.2827, -123.1207}, "America/Vancouver"},
+	{Point{19.4326, -99.1332}, "America/Mexico_City"},
+	{Point{-23.5505, -46.6333}, "America/Sao_Paulo"},
+	{Point{51.5074, -0.1278}, "Europe/London"},
+	{Point{53.3498, -6.2603}, "Europe/Dublin"},
+	{Point{48.8566, 2.3522}, "Europe/Paris"},
+	{Point{52.5200, 13.4050}, "Europe/Berlin"},
+	{Point{50.1109, 8.6821}, "Europe/Berlin"},
+	{Point{52.3676, 4.9041}, "Europe/Amsterdam"},
+	{Point{40.4168, -3.7038}, "Europe/Madrid"},
+	{Point{41.9028, 12.4964}, "Europe/Rome"},
+	{Point{47.3769, 8.5417}, "Europe/Zurich"},
+	{Point{25.2048, 55.2708}, "Asia/Dubai"},
+	{Point{28.6139, 77.2090}, "Asia/Kolkata"},
+	{Point{1.3521, 103.8198}, "Asia/Singapore"},
+	{Point{22.3193, 114.1694}, "Asia/Hong_Kong"},
+	{Point{31.2304, 121.4737}, "Asia/Shanghai"},
+	{Point{37.5665, 126.9780}, "Asia/Seoul"},
+	{Point{35.6762, 139.6503}, "Asia/Tokyo"},
+	{Point{-33.8688, 151.2093}, "Australia/Sydney"},
+	{Point{-37.8136, 144.9631}, "Australia/Melbourne"},
+}
+
+// ZoneAt returns the IANA time zone of a point, such as
+// America/Los_Angeles for San Francisco: that of the nearest of a table of
+// cities.
+func ZoneAt(p Point) string {
+	zone, best := "UTC", -1.0
+	for _, c := range zoneCities {
+		if d := DistanceKm(p, c.Point); best < 0 || d < best {
+			zone, best = c.zone, d
+		}
+	}
+	return zone
+}
+
+var locations sync.Map // zone name -> *time.Location
+
+// Location returns the time zone named, such as America/New_York, or UTC
+// if name is "" or not one.
+func Location(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		loc = time.UTC
+	}
+	locations.Store(name, loc)
+	return loc
+}
+
+// ValidZone reports whether name is an IANA time zone.
+func ValidZone(name string) bool {
+	if name == "" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// LocalDate returns the day t falls on where loc keeps time, as
+// 2006-01-02: the date a venue's showtime or class is listed under.
+func LocalDate(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format(time.DateOnly)
+}
@@ -0,0 +1,160 @@
+package geocode
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Address is a US street address.
+type Address struct {
+	Street string `json:"street"`
+	City   string `json:"city"`
+	State  string `json:"state"`
+	Zip    string `json:"zip"`
+}
+
+// String writes a on one line, such as
+// "789 Tech Ave, San Francisco, CA 94105".
+func (a Address) String() string {
+	return fmt.Sprintf("%s, %s, %s %s", a.Street, a.City, a.State, a.Zip)
+}
+
+// Parse reads a one-line address, such as
+// "789 Tech Avenue, San Francisco, CA 94105". A unit may follow the street
+// in a part of its own, as in "1 Main St, Apt 4, Austin, TX 78701". It
+// doesn't check the address; Verify does.
+func Parse(line string) (Address, error) {
+	parts := strings.Split(line, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) < 3 {
+		return Address{}, ErrUnparseable
+	}
+	n := len(parts)
+	fields := strings.Fields(parts[n-1])
+	if len(fields) < 2 {
+		return Address{}, ErrUnparseable
+	}
+	a := Address{
+		Street: strings.Join(parts[:n-2], ", "),
+		City:   parts[n-2],
+		State:  strings.Join(fields[:len(fields)-1], " "),
+		Zip:    fields[len(fields)-1],
+	}
+	if a.Street == "" || a.City == "" {
+		return Address{}, ErrUnparseable
+	}
+	return a, nil
+}
+
+// Normalize writes a the way the postal service does, mostly: words in
+// one case capitalized, street suffixes, directions and units abbreviated
+// (Avenue to Ave, North to N, Suite to Ste), states as their codes and
+// zip codes as 5 digits. It leaves zip codes it can't read alone.
+func Normalize(a Address) Address {
+	a.Street = normalizeStreet(a.Street)
+	a.City = capitalize(strings.Join(strings.Fields(a.City), " "))
+	state := strings.Join(strings.Fields(a.State), " ")
+	if code, ok := states[strings.ToLower(state)]; ok {
+		state = code
+	}
+	a.State = strings.ToUpper(state)
+	if zip, err := NormalizeZip(a.Zip); err == nil {
+		a.Zip = zip
+	} else {
+		a.Zip = strings.TrimSpace(a.Zip)
+	}
+	return a
+}
+
+// Verify normalizes a and checks that its zip code is known and, if it
+// names a state, in that state. It fills in the zip code's city and state,
+// as the postal service names them, and returns where the address is.
+func Verify(a Address) (Address, Place, error) {
+	a = Normalize(a)
+	place, err := Lookup(a.Zip)
+	if err != nil {
+		return a, Place{}, err
+	}
+	if a.State != "" && a.State != place.State {
+		return a, Place{}, fmt.Errorf("%w: %s is in %s, not %s", ErrStateMismatch, place.Zip, place.State, a.State)
+	}
+	a.City, a.State = place.City, place.State
+	return a, place, nil
+}
+
+// VerifyLine parses a one-line address and verifies it.
+func VerifyLine(line string) (Address, Place, error) {
+	a, err := Parse(line)
+	if err != nil {
+		return Address{}, Place{}, err
+	}
+	return Verify(a)
+}
+
+// abbreviations are the postal service's for the words of street names.
+var abbreviations = map[string]string{
+	"street": "St", "avenue": "Ave", "boulevard": "Blvd", "drive": "Dr",
+	"road": "Rd", "lane": "Ln", "court": "Ct", "place": "Pl",
+	"terrace": "Ter", "parkway": "Pkwy", "highway": "Hwy", "square": "Sq",
+	"circle": "Cir", "way": "Way", "plaza": "Plz", "trail": "Trl",
+	"north": "N", "south": "S", "east": "E", "west": "W",
+	"northeast": "NE", "northwest": "NW", "southeast": "SE", "southwest": "SW",
+	"suite": "Ste", "apartment": "Apt", "floor": "Fl", "building": "Bldg",
+	"st": "St", "ave": "Ave", "blvd": "Blvd", "dr": "Dr", "rd": "Rd",
+	"ln": "Ln", "ct": "Ct", "pl": "Pl", "ste": "Ste", "apt": "Apt",
+}
+
+func normalizeStreet(street string) string {
+	words := strings.Fields(strings.ReplaceAll(street, ",", ", "))
+	for i, w := range words {
+		comma := strings.HasSuffix(w, ",")
+		w = strings.TrimRight(w, ".,")
+		if abbr, ok := abbreviations[strings.ToLower(w)]; ok {
+			w = abbr
+		} else {
+			w = capitalize(w)
+		}
+		if comma {
+			w += ","
+		}
+		words[i] = w
+	}
+	return strings.Join(words, " ")
+}
+
+// capitalize capitalizes the words of s that are all in one case, leaving
+// the likes of McAllister and 2nd alone.
+func capitalize(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		if w != strings.ToLower(w) && w != strings.ToUpper(w) {
+			continue
+		}
+		r := []rune(strings.ToLower(w))
+		if unicode.IsLetter(r[0]) {
+			r[0] = unicode.ToUpper(r[0])
+		}
+		words[i] = string(r)
+	}
+	return strings.Join(words, " ")
+}
+
+// states are the codes of the states, by their lowercased names.
+var states = map[string]string{
+	"alabama": "AL", "alaska": "AK", "arizona": "AZ", "arkansas": "AR",
+	"california": "CA", "colorado": "CO", "connecticut": "CT", "delaware": "DE",
+	"district of columbia": "DC", "florida": "FL", "georgia": "GA", "hawaii": "HI",
+	"idaho": "ID", "illinois": "IL", "indiana": "IN", "iowa": "IA",
+	"kansas": "KS", "kentucky": "KY", "louisiana": "LA", "maine": "ME",
+	"maryland": "MD", "massachusetts": "MA", "michigan": "MI", "minnesota": "MN",
+	"mississippi": "MS", "missouri": "MO", "montana": "MT", "nebraska": "NE",
+	"nevada": "NV", "new hampshire": "NH", "new jersey": "NJ", "new mexico": "NM",
+	"new york": "NY", "north carolina": "NC", "north dakota": "ND", "ohio": "OH",
+	"oklahoma": "OK", "oregon": "OR", "pennsylvania": "PA", "rhode island": "RI",
+	"south carolina": "SC", "south dakota": "SD", "tennessee": "TN", "texas": "TX",
+	"utah": "UT", "vermont": "VT", "virginia": "VA", "washington": "WA",
+	"west virginia": "WV", "wisconsin": "WI", "wyoming": "WY",
+}
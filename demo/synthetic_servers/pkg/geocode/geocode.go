@@ -0,0 +1,81 @@
+// Package geocode checks US addresses and finds where they are, for the
+// synthetic servers' delivery, shipping and radius searches. It answers
+// from a seeded table of the zip codes the seeds and seedgen use, with each
+// one's city, state and centroid, instead of calling a geocoding service,
+// so that the same address is always in the same place.
+package geocode
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"pkg/geo"
+)
+
+// Errors of addresses that don't check out. They are wrapped with the
+// value at fault, so match them with errors.Is.
+var (
+	ErrMissingZip    = errors.New("zip code is required")
+	ErrMalformedZip  = errors.New("zip code must be 5 digits, or ZIP+4")
+	ErrUnknownZip    = errors.New("unknown zip code")
+	ErrStateMismatch = errors.New("zip code is not in that state")
+	ErrUnparseable   = errors.New(`address must read "street, city, state zip"`)
+)
+
+// Place is where a zip code is: its city and state, and its centroid.
+type Place struct {
+	Zip   string `json:"zip"`
+	City  string `json:"city"`
+	State string `json:"state"`
+	geo.Point
+}
+
+// NormalizeZip returns the 5-digit zip code of zip, which may be ZIP+4,
+// such as 94105-1420.
+func NormalizeZip(zip string) (string, error) {
+	zip = strings.TrimSpace(zip)
+	if zip == "" {
+		return "", ErrMissingZip
+	}
+	five, plus4, hasPlus4 := strings.Cut(zip, "-")
+	if len(five) != 5 || !digits(five) || (hasPlus4 && (len(plus4) != 4 || !digits(plus4))) {
+		return "", fmt.Errorf("%w: %q", ErrMalformedZip, zip)
+	}
+	return five, nil
+}
+
+func digits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup returns the place of a zip code, failing with ErrMalformedZip or
+// ErrUnknownZip.
+func Lookup(zip string) (Place, error) {
+	five, err := NormalizeZip(zip)
+	if err != nil {
+		return Place{}, err
+	}
+	place, ok := zips[five]
+	if !ok {
+		return Place{}, fmt.Errorf("%w: %s", ErrUnknownZip, five)
+	}
+	place.Zip = five
+	return place, nil
+}
+
+// Zips returns the zip codes Lookup knows, in order.
+func Zips() []string {
+	codes := make([]string, 0, len(zips))
+	for code := range zips {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
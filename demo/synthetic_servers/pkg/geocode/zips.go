@@ -0,0 +1,62 @@
+package geocode
+
+import "pkg/geo"
+
+// zips are the zip codes Lookup knows: those in the seeds, their
+// neighbours and the cities seedgen draws addresses around.
+var zips = map[string]Place{
+	// San Francisco
+	"94102": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7793, Lon: -122.4193}},
+	"94103": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7725, Lon: -122.4147}},
+	"94104": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7915, Lon: -122.4019}},
+	"94105": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7898, Lon: -122.3942}},
+	"94107": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7621, Lon: -122.3971}},
+	"94108": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7929, Lon: -122.4079}},
+	"94109": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7917, Lon: -122.4186}},
+	"94110": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7486, Lon: -122.4184}},
+	"94111": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7990, Lon: -122.3984}},
+	"94114": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7587, Lon: -122.4330}},
+	"94115": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7856, Lon: -122.4358}},
+	"94117": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7700, Lon: -122.4469}},
+	"94118": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7812, Lon: -122.4614}},
+	"94121": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7786, Lon: -122.4892}},
+	"94122": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.7590, Lon: -122.4846}},
+	"94123": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.8002, Lon: -122.4360}},
+	"94128": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.6213, Lon: -122.3790}},
+	"94133": {City: "San Francisco", State: "CA", Point: geo.Point{Lat: 37.8002, Lon: -122.4091}},
+
+	// Bay Area
+	"94080": {City: "South San Francisco", State: "CA", Point: geo.Point{Lat: 37.6547, Lon: -122.4077}},
+	"94301": {City: "Palo Alto", State: "CA", Point: geo.Point{Lat: 37.4443, Lon: -122.1598}},
+	"94501": {City: "Alameda", State: "CA", Point: geo.Point{Lat: 37.7712, Lon: -122.2824}},
+	"94607": {City: "Oakland", State: "CA", Point: geo.Point{Lat: 37.8044, Lon: -122.2712}},
+	"94612": {City: "Oakland", State: "CA", Point: geo.Point{Lat: 37.8085, Lon: -122.2666}},
+	"94704": {City: "Berkeley", State: "CA", Point: geo.Point{Lat: 37.8663, Lon: -122.2580}},
+	"94804": {City: "Richmond", State: "CA", Point: geo.Point{Lat: 37.9199, Lon: -122.3418}},
+	"95014": {City: "Cupertino", State: "CA", Point: geo.Point{Lat: 37.3230, Lon: -122.0322}},
+	"95112": {City: "San Jose", State: "CA", Point: geo.Point{Lat: 37.3441, Lon: -121.8830}},
+
+	// New York
+	"10001": {City: "New York", State: "NY", Point: geo.Point{Lat: 40.7506, Lon: -73.9972}},
+	"10003": {City: "New York", State: "NY", Point: geo.Point{Lat: 40.7318, Lon: -73.9890}},
+	"10019": {City: "New York", State: "NY", Point: geo.Point{Lat: 40.7655, Lon: -73.9858}},
+	"10036": {City: "New York", State: "NY", Point: geo.Point{Lat: 40.7592, Lon: -73.9896}},
+
+	// Other cities
+	"02108": {City: "Boston", State: "MA", Point: geo.Point{Lat: 42.3576, Lon: -71.0637}},
+	"19103": {City: "Philadelphia", State: "PA", Point: geo.Point{Lat: 39.9525, Lon: -75.1740}},
+	"30303": {City: "Atlanta", State: "GA", Point: geo.Point{Lat: 33.7525, Lon: -84.3915}},
+	"33131": {City: "Miami", State: "FL", Point: geo.Point{Lat: 25.7663, Lon: -80.1890}},
+	"37203": {City: "Nashville", State: "TN", Point: geo.Point{Lat: 36.1505, Lon: -86.7897}},
+	"55401": {City: "Minneapolis", State: "MN", Point: geo.Point{Lat: 44.9849, Lon: -93.2694}},
+	"60601": {City: "Chicago", State: "IL", Point: geo.Point{Lat: 41.8858, Lon: -87.6181}},
+	"75201": {City: "Dallas", State: "TX", Point: geo.Point{Lat: 32.7876, Lon: -96.7994}},
+	"77002": {City: "Houston", State: "TX", Point: geo.Point{Lat: 29.7566, Lon: -95.3650}},
+	"78701": {City: "Austin", State: "TX", Point: geo.Point{Lat: 30.2711, Lon: -97.7437}},
+	"80202": {City: "Denver", State: "CO", Point: geo.Point{Lat: 39.7527, Lon: -104.9992}},
+	"85004": {City: "Phoenix", State: "AZ", Point: geo.Point{Lat: 33.4515, Lon: -112.0687}},
+	"90012": {City: "Los Angeles", State: "CA", Point: geo.Point{Lat: 34.0614, Lon: -118.2385}},
+	"92101": {City: "San Diego", State: "CA", Point: geo.Point{Lat: 32.7194, Lon: -117.1628}},
+	"97204": {City: "Portland", State: "OR", Point: geo.Point{Lat: 45.5186, Lon: -122.6756}},
+	"98101": {City: "Seattle", State: "WA", Point: geo.Point{Lat: 47.6101, Lon: -122.3344}},
+}
@@ -0,0 +1,742 @@
+// Package graphqlapi describes a synthetic server's REST API as a GraphQL
+// schema, built from the server's OpenAPI spec, whose fields resolve by
+// calling the REST API. The spec's schemas become object types, keeping
+// their JSON field names, and each GET operation a query named for its
+// path, like account(accountId) for /accounts/{accountId} and
+// accountTransactions(accountId) for /accounts/{accountId}/transactions.
+// The other operations become mutations named for their summaries, like
+// chargeCard(accountId, input), taking their bodies as input.
+//
+// Objects link to the entities they refer to, so queries can follow
+// relationships without a request per hop:
+//
+//   - A field like hotel_id, or product_ids, gets a sibling hotel, or
+//     products, that resolves to the entity through the query that gets
+//     one, hotel(hotelId).
+//   - An entity embedded in another, like a booking's hotel, resolves to
+//     the entity as it is now through that query too, rather than the
+//     copy embedded.
+//   - An entity has a field for each collection under it, so a Hotel has
+//     rooms when there is a /hotels/{hotelId}/rooms.
+package graphqlapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+
+	"pkg/internal/names"
+)
+
+// Caller carries out a REST request for a resolver, with the query and
+// body, which is nil for none, and returns the response's JSON decoded,
+// or nil for none. Error responses are returned as errors.
+type Caller func(ctx context.Context, method, path string, query url.Values, body any) (any, error)
+
+// New builds the GraphQL schema for the OpenAPI spec, whose fields resolve
+// through call.
+func New(spec []byte, call Caller) (graphql.Schema, error) {
+	var doc openAPI
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return graphql.Schema{}, fmt.Errorf("parsing OpenAPI spec: %w", err)
+	}
+	b := &builder{
+		doc:      &doc,
+		call:     call,
+		objects:  make(map[string]*graphql.Object),
+		inputs:   make(map[string]*graphql.InputObject),
+		taken:    make(map[string]bool),
+		getters:  make(map[string]*operation),
+		entities: make(map[string]*operation),
+		children: make(map[string][]*operation),
+	}
+	for _, name := range []string{"Query", "Mutation", "JSON"} {
+		b.taken[name] = true
+	}
+	b.operations()
+
+	cfg := graphql.SchemaConfig{Query: b.root("Query", b.queries)}
+	if len(b.mutations) > 0 {
+		cfg.Mutation = b.root("Mutation", b.mutations)
+	}
+	return graphql.NewSchema(cfg)
+}
+
+// JSON is the scalar for values the spec doesn't describe, such as free-form
+// objects, which are passed through as they are.
+var JSON = graphql.NewScalar(graphql.ScalarConfig{
+	Name:         "JSON",
+	Description:  "Any JSON value",
+	Serialize:    func(v any) any { return v },
+	ParseValue:   func(v any) any { return v },
+	ParseLiteral: literal,
+})
+
+// openAPI is the part of an OpenAPI spec the schema is built from.
+type openAPI struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	Summary     string      `json:"summary"`
+	Description string      `json:"description"`
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+
+	verb, path, name string
+	body, result     *schema // Nil for none
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Required    bool    `json:"required"`
+	Schema      *schema `json:"schema"`
+}
+
+type schema struct {
+	Ref         string             `json:"$ref"`
+	Type        string             `json:"type"`
+	Description string             `json:"description"`
+	Items       *schema            `json:"items"`
+	Properties  map[string]*schema `json:"properties"`
+}
+
+type builder struct {
+	doc                *openAPI
+	call               Caller
+	queries, mutations []*operation
+	objects            map[string]*graphql.Object      // By schema name
+	inputs             map[string]*graphql.InputObject // By schema name
+	taken              map[string]bool                 // Type names
+	getters            map[string]*operation           // Schema name -> the query getting one by ID
+	entities           map[string]*operation           // Entity name, like hotel -> the query getting one
+	children           map[string][]*operation         // Getter's path -> the queries for collections under it
+}
+
+// operations sorts the operations that answer with JSON into queries and
+// mutations, and finds the relationships between entities.
+func (b *builder) operations() {
+	fieldNames := make(map[string]bool)
+	for _, path := range sortedKeys(b.doc.Paths) {
+		for _, verb := range []string{"get", "post", "put", "patch", "delete"} {
+			raw, ok := b.doc.Paths[path][verb]
+			if !ok {
+				continue
+			}
+			op := &operation{}
+			if json.Unmarshal(raw, op) != nil {
+				continue
+			}
+			result, ok := successSchema(op)
+			if !ok {
+				continue
+			}
+			op.verb, op.path, op.result = verb, path, result
+			if op.RequestBody != nil {
+				op.body = op.RequestBody.Content["application/json"].Schema
+			}
+			if verb == "get" {
+				op.name = uniqueName(fieldNames, queryName(path), pathParams(path))
+				b.queries = append(b.queries, op)
+			} else {
+				name := mutationName(op.Summary, verb, path)
+				if fieldNames[name] {
+					name = mutationName("", verb, path)
+				}
+				op.name = uniqueName(fieldNames, name, nil)
+				b.mutations = append(b.mutations, op)
+			}
+		}
+	}
+
+	for _, op := range b.queries {
+		params := pathParams(op.path)
+		if len(params) != 1 || !strings.HasSuffix(op.path, "}") || op.result == nil || !b.isObject(op.result.Ref) {
+			continue
+		}
+		name := refName(op.result.Ref)
+		if b.getters[name] == nil {
+			b.getters[name] = op
+		}
+		if b.entities[op.name] == nil {
+			b.entities[op.name] = op
+		}
+	}
+	for _, op := range b.queries {
+		parent, seg, ok := cutLast(op.path)
+		if !ok || strings.HasPrefix(seg, "{") || len(pathParams(op.path)) != 1 {
+			continue
+		}
+		for _, getter := range b.getters {
+			if getter.path == parent {
+				b.children[parent] = append(b.children[parent], op)
+				break
+			}
+		}
+	}
+}
+
+// successSchema returns the schema of an operation's first 2xx response,
+// nil if it has no body, and false if its body isn't JSON.
+func successSchema(op *operation) (*schema, bool) {
+	for _, status := range sortedKeys(op.Responses) {
+		if !strings.HasPrefix(status, "2") {
+			continue
+		}
+		content := op.Responses[status].Content
+		if len(content) == 0 {
+			return nil, true
+		}
+		media, ok := content["application/json"]
+		if !ok {
+			return nil, false
+		}
+		return media.Schema, true
+	}
+	return nil, true
+}
+
+// root builds the Query or Mutation type, with a field for each operation.
+func (b *builder) root(name string, ops []*operation) *graphql.Object {
+	fields := graphql.Fields{}
+	for _, op := range ops {
+		field := &graphql.Field{
+			Type:        b.resultType(op, names.Camel(op.name)+"Result"),
+			Description: strings.TrimSpace(op.Summary + "\n\n" + op.Description),
+			Args:        b.args(op, true),
+		}
+		field.Resolve = func(p graphql.ResolveParams) (any, error) {
+			return b.resolve(p.Context, op, nil, p.Args)
+		}
+		fields[op.name] = field
+	}
+	return graphql.NewObject(graphql.ObjectConfig{Name: name, Fields: fields})
+}
+
+// args returns the arguments for an operation's parameters and, if
+// withPath, its path parameters too, then its body as input.
+func (b *builder) args(op *operation, withPath bool) graphql.FieldConfigArgument {
+	args := graphql.FieldConfigArgument{}
+	for _, p := range op.Parameters {
+		if p.In != "query" && (p.In != "path" || !withPath) {
+			continue
+		}
+		t := b.inputType(p.Schema, names.Camel(op.name+" "+p.Name))
+		if p.In == "path" || p.Required {
+			t = graphql.NewNonNull(t)
+		}
+		args[fieldName(p.Name)] = &graphql.ArgumentConfig{Type: t, Description: p.Description}
+	}
+	if op.body != nil {
+		args["input"] = &graphql.ArgumentConfig{Type: graphql.NewNonNull(b.inputType(op.body, names.Camel(op.name)))}
+	}
+	return args
+}
+
+// resolve carries out an operation with the arguments, the path parameters
+// among them unless given as pathValues.
+func (b *builder) resolve(ctx context.Context, op *operation, pathValues map[string]any, args map[string]any) (any, error) {
+	path := op.path
+	query := url.Values{}
+	for _, p := range op.Parameters {
+		v, ok := pathValues[p.Name]
+		if !ok {
+			v, ok = args[fieldName(p.Name)]
+		}
+		if !ok || v == nil {
+			continue
+		}
+		switch p.In {
+		case "path":
+			path = strings.ReplaceAll(path, "{"+p.Name+"}", url.PathEscape(fmt.Sprint(v)))
+		case "query":
+			if list, ok := v.([]any); ok {
+				for _, item := range list {
+					query.Add(p.Name, fmt.Sprint(item))
+				}
+			} else {
+				query.Set(p.Name, fmt.Sprint(v))
+			}
+		}
+	}
+	var body any
+	if op.body != nil {
+		body = b.jsonValue(op.body, args["input"])
+	}
+	result, err := b.call(ctx, strings.ToUpper(op.verb), path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	if op.result == nil {
+		return true, nil
+	}
+	return result, nil
+}
+
+// resultType returns the type of an operation's result, named like name
+// if it needs one of its own. Operations without one answer true.
+func (b *builder) resultType(op *operation, name string) graphql.Output {
+	if op.result == nil {
+		return graphql.Boolean
+	}
+	return b.outputType(op.result, name)
+}
+
+// outputType returns the type for values of s, which gets an object type
+// named like name if it needs one.
+func (b *builder) outputType(s *schema, name string) graphql.Output {
+	switch {
+	case s == nil:
+		return JSON
+	case s.Ref != "":
+		if b.isObject(s.Ref) {
+			return b.object(refName(s.Ref))
+		}
+		if target := b.doc.Components.Schemas[refName(s.Ref)]; target != nil && target.Ref == "" {
+			return b.outputType(target, name)
+		}
+		return JSON
+	}
+	switch s.Type {
+	case "string":
+		return graphql.String
+	case "integer":
+		return graphql.Int
+	case "number":
+		return graphql.Float
+	case "boolean":
+		return graphql.Boolean
+	case "array":
+		return graphql.NewList(b.outputType(s.Items, name+"Item"))
+	case "object":
+		if len(s.Properties) > 0 {
+			return b.newObject(b.typeName(name), s, nil)
+		}
+	}
+	return JSON
+}
+
+// object returns the object type for the named schema.
+func (b *builder) object(name string) *graphql.Object {
+	if o, ok := b.objects[name]; ok {
+		return o
+	}
+	b.taken[name] = true
+	o := b.newObject(name, b.doc.Components.Schemas[name], b.getters[name])
+	b.objects[name] = o
+	return o
+}
+
+// newObject builds the object type for s, whose values getter gets one of
+// by ID, if it isn't nil.
+func (b *builder) newObject(name string, s *schema, getter *operation) *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name:        name,
+		Description: s.Description,
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := graphql.Fields{}
+			for _, prop := range sortedKeys(s.Properties) {
+				ps := s.Properties[prop]
+				fields[fieldName(prop)] = &graphql.Field{
+					Type:        b.outputType(ps, name+names.Camel(prop)),
+					Description: ps.Description,
+					Resolve:     b.propertyResolver(prop, ps),
+				}
+			}
+			for _, prop := range sortedKeys(s.Properties) {
+				b.reference(fields, prop, s.Properties[prop])
+			}
+			if getter != nil {
+				b.collections(fields, s, getter)
+			}
+			return fields
+		}),
+	})
+}
+
+// propertyResolver returns the resolver for a property, which looks up
+// embedded entities by their IDs.
+func (b *builder) propertyResolver(prop string, ps *schema) graphql.FieldResolveFn {
+	var getter *operation
+	var key string
+	if ps != nil && ps.Ref != "" {
+		if getter = b.getters[refName(ps.Ref)]; getter != nil {
+			key = identifier(b.doc.Components.Schemas[refName(ps.Ref)], pathParams(getter.path)[0])
+		}
+	}
+	if key == "" {
+		return func(p graphql.ResolveParams) (any, error) {
+			return property(p.Source, prop), nil
+		}
+	}
+	param := pathParams(getter.path)[0]
+	return func(p graphql.ResolveParams) (any, error) {
+		embedded := property(p.Source, prop)
+		id := property(embedded, key)
+		if id == nil || id == "" {
+			return embedded, nil
+		}
+		// The embedded copy stands in for an entity that can't be had.
+		if entity, err := b.resolve(p.Context, getter, map[string]any{param: id}, nil); err == nil && entity != nil {
+			return entity, nil
+		}
+		return embedded, nil
+	}
+}
+
+// reference adds a field for the entity a property refers to, if it is an
+// ID of one: hotel for hotel_id, products for product_ids.
+func (b *builder) reference(fields graphql.Fields, prop string, ps *schema) {
+	words := names.Words(prop)
+	if len(words) < 2 || ps == nil {
+		return
+	}
+	many := ps.Type == "array"
+	switch last := words[len(words)-1]; {
+	case last == "id" && !many:
+	case last == "ids" && many:
+	default:
+		return
+	}
+	entity := names.LowerCamel(strings.Join(words[:len(words)-1], " "))
+	getter := b.entities[entity]
+	if getter == nil {
+		return
+	}
+	name := entity
+	if many {
+		name = names.Plural(entity)
+	}
+	if _, ok := fields[name]; ok {
+		return
+	}
+	param := pathParams(getter.path)[0]
+	get := func(ctx context.Context, id any) (any, error) {
+		if id == nil || id == "" {
+			return nil, nil
+		}
+		return b.resolve(ctx, getter, map[string]any{param: id}, nil)
+	}
+	field := &graphql.Field{
+		Type:        b.resultType(getter, ""),
+		Description: fmt.Sprintf("The %s %s refers to", strings.Join(words[:len(words)-1], " "), prop),
+		Resolve: func(p graphql.ResolveParams) (any, error) {
+			return get(p.Context, property(p.Source, prop))
+		},
+	}
+	if many {
+		field.Type = graphql.NewList(field.Type)
+		field.Resolve = func(p graphql.ResolveParams) (any, error) {
+			ids, _ := property(p.Source, prop).([]any)
+			out := make([]any, 0, len(ids))
+			for _, id := range ids {
+				v, err := get(p.Context, id)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, v)
+			}
+			return out, nil
+		}
+	}
+	fields[name] = field
+}
+
+// collections adds a field for each collection under an entity, which
+// getter gets: rooms on a Hotel for /hotels/{hotelId}/rooms.
+func (b *builder) collections(fields graphql.Fields, s *schema, getter *operation) {
+	param := pathParams(getter.path)[0]
+	key := identifier(s, param)
+	if key == "" {
+		return
+	}
+	for _, op := range b.children[getter.path] {
+		_, seg, _ := cutLast(op.path)
+		name := names.LowerCamel(seg)
+		if _, ok := fields[name]; ok {
+			continue
+		}
+		field := &graphql.Field{
+			Type:        b.resultType(op, names.Camel(op.name)+"Result"),
+			Description: strings.TrimSpace(op.Summary + "\n\n" + op.Description),
+			Args:        b.args(op, false),
+		}
+		field.Resolve = func(p graphql.ResolveParams) (any, error) {
+			return b.resolve(p.Context, op, map[string]any{param: property(p.Source, key)}, p.Args)
+		}
+		fields[name] = field
+	}
+}
+
+// identifier returns the property of an entity that its getter's path
+// parameter names it by: email for {email}, id for {hotelId}.
+func identifier(s *schema, param string) string {
+	candidates := []string{param, names.Snake(param)}
+	if words := names.Words(param); words[len(words)-1] == "id" {
+		candidates = append(candidates, "id")
+	}
+	for _, c := range candidates {
+		if _, ok := s.Properties[c]; ok {
+			return c
+		}
+	}
+	return ""
+}
+
+// inputType returns the input type for values of s, which gets an input
+// object type named like name if it needs one.
+func (b *builder) inputType(s *schema, name string) graphql.Input {
+	switch {
+	case s == nil:
+		return JSON
+	case s.Ref != "":
+		ref := refName(s.Ref)
+		if b.isObject(s.Ref) {
+			if in, ok := b.inputs[ref]; ok {
+				return in
+			}
+			in := b.newInput(b.typeName(ref+"Input"), b.doc.Components.Schemas[ref])
+			b.inputs[ref] = in
+			return in
+		}
+		if target := b.doc.Components.Schemas[ref]; target != nil && target.Ref == "" {
+			return b.inputType(target, name)
+		}
+		return JSON
+	}
+	switch s.Type {
+	case "string":
+		return graphql.String
+	case "integer":
+		return graphql.Int
+	case "number":
+		return graphql.Float
+	case "boolean":
+		return graphql.Boolean
+	case "array":
+		return graphql.NewList(b.inputType(s.Items, name+"Item"))
+	case "object":
+		if len(s.Properties) > 0 {
+			return b.newInput(b.typeName(name+"Input"), s)
+		}
+	}
+	return JSON
+}
+
+func (b *builder) newInput(name string, s *schema) *graphql.InputObject {
+	return graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        name,
+		Description: s.Description,
+		Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+			fields := graphql.InputObjectConfigFieldMap{}
+			base := strings.TrimSuffix(name, "Input")
+			for _, prop := range sortedKeys(s.Properties) {
+				fields[fieldName(prop)] = &graphql.InputObjectFieldConfig{
+					Type:        b.inputType(s.Properties[prop], base+names.Camel(prop)),
+					Description: s.Properties[prop].Description,
+				}
+			}
+			return fields
+		}),
+	})
+}
+
+// jsonValue converts an input value for s back to the JSON the REST API
+// takes, with its properties' own names.
+func (b *builder) jsonValue(s *schema, v any) any {
+	if s == nil || v == nil {
+		return v
+	}
+	if s.Ref != "" {
+		return b.jsonValue(b.doc.Components.Schemas[refName(s.Ref)], v)
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		if len(s.Properties) == 0 {
+			return v
+		}
+		out := make(map[string]any, len(v))
+		for prop, ps := range s.Properties {
+			if pv, ok := v[fieldName(prop)]; ok {
+				out[prop] = b.jsonValue(ps, pv)
+			}
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = b.jsonValue(s.Items, item)
+		}
+		return out
+	}
+	return v
+}
+
+// isObject reports whether ref names a schema with properties.
+func (b *builder) isObject(ref string) bool {
+	s := b.doc.Components.Schemas[refName(ref)]
+	return s != nil && len(s.Properties) > 0
+}
+
+// typeName returns name, or a variant of it if a type already has it, and
+// takes it.
+func (b *builder) typeName(name string) string {
+	candidate := name
+	for i := 2; b.taken[candidate] || b.doc.Components.Schemas[candidate] != nil; i++ {
+		candidate = fmt.Sprintf("%s%d", name, i)
+	}
+	b.taken[candidate] = true
+	return candidate
+}
+
+// literal converts a JSON value written in a query to Go.
+func literal(v ast.Value) any {
+	switch v := v.(type) {
+	case *ast.ObjectValue:
+		out := make(map[string]any, len(v.Fields))
+		for _, f := range v.Fields {
+			out[f.Name.Value] = literal(f.Value)
+		}
+		return out
+	case *ast.ListValue:
+		out := make([]any, len(v.Values))
+		for i, item := range v.Values {
+			out[i] = literal(item)
+		}
+		return out
+	case *ast.IntValue:
+		n, _ := strconv.ParseInt(v.Value, 10, 64)
+		return n
+	case *ast.FloatValue:
+		f, _ := strconv.ParseFloat(v.Value, 64)
+		return f
+	case *ast.StringValue:
+		return v.Value
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.EnumValue:
+		return v.Value
+	}
+	return nil
+}
+
+// property returns the value of a property of a JSON object.
+func property(source any, prop string) any {
+	m, _ := source.(map[string]any)
+	return m[prop]
+}
+
+var invalidName = regexp.MustCompile(`[^_0-9A-Za-z]`)
+
+// fieldName returns the GraphQL name for a JSON property or parameter:
+// its own, if GraphQL allows it.
+func fieldName(prop string) string {
+	name := invalidName.ReplaceAllString(prop, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// queryName names a query for its path, like accountTransactions for
+// /api/v1/accounts/{accountId}/transactions and account for
+// /api/v1/accounts/{accountId}.
+func queryName(path string) string {
+	var words []string
+	segs := strings.Split(strings.TrimPrefix(path, "/api/v1"), "/")
+	for i, seg := range segs {
+		if seg == "" || strings.HasPrefix(seg, "{") {
+			continue
+		}
+		w := names.Words(seg)
+		if i+1 < len(segs) && strings.HasPrefix(segs[i+1], "{") && len(w) > 0 {
+			w[len(w)-1] = names.Singular(w[len(w)-1])
+		}
+		words = append(words, w...)
+	}
+	if len(words) == 0 {
+		return "root"
+	}
+	return names.LowerCamel(strings.Join(words, " "))
+}
+
+// mutationName names a mutation for its summary's first clause, like
+// chargeCard for "Charge card", or else for its method and path.
+func mutationName(summary, verb, path string) string {
+	if summary != "" && !strings.HasPrefix(summary, strings.ToUpper(verb)+" /") {
+		if i := strings.IndexAny(summary, ":,;("); i > 0 {
+			summary = summary[:i]
+		}
+		return names.LowerCamel(summary)
+	}
+	return verb + names.Camel(queryName(path))
+}
+
+// uniqueName returns name, or if it is taken, name with By and the path
+// parameters, or else a number, and takes it.
+func uniqueName(taken map[string]bool, name string, params []string) string {
+	candidate := name
+	if taken[candidate] && len(params) > 0 {
+		candidate = name + "By" + names.Camel(strings.Join(params, " "))
+	}
+	for i := 2; taken[candidate]; i++ {
+		candidate = fmt.Sprintf("%s%d", name, i)
+	}
+	taken[candidate] = true
+	return candidate
+}
+
+// pathParams returns the names of a path's parameters, in order.
+func pathParams(path string) []string {
+	var params []string
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			params = append(params, seg[1:len(seg)-1])
+		}
+	}
+	return params
+}
+
+// cutLast splits a path before its last segment.
+func cutLast(path string) (parent, last string, ok bool) {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "", "", false
+	}
+	return path[:i], path[i+1:], true
+}
+
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
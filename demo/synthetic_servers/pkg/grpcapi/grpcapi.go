@@ -0,0 +1,514 @@
+// Package grpcapi describes a synthetic server's REST API as a gRPC
+// service, built from the server's OpenAPI spec so that the two never
+// drift apart. The spec's schemas become messages, and each operation an
+// RPC annotated with the REST route it maps to, as grpc-gateway expects:
+//
+//	rpc GetUserAccounts(GetUserAccountsRequest) returns (GetUserAccountsResponse) {
+//	  option (google.api.http) = { get: "/api/v1/accounts" };
+//	}
+//
+// A request message holds the route's path and query parameters, and its
+// JSON body under body. Operations that answer with anything but JSON,
+// like event streams, are left out.
+package grpcapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	_ "google.golang.org/protobuf/types/known/emptypb"  // Registers google/protobuf/empty.proto
+	_ "google.golang.org/protobuf/types/known/structpb" // Registers google/protobuf/struct.proto
+
+	"pkg/internal/names"
+)
+
+// Service is the name of the service in every API's package.
+const Service = "API"
+
+// Well-known types the messages use.
+const (
+	typeEmpty  = ".google.protobuf.Empty"
+	typeStruct = ".google.protobuf.Struct"
+	typeValue  = ".google.protobuf.Value"
+)
+
+// API is a server's gRPC API.
+type API struct {
+	File     *descriptorpb.FileDescriptorProto
+	comments map[string]string // Element's full name -> its comment
+}
+
+// Package returns the protobuf package for the API with the title, like
+// synthetic.chase_bank.v1 for Chase Bank.
+func Package(title string) string {
+	return "synthetic." + names.Snake(title) + ".v1"
+}
+
+// New builds the gRPC API for the OpenAPI spec.
+func New(spec []byte) (*API, error) {
+	var doc openAPI
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("parsing OpenAPI spec: %w", err)
+	}
+	if doc.Info.Title == "" {
+		return nil, fmt.Errorf("OpenAPI spec has no title")
+	}
+	pkg := Package(doc.Info.Title)
+	b := &builder{
+		doc: &doc,
+		api: &API{
+			File: &descriptorpb.FileDescriptorProto{
+				Name:       proto.String(strings.ReplaceAll(pkg, ".", "/") + "/api.proto"),
+				Package:    proto.String(pkg),
+				Dependency: []string{"google/api/annotations.proto", "google/protobuf/empty.proto", "google/protobuf/struct.proto"},
+				Syntax:     proto.String("proto3"),
+			},
+			comments: make(map[string]string),
+		},
+		prefix: "." + pkg + ".",
+		taken:  make(map[string]bool),
+	}
+	for name := range doc.Components.Schemas {
+		b.taken[name] = true
+	}
+	b.schemas()
+	b.service()
+	return b.api, nil
+}
+
+// Descriptor returns the API's file descriptor, resolving its imports
+// against the registered files.
+func (a *API) Descriptor() (protoreflect.FileDescriptor, error) {
+	return protodesc.NewFile(a.File, protoregistry.GlobalFiles)
+}
+
+// openAPI is the part of an OpenAPI spec the API is built from.
+type openAPI struct {
+	Info struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	} `json:"info"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	Summary     string      `json:"summary"`
+	Description string      `json:"description"`
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Schema      *schema `json:"schema"`
+}
+
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Description          string             `json:"description"`
+	Items                *schema            `json:"items"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"` // A schema, or true or false
+}
+
+// additional returns the schema of s's additional properties, if they
+// have one.
+func (s *schema) additional() *schema {
+	var add schema
+	if len(s.AdditionalProperties) == 0 || json.Unmarshal(s.AdditionalProperties, &add) != nil {
+		return nil
+	}
+	return &add
+}
+
+type builder struct {
+	doc    *openAPI
+	api    *API
+	prefix string          // Package, as message type names start
+	taken  map[string]bool // Top-level message names
+}
+
+// schemas adds a message for each of the spec's schemas.
+func (b *builder) schemas() {
+	for _, name := range sortedKeys(b.doc.Components.Schemas) {
+		s := b.doc.Components.Schemas[name]
+		if s.Type != "object" && len(s.Properties) == 0 {
+			continue
+		}
+		b.add(b.message(name, b.prefix+name, s.Properties), s.Description)
+	}
+}
+
+// service adds the service, with an RPC for each operation.
+func (b *builder) service() {
+	svc := &descriptorpb.ServiceDescriptorProto{Name: proto.String(Service)}
+	b.api.comments[b.prefix+Service] = strings.TrimSpace(b.doc.Info.Title + ": " + b.doc.Info.Description)
+	methods := make(map[string]bool)
+	for _, path := range sortedKeys(b.doc.Paths) {
+		for _, verb := range []string{"get", "post", "put", "patch", "delete"} {
+			raw, ok := b.doc.Paths[path][verb]
+			if !ok {
+				continue
+			}
+			var op operation
+			if json.Unmarshal(raw, &op) != nil {
+				continue
+			}
+			if m := b.method(path, verb, &op, methods); m != nil {
+				svc.Method = append(svc.Method, m)
+			}
+		}
+	}
+	b.api.File.Service = append(b.api.File.Service, svc)
+}
+
+// method builds the RPC for an operation, and its request and response
+// messages, or returns nil if it doesn't answer with JSON.
+func (b *builder) method(path, verb string, op *operation, methods map[string]bool) *descriptorpb.MethodDescriptorProto {
+	result, ok := successSchema(op)
+	if !ok {
+		return nil
+	}
+	name := methodName(op.Summary, verb, path)
+	if name == "" || methods[name] {
+		name = methodName("", verb, path)
+	}
+	for i := 2; methods[name]; i++ {
+		name = fmt.Sprintf("%s%d", methodName("", verb, path), i)
+	}
+	methods[name] = true
+
+	rule := &annotations.HttpRule{}
+	template := path
+
+	// The request: path and query parameters, then the body.
+	reqName := b.topName(name + "Request")
+	req := &descriptorpb.DescriptorProto{Name: proto.String(reqName)}
+	fields := make(map[string]bool)
+	for _, p := range op.Parameters {
+		if (p.In != "path" && p.In != "query") || fields[p.Name] {
+			continue
+		}
+		fields[p.Name] = true
+		f := b.field(req, b.prefix+reqName, p.Name, p.Schema)
+		if p.In == "path" {
+			template = strings.ReplaceAll(template, "{"+p.Name+"}", "{"+f.GetName()+"}")
+		}
+		b.comment(b.prefix+reqName+"."+f.GetName(), p.Description)
+	}
+	if op.RequestBody != nil {
+		if media, ok := op.RequestBody.Content["application/json"]; ok && media.Schema != nil {
+			body := "body"
+			if fields[body] {
+				body = "request_body"
+			}
+			f := b.field(req, b.prefix+reqName, body, media.Schema)
+			rule.Body = f.GetName()
+		}
+	}
+	b.add(req, "")
+
+	// The response: a message from the spec as it is, or one wrapping it.
+	output := typeEmpty
+	switch {
+	case result == nil:
+	case result.Ref != "" && b.isMessage(result.Ref):
+		output = b.prefix + refName(result.Ref)
+	case len(result.Properties) > 0:
+		respName := b.topName(name + "Response")
+		b.add(b.message(respName, b.prefix+respName, result.Properties), "")
+		output = b.prefix + respName
+	default:
+		respName := b.topName(name + "Response")
+		resp := &descriptorpb.DescriptorProto{Name: proto.String(respName)}
+		wrapped := "value"
+		if result.Type == "array" {
+			wrapped = "items"
+		}
+		b.field(resp, b.prefix+respName, wrapped, result)
+		b.add(resp, "")
+		rule.ResponseBody = wrapped
+		output = b.prefix + respName
+	}
+
+	switch verb {
+	case "get":
+		rule.Pattern = &annotations.HttpRule_Get{Get: template}
+	case "post":
+		rule.Pattern = &annotations.HttpRule_Post{Post: template}
+	case "put":
+		rule.Pattern = &annotations.HttpRule_Put{Put: template}
+	case "patch":
+		rule.Pattern = &annotations.HttpRule_Patch{Patch: template}
+	case "delete":
+		rule.Pattern = &annotations.HttpRule_Delete{Delete: template}
+	}
+	opts := &descriptorpb.MethodOptions{}
+	proto.SetExtension(opts, annotations.E_Http, rule)
+	b.comment(b.prefix+Service+"."+name, strings.TrimSpace(op.Summary+"\n\n"+op.Description))
+	return &descriptorpb.MethodDescriptorProto{
+		Name:       proto.String(name),
+		InputType:  proto.String(b.prefix + reqName),
+		OutputType: proto.String(output),
+		Options:    opts,
+	}
+}
+
+// successSchema returns the schema of an operation's first 2xx response,
+// nil if it has no body, and false if its body isn't JSON.
+func successSchema(op *operation) (*schema, bool) {
+	for _, status := range sortedKeys(op.Responses) {
+		if !strings.HasPrefix(status, "2") {
+			continue
+		}
+		content := op.Responses[status].Content
+		if len(content) == 0 {
+			return nil, true
+		}
+		media, ok := content["application/json"]
+		if !ok {
+			return nil, false
+		}
+		return media.Schema, true
+	}
+	return nil, true
+}
+
+// message builds a message with a field for each property.
+func (b *builder) message(name, fullName string, props map[string]*schema) *descriptorpb.DescriptorProto {
+	m := &descriptorpb.DescriptorProto{Name: proto.String(name)}
+	for _, prop := range sortedKeys(props) {
+		f := b.field(m, fullName, prop, props[prop])
+		b.comment(fullName+"."+f.GetName(), props[prop].Description)
+	}
+	return m
+}
+
+// field adds a field for the JSON property to m, whose full name is
+// parent, numbering it after the others.
+func (b *builder) field(m *descriptorpb.DescriptorProto, parent, jsonName string, s *schema) *descriptorpb.FieldDescriptorProto {
+	name := names.Snake(jsonName)
+	for i := 2; hasField(m, name); i++ {
+		name = fmt.Sprintf("%s_%d", names.Snake(jsonName), i)
+	}
+	f := &descriptorpb.FieldDescriptorProto{
+		Name:     proto.String(name),
+		JsonName: proto.String(jsonName),
+		Number:   proto.Int32(int32(len(m.Field) + 1)),
+		Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+	}
+	b.setType(m, parent, f, s)
+	if f.GetLabel() == descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL && f.GetType() != descriptorpb.FieldDescriptorProto_TYPE_MESSAGE {
+		// Scalars track presence, so that false and 0 can be sent.
+		f.Proto3Optional = proto.Bool(true)
+		f.OneofIndex = proto.Int32(int32(len(m.OneofDecl)))
+		m.OneofDecl = append(m.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String("_" + name)})
+	}
+	m.Field = append(m.Field, f)
+	return f
+}
+
+// setType gives f the type for s, adding any message it needs to m, whose
+// full name is parent.
+func (b *builder) setType(m *descriptorpb.DescriptorProto, parent string, f *descriptorpb.FieldDescriptorProto, s *schema) {
+	message := func(typeName string) {
+		f.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+		f.TypeName = proto.String(typeName)
+	}
+	if s == nil {
+		message(typeValue)
+		return
+	}
+	if s.Ref != "" {
+		if b.isMessage(s.Ref) {
+			message(b.prefix + refName(s.Ref))
+		} else if target := b.doc.Components.Schemas[refName(s.Ref)]; target != nil && target.Ref == "" {
+			b.setType(m, parent, f, target)
+		} else {
+			message(typeValue)
+		}
+		return
+	}
+
+	scalar := func(t descriptorpb.FieldDescriptorProto_Type) {
+		f.Type = t.Enum()
+	}
+	switch s.Type {
+	case "string":
+		scalar(descriptorpb.FieldDescriptorProto_TYPE_STRING)
+	case "integer":
+		if s.Format == "int32" {
+			scalar(descriptorpb.FieldDescriptorProto_TYPE_INT32)
+		} else {
+			scalar(descriptorpb.FieldDescriptorProto_TYPE_INT64)
+		}
+	case "number":
+		scalar(descriptorpb.FieldDescriptorProto_TYPE_DOUBLE)
+	case "boolean":
+		scalar(descriptorpb.FieldDescriptorProto_TYPE_BOOL)
+	case "array":
+		if s.Items == nil || s.Items.Type == "array" {
+			message(typeValue)
+			f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			return
+		}
+		b.setType(m, parent, f, s.Items)
+		f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	case "object":
+		switch add := s.additional(); {
+		case len(s.Properties) > 0:
+			name := nestedName(m, names.Camel(f.GetJsonName()))
+			m.NestedType = append(m.NestedType, b.message(name, parent+"."+name, s.Properties))
+			message(parent + "." + name)
+		case add != nil && add.Type != "array":
+			// A map, which protobuf spells as a repeated entry message.
+			name := nestedName(m, names.Camel(f.GetJsonName())+"Entry")
+			entry := &descriptorpb.DescriptorProto{
+				Name:    proto.String(name),
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				Field: []*descriptorpb.FieldDescriptorProto{{
+					Name:     proto.String("key"),
+					JsonName: proto.String("key"),
+					Number:   proto.Int32(1),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				}},
+			}
+			value := &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String("value"),
+				JsonName: proto.String("value"),
+				Number:   proto.Int32(2),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}
+			b.setType(entry, parent+"."+name, value, add)
+			entry.Field = append(entry.Field, value)
+			m.NestedType = append(m.NestedType, entry)
+			message(parent + "." + name)
+			f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		default:
+			message(typeStruct)
+		}
+	default:
+		message(typeValue)
+	}
+}
+
+// isMessage reports whether ref names a schema that has a message.
+func (b *builder) isMessage(ref string) bool {
+	s := b.doc.Components.Schemas[refName(ref)]
+	return s != nil && (s.Type == "object" || len(s.Properties) > 0)
+}
+
+// topName returns name, or a variant of it if a top-level message already
+// has it, and takes it.
+func (b *builder) topName(name string) string {
+	if b.taken[name] {
+		stem := strings.TrimSuffix(strings.TrimSuffix(name, "Request"), "Response")
+		name = stem + "Rpc" + strings.TrimPrefix(name, stem)
+	}
+	for i := 2; b.taken[name]; i++ {
+		name = fmt.Sprintf("%s%d", strings.TrimRight(name, "0123456789"), i)
+	}
+	b.taken[name] = true
+	return name
+}
+
+func (b *builder) add(m *descriptorpb.DescriptorProto, comment string) {
+	b.api.File.MessageType = append(b.api.File.MessageType, m)
+	b.comment(b.prefix+m.GetName(), comment)
+}
+
+func (b *builder) comment(fullName, text string) {
+	if text = strings.TrimSpace(text); text != "" {
+		b.api.comments[strings.TrimPrefix(fullName, ".")] = text
+	}
+}
+
+func hasField(m *descriptorpb.DescriptorProto, name string) bool {
+	for _, f := range m.Field {
+		if f.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func nestedName(m *descriptorpb.DescriptorProto, name string) string {
+	taken := func(name string) bool {
+		for _, n := range m.NestedType {
+			if n.GetName() == name {
+				return true
+			}
+		}
+		return false
+	}
+	candidate := name
+	for i := 2; taken(candidate); i++ {
+		candidate = fmt.Sprintf("%s%d", name, i)
+	}
+	return candidate
+}
+
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// methodName names an RPC after its operation's summary, like
+// GetUserAccounts for "Get user accounts", or else after its method and
+// path, like GetAccountsByAccountId for GET /api/v1/accounts/{accountId}.
+// Only a summary's first clause counts, and not at all if it only restates
+// the method and path.
+func methodName(summary, verb, path string) string {
+	if summary != "" && !strings.HasPrefix(summary, strings.ToUpper(verb)+" /") {
+		if i := strings.IndexAny(summary, ":,;("); i > 0 {
+			summary = summary[:i]
+		}
+		return names.Camel(summary)
+	}
+	var name strings.Builder
+	name.WriteString(names.Camel(verb))
+	for _, seg := range strings.Split(strings.TrimPrefix(path, "/api/v1"), "/") {
+		if seg == "" {
+			continue
+		}
+		if param, ok := strings.CutPrefix(seg, "{"); ok {
+			name.WriteString("By" + names.Camel(strings.TrimSuffix(param, "}")))
+		} else {
+			name.WriteString(names.Camel(seg))
+		}
+	}
+	return name.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
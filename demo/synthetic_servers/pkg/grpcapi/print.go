@@ -0,0 +1,178 @@
+package grpcapi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Proto renders the API as a .proto file.
+func (a *API) Proto() []byte {
+	p := &printer{api: a, pkg: a.File.GetPackage()}
+	p.line("// Code generated by protogen from openapi.json. DO NOT EDIT.")
+	p.line("")
+	p.line(`syntax = "proto3";`)
+	p.line("")
+	p.line("package %s;", p.pkg)
+	p.line("")
+	for _, dep := range a.File.Dependency {
+		p.line("import %q;", dep)
+	}
+	for _, svc := range a.File.Service {
+		p.line("")
+		p.service(svc)
+	}
+	for _, m := range a.File.MessageType {
+		p.line("")
+		p.message(m, p.pkg+"."+m.GetName())
+	}
+	return []byte(p.String())
+}
+
+type printer struct {
+	strings.Builder
+	api    *API
+	pkg    string
+	indent int
+}
+
+func (p *printer) line(format string, args ...any) {
+	if format != "" {
+		p.WriteString(strings.Repeat("  ", p.indent))
+		fmt.Fprintf(p, format, args...)
+	}
+	p.WriteByte('\n')
+}
+
+func (p *printer) comment(fullName string) {
+	text, ok := p.api.comments[fullName]
+	if !ok {
+		return
+	}
+	for _, l := range strings.Split(text, "\n") {
+		if l = strings.TrimRight(l, " \t"); l == "" {
+			p.line("//")
+		} else {
+			p.line("// %s", l)
+		}
+	}
+}
+
+func (p *printer) service(svc *descriptorpb.ServiceDescriptorProto) {
+	name := p.pkg + "." + svc.GetName()
+	p.comment(name)
+	p.line("service %s {", svc.GetName())
+	p.indent++
+	for i, m := range svc.Method {
+		if i > 0 {
+			p.line("")
+		}
+		p.comment(name + "." + m.GetName())
+		p.line("rpc %s(%s) returns (%s) {", m.GetName(), p.typeName(m.GetInputType()), p.typeName(m.GetOutputType()))
+		p.indent++
+		rule := proto.GetExtension(m.GetOptions(), annotations.E_Http).(*annotations.HttpRule)
+		verb, path := route(rule)
+		fields := []string{fmt.Sprintf("%s: %q", verb, path)}
+		if rule.GetBody() != "" {
+			fields = append(fields, fmt.Sprintf("body: %q", rule.GetBody()))
+		}
+		if rule.GetResponseBody() != "" {
+			fields = append(fields, fmt.Sprintf("response_body: %q", rule.GetResponseBody()))
+		}
+		p.line("option (google.api.http) = { %s };", strings.Join(fields, " "))
+		p.indent--
+		p.line("}")
+	}
+	p.indent--
+	p.line("}")
+}
+
+func (p *printer) message(m *descriptorpb.DescriptorProto, fullName string) {
+	p.comment(fullName)
+	p.line("message %s {", m.GetName())
+	p.indent++
+	entries := make(map[string]*descriptorpb.DescriptorProto)
+	for _, nested := range m.NestedType {
+		if nested.GetOptions().GetMapEntry() {
+			entries["."+fullName+"."+nested.GetName()] = nested
+			continue
+		}
+		p.message(nested, fullName+"."+nested.GetName())
+	}
+	for _, f := range m.Field {
+		p.comment(fullName + "." + f.GetName())
+		var typ string
+		if entry, ok := entries[f.GetTypeName()]; ok {
+			typ = fmt.Sprintf("map<%s, %s>", p.fieldType(entry.Field[0]), p.fieldType(entry.Field[1]))
+		} else {
+			typ = p.fieldType(f)
+			switch {
+			case f.GetLabel() == descriptorpb.FieldDescriptorProto_LABEL_REPEATED:
+				typ = "repeated " + typ
+			case f.GetProto3Optional():
+				typ = "optional " + typ
+			}
+		}
+		opts := ""
+		if f.GetJsonName() != jsonName(f.GetName()) {
+			opts = fmt.Sprintf(" [json_name = %s]", strconv.Quote(f.GetJsonName()))
+		}
+		p.line("%s %s = %d%s;", typ, f.GetName(), f.GetNumber(), opts)
+	}
+	p.indent--
+	p.line("}")
+}
+
+func (p *printer) fieldType(f *descriptorpb.FieldDescriptorProto) string {
+	if f.GetType() == descriptorpb.FieldDescriptorProto_TYPE_MESSAGE {
+		return p.typeName(f.GetTypeName())
+	}
+	return strings.ToLower(strings.TrimPrefix(f.GetType().String(), "TYPE_"))
+}
+
+// typeName spells a fully-qualified type name as short as it can be in the
+// API's package.
+func (p *printer) typeName(name string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(name, "."), p.pkg+".")
+}
+
+// route returns the method and path of an HTTP rule.
+func route(rule *annotations.HttpRule) (verb, path string) {
+	switch pattern := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		return "get", pattern.Get
+	case *annotations.HttpRule_Post:
+		return "post", pattern.Post
+	case *annotations.HttpRule_Put:
+		return "put", pattern.Put
+	case *annotations.HttpRule_Patch:
+		return "patch", pattern.Patch
+	case *annotations.HttpRule_Delete:
+		return "delete", pattern.Delete
+	}
+	return "", ""
+}
+
+// jsonName returns the JSON name protobuf gives a field by default, its
+// name in lowerCamelCase.
+func jsonName(field string) string {
+	var name strings.Builder
+	upper := false
+	for _, r := range field {
+		switch {
+		case r == '_':
+			upper = true
+		case upper && 'a' <= r && r <= 'z':
+			name.WriteRune(r - 'a' + 'A')
+			upper = false
+		default:
+			name.WriteRune(r)
+			upper = false
+		}
+	}
+	return name.String()
+}
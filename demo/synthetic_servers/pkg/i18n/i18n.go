@@ -0,0 +1,184 @@
+// Package i18n translates what the synthetic servers say to people: error
+// messages, notifications, texts and emails. Messages are written in
+// English, and the English is the key to their translations, so code
+// keeps writing
+//
+//	return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "notification not found")
+//
+// and the message is translated on its way out, into the language the
+// request's Accept-Language header prefers or the one a user chose for
+// what's sent them. A message whose parts vary names them {{name}}, as
+// templates do, in its English and its translations alike:
+//
+//	i18n.Add("es", map[string]string{"Your order {{id}} has shipped.": "Tu pedido {{id}} ha sido enviado."})
+//
+// Messages without a translation stay in English.
+package i18n
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the language messages are written in, and what requests
+// that don't say, or ask only for languages there are no translations
+// into, get.
+const Default = "en"
+
+// Languages are those there are translations into, as well as Default.
+var Languages = []string{"en", "es", "fr"}
+
+// Supported reports whether lang is one of Languages.
+func Supported(lang string) bool {
+	for _, l := range Languages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the language of Languages an Accept-Language header,
+// such as "fr-CA,fr;q=0.9,en;q=0.5", prefers most, by the locales'
+// primary subtags, or Default.
+func Negotiate(header string) string {
+	for _, locale := range Locales(header) {
+		lang, _, _ := strings.Cut(strings.ToLower(locale), "-")
+		if Supported(lang) {
+			return lang
+		}
+	}
+	return Default
+}
+
+// Locales returns the locales of an Accept-Language header, most
+// preferred first, leaving out those it refuses with q=0.
+func Locales(header string) []string {
+	type locale struct {
+		tag string
+		q   float64
+	}
+	var locales []locale
+	for _, entry := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if tag != "" && tag != "*" && q > 0 {
+			locales = append(locales, locale{tag, q})
+		}
+	}
+	sort.SliceStable(locales, func(i, j int) bool { return locales[i].q > locales[j].q })
+	tags := make([]string, len(locales))
+	for i, l := range locales {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+// catalog is every translation, by language and English message.
+var catalog = struct {
+	sync.RWMutex
+	messages map[string]map[string]string // Language -> English -> translation
+	patterns map[string][]pattern         // Language -> messages with {{names}}, longest first
+}{
+	messages: make(map[string]map[string]string),
+	patterns: make(map[string][]pattern),
+}
+
+// pattern is a message whose parts vary, matched by a regular expression
+// with a group for each {{name}}.
+type pattern struct {
+	english     string
+	re          *regexp.Regexp
+	names       []string
+	translation string
+}
+
+var placeholder = regexp.MustCompile(`\{\{([\w.]+)\}\}`)
+
+// Add adds translations into lang, by their English, replacing those of
+// the same messages.
+func Add(lang string, messages map[string]string) {
+	catalog.Lock()
+	defer catalog.Unlock()
+	if catalog.messages[lang] == nil {
+		catalog.messages[lang] = make(map[string]string)
+	}
+	for english, translation := range messages {
+		catalog.messages[lang][english] = translation
+		if !placeholder.MatchString(english) {
+			continue
+		}
+		p := pattern{english: english, translation: translation}
+		var expr strings.Builder
+		expr.WriteString("^")
+		last := 0
+		for _, m := range placeholder.FindAllStringSubmatchIndex(english, -1) {
+			expr.WriteString(regexp.QuoteMeta(english[last:m[0]]))
+			expr.WriteString("(.+?)")
+			p.names = append(p.names, english[m[2]:m[3]])
+			last = m[1]
+		}
+		expr.WriteString(regexp.QuoteMeta(english[last:]))
+		expr.WriteString("$")
+		p.re = regexp.MustCompile(expr.String())
+		patterns := catalog.patterns[lang]
+		for i := range patterns {
+			if patterns[i].english == english {
+				patterns = append(patterns[:i], patterns[i+1:]...)
+				break
+			}
+		}
+		patterns = append(patterns, p)
+		sort.SliceStable(patterns, func(i, j int) bool { return len(patterns[i].english) > len(patterns[j].english) })
+		catalog.patterns[lang] = patterns
+	}
+}
+
+// T translates message into lang: a message in the catalog as it is, or
+// one a message with {{names}} matches, its parts filled into the
+// translation. Anything else, and any message for Default, is returned as
+// it is.
+func T(lang, message string) string {
+	if lang == Default || lang == "" || message == "" {
+		return message
+	}
+	catalog.RLock()
+	defer catalog.RUnlock()
+	if translation, ok := catalog.messages[lang][message]; ok {
+		return translation
+	}
+	for _, p := range catalog.patterns[lang] {
+		m := p.re.FindStringSubmatch(message)
+		if m == nil {
+			continue
+		}
+		translation := p.translation
+		for i, name := range p.names {
+			translation = strings.ReplaceAll(translation, "{{"+name+"}}", m[i+1])
+		}
+		return translation
+	}
+	return message
+}
+
+// Template translates a template, such as a notice's "Your order {{id}}
+// has shipped.", into lang before it is filled, as T translates messages.
+func Template(lang, template string) string {
+	if lang == Default || lang == "" {
+		return template
+	}
+	catalog.RLock()
+	defer catalog.RUnlock()
+	if translation, ok := catalog.messages[lang][template]; ok {
+		return translation
+	}
+	return template
+}
@@ -0,0 +1,207 @@
+package i18n
+
+// The translations of what the shared modules say: the scaffolding's
+// errors and validation messages, the notices lifecycles send, and the
+// texts in server.TextTemplates. Servers add their own with Add.
+func init() {
+	Add("es", spanish)
+	Add("fr", french)
+}
+
+var spanish = map[string]string{
+	// Errors
+	"Validation failed":                               "La validación falló",
+	"Invalid request body":                            "Cuerpo de la solicitud no válido",
+	"invalid request body":                            "cuerpo de la solicitud no válido",
+	"authorization required":                          "se requiere autorización",
+	"authorization must be a bearer token":            "la autorización debe ser un token bearer",
+	"invalid token":                                   "token no válido",
+	"token does not belong to {{who}}":                "el token no pertenece a {{who}}",
+	"invalid admin token":                             "token de administrador no válido",
+	"not found":                                       "no encontrado",
+	"entity not found":                                "entidad no encontrada",
+	"notification not found":                          "notificación no encontrada",
+	"charge not found":                                "cargo no encontrado",
+	"webhook not found":                               "webhook no encontrado",
+	"sandbox not found":                               "sandbox no encontrado",
+	"snapshot not found":                              "instantánea no encontrada",
+	"fault not found":                                 "falla no encontrada",
+	"User not found":                                  "Usuario no encontrado",
+	"No such archived entity":                         "No existe esa entidad archivada",
+	"email parameter is required":                     "el parámetro email es obligatorio",
+	"query is required":                               "la consulta es obligatoria",
+	"q is required":                                   "q es obligatorio",
+	"type must be among {{types}}":                    "type debe estar entre {{types}}",
+	"file not found":                                  "archivo no encontrado",
+	"file is larger than {{max}} bytes":               "el archivo supera los {{max}} bytes",
+	"a valid email is required":                       "se requiere un email válido",
+	"email is already registered":                     "el email ya está registrado",
+	"invalid email or password":                       "email o contraseña no válidos",
+	"refresh_token is required":                       "refresh_token es obligatorio",
+	"invalid or expired refresh token":                "refresh token no válido o vencido",
+	"API tokens cannot be logged out":                 "los tokens de API no pueden cerrar sesión",
+	"Invalid cursor":                                  "Cursor no válido",
+	"This list can't be paged by cursor":              "Esta lista no se puede paginar por cursor",
+	"sort can't be combined with cursor paging":       "sort no se puede combinar con la paginación por cursor",
+	"Cannot sort by {{field}}":                        "No se puede ordenar por {{field}}",
+	"{{name}} must be an integer of at least {{min}}": "{{name}} debe ser un entero de al menos {{min}}",
+	"This resource has no version to match":           "Este recurso no tiene una versión con la que coincidir",
+	"The resource has changed since it was read; fetch it again and retry":                 "El recurso cambió desde que se leyó; vuelve a obtenerlo e inténtalo de nuevo",
+	"Idempotency-Key was already used for a different request":                             "La Idempotency-Key ya se usó para otra solicitud",
+	"A request with this Idempotency-Key is still in progress":                             "Una solicitud con esta Idempotency-Key todavía está en curso",
+	"Rate limit of {{max}} requests per {{per}} exceeded; retry after {{seconds}} seconds": "Se superó el límite de {{max}} solicitudes por {{per}}; vuelve a intentarlo en {{seconds}} segundos",
+	"The server is read-only: {{request}} isn't allowed, only reads are":                   "El servidor es de solo lectura: {{request}} no está permitido, solo las lecturas",
+	"The request took longer than {{timeout}}":                                             "La solicitud tardó más de {{timeout}}",
+	"files of type {{type}} aren't taken, only {{types}}":                                  "no se aceptan archivos de tipo {{type}}, solo {{types}}",
+	"shutting down":              "apagando",
+	"database is being reloaded": "la base de datos se está recargando",
+	"Injected fault":             "Falla inyectada",
+	"Injected timeout":           "Tiempo de espera inyectado",
+	"insufficient funds":         "fondos insuficientes",
+	"Cannot {{method}} {{path}}": "No se puede {{method}} {{path}}",
+	"{{method}} isn't allowed on {{path}}; use {{allowed}}":             "{{method}} no está permitido en {{path}}; usa {{allowed}}",
+	"API v1 was retired on {{date}}":                                    "La API v1 se retiró el {{date}}",
+	"{{machine}} is {{status}}, and can't be changed":                   "{{machine}} está en {{status}} y no se puede cambiar",
+	"{{machine}} can't go from {{from}} to {{to}}, only to {{allowed}}": "{{machine}} no puede pasar de {{from}} a {{to}}, solo a {{allowed}}",
+	"Not Found":             "No encontrado",
+	"Bad Request":           "Solicitud incorrecta",
+	"Unauthorized":          "No autorizado",
+	"Forbidden":             "Prohibido",
+	"Method Not Allowed":    "Método no permitido",
+	"Conflict":              "Conflicto",
+	"Too Many Requests":     "Demasiadas solicitudes",
+	"Internal Server Error": "Error interno del servidor",
+	"Service Unavailable":   "Servicio no disponible",
+
+	// Validation, of a field
+	"is required":                                         "es obligatorio",
+	"must be a valid email address":                       "debe ser una dirección de email válida",
+	"must be a date in YYYY-MM-DD format":                 "debe ser una fecha en formato AAAA-MM-DD",
+	"must be an RFC 3339 timestamp":                       "debe ser una marca de tiempo RFC 3339",
+	"must be an IANA time zone, such as America/New_York": "debe ser una zona horaria IANA, como America/New_York",
+	"must be one of {{options}}":                          "debe ser uno de {{options}}",
+	"must have at least {{n}} {{unit}}":                   "debe tener al menos {{n}} {{unit}}",
+	"must have at most {{n}} {{unit}}":                    "debe tener como máximo {{n}} {{unit}}",
+	"must be at least {{n}}":                              "debe ser al menos {{n}}",
+	"must be at most {{n}}":                               "debe ser como máximo {{n}}",
+	"must be greater than {{n}}":                          "debe ser mayor que {{n}}",
+	"must be an amount, like 59.98":                       "debe ser un importe, como 59.98",
+	"must be an http or https URL":                        "debe ser una URL http o https",
+
+	// Notices
+	"Your order {{id}} has shipped.":                            "Tu pedido {{id}} ha sido enviado.",
+	"Your order {{id}} was delivered.":                          "Tu pedido {{id}} fue entregado.",
+	"Your order {{id}} is confirmed.":                           "Tu pedido {{id}} está confirmado.",
+	"Your order {{id}} is on its way.":                          "Tu pedido {{id}} está en camino.",
+	"Your order {{id}} is ready for pickup.":                    "Tu pedido {{id}} está listo para recoger.",
+	"Your purchase {{id}} is approved.":                         "Tu compra {{id}} está aprobada.",
+	"Your car is on its way for delivery on your order {{id}}.": "Tu auto está en camino para la entrega de tu pedido {{id}}.",
+	"Your shipment {{tracking_number}} was delivered.":          "Tu envío {{tracking_number}} fue entregado.",
+	"Your driver has arrived.":                                  "Tu conductor ha llegado.",
+	"Your ride {{id}} is complete.":                             "Tu viaje {{id}} ha terminado.",
+	"A Tasker accepted your task {{id}}.":                       "Un Tasker aceptó tu tarea {{id}}.",
+	"Your task {{id}} is complete.":                             "Tu tarea {{id}} está terminada.",
+
+	// Texts
+	"{{code}} is your {{from}} verification code. It expires in {{minutes}} minutes. Don't share it with anyone.": "{{code}} es tu código de verificación de {{from}}. Vence en {{minutes}} minutos. No lo compartas con nadie.",
+	"{{from}}: Your driver is arriving now. Please meet them at your pickup spot.":                                "{{from}}: Tu conductor está llegando. Encuéntralo en tu punto de recogida.",
+}
+
+var french = map[string]string{
+	// Errors
+	"Validation failed":                               "La validation a échoué",
+	"Invalid request body":                            "Corps de requête invalide",
+	"invalid request body":                            "corps de requête invalide",
+	"authorization required":                          "autorisation requise",
+	"authorization must be a bearer token":            "l'autorisation doit être un jeton bearer",
+	"invalid token":                                   "jeton invalide",
+	"token does not belong to {{who}}":                "le jeton n'appartient pas à {{who}}",
+	"invalid admin token":                             "jeton d'administration invalide",
+	"not found":                                       "introuvable",
+	"entity not found":                                "entité introuvable",
+	"notification not found":                          "notification introuvable",
+	"charge not found":                                "paiement introuvable",
+	"webhook not found":                               "webhook introuvable",
+	"sandbox not found":                               "bac à sable introuvable",
+	"snapshot not found":                              "instantané introuvable",
+	"fault not found":                                 "panne introuvable",
+	"User not found":                                  "Utilisateur introuvable",
+	"No such archived entity":                         "Aucune entité archivée de ce nom",
+	"email parameter is required":                     "le paramètre email est obligatoire",
+	"query is required":                               "la requête est obligatoire",
+	"q is required":                                   "q est obligatoire",
+	"type must be among {{types}}":                    "type doit faire partie de {{types}}",
+	"file not found":                                  "fichier introuvable",
+	"file is larger than {{max}} bytes":               "le fichier dépasse {{max}} octets",
+	"a valid email is required":                       "un email valide est requis",
+	"email is already registered":                     "cet email est déjà inscrit",
+	"invalid email or password":                       "email ou mot de passe invalide",
+	"refresh_token is required":                       "refresh_token est obligatoire",
+	"invalid or expired refresh token":                "refresh token invalide ou expiré",
+	"API tokens cannot be logged out":                 "les jetons d'API ne peuvent pas être déconnectés",
+	"Invalid cursor":                                  "Curseur invalide",
+	"This list can't be paged by cursor":              "Cette liste ne peut pas être paginée par curseur",
+	"sort can't be combined with cursor paging":       "sort ne peut pas être combiné avec la pagination par curseur",
+	"Cannot sort by {{field}}":                        "Impossible de trier par {{field}}",
+	"{{name}} must be an integer of at least {{min}}": "{{name}} doit être un entier d'au moins {{min}}",
+	"This resource has no version to match":           "Cette ressource n'a pas de version à comparer",
+	"The resource has changed since it was read; fetch it again and retry":                 "La ressource a changé depuis sa lecture ; récupérez-la et réessayez",
+	"Idempotency-Key was already used for a different request":                             "L'Idempotency-Key a déjà servi pour une autre requête",
+	"A request with this Idempotency-Key is still in progress":                             "Une requête avec cette Idempotency-Key est encore en cours",
+	"Rate limit of {{max}} requests per {{per}} exceeded; retry after {{seconds}} seconds": "Limite de {{max}} requêtes par {{per}} dépassée ; réessayez dans {{seconds}} secondes",
+	"The server is read-only: {{request}} isn't allowed, only reads are":                   "Le serveur est en lecture seule : {{request}} n'est pas permis, seules les lectures le sont",
+	"The request took longer than {{timeout}}":                                             "La requête a pris plus de {{timeout}}",
+	"files of type {{type}} aren't taken, only {{types}}":                                  "les fichiers de type {{type}} ne sont pas acceptés, seulement {{types}}",
+	"shutting down":              "arrêt en cours",
+	"database is being reloaded": "la base de données est en cours de rechargement",
+	"Injected fault":             "Panne injectée",
+	"Injected timeout":           "Délai d'attente injecté",
+	"insufficient funds":         "fonds insuffisants",
+	"Cannot {{method}} {{path}}": "Impossible de {{method}} {{path}}",
+	"{{method}} isn't allowed on {{path}}; use {{allowed}}":             "{{method}} n'est pas permis sur {{path}} ; utilisez {{allowed}}",
+	"API v1 was retired on {{date}}":                                    "L'API v1 a été retirée le {{date}}",
+	"{{machine}} is {{status}}, and can't be changed":                   "{{machine}} est {{status}} et ne peut plus changer",
+	"{{machine}} can't go from {{from}} to {{to}}, only to {{allowed}}": "{{machine}} ne peut pas passer de {{from}} à {{to}}, seulement à {{allowed}}",
+	"Not Found":             "Introuvable",
+	"Bad Request":           "Requête incorrecte",
+	"Unauthorized":          "Non autorisé",
+	"Forbidden":             "Interdit",
+	"Method Not Allowed":    "Méthode non autorisée",
+	"Conflict":              "Conflit",
+	"Too Many Requests":     "Trop de requêtes",
+	"Internal Server Error": "Erreur interne du serveur",
+	"Service Unavailable":   "Service indisponible",
+
+	// Validation, of a field
+	"is required":                                         "est obligatoire",
+	"must be a valid email address":                       "doit être une adresse email valide",
+	"must be a date in YYYY-MM-DD format":                 "doit être une date au format AAAA-MM-JJ",
+	"must be an RFC 3339 timestamp":                       "doit être un horodatage RFC 3339",
+	"must be an IANA time zone, such as America/New_York": "doit être un fuseau horaire IANA, comme America/New_York",
+	"must be one of {{options}}":                          "doit être l'une des valeurs {{options}}",
+	"must have at least {{n}} {{unit}}":                   "doit avoir au moins {{n}} {{unit}}",
+	"must have at most {{n}} {{unit}}":                    "doit avoir au plus {{n}} {{unit}}",
+	"must be at least {{n}}":                              "doit être au moins {{n}}",
+	"must be at most {{n}}":                               "doit être au plus {{n}}",
+	"must be greater than {{n}}":                          "doit être supérieur à {{n}}",
+	"must be an amount, like 59.98":                       "doit être un montant, comme 59.98",
+	"must be an http or https URL":                        "doit être une URL http ou https",
+
+	// Notices
+	"Your order {{id}} has shipped.":                            "Votre commande {{id}} a été expédiée.",
+	"Your order {{id}} was delivered.":                          "Votre commande {{id}} a été livrée.",
+	"Your order {{id}} is confirmed.":                           "Votre commande {{id}} est confirmée.",
+	"Your order {{id}} is on its way.":                          "Votre commande {{id}} est en route.",
+	"Your order {{id}} is ready for pickup.":                    "Votre commande {{id}} est prête à être retirée.",
+	"Your purchase {{id}} is approved.":                         "Votre achat {{id}} est approuvé.",
+	"Your car is on its way for delivery on your order {{id}}.": "Votre voiture est en route pour la livraison de votre commande {{id}}.",
+	"Your shipment {{tracking_number}} was delivered.":          "Votre colis {{tracking_number}} a été livré.",
+	"Your driver has arrived.":                                  "Votre chauffeur est arrivé.",
+	"Your ride {{id}} is complete.":                             "Votre course {{id}} est terminée.",
+	"A Tasker accepted your task {{id}}.":                       "Un Tasker a accepté votre tâche {{id}}.",
+	"Your task {{id}} is complete.":                             "Votre tâche {{id}} est terminée.",
+
+	// Texts
+	"{{code}} is your {{from}} verification code. It expires in {{minutes}} minutes. Don't share it with anyone.": "{{code}} est votre code de vérification {{from}}. Il expire dans {{minutes}} minutes. Ne le partagez avec personne.",
+	"{{from}}: Your driver is arriving now. Please meet them at your pickup spot.":                                "{{from}} : Votre chauffeur arrive. Retrouvez-le à votre point de prise en charge.",
+}
@@ -0,0 +1,67 @@
+// Package identity is the directory of the people the synthetic servers'
+// seeds share. The same personas, such as Casey Wringer, sign in to most of
+// the servers, and an agent working across them (ordering on Amazon, then
+// paying by Chase) should find one person: the same name, phone, address
+// and cards everywhere. Seeds refer to a persona by email, and seedgen's
+// -sync brings the records in a server's seed into line with the directory.
+package identity
+
+import (
+	"slices"
+	"strings"
+
+	"pkg/geo"
+	"pkg/geocode"
+)
+
+// Person is a persona as the directory knows them.
+type Person struct {
+	Email       string
+	First, Last string
+	Phone       string
+	DateOfBirth string // YYYY-MM-DD, if known
+	Address     geocode.Address
+	Home        geo.Point // Where Address is
+	Cards       []Card
+}
+
+// Name returns p's full name.
+func (p Person) Name() string {
+	return p.First + " " + p.Last
+}
+
+// Card finds p's card ending in last4.
+func (p Person) Card(last4 string) (Card, bool) {
+	for _, c := range p.Cards {
+		if c.Last4 == last4 {
+			return c, true
+		}
+	}
+	return Card{}, false
+}
+
+// Card is a payment card a person keeps on file. Servers give their payment
+// methods IDs of their own; a card is the same card wherever it has the
+// same last four digits.
+type Card struct {
+	Type     string // credit_card or debit_card
+	Last4    string
+	ExpiryMM int
+	ExpiryYY int // Two digits, such as 29 for 2029
+}
+
+// Lookup returns the person with the email, in any case.
+func Lookup(email string) (Person, bool) {
+	email = strings.TrimSpace(email)
+	for _, p := range people {
+		if strings.EqualFold(p.Email, email) {
+			return p, true
+		}
+	}
+	return Person{}, false
+}
+
+// People returns the directory, Casey Wringer first.
+func People() []Person {
+	return slices.Clone(people)
+}
@@ -0,0 +1,51 @@
+package identity
+
+import (
+	"pkg/geo"
+	"pkg/geocode"
+)
+
+// people are the personas the seeds share. Casey Wringer is everyone's
+// signed-in user; the others turn up as friends, contacts and payees, and
+// in a few seeds as users of their own.
+var people = []Person{
+	{
+		Email: "casey.wringer@email.com", First: "Casey", Last: "Wringer",
+		Phone: "+1-555-0123", DateOfBirth: "1990-05-15",
+		Address: geocode.Address{Street: "789 Tech Avenue", City: "San Francisco", State: "CA", Zip: "94105"},
+		Home:    geo.Point{Lat: 37.7849, Lon: -122.3968},
+		Cards: []Card{
+			{Type: "credit_card", Last4: "4242", ExpiryMM: 12, ExpiryYY: 29},
+		},
+	},
+	{
+		Email: "jordan.lee@email.com", First: "Jordan", Last: "Lee",
+		Phone: "+1-555-0177", DateOfBirth: "1987-09-02",
+		Address: geocode.Address{Street: "1200 Irving Street", City: "San Francisco", State: "CA", Zip: "94122"},
+		Home:    geo.Point{Lat: 37.7641, Lon: -122.4702},
+		Cards: []Card{
+			{Type: "credit_card", Last4: "5100", ExpiryMM: 8, ExpiryYY: 29},
+		},
+	},
+	{
+		Email: "alex.smith@email.com", First: "Alex", Last: "Smith",
+		Phone:   "+1-555-0124",
+		Address: geocode.Address{Street: "455 Market Street", City: "San Francisco", State: "CA", Zip: "94111"},
+		Home:    geo.Point{Lat: 37.7912, Lon: -122.3987},
+	},
+	{
+		Email: "maria.garcia@email.com", First: "Maria", Last: "Garcia",
+		Phone:   "+1-555-0125",
+		Address: geocode.Address{Street: "2101 Telegraph Avenue", City: "Oakland", State: "CA", Zip: "94612"},
+		Home:    geo.Point{Lat: 37.8119, Lon: -122.2689},
+	},
+	{
+		Email: "john.doe@email.com", First: "John", Last: "Doe",
+		Phone:   "+1-555-0199",
+		Address: geocode.Address{Street: "350 5th Avenue", City: "New York", State: "NY", Zip: "10001"},
+		Home:    geo.Point{Lat: 40.7484, Lon: -73.9857},
+		Cards: []Card{
+			{Type: "debit_card", Last4: "1111", ExpiryMM: 6, ExpiryYY: 29},
+		},
+	},
+}
@@ -0,0 +1,101 @@
+// Package names respells the names in OpenAPI specs, such as JSON
+// properties and operation summaries, for the APIs generated from them.
+package names
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Words splits a name or phrase into its lower-case words: user_email,
+// userEmail and "User email" are all user, email.
+func Words(s string) []string {
+	var out []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			out = append(out, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	runes := []rune(s)
+	for i, r := range runes {
+		switch {
+		case r == '\'':
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			flush()
+		case unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+			unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])):
+			flush()
+			word = append(word, r)
+		default:
+			word = append(word, r)
+		}
+	}
+	flush()
+	return out
+}
+
+// Snake spells a name in snake_case, with a leading _ if it would start
+// with a digit.
+func Snake(s string) string {
+	name := strings.Join(Words(s), "_")
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+	return name
+}
+
+// Camel spells a name in CamelCase, with a leading X if it would start with
+// a digit.
+func Camel(s string) string {
+	var name strings.Builder
+	for _, w := range Words(s) {
+		r := []rune(w)
+		name.WriteString(string(unicode.ToUpper(r[0])) + string(r[1:]))
+	}
+	if name.Len() == 0 || unicode.IsDigit(rune(name.String()[0])) {
+		return "X" + name.String()
+	}
+	return name.String()
+}
+
+// LowerCamel spells a name in lowerCamelCase, with a leading _ if it would
+// start with a digit.
+func LowerCamel(s string) string {
+	words := Words(s)
+	if len(words) == 0 {
+		return "_"
+	}
+	name := words[0]
+	if unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+	return name + strings.TrimPrefix(Camel(strings.Join(words[1:], " ")), "X")
+}
+
+// Singular returns the singular of an English plural, like hotel for
+// hotels and category for categories, or the word itself.
+func Singular(word string) string {
+	switch {
+	case strings.HasSuffix(word, "ies") && len(word) > 3:
+		return strings.TrimSuffix(word, "ies") + "y"
+	case strings.HasSuffix(word, "sses"), strings.HasSuffix(word, "ches"), strings.HasSuffix(word, "shes"), strings.HasSuffix(word, "xes"):
+		return strings.TrimSuffix(word, "es")
+	case strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") && len(word) > 1:
+		return strings.TrimSuffix(word, "s")
+	}
+	return word
+}
+
+// Plural returns the plural of an English noun, like hotels for hotel and
+// categories for category.
+func Plural(word string) string {
+	switch {
+	case strings.HasSuffix(word, "y") && len(word) > 1 && !strings.ContainsRune("aeiou", rune(word[len(word)-2])):
+		return strings.TrimSuffix(word, "y") + "ies"
+	case strings.HasSuffix(word, "s"), strings.HasSuffix(word, "ch"), strings.HasSuffix(word, "sh"), strings.HasSuffix(word, "x"):
+		return word + "es"
+	}
+	return word + "s"
+}
@@ -0,0 +1,66 @@
+// Package vars carries values from one scripted request to the next: it
+// picks fields out of JSON responses and fills them into later requests
+// where they say {{name}}.
+package vars
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Fill replaces each {{name}} in s with the variable's value. Names
+// without a value are left as they are.
+func Fill(s string, vars map[string]string) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	for name, v := range vars {
+		s = strings.ReplaceAll(s, "{{"+name+"}}", v)
+	}
+	return s
+}
+
+// Substitute fills in variables in the strings, keys included, of a JSON
+// value.
+func Substitute(v any, vars map[string]string) any {
+	switch v := v.(type) {
+	case string:
+		return Fill(v, vars)
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[Fill(k, vars)] = Substitute(e, vars)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = Substitute(e, vars)
+		}
+		return out
+	}
+	return v
+}
+
+// Lookup returns the value at a dotted path in a JSON value, such as
+// data.0.id.
+func Lookup(v any, path string) (any, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch e := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = e[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(e) {
+				return nil, false
+			}
+			v = e[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,271 @@
+// Package ledger keeps the synthetic banks' books by double entry. Every
+// movement of money is a Journal whose legs, one per account it touches,
+// sum to zero: a transfer takes from one account what it gives another, and
+// a bill payment takes from an account what it gives the payee, an external
+// account outside the bank. A Ledger is the entries journals post, and an
+// account's balance should always be the sum of its entries; Check finds
+// the accounts whose balances have drifted from their books.
+//
+// Locks are the accounts' locks, taken together in a fixed order, so that a
+// movement holds every account it touches from the check of funds to the
+// change of balances without deadlocking another going the other way.
+package ledger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg/money"
+)
+
+// External prefixes the accounts outside the bank: payees, merchants,
+// other banks, and the opening balances the books started from. They have
+// no balance of their own to check.
+const External = "external:"
+
+// Opening is the external account opening balances came from.
+const Opening = External + "opening"
+
+// IsExternal reports whether account is outside the bank.
+func IsExternal(account string) bool {
+	return strings.HasPrefix(account, External)
+}
+
+// Entry is one leg of a journal as posted to an account.
+type Entry struct {
+	ID        string      `json:"id"`
+	Journal   string      `json:"journal"` // The journal it was posted in
+	Account   string      `json:"account"`
+	Amount    money.Money `json:"amount"` // Positive into the account, negative out of it
+	Memo      string      `json:"memo,omitempty"`
+	Reference string      `json:"reference,omitempty"` // What moved the money, such as a transfer's ID
+	PostedAt  time.Time   `json:"posted_at"`
+}
+
+// Leg is what a journal moves into an account, or out of it when negative.
+type Leg struct {
+	Account string
+	Amount  money.Money
+}
+
+// Journal is a movement of money between accounts.
+type Journal struct {
+	Memo      string
+	Reference string
+	Legs      []Leg
+}
+
+// Transfer is the journal of amount moving from one account to another.
+func Transfer(from, to string, amount money.Money, memo, reference string) Journal {
+	return Journal{
+		Memo:      memo,
+		Reference: reference,
+		Legs:      []Leg{{Account: from, Amount: amount.Neg()}, {Account: to, Amount: amount}},
+	}
+}
+
+// UnbalancedError is a journal whose legs don't sum to zero.
+type UnbalancedError struct {
+	Currency string
+	Sum      money.Money
+}
+
+func (e *UnbalancedError) Error() string {
+	return fmt.Sprintf("journal is out of balance by %s %s", e.Sum.Decimal(), e.Currency)
+}
+
+// Ledger is the entries posted to a bank's accounts, by ID.
+type Ledger map[string]Entry
+
+// Post posts j, as the journal id, at at, and returns its entries. A
+// journal whose legs don't sum to zero in each currency is an
+// *UnbalancedError, and posts nothing. Legs of zero are left out.
+func (l Ledger) Post(id string, j Journal, at time.Time) ([]Entry, error) {
+	sums := make(map[string]money.Money)
+	for _, leg := range j.Legs {
+		code := leg.Amount.Code()
+		sums[code] = money.New(sums[code].Minor+leg.Amount.Minor, code)
+	}
+	for code, sum := range sums {
+		if !sum.IsZero() {
+			return nil, &UnbalancedError{Currency: code, Sum: sum}
+		}
+	}
+	var posted []Entry
+	for i, leg := range j.Legs {
+		if leg.Amount.IsZero() {
+			continue
+		}
+		e := Entry{
+			ID:        fmt.Sprintf("%s-%d", id, i+1),
+			Journal:   id,
+			Account:   leg.Account,
+			Amount:    leg.Amount,
+			Memo:      j.Memo,
+			Reference: j.Reference,
+			PostedAt:  at,
+		}
+		l[e.ID] = e
+		posted = append(posted, e)
+	}
+	return posted, nil
+}
+
+// Has reports whether anything has been posted to account.
+func (l Ledger) Has(account string) bool {
+	for _, e := range l {
+		if e.Account == account {
+			return true
+		}
+	}
+	return false
+}
+
+// Balances returns the sum of each account's entries, or an error if an
+// account has entries of more than one currency.
+func (l Ledger) Balances() (map[string]money.Money, error) {
+	balances := make(map[string]money.Money)
+	for _, e := range l {
+		b, ok := balances[e.Account]
+		if !ok {
+			balances[e.Account] = e.Amount
+			continue
+		}
+		sum, err := b.Add(e.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %w", e.Account, err)
+		}
+		balances[e.Account] = sum
+	}
+	return balances, nil
+}
+
+// Entries returns account's entries, oldest first, or every entry if
+// account is "".
+func (l Ledger) Entries(account string) []Entry {
+	found := []Entry{}
+	for _, e := range l {
+		if account == "" || e.Account == account {
+			found = append(found, e)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].PostedAt.Equal(found[j].PostedAt) {
+			return found[i].PostedAt.Before(found[j].PostedAt)
+		}
+		return found[i].ID < found[j].ID
+	})
+	return found
+}
+
+// Mismatch is an account whose balance isn't the sum of its entries.
+type Mismatch struct {
+	Account    string      `json:"account"`
+	Balance    money.Money `json:"balance"`    // As the account has it
+	Ledger     money.Money `json:"ledger"`     // The sum of its entries
+	Difference money.Money `json:"difference"` // Balance less ledger
+}
+
+// Check compares balances, by account, with l, and returns the accounts
+// they differ for, by account. An account of the bank's with entries but
+// no balance, as when it was removed, is checked as a balance of zero. An
+// account whose entries are of more than one currency is an error.
+func (l Ledger) Check(balances map[string]money.Money) ([]Mismatch, error) {
+	books, err := l.Balances()
+	if err != nil {
+		return nil, err
+	}
+	accounts := make(map[string]bool)
+	for account := range balances {
+		accounts[account] = true
+	}
+	for account := range books {
+		if !IsExternal(account) {
+			accounts[account] = true
+		}
+	}
+	var mismatches []Mismatch
+	for account := range accounts {
+		balance, ok := balances[account]
+		posted, hasBooks := books[account]
+		switch {
+		case !ok:
+			balance = money.New(0, posted.Code())
+		case !hasBooks:
+			posted = money.New(0, balance.Code())
+		}
+		if balance.Code() != posted.Code() || balance.Minor != posted.Minor {
+			mismatches = append(mismatches, Mismatch{
+				Account:    account,
+				Balance:    balance,
+				Ledger:     posted,
+				Difference: money.New(balance.Minor-posted.Minor, balance.Code()),
+			})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Account < mismatches[j].Account })
+	return mismatches, nil
+}
+
+// Locks are per-account locks. Lock takes the accounts a movement touches
+// in sorted order, so that two movements between the same accounts, in
+// either direction, wait on each other rather than deadlock; LockAll takes
+// every account at once, for work over all of them like closing
+// statements. Callers take the accounts' locks before the database's, and
+// never the other way round. The zero value is ready to use.
+type Locks struct {
+	all   sync.RWMutex // Held for reading by Lock, and for writing by LockAll
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// Lock locks accounts, skipping "" and external ones, and returns the
+// function that unlocks them.
+func (l *Locks) Lock(accounts ...string) (unlock func()) {
+	keys := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		if account != "" && !IsExternal(account) {
+			keys = append(keys, account)
+		}
+	}
+	sort.Strings(keys)
+
+	l.all.RLock()
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	var held []*sync.Mutex
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		m, ok := l.locks[key]
+		if !ok {
+			m = new(sync.Mutex)
+			l.locks[key] = m
+		}
+		held = append(held, m)
+	}
+	l.mu.Unlock()
+
+	for _, m := range held {
+		m.Lock()
+	}
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+		}
+		l.all.RUnlock()
+	}
+}
+
+// LockAll waits for every movement in progress to finish, locks every
+// account, and returns the function that unlocks them.
+func (l *Locks) LockAll() (unlock func()) {
+	l.all.Lock()
+	return l.all.Unlock
+}
@@ -0,0 +1,228 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"pkg/money"
+)
+
+var at = time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC)
+
+func TestPost(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal Journal
+		entries int
+		off     string // Currency the journal is out of balance in, if it is
+	}{
+		{
+			name:    "transfer",
+			journal: Transfer("checking", "savings", money.Cents(2500), "Move", "tr_1"),
+			entries: 2,
+		},
+		{
+			name: "split",
+			journal: Journal{Legs: []Leg{
+				{Account: "checking", Amount: money.Cents(-3000)},
+				{Account: "bill_1", Amount: money.Cents(1000)},
+				{Account: "bill_2", Amount: money.Cents(2000)},
+			}},
+			entries: 3,
+		},
+		{
+			name: "zero legs left out",
+			journal: Journal{Legs: []Leg{
+				{Account: "checking", Amount: money.Cents(-100)},
+				{Account: "fees", Amount: money.Cents(0)},
+				{Account: "savings", Amount: money.Cents(100)},
+			}},
+			entries: 2,
+		},
+		{
+			name:    "nothing",
+			journal: Journal{},
+		},
+		{
+			name: "unbalanced",
+			journal: Journal{Legs: []Leg{
+				{Account: "checking", Amount: money.Cents(-100)},
+				{Account: "savings", Amount: money.Cents(99)},
+			}},
+			off: money.USD,
+		},
+		{
+			name: "balanced in each currency",
+			journal: Journal{Legs: []Leg{
+				{Account: "checking", Amount: money.Cents(-100)},
+				{Account: Opening, Amount: money.Cents(100)},
+				{Account: "euros", Amount: money.New(-90, "EUR")},
+				{Account: Opening, Amount: money.New(90, "EUR")},
+			}},
+			entries: 4,
+		},
+		{
+			name: "balanced only across currencies",
+			journal: Journal{Legs: []Leg{
+				{Account: "checking", Amount: money.Cents(-100)},
+				{Account: "euros", Amount: money.New(100, "EUR")},
+			}},
+			off: "EUR",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := make(Ledger)
+			entries, err := l.Post("j_1", tt.journal, at)
+			if tt.off != "" {
+				var unbalanced *UnbalancedError
+				if !errors.As(err, &unbalanced) {
+					t.Fatalf("got %v, want an *UnbalancedError", err)
+				}
+				if len(l) != 0 {
+					t.Errorf("posted %d entries of an unbalanced journal", len(l))
+				}
+				// Either currency may be found out first.
+				if unbalanced.Currency != money.USD && unbalanced.Currency != tt.off {
+					t.Errorf("out of balance in %s, want %s", unbalanced.Currency, tt.off)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.entries || len(l) != tt.entries {
+				t.Fatalf("posted %d entries, and the ledger has %d, want %d", len(entries), len(l), tt.entries)
+			}
+			for _, e := range entries {
+				if e.Journal != "j_1" || !e.PostedAt.Equal(at) || e.Amount.IsZero() {
+					t.Errorf("posted %+v", e)
+				}
+			}
+		})
+	}
+}
+
+func TestBalancesAndCheck(t *testing.T) {
+	l := make(Ledger)
+	journals := []Journal{
+		Transfer(Opening, "checking", money.Cents(10000), "Opening balance", ""),
+		Transfer(Opening, "savings", money.Cents(50000), "Opening balance", ""),
+		Transfer("checking", "savings", money.Cents(2500), "Move", "tr_1"),
+		Transfer("checking", External+"payee", money.Cents(1999), "Bill", "bill_1"),
+	}
+	for i, j := range journals {
+		if _, err := l.Post(string(rune('a'+i)), j, at.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	balances, err := l.Balances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, b := range balances {
+		total += b.Minor
+	}
+	if total != 0 {
+		t.Errorf("balances sum to %d, want 0 as every journal balances", total)
+	}
+	if got := balances["checking"].Minor; got != 10000-2500-1999 {
+		t.Errorf("checking has %d, want %d", got, 10000-2500-1999)
+	}
+	if entries := l.Entries("checking"); len(entries) != 3 || entries[0].Memo != "Opening balance" || entries[2].Reference != "bill_1" {
+		t.Errorf("checking's entries are %+v, want its three oldest first", entries)
+	}
+
+	tests := []struct {
+		name     string
+		balances map[string]money.Money
+		want     []string // Mismatched accounts
+	}{
+		{
+			name:     "agree",
+			balances: map[string]money.Money{"checking": money.Cents(5501), "savings": money.Cents(52500)},
+		},
+		{
+			name:     "off",
+			balances: map[string]money.Money{"checking": money.Cents(5500), "savings": money.Cents(52500)},
+			want:     []string{"checking"},
+		},
+		{
+			name:     "account removed",
+			balances: map[string]money.Money{"checking": money.Cents(5501)},
+			want:     []string{"savings"},
+		},
+		{
+			name:     "account never posted to",
+			balances: map[string]money.Money{"checking": money.Cents(5501), "savings": money.Cents(52500), "new": money.Cents(1)},
+			want:     []string{"new"},
+		},
+		{
+			name:     "other currency",
+			balances: map[string]money.Money{"checking": money.New(5501, "EUR"), "savings": money.Cents(52500)},
+			want:     []string{"checking"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatches, err := l.Check(tt.balances)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range mismatches {
+				got = append(got, m.Account)
+			}
+			if len(got) != len(tt.want) || len(got) > 0 && got[0] != tt.want[0] {
+				t.Errorf("mismatched %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBalancesOfMixedCurrencies(t *testing.T) {
+	l := Ledger{
+		"a-1": {Account: "checking", Amount: money.Cents(100)},
+		"b-1": {Account: "checking", Amount: money.New(100, "EUR")},
+	}
+	if _, err := l.Balances(); !errors.Is(err, money.ErrMixedCurrencies) {
+		t.Errorf("got %v, want ErrMixedCurrencies", err)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	var l Locks
+	unlock := l.Lock("b", "a", External+"payee", "")
+	done := make(chan bool)
+	go func() {
+		// The other way round, it waits rather than deadlocks.
+		unlock := l.Lock("a", "b")
+		unlock()
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("took accounts that were locked")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-done
+
+	// LockAll waits for movements in progress, even between external
+	// accounts only.
+	unlock = l.Lock(External + "payee")
+	go func() {
+		all := l.LockAll()
+		all()
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("locked every account during a movement")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-done
+}
@@ -0,0 +1,147 @@
+// Package messaging keeps the conversations the synthetic servers' users
+// have with the people serving them: a family and the caregiver applying
+// to their job, a diner and the courier bringing their order, a passenger
+// and their driver. A conversation is about something, named by its kind
+// and ID, and has participants, each of whom has read it through some
+// message; the messages after that, from others, are unread. Participants
+// are users, known by their email, or people the server plays, such as a
+// driver, known by their ID. A closed conversation can be read but takes
+// no more messages.
+package messaging
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// About is what a conversation is about.
+type About struct {
+	Kind string `json:"kind"` // Such as "ride" or "application"
+	ID   string `json:"id"`
+}
+
+// Participant is someone in a conversation.
+type Participant struct {
+	ID   string `json:"id"`   // A user's email, or the ID of someone the server plays, such as a driver
+	Role string `json:"role"` // Such as "passenger" or "driver"
+	Name string `json:"name,omitempty"`
+	// ReadThrough is the Seq of the last message they have read, and
+	// Unread how many of those after it are from others.
+	ReadThrough int `json:"read_through"`
+	Unread      int `json:"unread"`
+}
+
+// Conversation is the messages between its participants about something.
+type Conversation struct {
+	ID           string        `json:"id"`
+	About        About         `json:"about"`
+	Participants []Participant `json:"participants"`
+	Messages     int           `json:"messages"` // How many there are, and the Seq of the last
+	LastMessage  *Message      `json:"last_message,omitempty"`
+	Closed       bool          `json:"closed,omitempty"`
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+}
+
+// Message is one participant's say in a conversation.
+type Message struct {
+	ID             string    `json:"id"`
+	ConversationID string    `json:"conversation_id"`
+	Seq            int       `json:"seq"`  // Its place in the conversation, from 1
+	From           string    `json:"from"` // The participant's ID
+	Role           string    `json:"role"` // The participant's role
+	Body           string    `json:"body"`
+	SentAt         time.Time `json:"sent_at"`
+}
+
+// MaxBody is the longest a message may be, in characters.
+const MaxBody = 2000
+
+// Errors Send and Read return.
+var (
+	ErrNotFound       = errors.New("conversation not found")
+	ErrNotParticipant = errors.New("you are not in this conversation")
+	ErrClosed         = errors.New("this conversation is closed")
+)
+
+// Member returns the index in c.Participants of the participant id, or -1.
+// Users' emails match in any case.
+func (c Conversation) Member(id string) int {
+	for i, p := range c.Participants {
+		if strings.EqualFold(p.ID, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Unread returns how many messages from others the participant id hasn't
+// read, or 0 if they aren't in c.
+func (c Conversation) Unread(id string) int {
+	if i := c.Member(id); i >= 0 {
+		return c.Participants[i].Unread
+	}
+	return 0
+}
+
+// Send adds a message from the participant from to c, counting it unread
+// by the others, and returns it without an ID. A participant has read what
+// they reply to.
+func (c *Conversation) Send(from, body string, now time.Time) (Message, error) {
+	i := c.Member(from)
+	switch {
+	case i < 0:
+		return Message{}, ErrNotParticipant
+	case c.Closed:
+		return Message{}, ErrClosed
+	}
+	c.Messages++
+	m := Message{
+		ConversationID: c.ID,
+		Seq:            c.Messages,
+		From:           c.Participants[i].ID,
+		Role:           c.Participants[i].Role,
+		Body:           body,
+		SentAt:         now,
+	}
+	for j := range c.Participants {
+		if j == i {
+			c.Participants[j].ReadThrough, c.Participants[j].Unread = m.Seq, 0
+		} else {
+			c.Participants[j].Unread++
+		}
+	}
+	c.UpdatedAt = now
+	return m, nil
+}
+
+// Read marks c read by the participant id through its last message.
+func (c *Conversation) Read(id string) error {
+	i := c.Member(id)
+	if i < 0 {
+		return ErrNotParticipant
+	}
+	c.Participants[i].ReadThrough, c.Participants[i].Unread = c.Messages, 0
+	return nil
+}
+
+// Newest sorts conversations by their last message, or their start if they
+// have none, newest first.
+func Newest(conversations []Conversation) {
+	sort.Slice(conversations, func(i, j int) bool {
+		a, b := conversations[i], conversations[j]
+		if !a.UpdatedAt.Equal(b.UpdatedAt) {
+			return a.UpdatedAt.After(b.UpdatedAt)
+		}
+		return a.ID < b.ID
+	})
+}
+
+// InOrder sorts a conversation's messages oldest first.
+func InOrder(messages []Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Seq < messages[j].Seq
+	})
+}
@@ -0,0 +1,99 @@
+package money
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// rates are the seeded exchange rates: units of each currency a US dollar
+// buys. They are fixed, so that prices in a currency are the same from one
+// run to the next.
+var rates = map[string]float64{
+	"USD": 1,
+	"EUR": 0.92,
+	"GBP": 0.79,
+	"CAD": 1.36,
+	"AUD": 1.52,
+	"JPY": 151.5,
+	"CNY": 7.24,
+	"INR": 83.3,
+	"KRW": 1350,
+	"MXN": 17.1,
+	"BRL": 5.05,
+	"CHF": 0.9,
+}
+
+// Currencies returns the codes of the currencies amounts can be converted
+// to, in order.
+func Currencies() []string {
+	codes := make([]string, 0, len(rates))
+	for code := range rates {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Known reports whether amounts can be converted to currency.
+func Known(currency string) bool {
+	_, ok := rates[strings.ToUpper(currency)]
+	return ok
+}
+
+// Rate returns how many units of to a unit of from buys.
+func Rate(from, to string) (float64, error) {
+	f, ok := rates[strings.ToUpper(from)]
+	if !ok {
+		return 0, fmt.Errorf("money: unknown currency %q", from)
+	}
+	t, ok := rates[strings.ToUpper(to)]
+	if !ok {
+		return 0, fmt.Errorf("money: unknown currency %q", to)
+	}
+	return t / f, nil
+}
+
+// Convert returns m in currency at the seeded rate, rounded to the
+// currency's minor unit, halves away from zero, or an error if either
+// currency isn't Known or the result is ErrOutOfRange.
+func Convert(m Money, currency string) (Money, error) {
+	rate, err := Rate(m.Code(), currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return FromFloat(m.Float()*rate, currency)
+}
+
+// regionCurrencies are the currencies of the regions of locales, such as
+// the GB of en-GB.
+var regionCurrencies = map[string]string{
+	"US": "USD", "GB": "GBP", "CA": "CAD", "AU": "AUD", "JP": "JPY",
+	"CN": "CNY", "IN": "INR", "KR": "KRW", "MX": "MXN", "BR": "BRL",
+	"CH": "CHF", "LI": "CHF",
+	"AT": "EUR", "BE": "EUR", "DE": "EUR", "ES": "EUR", "FI": "EUR",
+	"FR": "EUR", "GR": "EUR", "IE": "EUR", "IT": "EUR", "LU": "EUR",
+	"NL": "EUR", "PT": "EUR",
+}
+
+// languageCurrencies are the currencies of locales that name only a
+// language, for the languages spoken mostly where one currency is used.
+var languageCurrencies = map[string]string{
+	"en": "USD", "de": "EUR", "fr": "EUR", "it": "EUR", "nl": "EUR",
+	"fi": "EUR", "el": "EUR", "ja": "JPY", "ko": "KRW", "zh": "CNY",
+	"hi": "INR",
+}
+
+// ForLocale returns the currency of a locale, such as EUR for de-DE, GBP
+// for en-GB or JPY for ja, or "" if it can't tell.
+func ForLocale(tag string) string {
+	parts := strings.Split(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"), "-")
+	for _, part := range parts[1:] {
+		if len(part) == 2 {
+			// A region this doesn't know, such as the TW of zh-TW, isn't
+			// answered for by its language.
+			return regionCurrencies[strings.ToUpper(part)]
+		}
+	}
+	return languageCurrencies[strings.ToLower(parts[0])]
+}
@@ -0,0 +1,377 @@
+// Package money keeps amounts of money exactly, as whole minor units of a
+// currency such as cents, so that carts, balances and fares add up without
+// the rounding errors of float64, like 107.91000000000001. It converts
+// prices between currencies at a fixed table of rates.
+package money
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// USD is the currency of an amount that doesn't name one.
+const USD = "USD"
+
+// decimals are the digits after the point in the currencies' amounts, for
+// those that don't have two.
+var decimals = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+	"BHD": 3,
+	"KWD": 3,
+}
+
+// Decimals returns the number of digits after the point in amounts of a
+// currency: 2 for most, such as USD, 0 for JPY.
+func Decimals(currency string) int {
+	if d, ok := decimals[strings.ToUpper(currency)]; ok {
+		return d
+	}
+	return 2
+}
+
+// Money is an amount of a currency, in its minor units. The zero Money is
+// no US dollars.
+//
+// It is written to JSON as a decimal number with the currency's digits at
+// most, such as 107.91, as a float64 amount was, so fields can hold it in
+// place of one. The currency isn't written: entities that have one say so
+// in a field of their own.
+type Money struct {
+	Minor    int64  // In minor units, such as cents
+	Currency string // An ISO 4217 code; "" is USD
+}
+
+// New returns an amount of minor units of currency.
+func New(minor int64, currency string) Money {
+	return Money{Minor: minor, Currency: strings.ToUpper(currency)}
+}
+
+// Cents returns an amount of US cents.
+func Cents(cents int64) Money {
+	return Money{Minor: cents}
+}
+
+// Dollars returns an amount of US dollars, rounded to the cent. It is for
+// amounts, such as configured fees, that come as float64, and panics if
+// one is beyond what a Money holds, as FromFloat would refuse it.
+func Dollars(dollars float64) Money {
+	m, err := FromFloat(dollars, USD)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// ErrOutOfRange is the error of an amount too large, in either direction,
+// for a Money to hold, or not a number at all.
+var ErrOutOfRange = errors.New("money: amount out of range")
+
+// FromFloat returns amount of currency rounded to its minor unit, halves
+// away from zero, or ErrOutOfRange if that is more minor units than an
+// int64 holds.
+func FromFloat(amount float64, currency string) (Money, error) {
+	minor := math.Round(amount * scale(currency))
+	// -2^63 is the least int64 and 2^63 one more than the greatest, both
+	// exact as float64s.
+	if math.IsNaN(minor) || minor < math.MinInt64 || minor >= math.MaxInt64 {
+		return Money{}, fmt.Errorf("%w: %v %s", ErrOutOfRange, amount, strings.ToUpper(currency))
+	}
+	return New(int64(minor), currency), nil
+}
+
+// Parse reads an amount of currency written as a decimal, such as 107.91,
+// rounding it to the currency's minor unit, halves away from zero. An
+// amount too large for a Money, such as 1e30, is ErrOutOfRange.
+func Parse(s, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	digits := Decimals(currency)
+	sign := int64(1)
+	rest := s
+	if r, ok := strings.CutPrefix(rest, "-"); ok {
+		sign, rest = -1, r
+	} else {
+		rest = strings.TrimPrefix(rest, "+")
+	}
+	whole, frac, _ := strings.Cut(rest, ".")
+	if (whole == "" && frac == "") || !isDigits(whole) || !isDigits(frac) {
+		// Exponents and the like, which amounts are rarely written with.
+		f, err := strconv.ParseFloat(s, 64)
+		var numErr *strconv.NumError
+		switch {
+		case errors.As(err, &numErr) && errors.Is(numErr.Err, strconv.ErrRange), math.IsInf(f, 0):
+			return Money{}, fmt.Errorf("%w: %q", ErrOutOfRange, s)
+		case err != nil || math.IsNaN(f):
+			return Money{}, fmt.Errorf("money: %q is not an amount", s)
+		}
+		m, err := FromFloat(f, currency)
+		if err != nil {
+			return Money{}, fmt.Errorf("%w: %q", ErrOutOfRange, s)
+		}
+		return m, nil
+	}
+
+	roundUp := false
+	if len(frac) > digits {
+		roundUp = frac[digits] >= '5'
+		frac = frac[:digits]
+	}
+	frac += strings.Repeat("0", digits-len(frac))
+	minor, err := strconv.ParseInt("0"+whole+frac, 10, 64)
+	if err == nil && roundUp {
+		if minor == math.MaxInt64 {
+			err = strconv.ErrRange
+		}
+		minor++
+	}
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %q", ErrOutOfRange, s)
+	}
+	return New(sign*minor, currency), nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// scale is the number of minor units in a unit of currency.
+func scale(currency string) float64 {
+	return math.Pow10(Decimals(currency))
+}
+
+// Code returns m's currency, USD if it doesn't name one.
+func (m Money) Code() string {
+	if m.Currency == "" {
+		return USD
+	}
+	return m.Currency
+}
+
+// In returns m as an amount of currency, which it must already be in: it
+// labels amounts, such as an account's balance, whose currency is kept
+// apart from them.
+func (m Money) In(currency string) Money {
+	return New(m.Minor, currency)
+}
+
+// ErrMixedCurrencies is the error of adding, subtracting or comparing
+// amounts of different currencies, which would need a conversion first.
+var ErrMixedCurrencies = errors.New("money: amounts of different currencies mixed")
+
+func (m Money) same(n Money) error {
+	if m.Code() != n.Code() {
+		return fmt.Errorf("%w: %s and %s", ErrMixedCurrencies, m.Code(), n.Code())
+	}
+	return nil
+}
+
+// Add returns m+n, or ErrMixedCurrencies if they aren't of the same
+// currency.
+func (m Money) Add(n Money) (Money, error) {
+	if err := m.same(n); err != nil {
+		return Money{}, err
+	}
+	m.Minor += n.Minor
+	return m, nil
+}
+
+// Sub returns m-n, or ErrMixedCurrencies if they aren't of the same
+// currency.
+func (m Money) Sub(n Money) (Money, error) {
+	if err := m.same(n); err != nil {
+		return Money{}, err
+	}
+	m.Minor -= n.Minor
+	return m, nil
+}
+
+// Times returns m n times over, such as a price times a quantity.
+func (m Money) Times(n int) Money {
+	m.Minor *= int64(n)
+	return m
+}
+
+// Mul returns m multiplied by a rate, such as a tax rate, rounded to the
+// minor unit, halves away from zero.
+func (m Money) Mul(rate float64) Money {
+	m.Minor = int64(math.Round(float64(m.Minor) * rate))
+	return m
+}
+
+// Neg returns -m.
+func (m Money) Neg() Money {
+	m.Minor = -m.Minor
+	return m
+}
+
+// Cmp compares m and n: -1 if m is less, 0 if they are equal and +1 if m
+// is more. Amounts of different currencies don't compare, and are
+// ErrMixedCurrencies.
+func (m Money) Cmp(n Money) (int, error) {
+	if err := m.same(n); err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Minor < n.Minor:
+		return -1, nil
+	case m.Minor > n.Minor:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Less reports whether m is less than n, or ErrMixedCurrencies if they
+// aren't of the same currency.
+func (m Money) Less(n Money) (bool, error) {
+	cmp, err := m.Cmp(n)
+	return cmp < 0, err
+}
+
+// IsZero reports whether m is nothing, of any currency.
+func (m Money) IsZero() bool { return m.Minor == 0 }
+
+// IsNegative reports whether m is less than nothing.
+func (m Money) IsNegative() bool { return m.Minor < 0 }
+
+// IsPositive reports whether m is more than nothing.
+func (m Money) IsPositive() bool { return m.Minor > 0 }
+
+// Float returns m in units of its currency, such as dollars, for
+// comparing it with float64 amounts and rates.
+func (m Money) Float() float64 {
+	return float64(m.Minor) / scale(m.Code())
+}
+
+// Min returns the lesser of m and n, or ErrMixedCurrencies if they aren't
+// of the same currency.
+func Min(m, n Money) (Money, error) {
+	less, err := n.Less(m)
+	if err != nil {
+		return Money{}, err
+	}
+	if less {
+		return n, nil
+	}
+	return m, nil
+}
+
+// Max returns the greater of m and n, or ErrMixedCurrencies if they aren't
+// of the same currency.
+func Max(m, n Money) (Money, error) {
+	less, err := m.Less(n)
+	if err != nil {
+		return Money{}, err
+	}
+	if less {
+		return n, nil
+	}
+	return m, nil
+}
+
+// Sum returns the total of amounts in currency, or ErrMixedCurrencies if
+// any of them is of another.
+func Sum(currency string, amounts ...Money) (Money, error) {
+	total := New(0, currency)
+	for _, a := range amounts {
+		var err error
+		if total, err = total.Add(a); err != nil {
+			return Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// parts splits m into its sign, "-" or "", and the digits of its magnitude
+// before and after the point, all of the currency's.
+func (m Money) parts() (sign, whole, frac string) {
+	digits := Decimals(m.Code())
+	magnitude := uint64(m.Minor)
+	if m.Minor < 0 {
+		sign, magnitude = "-", -magnitude
+	}
+	s := strconv.FormatUint(magnitude, 10)
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits-len(s)+1) + s
+	}
+	return sign, s[:len(s)-digits], s[len(s)-digits:]
+}
+
+// Decimal writes m as a decimal with no more digits than it needs, such as
+// 107.91, 19.9 or 20.
+func (m Money) Decimal() string {
+	sign, whole, frac := m.parts()
+	if frac = strings.TrimRight(frac, "0"); frac == "" {
+		return sign + whole
+	}
+	return sign + whole + "." + frac
+}
+
+// fixed writes m's magnitude with all its currency's digits, such as 19.90.
+func (m Money) fixed() string {
+	_, whole, frac := m.parts()
+	if frac == "" {
+		return whole
+	}
+	return whole + "." + frac
+}
+
+// String writes m with all its currency's digits and its code, such as
+// 19.90 USD.
+func (m Money) String() string {
+	sign, _, _ := m.parts()
+	return sign + m.fixed() + " " + m.Code()
+}
+
+// Format writes m for people, such as $19.90, or 1500 KRW in currencies
+// without a sign here.
+func (m Money) Format() string {
+	sign, _, _ := m.parts()
+	if symbol, ok := symbols[m.Code()]; ok {
+		return sign + symbol + m.fixed()
+	}
+	return sign + m.fixed() + " " + m.Code()
+}
+
+// symbols are the signs amounts of currencies are written with.
+var symbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+}
+
+// MarshalJSON writes m as a decimal number, such as 107.91.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.Decimal()), nil
+}
+
+// UnmarshalJSON reads an amount written as a number or a string holding
+// one, such as 107.91 or "107.91". It keeps m's currency, and so reads
+// amounts of US dollars into the zero Money.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	} else if len(data) > 0 && data[0] == '"' {
+		return errors.New("money: bad string")
+	}
+	parsed, err := Parse(s, m.Code())
+	if err != nil {
+		return err
+	}
+	m.Minor = parsed.Minor
+	return nil
+}
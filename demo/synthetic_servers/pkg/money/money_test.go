@@ -0,0 +1,207 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		want     int64
+		err      error // Wrapped by the error, if one is wanted
+		bad      bool  // Not an amount at all
+	}{
+		{in: "107.91", want: 10791},
+		{in: "19.9", want: 1990},
+		{in: "20", want: 2000},
+		{in: ".5", want: 50},
+		{in: "-3.25", want: -325},
+		{in: "+3.25", want: 325},
+		{in: " 4.00 ", want: 400},
+		{in: "0.005", want: 1},
+		{in: "0.0049", want: 0},
+		{in: "-0.005", want: -1},
+		{in: "1500", currency: "JPY", want: 1500},
+		{in: "1500.5", currency: "JPY", want: 1501},
+		{in: "1.2345", currency: "KWD", want: 1235},
+		{in: "1e2", want: 10000},
+		{in: "2.5E-1", want: 25},
+		{in: "92233720368547758.07", want: math.MaxInt64},
+		{in: "-92233720368547758.07", want: -math.MaxInt64},
+		{in: "92233720368547758.075", err: ErrOutOfRange},
+		{in: "92233720368547758.08", err: ErrOutOfRange},
+		{in: "99999999999999999999", err: ErrOutOfRange},
+		{in: "1e17", err: ErrOutOfRange},
+		{in: "-1e17", err: ErrOutOfRange},
+		{in: "1e30", err: ErrOutOfRange},
+		{in: "1e400", err: ErrOutOfRange},
+		{in: "1e17", currency: "JPY", want: 1e17},
+		{in: "", bad: true},
+		{in: ".", bad: true},
+		{in: "abc", bad: true},
+		{in: "1.2.3", bad: true},
+		{in: "NaN", bad: true},
+		{in: "Inf", err: ErrOutOfRange},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in, tt.currency)
+		switch {
+		case tt.err != nil || tt.bad:
+			if err == nil {
+				t.Errorf("Parse(%q, %q) = %v, want an error", tt.in, tt.currency, got)
+			} else if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("Parse(%q, %q): %v, want %v", tt.in, tt.currency, err, tt.err)
+			} else if tt.bad && errors.Is(err, ErrOutOfRange) {
+				t.Errorf("Parse(%q, %q): %v, want it not an amount", tt.in, tt.currency, err)
+			}
+		case err != nil:
+			t.Errorf("Parse(%q, %q): %v", tt.in, tt.currency, err)
+		case got.Minor != tt.want:
+			t.Errorf("Parse(%q, %q) = %d minor units, want %d", tt.in, tt.currency, got.Minor, tt.want)
+		}
+	}
+}
+
+func TestFromFloat(t *testing.T) {
+	tests := []struct {
+		in       float64
+		currency string
+		want     int64
+		err      bool
+	}{
+		{in: 107.91, want: 10791},
+		{in: 0.1 + 0.2, want: 30},
+		{in: 2.675, want: 268},
+		{in: -2.675, want: -268},
+		{in: 1.005, want: 100}, // 1.00499999999999989... as a float64
+		{in: 1234.5, currency: "JPY", want: 1235},
+		{in: 9e16, want: 9e18},
+		{in: 1e17, err: true},
+		{in: -1e17, err: true},
+		{in: 1e30, err: true},
+		{in: math.Inf(1), err: true},
+		{in: math.NaN(), err: true},
+	}
+	for _, tt := range tests {
+		got, err := FromFloat(tt.in, tt.currency)
+		switch {
+		case tt.err:
+			if !errors.Is(err, ErrOutOfRange) {
+				t.Errorf("FromFloat(%v, %q) = %v, %v, want ErrOutOfRange", tt.in, tt.currency, got, err)
+			}
+		case err != nil:
+			t.Errorf("FromFloat(%v, %q): %v", tt.in, tt.currency, err)
+		case got.Minor != tt.want:
+			t.Errorf("FromFloat(%v, %q) = %d minor units, want %d", tt.in, tt.currency, got.Minor, tt.want)
+		}
+	}
+}
+
+func TestDollarsPanicsOutOfRange(t *testing.T) {
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("recovered %v, want ErrOutOfRange", err)
+		}
+	}()
+	Dollars(1e30)
+}
+
+func TestMul(t *testing.T) {
+	tests := []struct {
+		minor int64
+		rate  float64
+		want  int64
+	}{
+		{minor: 1000, rate: 0.0825, want: 83}, // 82.5 rounds away from zero
+		{minor: -1000, rate: 0.0825, want: -83},
+		{minor: 1999, rate: 0.5, want: 1000},
+		{minor: 1999, rate: 0, want: 0},
+		{minor: 333, rate: 3, want: 999},
+	}
+	for _, tt := range tests {
+		if got := Cents(tt.minor).Mul(tt.rate); got.Minor != tt.want {
+			t.Errorf("Cents(%d).Mul(%v) = %d, want %d", tt.minor, tt.rate, got.Minor, tt.want)
+		}
+	}
+}
+
+func TestMixedCurrencies(t *testing.T) {
+	usd, eur := Cents(500), New(500, "eur")
+	ops := map[string]func() error{
+		"Add": func() error { _, err := usd.Add(eur); return err },
+		"Sub": func() error { _, err := usd.Sub(eur); return err },
+		"Cmp": func() error { _, err := usd.Cmp(eur); return err },
+		"Min": func() error { _, err := Min(usd, eur); return err },
+		"Max": func() error { _, err := Max(usd, eur); return err },
+		"Sum": func() error { _, err := Sum(USD, usd, eur); return err },
+	}
+	for name, op := range ops {
+		if err := op(); !errors.Is(err, ErrMixedCurrencies) {
+			t.Errorf("%s of USD and EUR: %v, want ErrMixedCurrencies", name, err)
+		}
+	}
+	if sum, err := usd.Add(New(1, "usd")); err != nil || sum.Minor != 501 {
+		t.Errorf("USD and usd added to %v, %v, want 5.01 USD", sum, err)
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	tests := []struct {
+		m                       Money
+		decimal, str, formatted string
+	}{
+		{m: Cents(10791), decimal: "107.91", str: "107.91 USD", formatted: "$107.91"},
+		{m: Cents(1990), decimal: "19.9", str: "19.90 USD", formatted: "$19.90"},
+		{m: Cents(-5), decimal: "-0.05", str: "-0.05 USD", formatted: "-$0.05"},
+		{m: New(1500, "JPY"), decimal: "1500", str: "1500 JPY", formatted: "¥1500"},
+		{m: New(1500, "KRW"), decimal: "1500", str: "1500 KRW", formatted: "1500 KRW"},
+		{m: New(1235, "KWD"), decimal: "1.235", str: "1.235 KWD", formatted: "1.235 KWD"},
+		{m: Cents(math.MinInt64), decimal: "-92233720368547758.08", str: "-92233720368547758.08 USD", formatted: "-$92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Decimal(); got != tt.decimal {
+			t.Errorf("Decimal() = %q, want %q", got, tt.decimal)
+		}
+		if got := tt.m.String(); got != tt.str {
+			t.Errorf("String() = %q, want %q", got, tt.str)
+		}
+		if got := tt.m.Format(); got != tt.formatted {
+			t.Errorf("Format() = %q, want %q", got, tt.formatted)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Price Money `json:"price"`
+	}
+	for _, in := range []string{`{"price": 107.91}`, `{"price": "107.91"}`} {
+		if err := json.Unmarshal([]byte(in), &v); err != nil || v.Price.Minor != 10791 {
+			t.Errorf("unmarshalling %s: %v, %v, want 107.91", in, v.Price, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"price": 1e30}`), &v); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("unmarshalling 1e30: %v, want ErrOutOfRange", err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil || string(data) != `{"price":107.91}` {
+		t.Errorf("marshalled to %s, %v", data, err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	if _, err := Convert(Cents(100), "XXX"); err == nil {
+		t.Error("converted to an unknown currency")
+	}
+	if _, err := Convert(Cents(math.MaxInt64), "JPY"); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("converting the most dollars to yen: %v, want ErrOutOfRange", err)
+	}
+	same, err := Convert(Cents(12345), USD)
+	if err != nil || same.Minor != 12345 {
+		t.Errorf("converting dollars to dollars: %v, %v", same, err)
+	}
+}
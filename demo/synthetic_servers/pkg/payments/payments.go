@@ -0,0 +1,303 @@
+// Package payments simulates a card processor for the synthetic servers. It
+// authorizes charges to the cards users keep on file, captures, voids and
+// refunds them, and declines those a real processor would, such as charges
+// to expired cards. Declines are reproducible: test cards always decline
+// the same way, and harnesses script others with scenarios, so that agents'
+// handling of a declined payment can be tested.
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg/money"
+)
+
+// Card is a payment card on file, as the servers keep them: the last four
+// digits of its number and when it expires.
+type Card struct {
+	Last4    string
+	ExpiryMM int // 1 to 12
+	ExpiryYY int // The year, such as 29 for 2029; cards without one don't expire
+}
+
+// Expired reports whether c has expired by now. Cards are good through the
+// end of their expiry month.
+func (c Card) Expired(now time.Time) bool {
+	if c.ExpiryYY == 0 {
+		return false
+	}
+	year, month := c.ExpiryYY, c.ExpiryMM
+	if year < 100 {
+		year += 2000
+	}
+	if month < 1 || month > 12 {
+		month = 12
+	}
+	return !now.Before(time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// Why charges are declined, as processors name it.
+const (
+	DeclineGeneric           = "card_declined"
+	DeclineInsufficientFunds = "insufficient_funds"
+	DeclineExpiredCard       = "expired_card"
+	DeclineLostCard          = "lost_card"
+	DeclineProcessingError   = "processing_error"
+)
+
+// declineMessages are what the cardholder is told of each decline.
+var declineMessages = map[string]string{
+	DeclineGeneric:           "Your card was declined",
+	DeclineInsufficientFunds: "Your card has insufficient funds",
+	DeclineExpiredCard:       "Your card has expired",
+	DeclineLostCard:          "Your card was declined",
+	DeclineProcessingError:   "An error occurred while processing your card; try again",
+}
+
+// DeclineCodes returns the decline codes, in order.
+func DeclineCodes() []string {
+	codes := make([]string, 0, len(declineMessages))
+	for code := range declineMessages {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Decline is the error of a declined charge.
+type Decline struct {
+	Code    string // Such as insufficient_funds
+	Message string
+}
+
+func (d *Decline) Error() string { return d.Message }
+
+// NewDecline returns the decline of code, with its message.
+func NewDecline(code string) *Decline {
+	msg, ok := declineMessages[code]
+	if !ok {
+		msg = declineMessages[DeclineGeneric]
+	}
+	return &Decline{Code: code, Message: msg}
+}
+
+// TestCards are the cards that always decline, by the last four digits of
+// their numbers, after the card networks' own test numbers.
+var TestCards = map[string]string{
+	"0002": DeclineGeneric,
+	"9995": DeclineInsufficientFunds,
+	"0069": DeclineExpiredCard,
+	"9987": DeclineLostCard,
+	"0119": DeclineProcessingError,
+}
+
+// Scenario declines the charges it matches with Code: those to the card
+// ending in Last4, if set, for more than Over, if set. It declines Count of
+// them, or every one if Count is 0.
+type Scenario struct {
+	Last4    string       `json:"last4,omitempty"`
+	Over     *money.Money `json:"over,omitempty"`
+	Code     string       `json:"code"`
+	Count    int          `json:"count,omitempty"`
+	Declined int          `json:"declined"` // How many it has declined
+}
+
+func (s *Scenario) matches(card Card, amount money.Money) bool {
+	if s.Last4 != "" && s.Last4 != card.Last4 {
+		return false
+	}
+	if s.Over == nil {
+		return true
+	}
+	cmp, err := amount.Cmp(*s.Over)
+	return err == nil && cmp > 0
+}
+
+// Processor decides which charges go through. The zero Processor declines
+// charges to expired cards and test cards; scenarios decline others.
+type Processor struct {
+	mu        sync.Mutex
+	scenarios []*Scenario
+}
+
+// Check returns the decline a charge of amount to card meets at now, or
+// nil if it goes through, counting it against the scenario that declines
+// it.
+func (p *Processor) Check(card Card, amount money.Money, now time.Time) *Decline {
+	if card.Expired(now) {
+		return NewDecline(DeclineExpiredCard)
+	}
+	if code, ok := TestCards[card.Last4]; ok {
+		return NewDecline(code)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, s := range p.scenarios {
+		if !s.matches(card, amount) {
+			continue
+		}
+		s.Declined++
+		if s.Count > 0 && s.Declined >= s.Count {
+			p.scenarios = slices.Delete(p.scenarios, i, i+1)
+		}
+		return NewDecline(s.Code)
+	}
+	return nil
+}
+
+// SetScenarios replaces the scenarios, checked in order, after checking
+// that they decline with codes processors use.
+func (p *Processor) SetScenarios(scenarios []Scenario) error {
+	list := make([]*Scenario, len(scenarios))
+	for i, s := range scenarios {
+		if _, ok := declineMessages[s.Code]; !ok {
+			return fmt.Errorf("scenarios[%d].code must be one of %s", i, strings.Join(DeclineCodes(), ", "))
+		}
+		if s.Count < 0 {
+			return fmt.Errorf("scenarios[%d].count must not be negative", i)
+		}
+		s.Declined = 0
+		list[i] = &s
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scenarios = list
+	return nil
+}
+
+// Reset drops the scenarios.
+func (p *Processor) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scenarios = nil
+}
+
+// Scenarios returns the scenarios still in effect.
+func (p *Processor) Scenarios() []Scenario {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	scenarios := make([]Scenario, len(p.scenarios))
+	for i, s := range p.scenarios {
+		scenarios[i] = *s
+	}
+	return scenarios
+}
+
+// Status is where a charge is between authorization and refund.
+type Status string
+
+const (
+	StatusAuthorized        Status = "authorized" // Held on the card, not yet taken
+	StatusCaptured          Status = "captured"
+	StatusPartiallyRefunded Status = "partially_refunded"
+	StatusRefunded          Status = "refunded"
+	StatusVoided            Status = "voided" // Released before it was captured
+	StatusDeclined          Status = "declined"
+)
+
+// Charge is a charge to a card, from its authorization on.
+type Charge struct {
+	ID              string      `json:"id"`
+	UserEmail       string      `json:"user_email"`
+	PaymentMethodID string      `json:"payment_method_id,omitempty"`
+	Last4           string      `json:"last4"`
+	Description     string      `json:"description,omitempty"` // What it pays for, such as "Order 1f0c…"
+	Amount          money.Money `json:"amount"`                // Authorized
+	AmountCaptured  money.Money `json:"amount_captured"`
+	AmountRefunded  money.Money `json:"amount_refunded"`
+	Currency        string      `json:"currency,omitempty"`
+	Status          Status      `json:"status"`
+	DeclineCode     string      `json:"decline_code,omitempty"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+}
+
+// Errors of charges that can't move on as asked.
+var (
+	ErrNotAuthorized = errors.New("charge isn't authorized")
+	ErrNotCaptured   = errors.New("charge hasn't been captured")
+	ErrOverCapture   = errors.New("can't capture more than was authorized")
+	ErrOverRefund    = errors.New("can't refund more than was captured")
+)
+
+// label labels ch's amounts, and amount, with its currency, which JSON
+// leaves off them.
+func (ch *Charge) label(amount money.Money) money.Money {
+	ch.Amount = ch.Amount.In(ch.Currency)
+	ch.AmountCaptured = ch.AmountCaptured.In(ch.Currency)
+	ch.AmountRefunded = ch.AmountRefunded.In(ch.Currency)
+	return amount.In(ch.Currency)
+}
+
+// Capture takes amount of an authorized charge, or all of it if amount is
+// zero, releasing the rest of the hold.
+func (ch *Charge) Capture(amount money.Money, at time.Time) error {
+	if ch.Status != StatusAuthorized {
+		return ErrNotAuthorized
+	}
+	amount = ch.label(amount)
+	if amount.IsZero() {
+		amount = ch.Amount
+	}
+	over, err := ch.Amount.Less(amount)
+	if err != nil {
+		return err
+	}
+	if amount.IsNegative() || over {
+		return ErrOverCapture
+	}
+	ch.AmountCaptured = amount
+	ch.Status = StatusCaptured
+	ch.UpdatedAt = at
+	return nil
+}
+
+// Void releases an authorized charge without taking any of it.
+func (ch *Charge) Void(at time.Time) error {
+	if ch.Status != StatusAuthorized {
+		return ErrNotAuthorized
+	}
+	ch.Status = StatusVoided
+	ch.UpdatedAt = at
+	return nil
+}
+
+// Refund gives back amount of a captured charge, or all that hasn't been
+// refunded if amount is zero.
+func (ch *Charge) Refund(amount money.Money, at time.Time) error {
+	if ch.Status != StatusCaptured && ch.Status != StatusPartiallyRefunded {
+		return ErrNotCaptured
+	}
+	amount = ch.label(amount)
+	left, err := ch.AmountCaptured.Sub(ch.AmountRefunded)
+	if err != nil {
+		return err
+	}
+	if amount.IsZero() {
+		amount = left
+	}
+	over, err := left.Less(amount)
+	if err != nil {
+		return err
+	}
+	if amount.IsNegative() || over {
+		return ErrOverRefund
+	}
+	refunded, err := ch.AmountRefunded.Add(amount)
+	if err != nil {
+		return err
+	}
+	ch.AmountRefunded = refunded
+	ch.Status = StatusPartiallyRefunded
+	if ch.AmountRefunded == ch.AmountCaptured {
+		ch.Status = StatusRefunded
+	}
+	ch.UpdatedAt = at
+	return nil
+}
@@ -0,0 +1,172 @@
+package payments
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"pkg/money"
+)
+
+var now = time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC)
+
+func TestExpired(t *testing.T) {
+	tests := []struct {
+		card Card
+		want bool
+	}{
+		{card: Card{ExpiryMM: 1, ExpiryYY: 25}, want: false}, // Good through January
+		{card: Card{ExpiryMM: 12, ExpiryYY: 24}, want: true},
+		{card: Card{ExpiryMM: 12, ExpiryYY: 2024}, want: true},
+		{card: Card{ExpiryMM: 2, ExpiryYY: 2025}, want: false},
+		{card: Card{ExpiryMM: 0, ExpiryYY: 24}, want: true}, // A bad month is December
+		{card: Card{}, want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.card.Expired(now); got != tt.want {
+			t.Errorf("%+v expired: %v, want %v", tt.card, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	hundred := money.Cents(10000)
+	var p Processor
+	if err := p.SetScenarios([]Scenario{
+		{Last4: "4242", Code: DeclineInsufficientFunds, Count: 2},
+		{Over: &hundred, Code: DeclineGeneric},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	good := Card{Last4: "4242", ExpiryMM: 12, ExpiryYY: 30}
+	other := Card{Last4: "1881", ExpiryMM: 12, ExpiryYY: 30}
+	tests := []struct {
+		name   string
+		card   Card
+		amount money.Money
+		want   string // Decline code; "" if the charge goes through
+	}{
+		{name: "expired", card: Card{Last4: "4242", ExpiryMM: 1, ExpiryYY: 20}, amount: money.Cents(100), want: DeclineExpiredCard},
+		{name: "test card", card: Card{Last4: "9995"}, amount: money.Cents(100), want: DeclineInsufficientFunds},
+		{name: "scenario's first", card: good, amount: money.Cents(100), want: DeclineInsufficientFunds},
+		{name: "scenario's second", card: good, amount: money.Cents(100), want: DeclineInsufficientFunds},
+		{name: "scenario spent", card: good, amount: money.Cents(100)},
+		{name: "at the limit", card: other, amount: hundred},
+		{name: "over the limit", card: other, amount: money.Cents(10001), want: DeclineGeneric},
+		{name: "over in another currency", card: other, amount: money.New(10001, "EUR")},
+	}
+	for _, tt := range tests {
+		decline := p.Check(tt.card, tt.amount, now)
+		switch {
+		case tt.want == "" && decline != nil:
+			t.Errorf("%s: declined %s", tt.name, decline.Code)
+		case tt.want != "" && (decline == nil || decline.Code != tt.want):
+			t.Errorf("%s: got %v, want %s", tt.name, decline, tt.want)
+		}
+	}
+	if s := p.Scenarios(); len(s) != 1 || s[0].Declined != 1 {
+		t.Errorf("scenarios left: %+v, want the unlimited one, having declined once", s)
+	}
+	p.Reset()
+	if decline := p.Check(other, money.Cents(10001), now); decline != nil {
+		t.Errorf("declined %s after a reset", decline.Code)
+	}
+}
+
+func TestSetScenarios(t *testing.T) {
+	tests := []struct {
+		scenario Scenario
+		ok       bool
+	}{
+		{scenario: Scenario{Code: DeclineLostCard}, ok: true},
+		{scenario: Scenario{Code: "stolen"}},
+		{scenario: Scenario{Code: DeclineGeneric, Count: -1}},
+	}
+	for _, tt := range tests {
+		var p Processor
+		if err := p.SetScenarios([]Scenario{tt.scenario}); (err == nil) != tt.ok {
+			t.Errorf("SetScenarios(%+v): %v", tt.scenario, err)
+		}
+	}
+}
+
+func TestCharge(t *testing.T) {
+	type step struct {
+		op     string // capture, void or refund
+		amount int64
+		err    error
+		status Status
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "captured in full and refunded in parts",
+			steps: []step{
+				{op: "capture", status: StatusCaptured},
+				{op: "refund", amount: 1500, status: StatusPartiallyRefunded},
+				{op: "refund", amount: 3501, err: ErrOverRefund, status: StatusPartiallyRefunded},
+				{op: "refund", status: StatusRefunded},
+				{op: "refund", amount: 1, err: ErrNotCaptured, status: StatusRefunded},
+			},
+		},
+		{
+			name: "captured in part",
+			steps: []step{
+				{op: "capture", amount: 5001, err: ErrOverCapture, status: StatusAuthorized},
+				{op: "capture", amount: -1, err: ErrOverCapture, status: StatusAuthorized},
+				{op: "capture", amount: 4000, status: StatusCaptured},
+				{op: "capture", err: ErrNotAuthorized, status: StatusCaptured},
+				{op: "void", err: ErrNotAuthorized, status: StatusCaptured},
+				{op: "refund", amount: 4000, status: StatusRefunded},
+			},
+		},
+		{
+			name: "voided",
+			steps: []step{
+				{op: "refund", err: ErrNotCaptured, status: StatusAuthorized},
+				{op: "void", status: StatusVoided},
+				{op: "capture", err: ErrNotAuthorized, status: StatusVoided},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := Charge{Amount: money.Cents(5000), Currency: money.USD, Status: StatusAuthorized}
+			for i, s := range tt.steps {
+				var err error
+				switch amount := money.Cents(s.amount); s.op {
+				case "capture":
+					err = ch.Capture(amount, now)
+				case "void":
+					err = ch.Void(now)
+				case "refund":
+					err = ch.Refund(amount, now)
+				}
+				if !errors.Is(err, s.err) {
+					t.Fatalf("step %d, %s %d: %v, want %v", i+1, s.op, s.amount, err, s.err)
+				}
+				if ch.Status != s.status {
+					t.Fatalf("step %d, %s %d: charge is %s, want %s", i+1, s.op, s.amount, ch.Status, s.status)
+				}
+			}
+			if less, _ := ch.AmountCaptured.Less(ch.AmountRefunded); less {
+				t.Errorf("refunded %s of %s captured", ch.AmountRefunded, ch.AmountCaptured)
+			}
+		})
+	}
+}
+
+func TestChargeInAnotherCurrency(t *testing.T) {
+	ch := Charge{Amount: money.New(5000, "EUR"), Currency: "EUR", Status: StatusAuthorized}
+	// JSON leaves amounts without their currency, which the charge labels
+	// them with.
+	if err := ch.Capture(money.Cents(2000), now); err != nil {
+		t.Fatal(err)
+	}
+	if ch.AmountCaptured.Code() != "EUR" || ch.AmountCaptured.Minor != 2000 {
+		t.Errorf("captured %s, want 20.00 EUR", ch.AmountCaptured)
+	}
+}
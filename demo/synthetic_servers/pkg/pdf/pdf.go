@@ -0,0 +1,94 @@
+// Package pdf renders the one-page documents the synthetic servers hand
+// out, such as certificates, receipts and boarding passes, as PDFs: lines
+// of text in Helvetica, placed where they go on the page.
+//
+//	doc := pdf.Page{Width: pdf.LetterWidth, Height: pdf.LetterHeight, Lines: []pdf.Line{
+//		{Bold: true, Size: 24, X: 72, Y: 700, Text: "Boarding Pass"},
+//		{Size: 12, X: 72, Y: 670, Text: "UA 1234  SFO to ORD"},
+//	}}
+//	data := doc.Render()
+//
+// The standard fonts have no characters beyond ASCII, so others print as ?.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// MIMEApplicationPDF is the media type of what Render returns.
+const MIMEApplicationPDF = "application/pdf"
+
+// The size of a US Letter page in points, upright; swap them for landscape.
+const (
+	LetterWidth  = 612
+	LetterHeight = 792
+)
+
+// Page is a one-page document.
+type Page struct {
+	Width, Height int // In points, 72 to an inch
+	Lines         []Line
+}
+
+// Line is a line of text on a page.
+type Line struct {
+	Bold bool
+	Size int    // In points
+	X, Y int    // Where the line starts, in points from the page's bottom left
+	Text string // ASCII
+}
+
+// Render returns the page as a PDF.
+func (p Page) Render() []byte {
+	var content strings.Builder
+	for _, line := range p.Lines {
+		font := "F1"
+		if line.Bold {
+			font = "F2"
+		}
+		fmt.Fprintf(&content, "BT /%s %d Tf %d %d Td (%s) Tj ET\n", font, line.Size, line.X, line.Y, escape(line.Text))
+	}
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents 6 0 R >>", p.Width, p.Height),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// escape escapes a string for a PDF literal, replacing anything outside
+// printable ASCII since the standard fonts can't show it.
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
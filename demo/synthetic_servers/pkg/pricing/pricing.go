@@ -0,0 +1,185 @@
+// Package pricing works out what orders cost, for the synthetic servers
+// that sell things. An order's lines make its subtotal, and then its rules,
+// such as a membership discount, a promotion, a delivery fee and sales
+// tax, adjust it in the order they are given, each seeing the quote as the
+// rules before it left it. Servers price their carts and orders with the
+// same rules, so a cart's total is what its order will cost. A quote is
+// in one currency: a line or rule of another makes pricing fail.
+package pricing
+
+import (
+	"fmt"
+	"strings"
+
+	"pkg/money"
+)
+
+// Line is one thing an order is for: Quantity of it at Price each.
+type Line struct {
+	Price    money.Money
+	Quantity int
+}
+
+// What an Adjustment does to a quote.
+const (
+	KindDiscount = "discount"
+	KindFee      = "fee"
+	KindTax      = "tax"
+)
+
+// Adjustment is what one rule did to a quote.
+type Adjustment struct {
+	Rule   string      // The rule's name, such as "delivery" or "sales_tax"
+	Kind   string      // KindDiscount, KindFee or KindTax
+	Amount money.Money // How much it took off, or added, as a positive amount
+}
+
+// Quote is what an order costs.
+type Quote struct {
+	Subtotal    money.Money  // The lines' prices times their quantities
+	Discount    money.Money  // Taken off the subtotal
+	Fees        money.Money  // Added to it, such as for delivery
+	Tax         money.Money  // Charged on the subtotal less discounts
+	Total       money.Money  // What the order costs: never less than nothing
+	Adjustments []Adjustment // What each rule did, in order
+
+	err error // The first amount of another currency a rule gave
+}
+
+// Discounted returns the subtotal less the discounts so far. Both are
+// always in the quote's currency.
+func (q *Quote) Discounted() money.Money {
+	return money.New(q.Subtotal.Minor-q.Discount.Minor, q.Subtotal.Code())
+}
+
+func (q *Quote) adjust(rule, kind string, amount money.Money) {
+	if amount.IsZero() || q.err != nil {
+		return
+	}
+	total := &q.Discount
+	switch kind {
+	case KindFee:
+		total = &q.Fees
+	case KindTax:
+		total = &q.Tax
+	}
+	sum, err := total.Add(amount)
+	if err != nil {
+		q.fail(rule, err)
+		return
+	}
+	*total = sum
+	q.Adjustments = append(q.Adjustments, Adjustment{Rule: rule, Kind: kind, Amount: amount})
+}
+
+// fail records that rule failed with err, unless one failed before it.
+func (q *Quote) fail(rule string, err error) {
+	if q.err == nil {
+		q.err = fmt.Errorf("%s: %w", rule, err)
+	}
+}
+
+// Rule adjusts a quote.
+type Rule func(q *Quote)
+
+// Price prices lines in currency by rules, in order. A line, or an amount
+// a rule gives, in another currency is an error wrapping
+// money.ErrMixedCurrencies.
+func Price(currency string, lines []Line, rules ...Rule) (Quote, error) {
+	zero := money.New(0, currency)
+	q := Quote{Subtotal: zero, Discount: zero, Fees: zero, Tax: zero}
+	for _, line := range lines {
+		subtotal, err := q.Subtotal.Add(line.Price.Times(line.Quantity))
+		if err != nil {
+			return Quote{}, err
+		}
+		q.Subtotal = subtotal
+	}
+	for _, rule := range rules {
+		if rule != nil {
+			rule(&q)
+		}
+	}
+	if q.err != nil {
+		return Quote{}, q.err
+	}
+	q.Total = zero
+	if total := q.Discounted().Minor + q.Fees.Minor + q.Tax.Minor; total > 0 {
+		q.Total = money.New(total, currency)
+	}
+	return q, nil
+}
+
+// PercentOff takes rate, such as 0.1 for 10%, off what is left of the
+// subtotal, as membership discounts do.
+func PercentOff(name string, rate float64) Rule {
+	return func(q *Quote) {
+		q.adjust(name, KindDiscount, q.Discounted().Mul(rate))
+	}
+}
+
+// AmountOff takes amount off the subtotal, as promotions and redeemed
+// rewards do, but no more than is left of it.
+func AmountOff(name string, amount money.Money) Rule {
+	return func(q *Quote) {
+		least, err := money.Min(amount, q.Discounted())
+		if err != nil {
+			q.fail(name, err)
+		}
+		q.adjust(name, KindDiscount, least)
+	}
+}
+
+// Fee charges amount, such as for delivery.
+func Fee(name string, amount money.Money) Rule {
+	return func(q *Quote) {
+		q.adjust(name, KindFee, amount)
+	}
+}
+
+// FeeUnder charges amount unless what is left of the subtotal is minimum
+// or more, as shipping that is free over a minimum is.
+func FeeUnder(name string, amount, minimum money.Money) Rule {
+	return func(q *Quote) {
+		less, err := q.Discounted().Less(minimum)
+		if err != nil {
+			q.fail(name, err)
+		}
+		if less {
+			q.adjust(name, KindFee, amount)
+		}
+	}
+}
+
+// Tax charges sales tax at rate on what is left of the subtotal; fees
+// aren't taxed.
+func Tax(rate float64) Rule {
+	return func(q *Quote) {
+		q.adjust("sales_tax", KindTax, q.Discounted().Mul(rate))
+	}
+}
+
+// stateTaxRates are the statewide sales tax rates of the US states and DC,
+// without the local taxes added to them.
+var stateTaxRates = map[string]float64{
+	"AL": 0.04, "AK": 0, "AZ": 0.056, "AR": 0.065, "CA": 0.0725,
+	"CO": 0.029, "CT": 0.0635, "DE": 0, "DC": 0.06, "FL": 0.06,
+	"GA": 0.04, "HI": 0.04, "ID": 0.06, "IL": 0.0625, "IN": 0.07,
+	"IA": 0.06, "KS": 0.065, "KY": 0.06, "LA": 0.0445, "ME": 0.055,
+	"MD": 0.06, "MA": 0.0625, "MI": 0.06, "MN": 0.06875, "MS": 0.07,
+	"MO": 0.04225, "MT": 0, "NE": 0.055, "NV": 0.0685, "NH": 0,
+	"NJ": 0.06625, "NM": 0.04875, "NY": 0.04, "NC": 0.0475, "ND": 0.05,
+	"OH": 0.0575, "OK": 0.045, "OR": 0, "PA": 0.06, "RI": 0.07,
+	"SC": 0.06, "SD": 0.042, "TN": 0.07, "TX": 0.0625, "UT": 0.061,
+	"VT": 0.06, "VA": 0.053, "WA": 0.065, "WV": 0.06, "WI": 0.05,
+	"WY": 0.04,
+}
+
+// StateTaxRate returns the statewide sales tax rate of a US state, by its
+// two-letter code, or def for places it doesn't know.
+func StateTaxRate(state string, def float64) float64 {
+	if rate, ok := stateTaxRates[strings.ToUpper(strings.TrimSpace(state))]; ok {
+		return rate
+	}
+	return def
+}
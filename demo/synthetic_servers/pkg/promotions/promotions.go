@@ -0,0 +1,147 @@
+// Package promotions keeps the promo codes the synthetic servers take at
+// checkout. A code takes a percentage or an amount off an order, when the
+// order is eligible for it: the code has started and not expired, has
+// uses left overall and for its user, and the order meets its minimum. An
+// order may carry more than one code only if all of them stack. Codes
+// become pricing rules, so they come off an order's price before tax.
+package promotions
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"pkg/money"
+	"pkg/pricing"
+)
+
+// Kinds of promotion.
+const (
+	KindPercentOff = "percent_off"
+	KindAmountOff  = "amount_off"
+)
+
+// Promotion is a promo code and what it takes off an order.
+type Promotion struct {
+	Code           string      `json:"code"`
+	Description    string      `json:"description,omitempty"`
+	Kind           string      `json:"kind"`                  // KindPercentOff or KindAmountOff
+	PercentOff     float64     `json:"percent_off,omitempty"` // For KindPercentOff, such as 10 for 10%
+	AmountOff      money.Money `json:"amount_off"`            // For KindAmountOff
+	MinSubtotal    money.Money `json:"min_subtotal"`          // The least an order's subtotal may be
+	StartsAt       *time.Time  `json:"starts_at,omitempty"`
+	ExpiresAt      *time.Time  `json:"expires_at,omitempty"`
+	MaxUses        int         `json:"max_uses,omitempty"`          // In all; unlimited if 0
+	MaxUsesPerUser int         `json:"max_uses_per_user,omitempty"` // Unlimited if 0
+	Uses           int         `json:"uses"`
+	Stackable      bool        `json:"stackable,omitempty"` // May be used along with other codes
+}
+
+// Redemption is a code's use on an order.
+type Redemption struct {
+	ID        string      `json:"id"`
+	Code      string      `json:"code"`
+	UserEmail string      `json:"user_email"`
+	OrderID   string      `json:"order_id"`
+	Amount    money.Money `json:"amount"` // What it took off
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// Normalize returns a code as promotions are keyed by it, in upper case.
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Order is what a code is checked against.
+type Order struct {
+	UserEmail string
+	Subtotal  money.Money
+}
+
+// Why a code can't be used.
+const (
+	ReasonNotFound     = "not_found"
+	ReasonNotStarted   = "not_started"
+	ReasonExpired      = "expired"
+	ReasonExhausted    = "exhausted"
+	ReasonAlreadyUsed  = "already_used"
+	ReasonBelowMinimum = "below_minimum"
+	ReasonNotStackable = "not_stackable"
+	ReasonCurrency     = "wrong_currency"
+)
+
+// Error is why a code can't be used on an order.
+type Error struct {
+	Code    string // The promo code
+	Reason  string // ReasonNotFound, ReasonExpired and so on
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func fail(code, reason, format string, args ...any) *Error {
+	return &Error{Code: code, Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// NotFound is the error for a code there is no promotion for.
+func NotFound(code string) *Error {
+	return fail(code, ReasonNotFound, "promo code %s is not valid", code)
+}
+
+// Check returns why p can't be used on order now, given how many times
+// order's user has used it already, or nil if it can.
+func (p Promotion) Check(order Order, used int, now time.Time) error {
+	below, err := order.Subtotal.Less(p.MinSubtotal)
+	switch {
+	case p.StartsAt != nil && now.Before(*p.StartsAt):
+		return fail(p.Code, ReasonNotStarted, "promo code %s isn't valid until %s", p.Code, p.StartsAt.Format("January 2, 2006"))
+	case p.ExpiresAt != nil && !now.Before(*p.ExpiresAt):
+		return fail(p.Code, ReasonExpired, "promo code %s has expired", p.Code)
+	case p.MaxUses > 0 && p.Uses >= p.MaxUses:
+		return fail(p.Code, ReasonExhausted, "promo code %s has reached its usage limit", p.Code)
+	case p.MaxUsesPerUser > 0 && used >= p.MaxUsesPerUser:
+		return fail(p.Code, ReasonAlreadyUsed, "you have already used promo code %s", p.Code)
+	case err != nil:
+		return fail(p.Code, ReasonCurrency, "promo code %s is for orders in %s", p.Code, p.MinSubtotal.Code())
+	case below:
+		return fail(p.Code, ReasonBelowMinimum, "promo code %s needs an order of %s or more", p.Code, p.MinSubtotal.Format())
+	}
+	return nil
+}
+
+// Stack returns why promotions can't be used together on one order, or nil
+// if they can: each code once, and only codes that stack with others.
+func Stack(promotions []Promotion) error {
+	seen := make(map[string]bool)
+	for _, p := range promotions {
+		if seen[p.Code] {
+			return fail(p.Code, ReasonNotStackable, "promo code %s is given twice", p.Code)
+		}
+		seen[p.Code] = true
+		if len(promotions) > 1 && !p.Stackable {
+			return fail(p.Code, ReasonNotStackable, "promo code %s can't be combined with other codes", p.Code)
+		}
+	}
+	return nil
+}
+
+// Rule is what p takes off an order, as a pricing rule named after its
+// code.
+func (p Promotion) Rule() pricing.Rule {
+	if p.Kind == KindPercentOff {
+		return pricing.PercentOff(p.Code, p.PercentOff/100)
+	}
+	return pricing.AmountOff(p.Code, p.AmountOff)
+}
+
+// Discount returns what p took off an order priced as quote. A quote's
+// adjustments are all in its currency.
+func (p Promotion) Discount(quote pricing.Quote) money.Money {
+	amount := money.New(0, quote.Subtotal.Code())
+	for _, a := range quote.Adjustments {
+		if a.Rule == p.Code && a.Kind == pricing.KindDiscount {
+			amount.Minor += a.Amount.Minor
+		}
+	}
+	return amount
+}
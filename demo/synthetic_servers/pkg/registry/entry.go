@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SpecFiles are where a server's OpenAPI spec may be, in order of
+// preference: the one generated from its source, then the hand-written one.
+var SpecFiles = []string{"openapi.json", "api_spec.json"}
+
+// SeedFile is the seed database a server loads by default.
+const SeedFile = "database.json"
+
+// Entry describes a service for harnesses enumerating them, as served at
+// /registry.
+type Entry struct {
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+	Port        int    `json:"port"`
+	URL         string `json:"url"`      // Base URL to call it at
+	SpecURL     string `json:"spec_url"` // Its OpenAPI spec
+	Seed        *Seed  `json:"seed,omitempty"`
+}
+
+// Seed describes the seed database a server loads by default.
+type Seed struct {
+	File        string         `json:"file"`                  // In the server's directory
+	Collections map[string]int `json:"collections,omitempty"` // Entities in each, leaving out auth
+}
+
+// Describe returns the service's entry, with what its spec says about it
+// and the collections in its seed. URL and SpecURL are for the caller to
+// fill in, since they depend on how the service is reached.
+func (svc Service) Describe() (Entry, error) {
+	e := Entry{Name: svc.Name, Title: svc.Name, Version: "1.0.0", Port: svc.Port}
+	spec, err := svc.Spec()
+	if err != nil {
+		return Entry{}, err
+	}
+	if info, ok := spec["info"].(map[string]any); ok {
+		if title, _ := info["title"].(string); title != "" {
+			e.Title = title
+		}
+		if version, _ := info["version"].(string); version != "" {
+			e.Version = version
+		}
+		e.Description, _ = info["description"].(string)
+	}
+
+	data, err := os.ReadFile(filepath.Join(svc.Dir, SeedFile))
+	if os.IsNotExist(err) {
+		return e, nil
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	e.Seed = &Seed{File: SeedFile}
+	var collections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &collections); err != nil {
+		// The entry is still of use without the counts.
+		return e, fmt.Errorf("%s: %s: %w", svc.Name, SeedFile, err)
+	}
+	e.Seed.Collections = make(map[string]int)
+	for name, raw := range collections {
+		var byKey map[string]json.RawMessage
+		var list []json.RawMessage
+		switch {
+		case name == "auth":
+		case json.Unmarshal(raw, &byKey) == nil:
+			e.Seed.Collections[name] = len(byKey)
+		case json.Unmarshal(raw, &list) == nil:
+			e.Seed.Collections[name] = len(list)
+		}
+	}
+	return e, nil
+}
+
+// Describe returns the entries of services, in order, with their URLs as
+// url gives them. Entries that could only be described in part are
+// returned along with the errors describing them.
+func Describe(services []Service, url func(Service) string) ([]Entry, []error) {
+	var entries []Entry
+	var errs []error
+	for _, svc := range services {
+		e, err := svc.Describe()
+		if err != nil {
+			errs = append(errs, err)
+			if e.Name == "" {
+				continue
+			}
+		}
+		e.URL = url(svc)
+		e.SpecURL = e.URL + "/openapi.json"
+		entries = append(entries, e)
+	}
+	return entries, errs
+}
+
+// Spec reads the service's OpenAPI spec, or returns nil if it has none.
+func (svc Service) Spec() (map[string]any, error) {
+	for _, name := range SpecFiles {
+		data, err := os.ReadFile(filepath.Join(svc.Dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var spec map[string]any
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", svc.Name, name, err)
+		}
+		return spec, nil
+	}
+	return nil, nil
+}
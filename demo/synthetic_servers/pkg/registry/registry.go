@@ -0,0 +1,130 @@
+// Package registry finds the synthetic servers in a directory, the ports
+// they run on, and what they serve.
+//
+// A directory of servers, like v1, holds one server per subdirectory,
+// named for its service, and a ports.json manifest giving each service its
+// port:
+//
+//	{
+//	  "amazon": 8105,
+//	  "uber": 8186
+//	}
+//
+// Ports in the manifest stay put as servers come and go, so clients can
+// hard-code them.
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Manifest is the name of the file in a directory of servers that assigns
+// them ports.
+const Manifest = "ports.json"
+
+// Service is a synthetic server.
+type Service struct {
+	Name     string `json:"name"`
+	Dir      string `json:"-"`
+	Port     int    `json:"port"`
+	Assigned bool   `json:"-"` // Its port isn't in the manifest
+}
+
+// Discover returns the servers in dir, the subdirectories with a main.go,
+// in name order. Each gets its port from the manifest; servers missing from
+// it get the ports after the highest one there, and are marked Assigned.
+func Discover(dir string) ([]Service, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := LoadPorts(filepath.Join(dir, Manifest))
+	if err != nil {
+		return nil, err
+	}
+
+	next := 0
+	for _, port := range ports {
+		next = max(next, port+1)
+	}
+	if next == 0 {
+		next = 8101
+	}
+	var services []Service
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		svcDir := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(filepath.Join(svcDir, "main.go")); err != nil {
+			continue
+		}
+		svc := Service{Name: entry.Name(), Dir: svcDir, Port: ports[entry.Name()]}
+		if svc.Port == 0 {
+			svc.Port, svc.Assigned = next, true
+			next++
+		}
+		services = append(services, svc)
+	}
+	return services, nil
+}
+
+// LoadPorts reads a ports manifest. A missing one assigns no ports.
+func LoadPorts(path string) (map[string]int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]int{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ports map[string]int
+	if err := json.Unmarshal(data, &ports); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	taken := make(map[int]string)
+	for name, port := range ports {
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("%s: %s has port %d", path, name, port)
+		}
+		if other, ok := taken[port]; ok {
+			return nil, fmt.Errorf("%s: %s and %s both have port %d", path, min(name, other), max(name, other), port)
+		}
+		taken[port] = name
+	}
+	return ports, nil
+}
+
+// UsePorts gives services the ports in the manifest at path instead, such
+// as the one runall's -ports-file writes with the ports its servers got.
+// Services the manifest doesn't name keep theirs.
+func UsePorts(services []Service, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	ports, err := LoadPorts(path)
+	if err != nil {
+		return err
+	}
+	for i, svc := range services {
+		if port, ok := ports[svc.Name]; ok {
+			services[i].Port, services[i].Assigned = port, false
+		}
+	}
+	return nil
+}
+
+// Find returns the service with name.
+func Find(services []Service, name string) (Service, bool) {
+	for _, svc := range services {
+		if svc.Name == name {
+			return svc, true
+		}
+	}
+	return Service{}, false
+}
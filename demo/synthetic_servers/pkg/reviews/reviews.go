@@ -0,0 +1,262 @@
+// Package reviews keeps what users say about the things the synthetic
+// servers offer, whether products, restaurants, caregivers, classes or
+// movies. A review is of a Target, named by its kind and ID, so one book of
+// reviews serves a server whatever it reviews. Each kind has a Policy: the
+// scale it is rated on, and whether only users who have bought, booked,
+// hired or seen what they review may review it. Users flag reviews they
+// find abusive, and a review flagged by enough of them is hidden until a
+// moderator looks at it; hidden reviews count toward no summary.
+package reviews
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Target is what a review is of.
+type Target struct {
+	Kind string `json:"kind"` // Such as "product" or "movie"
+	ID   string `json:"id"`
+}
+
+// Review is a user's rating of a target, and what they say about it.
+type Review struct {
+	ID        string  `json:"id"`
+	Target    Target  `json:"target"`
+	UserEmail string  `json:"user_email"`
+	Rating    float64 `json:"rating"`
+	Title     string  `json:"title,omitempty"`
+	Body      string  `json:"body,omitempty"`
+	// Verified is whether the user bought, booked, hired or saw the target,
+	// and VerifiedBy what shows it, such as an order or ticket ID.
+	Verified   bool      `json:"verified"`
+	VerifiedBy string    `json:"verified_by,omitempty"`
+	Flags      []Flag    `json:"flags,omitempty"`
+	Hidden     bool      `json:"hidden,omitempty"` // Flagged too often; awaiting moderation
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Reasons a review may be flagged for.
+var Reasons = []string{"spam", "offensive", "off_topic", "fake", "other"}
+
+// Flag is a user's report of a review.
+type Flag struct {
+	UserEmail string    `json:"user_email"`
+	Reason    string    `json:"reason"` // One of Reasons
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Scale is the ratings a kind of target may be given: Min to Max, in Steps.
+type Scale struct {
+	Min, Max, Step float64
+}
+
+var (
+	// Stars are whole stars, 1 to 5.
+	Stars = Scale{Min: 1, Max: 5, Step: 1}
+	// HalfStars are half stars, 0.5 to 5.
+	HalfStars = Scale{Min: 0.5, Max: 5, Step: 0.5}
+)
+
+// Check returns an error if rating isn't on s.
+func (s Scale) Check(rating float64) error {
+	steps := (rating - s.Min) / s.Step
+	if rating < s.Min || rating > s.Max || math.Abs(steps-math.Round(steps)) > 1e-9 {
+		return fmt.Errorf("rating must be from %g to %g in steps of %g", s.Min, s.Max, s.Step)
+	}
+	return nil
+}
+
+// Policy is how a server takes reviews of one kind of target.
+type Policy struct {
+	Kind  string // Of the targets, such as "product"
+	Scale Scale
+	// Verified is whether only users who have bought, booked, hired or seen
+	// a target may review it. Others may, unverified, if it is false.
+	Verified bool
+}
+
+// HideAfter is how many users' flags hide a review.
+var HideAfter = 3
+
+// Errors Add and Flag return.
+var (
+	ErrNotFound        = errors.New("review not found")
+	ErrAlreadyReviewed = errors.New("you have already reviewed this")
+	ErrNotVerified     = errors.New("only customers who have used this may review it")
+	ErrAlreadyFlagged  = errors.New("you have already flagged this review")
+	ErrOwnReview       = errors.New("you can't flag your own review")
+)
+
+// Book is a server's reviews, by ID, as its database keeps them.
+type Book map[string]Review
+
+// Add adds r, of a target of policy's kind, verified by verifiedBy, if not
+// "", such as the ID of the order that shows the user bought it. A user
+// reviews a target once.
+func (b Book) Add(policy Policy, r Review, verifiedBy string) (Review, error) {
+	if err := policy.Scale.Check(r.Rating); err != nil {
+		return Review{}, err
+	}
+	r.Target.Kind = policy.Kind
+	for _, existing := range b {
+		if existing.Target == r.Target && strings.EqualFold(existing.UserEmail, r.UserEmail) {
+			return Review{}, ErrAlreadyReviewed
+		}
+	}
+	if verifiedBy == "" && policy.Verified {
+		return Review{}, ErrNotVerified
+	}
+	r.Verified, r.VerifiedBy = verifiedBy != "", verifiedBy
+	b[r.ID] = r
+	return r, nil
+}
+
+// Flag records email's report of the review id, and hides the review once
+// HideAfter users have flagged it.
+func (b Book) Flag(id, email, reason string, now time.Time) (Flag, error) {
+	r, ok := b[id]
+	if !ok || r.Hidden {
+		return Flag{}, ErrNotFound
+	}
+	if strings.EqualFold(r.UserEmail, email) {
+		return Flag{}, ErrOwnReview
+	}
+	for _, f := range r.Flags {
+		if strings.EqualFold(f.UserEmail, email) {
+			return Flag{}, ErrAlreadyFlagged
+		}
+	}
+	f := Flag{UserEmail: email, Reason: reason, CreatedAt: now}
+	r.Flags = append(r.Flags, f)
+	r.Hidden = len(r.Flags) >= HideAfter
+	b[id] = r
+	return f, nil
+}
+
+// Flagged returns the reviews users have flagged, hidden ones first, then
+// the most flagged, for moderators.
+func (b Book) Flagged() []Review {
+	found := []Review{}
+	for _, r := range b {
+		if len(r.Flags) > 0 {
+			found = append(found, r)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		switch {
+		case a.Hidden != b.Hidden:
+			return a.Hidden
+		case len(a.Flags) != len(b.Flags):
+			return len(a.Flags) > len(b.Flags)
+		}
+		return a.ID < b.ID
+	})
+	return found
+}
+
+// Restore is a moderator's keeping the review id: its flags are dropped,
+// and it is shown again if it was hidden.
+func (b Book) Restore(id string) (Review, error) {
+	r, ok := b[id]
+	if !ok {
+		return Review{}, ErrNotFound
+	}
+	r.Flags, r.Hidden = nil, false
+	b[id] = r
+	return r, nil
+}
+
+// Of returns target's reviews that aren't hidden, in order, as Sort takes
+// it. Like By, it leaves out their flags, which are for moderators.
+func (b Book) Of(target Target, order string) []Review {
+	found := []Review{}
+	for _, r := range b {
+		if r.Target == target && !r.Hidden {
+			r.Flags = nil
+			found = append(found, r)
+		}
+	}
+	Sort(found, order)
+	return found
+}
+
+// By returns email's reviews, hidden ones too, newest first.
+func (b Book) By(email string) []Review {
+	found := []Review{}
+	for _, r := range b {
+		if strings.EqualFold(r.UserEmail, email) {
+			r.Flags = nil
+			found = append(found, r)
+		}
+	}
+	Sort(found, "")
+	return found
+}
+
+// Summary returns what target's reviews that aren't hidden add up to.
+func (b Book) Summary(target Target) Summary {
+	var s Summary
+	total := 0.0
+	for _, r := range b {
+		if r.Target == target && !r.Hidden {
+			s.Count++
+			total += r.Rating
+			s.Stars[star(r.Rating)]++
+		}
+	}
+	if s.Count > 0 {
+		s.Average = math.Round(total/float64(s.Count)*100) / 100
+	}
+	return s
+}
+
+// Orders Sort takes.
+const (
+	SortNewest     = "newest"
+	SortRatingDesc = "rating_desc"
+	SortRatingAsc  = "rating_asc"
+)
+
+// Sort sorts reviews by order, newest first if it is "" or unknown, and
+// newest first among equal ratings.
+func Sort(reviews []Review, order string) {
+	sort.Slice(reviews, func(i, j int) bool {
+		a, b := reviews[i], reviews[j]
+		switch {
+		case order == SortRatingDesc && a.Rating != b.Rating:
+			return a.Rating > b.Rating
+		case order == SortRatingAsc && a.Rating != b.Rating:
+			return a.Rating < b.Rating
+		case !a.CreatedAt.Equal(b.CreatedAt):
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+}
+
+// Summary is what a target's ratings add up to.
+type Summary struct {
+	Count   int     `json:"count"`
+	Average float64 `json:"average"` // To two decimal places; 0 with no reviews
+	Stars   [5]int  `json:"stars"`   // How many are of 1 to 5 stars, half stars rounded up
+}
+
+// Add folds rating into s, as a new review's. A target that keeps its
+// average and count, rather than its reviews, adds to them this way.
+func (s *Summary) Add(rating float64) {
+	total := s.Average*float64(s.Count) + rating
+	s.Count++
+	s.Average = math.Round(total/float64(s.Count)*100) / 100
+	s.Stars[star(rating)]++
+}
+
+// star returns the index in Summary.Stars of rating.
+func star(rating float64) int {
+	return min(max(int(math.Ceil(rating)), 1), 5) - 1
+}
@@ -0,0 +1,118 @@
+package scenario
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"pkg/internal/vars"
+)
+
+// maxProblems is how many ways a response can miss its expect before the
+// rest are counted rather than listed.
+const maxProblems = 10
+
+// MismatchError is a response that isn't what its step expects.
+type MismatchError struct {
+	Problems []string
+}
+
+func (e *MismatchError) Error() string {
+	return "unexpected response:\n" + strings.Join(e.Problems, "\n")
+}
+
+// check lists how a response misses what e expects of it, with want the
+// expected body, variables filled in.
+func (e *Expect) check(status int, header http.Header, body, want any, saved map[string]string) []string {
+	var problems []string
+	if e.Status != 0 && status != e.Status {
+		problem := fmt.Sprintf("status: want %d, got %d", e.Status, status)
+		if msg, ok := vars.Lookup(body, "error.message"); ok {
+			problem += fmt.Sprintf(": %v", msg)
+		}
+		problems = append(problems, problem)
+	}
+	for k, v := range e.Headers {
+		if got, want := header.Get(k), vars.Fill(v, saved); got != want {
+			problems = append(problems, fmt.Sprintf("header %s: want %q, got %q", k, want, got))
+		}
+	}
+	if want != nil {
+		match("body", want, body, &problems)
+	}
+	if len(problems) > maxProblems {
+		problems = append(problems[:maxProblems], fmt.Sprintf("and %d more", len(problems)-maxProblems))
+	}
+	return problems
+}
+
+// match checks that got holds want: an object holds the fields of want's,
+// a list holds want's items in any order, and anything else is equal.
+func match(path string, want, got any, problems *[]string) {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			break
+		}
+		for k, wv := range w {
+			gv, ok := g[k]
+			if !ok {
+				*problems = append(*problems, fmt.Sprintf("%s.%s: missing, want %s", path, k, show(wv)))
+				continue
+			}
+			match(path+"."+k, wv, gv, problems)
+		}
+		return
+	case []any:
+		g, ok := got.([]any)
+		if !ok {
+			break
+		}
+		used := make([]bool, len(g))
+	items:
+		for i, wv := range w {
+			for j, gv := range g {
+				if !used[j] && holds(wv, gv) {
+					used[j] = true
+					continue items
+				}
+			}
+			*problems = append(*problems, fmt.Sprintf("%s: no item like item %s, %s, among %d", path, strconv.Itoa(i), show(wv), len(g)))
+		}
+		return
+	}
+	// Either scalars, or values of different types.
+	if want != got {
+		*problems = append(*problems, fmt.Sprintf("%s: want %s, got %s", path, show(want), show(got)))
+	}
+}
+
+// holds reports whether got holds want, as match checks it.
+func holds(want, got any) bool {
+	var problems []string
+	match("", want, got, &problems)
+	return len(problems) == 0
+}
+
+// show renders a JSON value in a problem, cut short if it's long.
+func show(v any) string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		s = "null"
+	case string:
+		s = strconv.Quote(v)
+	case map[string]any:
+		s = fmt.Sprintf("an object of %d fields", len(v))
+	case []any:
+		s = fmt.Sprintf("a list of %d items", len(v))
+	default:
+		s = fmt.Sprint(v)
+	}
+	if len(s) > 80 {
+		s = s[:77] + "..."
+	}
+	return s
+}
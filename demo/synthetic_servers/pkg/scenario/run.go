@@ -0,0 +1,238 @@
+package scenario
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"pkg/internal/vars"
+)
+
+// Runner runs scenarios against servers that are already up, with the
+// admin endpoints enabled.
+type Runner struct {
+	// Servers maps each server's name to its base URL, such as
+	// http://localhost:8105 or a gateway's http://localhost:8080/amazon.
+	Servers map[string]string
+	// AdminToken is the servers' --admin-token.
+	AdminToken string
+	// Header is sent with every request, such as a gateway's X-API-Key.
+	Header http.Header
+	// Client sends the requests; http.DefaultClient if nil.
+	Client *http.Client
+	// Log, if set, gets a line for each step that passes.
+	Log io.Writer
+}
+
+// StepError is a step that failed, and why.
+type StepError struct {
+	Scenario string
+	Step     string
+	Err      error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Scenario, e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error { return e.Err }
+
+// Run runs a scenario's steps in order, stopping at the first to fail,
+// and returns the variables it ended with.
+func (r *Runner) Run(ctx context.Context, s *Scenario, given map[string]string) (map[string]string, error) {
+	saved := make(map[string]string, len(given))
+	for k, v := range given {
+		saved[k] = v
+	}
+	return saved, r.run(ctx, s, saved)
+}
+
+func (r *Runner) run(ctx context.Context, s *Scenario, saved map[string]string) error {
+	for k, v := range s.Vars {
+		if _, ok := saved[k]; !ok {
+			saved[k] = vars.Fill(v, saved)
+		}
+	}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if step.used != nil {
+			if err := r.run(ctx, step.used, saved); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.step(ctx, s, step, saved); err != nil {
+			return &StepError{Scenario: s.Name, Step: step.String(), Err: err}
+		}
+		if r.Log != nil {
+			fmt.Fprintf(r.Log, "ok   %s: %s\n", s.Name, step)
+		}
+	}
+	return nil
+}
+
+func (r *Runner) step(ctx context.Context, s *Scenario, step *Step, saved map[string]string) error {
+	switch {
+	case len(step.Reset) > 0:
+		for _, server := range step.Reset {
+			if _, _, err := r.admin(ctx, vars.Fill(server, saved), http.MethodPost, "/admin/reset", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case step.Clock != nil:
+		servers := []string(step.Clock.Server)
+		if len(servers) == 0 {
+			servers = s.servers()
+		}
+		path, body := "/admin/clock/advance", map[string]any{"duration": vars.Fill(step.Clock.Advance, saved)}
+		if step.Clock.Set != "" {
+			t, err := time.Parse(time.RFC3339, vars.Fill(step.Clock.Set, saved))
+			if err != nil {
+				return fmt.Errorf("clock: set must be RFC 3339: %v", err)
+			}
+			path, body = "/admin/clock/set", map[string]any{"time": t, "frozen": step.Clock.Frozen}
+		}
+		for _, server := range servers {
+			if _, _, err := r.admin(ctx, vars.Fill(server, saved), http.MethodPost, path, body); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case step.Seed != nil:
+		entity := vars.Substitute(step.Seed.Entity, saved)
+		key := vars.Fill(step.Seed.Key, saved)
+		if key == "" {
+			id, _ := vars.Lookup(entity, "id")
+			if id == nil {
+				return fmt.Errorf("seed: the entity has no id; give its key")
+			}
+			key = fmt.Sprint(id)
+		}
+		path := "/admin/entities/" + url.PathEscape(vars.Fill(step.Seed.Collection, saved)) + "/" + url.PathEscape(key)
+		_, stored, err := r.admin(ctx, vars.Fill(step.Seed.Server, saved), http.MethodPut, path, entity)
+		if err != nil {
+			return err
+		}
+		return save(step.Save, stored, saved)
+
+	case step.Call != nil:
+		status, header, body, err := r.call(ctx, step.Call, saved)
+		if err != nil {
+			return err
+		}
+		if step.Expect != nil {
+			if problems := step.Expect.check(status, header, body, vars.Substitute(step.Expect.Body, saved), saved); len(problems) > 0 {
+				return &MismatchError{Problems: problems}
+			}
+		}
+		return save(step.Save, body, saved)
+	}
+	return nil
+}
+
+// save sets the variables in want to the fields at their paths in body.
+func save(want map[string]string, body any, saved map[string]string) error {
+	for name, path := range want {
+		v, ok := vars.Lookup(body, path)
+		if !ok {
+			return fmt.Errorf("no %s in the response to save as %s", path, name)
+		}
+		saved[name] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+// call sends a call's request with the variables filled in.
+func (r *Runner) call(ctx context.Context, c *Call, saved map[string]string) (int, http.Header, any, error) {
+	var body io.Reader
+	if c.Body != nil {
+		data, err := json.Marshal(vars.Substitute(c.Body, saved))
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	base, err := r.url(vars.Fill(c.Server, saved))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, c.method(), base+vars.Fill(c.Path, saved), body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if c.Body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, vars.Fill(v, saved))
+	}
+	return r.do(req)
+}
+
+// admin sends a request to one of a server's admin endpoints, which must
+// succeed.
+func (r *Runner) admin(ctx context.Context, server, method, path string, body any) (int, any, error) {
+	base, err := r.url(server)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.AdminToken)
+	status, _, resp, err := r.do(req)
+	if err == nil && status >= 300 {
+		msg, _ := vars.Lookup(resp, "error.message")
+		err = fmt.Errorf("%s %s%s: status %d: %v", method, server, path, status, msg)
+	}
+	return status, resp, err
+}
+
+func (r *Runner) url(server string) (string, error) {
+	base, ok := r.Servers[server]
+	if !ok {
+		return "", fmt.Errorf("no server %q", server)
+	}
+	return base, nil
+}
+
+func (r *Runner) do(req *http.Request) (int, http.Header, any, error) {
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return resp.StatusCode, resp.Header, nil, nil
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		v = string(data) // Not JSON; match it as text.
+	}
+	return resp.StatusCode, resp.Header, v, nil
+}
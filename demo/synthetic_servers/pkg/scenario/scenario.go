@@ -0,0 +1,286 @@
+// Package scenario runs declarative, multi-step scripts against running
+// synthetic servers, so a task's setup, like "the user has a pending order
+// and a membership that expires tomorrow", can be written once and reused.
+//
+// A scenario is a YAML file of steps, run in order until one fails:
+//
+//	name: pending order, expiring membership
+//	vars:
+//	  email: casey.wringer@email.com
+//	steps:
+//	  - reset: [amazon, la-fitness]
+//	  - clock: {set: "2025-01-15T12:00:00Z", frozen: true}
+//	  - seed:
+//	      server: amazon
+//	      collection: orders
+//	      entity: {id: ord_pending, user_email: "{{email}}", status: pending, ...}
+//	  - call: {server: amazon, method: GET, path: "/api/v1/orders?email={{email}}"}
+//	    expect: {status: 200, body: {data: [{id: ord_pending, status: pending}]}}
+//	    save: {order: data.0.id}
+//	  - use: common/login.yaml
+//
+// Each step does one thing:
+//
+//   - reset reloads the named servers' seed databases.
+//   - clock sets the named servers' clocks, or advances them by a duration
+//     such as "72h"; without servers, it sets those the scenario calls or
+//     seeds.
+//   - seed puts an entity into a collection, through the admin API; its key
+//     is the entity's "id" unless one is given.
+//   - call sends a request to a server's API, and checks its response
+//     against expect: the status, headers, and a body that must hold the
+//     fields given, where a list holds the items given, in any order.
+//   - use runs another scenario, its path relative to this one's file.
+//
+// A call's or a seed's save picks fields out of the response body by
+// dotted path, such as data.0.id, into variables, which later steps use as
+// {{name}} in their strings. Variables given to Run come first, then the
+// scenario's vars, then those of the scenarios it uses.
+package scenario
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario is a script of steps.
+type Scenario struct {
+	Name        string            `yaml:"name"`
+	Description string            `yaml:"description"`
+	Vars        map[string]string `yaml:"vars"`
+	Steps       []Step            `yaml:"steps"`
+
+	path string
+}
+
+// Step is one step of a scenario, which does exactly one of its actions.
+type Step struct {
+	Name string `yaml:"name"`
+
+	Use   string `yaml:"use"`
+	Reset Names  `yaml:"reset"`
+	Clock *Clock `yaml:"clock"`
+	Seed  *Seed  `yaml:"seed"`
+	Call  *Call  `yaml:"call"`
+
+	Expect *Expect           `yaml:"expect"`
+	Save   map[string]string `yaml:"save"`
+
+	used *Scenario
+}
+
+// Clock sets servers' clocks, or advances them.
+type Clock struct {
+	Server  Names  `yaml:"server"`
+	Set     string `yaml:"set"`
+	Advance string `yaml:"advance"`
+	Frozen  bool   `yaml:"frozen"`
+}
+
+// Seed puts an entity into one of a server's collections.
+type Seed struct {
+	Server     string `yaml:"server"`
+	Collection string `yaml:"collection"`
+	Key        string `yaml:"key"`
+	Entity     any    `yaml:"entity"`
+}
+
+// Call is a request to a server's API.
+type Call struct {
+	Server  string            `yaml:"server"`
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+	Body    any               `yaml:"body"`
+}
+
+// Expect is what a call's response must be. Only what's given is checked.
+type Expect struct {
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    any               `yaml:"body"`
+}
+
+// Names is a list of servers, written in YAML as a list or a single name.
+type Names []string
+
+func (n *Names) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*n = Names{node.Value}
+		return nil
+	}
+	var names []string
+	if err := node.Decode(&names); err != nil {
+		return err
+	}
+	*n = names
+	return nil
+}
+
+// Load reads a scenario, and those it uses, from a YAML file.
+func Load(path string) (*Scenario, error) {
+	return load(path, nil)
+}
+
+// load reads a scenario that the ones in stack use, in turn.
+func load(path string, stack []string) (*Scenario, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range stack {
+		if p == abs {
+			return nil, fmt.Errorf("%s uses itself", path)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scenario{path: path}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if err := step.validate(); err != nil {
+			return nil, fmt.Errorf("%s: step %d: %w", path, i+1, err)
+		}
+		if step.Seed != nil {
+			if step.Seed.Entity, err = jsonValue(step.Seed.Entity); err != nil {
+				return nil, fmt.Errorf("%s: step %d: entity: %w", path, i+1, err)
+			}
+		}
+		if step.Call != nil {
+			if step.Call.Body, err = jsonValue(step.Call.Body); err != nil {
+				return nil, fmt.Errorf("%s: step %d: body: %w", path, i+1, err)
+			}
+		}
+		if step.Expect != nil {
+			if step.Expect.Body, err = jsonValue(step.Expect.Body); err != nil {
+				return nil, fmt.Errorf("%s: step %d: expected body: %w", path, i+1, err)
+			}
+		}
+		if step.Use != "" {
+			used := step.Use
+			if !filepath.IsAbs(used) {
+				used = filepath.Join(filepath.Dir(path), used)
+			}
+			if step.used, err = load(used, append(stack, abs)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *Step) validate() error {
+	actions := 0
+	for _, set := range []bool{s.Use != "", len(s.Reset) > 0, s.Clock != nil, s.Seed != nil, s.Call != nil} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return errors.New("a step does exactly one of use, reset, clock, seed and call")
+	}
+	switch {
+	case s.Expect != nil && s.Call == nil:
+		return errors.New("only a call has an expect")
+	case len(s.Save) > 0 && s.Call == nil && s.Seed == nil:
+		return errors.New("only a call or a seed has a save")
+	case s.Clock != nil && (s.Clock.Set == "") == (s.Clock.Advance == ""):
+		return errors.New("a clock step either sets or advances the clock")
+	case s.Seed != nil && (s.Seed.Server == "" || s.Seed.Collection == "" || s.Seed.Entity == nil):
+		return errors.New("a seed needs a server, a collection and an entity")
+	case s.Call != nil && (s.Call.Server == "" || s.Call.Path == ""):
+		return errors.New("a call needs a server and a path")
+	}
+	return nil
+}
+
+// String names a step, by its name or else what it does.
+func (s *Step) String() string {
+	switch {
+	case s.Name != "":
+		return s.Name
+	case s.Use != "":
+		return "use " + s.Use
+	case len(s.Reset) > 0:
+		return "reset " + strings.Join(s.Reset, ", ")
+	case s.Clock != nil && s.Clock.Set != "":
+		return "clock set " + s.Clock.Set
+	case s.Clock != nil:
+		return "clock advance " + s.Clock.Advance
+	case s.Seed != nil && s.Seed.Key != "":
+		return fmt.Sprintf("seed %s %s/%s", s.Seed.Server, s.Seed.Collection, s.Seed.Key)
+	case s.Seed != nil:
+		return fmt.Sprintf("seed %s %s", s.Seed.Server, s.Seed.Collection)
+	case s.Call != nil:
+		return fmt.Sprintf("%s %s %s", s.Call.method(), s.Call.Server, s.Call.Path)
+	}
+	return "step"
+}
+
+func (c *Call) method() string {
+	if c.Method == "" {
+		return "GET"
+	}
+	return strings.ToUpper(c.Method)
+}
+
+// servers returns the servers a scenario, and those it uses, call or seed.
+func (s *Scenario) servers() []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, step := range s.Steps {
+		switch {
+		case step.Seed != nil:
+			add(step.Seed.Server)
+		case step.Call != nil:
+			add(step.Call.Server)
+		case step.used != nil:
+			for _, name := range step.used.servers() {
+				add(name)
+			}
+		}
+	}
+	return names
+}
+
+// jsonValue turns a value decoded from YAML into the one it is in JSON, so
+// it compares with response bodies: numbers become float64s, and
+// timestamps strings.
+func jsonValue(v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	return out, json.Unmarshal(data, &out)
+}
@@ -0,0 +1,218 @@
+// Package search is an in-memory full-text index for the synthetic servers'
+// search endpoints, so they look up the few entities a query names instead
+// of scanning every one.
+//
+// Text is split into lowercase words, with a plural's s dropped, and each
+// word of a query must be one of an entity's words or the start of one:
+// "wire head" finds "Wireless Headphones". Entities are ranked by how much
+// of the query they match, weighing rarer words and the fields given more
+// weight higher, and exact words above prefixes.
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// prefixWeight is how much a word the query only starts counts for, against
+// one it names whole.
+const prefixWeight = 0.5
+
+// Field is a piece of an entity's text, with how much matches in it count
+// toward the entity's score.
+type Field struct {
+	Text   string
+	Weight float64
+}
+
+// Result is an entity a query matched, and its score.
+type Result struct {
+	ID    string
+	Score float64
+}
+
+// Index maps words to the entities whose text has them. It is safe for
+// concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]float64 // Word to entity to weight
+	docs     map[string][]string           // Entity to its words, to remove them
+	words    []string                      // Sorted, for prefixes; nil when stale
+}
+
+// New returns an empty index.
+func New() *Index {
+	return &Index{
+		postings: make(map[string]map[string]float64),
+		docs:     make(map[string][]string),
+	}
+}
+
+// Add indexes the entity id's text, in place of any it had.
+func (ix *Index) Add(id string, fields ...Field) {
+	weights := make(map[string]float64)
+	for _, f := range fields {
+		for _, word := range Tokenize(f.Text) {
+			weights[word] += f.Weight
+		}
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(id)
+	words := make([]string, 0, len(weights))
+	for word, weight := range weights {
+		if ix.postings[word] == nil {
+			ix.postings[word] = make(map[string]float64)
+			ix.words = nil
+		}
+		ix.postings[word][id] = weight
+		words = append(words, word)
+	}
+	ix.docs[id] = words
+}
+
+// Remove takes the entity id out of the index.
+func (ix *Index) Remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(id)
+}
+
+func (ix *Index) remove(id string) {
+	for _, word := range ix.docs[id] {
+		delete(ix.postings[word], id)
+		if len(ix.postings[word]) == 0 {
+			delete(ix.postings, word)
+			ix.words = nil
+		}
+	}
+	delete(ix.docs, id)
+}
+
+// Len returns the number of entities indexed.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// Search returns the entities matching every word of query, best first and
+// then by ID. A query without words matches nothing.
+func (ix *Index) Search(query string) []Result {
+	terms := Tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	ix.mu.RLock()
+	for ix.words == nil {
+		ix.mu.RUnlock()
+		ix.sortWords()
+		ix.mu.RLock()
+	}
+	defer ix.mu.RUnlock()
+
+	var scores map[string]float64
+	for _, term := range terms {
+		// Each entity's best match for the term.
+		best := make(map[string]float64)
+		for _, word := range ix.completions(term) {
+			postings := ix.postings[word]
+			score := math.Log(1 + float64(len(ix.docs))/float64(len(postings)))
+			if word != term {
+				score *= prefixWeight
+			}
+			for id, weight := range postings {
+				if s := score * weight; s > best[id] {
+					best[id] = s
+				}
+			}
+		}
+		if scores == nil {
+			scores = best
+			continue
+		}
+		for id, score := range scores {
+			if s, ok := best[id]; ok {
+				scores[id] = score + s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, Result{ID: id, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+// IDs returns the IDs of results, in order.
+func IDs(results []Result) []string {
+	ids := make([]string, len(results))
+	for i, r := range results {
+		ids[i] = r.ID
+	}
+	return ids
+}
+
+// sortWords brings the sorted list of words up to date.
+func (ix *Index) sortWords() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.words != nil {
+		return
+	}
+	words := make([]string, 0, len(ix.postings))
+	for word := range ix.postings {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	ix.words = words
+}
+
+// completions returns the indexed words that start with term, term itself
+// among them if it is one. The caller holds ix.mu with the words sorted.
+func (ix *Index) completions(term string) []string {
+	i := sort.SearchStrings(ix.words, term)
+	j := i
+	for j < len(ix.words) && strings.HasPrefix(ix.words[j], term) {
+		j++
+	}
+	return ix.words[i:j]
+}
+
+// Tokenize splits text into the words it is indexed and searched by:
+// runs of letters and digits, lowercased, with a plural's s dropped.
+func Tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range fields {
+		fields[i] = singular(word)
+	}
+	return fields
+}
+
+// singular drops the s of a plural, roughly: "laptops" and "laptop" are
+// the same word, while "glass" and "bus" keep theirs.
+func singular(word string) string {
+	if len(word) <= 3 || !strings.HasSuffix(word, "s") {
+		return word
+	}
+	switch word[len(word)-2] {
+	case 's', 'u', 'i':
+		return word
+	}
+	return word[:len(word)-1]
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// activityRetention is how many activities the log keeps; the oldest go
+// first.
+const activityRetention = 10_000
+
+// Activity is one change to an entity in the audit trail. Before and After
+// summarize it: the fields an update changed, the new entity for a
+// creation, and the old one for a deletion.
+type Activity struct {
+	ID         int64                      `json:"id"`
+	Timestamp  time.Time                  `json:"timestamp"`
+	Actor      string                     `json:"actor,omitempty"` // Empty for background changes
+	Action     string                     `json:"action"`
+	Collection string                     `json:"collection"`
+	EntityID   string                     `json:"entity_id"`
+	Owner      string                     `json:"owner,omitempty"`
+	Summary    string                     `json:"summary"`
+	Before     map[string]json.RawMessage `json:"before,omitempty"`
+	After      map[string]json.RawMessage `json:"after,omitempty"`
+}
+
+// activity records every event as an Activity, in an append-only log each
+// user can read their part of: the changes to their entities.
+type activity struct {
+	events *events
+
+	mu  sync.Mutex
+	log []Activity
+}
+
+func newActivity(e *events) *activity {
+	return &activity{events: e}
+}
+
+func (a *activity) attach(app *fiber.App) {
+	a.events.listen(a.record)
+	app.Get("/api/v1/activity", a.list)
+}
+
+func (a *activity) record(ev Event) {
+	entry := Activity{
+		ID:         ev.ID,
+		Timestamp:  ev.Time,
+		Actor:      ev.Actor,
+		Action:     ev.Action,
+		Collection: ev.Collection,
+		EntityID:   ev.Key,
+		Owner:      ev.Owner,
+	}
+	switch ev.Action {
+	case EventCreated:
+		entry.After = fields(ev.Entity)
+	case EventDeleted:
+		entry.Before = fields(ev.Entity)
+	default:
+		entry.Before, entry.After = changedFields(fields(ev.Before), fields(ev.Entity))
+	}
+	entry.Summary = summarize(entry)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.log = append(a.log, entry)
+	if n := len(a.log) - activityRetention; n > 0 {
+		a.log = slices.Delete(a.log, 0, n)
+	}
+}
+
+// clear forgets the activity so far.
+func (a *activity) clear() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.log = nil
+}
+
+// list responds with the caller's activity, newest first, as a page:
+//
+//	GET /api/v1/activity?email=...&collection=orders&action=updated
+//
+// Users see the changes to the entities they own, whoever made them, and
+// not the changes they made to others'. Admins see everyone's, and can
+// narrow it with actor or owner.
+func (a *activity) list(c *fiber.Ctx) error {
+	email, role, err := caller(c)
+	if err != nil {
+		return err
+	}
+	collection, action := c.Query("collection"), c.Query("action")
+	actor, owner := c.Query("actor"), c.Query("owner")
+	if action != "" && action != EventCreated && action != EventUpdated && action != EventDeleted {
+		return fiber.NewError(fiber.StatusBadRequest, "action must be created, updated or deleted")
+	}
+	if role != RoleAdmin && (actor != "" || owner != "") {
+		return fiber.NewError(fiber.StatusForbidden, "Only admins may filter by actor or owner")
+	}
+
+	a.mu.Lock()
+	entries := make([]Activity, 0, len(a.log))
+	for i := len(a.log) - 1; i >= 0; i-- {
+		entry := a.log[i]
+		switch {
+		case role != RoleAdmin && !strings.EqualFold(entry.Owner, email),
+			collection != "" && !strings.EqualFold(entry.Collection, collection),
+			action != "" && entry.Action != action,
+			actor != "" && !strings.EqualFold(entry.Actor, actor),
+			owner != "" && !strings.EqualFold(entry.Owner, owner):
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	a.mu.Unlock()
+	return List(c, entries)
+}
+
+// fields splits an entity into its fields; anything but an object is one
+// field, "value".
+func fields(raw json.RawMessage) map[string]json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+	var m map[string]json.RawMessage
+	if json.Unmarshal(raw, &m) != nil {
+		return map[string]json.RawMessage{"value": raw}
+	}
+	return m
+}
+
+// changedFields returns the fields that differ between before and after,
+// as they were and as they are.
+func changedFields(before, after map[string]json.RawMessage) (was, is map[string]json.RawMessage) {
+	was, is = make(map[string]json.RawMessage), make(map[string]json.RawMessage)
+	for _, name := range sortedKeys(before, after) {
+		b, hadBefore := before[name]
+		v, hasAfter := after[name]
+		if hadBefore && hasAfter && sameJSON(b, v) {
+			continue
+		}
+		if hadBefore {
+			was[name] = b
+		}
+		if hasAfter {
+			is[name] = v
+		}
+	}
+	return was, is
+}
+
+// summarize describes an activity in a sentence, such as "Updated
+// transfers/tr_1: status from "PENDING" to "COMPLETED"".
+func summarize(entry Activity) string {
+	verb := strings.ToUpper(entry.Action[:1]) + entry.Action[1:]
+	s := fmt.Sprintf("%s %s/%s", verb, entry.Collection, entry.EntityID)
+	if entry.Action != EventUpdated {
+		return s
+	}
+	var changes []string
+	for _, name := range sortedKeys(entry.Before, entry.After) {
+		b, hadBefore := entry.Before[name]
+		v, hasAfter := entry.After[name]
+		switch {
+		case !hadBefore:
+			changes = append(changes, fmt.Sprintf("%s set to %s", name, brief(v)))
+		case !hasAfter:
+			changes = append(changes, name+" removed")
+		default:
+			changes = append(changes, fmt.Sprintf("%s from %s to %s", name, brief(b), brief(v)))
+		}
+	}
+	return s + ": " + strings.Join(changes, ", ")
+}
+
+// brief shortens a JSON value for a summary.
+func brief(raw json.RawMessage) string {
+	const max = 40
+	if r := []rune(string(raw)); len(r) > max {
+		return string(r[:max-3]) + "..."
+	}
+	return string(raw)
+}
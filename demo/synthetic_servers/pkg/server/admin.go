@@ -0,0 +1,406 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// admin serves the endpoints evaluation harnesses use to control a
+// server's state between and within episodes.
+type admin struct {
+	token string
+	base  string // The seed database, whose fixtures admins can load
+	db    Database
+	auth  *authenticator // nil unless the database has users
+
+	faults     *faults
+	latency    *latency         // nil without WithLatency
+	replayer   *replayer        // nil unless replaying a session
+	lifecycles *lifecycleEngine // nil without lifecycles
+	archive    *retention       // nil without retention
+	sandboxes  *sandboxes
+	outbox     *outbox     // nil without an Inbox
+	reviews    *reviewBook // nil without Reviews
+	chats      *chats      // nil without Messaging
+	books      *bookkeeper // nil without Books
+	replays    *idempotency
+	audit      *audit
+	activity   *activity
+	metrics    *metrics
+
+	mu        sync.Mutex
+	seed      string // The seed, or fixture, resets reload
+	fixture   string
+	snapshots map[string]*snapshot
+	nextID    int
+}
+
+// snapshot is a copy of the full database taken through the admin API.
+type snapshot struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int       `json:"size_bytes"`
+	seq       int
+	data      []byte
+}
+
+// snapshotStore serves a snapshot to a database's Load.
+type snapshotStore []byte
+
+func (s snapshotStore) Load() ([]byte, error) { return s, nil }
+func (snapshotStore) Save([]byte) error       { return nil }
+func (snapshotStore) Close() error            { return nil }
+
+func newAdmin(cfg Config, db Database) *admin {
+	fixture := cfg.Fixture
+	if fixture == "" {
+		fixture = FixtureDefault
+	}
+	return &admin{
+		token:     cfg.AdminToken,
+		base:      cfg.DataFile,
+		seed:      cfg.Seed(),
+		fixture:   fixture,
+		db:        db,
+		snapshots: make(map[string]*snapshot),
+		faults:    &faults{},
+	}
+}
+
+// attach mounts the admin endpoints, which require
+// "Authorization: Bearer <token>", with the admin token or the token of a
+// user holding the admin role:
+//
+//	POST   /admin/reset                      Reload the seed database
+//	GET    /admin/fixtures                   The fixtures, and the one loaded
+//	POST   /admin/fixtures/:name/load        Swap the database for a fixture
+//	POST   /admin/snapshots                  Snapshot the database
+//	GET    /admin/snapshots                  List snapshots, oldest first
+//	POST   /admin/snapshots/:id/restore      Roll the database back to a snapshot
+//	DELETE /admin/snapshots/:id              Discard a snapshot
+//	GET    /admin/diff?since=:id             Entities changed since a snapshot
+//	GET    /admin/audit?since=:id            Changes to the database, oldest first
+//	GET    /admin/clock                      The server's clock
+//	POST   /admin/clock/set                  Set the clock
+//	POST   /admin/clock/advance              Fast-forward the clock
+//	GET    /admin/entities                   The collections, and how many entities each holds
+//	GET    /admin/entities/:collection       List a collection's entities
+//	POST   /admin/entities/:collection       Add an entity to a collection
+//	GET    /admin/entities/:collection/:key  Get an entity
+//	PUT    /admin/entities/:collection/:key  Put an entity into a collection
+//	PATCH  /admin/entities/:collection/:key  Change some of an entity's fields
+//	DELETE /admin/entities/:collection/:key  Remove an entity
+//	GET    /admin/deleted                    Soft-deleted entities, latest first
+//	POST   /admin/deleted/restore            Undelete a soft-deleted entity
+//	GET    /admin/stats                      Requests by route, and entities by collection
+//
+// along with those for injecting faults, under /admin/faults, configuring
+// chaos mode, under /admin/chaos, declined payments, under /admin/payments,
+// and latency, under /admin/latency, managing sandboxes, under
+// /admin/sandboxes, steering lifecycles, under /admin/lifecycles, reading
+// archived entities, under /admin/archive, reading what was sent, under
+// /admin/outbox, moderating reviews, under /admin/reviews, writing as the
+// people a server plays in its users' conversations, under
+// /admin/conversations, and checking a bank's books, under /admin/ledger.
+func (a *admin) attach(app *fiber.App) {
+	group := app.Group("/admin", a.authorize)
+	group.Post("/reset", a.reset)
+	group.Get("/fixtures", a.listFixtures)
+	group.Post("/fixtures/:name/load", a.loadFixture)
+	group.Post("/snapshots", a.createSnapshot)
+	group.Get("/snapshots", a.listSnapshots)
+	group.Post("/snapshots/:id/restore", a.restoreSnapshot)
+	group.Delete("/snapshots/:id", a.deleteSnapshot)
+	group.Get("/diff", a.diff)
+	if a.audit != nil {
+		a.audit.attachAdmin(group)
+	}
+	group.Get("/clock", a.getClock)
+	group.Post("/clock/set", a.setClock)
+	group.Post("/clock/advance", a.advanceClock)
+	group.Get("/entities", a.listCollections)
+	group.Get("/entities/:collection", a.listEntities)
+	group.Post("/entities/:collection", a.createEntity)
+	group.Get("/entities/:collection/:key", a.getEntity)
+	group.Put("/entities/:collection/:key", a.putEntity)
+	group.Patch("/entities/:collection/:key", a.patchEntity)
+	group.Delete("/entities/:collection/:key", a.deleteEntity)
+	group.Get("/deleted", a.listDeleted)
+	group.Post("/deleted/restore", a.restoreDeleted)
+	if a.metrics != nil {
+		a.metrics.attachAdmin(group)
+	}
+	a.faults.attachAdmin(group)
+	chaos.attachAdmin(group)
+	attachPaymentsAdmin(group)
+	if a.latency != nil {
+		a.latency.attachAdmin(group)
+	}
+	if a.sandboxes != nil {
+		a.sandboxes.attachAdmin(group)
+	}
+	if a.lifecycles != nil {
+		a.lifecycles.attach(group)
+	}
+	if a.archive != nil {
+		a.archive.attachAdmin(group)
+	}
+	if a.outbox != nil {
+		a.outbox.attachAdmin(group)
+	}
+	if a.reviews != nil {
+		a.reviews.attachAdmin(group)
+	}
+	if a.chats != nil {
+		a.chats.attachAdmin(group)
+	}
+	if a.books != nil {
+		a.books.attachAdmin(group)
+	}
+}
+
+// authorize admits requests with the admin token, or with the token of a
+// user holding the admin role, who is logged as the caller.
+func (a *admin) authorize(c *fiber.Ctx) error {
+	got, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if ok && subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) == 1 {
+		return c.Next()
+	}
+	if ok && a.auth != nil {
+		if email, role, found := a.auth.lookup(got); found {
+			if role != RoleAdmin {
+				return fiber.NewError(fiber.StatusForbidden, "requires the admin role")
+			}
+			c.Locals(localsEmail, email)
+			c.Locals(localsRole, role)
+			return c.Next()
+		}
+	}
+	return fiber.NewError(fiber.StatusUnauthorized, "invalid admin token")
+}
+
+// reset reloads the seed, or the fixture loaded last, discarding every
+// change since startup, the archive, the activity users read, injected
+// faults, payment scenarios, lifecycle overrides and the responses kept
+// for Idempotency-Keys, puts
+// chaos mode and latency back as the command line set them and the clock
+// back on the wall clock. Snapshots and sandboxes are kept.
+func (a *admin) reset(c *fiber.Ctx) error {
+	if err := a.restart(c); err != nil {
+		return err
+	}
+	Logger(c).Info("Database reset", "seed", a.currentSeed())
+	return c.JSON(fiber.Map{"status": "reset"})
+}
+
+// restart does a reset's work.
+func (a *admin) restart(c *fiber.Ctx) error {
+	a.faults.reset()
+	chaos.reset()
+	processor.Reset()
+	if a.latency != nil {
+		a.latency.reset()
+	}
+	if a.replayer != nil {
+		a.replayer.reset()
+	}
+	clock.Reset()
+	idGenerator().Reset()
+	if a.replays != nil {
+		a.replays.clear("")
+	}
+	if err := a.db.replace(c.UserContext(), memoryStore{seed: a.currentSeed()}); err != nil {
+		return err
+	}
+	if a.lifecycles != nil {
+		a.lifecycles.restart(true)
+	}
+	if a.archive != nil {
+		if err := a.archive.clear(); err != nil {
+			return err
+		}
+	}
+	if a.activity != nil {
+		a.activity.clear() // Undoing the session isn't anyone's activity
+	}
+	return nil
+}
+
+func (a *admin) currentSeed() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seed
+}
+
+func (a *admin) createSnapshot(c *fiber.Ctx) error {
+	data, err := a.db.encode(c.UserContext())
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nextID++
+	snap := &snapshot{
+		ID:        fmt.Sprintf("snap_%d", a.nextID),
+		CreatedAt: time.Now(),
+		Size:      len(data),
+		seq:       a.nextID,
+		data:      data,
+	}
+	a.snapshots[snap.ID] = snap
+	return c.Status(fiber.StatusCreated).JSON(snap)
+}
+
+// sandboxSource returns the database a sandbox starts from: "live" for the
+// live one, "seed" for the seed, or a snapshot's ID.
+func (a *admin) sandboxSource(ctx context.Context, from string) ([]byte, error) {
+	switch from {
+	case "live":
+		return a.db.encode(ctx)
+	case "seed":
+		return memoryStore{seed: a.currentSeed()}.Load()
+	}
+	snap, err := a.lookup(from)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "from must be live, seed or a snapshot ID")
+	}
+	return snap.data, nil
+}
+
+func (a *admin) listSnapshots(c *fiber.Ctx) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	snaps := make([]*snapshot, 0, len(a.snapshots))
+	for _, snap := range a.snapshots {
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].seq < snaps[j].seq
+	})
+	return c.JSON(snaps)
+}
+
+func (a *admin) lookup(id string) (*snapshot, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	snap, ok := a.snapshots[id]
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusNotFound, "snapshot not found")
+	}
+	return snap, nil
+}
+
+// restoreSnapshot rolls the database back to a snapshot, which stays
+// available so a scenario can branch from it again. Entities start their
+// lifecycles afresh.
+func (a *admin) restoreSnapshot(c *fiber.Ctx) error {
+	snap, err := a.lookup(c.Params("id"))
+	if err != nil {
+		return err
+	}
+	if err := a.db.replace(c.UserContext(), snapshotStore(snap.data)); err != nil {
+		return err
+	}
+	if a.lifecycles != nil {
+		a.lifecycles.restart(false)
+	}
+	if a.replays != nil {
+		a.replays.clear("")
+	}
+	Logger(c).Info("Database restored", "snapshot", snap.ID)
+	return c.JSON(snap)
+}
+
+func (a *admin) deleteSnapshot(c *fiber.Ctx) error {
+	snap, err := a.lookup(c.Params("id"))
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	delete(a.snapshots, snap.ID)
+	a.mu.Unlock()
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// diff reports the entities created, updated and deleted since a snapshot,
+// grouped by collection. Unchanged collections are left out.
+func (a *admin) diff(c *fiber.Ctx) error {
+	id := c.Query("since")
+	if id == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "since parameter is required")
+	}
+	snap, err := a.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	data, err := a.db.encode(c.UserContext())
+	if err != nil {
+		return err
+	}
+	diffs, err := diffDatabases(snap.data, data)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{
+		"since":       snap.ID,
+		"collections": diffs,
+	})
+}
+
+func (a *admin) getClock(c *fiber.Ctx) error {
+	return c.JSON(clockState())
+}
+
+// setClock moves the clock to a time, from where it keeps running unless
+// frozen:
+//
+//	POST /admin/clock/set {"time": "2025-03-01T09:00:00Z", "frozen": true}
+func (a *admin) setClock(c *fiber.Ctx) error {
+	var req struct {
+		Time   time.Time `json:"time"`
+		Frozen bool      `json:"frozen"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Time.IsZero() {
+		return fiber.NewError(fiber.StatusBadRequest, "time is required, as RFC 3339")
+	}
+	clock.Set(req.Time, req.Frozen)
+	Logger(c).Info("Clock set", "time", req.Time, "frozen", req.Frozen)
+	return c.JSON(clockState())
+}
+
+// advanceClock moves the clock forward by a duration, such as "90m" or
+// "72h":
+//
+//	POST /admin/clock/advance {"duration": "72h"}
+func (a *admin) advanceClock(c *fiber.Ctx) error {
+	var req struct {
+		Duration string `json:"duration"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		return fiber.NewError(fiber.StatusBadRequest, `duration must be positive, such as "90m" or "72h"`)
+	}
+	clock.Advance(d)
+	Logger(c).Info("Clock advanced", "duration", d.String())
+	return c.JSON(clockState())
+}
+
+func clockState() fiber.Map {
+	return fiber.Map{
+		"now":            clock.Now(),
+		"offset_seconds": clock.Offset().Seconds(),
+		"frozen":         clock.Frozen(),
+	}
+}
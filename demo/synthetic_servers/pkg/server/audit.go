@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// auditRetention is how many audit entries are kept in memory; the audit
+// file, if there is one, keeps them all.
+const auditRetention = 10_000
+
+// AuditEntry is one mutation of an entity, with the entity whole as it was
+// and as it became, and the difference between them.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	Time       time.Time       `json:"time"`
+	Actor      string          `json:"actor,omitempty"` // Empty for background changes
+	Operation  string          `json:"operation"`       // EventCreated, EventUpdated or EventDeleted
+	EntityType string          `json:"entity_type"`     // The entity's collection, such as orders
+	EntityID   string          `json:"entity_id"`
+	Owner      string          `json:"owner,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"` // Absent for a creation
+	After      json.RawMessage `json:"after,omitempty"`  // Absent for a deletion
+	Diff       []Change        `json:"diff"`
+}
+
+// Change is one difference between two JSON documents, at a JSON Pointer
+// path such as /address/city. Objects are compared field by field;
+// anything else, arrays among them, is replaced whole.
+type Change struct {
+	Op     string          `json:"op"` // add, remove or replace
+	Path   string          `json:"path"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// audit is the write-ahead log of every mutation to the live database. The
+// journal tells it of each change as a repository is about to make it,
+// credited to the request or job making it, and it appends the entry to
+// its file, if it has one, as a JSON line before the change is made. That
+// includes the changes of an atomic batch, before it commits: a batch
+// rolled back is audited with its undoing. The persister syncs the file
+// before saving a snapshot, so no saved change goes unaudited. Sandboxed
+// changes aren't audited.
+type audit struct {
+	journal *journal
+	private map[string]bool
+
+	mu   sync.Mutex
+	file *os.File // nil without --audit-log
+	seq  int64
+	log  []AuditEntry
+}
+
+// newAudit opens the audit log at path, picking up where the entries
+// already in it leave off. Without a path it only keeps entries in memory.
+func newAudit(db Database, path string) (*audit, error) {
+	a := &audit{journal: db.journal, private: make(map[string]bool)}
+	for _, name := range db.Private {
+		a.private[name] = true
+	}
+	if path == "" {
+		return a, nil
+	}
+	if err := a.load(path); err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	a.file = f
+	return a, nil
+}
+
+// load reads the entries already in the file at path, keeping the latest.
+func (a *audit) load(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		a.seq = max(a.seq, entry.ID)
+		a.append(entry)
+	}
+	return scanner.Err()
+}
+
+func (a *audit) attach(app *fiber.App) {
+	a.journal.listenAhead(a.record)
+	if a.file != nil {
+		app.Hooks().OnShutdown(func() error {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			f := a.file
+			a.file = nil
+			return f.Close()
+		})
+	}
+}
+
+// attachAdmin mounts the audit log under the admin group:
+//
+//	GET /admin/audit?since=:id&entity_type=orders&operation=updated
+//
+// It lists the kept entries after since, oldest first, as a page, and like
+// other lists filters on their fields, such as entity_id and actor.
+func (a *audit) attachAdmin(group fiber.Router) {
+	group.Get("/audit", a.list)
+}
+
+func (a *audit) record(ch change) {
+	ev, ok := newEvent(ch, a.private)
+	if !ok {
+		return
+	}
+	entry := AuditEntry{
+		Time:       ev.Time,
+		Actor:      ev.Actor,
+		Operation:  ev.Action,
+		EntityType: ev.Collection,
+		EntityID:   ev.Key,
+		Owner:      ev.Owner,
+	}
+	switch ev.Action {
+	case EventCreated:
+		entry.After = compact(ev.Entity)
+	case EventDeleted:
+		entry.Before = compact(ev.Entity)
+	default:
+		entry.Before, entry.After = compact(ev.Before), compact(ev.Entity)
+	}
+	entry.Diff = diffJSON("", entry.Before, entry.After, []Change{})
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq++
+	entry.ID = a.seq
+	if a.file != nil {
+		if err := a.write(entry); err != nil {
+			log.Printf("Audit log: %v", err)
+		}
+	}
+	a.append(entry)
+}
+
+// write appends entry to the file. The caller holds a.mu.
+func (a *audit) write(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// append keeps entry in memory. The caller holds a.mu.
+func (a *audit) append(entry AuditEntry) {
+	a.log = append(a.log, entry)
+	if n := len(a.log) - auditRetention; n > 0 {
+		a.log = slices.Delete(a.log, 0, n)
+	}
+}
+
+// sync flushes the file to disk, ahead of the database being saved. The
+// caller holds live for reading.
+func (a *audit) sync(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Sync()
+}
+
+func (a *audit) list(c *fiber.Ctx) error {
+	since := c.QueryInt("since")
+	if since < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "since must be an audit entry id")
+	}
+
+	a.mu.Lock()
+	i, _ := slices.BinarySearchFunc(a.log, int64(since)+1, func(entry AuditEntry, id int64) int {
+		return int(entry.ID - id)
+	})
+	entries := slices.Clone(a.log[i:])
+	a.mu.Unlock()
+	return List(c, entries, "since")
+}
+
+// compact returns raw without insignificant space, as it is written to the
+// audit file; nil stays nil.
+func compact(raw json.RawMessage) json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if json.Compact(&buf, raw) != nil {
+		return raw
+	}
+	return buf.Bytes()
+}
+
+// diffJSON appends the changes that turn before into after, below path, to
+// changes. A missing document is nothing, so a created entity's fields are
+// all added and a deleted one's all removed.
+func diffJSON(path string, before, after json.RawMessage, changes []Change) []Change {
+	switch {
+	case before == nil && after == nil:
+		return changes
+	case sameJSON(before, after):
+		return changes
+	}
+	a, aObject := object(before)
+	b, bObject := object(after)
+	switch {
+	case aObject && bObject:
+		for _, name := range sortedKeys(a, b) {
+			changes = diffJSON(path+"/"+escapePointer(name), a[name], b[name], changes)
+		}
+		return changes
+	case before == nil:
+		return append(changes, Change{Op: "add", Path: path, After: after})
+	case after == nil:
+		return append(changes, Change{Op: "remove", Path: path, Before: before})
+	}
+	return append(changes, Change{Op: "replace", Path: path, Before: before, After: after})
+}
+
+// object decodes raw as a JSON object; a missing document is an empty one.
+func object(raw json.RawMessage) (map[string]json.RawMessage, bool) {
+	if raw == nil {
+		return map[string]json.RawMessage{}, true
+	}
+	var m map[string]json.RawMessage
+	if json.Unmarshal(raw, &m) != nil || m == nil {
+		return nil, false
+	}
+	return m, true
+}
+
+// escapePointer escapes a field name for a JSON Pointer.
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Auth is the authentication state a server keeps in its database by
+// embedding it:
+//
+//	type Database struct {
+//		server.Auth `json:"auth"`
+//		...
+//	}
+//
+// Embedding puts it under the database's lock and in its snapshots.
+type Auth struct {
+	Tokens      map[string]string     `json:"tokens"`      // API token -> user email
+	Credentials map[string]Credential `json:"credentials"` // By lowercased email
+	Sessions    map[string]Session    `json:"sessions"`    // By access token
+	Roles       map[string]string     `json:"roles"`       // By lowercased email; RoleConsumer if absent
+}
+
+// Roles a user can hold. Partners run a business on the service, such as
+// a studio or restaurant; admins run the service itself and may do
+// anything a partner can.
+const (
+	RoleConsumer = "consumer"
+	RolePartner  = "partner"
+	RoleAdmin    = "admin"
+)
+
+// role returns the role email holds.
+func (a *Auth) role(email string) string {
+	if role, ok := a.Roles[strings.ToLower(email)]; ok {
+		return role
+	}
+	return RoleConsumer
+}
+
+// Credential is a user's login, created by registration or seeded.
+type Credential struct {
+	Email        string    `json:"email"`
+	Name         string    `json:"name,omitempty"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Session is a login. Its access token expires after sessionTTL, after
+// which the refresh token trades it for a new session until refreshTTL.
+type Session struct {
+	Email            string    `json:"email"`
+	AccessToken      string    `json:"access_token"`
+	RefreshToken     string    `json:"refresh_token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+func (a *Auth) authState() *Auth { return a }
+
+type authenticated interface {
+	authState() *Auth
+}
+
+// authenticator derives the caller's identity from their bearer token,
+// either a seeded API token or a session's access token. Handlers still
+// read the email query parameter (or X-User-Email), which it fills in from
+// the token; an identity the client supplies itself, there, in the path or
+// in a write's body, must match the token's. When required, writes to the
+// API need a token whether or not they name a user. Unless required,
+// requests without a token keep their claimed identity.
+type authenticator struct {
+	db       Database
+	required bool
+}
+
+func (a *authenticator) attach(app *fiber.App) {
+	app.Use(a.authenticate)
+}
+
+// routes adds the endpoints for signing in and out.
+func (a *authenticator) routes(app *fiber.App) {
+	auth := app.Group("/api/v1/auth")
+	auth.Post("/register", a.register)
+	auth.Post("/login", a.login)
+	auth.Post("/refresh", a.refresh)
+	auth.Post("/logout", a.logout)
+	app.Get("/api/v1/me", a.me)
+}
+
+func (a *authenticator) authenticate(c *fiber.Ctx) error {
+	c.Locals(localsRequired, a.required)
+	claims := identityClaims(c)
+	body := bodyIdentities(c)
+	for _, name := range identityFields {
+		if claim, ok := body[name]; ok {
+			claims = append(claims, claim)
+		}
+	}
+	header := c.Get(fiber.HeaderAuthorization)
+	if header == "" {
+		if !a.required || len(claims) == 0 && !apiWrite(c) {
+			return c.Next()
+		}
+		return fiber.NewError(fiber.StatusUnauthorized, "authorization required")
+	}
+
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "authorization must be a bearer token")
+	}
+	email, role, ok := a.lookup(token)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid token")
+	}
+	for _, claim := range claims {
+		if !strings.EqualFold(claim, email) {
+			return fiber.NewError(fiber.StatusForbidden, "token does not belong to "+claim)
+		}
+	}
+
+	c.Request().URI().QueryArgs().Set("email", email)
+	c.Request().Header.Set("X-User-Email", email)
+	if err := setBodyIdentity(c, body, email); err != nil {
+		return err
+	}
+	c.Locals(localsToken, token)
+	c.Locals(localsEmail, email)
+	c.Locals(localsRole, role)
+	return c.Next()
+}
+
+// Caller returns the email of the user whose token a request bears, or ""
+// if it bears none, as servers that don't require authentication allow.
+// Handlers check that what a request acts as by ID, such as a caregiver,
+// belongs to the caller with Owns, since only emails are checked for them.
+func Caller(c *fiber.Ctx) string {
+	email, _ := c.Locals(localsEmail).(string)
+	return email
+}
+
+// lookup returns the user a token belongs to and their role.
+func (a *authenticator) lookup(token string) (email, role string, ok bool) {
+	state, unlock := a.state(false)
+	defer unlock()
+	if email, ok := state.Tokens[token]; ok {
+		return email, state.role(email), true
+	}
+	if s, ok := state.Sessions[token]; ok && Now().Before(s.ExpiresAt) {
+		return s.Email, state.role(s.Email), true
+	}
+	return "", "", false
+}
+
+// RequireRole admits only callers holding one of roles, or admins, to the
+// routes it guards:
+//
+//	api.Post("/menus/:id/items", server.RequireRole(server.RolePartner), addMenuItem)
+//
+// When the server doesn't require authentication, unauthenticated callers
+// are let through as before.
+func RequireRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		role, ok := c.Locals(localsRole).(string)
+		if !ok {
+			if required, _ := c.Locals(localsRequired).(bool); !required {
+				return c.Next()
+			}
+			return fiber.NewError(fiber.StatusUnauthorized, "authorization required")
+		}
+		if role == RoleAdmin || slices.Contains(roles, role) {
+			return c.Next()
+		}
+		return fiber.NewError(fiber.StatusForbidden,
+			fmt.Sprintf("requires the %s role", strings.Join(roles, " or ")))
+	}
+}
+
+// state locks the database, for writing if write is set, and returns its
+// Auth along with the matching unlock.
+func (a *authenticator) state(write bool) (*Auth, func()) {
+	v, mu := a.db.Current()
+	unlock := func() {}
+	switch {
+	case mu == nil:
+	case write:
+		mu.Lock()
+		unlock = mu.Unlock
+	default:
+		mu.RLock()
+		unlock = mu.RUnlock
+	}
+	return v.(authenticated).authState(), unlock
+}
+
+// identityClaims returns the user emails a request names: the email query
+// parameter, X-User-Email, and path segments such as /users/:email.
+func identityClaims(c *fiber.Ctx) []string {
+	var claims []string
+	if email := c.Query("email"); email != "" {
+		claims = append(claims, email)
+	}
+	if email := c.Get("X-User-Email"); email != "" {
+		claims = append(claims, email)
+	}
+	for _, segment := range strings.Split(c.Path(), "/") {
+		if s, err := url.PathUnescape(segment); err == nil && strings.Contains(s, "@") {
+			claims = append(claims, s)
+		}
+	}
+	return claims
+}
+
+// identityFields are the fields of a write's body that name the user it
+// acts as. A body's email does too, but only without any of these, since
+// beside them it is someone else's, such as a recipient's.
+var identityFields = []string{"user_email", "userEmail", "owner_email", "client_email", "passenger_email", "sender_email", "from_email", "author_email", "reviewer_email", "admin_email", "email"}
+
+// bodyIdentities returns the identity fields a write's JSON body has,
+// and the emails they hold. Signing in takes an email that isn't one.
+func bodyIdentities(c *fiber.Ctx) map[string]string {
+	if !isWrite(c.Method()) || signingIn(c.Path()) || !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(c.Body(), &fields) != nil {
+		return nil
+	}
+	found := make(map[string]string)
+	for _, name := range identityFields {
+		var email string
+		if name == "email" && len(found) > 0 {
+			break
+		}
+		if json.Unmarshal(fields[name], &email) == nil && email != "" {
+			found[name] = email
+		}
+	}
+	return found
+}
+
+// setBodyIdentity makes the identity fields of a write's body, which match
+// email but for case, email exactly, so handlers act as the token's user.
+func setBodyIdentity(c *fiber.Ctx, body map[string]string, email string) error {
+	changed := false
+	for _, claim := range body {
+		changed = changed || claim != email
+	}
+	if !changed {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &fields); err != nil {
+		return err
+	}
+	for name := range body {
+		fields[name], _ = json.Marshal(email)
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	c.Request().SetBody(data)
+	return nil
+}
+
+// signInPaths are the routes for signing in, which take no token, and
+// whose body's email is the one to sign in as.
+var signInPaths = []string{"/api/v1/auth/register", "/api/v1/auth/login", "/api/v1/auth/refresh"}
+
+// apiWrite reports whether a request may change something through the
+// API, other than signing in and batches, whose operations are checked one
+// by one as they are carried out.
+func apiWrite(c *fiber.Ctx) bool {
+	path := strings.TrimSuffix(c.Path(), "/")
+	return isWrite(c.Method()) && strings.HasPrefix(path, "/api/") && !signingIn(path) && path != batchPath
+}
+
+func isWrite(method string) bool {
+	switch method {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return false
+	}
+	return true
+}
+
+func signingIn(path string) bool {
+	return slices.Contains(signInPaths, strings.TrimSuffix(path, "/"))
+}
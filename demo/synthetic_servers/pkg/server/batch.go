@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// batchPath is where batches are POSTed.
+const batchPath = "/api/v1/batch"
+
+// localsBatch is the Fiber local marking a request as an operation of an
+// atomic batch, which holds its database's lock for it.
+const localsBatch = "batch"
+
+// live is held for reading by everything that uses the live database,
+// requests and background jobs alike, and for writing by an atomic batch,
+// so nothing else sees the database until the batch is done. A sandbox has
+// a lock of its own, for its requests and batches.
+var live sync.RWMutex
+
+// BatchRequest is a batch of up to 50 API requests, carried out in order:
+//
+//	POST /api/v1/batch
+//	{"operations": [
+//	  {"method": "POST", "path": "/api/v1/cart", "body": {"product_id": "p1", "quantity": 2}},
+//	  {"method": "GET", "path": "/api/v1/cart?email=..."}
+//	]}
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations" validate:"required,min=1,max=50"`
+	// Atomic, the default, undoes the whole batch if an operation fails.
+	Atomic *bool `json:"atomic,omitempty"`
+}
+
+// BatchOperation is one request in a batch. It is sent with the batch's
+// headers, so with its token and X-Sandbox-ID.
+type BatchOperation struct {
+	Method string          `json:"method" validate:"required,oneof=GET POST PUT PATCH DELETE"`
+	Path   string          `json:"path" validate:"required"` // Under /api/, with any query
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// BatchResponse is how a batch's operations went, in order.
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+	// RolledBack is set when an operation of an atomic batch failed: the
+	// operations before it were undone, and those after it not carried
+	// out, so results ends with the failure.
+	RolledBack bool `json:"rolled_back"`
+}
+
+// BatchResult is an operation's response. A body that isn't JSON, such as
+// an export's, is a string.
+type BatchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// batch carries out batches of API requests through a loopback, so that
+// each goes through the middleware and handler it would on its own.
+type batch struct {
+	app       *loopback
+	db        Database
+	sandboxes *sandboxes
+}
+
+// attachBatch serves batches at /api/v1/batch. Like GraphQL, it goes ahead
+// of the middleware its operations go through.
+//
+// An atomic batch holds live for writing, or its sandbox's lock, so
+// nothing else sees the database until it is done. Its changes are held
+// back in the journal and published as events, credited to its caller,
+// once they have all been made; if an operation fails, the database, or
+// the sandbox's, is put back as it was before the first, and nothing is
+// published.
+func attachBatch(app *fiber.App, db Database, s *sandboxes) {
+	b := &batch{app: newLoopback(app), db: db, sandboxes: s}
+	app.Post(batchPath, b.serve)
+}
+
+// batched reports whether a request is an operation of an atomic batch.
+func batched(c *fiber.Ctx) bool {
+	held, _ := c.Locals(localsBatch).(bool)
+	return held
+}
+
+func (b *batch) serve(c *fiber.Ctx) error {
+	var req BatchRequest
+	if err := Bind(c, &req); err != nil {
+		return err
+	}
+	var errs []FieldError
+	for i, op := range req.Operations {
+		path, _, _ := strings.Cut(op.Path, "?")
+		switch {
+		case !strings.HasPrefix(path, "/api/"):
+			errs = append(errs, FieldError{Field: fmt.Sprintf("operations[%d].path", i), Message: "must be under /api/"})
+		case path == batchPath, path == "/api/v1/events/stream":
+			errs = append(errs, FieldError{Field: fmt.Sprintf("operations[%d].path", i), Message: "can't be batched"})
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+
+	var header fasthttp.RequestHeader
+	c.Request().Header.CopyTo(&header)
+	for _, h := range []string{fiber.HeaderContentType, fiber.HeaderContentLength, fiber.HeaderAcceptEncoding, HeaderIdempotencyKey} {
+		header.Del(h)
+	}
+	header.Set(HeaderRequestID, RequestID(c))
+
+	atomic := req.Atomic == nil || *req.Atomic
+	var locals map[string]any
+	var sb *sandbox
+	var before []byte
+	if atomic {
+		if id := c.Get(HeaderSandboxID); id != "" {
+			if sb = b.sandboxes.use(id); sb == nil {
+				return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("%s: no sandbox %q", HeaderSandboxID, id))
+			}
+		}
+		lock := &live
+		if sb != nil {
+			lock = &sb.using
+		}
+		if err := Lock(c.UserContext(), lock); err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		var err error
+		if before, err = b.encode(c.UserContext(), sb); err != nil {
+			return err
+		}
+		locals = map[string]any{localsBatch: true}
+		if sb != nil {
+			locals[localsSandbox] = sb
+		} else {
+			b.db.journal.begin()
+			defer b.db.journal.discard()
+		}
+	}
+
+	resp := BatchResponse{Results: make([]BatchResult, 0, len(req.Operations))}
+	actor := ""
+	for _, op := range req.Operations {
+		sub := &fasthttp.Request{}
+		header.CopyTo(&sub.Header)
+		sub.Header.SetMethod(op.Method)
+		sub.SetRequestURI(op.Path)
+		if len(op.Body) > 0 {
+			sub.Header.SetContentType(fiber.MIMEApplicationJSON)
+			sub.SetBody(op.Body)
+		}
+		rc := b.app.serve(sub, c.Context().RemoteAddr(), locals)
+		result := BatchResult{Status: rc.Response.StatusCode()}
+		if body := rc.Response.Body(); json.Valid(body) {
+			result.Body = append(json.RawMessage(nil), body...)
+		} else if len(body) > 0 {
+			result.Body, _ = json.Marshal(string(body))
+		}
+		resp.Results = append(resp.Results, result)
+		if actor == "" {
+			actor, _ = rc.UserValue(localsEmail).(string)
+		}
+		if atomic && result.Status >= fiber.StatusBadRequest {
+			resp.RolledBack = true
+			break
+		}
+	}
+
+	switch {
+	case !atomic:
+	case resp.RolledBack:
+		// Its undoing is audited, credited to its caller.
+		prev := b.db.journal.by.Swap(&credit{actor: actor, requestID: RequestID(c)})
+		defer b.db.journal.by.Store(prev)
+		if err := b.restore(c.UserContext(), sb, before); err != nil {
+			return fmt.Errorf("rolling back the batch: %w", err)
+		}
+		Logger(c).Info("Batch rolled back", "operations", len(req.Operations), "failed", len(resp.Results)-1)
+	case sb == nil:
+		b.db.journal.commit()
+	}
+	return c.JSON(resp)
+}
+
+// encode snapshots the database a batch runs against: the live one, or
+// sb's. The caller holds its lock for writing.
+func (b *batch) encode(ctx context.Context, sb *sandbox) ([]byte, error) {
+	if sb != nil {
+		return sb.db.encode(ctx)
+	}
+	return b.db.encode(ctx)
+}
+
+// restore puts the database a batch ran against back as data, its
+// snapshot from before, telling its journal of the undoing. The caller
+// holds its lock for writing.
+func (b *batch) restore(ctx context.Context, sb *sandbox, data []byte) error {
+	if sb != nil {
+		return sb.db.replace(ctx, snapshotStore(data))
+	}
+	return b.db.replace(ctx, snapshotStore(data))
+}
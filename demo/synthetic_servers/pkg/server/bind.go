@@ -0,0 +1,341 @@
+package server
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/geo"
+	"pkg/money"
+)
+
+// Limits on request fields whose validate tags don't set their own.
+const (
+	MaxStringLength = 10000 // Characters in a string
+	MaxCount        = 10000 // A count, such as a quantity, which mustn't be negative either
+)
+
+// countWords name the fields that count things, as their JSON names or the
+// ends of them, like quantity or party_size.
+var countWords = []string{"quantity", "qty", "servings", "guests", "party_size", "adults", "children", "passengers", "travelers", "tickets", "seats", "nights", "rooms"}
+
+// textWords name the fields of free text that HTML is stripped from, as
+// their JSON names or the ends of them, like description or review_text.
+var textWords = []string{"description", "review", "text", "comment", "comments", "body", "content", "message", "note", "notes", "bio", "about", "instructions", "title", "subject", "caption", "summary", "headline", "reason", "feedback"}
+
+var (
+	htmlBlocks = regexp.MustCompile(`(?is)<(script|style)\b.*?(</(script|style)\s*>|$)`)
+	htmlTags   = regexp.MustCompile(`(?s)<!--.*?-->|</?[a-zA-Z][^>]*>`)
+)
+
+// FieldError is one request field that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a request that failed validation.
+// ErrorHandler reports it as 422 VALIDATION_FAILED with the fields as its
+// details.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Field + " " + fe.Message
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+// Bind parses the request body into v and validates it, returning a 400
+// for a body that doesn't parse and a *ValidationError for one that breaks
+// the rules in v's validate tags.
+func Bind(c *fiber.Ctx, v any) error {
+	if err := c.BodyParser(v); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+	return Validate(v)
+}
+
+// Validate checks a struct against the comma-separated rules in its
+// fields' validate tags, descending into nested structs and slices:
+//
+//	required     not the zero value
+//	omitempty    skip the other rules when the field is the zero value
+//	email        a valid email address
+//	date         a YYYY-MM-DD date
+//	datetime     an RFC 3339 timestamp
+//	timezone     an IANA time zone, such as America/New_York
+//	min=N max=N  bounds on a number, or on the length of a string or slice
+//	gt=N gte=N   lower bounds on a number
+//	oneof=a b c  one of the listed values
+//
+// Amounts of money are bounded in units of their currency, so gt=0 on a
+// price refuses 0.00. Fields are named by their json tags in the errors.
+//
+// Fields without rules of their own are held to sane ones: strings to
+// MaxStringLength characters, and counts, such as quantity or servings, to
+// between 0 and MaxCount. Scripts and HTML tags are stripped from free
+// text, such as descriptions and reviews, before the rules are checked,
+// which changes v if it is a pointer.
+func Validate(v any) error {
+	var errs []FieldError
+	validateValue(reflect.ValueOf(v), "", &errs)
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+func validateValue(v reflect.Value, path string, errs *[]FieldError) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := fieldName(field)
+			if name == "-" {
+				continue
+			}
+			if field.Anonymous && field.Tag.Get("json") == "" {
+				name = "" // Promoted fields
+			}
+			fv := v.Field(i)
+			fpath := joinPath(path, name)
+			if namedBy(name, textWords) {
+				stripHTML(fv)
+			}
+			tag, ok := field.Tag.Lookup("validate")
+			if ok {
+				if msg := checkRules(fv, tag); msg != "" {
+					*errs = append(*errs, FieldError{Field: fpath, Message: msg})
+					continue
+				}
+			}
+			if msg := checkLimits(fv, name, tag); msg != "" {
+				*errs = append(*errs, FieldError{Field: fpath, Message: msg})
+				continue
+			}
+			validateValue(fv, fpath, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	}
+}
+
+// checkRules returns why v breaks one of the rules in tag, or "" if it
+// keeps them all.
+func checkRules(v reflect.Value, tag string) string {
+	rules := strings.Split(tag, ",")
+	set := !v.IsZero() // A pointer to a zero value is set
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			if slices.Contains(rules, "required") {
+				return "is required"
+			}
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	for _, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "":
+		case "omitempty":
+			if !set {
+				return ""
+			}
+		case "required":
+			if !set {
+				return "is required"
+			}
+		case "email":
+			if s := v.String(); s != "" {
+				if addr, err := mail.ParseAddress(s); err != nil || addr.Address != s {
+					return "must be a valid email address"
+				}
+			}
+		case "date":
+			if s := v.String(); s != "" {
+				if _, err := time.Parse("2006-01-02", s); err != nil {
+					return "must be a date in YYYY-MM-DD format"
+				}
+			}
+		case "datetime":
+			if s := v.String(); s != "" {
+				if _, err := time.Parse(time.RFC3339, s); err != nil {
+					return "must be an RFC 3339 timestamp"
+				}
+			}
+		case "timezone":
+			if s := v.String(); s != "" && !geo.ValidZone(s) {
+				return "must be an IANA time zone, such as America/New_York"
+			}
+		case "oneof":
+			options := strings.Fields(arg)
+			if s := fmt.Sprint(v.Interface()); !slices.Contains(options, s) {
+				return "must be one of " + strings.Join(options, ", ")
+			}
+		case "min", "max", "gt", "gte":
+			if msg := checkBound(v, name, arg); msg != "" {
+				return msg
+			}
+		default:
+			panic(fmt.Sprintf("server: unknown validation rule %q", rule))
+		}
+	}
+	return ""
+}
+
+func checkBound(v reflect.Value, rule, arg string) string {
+	bound, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		panic(fmt.Sprintf("server: bad bound in validation rule %s=%s", rule, arg))
+	}
+
+	var n float64
+	unit := "" // What a length counts; empty for numbers
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = v.Float()
+	case reflect.Struct:
+		m, ok := v.Interface().(money.Money)
+		if !ok {
+			return ""
+		}
+		n = m.Float()
+	case reflect.String:
+		n, unit = float64(len([]rune(v.String()))), "characters"
+	case reflect.Slice, reflect.Map, reflect.Array:
+		n, unit = float64(v.Len()), "items"
+	default:
+		return ""
+	}
+
+	switch {
+	case rule == "min" && unit != "" && n < bound:
+		return fmt.Sprintf("must have at least %s %s", arg, unit)
+	case rule == "max" && unit != "" && n > bound:
+		return fmt.Sprintf("must have at most %s %s", arg, unit)
+	case rule == "min" && n < bound, rule == "gte" && n < bound:
+		return "must be at least " + arg
+	case rule == "max" && n > bound:
+		return "must be at most " + arg
+	case rule == "gt" && n <= bound:
+		return "must be greater than " + arg
+	}
+	return ""
+}
+
+// checkLimits returns why v, the field called name, breaks the limits on
+// fields whose rules in tag don't set their own, or "" if it doesn't.
+func checkLimits(v reflect.Value, name, tag string) string {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	bounded := func(rules ...string) bool {
+		for _, rule := range strings.Split(tag, ",") {
+			r, _, _ := strings.Cut(rule, "=")
+			if slices.Contains(rules, r) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if !bounded("max") && len([]rune(v.String())) > MaxStringLength {
+			return fmt.Sprintf("must have at most %d characters", MaxStringLength)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if !namedBy(name, countWords) {
+			return ""
+		}
+		if !bounded("min", "gt", "gte") {
+			if msg := checkBound(v, "min", "0"); msg != "" {
+				return msg
+			}
+		}
+		if !bounded("max") {
+			return checkBound(v, "max", strconv.Itoa(MaxCount))
+		}
+	}
+	return ""
+}
+
+// stripHTML removes scripts, styles and HTML tags from v, a string field,
+// if it can be set.
+func stripHTML(v reflect.Value) {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.String || !v.CanSet() || !strings.Contains(v.String(), "<") {
+		return
+	}
+	s := htmlBlocks.ReplaceAllString(v.String(), "")
+	v.SetString(strings.TrimSpace(htmlTags.ReplaceAllString(s, "")))
+}
+
+// namedBy reports whether a field's JSON name is one of words, or ends in
+// one after an underscore.
+func namedBy(name string, words []string) bool {
+	for _, w := range words {
+		if name == w || strings.HasSuffix(name, "_"+w) {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func joinPath(path, name string) string {
+	switch {
+	case path == "":
+		return name
+	case name == "":
+		return path
+	}
+	return path + "." + name
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// valuesBucket holds the database's top-level values that aren't
+// collections, such as a list of plans, by field name. JSON field names
+// don't start with $, so no collection's bucket is named the same.
+var valuesBucket = []byte("$values")
+
+// boltStore keeps the database in a bbolt file: each top-level object, such
+// as a map of orders, in a bucket of its own with an entry per key, and the
+// other top-level values in valuesBucket. Repositories put and delete
+// their entities as they change them, and a save writes only the entries
+// that differ, so a large database is never rewritten whole.
+type boltStore struct {
+	db   *bolt.DB
+	path string
+	seed string
+}
+
+// openBolt opens the bbolt file at path, making it if it doesn't exist. It
+// fails rather than wait if another server has it open.
+func openBolt(path, seed string) (*boltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s: in use by another server", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &boltStore{db: db, path: path, seed: seed}, nil
+}
+
+// boltPath is where the bolt backend keeps the database by default: next
+// to the seed, as database.db for database.json.
+func boltPath(seed string) string {
+	return strings.TrimSuffix(seed, filepath.Ext(seed)) + ".db"
+}
+
+// Load assembles the database from the buckets, or migrates the seed into
+// them if there are none yet.
+func (s *boltStore) Load() ([]byte, error) {
+	var buf bytes.Buffer
+	empty := true
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf.WriteByte('{')
+		first := true
+		field := func(name []byte) {
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			key, _ := json.Marshal(string(name))
+			buf.Write(key)
+			buf.WriteByte(':')
+		}
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			empty = false
+			if bytes.Equal(name, valuesBucket) {
+				return b.ForEach(func(k, v []byte) error {
+					field(k)
+					buf.Write(v)
+					return nil
+				})
+			}
+			field(name)
+			buf.WriteByte('{')
+			n := 0
+			err := b.ForEach(func(k, v []byte) error {
+				if n > 0 {
+					buf.WriteByte(',')
+				}
+				n++
+				key, _ := json.Marshal(string(k))
+				buf.Write(key)
+				buf.WriteByte(':')
+				buf.Write(v)
+				return nil
+			})
+			buf.WriteByte('}')
+			return err
+		})
+		buf.WriteByte('}')
+		return err
+	})
+	if err != nil || !empty {
+		return buf.Bytes(), err
+	}
+
+	data, err := os.ReadFile(s.seed)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Save(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.seed, err)
+	}
+	log.Printf("Migrated %s into %s", s.seed, s.path)
+	return data, nil
+}
+
+// Save brings the buckets in line with data in one transaction, putting
+// the entries that are new or changed and deleting those that are gone.
+func (s *boltStore) Save(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		values, err := tx.CreateBucketIfNotExists(valuesBucket)
+		if err != nil {
+			return err
+		}
+		for name, raw := range fields {
+			if err := saveField(tx, values, name, raw); err != nil {
+				return err
+			}
+		}
+
+		// Drop what data no longer has
+		var gone [][]byte
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if _, ok := fields[string(name)]; !ok && !bytes.Equal(name, valuesBucket) {
+				gone = append(gone, bytes.Clone(name))
+			}
+			return nil
+		})
+		for _, name := range gone {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return syncKeys(values, func(k []byte) bool {
+			_, ok := fields[string(k)]
+			return ok && tx.Bucket(k) == nil
+		})
+	})
+}
+
+// saveField makes the database in tx hold raw as its field name: a bucket
+// of entries if raw is an object, or else an entry in values.
+func saveField(tx *bolt.Tx, values *bolt.Bucket, name string, raw json.RawMessage) error {
+	var entries map[string]json.RawMessage
+	if raw[0] != '{' || json.Unmarshal(raw, &entries) != nil {
+		if tx.Bucket([]byte(name)) != nil {
+			if err := tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return putChanged(values, []byte(name), raw)
+	}
+	if err := values.Delete([]byte(name)); err != nil {
+		return err
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return err
+	}
+	if err := syncBucket(b, entries); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// SaveField replaces the field name alone, in a transaction of its own.
+func (s *boltStore) SaveField(name string, raw json.RawMessage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		values, err := tx.CreateBucketIfNotExists(valuesBucket)
+		if err != nil {
+			return err
+		}
+		return saveField(tx, values, name, raw)
+	})
+}
+
+// Put puts the entity in its collection's bucket.
+func (s *boltStore) Put(collection, key string, raw json.RawMessage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(collection))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), raw)
+	})
+}
+
+// Delete deletes the entity from its collection's bucket.
+func (s *boltStore) Delete(collection, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(collection)); b != nil {
+			return b.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+// syncBucket makes b hold entries, writing only what differs.
+func syncBucket(b *bolt.Bucket, entries map[string]json.RawMessage) error {
+	for key, raw := range entries {
+		if err := putChanged(b, []byte(key), raw); err != nil {
+			return err
+		}
+	}
+	return syncKeys(b, func(k []byte) bool {
+		_, ok := entries[string(k)]
+		return ok
+	})
+}
+
+// syncKeys deletes the keys of b that keep rejects.
+func syncKeys(b *bolt.Bucket, keep func(k []byte) bool) error {
+	var gone [][]byte
+	b.ForEach(func(k, _ []byte) error {
+		if !keep(k) {
+			gone = append(gone, bytes.Clone(k))
+		}
+		return nil
+	})
+	for _, k := range gone {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putChanged puts raw, compacted, under key unless it is there already.
+func putChanged(b *bolt.Bucket, key []byte, raw json.RawMessage) error {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return err
+	}
+	if bytes.Equal(b.Get(key), compact.Bytes()) {
+		return nil
+	}
+	return b.Put(key, compact.Bytes())
+}
+
+func (s *boltStore) Close() error   { return s.db.Close() }
+func (s *boltStore) String() string { return s.path }
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/ledger"
+	"pkg/money"
+)
+
+// Books are a bank's double-entry books, kept in its database by
+// embedding it, untagged, like Inbox, in a database that reports its
+// accounts' balances:
+//
+//	type Database struct {
+//		server.Auth `json:"auth"`
+//		server.Books
+//		...
+//	}
+//
+//	// Balances returns each account's balance, by ID. The caller holds
+//	// the database's lock.
+//	func (d *Database) Balances() map[string]money.Money
+//
+// Its entries are then the database's "ledger" collection. When the
+// database is loaded, every account with no entries yet is opened with
+// one for its balance, against ledger.Opening. Handlers lock the accounts
+// a movement touches, with a ledger.Locks, before the database, and post
+// the movement with Post as they change the balances, under both:
+//
+//	unlock := accountLocks.Lock(from.ID, to.ID)
+//	defer unlock()
+//	db.mu.Lock()
+//	defer db.mu.Unlock()
+//	if err := db.Post(ledger.Transfer(from.ID, to.ID, amount, memo, transfer.ID)); err != nil {
+//		return err
+//	}
+//	if from.Balance, err = from.Balance.Sub(amount); err != nil {
+//		return err
+//	}
+//	...
+//
+// Admins read the books at /admin/ledger, and check them against the
+// balances at /admin/ledger/check.
+type Books struct {
+	Ledger ledger.Ledger `json:"ledger,omitempty"`
+}
+
+// Post posts j to the books at the clock's time. A journal whose legs
+// don't sum to zero posts nothing and is an error, which the caller
+// returns before changing any balance. The caller holds the database's
+// lock for writing.
+func (b *Books) Post(j ledger.Journal) error {
+	if b.Ledger == nil {
+		b.Ledger = make(ledger.Ledger)
+	}
+	_, err := b.Ledger.Post(messageID("jnl_"), j, Now())
+	return err
+}
+
+// open posts an opening entry for each account in balances that has none.
+func (b *Books) open(balances map[string]money.Money) {
+	if b.Ledger == nil {
+		b.Ledger = make(ledger.Ledger)
+	}
+	for account, balance := range balances {
+		if balance.IsZero() || b.Ledger.Has(account) {
+			continue
+		}
+		b.Post(ledger.Transfer(ledger.Opening, account, balance, "Opening balance", ""))
+	}
+}
+
+func (b *Books) books() *Books { return b }
+
+// bookkeeping is a database that embeds Books.
+type bookkeeping interface {
+	books() *Books
+	Balances() map[string]money.Money
+}
+
+// openBooks opens the books of v, a database just loaded, if it keeps
+// them.
+func openBooks(v any) {
+	if b, ok := v.(bookkeeping); ok {
+		b.books().open(b.Balances())
+	}
+}
+
+// bookkeeper serves admins a database's books, or a sandbox's.
+type bookkeeper struct {
+	db Database
+}
+
+// attachAdmin mounts the books under the admin group:
+//
+//	GET /admin/ledger        Entries, latest first
+//	GET /admin/ledger/check  Accounts whose balances aren't their entries' sum
+func (k *bookkeeper) attachAdmin(group fiber.Router) {
+	group.Get("/ledger", k.entries)
+	group.Get("/ledger/check", k.check)
+}
+
+// entries responds with the books' entries, latest first, as a page that
+// filters like any list, such as by account or journal.
+func (k *bookkeeper) entries(c *fiber.Ctx) error {
+	v, unlock := k.current(c)
+	found := v.books().Ledger.Entries("")
+	unlock()
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return List(c, found)
+}
+
+// check responds with whether every account's balance is the sum of its
+// entries, and the accounts where it isn't:
+//
+//	{"balanced": false, "accounts": 12, "entries": 40,
+//	 "mismatches": [{"account": "ACC003", "balance": 90, "ledger": 100, "difference": -10}]}
+func (k *bookkeeper) check(c *fiber.Ctx) error {
+	v, unlock := k.current(c)
+	balances := v.Balances()
+	books := v.books().Ledger
+	mismatches, err := books.Check(balances)
+	entries := len(books)
+	unlock()
+	if err != nil {
+		return FailWith(c, fiber.StatusInternalServerError, err)
+	}
+	if mismatches == nil {
+		mismatches = []ledger.Mismatch{}
+	}
+	return c.JSON(fiber.Map{
+		"balanced":   len(mismatches) == 0,
+		"accounts":   len(balances),
+		"entries":    entries,
+		"mismatches": mismatches,
+	})
+}
+
+func (k *bookkeeper) current(c *fiber.Ctx) (bookkeeping, func()) {
+	v, mu := k.db.in(c).Current()
+	if mu == nil {
+		return v.(bookkeeping), func() {}
+	}
+	mu.RLock()
+	return v.(bookkeeping), mu.RUnlock
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// catalogMethods are the methods the catalog lists, in the order it lists
+// a path's; HEAD goes without saying for every GET.
+var catalogMethods = []string{fiber.MethodGet, fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete}
+
+// scaffoldRoutes describe the routes every server has that its spec
+// doesn't, by their paths or what they start with.
+var scaffoldRoutes = []struct{ prefix, description string }{
+	{"/admin/", "For harnesses, with the admin token"},
+	{"/debug/", "Recent requests, for debugging"},
+	{"/healthz", "Whether the server is up"},
+	{"/readyz", "Whether the server can take traffic"},
+	{"/metrics", "Request and database metrics, for Prometheus"},
+	{"/openapi.json", "The OpenAPI spec"},
+	{"/graphql", "The API over GraphQL"},
+}
+
+// CatalogRoute is a route in the catalog, with its path's parameters
+// written as in the spec, like /api/v1/accounts/{accountId}.
+type CatalogRoute struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	Description string `json:"description,omitempty"`
+}
+
+// routeCatalog knows the app's routes once they are all registered. It
+// lists them at GET /api/routes, each with its summary from the spec, and
+// answers a request for a path the app serves with a method it doesn't
+// with 405 and an Allow header naming those it does, before middleware
+// such as auth's gets to turn it away for something else. OPTIONS gets
+// the Allow header with a 204, when it isn't a CORS preflight.
+type routeCatalog struct {
+	summaries map[string]map[string]string // By path, as in the spec, and method
+
+	once   sync.Once
+	routes []fiber.Route
+}
+
+func newRouteCatalog(spec []byte) *routeCatalog {
+	rc := &routeCatalog{}
+	var s struct {
+		Paths map[string]map[string]struct {
+			Summary string `json:"summary"`
+		} `json:"paths"`
+	}
+	if spec != nil && json.Unmarshal(spec, &s) == nil {
+		rc.summaries = make(map[string]map[string]string, len(s.Paths))
+		for path, item := range s.Paths {
+			rc.summaries[path] = make(map[string]string, len(item))
+			for method, op := range item {
+				rc.summaries[path][strings.ToUpper(method)] = op.Summary
+			}
+		}
+	}
+	return rc
+}
+
+func (rc *routeCatalog) attach(app *fiber.App) {
+	app.Use(rc.checkMethod)
+	app.Get("/api/routes", rc.list)
+}
+
+// all returns the app's routes, but for middleware, which it takes to be
+// registered by the first request.
+func (rc *routeCatalog) all(app *fiber.App) []fiber.Route {
+	rc.once.Do(func() {
+		rc.routes = app.GetRoutes(true)
+	})
+	return rc.routes
+}
+
+func (rc *routeCatalog) checkMethod(c *fiber.Ctx) error {
+	var allowed []string
+	for _, r := range rc.all(c.App()) {
+		if matchRoute(r.Path, c.Path()) {
+			if r.Method == c.Method() {
+				return c.Next()
+			}
+			if !slices.Contains(allowed, r.Method) {
+				allowed = append(allowed, r.Method)
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		return c.Next() // Not found, or not a route but middleware's
+	}
+	sort.Slice(allowed, func(i, j int) bool { return methodOrder(allowed[i]) < methodOrder(allowed[j]) })
+	c.Set(fiber.HeaderAllow, strings.Join(allowed, ", "))
+	if c.Method() == fiber.MethodOptions {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	return Fail(c, fiber.StatusMethodNotAllowed, CodeMethodNotAllowed, c.Method()+" isn't allowed on "+c.Path()+"; use "+strings.Join(allowed, ", "))
+}
+
+// allowOrder is the order Allow headers list methods in; others go last.
+var allowOrder = []string{fiber.MethodGet, fiber.MethodHead, fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete}
+
+func methodOrder(method string) int {
+	if i := slices.Index(allowOrder, method); i >= 0 {
+		return i
+	}
+	return len(allowOrder)
+}
+
+// list responds with the app's routes, in order of path:
+//
+//	GET /api/routes
+func (rc *routeCatalog) list(c *fiber.Ctx) error {
+	seen := make(map[CatalogRoute]bool)
+	routes := []CatalogRoute{}
+	for _, r := range rc.all(c.App()) {
+		if !slices.Contains(catalogMethods, r.Method) {
+			continue
+		}
+		path := specPath(r.Path)
+		if path != "/" {
+			path = strings.TrimSuffix(path, "/") // As routed in groups
+		}
+		route := CatalogRoute{Method: r.Method, Path: path, Description: rc.describe(r.Method, path)}
+		if !seen[route] {
+			seen[route] = true
+			routes = append(routes, route)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return methodOrder(routes[i].Method) < methodOrder(routes[j].Method)
+	})
+	return c.JSON(fiber.Map{"routes": routes})
+}
+
+// describe returns the spec's summary of a route, or what the scaffolding
+// serves it for.
+func (rc *routeCatalog) describe(method, path string) string {
+	if summary := rc.summaries[path][method]; summary != "" {
+		return summary
+	}
+	if path == "/" {
+		return "The OpenAPI spec"
+	}
+	for _, r := range scaffoldRoutes {
+		if strings.HasPrefix(path, r.prefix) {
+			return r.description
+		}
+	}
+	return ""
+}
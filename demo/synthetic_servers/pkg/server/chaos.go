@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Disruptions servers simulate in chaos mode. Servers may name others of
+// their own.
+const (
+	ChaosOutOfStock      = "out_of_stock"     // An item sells out during checkout
+	ChaosPaymentDeclined = "payment_declined" // The payment method is declined
+	ChaosFlightCancelled = "flight_cancelled" // The flight is cancelled
+	ChaosDriverDeclined  = "driver_declined"  // The driver turns the ride down
+)
+
+// chaosConfig is how often each disruption happens, and the seed that makes
+// the dice reproducible.
+type chaosConfig struct {
+	Seed  uint64             `json:"seed"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// chaosMode rolls the dice for disruptions. Each disruption has its own
+// generator, seeded from the seed and its name, so a run with the same seed
+// and requests disrupts the same ones however the rates of the others are
+// set.
+type chaosMode struct {
+	mu       sync.Mutex
+	initial  chaosConfig // From the command line, restored by an admin reset
+	config   chaosConfig
+	rands    map[string]*rand.Rand
+	rolls    map[string]int
+	disrupts map[string]int
+}
+
+// chaos is the chaos mode Chaos consults; off until configured.
+var chaos = &chaosMode{}
+
+// parseChaos parses the --chaos flag: comma-separated disruptions and their
+// rates between 0 and 1, such as payment_declined=0.1,out_of_stock=0.05.
+func parseChaos(spec string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, rate, ok := strings.Cut(item, "=")
+		r, err := strconv.ParseFloat(rate, 64)
+		if !ok || name == "" || err != nil || r < 0 || r > 1 {
+			return nil, fmt.Errorf("chaos %q: want a disruption and a rate from 0 to 1, like payment_declined=0.1", item)
+		}
+		rates[name] = r
+	}
+	return rates, nil
+}
+
+// WithChaos turns on the disruptions cfg.Chaos names, at their rates. Admins
+// can change them, and the seed, at /admin/chaos.
+func WithChaos(cfg Config) Option {
+	return func(o *options) {
+		rates, err := parseChaos(cfg.Chaos)
+		if err != nil {
+			log.Fatal(err)
+		}
+		chaos.configure(chaosConfig{Seed: cfg.ChaosSeed, Rates: rates}, true)
+	}
+}
+
+// Chaos reports whether to simulate disruption on the request c is
+// handling, at the rate chaos mode sets for it; never, by default. Handlers
+// call it where the disruption would strike:
+//
+//	if server.Chaos(c, server.ChaosPaymentDeclined) {
+//		return server.NewError(server.CodePaymentDeclined, "Your card was declined")
+//	}
+func Chaos(c *fiber.Ctx, disruption string) bool {
+	if !chaos.roll(disruption) {
+		return false
+	}
+	Logger(c).Info("Simulating disruption", "disruption", disruption)
+	return true
+}
+
+func (m *chaosMode) roll(disruption string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rate := m.config.Rates[disruption]
+	if rate <= 0 {
+		return false
+	}
+	r, ok := m.rands[disruption]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(disruption))
+		r = rand.New(rand.NewPCG(m.config.Seed, h.Sum64()))
+		m.rands[disruption] = r
+	}
+	m.rolls[disruption]++
+	if r.Float64() >= rate {
+		return false
+	}
+	m.disrupts[disruption]++
+	return true
+}
+
+// configure replaces the rates and seed, starting the dice over. With
+// initial set, they are also what a reset goes back to.
+func (m *chaosMode) configure(config chaosConfig, initial bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if config.Rates == nil {
+		config.Rates = make(map[string]float64)
+	}
+	if initial {
+		m.initial = config
+	}
+	m.config = config
+	m.rands = make(map[string]*rand.Rand)
+	m.rolls = make(map[string]int)
+	m.disrupts = make(map[string]int)
+}
+
+// reset goes back to the command line's configuration.
+func (m *chaosMode) reset() {
+	m.mu.Lock()
+	initial := m.initial
+	m.mu.Unlock()
+	m.configure(initial, false)
+}
+
+// attachAdmin mounts the chaos admin endpoints on the admin group:
+//
+//	GET /admin/chaos  The rates and seed, and how often each disruption struck
+//	PUT /admin/chaos  Set them, starting the dice over
+func (m *chaosMode) attachAdmin(group fiber.Router) {
+	group.Get("/chaos", m.get)
+	group.Put("/chaos", m.put)
+}
+
+func (m *chaosMode) get(c *fiber.Ctx) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return c.JSON(m.state())
+}
+
+// put replaces the chaos configuration; disruptions left out are off:
+//
+//	PUT /admin/chaos {"seed": 42, "rates": {"payment_declined": 0.1, "out_of_stock": 0.05}}
+func (m *chaosMode) put(c *fiber.Ctx) error {
+	var config chaosConfig
+	if err := c.BodyParser(&config); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	names := make([]string, 0, len(config.Rates))
+	for name := range config.Rates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if r := config.Rates[name]; r < 0 || r > 1 {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("rates.%s must be from 0 to 1", name))
+		}
+	}
+	m.configure(config, false)
+	Logger(c).Info("Chaos configured", "seed", config.Seed, "rates", config.Rates)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return c.JSON(m.state())
+}
+
+// state describes the configuration and what it has done. The caller holds
+// m.mu.
+func (m *chaosMode) state() fiber.Map {
+	return fiber.Map{
+		"seed":      m.config.Seed,
+		"rates":     m.config.Rates,
+		"rolls":     m.rolls,
+		"disrupted": m.disrupts,
+	}
+}
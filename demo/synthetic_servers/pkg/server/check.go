@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"pkg/money"
+)
+
+// maxProblems is how many problems with the database checkDatabase names
+// before it gives up counting.
+const maxProblems = 50
+
+// checkDatabase checks the database v, as loaded at startup, for what
+// decoding it lets through as zero values or dangling references: entities
+// keyed by something other than their id, or their email in collections
+// keyed by email; fields the spec requires left empty; values outside a
+// field's enum, such as a status the server's constants don't name; and
+// references, such as a ride's user_email or an order item's product_id,
+// to entities that aren't in the collection they name. The error names
+// each problem by where it is, like rides["ride_1"].status.
+func checkDatabase(v any, spec []byte) error {
+	var c dbCheck
+	if spec != nil {
+		json.Unmarshal(spec, &c.spec)
+	}
+	c.collect(v)
+	for _, coll := range c.collections {
+		for _, e := range coll.entities {
+			c.checkKey(e)
+			c.checkValue(e.path, e.value, c.spec.Components.Schemas[coll.schema])
+			c.checkRefs(e.path, e.value)
+		}
+	}
+	if len(c.problems) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%d problems with the database", len(c.problems))
+	if len(c.problems) == 1 {
+		msg = "a problem with the database"
+	}
+	if len(c.problems) > maxProblems {
+		c.problems = append(c.problems[:maxProblems], fmt.Sprintf("and %d more", len(c.problems)-maxProblems))
+	}
+	return errors.New(msg + ":\n\t" + strings.Join(c.problems, "\n\t"))
+}
+
+// dbCheck is a check of a database in progress.
+type dbCheck struct {
+	spec        openAPI
+	collections []*dbCollection
+	problems    []string
+}
+
+// dbCollection is a top-level collection of a database, as JSON.
+type dbCollection struct {
+	name     string
+	schema   string // Its entities' component in the spec
+	entities []dbEntity
+	keys     map[string]bool // Its entities' keys and ids, for references to resolve to
+	byEmail  bool            // Whether it is a map keyed by email
+}
+
+type dbEntity struct {
+	path  string // Where it is, like orders["ord_1"]
+	key   string // Its key, if the collection is a map of entities
+	value any
+}
+
+func (c *dbCheck) problem(format string, args ...any) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// collect finds the database's collections: its maps, Repositories and
+// slices of structs, and maps of slices of them, such as orders listed by
+// user. Auth is the server's own, and left alone.
+func (c *dbCheck) collect(v any) {
+	fields := jsonFields(reflect.TypeOf(v))
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "auth" {
+			continue
+		}
+		fv, ok := fieldValue(v, fields[name])
+		if !ok {
+			continue
+		}
+		if r, ok := fv.Addr().Interface().(repository); ok {
+			fv, _ = r.entities()
+		}
+		coll := &dbCollection{name: name, keys: make(map[string]bool)}
+		switch fv.Kind() {
+		case reflect.Map:
+			if fv.Type().Key().Kind() != reflect.String {
+				continue
+			}
+			keys := fv.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, key := range keys {
+				path := fmt.Sprintf("%s[%q]", name, key.String())
+				item := fv.MapIndex(key)
+				if elem := entityType(item.Type()); elem != nil {
+					coll.schema = elem.Name()
+					coll.add(path, key.String(), item)
+					coll.byEmail = strings.Contains(key.String(), "@")
+				} else if list := reflect.Indirect(item); list.Kind() == reflect.Slice {
+					if elem := entityType(list.Type().Elem()); elem != nil {
+						coll.schema = elem.Name()
+						for i := 0; i < list.Len(); i++ {
+							coll.add(fmt.Sprintf("%s[%d]", path, i), "", list.Index(i))
+						}
+					}
+				}
+			}
+		case reflect.Slice:
+			if elem := entityType(fv.Type().Elem()); elem != nil {
+				coll.schema = elem.Name()
+				for i := 0; i < fv.Len(); i++ {
+					coll.add(fmt.Sprintf("%s[%d]", name, i), "", fv.Index(i))
+				}
+			}
+		}
+		if len(coll.entities) > 0 {
+			c.collections = append(c.collections, coll)
+		}
+	}
+}
+
+// entityType returns the struct type of t, or of what it points to, or nil
+// if it isn't an entity's.
+func entityType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == reflect.TypeFor[time.Time]() || t == reflect.TypeFor[money.Money]() {
+		return nil
+	}
+	return t
+}
+
+func (coll *dbCollection) add(path, key string, item reflect.Value) {
+	data, err := json.Marshal(item.Interface())
+	if err != nil {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if dec.Decode(&value) != nil {
+		return
+	}
+	coll.entities = append(coll.entities, dbEntity{path: path, key: key, value: value})
+	if key != "" {
+		coll.keys[key] = true
+		coll.keys[strings.ToLower(key)] = true
+	}
+	coll.addIDs(value, true)
+}
+
+// addIDs adds the id of an entity to the collection's keys, and those of
+// the entities listed in it, such as a series' episodes, which references
+// may name too.
+func (coll *dbCollection) addIDs(value any, entity bool) {
+	switch value := value.(type) {
+	case map[string]any:
+		if id, ok := value["id"].(string); ok && id != "" && entity {
+			coll.keys[id] = true
+		}
+		for _, v := range value {
+			coll.addIDs(v, false)
+		}
+	case []any:
+		for _, item := range value {
+			coll.addIDs(item, true)
+		}
+	}
+}
+
+// checkKey checks that an entity in a map is keyed by its id, or by its
+// email where the map is keyed by email, as handlers look it up by one
+// and show the other. Keys may be made of more than that, like
+// casey@email.com:content_1.
+func (c *dbCheck) checkKey(e dbEntity) {
+	obj, ok := e.value.(map[string]any)
+	if e.key == "" || !ok {
+		return
+	}
+	field := "id"
+	if strings.Contains(e.key, "@") {
+		field = "email"
+	}
+	id, ok := obj[field].(string)
+	if !ok {
+		return
+	}
+	if id == "" || !strings.Contains(strings.ToLower(e.key), strings.ToLower(id)) {
+		c.problem("%s: %s is %q, but it is keyed by %q", e.path, field, id, e.key)
+	}
+}
+
+// checkValue checks value against the spec's schema for it: that the
+// fields it requires are set, and that strings with an enum are one of
+// its values.
+func (c *dbCheck) checkValue(path string, value any, s *schema) {
+	if s == nil {
+		return
+	}
+	if s.Ref != "" {
+		c.checkValue(path, value, c.spec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")])
+		return
+	}
+	switch value := value.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if v, ok := value[name]; !ok || v == nil || v == "" {
+				c.problem("%s.%s: is required", path, name)
+			}
+		}
+		for _, name := range sortedKeys(value, nil) {
+			prop := s.Properties[name]
+			if prop == nil {
+				prop = s.AdditionalProperties
+			}
+			c.checkValue(path+"."+name, value[name], prop)
+		}
+	case []any:
+		for i, item := range value {
+			c.checkValue(fmt.Sprintf("%s[%d]", path, i), item, s.Items)
+		}
+	case string:
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, value) {
+			c.problem("%s: %q isn't one of %s", path, value, strings.Join(s.Enum, ", "))
+		}
+	}
+}
+
+// checkRefs checks the references in value to other collections' entities:
+// fields named for a collection, such as product_id, product_ids or
+// assigned_driver_id for products and drivers, and emails, such as
+// user_email, for a collection of users keyed by email. Empty references
+// are taken to be unset.
+func (c *dbCheck) checkRefs(path string, value any) {
+	switch value := value.(type) {
+	case map[string]any:
+		for _, name := range sortedKeys(value, nil) {
+			field := path + "." + name
+			switch v := value[name].(type) {
+			case string:
+				if coll := c.target(name, false); coll != nil && v != "" && !coll.has(v) {
+					c.problem("%s: %q isn't in %s", field, v, coll.name)
+				}
+			case []any:
+				coll := c.target(name, true)
+				for i, item := range v {
+					if s, ok := item.(string); ok {
+						if coll != nil && s != "" && !coll.has(s) {
+							c.problem("%s[%d]: %q isn't in %s", field, i, s, coll.name)
+						}
+						continue
+					}
+					c.checkRefs(fmt.Sprintf("%s[%d]", field, i), item)
+				}
+			default:
+				c.checkRefs(field, v)
+			}
+		}
+	}
+}
+
+// refSuffixes end the names of fields that refer to entities, by whether
+// they hold a list of references.
+var refSuffixes = map[bool][]string{false: {"_id", "_email"}, true: {"_ids", "_emails"}}
+
+// target returns the collection a field refers to, if any, trying ever
+// shorter names: assigned_driver, then driver. Emails only refer to
+// collections keyed by email.
+func (c *dbCheck) target(field string, list bool) *dbCollection {
+	for _, suffix := range refSuffixes[list] {
+		base, ok := strings.CutSuffix(field, suffix)
+		for ok {
+			for _, coll := range c.collections {
+				if coll.name == base || singular(coll.name) == base {
+					if strings.Contains(suffix, "email") && !coll.byEmail {
+						return nil
+					}
+					return coll
+				}
+			}
+			_, base, ok = strings.Cut(base, "_")
+		}
+	}
+	return nil
+}
+
+// has reports whether the collection has an entity with a key or id, or
+// with an email for a key in any case.
+func (coll *dbCollection) has(key string) bool {
+	return coll.keys[key] || coll.byEmail && coll.keys[strings.ToLower(key)]
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time servers run on. It follows the wall clock until an
+// admin sets or advances it, so tests can fast-forward through delivery
+// ETAs, statement cycles and the like. Servers read it with Now, Since
+// and Until instead of the time package, and run time-driven work with
+// Every.
+type Clock struct {
+	mu     sync.Mutex
+	offset time.Duration // Added to the wall clock
+	frozen time.Time     // Where the clock stands still, if it does
+	jobs   []*clockJob
+}
+
+// clock is the Clock the package functions read.
+var clock = &Clock{}
+
+// clockJob is work Every runs.
+type clockJob struct {
+	mu sync.Mutex // Held while fn runs, so runs don't overlap
+	fn func(now time.Time)
+}
+
+func (j *clockJob) run(now time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fn(now)
+}
+
+// DefaultClock returns the server's clock, which the package functions
+// read and admins set, for handlers that are handed their clock rather
+// than calling Now. Tests hand them a Clock of their own instead.
+func DefaultClock() *Clock { return clock }
+
+// Now returns the current time on the server's clock.
+func Now() time.Time { return clock.Now() }
+
+// Since returns the time elapsed since t on the server's clock.
+func Since(t time.Time) time.Duration { return clock.Now().Sub(t) }
+
+// Until returns the duration until t on the server's clock.
+func Until(t time.Time) time.Duration { return t.Sub(clock.Now()) }
+
+// Every calls fn with the time on the server's clock every interval of
+// real time, and again whenever the clock is set or advanced, before the
+// admin request that moved it returns. fn should catch up on everything
+// due by then, since a jump may skip many intervals. Every never returns,
+// so it is meant to be run in its own goroutine:
+//
+//	go server.Every(time.Minute, func(now time.Time) {
+//		db.SettleZelle(now)
+//	})
+func Every(interval time.Duration, fn func(now time.Time)) {
+	clock.Every(interval, fn)
+}
+
+// Now returns the current time on c.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.frozen.IsZero() {
+		return c.frozen
+	}
+	return time.Now().Add(c.offset)
+}
+
+// Every is the package function Every for c.
+func (c *Clock) Every(interval time.Duration, fn func(now time.Time)) {
+	job := &clockJob{fn: fn}
+	c.mu.Lock()
+	c.jobs = append(c.jobs, job)
+	c.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		live.RLock()
+		writing.Lock()
+		job.run(c.Now())
+		writing.Unlock()
+		live.RUnlock()
+	}
+}
+
+// Set moves c to t, from where it keeps running, or stands still if frozen
+// is set, and runs the jobs due.
+func (c *Clock) Set(t time.Time, frozen bool) {
+	c.mu.Lock()
+	c.offset = time.Until(t)
+	c.frozen = time.Time{}
+	if frozen {
+		c.frozen = t
+	}
+	c.mu.Unlock()
+	c.runJobs()
+}
+
+// Advance moves c forward by d, and runs the jobs due.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.offset += d
+	if !c.frozen.IsZero() {
+		c.frozen = c.frozen.Add(d)
+	}
+	c.mu.Unlock()
+	c.runJobs()
+}
+
+// Reset puts c back on the wall clock.
+func (c *Clock) Reset() {
+	c.mu.Lock()
+	c.offset, c.frozen = 0, time.Time{}
+	c.mu.Unlock()
+	c.runJobs()
+}
+
+// Frozen reports whether c stands still.
+func (c *Clock) Frozen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.frozen.IsZero()
+}
+
+// Offset returns how far c is ahead of the wall clock, or behind it if
+// negative.
+func (c *Clock) Offset() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.frozen.IsZero() {
+		return time.Until(c.frozen)
+	}
+	return c.offset
+}
+
+func (c *Clock) runJobs() {
+	c.mu.Lock()
+	jobs := append([]*clockJob(nil), c.jobs...)
+	c.mu.Unlock()
+	now := c.Now()
+	for _, job := range jobs {
+		job.run(now)
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// DefaultCompressMin is the size, in bytes, responses must reach to be
+// compressed unless cfg.CompressMin says otherwise; smaller ones gain
+// little from it.
+const DefaultCompressMin = 1024
+
+// WithCompression compresses responses of cfg.CompressMin bytes or more,
+// with brotli or gzip as the client accepts, or deflate or zstd failing
+// those, and leaves them alone if it is 0. Responses that are already
+// encoded, aren't text or JSON, or are streamed, such as events, aren't
+// compressed, and neither are the app's requests to itself.
+func WithCompression(cfg Config) Option {
+	return func(o *options) {
+		o.compressMin = cfg.CompressMin
+	}
+}
+
+// compress returns middleware that compresses responses of at least
+// minSize bytes. It goes outside the middleware that keeps responses, such
+// as the inspector, so they keep them as they were.
+func compress(minSize int) fiber.Handler {
+	compressor := fasthttp.CompressHandlerBrotliLevel(func(*fasthttp.RequestCtx) {},
+		fasthttp.CompressBrotliDefaultCompression,
+		fasthttp.CompressDefaultCompression,
+	)
+	return func(c *fiber.Ctx) error {
+		if err := c.Next(); err != nil {
+			return err // Errors are small
+		}
+		resp := c.Response()
+		if !resp.IsBodyStream() && len(resp.Body()) >= minSize {
+			compressor(c.Context())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envVars are the environment variables that set the standard flags, for
+// deployments that configure servers through their environment.
+var envVars = map[string]string{
+	"port":               "PORT",
+	"port-file":          "PORT_FILE",
+	"database":           "DATABASE_PATH",
+	"fixture":            "FIXTURE",
+	"store":              "STORE",
+	"store-path":         "STORE_PATH",
+	"persist":            "PERSIST",
+	"admin-token":        "ADMIN_TOKEN",
+	"auth":               "AUTH",
+	"spec":               "SPEC",
+	"validate-responses": "VALIDATE_RESPONSES",
+	"rate-limit":         "RATE_LIMIT",
+	"lifecycles":         "LIFECYCLES",
+	"retention":          "RETENTION",
+	"archive":            "ARCHIVE",
+	"check-database":     "CHECK_DATABASE",
+	"watch-seed":         "WATCH_SEED",
+	"watch-policy":       "WATCH_POLICY",
+	"read-only":          "READ_ONLY",
+	"profile":            "PROFILE",
+	"chaos":              "CHAOS",
+	"chaos-seed":         "CHAOS_SEED",
+	"latency":            "LATENCY",
+	"grpc-port":          "GRPC_PORT",
+	"graphql":            "GRAPHQL",
+	"record":             "RECORD",
+	"replay":             "REPLAY",
+	"audit-log":          "AUDIT_LOG",
+	"debug-requests":     "DEBUG_REQUESTS",
+	"compress-min-size":  "COMPRESS_MIN_SIZE",
+	"max-body-size":      "MAX_BODY_SIZE",
+	"blobs":              "BLOBS",
+	"max-upload-size":    "MAX_UPLOAD_SIZE",
+	"request-timeout":    "REQUEST_TIMEOUT",
+	"ids":                "IDS",
+	"id-seed":            "ID_SEED",
+	"v1-deprecated":      "V1_DEPRECATED",
+	"v1-sunset":          "V1_SUNSET",
+	"tax-rate":           "TAX_RATE",
+	"fees":               "FEES",
+	"rules":              "RULES",
+	"cors-origins":       "CORS_ORIGINS",
+	"tls-cert":           "TLS_CERT",
+	"tls-key":            "TLS_KEY",
+	"tls-client-ca":      "TLS_CLIENT_CA",
+}
+
+// flagAliases are the old names of flags, which set the same thing.
+var flagAliases = map[string]string{"data": "database"}
+
+func canonicalFlag(name string) string {
+	if alias, ok := flagAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// applyConfig sets the flags in fs that weren't given on the command line
+// from their environment variables, or else from the config file at path,
+// if there is one. The file sets flags by name, with the settings under
+// servers.<service> overriding the rest for that service:
+//
+//	store: json
+//	tax-rate: 0.0825
+//	cors-origins: [https://app.example.com]
+//	servers:
+//	  amazon:
+//	    port: 8105
+//	    fees: {prime: 0}
+//	    rules: {free_shipping_minimum: 50}
+//
+// Lists are given as comma-separated flags, and maps as name=value ones.
+func applyConfig(fs *flag.FlagSet, path, service string) error {
+	values := make(map[string]string)
+	if path != "" {
+		if err := readConfig(fs, path, service, values); err != nil {
+			return fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+	for name, env := range envVars {
+		if v, ok := os.LookupEnv(env); ok && fs.Lookup(name) != nil {
+			values[name] = v
+		}
+	}
+	fs.Visit(func(f *flag.Flag) { delete(values, canonicalFlag(f.Name)) })
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// readConfig reads a config file's settings for service into values.
+func readConfig(fs *flag.FlagSet, path, service string, values map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Settings map[string]any            `yaml:",inline"`
+		Servers  map[string]map[string]any `yaml:"servers"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	for _, settings := range []map[string]any{file.Settings, file.Servers[service]} {
+		for key, v := range settings {
+			name := canonicalFlag(strings.ReplaceAll(key, "_", "-"))
+			if fs.Lookup(name) == nil || name == "config" {
+				return fmt.Errorf("no setting %q", key)
+			}
+			value, err := flagValue(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			values[name] = value
+		}
+	}
+	return nil
+}
+
+// flagValue renders a setting as a flag would be given it.
+func flagValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, k := range keys {
+			s, err := flagValue(v[k])
+			if err != nil {
+				return "", err
+			}
+			pairs[i] = k + "=" + s
+		}
+		return strings.Join(pairs, ","), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case string, bool, int, int64, uint64:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("can't be given as %T", v)
+}
+
+// resolvePath finds a server's file given by a relative path, such as its
+// database.json, so the server runs from any directory: the path is taken
+// as it is if it exists from the working directory, and otherwise from the
+// directory of the server's binary or of its source, srcDir, whichever has
+// it.
+func resolvePath(path, srcDir string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	dirs := []string{srcDir}
+	if exe, err := os.Executable(); err == nil {
+		dirs = append([]string{filepath.Dir(exe)}, dirs...)
+	}
+	for _, dir := range dirs {
+		candidate := filepath.Join(dir, path)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return path
+}
+
+// defaultServiceName is the name of the server's binary, which is its
+// service's name when built by go run, runall or contract.
+func defaultServiceName() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(filepath.Base(exe), ".exe")
+}
+
+// taxRateFlag is a sales tax rate, which is unset until given.
+type taxRateFlag struct{ rate **float64 }
+
+func (f taxRateFlag) String() string {
+	if f.rate == nil || *f.rate == nil {
+		return ""
+	}
+	return strconv.FormatFloat(**f.rate, 'f', -1, 64)
+}
+
+func (f taxRateFlag) Set(s string) error {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate < 0 || rate >= 1 {
+		return errors.New("want a rate from 0 up to 1, like 0.0825")
+	}
+	*f.rate = &rate
+	return nil
+}
+
+// feesFlag is a set of named fees, like delivery=3.99,wire_domestic=25.
+type feesFlag map[string]float64
+
+func (f feesFlag) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.FormatFloat(f[name], 'f', -1, 64)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f feesFlag) Set(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, amount, ok := strings.Cut(pair, "=")
+		fee, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+		if !ok || err != nil || fee < 0 {
+			return fmt.Errorf("%q: want name=amount, like delivery=3.99", pair)
+		}
+		f[strings.TrimSpace(name)] = fee
+	}
+	return nil
+}
+
+// TaxRate returns the configured sales tax rate, or the server's own,
+// def, if none was.
+func (cfg Config) TaxRate(def float64) float64 {
+	if cfg.Tax == nil {
+		return def
+	}
+	return *cfg.Tax
+}
+
+// Fee returns the configured amount of the named fee, or the server's
+// own, def, if none was.
+func (cfg Config) Fee(name string, def float64) float64 {
+	if fee, ok := cfg.Fees[name]; ok {
+		return fee
+	}
+	return def
+}
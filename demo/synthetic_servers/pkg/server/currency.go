@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/i18n"
+	"pkg/money"
+)
+
+// Currency returns the currency a request wants prices in: ?currency=EUR,
+// or else that of the locale it prefers most, by its Accept-Language, that
+// has one, or else USD. It answers 400 for a ?currency= prices can't be
+// converted to.
+//
+// Handlers that serve prices convert them with money.Convert and say which
+// currency they are in:
+//
+//	currency, err := server.Currency(c)
+//	if err != nil {
+//		return err
+//	}
+//	if product.Price, err = money.Convert(product.Price, currency); err != nil {
+//		return err
+//	}
+//	product.Currency = currency
+func Currency(c *fiber.Ctx) (string, error) {
+	if code := c.Query("currency"); code != "" {
+		code = strings.ToUpper(code)
+		if !money.Known(code) {
+			return "", fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("currency must be one of %s", strings.Join(money.Currencies(), ", ")))
+		}
+		return code, nil
+	}
+	header := c.Get(fiber.HeaderAcceptLanguage)
+	if header == "" {
+		return money.USD, nil
+	}
+	c.Vary(fiber.HeaderAcceptLanguage)
+	for _, locale := range i18n.Locales(header) {
+		if code := money.ForLocale(locale); code != "" && money.Known(code) {
+			return code, nil
+		}
+	}
+	return money.USD, nil
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/money"
+)
+
+// CursorPage is the envelope List responds with when paging by cursor.
+// NextCursor fetches the page after this one and is null on the last.
+type CursorPage[T any] struct {
+	Data       []T     `json:"data"`
+	Total      int     `json:"total"`
+	Limit      int     `json:"limit"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+// cursor marks the last item of a page by its sort key, so the next page
+// starts after it even if items were added or removed in between.
+type cursor struct {
+	CreatedAt string `json:"c,omitempty"`
+	ID        string `json:"i"`
+}
+
+// createdFields are the fields, in order of preference, that say when an
+// item was created.
+var createdFields = []string{"created_at", "createdAt", "timestamp", "date"}
+
+// cursorOrder finds the fields cursor paging orders by: when the item was
+// created, if the items say, then id.
+func cursorOrder(fields map[string][]int) (created, id []int, ok bool) {
+	id, ok = fields["id"]
+	if !ok {
+		return nil, nil, false
+	}
+	for _, name := range createdFields {
+		if index, ok := fields[name]; ok {
+			return index, id, true
+		}
+	}
+	return nil, id, true
+}
+
+// listByCursor responds with the page of items, newest first, after the
+// one the cursor query parameter marks; an empty cursor starts at the top.
+func listByCursor[T any](c *fiber.Ctx, items []T, limit int, fields map[string][]int) error {
+	if c.Query("sort") != "" {
+		return fiber.NewError(fiber.StatusBadRequest, "sort can't be combined with cursor paging")
+	}
+	created, id, ok := cursorOrder(fields)
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest, "This list can't be paged by cursor")
+	}
+
+	// Newest first, then by id, so the order is total.
+	order := func(a, b T) int {
+		for _, index := range [][]int{created, id} {
+			if index == nil {
+				continue
+			}
+			va, oka := fieldValue(a, index)
+			vb, okb := fieldValue(b, index)
+			if n := compareValues(va, oka, vb, okb); n != 0 {
+				return -n
+			}
+		}
+		return 0
+	}
+	slices.SortFunc(items, order)
+
+	start := 0
+	if token := c.Query("cursor"); token != "" {
+		after, err := decodeCursor[T](token, created, id)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid cursor")
+		}
+		start, _ = slices.BinarySearchFunc(items, after, order)
+		if start < len(items) && order(items[start], after) == 0 {
+			start++
+		}
+	}
+
+	end := min(start+limit, len(items))
+	page := CursorPage[T]{Data: slices.Clip(items[start:end]), Total: len(items), Limit: limit}
+	if end < len(items) {
+		next := encodeCursor(items[end-1], created, id)
+		page.NextCursor = &next
+	}
+	return c.JSON(page)
+}
+
+func encodeCursor(item any, created, id []int) string {
+	var cur cursor
+	if v, ok := fieldValue(item, id); ok {
+		cur.ID = cursorValue(v)
+	}
+	if created != nil {
+		if v, ok := fieldValue(item, created); ok {
+			cur.CreatedAt = cursorValue(v)
+		}
+	}
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns a T holding the sort key a cursor marks, to search
+// the ordered items with.
+func decodeCursor[T any](token string, created, id []int) (T, error) {
+	var zero T
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return zero, err
+	}
+	var cur cursor
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return zero, err
+	}
+
+	// Build the key into a fresh item; pointer items get a fresh target.
+	item := reflect.New(reflect.TypeFor[T]()).Elem()
+	target := item
+	for target.Kind() == reflect.Pointer {
+		target.Set(reflect.New(target.Type().Elem()))
+		target = target.Elem()
+	}
+	if err := setCursorValue(target, id, cur.ID); err != nil {
+		return zero, err
+	}
+	if created != nil && cur.CreatedAt != "" {
+		if err := setCursorValue(target, created, cur.CreatedAt); err != nil {
+			return zero, err
+		}
+	}
+	return item.Interface().(T), nil
+}
+
+// cursorValue renders a sort key so setCursorValue can restore it exactly.
+func cursorValue(v reflect.Value) string {
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return formatValue(v)
+}
+
+func setCursorValue(item reflect.Value, index []int, s string) error {
+	v, err := item.FieldByIndexErr(index)
+	if err != nil {
+		return err
+	}
+	if v.Kind() == reflect.Pointer {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+	switch v.Interface().(type) {
+	case time.Time:
+		t, err := time.Parse(time.RFC3339Nano, s)
+		v.Set(reflect.ValueOf(t))
+		return err
+	case money.Money:
+		m, err := money.Parse(s, "")
+		v.Set(reflect.ValueOf(m))
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		v.SetInt(n)
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		v.SetUint(n)
+		return err
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		v.SetFloat(n)
+		return err
+	default:
+		return fmt.Errorf("can't page by a %s field", v.Type())
+	}
+	return nil
+}
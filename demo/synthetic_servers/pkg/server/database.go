@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Database is a server's in-memory database as the scaffolding sees it.
+// Loading replaces the database wholesale, so it is reached through Current
+// rather than held on to.
+type Database struct {
+	// Current returns the database and the mutex guarding it, or nil for
+	// databases without one.
+	Current func() (any, *sync.RWMutex)
+	// Load replaces the database with the one in store.
+	Load func(Store) error
+	// Private lists the top-level collections whose entities belong to
+	// the user their user_email (or similar) field names.
+	Private []string
+	// Search lists the top-level collections /api/v1/search looks through,
+	// the server's main ones, in the order it groups results by; the
+	// server has no search across collections without them.
+	Search []string
+
+	journal *journal // Hears of the changes to its repositories
+}
+
+// in returns the database a request runs against: its sandbox's, if it
+// runs in one, or else db.
+func (db Database) in(c *fiber.Ctx) Database {
+	if sb := sandboxOf(c); sb != nil {
+		return sb.db
+	}
+	return db
+}
+
+// Ref holds a server's database for handlers that are handed it. A reload
+// sets it while requests get it, so both take its lock.
+type Ref[T any] struct {
+	mu sync.RWMutex
+	v  *T
+}
+
+// Get returns the database as last set, the live one, for background
+// jobs; handlers use In.
+func (r *Ref[T]) Get() *T {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.v
+}
+
+// In returns the database a request runs against: its sandbox's, if it
+// runs in one, or else the live one.
+func (r *Ref[T]) In(c *fiber.Ctx) *T {
+	if sb := sandboxOf(c); sb != nil {
+		v, _ := sb.db.Current()
+		if v, ok := v.(*T); ok {
+			return v
+		}
+	}
+	return r.Get()
+}
+
+// Set replaces the database with v. A database loaded for a sandbox stays
+// the sandbox's.
+func (r *Ref[T]) Set(v *T) {
+	if _, ok := sandboxLoads.LoadAndDelete(v); ok {
+		return
+	}
+	r.mu.Lock()
+	r.v = v
+	r.mu.Unlock()
+}
+
+// WithDatabase hooks db up to store, saving it after mutating requests,
+// periodically and on shutdown unless store keeps nothing, and to the admin
+// endpoints when cfg has an admin token. Unless cfg says not to, the server
+// refuses to start if db, as loaded, fails checkDatabase, and with
+// cfg.WatchSeed, db is reloaded when its seed changes on disk, as
+// cfg.WatchPolicy says. With cfg.ReadOnly, requests that could change db
+// are refused. cfg.Profile must be one of the server's; see WithProfiles.
+// Entities get ETags, and updates to them may be made
+// conditional with If-Match. Changes to them are streamed as events from
+// /api/v1/events/stream, sent to the webhooks users register at
+// /api/v1/webhooks, and kept as an audit trail at /api/v1/activity, and
+// every change is written, before it is made, to the audit log at
+// /admin/audit and, with cfg.AuditLog, its file. With cfg.Inspect, the
+// latest requests are kept, with their responses and the changes they made,
+// at /debug/requests. Requests with an X-Sandbox-ID header run against a
+// sandbox's copy of db instead, made at /admin/sandboxes. If db embeds
+// Auth, callers authenticate with its bearer tokens, which cfg may make
+// optional, and can register and log in; if it embeds Inbox, they read
+// their notifications at /api/v1/notifications, and the emails sent them
+// are at /admin/outbox; if it embeds Payments, they read the charges to
+// their cards at /api/v1/charges; if it embeds Promotions, they check
+// promo codes at /api/v1/promotions and read the ones they have used at
+// /api/v1/redemptions; if it embeds Reviews, they read the reviews they
+// have written at /api/v1/reviews and flag others'; if it embeds
+// Messaging, they talk to the people serving them at /api/v1/conversations;
+// and if it embeds Books, admins check them at /admin/ledger. With
+// db.Search, callers search its main collections at /api/v1/search.
+func WithDatabase(cfg Config, store Store, db Database) Option {
+	return func(o *options) {
+		db.journal = newJournal(&writing)
+		db.bind()
+		if _, ok := store.(memoryStore); !ok {
+			if s, ok := store.(entityStore); ok {
+				db.journal.store = s
+			}
+			o.persister = newPersister(store, db)
+		}
+		if cfg.AdminToken != "" {
+			o.admin = newAdmin(cfg, db)
+		}
+		if cfg.CheckData {
+			o.checkData = store
+		}
+		if cfg.WatchSeed {
+			o.watcher = newSeedWatcher(cfg, store, db)
+		}
+		o.readOnly = cfg.ReadOnly
+		o.profile = cfg.Profile
+		o.versions = newVersions(db.journal)
+		o.db = &db
+		o.events = newEvents(db)
+		o.webhooks = newWebhooks(o.events)
+		o.activity = newActivity(o.events)
+		if o.admin != nil {
+			o.admin.activity = o.activity
+		}
+		a, err := newAudit(db, cfg.AuditLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.audit = a
+		if cfg.Inspect > 0 {
+			o.inspector = newInspector(o.events, cfg.Inspect)
+		}
+		if o.persister != nil {
+			o.persister.audit = a
+		}
+		if o.admin != nil {
+			o.admin.audit = a
+		}
+		v, _ := db.Current()
+		if _, ok := v.(authenticated); ok {
+			o.auth = &authenticator{db: db, required: cfg.Auth}
+			if o.admin != nil {
+				o.admin.auth = o.auth
+			}
+			if len(db.Private) > 0 {
+				for _, name := range db.Private {
+					if !db.journal.bound(name) {
+						log.Printf("Ownership: %s is not a collection", name)
+					}
+				}
+				o.ownership = newOwnership(db.journal, db.Private)
+			}
+		}
+		o.sandboxes = newSandboxes(db, o.ownership)
+		if len(db.Search) > 0 {
+			o.search = newSearcher(db, o.events)
+		}
+		if _, ok := v.(notifying); ok {
+			o.inbox = &notifications{db: db}
+			if o.admin != nil {
+				o.admin.outbox = &outbox{db: db}
+			}
+		}
+		if _, ok := v.(paying); ok {
+			o.charges = &charges{db: db}
+		}
+		if _, ok := v.(promoting); ok {
+			o.promos = &promos{db: db}
+		}
+		if _, ok := v.(reviewing); ok {
+			o.reviews = &reviewBook{db: db}
+			if o.admin != nil {
+				o.admin.reviews = o.reviews
+			}
+		}
+		if _, ok := v.(conversing); ok {
+			o.chats = newChats(db, o.events)
+			if o.admin != nil {
+				o.admin.chats = o.chats
+			}
+		}
+		if _, ok := v.(bookkeeping); ok && o.admin != nil {
+			o.admin.books = &bookkeeper{db: db}
+		}
+	}
+}
+
+// encode snapshots the database as JSON.
+func (db Database) encode(ctx context.Context) ([]byte, error) {
+	_, span := StartSpan(ctx, "db.encode")
+	defer span.End()
+	v, mu := db.Current()
+	if mu != nil {
+		if err := RLock(ctx, mu); err != nil {
+			span.SetError(err)
+			return nil, err
+		}
+		defer mu.RUnlock()
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	span.SetAttribute("db.size", len(data))
+	span.SetError(err)
+	return data, err
+}
+
+// replace loads the database in store over db. It holds the old
+// database's lock throughout, so requests in flight finish before the swap.
+// The journal hears of the differences between the two, credited to the
+// caller.
+func (db Database) replace(ctx context.Context, store Store) error {
+	_, span := StartSpan(ctx, "db.replace")
+	defer span.End()
+	reloading.Add(1)
+	defer reloading.Add(-1)
+	v, mu := db.Current()
+	if mu != nil {
+		if err := Lock(ctx, mu); err != nil {
+			span.SetError(err)
+			return err
+		}
+		defer mu.Unlock()
+	}
+	var before []byte
+	if db.journal != nil {
+		var err error
+		if before, err = json.Marshal(v); err != nil {
+			span.SetError(err)
+			return err
+		}
+	}
+	if err := db.Load(store); err != nil {
+		span.SetError(err)
+		return err
+	}
+	if db.journal == nil {
+		return nil
+	}
+	v, loaded := db.Current()
+	if loaded != nil && loaded != mu {
+		loaded.Lock()
+		defer loaded.Unlock()
+	}
+	db.bind()
+	after, err := json.Marshal(v)
+	if err == nil {
+		err = db.journal.reload(before, after)
+	}
+	span.SetError(err)
+	return err
+}
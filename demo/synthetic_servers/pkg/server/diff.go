@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+// collectionDiff lists the entities of one top-level Database field that
+// changed between two snapshots.
+type collectionDiff struct {
+	Created []json.RawMessage `json:"created"`
+	Updated []entityChange    `json:"updated"`
+	Deleted []json.RawMessage `json:"deleted"`
+}
+
+type entityChange struct {
+	Key    string          `json:"key"`
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// diffDatabases compares two encoded databases collection by collection.
+// Entities in a map are matched by key and those in a list by their "id",
+// or by position if they have none. Any other field that changed is
+// reported as a single updated entity keyed by the field name.
+func diffDatabases(before, after []byte) (map[string]*collectionDiff, error) {
+	var old, cur map[string]json.RawMessage
+	if err := json.Unmarshal(before, &old); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(after, &cur); err != nil {
+		return nil, err
+	}
+
+	diffs := make(map[string]*collectionDiff)
+	for _, name := range sortedKeys(old, cur) {
+		a, okA := entities(old[name])
+		b, okB := entities(cur[name])
+		if !okA || !okB {
+			a = map[string]json.RawMessage{name: old[name]}
+			b = map[string]json.RawMessage{name: cur[name]}
+		}
+
+		d := &collectionDiff{
+			Created: []json.RawMessage{},
+			Updated: []entityChange{},
+			Deleted: []json.RawMessage{},
+		}
+		for _, key := range sortedKeys(a, b) {
+			before, hadBefore := a[key]
+			after, hasAfter := b[key]
+			switch {
+			case !hadBefore:
+				d.Created = append(d.Created, after)
+			case !hasAfter:
+				d.Deleted = append(d.Deleted, before)
+			case !sameJSON(before, after):
+				d.Updated = append(d.Updated, entityChange{Key: key, Before: before, After: after})
+			}
+		}
+		if len(d.Created)+len(d.Updated)+len(d.Deleted) > 0 {
+			diffs[name] = d
+		}
+	}
+	return diffs, nil
+}
+
+// entities indexes a collection by entity key. A missing or null field
+// is an empty collection; anything but an object or array is not one.
+func entities(raw json.RawMessage) (map[string]json.RawMessage, bool) {
+	var byKey map[string]json.RawMessage
+	if len(raw) == 0 || string(raw) == "null" {
+		return byKey, true
+	}
+	if json.Unmarshal(raw, &byKey) == nil {
+		return byKey, true
+	}
+
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) != nil {
+		return nil, false
+	}
+	byKey = make(map[string]json.RawMessage, len(list))
+	for i, item := range list {
+		key := itemID(item)
+		if key == "" {
+			key = strconv.Itoa(i)
+		}
+		byKey[key] = item
+	}
+	return byKey, true
+}
+
+func sameJSON(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// sortedKeys returns the keys in either map, sorted.
+func sortedKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
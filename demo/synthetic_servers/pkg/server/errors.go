@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/statemachine"
+)
+
+// Error codes, which every error response carries so that clients can tell
+// errors apart without parsing their messages. Most follow from the
+// response's status; the rest name a condition a client may handle on its
+// own, like a balance too low for a payment.
+const (
+	CodeBadRequest           = "BAD_REQUEST"
+	CodeValidationFailed     = "VALIDATION_FAILED"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodePaymentRequired      = "PAYMENT_REQUIRED"
+	CodePaymentDeclined      = "PAYMENT_DECLINED"
+	CodeInsufficientFunds    = "INSUFFICIENT_FUNDS"
+	CodeForbidden            = "FORBIDDEN"
+	CodeReadOnly             = "READ_ONLY"
+	CodeNotFound             = "NOT_FOUND"
+	CodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	CodeConflict             = "CONFLICT"
+	CodeInvalidTransition    = "INVALID_TRANSITION"
+	CodeOutOfStock           = "OUT_OF_STOCK"
+	CodeGone                 = "GONE"
+	CodePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	CodePreconditionFailed   = "PRECONDITION_FAILED"
+	CodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	CodeRateLimited          = "RATE_LIMITED"
+	CodeInternal             = "INTERNAL"
+	CodeUnavailable          = "UNAVAILABLE"
+	CodeTimeout              = "TIMEOUT"
+)
+
+// ErrorCode is an entry in the catalog of error codes.
+type ErrorCode struct {
+	Code        string `json:"code"`
+	Status      int    `json:"status"` // Answered with, unless the handler says otherwise
+	Description string `json:"description"`
+}
+
+// ErrorCodes is the catalog of error codes, which the OpenAPI specs list.
+var ErrorCodes = []ErrorCode{
+	{CodeBadRequest, fiber.StatusBadRequest, "The request can't be carried out as sent"},
+	{CodeValidationFailed, fiber.StatusUnprocessableEntity, "A parameter or body field is missing or invalid; details lists the fields when they are known"},
+	{CodeUnauthorized, fiber.StatusUnauthorized, "The request needs a valid token"},
+	{CodePaymentRequired, fiber.StatusPaymentRequired, "The request needs a payment the caller hasn't made"},
+	{CodePaymentDeclined, fiber.StatusPaymentRequired, "The payment method was declined"},
+	{CodeInsufficientFunds, fiber.StatusPaymentRequired, "The balance is too low for the amount"},
+	{CodeForbidden, fiber.StatusForbidden, "The caller may not do this"},
+	{CodeReadOnly, fiber.StatusForbidden, "The server is read-only, and the request would change its data"},
+	{CodeNotFound, fiber.StatusNotFound, "There is no such resource, or the caller may not see it"},
+	{CodeMethodNotAllowed, fiber.StatusMethodNotAllowed, "The resource doesn't support the method"},
+	{CodeConflict, fiber.StatusConflict, "The request conflicts with the resource's state"},
+	{CodeInvalidTransition, fiber.StatusConflict, "The resource's status can't change to the one asked for from the one it has; details gives both, and those it can change to"},
+	{CodeOutOfStock, fiber.StatusConflict, "Too few of an item are in stock"},
+	{CodeGone, fiber.StatusGone, "The resource no longer exists"},
+	{CodePayloadTooLarge, fiber.StatusRequestEntityTooLarge, "The request body is larger than the server takes"},
+	{CodePreconditionFailed, fiber.StatusPreconditionFailed, "The resource has changed since the version in If-Match"},
+	{CodeUnsupportedMediaType, fiber.StatusUnsupportedMediaType, "The uploaded file is of a type the server doesn't take"},
+	{CodeRateLimited, fiber.StatusTooManyRequests, "Too many requests; retry after Retry-After seconds"},
+	{CodeInternal, fiber.StatusInternalServerError, "The server failed"},
+	{CodeUnavailable, fiber.StatusServiceUnavailable, "The server can't take requests at the moment"},
+	{CodeTimeout, fiber.StatusGatewayTimeout, "The server took too long"},
+}
+
+// statusCodes are the codes errors get from their status alone.
+var statusCodes = map[int]string{
+	fiber.StatusBadRequest:            CodeBadRequest,
+	fiber.StatusUnauthorized:          CodeUnauthorized,
+	fiber.StatusPaymentRequired:       CodePaymentRequired,
+	fiber.StatusForbidden:             CodeForbidden,
+	fiber.StatusNotFound:              CodeNotFound,
+	fiber.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	fiber.StatusConflict:              CodeConflict,
+	fiber.StatusGone:                  CodeGone,
+	fiber.StatusPreconditionFailed:    CodePreconditionFailed,
+	fiber.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+	fiber.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	fiber.StatusUnprocessableEntity:   CodeValidationFailed,
+	fiber.StatusTooManyRequests:       CodeRateLimited,
+	fiber.StatusInternalServerError:   CodeInternal,
+	fiber.StatusServiceUnavailable:    CodeUnavailable,
+	fiber.StatusGatewayTimeout:        CodeTimeout,
+}
+
+// StatusCode returns the error code for a status, such as NOT_FOUND for
+// 404. A status outside the catalog gets its name in the same form.
+func StatusCode(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status < fiber.StatusInternalServerError {
+		if text := http.StatusText(status); text != "" {
+			return strings.ToUpper(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+		}
+		return CodeBadRequest
+	}
+	return CodeInternal
+}
+
+// Error is an error with a code from the catalog, for domain errors that
+// clients should be able to tell apart:
+//
+//	var ErrInsufficientFunds = server.NewError(server.CodeInsufficientFunds, "insufficient funds")
+//
+// Returned from a handler, it is answered with its code's status.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"` // More about the error, such as the fields that failed validation
+}
+
+// NewError returns an error with a code and message.
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithDetails returns a copy of e with details.
+func (e *Error) WithDetails(details any) *Error {
+	copy := *e
+	copy.Details = details
+	return &copy
+}
+
+// status returns the status e's code is answered with by default.
+func (e *Error) status() int {
+	for _, ec := range ErrorCodes {
+		if ec.Code == e.Code {
+			return ec.Status
+		}
+	}
+	return fiber.StatusInternalServerError
+}
+
+// errorBody is the envelope every error response has:
+//
+//	{"error": {"code": "NOT_FOUND", "message": "User not found", "request_id": "..."}}
+type errorBody struct {
+	Error errorEnvelope `json:"error"`
+}
+
+type errorEnvelope struct {
+	*Error
+	RequestID string `json:"request_id,omitempty"` // To find the request in the server's log
+}
+
+// Fail responds with status and an error with code and message; code may
+// be empty for the status's own, like NOT_FOUND for 404:
+//
+//	return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
+func Fail(c *fiber.Ctx, status int, code, message string) error {
+	return sendError(c, status, &Error{Code: code, Message: message})
+}
+
+// FailWith responds with status and err, with err's code and details if it
+// is or wraps an *Error, INVALID_TRANSITION with the move if it is or wraps
+// a *statemachine.Error, and otherwise the status's code:
+//
+//	if err := db.Transfer(from, to, amount); err != nil {
+//		return server.FailWith(c, fiber.StatusBadRequest, err)
+//	}
+func FailWith(c *fiber.Ctx, status int, err error) error {
+	e := &Error{Message: err.Error()}
+	var coded *Error
+	var move *statemachine.Error
+	if errors.As(err, &coded) {
+		e.Code, e.Details = coded.Code, coded.Details
+	} else if errors.As(err, &move) {
+		e.Code, e.Details = CodeInvalidTransition, move
+	}
+	return sendError(c, status, e)
+}
+
+// readError reads the error in the body of an error response with status,
+// and the ID of the request it answered. What the body lacks comes from
+// the status.
+func readError(status int, body []byte) (e *Error, requestID string) {
+	var envelope struct {
+		Error struct {
+			Error
+			RequestID string `json:"request_id"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(body, &envelope)
+	e = &envelope.Error.Error
+	if e.Code == "" {
+		e.Code = StatusCode(status)
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+	return e, envelope.Error.RequestID
+}
+
+func sendError(c *fiber.Ctx, status int, e *Error) error {
+	if e.Code == "" {
+		e.Code = StatusCode(status)
+	}
+	localize(c, e)
+	return c.Status(status).JSON(errorBody{errorEnvelope{Error: e, RequestID: RequestID(c)}})
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// versions indexes the versions entities are at, which their repositories
+// keep on them, by key and ID, with when each was last modified. A GET for
+// an entity, one whose path ends in its key or ID, carries its version as
+// its ETag, and when it was last modified as its Last-Modified (see
+// setLastModified). A write with If-Match only goes ahead if the entity is
+// still at that version, so concurrent clients can't clobber each other's
+// updates; for writes to a sub-resource, like POST
+// /accounts/:id/transfers, the version is that of the last entity in the
+// path.
+type versions struct {
+	// Conditional writes hold write exclusively, so nothing changes the
+	// database between checking If-Match and the update; other mutating
+	// requests share it.
+	write sync.RWMutex
+
+	mu          sync.Mutex
+	entries     map[string]version // Entity key or ID -> its version
+	collections map[string]version // Collection name -> its version
+}
+
+type version struct {
+	n          int // The entity's; for a collection, a count of its changes
+	hash       [sha256.Size]byte
+	modified   time.Time // To the second
+	collection string    // The entity's, or the first it was in
+}
+
+// newVersions indexes the versions of the entities of the database j
+// journals, from the changes it hears of.
+func newVersions(j *journal) *versions {
+	v := &versions{entries: make(map[string]version), collections: make(map[string]version)}
+	j.follow(v.observe)
+	return v
+}
+
+func (v *versions) attach(app *fiber.App) {
+	app.Use(v.check)
+}
+
+func (v *versions) check(c *fiber.Ctx) error {
+	if sb := sandboxOf(c); sb != nil {
+		v = sb.versions
+	}
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead:
+		return v.get(c)
+	case fiber.MethodOptions:
+		return c.Next()
+	}
+	if c.Get(fiber.HeaderIfMatch) != "" {
+		return v.conditionalWrite(c)
+	}
+
+	if err := RLock(c.UserContext(), &v.write); err != nil {
+		return err
+	}
+	defer v.write.RUnlock()
+	err := c.Next()
+	if err == nil {
+		v.setETag(c)
+	}
+	return err
+}
+
+func (v *versions) get(c *fiber.Ctx) error {
+	if err := c.Next(); err != nil || c.Response().StatusCode() != fiber.StatusOK {
+		return err
+	}
+	tag := v.setETag(c)
+	modified := v.setLastModified(c)
+	// If-Modified-Since only counts without If-None-Match, which is exact.
+	var unchanged bool
+	if match := c.Get(fiber.HeaderIfNoneMatch); match != "" {
+		unchanged = tag != "" && matchesETag(match, tag)
+	} else {
+		unchanged = notModifiedSince(c.Get(fiber.HeaderIfModifiedSince), modified)
+	}
+	if unchanged {
+		c.Status(fiber.StatusNotModified)
+		c.Response().ResetBody()
+	}
+	return nil
+}
+
+func (v *versions) conditionalWrite(c *fiber.Ctx) error {
+	if err := Lock(c.UserContext(), &v.write); err != nil {
+		return err
+	}
+	defer v.write.Unlock()
+
+	var tag string
+	for _, id := range pathIDs(c.Path()) {
+		if ver, ok := v.entry(id); ok {
+			tag = ver.etag()
+		}
+	}
+	if tag == "" {
+		return fiber.NewError(fiber.StatusPreconditionFailed, "This resource has no version to match")
+	}
+	if !matchesETag(c.Get(fiber.HeaderIfMatch), tag) {
+		c.Set(fiber.HeaderETag, tag)
+		return fiber.NewError(fiber.StatusPreconditionFailed, "The resource has changed since it was read; fetch it again and retry")
+	}
+
+	err := c.Next()
+	if err == nil && c.Method() != fiber.MethodDelete {
+		v.setETag(c)
+	}
+	return err
+}
+
+// setETag tags a successful response with the version of the entity its
+// path names, if any, and returns the tag.
+func (v *versions) setETag(c *fiber.Ctx) string {
+	if c.Response().StatusCode() >= 300 {
+		return ""
+	}
+	tag := v.etag(c.Path())
+	if tag == "" {
+		return ""
+	}
+	c.Set(fiber.HeaderETag, tag)
+	return tag
+}
+
+// etag returns the ETag of the entity whose key or ID ends path, or "" if
+// it doesn't end in one.
+func (v *versions) etag(path string) string {
+	ids := pathIDs(path)
+	if len(ids) == 0 {
+		return ""
+	}
+	if ver, ok := v.entry(ids[len(ids)-1]); ok {
+		return ver.etag()
+	}
+	return ""
+}
+
+// entry returns the version of the entity with key or ID id.
+func (v *versions) entry(id string) (version, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ver, ok := v.entries[id]
+	return ver, ok
+}
+
+func (ver version) etag() string {
+	// The hash tells versions apart across resets, which put entities
+	// back at the versions they were seeded at.
+	return fmt.Sprintf(`"v%d-%x"`, ver.n, ver.hash[:4])
+}
+
+// pathIDs returns the unescaped segments of path.
+func pathIDs(path string) []string {
+	var ids []string
+	for _, segment := range strings.Split(path, "/") {
+		if id, err := url.PathUnescape(segment); err == nil && id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// observe notes the version of an entity that changed, by its key and ID,
+// and bumps its collection's. An entity that goes keeps its collection's
+// version moving, and a key or ID shared by entities in several
+// collections versions them together.
+func (v *versions) observe(ch change) {
+	if ch.Collection == "auth" {
+		return
+	}
+	raw := ch.After
+	if raw == nil {
+		raw = ch.Before
+	}
+	ids := []string{ch.Key}
+	var entity struct {
+		ID any `json:"id"`
+	}
+	if json.Unmarshal(raw, &entity) == nil && entity.ID != nil {
+		if id := fmt.Sprint(entity.ID); id != ch.Key {
+			ids = append(ids, id)
+		}
+	}
+	hash := sha256.Sum256(ch.After)
+	stamp := entityStamp(ch.After)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, id := range ids {
+		prev, ok := v.entries[id]
+		switch {
+		case ch.After != nil:
+			ver := bump(prev, ok, hash, stamp, ch)
+			ver.n = ch.Version
+			if !ok {
+				ver.collection = ch.Collection
+			}
+			v.entries[id] = ver
+		case ok && prev.collection == ch.Collection:
+			delete(v.entries, id)
+		}
+	}
+	prev, ok := v.collections[ch.Collection]
+	v.collections[ch.Collection] = bump(prev, ok, sha256.Sum256(append(prev.hash[:], hash[:]...)), stamp, ch)
+}
+
+// bump returns the version after prev, if there was one, now with the
+// given hash after ch: the same one if it hasn't changed, or the next,
+// modified at stamp or when ch was made. What was in the database all
+// along, as in the seed, was modified when it says.
+func bump(prev version, ok bool, hash [sha256.Size]byte, stamp time.Time, ch change) version {
+	switch {
+	case ch.Seeded:
+		if stamp.IsZero() {
+			stamp = ch.Time
+		}
+		return version{n: 1, hash: hash, modified: later(prev.modified, stamp.Truncate(time.Second)), collection: prev.collection}
+	case !ok:
+		return version{n: 1, hash: hash, modified: modifiedAt(stamp, time.Time{}, ch.Time)}
+	case prev.hash != hash:
+		return version{n: prev.n + 1, hash: hash, modified: modifiedAt(stamp, prev.modified, ch.Time), collection: prev.collection}
+	}
+	return prev
+}
+
+// matchesETag reports whether an If-Match or If-None-Match header lists
+// tag, or is "*".
+func matchesETag(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
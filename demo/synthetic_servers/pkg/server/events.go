@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Event actions.
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+)
+
+const (
+	// eventHistory is how many events are kept for clients resuming a
+	// stream with Last-Event-ID.
+	eventHistory = 1000
+	// eventBuffer is how many events a subscriber may fall behind by
+	// before it is dropped.
+	eventBuffer = 256
+	// eventHeartbeat is how often an idle stream sends a comment, so
+	// proxies don't time it out.
+	eventHeartbeat = 15 * time.Second
+)
+
+// Event is a change to one entity.
+type Event struct {
+	ID         int64           `json:"id"`
+	Type       string          `json:"type"` // Collection and action, like orders.updated
+	Collection string          `json:"collection"`
+	Action     string          `json:"action"` // EventCreated, EventUpdated or EventDeleted
+	Key        string          `json:"key"`
+	Owner      string          `json:"owner,omitempty"`  // The user the entity belongs to
+	Actor      string          `json:"actor,omitempty"`  // The user whose request made the change
+	Entity     json.RawMessage `json:"entity"`           // As it is now, or was before deletion
+	Before     json.RawMessage `json:"before,omitempty"` // As it was before an update
+	Time       time.Time       `json:"time"`
+
+	requestID string // Of the request that made the change; empty for background changes
+}
+
+// events publishes the changes to the database's entities as events, as
+// its journal hears of them, each credited to the request or background
+// job that made it.
+type events struct {
+	private map[string]bool
+
+	mu        sync.Mutex
+	seq       int64
+	history   []Event
+	subs      map[chan Event]bool
+	listeners []func(Event)
+}
+
+func newEvents(db Database) *events {
+	private := make(map[string]bool)
+	for _, name := range db.Private {
+		private[name] = true
+	}
+	e := &events{private: private, subs: make(map[chan Event]bool)}
+	db.journal.listen(e.record)
+	return e
+}
+
+func (e *events) attach(app *fiber.App) {
+	app.Get("/api/v1/events/stream", e.stream)
+}
+
+// listen calls fn with every event from now on, in order, as it is
+// published. Unlike subscribers, listeners never miss an event, but must
+// be quick.
+func (e *events) listen(fn func(Event)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.listeners = append(e.listeners, fn)
+}
+
+// subscribe returns a channel receiving every event from now on, and the
+// function to stop receiving them. The channel is closed if the subscriber
+// falls too far behind.
+func (e *events) subscribe() (<-chan Event, func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ch := make(chan Event, eventBuffer)
+	e.subs[ch] = true
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.subs[ch] {
+			delete(e.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// visible reports whether user, who has role, may see ev: they may if the
+// entity is theirs, or belongs to no one and is not in a private
+// collection. Admins see everything, as does everyone when the server
+// doesn't require authentication and the caller hasn't said who they are.
+func (e *events) visible(ev Event, user, role string, required bool) bool {
+	switch {
+	case role == RoleAdmin, user != "" && strings.EqualFold(ev.Owner, user):
+		return true
+	case user == "" && !required:
+		return true
+	}
+	return ev.Owner == "" && !e.private[ev.Collection]
+}
+
+// since returns the kept events after id.
+func (e *events) since(id int64) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i, _ := slices.BinarySearchFunc(e.history, id+1, func(ev Event, id int64) int {
+		return int(ev.ID - id)
+	})
+	return slices.Clone(e.history[i:])
+}
+
+// record publishes a change as an event, unless it changes nothing.
+func (e *events) record(ch change) {
+	ev, ok := newEvent(ch, e.private)
+	if !ok {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	ev.ID = e.seq
+	e.history = append(e.history, ev)
+	if n := len(e.history) - eventHistory; n > 0 {
+		e.history = slices.Delete(e.history, 0, n)
+	}
+	for _, fn := range e.listeners {
+		fn(ev)
+	}
+	for sub := range e.subs {
+		select {
+		case sub <- ev:
+		default:
+			// Too far behind; it can resume with Last-Event-ID.
+			delete(e.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// newEvent describes a change as an event, without an ID, owned as the
+// entity's owner fields say or, in the private collections, as
+// privateOwner does. It reports false for a change that changes nothing.
+func newEvent(ch change, private map[string]bool) (Event, bool) {
+	ev := Event{Collection: ch.Collection, Key: ch.Key, Actor: ch.Actor, Time: ch.Time, requestID: ch.RequestID}
+	switch {
+	case ch.Before == nil:
+		ev.Action, ev.Entity = EventCreated, ch.After
+	case ch.After == nil:
+		ev.Action, ev.Entity = EventDeleted, ch.Before
+	case sameJSON(ch.Before, ch.After):
+		return Event{}, false
+	default:
+		ev.Action, ev.Entity, ev.Before = EventUpdated, ch.After, ch.Before
+	}
+	ev.Type = ev.Collection + "." + ev.Action
+	var entity map[string]any
+	json.Unmarshal(ev.Entity, &entity)
+	ev.Owner = entityOwner(entity)
+	if private[ev.Collection] {
+		ev.Owner = privateOwner(ev.Key, entity)
+	}
+	return ev, true
+}
+
+// stream sends the caller events as server-sent events, each named by its
+// type with the Event as data:
+//
+//	GET /api/v1/events/stream?type=orders,rides.updated
+//	GET /api/v1/events/stream?type=rides&key=ride_1
+//
+// type keeps events of the given collections, or collection.action types,
+// and key those of the entities with the given keys, such as a ride being
+// tracked.
+// Events for entities that belong to a user, or that are in private
+// collections, only go to their owner and admins. A client reconnecting
+// with Last-Event-ID gets the events it missed, if they are still kept.
+func (e *events) stream(c *fiber.Ctx) error {
+	user := strings.Clone(c.Query("email"))
+	role, _ := c.Locals(localsRole).(string)
+	required, _ := c.Locals(localsRequired).(bool)
+	var types []string
+	if t := c.Query("type"); t != "" {
+		types = strings.Split(strings.ToLower(t), ",")
+	}
+	var keys []string
+	if k := c.Query("key"); k != "" {
+		keys = strings.Split(strings.Clone(k), ",")
+	}
+	return e.serve(c, func(ev Event) bool {
+		if len(types) > 0 && !slices.Contains(types, strings.ToLower(ev.Collection)) && !slices.Contains(types, strings.ToLower(ev.Type)) {
+			return false
+		}
+		if len(keys) > 0 && !slices.Contains(keys, ev.Key) {
+			return false
+		}
+		return e.visible(ev, user, role, required)
+	})
+}
+
+// serve sends the caller the events visible keeps as server-sent events,
+// from the one after the request's Last-Event-ID, if it is still kept, or
+// from now on.
+func (e *events) serve(c *fiber.Ctx, visible func(Event) bool) error {
+	var lastID int64
+	if id := c.Get("Last-Event-ID"); id != "" {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Last-Event-ID must be an event id")
+		}
+		lastID = n
+	}
+
+	ch, unsubscribe := e.subscribe()
+	var backlog []Event
+	if lastID > 0 {
+		backlog = e.since(lastID)
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+		send := func(ev Event) error {
+			if ev.ID <= lastID || !visible(ev) {
+				return nil
+			}
+			lastID = ev.ID
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+			return w.Flush()
+		}
+
+		// Tell the client the stream is open, so it knows it's subscribed.
+		fmt.Fprint(w, ": connected\n\n")
+		if w.Flush() != nil {
+			return
+		}
+		for _, ev := range backlog {
+			if send(ev) != nil {
+				return
+			}
+		}
+		heartbeat := time.NewTicker(eventHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case ev, ok := <-ch:
+				if !ok || send(ev) != nil {
+					return
+				}
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+				if w.Flush() != nil {
+					return
+				}
+			case <-draining:
+				return
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"path"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Export formats, asked for with ?format= or the Accept header.
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+)
+
+// exportTypes are the media types of the export formats, and the Accept
+// header values that ask for them.
+var exportTypes = map[string]string{
+	FormatCSV:   "text/csv; charset=utf-8",
+	FormatJSONL: "application/x-ndjson",
+}
+
+var exportAccepts = map[string]string{
+	"text/csv":             FormatCSV,
+	"application/x-ndjson": FormatJSONL,
+	"application/jsonl":    FormatJSONL,
+}
+
+// ExportFormat returns the export format the request asks for, with
+// ?format=csv or jsonl or by accepting text/csv or application/x-ndjson, or
+// "" for the usual JSON.
+func ExportFormat(c *fiber.Ctx) string {
+	if f := strings.ToLower(c.Query("format")); f == FormatCSV || f == FormatJSONL {
+		return f
+	}
+	for _, accept := range strings.Split(c.Get(fiber.HeaderAccept), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if f, ok := exportAccepts[mediaType]; ok {
+			return f
+		}
+	}
+	return ""
+}
+
+// Export streams items, all of them, in format as an attachment named for
+// the request's path, such as orders.csv. A CSV has a header row of the
+// items' JSON field names; fields that are objects or arrays are written as
+// JSON, and missing ones are empty. JSON lines have one item per line.
+func Export[T any](c *fiber.Ctx, items []T, format string) error {
+	contentType, ok := exportTypes[format]
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest, "format must be csv or jsonl")
+	}
+	rows := make([]json.RawMessage, len(items))
+	for i, item := range items {
+		row, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		rows[i] = row
+	}
+
+	name := path.Base(strings.TrimSuffix(c.Path(), "/")) + "." + format
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	columns := exportColumns(reflect.TypeFor[T](), rows)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if format == FormatJSONL {
+			for _, row := range rows {
+				w.Write(row)
+				w.WriteByte('\n')
+			}
+			w.Flush()
+			return
+		}
+		cw := csv.NewWriter(w)
+		cw.Write(columns)
+		record := make([]string, len(columns))
+		for _, row := range rows {
+			var fields map[string]json.RawMessage
+			if json.Unmarshal(row, &fields) != nil {
+				fields = map[string]json.RawMessage{"value": row}
+			}
+			for i, column := range columns {
+				record[i] = csvValue(fields[column])
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+	})
+	return nil
+}
+
+// exportColumns returns the CSV columns for items of type t: its JSON
+// fields in order, promoted ones in place, or else every field the rows
+// have, sorted.
+func exportColumns(t reflect.Type, rows []json.RawMessage) []string {
+	fields := jsonFields(t)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var columns []string
+	if t.Kind() == reflect.Struct {
+		for _, f := range reflect.VisibleFields(t) {
+			name := fieldName(f)
+			if index, ok := fields[name]; ok && slices.Equal(index, f.Index) {
+				columns = append(columns, name)
+			}
+		}
+		return columns
+	}
+
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		var m map[string]json.RawMessage
+		if json.Unmarshal(row, &m) != nil {
+			m = map[string]json.RawMessage{"value": row}
+		}
+		for name := range m {
+			if !seen[name] {
+				seen[name] = true
+				columns = append(columns, name)
+			}
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// csvValue renders a JSON value as a CSV field: strings as they are, null
+// and missing values as nothing, and anything else as JSON.
+func csvValue(raw json.RawMessage) string {
+	if raw == nil || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
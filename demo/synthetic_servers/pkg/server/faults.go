@@ -0,0 +1,223 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Fault types.
+const (
+	FaultError     = "error"     // Answer with an error status instead of running the handler
+	FaultTimeout   = "timeout"   // Hang, then answer 504 without running the handler
+	FaultMalformed = "malformed" // Run the handler, then cut its JSON body short
+)
+
+// defaultFaultDelay is how long a timeout fault hangs unless told otherwise.
+const defaultFaultDelay = 30 * time.Second
+
+// fault is a failure injected into the requests matching a method and path
+// pattern, with a probability, and for a number of requests if Count is
+// set.
+type fault struct {
+	ID          string  `json:"id"`
+	Method      string  `json:"method,omitempty"` // Any method if empty
+	Path        string  `json:"path"`             // Like /api/v1/orders/:id, or /api/v1/* for a prefix
+	Type        string  `json:"type"`
+	Status      int     `json:"status,omitempty"` // For errors
+	Delay       string  `json:"delay,omitempty"`  // For timeouts
+	Probability float64 `json:"probability"`
+	Count       int     `json:"count,omitempty"` // Injections before the fault expires; unlimited if 0
+	Seed        *uint64 `json:"seed,omitempty"`  // Makes the dice reproducible
+	Injected    int     `json:"injected"`
+
+	delay time.Duration
+	rand  *rand.Rand
+}
+
+// faults injects the faults admins configure, so agents' error handling
+// and retries can be tested. Admin routes are never faulted.
+type faults struct {
+	mu     sync.Mutex
+	faults []*fault
+	nextID int
+}
+
+func (f *faults) attach(app *fiber.App) {
+	app.Use(f.inject)
+}
+
+func (f *faults) inject(c *fiber.Ctx) error {
+	if strings.HasPrefix(c.Path(), "/admin/") {
+		return c.Next()
+	}
+	ft := f.pick(c.Method(), c.Path())
+	if ft == nil {
+		return c.Next()
+	}
+	Logger(c).Info("Injecting fault", "fault", ft.ID, "type", ft.Type)
+
+	switch ft.Type {
+	case FaultTimeout:
+		if err := sleep(c.UserContext(), ft.delay); err != nil {
+			return err
+		}
+		return fiber.NewError(fiber.StatusGatewayTimeout, "Injected timeout")
+	case FaultMalformed:
+		if err := c.Next(); err != nil {
+			if err := c.App().Config().ErrorHandler(c, err); err != nil {
+				return err
+			}
+		}
+		if body := c.Response().Body(); len(body) >= 2 {
+			c.Response().SetBodyRaw(slices.Clone(body[:len(body)/2]))
+		} else {
+			c.Response().SetBodyString(`{"data": `)
+		}
+		return nil
+	}
+	return fiber.NewError(ft.Status, "Injected fault")
+}
+
+// pick returns the first fault that matches the request and fires, if any,
+// counting the injection.
+func (f *faults) pick(method, path string) *fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, ft := range f.faults {
+		if ft.Method != "" && !strings.EqualFold(ft.Method, method) || !matchPath(ft.Path, path) {
+			continue
+		}
+		if ft.Probability < 1 && ft.rand.Float64() >= ft.Probability {
+			continue
+		}
+		ft.Injected++
+		if ft.Count > 0 && ft.Injected >= ft.Count {
+			f.faults = slices.Delete(f.faults, i, i+1)
+		}
+		return ft
+	}
+	return nil
+}
+
+// matchPath reports whether path matches pattern, whose :name segments
+// match any one segment and whose trailing * matches the rest.
+func matchPath(pattern, path string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	want := strings.Split(strings.Trim(pattern, "/"), "/")
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i, segment := range want {
+		if !strings.HasPrefix(segment, ":") && segment != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// attachAdmin mounts the fault admin endpoints on the admin group:
+//
+//	POST   /admin/faults      Inject a fault
+//	GET    /admin/faults      List the faults in effect
+//	DELETE /admin/faults/:id  Remove a fault
+//	DELETE /admin/faults      Remove them all
+func (f *faults) attachAdmin(group fiber.Router) {
+	group.Post("/faults", f.create)
+	group.Get("/faults", f.list)
+	group.Delete("/faults/:id", f.remove)
+	group.Delete("/faults", f.clear)
+}
+
+// create adds a fault, checked before those added earlier:
+//
+//	POST /admin/faults {"path": "/api/v1/orders*", "method": "POST", "type": "error", "status": 503, "probability": 0.5}
+//	POST /admin/faults {"path": "/api/v1/rides/:id", "type": "timeout", "delay": "10s", "count": 2}
+func (f *faults) create(c *fiber.Ctx) error {
+	ft := &fault{Probability: 1}
+	if err := c.BodyParser(ft); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	ft.Injected = 0
+	switch ft.Type {
+	case FaultError:
+		if ft.Status == 0 {
+			ft.Status = fiber.StatusInternalServerError
+		}
+		if ft.Status < 400 || ft.Status > 599 {
+			return fiber.NewError(fiber.StatusBadRequest, "status must be an error status, 400 to 599")
+		}
+	case FaultTimeout:
+		ft.delay = defaultFaultDelay
+		if ft.Delay != "" {
+			d, err := time.ParseDuration(ft.Delay)
+			if err != nil || d < 0 {
+				return fiber.NewError(fiber.StatusBadRequest, `delay must be a duration, such as "30s"`)
+			}
+			ft.delay = d
+		}
+		ft.Delay = ft.delay.String()
+	case FaultMalformed:
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("type must be %s, %s or %s", FaultError, FaultTimeout, FaultMalformed))
+	}
+	if !strings.HasPrefix(ft.Path, "/") {
+		return fiber.NewError(fiber.StatusBadRequest, "path must start with /")
+	}
+	if ft.Probability <= 0 || ft.Probability > 1 {
+		return fiber.NewError(fiber.StatusBadRequest, "probability must be above 0 and at most 1")
+	}
+	if ft.Count < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "count must not be negative")
+	}
+	seed := rand.Uint64()
+	if ft.Seed != nil {
+		seed = *ft.Seed
+	}
+	ft.rand = rand.New(rand.NewPCG(seed, 0))
+	ft.Method = strings.ToUpper(ft.Method)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	ft.ID = fmt.Sprintf("fault_%d", f.nextID)
+	f.faults = append([]*fault{ft}, f.faults...)
+	return c.Status(fiber.StatusCreated).JSON(ft)
+}
+
+func (f *faults) list(c *fiber.Ctx) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return c.JSON(append([]*fault{}, f.faults...))
+}
+
+func (f *faults) remove(c *fiber.Ctx) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := slices.IndexFunc(f.faults, func(ft *fault) bool { return ft.ID == c.Params("id") })
+	if i < 0 {
+		return fiber.NewError(fiber.StatusNotFound, "fault not found")
+	}
+	f.faults = slices.Delete(f.faults, i, i+1)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (f *faults) clear(c *fiber.Ctx) error {
+	f.reset()
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// reset removes every fault.
+func (f *faults) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/blob"
+)
+
+// DefaultMaxUploadSize is the largest file servers take in an upload
+// unless cfg.MaxUpload says otherwise.
+const DefaultMaxUploadSize = 10 << 20
+
+// multipartOverhead is what a multipart body may take beyond its file, for
+// its boundaries, headers and other fields.
+const multipartOverhead = 64 << 10
+
+// DefaultUploadTypes are the media types uploads may have unless a server
+// says otherwise: documents, and pictures of them.
+var DefaultUploadTypes = []string{"application/pdf", "image/jpeg", "image/png", "image/gif", "image/webp", "text/plain"}
+
+// StoredFile is a file in the server's blob store, uploaded or generated,
+// as responses describe it. Entities that have files keep their IDs.
+type StoredFile struct {
+	ID          string `json:"id"`             // The SHA-256 of its content, in hex
+	Name        string `json:"name,omitempty"` // As uploaded, or as it downloads
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	URL         string `json:"url"` // Where to download it
+}
+
+// files keeps the files a server takes and makes in a blob store, content
+// addressed, so the same bytes are stored once however often they are
+// uploaded or rendered.
+type files struct {
+	store   *blob.Store
+	maxSize int64
+	types   []string
+}
+
+var (
+	filesMu sync.Mutex
+	stored  *files
+)
+
+// WithFiles keeps the files the server takes in uploads and makes, such
+// as rendered PDFs, in a blob store in the cfg.Blobs directory, and serves
+// them:
+//
+//	POST /api/v1/blobs      Upload a file, as the multipart field file
+//	GET  /api/v1/blobs/:id  Download a file by its ID
+//
+// Uploads are of one of types, DefaultUploadTypes if none are given, and
+// no larger than cfg.MaxUpload. Handlers take them with Upload, store
+// what they make with StoreFile and serve either with ServeFile. Anyone
+// with a file's ID can download it, as anyone with a link can; servers
+// that check who may see a file serve it from their own routes instead.
+func WithFiles(cfg Config, types ...string) Option {
+	return func(o *options) {
+		store, err := blob.Open(cfg.Blobs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(types) == 0 {
+			types = DefaultUploadTypes
+		}
+		maxSize := int64(cfg.MaxUpload)
+		if maxSize <= 0 {
+			maxSize = DefaultMaxUploadSize
+		}
+		o.files = &files{store: store, maxSize: maxSize, types: types}
+		filesMu.Lock()
+		stored = o.files
+		filesMu.Unlock()
+	}
+}
+
+func currentFiles() (*files, error) {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	if stored == nil {
+		return nil, errors.New("files: the server has no blob store; add server.WithFiles")
+	}
+	return stored, nil
+}
+
+func (f *files) attach(app *fiber.App) {
+	app.Post("/api/v1/blobs", f.upload)
+	app.Get("/api/v1/blobs/:id", func(c *fiber.Ctx) error {
+		return ServeFile(c, c.Params("id"), "")
+	})
+}
+
+// limitBodies refuses bodies larger than bodyLimit other than uploads,
+// which the app takes up to the larger upload limit.
+func (f *files) limitBodies(bodyLimit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if len(c.Request().Body()) > bodyLimit && !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+			return fiber.ErrRequestEntityTooLarge
+		}
+		return c.Next()
+	}
+}
+
+// bodyLimit is the largest body the app must take for uploads.
+func (f *files) bodyLimit() int {
+	return int(f.maxSize) + multipartOverhead
+}
+
+// upload stores a file for later use, such as attaching to an entity:
+//
+//	POST /api/v1/blobs  (multipart/form-data, file=@w2.pdf)
+//
+//	{"id": "3a7bd3e2...", "name": "w2.pdf", "size": 48213,
+//	 "content_type": "application/pdf", "url": "/api/v1/blobs/3a7bd3e2..."}
+func (f *files) upload(c *fiber.Ctx) error {
+	file, err := Upload(c, "file")
+	if err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(file)
+}
+
+// Upload stores the file a multipart request sends as field, such as
+// file, in the blob store, and describes it. A request without one fails
+// validation; a file larger than cfg.MaxUpload is refused with 413
+// PAYLOAD_TOO_LARGE, and one whose content isn't of a type the server
+// takes with 415 UNSUPPORTED_MEDIA_TYPE. The type is sniffed from the
+// content rather than taken from the client.
+func Upload(c *fiber.Ctx, field string) (StoredFile, error) {
+	f, err := currentFiles()
+	if err != nil {
+		return StoredFile{}, err
+	}
+	header, err := c.FormFile(field)
+	if err != nil {
+		return StoredFile{}, &ValidationError{Errors: []FieldError{{Field: field, Message: "is required"}}}
+	}
+	if header.Size > f.maxSize {
+		return StoredFile{}, NewError(CodePayloadTooLarge, fmt.Sprintf("file is larger than %d bytes", f.maxSize))
+	}
+	src, err := header.Open()
+	if err != nil {
+		return StoredFile{}, err
+	}
+	defer src.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return StoredFile{}, err
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	if media, _, err := mime.ParseMediaType(contentType); err != nil || !slices.Contains(f.types, media) {
+		return StoredFile{}, NewError(CodeUnsupportedMediaType, fmt.Sprintf("files of type %s aren't taken, only %s", contentType, strings.Join(f.types, ", ")))
+	}
+	b, err := f.store.Put(io.MultiReader(bytes.NewReader(head), src), contentType)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	return storedFile(b, header.Filename), nil
+}
+
+// StoreFile stores a file the server made, such as a rendered receipt, of
+// contentType, in the blob store, and describes it. name is what it
+// downloads as.
+func StoreFile(data []byte, contentType, name string) (StoredFile, error) {
+	f, err := currentFiles()
+	if err != nil {
+		return StoredFile{}, err
+	}
+	b, err := f.store.Put(bytes.NewReader(data), contentType)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	return storedFile(b, name), nil
+}
+
+// ServeFile responds with the file id names in the blob store, as an
+// attachment named name if name isn't empty, or with 404 NOT_FOUND. A
+// file's content never changes, so its ID is its ETag.
+func ServeFile(c *fiber.Ctx, id, name string) error {
+	f, err := currentFiles()
+	if err != nil {
+		return err
+	}
+	content, b, err := f.store.Open(id)
+	if errors.Is(err, blob.ErrNotFound) {
+		return Fail(c, fiber.StatusNotFound, CodeNotFound, "file not found")
+	}
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	etag := `"` + b.ID + `"`
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderCacheControl, "private, max-age=31536000, immutable")
+	if c.Get(fiber.HeaderIfNoneMatch) == etag {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, b.ContentType)
+	if name != "" {
+		c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+	return c.Send(data)
+}
+
+func storedFile(b blob.Blob, name string) StoredFile {
+	return StoredFile{ID: b.ID, Name: name, Size: b.Size, ContentType: b.ContentType, URL: "/api/v1/blobs/" + b.ID}
+}
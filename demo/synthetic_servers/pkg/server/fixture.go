@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// FixtureDefault names the seed database itself among its fixtures.
+const FixtureDefault = "default"
+
+// fixtureFile returns the file of the fixture name of the seed database.
+// Fixtures are named seed databases kept beside a server's seed, for
+// evaluation suites that need data of another shape: database.small.json
+// is the "small" fixture of database.json, and database.edge-cases.json its
+// "edge-cases" one. --fixture picks one at startup, and admins swap them at
+// /admin/fixtures.
+func fixtureFile(seed, name string) string {
+	if name == "" || name == FixtureDefault {
+		return seed
+	}
+	ext := filepath.Ext(seed)
+	return strings.TrimSuffix(seed, ext) + "." + name + ext
+}
+
+// fixtures returns the names of the seed database's fixtures, the default
+// first and the rest in order.
+func fixtures(seed string) []string {
+	ext := filepath.Ext(seed)
+	prefix := strings.TrimSuffix(seed, ext) + "."
+	matches, _ := filepath.Glob(globEscape(prefix) + "*" + ext)
+	var names []string
+	for _, m := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(m, prefix), ext)
+		if validFixture(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{FixtureDefault}, names...)
+}
+
+// validFixture reports whether name could name a fixture, rather than
+// reach outside the seed's directory.
+func validFixture(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && !strings.Contains(name, "..")
+}
+
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// checkFixture returns an error if the seed database has no fixture name.
+func checkFixture(seed, name string) error {
+	if name == "" || name == FixtureDefault {
+		return nil
+	}
+	if validFixture(name) {
+		if _, err := os.Stat(fixtureFile(seed, name)); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no fixture %q beside %s; the fixtures are %s", name, filepath.Base(seed), strings.Join(fixtures(seed), ", "))
+}
+
+// Seed returns the seed database the server starts from: DataFile, or its
+// --fixture.
+func (cfg Config) Seed() string {
+	return fixtureFile(cfg.DataFile, cfg.Fixture)
+}
+
+// listFixtures responds with the fixtures the server can load and the one
+// it has:
+//
+//	GET /admin/fixtures  {"fixture": "default", "fixtures": ["default", "edge-cases", "small"]}
+func (a *admin) listFixtures(c *fiber.Ctx) error {
+	a.mu.Lock()
+	current := a.fixture
+	a.mu.Unlock()
+	return c.JSON(fiber.Map{
+		"fixture":  current,
+		"fixtures": fixtures(a.base),
+	})
+}
+
+// loadFixture swaps the database for a fixture, as a reset does for the
+// seed, and resets from it from then on:
+//
+//	POST /admin/fixtures/edge-cases/load
+func (a *admin) loadFixture(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if err := checkFixture(a.base, name); err != nil {
+		return Fail(c, fiber.StatusNotFound, CodeNotFound, err.Error())
+	}
+	a.mu.Lock()
+	a.fixture, a.seed = name, fixtureFile(a.base, name)
+	a.mu.Unlock()
+	if err := a.restart(c); err != nil {
+		return err
+	}
+	Logger(c).Info("Fixture loaded", "fixture", name)
+	return c.JSON(fiber.Map{"status": "loaded", "fixture": name})
+}
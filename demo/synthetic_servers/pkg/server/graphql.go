@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/graphql-go/graphql"
+	"github.com/valyala/fasthttp"
+
+	"pkg/graphqlapi"
+)
+
+// WithGraphQL serves the API over GraphQL at /graphql too, unless
+// cfg.GraphQL is off, with a schema built from the server's OpenAPI spec;
+// see package graphqlapi. Queries are POSTed as
+// {"query", "variables", "operationName"}, or sent as GET parameters
+// unless they hold mutations. Each field is resolved by the REST request
+// it maps to, sent with the GraphQL request's headers, so both see the
+// same data, auth and limits; a field whose request fails is null, with
+// an error carrying the error's code in its extensions.
+func WithGraphQL(cfg Config) Option {
+	return func(o *options) {
+		o.graphQL = cfg.GraphQL
+	}
+}
+
+// graphQL serves an API over GraphQL by calling the app through a
+// loopback.
+type graphQL struct {
+	schema graphql.Schema
+	app    *loopback
+}
+
+// graphQLRequest is what a GraphQL request's fields are resolved for.
+type graphQLRequest struct {
+	header fasthttp.RequestHeader
+	addr   net.Addr
+	get    bool // Only queries may be sent by GET
+}
+
+type graphQLRequestKey struct{}
+
+// graphQLError is a failed REST request, as a GraphQL error.
+type graphQLError struct {
+	err       *Error
+	status    int
+	requestID string
+}
+
+func (e *graphQLError) Error() string {
+	return e.err.Message
+}
+
+// Extensions puts the error's code, status and details alongside its
+// message.
+func (e *graphQLError) Extensions() map[string]any {
+	ext := map[string]any{"code": e.err.Code, "status": e.status}
+	if e.requestID != "" {
+		ext["request_id"] = e.requestID
+	}
+	if e.err.Details != nil {
+		ext["details"] = e.err.Details
+	}
+	return ext
+}
+
+// attachGraphQL serves the API in spec over GraphQL at /graphql. It goes
+// ahead of the middleware its REST requests go through, so as not to go
+// through it twice.
+func attachGraphQL(app *fiber.App, spec []byte) {
+	g := &graphQL{app: newLoopback(app)}
+	schema, err := graphqlapi.New(spec, g.call)
+	if err != nil {
+		log.Fatalf("GraphQL: %v", err)
+	}
+	g.schema = schema
+	app.Get("/graphql", g.serve)
+	app.Post("/graphql", g.serve)
+}
+
+func (g *graphQL) serve(c *fiber.Ctx) error {
+	var req struct {
+		Query         string         `json:"query"`
+		Variables     map[string]any `json:"variables"`
+		OperationName string         `json:"operationName"`
+	}
+	if c.Method() == fiber.MethodGet {
+		req.Query, req.OperationName = c.Query("query"), c.Query("operationName")
+		if v := c.Query("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return Fail(c, fiber.StatusBadRequest, "", "variables: "+err.Error())
+			}
+		}
+	} else if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return Fail(c, fiber.StatusBadRequest, "", "Invalid GraphQL request: "+err.Error())
+	}
+	if req.Query == "" {
+		return Fail(c, fiber.StatusBadRequest, "", "query is required")
+	}
+
+	r := &graphQLRequest{addr: c.Context().RemoteAddr(), get: c.Method() == fiber.MethodGet}
+	c.Request().Header.CopyTo(&r.header)
+	for _, h := range []string{fiber.HeaderContentType, fiber.HeaderContentLength, fiber.HeaderAcceptEncoding, HeaderIdempotencyKey} {
+		r.header.Del(h)
+	}
+	r.header.Set(HeaderRequestID, RequestID(c))
+	result := graphql.Do(graphql.Params{
+		Schema:         g.schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        context.WithValue(c.UserContext(), graphQLRequestKey{}, r),
+	})
+	return c.JSON(result)
+}
+
+// call carries out a field's REST request.
+func (g *graphQL) call(ctx context.Context, method, path string, query url.Values, body any) (any, error) {
+	r := ctx.Value(graphQLRequestKey{}).(*graphQLRequest)
+	if r.get && method != fiber.MethodGet {
+		return nil, &graphQLError{err: NewError(CodeMethodNotAllowed, "mutations must be sent with POST"), status: fiber.StatusMethodNotAllowed}
+	}
+
+	req := &fasthttp.Request{}
+	r.header.CopyTo(&req.Header)
+	req.Header.SetMethod(method)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	req.SetRequestURI(path)
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.SetContentType(fiber.MIMEApplicationJSON)
+		req.SetBody(data)
+	}
+
+	resp := g.app.do(req, r.addr)
+	if status := resp.StatusCode(); status >= fiber.StatusBadRequest {
+		e, requestID := readError(status, resp.Body())
+		return nil, &graphQLError{err: e, status: status, requestID: requestID}
+	}
+	if len(resp.Body()) == 0 {
+		return nil, nil
+	}
+	var v any
+	if err := json.Unmarshal(resp.Body(), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
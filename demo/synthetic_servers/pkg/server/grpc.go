@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"pkg/grpcapi"
+)
+
+// WithGRPC serves the API over gRPC too, on cfg.GRPCPort, as described by
+// the server's OpenAPI spec; see package grpcapi. Each call is carried out
+// as the REST request its RPC maps to, so both see the same data, auth,
+// limits and errors. Metadata is sent as request headers, like
+// authorization and x-sandbox-id, and response headers come back as
+// header metadata. Error responses become statuses whose ErrorInfo
+// carries the error's code as its reason. Reflection is on, so tools like
+// grpcurl need no .proto file. With a TLS certificate, gRPC is served over
+// TLS too, mutual if HTTPS is.
+func WithGRPC(cfg Config) Option {
+	return func(o *options) {
+		o.grpcPort = cfg.GRPCPort
+		if cfg.GRPCPort == "" {
+			return
+		}
+		tlsCfg, err := tlsConfig(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.grpcTLS = tlsCfg
+	}
+}
+
+// grpcGateway serves an API over gRPC by calling the app through a
+// loopback.
+type grpcGateway struct {
+	api protoreflect.FileDescriptor
+	app *loopback
+}
+
+// attachGRPC starts serving the API in spec over gRPC on port when app
+// starts listening, and stops with it.
+func attachGRPC(app *fiber.App, spec []byte, port string, tlsCfg *tls.Config) {
+	api, err := grpcapi.New(spec)
+	if err != nil {
+		log.Fatalf("gRPC: %v", err)
+	}
+	fd, err := api.Descriptor()
+	if err != nil {
+		log.Fatalf("gRPC: %v", err)
+	}
+	// Reflection finds the API among the registered files.
+	if err := protoregistry.GlobalFiles.RegisterFile(fd); err != nil {
+		log.Fatalf("gRPC: %v", err)
+	}
+
+	g := &grpcGateway{api: fd, app: newLoopback(app)}
+	var opts []grpc.ServerOption
+	if tlsCfg != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	srv := grpc.NewServer(opts...)
+	for i := 0; i < fd.Services().Len(); i++ {
+		srv.RegisterService(g.serviceDesc(fd.Services().Get(i)), struct{}{})
+	}
+	reflection.Register(srv)
+
+	app.Hooks().OnListen(func(fiber.ListenData) error {
+		ln, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			log.Fatalf("gRPC: %v", err)
+		}
+		log.Printf("gRPC server starting on port %s", port)
+		go func() {
+			if err := srv.Serve(ln); err != nil {
+				log.Printf("gRPC: %v", err)
+			}
+		}()
+		return nil
+	})
+	app.Hooks().OnShutdown(func() error {
+		srv.GracefulStop()
+		return nil
+	})
+}
+
+func (g *grpcGateway) serviceDesc(svc protoreflect.ServiceDescriptor) *grpc.ServiceDesc {
+	desc := &grpc.ServiceDesc{
+		ServiceName: string(svc.FullName()),
+		HandlerType: (*any)(nil),
+		Metadata:    g.api.Path(),
+	}
+	for i := 0; i < svc.Methods().Len(); i++ {
+		m := svc.Methods().Get(i)
+		rule := proto.GetExtension(m.Options(), annotations.E_Http).(*annotations.HttpRule)
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: string(m.Name()),
+			Handler: func(_ any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				in := dynamicpb.NewMessage(m.Input())
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				call := func(ctx context.Context, req any) (any, error) {
+					return g.call(ctx, m, rule, req.(proto.Message).ProtoReflect())
+				}
+				if interceptor == nil {
+					return call(ctx, in)
+				}
+				info := &grpc.UnaryServerInfo{FullMethod: "/" + desc.ServiceName + "/" + string(m.Name())}
+				return interceptor(ctx, in, info, call)
+			},
+		})
+	}
+	return desc
+}
+
+// call carries out an RPC as the REST request its rule maps it to.
+func (g *grpcGateway) call(ctx context.Context, m protoreflect.MethodDescriptor, rule *annotations.HttpRule, in protoreflect.Message) (proto.Message, error) {
+	req, err := restRequest(rule, in)
+	if err != nil {
+		return nil, err
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-") || strings.HasSuffix(key, "-bin") ||
+			key == "content-type" || key == "user-agent" || key == "te" {
+			continue
+		}
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+	var addr net.Addr
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr
+	}
+
+	resp := g.app.do(req, addr)
+
+	header := metadata.MD{}
+	resp.Header.VisitAll(func(k, v []byte) {
+		key := strings.ToLower(string(k))
+		switch {
+		case strings.HasPrefix(key, "content-"), strings.HasPrefix(key, "access-control-"),
+			key == "date", key == "server", key == "vary", key == "connection":
+		default:
+			header.Append(key, string(v))
+		}
+	})
+	grpc.SetHeader(ctx, header)
+
+	if resp.StatusCode() >= fiber.StatusBadRequest {
+		return nil, g.error(resp.StatusCode(), resp.Body())
+	}
+	out := dynamicpb.NewMessage(m.Output())
+	body := resp.Body()
+	if len(body) == 0 || m.Output().FullName() == "google.protobuf.Empty" {
+		return out, nil
+	}
+	if rule.GetResponseBody() != "" {
+		field := m.Output().Fields().ByName(protoreflect.Name(rule.GetResponseBody()))
+		body = append(append([]byte(`{"`+field.JSONName()+`":`), body...), '}')
+	}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(body, out); err != nil {
+		return nil, status.Errorf(codes.Internal, "decoding response: %v", err)
+	}
+	return out, nil
+}
+
+// restRequest builds the REST request for an RPC's input: the rule's path
+// with the path fields filled in, the body field as JSON, and every other
+// field set in the query.
+func restRequest(rule *annotations.HttpRule, in protoreflect.Message) (*fasthttp.Request, error) {
+	verb, path := "", ""
+	switch pattern := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		verb, path = fiber.MethodGet, pattern.Get
+	case *annotations.HttpRule_Post:
+		verb, path = fiber.MethodPost, pattern.Post
+	case *annotations.HttpRule_Put:
+		verb, path = fiber.MethodPut, pattern.Put
+	case *annotations.HttpRule_Patch:
+		verb, path = fiber.MethodPatch, pattern.Patch
+	case *annotations.HttpRule_Delete:
+		verb, path = fiber.MethodDelete, pattern.Delete
+	}
+
+	req := &fasthttp.Request{}
+	req.Header.SetMethod(verb)
+	query := url.Values{}
+	fields := in.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		param := "{" + string(fd.Name()) + "}"
+		switch {
+		case strings.Contains(path, param):
+			if !in.Has(fd) {
+				return nil, status.Errorf(codes.InvalidArgument, "%s is required", fd.Name())
+			}
+			path = strings.ReplaceAll(path, param, url.PathEscape(fmt.Sprint(in.Get(fd).Interface())))
+		case string(fd.Name()) == rule.GetBody():
+			body, err := json.Marshal(jsonValue(fd, in.Get(fd)))
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "encoding %s: %v", fd.Name(), err)
+			}
+			req.Header.SetContentType(fiber.MIMEApplicationJSON)
+			req.SetBody(body)
+		case !in.Has(fd):
+		case fd.IsList():
+			list := in.Get(fd).List()
+			for j := 0; j < list.Len(); j++ {
+				query.Add(fd.JSONName(), fmt.Sprint(list.Get(j).Interface()))
+			}
+		default:
+			query.Set(fd.JSONName(), fmt.Sprint(in.Get(fd).Interface()))
+		}
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	req.SetRequestURI(path)
+	req.Header.SetHost("localhost")
+	return req, nil
+}
+
+// jsonValue converts a field's value to what encoding/json marshals as the
+// REST API's JSON for it: protojson would quote 64-bit integers.
+func jsonValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) any {
+	switch {
+	case fd.IsMap():
+		out := make(map[string]any)
+		v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			out[k.String()] = singularValue(fd.MapValue(), v)
+			return true
+		})
+		return out
+	case fd.IsList():
+		list := v.List()
+		out := make([]any, list.Len())
+		for i := range out {
+			out[i] = singularValue(fd, list.Get(i))
+		}
+		return out
+	}
+	return singularValue(fd, v)
+}
+
+func singularValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) any {
+	if fd.Kind() != protoreflect.MessageKind {
+		return v.Interface()
+	}
+	m := v.Message()
+	if m.Descriptor().FullName().Parent() == "google.protobuf" {
+		// Struct, Value and the like, which are JSON already.
+		data, err := protojson.Marshal(m.Interface())
+		if err != nil {
+			return nil
+		}
+		return json.RawMessage(data)
+	}
+	out := make(map[string]any)
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		out[fd.JSONName()] = jsonValue(fd, v)
+		return true
+	})
+	return out
+}
+
+// error converts an error response to a status, with an ErrorInfo giving
+// the error's code as its reason.
+func (g *grpcGateway) error(httpStatus int, body []byte) error {
+	e, requestID := readError(httpStatus, body)
+	info := &errdetails.ErrorInfo{
+		Reason:   e.Code,
+		Domain:   string(g.api.Package()),
+		Metadata: map[string]string{"http_status": strconv.Itoa(httpStatus)},
+	}
+	if requestID != "" {
+		info.Metadata["request_id"] = requestID
+	}
+	if e.Details != nil {
+		if details, err := json.Marshal(e.Details); err == nil {
+			info.Metadata["details"] = string(details)
+		}
+	}
+	st := status.New(grpcCode(httpStatus), e.Message)
+	if withInfo, err := st.WithDetails(info); err == nil {
+		st = withInfo
+	}
+	return st.Err()
+}
+
+// grpcCode returns the gRPC code for an HTTP error status, the reverse of
+// grpc-gateway's mapping.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case fiber.StatusBadRequest, fiber.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case fiber.StatusUnauthorized:
+		return codes.Unauthenticated
+	case fiber.StatusForbidden:
+		return codes.PermissionDenied
+	case fiber.StatusNotFound, fiber.StatusGone:
+		return codes.NotFound
+	case fiber.StatusConflict:
+		return codes.Aborted
+	case fiber.StatusPaymentRequired, fiber.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case fiber.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case fiber.StatusNotImplemented, fiber.StatusMethodNotAllowed:
+		return codes.Unimplemented
+	case fiber.StatusServiceUnavailable:
+		return codes.Unavailable
+	case fiber.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if httpStatus >= fiber.StatusInternalServerError {
+		return codes.Internal
+	}
+	return codes.InvalidArgument
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// shutdownTimeout is how long requests in flight get to finish once the
+// server is asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+var (
+	draining  = make(chan struct{}) // Closed once the server starts shutting down
+	drainOnce sync.Once
+	reloading atomic.Int32 // Database replacements under way
+)
+
+// startDraining fails readiness and ends long-lived responses, such as
+// event streams, so the server can shut down.
+func startDraining() {
+	drainOnce.Do(func() { close(draining) })
+}
+
+// attachHealth adds the probes orchestrators poll. GET /healthz answers 200
+// while the server is up. GET /readyz answers 200 while it can serve
+// requests, and 503 while an admin reset or restore reloads the database or
+// the server drains connections to shut down. Servers load their database
+// before they listen, so it is never served unloaded.
+func attachHealth(app *fiber.App) {
+	app.Get("/healthz", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	})
+	app.Get("/readyz", func(c *fiber.Ctx) error {
+		select {
+		case <-draining:
+			return fiber.NewError(fiber.StatusServiceUnavailable, "shutting down")
+		default:
+		}
+		if reloading.Load() > 0 {
+			return fiber.NewError(fiber.StatusServiceUnavailable, "database is being reloaded")
+		}
+		return c.JSON(fiber.Map{"status": "ready"})
+	})
+}
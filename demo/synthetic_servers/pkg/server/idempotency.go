@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/sha256"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Idempotency headers.
+const (
+	HeaderIdempotencyKey     = "Idempotency-Key"
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+)
+
+// idempotencyTTL is how long a response is replayed for its key.
+const idempotencyTTL = 24 * time.Hour
+
+// replayHeaders are the response headers kept with a cached response.
+var replayHeaders = []string{fiber.HeaderContentType, fiber.HeaderLocation, fiber.HeaderETag}
+
+// idempotency makes POST requests safe to retry. The first response to a
+// request with an Idempotency-Key header is kept for a day on the server's
+// clock and replayed to retries with the same key, instead of running the
+// request again. Keys belong to the caller, and to its sandbox, so users
+// can't replay each other's responses. Reusing a key for a different
+// request is refused with 422, and retrying while the first attempt is
+// still running with 409. Server errors aren't kept, so those requests can
+// be retried for real.
+//
+// An admin reset, or restoring a snapshot, forgets the live database's
+// keys, and discarding a sandbox forgets its keys, since the responses
+// they replay are of a database that is gone.
+type idempotency struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+	queue   []queuedKey // Keys in the order they were stored, and so expire
+}
+
+// queuedKey is a stored key, as of when it expires.
+type queuedKey struct {
+	key     string
+	expires time.Time
+}
+
+type idempotentResponse struct {
+	request [sha256.Size]byte // Method, path and body
+	sandbox string            // The sandbox's ID, or empty for the live database
+	done    bool
+	expires time.Time
+
+	status  int
+	headers map[string]string
+	body    []byte
+}
+
+func newIdempotency() *idempotency {
+	return &idempotency{entries: make(map[string]*idempotentResponse)}
+}
+
+func (i *idempotency) attach(app *fiber.App) {
+	app.Use(i.check)
+}
+
+func (i *idempotency) check(c *fiber.Ctx) error {
+	key := c.Get(HeaderIdempotencyKey)
+	if c.Method() != fiber.MethodPost || key == "" {
+		return c.Next()
+	}
+
+	caller, _ := c.Locals(localsEmail).(string)
+	if caller == "" {
+		caller = c.IP()
+	}
+	key = caller + "\x00" + key
+	var sandbox string
+	if sb := sandboxOf(c); sb != nil {
+		sandbox = sb.ID
+		key = sb.ID + "\x00" + key
+	}
+	h := sha256.New()
+	h.Write([]byte(c.Method() + " " + c.Path() + "\n"))
+	h.Write(c.Body())
+	var request [sha256.Size]byte
+	h.Sum(request[:0])
+
+	i.mu.Lock()
+	now := Now()
+	entry, ok := i.entries[key]
+	if ok && now.After(entry.expires) {
+		delete(i.entries, key)
+		ok = false
+	}
+	var mine *idempotentResponse
+	switch {
+	case !ok:
+		i.sweep(now)
+		mine = &idempotentResponse{request: request, sandbox: sandbox, expires: now.Add(idempotencyTTL)}
+		i.entries[key] = mine
+		i.queue = append(i.queue, queuedKey{key, mine.expires})
+	case entry.request != request:
+		i.mu.Unlock()
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+	case !entry.done:
+		i.mu.Unlock()
+		return fiber.NewError(fiber.StatusConflict, "A request with this Idempotency-Key is still in progress")
+	}
+	i.mu.Unlock()
+
+	if ok {
+		for name, value := range entry.headers {
+			c.Set(name, value)
+		}
+		c.Set(HeaderIdempotentReplayed, "true")
+		return c.Status(entry.status).Send(entry.body)
+	}
+
+	// Render errors here so the response can be kept.
+	if err := c.Next(); err != nil {
+		if err := c.App().Config().ErrorHandler(c, err); err != nil {
+			i.forget(key, mine)
+			return err
+		}
+	}
+
+	resp := c.Response()
+	if resp.StatusCode() >= 500 {
+		i.forget(key, mine)
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.entries[key] != mine {
+		// Forgotten while the request ran, by a reset or as expired.
+		return nil
+	}
+	entry = mine
+	entry.done = true
+	entry.status = resp.StatusCode()
+	entry.body = append([]byte(nil), resp.Body()...)
+	entry.headers = make(map[string]string)
+	for _, name := range replayHeaders {
+		if value := resp.Header.Peek(name); len(value) > 0 {
+			entry.headers[name] = string(value)
+		}
+	}
+	return nil
+}
+
+// forget drops the response kept for key, if it is still entry.
+func (i *idempotency) forget(key string, entry *idempotentResponse) {
+	i.mu.Lock()
+	if i.entries[key] == entry {
+		delete(i.entries, key)
+	}
+	i.mu.Unlock()
+}
+
+// clear forgets the keys of a sandbox, or of the live database if sandbox
+// is empty.
+func (i *idempotency) clear(sandbox string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for key, entry := range i.entries {
+		if entry.sandbox == sandbox {
+			delete(i.entries, key)
+		}
+	}
+}
+
+// sweep drops the responses expired by now, oldest first, stopping at the
+// first that hasn't. The caller holds i.mu.
+func (i *idempotency) sweep(now time.Time) {
+	n := 0
+	for _, q := range i.queue {
+		if !now.After(q.expires) {
+			break
+		}
+		if entry, ok := i.entries[q.key]; ok && entry.expires.Equal(q.expires) {
+			delete(i.entries, q.key)
+		}
+		n++
+	}
+	i.queue = slices.Delete(i.queue, 0, n)
+}
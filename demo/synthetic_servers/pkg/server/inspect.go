@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// inspectedBodyLimit is how much of a body the inspector keeps; longer
+// ones are cut short, and kept as a string.
+const inspectedBodyLimit = 64 << 10
+
+// inspected is a request the inspector kept: what came in, what went out,
+// how long it took and what it changed in the database.
+type inspected struct {
+	ID        string            `json:"id"` // Its X-Request-ID
+	Time      time.Time         `json:"time"`
+	Method    string            `json:"method"`
+	Path      string            `json:"path"` // With the query string
+	Route     string            `json:"route,omitempty"`
+	Status    int               `json:"status"`
+	LatencyMS float64           `json:"latency_ms"`
+	User      string            `json:"user,omitempty"`
+	Request   inspectedMessage  `json:"request"`
+	Response  inspectedMessage  `json:"response"`
+	Mutations []inspectedChange `json:"mutations"`
+}
+
+// inspectedMessage is the headers and body of a request or response.
+type inspectedMessage struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"` // As recordedBody keeps it
+}
+
+// inspectedChange is a change a request made to one entity.
+type inspectedChange struct {
+	Type string   `json:"type"` // Collection and action, like orders.updated
+	Key  string   `json:"key"`
+	Diff []Change `json:"diff"`
+}
+
+// inspector keeps the last requests to the API, with their bodies,
+// responses, latencies and the changes they made to the database, for
+// debugging an agent's trajectory from a browser or a script:
+//
+//	GET /debug/requests       The requests, newest first; a page to browse them from a browser
+//	GET /debug/requests/:id   One, by its X-Request-ID
+//
+// Changes are matched to requests by the events they publish, so those
+// made in sandboxes or by background jobs aren't shown. The endpoints are
+// only served with --debug-requests, and need no token: they show every
+// caller's tokens and data, so they are for servers run locally.
+type inspector struct {
+	events *events
+	size   int
+
+	mu       sync.Mutex
+	requests []*inspected                 // Oldest first
+	pending  map[string][]inspectedChange // Of requests in flight, by ID
+}
+
+func newInspector(e *events, size int) *inspector {
+	return &inspector{events: e, size: size, pending: make(map[string][]inspectedChange)}
+}
+
+// attach mounts the endpoints, and keeps requests from then on. It goes
+// outside panic recovery, to keep panics as the 500s they become.
+func (in *inspector) attach(app *fiber.App) {
+	in.events.listen(in.change)
+	app.Get("/debug/requests", in.list)
+	app.Get("/debug/requests/:id", in.get)
+	app.Use(in.keep)
+}
+
+func (in *inspector) keep(c *fiber.Ctx) error {
+	if !recorded(c.Path()) {
+		return c.Next()
+	}
+	id := strings.Clone(RequestID(c))
+	// Take the request as it came, before middleware such as auth's
+	// rewrites it. Fiber's strings are only good during the request.
+	r := &inspected{
+		ID:     id,
+		Time:   time.Now().UTC(),
+		Method: strings.Clone(c.Method()),
+		Path:   string(c.Request().RequestURI()),
+		Request: inspectedMessage{
+			Headers: pickHeaders(recordedRequestHeaders, c.Request().Header.Peek),
+			Body:    inspectedBody(c.Body()),
+		},
+	}
+	in.mu.Lock()
+	in.pending[id] = []inspectedChange{}
+	in.mu.Unlock()
+
+	start := time.Now()
+	// Render errors here so the response can be kept.
+	if err := c.Next(); err != nil {
+		if err := c.App().Config().ErrorHandler(c, err); err != nil {
+			return err
+		}
+	}
+	resp := c.Response()
+	r.Route = c.Route().Path
+	r.Status = resp.StatusCode()
+	r.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	user, _ := c.Locals(localsEmail).(string)
+	r.User = strings.Clone(user)
+	r.Response = inspectedMessage{Headers: pickHeaders(recordedResponseHeaders, resp.Header.Peek)}
+	if !resp.IsBodyStream() {
+		r.Response.Body = inspectedBody(resp.Body())
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	r.Mutations = in.pending[id]
+	delete(in.pending, id)
+	in.requests = append(in.requests, r)
+	if n := len(in.requests) - in.size; n > 0 {
+		in.requests = slices.Delete(in.requests, 0, n)
+	}
+	return nil
+}
+
+// change credits an event to the request in flight that made it.
+func (in *inspector) change(ev Event) {
+	if ev.requestID == "" {
+		return
+	}
+	before, after := ev.Before, ev.Entity
+	switch ev.Action {
+	case EventCreated:
+		before = nil
+	case EventDeleted:
+		before, after = ev.Entity, nil
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if changes, ok := in.pending[ev.requestID]; ok {
+		in.pending[ev.requestID] = append(changes, inspectedChange{
+			Type: ev.Type,
+			Key:  ev.Key,
+			Diff: diffJSON("", compact(before), compact(after), []Change{}),
+		})
+	}
+}
+
+// inspectedBody keeps a body as recordedBody does, cutting it short, as a
+// string, if it is too long.
+func inspectedBody(body []byte) json.RawMessage {
+	if len(body) <= inspectedBodyLimit {
+		return recordedBody(body)
+	}
+	cut, _ := json.Marshal(strings.ToValidUTF8(string(body[:inspectedBodyLimit]), "") + "...")
+	return cut
+}
+
+// list responds with the kept requests, newest first, as a page that
+// filters like any list, such as on status or method; or, to a browser,
+// with a page to browse them.
+func (in *inspector) list(c *fiber.Ctx) error {
+	if c.Accepts(fiber.MIMEApplicationJSON, fiber.MIMETextHTML) == fiber.MIMETextHTML {
+		c.Type("html")
+		return c.SendString(inspectorPage)
+	}
+	in.mu.Lock()
+	requests := slices.Clone(in.requests)
+	in.mu.Unlock()
+	slices.Reverse(requests)
+	return List(c, requests)
+}
+
+func (in *inspector) get(c *fiber.Ctx) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for i := len(in.requests) - 1; i >= 0; i-- {
+		if in.requests[i].ID == c.Params("id") {
+			return c.JSON(in.requests[i])
+		}
+	}
+	return Fail(c, fiber.StatusNotFound, CodeNotFound, "no request "+c.Params("id")+" is kept")
+}
+
+// inspectorPage lists the kept requests, and shows one's request, response
+// and changes when it is clicked.
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Requests</title>
+<style>
+body { font: 13px system-ui, sans-serif; margin: 0; display: flex; height: 100vh; }
+#list { width: 50%; overflow: auto; border-right: 1px solid #ccc; }
+#detail { flex: 1; overflow: auto; padding: 0 12px; }
+table { border-collapse: collapse; width: 100%; }
+td, th { padding: 4px 8px; text-align: left; white-space: nowrap; }
+tr.row { cursor: pointer; }
+tr.row:hover, tr.selected { background: #eef; }
+.s4 { color: #b60; } .s5 { color: #c00; font-weight: bold; }
+pre { background: #f6f6f6; padding: 8px; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<div id="list">
+<p style="padding: 0 8px"><label><input type="checkbox" id="live" checked> Refresh every 2s</label></p>
+<table><thead><tr><th>Time</th><th>Request</th><th>Status</th><th>ms</th><th>Changes</th><th>User</th></tr></thead><tbody id="rows"></tbody></table>
+</div>
+<div id="detail"><p>Click a request to see it.</p></div>
+<script>
+let selected = null;
+const show = (title, v) => v === undefined || v === null ? "" :
+  "<h3>" + esc(title) + "</h3><pre>" + esc(typeof v === "string" ? v : JSON.stringify(v, null, 2)) + "</pre>";
+const esc = s => s.replace(/[&<>]/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;"})[c]);
+async function load() {
+  const resp = await fetch("?limit=200", {headers: {Accept: "application/json"}});
+  const page = await resp.json();
+  const rows = document.getElementById("rows");
+  rows.innerHTML = "";
+  for (const r of page.data) {
+    const tr = document.createElement("tr");
+    tr.className = "row s" + String(r.status)[0] + (r.id === selected ? " selected" : "");
+    tr.innerHTML = "<td>" + new Date(r.time).toLocaleTimeString() + "</td><td>" + esc(r.method + " " + r.path) +
+      "</td><td>" + r.status + "</td><td>" + r.latency_ms.toFixed(1) + "</td><td>" + r.mutations.length +
+      "</td><td>" + esc(r.user || "") + "</td>";
+    tr.onclick = () => { selected = r.id; detail(r); load(); };
+    rows.appendChild(tr);
+  }
+}
+function detail(r) {
+  document.getElementById("detail").innerHTML = "<h2>" + esc(r.method + " " + r.path) + "</h2><p>" + r.status + " in " +
+    r.latency_ms.toFixed(1) + " ms, " + esc(r.id) + (r.route ? ", route " + esc(r.route) : "") + "</p>" +
+    show("Request headers", r.request.headers) + show("Request body", r.request.body) +
+    show("Response headers", r.response.headers) + show("Response body", r.response.body) +
+    (r.mutations.length ? r.mutations.map(m => show(m.type + " " + m.key, m.diff)).join("") : "<h3>No changes</h3>");
+}
+load();
+setInterval(() => { if (document.getElementById("live").checked) load(); }, 2000);
+</script>
+</body>
+</html>
+`
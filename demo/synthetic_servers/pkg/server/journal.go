@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// writing is held by whatever may change the live database: a request
+// other than a GET, or a background job. Its changes are credited to it,
+// so concurrent requests are never credited with each other's. It is taken
+// after live. A sandbox's journal has a lock of its own.
+var writing sync.Mutex
+
+// change is a change to one entity, as a repository tells its journal of
+// it, before it is made.
+type change struct {
+	Collection string
+	Key        string
+	Before     json.RawMessage // Nil for a creation
+	After      json.RawMessage // Nil for a deletion
+	Actor      string          // The user whose request made it; empty for background jobs
+	RequestID  string          // Of the request that made it; empty for background jobs
+	Time       time.Time
+	Version    int  // Of the entity after it; 0 for a deletion
+	Seeded     bool // The entity was there before whoever follows the journal began to
+}
+
+// credit is who a database's changes are credited to.
+type credit struct {
+	actor     string
+	requestID string
+}
+
+// journal hears of every change made through a database's repositories as
+// it is made, and passes it on, credited to whoever holds lock, to the
+// events, activity and audit trail listening. A database replaced
+// wholesale, as by a reset, is compared with what it replaced instead.
+type journal struct {
+	lock  *sync.Mutex // Held by whoever is changing the database
+	by    atomic.Pointer[credit]
+	store entityStore // Changes are written through to; nil for a database saved whole
+	stale atomic.Bool // A change failed to be written through
+
+	mu        sync.Mutex
+	ahead     []func(change) // Told at once, even of changes held back
+	listeners []func(change)
+	repos     map[string]repository // Those bound, by their collections' names
+	deferred  bool                  // Changes wait in pending to be committed
+	pending   []change
+}
+
+// newJournal journals a database changed by whoever holds lock.
+func newJournal(lock *sync.Mutex) *journal {
+	return &journal{lock: lock, repos: make(map[string]repository)}
+}
+
+// follow calls fn with every entity of the repositories bound, as if it had
+// just been created, and then, like listenAhead, with every change as it
+// is made, so fn can keep an index of the database. It is called before
+// the database is used, as fn starts out with what is in it.
+func (j *journal) follow(fn func(change)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := Now()
+	for _, name := range sortedKeys(j.repos, nil) {
+		j.repos[name].each(func(key string, raw json.RawMessage, version int) {
+			fn(change{Collection: name, Key: key, After: raw, Time: now, Version: version, Seeded: true})
+		})
+	}
+	j.ahead = append(j.ahead, fn)
+}
+
+// collections returns the names of the repositories bound, in order.
+func (j *journal) collections() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return sortedKeys(j.repos, nil)
+}
+
+// bound reports whether the collection name is a repository bound to j.
+func (j *journal) bound(name string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.repos[name]
+	return ok
+}
+
+// listen calls fn with every change from now on, in order, as it is made.
+// It is called with the database's lock held for writing, so it must be
+// quick and must not use the database.
+func (j *journal) listen(fn func(change)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.listeners = append(j.listeners, fn)
+}
+
+// listenAhead calls fn with every change from now on as it is made, like
+// listen, even while changes are held back for an atomic batch, so fn
+// hears of those that are later discarded too, and of their undoing.
+func (j *journal) listenAhead(fn func(change)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.ahead = append(j.ahead, fn)
+}
+
+// hold runs a request that may change the database holding the lock of
+// its journal, j or its sandbox's, crediting its changes to it, until
+// credit knows who the caller is. The operations of an atomic batch run
+// under the batch's hold.
+func (j *journal) hold(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	}
+	if batched(c) {
+		return c.Next()
+	}
+	if sb := sandboxOf(c); sb != nil {
+		j = sb.db.journal
+	}
+	if err := acquire(c.UserContext(), j.lock.TryLock, j.lock.Lock, j.lock.Unlock); err != nil {
+		return err
+	}
+	defer j.lock.Unlock()
+	j.by.Store(&credit{requestID: RequestID(c)})
+	defer j.by.Store(nil)
+	return c.Next()
+}
+
+// credit credits a request's changes to its caller, once they are known.
+// It goes after authentication.
+func (j *journal) credit(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	}
+	if sb := sandboxOf(c); sb != nil {
+		j = sb.db.journal
+	}
+	actor, _ := c.Locals(localsEmail).(string)
+	prev := j.by.Swap(&credit{actor: actor, requestID: RequestID(c)})
+	defer j.by.Store(prev)
+	return c.Next()
+}
+
+// record passes on a change a repository is about to make, which leaves
+// the entity at version.
+func (j *journal) record(collection, key string, before, after json.RawMessage, version int) {
+	ch := change{Collection: collection, Key: key, Before: before, After: after, Time: Now(), Version: version}
+	if by := j.by.Load(); by != nil {
+		ch.Actor, ch.RequestID = by.actor, by.requestID
+	}
+	if j.store != nil {
+		j.write(ch)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, fn := range j.ahead {
+		fn(ch)
+	}
+	if j.deferred {
+		j.pending = append(j.pending, ch)
+		return
+	}
+	for _, fn := range j.listeners {
+		fn(ch)
+	}
+}
+
+// write writes a change through to the store, the entity with its version.
+// A change that fails to be written is still made, and the persister saves
+// the database whole when it next saves it.
+func (j *journal) write(ch change) {
+	var err error
+	if ch.After == nil {
+		err = j.store.Delete(ch.Collection, ch.Key)
+	} else {
+		err = j.store.Put(ch.Collection, ch.Key, withVersion(ch.After, ch.Version))
+	}
+	if err != nil {
+		log.Printf("Persisting %s %s: %v", ch.Collection, ch.Key, err)
+		j.stale.Store(true)
+	}
+}
+
+// begin holds the changes made from now on back until they are committed
+// or discarded, as an atomic batch's are.
+func (j *journal) begin() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.deferred = true
+}
+
+// commit passes on the changes held back since begin.
+func (j *journal) commit() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, ch := range j.pending {
+		for _, fn := range j.listeners {
+			fn(ch)
+		}
+	}
+	j.deferred, j.pending = false, nil
+}
+
+// discard drops the changes held back since begin.
+func (j *journal) discard() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.deferred, j.pending = false, nil
+}
+
+// reload passes on the changes between two encoded databases, as when one
+// replaces the other wholesale, entity by entity of the repositories
+// bound. The entities' versions are taken out of them to be passed on
+// alongside.
+func (j *journal) reload(before, after []byte) error {
+	var old, cur map[string]json.RawMessage
+	if err := json.Unmarshal(before, &old); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(after, &cur); err != nil {
+		return err
+	}
+	for _, name := range j.collections() {
+		a, okA := entities(old[name])
+		b, okB := entities(cur[name])
+		if !okA || !okB {
+			continue
+		}
+		for _, key := range sortedKeys(a, b) {
+			prev, _ := withoutVersion(a[key])
+			next, version := withoutVersion(b[key])
+			if prev != nil && next != nil && sameJSON(prev, next) {
+				continue
+			}
+			if next == nil {
+				version = 0
+			}
+			j.record(name, key, prev, next, version)
+		}
+	}
+	return nil
+}
+
+// bind has the repositories of the database, by their collections' JSON
+// names, tell its journal of their changes. The caller holds the
+// database's lock for writing.
+func (db Database) bind() {
+	v, _ := db.Current()
+	if db.journal != nil && v != nil {
+		bindState(v, db.journal)
+	}
+}
+
+// bindState has the repositories of v, a *T for a server's Database type
+// T, tell j of their changes.
+func bindState(v any, j *journal) {
+	state := reflect.ValueOf(v)
+	if state.Kind() != reflect.Pointer || state.Elem().Kind() != reflect.Struct {
+		return
+	}
+	for name, index := range jsonFields(state.Type()) {
+		field, err := state.Elem().FieldByIndexErr(index)
+		if err != nil || !field.CanAddr() {
+			continue
+		}
+		if r, ok := field.Addr().Interface().(repository); ok {
+			r.bind(name, j)
+			j.mu.Lock()
+			j.repos[name] = r
+			j.mu.Unlock()
+		}
+	}
+}
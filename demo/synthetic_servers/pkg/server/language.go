@@ -0,0 +1,84 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/i18n"
+)
+
+// Language returns the language c's Accept-Language header prefers of
+// those there are translations into, or English. Error messages are
+// translated into it, and notifications when they are read.
+func Language(c *fiber.Ctx) string {
+	return i18n.Negotiate(c.Get(fiber.HeaderAcceptLanguage))
+}
+
+// localize translates e's message, and those of the fields it lists as
+// failing validation, into the language c asks for, saying which in
+// Content-Language. Requests that don't ask are answered in English, and
+// without the header.
+func localize(c *fiber.Ctx, e *Error) {
+	if c.Get(fiber.HeaderAcceptLanguage) == "" {
+		return
+	}
+	lang := Language(c)
+	c.Vary(fiber.HeaderAcceptLanguage)
+	c.Set(fiber.HeaderContentLanguage, lang)
+	e.Message = i18n.T(lang, e.Message)
+	if fields, ok := e.Details.([]FieldError); ok {
+		translated := make([]FieldError, len(fields))
+		for i, fe := range fields {
+			translated[i] = FieldError{Field: fe.Field, Message: i18n.T(lang, fe.Message)}
+		}
+		e.Details = translated
+	}
+}
+
+// Language returns the language email chose for what's sent them, or
+// English.
+func (in *Inbox) Language(email string) string {
+	if lang, ok := in.Languages.Get(strings.ToLower(email)); ok {
+		return lang
+	}
+	return i18n.Default
+}
+
+// language serves the language users choose for their notifications,
+// texts and emails:
+//
+//	GET /api/v1/notifications/language?email=...
+//	PUT /api/v1/notifications/language?email=...  {"language": "es"}
+func (n *notifications) language(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+	v, mu := n.db.in(c).Current()
+	if c.Method() == fiber.MethodGet {
+		if mu != nil {
+			mu.RLock()
+			defer mu.RUnlock()
+		}
+		return c.JSON(fiber.Map{"language": v.(notifying).inbox().Language(email)})
+	}
+
+	var req struct {
+		Language string `json:"language" validate:"required"`
+	}
+	if err := Bind(c, &req); err != nil {
+		return err
+	}
+	lang := strings.ToLower(req.Language)
+	if !i18n.Supported(lang) {
+		return &ValidationError{Errors: []FieldError{{Field: "language", Message: "must be one of " + strings.Join(i18n.Languages, ", ")}}}
+	}
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	in := v.(notifying).inbox()
+	in.Languages.Upsert(strings.ToLower(email), lang)
+	return c.JSON(fiber.Map{"language": lang})
+}
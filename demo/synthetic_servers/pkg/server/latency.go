@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HeaderSimulateLatency delays the response to a request by a duration, or a
+// random one in a range, like 2s or 500ms-3s, overriding the global latency.
+const HeaderSimulateLatency = "X-Simulate-Latency"
+
+// maxLatency caps simulated latency, so a typo can't hang a client for
+// hours.
+const maxLatency = 5 * time.Minute
+
+// latencyRange is a delay between min and max.
+type latencyRange struct {
+	min, max time.Duration
+}
+
+func (r latencyRange) String() string {
+	if r.min == r.max {
+		return r.min.String()
+	}
+	return r.min.String() + "-" + r.max.String()
+}
+
+// pick returns a delay in the range.
+func (r latencyRange) pick() time.Duration {
+	if r.max <= r.min {
+		return r.min
+	}
+	return r.min + rand.N(r.max-r.min+1)
+}
+
+// parseLatency parses a duration, like 200ms, or a range of them, like
+// 100ms-2s. An empty string is no latency.
+func parseLatency(s string) (latencyRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return latencyRange{}, nil
+	}
+	from, to, isRange := strings.Cut(s, "-")
+	lo, err := time.ParseDuration(strings.TrimSpace(from))
+	hi := lo
+	if err == nil && isRange {
+		hi, err = time.ParseDuration(strings.TrimSpace(to))
+	}
+	if err != nil || lo < 0 || hi < lo || hi > maxLatency {
+		return latencyRange{}, fmt.Errorf("latency %q: want a duration or a range of them up to %s, like 200ms or 100ms-2s", s, maxLatency)
+	}
+	return latencyRange{lo, hi}, nil
+}
+
+// latency delays responses, to test how agents cope with slow backends.
+// Admin routes are never delayed.
+type latency struct {
+	mu      sync.Mutex
+	initial latencyRange // From the command line, restored by an admin reset
+	global  latencyRange
+}
+
+// WithLatency delays every API response by cfg.Latency, and honors the
+// X-Simulate-Latency header on each request. Admins can change the global
+// latency at /admin/latency.
+func WithLatency(cfg Config) Option {
+	return func(o *options) {
+		r, err := parseLatency(cfg.Latency)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.latency = &latency{initial: r, global: r}
+	}
+}
+
+func (l *latency) attach(app *fiber.App) {
+	app.Use(l.delay)
+}
+
+func (l *latency) delay(c *fiber.Ctx) error {
+	if strings.HasPrefix(c.Path(), "/admin/") {
+		return c.Next()
+	}
+	l.mu.Lock()
+	r := l.global
+	l.mu.Unlock()
+	if header := c.Get(HeaderSimulateLatency); header != "" {
+		var err error
+		if r, err = parseLatency(header); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, HeaderSimulateLatency+": "+err.Error())
+		}
+	}
+	d := r.pick()
+	if d <= 0 {
+		return c.Next()
+	}
+	Logger(c).Info("Simulating latency", "delay", d.String())
+	if err := sleep(c.UserContext(), d); err != nil {
+		return err
+	}
+	return c.Next()
+}
+
+// attachAdmin mounts the latency admin endpoints on the admin group:
+//
+//	GET /admin/latency  The latency every response gets
+//	PUT /admin/latency  Set it
+func (l *latency) attachAdmin(group fiber.Router) {
+	group.Get("/latency", l.get)
+	group.Put("/latency", l.put)
+}
+
+func (l *latency) get(c *fiber.Ctx) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return c.JSON(l.state())
+}
+
+// put sets the global latency; an empty one turns it off:
+//
+//	PUT /admin/latency {"latency": "500ms-2s"}
+func (l *latency) put(c *fiber.Ctx) error {
+	var req struct {
+		Latency string `json:"latency"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	r, err := parseLatency(req.Latency)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global = r
+	Logger(c).Info("Latency configured", "latency", r.String())
+	return c.JSON(l.state())
+}
+
+// reset goes back to the command line's latency.
+func (l *latency) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global = l.initial
+}
+
+// state describes the global latency. The caller holds l.mu.
+func (l *latency) state() fiber.Map {
+	if l.global.max == 0 {
+		return fiber.Map{"latency": ""}
+	}
+	return fiber.Map{"latency": l.global.String()}
+}
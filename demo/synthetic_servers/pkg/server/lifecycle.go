@@ -0,0 +1,681 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/i18n"
+	"pkg/internal/vars"
+	"pkg/statemachine"
+)
+
+// lifecycleInterval is how often entities due to move on are moved, on top
+// of whenever the clock is moved.
+const lifecycleInterval = 5 * time.Second
+
+// Lifecycle moves the entities of a collection through their statuses on
+// their own as time passes on the server's clock, the way orders ship and
+// rides finish:
+//
+//	server.Lifecycle{Collection: "orders", Steps: []server.Step{
+//		{From: "pending", To: "confirmed", After: 5 * time.Minute},
+//		{From: "confirmed", To: "delivered", After: 48 * time.Hour},
+//	}}
+//
+// Entities in a status no step leaves, such as cancelled, stay put. A
+// database with a Stepped method hears of each step they take, and an
+// entity with a status_history field keeps them there. With a Machine, the
+// steps must be moves it allows, and its hooks run for each.
+type Lifecycle struct {
+	Collection string // The collection's JSON name in the database
+	Field      string // The status field's JSON name; "status" if empty
+	Steps      []Step
+	Sender     string // Who the steps' texts are from, such as Uber
+	Machine    *statemachine.Machine
+}
+
+// Step moves an entity from one status to the next once it has been in the
+// first for a while, or, with At, once a time the entity names has come. A
+// lifecycle has at most one step from each status.
+type Step struct {
+	From   string
+	To     string
+	After  time.Duration // How long after getting From, or after At; may be negative with At
+	At     string        // The JSON name of a time field to wait for instead, such as delivery_date
+	Notify Notice        // What to tell the entity's owner when it takes the step, if anything
+}
+
+// Notice is the notification a step sends the owner of the entity taking
+// it, in a database with an Inbox. Message may name the entity's fields as
+// {{field}}:
+//
+//	server.Notice{Type: "order_shipped", Message: "Your order {{id}} has shipped."}
+//
+// With Text, the owner is texted too, if the database has a PhoneNumber
+// method that knows their number.
+type Notice struct {
+	Type    string
+	Message string
+	Text    string // The TextTemplates entry to text, such as ride_arriving
+}
+
+// stepping is a database that acts on the steps its entities take, such as
+// capturing a ride's fare once it is completed. Stepped is called with the
+// database locked for writing, once the entity has its new status.
+type stepping interface {
+	Stepped(collection, key, from, to string)
+}
+
+// lifecycleOverride changes how one entity moves through its lifecycle.
+type lifecycleOverride struct {
+	paused bool                     // Keep it in its status
+	after  map[string]time.Duration // How long it stays in a status, replacing the step's
+}
+
+// WithLifecycles moves entities through lifecycles unless cfg turns them
+// off. Admins can inspect an entity's progress, pause it, change how long
+// it stays in a status or move it on at once under /admin/lifecycles. With
+// cfg.Retention, entities that have finished their lifecycles for that
+// long are archived to cfg.Archive, where admins find them at
+// /admin/archive, and dropped from the database.
+func WithLifecycles(cfg Config, lifecycles ...Lifecycle) Option {
+	return func(o *options) {
+		if cfg.Lifecycles {
+			o.lifecycles = append(o.lifecycles, lifecycles...)
+		}
+		if cfg.Retention > 0 {
+			if o.retention == nil {
+				r, err := newRetention(cfg.Retention, cfg.Archive)
+				if err != nil {
+					log.Fatal(err)
+				}
+				o.retention = r
+			}
+			o.retention.add(lifecycles...)
+		}
+	}
+}
+
+// lifecycleEntry is where an entity is in its lifecycle.
+type lifecycleEntry struct {
+	status string
+	since  time.Time // When it got the status, as far as the engine knows
+}
+
+// lifecycleEngine runs a database's lifecycles. It learns when an entity
+// got its status from events, or failing that from first seeing it, so
+// entities loaded from the seed start their timelines at startup.
+type lifecycleEngine struct {
+	db         Database
+	events     *events
+	lifecycles map[string]*Lifecycle
+
+	mu        sync.Mutex
+	entries   map[string]lifecycleEntry // Collection/key -> entry
+	overrides map[string]lifecycleOverride
+}
+
+func newLifecycleEngine(db Database, e *events, lifecycles []Lifecycle) *lifecycleEngine {
+	l := &lifecycleEngine{
+		db:         db,
+		events:     e,
+		lifecycles: make(map[string]*Lifecycle),
+		entries:    make(map[string]lifecycleEntry),
+		overrides:  make(map[string]lifecycleOverride),
+	}
+	for i := range lifecycles {
+		lc := &lifecycles[i]
+		if lc.Field == "" {
+			lc.Field = "status"
+		}
+		if lc.Machine != nil {
+			for _, step := range lc.Steps {
+				if err := lc.Machine.Check(step.From, step.To); err != nil {
+					log.Fatalf("Lifecycles: %s: %v", lc.Collection, err)
+				}
+			}
+		}
+		l.lifecycles[lc.Collection] = lc
+	}
+	return l
+}
+
+func (l *lifecycleEngine) start() {
+	l.events.listen(l.observe)
+	l.runLogged(Now())
+	go Every(lifecycleInterval, l.runLogged)
+}
+
+func (l *lifecycleEngine) runLogged(now time.Time) {
+	if n := l.run(now); n > 0 {
+		log.Printf("Advanced the status of %d entit(ies)", n)
+	}
+}
+
+// observe notes when an entity got its status from the event recording it.
+func (l *lifecycleEngine) observe(ev Event) {
+	lc := l.lifecycles[ev.Collection]
+	if lc == nil || ev.Action == EventDeleted {
+		return
+	}
+	var entity map[string]any
+	if json.Unmarshal(ev.Entity, &entity) != nil {
+		return
+	}
+	status, _ := entity[lc.Field].(string)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := ev.Collection + "/" + ev.Key
+	if l.entries[id].status != status {
+		l.entries[id] = lifecycleEntry{status: status, since: ev.Time}
+	}
+}
+
+// restart starts every entity's timeline afresh, after the database is
+// replaced. With overrides set, it drops the overrides too.
+func (l *lifecycleEngine) restart(overrides bool) {
+	l.mu.Lock()
+	l.entries = make(map[string]lifecycleEntry)
+	if overrides {
+		l.overrides = make(map[string]lifecycleOverride)
+	}
+	l.mu.Unlock()
+	l.runLogged(Now())
+}
+
+// lifecycleEntity is an entity in a lifecycle, reached through the
+// database.
+type lifecycleEntity struct {
+	key     string
+	item    reflect.Value
+	fields  map[string][]int
+	status  reflect.Value // Settable
+	stamp   reflect.Value // Its updated_at, if it has a settable one
+	history reflect.Value // Its status_history, if it has one
+	save    func()        // Writes it back, for entities stored by value in a map
+	remove  func()        // Takes it out of its collection; nil for entities in a list
+}
+
+// run moves on every entity due by now, through as many steps as are due,
+// and returns how many moved.
+func (l *lifecycleEngine) run(now time.Time) int {
+	v, mu := l.db.Current()
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	moved := 0
+	seen := make(map[string]bool)
+	for _, lc := range l.lifecycles {
+		for _, e := range lifecycleEntities(v, lc) {
+			id := lc.Collection + "/" + e.key
+			seen[id] = true
+			entry, ok := l.entries[id]
+			if !ok || entry.status != e.status.String() {
+				entry = lifecycleEntry{status: e.status.String(), since: now}
+			}
+			before := entry.status
+			var taken []stepTaken
+			for !l.overrides[id].paused {
+				step, ok := lc.step(entry.status)
+				if !ok {
+					break
+				}
+				at, ok := e.due(step, entry, l.overrides[id])
+				if !ok || at.After(now) {
+					break
+				}
+				entry = lifecycleEntry{status: step.To, since: at}
+				taken = append(taken, stepTaken{step, at})
+			}
+			l.entries[id] = entry
+			if entry.status != before {
+				e.set(lc, entry, taken)
+				moved++
+				if s, ok := v.(stepping); ok {
+					for _, step := range taken {
+						s.Stepped(lc.Collection, e.key, step.From, step.To)
+					}
+				}
+				if _, ok := v.(notifying); ok {
+					e.notify(v, lc, taken)
+				}
+			}
+		}
+	}
+	for id := range l.entries {
+		if !seen[id] {
+			delete(l.entries, id)
+		}
+	}
+	return moved
+}
+
+// due returns when e, which got its status at entry.since, is due to take
+// step, or false if it never is.
+func (e lifecycleEntity) due(step Step, entry lifecycleEntry, override lifecycleOverride) (time.Time, bool) {
+	after := step.After
+	if d, ok := override.after[step.From]; ok {
+		after = d
+	}
+	if step.At == "" {
+		return entry.since.Add(after), true
+	}
+	at, ok := e.time(step.At)
+	return at.Add(after), ok
+}
+
+// time reads e's time field name, which may be a time.Time, a pointer to
+// one, or an RFC 3339 or YYYY-MM-DD string.
+func (e lifecycleEntity) time(name string) (time.Time, bool) {
+	index, ok := e.fields[name]
+	if !ok {
+		return time.Time{}, false
+	}
+	v, ok := fieldValue(e.item.Interface(), index)
+	if !ok {
+		return time.Time{}, false
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t, !t.IsZero()
+	}
+	if v.Kind() != reflect.String {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, v.String()); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// step returns the step from status.
+func (lc *Lifecycle) step(status string) (Step, bool) {
+	for _, s := range lc.Steps {
+		if s.From == status {
+			return s, true
+		}
+	}
+	return Step{}, false
+}
+
+// stepTaken is a step an entity took, and when.
+type stepTaken struct {
+	Step
+	at time.Time
+}
+
+// notify sends the entity's owner, in the database v, the notices of the
+// steps it took. Entities without an owner go unannounced.
+func (e lifecycleEntity) notify(v any, lc *Lifecycle, taken []stepTaken) {
+	data, err := json.Marshal(e.item.Interface())
+	if err != nil {
+		return
+	}
+	var entity map[string]any
+	if json.Unmarshal(data, &entity) != nil {
+		return
+	}
+	owner := entityOwner(entity)
+	if owner == "" {
+		return
+	}
+	fields := make(map[string]string, len(entity))
+	flatten("", entity, fields)
+	in := v.(notifying).inbox()
+	phone := ""
+	if book, ok := v.(phoneBook); ok {
+		phone = book.PhoneNumber(owner)
+	}
+	for _, step := range taken {
+		if step.Notify.Type == "" {
+			continue
+		}
+		n := in.Notify(Notification{
+			UserEmail:  owner,
+			Type:       step.Notify.Type,
+			Message:    vars.Fill(i18n.Template(in.Language(owner), step.Notify.Message), fields),
+			Collection: lc.Collection,
+			EntityID:   e.key,
+			CreatedAt:  step.at,
+		})
+		if step.Notify.Text == "" || phone == "" {
+			continue
+		}
+		fields["message"] = n.Message
+		in.SendText(Text{
+			From:       lc.Sender,
+			To:         phone,
+			UserEmail:  owner,
+			Template:   step.Notify.Text,
+			Collection: lc.Collection,
+			EntityID:   e.key,
+			SentAt:     step.at,
+		}, fields)
+	}
+}
+
+// flatten puts the scalar fields of a JSON object into fields, the nested
+// ones by dotted names such as driver.name.
+func flatten(prefix string, object map[string]any, fields map[string]string) {
+	for name, v := range object {
+		switch v := v.(type) {
+		case string, float64, bool:
+			fields[prefix+name] = fmt.Sprint(v)
+		case map[string]any:
+			flatten(prefix+name+".", v, fields)
+		}
+	}
+}
+
+// set gives e the status of entry, having taken the steps taken to get
+// there, which go in its history and to lc's machine's hooks.
+func (e lifecycleEntity) set(lc *Lifecycle, entry lifecycleEntry, taken []stepTaken) {
+	e.status.SetString(entry.status)
+	for _, step := range taken {
+		t := statemachine.Transition{From: step.From, To: step.To, At: step.at}
+		if e.history.IsValid() {
+			e.history.Set(reflect.Append(e.history, reflect.ValueOf(t)))
+		}
+		if lc.Machine != nil {
+			lc.Machine.Moved(e.item.Addr().Interface(), t)
+		}
+	}
+	if e.stamp.IsValid() {
+		e.stamp.Set(reflect.ValueOf(entry.since))
+	}
+	if e.save != nil {
+		e.save()
+	}
+}
+
+// lifecycleEntities finds the entities of lc's collection in the database
+// v, which may be a map, Repository or slice of structs or pointers to
+// them. The caller holds the database's write lock.
+func lifecycleEntities(v any, lc *Lifecycle) []lifecycleEntity {
+	index, ok := jsonFields(reflect.TypeOf(v))[lc.Collection]
+	if !ok {
+		return nil
+	}
+	coll, ok := fieldValue(v, index)
+	if !ok {
+		return nil
+	}
+
+	var found []lifecycleEntity
+	add := func(key string, item reflect.Value, save, remove func()) {
+		for item.Kind() == reflect.Pointer {
+			if item.IsNil() {
+				return
+			}
+			item = item.Elem()
+		}
+		if item.Kind() != reflect.Struct {
+			return
+		}
+		fields := jsonFields(item.Type())
+		status, ok := fields[lc.Field]
+		if !ok || item.FieldByIndex(status).Kind() != reflect.String {
+			return
+		}
+		if key == "" {
+			key = entityKey(item, fields)
+		}
+		e := lifecycleEntity{key: key, item: item, fields: fields, status: item.FieldByIndex(status), save: save, remove: remove}
+		if stamp, ok := fields["updated_at"]; ok && item.FieldByIndex(stamp).Type() == reflect.TypeFor[time.Time]() {
+			e.stamp = item.FieldByIndex(stamp)
+		}
+		if history, ok := fields["status_history"]; ok && item.FieldByIndex(history).Type() == reflect.TypeFor[[]statemachine.Transition]() {
+			e.history = item.FieldByIndex(history)
+		}
+		found = append(found, e)
+	}
+
+	store := func(key, item reflect.Value) { coll.SetMapIndex(key, item) }
+	drop := func(key reflect.Value) { coll.SetMapIndex(key, reflect.Value{}) }
+	if r, ok := coll.Addr().Interface().(repository); ok {
+		// A Repository stores entities back through Upsert, and removes
+		// them through Delete, which keep its indexes.
+		var upsert func(string, reflect.Value)
+		coll, upsert = r.entities()
+		store = func(key, item reflect.Value) { upsert(key.String(), item) }
+		drop = func(key reflect.Value) { r.remove(key.String()) }
+	}
+
+	switch coll.Kind() {
+	case reflect.Map:
+		iter := coll.MapRange()
+		for iter.Next() {
+			key, item := iter.Key(), iter.Value()
+			name := fmt.Sprint(key.Interface())
+			remove := func() { drop(key) }
+			if item.Kind() == reflect.Pointer {
+				add(name, item, nil, remove)
+				continue
+			}
+			// Map values can't be set in place; work on a copy and
+			// store it back.
+			copied := reflect.New(item.Type()).Elem()
+			copied.Set(item)
+			add(name, copied, func() { store(key, copied) }, remove)
+		}
+	case reflect.Slice:
+		for i := 0; i < coll.Len(); i++ {
+			add("", coll.Index(i), nil, nil)
+		}
+	}
+	return found
+}
+
+// entityKey keys an entity in a list by its id, as events and diffs do.
+func entityKey(item reflect.Value, fields map[string][]int) string {
+	index, ok := fields["id"]
+	if !ok {
+		return ""
+	}
+	b, err := json.Marshal(item.FieldByIndex(index).Interface())
+	if err != nil {
+		return ""
+	}
+	return string(bytes.Trim(b, `"`))
+}
+
+// attach mounts the lifecycle admin endpoints on the admin group:
+//
+//	GET    /admin/lifecycles                           Lifecycles and their steps
+//	GET    /admin/lifecycles/:collection/:id           Where an entity is in its lifecycle
+//	PUT    /admin/lifecycles/:collection/:id           Override how it moves on
+//	DELETE /admin/lifecycles/:collection/:id           Remove the override
+//	POST   /admin/lifecycles/:collection/:id/advance   Move it on to its next status now
+func (l *lifecycleEngine) attach(group fiber.Router) {
+	group.Get("/lifecycles", l.list)
+	group.Get("/lifecycles/:collection/:id", l.get)
+	group.Put("/lifecycles/:collection/:id", l.override)
+	group.Delete("/lifecycles/:collection/:id", l.clearOverride)
+	group.Post("/lifecycles/:collection/:id/advance", l.advance)
+}
+
+func (l *lifecycleEngine) list(c *fiber.Ctx) error {
+	type step struct {
+		From  string `json:"from"`
+		To    string `json:"to"`
+		After string `json:"after"`
+		At    string `json:"at,omitempty"`
+	}
+	out := make(map[string]fiber.Map, len(l.lifecycles))
+	for name, lc := range l.lifecycles {
+		steps := make([]step, len(lc.Steps))
+		for i, s := range lc.Steps {
+			steps[i] = step{s.From, s.To, s.After.String(), s.At}
+		}
+		out[name] = fiber.Map{"field": lc.Field, "steps": steps}
+		if lc.Machine != nil {
+			out[name]["moves"] = lc.Machine.Moves
+		}
+	}
+	return c.JSON(out)
+}
+
+// lookup finds the lifecycle and entity a request names. The caller holds
+// the database's lock.
+func (l *lifecycleEngine) lookup(c *fiber.Ctx) (*Lifecycle, lifecycleEntity, error) {
+	lc := l.lifecycles[c.Params("collection")]
+	if lc == nil {
+		return nil, lifecycleEntity{}, fiber.NewError(fiber.StatusNotFound, "no lifecycle for that collection")
+	}
+	v, _ := l.db.Current()
+	for _, e := range lifecycleEntities(v, lc) {
+		if e.key == c.Params("id") {
+			return lc, e, nil
+		}
+	}
+	return nil, lifecycleEntity{}, fiber.NewError(fiber.StatusNotFound, "entity not found")
+}
+
+// state describes where an entity is in its lifecycle. The caller holds
+// l.mu.
+func (l *lifecycleEngine) state(lc *Lifecycle, e lifecycleEntity) fiber.Map {
+	id := lc.Collection + "/" + e.key
+	status := e.status.String()
+	out := fiber.Map{"collection": lc.Collection, "id": e.key, "status": status}
+	entry, ok := l.entries[id]
+	if ok && entry.status == status {
+		out["since"] = entry.since
+	}
+	override, overridden := l.overrides[id]
+	if overridden {
+		after := make(map[string]string, len(override.after))
+		for s, d := range override.after {
+			after[s] = d.String()
+		}
+		out["override"] = fiber.Map{"paused": override.paused, "after": after}
+	}
+	if step, ok := lc.step(status); ok && !override.paused {
+		next := fiber.Map{"status": step.To}
+		if _, known := out["since"]; known || step.At != "" {
+			if at, ok := e.due(step, entry, override); ok {
+				next["at"] = at
+			}
+		}
+		out["next"] = next
+	}
+	return out
+}
+
+func (l *lifecycleEngine) get(c *fiber.Ctx) error {
+	_, mu := l.db.Current()
+	if mu != nil {
+		mu.RLock()
+		defer mu.RUnlock()
+	}
+	lc, e, err := l.lookup(c)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return c.JSON(l.state(lc, e))
+}
+
+// override changes how an entity moves on, with durations such as "90m":
+//
+//	PUT /admin/lifecycles/orders/ord_1 {"paused": false, "after": {"confirmed": "10m"}}
+func (l *lifecycleEngine) override(c *fiber.Ctx) error {
+	var req struct {
+		Paused bool              `json:"paused"`
+		After  map[string]string `json:"after"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	override := lifecycleOverride{paused: req.Paused, after: make(map[string]time.Duration)}
+	for status, s := range req.After {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("after.%s must be a duration, such as \"90m\" or \"72h\"", status))
+		}
+		override.after[status] = d
+	}
+
+	_, mu := l.db.Current()
+	if mu != nil {
+		mu.RLock()
+		defer mu.RUnlock()
+	}
+	lc, e, err := l.lookup(c)
+	if err != nil {
+		return err
+	}
+	for status := range override.after {
+		if _, ok := lc.step(status); !ok {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("no step leaves status %q; statuses: %s", status, strings.Join(lc.statuses(), ", ")))
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.overrides[lc.Collection+"/"+e.key] = override
+	return c.JSON(l.state(lc, e))
+}
+
+func (l *lifecycleEngine) clearOverride(c *fiber.Ctx) error {
+	_, mu := l.db.Current()
+	if mu != nil {
+		mu.RLock()
+		defer mu.RUnlock()
+	}
+	lc, e, err := l.lookup(c)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.overrides, lc.Collection+"/"+e.key)
+	return c.JSON(l.state(lc, e))
+}
+
+// advance moves an entity on to its next status now, paused or not.
+func (l *lifecycleEngine) advance(c *fiber.Ctx) error {
+	_, mu := l.db.Current()
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	lc, e, err := l.lookup(c)
+	if err != nil {
+		return err
+	}
+	step, ok := lc.step(e.status.String())
+	if !ok {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("status %q is final", e.status.String()))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := lifecycleEntry{status: step.To, since: Now()}
+	l.entries[lc.Collection+"/"+e.key] = entry
+	e.set(lc, entry, []stepTaken{{step, entry.since}})
+	Logger(c).Info("Lifecycle advanced", "collection", lc.Collection, "id", e.key, "status", step.To)
+	return c.JSON(l.state(lc, e))
+}
+
+// statuses lists the statuses steps leave, sorted.
+func (lc *Lifecycle) statuses() []string {
+	var statuses []string
+	for _, s := range lc.Steps {
+		statuses = append(statuses, s.From)
+	}
+	sort.Strings(statuses)
+	return statuses
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MIMEApplicationHAL is the media type of responses whose entities carry
+// links, which clients ask for with Accept.
+const MIMEApplicationHAL = "application/hal+json"
+
+// Links are the links the entities of one of the spec's schemas carry in
+// responses to clients that ask for them, as HAL's _links:
+//
+//	server.Links{Schema: "Ride", Links: []server.Link{
+//		{Rel: "self", Href: "/api/v1/rides/{{id}}"},
+//		{Rel: "cancel", Href: "/api/v1/rides/{{id}}", Method: fiber.MethodDelete, Status: []string{"requested", "accepted"}},
+//	}}
+//
+// A client that sends Accept: application/hal+json then gets
+//
+//	{"id": "ride_1", ..., "_links": {"self": {"href": "/api/v1/rides/ride_1"},
+//	 "cancel": {"href": "/api/v1/rides/ride_1", "method": "DELETE"}}}
+//
+// wherever the spec says a response has a Ride, in a list or nested in
+// another entity as well as on its own. Links to routes the spec doesn't
+// have, such as those of another profile, are left out.
+type Links struct {
+	Schema string // The entities' schema in the spec, which is their Go type, such as Ride
+	Field  string // The status field's JSON name, for Link.Status; "status" if empty
+	Links  []Link
+}
+
+// Link is a link an entity carries. Href names the entity's fields as
+// {{field}}, and fields of its nested objects by their paths; a path
+// through an array, such as {{items.product_id}}, gives a link for each
+// element, and the relation is a list of them.
+type Link struct {
+	Rel    string   // Such as self, cancel or product
+	Href   string   // Such as /api/v1/products/{{items.product_id}}
+	Method string   // For actions, such as POST; empty for GET
+	Status []string // The statuses the entity must be in to carry it, such as those it can be cancelled in; any if empty
+}
+
+// WithLinks adds links to the entities of the spec's schemas, for clients
+// that ask for them. A server without a spec serves none.
+func WithLinks(links ...Links) Option {
+	return func(o *options) {
+		o.links = append(o.links, links...)
+	}
+}
+
+// linker adds links to the entities in responses, by the schemas the spec
+// says the responses have.
+type linker struct {
+	spec    openAPI
+	schemas map[string]Links
+}
+
+func newLinker(spec []byte, links []Links) (*linker, error) {
+	l := &linker{schemas: make(map[string]Links, len(links))}
+	if err := json.Unmarshal(spec, &l.spec); err != nil {
+		return nil, fmt.Errorf("parsing OpenAPI spec: %w", err)
+	}
+	for _, ls := range links {
+		if _, ok := l.spec.Components.Schemas[ls.Schema]; !ok {
+			return nil, fmt.Errorf("links: the spec has no schema %s", ls.Schema)
+		}
+		if ls.Field == "" {
+			ls.Field = "status"
+		}
+		var served []Link
+		for _, link := range ls.Links {
+			if l.serves(link) {
+				served = append(served, link)
+			}
+		}
+		ls.Links = served
+		l.schemas[ls.Schema] = ls
+	}
+	return l, nil
+}
+
+// serves reports whether the spec has the route link leads to, which a
+// profile of the server may not.
+func (l *linker) serves(link Link) bool {
+	method := strings.ToLower(link.Method)
+	if method == "" {
+		method = "get"
+	}
+	path, _, _ := strings.Cut(link.Href, "?")
+	want := strings.Split(path, "/")
+	for route, ops := range l.spec.Paths {
+		if _, ok := ops[method]; !ok {
+			continue
+		}
+		got := strings.Split(route, "/")
+		if len(got) != len(want) {
+			continue
+		}
+		match := true
+		for i, segment := range got {
+			param := strings.HasPrefix(segment, "{") && strings.Contains(want[i], "{{")
+			if segment != want[i] && !param {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// attach serves links under /api, behind the API versions, so that a
+// version's serializer sees them as part of v1's response.
+func (l *linker) attach(app *fiber.App) {
+	app.Use("/api", l.serve)
+}
+
+func (l *linker) serve(c *fiber.Ctx) error {
+	if c.Accepts(fiber.MIMEApplicationJSON, MIMEApplicationHAL) != MIMEApplicationHAL {
+		return c.Next()
+	}
+	c.Vary(fiber.HeaderAccept)
+	if err := c.Next(); err != nil {
+		if err := c.App().Config().ErrorHandler(c, err); err != nil {
+			return err
+		}
+	}
+
+	resp := c.Response()
+	if resp.IsBodyStream() || !strings.HasPrefix(string(resp.Header.ContentType()), fiber.MIMEApplicationJSON) {
+		return nil
+	}
+	op, ok := l.spec.Paths[specPath(c.Route().Path)][strings.ToLower(c.Method())]
+	if !ok {
+		return nil
+	}
+	media, ok := op.Responses[fmt.Sprint(resp.StatusCode())].Content[fiber.MIMEApplicationJSON]
+	if !ok || media.Schema == nil {
+		return nil
+	}
+	body, err := l.annotate(resp.Body(), media.Schema, RequestVersion(c))
+	if err != nil {
+		return err
+	}
+	resp.SetBodyRaw(body)
+	c.Set(fiber.HeaderContentType, MIMEApplicationHAL)
+	return nil
+}
+
+// annotate returns data, compacted, with _links added to each entity in
+// it that has links, by its schema s. Links to v1 are given to version.
+func (l *linker) annotate(data json.RawMessage, s *schema, version string) (json.RawMessage, error) {
+	var links []Link
+	field := ""
+	for s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+		if ls, ok := l.schemas[name]; ok && links == nil {
+			links, field = ls.Links, ls.Field
+		}
+		if s = l.spec.Components.Schemas[name]; s == nil {
+			return compact(data), nil
+		}
+	}
+
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) > 0 && data[0] == '[' && s.Items != nil:
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		out.WriteByte('[')
+		for i, e := range elems {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			e, err := l.annotate(e, s.Items, version)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(e)
+		}
+		out.WriteByte(']')
+		return out.Bytes(), nil
+
+	case len(data) > 0 && data[0] == '{':
+		dec := json.NewDecoder(bytes.NewReader(data))
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		out.WriteByte('{')
+		for n := 0; dec.More(); n++ {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := tok.(string)
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, err
+			}
+			if prop := s.Properties[key]; prop != nil {
+				value, err = l.annotate(value, prop, version)
+			} else if s.AdditionalProperties != nil {
+				value, err = l.annotate(value, s.AdditionalProperties, version)
+			} else {
+				value = compact(value)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				out.WriteByte(',')
+			}
+			k, _ := json.Marshal(key)
+			out.Write(k)
+			out.WriteByte(':')
+			out.Write(value)
+		}
+		if links != nil {
+			rendered, err := renderLinks(data, links, field, version)
+			if err != nil {
+				return nil, err
+			}
+			if rendered != nil {
+				if out.Len() > 1 {
+					out.WriteByte(',')
+				}
+				out.WriteString(`"_links":`)
+				out.Write(rendered)
+			}
+		}
+		out.WriteByte('}')
+		return out.Bytes(), nil
+	}
+	return compact(data), nil
+}
+
+// halLink is a link as HAL renders it.
+type halLink struct {
+	Href   string `json:"href"`
+	Method string `json:"method,omitempty"`
+}
+
+var linkField = regexp.MustCompile(`\{\{([\w.]+)\}\}`)
+
+// renderLinks returns the _links of the entity data, or nil if it carries
+// none: those its status allows, with every field their hrefs name.
+func renderLinks(data json.RawMessage, links []Link, field, version string) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var entity map[string]any
+	if err := dec.Decode(&entity); err != nil {
+		return nil, err
+	}
+	status, _ := entity[field].(string)
+
+	var rels []string
+	rendered := make(map[string]any)
+	for _, link := range links {
+		if len(link.Status) > 0 && !slices.Contains(link.Status, status) {
+			continue
+		}
+		hrefs := []string{link.Href}
+		many := false
+		for _, m := range linkField.FindAllStringSubmatch(link.Href, -1) {
+			values, fanned := linkValues(entity, strings.Split(m[1], "."))
+			many = many || fanned
+			var filled []string
+			for _, href := range hrefs {
+				for _, v := range values {
+					filled = append(filled, strings.ReplaceAll(href, m[0], url.PathEscape(v)))
+				}
+			}
+			hrefs = filled
+		}
+		if version != "v1" {
+			for i, href := range hrefs {
+				if rest, ok := strings.CutPrefix(href, "/api/v1/"); ok {
+					hrefs[i] = "/api/" + version + "/" + rest
+				}
+			}
+		}
+		if len(hrefs) == 0 {
+			continue
+		}
+		if !many {
+			rendered[link.Rel] = halLink{Href: hrefs[0], Method: link.Method}
+		} else {
+			list := make([]halLink, len(hrefs))
+			for i, href := range hrefs {
+				list[i] = halLink{Href: href, Method: link.Method}
+			}
+			rendered[link.Rel] = list
+		}
+		rels = append(rels, link.Rel)
+	}
+	if len(rels) == 0 {
+		return nil, nil
+	}
+
+	// The relations keep the order the server gave them, and hrefs their
+	// query strings' &s.
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	out.WriteByte('{')
+	for i, rel := range rels {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		if err := enc.Encode(rel); err != nil {
+			return nil, err
+		}
+		out.Truncate(out.Len() - 1) // Encode's newline
+		out.WriteByte(':')
+		if err := enc.Encode(rendered[rel]); err != nil {
+			return nil, err
+		}
+		out.Truncate(out.Len() - 1)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+// linkValues returns the values at path in v, as strings, and whether the
+// path went through an array, giving one for each of its elements. Values
+// that are missing, empty or not scalars are left out.
+func linkValues(v any, path []string) (values []string, fanned bool) {
+	switch e := v.(type) {
+	case []any:
+		for _, elem := range e {
+			found, _ := linkValues(elem, path)
+			values = append(values, found...)
+		}
+		return values, true
+	case map[string]any:
+		if len(path) == 0 {
+			return nil, false
+		}
+		return linkValues(e[path[0]], path[1:])
+	case nil:
+		return nil, false
+	}
+	if len(path) > 0 {
+		return nil, false
+	}
+	s := fmt.Sprint(v)
+	if s == "" {
+		return nil, false
+	}
+	return []string{s}, false
+}
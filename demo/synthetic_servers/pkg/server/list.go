@@ -0,0 +1,315 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/money"
+)
+
+// Paging limits for list endpoints.
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+)
+
+// Page is the envelope list endpoints respond with: one page of the
+// matching items and how many match in all.
+type Page[T any] struct {
+	Data   []T `json:"data"`
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// listParams are the query parameters List reads itself, or that mean
+// something else, such as currency; any other parameter naming a field of
+// the items filters on it.
+var listParams = map[string]bool{"limit": true, "offset": true, "sort": true, "cursor": true, "email": true, "currency": true}
+
+// List responds with a page of items, shaped by the query:
+//
+//	?status=active,paused  keep items whose status is one of the values
+//	?sort=-price,name      order by price descending, then name
+//	?limit=20&offset=40    the page; limit defaults to DefaultLimit
+//	?limit=20&cursor=      the first page by cursor, newest first, with
+//	                       next_cursor to pass for the next one
+//	?format=csv            every matching item, unpaged, as CSV or
+//	                       JSON lines (jsonl); see Export
+//
+// Filters and sort keys are the items' JSON field names. Parameters the
+// handler has already filtered on itself, perhaps differently, are named in
+// handled so they aren't applied again; a handler that has put the items in
+// the order its own sort parameter asks for names "sort". Soft-deleted
+// items are left out, as are those of private collections that belong to
+// someone other than the caller. items is not modified.
+func List[T any](c *fiber.Ctx, items []T, handled ...string) error {
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+
+	fields := jsonFields(reflect.TypeFor[T]())
+	format := ExportFormat(c)
+	if format != "" {
+		handled = append(slices.Clip(handled), "format")
+	}
+	matched := filterItems(c, withoutOthers(c, withoutDeleted(items), fields), fields, handled)
+	sortBy := c.Query("sort")
+	if slices.Contains(handled, "sort") {
+		sortBy = ""
+	}
+	if format != "" {
+		if err := sortItems(matched, sortBy, fields); err != nil {
+			return err
+		}
+		return Export(c, matched, format)
+	}
+	if c.Context().QueryArgs().Has("cursor") {
+		return listByCursor(c, matched, limit, fields)
+	}
+	if err := sortItems(matched, sortBy, fields); err != nil {
+		return err
+	}
+	return c.JSON(pageOf(matched, limit, offset))
+}
+
+// Paginate returns the page of items the query's limit and offset ask for,
+// checked as List checks them, for responses that carry a page alongside
+// something else, such as a thread with a page of its replies:
+//
+//	replies, err := server.Paginate(c, thread.Replies)
+//	...
+//	return c.JSON(fiber.Map{"thread": thread, "replies": replies})
+//
+// items are paged as they are, neither filtered nor sorted.
+func Paginate[T any](c *fiber.Ctx, items []T) (Page[T], error) {
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		return Page[T]{}, err
+	}
+	return pageOf(items, limit, offset), nil
+}
+
+// pageParams reads the query's limit and offset.
+func pageParams(c *fiber.Ctx) (limit, offset int, err error) {
+	if limit, err = queryInt(c, "limit", DefaultLimit, 1, MaxLimit); err != nil {
+		return 0, 0, err
+	}
+	if offset, err = queryInt(c, "offset", 0, 0, -1); err != nil {
+		return 0, 0, err
+	}
+	return limit, offset, nil
+}
+
+// pageOf returns the page of items from offset, of limit at most.
+func pageOf[T any](items []T, limit, offset int) Page[T] {
+	page := Page[T]{Data: []T{}, Total: len(items), Limit: limit, Offset: offset}
+	if offset < len(items) {
+		page.Data = items[offset:min(offset+limit, len(items))]
+	}
+	return page
+}
+
+// withoutOthers leaves out the items that ownership indexes, by ID, as
+// someone else's. The caller's own, those of no one, and all of them for
+// those who may see everything are kept.
+func withoutOthers[T any](c *fiber.Ctx, items []T, fields map[string][]int) []T {
+	owners, _ := c.Locals(localsOwners).(*ownership)
+	index, ok := fields["id"]
+	if owners == nil || !ok {
+		return items
+	}
+	kept := make([]T, 0, len(items))
+	for _, item := range items {
+		if v, ok := fieldValue(item, index); ok && v.Kind() == reflect.String {
+			if owner, ok := owners.owner(v.String()); ok && !Owns(c, owner) {
+				continue
+			}
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+func queryInt(c *fiber.Ctx, name string, def, lo, hi int) (int, error) {
+	s := c.Query(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < lo {
+		return 0, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("%s must be an integer of at least %d", name, lo))
+	}
+	if hi >= 0 && n > hi {
+		n = hi
+	}
+	return n, nil
+}
+
+// jsonFields maps the JSON names of a struct's fields, including promoted
+// ones, to their indexes. It is empty for items that aren't structs.
+func jsonFields(t reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return fields
+	}
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous && f.Tag.Get("json") == "" {
+			continue
+		}
+		if name := fieldName(f); name != "-" {
+			if _, ok := fields[name]; !ok || len(f.Index) < len(fields[name]) {
+				fields[name] = f.Index
+			}
+		}
+	}
+	return fields
+}
+
+// fieldValue returns item's field at index, or false if a nil pointer is
+// in the way.
+func fieldValue(item any, index []int) (reflect.Value, bool) {
+	v := reflect.ValueOf(item)
+	for _, i := range index {
+		for v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	return v, true
+}
+
+func filterItems[T any](c *fiber.Ctx, items []T, fields map[string][]int, handled []string) []T {
+	type filter struct {
+		index  []int
+		values []string
+	}
+	var filters []filter
+	for name, value := range c.Queries() {
+		if index, ok := fields[name]; ok && !listParams[name] && !slices.Contains(handled, name) {
+			filters = append(filters, filter{index, strings.Split(value, ",")})
+		}
+	}
+
+	matched := make([]T, 0, len(items))
+	for _, item := range items {
+		keep := true
+		for _, f := range filters {
+			v, ok := fieldValue(item, f.index)
+			if !ok || !slices.ContainsFunc(f.values, func(want string) bool { return strings.EqualFold(formatValue(v), want) }) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			matched = append(matched, item)
+		}
+	}
+	return matched
+}
+
+// formatValue renders a field as it would be written in a query.
+func formatValue(v reflect.Value) string {
+	switch t := v.Interface().(type) {
+	case time.Time:
+		return t.Format(time.RFC3339)
+	case money.Money:
+		return t.Decimal()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func sortItems[T any](items []T, sortBy string, fields map[string][]int) error {
+	if sortBy == "" {
+		return nil
+	}
+	type key struct {
+		index []int
+		desc  bool
+	}
+	var keys []key
+	for _, name := range strings.Split(sortBy, ",") {
+		name, desc := strings.CutPrefix(strings.TrimSpace(name), "-")
+		index, ok := fields[name]
+		if !ok {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Cannot sort by %q", name))
+		}
+		keys = append(keys, key{index, desc})
+	}
+
+	slices.SortStableFunc(items, func(a, b T) int {
+		for _, k := range keys {
+			va, oka := fieldValue(a, k.index)
+			vb, okb := fieldValue(b, k.index)
+			n := compareValues(va, oka, vb, okb)
+			if k.desc {
+				n = -n
+			}
+			if n != 0 {
+				return n
+			}
+		}
+		return 0
+	})
+	return nil
+}
+
+// compareValues orders two fields of the same type; missing values, from
+// nil pointers, sort first.
+func compareValues(a reflect.Value, oka bool, b reflect.Value, okb bool) int {
+	if !oka || !okb {
+		return cmp.Compare(boolInt(oka), boolInt(okb))
+	}
+	switch ta := a.Interface().(type) {
+	case time.Time:
+		return ta.Compare(b.Interface().(time.Time))
+	case money.Money:
+		return cmp.Compare(ta.Minor, b.Interface().(money.Money).Minor)
+	}
+	switch a.Kind() {
+	case reflect.String:
+		return strings.Compare(strings.ToLower(a.String()), strings.ToLower(b.String()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp.Compare(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp.Compare(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return cmp.Compare(a.Float(), b.Float())
+	case reflect.Bool:
+		return cmp.Compare(boolInt(a.Bool()), boolInt(b.Bool()))
+	}
+	return strings.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
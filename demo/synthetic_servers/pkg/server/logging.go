@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HeaderRequestID identifies a request in the logs. A client may send its
+// own; otherwise the server makes one up. Either way the response carries
+// it.
+const HeaderRequestID = "X-Request-ID"
+
+const localsRequestID = "server.requestID"
+
+type requestIDKey struct{}
+
+// setupLogging writes logs, including those from the log package, to
+// stderr as JSON lines.
+func setupLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+}
+
+// logRequests logs every request once it is done: its ID, method, path
+// and route, status, latency and the caller's identity.
+func logRequests(c *fiber.Ctx) error {
+	start := time.Now()
+	id := requestID(c.Get(HeaderRequestID))
+	c.Set(HeaderRequestID, id)
+	c.Locals(localsRequestID, id)
+	c.SetUserContext(context.WithValue(c.UserContext(), requestIDKey{}, id))
+
+	if err := c.Next(); err != nil {
+		// Render the error here to log its status.
+		if err := c.App().Config().ErrorHandler(c, err); err != nil {
+			return err
+		}
+	}
+
+	status := c.Response().StatusCode()
+	level := slog.LevelInfo
+	if status >= fiber.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{
+		slog.String("method", c.Method()),
+		slog.String("path", c.Path()),
+		slog.String("route", c.Route().Path),
+		slog.Int("status", status),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.String("ip", c.IP()),
+	}
+	if email, _ := c.Locals(localsEmail).(string); email != "" {
+		attrs = append(attrs, slog.String("user", email))
+	}
+	Logger(c).LogAttrs(c.UserContext(), level, "request", attrs...)
+	return nil
+}
+
+// requestID returns the ID a client sent, if it is reasonable, or a new
+// one.
+func requestID(sent string) string {
+	if sent != "" && len(sent) <= 128 && !strings.ContainsFunc(sent, func(r rune) bool { return r < ' ' || r > '~' }) {
+		return strings.Clone(sent)
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// RequestID returns the ID of the request c is handling.
+func RequestID(c *fiber.Ctx) string {
+	id, _ := c.Locals(localsRequestID).(string)
+	return id
+}
+
+// Logger returns the logger for handlers to log with, which tags each
+// line with the request's ID:
+//
+//	server.Logger(c).Info("Refund issued", "order", order.ID)
+func Logger(c *fiber.Ctx) *slog.Logger {
+	return LoggerContext(c.UserContext())
+}
+
+// LoggerContext is Logger for code that has the request's context,
+// c.UserContext(), rather than c.
+func LoggerContext(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
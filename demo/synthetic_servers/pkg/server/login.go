@@ -0,0 +1,307 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	sessionTTL = time.Hour
+	refreshTTL = 30 * 24 * time.Hour
+
+	minPasswordLength = 8
+	hashIterations    = 100_000
+)
+
+// Fiber locals set by authenticate.
+const (
+	localsToken    = "auth_token"
+	localsEmail    = "auth_email"
+	localsRole     = "auth_role"
+	localsRequired = "auth_required"
+)
+
+type credentialsRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+}
+
+// sessionResponse is what register, login and refresh return.
+type sessionResponse struct {
+	TokenType        string    `json:"token_type"`
+	AccessToken      string    `json:"access_token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+type userResponse struct {
+	Email     string     `json:"email"`
+	Name      string     `json:"name,omitempty"`
+	Role      string     `json:"role"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+func (a *authenticator) register(c *fiber.Ctx) error {
+	var req credentialsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	email := strings.TrimSpace(req.Email)
+	if !strings.Contains(email, "@") {
+		return fiber.NewError(fiber.StatusBadRequest, "a valid email is required")
+	}
+	if len(req.Password) < minPasswordLength {
+		return fiber.NewError(fiber.StatusBadRequest,
+			fmt.Sprintf("password must be at least %d characters", minPasswordLength))
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+
+	state, unlock := a.state(true)
+	defer unlock()
+	key := strings.ToLower(email)
+	if _, ok := state.Credentials[key]; ok {
+		return fiber.NewError(fiber.StatusConflict, "email is already registered")
+	}
+	if state.Credentials == nil {
+		state.Credentials = make(map[string]Credential)
+	}
+	cred := Credential{
+		Email:        email,
+		Name:         strings.TrimSpace(req.Name),
+		PasswordHash: hash,
+		CreatedAt:    Now(),
+	}
+	state.Credentials[key] = cred
+
+	session, err := state.newSession(cred.Email)
+	if err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"user":    cred.user(state.role(cred.Email)),
+		"session": session.response(),
+	})
+}
+
+func (a *authenticator) login(c *fiber.Ctx) error {
+	var req credentialsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	// Checking the password takes a while, so it is done holding no lock,
+	// and the write lock only to start the session.
+	state, unlock := a.state(false)
+	cred, ok := state.Credentials[strings.ToLower(strings.TrimSpace(req.Email))]
+	unlock()
+	if !ok || !checkPassword(cred.PasswordHash, req.Password) {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid email or password")
+	}
+
+	state, unlock = a.state(true)
+	defer unlock()
+	session, err := state.newSession(cred.Email)
+	if err != nil {
+		return err
+	}
+	return c.JSON(session.response())
+}
+
+// refresh trades a refresh token for a new session, revoking the old one.
+func (a *authenticator) refresh(c *fiber.Ctx) error {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.RefreshToken == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "refresh_token is required")
+	}
+
+	state, unlock := a.state(true)
+	defer unlock()
+	now := Now()
+	for token, s := range state.Sessions {
+		if s.RefreshToken != req.RefreshToken {
+			continue
+		}
+		delete(state.Sessions, token)
+		if !now.Before(s.RefreshExpiresAt) {
+			break
+		}
+		session, err := state.newSession(s.Email)
+		if err != nil {
+			return err
+		}
+		return c.JSON(session.response())
+	}
+	return fiber.NewError(fiber.StatusUnauthorized, "invalid or expired refresh token")
+}
+
+// logout revokes the session the request was made with.
+func (a *authenticator) logout(c *fiber.Ctx) error {
+	token, _ := c.Locals(localsToken).(string)
+	if token == "" {
+		return fiber.NewError(fiber.StatusUnauthorized, "authorization required")
+	}
+
+	state, unlock := a.state(true)
+	defer unlock()
+	if _, ok := state.Sessions[token]; !ok {
+		return fiber.NewError(fiber.StatusBadRequest, "API tokens cannot be logged out")
+	}
+	delete(state.Sessions, token)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (a *authenticator) me(c *fiber.Ctx) error {
+	email, _ := c.Locals(localsEmail).(string)
+	if email == "" {
+		return fiber.NewError(fiber.StatusUnauthorized, "authorization required")
+	}
+
+	state, unlock := a.state(false)
+	defer unlock()
+	role := state.role(email)
+	if cred, ok := state.Credentials[strings.ToLower(email)]; ok {
+		return c.JSON(cred.user(role))
+	}
+	return c.JSON(userResponse{Email: email, Role: role})
+}
+
+// newSession logs email in, dropping sessions that can no longer be
+// refreshed. Callers must hold the database's write lock.
+func (a *Auth) newSession(email string) (Session, error) {
+	now := Now()
+	for token, s := range a.Sessions {
+		if !now.Before(s.RefreshExpiresAt) {
+			delete(a.Sessions, token)
+		}
+	}
+
+	access, err := randomToken("sess_")
+	if err != nil {
+		return Session{}, err
+	}
+	refresh, err := randomToken("ref_")
+	if err != nil {
+		return Session{}, err
+	}
+	s := Session{
+		Email:            email,
+		AccessToken:      access,
+		RefreshToken:     refresh,
+		ExpiresAt:        now.Add(sessionTTL),
+		RefreshExpiresAt: now.Add(refreshTTL),
+		CreatedAt:        now,
+	}
+	if a.Sessions == nil {
+		a.Sessions = make(map[string]Session)
+	}
+	a.Sessions[access] = s
+	return s, nil
+}
+
+func (s Session) response() sessionResponse {
+	return sessionResponse{
+		TokenType:        "Bearer",
+		AccessToken:      s.AccessToken,
+		ExpiresAt:        s.ExpiresAt,
+		RefreshToken:     s.RefreshToken,
+		RefreshExpiresAt: s.RefreshExpiresAt,
+	}
+}
+
+func (c Credential) user(role string) userResponse {
+	return userResponse{Email: c.Email, Name: c.Name, Role: role, CreatedAt: &c.CreatedAt}
+}
+
+func randomToken(prefix string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// Password hashes are PBKDF2-HMAC-SHA256, stored as
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>" with unpadded base64.
+const hashScheme = "pbkdf2-sha256"
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return HashPassword(password, salt), nil
+}
+
+// HashPassword hashes a password with the given salt, as seeds store it
+// under auth.credentials. Seed generators pass their own salt, so their
+// output is reproducible.
+func HashPassword(password string, salt []byte) string {
+	key := pbkdf2([]byte(password), salt, hashIterations, sha256.Size)
+	return strings.Join([]string{
+		hashScheme,
+		strconv.Itoa(hashIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$")
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2([]byte(password), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2 derives a key as in RFC 8018, section 5.2, with HMAC-SHA256.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
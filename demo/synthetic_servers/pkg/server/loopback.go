@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// loopback carries out requests against the app itself, for the APIs it
+// serves over other protocols, so that their calls go through the same
+// middleware and handlers as REST requests.
+type loopback struct {
+	handler fasthttp.RequestHandler
+}
+
+// newLoopback returns a loopback to app, which works once app is
+// listening.
+func newLoopback(app *fiber.App) *loopback {
+	l := &loopback{}
+	app.Hooks().OnListen(func(fiber.ListenData) error {
+		l.handler = app.Handler()
+		return nil
+	})
+	return l
+}
+
+// do carries out req as if it came from addr, which may be nil.
+func (l *loopback) do(req *fasthttp.Request, addr net.Addr) *fasthttp.Response {
+	return &l.serve(req, addr, nil).Response
+}
+
+// serve carries out req like do, with locals set for the middleware and
+// handlers to see, and returns the request once it is done, with the
+// locals they set.
+func (l *loopback) serve(req *fasthttp.Request, addr net.Addr, locals map[string]any) *fasthttp.RequestCtx {
+	// Callers read the response as it is, so it mustn't be compressed.
+	req.Header.Del(fiber.HeaderAcceptEncoding)
+	var rc fasthttp.RequestCtx
+	rc.Init(req, addr, nil)
+	for key, v := range locals {
+		rc.SetUserValue(key, v)
+	}
+	l.handler(&rc)
+	return &rc
+}
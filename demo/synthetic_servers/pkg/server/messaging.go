@@ -0,0 +1,353 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/messaging"
+)
+
+// Messaging is the conversations a server's users have with the people
+// serving them, kept in its database by embedding it, untagged, like
+// Payments:
+//
+//	type Database struct {
+//		server.Auth `json:"auth"`
+//		server.Messaging
+//		...
+//	}
+//
+// Its conversations and their messages are then the database's
+// "conversations" and "messages" collections, which only their
+// participants and admins see. A server opens a conversation with Open
+// when there is someone to talk to, such as once a ride has a driver,
+// sends the messages of those it plays with Send, and closes it with Close
+// once there is nothing left to say, all under the database's lock for
+// writing:
+//
+//	c := db.Open(messaging.About{Kind: "ride", ID: ride.ID},
+//		messaging.Participant{ID: ride.UserEmail, Role: "passenger"},
+//		messaging.Participant{ID: driver.ID, Role: "driver", Name: driver.Name})
+//	db.Send(c.ID, driver.ID, "I'm on my way.")
+//
+// Users read and write theirs under /api/v1/conversations, and may stream a
+// conversation's messages as they are sent; tests write as the people the
+// server plays at /admin/conversations/{id}/messages.
+type Messaging struct {
+	Conversations Repository[messaging.Conversation] `json:"conversations"`
+	Messages      Repository[messaging.Message]      `json:"messages"`
+}
+
+// Open returns the open conversation about about, or starts one between
+// participants if there is none. The caller holds the database's lock for
+// writing.
+func (m *Messaging) Open(about messaging.About, participants ...messaging.Participant) messaging.Conversation {
+	if c, ok := m.ConversationAbout(about); ok && !c.Closed {
+		return c
+	}
+	now := Now()
+	c := messaging.Conversation{
+		ID:           messageID("conv_"),
+		About:        about,
+		Participants: append([]messaging.Participant(nil), participants...),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	m.Conversations.Upsert(c.ID, c)
+	return c
+}
+
+// ConversationAbout returns the latest conversation about about, if there
+// is one. The caller holds the database's lock.
+func (m *Messaging) ConversationAbout(about messaging.About) (messaging.Conversation, bool) {
+	var found messaging.Conversation
+	ok := false
+	for _, c := range m.Conversations.List() {
+		if c.About == about && (!ok || c.CreatedAt.After(found.CreatedAt)) {
+			found, ok = c, true
+		}
+	}
+	return found, ok
+}
+
+// Send adds a message from the participant from to the conversation id.
+// It returns messaging.ErrNotFound, ErrNotParticipant or ErrClosed if it
+// can't. The caller holds the database's lock for writing.
+func (m *Messaging) Send(id, from, body string) (messaging.Message, error) {
+	c, ok := m.Conversations.Get(id)
+	if !ok {
+		return messaging.Message{}, messaging.ErrNotFound
+	}
+	msg, err := c.Send(from, body, Now())
+	if err != nil {
+		return messaging.Message{}, err
+	}
+	msg.ID = messageID("msg_")
+	c.LastMessage = &msg
+	m.Conversations.Upsert(id, c)
+	m.Messages.Upsert(msg.ID, msg)
+	return msg, nil
+}
+
+// Close closes the conversations about about, so that they take no more
+// messages. The caller holds the database's lock for writing.
+func (m *Messaging) Close(about messaging.About) {
+	for _, c := range m.Conversations.List() {
+		if c.About == about && !c.Closed {
+			c.Closed, c.UpdatedAt = true, Now()
+			m.Conversations.Upsert(c.ID, c)
+		}
+	}
+}
+
+func (m *Messaging) messaging() *Messaging { return m }
+
+// conversing is a database that embeds Messaging.
+type conversing interface {
+	messaging() *Messaging
+}
+
+// chats serves users their conversations from the database, or a
+// sandbox's, and streams them the messages sent in them.
+type chats struct {
+	db     Database
+	events *events
+}
+
+func newChats(db Database, e *events) *chats {
+	// Conversations belong to all their participants, not one owner, so
+	// the event stream only shows them to admins; the conversation stream
+	// shows them to their participants.
+	e.private["conversations"], e.private["messages"] = true, true
+	return &chats{db: db, events: e}
+}
+
+func (ch *chats) attach(app *fiber.App) {
+	app.Get("/api/v1/conversations", ch.list)
+	app.Get("/api/v1/conversations/:id", ch.get)
+	app.Get("/api/v1/conversations/:id/messages", ch.messages)
+	app.Post("/api/v1/conversations/:id/messages", ch.send)
+	app.Post("/api/v1/conversations/:id/read", ch.read)
+	app.Get("/api/v1/conversations/:id/stream", ch.stream)
+}
+
+// list responds with the caller's conversations, the most recently active
+// first, as a page:
+//
+//	GET /api/v1/conversations?email=...&unread=true
+func (ch *chats) list(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+	unread := c.QueryBool("unread")
+
+	v, mu := ch.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+	}
+	found := v.(conversing).messaging().Conversations.Query(func(conv messaging.Conversation) bool {
+		return conv.Member(email) >= 0 && !(unread && conv.Unread(email) == 0)
+	})
+	if mu != nil {
+		mu.RUnlock()
+	}
+	messaging.Newest(found)
+	return List(c, found)
+}
+
+// conversation returns the conversation id, if email, who has role, is in
+// it or is an admin. The caller holds the database's lock.
+func (m *Messaging) conversation(id, email, role string) (messaging.Conversation, bool) {
+	conv, ok := m.Conversations.Get(id)
+	if !ok || (conv.Member(email) < 0 && role != RoleAdmin) {
+		return messaging.Conversation{}, false
+	}
+	return conv, true
+}
+
+func (ch *chats) get(c *fiber.Ctx) error {
+	email, role, err := caller(c)
+	if err != nil {
+		return err
+	}
+
+	v, mu := ch.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+		defer mu.RUnlock()
+	}
+	conv, ok := v.(conversing).messaging().conversation(c.Params("id"), email, role)
+	if !ok {
+		return FailWith(c, fiber.StatusNotFound, messaging.ErrNotFound)
+	}
+	return c.JSON(conv)
+}
+
+// messages responds with a conversation's messages, oldest first, as a
+// page.
+func (ch *chats) messages(c *fiber.Ctx) error {
+	email, role, err := caller(c)
+	if err != nil {
+		return err
+	}
+
+	v, mu := ch.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+	}
+	m := v.(conversing).messaging()
+	conv, ok := m.conversation(c.Params("id"), email, role)
+	found := []messaging.Message{}
+	if ok {
+		found = m.Messages.By("conversation_id", conv.ID)
+	}
+	if mu != nil {
+		mu.RUnlock()
+	}
+	if !ok {
+		return FailWith(c, fiber.StatusNotFound, messaging.ErrNotFound)
+	}
+	messaging.InOrder(found)
+	return List(c, found)
+}
+
+type sendRequest struct {
+	Body string `json:"body" validate:"required,max=2000"`
+}
+
+type adminSendRequest struct {
+	From string `json:"from" validate:"required"`
+	Body string `json:"body" validate:"required,max=2000"`
+}
+
+// send adds a message from the caller to a conversation they are in:
+//
+//	POST /api/v1/conversations/conv_1/messages?email=...
+//	{"body": "I'm at the side door."}
+//
+// A closed conversation is answered with 409.
+func (ch *chats) send(c *fiber.Ctx) error {
+	email, role, err := caller(c)
+	if err != nil {
+		return err
+	}
+	var req sendRequest
+	if err := Bind(c, &req); err != nil {
+		return err
+	}
+	return ch.post(c, email, role, req.Body)
+}
+
+// post adds a message from the participant from to the conversation the
+// request names, and responds with it.
+func (ch *chats) post(c *fiber.Ctx, from, role, body string) error {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return &ValidationError{Errors: []FieldError{{Field: "body", Message: "is required"}}}
+	}
+
+	v, mu := ch.db.in(c).Current()
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	m := v.(conversing).messaging()
+	conv, ok := m.conversation(c.Params("id"), from, role)
+	if !ok {
+		return FailWith(c, fiber.StatusNotFound, messaging.ErrNotFound)
+	}
+	msg, err := m.Send(conv.ID, from, body)
+	switch err {
+	case nil:
+	case messaging.ErrNotParticipant:
+		return FailWith(c, fiber.StatusForbidden, err)
+	case messaging.ErrClosed:
+		return FailWith(c, fiber.StatusConflict, err)
+	default:
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(msg)
+}
+
+// read marks a conversation read by the caller through its last message,
+// and responds with it.
+func (ch *chats) read(c *fiber.Ctx) error {
+	email, role, err := caller(c)
+	if err != nil {
+		return err
+	}
+
+	v, mu := ch.db.in(c).Current()
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	m := v.(conversing).messaging()
+	conv, ok := m.conversation(c.Params("id"), email, role)
+	if !ok {
+		return FailWith(c, fiber.StatusNotFound, messaging.ErrNotFound)
+	}
+	if err := conv.Read(email); err != nil {
+		return FailWith(c, fiber.StatusForbidden, err)
+	}
+	m.Conversations.Upsert(conv.ID, conv)
+	return c.JSON(conv)
+}
+
+// stream sends the caller the messages sent in a conversation, and its
+// changes, such as others reading it, as server-sent events named
+// messages.created and conversations.updated, with the change event as
+// data:
+//
+//	GET /api/v1/conversations/conv_1/stream?email=...
+//
+// Like the event stream, it resumes after Last-Event-ID.
+func (ch *chats) stream(c *fiber.Ctx) error {
+	email, role, err := caller(c)
+	if err != nil {
+		return err
+	}
+
+	v, mu := ch.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+	}
+	conv, ok := v.(conversing).messaging().conversation(c.Params("id"), email, role)
+	if mu != nil {
+		mu.RUnlock()
+	}
+	if !ok {
+		return FailWith(c, fiber.StatusNotFound, messaging.ErrNotFound)
+	}
+	return ch.events.serve(c, func(ev Event) bool {
+		switch ev.Collection {
+		case "conversations":
+			return ev.Key == conv.ID
+		case "messages":
+			var msg struct {
+				ConversationID string `json:"conversation_id"`
+			}
+			return json.Unmarshal(ev.Entity, &msg) == nil && msg.ConversationID == conv.ID
+		}
+		return false
+	})
+}
+
+// attachAdmin mounts writing as anyone in a conversation, such as a
+// driver the server plays, under the admin group:
+//
+//	POST /admin/conversations/:id/messages   {"from": "driver_1", "body": "..."}
+func (ch *chats) attachAdmin(group fiber.Router) {
+	group.Post("/conversations/:id/messages", ch.sendAs)
+}
+
+func (ch *chats) sendAs(c *fiber.Ctx) error {
+	var req adminSendRequest
+	if err := Bind(c, &req); err != nil {
+		return err
+	}
+	return ch.post(c, req.From, RoleAdmin, req.Body)
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram: Prometheus's defaults.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics counts requests by route and status, and times them, for
+// Prometheus to scrape from GET /metrics along with how many entities each
+// database collection holds, and for harnesses to read as JSON from GET
+// /admin/stats. Routes are labelled by pattern, such as
+// /api/v1/accounts/:accountId, so the series stay few.
+type metrics struct {
+	started time.Time
+
+	mu        sync.Mutex
+	requests  map[requestLabels]uint64
+	latencies map[routeLabels]*histogram
+	entities  map[string]int // By collection, as the journal hears of them; nil without a database
+}
+
+type routeLabels struct {
+	method, route string
+}
+
+type requestLabels struct {
+	routeLabels
+	status int
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative; the last is +Inf
+	sum    float64
+}
+
+func newMetrics(db *Database) *metrics {
+	m := &metrics{
+		started:   time.Now(),
+		requests:  make(map[requestLabels]uint64),
+		latencies: make(map[routeLabels]*histogram),
+	}
+	if db != nil {
+		m.entities = make(map[string]int)
+		for _, name := range db.journal.collections() {
+			m.entities[name] = 0
+		}
+		db.journal.follow(m.count)
+	}
+	return m
+}
+
+func (m *metrics) attach(app *fiber.App) {
+	app.Use(m.record)
+	app.Get("/metrics", m.serve)
+}
+
+func (m *metrics) record(c *fiber.Ctx) error {
+	start := time.Now()
+	if err := c.Next(); err != nil {
+		// Render the error here to count its status.
+		if err := c.App().Config().ErrorHandler(c, err); err != nil {
+			return err
+		}
+	}
+	elapsed := time.Since(start).Seconds()
+
+	route := c.Route().Path
+	if route == "/" && c.Path() != "/" {
+		// No route handled it: it was unknown, or middleware such as
+		// authentication turned it away.
+		route = "unmatched"
+	}
+	labels := routeLabels{strings.Clone(c.Method()), route}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestLabels{labels, c.Response().StatusCode()}]++
+	h, ok := m.latencies[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latencies[labels] = h
+	}
+	i, _ := slices.BinarySearch(latencyBuckets, elapsed)
+	h.counts[i]++
+	h.sum += elapsed
+	return nil
+}
+
+// serve writes the metrics in the Prometheus text format.
+func (m *metrics) serve(c *fiber.Ctx) error {
+	var b strings.Builder
+
+	m.mu.Lock()
+	b.WriteString("# HELP http_requests_total Requests handled, by method, route and status.\n")
+	b.WriteString("# TYPE http_requests_total counter\n")
+	requests := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		requests = append(requests, l)
+	}
+	slices.SortFunc(requests, func(a, b requestLabels) int {
+		if n := compareRouteLabels(a.routeLabels, b.routeLabels); n != 0 {
+			return n
+		}
+		return a.status - b.status
+	})
+	for _, l := range requests {
+		fmt.Fprintf(&b, "http_requests_total{method=%s,route=%s,status=\"%d\"} %d\n", labelValue(l.method), labelValue(l.route), l.status, m.requests[l])
+	}
+
+	b.WriteString("# HELP http_request_duration_seconds How long requests took to handle, by method and route.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	routes := make([]routeLabels, 0, len(m.latencies))
+	for l := range m.latencies {
+		routes = append(routes, l)
+	}
+	slices.SortFunc(routes, compareRouteLabels)
+	for _, l := range routes {
+		h := m.latencies[l]
+		labels := fmt.Sprintf("method=%s,route=%s", labelValue(l.method), labelValue(l.route))
+		var count uint64
+		for i, n := range h.counts {
+			count += n
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(&b, "http_request_duration_seconds_bucket{%s,le=%q} %d\n", labels, le, count)
+		}
+		fmt.Fprintf(&b, "http_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(&b, "http_request_duration_seconds_count{%s} %d\n", labels, count)
+	}
+	m.mu.Unlock()
+
+	if counts := m.entityCounts(); counts != nil {
+		b.WriteString("# HELP db_entities Entities in each database collection.\n")
+		b.WriteString("# TYPE db_entities gauge\n")
+		for _, name := range sortedKeys(counts, nil) {
+			fmt.Fprintf(&b, "db_entities{collection=%s} %d\n", labelValue(name), counts[name])
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	return c.SendString(b.String())
+}
+
+// attachAdmin mounts GET /admin/stats on the admin group.
+func (m *metrics) attachAdmin(group fiber.Router) {
+	group.Get("/stats", m.stats)
+}
+
+// routeStats are the requests a route has handled since startup.
+type routeStats struct {
+	Method   string            `json:"method"`
+	Route    string            `json:"route"`
+	Calls    uint64            `json:"calls"`
+	Errors   uint64            `json:"errors"`   // Answered with a 4xx or 5xx
+	Statuses map[string]uint64 `json:"statuses"` // Calls by status
+	Latency  latencyStats      `json:"latency"`
+}
+
+type latencyStats struct {
+	MeanSeconds float64         `json:"mean_seconds"`
+	Buckets     []latencyBucket `json:"buckets"` // Cumulative, as in Prometheus
+}
+
+// latencyBucket counts the requests that took at most LE seconds, or any
+// time at all if it is +Inf.
+type latencyBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// stats responds with what /metrics has, as JSON: the calls to each route
+// since startup, how many failed, and how long they took, and how many
+// entities each collection holds now, so harnesses can check what an
+// agent touched:
+//
+//	GET /admin/stats
+//
+//	{"since": "...", "routes": [{"method": "GET", "route": "/api/v1/rides/:rideId",
+//	  "calls": 3, "errors": 1, "statuses": {"200": 2, "404": 1}, "latency": {...}}],
+//	 "collections": {"rides": 2, ...}}
+func (m *metrics) stats(c *fiber.Ctx) error {
+	m.mu.Lock()
+	byRoute := make(map[routeLabels]*routeStats, len(m.latencies))
+	for l, h := range m.latencies {
+		rs := &routeStats{Method: l.method, Route: l.route, Statuses: make(map[string]uint64)}
+		var count uint64
+		for i, n := range h.counts {
+			count += n
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			rs.Latency.Buckets = append(rs.Latency.Buckets, latencyBucket{LE: le, Count: count})
+		}
+		if count > 0 {
+			rs.Latency.MeanSeconds = h.sum / float64(count)
+		}
+		byRoute[l] = rs
+	}
+	for l, n := range m.requests {
+		rs, ok := byRoute[l.routeLabels]
+		if !ok {
+			continue
+		}
+		rs.Calls += n
+		if l.status >= fiber.StatusBadRequest {
+			rs.Errors += n
+		}
+		rs.Statuses[strconv.Itoa(l.status)] += n
+	}
+	m.mu.Unlock()
+
+	labels := make([]routeLabels, 0, len(byRoute))
+	for l := range byRoute {
+		labels = append(labels, l)
+	}
+	slices.SortFunc(labels, compareRouteLabels)
+	routes := make([]*routeStats, len(labels))
+	for i, l := range labels {
+		routes[i] = byRoute[l]
+	}
+
+	counts := m.entityCounts()
+	if counts == nil {
+		counts = map[string]int{}
+	}
+	return c.JSON(fiber.Map{"since": m.started.UTC(), "routes": routes, "collections": counts})
+}
+
+// count keeps the entity counts up to date with a change.
+func (m *metrics) count(ch change) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case ch.Before == nil && ch.After != nil:
+		m.entities[ch.Collection]++
+	case ch.Before != nil && ch.After == nil:
+		m.entities[ch.Collection]--
+	}
+}
+
+// entityCounts returns how many entities each collection of the live
+// database holds, or nil without a database.
+func (m *metrics) entityCounts() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entities == nil {
+		return nil
+	}
+	counts := make(map[string]int, len(m.entities))
+	for name, n := range m.entities {
+		counts[name] = n
+	}
+	return counts
+}
+
+// countEntities counts the entities in each collection of an encoded
+// database, leaving out auth.
+func countEntities(data []byte) (map[string]int, error) {
+	var collections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &collections); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(collections))
+	for name, raw := range collections {
+		if name == "auth" {
+			continue
+		}
+		if byKey, ok := entities(raw); ok {
+			counts[name] = len(byKey)
+		}
+	}
+	return counts, nil
+}
+
+func compareRouteLabels(a, b routeLabels) int {
+	if n := strings.Compare(a.route, b.route); n != 0 {
+		return n
+	}
+	return strings.Compare(a.method, b.method)
+}
+
+// labelValue quotes a Prometheus label value.
+func labelValue(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
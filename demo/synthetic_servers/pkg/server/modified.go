@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setLastModified sets a successful GET's Last-Modified, if it can tell
+// when what it shows was modified, and returns it. With it, and 304s for
+// an If-Modified-Since no earlier, clients can cache slowly changing data
+// such as products and menus until it changes.
+//
+// An entity's, at a path that ends in its key or ID, is its updated_at,
+// or its created_at if it has none, as the seed has it, and from then on
+// the time the server noticed it change: its new updated_at if it has
+// one, or the server's clock. A page of a list's is the latest of its
+// entities' collections', which any change to one of their entities moves
+// on, their removal included; an empty page has none. Last-Modified is to
+// the second, so a change always moves it on by one at least, whatever
+// the clock says.
+func (v *versions) setLastModified(c *fiber.Ctx) time.Time {
+	modified := v.lastModified(c)
+	if !modified.IsZero() {
+		c.Set(fiber.HeaderLastModified, modified.UTC().Format(http.TimeFormat))
+	}
+	return modified
+}
+
+func (v *versions) lastModified(c *fiber.Ctx) time.Time {
+	ids := pathIDs(c.Path())
+	if len(ids) == 0 {
+		return time.Time{}
+	}
+	if ver, ok := v.entry(ids[len(ids)-1]); ok {
+		return ver.modified
+	}
+
+	var page struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if c.Response().IsBodyStream() || json.Unmarshal(c.Response().Body(), &page) != nil {
+		return time.Time{}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var modified time.Time
+	for _, item := range page.Data {
+		ver, ok := v.entries[itemID(item)]
+		if !ok {
+			return time.Time{} // Not all from the database, as far as it knows
+		}
+		modified = later(modified, v.collections[ver.collection].modified)
+	}
+	return modified
+}
+
+// notModifiedSince reports whether an If-Modified-Since header is a date
+// no earlier than modified.
+func notModifiedSince(header string, modified time.Time) bool {
+	if header == "" || modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	return err == nil && !since.Before(modified)
+}
+
+// entityStamp returns an entity's updated_at, or its created_at, or the
+// zero time if it has neither as an RFC 3339 time.
+func entityStamp(raw json.RawMessage) time.Time {
+	var entity struct {
+		UpdatedAt any `json:"updated_at"`
+		CreatedAt any `json:"created_at"`
+	}
+	if json.Unmarshal(raw, &entity) != nil {
+		return time.Time{}
+	}
+	for _, stamp := range []any{entity.UpdatedAt, entity.CreatedAt} {
+		if s, ok := stamp.(string); ok {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// modifiedAt returns when something last modified at prev was modified
+// again, as of now: at stamp, its updated_at, if that is later than prev,
+// or else now; and a second after prev at least.
+func modifiedAt(stamp, prev, now time.Time) time.Time {
+	t := now
+	if stamp.After(prev) {
+		t = stamp
+	}
+	return later(t.Truncate(time.Second), prev.Add(time.Second))
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/i18n"
+)
+
+// Inbox is what a server has sent its users, kept in its database by
+// embedding it, untagged, next to Auth:
+//
+//	type Database struct {
+//		server.Auth `json:"auth"`
+//		server.Inbox
+//		...
+//	}
+//
+// Its notifications, emails and texts are then the database's
+// "notifications", "emails" and "texts" collections, saved, snapshotted,
+// sandboxed and streamed as events like the rest. Servers send
+// notifications with Notify when something happens to a user's orders,
+// bookings or bills, and users read them at /api/v1/notifications; emails
+// and texts, sent with SendEmail and SendText, only ever reach the outbox
+// tests read at /admin/outbox. All three are sent in the language their
+// recipient chose at /api/v1/notifications/language, English unless they
+// did, as far as the i18n catalog has them.
+type Inbox struct {
+	Notifications Repository[Notification] `json:"notifications"`
+	Emails        Repository[Email]        `json:"emails"`
+	Texts         Repository[Text]         `json:"texts"`
+	Languages     Repository[string]       `json:"languages"` // By user email, in lower case
+}
+
+// Notification tells a user something happened, such as their order
+// shipping, and points at the entity it happened to.
+type Notification struct {
+	ID         string     `json:"id"`
+	UserEmail  string     `json:"user_email"`
+	Type       string     `json:"type"` // What happened, such as order_shipped
+	Message    string     `json:"message"`
+	Collection string     `json:"collection,omitempty"` // The entity's collection, such as orders
+	EntityID   string     `json:"entity_id,omitempty"`
+	Read       bool       `json:"read"`
+	ReadAt     *time.Time `json:"read_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Notify sends n to n.UserEmail, giving it an ID and, unless it has one,
+// the clock's time, and returns it as sent, its message translated into
+// their language. The caller holds the database's lock for writing.
+func (in *Inbox) Notify(n Notification) Notification {
+	n.Message = i18n.T(in.Language(n.UserEmail), n.Message)
+	n.ID = messageID("notif_")
+	if n.CreatedAt.IsZero() {
+		n.CreatedAt = Now()
+	}
+	in.Notifications.Upsert(n.ID, n)
+	return n
+}
+
+func (in *Inbox) inbox() *Inbox { return in }
+
+// notifying is a database that embeds an Inbox.
+type notifying interface {
+	inbox() *Inbox
+}
+
+// notifications serves users their notifications from the database's Inbox,
+// or a sandbox's.
+type notifications struct {
+	db Database
+}
+
+func (n *notifications) attach(app *fiber.App) {
+	app.Get("/api/v1/notifications", n.list)
+	app.Post("/api/v1/notifications/read", n.readAll)
+	app.Get("/api/v1/notifications/language", n.language)
+	app.Put("/api/v1/notifications/language", n.language)
+	app.Post("/api/v1/notifications/:id/read", n.read)
+}
+
+// list responds with the caller's notifications, newest first, as a page:
+//
+//	GET /api/v1/notifications?email=...&unread=true&type=order_shipped
+//
+// Like other lists, it filters on the notifications' fields, such as type.
+// With Accept-Language, messages are translated into the language it asks
+// for.
+func (n *notifications) list(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+	unread := c.QueryBool("unread")
+
+	v, mu := n.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+	}
+	found := v.(notifying).inbox().Notifications.Query(func(note Notification) bool {
+		return strings.EqualFold(note.UserEmail, email) && !(unread && note.Read)
+	})
+	if c.Get(fiber.HeaderAcceptLanguage) != "" {
+		lang := Language(c)
+		c.Vary(fiber.HeaderAcceptLanguage)
+		c.Set(fiber.HeaderContentLanguage, lang)
+		for i := range found {
+			found[i].Message = i18n.T(lang, found[i].Message)
+		}
+	}
+	if mu != nil {
+		mu.RUnlock()
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].CreatedAt.Equal(found[j].CreatedAt) {
+			return found[i].CreatedAt.After(found[j].CreatedAt)
+		}
+		return found[i].ID < found[j].ID
+	})
+	return List(c, found)
+}
+
+// read marks one of the caller's notifications read and responds with it.
+func (n *notifications) read(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+	id := c.Params("id")
+
+	v, mu := n.db.in(c).Current()
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	in := v.(notifying).inbox()
+	note, ok := in.Notifications.Get(id)
+	if !ok || !strings.EqualFold(note.UserEmail, email) {
+		return Fail(c, fiber.StatusNotFound, CodeNotFound, "notification not found")
+	}
+	if !note.Read {
+		now := Now()
+		note.Read, note.ReadAt = true, &now
+		in.Notifications.Upsert(note.ID, note)
+	}
+	return c.JSON(note)
+}
+
+// readAll marks all the caller's notifications read, and responds with how
+// many weren't already.
+func (n *notifications) readAll(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+
+	v, mu := n.db.in(c).Current()
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	in := v.(notifying).inbox()
+	now := Now()
+	marked := 0
+	for _, note := range in.Notifications.By("user_email", email) {
+		if note.Read {
+			continue
+		}
+		note.Read, note.ReadAt = true, &now
+		in.Notifications.Upsert(note.ID, note)
+		marked++
+	}
+	return c.JSON(fiber.Map{"marked": marked})
+}
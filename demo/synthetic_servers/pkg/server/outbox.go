@@ -0,0 +1,151 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/i18n"
+	"pkg/internal/vars"
+)
+
+// Email is a message a server would have emailed a user, such as an order
+// receipt or a booking confirmation. Nothing is sent: it waits in the
+// database's outbox for tests to read at /admin/outbox/emails.
+type Email struct {
+	ID         string    `json:"id"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Subject    string    `json:"subject"`
+	Body       string    `json:"body"`
+	Collection string    `json:"collection,omitempty"` // The entity's collection, such as orders
+	EntityID   string    `json:"entity_id,omitempty"`
+	SentAt     time.Time `json:"sent_at"`
+}
+
+// SendEmail puts e in the outbox, giving it an ID and, unless it has one,
+// the clock's time, and returns it as sent, its subject and body
+// translated into the language of its recipient. The caller holds the
+// database's lock for writing.
+func (in *Inbox) SendEmail(e Email) Email {
+	lang := in.Language(e.To)
+	e.Subject, e.Body = i18n.T(lang, e.Subject), i18n.T(lang, e.Body)
+	e.ID = messageID("email_")
+	if e.SentAt.IsZero() {
+		e.SentAt = Now()
+	}
+	in.Emails.Upsert(e.ID, e)
+	return e
+}
+
+// Text is an SMS a server would have sent a user, such as a verification
+// code or word that their ride is arriving. Like emails, texts wait in the
+// database's outbox, for tests to read at /admin/outbox/texts.
+type Text struct {
+	ID         string    `json:"id"`
+	From       string    `json:"from"` // The sender's name or short code
+	To         string    `json:"to"`   // A phone number
+	UserEmail  string    `json:"user_email,omitempty"`
+	Template   string    `json:"template,omitempty"` // The TextTemplates entry it was made from
+	Body       string    `json:"body"`
+	Collection string    `json:"collection,omitempty"` // The entity's collection, such as rides
+	EntityID   string    `json:"entity_id,omitempty"`
+	SentAt     time.Time `json:"sent_at"`
+}
+
+// TextTemplates are the texts servers send, by name. A template names the
+// values filling it as {{name}}, and {{from}} is the sender. Those sent by
+// lifecycle steps are filled with the entity's fields, nested ones by
+// dotted names such as driver.name, and {{message}}, the step's notice.
+var TextTemplates = map[string]string{
+	"verification_code": "{{code}} is your {{from}} verification code. It expires in {{minutes}} minutes. Don't share it with anyone.",
+	"ride_arriving":     "{{from}}: Your driver is arriving now. Please meet them at your pickup spot.",
+	"delivery_update":   "{{from}}: {{message}}",
+}
+
+// SendText puts t in the outbox, giving it an ID and, unless it has one,
+// the clock's time, and returns it as sent. Without a body, t is made from
+// its template, in the language of t.UserEmail, filled with values. The
+// caller holds the database's lock for writing.
+func (in *Inbox) SendText(t Text, values map[string]string) Text {
+	lang := in.Language(t.UserEmail)
+	if t.Body == "" {
+		filled := map[string]string{"from": t.From}
+		for name, v := range values {
+			filled[name] = v
+		}
+		t.Body = vars.Fill(i18n.Template(lang, TextTemplates[t.Template]), filled)
+	} else {
+		t.Body = i18n.T(lang, t.Body)
+	}
+	t.ID = messageID("sms_")
+	if t.SentAt.IsZero() {
+		t.SentAt = Now()
+	}
+	in.Texts.Upsert(t.ID, t)
+	return t
+}
+
+// phoneBook is a database that knows its users' phone numbers, so that
+// lifecycle steps can text them. PhoneNumber returns "" for a user without
+// one; the caller holds the database's lock.
+type phoneBook interface {
+	PhoneNumber(email string) string
+}
+
+// outbox shows tests what the server has sent, from the live database or,
+// with X-Sandbox-ID, a sandbox's.
+type outbox struct {
+	db Database
+}
+
+// attachAdmin mounts the outbox under the admin group:
+//
+//	GET /admin/outbox/emails?to=...   Emails sent, newest first
+//	GET /admin/outbox/texts?to=...    Texts sent, newest first
+func (o *outbox) attachAdmin(group fiber.Router) {
+	group.Get("/outbox/emails", o.emails)
+	group.Get("/outbox/texts", o.texts)
+}
+
+// emails responds with the emails sent, newest first, as a page. Like other
+// lists, it filters on their fields, such as to and collection.
+func (o *outbox) emails(c *fiber.Ctx) error {
+	in, unlock := o.inbox(c)
+	found := in.Emails.List()
+	unlock()
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].SentAt.Equal(found[j].SentAt) {
+			return found[i].SentAt.After(found[j].SentAt)
+		}
+		return found[i].ID < found[j].ID
+	})
+	return List(c, found)
+}
+
+// texts responds with the texts sent, newest first, as a page, filtered
+// like emails: by to, user_email and so on.
+func (o *outbox) texts(c *fiber.Ctx) error {
+	in, unlock := o.inbox(c)
+	found := in.Texts.List()
+	unlock()
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].SentAt.Equal(found[j].SentAt) {
+			return found[i].SentAt.After(found[j].SentAt)
+		}
+		return found[i].ID < found[j].ID
+	})
+	return List(c, found)
+}
+
+// inbox read-locks the Inbox the request is about, the live database's or
+// its sandbox's, and returns it along with the matching unlock.
+func (o *outbox) inbox(c *fiber.Ctx) (*Inbox, func()) {
+	v, mu := o.db.in(c).Current()
+	if mu == nil {
+		return v.(notifying).inbox(), func() {}
+	}
+	mu.RLock()
+	return v.(notifying).inbox(), mu.RUnlock
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ownerFields name the user an entity belongs to, in order of preference.
+// One holding an object, such as a passenger, names them by its email.
+var ownerFields = []string{"user_email", "userEmail", "owner_email", "client_email", "passenger_email", "owner", "user_id", "passenger"}
+
+// localsOwners holds the *ownership of a request's database for List,
+// which leaves the entities of others out of lists as check keeps them out
+// of paths.
+const localsOwners = "owners"
+
+// ownership keeps users out of each other's private entities. It indexes
+// the entities in a database's Private collections by key and ID, as its
+// journal hears of them, and answers requests whose path names one that
+// belongs to someone else with 404, so callers can't probe for IDs either;
+// List leaves such entities out of lists. Admins may see everything.
+type ownership struct {
+	private map[string]bool
+
+	mu     sync.Mutex
+	owners map[string]string   // Entity key or ID -> owner email
+	held   map[string][]string // Collection and key -> the keys and IDs it holds in owners
+}
+
+// newOwnership indexes the entities of the private collections of the
+// database j journals, and keeps the index up to date.
+func newOwnership(j *journal, private []string) *ownership {
+	o := &ownership{private: make(map[string]bool), owners: make(map[string]string), held: make(map[string][]string)}
+	for _, name := range private {
+		o.private[name] = true
+	}
+	j.follow(o.observe)
+	return o
+}
+
+func (o *ownership) attach(app *fiber.App) {
+	app.Use(o.check)
+}
+
+func (o *ownership) check(c *fiber.Ctx) error {
+	if sb := sandboxOf(c); sb != nil {
+		o = sb.ownership
+	}
+	for _, segment := range strings.Split(c.Path(), "/") {
+		id, err := url.PathUnescape(segment)
+		if err != nil {
+			continue
+		}
+		owner, ok := o.owner(id)
+		switch {
+		case !ok, Owns(c, owner):
+		case Caller(c) == "":
+			return fiber.NewError(fiber.StatusUnauthorized, "authorization required")
+		default:
+			return fiber.NewError(fiber.StatusNotFound, "not found")
+		}
+	}
+	c.Locals(localsOwners, o)
+	return c.Next()
+}
+
+// owner returns who the entity with key or ID id belongs to, if it is in
+// a private collection.
+func (o *ownership) owner(id string) (string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	owner, ok := o.owners[id]
+	return owner, ok
+}
+
+// observe keeps the index up to date with a change.
+func (o *ownership) observe(ch change) {
+	if !o.private[ch.Collection] {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	at := ch.Collection + "/" + ch.Key
+	for _, id := range o.held[at] {
+		delete(o.owners, id)
+	}
+	delete(o.held, at)
+	if ch.After == nil {
+		return
+	}
+	var entity map[string]any
+	json.Unmarshal(ch.After, &entity)
+	owner := privateOwner(ch.Key, entity)
+	if owner == "" {
+		return
+	}
+	ids := []string{ch.Key}
+	if id, ok := entity["id"].(string); ok && id != ch.Key {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		o.owners[id] = owner
+	}
+	o.held[at] = ids
+}
+
+// Owns reports whether the request may see what belongs to owner: it is
+// the caller's, or the caller is an admin, or the request bears no token
+// on a server that doesn't require one. Handlers check what they reach
+// through something else with it, such as a job's applications.
+func Owns(c *fiber.Ctx, owner string) bool {
+	email := Caller(c)
+	role, _ := c.Locals(localsRole).(string)
+	required, _ := c.Locals(localsRequired).(bool)
+	switch {
+	case role == RoleAdmin, email != "" && strings.EqualFold(owner, email):
+		return true
+	}
+	return email == "" && !required
+}
+
+func entityOwner(entity map[string]any) string {
+	for _, field := range ownerFields {
+		v := entity[field]
+		if nested, ok := v.(map[string]any); ok {
+			v = nested["email"]
+		}
+		if owner, ok := v.(string); ok && strings.Contains(owner, "@") {
+			return owner
+		}
+	}
+	return ""
+}
+
+// privateOwner returns who the entity at key in a private collection
+// belongs to: the user its owner fields name, or else its email or, in
+// collections kept by user, such as watchlists by email, its key. entity
+// is nil if it isn't an object.
+func privateOwner(key string, entity map[string]any) string {
+	if owner := entityOwner(entity); owner != "" {
+		return owner
+	}
+	if email, ok := entity["email"].(string); ok && strings.Contains(email, "@") {
+		return email
+	}
+	if strings.Contains(key, "@") {
+		return key
+	}
+	return ""
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/money"
+	"pkg/payments"
+)
+
+// Payments is what a server has charged its users' cards, kept in its
+// database by embedding it, untagged, like Inbox:
+//
+//	type Database struct {
+//		server.Auth `json:"auth"`
+//		server.Inbox
+//		server.Payments
+//		...
+//	}
+//
+// Its charges are then the database's "charges" collection, and users read
+// theirs at /api/v1/charges. Servers authorize a charge with Authorize when
+// an order, booking, ride or ticket is made, and capture, void or refund it
+// as that goes ahead or is cancelled.
+type Payments struct {
+	Charges Repository[payments.Charge] `json:"charges"`
+}
+
+// ChargeRequest is a charge a handler asks Authorize for.
+type ChargeRequest struct {
+	UserEmail       string
+	PaymentMethodID string
+	Card            payments.Card
+	Amount          money.Money
+	Description     string // What it pays for, such as "Order 1f0c…"
+	Capture         bool   // Take the amount at once rather than holding it
+}
+
+// processor decides which charges are declined. Admins script declines at
+// /admin/payments.
+var processor = &payments.Processor{}
+
+// Authorize charges req.Card through the payments simulator and returns the
+// charge, authorized or, with req.Capture, captured. A declined charge is
+// kept too, and answered with 402 PAYMENT_DECLINED, or INSUFFICIENT_FUNDS,
+// whose details name the decline code and the charge. In chaos mode,
+// payment_declined declines it. The caller holds the database's lock for
+// writing:
+//
+//	db.mu.Lock()
+//	charge, err := db.Authorize(c, server.ChargeRequest{...})
+//	db.mu.Unlock()
+//	if err != nil {
+//		return err
+//	}
+func (p *Payments) Authorize(c *fiber.Ctx, req ChargeRequest) (payments.Charge, error) {
+	now := Now()
+	charge := payments.Charge{
+		ID:              messageID("ch_"),
+		UserEmail:       req.UserEmail,
+		PaymentMethodID: req.PaymentMethodID,
+		Last4:           req.Card.Last4,
+		Description:     req.Description,
+		Amount:          req.Amount,
+		Status:          payments.StatusAuthorized,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if code := req.Amount.Code(); code != money.USD {
+		charge.Currency = code
+	}
+
+	decline := processor.Check(req.Card, req.Amount, now)
+	if decline == nil && Chaos(c, ChaosPaymentDeclined) {
+		decline = payments.NewDecline(payments.DeclineGeneric)
+	}
+	if decline != nil {
+		charge.Status, charge.DeclineCode = payments.StatusDeclined, decline.Code
+		p.Charges.Upsert(charge.ID, charge)
+		Logger(c).Info("Charge declined", "charge", charge.ID, "decline_code", decline.Code)
+		code := CodePaymentDeclined
+		if decline.Code == payments.DeclineInsufficientFunds {
+			code = CodeInsufficientFunds
+		}
+		return charge, NewError(code, decline.Message).WithDetails(fiber.Map{
+			"decline_code": decline.Code,
+			"charge_id":    charge.ID,
+		})
+	}
+
+	if req.Capture {
+		charge.Capture(money.Money{}, now)
+	}
+	p.Charges.Upsert(charge.ID, charge)
+	return charge, nil
+}
+
+// Charger authorizes a charge as Authorize does. Database methods that
+// work out what to charge under the database's lock take one from the
+// handler, bound to its request:
+//
+//	ticket, err := db.CreateTicket(ticket, db.Charger(c))
+type Charger func(ChargeRequest) (payments.Charge, error)
+
+// Charger returns a Charger that authorizes charges on c's behalf. Like
+// Authorize, it is called with the database's lock held for writing.
+func (p *Payments) Charger(c *fiber.Ctx) Charger {
+	return func(req ChargeRequest) (payments.Charge, error) {
+		return p.Authorize(c, req)
+	}
+}
+
+// Capture takes amount of an authorized charge, or all of it if amount is
+// zero, as when a ride's final fare is known. The caller holds the
+// database's lock for writing.
+func (p *Payments) Capture(id string, amount money.Money) (payments.Charge, error) {
+	return p.update(id, func(ch *payments.Charge) error { return ch.Capture(amount, Now()) })
+}
+
+// Void releases an authorized charge, as when a ride is cancelled before
+// it starts. The caller holds the database's lock for writing.
+func (p *Payments) Void(id string) (payments.Charge, error) {
+	return p.update(id, func(ch *payments.Charge) error { return ch.Void(Now()) })
+}
+
+// Refund gives back amount of a captured charge, or all that is left of it
+// if amount is zero, as when an order or booking is cancelled. The caller
+// holds the database's lock for writing.
+func (p *Payments) Refund(id string, amount money.Money) (payments.Charge, error) {
+	return p.update(id, func(ch *payments.Charge) error { return ch.Refund(amount, Now()) })
+}
+
+// update applies change to the charge id, answering 404 if there is no such
+// charge and 409 if it can't change that way.
+func (p *Payments) update(id string, change func(*payments.Charge) error) (payments.Charge, error) {
+	charge, ok := p.Charges.Get(id)
+	if !ok {
+		return payments.Charge{}, NewError(CodeNotFound, "charge not found")
+	}
+	if err := change(&charge); err != nil {
+		return charge, NewError(CodeConflict, err.Error())
+	}
+	p.Charges.Upsert(id, charge)
+	return charge, nil
+}
+
+func (p *Payments) payments() *Payments { return p }
+
+// paying is a database that embeds Payments.
+type paying interface {
+	payments() *Payments
+}
+
+// charges serves users the charges to their cards from the database's
+// Payments, or a sandbox's.
+type charges struct {
+	db Database
+}
+
+func (ch *charges) attach(app *fiber.App) {
+	app.Get("/api/v1/charges", ch.list)
+	app.Get("/api/v1/charges/:id", ch.get)
+}
+
+// list responds with the caller's charges, newest first, as a page:
+//
+//	GET /api/v1/charges?email=...&status=refunded
+//
+// Like other lists, it filters on the charges' fields, such as status.
+func (ch *charges) list(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+
+	v, mu := ch.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+	}
+	found := v.(paying).payments().Charges.By("user_email", email)
+	if mu != nil {
+		mu.RUnlock()
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].CreatedAt.Equal(found[j].CreatedAt) {
+			return found[i].CreatedAt.After(found[j].CreatedAt)
+		}
+		return found[i].ID < found[j].ID
+	})
+	return List(c, found)
+}
+
+// get responds with one of the caller's charges.
+func (ch *charges) get(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+
+	v, mu := ch.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+		defer mu.RUnlock()
+	}
+	charge, ok := v.(paying).payments().Charges.Get(c.Params("id"))
+	if !ok || !strings.EqualFold(charge.UserEmail, email) {
+		return Fail(c, fiber.StatusNotFound, CodeNotFound, "charge not found")
+	}
+	return c.JSON(charge)
+}
+
+// attachPaymentsAdmin mounts the payments admin endpoints on the admin
+// group:
+//
+//	GET /admin/payments  The decline scenarios in effect, and the test cards
+//	PUT /admin/payments  Replace the scenarios
+func attachPaymentsAdmin(group fiber.Router) {
+	group.Get("/payments", getPayments)
+	group.Put("/payments", putPayments)
+}
+
+func getPayments(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"scenarios":  processor.Scenarios(),
+		"test_cards": payments.TestCards,
+	})
+}
+
+// putPayments replaces the decline scenarios, checked in order, each
+// declining the charges it matches until it has declined count of them:
+//
+//	PUT /admin/payments {"scenarios": [{"last4": "4242", "code": "insufficient_funds", "count": 1}, {"over": 500, "code": "card_declined"}]}
+func putPayments(c *fiber.Ctx) error {
+	var req struct {
+		Scenarios []payments.Scenario `json:"scenarios"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := processor.SetScenarios(req.Scenarios); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	Logger(c).Info("Payment scenarios configured", "scenarios", len(req.Scenarios))
+	return getPayments(c)
+}
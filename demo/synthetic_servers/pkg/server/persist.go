@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Snapshots are written once mutations have been quiet for persistDelay,
+// and at least every persistMaxDelay while they keep coming. Background
+// jobs change state without a request, so the database is also checked
+// every persistInterval.
+const (
+	persistDelay    = time.Second
+	persistMaxDelay = 10 * time.Second
+	persistInterval = time.Minute
+)
+
+// persister saves a server's database to its store. An entityStore has
+// the changes to repositories written through to it as they are made, so
+// the persister saves only the database's other fields to one.
+type persister struct {
+	store Store
+	db    Database
+	audit *audit // Synced before each snapshot, so it is written ahead
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending time.Time // First mutation not yet written
+	last    []byte    // Last snapshot on disk
+}
+
+func newPersister(store Store, db Database) *persister {
+	p := &persister{store: store, db: db}
+	if data, err := p.db.encode(context.Background()); err == nil {
+		p.last = data
+	}
+	return p
+}
+
+func (p *persister) attach(app *fiber.App) {
+	app.Use(func(c *fiber.Ctx) error {
+		err := c.Next()
+		switch c.Method() {
+		case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		default:
+			if err == nil && c.Response().StatusCode() < fiber.StatusBadRequest {
+				p.touch()
+			}
+		}
+		return err
+	})
+	app.Hooks().OnShutdown(func() error {
+		if err := p.flush(); err != nil {
+			return err
+		}
+		return p.store.Close()
+	})
+
+	go func() {
+		ticker := time.NewTicker(persistInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			p.flushLogged()
+		}
+	}()
+	log.Printf("Persisting database to %s", p.store)
+}
+
+// touch schedules a snapshot after a mutation.
+func (p *persister) touch() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.pending.IsZero() {
+		p.pending = now
+	}
+	delay := min(persistDelay, p.pending.Add(persistMaxDelay).Sub(now))
+	if p.timer == nil {
+		p.timer = time.AfterFunc(delay, p.flushLogged)
+	} else {
+		p.timer.Reset(delay)
+	}
+}
+
+// flush writes the database if it changed since the last snapshot.
+func (p *persister) flush() (err error) {
+	ctx, span := StartSpan(context.Background(), "db.save")
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	live.RLock()
+	if p.audit != nil {
+		if err := p.audit.sync(ctx); err != nil {
+			live.RUnlock()
+			return err
+		}
+	}
+	data, err := p.db.encode(ctx)
+	live.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = time.Time{}
+	if bytes.Equal(data, p.last) {
+		return nil
+	}
+	store, ok := p.store.(entityStore)
+	if !ok || p.db.journal.stale.Swap(false) {
+		if err := p.store.Save(data); err != nil {
+			p.db.journal.stale.Store(ok)
+			return err
+		}
+		p.last = data
+		return nil
+	}
+	if err := p.saveFields(store, data); err != nil {
+		return err
+	}
+	p.last = data
+	return nil
+}
+
+// saveFields saves the fields of data that changed since the last snapshot
+// and that no repository writes through itself.
+func (p *persister) saveFields(store entityStore, data []byte) error {
+	var fields, last map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	json.Unmarshal(p.last, &last)
+	for name, raw := range fields {
+		if p.db.journal.bound(name) {
+			continue
+		}
+		if old, ok := last[name]; ok && sameJSON(old, raw) {
+			continue
+		}
+		if err := store.SaveField(name, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (p *persister) flushLogged() {
+	if err := p.flush(); err != nil {
+		log.Printf("Persisting database: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ProfileDefault names a server's own behavior among its profiles.
+const ProfileDefault = "default"
+
+// profile is the profile the server runs with, set by New.
+var profile = ProfileDefault
+
+// Profile returns the profile the server runs with: ProfileDefault, or the
+// one of those WithProfiles names that --profile picked.
+func Profile() string {
+	return profile
+}
+
+// WithProfiles names the profiles a server has besides its default:
+// variants of its API, such as the older one Uber served as v2, kept in
+// the one implementation so that fixes reach them all. --profile picks
+// one at startup; setupRoutes registers the profile's own routes under
+// if server.Profile() == "v2", which is how cmd/openapi tells them apart,
+// and handlers check Profile where the variants behave differently. A
+// profile's own seed and spec, such as database.v2.json and
+// openapi.v2.json beside the server's, replace its default ones.
+func WithProfiles(names ...string) Option {
+	return func(o *options) {
+		o.profiles = names
+	}
+}
+
+// useProfile makes name the profile the server runs with, if it is one of
+// its profiles.
+func useProfile(name string, profiles []string) error {
+	switch {
+	case name == "" || name == ProfileDefault:
+		profile = ProfileDefault
+		return nil
+	case len(profiles) == 0:
+		return fmt.Errorf("--profile %q: the server has no profiles but %s", name, ProfileDefault)
+	case !slices.Contains(profiles, name):
+		return fmt.Errorf("--profile %q: want %s or %s", name, ProfileDefault, strings.Join(profiles, ", "))
+	}
+	profile = name
+	return nil
+}
+
+// profileFile returns the profile name's own version of the file at path,
+// named as its fixtures are, like openapi.v2.json for openapi.json, or
+// path itself if it has none.
+func profileFile(path, name string) string {
+	if name == "" || name == ProfileDefault || !validFixture(name) {
+		return path
+	}
+	own := fixtureFile(path, name)
+	if _, err := os.Stat(own); err != nil {
+		return path
+	}
+	return own
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/money"
+	"pkg/pricing"
+	"pkg/promotions"
+)
+
+// Promotions are the promo codes a server takes at checkout, and their
+// uses, kept in its database by embedding it, untagged, like Payments:
+//
+//	type Database struct {
+//		server.Auth `json:"auth"`
+//		server.Promotions
+//		...
+//	}
+//
+// Its codes are then the database's "promotions" collection, keyed by code
+// in upper case, and their uses its "redemptions". Users check a code at
+// /api/v1/promotions/{code} and read the codes they have used at
+// /api/v1/redemptions. A checkout takes codes with Discounts, prices the
+// order with the rules it returns ahead of tax, and records the codes'
+// use with Redeem, all under the database's lock for writing:
+//
+//	discounts, err := db.Discounts(req.PromoCodes, promotions.Order{UserEmail: email, Subtotal: subtotal})
+//	if err != nil {
+//		return err
+//	}
+//	quote, err := pricing.Price(money.USD, lines, append(discounts, pricing.Tax(taxRate))...)
+//	if err != nil {
+//		return err
+//	}
+//	db.Redeem(req.PromoCodes, email, order.ID, quote)
+type Promotions struct {
+	Promotions  Repository[promotions.Promotion]  `json:"promotions"`
+	Redemptions Repository[promotions.Redemption] `json:"redemptions"`
+}
+
+// Discounts checks codes for order and returns what they take off it, as
+// pricing rules, in the order given. A code that can't be used is answered
+// with 422 VALIDATION_FAILED, as a failed promo_codes field, saying why.
+// The caller holds the database's lock.
+func (p *Promotions) Discounts(codes []string, order promotions.Order) ([]pricing.Rule, error) {
+	found, err := p.check(codes, order)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]pricing.Rule, len(found))
+	for i, promo := range found {
+		rules[i] = promo.Rule()
+	}
+	return rules, nil
+}
+
+// Redeem records the use of codes, which Discounts took, on the order
+// orderID, priced as quote, counting each against its limits. The caller
+// holds the database's lock for writing.
+func (p *Promotions) Redeem(codes []string, email, orderID string, quote pricing.Quote) []promotions.Redemption {
+	var redeemed []promotions.Redemption
+	for _, code := range codes {
+		key := promotions.Normalize(code)
+		if !p.Promotions.Update(key, func(promo *promotions.Promotion) { promo.Uses++ }) {
+			continue
+		}
+		promo, _ := p.Promotions.Get(key)
+		r := promotions.Redemption{
+			ID:        messageID("rd_"),
+			Code:      promo.Code,
+			UserEmail: email,
+			OrderID:   orderID,
+			Amount:    promo.Discount(quote),
+			CreatedAt: Now(),
+		}
+		p.Redemptions.Upsert(r.ID, r)
+		redeemed = append(redeemed, r)
+	}
+	return redeemed
+}
+
+// check looks codes up and checks them for order, and together.
+func (p *Promotions) check(codes []string, order promotions.Order) ([]promotions.Promotion, error) {
+	now := Now()
+	found := make([]promotions.Promotion, 0, len(codes))
+	for _, code := range codes {
+		key := promotions.Normalize(code)
+		promo, ok := p.Promotions.Get(key)
+		if !ok {
+			return nil, promotionError(promotions.NotFound(code))
+		}
+		promo.Code = key
+		if err := promo.Check(order, p.used(key, order.UserEmail), now); err != nil {
+			return nil, promotionError(err)
+		}
+		found = append(found, promo)
+	}
+	if err := promotions.Stack(found); err != nil {
+		return nil, promotionError(err)
+	}
+	return found, nil
+}
+
+// used returns how many times a user has used a code.
+func (p *Promotions) used(code, email string) int {
+	n := 0
+	for _, r := range p.Redemptions.By("user_email", email) {
+		if r.Code == code {
+			n++
+		}
+	}
+	return n
+}
+
+// promotionError answers a code that can't be used as a failed promo_codes
+// field.
+func promotionError(err error) error {
+	return &ValidationError{Errors: []FieldError{{Field: "promo_codes", Message: err.Error()}}}
+}
+
+func (p *Promotions) promotions() *Promotions { return p }
+
+// promoting is a database that embeds Promotions.
+type promoting interface {
+	promotions() *Promotions
+}
+
+// promos serves users the database's promo codes, or a sandbox's.
+type promos struct {
+	db Database
+}
+
+func (pr *promos) attach(app *fiber.App) {
+	app.Get("/api/v1/promotions/:code", pr.get)
+	app.Get("/api/v1/redemptions", pr.redemptions)
+}
+
+// get responds with a promo code, checked for the caller's order of
+// subtotal, and what it would take off it:
+//
+//	GET /api/v1/promotions/SAVE10?email=...&subtotal=59.98
+//
+// A code there is no such promotion for is answered with 404, and one the
+// caller can't use with 422, as a checkout would answer it.
+func (pr *promos) get(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+	subtotal := money.Money{}
+	if s := c.Query("subtotal"); s != "" {
+		subtotal, err = money.Parse(s, money.USD)
+		if err != nil || subtotal.IsNegative() {
+			return &ValidationError{Errors: []FieldError{{Field: "subtotal", Message: "must be an amount, like 59.98"}}}
+		}
+	}
+
+	v, mu := pr.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+		defer mu.RUnlock()
+	}
+	p := v.(promoting).promotions()
+	code := c.Params("code")
+	if _, ok := p.Promotions.Get(promotions.Normalize(code)); !ok {
+		return Fail(c, fiber.StatusNotFound, CodeNotFound, promotions.NotFound(code).Message)
+	}
+	found, err := p.check([]string{code}, promotions.Order{UserEmail: email, Subtotal: subtotal})
+	if err != nil {
+		return err
+	}
+	promo := found[0]
+	quote, err := pricing.Price(subtotal.Code(), []pricing.Line{{Price: subtotal, Quantity: 1}}, promo.Rule())
+	if err != nil {
+		return promotionError(err)
+	}
+	return c.JSON(fiber.Map{
+		"promotion": promo,
+		"discount":  quote.Discount,
+	})
+}
+
+// redemptions responds with the codes the caller has used, newest first,
+// as a page:
+//
+//	GET /api/v1/redemptions?email=...
+func (pr *promos) redemptions(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+
+	v, mu := pr.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+	}
+	found := v.(promoting).promotions().Redemptions.By("user_email", email)
+	if mu != nil {
+		mu.RUnlock()
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].CreatedAt.Equal(found[j].CreatedAt) {
+			return found[i].CreatedAt.After(found[j].CreatedAt)
+		}
+		return found[i].ID < found[j].ID
+	})
+	return List(c, found)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+)
+
+// rateLimit allows each caller max requests per window to the routes
+// under prefix.
+type rateLimit struct {
+	prefix string
+	max    int // 0 for no limit
+	window time.Duration
+	per    string // The window, as in "per minute"
+}
+
+var rateWindows = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+var rateWindowNames = map[string]string{"s": "second", "m": "minute", "h": "hour"}
+
+// parseRateLimits parses the --rate-limit flag: comma-separated limits
+// such as 120/m, each optionally for a route prefix, as in
+// /api/v1/auth=10/m. A limit without a prefix covers every other route.
+func parseRateLimits(spec string) ([]rateLimit, error) {
+	var limits []rateLimit
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, limit, ok := strings.Cut(item, "=")
+		if !ok {
+			prefix, limit = "", item
+		}
+		count, unit, _ := strings.Cut(limit, "/")
+		max, err := strconv.Atoi(count)
+		window, ok := rateWindows[unit]
+		if err != nil || max < 0 || !ok {
+			return nil, fmt.Errorf("rate limit %q: want a count per s, m or h, like 60/m", item)
+		}
+		limits = append(limits, rateLimit{prefix: strings.TrimSuffix(prefix, "/"), max: max, window: window, per: rateWindowNames[unit]})
+	}
+	return limits, nil
+}
+
+// WithRateLimit throttles callers as cfg.RateLimit says, answering those
+// over their limit with 429 and a Retry-After header. Callers are counted
+// by user once authenticated, and by IP address otherwise, separately for
+// each limit; a request counts only towards the limit with the longest
+// prefix of its path.
+func WithRateLimit(cfg Config) Option {
+	return func(o *options) {
+		limits, err := parseRateLimits(cfg.RateLimit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.rateLimits = limits
+	}
+}
+
+func attachRateLimits(app *fiber.App, limits []rateLimit) {
+	for _, l := range limits {
+		if l.max == 0 {
+			continue
+		}
+		app.Use(limiter.New(limiter.Config{
+			Next: func(c *fiber.Ctx) bool {
+				return matchRateLimit(limits, c.Path()).prefix != l.prefix
+			},
+			Max:        l.max,
+			Expiration: l.window,
+			KeyGenerator: func(c *fiber.Ctx) string {
+				if email, _ := c.Locals(localsEmail).(string); email != "" {
+					return email
+				}
+				return c.IP()
+			},
+			LimitReached: func(c *fiber.Ctx) error {
+				return fiber.NewError(fiber.StatusTooManyRequests, fmt.Sprintf("Rate limit of %d requests per %s exceeded; retry after %s seconds", l.max, l.per, c.GetRespHeader(fiber.HeaderRetryAfter)))
+			},
+		}))
+	}
+}
+
+// matchRateLimit returns the limit with the longest prefix of path.
+func matchRateLimit(limits []rateLimit, path string) rateLimit {
+	best := rateLimit{prefix: "\x00"} // Matches nothing
+	for _, l := range limits {
+		covers := l.prefix == "" || path == l.prefix || strings.HasPrefix(path, l.prefix+"/")
+		if covers && (best.prefix == "\x00" || len(l.prefix) > len(best.prefix)) {
+			best = l
+		}
+	}
+	return best
+}
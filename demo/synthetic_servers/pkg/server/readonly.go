@@ -0,0 +1,30 @@
+package server
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// readOnlyExempt are the paths read-only mode takes any method on: logging
+// in, which reading may take, and the batch and GraphQL endpoints, whose
+// operations it takes or refuses one by one as they are carried out.
+var readOnlyExempt = []string{"/api/v1/auth/login", "/api/v1/auth/refresh", batchPath, "/graphql"}
+
+// readOnly refuses requests that could change the database, those with
+// any method but GET, HEAD or OPTIONS, with 403 READ_ONLY, for demos and
+// for phases of an evaluation in which agents may only look. The admin
+// endpoints are left to the harness.
+func readOnly(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	}
+	path := strings.TrimSuffix(c.Path(), "/")
+	if strings.HasPrefix(path, "/admin/") || slices.Contains(readOnlyExempt, path) {
+		return c.Next()
+	}
+	requested, _, _ := strings.Cut(c.OriginalURL(), "?") // As sent, before versions rewrote it
+	return Fail(c, fiber.StatusForbidden, CodeReadOnly, "The server is read-only: "+c.Method()+" "+requested+" isn't allowed, only reads are")
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// recordedRequestHeaders are the request headers kept in a session, and
+// recordedResponseHeaders the response ones.
+var (
+	recordedRequestHeaders  = []string{fiber.HeaderAuthorization, fiber.HeaderContentType, fiber.HeaderIfMatch, fiber.HeaderIfNoneMatch, HeaderIdempotencyKey, HeaderSandboxID}
+	recordedResponseHeaders = []string{fiber.HeaderContentType, fiber.HeaderLocation, fiber.HeaderETag, fiber.HeaderRetryAfter, HeaderIdempotentReplayed}
+)
+
+// exchange is a request and its response, one line of a session file.
+type exchange struct {
+	Seq      int              `json:"seq"`
+	Time     time.Time        `json:"time"`
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"` // With the query string
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+type recordedResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// WithRecording records every API request and its response to the session
+// file cfg.Record, or, with cfg.Replay, answers requests with the responses
+// recorded in one instead of running them; see recorder and replayer.
+func WithRecording(cfg Config) Option {
+	return func(o *options) {
+		switch {
+		case cfg.Record != "" && cfg.Replay != "":
+			log.Fatal("--record and --replay can't be used together")
+		case cfg.Record != "":
+			r, err := newRecorder(cfg.Record)
+			if err != nil {
+				log.Fatal(err)
+			}
+			o.recorder = r
+		case cfg.Replay != "":
+			r, err := loadReplayer(cfg.Replay)
+			if err != nil {
+				log.Fatal(err)
+			}
+			o.replayer = r
+		}
+	}
+}
+
+// recorded reports whether requests to path belong in a session: the
+// admin, debug, health and metrics endpoints are for harnesses, not agents.
+func recorded(path string) bool {
+	return !strings.HasPrefix(path, "/admin") && !strings.HasPrefix(path, "/debug") && path != "/healthz" && path != "/readyz" && path != "/metrics"
+}
+
+// recorder writes each API request and the response it got to a session
+// file, as a JSON line, so an agent's trajectory can be replayed later
+// without the server's state. Bodies are kept as JSON, or as a JSON string
+// if they aren't JSON; streamed responses, like server-sent events, aren't
+// recorded.
+type recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	seq  int
+}
+
+func newRecorder(path string) (*recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("recording: %w", err)
+	}
+	return &recorder{file: f}, nil
+}
+
+func (r *recorder) attach(app *fiber.App) {
+	app.Use(r.record)
+	app.Hooks().OnShutdown(func() error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.file.Close()
+	})
+}
+
+func (r *recorder) record(c *fiber.Ctx) error {
+	if !recorded(c.Path()) {
+		return c.Next()
+	}
+	// Take the request as it came, before middleware such as auth's
+	// rewrites it.
+	e := exchange{
+		Time: time.Now().UTC(),
+		Request: recordedRequest{
+			Method:  c.Method(),
+			Path:    string(c.Request().RequestURI()),
+			Headers: pickHeaders(recordedRequestHeaders, c.Request().Header.Peek),
+			Body:    recordedBody(c.Body()),
+		},
+	}
+	// Render errors here so the response can be recorded.
+	if err := c.Next(); err != nil {
+		if err := c.App().Config().ErrorHandler(c, err); err != nil {
+			return err
+		}
+	}
+	resp := c.Response()
+	if resp.IsBodyStream() {
+		return nil
+	}
+	e.Response = recordedResponse{
+		Status:  resp.StatusCode(),
+		Headers: pickHeaders(recordedResponseHeaders, resp.Header.Peek),
+		Body:    recordedBody(resp.Body()),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	e.Seq = r.seq
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		Logger(c).Error("Recording failed", "error", err)
+	}
+	return nil
+}
+
+func pickHeaders(names []string, peek func(string) []byte) map[string]string {
+	var headers map[string]string
+	for _, name := range names {
+		if value := peek(name); len(value) > 0 {
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[name] = string(value)
+		}
+	}
+	return headers
+}
+
+// recordedBody keeps a body as compact JSON, or as a JSON string if it
+// isn't JSON.
+func recordedBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		var buf bytes.Buffer
+		if json.Compact(&buf, body) == nil {
+			return buf.Bytes()
+		}
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
+
+// replayer answers API requests with the responses recorded for them in a
+// session file, without running them, so a trajectory can be re-evaluated
+// offline. A request matches a recorded one with the same method, path,
+// query, Authorization, X-Sandbox-ID and body. Requests that were sent more
+// than once get their responses in the order they were recorded, and then
+// the last one again; requests the session doesn't have get a 404.
+type replayer struct {
+	mu        sync.Mutex
+	responses map[string][]recordedResponse
+	served    map[string]int
+}
+
+func loadReplayer(path string) (*replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	defer f.Close()
+
+	r := &replayer{responses: make(map[string][]recordedResponse), served: make(map[string]int)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e exchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("replay: %s:%d: %w", path, line, err)
+		}
+		key := replayKey(e.Request.Method, e.Request.Path, e.Request.Headers[fiber.HeaderAuthorization], e.Request.Headers[HeaderSandboxID], e.Request.Body)
+		r.responses[key] = append(r.responses[key], e.Response)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	return r, nil
+}
+
+func replayKey(method, path, authorization, sandbox string, body json.RawMessage) string {
+	return strings.Join([]string{method, path, authorization, sandbox, string(body)}, "\x00")
+}
+
+func (r *replayer) attach(app *fiber.App) {
+	app.Use(r.replay)
+}
+
+func (r *replayer) replay(c *fiber.Ctx) error {
+	if !recorded(c.Path()) {
+		return c.Next()
+	}
+	key := replayKey(c.Method(), string(c.Request().RequestURI()), c.Get(fiber.HeaderAuthorization), c.Get(HeaderSandboxID), recordedBody(c.Body()))
+
+	r.mu.Lock()
+	responses := r.responses[key]
+	i := min(r.served[key], len(responses)-1)
+	r.served[key]++
+	r.mu.Unlock()
+	if len(responses) == 0 {
+		return Fail(c, fiber.StatusNotFound, CodeNotFound, fmt.Sprintf("%s %s isn't in the recorded session", c.Method(), c.OriginalURL()))
+	}
+
+	resp := responses[i]
+	for name, value := range resp.Headers {
+		c.Set(name, value)
+	}
+	c.Status(resp.Status)
+	if len(resp.Body) == 0 {
+		return nil
+	}
+	var text string
+	if !strings.HasPrefix(resp.Headers[fiber.HeaderContentType], fiber.MIMEApplicationJSON) && json.Unmarshal(resp.Body, &text) == nil {
+		return c.SendString(text)
+	}
+	return c.Send(resp.Body)
+}
+
+// reset starts the session over, so each request gets its first recorded
+// response again.
+func (r *replayer) reset() {
+	r.mu.Lock()
+	r.served = make(map[string]int)
+	r.mu.Unlock()
+}
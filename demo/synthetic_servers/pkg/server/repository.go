@@ -0,0 +1,436 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Repository is a collection of a server's database, entities of type T by
+// their keys, in place of a map[string]T:
+//
+//	type Database struct {
+//		Products server.Repository[Product] `json:"products"`
+//		Orders   server.Repository[Order]   `json:"orders"`
+//		mu       sync.RWMutex
+//	}
+//
+// It is written to and read from JSON as the map would be, so seeds,
+// snapshots, sandboxes and lifecycles see no difference. Besides looking
+// entities up by key, it indexes them by the fields that refer to users
+// and other entities: email, those ending in _email, and those ending in
+// _id, such as user_email and product_id. By finds them by those fields
+// without a scan.
+//
+// Every change made through Upsert, Update or Delete is told, before it is
+// made, to the database's journal, which credits it to the request or job
+// making it and passes it on as events, activity and the audit trail, and
+// which writes it through to the store when the database is kept entity by
+// entity, as the json and bolt backends keep it.
+//
+// Each entity has a version, which starts at 1 and goes up whenever a
+// change makes a difference to it; ETags are made from it. An entity
+// past version 1 is written with it, as its "_version", so it lasts
+// through snapshots, sandboxes and restarts. Only structs are versioned
+// beyond the life of the server: other entities, such as maps, have
+// nowhere to keep it.
+//
+// Like the map, a Repository doesn't lock: callers hold the database's
+// lock, for reading or writing as the method says, and its zero value is
+// an empty repository ready to use.
+type Repository[T any] struct {
+	items   map[string]T
+	indexes map[string]map[string][]string // Keys, by field and value
+
+	name     string                     // Of its collection, once bound
+	journal  *journal                   // Told of its changes, once bound
+	saved    map[string]json.RawMessage // Its entities as the journal was last told of them
+	versions map[string]int             // Of the entities past version 1
+}
+
+// Len returns how many entities there are. The caller holds the
+// database's lock for reading.
+func (r *Repository[T]) Len() int {
+	return len(r.items)
+}
+
+// Get returns the entity with key. The caller holds the database's lock
+// for reading.
+func (r *Repository[T]) Get(key string) (T, bool) {
+	item, ok := r.items[key]
+	return item, ok
+}
+
+// Keys returns the entities' keys, in order. The caller holds the
+// database's lock for reading.
+func (r *Repository[T]) Keys() []string {
+	keys := make([]string, 0, len(r.items))
+	for key := range r.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// List returns the entities, in order of their keys. The caller holds the
+// database's lock for reading.
+func (r *Repository[T]) List() []T {
+	return r.Query(nil)
+}
+
+// Query returns the entities match accepts, or all of them if match is
+// nil, in order of their keys. The caller holds the database's lock for
+// reading.
+func (r *Repository[T]) Query(match func(T) bool) []T {
+	found := []T{}
+	for _, key := range r.Keys() {
+		if item := r.items[key]; match == nil || match(item) {
+			found = append(found, item)
+		}
+	}
+	return found
+}
+
+// By returns the entities whose field, by its JSON name, is value, in
+// order of their keys. Emails match in any case. Indexed fields are looked
+// up; others are scanned for. The caller holds the database's lock for
+// reading.
+func (r *Repository[T]) By(field, value string) []T {
+	if isEmailField(field) {
+		value = strings.ToLower(value)
+	}
+	found := []T{}
+	if _, ok := indexedFields[T]()[field]; ok {
+		for _, key := range r.indexes[field][value] {
+			found = append(found, r.items[key])
+		}
+		return found
+	}
+	index, ok := jsonFields(reflect.TypeFor[T]())[field]
+	if !ok {
+		return found
+	}
+	for _, key := range r.Keys() {
+		item := r.items[key]
+		if v, ok := fieldValue(item, index); ok && v.Kind() == reflect.String && indexValue(field, v.String()) == value {
+			found = append(found, item)
+		}
+	}
+	return found
+}
+
+// Upsert puts item in under key, replacing the entity there if there is
+// one. The caller holds the database's lock for writing.
+func (r *Repository[T]) Upsert(key string, item T) {
+	if r.journal != nil {
+		r.record(key, &item)
+	}
+	r.put(key, item)
+}
+
+// put stores item under key, as Upsert does, without telling the journal.
+func (r *Repository[T]) put(key string, item T) {
+	if r.items == nil {
+		r.items = make(map[string]T)
+	}
+	if old, ok := r.items[key]; ok {
+		r.unindex(key, old)
+	}
+	r.items[key] = item
+	r.index(key, item)
+}
+
+// Update applies change to the entity with key, if there is one, and
+// stores the result, reporting whether there was. The caller holds the
+// database's lock for writing.
+func (r *Repository[T]) Update(key string, change func(*T)) bool {
+	item, ok := r.items[key]
+	if !ok {
+		return false
+	}
+	change(&item)
+	r.Upsert(key, item)
+	return true
+}
+
+// Delete removes the entity with key, returning it if there was one. The
+// caller holds the database's lock for writing.
+func (r *Repository[T]) Delete(key string) (T, bool) {
+	item, ok := r.items[key]
+	if ok {
+		if r.journal != nil {
+			r.record(key, nil)
+		}
+		r.unindex(key, item)
+		delete(r.items, key)
+		delete(r.versions, key)
+	}
+	return item, ok
+}
+
+// version returns the version of the entity with key. The caller holds
+// the database's lock for reading.
+func (r *Repository[T]) version(key string) int {
+	if n, ok := r.versions[key]; ok {
+		return n
+	}
+	return 1
+}
+
+// MarshalJSON writes the repository as a JSON object of its entities by
+// key, as a map[string]T, with the versions of those past version 1.
+func (r Repository[T]) MarshalJSON() ([]byte, error) {
+	if r.items == nil {
+		return []byte("{}"), nil
+	}
+	if len(r.versions) == 0 || !versionable[T]() {
+		return json.Marshal(r.items)
+	}
+	items := make(map[string]json.RawMessage, len(r.items))
+	for key, item := range r.items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		items[key] = withVersion(data, r.version(key))
+	}
+	return json.Marshal(items)
+}
+
+// UnmarshalJSON reads a JSON object of entities by key, replacing the
+// repository's, and their versions.
+func (r *Repository[T]) UnmarshalJSON(data []byte) error {
+	var items map[string]T
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	var versions map[string]struct {
+		Version int `json:"_version"`
+	}
+	if versionable[T]() {
+		if err := json.Unmarshal(data, &versions); err != nil {
+			return err
+		}
+	}
+	r.items, r.indexes, r.saved, r.versions = nil, nil, nil, nil
+	for key, item := range items {
+		r.put(key, item)
+		if n := versions[key].Version; n > 1 {
+			if r.versions == nil {
+				r.versions = make(map[string]int)
+			}
+			r.versions[key] = n
+		}
+	}
+	return nil
+}
+
+// bind has the repository, the collection name, tell j of its changes.
+func (r *Repository[T]) bind(name string, j *journal) {
+	r.name, r.journal = name, j
+	r.saved = make(map[string]json.RawMessage, len(r.items))
+	for key, item := range r.items {
+		if data, err := json.Marshal(item); err == nil {
+			r.saved[key] = data
+		}
+	}
+}
+
+// record tells the journal of a change to the entity with key before it
+// is made: its new value, or its deletion if item is nil, and moves its
+// version on if it makes a difference. The entity as it was is what the
+// journal was last told, since handlers may have changed the maps and
+// slices it shares with its new value already.
+func (r *Repository[T]) record(key string, item *T) {
+	before, ok := r.saved[key]
+	if old, had := r.items[key]; !ok && had {
+		before, _ = json.Marshal(old)
+	}
+	var after json.RawMessage
+	if item != nil {
+		after, _ = json.Marshal(*item)
+	}
+	if r.saved == nil {
+		r.saved = make(map[string]json.RawMessage)
+	}
+	version := 0
+	switch {
+	case after == nil:
+		delete(r.saved, key)
+		delete(r.versions, key)
+	case before == nil:
+		r.saved[key] = after
+		delete(r.versions, key)
+		version = 1
+	default:
+		r.saved[key] = after
+		version = r.version(key)
+		if !bytes.Equal(before, after) {
+			version++
+			if r.versions == nil {
+				r.versions = make(map[string]int)
+			}
+			r.versions[key] = version
+		}
+	}
+	r.journal.record(r.name, key, before, after, version)
+}
+
+// each calls fn with the entities, in order of their keys, as the journal
+// was last told of them, and their versions.
+func (r *Repository[T]) each(fn func(key string, raw json.RawMessage, version int)) {
+	for _, key := range sortedKeys(r.saved, nil) {
+		fn(key, r.saved[key], r.version(key))
+	}
+}
+
+// entities returns the repository's map, for lifecycles, which find
+// entities by reflection, and a func to store one back under its key.
+func (r *Repository[T]) entities() (reflect.Value, func(key string, item reflect.Value)) {
+	if r.items == nil {
+		r.items = make(map[string]T)
+	}
+	return reflect.ValueOf(r.items), func(key string, item reflect.Value) {
+		r.Upsert(key, item.Interface().(T))
+	}
+}
+
+// remove deletes the entity with key, for lifecycles.
+func (r *Repository[T]) remove(key string) { r.Delete(key) }
+
+// repository is a Repository of any type.
+type repository interface {
+	entities() (reflect.Value, func(key string, item reflect.Value))
+	remove(key string)
+	bind(name string, j *journal)
+	each(fn func(key string, raw json.RawMessage, version int))
+}
+
+// versionable reports whether entities of type T, structs, can be written
+// with their versions.
+func versionable[T any]() bool {
+	t := reflect.TypeFor[T]()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// versionPrefix starts an entity written with its version.
+const versionPrefix = `{"_version":`
+
+// withVersion writes the version into an entity, a JSON object, if it is
+// past version 1.
+func withVersion(data []byte, version int) json.RawMessage {
+	if version <= 1 || len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	out := strconv.AppendInt([]byte(versionPrefix), int64(version), 10)
+	if string(data) != "{}" {
+		out = append(out, ',')
+	}
+	return append(out, data[1:]...)
+}
+
+// withoutVersion takes the version withVersion wrote out of an entity,
+// returning it and its version.
+func withoutVersion(raw json.RawMessage) (json.RawMessage, int) {
+	rest, ok := bytes.CutPrefix(raw, []byte(versionPrefix))
+	if !ok {
+		return raw, 1
+	}
+	end := bytes.IndexAny(rest, ",}")
+	if end < 0 {
+		return raw, 1
+	}
+	version, err := strconv.Atoi(string(rest[:end]))
+	if err != nil {
+		return raw, 1
+	}
+	if rest[end] == '}' {
+		return json.RawMessage("{}"), version
+	}
+	return append([]byte{'{'}, rest[end+1:]...), version
+}
+
+func (r *Repository[T]) index(key string, item T) {
+	for field, at := range indexedFields[T]() {
+		v, ok := fieldValue(item, at)
+		if !ok || v.String() == "" {
+			continue
+		}
+		if r.indexes == nil {
+			r.indexes = make(map[string]map[string][]string)
+		}
+		if r.indexes[field] == nil {
+			r.indexes[field] = make(map[string][]string)
+		}
+		value := indexValue(field, v.String())
+		keys := r.indexes[field][value]
+		if i, found := slices.BinarySearch(keys, key); !found {
+			r.indexes[field][value] = slices.Insert(keys, i, key)
+		}
+	}
+}
+
+func (r *Repository[T]) unindex(key string, item T) {
+	for field, at := range indexedFields[T]() {
+		v, ok := fieldValue(item, at)
+		if !ok {
+			continue
+		}
+		value := indexValue(field, v.String())
+		keys := r.indexes[field][value]
+		if i, found := slices.BinarySearch(keys, key); found {
+			keys = slices.Delete(keys, i, i+1)
+			if len(keys) == 0 {
+				delete(r.indexes[field], value)
+			} else {
+				r.indexes[field][value] = keys
+			}
+		}
+	}
+}
+
+// indexed caches the fields each type of entity is indexed by.
+var indexed sync.Map // reflect.Type -> map[string][]int
+
+// indexedFields returns the fields of T that repositories index, by JSON
+// name: strings named email, or ending in _email or _id.
+func indexedFields[T any]() map[string][]int {
+	t := reflect.TypeFor[T]()
+	if fields, ok := indexed.Load(t); ok {
+		return fields.(map[string][]int)
+	}
+	fields := make(map[string][]int)
+	for name, index := range jsonFields(t) {
+		if !isEmailField(name) && !strings.HasSuffix(name, "_id") {
+			continue
+		}
+		st := t
+		for st.Kind() == reflect.Pointer {
+			st = st.Elem()
+		}
+		if st.FieldByIndex(index).Type.Kind() == reflect.String {
+			fields[name] = index
+		}
+	}
+	indexed.Store(t, fields)
+	return fields
+}
+
+func isEmailField(name string) bool {
+	return name == "email" || strings.HasSuffix(name, "_email")
+}
+
+func indexValue(field, value string) string {
+	if isEmailField(field) {
+		return strings.ToLower(value)
+	}
+	return value
+}
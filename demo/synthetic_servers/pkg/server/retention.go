@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/statemachine"
+)
+
+// retentionInterval is how often finished entities are looked for, on top
+// of whenever the clock is moved.
+const retentionInterval = time.Minute
+
+// ArchivedEntity is an entity retention took out of the database, as
+// /admin/archive lists it.
+type ArchivedEntity struct {
+	Collection string          `json:"collection"`
+	ID         string          `json:"id"`
+	Owner      string          `json:"owner,omitempty"`
+	Status     string          `json:"status"`
+	FinishedAt time.Time       `json:"finished_at"` // When it got its final status, as far as is known
+	ArchivedAt time.Time       `json:"archived_at"`
+	Entity     json.RawMessage `json:"entity"`
+}
+
+// retention bounds the memory a long session takes: the entities of a
+// lifecycle's collection that have been in a final status, one no step
+// leaves, such as delivered or cancelled, for longer than ttl are
+// appended to the archive file and taken out of the database. An entity
+// finished when its status_history says it got its status, or failing
+// that at its updated_at, or failing both when retention first saw it so.
+// Entities kept in a list rather than a map stay.
+type retention struct {
+	db         Database
+	ttl        time.Duration
+	lifecycles []*Lifecycle
+
+	mu   sync.Mutex
+	path string
+	file *os.File
+	seen map[string]time.Time // Collection/key -> when first seen finished, for entities with no time of their own
+}
+
+// newRetention opens the archive at path, or at a new temporary file if
+// path is empty, to archive entities to once they have been finished for
+// ttl.
+func newRetention(ttl time.Duration, path string) (*retention, error) {
+	if path == "" {
+		tmp, err := os.CreateTemp("", "archive-*.jsonl")
+		if err != nil {
+			return nil, fmt.Errorf("archive: %w", err)
+		}
+		tmp.Close()
+		path = tmp.Name()
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("archive: %w", err)
+	}
+	return &retention{ttl: ttl, path: path, file: f, seen: make(map[string]time.Time)}, nil
+}
+
+// add retains the entities of lifecycles' collections.
+func (r *retention) add(lifecycles ...Lifecycle) {
+	for _, lc := range lifecycles {
+		if lc.Field == "" {
+			lc.Field = "status"
+		}
+		r.lifecycles = append(r.lifecycles, &lc)
+	}
+}
+
+func (r *retention) start(app *fiber.App) {
+	log.Printf("Archiving entities finished for %v to %s", r.ttl, r.path)
+	app.Hooks().OnShutdown(func() error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.file.Close()
+	})
+	r.runLogged(Now())
+	go Every(retentionInterval, r.runLogged)
+}
+
+func (r *retention) runLogged(now time.Time) {
+	n, err := r.run(now)
+	if err != nil {
+		log.Printf("Archiving: %v", err)
+	}
+	if n > 0 {
+		log.Printf("Archived %d finished entit(ies)", n)
+	}
+}
+
+// run archives every entity finished for r.ttl by now, and returns how
+// many it archived. Entities are only taken out of the database once the
+// archive has them on disk.
+func (r *retention) run(now time.Time) (int, error) {
+	v, mu := r.db.Current()
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var archived []ArchivedEntity
+	var removals []func()
+	seen := make(map[string]bool)
+	for _, lc := range r.lifecycles {
+		for _, e := range lifecycleEntities(v, lc) {
+			status := e.status.String()
+			if e.remove == nil || !lc.final(status) {
+				continue
+			}
+			id := lc.Collection + "/" + e.key
+			seen[id] = true
+			finished, ok := e.finished(status)
+			if !ok {
+				if _, known := r.seen[id]; !known {
+					r.seen[id] = now
+				}
+				finished = r.seen[id]
+			}
+			if now.Sub(finished) < r.ttl {
+				continue
+			}
+			data, err := json.Marshal(e.item.Interface())
+			if err != nil {
+				return 0, err
+			}
+			var entity map[string]any
+			json.Unmarshal(data, &entity)
+			archived = append(archived, ArchivedEntity{
+				Collection: lc.Collection,
+				ID:         e.key,
+				Owner:      entityOwner(entity),
+				Status:     status,
+				FinishedAt: finished,
+				ArchivedAt: now,
+				Entity:     data,
+			})
+			removals = append(removals, e.remove)
+		}
+	}
+	for id := range r.seen {
+		if !seen[id] {
+			delete(r.seen, id)
+		}
+	}
+	if len(archived) == 0 {
+		return 0, nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, a := range archived {
+		if err := enc.Encode(a); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := r.file.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := r.file.Sync(); err != nil {
+		return 0, err
+	}
+	for _, remove := range removals {
+		remove()
+	}
+	return len(archived), nil
+}
+
+// final reports whether status is one entities stay in: one lc's machine
+// moves nowhere from, or without a machine, one no step leaves.
+func (lc *Lifecycle) final(status string) bool {
+	if lc.Machine != nil {
+		return lc.Machine.Final(status)
+	}
+	_, ok := lc.step(status)
+	return !ok
+}
+
+// finished returns when e got status, its last, from its status_history
+// or else its updated_at, or false if it has neither.
+func (e lifecycleEntity) finished(status string) (time.Time, bool) {
+	if e.history.IsValid() {
+		history := e.history.Interface().([]statemachine.Transition)
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].To == status {
+				return history[i].At, true
+			}
+		}
+	}
+	return e.time("updated_at")
+}
+
+// entities reads the archive, oldest first.
+func (r *retention) entities() ([]ArchivedEntity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	found := []ArchivedEntity{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var a ArchivedEntity
+		if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filepath.Base(r.path), line, err)
+		}
+		found = append(found, a)
+	}
+	return found, scanner.Err()
+}
+
+// clear empties the archive, as a reset discards what happened since
+// startup.
+func (r *retention) clear() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen = make(map[string]time.Time)
+	return r.file.Truncate(0)
+}
+
+// attachAdmin mounts the archive's endpoints on the admin group:
+//
+//	GET /admin/archive                  Archived entities, latest first
+//	GET /admin/archive/:collection/:id  An archived entity
+func (r *retention) attachAdmin(group fiber.Router) {
+	group.Get("/archive", r.list)
+	group.Get("/archive/:collection/:id", r.get)
+}
+
+// list responds with the archived entities, latest first, as a page that
+// filters like any list:
+//
+//	GET /admin/archive?collection=rides&owner=casey@example.com
+func (r *retention) list(c *fiber.Ctx) error {
+	found, err := r.entities()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].ArchivedAt.After(found[j].ArchivedAt)
+	})
+	return List(c, found)
+}
+
+func (r *retention) get(c *fiber.Ctx) error {
+	found, err := r.entities()
+	if err != nil {
+		return err
+	}
+	for i := len(found) - 1; i >= 0; i-- {
+		if found[i].Collection == c.Params("collection") && found[i].ID == c.Params("id") {
+			return c.JSON(found[i])
+		}
+	}
+	return Fail(c, fiber.StatusNotFound, CodeNotFound, "No such archived entity")
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/reviews"
+)
+
+// Reviews are what a server's users say about what it offers, kept in its
+// database by embedding it, untagged, like Payments:
+//
+//	type Database struct {
+//		server.Auth `json:"auth"`
+//		server.Reviews
+//		...
+//	}
+//
+// Its reviews are then the database's "reviews" collection. A server takes
+// and lists reviews under its own routes, such as /api/v1/movies/{id}/reviews,
+// with AddReview, ReviewsOf and ReviewSummary, under a policy for what it
+// reviews. Users read the reviews they have written at /api/v1/reviews, and
+// flag others' at /api/v1/reviews/{id}/flags; moderators keep or remove
+// flagged reviews under /admin/reviews. A database that keeps ratings worked
+// out from reviews, such as a movie's average, works them out again in a
+// Rerate(reviews.Target) method, if it has one, when moderation changes
+// which reviews count.
+type Reviews struct {
+	Reviews reviews.Book `json:"reviews,omitempty"`
+}
+
+// AddReview adds r, of a target of policy's kind, from a user whose
+// purchase, booking or the like verifiedBy names, if any, giving it an ID
+// and time. It returns the errors reviews.Book.Add does, which the caller
+// answers as it sees fit, and holds the database's lock for writing:
+//
+//	db.mu.Lock()
+//	review, err := db.AddReview(moviePolicy, reviews.Review{...}, ticketID)
+//	db.mu.Unlock()
+func (rv *Reviews) AddReview(policy reviews.Policy, r reviews.Review, verifiedBy string) (reviews.Review, error) {
+	if rv.Reviews == nil {
+		rv.Reviews = make(reviews.Book)
+	}
+	r.ID = NewID("REV")
+	r.CreatedAt = Now()
+	return rv.Reviews.Add(policy, r, verifiedBy)
+}
+
+// ReviewsOf returns target's reviews that aren't hidden, in order, as
+// reviews.Sort takes it. The caller holds the database's lock.
+func (rv *Reviews) ReviewsOf(target reviews.Target, order string) []reviews.Review {
+	return rv.Reviews.Of(target, order)
+}
+
+// ReviewSummary returns what target's reviews that aren't hidden add up
+// to. The caller holds the database's lock.
+func (rv *Reviews) ReviewSummary(target reviews.Target) reviews.Summary {
+	return rv.Reviews.Summary(target)
+}
+
+func (rv *Reviews) reviews() *Reviews { return rv }
+
+// reviewing is a database that embeds Reviews.
+type reviewing interface {
+	reviews() *Reviews
+}
+
+// rerating is a database whose targets keep their ratings, such as a
+// movie's average, worked out from their reviews. Rerate works target's
+// out again after moderation hides, shows or removes one of its reviews;
+// the caller holds the database's lock for writing.
+type rerating interface {
+	Rerate(target reviews.Target)
+}
+
+// rerate has v rerate target, if it keeps ratings.
+func rerate(v any, target reviews.Target) {
+	if r, ok := v.(rerating); ok {
+		r.Rerate(target)
+	}
+}
+
+// reviewBook serves users their reviews and flags, and moderators the
+// flagged reviews, from the database or a sandbox's.
+type reviewBook struct {
+	db Database
+}
+
+func (rb *reviewBook) attach(app *fiber.App) {
+	app.Get("/api/v1/reviews", rb.list)
+	app.Post("/api/v1/reviews/:id/flags", rb.flag)
+}
+
+// list responds with the reviews the caller has written, newest first, as
+// a page, with those hidden for being flagged too:
+//
+//	GET /api/v1/reviews?email=...
+func (rb *reviewBook) list(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+
+	v, mu := rb.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+	}
+	found := v.(reviewing).reviews().Reviews.By(email)
+	if mu != nil {
+		mu.RUnlock()
+	}
+	return List(c, found)
+}
+
+type flagRequest struct {
+	Reason string `json:"reason" validate:"required,oneof=spam offensive off_topic fake other"`
+}
+
+// flag reports a review for moderation, once per user:
+//
+//	POST /api/v1/reviews/REV-1/flags?email=...
+//	{"reason": "spam"}
+//
+// A review enough users flag is hidden until a moderator looks at it.
+func (rb *reviewBook) flag(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+	var req flagRequest
+	if err := Bind(c, &req); err != nil {
+		return err
+	}
+
+	v, mu := rb.db.in(c).Current()
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	book := v.(reviewing).reviews().Reviews
+	id := strings.Clone(c.Params("id"))
+	f, err := book.Flag(id, email, req.Reason, Now())
+	switch err {
+	case nil:
+		if r := book[id]; r.Hidden {
+			rerate(v, r.Target)
+		}
+	case reviews.ErrNotFound:
+		return FailWith(c, fiber.StatusNotFound, err)
+	case reviews.ErrOwnReview:
+		return FailWith(c, fiber.StatusForbidden, err)
+	case reviews.ErrAlreadyFlagged:
+		return FailWith(c, fiber.StatusConflict, err)
+	default:
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(f)
+}
+
+// attachAdmin mounts moderation under the admin group:
+//
+//	GET    /admin/reviews/flagged       Flagged reviews, hidden ones first
+//	POST   /admin/reviews/:id/restore   Keep a review, dropping its flags
+//	DELETE /admin/reviews/:id           Remove a review
+func (rb *reviewBook) attachAdmin(group fiber.Router) {
+	group.Get("/reviews/flagged", rb.flagged)
+	group.Post("/reviews/:id/restore", rb.restore)
+	group.Delete("/reviews/:id", rb.remove)
+}
+
+func (rb *reviewBook) flagged(c *fiber.Ctx) error {
+	v, mu := rb.db.in(c).Current()
+	if mu != nil {
+		mu.RLock()
+	}
+	found := v.(reviewing).reviews().Reviews.Flagged()
+	if mu != nil {
+		mu.RUnlock()
+	}
+	return List(c, found)
+}
+
+func (rb *reviewBook) restore(c *fiber.Ctx) error {
+	v, mu := rb.db.in(c).Current()
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	r, err := v.(reviewing).reviews().Reviews.Restore(strings.Clone(c.Params("id")))
+	if err != nil {
+		return FailWith(c, fiber.StatusNotFound, err)
+	}
+	rerate(v, r.Target)
+	return c.JSON(r)
+}
+
+func (rb *reviewBook) remove(c *fiber.Ctx) error {
+	v, mu := rb.db.in(c).Current()
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	book := v.(reviewing).reviews().Reviews
+	id := c.Params("id")
+	r, ok := book[id]
+	if !ok {
+		return FailWith(c, fiber.StatusNotFound, reviews.ErrNotFound)
+	}
+	delete(book, id)
+	rerate(v, r.Target)
+	return c.SendStatus(fiber.StatusNoContent)
+}
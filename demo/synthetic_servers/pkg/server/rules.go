@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rulesFlag is a set of named business rules, like
+// free_shipping_minimum=25,surge_hours=16-20,22-3. A piece without a name
+// goes on the value before it, so a rule's value may be a list.
+type rulesFlag map[string]string
+
+func (f rulesFlag) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + f[name]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f rulesFlag) Set(s string) error {
+	var last string
+	for _, piece := range strings.Split(s, ",") {
+		piece = strings.TrimSpace(piece)
+		if piece == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(piece, "=")
+		if !ok {
+			if last == "" {
+				return fmt.Errorf("%q: want name=value, like free_shipping_minimum=25", piece)
+			}
+			f[last] += "," + piece
+			continue
+		}
+		last = strings.TrimSpace(name)
+		f[last] = strings.TrimSpace(value)
+	}
+	return nil
+}
+
+// Rule returns the configured value of the named business rule, a number
+// such as a delivery radius or a free shipping minimum, or the server's
+// own, def, if none was.
+func (cfg Config) Rule(name string, def float64) float64 {
+	s, ok := cfg.Rules[name]
+	if !ok {
+		return def
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		log.Fatalf("--rules %s: want a number, like %s=%g", name, name, def)
+	}
+	return v
+}
+
+// RuleDuration returns the configured value of the named business rule, a
+// duration such as a cancellation window, or the server's own, def, if
+// none was.
+func (cfg Config) RuleDuration(name string, def time.Duration) time.Duration {
+	s, ok := cfg.Rules[name]
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		log.Fatalf("--rules %s: want a duration, like %s=%s", name, name, def)
+	}
+	return d
+}
+
+// RuleHours returns the configured value of the named business rule, the
+// hours of the day something applies in, such as surge pricing, or the
+// server's own, def, if none was. Both are given as ParseHours takes them.
+func (cfg Config) RuleHours(name string, def string) Hours {
+	s, ok := cfg.Rules[name]
+	if !ok {
+		s = def
+	}
+	h, err := ParseHours(s)
+	if err != nil {
+		log.Fatalf("--rules %s: %v", name, err)
+	}
+	return h
+}
+
+// Hours are the hours of the day, 0 to 23, something applies in.
+type Hours [24]bool
+
+// ParseHours parses comma-separated ranges of hours, each from its first
+// hour up to its last, which wraps past midnight if it is the smaller:
+// 16-20,22-3 is from 4 to 8pm and from 10pm to 3am. A single hour, like 9,
+// is that hour alone, and an empty string none.
+func ParseHours(s string) (Hours, error) {
+	var h Hours
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(r, "-")
+		if !isRange {
+			to = strconv.Itoa(parseHour(from) + 1)
+		}
+		start, end := parseHour(from), parseHour(to)
+		if start < 0 || start > 23 || end < 0 || end > 24 || start == end {
+			return Hours{}, fmt.Errorf("%q: want ranges of hours from 0 to 24, like 16-20,22-3", r)
+		}
+		for hour := start; ; {
+			h[hour] = true
+			if hour = (hour + 1) % 24; hour == end%24 {
+				break
+			}
+		}
+	}
+	return h, nil
+}
+
+// atoi parses an hour, or returns -1 if s isn't one.
+func parseHour(s string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// Contain reports whether t, in its own time zone, falls in h.
+func (h Hours) Contain(t time.Time) bool {
+	return h[t.Hour()]
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HeaderSandboxID runs a request in a sandbox, made at /admin/sandboxes,
+// instead of against the live database.
+const HeaderSandboxID = "X-Sandbox-ID"
+
+const (
+	// sandboxTTL is how long a sandbox lasts unused, unless it is made
+	// with a TTL of its own.
+	sandboxTTL = time.Hour
+	// maxSandboxTTL caps a sandbox's TTL.
+	maxSandboxTTL = 24 * time.Hour
+	// sandboxSweepInterval is how often expired sandboxes are discarded.
+	sandboxSweepInterval = time.Minute
+)
+
+// localsSandbox is the Fiber local holding a request's *sandbox.
+const localsSandbox = "sandbox"
+
+// sandboxIDPattern is what IDs callers may give their sandboxes.
+var sandboxIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// sandboxes give parallel callers, such as agent evaluations sharing a
+// server, databases of their own. Each sandbox has its own Database,
+// loaded by the server as it loads the live one, from the live database,
+// the seed or a snapshot, with its own journal, which its ETags, ownership
+// and search follow, its own locks and its own Idempotency-Keys. A request
+// with an X-Sandbox-ID header runs against it: handlers reach it through
+// Ref.In, and the scaffolding through Database.in. Requests in different
+// sandboxes, and in the live database, don't wait for each other, and
+// sandboxed changes aren't persisted, streamed as events, sent to webhooks
+// or kept as activity. Logins and tokens are shared with the live
+// database. A sandbox unused for its TTL is discarded.
+type sandboxes struct {
+	db          Database
+	ownership   *ownership // The live database's, if it has one
+	source      func(ctx context.Context, from string) ([]byte, error)
+	idempotency *idempotency
+
+	mu     sync.Mutex
+	boxes  map[string]*sandbox
+	nextID int
+}
+
+// sandbox is one caller's database.
+type sandbox struct {
+	ID        string    `json:"id"`
+	From      string    `json:"from"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	TTL       string    `json:"ttl"`
+	seq       int
+	ttl       time.Duration
+
+	db        Database     // Its own, whose journal its indexes follow
+	using     sync.RWMutex // As live is for the live database
+	writing   sync.Mutex   // As writing is for the live database
+	versions  *versions
+	ownership *ownership
+	search    *searchIndex
+
+	mu    sync.Mutex
+	state any           // *T, for the server's Database type T
+	lock  *sync.RWMutex // state's
+}
+
+func newSandboxes(db Database, owners *ownership) *sandboxes {
+	s := &sandboxes{db: db, ownership: owners, boxes: make(map[string]*sandbox)}
+	go func() {
+		ticker := time.NewTicker(sandboxSweepInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.sweep(now)
+		}
+	}()
+	return s
+}
+
+// hold runs the request holding the lock of the database it runs against
+// for reading: its sandbox's, which must exist, or live. The operations of
+// an atomic batch run under the batch's hold.
+func (s *sandboxes) hold(c *fiber.Ctx) error {
+	if batched(c) {
+		// The batch holds the lock for writing already, and has put the
+		// request in its sandbox.
+		return c.Next()
+	}
+	lock := &live
+	if id := c.Get(HeaderSandboxID); id != "" {
+		sb := s.use(id)
+		if sb == nil {
+			return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("%s: no sandbox %q", HeaderSandboxID, id))
+		}
+		c.Locals(localsSandbox, sb)
+		lock = &sb.using
+	}
+	if err := RLock(c.UserContext(), lock); err != nil {
+		return err
+	}
+	defer lock.RUnlock()
+	return c.Next()
+}
+
+// sandboxOf returns the sandbox a request runs in, if any.
+func sandboxOf(c *fiber.Ctx) *sandbox {
+	sb, _ := c.Locals(localsSandbox).(*sandbox)
+	return sb
+}
+
+// current is the sandbox's database's Current.
+func (sb *sandbox) current() (any, *sync.RWMutex) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.state, sb.lock
+}
+
+// load is the sandbox's database's Load: the server loads store as it
+// loads the live database, but for the sandbox.
+func (s *sandboxes) load(sb *sandbox, store Store) error {
+	state, lock, err := s.open(store)
+	if err != nil {
+		return err
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.state, sb.lock = state, lock
+	return nil
+}
+
+// open has the server load a database from store as it loads the live
+// one, so it is wired up like it, with the clock and indexes the server
+// gives it, and returns it, and its lock, without making it live.
+func (s *sandboxes) open(store Store) (any, *sync.RWMutex, error) {
+	box := &sandboxStore{Store: store}
+	err := s.db.Load(box)
+	if box.v != nil {
+		sandboxLoads.Delete(box.v)
+	}
+	switch {
+	case err != nil:
+		return nil, nil, err
+	case box.v == nil:
+		return nil, nil, fmt.Errorf("the server doesn't load its database with server.Load")
+	}
+	v, mu := s.db.Current()
+	return box.v, lockOf(box.v, v, mu), nil
+}
+
+// sandboxLoads holds the databases loaded for sandboxes, which Ref.Set
+// leaves alone, until it is handed them.
+var sandboxLoads sync.Map // *T -> struct{}
+
+// sandboxStore is the store a sandbox's database is loaded from: Load
+// notes the database it decodes into, so it goes to the sandbox instead of
+// the server's Ref.
+type sandboxStore struct {
+	Store
+	v any
+}
+
+func (s *sandboxStore) Save([]byte) error { return nil }
+
+// claim marks v, which Load decoded the store into, as the sandbox's.
+func (s *sandboxStore) claim(v any) {
+	s.v = v
+	sandboxLoads.Store(v, struct{}{})
+}
+
+// lockOf returns the lock of v, a database of the same type as live: the
+// field of v where mu, live's lock, is in live.
+func lockOf(v, live any, mu *sync.RWMutex) *sync.RWMutex {
+	if mu == nil {
+		return nil
+	}
+	at := reflect.ValueOf(mu).Pointer()
+	a, b := reflect.ValueOf(live).Elem(), reflect.ValueOf(v).Elem()
+	for i := range a.NumField() {
+		if a.Field(i).Addr().Pointer() == at {
+			return (*sync.RWMutex)(b.Field(i).Addr().UnsafePointer())
+		}
+	}
+	return nil
+}
+
+// use returns the sandbox with id, if there is one that hasn't expired,
+// and puts off its expiry.
+func (s *sandboxes) use(id string) *sandbox {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sb := s.boxes[id]
+	now := time.Now()
+	switch {
+	case sb == nil:
+		return nil
+	case now.After(sb.ExpiresAt):
+		delete(s.boxes, id)
+		return nil
+	}
+	sb.ExpiresAt = now.Add(sb.ttl)
+	return sb
+}
+
+// sweep discards the sandboxes expired by now.
+func (s *sandboxes) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sb := range s.boxes {
+		if now.After(sb.ExpiresAt) {
+			delete(s.boxes, id)
+			s.forget(id)
+		}
+	}
+}
+
+// attachAdmin mounts the sandbox admin endpoints on the admin group:
+//
+//	POST   /admin/sandboxes      Make a sandbox
+//	GET    /admin/sandboxes      List sandboxes, oldest first
+//	DELETE /admin/sandboxes/:id  Discard a sandbox
+func (s *sandboxes) attachAdmin(group fiber.Router) {
+	group.Post("/sandboxes", s.create)
+	group.Get("/sandboxes", s.list)
+	group.Delete("/sandboxes/:id", s.delete)
+}
+
+// create makes a sandbox. Every field is optional: the ID defaults to a
+// fresh one, the TTL to sandboxTTL, and the database to a copy of the live
+// one; "seed" starts it from the seed, and a snapshot ID from the snapshot.
+//
+//	POST /admin/sandboxes {"id": "eval-17", "ttl": "30m", "from": "seed"}
+func (s *sandboxes) create(c *fiber.Ctx) error {
+	var req struct {
+		ID   string `json:"id"`
+		TTL  string `json:"ttl"`
+		From string `json:"from"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+		}
+	}
+	if req.ID != "" && !sandboxIDPattern.MatchString(req.ID) {
+		return fiber.NewError(fiber.StatusBadRequest, "id must be 1 to 64 letters, digits, dots, dashes or underscores")
+	}
+	ttl := sandboxTTL
+	if req.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 || ttl > maxSandboxTTL {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("ttl must be a duration up to %s, like 30m", maxSandboxTTL))
+		}
+	}
+	if req.From == "" {
+		req.From = "live"
+	}
+
+	data, err := s.source(c.UserContext(), req.From)
+	if err != nil {
+		return err
+	}
+	state, lock, err := s.open(snapshotStore(data))
+	if err != nil {
+		return fmt.Errorf("loading the sandbox's database: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	if req.ID == "" {
+		req.ID = fmt.Sprintf("sandbox_%d", s.nextID)
+	}
+	if _, ok := s.boxes[req.ID]; ok {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("sandbox %q already exists", req.ID))
+	}
+	now := time.Now()
+	sb := &sandbox{
+		ID:        req.ID,
+		From:      req.From,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		TTL:       ttl.String(),
+		seq:       s.nextID,
+		ttl:       ttl,
+		state:     state,
+		lock:      lock,
+	}
+	sb.db = Database{
+		Current: sb.current,
+		Load:    func(store Store) error { return s.load(sb, store) },
+		Private: s.db.Private,
+		Search:  s.db.Search,
+		journal: newJournal(&sb.writing),
+	}
+	sb.db.bind()
+	sb.versions = newVersions(sb.db.journal)
+	if s.ownership != nil {
+		sb.ownership = newOwnership(sb.db.journal, s.db.Private)
+	}
+	if len(s.db.Search) > 0 {
+		sb.search = newSearchIndex(sb.db.journal, s.db.Search, s.db.Private)
+	}
+	s.boxes[sb.ID] = sb
+	Logger(c).Info("Sandbox created", "sandbox", sb.ID, "from", sb.From, "ttl", sb.TTL)
+	return c.Status(fiber.StatusCreated).JSON(sb)
+}
+
+func (s *sandboxes) list(c *fiber.Ctx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	boxes := make([]*sandbox, 0, len(s.boxes))
+	for _, sb := range s.boxes {
+		boxes = append(boxes, sb)
+	}
+	sort.Slice(boxes, func(i, j int) bool {
+		return boxes[i].seq < boxes[j].seq
+	})
+	return c.JSON(boxes)
+}
+
+func (s *sandboxes) delete(c *fiber.Ctx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := c.Params("id")
+	if _, ok := s.boxes[id]; !ok {
+		return fiber.NewError(fiber.StatusNotFound, "sandbox not found")
+	}
+	delete(s.boxes, id)
+	s.forget(id)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// forget drops what was kept for a discarded sandbox, so a sandbox made
+// again with its ID starts afresh.
+func (s *sandboxes) forget(id string) {
+	if s.idempotency != nil {
+		s.idempotency.clear(id)
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"pkg/search"
+)
+
+// Paging limits for search, per type of result.
+const (
+	DefaultSearchLimit = 10
+	MaxSearchLimit     = 100
+)
+
+// titleFields name the fields an entity is best known by, whose words
+// count for more in search.
+var titleFields = map[string]bool{
+	"name": true, "title": true, "display_name": true, "full_name": true, "username": true,
+	"brand": true, "make": true, "model": true, "artist": true, "author": true,
+}
+
+// secretFields hold what no one should find an entity by.
+var secretFields = []string{"password", "token", "secret", "hash", "ssn", "card_number", "cvv", "account_number", "routing_number"}
+
+// SearchGroup is the results of one type of search, the entities of one
+// collection, best first.
+type SearchGroup struct {
+	Type  string            `json:"type"`  // The collection, such as products
+	Total int               `json:"total"` // Matching entities of the type, across pages
+	Data  []json.RawMessage `json:"data"`  // As the collection's own endpoints serve them
+}
+
+// searchDoc is an entity in the index.
+type searchDoc struct {
+	collection string
+	owner      string
+	entity     json.RawMessage
+}
+
+// searcher serves a search across a database's main collections, those
+// its Search lists, from one index of their entities' text. The index
+// follows the database's journal, so it keeps up with every change, resets
+// included.
+type searcher struct {
+	events      *events
+	collections []string
+	live        *searchIndex
+}
+
+// searchIndex indexes the text of the entities of one database's main
+// collections: the live one's or a sandbox's.
+type searchIndex struct {
+	collections []string
+	private     map[string]bool
+
+	mu    sync.RWMutex
+	index *search.Index
+	docs  map[string]searchDoc // By collection and key, as the index knows them
+}
+
+func newSearcher(db Database, e *events) *searcher {
+	for _, name := range db.Search {
+		if !db.journal.bound(name) {
+			log.Printf("Search: %s is not a collection", name)
+		}
+	}
+	return &searcher{events: e, collections: db.Search, live: newSearchIndex(db.journal, db.Search, db.Private)}
+}
+
+func (s *searcher) attach(app *fiber.App) {
+	app.Get("/api/v1/search", s.search)
+}
+
+// newSearchIndex indexes the main collections, those named, of the
+// database j journals, and keeps the index up to date. Entities in private
+// collections belong to their private owner.
+func newSearchIndex(j *journal, collections, private []string) *searchIndex {
+	x := &searchIndex{collections: collections, private: make(map[string]bool), index: search.New(), docs: make(map[string]searchDoc)}
+	for _, name := range private {
+		x.private[name] = true
+	}
+	j.follow(x.observe)
+	return x
+}
+
+// observe keeps the index up to date with a change.
+func (x *searchIndex) observe(ch change) {
+	if !slices.Contains(x.collections, ch.Collection) {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if ch.After == nil {
+		id := ch.Collection + "/" + ch.Key
+		x.index.Remove(id)
+		delete(x.docs, id)
+		return
+	}
+	indexEntity(x.index, x.docs, ch.Collection, ch.Key, ch.After, x.private[ch.Collection])
+}
+
+// indexEntity adds the entity at key in collection, which may be private,
+// to index, or takes it out if it is soft-deleted.
+func indexEntity(index *search.Index, docs map[string]searchDoc, collection, key string, raw json.RawMessage, private bool) {
+	id := collection + "/" + key
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var entity map[string]any
+	if dec.Decode(&entity) != nil || entity["deleted_at"] != nil {
+		index.Remove(id)
+		delete(docs, id)
+		return
+	}
+	var fields []search.Field
+	for name, v := range entity {
+		weight := 1.0
+		if titleFields[name] {
+			weight = 2
+		}
+		fields = appendText(fields, name, v, weight)
+	}
+	index.Add(id, fields...)
+	owner := entityOwner(entity)
+	if private {
+		owner = privateOwner(key, entity)
+	}
+	docs[id] = searchDoc{collection: collection, owner: owner, entity: raw}
+}
+
+// appendText appends the text of the value of the field name, and of any
+// values nested in it, to fields. Owners' emails, times and secrets are
+// left out.
+func appendText(fields []search.Field, name string, v any, weight float64) []search.Field {
+	if slices.Contains(ownerFields, name) {
+		return fields
+	}
+	for _, secret := range secretFields {
+		if strings.Contains(name, secret) {
+			return fields
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		if _, err := time.Parse(time.RFC3339, v); err == nil || v == "" {
+			return fields
+		}
+		return append(fields, search.Field{Text: v, Weight: weight})
+	case map[string]any:
+		for k, e := range v {
+			fields = appendText(fields, k, e, 1)
+		}
+	case []any:
+		for _, e := range v {
+			fields = appendText(fields, name, e, weight)
+		}
+	}
+	return fields
+}
+
+// search responds with the entities of the main collections matching a
+// query, grouped by type in the order the server lists them:
+//
+//	GET /api/v1/search?q=wireless+headphones&type=products,orders&limit=5
+//
+//	{"query": "wireless headphones", "total": 4, "groups": [
+//	  {"type": "products", "total": 3, "data": [...]},
+//	  {"type": "orders", "total": 1, "data": [...]}]}
+//
+// type keeps the given collections, and limit is how many of each to
+// respond with, DefaultSearchLimit unless it says otherwise. Entities that
+// belong to a user, or that are in private collections, are only found by
+// their owner and admins, as events are.
+func (s *searcher) search(c *fiber.Ctx) error {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		return Fail(c, fiber.StatusBadRequest, CodeValidationFailed, "q is required")
+	}
+	limit, err := queryInt(c, "limit", DefaultSearchLimit, 1, MaxSearchLimit)
+	if err != nil {
+		return err
+	}
+	types := s.collections
+	if t := c.Query("type"); t != "" {
+		types = strings.Split(strings.ToLower(t), ",")
+		for _, name := range types {
+			if !slices.Contains(s.collections, name) {
+				return Fail(c, fiber.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("type must be among %s", strings.Join(s.collections, ", ")))
+			}
+		}
+	}
+
+	x := s.live
+	if sb := sandboxOf(c); sb != nil {
+		x = sb.search
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	user := c.Query("email")
+	role, _ := c.Locals(localsRole).(string)
+	required, _ := c.Locals(localsRequired).(bool)
+	groups := make(map[string]*SearchGroup)
+	total := 0
+	for _, r := range x.index.Search(q) {
+		doc := x.docs[r.ID]
+		if !slices.Contains(types, doc.collection) || !s.events.visible(Event{Collection: doc.collection, Owner: doc.owner}, user, role, required) {
+			continue
+		}
+		g := groups[doc.collection]
+		if g == nil {
+			g = &SearchGroup{Type: doc.collection, Data: []json.RawMessage{}}
+			groups[doc.collection] = g
+		}
+		g.Total++
+		total++
+		if len(g.Data) < limit {
+			g.Data = append(g.Data, doc.entity)
+		}
+	}
+
+	found := []SearchGroup{}
+	for _, name := range s.collections {
+		if g := groups[name]; g != nil {
+			found = append(found, *g)
+		}
+	}
+	return c.JSON(fiber.Map{"query": q, "total": total, "groups": found})
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// putEntity puts an entity into a collection, replacing the one with its
+// key if there is one, so tests can set up the state they need without
+// going through the API:
+//
+//	PUT /admin/entities/orders/ord_42 {"id": "ord_42", "status": "pending", ...}
+//	PUT /admin/entities/auth.tokens/tok_test "casey.wringer@email.com"
+//
+// The collection is a top-level field of the database, or a dotted path to
+// one nested in another. In a map the key is the entity's key; in a list,
+// its "id". The entity is loaded as the server's types have it, so fields
+// they lack are dropped; the response is the entity as stored.
+func (a *admin) putEntity(c *fiber.Ctx) error {
+	if !json.Valid(c.Body()) {
+		return fiber.NewError(fiber.StatusBadRequest, "the body must be the entity as JSON")
+	}
+	created := false
+	stored, err := a.editEntity(c, c.Params("key"), func(collection json.RawMessage, key string) (json.RawMessage, error) {
+		out, isNew, err := setEntity(collection, key, c.Body())
+		created = isNew
+		return out, err
+	})
+	if err != nil {
+		return err
+	}
+	Logger(c).Info("Entity seeded", "collection", c.Params("collection"), "key", c.Params("key"))
+	if created {
+		c.Status(fiber.StatusCreated)
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(stored)
+}
+
+// deleteEntity removes an entity from a collection:
+//
+//	DELETE /admin/entities/orders/ord_42
+func (a *admin) deleteEntity(c *fiber.Ctx) error {
+	_, err := a.editEntity(c, c.Params("key"), func(collection json.RawMessage, key string) (json.RawMessage, error) {
+		return removeEntity(collection, key)
+	})
+	if err != nil {
+		return err
+	}
+	Logger(c).Info("Entity removed", "collection", c.Params("collection"), "key", c.Params("key"))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// listCollections responds with the database's collections, leaving out
+// auth, and how many entities each holds:
+//
+//	GET /admin/entities
+//
+//	{"collections": {"orders": 12, "products": 40, ...}}
+func (a *admin) listCollections(c *fiber.Ctx) error {
+	data, err := a.db.encode(c.UserContext())
+	if err != nil {
+		return err
+	}
+	counts, err := countEntities(data)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"collections": counts})
+}
+
+// adminEntity is an entity in a collection, under its key.
+type adminEntity struct {
+	Key    string          `json:"key"`
+	Entity json.RawMessage `json:"entity"`
+}
+
+// listEntities responds with a page of a collection's entities, as List
+// does, in a list's order or by key:
+//
+//	GET /admin/entities/products?limit=20
+//
+//	{"data": [{"key": "prod_1", "entity": {"id": "prod_1", ...}}, ...],
+//	 "total": 40, "limit": 20, "offset": 0}
+func (a *admin) listEntities(c *fiber.Ctx) error {
+	collection, err := a.collection(c)
+	if err != nil {
+		return err
+	}
+	var items []adminEntity
+	if list, ok := collectionList(collection); ok {
+		for i, item := range list {
+			key := itemID(item)
+			if key == "" {
+				key = strconv.Itoa(i)
+			}
+			items = append(items, adminEntity{Key: key, Entity: item})
+		}
+		return List(c, items)
+	}
+	byKey, ok := entities(collection)
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest, "not a collection")
+	}
+	for key, entity := range byKey {
+		items = append(items, adminEntity{Key: key, Entity: entity})
+	}
+	slices.SortFunc(items, func(a, b adminEntity) int { return strings.Compare(a.Key, b.Key) })
+	return List(c, items)
+}
+
+// getEntity responds with an entity as stored:
+//
+//	GET /admin/entities/products/prod_1
+func (a *admin) getEntity(c *fiber.Ctx) error {
+	collection, err := a.collection(c)
+	if err != nil {
+		return err
+	}
+	byKey, ok := entities(collection)
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest, "not a collection")
+	}
+	entity, ok := byKey[c.Params("key")]
+	if !ok {
+		return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("no entity %q", c.Params("key")))
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(entity)
+}
+
+// createEntity adds an entity to a collection under its "id", which is
+// made for it, as the server makes IDs, if it has none. An entity that is
+// already there is left alone with 409 CONFLICT; PUT replaces one.
+//
+//	POST /admin/entities/products {"name": "Desk lamp", "price": 34.99, ...}
+//
+//	201 {"id": "PRODUCT-1001", "name": "Desk lamp", ...}
+func (a *admin) createEntity(c *fiber.Ctx) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &fields); err != nil || fields == nil {
+		return fiber.NewError(fiber.StatusBadRequest, "the body must be the entity as a JSON object")
+	}
+	key := itemID(c.Body())
+	if key == "" {
+		key = NewID(idKind(c.Params("collection")))
+		fields["id"], _ = json.Marshal(key)
+	}
+	entity, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	stored, err := a.editEntity(c, key, func(collection json.RawMessage, key string) (json.RawMessage, error) {
+		if byKey, ok := entities(collection); ok {
+			if _, exists := byKey[key]; exists {
+				return nil, NewError(CodeConflict, fmt.Sprintf("entity %q already exists; PUT it to replace it", key))
+			}
+		}
+		out, _, err := setEntity(collection, key, entity)
+		return out, err
+	})
+	if err != nil {
+		return err
+	}
+	Logger(c).Info("Entity created", "collection", c.Params("collection"), "key", key)
+	c.Location("/admin/entities/" + c.Params("collection") + "/" + url.PathEscape(key))
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(fiber.StatusCreated).Send(stored)
+}
+
+// patchEntity changes some of an entity's fields, as a JSON merge patch
+// (RFC 7386) does: the fields the body has replace the entity's, objects
+// merging field by field, and those it sets to null are removed.
+//
+//	PATCH /admin/entities/flights/UA1234 {"status": "delayed", "gate": null}
+//
+// Its "id" can't change, since the entity is kept under it; put the entity
+// under its new key and delete the old one instead.
+func (a *admin) patchEntity(c *fiber.Ctx) error {
+	patch, err := decodeNumbers(c.Body())
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "the body must be a JSON merge patch")
+	}
+	stored, err := a.editEntity(c, c.Params("key"), func(collection json.RawMessage, key string) (json.RawMessage, error) {
+		byKey, ok := entities(collection)
+		if !ok {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "not a collection")
+		}
+		current, ok := byKey[key]
+		if !ok {
+			return nil, fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("no entity %q", key))
+		}
+		doc, err := decodeNumbers(current)
+		if err != nil {
+			return nil, err
+		}
+		patched, err := json.Marshal(mergePatch(doc, patch))
+		if err != nil {
+			return nil, err
+		}
+		if itemID(patched) != itemID(current) {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "id can't be changed")
+		}
+		out, _, err := setEntity(collection, key, patched)
+		return out, err
+	})
+	if err != nil {
+		return err
+	}
+	Logger(c).Info("Entity patched", "collection", c.Params("collection"), "key", c.Params("key"))
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(stored)
+}
+
+// collection returns the collection the request's path names, as stored.
+func (a *admin) collection(c *fiber.Ctx) (json.RawMessage, error) {
+	data, err := a.db.encode(c.UserContext())
+	if err != nil {
+		return nil, err
+	}
+	var found json.RawMessage
+	_, err = editPath(data, strings.Split(c.Params("collection"), "."), func(collection json.RawMessage) (json.RawMessage, error) {
+		found = collection
+		return collection, nil
+	})
+	return found, err
+}
+
+// editEntity applies edit to the collection in the request's path and
+// key, reloads the database with the result, and returns the entity as
+// stored.
+func (a *admin) editEntity(c *fiber.Ctx, key string, edit func(collection json.RawMessage, key string) (json.RawMessage, error)) (json.RawMessage, error) {
+	path := strings.Split(c.Params("collection"), ".")
+
+	data, err := a.db.encode(c.UserContext())
+	if err != nil {
+		return nil, err
+	}
+	edited, err := editPath(data, path, func(collection json.RawMessage) (json.RawMessage, error) {
+		return edit(collection, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := a.reload(c, data, edited); err != nil {
+		return nil, err
+	}
+
+	data, err = a.db.encode(c.UserContext())
+	if err != nil {
+		return nil, err
+	}
+	var stored json.RawMessage
+	_, err = editPath(data, path, func(collection json.RawMessage) (json.RawMessage, error) {
+		byKey, _ := entities(collection)
+		stored = byKey[key]
+		return collection, nil
+	})
+	return stored, err
+}
+
+// reload replaces the database, encoded as before, with edited. If the
+// server can't load it, the database is put back.
+func (a *admin) reload(c *fiber.Ctx, before, edited []byte) error {
+	if err := a.db.replace(c.UserContext(), snapshotStore(edited)); err != nil {
+		if restoreErr := a.db.replace(c.UserContext(), snapshotStore(before)); restoreErr != nil {
+			return restoreErr
+		}
+		return fiber.NewError(fiber.StatusBadRequest, "the entity doesn't fit the collection: "+err.Error())
+	}
+	if a.lifecycles != nil {
+		a.lifecycles.restart(false)
+	}
+	return nil
+}
+
+// editPath applies edit to the field at a dotted path in a JSON object.
+func editPath(data json.RawMessage, path []string, edit func(json.RawMessage) (json.RawMessage, error)) (json.RawMessage, error) {
+	if len(path) == 0 {
+		return edit(data)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("no collection %q", path[0]))
+	}
+	field, ok := fields[path[0]]
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("no collection %q", path[0]))
+	}
+	edited, err := editPath(field, path[1:], edit)
+	if err != nil {
+		return nil, err
+	}
+	fields[path[0]] = edited
+	return json.Marshal(fields)
+}
+
+// setEntity puts an entity into a collection under key, reporting whether
+// it is new.
+func setEntity(collection json.RawMessage, key string, entity json.RawMessage) (json.RawMessage, bool, error) {
+	if list, ok := collectionList(collection); ok {
+		for i, item := range list {
+			if itemID(item) == key {
+				list[i] = entity
+				out, err := json.Marshal(list)
+				return out, false, err
+			}
+		}
+		out, err := json.Marshal(append(list, entity))
+		return out, true, err
+	}
+
+	byKey, ok := entities(collection)
+	if !ok {
+		return nil, false, fiber.NewError(fiber.StatusBadRequest, "not a collection")
+	}
+	if byKey == nil {
+		byKey = make(map[string]json.RawMessage)
+	}
+	_, existed := byKey[key]
+	byKey[key] = entity
+	out, err := json.Marshal(byKey)
+	return out, !existed, err
+}
+
+// removeEntity removes the entity under key from a collection.
+func removeEntity(collection json.RawMessage, key string) (json.RawMessage, error) {
+	notFound := fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("no entity %q", key))
+	if list, ok := collectionList(collection); ok {
+		for i, item := range list {
+			if itemID(item) == key {
+				return json.Marshal(append(list[:i], list[i+1:]...))
+			}
+		}
+		return nil, notFound
+	}
+	byKey, ok := entities(collection)
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "not a collection")
+	}
+	if _, ok := byKey[key]; !ok {
+		return nil, notFound
+	}
+	delete(byKey, key)
+	return json.Marshal(byKey)
+}
+
+// collectionList returns a collection's items if it is a list.
+func collectionList(collection json.RawMessage) ([]json.RawMessage, bool) {
+	var list []json.RawMessage
+	if !bytes.HasPrefix(bytes.TrimSpace(collection), []byte("[")) || json.Unmarshal(collection, &list) != nil {
+		return nil, false
+	}
+	return list, true
+}
+
+// itemID returns a list item's "id", as entities keys it.
+func itemID(item json.RawMessage) string {
+	var entity struct {
+		ID any `json:"id"`
+	}
+	if json.Unmarshal(item, &entity) != nil || entity.ID == nil {
+		return ""
+	}
+	b, err := json.Marshal(entity.ID)
+	if err != nil {
+		return ""
+	}
+	return string(bytes.Trim(b, `"`))
+}
+
+// mergePatch applies patch to doc as a JSON merge patch: an object merges
+// into an object field by field, a null field removes the field, and
+// anything else replaces what it patches.
+func mergePatch(doc, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	target, ok := doc.(map[string]any)
+	if !ok {
+		target = make(map[string]any, len(fields))
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(target, name)
+			continue
+		}
+		target[name] = mergePatch(target[name], value)
+	}
+	return target
+}
+
+// idKind is the kind of ID NewID makes for a collection's entities, its
+// name in capitals without a plural s, like PRODUCT for catalog.products.
+func idKind(collection string) string {
+	name := collection[strings.LastIndex(collection, ".")+1:]
+	return strings.ToUpper(strings.TrimSuffix(name, "s"))
+}
@@ -0,0 +1,583 @@
+// Package server holds the scaffolding shared by the synthetic API servers:
+// command-line config, the Fiber app with its standard middleware, and
+// storing the database. A server only defines its models, handlers and
+// routes:
+//
+//	func main() {
+//		cfg := server.ParseFlags()
+//		store, err := server.OpenStore(cfg)
+//		if err != nil {
+//			log.Fatal(err)
+//		}
+//
+//		if err := loadDatabase(store); err != nil {
+//			log.Fatal(err)
+//		}
+//
+//		app := server.New(
+//			server.WithDatabase(cfg, store, server.Database{
+//				Current: func() (any, *sync.RWMutex) { return db, &db.mu },
+//				Load:    loadDatabase,
+//			}),
+//			server.WithSpec(cfg),
+//			server.WithRateLimit(cfg),
+//		)
+//		setupRoutes(app)
+//
+//		if err := server.Listen(app, cfg); err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/money"
+	"pkg/statemachine"
+)
+
+// Config is the command-line configuration every server accepts.
+type Config struct {
+	Port        string
+	PortFile    string // File to write the port listened on to, once listening; none if empty
+	AnyPort     bool   // Listen on a free port if Port is taken, as the default port may be
+	DataFile    string // Seed database
+	Fixture     string // Named seed beside DataFile to start from, such as small for database.small.json; DataFile itself if empty
+	Store       string // Storage backend, StoreMemory, StoreJSON or StoreBolt
+	StorePath   string // Where the backend keeps the database; the seed without its extension, as a directory for StoreJSON or with .db for StoreBolt, if empty
+	AdminToken  string // Guards the admin endpoints, which are off if empty
+	Auth        bool   // Identify users by bearer token rather than by email
+	SpecFile    string // OpenAPI spec served at / and /openapi.json
+	Validate    string // Check responses against the spec: ValidateOff, ValidateLog or ValidateFail
+	RateLimit   string // Requests each caller may make, like 120/m,/api/v1/auth=10/m; unlimited if empty
+	Lifecycles  bool   // Move entities through their lifecycles as time passes
+	Archive     string // File to archive finished entities to, with Retention; a temporary one if empty
+	CheckData   bool   // Refuse to start from a database with missing fields, unknown enum values or dangling references
+	WatchSeed   bool   // Reload the database when its seed file changes
+	WatchPolicy string // How to reload it: WatchReplace or WatchMerge
+	ReadOnly    bool   // Refuse requests that would change the database
+	Profile     string // Variant of its API the server serves, of those WithProfiles names; ProfileDefault if empty
+	Chaos       string // Disruptions to simulate and their rates, like payment_declined=0.1; none if empty
+	ChaosSeed   uint64 // Seeds the chaos dice
+	Latency     string // Delay for every response, like 200ms or 100ms-2s; none if empty
+	GRPCPort    string // Port to serve the API over gRPC on as well; off if empty
+	GraphQL     bool   // Serve the API over GraphQL at /graphql as well
+	Record      string // Session file to record API requests and responses to; off if empty
+	Replay      string // Session file to answer API requests from instead of running them; off if empty
+	AuditLog    string // File to append every change to the database to, as JSON lines; in memory only if empty
+	Inspect     int    // Requests to keep for /debug/requests; off if 0
+	CompressMin int    // Size in bytes from which responses are compressed; off if 0
+	MaxBodySize int    // Largest request body to take, in bytes
+	Blobs       string // Directory to keep uploaded and generated files in, with WithFiles; a temporary one if empty
+	MaxUpload   int    // Largest file to take in an upload, in bytes
+	IDs         string // How new entities' IDs are made: IDsRandom or IDsSequential
+	IDSeed      int    // Sequential IDs are numbered from
+
+	RequestTimeout time.Duration // How long a request may take before it gets 504; no limit if 0
+	Retention      time.Duration // How long entities stay in memory once finished, before they are archived; for ever if 0
+
+	V1Deprecated string // Date, or RFC 3339 time, v1 was deprecated on; not deprecated if empty
+	V1Sunset     string // Date, or RFC 3339 time, v1 is retired on; never if empty
+
+	Tax         *float64           // Sales tax rate; each server's own if nil, see TaxRate
+	Fees        map[string]float64 // Fees by name, overriding the servers' own; see Fee
+	Rules       map[string]string  // Business rules by name, overriding the servers' own; see Rule
+	CORSOrigins string             // Comma-separated origins browsers may call from; any if "*"
+	TLSCert     string             // Certificate to serve HTTPS with; plain HTTP if empty
+	TLSKey      string             // The certificate's private key
+	TLSClientCA string             // CAs whose client certificates are required, for mutual TLS; off if empty
+	ConfigFile  string             // YAML file of settings, which flags and the environment override
+	ServiceName string             // Picks the config file's per-server settings
+}
+
+// defaultPort is the port servers run on unless told otherwise.
+const defaultPort = "3000"
+
+// ParseFlags registers the standard flags and parses the command line, and
+// switches logging to JSON. Servers with flags of their own register them
+// before calling it. Flags not on the command line are taken from their
+// environment variables, such as PORT or RATE_LIMIT, and then from the
+// --config file, which can set a server's own flags too; see applyConfig.
+func ParseFlags() Config {
+	setupLogging()
+
+	cfg := Config{Fees: make(map[string]float64), Rules: make(map[string]string)}
+	flag.StringVar(&cfg.Port, "port", defaultPort, "Port to run the server on; 0 for any free one, which it logs and writes to --port-file. If the default is taken, it runs on a free one instead")
+	flag.StringVar(&cfg.PortFile, "port-file", "", "File to write the port the server listens on to, once it does, for whatever started it to read (default: none)")
+	flag.StringVar(&cfg.DataFile, "database", "database.json", "Path to the seed database, found in the server's directory if it isn't in the working one (default: $DATABASE_PATH, or database.json)")
+	flag.StringVar(&cfg.DataFile, "data", "database.json", "Same as --database")
+	flag.StringVar(&cfg.Fixture, "fixture", "", "Named seed beside the --database file to start from, e.g. small for database.small.json (default: $FIXTURE, or the --database file itself)")
+	flag.StringVar(&cfg.Store, "store", StoreMemory, "Storage backend: memory, json or bolt")
+	flag.StringVar(&cfg.StorePath, "store-path", "", "Where the storage backend keeps the database (default: the --database file without its extension, as a directory for json or with .db for bolt)")
+	flag.StringVar(&cfg.AdminToken, "admin-token", "", "Token for the admin endpoints, which are disabled without one (default: $ADMIN_TOKEN)")
+	flag.BoolVar(&cfg.Auth, "auth", true, "Require bearer tokens on user-scoped requests; with --auth=false the email parameter is trusted")
+	flag.StringVar(&cfg.SpecFile, "spec", "openapi.json", "OpenAPI spec to serve at / and /openapi.json, found in the server's directory if it isn't in the working one")
+	flag.StringVar(&cfg.Validate, "validate-responses", ValidateOff, "Check every response against the OpenAPI spec, for tests: off, log, or fail with a 500")
+	flag.StringVar(&cfg.RateLimit, "rate-limit", "", "Requests each caller may make, per s, m or h, overall or under a route prefix, e.g. 120/m,/api/v1/auth=10/m (default: unlimited)")
+	flag.BoolVar(&cfg.CheckData, "check-database", true, "Check the database at startup for missing required fields, values outside their enums and references to entities that don't exist, and refuse to start if it has any")
+	flag.BoolVar(&cfg.WatchSeed, "watch-seed", false, "Reload the database when the seed file, or the fixture loaded, changes on disk, for iterating on fixtures")
+	flag.StringVar(&cfg.WatchPolicy, "watch-policy", WatchReplace, "How --watch-seed reloads the database: replace, discarding the changes made since, or merge, applying the seed's changes to it")
+	flag.BoolVar(&cfg.ReadOnly, "read-only", false, "Refuse every request that could change the database, any but GET, HEAD and OPTIONS outside the admin endpoints, with 403 READ_ONLY")
+	flag.StringVar(&cfg.Profile, "profile", ProfileDefault, "Variant of its API to serve, for servers with more than one, such as v2 for Uber's, Lyft's and MyFitnessPal's older APIs; it starts from the variant's own seed and spec, like database.v2.json, if there is one")
+	flag.BoolVar(&cfg.Lifecycles, "lifecycles", true, "Move entities such as orders and rides through their statuses as time passes; with --lifecycles=false they only change on request")
+	flag.DurationVar(&cfg.Retention, "retention", 0, "Archive entities such as orders and rides once they have been delivered, completed or cancelled this long on the server's clock, e.g. 72h, taking them out of memory; 0 keeps them (default)")
+	flag.StringVar(&cfg.Archive, "archive", "", "File to append the entities --retention archives to, as JSON lines (default: a new temporary file)")
+	flag.StringVar(&cfg.Chaos, "chaos", "", "Domain disruptions to simulate and how often, from 0 to 1, e.g. payment_declined=0.1,out_of_stock=0.05 (default: none)")
+	flag.Uint64Var(&cfg.ChaosSeed, "chaos-seed", 1, "Seed for chaos mode, so runs disrupt the same requests")
+	flag.StringVar(&cfg.Latency, "latency", "", "Delay every API response by a duration, or a random one in a range, e.g. 200ms or 100ms-2s (default: none)")
+	flag.StringVar(&cfg.GRPCPort, "grpc-port", "", "Port to serve the API over gRPC on as well, as described by its OpenAPI spec (default: off)")
+	flag.BoolVar(&cfg.GraphQL, "graphql", true, "Serve the API over GraphQL at /graphql as well, as described by its OpenAPI spec")
+	flag.StringVar(&cfg.Record, "record", "", "Record every API request and its response to this session file, as JSON lines (default: off)")
+	flag.IntVar(&cfg.Inspect, "debug-requests", 0, "Keep this many of the latest API requests, with their bodies, responses and changes to the database, to inspect at /debug/requests (default: off)")
+	flag.IntVar(&cfg.CompressMin, "compress-min-size", DefaultCompressMin, "Compress responses of this many bytes or more with brotli or gzip, as the client accepts; 0 turns compression off")
+	flag.IntVar(&cfg.MaxBodySize, "max-body-size", DefaultMaxBodySize, "Largest request body to take, in bytes; larger ones are refused with 413")
+	flag.StringVar(&cfg.Blobs, "blobs", "", "Directory to keep uploaded files and generated documents in, by their content's SHA-256, for servers that take or make them; set it for them to outlive the server (default: a new temporary directory)")
+	flag.IntVar(&cfg.MaxUpload, "max-upload-size", DefaultMaxUploadSize, "Largest file to take in an upload, in bytes; larger ones are refused with 413")
+	flag.DurationVar(&cfg.RequestTimeout, "request-timeout", DefaultRequestTimeout, "How long a request may take before it is given up on with 504; 0 for no limit. Admin requests have none")
+	flag.StringVar(&cfg.IDs, "ids", IDsRandom, "How to make new entities' IDs: random, as UUIDs, or sequential, as readable IDs numbered from --id-seed, like ORD-1001")
+	flag.IntVar(&cfg.IDSeed, "id-seed", 1000, "Number sequential IDs of each kind go on from, so the first order is ORD-1001")
+	flag.StringVar(&cfg.AuditLog, "audit-log", "", "Append every change to the database to this file, as JSON lines, before it is saved (default: kept in memory only)")
+	flag.StringVar(&cfg.V1Deprecated, "v1-deprecated", "", "Mark /api/v1 deprecated as of this date, YYYY-MM-DD or RFC 3339, with a Deprecation header on its responses (default: not deprecated)")
+	flag.StringVar(&cfg.V1Sunset, "v1-sunset", "", "Retire /api/v1 on this date, YYYY-MM-DD or RFC 3339: its responses carry a Sunset header until then, and it answers 410 Gone after (default: never)")
+	flag.StringVar(&cfg.Replay, "replay", "", "Answer API requests with the responses recorded in this session file instead of running them (default: off)")
+	flag.Var(taxRateFlag{&cfg.Tax}, "tax-rate", "Sales tax rate for servers that charge it, e.g. 0.0825 (default: each server's own)")
+	flag.Var(feesFlag(cfg.Fees), "fees", "Fees to charge instead of the server's own, by name, e.g. delivery=3.99,wire_domestic=25")
+	flag.Var(rulesFlag(cfg.Rules), "rules", "Business rules to follow instead of the server's own, by name, e.g. free_shipping_minimum=50,surge_hours=7-10,16-20")
+	flag.StringVar(&cfg.CORSOrigins, "cors-origins", "*", "Comma-separated origins browsers may call the API from, or * for any")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "PEM certificate to serve HTTPS, and gRPC, with (default: plain HTTP)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "PEM private key of the --tls-cert certificate")
+	flag.StringVar(&cfg.TLSClientCA, "tls-client-ca", "", "PEM CAs to require client certificates from, for mutual TLS (default: none required)")
+	flag.StringVar(&cfg.ConfigFile, "config", os.Getenv("SERVER_CONFIG"), "YAML file of settings by flag name, with per-server ones under servers.<service> (default: $SERVER_CONFIG)")
+	flag.StringVar(&cfg.ServiceName, "service-name", defaultServiceName(), "The service's name in the config file")
+	persist := flag.Bool("persist", false, "Keep changes in a directory beside the database file; shorthand for --store json")
+	flag.Parse()
+	if err := applyConfig(flag.CommandLine, cfg.ConfigFile, cfg.ServiceName); err != nil {
+		log.Fatal(err)
+	}
+	cfg.AnyPort = true
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "port" { // Given, so wanted
+			cfg.AnyPort = false
+		}
+	})
+	// The caller is the server's main, in its directory.
+	_, main, _, _ := runtime.Caller(1)
+	cfg.DataFile = resolvePath(cfg.DataFile, filepath.Dir(main))
+	if cfg.Fixture == "" && profileFile(cfg.DataFile, cfg.Profile) != cfg.DataFile {
+		cfg.Fixture = cfg.Profile
+	}
+	if err := checkFixture(cfg.DataFile, cfg.Fixture); err != nil {
+		log.Fatalf("--fixture: %v", err)
+	}
+	cfg.SpecFile = profileFile(resolvePath(cfg.SpecFile, filepath.Dir(main)), cfg.Profile)
+
+	if *persist && cfg.Store == StoreMemory {
+		cfg.Store = StoreJSON
+	}
+	return cfg
+}
+
+type options struct {
+	allowHeaders []string
+	persister    *persister
+	admin        *admin
+	auth         *authenticator
+	ownership    *ownership
+	versions     *versions
+	spec         []byte
+	specTitle    string // For the spec made from the routes, without one
+	validator    *validator
+	rateLimits   []rateLimit
+	db           *Database
+	events       *events
+	webhooks     *webhooks
+	activity     *activity
+	audit        *audit
+	inspector    *inspector
+	inbox        *notifications
+	charges      *charges
+	promos       *promos
+	reviews      *reviewBook
+	chats        *chats
+	search       *searcher
+	files        *files
+	lifecycles   []Lifecycle
+	retention    *retention
+	latency      *latency
+	sandboxes    *sandboxes
+	grpcPort     string
+	grpcTLS      *tls.Config
+	graphQL      bool
+	recorder     *recorder
+	replayer     *replayer
+	corsOrigins  string
+	compressMin  int
+	bodyLimit    int
+	timeout      time.Duration
+	apiVersions  *apiVersions
+	links        []Links
+	checkData    Store // The database's store, if it is to be checked at startup
+	watcher      *seedWatcher
+	readOnly     bool
+	profile      string
+	profiles     []string // Besides the default
+}
+
+// Option customizes the app built by New.
+type Option func(*options)
+
+// WithAllowHeaders lets browsers send extra request headers, beyond the
+// standard ones, through CORS.
+func WithAllowHeaders(headers ...string) Option {
+	return func(o *options) {
+		o.allowHeaders = append(o.allowHeaders, headers...)
+	}
+}
+
+// DefaultMaxBodySize is the largest request body servers take unless
+// cfg.MaxBodySize says otherwise.
+const DefaultMaxBodySize = 1 << 20
+
+// WithBodyLimit refuses request bodies larger than cfg.MaxBodySize with
+// 413 PAYLOAD_TOO_LARGE.
+func WithBodyLimit(cfg Config) Option {
+	return func(o *options) {
+		o.bodyLimit = cfg.MaxBodySize
+	}
+}
+
+// WithCORS lets browsers call the API only from cfg.CORSOrigins, rather
+// than from anywhere.
+func WithCORS(cfg Config) Option {
+	return func(o *options) {
+		o.corsOrigins = cfg.CORSOrigins
+	}
+}
+
+// New builds a Fiber app that reports errors as JSON and logs requests, with
+// their X-Request-ID, as JSON, recovers from panics, serves Prometheus
+// metrics at /metrics, allows cross-origin calls and replays responses to
+// POST requests retried with the same Idempotency-Key.
+func New(opts ...Option) *fiber.App {
+	o := options{corsOrigins: "*", compressMin: DefaultCompressMin, bodyLimit: DefaultMaxBodySize, timeout: DefaultRequestTimeout, allowHeaders: []string{"Origin", "Content-Type", "Accept", "Authorization", "If-Match", "If-None-Match", "If-Modified-Since", HeaderIdempotencyKey, HeaderRequestID, HeaderTraceparent, HeaderSimulateLatency, HeaderSandboxID}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := useProfile(o.profile, o.profiles); err != nil {
+		log.Fatal(err)
+	}
+	if o.db != nil && o.checkData != nil {
+		v, _ := o.db.Current()
+		if err := checkDatabase(v, o.spec); err != nil {
+			log.Fatalf("%v: %v\nFix it, or start with --check-database=false to run anyway", o.checkData, err)
+		}
+	}
+
+	bodyLimit := o.bodyLimit
+	if o.files != nil {
+		bodyLimit = max(bodyLimit, o.files.bodyLimit())
+	}
+	// Handlers keep path parameters and other request strings in the
+	// database, so they mustn't alias buffers fiber reuses.
+	app := fiber.New(fiber.Config{
+		ErrorHandler:          ErrorHandler,
+		DisableStartupMessage: true,
+		BodyLimit:             bodyLimit,
+		Immutable:             true,
+	})
+	app.Use(logRequests)
+	if o.compressMin > 0 {
+		app.Use(compress(o.compressMin))
+	}
+	if o.inspector != nil {
+		o.inspector.attach(app)
+	}
+	app.Use(recover.New())
+	if t := traces(); t != nil {
+		t.attach(app)
+	}
+	m := newMetrics(o.db)
+	m.attach(app)
+	if o.admin != nil {
+		o.admin.metrics = m
+	}
+	attachHealth(app)
+	app.Use(limitRequests(o.timeout))
+	if o.files != nil {
+		app.Use(o.files.limitBodies(o.bodyLimit))
+	}
+	app.Use(cors.New(cors.Config{
+		AllowOrigins:  o.corsOrigins,
+		AllowMethods:  "GET,POST,PUT,PATCH,DELETE",
+		AllowHeaders:  strings.Join(o.allowHeaders, ", "),
+		ExposeHeaders: strings.Join([]string{fiber.HeaderETag, fiber.HeaderLastModified, HeaderIdempotentReplayed, HeaderRequestID, fiber.HeaderRetryAfter, HeaderDeprecation, HeaderSunset, fiber.HeaderLink, "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"}, ", "),
+	}))
+	if o.apiVersions != nil {
+		o.apiVersions.attach(app)
+	}
+	if len(o.links) > 0 && o.spec != nil {
+		l, err := newLinker(o.spec, o.links)
+		if err != nil {
+			log.Fatal(err)
+		}
+		l.attach(app)
+	}
+	newRouteCatalog(o.spec).attach(app)
+	if o.readOnly {
+		app.Use(readOnly)
+	}
+	if o.recorder != nil {
+		o.recorder.attach(app)
+	}
+	if o.replayer != nil {
+		o.replayer.attach(app)
+		if o.admin != nil {
+			o.admin.replayer = o.replayer
+		}
+	}
+	if o.graphQL && o.spec != nil {
+		attachGraphQL(app, o.spec)
+	}
+	if o.db != nil {
+		attachBatch(app, *o.db, o.sandboxes)
+	}
+	if o.latency != nil {
+		o.latency.attach(app)
+		if o.admin != nil {
+			o.admin.latency = o.latency
+		}
+	}
+	if o.admin != nil {
+		// Faults go outside validation, which would flag them.
+		o.admin.faults.attach(app)
+	}
+	if o.sandboxes != nil {
+		// Everything from here on runs holding the lock of the database
+		// it runs against, live or its sandbox's.
+		app.Use(o.sandboxes.hold)
+		if o.admin != nil {
+			o.admin.sandboxes = o.sandboxes
+			o.sandboxes.source = o.admin.sandboxSource
+		}
+	}
+	if o.db != nil {
+		// Requests that may change the database run one at a time from
+		// here on, so their changes are credited to them.
+		app.Use(o.db.journal.hold)
+	}
+	if o.validator != nil {
+		o.validator.attach(app)
+	}
+	if o.spec != nil {
+		serveSpec(app, o.spec)
+	} else {
+		serveRouteSpec(app, o.specTitle)
+	}
+	if o.persister != nil {
+		o.persister.attach(app)
+	}
+	var engine *lifecycleEngine
+	if o.db != nil && len(o.lifecycles) > 0 {
+		engine = newLifecycleEngine(*o.db, o.events, o.lifecycles)
+		engine.start()
+		if o.admin != nil {
+			o.admin.lifecycles = engine
+		}
+	}
+	if o.db != nil && o.retention != nil {
+		o.retention.db = *o.db
+		o.retention.start(app)
+		if o.admin != nil {
+			o.admin.archive = o.retention
+		}
+	}
+	if o.watcher != nil {
+		w := o.watcher
+		w.admin, w.lifecycles, w.persister = o.admin, engine, o.persister
+		if o.checkData != nil {
+			w.spec = o.spec
+		}
+		w.start()
+	}
+	if o.admin != nil {
+		o.admin.attach(app)
+	}
+	if o.auth != nil {
+		o.auth.attach(app)
+	}
+	// Limits count authenticated users by their identity, and cover signing
+	// in.
+	attachRateLimits(app, o.rateLimits)
+	if o.auth != nil {
+		o.auth.routes(app)
+	}
+	if o.db != nil {
+		app.Use(o.db.journal.credit)
+	}
+	if o.events != nil {
+		o.events.attach(app)
+	}
+	if o.webhooks != nil {
+		o.webhooks.attach(app)
+	}
+	if o.activity != nil {
+		o.activity.attach(app)
+	}
+	if o.audit != nil {
+		o.audit.attach(app)
+	}
+	if o.ownership != nil {
+		o.ownership.attach(app)
+	}
+	replays := newIdempotency()
+	replays.attach(app)
+	if o.admin != nil {
+		o.admin.replays = replays
+	}
+	if o.sandboxes != nil {
+		o.sandboxes.idempotency = replays
+	}
+	if o.versions != nil {
+		o.versions.attach(app)
+	}
+	if o.inbox != nil {
+		o.inbox.attach(app)
+	}
+	if o.charges != nil {
+		o.charges.attach(app)
+	}
+	if o.promos != nil {
+		o.promos.attach(app)
+	}
+	if o.reviews != nil {
+		o.reviews.attach(app)
+	}
+	if o.chats != nil {
+		o.chats.attach(app)
+	}
+	if o.search != nil {
+		o.search.attach(app)
+	}
+	if o.files != nil {
+		o.files.attach(app)
+	}
+	if o.grpcPort != "" {
+		if o.spec == nil {
+			log.Fatal("gRPC: the API is described by the OpenAPI spec, and there is none")
+		}
+		attachGRPC(app, o.spec, o.grpcPort, o.grpcTLS)
+	}
+	return app
+}
+
+// ErrorHandler responds to an error returned by a handler in the error
+// envelope, as Fail does. An *Error is answered with its code's status, a
+// *fiber.Error with its own and anything else with 500. A
+// *ValidationError is a 422 VALIDATION_FAILED that lists the failing
+// fields as its details, a *statemachine.Error a 409 INVALID_TRANSITION,
+// and money.ErrMixedCurrencies, amounts of different currencies added or
+// compared, or money.ErrOutOfRange, an amount too large to keep, a 422
+// VALIDATION_FAILED.
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return sendError(c, fiber.StatusUnprocessableEntity, &Error{
+			Code:    CodeValidationFailed,
+			Message: "Validation failed",
+			Details: ve.Errors,
+		})
+	}
+	var coded *Error
+	if errors.As(err, &coded) {
+		return FailWith(c, coded.status(), err)
+	}
+	var move *statemachine.Error
+	if errors.As(err, &move) {
+		return FailWith(c, fiber.StatusConflict, err)
+	}
+	if errors.Is(err, money.ErrMixedCurrencies) || errors.Is(err, money.ErrOutOfRange) {
+		return Fail(c, fiber.StatusUnprocessableEntity, CodeValidationFailed, err.Error())
+	}
+
+	status := fiber.StatusInternalServerError
+	var e *fiber.Error
+	if errors.As(err, &e) {
+		status = e.Code
+	}
+	return Fail(c, status, "", err.Error())
+}
+
+// Listen serves app on cfg.Port until it stops, over HTTPS if cfg has a
+// certificate. Port 0, or a taken port with cfg.AnyPort, has it listen on
+// any free port, which it logs and writes to cfg.PortFile. An interrupt or
+// SIGTERM shuts the server down gracefully: /readyz starts failing,
+// requests in flight get shutdownTimeout to finish, and the shutdown hooks
+// run before Listen returns.
+func Listen(app *fiber.App, cfg Config) error {
+	tlsCfg, err := tlsConfig(cfg)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil && cfg.AnyPort && errors.Is(err, syscall.EADDRINUSE) {
+		log.Printf("Port %s is taken; listening on a free one", cfg.Port)
+		ln, err = net.Listen("tcp", ":0")
+	}
+	if err != nil {
+		return err
+	}
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	if cfg.PortFile != "" {
+		if err := writeFileAtomic(cfg.PortFile, []byte(port+"\n")); err != nil {
+			ln.Close()
+			return fmt.Errorf("--port-file: %w", err)
+		}
+		defer os.Remove(cfg.PortFile)
+	}
+	ln = watchListener{ln}
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		startDraining()
+		log.Printf("Shutting down")
+		if err := app.ShutdownWithTimeout(shutdownTimeout); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+	}()
+
+	if tlsCfg == nil {
+		log.Printf("Server starting on port %s", port)
+	} else {
+		log.Printf("Server starting on port %s, over HTTPS", port)
+	}
+	if err := app.Listener(ln); err != nil {
+		return err
+	}
+	<-done
+	return nil
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SoftDelete lets an entity be deleted without being removed, so a
+// destructive request can be undone. Entities embed it, untagged:
+//
+//	type Job struct {
+//		ID string `json:"id"`
+//		...
+//		server.SoftDelete
+//	}
+//
+// A deleted entity keeps its place in the database, with the time it was
+// deleted as its deleted_at. List leaves it out, and handlers treat it as
+// gone; admins find it at /admin/deleted and put it back from there.
+type SoftDelete struct {
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Deleted reports whether the entity has been deleted.
+func (s SoftDelete) Deleted() bool { return s.DeletedAt != nil }
+
+// MarkDeleted deletes the entity as of the clock's time.
+func (s *SoftDelete) MarkDeleted() {
+	now := Now()
+	s.DeletedAt = &now
+}
+
+// deletable is an entity that embeds SoftDelete.
+type deletable interface {
+	Deleted() bool
+}
+
+// withoutDeleted returns the items that haven't been deleted, leaving
+// items as it is.
+func withoutDeleted[T any](items []T) []T {
+	kept := make([]T, 0, len(items))
+	for _, item := range items {
+		if d, ok := any(item).(deletable); ok && d.Deleted() {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+// DeletedEntity is an entity that was soft-deleted, as /admin/deleted
+// lists it.
+type DeletedEntity struct {
+	Path       string          `json:"path"`       // A JSON Pointer to it, such as /jobs/job_1
+	Collection string          `json:"collection"` // The top-level collection it is in
+	ID         string          `json:"id,omitempty"`
+	DeletedAt  time.Time       `json:"deleted_at"`
+	Entity     json.RawMessage `json:"entity"`
+}
+
+// listDeleted responds with the soft-deleted entities anywhere in the
+// database, most recently deleted first, as a page:
+//
+//	GET /admin/deleted?collection=jobs
+func (a *admin) listDeleted(c *fiber.Ctx) error {
+	doc, err := a.decodeDatabase(c)
+	if err != nil {
+		return err
+	}
+	found := []DeletedEntity{}
+	fields, _ := doc.(map[string]any)
+	for name, v := range fields {
+		if name != "auth" {
+			found = collectDeleted(v, "/"+escapePointer(name), name, found)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].DeletedAt.Equal(found[j].DeletedAt) {
+			return found[i].DeletedAt.After(found[j].DeletedAt)
+		}
+		return found[i].Path < found[j].Path
+	})
+	return List(c, found)
+}
+
+// collectDeleted appends the deleted entities in v, at path, to found. An
+// entity is an object with a deleted_at; what a deleted one holds isn't
+// looked into.
+func collectDeleted(v any, path, collection string, found []DeletedEntity) []DeletedEntity {
+	switch v := v.(type) {
+	case map[string]any:
+		if s, ok := v["deleted_at"].(string); ok {
+			at, err := time.Parse(time.RFC3339Nano, s)
+			if err == nil {
+				entity, _ := json.Marshal(v)
+				id, _ := v["id"].(string)
+				return append(found, DeletedEntity{Path: path, Collection: collection, ID: id, DeletedAt: at, Entity: entity})
+			}
+		}
+		for key, item := range v {
+			found = collectDeleted(item, path+"/"+escapePointer(key), collection, found)
+		}
+	case []any:
+		for i, item := range v {
+			found = collectDeleted(item, path+"/"+strconv.Itoa(i), collection, found)
+		}
+	}
+	return found
+}
+
+// restoreDeleted undeletes the soft-deleted entity at a path /admin/deleted
+// listed, and responds with it:
+//
+//	POST /admin/deleted/restore {"path": "/jobs/job_1"}
+func (a *admin) restoreDeleted(c *fiber.Ctx) error {
+	var req struct {
+		Path string `json:"path" validate:"required"`
+	}
+	if err := Bind(c, &req); err != nil {
+		return err
+	}
+	data, err := a.db.encode(c.UserContext())
+	if err != nil {
+		return err
+	}
+	doc, err := decodeNumbers(data)
+	if err != nil {
+		return err
+	}
+	entity, ok := resolvePointer(doc, req.Path).(map[string]any)
+	if !ok || entity["deleted_at"] == nil || strings.HasPrefix(req.Path, "/auth/") {
+		return Fail(c, fiber.StatusNotFound, CodeNotFound, fmt.Sprintf("no deleted entity at %q", req.Path))
+	}
+	delete(entity, "deleted_at")
+	edited, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := a.reload(c, data, edited); err != nil {
+		return err
+	}
+
+	doc, err = a.decodeDatabase(c)
+	if err != nil {
+		return err
+	}
+	Logger(c).Info("Entity restored", "path", req.Path)
+	return c.JSON(resolvePointer(doc, req.Path))
+}
+
+// decodeDatabase decodes the database as generic JSON, keeping its numbers
+// as they are.
+func (a *admin) decodeDatabase(c *fiber.Ctx) (any, error) {
+	data, err := a.db.encode(c.UserContext())
+	if err != nil {
+		return nil, err
+	}
+	return decodeNumbers(data)
+}
+
+func decodeNumbers(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// resolvePointer returns the value at a JSON Pointer in doc, or nil if
+// there is none.
+func resolvePointer(doc any, pointer string) any {
+	if pointer == "" {
+		return doc
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil
+	}
+	v := doc
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[token]
+		case []any:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
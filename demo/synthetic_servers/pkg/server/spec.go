@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// WithSpec serves the OpenAPI spec in cfg.SpecFile, as generated by
+// pkg/cmd/openapi, at GET / and GET /openapi.json, and checks responses
+// against it as cfg.Validate says. A server without a spec serves a
+// minimal one made from its routes instead, and checks nothing.
+func WithSpec(cfg Config) Option {
+	return func(o *options) {
+		path := cfg.SpecFile
+		if data, err := filepath.Abs(cfg.DataFile); err == nil {
+			o.specTitle = filepath.Base(filepath.Dir(data)) // The server's directory
+		}
+		spec, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("No OpenAPI spec at %s; serving one made from the routes. Run go generate to create the full one", path)
+			return
+		}
+		if err != nil {
+			log.Fatalf("Reading OpenAPI spec: %v", err)
+		}
+		if !json.Valid(spec) {
+			log.Fatalf("Reading OpenAPI spec: %s is not valid JSON", path)
+		}
+		o.spec = spec
+
+		switch cfg.Validate {
+		case ValidateOff:
+		case ValidateLog, ValidateFail:
+			v, err := newValidator(spec, cfg.Validate)
+			if err != nil {
+				log.Fatal(err)
+			}
+			o.validator = v
+		default:
+			log.Fatalf("Unknown --validate-responses mode %q", cfg.Validate)
+		}
+	}
+}
+
+func serveSpec(app *fiber.App, spec []byte) {
+	handler := func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+		return c.Send(spec)
+	}
+	app.Get("/", handler)
+	app.Get("/openapi.json", handler)
+}
+
+// serveRouteSpec serves, for a server without a spec, a minimal one made
+// from its routes at GET / and GET /openapi.json: the API's paths, with
+// their methods and path parameters, but none of their schemas. It is
+// made at the first request, by which the routes are all registered.
+func serveRouteSpec(app *fiber.App, title string) {
+	var (
+		once sync.Once
+		spec []byte
+	)
+	handler := func(c *fiber.Ctx) error {
+		once.Do(func() {
+			spec, _ = json.Marshal(routeSpec(c.App().GetRoutes(true), title))
+		})
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+		return c.Send(spec)
+	}
+	app.Get("/", handler)
+	app.Get("/openapi.json", handler)
+}
+
+// routeSpec returns an OpenAPI spec of the routes, leaving out the
+// scaffolding's, which generated specs don't describe either.
+func routeSpec(routes []fiber.Route, title string) fiber.Map {
+	paths := make(map[string]fiber.Map)
+	for _, r := range routes {
+		if !slices.Contains(catalogMethods, r.Method) {
+			continue
+		}
+		path := strings.TrimSuffix(specPath(r.Path), "/") // As routed in groups
+		if path == "" || path == "/api/routes" || isScaffold(path) {
+			continue
+		}
+		op := fiber.Map{
+			"responses": fiber.Map{"default": fiber.Map{"description": "The response, or an error"}},
+		}
+		if params := pathParams(path); len(params) > 0 {
+			op["parameters"] = params
+		}
+		if paths[path] == nil {
+			paths[path] = fiber.Map{}
+		}
+		paths[path][strings.ToLower(r.Method)] = op
+	}
+	return fiber.Map{
+		"openapi": "3.0.0",
+		"info": fiber.Map{
+			"title":       title,
+			"version":     "1.0.0",
+			"description": "Made from the server's routes, as it has no spec; run go generate for the full one",
+		},
+		"paths": paths,
+	}
+}
+
+func isScaffold(path string) bool {
+	for _, r := range scaffoldRoutes {
+		if strings.HasPrefix(path, r.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathParams returns the parameters of a path in its OpenAPI form, in the
+// order they appear in it.
+func pathParams(path string) []fiber.Map {
+	var params []fiber.Map
+	for _, seg := range strings.Split(path, "/") {
+		if name, ok := strings.CutPrefix(seg, "{"); ok {
+			params = append(params, fiber.Map{
+				"name":     strings.TrimSuffix(name, "}"),
+				"in":       "path",
+				"required": true,
+				"schema":   fiber.Map{"type": "string"},
+			})
+		}
+	}
+	return params
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store backends selectable with --store.
+const (
+	StoreMemory = "memory" // Seed only; changes are lost on restart
+	StoreJSON   = "json"   // A directory at --store-path, with a JSON file per entity
+	StoreBolt   = "bolt"   // A bbolt file at --store-path, with an entry per entity
+)
+
+// Store is where a server's database lives between runs. A store hands the
+// database over as one encoded JSON document, so a server's models double
+// as its storage schema; the json and bolt backends keep it entity by
+// entity, as entityStores.
+type Store interface {
+	// Load returns the database: the stored one, or the seed if the store
+	// is still empty, in which case the seed is migrated into the store.
+	Load() ([]byte, error)
+	// Save replaces the stored database.
+	Save(data []byte) error
+	Close() error
+}
+
+// entityStore is a Store that keeps the database entity by entity: each
+// top-level object, such as a map of orders, as an entry per key, and each
+// other top-level value whole. Repositories write their changes through to
+// it as they make them (see journal), and the persister saves the rest of
+// the database field by field.
+type entityStore interface {
+	Store
+	// Put stores raw, an entity of collection, under key.
+	Put(collection, key string, raw json.RawMessage) error
+	// Delete removes the entity of collection with key, if there is one.
+	Delete(collection, key string) error
+	// SaveField replaces the top-level field name of the stored database
+	// with raw.
+	SaveField(name string, raw json.RawMessage) error
+}
+
+// OpenStore opens the backend selected by cfg.
+func OpenStore(cfg Config) (Store, error) {
+	switch cfg.Store {
+	case StoreMemory:
+		return memoryStore{seed: cfg.Seed()}, nil
+	case StoreJSON:
+		path := cfg.StorePath
+		if path == "" {
+			path = jsonPath(cfg.Seed())
+		}
+		if path == cfg.Seed() {
+			return nil, fmt.Errorf("--store-path %s: the json store is a directory; give it one of its own, not the seed", path)
+		}
+		return &jsonStore{dir: path, seed: cfg.Seed()}, nil
+	case StoreBolt:
+		path := cfg.StorePath
+		if path == "" {
+			path = boltPath(cfg.Seed())
+		}
+		return openBolt(path, cfg.Seed())
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
+
+// Load decodes the database in store into v. An error says where in the
+// JSON decoding it failed, by line and column, and for a value of the
+// wrong type, the field it is in. A database that embeds Books has the
+// accounts with no entries yet opened in them.
+func Load(store Store, v any) error {
+	data, err := store.Load()
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, v)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("%v:%s: %v", store, position(data, syntaxErr.Offset), err)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("%v:%s: %s: want %s, got %s", store, position(data, typeErr.Offset), typeErr.Field, typeErr.Type, typeErr.Value)
+	case err != nil:
+		return err
+	}
+	openBooks(v)
+	if box, ok := store.(*sandboxStore); ok {
+		box.claim(v)
+	}
+	return nil
+}
+
+// position returns the line and column of offset in data, like 12:5.
+func position(data []byte, offset int64) string {
+	before := data[:min(int(offset), len(data))]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("%d:%d", line, col)
+}
+
+// memoryStore keeps nothing: every run starts from the seed.
+type memoryStore struct {
+	seed string
+}
+
+func (s memoryStore) Load() ([]byte, error) { return os.ReadFile(s.seed) }
+func (memoryStore) Save([]byte) error       { return nil }
+func (memoryStore) Close() error            { return nil }
+func (s memoryStore) String() string        { return s.seed }
+
+// jsonStore keeps the database in a directory of JSON files: each
+// top-level object, such as a map of orders, in a directory of its own with
+// a file per key, and each other top-level value in a file of its own, as
+// orders/ord_1.json and plans.json. Names are escaped to name files.
+type jsonStore struct {
+	dir  string
+	seed string
+}
+
+// jsonPath is where the json backend keeps the database by default: next
+// to the seed, as the directory database for database.json.
+func jsonPath(seed string) string {
+	return strings.TrimSuffix(seed, filepath.Ext(seed))
+}
+
+// Load assembles the database from the files, or migrates the seed into
+// them if there are none yet.
+func (s *jsonStore) Load() ([]byte, error) {
+	fields, err := readJSONDir(s.dir, func(dir string) (json.RawMessage, error) {
+		entries, err := readJSONDir(dir, nil)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(entries)
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if len(fields) > 0 {
+		return json.Marshal(fields)
+	}
+
+	data, err := os.ReadFile(s.seed)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Save(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.seed, err)
+	}
+	log.Printf("Migrated %s into %s", s.seed, s.dir)
+	return data, nil
+}
+
+// readJSONDir reads the JSON files in dir by their unescaped names, and,
+// with sub, its directories too. Files starting with a dot, such as those
+// being written, are skipped.
+func readJSONDir(dir string, sub func(dir string) (json.RawMessage, error)) (map[string]json.RawMessage, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]json.RawMessage, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		var raw json.RawMessage
+		switch base, ok := strings.CutSuffix(name, ".json"); {
+		case e.IsDir() && sub != nil:
+			raw, err = sub(filepath.Join(dir, name))
+		case !e.IsDir() && ok:
+			name = base
+			raw, err = os.ReadFile(filepath.Join(dir, name+".json"))
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		key, err := url.PathUnescape(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, name), err)
+		}
+		found[key] = raw
+	}
+	return found, nil
+}
+
+// Save replaces the files with data's, writing only those that differ.
+func (s *jsonStore) Save(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	for name, raw := range fields {
+		if err := s.SaveField(name, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, _ := url.PathUnescape(strings.TrimSuffix(e.Name(), ".json"))
+		if _, ok := fields[name]; !ok && !strings.HasPrefix(e.Name(), ".") {
+			if err := os.RemoveAll(filepath.Join(s.dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SaveField writes a top-level object as a directory of its entries, and
+// any other value as a file, writing only what differs.
+func (s *jsonStore) SaveField(name string, raw json.RawMessage) error {
+	dir := filepath.Join(s.dir, escapeFileName(name))
+	var entries map[string]json.RawMessage
+	if raw[0] != '{' || json.Unmarshal(raw, &entries) != nil {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		return writeChanged(dir+".json", raw)
+	}
+	if err := os.Remove(dir + ".json"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for key, raw := range entries {
+		if err := writeChanged(filepath.Join(dir, escapeFileName(key)+".json"), raw); err != nil {
+			return err
+		}
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		key, _ := url.PathUnescape(strings.TrimSuffix(f.Name(), ".json"))
+		if _, ok := entries[key]; !ok && !strings.HasPrefix(f.Name(), ".") {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Put writes the entity's file.
+func (s *jsonStore) Put(collection, key string, raw json.RawMessage) error {
+	dir := filepath.Join(s.dir, escapeFileName(collection))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, escapeFileName(key)+".json"), raw)
+}
+
+// Delete removes the entity's file.
+func (s *jsonStore) Delete(collection, key string) error {
+	err := os.Remove(filepath.Join(s.dir, escapeFileName(collection), escapeFileName(key)+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *jsonStore) Close() error   { return nil }
+func (s *jsonStore) String() string { return s.dir }
+
+// escapeFileName escapes a key or field name to name a file with, so it
+// has no slashes and doesn't start with a dot.
+func escapeFileName(name string) string {
+	name = url.PathEscape(name)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+// writeChanged writes raw, compacted, to path unless it holds it already.
+func writeChanged(path string, raw json.RawMessage) error {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return err
+	}
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, compact.Bytes()) {
+		return nil
+	}
+	return writeFileAtomic(path, compact.Bytes())
+}
+
+// writeFileAtomic replaces path with data, so readers and crashes only
+// ever see the old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
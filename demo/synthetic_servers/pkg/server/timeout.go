@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// DefaultRequestTimeout is how long a request may take unless
+// cfg.RequestTimeout says otherwise.
+const DefaultRequestTimeout = 30 * time.Second
+
+// StatusClientClosedRequest is the status logged for a request whose client
+// hung up before it was answered, as nginx logs it.
+const StatusClientClosedRequest = 499
+
+// errClientGone is the cause of a request's context ending when its client
+// hangs up.
+var errClientGone = errors.New("client closed the connection")
+
+// WithRequestTimeout gives every request cfg.RequestTimeout to be answered,
+// or none with 0. Its context, c.UserContext(), ends at the deadline, or
+// as soon as the client hangs up, and the work it waits on, such as the
+// database's locks and simulated latency, gives up then: a request past
+// its deadline gets 504 TIMEOUT, and one whose client left is logged with
+// 499. Handlers that wait on anything else of their own take the context
+// along, and lock the database with Lock and RLock rather than its
+// mutex's methods:
+//
+//	if err := server.Lock(c.UserContext(), &db.mu); err != nil {
+//		return err
+//	}
+//	defer db.mu.Unlock()
+//
+// Admin requests have no deadline, but end when their client leaves too.
+func WithRequestTimeout(cfg Config) Option {
+	return func(o *options) {
+		o.timeout = cfg.RequestTimeout
+	}
+}
+
+// limitRequests returns middleware that gives each request a context that
+// ends after timeout, unless it is 0, or when its client hangs up.
+func limitRequests(timeout time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithCancelCause(c.UserContext())
+		defer cancel(nil)
+		if timeout > 0 && !strings.HasPrefix(c.Path(), "/admin/") {
+			var stop context.CancelFunc
+			ctx, stop = context.WithTimeout(ctx, timeout)
+			defer stop()
+		}
+		if conn := watchedConnOf(c); conn != nil {
+			conn.watch(func() { cancel(errClientGone) })
+		}
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+		switch {
+		case errors.Is(context.Cause(ctx), errClientGone):
+			Logger(c).Info("Client closed the connection")
+			return fiber.NewError(StatusClientClosedRequest, "Client closed request")
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return Fail(c, fiber.StatusGatewayTimeout, CodeTimeout, "The request took longer than "+timeout.String())
+		}
+		return err
+	}
+}
+
+// Lock locks mu for writing, unless ctx ends first, in which case it
+// returns ctx's error and mu stays unlocked.
+func Lock(ctx context.Context, mu *sync.RWMutex) error {
+	return acquire(ctx, mu.TryLock, mu.Lock, mu.Unlock)
+}
+
+// RLock locks mu for reading, unless ctx ends first, in which case it
+// returns ctx's error and mu stays unlocked.
+func RLock(ctx context.Context, mu *sync.RWMutex) error {
+	return acquire(ctx, mu.TryRLock, mu.RLock, mu.RUnlock)
+}
+
+// acquire takes a lock with lock, unless ctx ends first. A lock taken
+// after that is let go of again at once.
+func acquire(ctx context.Context, try func() bool, lock, unlock func()) error {
+	if try() {
+		return nil
+	}
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// sleep waits for d, unless ctx ends or the server starts shutting down
+// first, and returns ctx's error if it ended.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-draining:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// watchListener accepts connections that can tell when their client hangs
+// up while a request runs.
+type watchListener struct {
+	net.Listener
+}
+
+func (ln watchListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &watchedConn{Conn: conn}, nil
+}
+
+// watchedConn notices its client hanging up while a request runs, as
+// net/http does, by reading ahead from the connection until the server
+// reads the next request. A byte read ahead, from a request pipelined
+// behind the one running, ends the watch and is handed to the next Read.
+// Over HTTPS, only the connection closing shows; a TLS close_notify alert
+// counts as reading ahead. Only the goroutine serving the connection calls
+// watch and Read.
+type watchedConn struct {
+	net.Conn
+	ahead   []byte        // Read ahead, for the next Read
+	err     error         // What reading ahead ended with, for the next Read
+	reading chan struct{} // Closed when reading ahead stops; nil if not watching
+}
+
+// watch calls gone if the client hangs up before the next Read.
+func (c *watchedConn) watch(gone func()) {
+	if c.reading != nil || len(c.ahead) > 0 || c.err != nil {
+		return
+	}
+	reading := make(chan struct{})
+	c.reading = reading
+	go func() {
+		defer close(reading)
+		var b [1]byte
+		n, err := c.Conn.Read(b[:])
+		if n > 0 {
+			c.ahead = append(c.ahead, b[0])
+			return
+		}
+		if err == nil || isTimeout(err) { // Stopped by Read
+			return
+		}
+		c.err = err
+		gone()
+	}()
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	if c.reading != nil {
+		c.Conn.SetReadDeadline(time.Unix(1, 0)) // Unblocks reading ahead
+		<-c.reading
+		c.Conn.SetReadDeadline(time.Time{})
+		c.reading = nil
+	}
+	if len(c.ahead) > 0 {
+		n := copy(p, c.ahead)
+		c.ahead = c.ahead[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// watchedConnOf returns the connection a request came in on, if it can be
+// watched: not one of the in-process requests of batches and GraphQL.
+func watchedConnOf(c *fiber.Ctx) *watchedConn {
+	conn := c.Context().Conn()
+	if tc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tc.NetConn()
+	}
+	wc, _ := conn.(*watchedConn)
+	return wc
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Tracing follows the OpenTelemetry environment variables: spans are
+// exported over OTLP/HTTP as JSON to OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or
+// to /v1/traces under OTEL_EXPORTER_OTLP_ENDPOINT, with the headers in
+// OTEL_EXPORTER_OTLP_HEADERS. The service is named by OTEL_SERVICE_NAME,
+// by default after the directory the server runs in. Without an endpoint,
+// or with OTEL_SDK_DISABLED=true, nothing is traced.
+const (
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+	traceQueueSize     = 4096
+)
+
+// HeaderTraceparent carries the W3C trace context of a request.
+const HeaderTraceparent = "traceparent"
+
+// Span kinds, as OTLP numbers them.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// Span is one timed operation in a trace. The zero *Span, which StartSpan
+// returns when tracing is off, does nothing.
+type Span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	kind     int
+	start    time.Time
+
+	mu     sync.Mutex
+	name   string
+	attrs  map[string]any
+	err    string
+	failed bool
+	ended  bool
+}
+
+type spanKey struct{}
+
+// StartSpan starts a span named name as a child of the one in ctx, which
+// for handlers is c.UserContext(), and returns a context holding it. End
+// the span when the operation is done:
+//
+//	ctx, span := server.StartSpan(c.UserContext(), "charge card")
+//	defer span.End()
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent, _ := ctx.Value(spanKey{}).(*Span)
+	t := traces()
+	if t == nil || parent != nil && !parent.sampled {
+		return ctx, nil
+	}
+	span := t.newSpan(name, spanKindInternal, parent)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute records a string, integer, float or boolean attribute.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed with err, if it isn't nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed, s.err = true, err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.mu.Unlock()
+	s.tracer.export(s, time.Now())
+}
+
+// tracer batches finished spans and exports them over OTLP/HTTP.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	resource []any // OTLP attributes
+	client   *http.Client
+
+	mu    sync.Mutex
+	queue []any // OTLP spans
+	kick  chan struct{}
+	done  chan struct{}
+}
+
+var (
+	tracerOnce   sync.Once
+	activeTracer *tracer
+)
+
+// traces returns the tracer the environment configures, or nil if tracing
+// is off.
+func traces() *tracer {
+	tracerOnce.Do(func() {
+		activeTracer = newTracerFromEnv()
+	})
+	return activeTracer
+}
+
+func newTracerFromEnv() *tracer {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"} {
+		if p := os.Getenv(name); p != "" && p != "http/json" {
+			log.Printf("Tracing: %s=%s is not supported; exporting OTLP as http/json", name, p)
+			break
+		}
+	}
+
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	resource := envPairs("OTEL_RESOURCE_ATTRIBUTES")
+	if service == "" {
+		service = resource["service.name"]
+	}
+	if service == "" {
+		if dir, err := os.Getwd(); err == nil {
+			service = filepath.Base(dir)
+		}
+	}
+	resource["service.name"] = service
+
+	headers := envPairs("OTEL_EXPORTER_OTLP_HEADERS")
+	for k, v := range envPairs("OTEL_EXPORTER_OTLP_TRACES_HEADERS") {
+		headers[k] = v
+	}
+
+	attrs := make(map[string]any, len(resource))
+	for k, v := range resource {
+		attrs[k] = v
+	}
+	t := &tracer{
+		endpoint: endpoint,
+		headers:  headers,
+		resource: otlpAttributes(attrs),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		kick:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	log.Printf("Tracing to %s as %s", endpoint, service)
+	return t
+}
+
+// envPairs parses an environment variable of comma-separated key=value
+// pairs, with URL-encoded values.
+func envPairs(name string) map[string]string {
+	pairs := make(map[string]string)
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		if u, err := url.QueryUnescape(strings.TrimSpace(v)); err == nil {
+			v = u
+		}
+		pairs[strings.TrimSpace(k)] = v
+	}
+	return pairs
+}
+
+func (t *tracer) newSpan(name string, kind int, parent *Span) *Span {
+	s := &Span{tracer: t, name: name, kind: kind, sampled: true, start: time.Now(), attrs: make(map[string]any)}
+	if parent != nil {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		putUint64(s.traceID[:8], rand.Uint64())
+		putUint64(s.traceID[8:], rand.Uint64())
+	}
+	putUint64(s.spanID[:], rand.Uint64())
+	return s
+}
+
+func putUint64(b []byte, n uint64) {
+	for i := range b {
+		b[i] = byte(n >> (8 * (len(b) - 1 - i)))
+	}
+}
+
+// parseTraceparent reads the remote parent of a request from its
+// traceparent header, returning nil if it has none or it is malformed.
+func parseTraceparent(header string) *Span {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil
+	}
+	var s Span
+	flags, err := hex.DecodeString(parts[3])
+	if _, err1 := hex.Decode(s.traceID[:], []byte(parts[1])); err1 != nil || err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil
+	}
+	if s.traceID == [16]byte{} || s.spanID == [8]byte{} {
+		return nil
+	}
+	s.sampled = flags[0]&1 == 1
+	return &s
+}
+
+// attach traces every request with a server span, continuing the trace in
+// its traceparent header if it has one. Handlers find the span in
+// c.UserContext(), to start their own spans under it.
+func (t *tracer) attach(app *fiber.App) {
+	app.Use(t.trace)
+	app.Hooks().OnShutdown(func() error {
+		close(t.done)
+		t.flush()
+		return nil
+	})
+}
+
+func (t *tracer) trace(c *fiber.Ctx) error {
+	// Fiber reuses the request's strings, so the span keeps copies.
+	method, path := strings.Clone(c.Method()), strings.Clone(c.Path())
+	span := t.newSpan(method, spanKindServer, parseTraceparent(c.Get(HeaderTraceparent)))
+	defer span.End()
+	c.SetUserContext(context.WithValue(c.UserContext(), spanKey{}, span))
+
+	err := c.Next()
+	if err != nil {
+		// Render the error here to record its status.
+		if err := c.App().Config().ErrorHandler(c, err); err != nil {
+			span.SetError(err)
+			return err
+		}
+	}
+
+	status := c.Response().StatusCode()
+	route := c.Route().Path
+	span.mu.Lock()
+	if route != "/" || path == "/" {
+		span.name = method + " " + route
+		span.attrs["http.route"] = route
+	}
+	span.attrs["http.request.method"] = method
+	span.attrs["url.path"] = path
+	span.attrs["http.response.status_code"] = status
+	span.attrs["client.address"] = c.IP()
+	if id := RequestID(c); id != "" {
+		span.attrs["http.request.id"] = id
+	}
+	if email, _ := c.Locals(localsEmail).(string); email != "" {
+		span.attrs["enduser.id"] = strings.Clone(email)
+	}
+	if status >= fiber.StatusInternalServerError {
+		span.failed = true
+		if err != nil {
+			span.err = err.Error()
+		}
+	}
+	span.mu.Unlock()
+	return nil
+}
+
+func (t *tracer) export(s *Span, end time.Time) {
+	s.mu.Lock()
+	span := map[string]any{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.failed {
+		span["status"] = map[string]any{"code": 2, "message": s.err}
+	}
+	s.mu.Unlock()
+
+	t.mu.Lock()
+	if len(t.queue) < traceQueueSize {
+		t.queue = append(t.queue, span)
+	}
+	full := len(t.queue) >= traceBatchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.kick:
+		case <-t.done:
+			return
+		}
+		t.flush()
+	}
+}
+
+// flush exports the queued spans.
+func (t *tracer) flush() {
+	t.mu.Lock()
+	spans := t.queue
+	t.queue = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": t.resource},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "pkg/server"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Printf("Tracing: %v", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Tracing: %v", err)
+		return
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		log.Printf("Tracing: exporting %d spans: %v", len(spans), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Tracing: exporting %d spans: %s", len(spans), resp.Status)
+	}
+}
+
+// otlpAttributes encodes attributes as OTLP key-values, in key order.
+func otlpAttributes(attrs map[string]any) []any {
+	kvs := make([]any, 0, len(attrs))
+	for _, k := range sortedKeys(attrs, nil) {
+		var value map[string]any
+		switch v := attrs[k].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, map[string]any{"key": k, "value": value})
+	}
+	return kvs
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Response validation modes.
+const (
+	ValidateOff  = "off"
+	ValidateLog  = "log"  // Log responses that don't match the spec
+	ValidateFail = "fail" // Replace them with a 500 explaining the mismatch
+)
+
+// openAPI is the part of an OpenAPI spec that describes responses.
+type openAPI struct {
+	Paths map[string]map[string]struct {
+		Responses map[string]struct {
+			Content map[string]struct {
+				Schema *schema `json:"schema"`
+			} `json:"content"`
+		} `json:"responses"`
+	} `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+// schema is the subset of JSON Schema the spec generator emits.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Nullable             bool               `json:"nullable"`
+	Items                *schema            `json:"items"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	Required             []string           `json:"required"`
+	Enum                 []string           `json:"enum"`
+}
+
+// validator checks response bodies against the schemas in the spec, to
+// catch handlers that drifted from what the spec promises.
+type validator struct {
+	spec openAPI
+	fail bool
+}
+
+func newValidator(spec []byte, mode string) (*validator, error) {
+	v := &validator{fail: mode == ValidateFail}
+	if err := json.Unmarshal(spec, &v.spec); err != nil {
+		return nil, fmt.Errorf("parsing OpenAPI spec: %w", err)
+	}
+	return v, nil
+}
+
+func (v *validator) attach(app *fiber.App) {
+	app.Use(v.validate)
+}
+
+func (v *validator) validate(c *fiber.Ctx) error {
+	if err := c.Next(); err != nil {
+		// Validate the error response too, so render it here rather than
+		// leaving it to the app's error handler.
+		if err := c.App().Config().ErrorHandler(c, err); err != nil {
+			return err
+		}
+	}
+
+	err := v.check(c)
+	if err == nil {
+		return nil
+	}
+	Logger(c).Warn("Response does not match the OpenAPI spec", "method", c.Method(), "url", c.OriginalURL(), "error", err.Error())
+	if !v.fail {
+		return nil
+	}
+	c.Response().Reset()
+	return Fail(c, fiber.StatusInternalServerError, CodeInternal, "response does not match the OpenAPI spec: "+err.Error())
+}
+
+// check validates the response to c. Routes the spec doesn't describe, and
+// error statuses it doesn't list, are not checked.
+func (v *validator) check(c *fiber.Ctx) error {
+	op, ok := v.spec.Paths[specPath(c.Route().Path)][strings.ToLower(c.Method())]
+	if !ok {
+		return nil
+	}
+	status := c.Response().StatusCode()
+	if status == fiber.StatusNotModified {
+		return nil
+	}
+	resp, ok := op.Responses[fmt.Sprint(status)]
+	if !ok {
+		if status >= 400 {
+			return nil
+		}
+		return fmt.Errorf("status %d is not documented", status)
+	}
+
+	if len(resp.Content) == 0 || c.Response().IsBodyStream() {
+		// Streams, such as exports, aren't checked.
+		return nil
+	}
+	contentType, _, _ := strings.Cut(string(c.Response().Header.ContentType()), ";")
+	contentType = strings.TrimSpace(contentType)
+	media, ok := resp.Content[contentType]
+	if !ok {
+		if _, ok := resp.Content[fiber.MIMEOctetStream]; ok {
+			// Files, which have whatever type they were uploaded with.
+			return nil
+		}
+		return fmt.Errorf("content type %q is not documented", c.Response().Header.ContentType())
+	}
+	if contentType != fiber.MIMEApplicationJSON || media.Schema == nil {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(c.Response().Body()))
+	dec.UseNumber()
+	var body any
+	if err := dec.Decode(&body); err != nil {
+		return fmt.Errorf("decoding body: %w", err)
+	}
+	return v.match("$", body, media.Schema)
+}
+
+// match reports the first place value differs from s. Go encodes nil
+// slices, maps and pointers as null, so null matches arrays, objects and
+// references as well as nullable schemas.
+func (v *validator) match(path string, value any, s *schema) error {
+	if s.Ref != "" {
+		if value == nil {
+			return nil
+		}
+		ref, ok := v.spec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+		if !ok {
+			return fmt.Errorf("%s: unknown schema %s", path, s.Ref)
+		}
+		return v.match(path, value, ref)
+	}
+	if s.Type == "" || value == nil && (s.Nullable || s.Type == "array" || s.Type == "object") {
+		return nil
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			break
+		}
+		for _, key := range sortedKeys(obj, nil) {
+			prop, ok := s.Properties[key]
+			if !ok {
+				prop = s.AdditionalProperties
+			}
+			if prop == nil {
+				if len(s.Properties) == 0 {
+					continue // Free-form object
+				}
+				return fmt.Errorf("%s: unexpected property %q", path, key)
+			}
+			if err := v.match(path+"."+key, obj[key], prop); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "array":
+		arr, ok := value.([]any)
+		if !ok {
+			break
+		}
+		if s.Items == nil {
+			return nil
+		}
+		for i, item := range arr {
+			if err := v.match(fmt.Sprintf("%s[%d]", path, i), item, s.Items); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "string":
+		if _, ok := value.(string); ok {
+			return nil
+		}
+	case "boolean":
+		if _, ok := value.(bool); ok {
+			return nil
+		}
+	case "number":
+		if _, ok := value.(json.Number); ok {
+			return nil
+		}
+	case "integer":
+		if n, ok := value.(json.Number); ok {
+			if _, err := n.Int64(); err == nil {
+				return nil
+			}
+		}
+	default:
+		return nil
+	}
+	return fmt.Errorf("%s: want %s, got %s", path, s.Type, jsonType(value))
+}
+
+func jsonType(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// specPath turns a Fiber route path such as /accounts/:id into its OpenAPI
+// form, /accounts/{id}.
+func specPath(route string) string {
+	segments := strings.Split(route, "/")
+	for i, seg := range segments {
+		if name, ok := strings.CutPrefix(seg, ":"); ok {
+			segments[i] = "{" + strings.TrimSuffix(name, "?") + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// Headers telling clients of v1 that it is going away, from RFC 9745 and
+// RFC 8594.
+const (
+	HeaderDeprecation = "Deprecation"
+	HeaderSunset      = "Sunset"
+)
+
+// localsVersion is the Fiber local holding the API version a request was
+// made to, when it isn't v1.
+const localsVersion = "api_version"
+
+// APIVersion is a version of the API served alongside v1, at /api/<Name>.
+// Its requests are served by v1's handlers, through its Serializer, except
+// for those matching routes the server registers under /api/<Name> itself:
+//
+//	v2 := app.Group("/api/v2")
+//	v2.Get("/orders/:id", getOrderV2)
+type APIVersion struct {
+	Name       string     // Such as v2
+	Serializer Serializer // Nil serves v1's requests and responses as they are
+}
+
+// V2 is v1 with its JSON fields and query parameters named in camelCase.
+var V2 = APIVersion{Name: "v2", Serializer: CamelCase}
+
+// Serializer translates between a version's requests and responses and
+// v1's, for v1's handlers to serve the version.
+type Serializer interface {
+	// Request rewrites a request to the version as one to v1.
+	Request(c *fiber.Ctx) error
+	// Response rewrites v1's response as the version's.
+	Response(c *fiber.Ctx) error
+}
+
+// RequestVersion returns the API version a request was made to, such as
+// v2, for handlers that answer versions differently; it is v1 for
+// everything else.
+func RequestVersion(c *fiber.Ctx) string {
+	if v, ok := c.Locals(localsVersion).(string); ok {
+		return v
+	}
+	return "v1"
+}
+
+// WithVersions serves versions of the API alongside v1, and marks v1
+// deprecated as cfg says: once it is, its responses carry a Deprecation
+// header, a Sunset one with cfg.V1Sunset if it has one, and a Link to the
+// same path in the newest version. From the sunset, by the server's clock,
+// v1 answers 410 GONE. A sunset without cfg.V1Deprecated deprecates v1 from
+// when the server starts.
+func WithVersions(cfg Config, versions ...APIVersion) Option {
+	return func(o *options) {
+		v := &apiVersions{versions: versions}
+		var err error
+		if v.deprecated, err = parseVersionDate(cfg.V1Deprecated); err != nil {
+			log.Fatalf("--v1-deprecated: %v", err)
+		}
+		if v.sunset, err = parseVersionDate(cfg.V1Sunset); err != nil {
+			log.Fatalf("--v1-sunset: %v", err)
+		}
+		if v.deprecated.IsZero() && !v.sunset.IsZero() {
+			v.deprecated = Now()
+		}
+		o.apiVersions = v
+	}
+}
+
+// parseVersionDate parses a date, or time, v1 is deprecated or retired
+// on; "" is none.
+func parseVersionDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a YYYY-MM-DD date or RFC 3339 time", s)
+	}
+	return t, nil
+}
+
+// apiVersions serves the versions of the API after v1.
+type apiVersions struct {
+	versions   []APIVersion
+	deprecated time.Time // Zero if v1 isn't deprecated
+	sunset     time.Time // Zero if v1 isn't being retired
+}
+
+// attach mounts each version ahead of the routes, so that its requests
+// reach v1's. It goes ahead of the middleware too, which sees them as
+// requests to v1.
+func (v *apiVersions) attach(app *fiber.App) {
+	if !v.deprecated.IsZero() {
+		app.Use("/api/v1", v.deprecate)
+	}
+	for _, version := range v.versions {
+		prefix := "/api/" + version.Name
+		var own []fiber.Route
+		app.Use(prefix, v.serve(version, &own))
+		app.Hooks().OnRoute(func(r fiber.Route) error {
+			if strings.HasPrefix(r.Path, prefix+"/") {
+				own = append(own, r)
+			}
+			return nil
+		})
+	}
+}
+
+// deprecate marks a response from v1 deprecated, or refuses the request
+// once v1 is retired.
+func (v *apiVersions) deprecate(c *fiber.Ctx) error {
+	c.Set(HeaderDeprecation, "@"+strconv.FormatInt(v.deprecated.Unix(), 10))
+	if len(v.versions) > 0 {
+		successor := "/api/" + v.versions[len(v.versions)-1].Name + strings.TrimPrefix(c.Path(), "/api/v1")
+		c.Set(fiber.HeaderLink, fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+	}
+	if v.sunset.IsZero() {
+		return c.Next()
+	}
+	c.Set(HeaderSunset, v.sunset.UTC().Format(http.TimeFormat))
+	if !Now().Before(v.sunset) {
+		return Fail(c, fiber.StatusGone, CodeGone, fmt.Sprintf("API v1 was retired on %s", v.sunset.UTC().Format(time.DateOnly)))
+	}
+	return c.Next()
+}
+
+// serve hands a request to version on to v1, through its serializer,
+// unless it is for one of the version's own routes.
+func (v *apiVersions) serve(version APIVersion, own *[]fiber.Route) fiber.Handler {
+	prefix := "/api/" + version.Name
+	return func(c *fiber.Ctx) error {
+		// The path is rewritten in place below, so it is copied.
+		path := strings.Clone(c.Path())
+		c.Locals(localsVersion, version.Name)
+		for _, r := range *own {
+			if r.Method == c.Method() && matchRoute(r.Path, path) {
+				return c.Next()
+			}
+		}
+
+		if s := version.Serializer; s != nil {
+			if err := s.Request(c); err != nil {
+				return err
+			}
+		}
+		c.Path("/api/v1" + strings.TrimPrefix(path, prefix))
+		if err := c.Next(); err != nil {
+			// Render the error here for the serializer to translate.
+			if err := c.App().Config().ErrorHandler(c, err); err != nil {
+				return err
+			}
+		}
+		c.Path(path)
+		if location := c.GetRespHeader(fiber.HeaderLocation); strings.HasPrefix(location, "/api/v1/") {
+			c.Set(fiber.HeaderLocation, prefix+strings.TrimPrefix(location, "/api/v1"))
+		}
+		if s := version.Serializer; s != nil {
+			return s.Response(c)
+		}
+		return nil
+	}
+}
+
+// matchRoute reports whether path matches a route's, such as
+// /api/v2/orders/:id.
+func matchRoute(route, path string) bool {
+	want := strings.Split(strings.TrimSuffix(route, "/"), "/")
+	got := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	for i, segment := range want {
+		switch {
+		case strings.HasPrefix(segment, "*"), strings.HasPrefix(segment, "+"):
+			return true
+		case i >= len(got):
+			return i == len(want)-1 && strings.HasPrefix(segment, ":") && strings.HasSuffix(segment, "?")
+		case strings.HasPrefix(segment, ":"):
+		case !strings.EqualFold(segment, got[i]):
+			return false
+		}
+	}
+	return len(got) == len(want)
+}
+
+// CamelCase is the serializer of a version whose JSON fields and query
+// parameters, sort's included, are named in camelCase, such as userEmail,
+// where v1's are snake_case. Only names made of lower-case words are
+// renamed, so keys that are IDs, such as acc_checking_1, stay as they are.
+var CamelCase Serializer = camelCase{}
+
+type camelCase struct{}
+
+var (
+	snakeNamePattern = regexp.MustCompile(`^[a-z]+(_[a-z]+)+$`)
+	camelNamePattern = regexp.MustCompile(`^[a-z]+([A-Z][a-z]+)+$`)
+)
+
+func (camelCase) Request(c *fiber.Ctx) error {
+	args := c.Request().URI().QueryArgs()
+	if args.Len() > 0 {
+		renamed := fasthttp.AcquireArgs()
+		defer fasthttp.ReleaseArgs(renamed)
+		args.VisitAll(func(key, value []byte) {
+			name := snakeName(string(key))
+			if name == "sort" {
+				fields := strings.Split(string(value), ",")
+				for i, f := range fields {
+					f, desc := strings.CutPrefix(f, "-")
+					fields[i] = snakeName(f)
+					if desc {
+						fields[i] = "-" + fields[i]
+					}
+				}
+				value = []byte(strings.Join(fields, ","))
+			}
+			renamed.AddBytesV(name, value)
+		})
+		renamed.CopyTo(args)
+	}
+	if body := c.Body(); len(body) > 0 && json.Valid(body) {
+		body, err := renameKeys(body, snakeName)
+		if err != nil {
+			return err
+		}
+		c.Request().SetBody(body)
+	}
+	return nil
+}
+
+func (camelCase) Response(c *fiber.Ctx) error {
+	resp := c.Response()
+	contentType := string(resp.Header.ContentType())
+	if resp.IsBodyStream() || !strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) && !strings.HasPrefix(contentType, MIMEApplicationHAL) {
+		return nil
+	}
+	body, err := renameKeys(resp.Body(), camelName)
+	if err != nil {
+		return err
+	}
+	resp.SetBodyRaw(body)
+	return nil
+}
+
+// camelName spells a snake_case name, such as user_email, in camelCase.
+func camelName(name string) string {
+	if !snakeNamePattern.MatchString(name) {
+		return name
+	}
+	words := strings.Split(name, "_")
+	for i := 1; i < len(words); i++ {
+		words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+	}
+	return strings.Join(words, "")
+}
+
+// snakeName spells a camelCase name, such as userEmail, in snake_case.
+func snakeName(name string) string {
+	if !camelNamePattern.MatchString(name) {
+		return name
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsUpper(r) {
+			b.WriteByte('_')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// renameKeys returns the JSON document data, compacted, with its objects'
+// keys renamed, keeping their order.
+func renameKeys(data []byte, rename func(string) string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var out bytes.Buffer
+	type level struct {
+		object bool
+		n      int // Tokens in it so far, keys and values alike
+	}
+	var stack []level
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			out.WriteByte(byte(d))
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				stack[len(stack)-1].n++
+			}
+			continue
+		}
+
+		key := false
+		if len(stack) > 0 {
+			top := stack[len(stack)-1]
+			switch {
+			case top.object && top.n%2 == 1:
+				out.WriteByte(':')
+			case top.n > 0:
+				out.WriteByte(',')
+			}
+			key = top.object && top.n%2 == 0
+		}
+		switch tok := tok.(type) {
+		case json.Delim:
+			out.WriteByte(byte(tok))
+			stack = append(stack, level{object: tok == '{'})
+			continue
+		case string:
+			if key {
+				tok = rename(tok)
+			}
+			b, err := json.Marshal(tok)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(b)
+		case json.Number:
+			out.WriteString(tok.String())
+		case bool:
+			out.WriteString(strconv.FormatBool(tok))
+		case nil:
+			out.WriteString("null")
+		}
+		if len(stack) > 0 {
+			stack[len(stack)-1].n++
+		}
+	}
+}
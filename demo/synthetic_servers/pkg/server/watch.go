@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// Policies for reloading a watched seed, selectable with --watch-policy.
+const (
+	WatchReplace = "replace" // Load the seed as it now is, discarding the changes made since, as a reset does
+	WatchMerge   = "merge"   // Apply the seed's changes to the database, keeping the rest
+)
+
+// watchInterval is how often a watched seed file is checked for changes.
+const watchInterval = 500 * time.Millisecond
+
+// seedWatcher reloads the database when its seed file changes on disk, so
+// fixture authors see their edits without restarting the server. It
+// watches the file resets reload, which is the fixture admins loaded last,
+// if any. A file that isn't valid JSON, as while an editor is saving it,
+// is left until it changes again.
+type seedWatcher struct {
+	db     Database
+	policy string
+	seed   string // The seed at startup
+
+	admin      *admin // Knows which fixture is loaded; nil without admin endpoints
+	lifecycles *lifecycleEngine
+	persister  *persister
+	spec       []byte // To check reloaded databases against; nil not to
+
+	file    string // The seed as last seen
+	modTime time.Time
+	size    int64
+	loaded  []byte // Its contents, as last loaded, which merges diff against
+}
+
+func newSeedWatcher(cfg Config, store Store, db Database) *seedWatcher {
+	switch cfg.WatchPolicy {
+	case WatchReplace, WatchMerge:
+	default:
+		log.Fatalf("--watch-policy %q: want %s or %s", cfg.WatchPolicy, WatchReplace, WatchMerge)
+	}
+	return &seedWatcher{db: db, policy: cfg.WatchPolicy, seed: cfg.Seed()}
+}
+
+func (w *seedWatcher) start() {
+	w.poll()
+	go func() {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			w.poll()
+		}
+	}()
+	log.Printf("Watching %s for changes, to %s the database", w.file, w.policy)
+}
+
+func (w *seedWatcher) currentSeed() string {
+	if w.admin != nil {
+		return w.admin.currentSeed()
+	}
+	return w.seed
+}
+
+// poll reloads the database if the seed has changed since it last looked.
+func (w *seedWatcher) poll() {
+	file := w.currentSeed()
+	info, err := os.Stat(file)
+	if err != nil {
+		return // Being replaced, perhaps; wait for it
+	}
+	if file == w.file && info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	first := file != w.file // At startup, or a fixture loaded since, which the load loaded
+	w.file, w.modTime, w.size = file, info.ModTime(), info.Size()
+	if first {
+		w.loaded = data
+		return
+	}
+	if sameJSON(data, w.loaded) {
+		return
+	}
+	if !json.Valid(data) {
+		log.Printf("%s changed, but isn't valid JSON; waiting for it to change again", file)
+		return
+	}
+	if err := w.reload(data); err != nil {
+		log.Printf("Reloading %s: %v", file, err)
+		return
+	}
+	w.loaded = data
+	log.Printf("Reloaded %s (%s)", file, w.policy)
+}
+
+// reload loads the seed data into the database as the policy says. If the
+// database won't load, it is left as it was.
+func (w *seedWatcher) reload(data []byte) error {
+	live.RLock()
+	defer live.RUnlock()
+	writing.Lock()
+	defer writing.Unlock()
+
+	ctx := context.Background()
+	before, err := w.db.encode(ctx)
+	if err != nil {
+		return err
+	}
+	next := data
+	if w.policy == WatchMerge {
+		if next, err = mergeSeed(before, w.loaded, data); err != nil {
+			return err
+		}
+	}
+	if err := w.db.replace(ctx, snapshotStore(next)); err != nil {
+		if restoreErr := w.db.replace(ctx, snapshotStore(before)); restoreErr != nil {
+			return restoreErr
+		}
+		return err
+	}
+
+	if w.spec != nil {
+		v, mu := w.db.Current()
+		if mu != nil {
+			mu.RLock()
+		}
+		err := checkDatabase(v, w.spec)
+		if mu != nil {
+			mu.RUnlock()
+		}
+		if err != nil {
+			log.Printf("%s: %v", w.file, err)
+		}
+	}
+	if w.lifecycles != nil {
+		w.lifecycles.restart(false)
+	}
+	if w.persister != nil {
+		w.persister.touch()
+	}
+	return nil
+}
+
+// mergeSeed applies the changes between two versions of a seed, from and
+// to, to the encoded database current. Entities the seed added, changed or
+// removed are added, replaced or removed, whatever became of them at
+// runtime, and the rest are left as they are. Fields that aren't
+// collections take the seed's new value, if it changed.
+func mergeSeed(current, from, to []byte) ([]byte, error) {
+	var cur, old, seed map[string]json.RawMessage
+	for _, doc := range []struct {
+		data []byte
+		into *map[string]json.RawMessage
+	}{{current, &cur}, {from, &old}, {to, &seed}} {
+		if err := json.Unmarshal(doc.data, doc.into); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range sortedKeys(old, seed) {
+		a, okA := entities(old[name])
+		b, okB := entities(seed[name])
+		collection, ok := cur[name]
+		if !okA || !okB || !ok {
+			if _, kept := seed[name]; !kept {
+				delete(cur, name)
+			} else if !sameJSON(old[name], seed[name]) {
+				cur[name] = seed[name]
+			}
+			continue
+		}
+		for _, key := range sortedKeys(a, b) {
+			before, had := a[key]
+			after, has := b[key]
+			switch {
+			case !has:
+				if edited, err := removeEntity(collection, key); err == nil {
+					collection = edited
+				} // Otherwise it is gone already
+			case !had || !sameJSON(before, after):
+				edited, _, err := setEntity(collection, key, after)
+				if err != nil {
+					return nil, err
+				}
+				collection = edited
+			}
+		}
+		cur[name] = collection
+	}
+	return json.Marshal(cur)
+}
@@ -0,0 +1,425 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Webhook delivery headers. The signature is
+// "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)).
+const (
+	HeaderWebhookID        = "X-Webhook-ID"
+	HeaderWebhookEvent     = "X-Webhook-Event"
+	HeaderWebhookDelivery  = "X-Webhook-Delivery"
+	HeaderWebhookTimestamp = "X-Webhook-Timestamp"
+	HeaderWebhookSignature = "X-Webhook-Signature"
+)
+
+const (
+	// A delivery is attempted webhookAttempts times, waiting
+	// webhookBackoff, then twice as long each time, between attempts.
+	webhookAttempts = 6
+	webhookBackoff  = time.Second
+	webhookTimeout  = 10 * time.Second
+	webhookWorkers  = 4
+	// webhookDeliveries is how many deliveries each webhook keeps.
+	webhookDeliveries = 100
+)
+
+// Webhook is a callback URL subscribed to events. Events are named by
+// their type (orders.updated), the entity in the singular with the action
+// (order.updated), or, when the entity's status is set or changes, the
+// entity with the new status (booking.cancelled, transfer.completed); "*"
+// subscribes to all of them.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"` // Only shown when created
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	role       string
+	deliveries []*WebhookDelivery
+}
+
+// WebhookDelivery is the sending of one event to a webhook.
+type WebhookDelivery struct {
+	ID            string     `json:"id"`
+	Event         string     `json:"event"`
+	EventID       int64      `json:"event_id"`
+	Status        string     `json:"status"` // pending, succeeded or failed
+	Attempts      int        `json:"attempts"`
+	ResponseCode  int        `json:"response_code,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+
+	webhook *Webhook
+	payload []byte
+}
+
+type webhookRequest struct {
+	URL    string   `json:"url" validate:"required"`
+	Events []string `json:"events" validate:"required,min=1"`
+	Secret string   `json:"secret"`
+}
+
+// webhooks delivers events to the callback URLs users register, signing
+// each payload with the webhook's secret and retrying failed deliveries
+// with exponential backoff. Webhooks only hear of events their owner could
+// see on the event stream. They live in memory, apart from the database,
+// so resets and restores keep them.
+type webhooks struct {
+	events *events
+	client *http.Client
+	queue  chan *WebhookDelivery
+
+	mu             sync.Mutex
+	hooks          map[string]*Webhook
+	nextID         int
+	nextDeliveryID int
+	listening      bool
+}
+
+func newWebhooks(e *events) *webhooks {
+	return &webhooks{
+		events: e,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan *WebhookDelivery, 1024),
+		hooks:  make(map[string]*Webhook),
+	}
+}
+
+// attach adds the routes to manage webhooks:
+//
+//	POST   /api/v1/webhooks                 Register a webhook
+//	GET    /api/v1/webhooks                 The caller's webhooks
+//	GET    /api/v1/webhooks/:id             One webhook
+//	DELETE /api/v1/webhooks/:id             Unregister a webhook
+//	GET    /api/v1/webhooks/:id/deliveries  Its recent deliveries
+func (w *webhooks) attach(app *fiber.App) {
+	group := app.Group("/api/v1/webhooks")
+	group.Post("/", w.create)
+	group.Get("/", w.list)
+	group.Get("/:id", w.get)
+	group.Delete("/:id", w.delete)
+	group.Get("/:id/deliveries", w.listDeliveries)
+
+	for range webhookWorkers {
+		go func() {
+			for d := range w.queue {
+				w.deliver(d)
+			}
+		}()
+	}
+}
+
+// caller returns who is calling, who must say.
+func caller(c *fiber.Ctx) (email, role string, err error) {
+	email = strings.Clone(c.Query("email"))
+	role, _ = c.Locals(localsRole).(string)
+	if email == "" {
+		if required, _ := c.Locals(localsRequired).(bool); required {
+			return "", "", fiber.NewError(fiber.StatusUnauthorized, "authorization required")
+		}
+		return "", "", fiber.NewError(fiber.StatusBadRequest, "email parameter is required")
+	}
+	return email, role, nil
+}
+
+func (w *webhooks) create(c *fiber.Ctx) error {
+	email, role, err := caller(c)
+	if err != nil {
+		return err
+	}
+	var req webhookRequest
+	if err := Bind(c, &req); err != nil {
+		return err
+	}
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &ValidationError{Errors: []FieldError{{Field: "url", Message: "must be an http or https URL"}}}
+	}
+	secret := req.Secret
+	if secret == "" {
+		if secret, err = randomToken("whsec_"); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.nextID++
+	hook := &Webhook{
+		ID:        fmt.Sprintf("wh_%d", w.nextID),
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    secret,
+		Owner:     email,
+		CreatedAt: Now(),
+		role:      role,
+	}
+	w.hooks[hook.ID] = hook
+	if !w.listening {
+		w.listening = true
+		go w.listen()
+	}
+	return c.Status(fiber.StatusCreated).JSON(hook)
+}
+
+func (w *webhooks) list(c *fiber.Ctx) error {
+	email, _, err := caller(c)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	hooks := []Webhook{}
+	for _, hook := range w.hooks {
+		if strings.EqualFold(hook.Owner, email) {
+			hooks = append(hooks, hook.public())
+		}
+	}
+	slices.SortFunc(hooks, func(a, b Webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return c.JSON(hooks)
+}
+
+// lookup returns the caller's webhook named in the path. The caller must
+// hold w.mu.
+func (w *webhooks) lookup(c *fiber.Ctx) (*Webhook, error) {
+	email, _, err := caller(c)
+	if err != nil {
+		return nil, err
+	}
+	hook, ok := w.hooks[c.Params("id")]
+	if !ok || !strings.EqualFold(hook.Owner, email) {
+		return nil, fiber.NewError(fiber.StatusNotFound, "webhook not found")
+	}
+	return hook, nil
+}
+
+func (w *webhooks) get(c *fiber.Ctx) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	hook, err := w.lookup(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(hook.public())
+}
+
+func (w *webhooks) delete(c *fiber.Ctx) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	hook, err := w.lookup(c)
+	if err != nil {
+		return err
+	}
+	delete(w.hooks, hook.ID)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (w *webhooks) listDeliveries(c *fiber.Ctx) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	hook, err := w.lookup(c)
+	if err != nil {
+		return err
+	}
+	deliveries := make([]WebhookDelivery, len(hook.deliveries))
+	for i, d := range hook.deliveries {
+		deliveries[i] = *d
+	}
+	slices.Reverse(deliveries) // Newest first
+	return c.JSON(deliveries)
+}
+
+// public returns a copy of hook without its secret.
+func (hook *Webhook) public() Webhook {
+	h := *hook
+	h.Secret = ""
+	return h
+}
+
+// listen queues a delivery for every event a webhook subscribes to.
+func (w *webhooks) listen() {
+	for {
+		ch, unsubscribe := w.events.subscribe()
+		for ev := range ch {
+			w.dispatch(ev)
+		}
+		// Fell behind; the missed events are lost.
+		unsubscribe()
+	}
+}
+
+func (w *webhooks) dispatch(ev Event) {
+	names := eventNames(ev)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, hook := range w.hooks {
+		name := hook.match(names)
+		if name == "" || !w.events.visible(ev, hook.Owner, hook.role, true) {
+			continue
+		}
+		w.nextDeliveryID++
+		d := &WebhookDelivery{
+			ID:        fmt.Sprintf("whd_%d", w.nextDeliveryID),
+			Event:     name,
+			EventID:   ev.ID,
+			Status:    "pending",
+			CreatedAt: Now(),
+			webhook:   hook,
+		}
+		d.payload, _ = json.Marshal(fiber.Map{
+			"id":         d.ID,
+			"event":      name,
+			"created_at": d.CreatedAt,
+			"data":       ev,
+		})
+		hook.deliveries = append(hook.deliveries, d)
+		if n := len(hook.deliveries) - webhookDeliveries; n > 0 {
+			hook.deliveries = slices.Delete(hook.deliveries, 0, n)
+		}
+		w.enqueue(d)
+	}
+}
+
+func (w *webhooks) enqueue(d *WebhookDelivery) {
+	select {
+	case w.queue <- d:
+	default:
+		d.Status, d.Error = "failed", "delivery queue is full"
+		log.Printf("Webhooks: dropped delivery %s to %s: queue is full", d.ID, d.webhook.URL)
+	}
+}
+
+// match returns the first of names the webhook subscribes to, or "".
+func (hook *Webhook) match(names []string) string {
+	for _, name := range names {
+		for _, want := range hook.Events {
+			if want == "*" || strings.EqualFold(want, name) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// eventNames returns the names ev goes by, most specific first: the
+// entity's new status, if set or changed, the entity and action, and the
+// event's type.
+func eventNames(ev Event) []string {
+	entity := singular(ev.Collection)
+	var names []string
+	if ev.Action != EventDeleted {
+		var after, before struct {
+			Status any `json:"status"`
+		}
+		json.Unmarshal(ev.Entity, &after)
+		if ev.Before != nil {
+			json.Unmarshal(ev.Before, &before)
+		}
+		status, _ := after.Status.(string)
+		if was, _ := before.Status.(string); status != "" && status != was {
+			names = append(names, entity+"."+strings.ToLower(status))
+		}
+	}
+	return append(names, entity+"."+ev.Action, ev.Type)
+}
+
+// singular guesses the singular of an English collection name.
+func singular(name string) string {
+	switch {
+	case strings.HasSuffix(name, "ies"):
+		return strings.TrimSuffix(name, "ies") + "y"
+	case strings.HasSuffix(name, "sses"), strings.HasSuffix(name, "xes"), strings.HasSuffix(name, "ches"), strings.HasSuffix(name, "shes"):
+		return strings.TrimSuffix(name, "es")
+	case strings.HasSuffix(name, "s") && !strings.HasSuffix(name, "ss"):
+		return strings.TrimSuffix(name, "s")
+	}
+	return name
+}
+
+// deliver attempts a delivery, scheduling a retry if it fails.
+func (w *webhooks) deliver(d *WebhookDelivery) {
+	w.mu.Lock()
+	hook := d.webhook
+	target, secret := hook.URL, hook.Secret
+	_, registered := w.hooks[hook.ID]
+	d.Attempts++
+	d.NextAttemptAt = nil
+	w.mu.Unlock()
+	if !registered {
+		w.finish(d, "failed", 0, "webhook was deleted")
+		return
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(d.payload)
+
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(d.payload))
+	if err != nil {
+		w.finish(d, "failed", 0, err.Error())
+		return
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(HeaderWebhookID, hook.ID)
+	req.Header.Set(HeaderWebhookEvent, d.Event)
+	req.Header.Set(HeaderWebhookDelivery, d.ID)
+	req.Header.Set(HeaderWebhookTimestamp, timestamp)
+	req.Header.Set(HeaderWebhookSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := w.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			w.finish(d, "succeeded", resp.StatusCode, "")
+			return
+		}
+		err = fmt.Errorf("callback answered %s", resp.Status)
+	}
+	code := 0
+	if resp != nil {
+		code = resp.StatusCode
+	}
+
+	w.mu.Lock()
+	attempts := d.Attempts
+	w.mu.Unlock()
+	if attempts >= webhookAttempts {
+		w.finish(d, "failed", code, err.Error())
+		return
+	}
+	delay := webhookBackoff << (attempts - 1)
+	next := time.Now().Add(delay)
+	w.mu.Lock()
+	d.ResponseCode, d.Error, d.NextAttemptAt = code, err.Error(), &next
+	w.mu.Unlock()
+	time.AfterFunc(delay, func() { w.enqueue(d) })
+}
+
+func (w *webhooks) finish(d *WebhookDelivery, status string, code int, msg string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	d.Status, d.ResponseCode, d.Error = status, code, msg
+	if status == "failed" {
+		log.Printf("Webhooks: delivery %s to %s failed after %d attempt(s): %s", d.ID, d.webhook.URL, d.Attempts, msg)
+	}
+}
@@ -0,0 +1,57 @@
+// Package servertest runs a server's handlers in tests, against a database
+// and a clock of the test's own, without a seed file or a listener.
+package servertest
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"pkg/server"
+)
+
+// store holds a test's database. Saving it keeps nothing.
+type store string
+
+func (s store) Load() ([]byte, error) { return []byte(s), nil }
+func (store) Save([]byte) error       { return nil }
+func (store) Close() error            { return nil }
+
+// Store returns a store holding data, a database as JSON, for a server's
+// newHandlers to load.
+func Store(data string) server.Store { return store(data) }
+
+// Clock returns a clock stopped at t.
+func Clock(t time.Time) *server.Clock {
+	c := &server.Clock{}
+	c.Set(t, true)
+	return c
+}
+
+// App returns an app that reports errors as servers do, bare of the rest of
+// server.New's middleware, for a test to set a server's routes up on.
+func App() *fiber.App {
+	return fiber.New(fiber.Config{ErrorHandler: server.ErrorHandler, Immutable: true})
+}
+
+// Do sends app a request with body as JSON, decodes the response into v
+// unless v is nil, and returns its status.
+func Do(t testing.TB, app *fiber.App, method, target, body string, v any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+	return resp.StatusCode
+}
@@ -0,0 +1,124 @@
+// Package statemachine checks the moves the synthetic servers' entities
+// make between statuses: an order from pending to shipped, a ride from
+// requested to accepted. A Machine lists the statuses each status may move
+// to; a status that moves nowhere is final. Move makes a move the machine
+// allows, records it, with when it was made, in the entity's history, and
+// runs the machine's hooks for it; one it doesn't allow is an *Error,
+// which the servers answer with 409 INVALID_TRANSITION.
+package statemachine
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Machine is the moves an entity, such as an order, may make between its
+// statuses.
+type Machine struct {
+	Name  string              // What moves through it, such as "order"
+	Moves map[string][]string // The statuses each status may move to
+	Hooks []Hook
+}
+
+// Hook is something to do once an entity makes a move.
+type Hook struct {
+	From, To string // The move it follows; either may be "" for any
+	// Do is given the entity Move was, such as a *Order, and the move.
+	Do func(entity any, t Transition)
+}
+
+// Transition is a move an entity made, and when.
+type Transition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// Error is a move a machine doesn't allow.
+type Error struct {
+	Machine string   `json:"-"`
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Allowed []string `json:"allowed"` // Where From may move instead; empty if it is final
+}
+
+func (e *Error) Error() string {
+	if len(e.Allowed) == 0 {
+		return fmt.Sprintf("%s is %s, and can't be changed", e.Machine, e.From)
+	}
+	return fmt.Sprintf("%s can't go from %s to %s, only to %s", e.Machine, e.From, e.To, strings.Join(e.Allowed, " or "))
+}
+
+// Allows reports whether m lets an entity move from one status to
+// another.
+func (m *Machine) Allows(from, to string) bool {
+	return slices.Contains(m.Moves[from], to)
+}
+
+// Next returns the statuses m lets an entity in status move to, sorted.
+func (m *Machine) Next(status string) []string {
+	next := slices.Clone(m.Moves[status])
+	sort.Strings(next)
+	return next
+}
+
+// Final reports whether status moves nowhere.
+func (m *Machine) Final(status string) bool {
+	return len(m.Moves[status]) == 0
+}
+
+// Statuses returns every status m knows, sorted.
+func (m *Machine) Statuses() []string {
+	seen := make(map[string]bool)
+	for from, tos := range m.Moves {
+		seen[from] = true
+		for _, to := range tos {
+			seen[to] = true
+		}
+	}
+	statuses := make([]string, 0, len(seen))
+	for s := range seen {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	return statuses
+}
+
+// Check returns an *Error if m doesn't let an entity move from one status
+// to another.
+func (m *Machine) Check(from, to string) error {
+	if m.Allows(from, to) {
+		return nil
+	}
+	return &Error{Machine: m.Name, From: from, To: to, Allowed: m.Next(from)}
+}
+
+// Move moves entity, whose status is *status, to the status to at at, if m
+// allows it, appending the move to *history, unless history is nil, and
+// running m's hooks for it:
+//
+//	err := statemachine.Move(orderMachine, &order, &order.Status, &order.StatusHistory, OrderCancelled, now)
+func Move[S ~string](m *Machine, entity any, status *S, history *[]Transition, to S, at time.Time) error {
+	if err := m.Check(string(*status), string(to)); err != nil {
+		return err
+	}
+	t := Transition{From: string(*status), To: string(to), At: at}
+	*status = to
+	if history != nil {
+		*history = append(*history, t)
+	}
+	m.Moved(entity, t)
+	return nil
+}
+
+// Moved runs m's hooks for a move entity has made.
+func (m *Machine) Moved(entity any, t Transition) {
+	for _, h := range m.Hooks {
+		if (h.From == "" || h.From == t.From) && (h.To == "" || h.To == t.To) {
+			h.Do(entity, t)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package statemachine
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+type status string
+
+type order struct {
+	Status  status
+	History []Transition
+}
+
+// orders is the machine of an order, from pending to delivered or
+// cancelled.
+var orders = &Machine{
+	Name: "order",
+	Moves: map[string][]string{
+		"pending":   {"paid", "cancelled"},
+		"paid":      {"shipped", "cancelled"},
+		"shipped":   {"delivered"},
+		"delivered": nil,
+		"cancelled": nil,
+	},
+}
+
+var at = time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC)
+
+func TestMove(t *testing.T) {
+	tests := []struct {
+		from, to string
+		allowed  []string // Where from may move instead, if it may not move to to
+		final    bool
+	}{
+		{from: "pending", to: "paid"},
+		{from: "pending", to: "cancelled"},
+		{from: "paid", to: "shipped"},
+		{from: "shipped", to: "delivered"},
+		{from: "pending", to: "shipped", allowed: []string{"cancelled", "paid"}},
+		{from: "shipped", to: "cancelled", allowed: []string{"delivered"}},
+		{from: "paid", to: "paid", allowed: []string{"cancelled", "shipped"}},
+		{from: "delivered", to: "cancelled", final: true},
+		{from: "cancelled", to: "pending", final: true},
+		{from: "lost", to: "pending", final: true}, // Unknown statuses move nowhere
+	}
+	for _, tt := range tests {
+		o := order{Status: status(tt.from)}
+		err := Move(orders, &o, &o.Status, &o.History, status(tt.to), at)
+		if tt.allowed == nil && !tt.final {
+			if err != nil {
+				t.Errorf("%s to %s: %v", tt.from, tt.to, err)
+			}
+			want := []Transition{{From: tt.from, To: tt.to, At: at}}
+			if string(o.Status) != tt.to || !slices.Equal(o.History, want) {
+				t.Errorf("%s to %s left the order %s with history %v", tt.from, tt.to, o.Status, o.History)
+			}
+			continue
+		}
+
+		var move *Error
+		if !errors.As(err, &move) {
+			t.Errorf("%s to %s: %v, want an *Error", tt.from, tt.to, err)
+			continue
+		}
+		if move.Machine != "order" || move.From != tt.from || move.To != tt.to || !slices.Equal(move.Allowed, tt.allowed) {
+			t.Errorf("%s to %s: %+v, want it allowed only %v", tt.from, tt.to, move, tt.allowed)
+		}
+		if string(o.Status) != tt.from || len(o.History) != 0 {
+			t.Errorf("%s to %s, refused, left the order %s with history %v", tt.from, tt.to, o.Status, o.History)
+		}
+		if final := orders.Final(tt.from); final != tt.final {
+			t.Errorf("Final(%s) = %v, want %v", tt.from, final, tt.final)
+		}
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	tests := []struct {
+		from, to, want string
+	}{
+		{from: "pending", to: "delivered", want: "order can't go from pending to delivered, only to cancelled or paid"},
+		{from: "delivered", to: "pending", want: "order is delivered, and can't be changed"},
+	}
+	for _, tt := range tests {
+		if err := orders.Check(tt.from, tt.to); err == nil || err.Error() != tt.want {
+			t.Errorf("Check(%s, %s) = %v, want %q", tt.from, tt.to, err, tt.want)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var ran []string
+	hook := func(name string) func(any, Transition) {
+		return func(entity any, t Transition) {
+			entity.(*order).Status += "!"
+			ran = append(ran, name+":"+t.From+">"+t.To)
+		}
+	}
+	m := &Machine{
+		Name:  orders.Name,
+		Moves: orders.Moves,
+		Hooks: []Hook{
+			{Do: hook("any")},
+			{From: "pending", Do: hook("from pending")},
+			{To: "cancelled", Do: hook("to cancelled")},
+			{From: "paid", To: "shipped", Do: hook("shipping")},
+		},
+	}
+	o := order{Status: "pending"}
+	if err := Move(m, &o, &o.Status, nil, "cancelled", at); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"any:pending>cancelled", "from pending:pending>cancelled", "to cancelled:pending>cancelled"}
+	if !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+	if o.Status != "cancelled!!!" {
+		t.Errorf("hooks were given %q, want the order itself, moved", o.Status)
+	}
+
+	ran = nil
+	o = order{Status: "pending"}
+	if err := Move(m, &o, &o.Status, nil, "shipped", at); err == nil {
+		t.Fatal("moved from pending to shipped")
+	}
+	if len(ran) != 0 {
+		t.Errorf("ran %v for a refused move", ran)
+	}
+}
+
+func TestStatuses(t *testing.T) {
+	want := []string{"cancelled", "delivered", "paid", "pending", "shipped"}
+	if got := orders.Statuses(); !slices.Equal(got, want) {
+		t.Errorf("Statuses() = %v, want %v", got, want)
+	}
+	if got := orders.Next("paid"); !slices.Equal(got, []string{"cancelled", "shipped"}) {
+		t.Errorf("Next(paid) = %v", got)
+	}
+}
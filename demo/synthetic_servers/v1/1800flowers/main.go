@@ -1,31 +1,29 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/payments"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Product struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Category    string    `json:"category"`
-	Price       float64   `json:"price"`
-	ImageURL    string    `json:"image_url"`
-	Available   bool      `json:"available"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Category    string      `json:"category"`
+	Price       money.Money `json:"price"`
+	ImageURL    string      `json:"image_url"`
+	Available   bool        `json:"available"`
+	CreatedAt   time.Time   `json:"created_at"`
 }
 
 type Recipient struct {
@@ -46,24 +44,42 @@ const (
 	OrderStatusCancelled OrderStatus = "cancelled"
 )
 
+// orderMachine is the statuses an order moves through: confirmed, then
+// delivered, unless it is cancelled first.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	string(OrderStatusPending):   {string(OrderStatusConfirmed), string(OrderStatusCancelled)},
+	string(OrderStatusConfirmed): {string(OrderStatusDelivered), string(OrderStatusCancelled)},
+}}
+
+// orderLifecycle confirms orders shortly after they're placed and delivers
+// them on their delivery date.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: string(OrderStatusPending), To: string(OrderStatusConfirmed), After: 15 * time.Minute,
+		Notify: server.Notice{Type: "order_confirmed", Message: "Your order {{id}} is confirmed."}},
+	{From: string(OrderStatusConfirmed), To: string(OrderStatusDelivered), At: "delivery_date", After: 14 * time.Hour,
+		Notify: server.Notice{Type: "order_delivered", Message: "Your order {{id}} was delivered.", Text: "delivery_update"}},
+}, Sender: "1-800-Flowers", Machine: orderMachine}
+
 type Order struct {
-	ID           string      `json:"id"`
-	UserEmail    string      `json:"user_email"`
-	Product      Product     `json:"product"`
-	Recipient    Recipient   `json:"recipient"`
-	Message      string      `json:"message"`
-	DeliveryDate time.Time   `json:"delivery_date"`
-	Status       OrderStatus `json:"status"`
-	Total        float64     `json:"total"`
-	CreatedAt    time.Time   `json:"created_at"`
-	UpdatedAt    time.Time   `json:"updated_at"`
+	ID            string                    `json:"id"`
+	UserEmail     string                    `json:"user_email"`
+	Product       Product                   `json:"product"`
+	Recipient     Recipient                 `json:"recipient"`
+	Message       string                    `json:"message"`
+	DeliveryDate  time.Time                 `json:"delivery_date"`
+	Status        OrderStatus               `json:"status"`
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+	Total         money.Money               `json:"total"`
+	ChargeID      string                    `json:"charge_id,omitempty"` // The charge to the payment method
+	CreatedAt     time.Time                 `json:"created_at"`
+	UpdatedAt     time.Time                 `json:"updated_at"`
 }
 
 type DeliveryDate struct {
-	Date         time.Time `json:"date"`
-	Available    bool      `json:"available"`
-	Price        float64   `json:"price"`
-	DeliveryType string    `json:"delivery_type"`
+	Date         time.Time   `json:"date"`
+	Available    bool        `json:"available"`
+	Price        money.Money `json:"price"`
+	DeliveryType string      `json:"delivery_type"`
 }
 
 type User struct {
@@ -82,28 +98,60 @@ type PaymentMethod struct {
 	ExpiryYY int    `json:"expiry_yy"`
 }
 
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
+}
+
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Products map[string]Product `json:"products"`
-	Orders   map[string]Order   `json:"orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+
+	Users    server.Repository[User]    `json:"users"`
+	Products server.Repository[Product] `json:"products"`
+	Orders   server.Repository[Order]   `json:"orders"`
 	mu       sync.RWMutex
 }
 
+// PhoneNumber returns the user's phone number, for texts. Callers must hold
+// d.mu.
+func (d *Database) PhoneNumber(email string) string {
+	user, _ := d.Users.Get(email)
+	return user.Phone
+}
+
 var (
 	ErrUserNotFound    = errors.New("user not found")
 	ErrProductNotFound = errors.New("product not found")
 	ErrOrderNotFound   = errors.New("order not found")
 )
 
-var db *Database
+// handlers take flower orders for 1-800-Flowers' users and products, dating
+// orders and offering delivery dates by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the catalog and orders in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+// Delivery fees, which --fees delivery=...,saturday_delivery=... override.
+var (
+	deliveryFee         = money.Cents(1299)
+	saturdayDeliveryFee = money.Cents(1999)
+)
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -114,7 +162,7 @@ func (d *Database) GetProduct(id string) (Product, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	product, exists := d.Products[id]
+	product, exists := d.Products.Get(id)
 	if !exists {
 		return Product{}, ErrProductNotFound
 	}
@@ -125,7 +173,7 @@ func (d *Database) CreateOrder(order Order) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Orders[order.ID] = order
+	d.Orders.Upsert(order.ID, order)
 	return nil
 }
 
@@ -133,7 +181,7 @@ func (d *Database) GetOrder(id string) (Order, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	order, exists := d.Orders[id]
+	order, exists := d.Orders.Get(id)
 	if !exists {
 		return Order{}, ErrOrderNotFound
 	}
@@ -141,14 +189,15 @@ func (d *Database) GetOrder(id string) (Order, error) {
 }
 
 // HTTP Handlers
-func getProducts(c *fiber.Ctx) error {
+func (h *handlers) getProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	priceRange := c.Query("price_range")
 
 	var filteredProducts []Product
 
 	db.mu.RLock()
-	for _, product := range db.Products {
+	for _, product := range db.Products.List() {
 		if !product.Available {
 			continue
 		}
@@ -160,15 +209,15 @@ func getProducts(c *fiber.Ctx) error {
 		if priceRange != "" {
 			switch priceRange {
 			case "under_50":
-				if product.Price >= 50 {
+				if product.Price.Float() >= 50 {
 					continue
 				}
 			case "50_100":
-				if product.Price < 50 || product.Price > 100 {
+				if product.Price.Float() < 50 || product.Price.Float() > 100 {
 					continue
 				}
 			case "over_100":
-				if product.Price <= 100 {
+				if product.Price.Float() <= 100 {
 					continue
 				}
 			}
@@ -178,36 +227,31 @@ func getProducts(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(filteredProducts)
+	return server.List(c, filteredProducts, "category")
 }
 
-func getDeliveryDates(c *fiber.Ctx) error {
+func (h *handlers) getDeliveryDates(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	zipCode := c.Query("zip_code")
 	productID := c.Query("product_id")
 
 	if zipCode == "" || productID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "zip_code and product_id are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "zip_code and product_id are required")
 	}
 
 	// Get product to check availability
 	product, err := db.GetProduct(productID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	if !product.Available {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Product is not available",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Product is not available")
 	}
 
 	// Generate available delivery dates (next 7 days)
 	var dates []DeliveryDate
-	baseDate := time.Now().AddDate(0, 0, 1) // Start from tomorrow
+	baseDate := h.clock.Now().AddDate(0, 0, 1) // Start from tomorrow
 
 	for i := 0; i < 7; i++ {
 		date := baseDate.AddDate(0, 0, i)
@@ -218,12 +262,12 @@ func getDeliveryDates(c *fiber.Ctx) error {
 		}
 
 		deliveryType := "standard"
-		price := 12.99
+		price := deliveryFee
 
 		// Premium delivery for Saturdays
 		if date.Weekday() == time.Saturday {
 			deliveryType = "premium"
-			price = 19.99
+			price = saturdayDeliveryFee
 		}
 
 		dates = append(dates, DeliveryDate{
@@ -234,72 +278,81 @@ func getDeliveryDates(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(dates)
+	return server.List(c, dates)
 }
 
-func createOrder(c *fiber.Ctx) error {
+func (h *handlers) createOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		ProductID       string    `json:"product_id"`
-		UserEmail       string    `json:"user_email"`
+		UserEmail       string    `json:"user_email" validate:"email"`
 		Recipient       Recipient `json:"recipient"`
 		Message         string    `json:"message"`
-		DeliveryDate    string    `json:"delivery_date"`
+		DeliveryDate    string    `json:"delivery_date" validate:"datetime"`
 		PaymentMethodID string    `json:"payment_method_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate product
 	product, err := db.GetProduct(req.ProductID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate payment method
-	validPayment := false
-	for _, pm := range user.PaymentMethods {
+	var method *PaymentMethod
+	for i, pm := range user.PaymentMethods {
 		if pm.ID == req.PaymentMethodID {
-			validPayment = true
+			method = &user.PaymentMethods[i]
 			break
 		}
 	}
-	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+	if method == nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Parse delivery date
 	deliveryDate, err := time.Parse(time.RFC3339, req.DeliveryDate)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid delivery date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid delivery date format")
 	}
 
 	// Calculate total (product price + delivery fee)
-	deliveryFee := 12.99
+	fee := deliveryFee
 	if deliveryDate.Weekday() == time.Saturday {
-		deliveryFee = 19.99
+		fee = saturdayDeliveryFee
+	}
+	total, err := product.Price.Add(fee)
+	if err != nil {
+		return err
+	}
+	id := server.NewID("ORD")
+
+	db.mu.Lock()
+	charge, err := db.Authorize(c, server.ChargeRequest{
+		UserEmail:       req.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          total,
+		Description:     "Order " + id,
+		Capture:         true,
+	})
+	db.mu.Unlock()
+	if err != nil {
+		return err
 	}
-	total := product.Price + deliveryFee
 
 	order := Order{
-		ID:           uuid.New().String(),
+		ID:           id,
 		UserEmail:    req.UserEmail,
 		Product:      product,
 		Recipient:    req.Recipient,
@@ -307,130 +360,128 @@ func createOrder(c *fiber.Ctx) error {
 		DeliveryDate: deliveryDate,
 		Status:       OrderStatusPending,
 		Total:        total,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+		ChargeID:     charge.ID,
+		CreatedAt:    h.clock.Now(),
+		UpdatedAt:    h.clock.Now(),
 	}
 
 	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create order")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	// Verify user exists
 	_, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var userOrders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
+	for _, order := range db.Orders.List() {
 		if order.UserEmail == email {
 			userOrders = append(userOrders, order)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return server.List(c, userOrders)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Products: make(map[string]Product),
-		Orders:   make(map[string]Order),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Product routes
-	api.Get("/products", getProducts)
+	api.Get("/products", h.getProducts)
 	api.Get("/products/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		product, err := db.GetProduct(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(product)
 	})
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", createOrder)
-	api.Get("/delivery-dates", getDeliveryDates)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.createOrder)
+	api.Get("/delivery-dates", h.getDeliveryDates)
 
 	// User routes
 	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		email := c.Params("email")
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(user)
 	})
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	deliveryFee = money.Dollars(cfg.Fee("delivery", deliveryFee.Float()))
+	saturdayDeliveryFee = money.Dollars(cfg.Fee("saturday_delivery", saturdayDeliveryFee.Float()))
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders"},
+			Search:  []string{"products", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -62,7 +58,10 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users map[string]User `json:"users"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users server.Repository[User] `json:"users"`
 	mu    sync.RWMutex
 }
 
@@ -73,15 +72,25 @@ var (
 	ErrNoHealthConsent = errors.New("user has not consented to health reports")
 )
 
-// Global database instance
-var db *Database
+// handlers serve 23andMe's users their ancestry, health and relative
+// reports, all read from db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users and their reports from store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -89,149 +98,135 @@ func (d *Database) GetUser(email string) (User, error) {
 }
 
 // HTTP Handlers
-func getGeneticProfile(c *fiber.Ctx) error {
+func (h *handlers) getGeneticProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(user.GeneticProfile)
 }
 
-func getAncestryComposition(c *fiber.Ctx) error {
+func (h *handlers) getAncestryComposition(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(user.Ancestry)
 }
 
-func getRelatives(c *fiber.Ctx) error {
+func (h *handlers) getRelatives(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Relatives)
+	return server.List(c, user.Relatives)
 }
 
-func getHealthReports(c *fiber.Ctx) error {
+func (h *handlers) getHealthReports(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	if !user.ConsentedToHealth {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": ErrNoHealthConsent.Error(),
-		})
+		return server.FailWith(c, fiber.StatusForbidden, ErrNoHealthConsent)
 	}
 
-	return c.JSON(user.HealthReports)
+	return server.List(c, user.HealthReports)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users: make(map[string]User),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Genetic profile routes
-	api.Get("/profile", getGeneticProfile)
+	api.Get("/profile", h.getGeneticProfile)
 
 	// Ancestry routes
-	api.Get("/ancestry", getAncestryComposition)
+	api.Get("/ancestry", h.getAncestryComposition)
 
 	// Relatives routes
-	api.Get("/relatives", getRelatives)
+	api.Get("/relatives", h.getRelatives)
 
 	// Health reports routes
-	api.Get("/health-reports", getHealthReports)
+	api.Get("/health-reports", h.getHealthReports)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
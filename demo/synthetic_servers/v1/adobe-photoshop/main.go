@@ -1,20 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -86,9 +81,13 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Projects map[string]Project `json:"projects"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]    `json:"users"`
+	Projects server.Repository[Project] `json:"projects"`
 	mu       sync.RWMutex
+	clock    *server.Clock
 }
 
 // Custom errors
@@ -99,15 +98,25 @@ var (
 	ErrStorageFull     = errors.New("storage limit exceeded")
 )
 
-// Global database instance
-var db *Database
+// handlers keep Photoshop users' projects and their layers, stamping new
+// projects with clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users and projects in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -118,12 +127,7 @@ func (d *Database) GetUserProjects(email string) ([]Project, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var projects []Project
-	for _, project := range d.Projects {
-		if project.UserEmail == email {
-			projects = append(projects, project)
-		}
-	}
+	projects := d.Projects.By("user_email", email)
 	return projects, nil
 }
 
@@ -132,7 +136,7 @@ func (d *Database) CreateProject(project Project) error {
 	defer d.mu.Unlock()
 
 	// Check user storage limit
-	user, exists := d.Users[project.UserEmail]
+	user, exists := d.Users.Get(project.UserEmail)
 	if !exists {
 		return ErrUserNotFound
 	}
@@ -142,9 +146,9 @@ func (d *Database) CreateProject(project Project) error {
 		return ErrStorageFull
 	}
 
-	d.Projects[project.ID] = project
+	d.Projects.Upsert(project.ID, project)
 	user.StorageUsed += 100 * 1024 * 1024
-	d.Users[project.UserEmail] = user
+	d.Users.Upsert(project.UserEmail, user)
 
 	return nil
 }
@@ -153,7 +157,7 @@ func (d *Database) GetProject(id string) (Project, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	project, exists := d.Projects[id]
+	project, exists := d.Projects.Get(id)
 	if !exists {
 		return Project{}, ErrProjectNotFound
 	}
@@ -164,60 +168,54 @@ func (d *Database) UpdateProject(project Project) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if _, exists := d.Projects[project.ID]; !exists {
+	if _, exists := d.Projects.Get(project.ID); !exists {
 		return ErrProjectNotFound
 	}
 
-	project.UpdatedAt = time.Now()
-	d.Projects[project.ID] = project
+	project.UpdatedAt = d.clock.Now()
+	d.Projects.Upsert(project.ID, project)
 	return nil
 }
 
 // HTTP Handlers
-func getUserProjects(c *fiber.Ctx) error {
+func (h *handlers) getUserProjects(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	projects, err := db.GetUserProjects(email)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
-	return c.JSON(projects)
+	return server.List(c, projects)
 }
 
 type CreateProjectRequest struct {
-	Name      string    `json:"name"`
-	Width     int       `json:"width"`
-	Height    int       `json:"height"`
-	ColorMode ColorMode `json:"color_mode"`
-	UserEmail string    `json:"user_email"`
+	Name      string    `json:"name" validate:"required"`
+	Width     int       `json:"width" validate:"required,gt=0"`
+	Height    int       `json:"height" validate:"required,gt=0"`
+	ColorMode ColorMode `json:"color_mode" validate:"omitempty,oneof=RGB CMYK"`
+	UserEmail string    `json:"user_email" validate:"required,email"`
 }
 
-func createProject(c *fiber.Ctx) error {
+func (h *handlers) createProject(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateProjectRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	_, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	project := Project{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("PROJ"),
 		UserEmail: req.UserEmail,
 		Name:      req.Name,
 		Dimensions: Dimensions{
@@ -226,40 +224,35 @@ func createProject(c *fiber.Ctx) error {
 		},
 		ColorMode: req.ColorMode,
 		Layers:    []Layer{},
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		CreatedAt: h.clock.Now(),
+		UpdatedAt: h.clock.Now(),
 	}
 
 	if err := db.CreateProject(project); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(project)
 }
 
-func getProjectLayers(c *fiber.Ctx) error {
+func (h *handlers) getProjectLayers(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	projectId := c.Params("projectId")
 	if projectId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Project ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Project ID is required")
 	}
 
 	project, err := db.GetProject(projectId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(project.Layers)
+	return server.List(c, project.Layers)
 }
 
 type NewLayerRequest struct {
-	Name     string    `json:"name"`
-	Type     LayerType `json:"type"`
+	Name     string    `json:"name" validate:"required"`
+	Type     LayerType `json:"type" validate:"required,oneof=raster text shape group"`
 	Content  string    `json:"content"`
 	Position struct {
 		X int `json:"x"`
@@ -267,30 +260,25 @@ type NewLayerRequest struct {
 	} `json:"position"`
 }
 
-func addLayer(c *fiber.Ctx) error {
+func (h *handlers) addLayer(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	projectId := c.Params("projectId")
 	if projectId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Project ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Project ID is required")
 	}
 
 	var req NewLayerRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	project, err := db.GetProject(projectId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	layer := Layer{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("LYR"),
 		Name:      req.Name,
 		Type:      req.Type,
 		Visible:   true,
@@ -302,9 +290,7 @@ func addLayer(c *fiber.Ctx) error {
 
 	project.Layers = append(project.Layers, layer)
 	if err := db.UpdateProject(project); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(layer)
@@ -316,26 +302,21 @@ type ExportRequest struct {
 	IncludeLayers bool   `json:"include_layers"`
 }
 
-func exportProject(c *fiber.Ctx) error {
+func (h *handlers) exportProject(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	projectId := c.Params("projectId")
 	if projectId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Project ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Project ID is required")
 	}
 
 	var req ExportRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	project, err := db.GetProject(projectId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Simulate export process
@@ -348,93 +329,93 @@ func exportProject(c *fiber.Ctx) error {
 	})
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Projects: make(map[string]Project),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Project routes
-	api.Get("/projects", getUserProjects)
-	api.Post("/projects", createProject)
+	api.Get("/projects", h.getUserProjects)
+	api.Post("/projects", h.createProject)
 	api.Get("/projects/:projectId", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		projectId := c.Params("projectId")
 		project, err := db.GetProject(projectId)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(project)
 	})
 
 	// Layer routes
-	api.Get("/projects/:projectId/layers", getProjectLayers)
-	api.Post("/projects/:projectId/layers", addLayer)
+	api.Get("/projects/:projectId/layers", h.getProjectLayers)
+	api.Post("/projects/:projectId/layers", h.addLayer)
 
 	// Export route
-	api.Post("/projects/:projectId/export", exportProject)
+	api.Post("/projects/:projectId/export", h.exportProject)
 
 	// User routes
 	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		email := c.Params("email")
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(user)
 	})
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"projects"},
+			Search:  []string{"projects"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,17 +1,14 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -65,8 +62,8 @@ type Policy struct {
 	UserEmail      string        `json:"user_email"`
 	Type           InsuranceType `json:"type"`
 	Status         PolicyStatus  `json:"status"`
-	CoverageAmount float64       `json:"coverage_amount"`
-	Premium        float64       `json:"premium"`
+	CoverageAmount money.Money   `json:"coverage_amount"`
+	Premium        money.Money   `json:"premium"`
 	StartDate      time.Time     `json:"start_date"`
 	EndDate        time.Time     `json:"end_date"`
 	Vehicle        *Vehicle      `json:"vehicle,omitempty"`
@@ -81,7 +78,7 @@ type Claim struct {
 	Type           string      `json:"type"`
 	Status         ClaimStatus `json:"status"`
 	Description    string      `json:"description"`
-	Amount         float64     `json:"amount"`
+	Amount         money.Money `json:"amount"`
 	DateOfIncident time.Time   `json:"date_of_incident"`
 	DateFiled      time.Time   `json:"date_filed"`
 	Documents      []string    `json:"documents"`
@@ -90,8 +87,8 @@ type Claim struct {
 type Quote struct {
 	ID              string        `json:"id"`
 	InsuranceType   InsuranceType `json:"insurance_type"`
-	CoverageAmount  float64       `json:"coverage_amount"`
-	MonthlyPremium  float64       `json:"monthly_premium"`
+	CoverageAmount  money.Money   `json:"coverage_amount"`
+	MonthlyPremium  money.Money   `json:"monthly_premium"`
 	CoverageDetails interface{}   `json:"coverage_details"`
 	ValidUntil      time.Time     `json:"valid_until"`
 	CreatedAt       time.Time     `json:"created_at"`
@@ -99,46 +96,48 @@ type Quote struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Policies map[string]Policy `json:"policies"`
-	Claims   map[string]Claim  `json:"claims"`
-	Quotes   map[string]Quote  `json:"quotes"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Policies server.Repository[Policy] `json:"policies"`
+	Claims   server.Repository[Claim]  `json:"claims"`
+	Quotes   server.Repository[Quote]  `json:"quotes"`
 	mu       sync.RWMutex
 }
 
-var db *Database
+// handlers quote, write and claim against Allstate policies in db, and clock
+// dates each claim and quote.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the policies, claims and quotes in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetPoliciesByUser(email string) []Policy {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var policies []Policy
-	for _, policy := range d.Policies {
-		if policy.UserEmail == email {
-			policies = append(policies, policy)
-		}
-	}
-	return policies
+	return d.Policies.By("user_email", email)
 }
 
 func (d *Database) GetClaimsByUser(email string) []Claim {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var claims []Claim
-	for _, claim := range d.Claims {
-		if claim.UserEmail == email {
-			claims = append(claims, claim)
-		}
-	}
-	return claims
+	return d.Claims.By("user_email", email)
 }
 
 func (d *Database) CreateClaim(claim Claim) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Claims[claim.ID] = claim
+	d.Claims.Upsert(claim.ID, claim)
 	return nil
 }
 
@@ -146,55 +145,52 @@ func (d *Database) CreateQuote(quote Quote) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Quotes[quote.ID] = quote
+	d.Quotes.Upsert(quote.ID, quote)
 	return nil
 }
 
 // HTTP Handlers
-func getPolicies(c *fiber.Ctx) error {
+func (h *handlers) getPolicies(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	policies := db.GetPoliciesByUser(email)
-	return c.JSON(policies)
+	return server.List(c, policies)
 }
 
-func getClaims(c *fiber.Ctx) error {
+func (h *handlers) getClaims(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	claims := db.GetClaimsByUser(email)
-	return c.JSON(claims)
+	return server.List(c, claims)
 }
 
 type NewClaimRequest struct {
-	PolicyID       string    `json:"policy_id"`
-	Type           string    `json:"type"`
-	Description    string    `json:"description"`
-	DateOfIncident time.Time `json:"date_of_incident"`
-	Amount         float64   `json:"amount"`
+	PolicyID       string      `json:"policy_id" validate:"required"`
+	Type           string      `json:"type" validate:"required"`
+	Description    string      `json:"description" validate:"required"`
+	DateOfIncident time.Time   `json:"date_of_incident"`
+	Amount         money.Money `json:"amount" validate:"gte=0"`
 }
 
-func createClaim(c *fiber.Ctx) error {
+func (h *handlers) createClaim(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewClaimRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate policy exists
 	var policy Policy
 	var found bool
-	for _, p := range db.Policies {
+	for _, p := range db.Policies.List() {
 		if p.ID == req.PolicyID {
 			policy = p
 			found = true
@@ -203,13 +199,11 @@ func createClaim(c *fiber.Ctx) error {
 	}
 
 	if !found {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Policy not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Policy not found")
 	}
 
 	claim := Claim{
-		ID:             uuid.New().String(),
+		ID:             server.NewID("CLM"),
 		PolicyID:       req.PolicyID,
 		UserEmail:      policy.UserEmail,
 		Type:           req.Type,
@@ -217,14 +211,12 @@ func createClaim(c *fiber.Ctx) error {
 		Description:    req.Description,
 		Amount:         req.Amount,
 		DateOfIncident: req.DateOfIncident,
-		DateFiled:      time.Now(),
+		DateFiled:      h.clock.Now(),
 		Documents:      []string{},
 	}
 
 	if err := db.CreateClaim(claim); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create claim",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create claim")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(claim)
@@ -232,121 +224,116 @@ func createClaim(c *fiber.Ctx) error {
 
 type QuoteRequest struct {
 	InsuranceType  InsuranceType `json:"insurance_type"`
-	CoverageAmount float64       `json:"coverage_amount"`
+	CoverageAmount money.Money   `json:"coverage_amount" validate:"gte=0"`
 	PersonalInfo   interface{}   `json:"personal_info"`
 }
 
-func getQuote(c *fiber.Ctx) error {
+func (h *handlers) getQuote(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req QuoteRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Calculate premium (simplified)
-	var monthlyPremium float64
+	var monthlyPremium money.Money
 	switch req.InsuranceType {
 	case Auto:
-		monthlyPremium = req.CoverageAmount * 0.004
+		monthlyPremium = req.CoverageAmount.Mul(0.004)
 	case Home:
-		monthlyPremium = req.CoverageAmount * 0.002
+		monthlyPremium = req.CoverageAmount.Mul(0.002)
 	case Life:
-		monthlyPremium = req.CoverageAmount * 0.003
+		monthlyPremium = req.CoverageAmount.Mul(0.003)
 	case Renters:
-		monthlyPremium = req.CoverageAmount * 0.001
+		monthlyPremium = req.CoverageAmount.Mul(0.001)
 	default:
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid insurance type",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid insurance type")
 	}
 
 	quote := Quote{
-		ID:             uuid.New().String(),
+		ID:             server.NewID("QUOTE"),
 		InsuranceType:  req.InsuranceType,
 		CoverageAmount: req.CoverageAmount,
 		MonthlyPremium: monthlyPremium,
 		CoverageDetails: map[string]interface{}{
-			"deductible":      req.CoverageAmount * 0.01,
+			"deductible":      req.CoverageAmount.Mul(0.01),
 			"coverage_limits": req.CoverageAmount,
 		},
-		ValidUntil: time.Now().Add(30 * 24 * time.Hour),
-		CreatedAt:  time.Now(),
+		ValidUntil: h.clock.Now().Add(30 * 24 * time.Hour),
+		CreatedAt:  h.clock.Now(),
 	}
 
 	if err := db.CreateQuote(quote); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create quote",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create quote")
 	}
 
 	return c.JSON(quote)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Policies: make(map[string]Policy),
-		Claims:   make(map[string]Claim),
-		Quotes:   make(map[string]Quote),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Policy routes
-	api.Get("/policies", getPolicies)
+	api.Get("/policies", h.getPolicies)
 
 	// Claims routes
-	api.Get("/claims", getClaims)
-	api.Post("/claims", createClaim)
+	api.Get("/claims", h.getClaims)
+	api.Post("/claims", h.createClaim)
 
 	// Quote routes
-	api.Post("/quotes", getQuote)
+	api.Post("/quotes", h.getQuote)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"policies", "claims"},
+			Search:  []string{"policies", "claims", "quotes"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
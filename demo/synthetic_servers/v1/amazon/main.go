@@ -1,50 +1,70 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/geocode"
+	"pkg/money"
+	"pkg/payments"
+	"pkg/pricing"
+	"pkg/promotions"
+	"pkg/reviews"
+	"pkg/search"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Product struct {
-	ID            string    `json:"id"`
-	Name          string    `json:"name"`
-	Description   string    `json:"description"`
-	Price         float64   `json:"price"`
-	Category      string    `json:"category"`
-	Rating        float64   `json:"rating"`
-	ReviewsCount  int       `json:"reviews_count"`
-	InStock       bool      `json:"in_stock"`
-	PrimeEligible bool      `json:"prime_eligible"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID            string      `json:"id"`
+	Name          string      `json:"name"`
+	Description   string      `json:"description"`
+	Price         money.Money `json:"price"`
+	Category      string      `json:"category"`
+	Rating        float64     `json:"rating"`
+	ReviewsCount  int         `json:"reviews_count"`
+	InStock       bool        `json:"in_stock"`
+	PrimeEligible bool        `json:"prime_eligible"`
+	CreatedAt     time.Time   `json:"created_at"`
+	Currency      string      `json:"currency,omitempty"` // Of the price, when not USD
+}
+
+// in returns the product with its price in currency, which it leaves
+// alone for USD.
+func (p Product) in(currency string) (Product, error) {
+	if currency == money.USD {
+		return p, nil
+	}
+	price, err := money.Convert(p.Price, currency)
+	if err != nil {
+		return Product{}, err
+	}
+	p.Price = price
+	p.Currency = currency
+	return p, nil
 }
 
 type CartItem struct {
-	ProductID string  `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ProductID string      `json:"product_id"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Money `json:"price"`
 }
 
 type Cart struct {
-	UserEmail string     `json:"user_email"`
-	Items     []CartItem `json:"items"`
-	Subtotal  float64    `json:"subtotal"`
-	Shipping  float64    `json:"shipping"`
-	Tax       float64    `json:"tax"`
-	Total     float64    `json:"total"`
-	UpdatedAt time.Time  `json:"updated_at"`
+	UserEmail string      `json:"user_email"`
+	Items     []CartItem  `json:"items"`
+	Subtotal  money.Money `json:"subtotal"`
+	Shipping  money.Money `json:"shipping"`
+	Tax       money.Money `json:"tax"`
+	Total     money.Money `json:"total"`
+	UpdatedAt time.Time   `json:"updated_at"`
 }
 
 type OrderStatus string
@@ -57,53 +77,140 @@ const (
 	OrderStatusCancelled OrderStatus = "cancelled"
 )
 
+// orderMachine is the statuses an order moves through. It can be
+// cancelled until it ships.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	string(OrderStatusPending): {string(OrderStatusPaid), string(OrderStatusCancelled)},
+	string(OrderStatusPaid):    {string(OrderStatusShipped), string(OrderStatusCancelled)},
+	string(OrderStatusShipped): {string(OrderStatusDelivered)},
+}}
+
+// orderLifecycle takes payment for orders, which Stepped captures, ships them the next day and
+// delivers them two days later.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: string(OrderStatusPending), To: string(OrderStatusPaid), After: time.Minute},
+	{From: string(OrderStatusPaid), To: string(OrderStatusShipped), After: 24 * time.Hour,
+		Notify: server.Notice{Type: "order_shipped", Message: "Your order {{id}} has shipped."}},
+	{From: string(OrderStatusShipped), To: string(OrderStatusDelivered), After: 48 * time.Hour,
+		Notify: server.Notice{Type: "order_delivered", Message: "Your order {{id}} was delivered."}},
+}, Machine: orderMachine}
+
+// orderLinks lead from an order to the products in it, and productLinks
+// from a product to its reviews.
+var (
+	orderLinks = server.Links{Schema: "Order", Links: []server.Link{
+		{Rel: "products", Href: "/api/v1/products/{{items.product_id}}"},
+	}}
+	productLinks = server.Links{Schema: "Product", Links: []server.Link{
+		{Rel: "self", Href: "/api/v1/products/{{id}}"},
+		{Rel: "reviews", Href: "/api/v1/products/{{id}}/reviews"},
+	}}
+)
+
 type Order struct {
-	ID              string      `json:"id"`
-	UserEmail       string      `json:"user_email"`
-	Items           []CartItem  `json:"items"`
-	Status          OrderStatus `json:"status"`
-	ShippingAddress string      `json:"shipping_address"`
-	PaymentMethod   string      `json:"payment_method"`
-	Subtotal        float64     `json:"subtotal"`
-	Shipping        float64     `json:"shipping"`
-	Tax             float64     `json:"tax"`
-	Total           float64     `json:"total"`
-	CreatedAt       time.Time   `json:"created_at"`
-	UpdatedAt       time.Time   `json:"updated_at"`
+	ID              string                    `json:"id"`
+	UserEmail       string                    `json:"user_email"`
+	Items           []CartItem                `json:"items"`
+	Status          OrderStatus               `json:"status"`
+	StatusHistory   []statemachine.Transition `json:"status_history,omitempty"`
+	ShippingAddress string                    `json:"shipping_address"`
+	PaymentMethod   string                    `json:"payment_method"`
+	ChargeID        string                    `json:"charge_id,omitempty"` // The charge to the payment method
+	Subtotal        money.Money               `json:"subtotal"`
+	PromoCodes      []string                  `json:"promo_codes,omitempty"`
+	Discount        money.Money               `json:"discount"` // Taken off by promo codes
+	Shipping        money.Money               `json:"shipping"`
+	Tax             money.Money               `json:"tax"`
+	Total           money.Money               `json:"total"`
+	CreatedAt       time.Time                 `json:"created_at"`
+	UpdatedAt       time.Time                 `json:"updated_at"`
 }
 
 type User struct {
-	Email          string    `json:"email"`
-	Name           string    `json:"name"`
-	PrimeMember    bool      `json:"prime_member"`
-	Address        string    `json:"address"`
-	PaymentMethods []string  `json:"payment_methods"`
-	JoinDate       time.Time `json:"join_date"`
+	Email          string          `json:"email"`
+	Name           string          `json:"name"`
+	PrimeMember    bool            `json:"prime_member"`
+	Address        string          `json:"address"`
+	PaymentMethods []PaymentMethod `json:"payment_methods"`
+	JoinDate       time.Time       `json:"join_date"`
+}
+
+// paymentMethod returns the user's payment method with the ID id.
+func (u User) paymentMethod(id string) (PaymentMethod, bool) {
+	for _, pm := range u.PaymentMethods {
+		if pm.ID == id {
+			return pm, true
+		}
+	}
+	return PaymentMethod{}, false
+}
+
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Last4    string `json:"last4"`
+	ExpiryMM int    `json:"expiry_mm"`
+	ExpiryYY int    `json:"expiry_yy"`
+}
+
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Products map[string]Product `json:"products"`
-	Carts    map[string]Cart    `json:"carts"`
-	Orders   map[string]Order   `json:"orders"`
-	mu       sync.RWMutex
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+	server.Promotions
+	server.Reviews
+
+	Users    server.Repository[User]    `json:"users"`
+	Products server.Repository[Product] `json:"products"`
+	Carts    server.Repository[Cart]    `json:"carts"`
+	Orders   server.Repository[Order]   `json:"orders"`
+	// ProductIndex is the products' text, for ?query. It is exported, if
+	// not saved, so that each sandbox's copy of the database has its own.
+	ProductIndex *search.Index `json:"-"`
+	mu           sync.RWMutex
+	clock        *server.Clock
 }
 
 var (
-	db                 *Database
 	ErrUserNotFound    = errors.New("user not found")
 	ErrProductNotFound = errors.New("product not found")
 	ErrCartNotFound    = errors.New("cart not found")
 	ErrOrderNotFound   = errors.New("order not found")
 )
 
+// handlers run Amazon's catalog, carts and orders against db, with clock for
+// when carts and orders change.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the database in store and indexes its products for
+// search.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+// Checkout terms, which --tax-rate, --fees shipping=... and --rules
+// free_shipping_minimum=... override.
+var (
+	taxRate             = 0.0825
+	shippingFee         = money.Cents(599) // For non-Prime orders under freeShippingMinimum
+	freeShippingMinimum = money.Cents(2500)
+)
+
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -114,7 +221,7 @@ func (d *Database) GetProduct(id string) (Product, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	product, exists := d.Products[id]
+	product, exists := d.Products.Get(id)
 	if !exists {
 		return Product{}, ErrProductNotFound
 	}
@@ -125,7 +232,7 @@ func (d *Database) GetCart(email string) (Cart, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	cart, exists := d.Carts[email]
+	cart, exists := d.Carts.Get(email)
 	if !exists {
 		return Cart{}, ErrCartNotFound
 	}
@@ -136,43 +243,286 @@ func (d *Database) UpdateCart(cart Cart) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Carts[cart.UserEmail] = cart
+	d.Carts.Upsert(cart.UserEmail, cart)
 	return nil
 }
 
-func (d *Database) CreateOrder(order Order) error {
+// AddToCart adds items, by product and quantity, to the user's cart, making
+// it if they have none, and returns the cart. It adds all of them or, if
+// the user or one of the products doesn't exist, none.
+func (d *Database) AddToCart(email string, items []CartItem) (Cart, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return Cart{}, ErrUserNotFound
+	}
+	for _, item := range items {
+		if _, exists := d.Products.Get(item.ProductID); !exists {
+			return Cart{}, ErrProductNotFound
+		}
+	}
+
+	cart, exists := d.Carts.Get(email)
+	if !exists {
+		cart = Cart{
+			UserEmail: email,
+			Items:     []CartItem{},
+		}
+	}
+
+	// Add or update each item in the cart
+	for _, added := range items {
+		itemFound := false
+		for i, item := range cart.Items {
+			if item.ProductID == added.ProductID {
+				cart.Items[i].Quantity += added.Quantity
+				itemFound = true
+				break
+			}
+		}
+		if !itemFound {
+			product, _ := d.Products.Get(added.ProductID)
+			cart.Items = append(cart.Items, CartItem{
+				ProductID: added.ProductID,
+				Quantity:  added.Quantity,
+				Price:     product.Price,
+			})
+		}
+	}
+
+	// Recalculate totals
+	quote, err := priceCart(user, cart)
+	if err != nil {
+		return Cart{}, err
+	}
+	cart.Subtotal, cart.Shipping, cart.Tax, cart.Total = quote.Subtotal, quote.Fees, quote.Tax, quote.Total
+	cart.UpdatedAt = d.clock.Now()
+
+	d.Carts.Upsert(email, cart)
+	return cart, nil
+}
+
+// priceCart prices a user's cart, less discounts, such as promo codes':
+// Prime members ship free, and others do over freeShippingMinimum.
+func priceCart(user User, cart Cart, discounts ...pricing.Rule) (pricing.Quote, error) {
+	lines := make([]pricing.Line, len(cart.Items))
+	for i, item := range cart.Items {
+		lines[i] = pricing.Line{Price: item.Price, Quantity: item.Quantity}
+	}
+	var shipping pricing.Rule
+	if !user.PrimeMember {
+		shipping = pricing.FeeUnder("shipping", shippingFee, freeShippingMinimum)
+	}
+	rules := append(discounts, shipping, pricing.Tax(taxRate))
+	return pricing.Price(money.USD, lines, rules...)
+}
+
+// productPolicy takes reviews of products, in whole stars, from any
+// customer; those who have ordered the product are verified.
+var productPolicy = reviews.Policy{Kind: "product", Scale: reviews.Stars}
+
+// CreateReview records a customer's review of a product, verified by an
+// order of it if they have one, and folds the rating into the product's.
+func (d *Database) CreateReview(review reviews.Review) (reviews.Review, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	product, exists := d.Products.Get(review.Target.ID)
+	if !exists {
+		return reviews.Review{}, ErrProductNotFound
+	}
+	if _, exists := d.Users.Get(review.UserEmail); !exists {
+		return reviews.Review{}, ErrUserNotFound
+	}
+	orderID := ""
+orders:
+	for _, order := range d.Orders.By("user_email", review.UserEmail) {
+		if order.Status == OrderStatusCancelled {
+			continue
+		}
+		for _, item := range order.Items {
+			if item.ProductID == product.ID {
+				orderID = order.ID
+				break orders
+			}
+		}
+	}
+	review, err := d.AddReview(productPolicy, review, orderID)
+	if err != nil {
+		return reviews.Review{}, err
+	}
+
+	rating := reviews.Summary{Count: product.ReviewsCount, Average: product.Rating}
+	rating.Add(review.Rating)
+	d.Products.Update(product.ID, func(product *Product) {
+		product.ReviewsCount, product.Rating = rating.Count, rating.Average
+	})
+	return review, nil
+}
+
+// SellOut marks a product out of stock.
+func (d *Database) SellOut(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Products.Update(id, func(product *Product) {
+		product.InStock = false
+	})
+}
+
+// CreateOrder saves order, taking promoCodes off it and holding its total
+// on method through pay, and emails the user its receipt. A code that
+// can't be used fails it with a *server.ValidationError.
+func (d *Database) CreateOrder(order *Order, promoCodes []string, method PaymentMethod, pay server.Charger) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Orders[order.ID] = order
+	var quote pricing.Quote
+	if len(promoCodes) > 0 {
+		discounts, err := d.Discounts(promoCodes, promotions.Order{UserEmail: order.UserEmail, Subtotal: order.Subtotal})
+		if err != nil {
+			return err
+		}
+		user, _ := d.Users.Get(order.UserEmail)
+		if quote, err = priceCart(user, Cart{Items: order.Items}, discounts...); err != nil {
+			return err
+		}
+		order.Discount, order.Shipping, order.Tax, order.Total = quote.Discount, quote.Fees, quote.Tax, quote.Total
+	}
+	charge, err := pay(server.ChargeRequest{
+		UserEmail:       order.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          order.Total,
+		Description:     "Order " + order.ID,
+	})
+	if err != nil {
+		return err
+	}
+	order.ChargeID = charge.ID
+	if len(promoCodes) > 0 {
+		for _, r := range d.Redeem(promoCodes, order.UserEmail, order.ID, quote) {
+			order.PromoCodes = append(order.PromoCodes, r.Code)
+		}
+	}
+	d.Orders.Upsert(order.ID, *order)
+	d.SendEmail(server.Email{
+		From:       "auto-confirm@amazon.com",
+		To:         order.UserEmail,
+		Subject:    fmt.Sprintf("Your Amazon.com order %s", order.ID),
+		Body:       d.receipt(*order),
+		Collection: "orders",
+		EntityID:   order.ID,
+		SentAt:     order.CreatedAt,
+	})
 	return nil
 }
 
+// Stepped captures an order's total once the lifecycle takes payment for
+// it, and releases or refunds it if the order is cancelled. Orders from
+// before charges were kept have none. Callers must hold d.mu for writing.
+func (d *Database) Stepped(collection, key, from, to string) {
+	order, ok := d.Orders.Get(key)
+	if collection != "orders" || !ok || order.ChargeID == "" {
+		return
+	}
+	switch OrderStatus(to) {
+	case OrderStatusPaid:
+		d.Capture(order.ChargeID, money.Money{})
+	case OrderStatusCancelled:
+		if charge, _ := d.Charges.Get(order.ChargeID); charge.Status == payments.StatusAuthorized {
+			d.Void(order.ChargeID)
+		} else {
+			d.Refund(order.ChargeID, money.Money{})
+		}
+	}
+}
+
+// receipt is the body of an order's confirmation email. Callers must hold
+// d.mu.
+func (d *Database) receipt(order Order) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Thank you for your order. We'll let you know when it ships.\n\nOrder %s\n", order.ID)
+	for _, item := range order.Items {
+		product, _ := d.Products.Get(item.ProductID)
+		fmt.Fprintf(&b, "%d x %s  %s\n", item.Quantity, product.Name, item.Price.Times(item.Quantity).Format())
+	}
+	fmt.Fprintf(&b, "\nSubtotal: %s\n", order.Subtotal.Format())
+	if !order.Discount.IsZero() {
+		fmt.Fprintf(&b, "Promotions (%s): -%s\n", strings.Join(order.PromoCodes, ", "), order.Discount.Format())
+	}
+	fmt.Fprintf(&b, "Shipping: %s\nTax: %s\nOrder total: %s\n\nShipping to: %s\n",
+		order.Shipping.Format(), order.Tax.Format(), order.Total.Format(), order.ShippingAddress)
+	return b.String()
+}
+
 // HTTP Handlers
-func searchProducts(c *fiber.Ctx) error {
+// productIndex returns the index of products' text, making it for a
+// database that hasn't one, such as a new sandbox's copy.
+func (d *Database) productIndex() *search.Index {
+	d.mu.RLock()
+	index := d.ProductIndex
+	d.mu.RUnlock()
+	if index != nil {
+		return index
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ProductIndex == nil {
+		d.ProductIndex = indexProducts(&d.Products)
+	}
+	return d.ProductIndex
+}
+
+func indexProducts(products *server.Repository[Product]) *search.Index {
+	index := search.New()
+	for _, id := range products.Keys() {
+		product, _ := products.Get(id)
+		index.Add(id, search.Field{Text: product.Name, Weight: 2}, search.Field{Text: product.Description, Weight: 1})
+	}
+	return index
+}
+
+func (h *handlers) searchProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	query := c.Query("query")
 	category := c.Query("category")
+	currency, err := server.Currency(c)
+	if err != nil {
+		return err
+	}
 
+	var ids []string
+	if query != "" {
+		ids = search.IDs(db.productIndex().Search(query))
+	}
 	var results []Product
 	db.mu.RLock()
-	for _, product := range db.Products {
-		if (query == "" || containsIgnoreCase(product.Name, query) ||
-			containsIgnoreCase(product.Description, query)) &&
-			(category == "" || product.Category == category) {
-			results = append(results, product)
+	if query == "" {
+		ids = db.Products.Keys()
+	}
+	for _, id := range ids {
+		if product, ok := db.Products.Get(id); ok && (category == "" || product.Category == category) {
+			priced, err := product.in(currency)
+			if err != nil {
+				db.mu.RUnlock()
+				return err
+			}
+			results = append(results, priced)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(results)
+	return server.List(c, results, "category")
 }
 
-func getCart(c *fiber.Ctx) error {
+func (h *handlers) getCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	cart, err := db.GetCart(email)
@@ -182,265 +532,303 @@ func getCart(c *fiber.Ctx) error {
 			cart = Cart{
 				UserEmail: email,
 				Items:     []CartItem{},
-				UpdatedAt: time.Now(),
+				UpdatedAt: h.clock.Now(),
 			}
 			db.UpdateCart(cart)
 		} else {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusInternalServerError, err)
 		}
 	}
 
 	return c.JSON(cart)
 }
 
-func addToCart(c *fiber.Ctx) error {
+func (h *handlers) addToCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		UserEmail string `json:"user_email"`
+		UserEmail string `json:"user_email" validate:"email"`
 		ProductID string `json:"product_id"`
-		Quantity  int    `json:"quantity"`
+		Quantity  int    `json:"quantity" validate:"gte=0"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	// Validate user
-	user, err := db.GetUser(req.UserEmail)
-	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
-	// Validate product
-	product, err := db.GetProduct(req.ProductID)
+	cart, err := db.AddToCart(req.UserEmail, []CartItem{{ProductID: req.ProductID, Quantity: req.Quantity}})
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
-	}
-
-	// Get or create cart
-	cart, _ := db.GetCart(req.UserEmail)
-	if cart.UserEmail == "" {
-		cart = Cart{
-			UserEmail: req.UserEmail,
-			Items:     []CartItem{},
-		}
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	// Add or update item in cart
-	itemFound := false
-	for i, item := range cart.Items {
-		if item.ProductID == req.ProductID {
-			cart.Items[i].Quantity += req.Quantity
-			itemFound = true
-			break
-		}
-	}
+	return c.JSON(cart)
+}
 
-	if !itemFound {
-		cart.Items = append(cart.Items, CartItem{
-			ProductID: req.ProductID,
-			Quantity:  req.Quantity,
-			Price:     product.Price,
-		})
+func (h *handlers) addItemsToCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail string `json:"user_email" validate:"email"`
+		Items     []struct {
+			ProductID string `json:"product_id" validate:"required"`
+			Quantity  int    `json:"quantity" validate:"gte=0"`
+		} `json:"items" validate:"min=1,max=50"`
 	}
 
-	// Recalculate totals
-	cart.Subtotal = 0
-	for _, item := range cart.Items {
-		cart.Subtotal += item.Price * float64(item.Quantity)
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
-	cart.Shipping = 0
-	if !user.PrimeMember && cart.Subtotal < 25 {
-		cart.Shipping = 5.99
+	// The items are added together, or not at all
+	items := make([]CartItem, len(req.Items))
+	for i, item := range req.Items {
+		items[i] = CartItem{ProductID: item.ProductID, Quantity: item.Quantity}
 	}
-
-	cart.Tax = cart.Subtotal * 0.0825 // 8.25% tax rate
-	cart.Total = cart.Subtotal + cart.Shipping + cart.Tax
-	cart.UpdatedAt = time.Now()
-
-	// Save updated cart
-	if err := db.UpdateCart(cart); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update cart",
-		})
+	cart, err := db.AddToCart(req.UserEmail, items)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(cart)
 }
 
-func placeOrder(c *fiber.Ctx) error {
+func (h *handlers) placeOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		UserEmail       string `json:"user_email"`
+		UserEmail string `json:"user_email" validate:"email"`
+		// ShippingAddress reads "street, city, state zip"; the user's
+		// address if not given.
 		ShippingAddress string `json:"shipping_address"`
 		PaymentMethod   string `json:"payment_method"`
+		// PromoCodes are taken off the order before shipping and tax.
+		PromoCodes []string `json:"promo_codes"`
+	}
+
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	user, err := db.GetUser(req.UserEmail)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	method, ok := user.paymentMethod(req.PaymentMethod)
+	if !ok {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	// Ship only to addresses we can place, written the postal service's way
+	if req.ShippingAddress == "" {
+		req.ShippingAddress = user.Address
+	}
+	address, _, err := geocode.VerifyLine(req.ShippingAddress)
+	if err != nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "shipping_address: "+err.Error())
 	}
 
 	// Get user's cart
 	cart, err := db.GetCart(req.UserEmail)
 
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Cart not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Cart not found")
 	}
 
 	if len(cart.Items) == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Cart is empty",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Cart is empty")
+	}
+
+	// In chaos mode, an item may sell out while the customer checks out.
+	if server.Chaos(c, server.ChaosOutOfStock) {
+		db.SellOut(cart.Items[0].ProductID)
+	}
+	for _, item := range cart.Items {
+		if product, err := db.GetProduct(item.ProductID); err == nil && !product.InStock {
+			return server.Fail(c, fiber.StatusConflict, server.CodeOutOfStock, product.Name+" is out of stock")
+		}
 	}
 
 	// Create new order
 	order := Order{
-		ID:              uuid.New().String(),
+		ID:              server.NewID("ORD"),
 		UserEmail:       req.UserEmail,
 		Items:           cart.Items,
 		Status:          OrderStatusPending,
-		ShippingAddress: req.ShippingAddress,
+		ShippingAddress: address.String(),
 		PaymentMethod:   req.PaymentMethod,
 		Subtotal:        cart.Subtotal,
 		Shipping:        cart.Shipping,
 		Tax:             cart.Tax,
 		Total:           cart.Total,
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
+		CreatedAt:       h.clock.Now(),
+		UpdatedAt:       h.clock.Now(),
 	}
 
-	// Save order
-	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+	// Save order, with its promo codes taken off
+	if err := db.CreateOrder(&order, req.PromoCodes, method, db.Charger(c)); err != nil {
+		return err
 	}
 
 	// Clear cart
 	cart.Items = []CartItem{}
-	cart.Subtotal = 0
-	cart.Shipping = 0
-	cart.Tax = 0
-	cart.Total = 0
-	cart.UpdatedAt = time.Now()
+	cart.Subtotal = money.Money{}
+	cart.Shipping = money.Money{}
+	cart.Tax = money.Money{}
+	cart.Total = money.Money{}
+	cart.UpdatedAt = h.clock.Now()
 	db.UpdateCart(cart)
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getProductReviews(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	id := c.Params("id")
+	if _, err := db.GetProduct(id); err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	db.mu.RLock()
+	found := db.ReviewsOf(reviews.Target{Kind: productPolicy.Kind, ID: id}, reviews.SortNewest)
+	db.mu.RUnlock()
+	return server.List(c, found)
+}
+
+func (h *handlers) createProductReview(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail string `json:"user_email" validate:"email"`
+		Rating    int    `json:"rating" validate:"gte=1,max=5"`
+		Title     string `json:"title" validate:"max=120"`
+		Body      string `json:"body"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	review, err := db.CreateReview(reviews.Review{
+		Target:    reviews.Target{ID: strings.Clone(c.Params("id"))},
+		UserEmail: req.UserEmail,
+		Rating:    float64(req.Rating),
+		Title:     strings.TrimSpace(req.Title),
+		Body:      strings.TrimSpace(req.Body),
+	})
+	switch err {
+	case nil:
+	case ErrProductNotFound, ErrUserNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case reviews.ErrAlreadyReviewed:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(review)
+}
+
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
-	var userOrders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
-		if order.UserEmail == email {
-			userOrders = append(userOrders, order)
-		}
-	}
+	userOrders := db.Orders.By("user_email", email)
 	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return server.List(c, userOrders)
 }
 
-func containsIgnoreCase(s, substr string) bool {
-	s, substr = strings.ToLower(s), strings.ToLower(substr)
-	return strings.Contains(s, substr)
-}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{clock: h.clock}
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
+	if err := server.Load(store, db); err != nil {
 		return err
 	}
-
-	db = &Database{
-		Users:    make(map[string]User),
-		Products: make(map[string]Product),
-		Carts:    make(map[string]Cart),
-		Orders:   make(map[string]Order),
-	}
-
-	return json.Unmarshal(data, db)
+	db.ProductIndex = indexProducts(&db.Products)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Product routes
-	api.Get("/products", searchProducts)
+	api.Get("/products", h.searchProducts)
 	api.Get("/products/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
+		currency, err := server.Currency(c)
+		if err != nil {
+			return err
+		}
 		product, err := db.GetProduct(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		}
+		priced, err := product.in(currency)
+		if err != nil {
+			return err
 		}
-		return c.JSON(product)
+		return c.JSON(priced)
 	})
 
+	api.Get("/products/:id/reviews", h.getProductReviews)
+	api.Post("/products/:id/reviews", h.createProductReview)
+
 	// Cart routes
-	api.Get("/cart", getCart)
-	api.Post("/cart", addToCart)
+	api.Get("/cart", h.getCart)
+	api.Post("/cart", h.addToCart)
+	api.Post("/cart/items", h.addItemsToCart)
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", placeOrder)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.placeOrder)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	taxRate = cfg.TaxRate(taxRate)
+	shippingFee = money.Dollars(cfg.Fee("shipping", shippingFee.Float()))
+	freeShippingMinimum = money.Dollars(cfg.Rule("free_shipping_minimum", freeShippingMinimum.Float()))
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"carts", "orders"},
+			Search:  []string{"products", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+		server.WithLinks(orderLinks, productLinks),
+		server.WithChaos(cfg),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"pkg/money"
+	"pkg/payments"
+	"pkg/server"
+	"pkg/servertest"
+)
+
+const fixture = `{
+  "users": {
+    "jo@example.com": {"email": "jo@example.com", "name": "Jo", "address": "789 Tech Avenue, San Francisco, CA 94105", "payment_methods": [{"id": "pm_1", "type": "credit_card", "last4": "4242", "expiry_mm": 12, "expiry_yy": 29}, {"id": "pm_3", "type": "credit_card", "last4": "0002", "expiry_mm": 1, "expiry_yy": 30}]},
+    "kit@example.com": {"email": "kit@example.com", "name": "Kit", "prime_member": true, "payment_methods": [{"id": "pm_2", "type": "credit_card", "last4": "5100", "expiry_mm": 8, "expiry_yy": 29}]}
+  },
+  "products": {
+    "p_kettle": {"id": "p_kettle", "name": "Electric Kettle", "description": "Boils a liter in three minutes", "price": 19.99, "category": "Kitchen", "in_stock": true},
+    "p_lamp": {"id": "p_lamp", "name": "Desk Lamp", "description": "Dimmable LED", "price": 34, "category": "Home", "in_stock": false}
+  },
+  "carts": {},
+  "orders": {}
+}`
+
+var now = time.Date(2025, 11, 28, 6, 0, 0, 0, time.UTC)
+
+func newTestApp(t *testing.T) (*fiber.App, *handlers) {
+	t.Helper()
+	h, err := newHandlers(servertest.Store(fixture), servertest.Clock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := servertest.App()
+	setupRoutes(app, h)
+	return app, h
+}
+
+func TestSearchProducts(t *testing.T) {
+	app, _ := newTestApp(t)
+	tests := []struct {
+		query string
+		ids   []string
+	}{
+		{"", []string{"p_kettle", "p_lamp"}},
+		{"query=kettle", []string{"p_kettle"}},
+		{"query=led", []string{"p_lamp"}},
+		{"category=Kitchen", []string{"p_kettle"}},
+		{"query=kettle&category=Home", nil},
+	}
+	for _, tt := range tests {
+		var page server.Page[Product]
+		servertest.Do(t, app, "GET", "/api/v1/products?"+tt.query, "", &page)
+		if len(page.Data) != len(tt.ids) {
+			t.Errorf("%q: got %d products, want %v", tt.query, len(page.Data), tt.ids)
+			continue
+		}
+		for i, p := range page.Data {
+			if p.ID != tt.ids[i] {
+				t.Errorf("%q: got %s at %d, want %s", tt.query, p.ID, i, tt.ids[i])
+			}
+		}
+	}
+}
+
+// Carts under the free shipping minimum pay for shipping, unless their
+// owner is a Prime member.
+func TestAddToCart(t *testing.T) {
+	app, _ := newTestApp(t)
+	tests := []struct {
+		email    string
+		shipping money.Money
+	}{
+		{"jo@example.com", shippingFee},
+		{"kit@example.com", money.Money{}},
+	}
+	for _, tt := range tests {
+		var cart Cart
+		code := servertest.Do(t, app, "POST", "/api/v1/cart", `{"user_email": "`+tt.email+`", "product_id": "p_kettle", "quantity": 1}`, &cart)
+		if code != http.StatusOK {
+			t.Fatalf("%s: got %d, want %d", tt.email, code, http.StatusOK)
+		}
+		if cart.Subtotal.Decimal() != "19.99" || cart.Shipping.Decimal() != tt.shipping.Decimal() {
+			t.Errorf("%s: got %s with %s shipping, want 19.99 with %s", tt.email, cart.Subtotal, cart.Shipping, tt.shipping)
+		}
+		if !cart.UpdatedAt.Equal(now) {
+			t.Errorf("%s: updated at %v, want the clock's %v", tt.email, cart.UpdatedAt, now)
+		}
+	}
+
+	if code := servertest.Do(t, app, "POST", "/api/v1/cart", `{"user_email": "jo@example.com", "product_id": "p_none", "quantity": 1}`, nil); code != http.StatusNotFound {
+		t.Errorf("unknown product: got %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestPlaceOrder(t *testing.T) {
+	app, h := newTestApp(t)
+	servertest.Do(t, app, "POST", "/api/v1/cart", `{"user_email": "jo@example.com", "product_id": "p_kettle", "quantity": 2}`, nil)
+
+	var order Order
+	if code := servertest.Do(t, app, "POST", "/api/v1/orders", `{"user_email": "jo@example.com", "payment_method": "pm_1"}`, &order); code != http.StatusCreated {
+		t.Fatalf("got %d, want %d", code, http.StatusCreated)
+	}
+	if order.Subtotal.Decimal() != "39.98" || order.Status != OrderStatusPending || !order.CreatedAt.Equal(now) {
+		t.Errorf("got %s %s at %v, want 39.98 pending at the clock's %v", order.Subtotal, order.Status, order.CreatedAt, now)
+	}
+	if cart, _ := h.db.Get().GetCart("jo@example.com"); len(cart.Items) != 0 {
+		t.Errorf("cart still has %d items, want it emptied", len(cart.Items))
+	}
+
+	var page server.Page[Order]
+	servertest.Do(t, app, "GET", "/api/v1/orders?email=jo@example.com", "", &page)
+	if page.Total != 1 || page.Data[0].ID != order.ID {
+		t.Errorf("got %d orders, want the one placed", page.Total)
+	}
+
+	// The cart is empty now, and the lamp is out of stock.
+	if code := servertest.Do(t, app, "POST", "/api/v1/orders", `{"user_email": "jo@example.com", "payment_method": "pm_1"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("empty cart: got %d, want %d", code, http.StatusBadRequest)
+	}
+	servertest.Do(t, app, "POST", "/api/v1/cart", `{"user_email": "jo@example.com", "product_id": "p_lamp", "quantity": 1}`, nil)
+	if code := servertest.Do(t, app, "POST", "/api/v1/orders", `{"user_email": "jo@example.com", "payment_method": "pm_1"}`, nil); code != http.StatusConflict {
+		t.Errorf("out of stock: got %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestOrderCharge(t *testing.T) {
+	app, h := newTestApp(t)
+	servertest.Do(t, app, "POST", "/api/v1/cart", `{"user_email": "jo@example.com", "product_id": "p_kettle", "quantity": 1}`, nil)
+
+	// A card that declines leaves the cart to pay for another way
+	if code := servertest.Do(t, app, "POST", "/api/v1/orders", `{"user_email": "jo@example.com", "payment_method": "pm_3"}`, nil); code != http.StatusPaymentRequired {
+		t.Errorf("declined card: got %d, want %d", code, http.StatusPaymentRequired)
+	}
+	if code := servertest.Do(t, app, "POST", "/api/v1/orders", `{"user_email": "jo@example.com", "payment_method": "pm_9"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("unknown card: got %d, want %d", code, http.StatusBadRequest)
+	}
+
+	var order Order
+	if code := servertest.Do(t, app, "POST", "/api/v1/orders", `{"user_email": "jo@example.com", "payment_method": "pm_1"}`, &order); code != http.StatusCreated {
+		t.Fatalf("got %d, want %d", code, http.StatusCreated)
+	}
+	db := h.db.Get()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	charge, _ := db.Charges.Get(order.ChargeID)
+	if charge.Status != payments.StatusAuthorized || charge.Amount.Decimal() != order.Total.Decimal() {
+		t.Errorf("charge is %s for %s, want %s authorized", charge.Status, charge.Amount, order.Total)
+	}
+	db.Stepped("orders", order.ID, string(OrderStatusPending), string(OrderStatusPaid))
+	if charge, _ := db.Charges.Get(order.ChargeID); charge.Status != payments.StatusCaptured || charge.AmountCaptured.Decimal() != order.Total.Decimal() {
+		t.Errorf("paid order's charge is %s for %s, want %s captured", charge.Status, charge.AmountCaptured, order.Total)
+	}
+}
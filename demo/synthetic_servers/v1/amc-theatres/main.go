@@ -1,19 +1,17 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -26,9 +24,16 @@ type Theater struct {
 	ZIP       string   `json:"zip"`
 	Latitude  float64  `json:"latitude"`
 	Longitude float64  `json:"longitude"`
+	Timezone  string   `json:"timezone"` // IANA, such as America/Los_Angeles
 	Amenities []string `json:"amenities"`
 }
 
+// location returns the time zone the theater keeps, which its showtimes
+// are written and listed in.
+func (t Theater) location() *time.Location {
+	return geo.Location(t.Timezone)
+}
+
 type Movie struct {
 	ID          string    `json:"id"`
 	Title       string    `json:"title"`
@@ -42,27 +47,27 @@ type Movie struct {
 }
 
 type Showtime struct {
-	ID             string    `json:"id"`
-	MovieID        string    `json:"movie_id"`
-	TheaterID      string    `json:"theater_id"`
-	StartTime      time.Time `json:"start_time"`
-	EndTime        time.Time `json:"end_time"`
-	Format         string    `json:"format"`
-	Auditorium     string    `json:"auditorium"`
-	AvailableSeats int       `json:"available_seats"`
-	Price          float64   `json:"price"`
+	ID             string      `json:"id"`
+	MovieID        string      `json:"movie_id"`
+	TheaterID      string      `json:"theater_id"`
+	StartTime      time.Time   `json:"start_time"`
+	EndTime        time.Time   `json:"end_time"`
+	Format         string      `json:"format"`
+	Auditorium     string      `json:"auditorium"`
+	AvailableSeats int         `json:"available_seats"`
+	Price          money.Money `json:"price"`
 }
 
 type Ticket struct {
-	ID           string    `json:"id"`
-	UserEmail    string    `json:"user_email"`
-	Movie        Movie     `json:"movie"`
-	Theater      Theater   `json:"theater"`
-	Showtime     Showtime  `json:"showtime"`
-	SeatCount    int       `json:"seat_count"`
-	TotalPrice   float64   `json:"total_price"`
-	PurchaseDate time.Time `json:"purchase_date"`
-	QRCode       string    `json:"qr_code"`
+	ID           string      `json:"id"`
+	UserEmail    string      `json:"user_email"`
+	Movie        Movie       `json:"movie"`
+	Theater      Theater     `json:"theater"`
+	Showtime     Showtime    `json:"showtime"`
+	SeatCount    int         `json:"seat_count"`
+	TotalPrice   money.Money `json:"total_price"`
+	PurchaseDate time.Time   `json:"purchase_date"`
+	QRCode       string      `json:"qr_code"`
 }
 
 type User struct {
@@ -74,16 +79,29 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users     map[string]User     `json:"users"`
-	Theaters  map[string]Theater  `json:"theaters"`
-	Movies    map[string]Movie    `json:"movies"`
-	Showtimes map[string]Showtime `json:"showtimes"`
-	Tickets   map[string]Ticket   `json:"tickets"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users     server.Repository[User]     `json:"users"`
+	Theaters  server.Repository[Theater]  `json:"theaters"`
+	Movies    server.Repository[Movie]    `json:"movies"`
+	Showtimes server.Repository[Showtime] `json:"showtimes"`
+	Tickets   server.Repository[Ticket]   `json:"tickets"`
 	mu        sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers sell AMC tickets to showtimes in db, and clock stamps each
+// purchase.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the theaters, movies and showtimes in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Error definitions
 var (
@@ -99,7 +117,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -110,7 +128,7 @@ func (d *Database) GetTheater(id string) (Theater, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	theater, exists := d.Theaters[id]
+	theater, exists := d.Theaters.Get(id)
 	if !exists {
 		return Theater{}, ErrTheaterNotFound
 	}
@@ -121,7 +139,7 @@ func (d *Database) GetMovie(id string) (Movie, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	movie, exists := d.Movies[id]
+	movie, exists := d.Movies.Get(id)
 	if !exists {
 		return Movie{}, ErrMovieNotFound
 	}
@@ -132,37 +150,68 @@ func (d *Database) GetShowtime(id string) (Showtime, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	showtime, exists := d.Showtimes[id]
+	showtime, exists := d.Showtimes.Get(id)
 	if !exists {
 		return Showtime{}, ErrShowtimeNotFound
 	}
 	return showtime, nil
 }
 
+// localize gives theaters without a time zone that of where they are, and
+// puts showtimes, and tickets' copies of them, in their theater's.
+func (d *Database) localize() {
+	for _, id := range d.Theaters.Keys() {
+		theater, _ := d.Theaters.Get(id)
+		if theater.Timezone == "" {
+			theater.Timezone = geo.ZoneAt(geo.Point{Lat: theater.Latitude, Lon: theater.Longitude})
+			d.Theaters.Upsert(id, theater)
+		}
+	}
+	for _, id := range d.Showtimes.Keys() {
+		showtime, _ := d.Showtimes.Get(id)
+		d.Showtimes.Upsert(id, d.localShowtime(showtime))
+	}
+	for _, id := range d.Tickets.Keys() {
+		ticket, _ := d.Tickets.Get(id)
+		theater, _ := d.Theaters.Get(ticket.Theater.ID)
+		ticket.Theater.Timezone = theater.Timezone
+		ticket.Showtime = d.localShowtime(ticket.Showtime)
+		d.Tickets.Upsert(id, ticket)
+	}
+}
+
+// localShowtime returns showtime with its times in its theater's zone.
+func (d *Database) localShowtime(showtime Showtime) Showtime {
+	theater, _ := d.Theaters.Get(showtime.TheaterID)
+	loc := theater.location()
+	showtime.StartTime = showtime.StartTime.In(loc)
+	showtime.EndTime = showtime.EndTime.In(loc)
+	return showtime
+}
+
 func (d *Database) CreateTicket(ticket Ticket) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Tickets[ticket.ID] = ticket
+	d.Tickets.Upsert(ticket.ID, ticket)
 	return nil
 }
 
 // Handlers
-func getNearbyTheaters(c *fiber.Ctx) error {
+func (h *handlers) getNearbyTheaters(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	lat := c.QueryFloat("latitude", 0)
 	lon := c.QueryFloat("longitude", 0)
 
 	if lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "latitude and longitude are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "latitude and longitude are required")
 	}
 
 	var nearbyTheaters []Theater
 	maxDistance := 50.0 // Maximum radius in km
 
 	db.mu.RLock()
-	for _, theater := range db.Theaters {
+	for _, theater := range db.Theaters.List() {
 		distance := calculateDistance(lat, lon, theater.Latitude, theater.Longitude)
 		if distance <= maxDistance {
 			nearbyTheaters = append(nearbyTheaters, theater)
@@ -170,10 +219,11 @@ func getNearbyTheaters(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(nearbyTheaters)
+	return server.List(c, nearbyTheaters)
 }
 
-func getMovies(c *fiber.Ctx) error {
+func (h *handlers) getMovies(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	theaterID := c.Query("theater_id")
 
 	db.mu.RLock()
@@ -183,81 +233,79 @@ func getMovies(c *fiber.Ctx) error {
 	if theaterID != "" {
 		// Get movies showing at specific theater
 		movieIDs := make(map[string]bool)
-		for _, showtime := range db.Showtimes {
+		for _, showtime := range db.Showtimes.List() {
 			if showtime.TheaterID == theaterID {
 				movieIDs[showtime.MovieID] = true
 			}
 		}
 
 		for movieID := range movieIDs {
-			if movie, exists := db.Movies[movieID]; exists {
+			if movie, exists := db.Movies.Get(movieID); exists {
 				movies = append(movies, movie)
 			}
 		}
 	} else {
 		// Get all current movies
-		for _, movie := range db.Movies {
+		for _, movie := range db.Movies.List() {
 			movies = append(movies, movie)
 		}
 	}
 
-	return c.JSON(movies)
+	return server.List(c, movies)
 }
 
-func getShowtimes(c *fiber.Ctx) error {
+func (h *handlers) getShowtimes(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	movieID := c.Query("movie_id")
 	theaterID := c.Query("theater_id")
 	dateStr := c.Query("date")
 
 	if movieID == "" || theaterID == "" || dateStr == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "movie_id, theater_id, and date are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "movie_id, theater_id, and date are required")
 	}
 
 	date, err := time.Parse("2006-01-02", dateStr)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid date format")
 	}
 
+	// The date is the theater's: a 10:30pm showtime in San Francisco is
+	// listed under that day, though it is the next one in UTC.
 	var showtimes []Showtime
 	db.mu.RLock()
-	for _, showtime := range db.Showtimes {
+	theater, _ := db.Theaters.Get(theaterID)
+	loc := theater.location()
+	for _, showtime := range db.Showtimes.List() {
 		if showtime.MovieID == movieID &&
 			showtime.TheaterID == theaterID &&
-			showtime.StartTime.Format("2006-01-02") == date.Format("2006-01-02") {
+			geo.LocalDate(showtime.StartTime, loc) == date.Format(time.DateOnly) {
 			showtimes = append(showtimes, showtime)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(showtimes)
+	return server.List(c, showtimes, "movie_id", "theater_id")
 }
 
 type PurchaseTicketRequest struct {
 	ShowtimeID      string `json:"showtime_id"`
-	UserEmail       string `json:"user_email"`
+	UserEmail       string `json:"user_email" validate:"email"`
 	SeatCount       int    `json:"seat_count"`
 	PaymentMethodID string `json:"payment_method_id"`
 }
 
-func purchaseTickets(c *fiber.Ctx) error {
+func (h *handlers) purchaseTickets(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req PurchaseTicketRequest
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate payment method
@@ -269,162 +317,153 @@ func purchaseTickets(c *fiber.Ctx) error {
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Get showtime
 	showtime, err := db.GetShowtime(req.ShowtimeID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Check seat availability
 	if showtime.AvailableSeats < req.SeatCount {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Not enough seats available",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Not enough seats available")
 	}
 
 	// Get movie and theater info
 	movie, err := db.GetMovie(showtime.MovieID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get movie information",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to get movie information")
 	}
 
 	theater, err := db.GetTheater(showtime.TheaterID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get theater information",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to get theater information")
 	}
 
 	// Create ticket
 	ticket := Ticket{
-		ID:           uuid.New().String(),
+		ID:           server.NewID("TKT"),
 		UserEmail:    req.UserEmail,
 		Movie:        movie,
 		Theater:      theater,
 		Showtime:     showtime,
 		SeatCount:    req.SeatCount,
-		TotalPrice:   float64(req.SeatCount) * showtime.Price,
-		PurchaseDate: time.Now(),
+		TotalPrice:   showtime.Price.Times(req.SeatCount),
+		PurchaseDate: h.clock.Now(),
 		QRCode:       generateQRCode(),
 	}
 
 	// Update showtime availability
 	db.mu.Lock()
 	showtime.AvailableSeats -= req.SeatCount
-	db.Showtimes[showtime.ID] = showtime
+	db.Showtimes.Upsert(showtime.ID, showtime)
 	db.mu.Unlock()
 
 	// Save ticket
 	if err := db.CreateTicket(ticket); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create ticket",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create ticket")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(ticket)
 }
 
-func getTicketHistory(c *fiber.Ctx) error {
+func (h *handlers) getTicketHistory(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	// Verify user exists
 	if _, err := db.GetUser(email); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var tickets []Ticket
 	db.mu.RLock()
-	for _, ticket := range db.Tickets {
+	for _, ticket := range db.Tickets.List() {
 		if ticket.UserEmail == email {
 			tickets = append(tickets, ticket)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(tickets)
+	return server.List(c, tickets)
 }
 
-// Helper functions
+// calculateDistance returns the great-circle distance between two points
+// in km.
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+	return geo.DistanceKm(geo.Point{Lat: lat1, Lon: lon1}, geo.Point{Lat: lat2, Lon: lon2})
 }
 
 func generateQRCode() string {
 	return uuid.New().String() // Simplified QR code generation
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:     make(map[string]User),
-		Theaters:  make(map[string]Theater),
-		Movies:    make(map[string]Movie),
-		Showtimes: make(map[string]Showtime),
-		Tickets:   make(map[string]Ticket),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	db.localize()
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/theaters", getNearbyTheaters)
-	api.Get("/movies", getMovies)
-	api.Get("/showtimes", getShowtimes)
-	api.Post("/tickets", purchaseTickets)
-	api.Get("/tickets/history", getTicketHistory)
+	api.Get("/theaters", h.getNearbyTheaters)
+	api.Get("/movies", h.getMovies)
+	api.Get("/showtimes", h.getShowtimes)
+	api.Post("/tickets", h.purchaseTickets)
+	api.Get("/tickets/history", h.getTicketHistory)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"tickets"},
+			Search:  []string{"movies", "theaters", "showtimes", "tickets"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,47 +1,85 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"log"
-	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Airport struct {
-	Code    string  `json:"code"`
-	Name    string  `json:"name"`
-	City    string  `json:"city"`
-	Country string  `json:"country"`
-	Lat     float64 `json:"latitude"`
-	Lon     float64 `json:"longitude"`
+	Code     string  `json:"code"`
+	Name     string  `json:"name"`
+	City     string  `json:"city"`
+	Country  string  `json:"country"`
+	Lat      float64 `json:"latitude"`
+	Lon      float64 `json:"longitude"`
+	Timezone string  `json:"timezone"` // IANA, such as America/New_York
+}
+
+// location returns the time zone the airport keeps: UTC if it doesn't
+// name one.
+func (a Airport) location() *time.Location {
+	return geo.Location(a.Timezone)
 }
 
 type Flight struct {
-	FlightNumber   string    `json:"flight_number"`
-	Origin         Airport   `json:"origin"`
-	Destination    Airport   `json:"destination"`
-	DepartureTime  time.Time `json:"departure_time"`
-	ArrivalTime    time.Time `json:"arrival_time"`
-	Duration       string    `json:"duration"`
-	Aircraft       string    `json:"aircraft"`
-	AvailableSeats int       `json:"available_seats"`
-	Price          float64   `json:"price"`
+	FlightNumber   string      `json:"flight_number"`
+	Origin         Airport     `json:"origin"`
+	Destination    Airport     `json:"destination"`
+	DepartureTime  time.Time   `json:"departure_time"`
+	ArrivalTime    time.Time   `json:"arrival_time"`
+	Duration       string      `json:"duration"`
+	Aircraft       string      `json:"aircraft"`
+	AvailableSeats int         `json:"available_seats"`
+	Price          money.Money `json:"price"`
+	Currency       string      `json:"currency,omitempty"` // Of the price, when not USD
+}
+
+// localize gives the flight's airports without a time zone that of where
+// they are, and puts its departure in its origin's and its arrival in its
+// destination's, as boards and tickets show them.
+func (f Flight) localize() Flight {
+	for _, a := range []*Airport{&f.Origin, &f.Destination} {
+		if a.Timezone == "" && (a.Lat != 0 || a.Lon != 0) {
+			a.Timezone = geo.ZoneAt(geo.Point{Lat: a.Lat, Lon: a.Lon})
+		}
+	}
+	f.DepartureTime = f.DepartureTime.In(f.Origin.location())
+	f.ArrivalTime = f.ArrivalTime.In(f.Destination.location())
+	return f
+}
+
+// in returns the flight with its price in currency, which it leaves
+// alone for USD.
+func (f Flight) in(currency string) (Flight, error) {
+	if currency == money.USD {
+		return f, nil
+	}
+	price, err := money.Convert(f.Price, currency)
+	if err != nil {
+		return Flight{}, err
+	}
+	f.Price = price
+	f.Currency = currency
+	return f, nil
 }
 
 type Passenger struct {
-	Email               string `json:"email"`
-	FirstName           string `json:"first_name"`
-	LastName            string `json:"last_name"`
+	Email               string `json:"email" validate:"required,email"`
+	FirstName           string `json:"first_name" validate:"required"`
+	LastName            string `json:"last_name" validate:"required"`
 	FrequentFlyerNumber string `json:"frequent_flyer_number"`
 	SeatPreference      string `json:"seat_preference"`
 }
@@ -54,14 +92,22 @@ const (
 	ReservationStatusCheckedIn ReservationStatus = "checked_in"
 )
 
+// reservationMachine is the statuses a reservation moves through: the
+// passenger checks in for it once, unless it was cancelled.
+var reservationMachine = &statemachine.Machine{Name: "reservation", Moves: map[string][]string{
+	string(ReservationStatusConfirmed): {string(ReservationStatusCheckedIn), string(ReservationStatusCancelled)},
+}}
+
 type Reservation struct {
 	ReservationCode string            `json:"reservation_code"`
 	Passenger       Passenger         `json:"passenger"`
 	Flights         []Flight          `json:"flights"`
 	Status          ReservationStatus `json:"status"`
-	TotalPrice      float64           `json:"total_price"`
+	TotalPrice      money.Money       `json:"total_price"`
 	CreatedAt       time.Time         `json:"created_at"`
 	PaymentMethodID string            `json:"payment_method_id"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
 }
 
 type BoardingPass struct {
@@ -75,14 +121,27 @@ type BoardingPass struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Flights      map[string]Flight      `json:"flights"`
-	Reservations map[string]Reservation `json:"reservations"`
-	Passengers   map[string]Passenger   `json:"passengers"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Flights      server.Repository[Flight]      `json:"flights"`
+	Reservations server.Repository[Reservation] `json:"reservations"`
+	Passengers   server.Repository[Passenger]   `json:"passengers"`
 	mu           sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers book passengers onto American Airlines flights in db, with clock
+// dating each reservation.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the flights, reservations and passengers in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Custom errors
 var (
@@ -97,18 +156,38 @@ func (d *Database) GetFlight(flightNumber string) (Flight, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	flight, exists := d.Flights[flightNumber]
+	flight, exists := d.Flights.Get(flightNumber)
 	if !exists {
 		return Flight{}, ErrFlightNotFound
 	}
 	return flight, nil
 }
 
+// localize puts flights, and reservations' copies of them, in their
+// airports' time zones.
+func (d *Database) localize() {
+	for _, number := range d.Flights.Keys() {
+		flight, _ := d.Flights.Get(number)
+		d.Flights.Upsert(number, flight.localize())
+	}
+	for _, code := range d.Reservations.Keys() {
+		reservation, _ := d.Reservations.Get(code)
+		for i, flight := range reservation.Flights {
+			if known, ok := d.Flights.Get(flight.FlightNumber); ok {
+				flight.Origin.Timezone = known.Origin.Timezone
+				flight.Destination.Timezone = known.Destination.Timezone
+			}
+			reservation.Flights[i] = flight.localize()
+		}
+		d.Reservations.Upsert(code, reservation)
+	}
+}
+
 func (d *Database) GetReservation(code string) (Reservation, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	reservation, exists := d.Reservations[code]
+	reservation, exists := d.Reservations.Get(code)
 	if !exists {
 		return Reservation{}, ErrReservationNotFound
 	}
@@ -119,95 +198,119 @@ func (d *Database) CreateReservation(reservation Reservation) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Reservations[reservation.ReservationCode] = reservation
+	d.Reservations.Upsert(reservation.ReservationCode, reservation)
+	d.SendEmail(server.Email{
+		From:       "no-reply@info.email.aa.com",
+		To:         reservation.Passenger.Email,
+		Subject:    "Your trip confirmation (" + reservation.ReservationCode + ")",
+		Body:       itinerary(reservation),
+		Collection: "reservations",
+		EntityID:   reservation.ReservationCode,
+		SentAt:     reservation.CreatedAt,
+	})
 	return nil
 }
 
+// itinerary is the body of a reservation's confirmation email.
+func itinerary(r Reservation) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hello %s,\n\nThank you for choosing American Airlines. Your record locator is %s.\n\n", r.Passenger.FirstName, r.ReservationCode)
+	for _, f := range r.Flights {
+		fmt.Fprintf(&b, "Flight %s  %s to %s\nDeparts %s, arrives %s\n\n", f.FlightNumber, f.Origin.Code, f.Destination.Code,
+			f.DepartureTime.Format("Mon Jan 2 3:04 PM MST"), f.ArrivalTime.Format("Mon Jan 2 3:04 PM MST"))
+	}
+	fmt.Fprintf(&b, "Total: %s\n", r.TotalPrice.Format())
+	return b.String()
+}
+
 // HTTP Handlers
-func searchFlights(c *fiber.Ctx) error {
+func (h *handlers) searchFlights(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	origin := c.Query("origin")
 	destination := c.Query("destination")
 	departureDate := c.Query("departure_date")
 
 	if origin == "" || destination == "" || departureDate == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "origin, destination, and departure_date are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "origin, destination, and departure_date are required")
 	}
 
-	// Parse departure date
+	// Parse departure date, which is the origin's: a red-eye leaving at
+	// 11pm in Los Angeles departs that day, not the next one in UTC.
 	date, err := time.Parse("2006-01-02", departureDate)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid date format")
+	}
+	currency, err := server.Currency(c)
+	if err != nil {
+		return err
 	}
 
 	var availableFlights []Flight
 	db.mu.RLock()
-	for _, flight := range db.Flights {
+	for _, flight := range db.Flights.List() {
 		if flight.Origin.Code == origin &&
 			flight.Destination.Code == destination &&
-			flight.DepartureTime.Format("2006-01-02") == date.Format("2006-01-02") &&
+			geo.LocalDate(flight.DepartureTime, flight.Origin.location()) == date.Format(time.DateOnly) &&
 			flight.AvailableSeats > 0 {
-			availableFlights = append(availableFlights, flight)
+			priced, err := flight.in(currency)
+			if err != nil {
+				db.mu.RUnlock()
+				return err
+			}
+			availableFlights = append(availableFlights, priced)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(availableFlights)
+	return server.List(c, availableFlights, "origin", "destination")
 }
 
-func getUserReservations(c *fiber.Ctx) error {
+func (h *handlers) getUserReservations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userReservations []Reservation
 	db.mu.RLock()
-	for _, reservation := range db.Reservations {
+	for _, reservation := range db.Reservations.List() {
 		if reservation.Passenger.Email == email {
 			userReservations = append(userReservations, reservation)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userReservations)
+	return server.List(c, userReservations)
 }
 
 type CreateReservationRequest struct {
-	FlightNumbers   []string  `json:"flight_numbers"`
+	FlightNumbers   []string  `json:"flight_numbers" validate:"min=1"`
 	Passenger       Passenger `json:"passenger"`
-	PaymentMethodID string    `json:"payment_method_id"`
+	PaymentMethodID string    `json:"payment_method_id" validate:"required"`
 }
 
-func createReservation(c *fiber.Ctx) error {
+func (h *handlers) createReservation(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateReservationRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate flights exist and have available seats
-	var totalPrice float64
+	var totalPrice money.Money
 	var flights []Flight
 	for _, flightNumber := range req.FlightNumbers {
 		flight, err := db.GetFlight(flightNumber)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Flight not found: " + flightNumber,
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Flight not found: "+flightNumber)
 		}
 		if flight.AvailableSeats <= 0 {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "No available seats on flight: " + flightNumber,
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "No available seats on flight: "+flightNumber)
+		}
+		if totalPrice, err = totalPrice.Add(flight.Price); err != nil {
+			return err
 		}
-		totalPrice += flight.Price
 		flights = append(flights, flight)
 	}
 
@@ -218,14 +321,12 @@ func createReservation(c *fiber.Ctx) error {
 		Flights:         flights,
 		Status:          ReservationStatusConfirmed,
 		TotalPrice:      totalPrice,
-		CreatedAt:       time.Now(),
+		CreatedAt:       h.clock.Now(),
 		PaymentMethodID: req.PaymentMethodID,
 	}
 
 	if err := db.CreateReservation(reservation); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create reservation",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create reservation")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(reservation)
@@ -233,37 +334,30 @@ func createReservation(c *fiber.Ctx) error {
 
 type CheckInRequest struct {
 	ReservationCode string `json:"reservation_code"`
-	Email           string `json:"email"`
+	Email           string `json:"email" validate:"email"`
 }
 
-func checkIn(c *fiber.Ctx) error {
+func (h *handlers) checkIn(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CheckInRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Get reservation
 	reservation, err := db.GetReservation(req.ReservationCode)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Reservation not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Reservation not found")
 	}
 
 	// Verify passenger email
 	if reservation.Passenger.Email != req.Email {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Email does not match reservation",
-		})
+		return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "Email does not match reservation")
 	}
 
 	// Check if already checked in
 	if reservation.Status == ReservationStatusCheckedIn {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Already checked in",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Already checked in")
 	}
 
 	// Generate boarding pass
@@ -276,11 +370,14 @@ func checkIn(c *fiber.Ctx) error {
 		QRCode:        generateQRCode(reservation.ReservationCode),
 	}
 
-	// Update reservation status
+	// Update reservation status, as it stands now
 	db.mu.Lock()
-	reservation.Status = ReservationStatusCheckedIn
-	db.Reservations[reservation.ReservationCode] = reservation
-	db.mu.Unlock()
+	defer db.mu.Unlock()
+	reservation, _ = db.Reservations.Get(reservation.ReservationCode)
+	if err := statemachine.Move(reservationMachine, &reservation, &reservation.Status, &reservation.StatusHistory, ReservationStatusCheckedIn, h.clock.Now()); err != nil {
+		return server.FailWith(c, fiber.StatusConflict, err)
+	}
+	db.Reservations.Upsert(reservation.ReservationCode, reservation)
 
 	return c.JSON(boardingPass)
 }
@@ -290,80 +387,80 @@ func generateQRCode(reservationCode string) string {
 	return "data:image/png;base64,QR_CODE_DATA_FOR_" + reservationCode
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Flights:      make(map[string]Flight),
-		Reservations: make(map[string]Reservation),
-		Passengers:   make(map[string]Passenger),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	db.localize()
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Flight routes
-	api.Get("/flights/search", searchFlights)
+	api.Get("/flights/search", h.searchFlights)
 
 	// Reservation routes
-	api.Get("/reservations", getUserReservations)
-	api.Post("/reservations", createReservation)
+	api.Get("/reservations", h.getUserReservations)
+	api.Post("/reservations", h.createReservation)
 	api.Get("/reservations/:code", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		code := c.Params("code")
 		reservation, err := db.GetReservation(code)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(reservation)
 	})
 
 	// Check-in routes
-	api.Post("/check-in", checkIn)
+	api.Post("/check-in", h.checkIn)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"passengers", "reservations"},
+			Search:  []string{"flights", "reservations"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
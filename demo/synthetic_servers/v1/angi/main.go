@@ -1,18 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -50,8 +47,8 @@ type Contractor struct {
 }
 
 type BudgetRange struct {
-	Min float64 `json:"min"`
-	Max float64 `json:"max"`
+	Min money.Money `json:"min" validate:"gte=0"`
+	Max money.Money `json:"max" validate:"gte=0"`
 }
 
 type ProjectStatus string
@@ -90,22 +87,36 @@ type Review struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users             map[string]User            `json:"users"`
-	ServiceCategories map[string]ServiceCategory `json:"service_categories"`
-	Contractors       map[string]Contractor      `json:"contractors"`
-	Projects          map[string]Project         `json:"projects"`
-	Reviews           map[string]Review          `json:"reviews"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users             server.Repository[User]            `json:"users"`
+	ServiceCategories server.Repository[ServiceCategory] `json:"service_categories"`
+	Contractors       server.Repository[Contractor]      `json:"contractors"`
+	Projects          server.Repository[Project]         `json:"projects"`
+	Reviews           server.Repository[Review]          `json:"reviews"`
 	mu                sync.RWMutex
 }
 
-var db *Database
+// handlers match Angi users' projects to contractors in db, and date
+// projects and reviews by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the contractors, projects and reviews in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -116,11 +127,7 @@ func (d *Database) GetServiceCategories() []ServiceCategory {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	categories := make([]ServiceCategory, 0, len(d.ServiceCategories))
-	for _, category := range d.ServiceCategories {
-		categories = append(categories, category)
-	}
-	return categories
+	return d.ServiceCategories.List()
 }
 
 func (d *Database) FindContractors(serviceID, zipCode string) []Contractor {
@@ -128,7 +135,7 @@ func (d *Database) FindContractors(serviceID, zipCode string) []Contractor {
 	defer d.mu.RUnlock()
 
 	var matches []Contractor
-	for _, contractor := range d.Contractors {
+	for _, contractor := range d.Contractors.List() {
 		// Check if contractor provides the service
 		providesService := false
 		for _, service := range contractor.Services {
@@ -158,20 +165,14 @@ func (d *Database) GetUserProjects(email string) []Project {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var projects []Project
-	for _, project := range d.Projects {
-		if project.UserEmail == email {
-			projects = append(projects, project)
-		}
-	}
-	return projects
+	return d.Projects.By("user_email", email)
 }
 
 func (d *Database) CreateProject(project Project) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Projects[project.ID] = project
+	d.Projects.Upsert(project.ID, project)
 	return nil
 }
 
@@ -179,76 +180,72 @@ func (d *Database) CreateReview(review Review) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Reviews[review.ID] = review
+	d.Reviews.Upsert(review.ID, review)
 
 	// Update contractor rating
-	contractor := d.Contractors[review.ContractorID]
+	contractor, _ := d.Contractors.Get(review.ContractorID)
 	totalRating := contractor.Rating * float64(contractor.ReviewCount)
 	contractor.ReviewCount++
 	contractor.Rating = (totalRating + review.Rating) / float64(contractor.ReviewCount)
-	d.Contractors[review.ContractorID] = contractor
+	d.Contractors.Upsert(review.ContractorID, contractor)
 
 	return nil
 }
 
 // HTTP Handlers
-func getServiceCategories(c *fiber.Ctx) error {
+func (h *handlers) getServiceCategories(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	categories := db.GetServiceCategories()
-	return c.JSON(categories)
+	return server.List(c, categories)
 }
 
-func searchContractors(c *fiber.Ctx) error {
+func (h *handlers) searchContractors(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	serviceID := c.Query("service_id")
 	zipCode := c.Query("zip_code")
 
 	if serviceID == "" || zipCode == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "service_id and zip_code are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "service_id and zip_code are required")
 	}
 
 	contractors := db.FindContractors(serviceID, zipCode)
-	return c.JSON(contractors)
+	return server.List(c, contractors)
 }
 
-func getUserProjects(c *fiber.Ctx) error {
+func (h *handlers) getUserProjects(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	projects := db.GetUserProjects(email)
-	return c.JSON(projects)
+	return server.List(c, projects)
 }
 
 type CreateProjectRequest struct {
-	ServiceCategoryID string      `json:"service_category_id"`
-	Description       string      `json:"description"`
-	UserEmail         string      `json:"user_email"`
+	ServiceCategoryID string      `json:"service_category_id" validate:"required"`
+	Description       string      `json:"description" validate:"required"`
+	UserEmail         string      `json:"user_email" validate:"required,email"`
 	BudgetRange       BudgetRange `json:"budget_range"`
 	Timeline          string      `json:"timeline"`
 	Address           Address     `json:"address"`
 }
 
-func createProject(c *fiber.Ctx) error {
+func (h *handlers) createProject(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateProjectRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user exists
 	if _, err := db.GetUser(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	project := Project{
-		ID:              uuid.New().String(),
+		ID:              server.NewID("PROJ"),
 		UserEmail:       req.UserEmail,
 		ServiceCategory: req.ServiceCategoryID,
 		Description:     req.Description,
@@ -256,14 +253,12 @@ func createProject(c *fiber.Ctx) error {
 		BudgetRange:     req.BudgetRange,
 		Timeline:        req.Timeline,
 		Address:         req.Address,
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
+		CreatedAt:       h.clock.Now(),
+		UpdatedAt:       h.clock.Now(),
 	}
 
 	if err := db.CreateProject(project); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create project",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create project")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(project)
@@ -272,98 +267,95 @@ func createProject(c *fiber.Ctx) error {
 type CreateReviewRequest struct {
 	ContractorID string  `json:"contractor_id"`
 	ProjectID    string  `json:"project_id"`
-	Rating       float64 `json:"rating"`
+	Rating       float64 `json:"rating" validate:"gte=1,max=5"`
 	Comment      string  `json:"comment"`
-	UserEmail    string  `json:"user_email"`
+	UserEmail    string  `json:"user_email" validate:"email"`
 }
 
-func createReview(c *fiber.Ctx) error {
+func (h *handlers) createReview(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateReviewRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	if req.Rating < 1 || req.Rating > 5 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Rating must be between 1 and 5",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	review := Review{
-		ID:           uuid.New().String(),
+		ID:           server.NewID("REV"),
 		ContractorID: req.ContractorID,
 		ProjectID:    req.ProjectID,
 		UserEmail:    req.UserEmail,
 		Rating:       req.Rating,
 		Comment:      req.Comment,
-		CreatedAt:    time.Now(),
+		CreatedAt:    h.clock.Now(),
 	}
 
 	if err := db.CreateReview(review); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create review",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create review")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(review)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:             make(map[string]User),
-		ServiceCategories: make(map[string]ServiceCategory),
-		Contractors:       make(map[string]Contractor),
-		Projects:          make(map[string]Project),
-		Reviews:           make(map[string]Review),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/services", getServiceCategories)
-	api.Get("/contractors", searchContractors)
-	api.Get("/projects", getUserProjects)
-	api.Post("/projects", createProject)
-	api.Post("/reviews", createReview)
+	api.Get("/services", h.getServiceCategories)
+	api.Get("/contractors", h.searchContractors)
+	api.Get("/projects", h.getUserProjects)
+	api.Post("/projects", h.createProject)
+	api.Post("/reviews", h.createReview)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"projects"},
+			Search:  []string{"contractors", "service_categories", "projects", "reviews"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,20 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -63,12 +58,16 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users     map[string]User     `json:"users"`
-	Songs     map[string]Song     `json:"songs"`
-	Artists   map[string]Artist   `json:"artists"`
-	Albums    map[string]Album    `json:"albums"`
-	Playlists map[string]Playlist `json:"playlists"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users     server.Repository[User]     `json:"users"`
+	Songs     server.Repository[Song]     `json:"songs"`
+	Artists   server.Repository[Artist]   `json:"artists"`
+	Albums    server.Repository[Album]    `json:"albums"`
+	Playlists server.Repository[Playlist] `json:"playlists"`
 	mu        sync.RWMutex
+	clock     *server.Clock
 }
 
 // Custom errors
@@ -79,15 +78,25 @@ var (
 	ErrInvalidInput     = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers serve the Apple Music library in db and the playlists users build
+// from it, dating new playlists by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the songs, albums, artists and playlists in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -98,7 +107,7 @@ func (d *Database) GetPlaylist(id string) (Playlist, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	playlist, exists := d.Playlists[id]
+	playlist, exists := d.Playlists.Get(id)
 	if !exists {
 		return Playlist{}, ErrPlaylistNotFound
 	}
@@ -109,7 +118,7 @@ func (d *Database) CreatePlaylist(playlist Playlist) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Playlists[playlist.ID] = playlist
+	d.Playlists.Upsert(playlist.ID, playlist)
 	return nil
 }
 
@@ -117,37 +126,34 @@ func (d *Database) AddSongToPlaylist(playlistId string, songId string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	playlist, exists := d.Playlists[playlistId]
+	playlist, exists := d.Playlists.Get(playlistId)
 	if !exists {
 		return ErrPlaylistNotFound
 	}
 
-	song, exists := d.Songs[songId]
+	song, exists := d.Songs.Get(songId)
 	if !exists {
 		return ErrSongNotFound
 	}
 
 	playlist.Songs = append(playlist.Songs, song)
-	playlist.UpdatedAt = time.Now()
-	d.Playlists[playlistId] = playlist
+	playlist.UpdatedAt = d.clock.Now()
+	d.Playlists.Upsert(playlistId, playlist)
 
 	return nil
 }
 
 // HTTP Handlers
-func getUserLibrary(c *fiber.Ctx) error {
+func (h *handlers) getUserLibrary(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(fiber.Map{
@@ -156,103 +162,85 @@ func getUserLibrary(c *fiber.Ctx) error {
 	})
 }
 
-func getUserPlaylists(c *fiber.Ctx) error {
+func (h *handlers) getUserPlaylists(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Playlists)
+	return server.List(c, user.Playlists)
 }
 
 type CreatePlaylistRequest struct {
-	Name        string `json:"name"`
+	Name        string `json:"name" validate:"required"`
 	Description string `json:"description"`
-	UserEmail   string `json:"user_email"`
+	UserEmail   string `json:"user_email" validate:"required,email"`
 }
 
-func createPlaylist(c *fiber.Ctx) error {
+func (h *handlers) createPlaylist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreatePlaylistRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	if req.Name == "" || req.UserEmail == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Name and user_email are required",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	playlist := Playlist{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("PLST"),
 		Name:        req.Name,
 		Description: req.Description,
 		Owner:       req.UserEmail,
 		Songs:       []Song{},
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		CreatedAt:   h.clock.Now(),
+		UpdatedAt:   h.clock.Now(),
 	}
 
 	if err := db.CreatePlaylist(playlist); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create playlist",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create playlist")
 	}
 
 	user.Playlists = append(user.Playlists, playlist)
-	db.Users[req.UserEmail] = user
+	db.Users.Upsert(req.UserEmail, user)
 
 	return c.Status(fiber.StatusCreated).JSON(playlist)
 }
 
-func addSongToPlaylist(c *fiber.Ctx) error {
+func (h *handlers) addSongToPlaylist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	playlistId := c.Params("playlistId")
 	var req struct {
 		SongId string `json:"song_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	if err := db.AddSongToPlaylist(playlistId, req.SongId); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	playlist, _ := db.GetPlaylist(playlistId)
 	return c.JSON(playlist)
 }
 
-func searchMusic(c *fiber.Ctx) error {
+func (h *handlers) searchMusic(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	query := c.Query("query")
 	searchType := c.Query("type")
 
 	if query == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "query parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "query parameter is required")
 	}
 
 	var results interface{}
@@ -262,7 +250,7 @@ func searchMusic(c *fiber.Ctx) error {
 	switch searchType {
 	case "song":
 		var songs []Song
-		for _, song := range db.Songs {
+		for _, song := range db.Songs.List() {
 			if contains(song.Title, query) || contains(song.Artist, query) {
 				songs = append(songs, song)
 			}
@@ -270,7 +258,7 @@ func searchMusic(c *fiber.Ctx) error {
 		results = songs
 	case "artist":
 		var artists []Artist
-		for _, artist := range db.Artists {
+		for _, artist := range db.Artists.List() {
 			if contains(artist.Name, query) {
 				artists = append(artists, artist)
 			}
@@ -278,16 +266,14 @@ func searchMusic(c *fiber.Ctx) error {
 		results = artists
 	case "album":
 		var albums []Album
-		for _, album := range db.Albums {
+		for _, album := range db.Albums.List() {
 			if contains(album.Title, query) || contains(album.Artist, query) {
 				albums = append(albums, album)
 			}
 		}
 		results = albums
 	default:
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid search type",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid search type")
 	}
 
 	return c.JSON(fiber.Map{
@@ -300,74 +286,72 @@ func contains(s, substr string) bool {
 	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:     make(map[string]User),
-		Songs:     make(map[string]Song),
-		Artists:   make(map[string]Artist),
-		Albums:    make(map[string]Album),
-		Playlists: make(map[string]Playlist),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Library routes
-	api.Get("/library", getUserLibrary)
+	api.Get("/library", h.getUserLibrary)
 
 	// Playlist routes
-	api.Get("/playlists", getUserPlaylists)
-	api.Post("/playlists", createPlaylist)
-	api.Post("/playlists/:playlistId/songs", addSongToPlaylist)
+	api.Get("/playlists", h.getUserPlaylists)
+	api.Post("/playlists", h.createPlaylist)
+	api.Post("/playlists/:playlistId/songs", h.addSongToPlaylist)
 
 	// Search routes
-	api.Get("/search", searchMusic)
+	api.Get("/search", h.searchMusic)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "playlists"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,17 +1,14 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -24,25 +21,25 @@ type Usage struct {
 }
 
 type Bill struct {
-	ID            string     `json:"id"`
-	Amount        float64    `json:"amount"`
-	DueDate       time.Time  `json:"due_date"`
-	Status        string     `json:"status"`
-	StatementDate time.Time  `json:"statement_date"`
-	Items         []BillItem `json:"items"`
+	ID            string      `json:"id"`
+	Amount        money.Money `json:"amount"`
+	DueDate       time.Time   `json:"due_date"`
+	Status        string      `json:"status"`
+	StatementDate time.Time   `json:"statement_date"`
+	Items         []BillItem  `json:"items"`
 }
 
 type BillItem struct {
-	Description string  `json:"description"`
-	Amount      float64 `json:"amount"`
+	Description string      `json:"description"`
+	Amount      money.Money `json:"amount"`
 }
 
 type Plan struct {
-	ID        string   `json:"id"`
-	Name      string   `json:"name"`
-	DataLimit float64  `json:"data_limit"`
-	Price     float64  `json:"price"`
-	Features  []string `json:"features"`
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	DataLimit float64     `json:"data_limit"`
+	Price     money.Money `json:"price"`
+	Features  []string    `json:"features"`
 }
 
 type Device struct {
@@ -64,19 +61,33 @@ type Account struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Accounts map[string]Account `json:"accounts"`
-	Plans    []Plan             `json:"plans"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Accounts server.Repository[Account] `json:"accounts"`
+	Plans    []Plan                     `json:"plans"`
 	mu       sync.RWMutex
 }
 
-var db *Database
+// handlers look after AT&T accounts and the plans they can switch to; clock
+// is there for whichever comes to need the time.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the accounts and plans in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetAccount(email string) (Account, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	account, exists := d.Accounts[email]
+	account, exists := d.Accounts.Get(email)
 	if !exists {
 		return Account{}, fiber.NewError(fiber.StatusNotFound, "Account not found")
 	}
@@ -90,12 +101,11 @@ func (d *Database) GetPlans() []Plan {
 }
 
 // HTTP Handlers
-func getAccountUsage(c *fiber.Ctx) error {
+func (h *handlers) getAccountUsage(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	account, err := db.GetAccount(email)
@@ -106,12 +116,11 @@ func getAccountUsage(c *fiber.Ctx) error {
 	return c.JSON(account.Usage)
 }
 
-func getBillingHistory(c *fiber.Ctx) error {
+func (h *handlers) getBillingHistory(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	account, err := db.GetAccount(email)
@@ -119,20 +128,20 @@ func getBillingHistory(c *fiber.Ctx) error {
 		return err
 	}
 
-	return c.JSON(account.Bills)
+	return server.List(c, account.Bills)
 }
 
-func getPlans(c *fiber.Ctx) error {
+func (h *handlers) getPlans(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	plans := db.GetPlans()
-	return c.JSON(plans)
+	return server.List(c, plans)
 }
 
-func getDevices(c *fiber.Ctx) error {
+func (h *handlers) getDevices(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	account, err := db.GetAccount(email)
@@ -140,63 +149,71 @@ func getDevices(c *fiber.Ctx) error {
 		return err
 	}
 
-	return c.JSON(account.Devices)
+	return server.List(c, account.Devices)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Accounts: make(map[string]Account),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Account routes
-	api.Get("/account/usage", getAccountUsage)
-	api.Get("/account/bills", getBillingHistory)
-	api.Get("/account/devices", getDevices)
+	api.Get("/account/usage", h.getAccountUsage)
+	api.Get("/account/bills", h.getBillingHistory)
+	api.Get("/account/devices", h.getDevices)
 
 	// Plans routes
-	api.Get("/plans", getPlans)
+	api.Get("/plans", h.getPlans)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"accounts"},
+			Search:  []string{"accounts", "plans"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
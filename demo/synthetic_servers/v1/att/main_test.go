@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"pkg/server"
+	"pkg/servertest"
+)
+
+const fixture = `{
+  "accounts": {
+    "dana@example.com": {
+      "email": "dana@example.com",
+      "name": "Dana",
+      "devices": [{"id": "dev_1", "phone_number": "555-0100", "model": "Pixel 9", "status": "active", "plan_id": "plan_unl"}],
+      "usage": {"data_used": 12.5, "data_limit": 50, "voice_minutes": 340, "texts_sent": 810},
+      "bills": [
+        {"id": "bill_1", "amount": 85, "status": "paid"},
+        {"id": "bill_2", "amount": 85, "status": "due"}
+      ]
+    }
+  },
+  "plans": [
+    {"id": "plan_unl", "name": "Unlimited Starter", "price": 65},
+    {"id": "plan_4gb", "name": "Value Plus", "data_limit": 4, "price": 50}
+  ]
+}`
+
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+	h, err := newHandlers(servertest.Store(fixture), servertest.Clock(time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := servertest.App()
+	setupRoutes(app, h)
+	return app
+}
+
+func TestGetAccountUsage(t *testing.T) {
+	app := newTestApp(t)
+	var usage Usage
+	if code := servertest.Do(t, app, "GET", "/api/v1/account/usage?email=dana@example.com", "", &usage); code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+	if usage.DataUsed != 12.5 || usage.VoiceMinutes != 340 {
+		t.Errorf("got %+v, want 12.5 GB and 340 minutes used", usage)
+	}
+
+	for target, want := range map[string]int{
+		"/api/v1/account/usage":                         http.StatusBadRequest,
+		"/api/v1/account/usage?email=eli@example.com":   http.StatusNotFound,
+		"/api/v1/account/bills?email=eli@example.com":   http.StatusNotFound,
+		"/api/v1/account/devices?email=eli@example.com": http.StatusNotFound,
+	} {
+		if code := servertest.Do(t, app, "GET", target, "", nil); code != want {
+			t.Errorf("%s: got %d, want %d", target, code, want)
+		}
+	}
+}
+
+func TestGetBillingHistory(t *testing.T) {
+	app := newTestApp(t)
+	var page server.Page[Bill]
+	servertest.Do(t, app, "GET", "/api/v1/account/bills?email=dana@example.com&status=due", "", &page)
+	if page.Total != 1 || page.Data[0].ID != "bill_2" {
+		t.Errorf("got %+v, want bill_2 alone", page.Data)
+	}
+}
+
+func TestGetPlans(t *testing.T) {
+	app := newTestApp(t)
+	var page server.Page[Plan]
+	servertest.Do(t, app, "GET", "/api/v1/plans?sort=price", "", &page)
+	if page.Total != 2 || page.Data[0].ID != "plan_4gb" {
+		t.Errorf("got %+v, want the 50.00 plan first", page.Data)
+	}
+}
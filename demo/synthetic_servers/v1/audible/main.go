@@ -1,33 +1,30 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
 type Book struct {
-	ID          string   `json:"id"`
-	Title       string   `json:"title"`
-	Author      string   `json:"author"`
-	Narrator    string   `json:"narrator"`
-	Duration    int      `json:"duration"` // in seconds
-	Rating      float64  `json:"rating"`
-	Price       float64  `json:"price"`
-	Summary     string   `json:"summary"`
-	Categories  []string `json:"categories"`
-	CoverURL    string   `json:"cover_url"`
-	ReleaseDate string   `json:"release_date"`
+	ID          string      `json:"id"`
+	Title       string      `json:"title"`
+	Author      string      `json:"author"`
+	Narrator    string      `json:"narrator"`
+	Duration    int         `json:"duration"` // in seconds
+	Rating      float64     `json:"rating"`
+	Price       money.Money `json:"price"`
+	Summary     string      `json:"summary"`
+	Categories  []string    `json:"categories"`
+	CoverURL    string      `json:"cover_url"`
+	ReleaseDate string      `json:"release_date"`
 }
 
 type LibraryBook struct {
@@ -56,27 +53,42 @@ type PaymentMethod struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users map[string]User `json:"users"`
-	Books map[string]Book `json:"books"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users server.Repository[User] `json:"users"`
+	Books server.Repository[Book] `json:"books"`
 	mu    sync.RWMutex
+	clock *server.Clock
 }
 
 // Custom errors
 var (
 	ErrUserNotFound = errors.New("user not found")
 	ErrBookNotFound = errors.New("book not found")
+	ErrBookOwned    = errors.New("book already owned")
 	ErrInvalidInput = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers serve Audible's audiobooks, sell them into users' libraries and
+// keep their listening progress.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the books and users in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -87,7 +99,7 @@ func (d *Database) GetBook(id string) (Book, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	book, exists := d.Books[id]
+	book, exists := d.Books.Get(id)
 	if !exists {
 		return Book{}, ErrBookNotFound
 	}
@@ -98,7 +110,7 @@ func (d *Database) UpdateProgress(email, bookId string, progress int) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
@@ -106,8 +118,8 @@ func (d *Database) UpdateProgress(email, bookId string, progress int) error {
 	for i, book := range user.Library {
 		if book.Book.ID == bookId {
 			user.Library[i].Progress = progress
-			user.Library[i].LastListened = time.Now()
-			d.Users[email] = user
+			user.Library[i].LastListened = d.clock.Now()
+			d.Users.Upsert(email, user)
 			return nil
 		}
 	}
@@ -119,12 +131,12 @@ func (d *Database) PurchaseBook(email, bookId string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
 
-	book, exists := d.Books[bookId]
+	book, exists := d.Books.Get(bookId)
 	if !exists {
 		return ErrBookNotFound
 	}
@@ -132,30 +144,31 @@ func (d *Database) PurchaseBook(email, bookId string) error {
 	// Check if user already owns the book
 	for _, lib := range user.Library {
 		if lib.Book.ID == bookId {
-			return errors.New("book already owned")
+			return ErrBookOwned
 		}
 	}
 
 	libraryBook := LibraryBook{
 		Book:         book,
 		Progress:     0,
-		PurchaseDate: time.Now(),
+		PurchaseDate: d.clock.Now(),
 		LastListened: time.Time{},
 	}
 
 	user.Library = append(user.Library, libraryBook)
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
 // HTTP Handlers
-func getBooks(c *fiber.Ctx) error {
+func (h *handlers) getBooks(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	search := c.Query("search")
 
 	var filteredBooks []Book
 	db.mu.RLock()
-	for _, book := range db.Books {
+	for _, book := range db.Books.List() {
 		if category != "" {
 			categoryMatch := false
 			for _, cat := range book.Categories {
@@ -180,46 +193,40 @@ func getBooks(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(filteredBooks)
+	return server.List(c, filteredBooks)
 }
 
-func getUserLibrary(c *fiber.Ctx) error {
+func (h *handlers) getUserLibrary(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Library)
+	return server.List(c, user.Library)
 }
 
-func purchaseBook(c *fiber.Ctx) error {
+func (h *handlers) purchaseBook(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	bookId := c.Params("bookId")
 	var req struct {
-		Email           string `json:"email"`
+		Email           string `json:"email" validate:"email"`
 		PaymentMethodId string `json:"payment_method_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user and payment method
 	user, err := db.GetUser(req.Email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	validPayment := false
@@ -230,15 +237,14 @@ func purchaseBook(c *fiber.Ctx) error {
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	if err := db.PurchaseBook(req.Email, bookId); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		if errors.Is(err, ErrBookOwned) {
+			return server.FailWith(c, fiber.StatusConflict, err)
+		}
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
@@ -246,23 +252,20 @@ func purchaseBook(c *fiber.Ctx) error {
 	})
 }
 
-func updateProgress(c *fiber.Ctx) error {
+func (h *handlers) updateProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		Email    string `json:"email"`
+		Email    string `json:"email" validate:"email"`
 		BookId   string `json:"book_id"`
 		Progress int    `json:"progress"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	if err := db.UpdateProgress(req.Email, req.BookId, req.Progress); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(fiber.Map{
@@ -270,19 +273,16 @@ func updateProgress(c *fiber.Ctx) error {
 	})
 }
 
-func getRecommendations(c *fiber.Ctx) error {
+func (h *handlers) getRecommendations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Simple recommendation system based on user's library categories
@@ -306,7 +306,7 @@ func getRecommendations(c *fiber.Ctx) error {
 	// Find books in the top category that the user doesn't own
 	var recommendations []Book
 	db.mu.RLock()
-	for _, book := range db.Books {
+	for _, book := range db.Books.List() {
 		// Check if user already owns the book
 		owned := false
 		for _, lib := range user.Library {
@@ -329,7 +329,7 @@ func getRecommendations(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(recommendations)
+	return server.List(c, recommendations)
 }
 
 // Utility functions
@@ -337,66 +337,68 @@ func contains(s, substr string) bool {
 	return true // Implement proper case-insensitive string search
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users: make(map[string]User),
-		Books: make(map[string]Book),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/books", getBooks)
-	api.Get("/library", getUserLibrary)
-	api.Post("/books/:bookId/purchase", purchaseBook)
-	api.Post("/progress", updateProgress)
-	api.Get("/recommendations", getRecommendations)
+	api.Get("/books", h.getBooks)
+	api.Get("/library", h.getUserLibrary)
+	api.Post("/books/:bookId/purchase", h.purchaseBook)
+	api.Post("/progress", h.updateProgress)
+	api.Get("/recommendations", h.getRecommendations)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+			Search:  []string{"books"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -49,7 +45,7 @@ type Account struct {
 	UserEmail   string        `json:"user_email"`
 	Type        AccountType   `json:"type"`
 	Name        string        `json:"name"`
-	Balance     float64       `json:"balance"`
+	Balance     money.Money   `json:"balance"`
 	Currency    string        `json:"currency"`
 	Status      AccountStatus `json:"status"`
 	CreatedAt   time.Time     `json:"created_at"`
@@ -61,7 +57,7 @@ type Transaction struct {
 	AccountID   string            `json:"account_id"`
 	Date        time.Time         `json:"date"`
 	Description string            `json:"description"`
-	Amount      float64           `json:"amount"`
+	Amount      money.Money       `json:"amount"`
 	Type        TransactionType   `json:"type"`
 	Category    string            `json:"category"`
 	Status      TransactionStatus `json:"status"`
@@ -72,37 +68,51 @@ type Transfer struct {
 	ID          string            `json:"id"`
 	FromAccount string            `json:"from_account"`
 	ToAccount   string            `json:"to_account"`
-	Amount      float64           `json:"amount"`
+	Amount      money.Money       `json:"amount"`
 	Description string            `json:"description"`
 	Status      TransactionStatus `json:"status"`
 	Timestamp   time.Time         `json:"timestamp"`
 }
 
 type Bill struct {
-	ID        string     `json:"id"`
-	UserEmail string     `json:"user_email"`
-	Payee     string     `json:"payee"`
-	Amount    float64    `json:"amount"`
-	DueDate   time.Time  `json:"due_date"`
-	Status    BillStatus `json:"status"`
-	Autopay   bool       `json:"autopay"`
+	ID        string      `json:"id"`
+	UserEmail string      `json:"user_email"`
+	Payee     string      `json:"payee"`
+	Amount    money.Money `json:"amount"`
+	DueDate   time.Time   `json:"due_date"`
+	Status    BillStatus  `json:"status"`
+	Autopay   bool        `json:"autopay"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Accounts     map[string]Account     `json:"accounts"`
-	Transactions map[string]Transaction `json:"transactions"`
-	Bills        map[string]Bill        `json:"bills"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Accounts     server.Repository[Account]     `json:"accounts"`
+	Transactions server.Repository[Transaction] `json:"transactions"`
+	Bills        server.Repository[Bill]        `json:"bills"`
 	mu           sync.RWMutex
+	clock        *server.Clock
 }
 
-// Global database instance
-var db *Database
+// handlers show Bank of America accounts, transactions and bills from db,
+// and date transfers by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the accounts, transactions and bills in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Custom errors
 var (
 	ErrAccountNotFound    = errors.New("account not found")
-	ErrInsufficientFunds  = errors.New("insufficient funds")
+	ErrInsufficientFunds  = server.NewError(server.CodeInsufficientFunds, "insufficient funds")
 	ErrInvalidTransaction = errors.New("invalid transaction")
 	ErrUnauthorized       = errors.New("unauthorized")
 )
@@ -112,7 +122,7 @@ func (d *Database) GetAccount(id string) (Account, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	account, exists := d.Accounts[id]
+	account, exists := d.Accounts.Get(id)
 	if !exists {
 		return Account{}, ErrAccountNotFound
 	}
@@ -123,13 +133,7 @@ func (d *Database) GetUserAccounts(email string) []Account {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var accounts []Account
-	for _, account := range d.Accounts {
-		if account.UserEmail == email {
-			accounts = append(accounts, account)
-		}
-	}
-	return accounts
+	return d.Accounts.By("user_email", email)
 }
 
 func (d *Database) GetAccountTransactions(accountId string, startDate, endDate time.Time) []Transaction {
@@ -137,7 +141,7 @@ func (d *Database) GetAccountTransactions(accountId string, startDate, endDate t
 	defer d.mu.RUnlock()
 
 	var transactions []Transaction
-	for _, tx := range d.Transactions {
+	for _, tx := range d.Transactions.List() {
 		if tx.AccountID == accountId {
 			if (startDate.IsZero() || !tx.Date.Before(startDate)) &&
 				(endDate.IsZero() || !tx.Date.After(endDate)) {
@@ -153,45 +157,55 @@ func (d *Database) CreateTransfer(transfer Transfer) error {
 	defer d.mu.Unlock()
 
 	// Validate accounts
-	fromAccount, exists := d.Accounts[transfer.FromAccount]
+	fromAccount, exists := d.Accounts.Get(transfer.FromAccount)
 	if !exists {
 		return ErrAccountNotFound
 	}
 
-	toAccount, exists := d.Accounts[transfer.ToAccount]
+	toAccount, exists := d.Accounts.Get(transfer.ToAccount)
 	if !exists {
 		return ErrAccountNotFound
 	}
 
-	// Check sufficient funds
-	if fromAccount.Balance < transfer.Amount {
+	// Check sufficient funds, in the accounts' currencies, which a
+	// transfer can't mix
+	amount := transfer.Amount.In(fromAccount.Currency)
+	from, err := fromAccount.Balance.In(fromAccount.Currency).Sub(amount)
+	if err != nil {
+		return err
+	}
+	to, err := toAccount.Balance.In(toAccount.Currency).Add(amount)
+	if err != nil {
+		return err
+	}
+	if from.IsNegative() {
 		return ErrInsufficientFunds
 	}
 
 	// Update account balances
-	fromAccount.Balance -= transfer.Amount
-	toAccount.Balance += transfer.Amount
-	fromAccount.LastUpdated = time.Now()
-	toAccount.LastUpdated = time.Now()
+	fromAccount.Balance = from
+	toAccount.Balance = to
+	fromAccount.LastUpdated = d.clock.Now()
+	toAccount.LastUpdated = d.clock.Now()
 
 	// Save updated accounts
-	d.Accounts[transfer.FromAccount] = fromAccount
-	d.Accounts[transfer.ToAccount] = toAccount
+	d.Accounts.Upsert(transfer.FromAccount, fromAccount)
+	d.Accounts.Upsert(transfer.ToAccount, toAccount)
 
 	// Create transactions
-	txId := uuid.New().String()
-	d.Transactions[txId+"_debit"] = Transaction{
+	txId := server.NewID("TXN")
+	d.Transactions.Upsert(txId+"_debit", Transaction{
 		ID:          txId + "_debit",
 		AccountID:   transfer.FromAccount,
 		Date:        transfer.Timestamp,
 		Description: transfer.Description,
-		Amount:      -transfer.Amount,
+		Amount:      transfer.Amount.Neg(),
 		Type:        TransactionTypeDebit,
 		Status:      TransactionStatusCompleted,
 		Reference:   transfer.ID,
-	}
+	})
 
-	d.Transactions[txId+"_credit"] = Transaction{
+	d.Transactions.Upsert(txId+"_credit", Transaction{
 		ID:          txId + "_credit",
 		AccountID:   transfer.ToAccount,
 		Date:        transfer.Timestamp,
@@ -200,30 +214,28 @@ func (d *Database) CreateTransfer(transfer Transfer) error {
 		Type:        TransactionTypeCredit,
 		Status:      TransactionStatusCompleted,
 		Reference:   transfer.ID,
-	}
+	})
 
 	return nil
 }
 
 // HTTP Handlers
-func getUserAccounts(c *fiber.Ctx) error {
+func (h *handlers) getUserAccounts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	accounts := db.GetUserAccounts(email)
-	return c.JSON(accounts)
+	return server.List(c, accounts)
 }
 
-func getAccountTransactions(c *fiber.Ctx) error {
+func (h *handlers) getAccountTransactions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	accountId := c.Params("accountId")
 	if accountId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "account ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "account ID is required")
 	}
 
 	startDateStr := c.Query("startDate")
@@ -235,172 +247,151 @@ func getAccountTransactions(c *fiber.Ctx) error {
 	if startDateStr != "" {
 		startDate, err = time.Parse("2006-01-02", startDateStr)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "invalid start date format",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid start date format")
 		}
 	}
 
 	if endDateStr != "" {
 		endDate, err = time.Parse("2006-01-02", endDateStr)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "invalid end date format",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid end date format")
 		}
 	}
 
 	transactions := db.GetAccountTransactions(accountId, startDate, endDate)
-	return c.JSON(transactions)
+	return server.List(c, transactions)
 }
 
 type TransferRequest struct {
-	FromAccountId string  `json:"fromAccountId"`
-	ToAccountId   string  `json:"toAccountId"`
-	Amount        float64 `json:"amount"`
-	Description   string  `json:"description"`
+	FromAccountId string      `json:"fromAccountId"`
+	ToAccountId   string      `json:"toAccountId"`
+	Amount        money.Money `json:"amount" validate:"gt=0"`
+	Description   string      `json:"description"`
 }
 
-func createTransfer(c *fiber.Ctx) error {
+func (h *handlers) createTransfer(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req TransferRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	if req.Amount <= 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Amount must be positive",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	transfer := Transfer{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("TRF"),
 		FromAccount: req.FromAccountId,
 		ToAccount:   req.ToAccountId,
 		Amount:      req.Amount,
 		Description: req.Description,
 		Status:      TransactionStatusCompleted,
-		Timestamp:   time.Now(),
+		Timestamp:   h.clock.Now(),
 	}
 
 	if err := db.CreateTransfer(transfer); err != nil {
-		switch err {
-		case ErrAccountNotFound:
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		case ErrInsufficientFunds:
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+		switch {
+		case errors.Is(err, ErrAccountNotFound):
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case errors.Is(err, ErrInsufficientFunds):
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		case errors.Is(err, money.ErrMixedCurrencies):
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
 		default:
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to process transfer",
-			})
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to process transfer")
 		}
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(transfer)
 }
 
-func getUserBills(c *fiber.Ctx) error {
+func (h *handlers) getUserBills(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	db.mu.RLock()
-	var bills []Bill
-	for _, bill := range db.Bills {
-		if bill.UserEmail == email {
-			bills = append(bills, bill)
-		}
-	}
+	bills := db.Bills.By("user_email", email)
 	db.mu.RUnlock()
 
-	return c.JSON(bills)
+	return server.List(c, bills)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Accounts:     make(map[string]Account),
-		Transactions: make(map[string]Transaction),
-		Bills:        make(map[string]Bill),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Account routes
-	api.Get("/accounts", getUserAccounts)
+	api.Get("/accounts", h.getUserAccounts)
 	api.Get("/accounts/:accountId", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		accountId := c.Params("accountId")
 		account, err := db.GetAccount(accountId)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(account)
 	})
-	api.Get("/accounts/:accountId/transactions", getAccountTransactions)
+	api.Get("/accounts/:accountId/transactions", h.getAccountTransactions)
 
 	// Transfer routes
-	api.Post("/transfers", createTransfer)
+	api.Post("/transfers", h.createTransfer)
 
 	// Bill routes
-	api.Get("/bills", getUserBills)
+	api.Get("/bills", h.getUserBills)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"accounts", "bills"},
+			Search:  []string{"accounts", "transactions", "bills"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,32 +1,29 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
 type Celebrity struct {
-	ID           string   `json:"id"`
-	Name         string   `json:"name"`
-	Category     string   `json:"category"`
-	Price        float64  `json:"price"`
-	Rating       float64  `json:"rating"`
-	ResponseTime string   `json:"response_time"`
-	Bio          string   `json:"bio"`
-	ProfileImage string   `json:"profile_image"`
-	SampleVideos []string `json:"sample_videos"`
-	IsAvailable  bool     `json:"is_available"`
+	ID           string      `json:"id"`
+	Name         string      `json:"name"`
+	Category     string      `json:"category"`
+	Price        money.Money `json:"price"`
+	Rating       float64     `json:"rating"`
+	ResponseTime string      `json:"response_time"`
+	Bio          string      `json:"bio"`
+	ProfileImage string      `json:"profile_image"`
+	SampleVideos []string    `json:"sample_videos"`
+	IsAvailable  bool        `json:"is_available"`
 }
 
 type BookingStatus string
@@ -72,9 +69,12 @@ type PaymentMethod struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Celebrities map[string]Celebrity `json:"celebrities"`
-	Bookings    map[string]Booking   `json:"bookings"`
-	Users       map[string]User      `json:"users"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Celebrities server.Repository[Celebrity] `json:"celebrities"`
+	Bookings    server.Repository[Booking]   `json:"bookings"`
+	Users       server.Repository[User]      `json:"users"`
 	mu          sync.RWMutex
 }
 
@@ -86,15 +86,25 @@ var (
 	ErrInvalidInput      = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers book personalized videos from Cameo's celebrities, with clock
+// dating each booking.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the celebrities, bookings and users in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetCelebrity(id string) (Celebrity, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	celebrity, exists := d.Celebrities[id]
+	celebrity, exists := d.Celebrities.Get(id)
 	if !exists {
 		return Celebrity{}, ErrCelebrityNotFound
 	}
@@ -105,7 +115,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -116,7 +126,7 @@ func (d *Database) CreateBooking(booking Booking) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Bookings[booking.ID] = booking
+	d.Bookings.Upsert(booking.ID, booking)
 	return nil
 }
 
@@ -124,7 +134,7 @@ func (d *Database) GetBooking(id string) (Booking, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	booking, exists := d.Bookings[id]
+	booking, exists := d.Bookings.Get(id)
 	if !exists {
 		return Booking{}, ErrBookingNotFound
 	}
@@ -132,195 +142,189 @@ func (d *Database) GetBooking(id string) (Booking, error) {
 }
 
 // HTTP Handlers
-func getCelebrities(c *fiber.Ctx) error {
+func (h *handlers) getCelebrities(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	priceMax := c.QueryFloat("price_max", 0)
 
 	var celebrities []Celebrity
 	db.mu.RLock()
-	for _, celeb := range db.Celebrities {
+	for _, celeb := range db.Celebrities.List() {
 		if (category == "" || celeb.Category == category) &&
-			(priceMax == 0 || celeb.Price <= priceMax) {
+			(priceMax == 0 || celeb.Price.Float() <= priceMax) {
 			celebrities = append(celebrities, celeb)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(celebrities)
+	return server.List(c, celebrities, "category")
 }
 
-func getUserBookings(c *fiber.Ctx) error {
+func (h *handlers) getUserBookings(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var bookings []Booking
 	db.mu.RLock()
-	for _, booking := range db.Bookings {
+	for _, booking := range db.Bookings.List() {
 		if booking.UserEmail == email {
 			bookings = append(bookings, booking)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(bookings)
+	return server.List(c, bookings)
 }
 
 type CreateBookingRequest struct {
-	CelebrityID   string `json:"celebrity_id"`
-	UserEmail     string `json:"user_email"`
+	CelebrityID   string `json:"celebrity_id" validate:"required"`
+	UserEmail     string `json:"user_email" validate:"required,email"`
 	Occasion      string `json:"occasion"`
-	RecipientName string `json:"recipient_name"`
+	RecipientName string `json:"recipient_name" validate:"required"`
 	Instructions  string `json:"instructions"`
 }
 
-func createBooking(c *fiber.Ctx) error {
+func (h *handlers) createBooking(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateBookingRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Validate celebrity
 	celebrity, err := db.GetCelebrity(req.CelebrityID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Celebrity not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Celebrity not found")
 	}
 
 	if !celebrity.IsAvailable {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Celebrity is not currently accepting bookings",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Celebrity is not currently accepting bookings")
 	}
 
 	booking := Booking{
-		ID:            uuid.New().String(),
+		ID:            server.NewID("BKG"),
 		Celebrity:     celebrity,
 		UserEmail:     user.Email,
 		Occasion:      req.Occasion,
 		RecipientName: req.RecipientName,
 		Instructions:  req.Instructions,
 		Status:        BookingStatusPending,
-		CreatedAt:     time.Now(),
+		CreatedAt:     h.clock.Now(),
 	}
 
 	if err := db.CreateBooking(booking); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create booking",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create booking")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(booking)
 }
 
-func getBooking(c *fiber.Ctx) error {
+func (h *handlers) getBooking(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	bookingId := c.Params("bookingId")
 	if bookingId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Booking ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Booking ID is required")
 	}
 
 	booking, err := db.GetBooking(bookingId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Booking not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Booking not found")
 	}
 
 	return c.JSON(booking)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Celebrities: make(map[string]Celebrity),
-		Bookings:    make(map[string]Booking),
-		Users:       make(map[string]User),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Celebrity routes
-	api.Get("/celebrities", getCelebrities)
+	api.Get("/celebrities", h.getCelebrities)
 	api.Get("/celebrities/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		celebrity, err := db.GetCelebrity(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Celebrity not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Celebrity not found")
 		}
 		return c.JSON(celebrity)
 	})
 
 	// Booking routes
-	api.Get("/bookings", getUserBookings)
-	api.Post("/bookings", createBooking)
-	api.Get("/bookings/:bookingId", getBooking)
+	api.Get("/bookings", h.getUserBookings)
+	api.Post("/bookings", h.createBooking)
+	api.Get("/bookings/:bookingId", h.getBooking)
 
 	// User routes
 	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		email := c.Params("email")
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "User not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 		}
 		return c.JSON(user)
 	})
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"bookings"},
+			Search:  []string{"celebrities", "bookings"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,25 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
+	"math"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/availability"
+	"pkg/geo"
+	"pkg/geocode"
+	"pkg/messaging"
+	"pkg/money"
+	"pkg/reviews"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -41,7 +47,8 @@ type Caregiver struct {
 	ID              string        `json:"id"`
 	UserEmail       string        `json:"user_email"`
 	ServiceTypes    []ServiceType `json:"service_types"`
-	HourlyRate      float64       `json:"hourly_rate"`
+	ZipCode         string        `json:"zip_code"` // Where they work; their user's if empty
+	HourlyRate      money.Money   `json:"hourly_rate"`
 	YearsExperience int           `json:"years_experience"`
 	Bio             string        `json:"bio"`
 	Availability    []string      `json:"availability"`
@@ -50,6 +57,31 @@ type Caregiver struct {
 	Certifications  []string      `json:"certifications"`
 }
 
+// availabilityHours are the weekly hours, in UTC, that each of the words
+// caregivers give their availability in stands for.
+var availabilityHours = map[string][]availability.Rule{
+	"weekday_mornings":   {{Days: workweek, Start: "08:00", End: "12:00"}},
+	"weekday_afternoons": {{Days: workweek, Start: "12:00", End: "17:00"}},
+	"weekday_evenings":   {{Days: workweek, Start: "17:00", End: "21:00"}},
+	"weekdays":           {{Days: workweek, Start: "08:00", End: "18:00"}},
+	"weekends":           {{Days: []string{"sat", "sun"}, Start: "09:00", End: "17:00"}},
+}
+
+var workweek = []string{"mon", "tue", "wed", "thu", "fri"}
+
+// interviewLength is how long a family's interview with a caregiver is.
+const interviewLength = time.Hour
+
+// schedule is when the caregiver can be interviewed: the hours they are
+// available, an interview at a time.
+func (cg Caregiver) schedule() availability.Schedule {
+	var rules []availability.Rule
+	for _, word := range cg.Availability {
+		rules = append(rules, availabilityHours[word]...)
+	}
+	return availability.Schedule{Rules: rules, Length: interviewLength}
+}
+
 type JobStatus string
 
 const (
@@ -59,6 +91,14 @@ const (
 	JobStatusCancelled  JobStatus = "cancelled"
 )
 
+// jobMachine is the statuses a job posting moves through. Hiring a
+// caregiver puts it in progress, and the family completes it once the care
+// is done, or it reopens if the caregiver they hired withdraws.
+var jobMachine = &statemachine.Machine{Name: "job", Moves: map[string][]string{
+	string(JobStatusOpen):       {string(JobStatusInProgress)},
+	string(JobStatusInProgress): {string(JobStatusCompleted), string(JobStatusOpen)},
+}}
+
 type JobPosting struct {
 	ID           string      `json:"id"`
 	UserEmail    string      `json:"user_email"`
@@ -67,12 +107,15 @@ type JobPosting struct {
 	Description  string      `json:"description"`
 	Requirements string      `json:"requirements"`
 	Schedule     string      `json:"schedule"`
-	HourlyRate   float64     `json:"hourly_rate"`
+	HourlyRate   money.Money `json:"hourly_rate"`
 	Location     string      `json:"location"`
 	ZipCode      string      `json:"zip_code"`
 	Status       JobStatus   `json:"status"`
 	CreatedAt    time.Time   `json:"created_at"`
 	UpdatedAt    time.Time   `json:"updated_at"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+	server.SoftDelete
 }
 
 type ApplicationStatus string
@@ -85,33 +128,94 @@ const (
 )
 
 type Application struct {
-	ID          string            `json:"id"`
-	JobID       string            `json:"job_id"`
-	CaregiverID string            `json:"caregiver_id"`
-	CoverLetter string            `json:"cover_letter"`
-	Status      ApplicationStatus `json:"status"`
-	CreatedAt   time.Time         `json:"created_at"`
-	UpdatedAt   time.Time         `json:"updated_at"`
+	ID             string             `json:"id"`
+	JobID          string             `json:"job_id"`
+	CaregiverID    string             `json:"caregiver_id"`
+	CoverLetter    string             `json:"cover_letter"`
+	Status         ApplicationStatus  `json:"status"`
+	ConversationID string             `json:"conversation_id,omitempty"` // The family's chat with the caregiver about it
+	Interview      *availability.Slot `json:"interview,omitempty"`       // When the family is to meet the caregiver
+	CreatedAt      time.Time          `json:"created_at"`
+	UpdatedAt      time.Time          `json:"updated_at"`
+}
+
+// caregiverPolicy takes reviews of caregivers, in whole stars, from the
+// families who hired them for a job they have completed.
+var caregiverPolicy = reviews.Policy{Kind: "caregiver", Scale: reviews.Stars, Verified: true}
+
+type ReferenceStatus string
+
+const (
+	ReferenceStatusPending   ReferenceStatus = "pending"
+	ReferenceStatusConfirmed ReferenceStatus = "confirmed"
+	ReferenceStatusDeclined  ReferenceStatus = "declined"
+)
+
+type Reference struct {
+	ID           string          `json:"id"`
+	CaregiverID  string          `json:"caregiver_id"`
+	ClientEmail  string          `json:"client_email"`
+	JobID        string          `json:"job_id"`
+	Relationship string          `json:"relationship"`
+	Status       ReferenceStatus `json:"status"`
+	Comment      string          `json:"comment"`
+	CreatedAt    time.Time       `json:"created_at"`
+	RespondedAt  *time.Time      `json:"responded_at,omitempty"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users        map[string]User        `json:"users"`
-	Caregivers   map[string]Caregiver   `json:"caregivers"`
-	JobPostings  map[string]JobPosting  `json:"job_postings"`
-	Applications map[string]Application `json:"applications"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Reviews
+	server.Messaging
+
+	Users        server.Repository[User]        `json:"users"`
+	Caregivers   server.Repository[Caregiver]   `json:"caregivers"`
+	JobPostings  server.Repository[JobPosting]  `json:"job_postings"`
+	Applications server.Repository[Application] `json:"applications"`
+	References   server.Repository[Reference]   `json:"references"`
 	mu           sync.RWMutex
+	clock        *server.Clock
+}
+
+var (
+	ErrCaregiverNotFound     = errors.New("caregiver not found")
+	ErrJobNotFound           = errors.New("job posting not found")
+	ErrReferenceNotFound     = errors.New("reference not found")
+	ErrNotJobOwner           = errors.New("job posting does not belong to user")
+	ErrJobNotCompleted       = errors.New("job posting is not completed")
+	ErrCaregiverNotHired     = errors.New("caregiver was not hired for this job")
+	ErrAlreadyReviewed       = errors.New("you have already reviewed this caregiver")
+	ErrReferenceAlreadyFinal = errors.New("reference has already been answered")
+	ErrApplicationNotFound   = errors.New("application not found")
+	ErrNotApplicant          = errors.New("application does not belong to caregiver")
+	ErrNotCaregiver          = errors.New("caregiver does not belong to user")
+	ErrApplicationNotPending = errors.New("application is no longer pending")
+	ErrApplicationFinal      = errors.New("application can no longer be withdrawn")
+	ErrJobNotOpen            = errors.New("job posting is not open")
+	ErrJobNotInProgress      = errors.New("job posting has no caregiver at work on it")
+)
+
+// handlers carry Care.com's job postings, applications and references
+// between families and caregivers, and date each step by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
 }
 
-// Global database instance
-var db *Database
+// newHandlers loads the caregivers, postings and applications in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -122,27 +226,34 @@ func (d *Database) GetCaregiver(id string) (Caregiver, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	caregiver, exists := d.Caregivers[id]
+	caregiver, exists := d.Caregivers.Get(id)
 	if !exists {
-		return Caregiver{}, errors.New("caregiver not found")
+		return Caregiver{}, ErrCaregiverNotFound
 	}
 	return caregiver, nil
 }
 
-func (d *Database) SearchCaregivers(serviceType ServiceType, zipCode string, radius int) []Caregiver {
+// SearchCaregivers returns the caregivers offering serviceType who work
+// within radius miles of origin, by their zip codes' centroids.
+func (d *Database) SearchCaregivers(serviceType ServiceType, origin geo.Point, radius float64) []Caregiver {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
 	var results []Caregiver
-	for _, caregiver := range d.Caregivers {
-		// Check if caregiver provides the requested service
-		for _, st := range caregiver.ServiceTypes {
-			if st == serviceType {
-				// In a real implementation, we would check the distance between zip codes
-				results = append(results, caregiver)
-				break
-			}
+	for _, caregiver := range d.Caregivers.List() {
+		if !slices.Contains(caregiver.ServiceTypes, serviceType) {
+			continue
+		}
+		zip := caregiver.ZipCode
+		if zip == "" {
+			user, _ := d.Users.Get(caregiver.UserEmail)
+			zip = user.ZipCode
 		}
+		place, err := geocode.Lookup(zip)
+		if err != nil || geo.DistanceMiles(origin, place.Point) > radius {
+			continue
+		}
+		results = append(results, caregiver)
 	}
 	return results
 }
@@ -151,7 +262,7 @@ func (d *Database) CreateJobPosting(job JobPosting) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.JobPostings[job.ID] = job
+	d.JobPostings.Upsert(job.ID, job)
 	return nil
 }
 
@@ -159,86 +270,594 @@ func (d *Database) GetJobPosting(id string) (JobPosting, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	job, exists := d.JobPostings[id]
-	if !exists {
-		return JobPosting{}, errors.New("job posting not found")
+	job, exists := d.JobPostings.Get(id)
+	if !exists || job.Deleted() {
+		return JobPosting{}, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// DeleteJobPosting takes down a family's open posting. It is only marked
+// deleted, so an admin can put it back.
+func (d *Database) DeleteJobPosting(id, ownerEmail string) (JobPosting, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	job, exists := d.JobPostings.Get(id)
+	if !exists || job.Deleted() {
+		return JobPosting{}, ErrJobNotFound
+	}
+	if job.UserEmail != ownerEmail {
+		return JobPosting{}, ErrNotJobOwner
+	}
+	if job.Status != JobStatusOpen {
+		return JobPosting{}, ErrJobNotOpen
 	}
+	job.MarkDeleted()
+	job.UpdatedAt = *job.DeletedAt
+	d.JobPostings.Upsert(job.ID, job)
 	return job, nil
 }
 
-func (d *Database) CreateApplication(app Application) error {
+// hiredForJob reports whether the caregiver holds an accepted application on
+// the job. Callers must hold d.mu.
+func (d *Database) hiredForJob(jobID, caregiverID string) bool {
+	for _, app := range d.Applications.List() {
+		if app.JobID == jobID && app.CaregiverID == caregiverID && app.Status == ApplicationStatusAccepted {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateReview records a family's review of a caregiver for a completed job
+// and folds the rating into the caregiver's running average.
+func (d *Database) CreateReview(review reviews.Review, jobID string) (reviews.Review, Caregiver, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	caregiver, exists := d.Caregivers.Get(review.Target.ID)
+	if !exists {
+		return reviews.Review{}, Caregiver{}, ErrCaregiverNotFound
+	}
+	job, exists := d.JobPostings.Get(jobID)
+	if !exists {
+		return reviews.Review{}, Caregiver{}, ErrJobNotFound
+	}
+	if job.UserEmail != review.UserEmail {
+		return reviews.Review{}, Caregiver{}, ErrNotJobOwner
+	}
+	if job.Status != JobStatusCompleted {
+		return reviews.Review{}, Caregiver{}, ErrJobNotCompleted
+	}
+	if !d.hiredForJob(job.ID, caregiver.ID) {
+		return reviews.Review{}, Caregiver{}, ErrCaregiverNotHired
+	}
+	review, err := d.AddReview(caregiverPolicy, review, job.ID)
+	if err == reviews.ErrAlreadyReviewed {
+		return reviews.Review{}, Caregiver{}, ErrAlreadyReviewed
+	} else if err != nil {
+		return reviews.Review{}, Caregiver{}, err
+	}
+
+	rating := reviews.Summary{Count: caregiver.ReviewsCount, Average: caregiver.Rating}
+	rating.Add(review.Rating)
+	caregiver.ReviewsCount, caregiver.Rating = rating.Count, rating.Average
+	d.Caregivers.Upsert(caregiver.ID, caregiver)
+	return review, caregiver, nil
+}
+
+func (d *Database) GetCaregiverReviews(caregiverID string) []reviews.Review {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.ReviewsOf(reviews.Target{Kind: caregiverPolicy.Kind, ID: caregiverID}, "")
+}
+
+// CreateReference asks a past client to confirm they employed the caregiver.
+// The client must own a job the caregiver was hired for.
+func (d *Database) CreateReference(ref Reference) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Caregivers.Get(ref.CaregiverID); !exists {
+		return ErrCaregiverNotFound
+	}
+	job, exists := d.JobPostings.Get(ref.JobID)
+	if !exists {
+		return ErrJobNotFound
+	}
+	if job.UserEmail != ref.ClientEmail {
+		return ErrNotJobOwner
+	}
+	if !d.hiredForJob(job.ID, ref.CaregiverID) {
+		return ErrCaregiverNotHired
+	}
+
+	d.References.Upsert(ref.ID, ref)
+	return nil
+}
+
+func (d *Database) GetCaregiverReferences(caregiverID string) []Reference {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	refs := d.References.By("caregiver_id", caregiverID)
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].CreatedAt.After(refs[j].CreatedAt)
+	})
+	return refs
+}
+
+// RespondToReference lets the named client confirm or decline a pending
+// reference request.
+func (d *Database) RespondToReference(id, clientEmail string, confirmed bool, comment string) (Reference, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ref, exists := d.References.Get(id)
+	if !exists {
+		return Reference{}, ErrReferenceNotFound
+	}
+	if ref.ClientEmail != clientEmail {
+		return Reference{}, ErrNotJobOwner
+	}
+	if ref.Status != ReferenceStatusPending {
+		return Reference{}, ErrReferenceAlreadyFinal
+	}
+
+	now := d.clock.Now()
+	ref.Status = ReferenceStatusDeclined
+	if confirmed {
+		ref.Status = ReferenceStatusConfirmed
+	}
+	ref.Comment = comment
+	ref.RespondedAt = &now
+	d.References.Upsert(ref.ID, ref)
+	return ref, nil
+}
+
+// JobSearchFilter narrows the open job postings a caregiver sees. Zero values
+// disable the corresponding filter.
+type JobSearchFilter struct {
+	ServiceType ServiceType
+	MinRate     float64
+	MaxRate     float64
+	Schedule    string
+	Origin      *geo.Point
+	RadiusMiles float64
+	OldestFirst bool
+}
+
+type JobSearchResult struct {
+	JobPosting
+	DistanceMiles *float64 `json:"distance_miles,omitempty"`
+}
+
+func (d *Database) SearchJobs(filter JobSearchFilter) []JobSearchResult {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	schedule := strings.ToLower(filter.Schedule)
+	results := []JobSearchResult{}
+	for _, job := range d.JobPostings.List() {
+		if job.Status != JobStatusOpen || job.Deleted() {
+			continue
+		}
+		if filter.ServiceType != "" && job.ServiceType != filter.ServiceType {
+			continue
+		}
+		if filter.MinRate > 0 && job.HourlyRate.Float() < filter.MinRate {
+			continue
+		}
+		if filter.MaxRate > 0 && job.HourlyRate.Float() > filter.MaxRate {
+			continue
+		}
+		if schedule != "" && !strings.Contains(strings.ToLower(job.Schedule), schedule) {
+			continue
+		}
+
+		result := JobSearchResult{JobPosting: job}
+		if filter.Origin != nil {
+			place, err := geocode.Lookup(job.ZipCode)
+			if err != nil {
+				continue
+			}
+			distance := math.Round(geo.DistanceMiles(*filter.Origin, place.Point)*10) / 10
+			if distance > filter.RadiusMiles {
+				continue
+			}
+			result.DistanceMiles = &distance
+		}
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if filter.OldestFirst {
+			return results[i].CreatedAt.Before(results[j].CreatedAt)
+		}
+		return results[i].CreatedAt.After(results[j].CreatedAt)
+	})
+	return results
+}
+
+// CreateApplication records an application, and opens a chat about it
+// between the family and the caregiver, starting with the cover letter.
+func (d *Database) CreateApplication(app *Application) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Applications[app.ID] = app
+	jobPosting, _ := d.JobPostings.Get(app.JobID)
+	family := jobPosting.UserEmail
+	caregiver := d.caregiverEmail(app.CaregiverID)
+	familyUser, _ := d.Users.Get(family)
+	caregiverUser, _ := d.Users.Get(caregiver)
+	chat := d.Open(applicationChat(*app),
+		messaging.Participant{ID: family, Role: "family", Name: familyUser.Name},
+		messaging.Participant{ID: caregiver, Role: "caregiver", Name: caregiverUser.Name})
+	if letter := strings.TrimSpace(app.CoverLetter); letter != "" {
+		d.Send(chat.ID, caregiver, letter)
+	}
+	app.ConversationID = chat.ID
+	d.Applications.Upsert(app.ID, *app)
 	return nil
 }
 
+// applicationChat is what the chat about an application is about. It is
+// closed once the application is rejected or withdrawn.
+func applicationChat(app Application) messaging.About {
+	return messaging.About{Kind: "application", ID: app.ID}
+}
+
+// notify sends an in-app notification about an application. Callers must
+// hold d.mu.
+func (d *Database) notify(recipient, kind, message string, app Application) {
+	d.Notify(server.Notification{
+		UserEmail:  recipient,
+		Type:       kind,
+		Message:    message,
+		Collection: "applications",
+		EntityID:   app.ID,
+	})
+}
+
+// caregiverEmail resolves the account email for a caregiver profile. Callers
+// must hold d.mu.
+func (d *Database) caregiverEmail(caregiverID string) string {
+	caregiver, _ := d.Caregivers.Get(caregiverID)
+	return caregiver.UserEmail
+}
+
+// DecideApplication lets the family that owns the job accept or reject a
+// pending application. Accepting hires the caregiver: the job moves to
+// in_progress and every other pending application is rejected.
+func (d *Database) DecideApplication(id, ownerEmail string, status ApplicationStatus) (Application, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	app, exists := d.Applications.Get(id)
+	if !exists {
+		return Application{}, ErrApplicationNotFound
+	}
+	job, exists := d.JobPostings.Get(app.JobID)
+	if !exists || job.Deleted() {
+		return Application{}, ErrJobNotFound
+	}
+	if job.UserEmail != ownerEmail {
+		return Application{}, ErrNotJobOwner
+	}
+	if app.Status != ApplicationStatusPending {
+		return Application{}, ErrApplicationNotPending
+	}
+
+	now := d.clock.Now()
+	if status == ApplicationStatusRejected {
+		app.Status = ApplicationStatusRejected
+		app.UpdatedAt = now
+		d.Applications.Upsert(app.ID, app)
+		d.Close(applicationChat(app))
+		d.notify(d.caregiverEmail(app.CaregiverID), "application_rejected",
+			"Your application for \""+job.Title+"\" was not selected", app)
+		return app, nil
+	}
+
+	if err := statemachine.Move(jobMachine, &job, &job.Status, &job.StatusHistory, JobStatusInProgress, now); err != nil {
+		return Application{}, ErrJobNotOpen
+	}
+
+	app.Status = ApplicationStatusAccepted
+	app.UpdatedAt = now
+	d.Applications.Upsert(app.ID, app)
+	d.notify(d.caregiverEmail(app.CaregiverID), "application_accepted",
+		"Your application for \""+job.Title+"\" was accepted", app)
+	d.notify(job.UserEmail, "caregiver_hired",
+		"You hired a caregiver for \""+job.Title+"\"", app)
+
+	for _, otherID := range d.Applications.Keys() {
+		other, _ := d.Applications.Get(otherID)
+		if other.JobID != job.ID || otherID == id || other.Status != ApplicationStatusPending {
+			continue
+		}
+		other.Status = ApplicationStatusRejected
+		other.UpdatedAt = now
+		d.Applications.Upsert(otherID, other)
+		d.Close(applicationChat(other))
+		d.notify(d.caregiverEmail(other.CaregiverID), "application_rejected",
+			"The position \""+job.Title+"\" has been filled", other)
+	}
+
+	job.UpdatedAt = now
+	d.JobPostings.Upsert(job.ID, job)
+	return app, nil
+}
+
+// GetCaregiverAvailability lists the hours a caregiver is free to be
+// interviewed over the given number of days starting at from.
+func (d *Database) GetCaregiverAvailability(id string, from time.Time, days int, now time.Time) ([]availability.Opening, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	caregiver, exists := d.Caregivers.Get(id)
+	if !exists {
+		return nil, ErrCaregiverNotFound
+	}
+	return caregiver.schedule().Open(caregiver.ID, from, days, d.interviews(), now), nil
+}
+
+// interviews are the times open applications' interviews take of their
+// caregivers and families. Callers must hold d.mu.
+func (d *Database) interviews() []availability.Reservation {
+	var reservations []availability.Reservation
+	for _, app := range d.Applications.List() {
+		if app.Interview == nil || (app.Status != ApplicationStatusPending && app.Status != ApplicationStatusAccepted) {
+			continue
+		}
+		jobPosting, _ := d.JobPostings.Get(app.JobID)
+		reservations = append(reservations, availability.Reservation{
+			ID:       app.ID,
+			Resource: app.CaregiverID,
+			Party:    jobPosting.UserEmail,
+			Start:    app.Interview.Start,
+			End:      app.Interview.End,
+		})
+	}
+	return reservations
+}
+
+// ScheduleInterview books, or moves, the family's interview with the
+// caregiver of a pending application for an hour the caregiver is
+// available and neither is in another interview, and tells the caregiver
+// in their chat about it. It returns availability.ErrPast, ErrUnavailable,
+// ErrFull, if the caregiver is busy, or ErrConflict, if the family is, when
+// the time won't do.
+func (d *Database) ScheduleInterview(id, ownerEmail string, start, now time.Time) (Application, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	app, exists := d.Applications.Get(id)
+	if !exists {
+		return Application{}, ErrApplicationNotFound
+	}
+	job, exists := d.JobPostings.Get(app.JobID)
+	if !exists || job.Deleted() {
+		return Application{}, ErrJobNotFound
+	}
+	if job.UserEmail != ownerEmail {
+		return Application{}, ErrNotJobOwner
+	}
+	if app.Status != ApplicationStatusPending {
+		return Application{}, ErrApplicationNotPending
+	}
+
+	interview := availability.Reservation{
+		ID:       app.ID,
+		Resource: app.CaregiverID,
+		Party:    job.UserEmail,
+		Start:    start.UTC(),
+		End:      start.UTC().Add(interviewLength),
+	}
+	booked := d.interviews()
+	caregiver, _ := d.Caregivers.Get(app.CaregiverID)
+	if err := caregiver.schedule().Check(interview, booked, now); err != nil {
+		return Application{}, err
+	}
+	if _, clash := availability.Conflict(interview, booked, now); clash {
+		return Application{}, availability.ErrConflict
+	}
+
+	app.Interview = &availability.Slot{Start: interview.Start, End: interview.End}
+	app.UpdatedAt = now
+	d.Applications.Upsert(app.ID, app)
+	when := interview.Start.Format("Mon Jan 2 at 3:04 PM MST")
+	d.Send(app.ConversationID, job.UserEmail, "Let's meet for an interview on "+when+".")
+	d.notify(d.caregiverEmail(app.CaregiverID), "interview_scheduled",
+		"Interview for \""+job.Title+"\" on "+when, app)
+	return app, nil
+}
+
+// WithdrawApplication lets a caregiver pull a pending or accepted application.
+// Withdrawing after being hired reopens the job for other applicants.
+func (d *Database) WithdrawApplication(id, caregiverID string) (Application, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	app, exists := d.Applications.Get(id)
+	if !exists {
+		return Application{}, ErrApplicationNotFound
+	}
+	if app.CaregiverID != caregiverID {
+		return Application{}, ErrNotApplicant
+	}
+	job, exists := d.JobPostings.Get(app.JobID)
+	if !exists {
+		return Application{}, ErrJobNotFound
+	}
+
+	now := d.clock.Now()
+	switch app.Status {
+	case ApplicationStatusPending:
+	case ApplicationStatusAccepted:
+		if err := statemachine.Move(jobMachine, &job, &job.Status, &job.StatusHistory, JobStatusOpen, now); err != nil {
+			return Application{}, ErrApplicationFinal
+		}
+		job.UpdatedAt = now
+		d.JobPostings.Upsert(job.ID, job)
+	default:
+		return Application{}, ErrApplicationFinal
+	}
+
+	app.Status = ApplicationStatusWithdrawn
+	app.UpdatedAt = now
+	d.Applications.Upsert(app.ID, app)
+	d.Close(applicationChat(app))
+	d.notify(job.UserEmail, "application_withdrawn",
+		"A caregiver withdrew their application for \""+job.Title+"\"", app)
+	d.notify(d.caregiverEmail(app.CaregiverID), "application_withdrawn",
+		"You withdrew your application for \""+job.Title+"\"", app)
+	return app, nil
+}
+
+// CompleteJob lets the family that owns a job in progress mark the care
+// done, after which they may review the caregiver they hired.
+func (d *Database) CompleteJob(id, ownerEmail string) (JobPosting, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	job, exists := d.JobPostings.Get(id)
+	if !exists || job.Deleted() {
+		return JobPosting{}, ErrJobNotFound
+	}
+	if job.UserEmail != ownerEmail {
+		return JobPosting{}, ErrNotJobOwner
+	}
+	now := d.clock.Now()
+	if err := statemachine.Move(jobMachine, &job, &job.Status, &job.StatusHistory, JobStatusCompleted, now); err != nil {
+		return JobPosting{}, ErrJobNotInProgress
+	}
+	job.UpdatedAt = now
+	d.JobPostings.Upsert(job.ID, job)
+
+	for _, app := range d.Applications.List() {
+		if app.JobID == job.ID && app.Status == ApplicationStatusAccepted {
+			d.notify(d.caregiverEmail(app.CaregiverID), "job_completed",
+				"The family marked \""+job.Title+"\" complete", app)
+		}
+	}
+	return job, nil
+}
+
 // HTTP Handlers
-func searchCaregivers(c *fiber.Ctx) error {
+func (h *handlers) searchCaregivers(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	serviceType := ServiceType(c.Query("service_type"))
 	zipCode := c.Query("zip_code")
-	radius := c.QueryInt("radius", 10)
+	radius := c.QueryFloat("radius", 10)
 
 	if serviceType == "" || zipCode == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "service_type and zip_code are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "service_type and zip_code are required")
+	}
+	if radius <= 0 {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "radius must be positive")
+	}
+	place, err := geocode.Lookup(zipCode)
+	if err != nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, err.Error())
 	}
 
-	caregivers := db.SearchCaregivers(serviceType, zipCode, radius)
-	return c.JSON(caregivers)
+	caregivers := db.SearchCaregivers(serviceType, place.Point, radius)
+	return server.List(c, caregivers, "zip_code")
 }
 
-func getUserJobs(c *fiber.Ctx) error {
+func (h *handlers) getUserJobs(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userJobs []JobPosting
 	db.mu.RLock()
-	for _, job := range db.JobPostings {
+	for _, job := range db.JobPostings.List() {
 		if job.UserEmail == email {
 			userJobs = append(userJobs, job)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userJobs)
+	return server.List(c, userJobs)
+}
+
+func (h *handlers) searchJobs(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	filter := JobSearchFilter{
+		ServiceType: ServiceType(c.Query("service_type")),
+		MinRate:     c.QueryFloat("min_rate", 0),
+		MaxRate:     c.QueryFloat("max_rate", 0),
+		Schedule:    c.Query("schedule"),
+		RadiusMiles: c.QueryFloat("radius", 10),
+	}
+
+	if filter.MinRate < 0 || filter.MaxRate < 0 || (filter.MaxRate > 0 && filter.MinRate > filter.MaxRate) {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid rate range")
+	}
+
+	if zipCode := c.Query("zip_code"); zipCode != "" {
+		place, err := geocode.Lookup(zipCode)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, err.Error())
+		}
+		if filter.RadiusMiles <= 0 {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "radius must be positive")
+		}
+		filter.Origin = &place.Point
+	}
+
+	switch c.Query("sort", "posted_desc") {
+	case "posted_desc":
+	case "posted_asc":
+		filter.OldestFirst = true
+	default:
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "sort must be posted_desc or posted_asc")
+	}
+
+	return server.List(c, db.SearchJobs(filter), "service_type", "schedule", "zip_code", "sort")
 }
 
 type CreateJobRequest struct {
-	ServiceType  ServiceType `json:"service_type"`
-	Title        string      `json:"title"`
+	ServiceType  ServiceType `json:"service_type" validate:"required,oneof=childcare seniorcare petcare housekeeping"`
+	Title        string      `json:"title" validate:"required"`
 	Description  string      `json:"description"`
 	Requirements string      `json:"requirements"`
 	Schedule     string      `json:"schedule"`
-	HourlyRate   float64     `json:"hourly_rate"`
+	HourlyRate   money.Money `json:"hourly_rate" validate:"gt=0"`
 	Location     string      `json:"location"`
 	ZipCode      string      `json:"zip_code"`
-	UserEmail    string      `json:"user_email"`
+	UserEmail    string      `json:"user_email" validate:"required,email"`
 }
 
-func createJob(c *fiber.Ctx) error {
+func (h *handlers) createJob(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateJobRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user exists
 	if _, err := db.GetUser(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
+	}
+
+	// Jobs are found by their zip code, so it has to be one we can place
+	place, err := geocode.Lookup(req.ZipCode)
+	if err != nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, err.Error())
+	}
+	if req.Location == "" {
+		req.Location = place.City + ", " + place.State
 	}
 
 	job := JobPosting{
-		ID:           uuid.New().String(),
+		ID:           server.NewID("JOB"),
 		UserEmail:    req.UserEmail,
 		ServiceType:  req.ServiceType,
 		Title:        req.Title,
@@ -247,49 +866,97 @@ func createJob(c *fiber.Ctx) error {
 		Schedule:     req.Schedule,
 		HourlyRate:   req.HourlyRate,
 		Location:     req.Location,
-		ZipCode:      req.ZipCode,
+		ZipCode:      place.Zip,
 		Status:       JobStatusOpen,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+		CreatedAt:    h.clock.Now(),
+		UpdatedAt:    h.clock.Now(),
 	}
 
 	if err := db.CreateJobPosting(job); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create job posting",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create job posting")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(job)
 }
 
+func (h *handlers) deleteJob(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	job, err := db.DeleteJobPosting(c.Params("id"), email)
+	if err != nil {
+		switch err {
+		case ErrJobNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNotJobOwner:
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		case ErrJobNotOpen:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to delete job posting")
+		}
+	}
+
+	return c.JSON(job)
+}
+
+type CompleteJobRequest struct {
+	UserEmail string `json:"user_email" validate:"required,email"`
+}
+
+func (h *handlers) completeJob(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req CompleteJobRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	job, err := db.CompleteJob(c.Params("id"), req.UserEmail)
+	if err != nil {
+		switch err {
+		case ErrJobNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNotJobOwner:
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		case ErrJobNotInProgress:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to complete job posting")
+		}
+	}
+
+	return c.JSON(job)
+}
+
 type CreateApplicationRequest struct {
-	JobID       string `json:"job_id"`
-	CaregiverID string `json:"caregiver_id"`
+	JobID       string `json:"job_id" validate:"required"`
+	CaregiverID string `json:"caregiver_id" validate:"required"`
 	CoverLetter string `json:"cover_letter"`
 }
 
-func createApplication(c *fiber.Ctx) error {
+func (h *handlers) createApplication(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateApplicationRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate job exists
 	job, err := db.GetJobPosting(req.JobID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Job posting not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Job posting not found")
 	}
 
 	// Validate caregiver exists
 	caregiver, err := db.GetCaregiver(req.CaregiverID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Caregiver not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Caregiver not found")
+	}
+	if !actingAs(c, caregiver) {
+		return server.FailWith(c, fiber.StatusForbidden, ErrNotCaregiver)
 	}
 
 	// Validate caregiver provides the required service
@@ -301,129 +968,401 @@ func createApplication(c *fiber.Ctx) error {
 		}
 	}
 	if !validService {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Caregiver does not provide the required service type",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Caregiver does not provide the required service type")
 	}
 
 	application := Application{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("APP"),
 		JobID:       req.JobID,
 		CaregiverID: req.CaregiverID,
 		CoverLetter: req.CoverLetter,
 		Status:      ApplicationStatusPending,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		CreatedAt:   h.clock.Now(),
+		UpdatedAt:   h.clock.Now(),
 	}
 
-	if err := db.CreateApplication(application); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create application",
-		})
+	if err := db.CreateApplication(&application); err != nil {
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create application")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(application)
 }
 
-func getApplications(c *fiber.Ctx) error {
+func (h *handlers) getApplications(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	jobID := c.Query("job_id")
 	if jobID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "job_id parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "job_id parameter is required")
 	}
 
+	// The family that posted the job sees every application to it, and
+	// caregivers only their own.
 	var jobApplications []Application
 	db.mu.RLock()
-	for _, app := range db.Applications {
-		if app.JobID == jobID {
+	jobPosting, _ := db.JobPostings.Get(jobID)
+	family := server.Owns(c, jobPosting.UserEmail)
+	for _, app := range db.Applications.List() {
+		if app.JobID == jobID && (family || server.Owns(c, db.caregiverEmail(app.CaregiverID))) {
 			jobApplications = append(jobApplications, app)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(jobApplications)
+	return server.List(c, jobApplications, "job_id")
+}
+
+type DecideApplicationRequest struct {
+	UserEmail string            `json:"user_email" validate:"required,email"`
+	Status    ApplicationStatus `json:"status" validate:"oneof=accepted rejected"`
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
+func (h *handlers) decideApplication(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req DecideApplicationRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	app, err := db.DecideApplication(c.Params("id"), req.UserEmail, req.Status)
 	if err != nil {
+		switch err {
+		case ErrApplicationNotFound, ErrJobNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNotJobOwner:
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		case ErrApplicationNotPending, ErrJobNotOpen:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update application")
+		}
+	}
+
+	return c.JSON(app)
+}
+
+type ScheduleInterviewRequest struct {
+	UserEmail string    `json:"user_email" validate:"required,email"`
+	Start     time.Time `json:"start" validate:"required"`
+}
+
+func (h *handlers) scheduleInterview(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ScheduleInterviewRequest
+	if err := server.Bind(c, &req); err != nil {
 		return err
 	}
 
-	db = &Database{
-		Users:        make(map[string]User),
-		Caregivers:   make(map[string]Caregiver),
-		JobPostings:  make(map[string]JobPosting),
-		Applications: make(map[string]Application),
+	app, err := db.ScheduleInterview(c.Params("id"), req.UserEmail, req.Start, h.clock.Now())
+	if err != nil {
+		switch err {
+		case ErrApplicationNotFound, ErrJobNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNotJobOwner:
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		case ErrApplicationNotPending, availability.ErrFull, availability.ErrConflict:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		case availability.ErrPast, availability.ErrUnavailable:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to schedule interview")
+		}
+	}
+
+	return c.JSON(app)
+}
+
+// actingAs reports whether the request may act as caregiver, which it
+// names by ID: it must be the caller's own, unless the caller is an admin
+// or the request has no token, as the server allows without --auth.
+func actingAs(c *fiber.Ctx, caregiver Caregiver) bool {
+	return server.Owns(c, caregiver.UserEmail)
+}
+
+type WithdrawApplicationRequest struct {
+	CaregiverID string `json:"caregiver_id" validate:"required"`
+}
+
+func (h *handlers) withdrawApplication(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req WithdrawApplicationRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	if caregiver, err := db.GetCaregiver(req.CaregiverID); err == nil && !actingAs(c, caregiver) {
+		return server.FailWith(c, fiber.StatusForbidden, ErrNotCaregiver)
+	}
+
+	app, err := db.WithdrawApplication(c.Params("id"), req.CaregiverID)
+	if err != nil {
+		switch err {
+		case ErrApplicationNotFound, ErrJobNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNotApplicant:
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		case ErrApplicationFinal:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to withdraw application")
+		}
+	}
+
+	return c.JSON(app)
+}
+
+type CreateReviewRequest struct {
+	UserEmail string `json:"user_email" validate:"required,email"`
+	JobID     string `json:"job_id" validate:"required"`
+	Rating    int    `json:"rating" validate:"gte=1,max=5"`
+	Text      string `json:"text"`
+}
+
+func (h *handlers) createReview(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req CreateReviewRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	review, caregiver, err := db.CreateReview(reviews.Review{
+		Target:    reviews.Target{ID: c.Params("id")},
+		UserEmail: req.UserEmail,
+		Rating:    float64(req.Rating),
+		Body:      req.Text,
+	}, req.JobID)
+	if err != nil {
+		switch err {
+		case ErrCaregiverNotFound, ErrJobNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNotJobOwner:
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		case ErrJobNotCompleted, ErrCaregiverNotHired, ErrAlreadyReviewed:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create review")
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"review":    review,
+		"caregiver": caregiver,
+	})
+}
+
+func (h *handlers) getCaregiverAvailability(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	now := h.clock.Now().UTC()
+	from := now
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "from must be a date in YYYY-MM-DD format")
+		}
+		from = parsed
+	}
+	days := c.QueryInt("days", 7)
+	if days < 1 || days > 31 {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "days must be between 1 and 31")
+	}
+
+	slots, err := db.GetCaregiverAvailability(c.Params("id"), from, days, now)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return c.JSON(fiber.Map{
+		"caregiver_id": c.Params("id"),
+		"from":         from.Format("2006-01-02"),
+		"days":         days,
+		"slots":        slots,
+	})
+}
+
+func (h *handlers) getCaregiverReviews(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	id := c.Params("id")
+	if _, err := db.GetCaregiver(id); err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return json.Unmarshal(data, db)
+	return server.List(c, db.GetCaregiverReviews(id))
 }
 
-func setupRoutes(app *fiber.App) {
+type CreateReferenceRequest struct {
+	ClientEmail  string `json:"client_email" validate:"required,email"`
+	JobID        string `json:"job_id" validate:"required"`
+	Relationship string `json:"relationship"`
+}
+
+func (h *handlers) createReference(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req CreateReferenceRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ref := Reference{
+		ID:           server.NewID("REF"),
+		CaregiverID:  c.Params("id"),
+		ClientEmail:  req.ClientEmail,
+		JobID:        req.JobID,
+		Relationship: req.Relationship,
+		Status:       ReferenceStatusPending,
+		CreatedAt:    h.clock.Now(),
+	}
+
+	if err := db.CreateReference(ref); err != nil {
+		switch err {
+		case ErrCaregiverNotFound, ErrJobNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNotJobOwner, ErrCaregiverNotHired:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create reference request")
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(ref)
+}
+
+func (h *handlers) getCaregiverReferences(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	id := c.Params("id")
+	if _, err := db.GetCaregiver(id); err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	return server.List(c, db.GetCaregiverReferences(id))
+}
+
+type RespondToReferenceRequest struct {
+	ClientEmail string `json:"client_email" validate:"required,email"`
+	Confirmed   bool   `json:"confirmed"`
+	Comment     string `json:"comment"`
+}
+
+func (h *handlers) respondToReference(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req RespondToReferenceRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ref, err := db.RespondToReference(c.Params("id"), req.ClientEmail, req.Confirmed, req.Comment)
+	if err != nil {
+		switch err {
+		case ErrReferenceNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNotJobOwner:
+			return server.Fail(c, fiber.StatusForbidden, server.CodeForbidden, "reference was not requested from this client")
+		case ErrReferenceAlreadyFinal:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update reference")
+		}
+	}
+
+	return c.JSON(ref)
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
+	}
+
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	h.db.Set(db)
+	return nil
+}
+
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Caregiver routes
-	api.Get("/caregivers", searchCaregivers)
+	api.Get("/caregivers", h.searchCaregivers)
 	api.Get("/caregivers/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		caregiver, err := db.GetCaregiver(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(caregiver)
 	})
+	api.Get("/caregivers/:id/availability", h.getCaregiverAvailability)
+	api.Get("/caregivers/:id/reviews", h.getCaregiverReviews)
+	api.Post("/caregivers/:id/reviews", h.createReview)
+	api.Get("/caregivers/:id/references", h.getCaregiverReferences)
+	api.Post("/caregivers/:id/references", h.createReference)
 
 	// Job posting routes
-	api.Get("/jobs", getUserJobs)
-	api.Post("/jobs", createJob)
+	api.Get("/jobs", h.getUserJobs)
+	api.Post("/jobs", h.createJob)
+	api.Get("/jobs/search", h.searchJobs)
 	api.Get("/jobs/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		job, err := db.GetJobPosting(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(job)
 	})
+	api.Delete("/jobs/:id", h.deleteJob)
+	api.Patch("/jobs/:id/complete", h.completeJob)
 
 	// Application routes
-	api.Get("/applications", getApplications)
-	api.Post("/applications", createApplication)
+	api.Get("/applications", h.getApplications)
+	api.Post("/applications", h.createApplication)
+	api.Patch("/applications/:id/status", h.decideApplication)
+	api.Patch("/applications/:id/withdraw", h.withdrawApplication)
+	api.Patch("/applications/:id/interview", h.scheduleInterview)
+
+	// Reference routes
+	api.Patch("/references/:id", h.respondToReference)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	setupRoutes(app)
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "applications"},
+			Search:  []string{"caregivers", "job_postings", "applications", "reviews"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
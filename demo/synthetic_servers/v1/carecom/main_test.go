@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"pkg/servertest"
+)
+
+const fixture = `{
+  "users": {
+    "casey@example.com": {"email": "casey@example.com", "name": "Casey", "zip_code": "94105"},
+    "maria@example.com": {"email": "maria@example.com", "name": "Maria", "zip_code": "94110"}
+  },
+  "caregivers": {
+    "cg_1": {"id": "cg_1", "user_email": "maria@example.com", "service_types": ["childcare"], "zip_code": "94110", "hourly_rate": 25.0}
+  },
+  "job_postings": {
+    "job_1": {"id": "job_1", "user_email": "casey@example.com", "service_type": "childcare", "title": "After-school care",
+      "hourly_rate": 28.0, "zip_code": "94105", "status": "open"}
+  },
+  "applications": {
+    "app_1": {"id": "app_1", "job_id": "job_1", "caregiver_id": "cg_1", "status": "pending"}
+  },
+  "references": {}
+}`
+
+var now = time.Date(2025, 3, 4, 17, 0, 0, 0, time.UTC)
+
+func newTestApp(t *testing.T) (*fiber.App, *handlers) {
+	t.Helper()
+	h, err := newHandlers(servertest.Store(fixture), servertest.Clock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := servertest.App()
+	setupRoutes(app, h)
+	return app, h
+}
+
+func TestCompleteJob(t *testing.T) {
+	app, _ := newTestApp(t)
+	const review = `{"user_email": "casey@example.com", "job_id": "job_1", "rating": 5, "text": "Wonderful with the kids"}`
+
+	if code := servertest.Do(t, app, "PATCH", "/api/v1/jobs/job_1/complete", `{"user_email": "casey@example.com"}`, nil); code != http.StatusConflict {
+		t.Errorf("completing an open job: got %d, want %d", code, http.StatusConflict)
+	}
+	if code := servertest.Do(t, app, "PATCH", "/api/v1/applications/app_1/status",
+		`{"user_email": "casey@example.com", "status": "accepted"}`, nil); code != http.StatusOK {
+		t.Fatalf("hiring: got %d", code)
+	}
+	if code := servertest.Do(t, app, "POST", "/api/v1/caregivers/cg_1/reviews", review, nil); code != http.StatusConflict {
+		t.Errorf("reviewing before the job is complete: got %d, want %d", code, http.StatusConflict)
+	}
+	if code := servertest.Do(t, app, "PATCH", "/api/v1/jobs/job_1/complete", `{"user_email": "maria@example.com"}`, nil); code != http.StatusForbidden {
+		t.Errorf("completing another family's job: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	var job JobPosting
+	if code := servertest.Do(t, app, "PATCH", "/api/v1/jobs/job_1/complete", `{"user_email": "casey@example.com"}`, &job); code != http.StatusOK {
+		t.Fatalf("completing: got %d", code)
+	}
+	if job.Status != JobStatusCompleted {
+		t.Errorf("job is %s, want completed", job.Status)
+	}
+	var moves []string
+	for _, tr := range job.StatusHistory {
+		moves = append(moves, tr.From+">"+tr.To)
+	}
+	if len(moves) != 2 || moves[0] != "open>in_progress" || moves[1] != "in_progress>completed" {
+		t.Errorf("job moved %v, want hired and then completed", moves)
+	}
+
+	if code := servertest.Do(t, app, "PATCH", "/api/v1/jobs/job_1/complete", `{"user_email": "casey@example.com"}`, nil); code != http.StatusConflict {
+		t.Errorf("completing twice: got %d, want %d", code, http.StatusConflict)
+	}
+	if code := servertest.Do(t, app, "POST", "/api/v1/caregivers/cg_1/reviews", review, nil); code != http.StatusCreated {
+		t.Errorf("reviewing the completed job: got %d, want %d", code, http.StatusCreated)
+	}
+}
+
+func TestWithdrawReopensJob(t *testing.T) {
+	app, h := newTestApp(t)
+	servertest.Do(t, app, "PATCH", "/api/v1/applications/app_1/status", `{"user_email": "casey@example.com", "status": "accepted"}`, nil)
+	if code := servertest.Do(t, app, "PATCH", "/api/v1/applications/app_1/withdraw", `{"caregiver_id": "cg_1"}`, nil); code != http.StatusOK {
+		t.Fatalf("withdrawing: got %d", code)
+	}
+	job, _ := h.db.Get().JobPostings.Get("job_1")
+	if job.Status != JobStatusOpen || len(job.StatusHistory) != 2 {
+		t.Errorf("job is %s after %d moves, want open again after 2", job.Status, len(job.StatusHistory))
+	}
+	if code := servertest.Do(t, app, "PATCH", "/api/v1/jobs/job_1/complete", `{"user_email": "casey@example.com"}`, nil); code != http.StatusConflict {
+		t.Errorf("completing a reopened job: got %d, want %d", code, http.StatusConflict)
+	}
+}
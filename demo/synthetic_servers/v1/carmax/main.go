@@ -1,34 +1,30 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
 type Car struct {
-	ID       string    `json:"id"`
-	Make     string    `json:"make"`
-	Model    string    `json:"model"`
-	Year     int       `json:"year"`
-	Price    float64   `json:"price"`
-	Mileage  int       `json:"mileage"`
-	Color    string    `json:"color"`
-	VIN      string    `json:"vin"`
-	Features []string  `json:"features"`
-	Images   []string  `json:"images"`
-	AddedAt  time.Time `json:"added_at"`
+	ID       string      `json:"id"`
+	Make     string      `json:"make"`
+	Model    string      `json:"model"`
+	Year     int         `json:"year"`
+	Price    money.Money `json:"price"`
+	Mileage  int         `json:"mileage"`
+	Color    string      `json:"color"`
+	VIN      string      `json:"vin"`
+	Features []string    `json:"features"`
+	Images   []string    `json:"images"`
+	AddedAt  time.Time   `json:"added_at"`
 }
 
 type SavedCar struct {
@@ -66,21 +62,34 @@ type Appointment struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users        map[string]User        `json:"users"`
-	Cars         map[string]Car         `json:"cars"`
-	Appointments map[string]Appointment `json:"appointments"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users        server.Repository[User]        `json:"users"`
+	Cars         server.Repository[Car]         `json:"cars"`
+	Appointments server.Repository[Appointment] `json:"appointments"`
 	mu           sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers list CarMax's cars, save the ones users like and book
+// appointments to see them, dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the cars, users and appointments in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -91,7 +100,7 @@ func (d *Database) GetCar(id string) (Car, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	car, exists := d.Cars[id]
+	car, exists := d.Cars.Get(id)
 	if !exists {
 		return Car{}, errors.New("car not found")
 	}
@@ -102,13 +111,13 @@ func (d *Database) SaveCar(email string, savedCar SavedCar) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return errors.New("user not found")
 	}
 
 	user.SavedCars = append(user.SavedCars, savedCar)
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
@@ -116,12 +125,13 @@ func (d *Database) CreateAppointment(appointment Appointment) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Appointments[appointment.ID] = appointment
+	d.Appointments.Upsert(appointment.ID, appointment)
 	return nil
 }
 
 // HTTP Handlers
-func searchCars(c *fiber.Ctx) error {
+func (h *handlers) searchCars(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	make := c.Query("make")
 	model := c.Query("model")
 	maxPrice := c.QueryFloat("maxPrice", 1000000)
@@ -130,210 +140,194 @@ func searchCars(c *fiber.Ctx) error {
 	var matchingCars []Car
 
 	db.mu.RLock()
-	for _, car := range db.Cars {
+	for _, car := range db.Cars.List() {
 		if (make == "" || car.Make == make) &&
 			(model == "" || car.Model == model) &&
-			car.Price <= maxPrice &&
+			car.Price.Float() <= maxPrice &&
 			car.Mileage <= maxMileage {
 			matchingCars = append(matchingCars, car)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(matchingCars)
+	return server.List(c, matchingCars, "make", "model")
 }
 
-func getSavedCars(c *fiber.Ctx) error {
+func (h *handlers) getSavedCars(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.SavedCars)
+	return server.List(c, user.SavedCars)
 }
 
-func saveCar(c *fiber.Ctx) error {
+func (h *handlers) saveCar(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		CarID     string `json:"carId"`
-		UserEmail string `json:"userEmail"`
+		UserEmail string `json:"userEmail" validate:"email"`
 		Notes     string `json:"notes"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	car, err := db.GetCar(req.CarID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	savedCar := SavedCar{
 		Car:     car,
-		SavedAt: time.Now(),
+		SavedAt: h.clock.Now(),
 		Notes:   req.Notes,
 	}
 
 	if err := db.SaveCar(req.UserEmail, savedCar); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(savedCar)
 }
 
-func getAppointments(c *fiber.Ctx) error {
+func (h *handlers) getAppointments(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userAppointments []Appointment
 
 	db.mu.RLock()
-	for _, appointment := range db.Appointments {
+	for _, appointment := range db.Appointments.List() {
 		if appointment.UserEmail == email {
 			userAppointments = append(userAppointments, appointment)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userAppointments)
+	return server.List(c, userAppointments)
 }
 
-func createAppointment(c *fiber.Ctx) error {
+func (h *handlers) createAppointment(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		CarID     string    `json:"carId"`
-		UserEmail string    `json:"userEmail"`
+		UserEmail string    `json:"userEmail" validate:"email"`
 		DateTime  time.Time `json:"datetime"`
 		Location  string    `json:"location"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	car, err := db.GetCar(req.CarID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	appointment := Appointment{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("APPT"),
 		Car:       car,
 		UserEmail: req.UserEmail,
 		DateTime:  req.DateTime,
 		Location:  req.Location,
 		Status:    AppointmentStatusPending,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		CreatedAt: h.clock.Now(),
+		UpdatedAt: h.clock.Now(),
 	}
 
 	if err := db.CreateAppointment(appointment); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(appointment)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:        make(map[string]User),
-		Cars:         make(map[string]Car),
-		Appointments: make(map[string]Appointment),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Car inventory routes
-	api.Get("/inventory", searchCars)
+	api.Get("/inventory", h.searchCars)
 	api.Get("/inventory/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		car, err := db.GetCar(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(car)
 	})
 
 	// Saved cars routes
-	api.Get("/saved-cars", getSavedCars)
-	api.Post("/saved-cars", saveCar)
+	api.Get("/saved-cars", h.getSavedCars)
+	api.Post("/saved-cars", h.saveCar)
 
 	// Appointment routes
-	api.Get("/appointments", getAppointments)
-	api.Post("/appointments", createAppointment)
+	api.Get("/appointments", h.getAppointments)
+	api.Post("/appointments", h.createAppointment)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"appointments"},
+			Search:  []string{"cars", "appointments"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
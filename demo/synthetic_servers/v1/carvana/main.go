@@ -1,50 +1,47 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Vehicle struct {
-	ID         string   `json:"id"`
-	Make       string   `json:"make"`
-	Model      string   `json:"model"`
-	Year       int      `json:"year"`
-	Price      float64  `json:"price"`
-	Mileage    int      `json:"mileage"`
-	Color      string   `json:"color"`
-	VIN        string   `json:"vin"`
-	Features   []string `json:"features"`
-	Images     []string `json:"images"`
-	Condition  string   `json:"condition"`
-	CarfaxLink string   `json:"carfax_link"`
-	Available  bool     `json:"available"`
+	ID         string      `json:"id"`
+	Make       string      `json:"make"`
+	Model      string      `json:"model"`
+	Year       int         `json:"year"`
+	Price      money.Money `json:"price"`
+	Mileage    int         `json:"mileage"`
+	Color      string      `json:"color"`
+	VIN        string      `json:"vin"`
+	Features   []string    `json:"features"`
+	Images     []string    `json:"images"`
+	Condition  string      `json:"condition"`
+	CarfaxLink string      `json:"carfax_link"`
+	Available  bool        `json:"available"`
 }
 
 type FinancingDetails struct {
-	TermMonths     int     `json:"term_months"`
-	APR            float64 `json:"apr"`
-	MonthlyPayment float64 `json:"monthly_payment"`
-	DownPayment    float64 `json:"down_payment"`
+	TermMonths     int         `json:"term_months"`
+	APR            float64     `json:"apr"`
+	MonthlyPayment money.Money `json:"monthly_payment"`
+	DownPayment    money.Money `json:"down_payment"`
 }
 
 type TradeInDetails struct {
-	Make  string  `json:"make"`
-	Model string  `json:"model"`
-	Year  int     `json:"year"`
-	Value float64 `json:"value"`
+	Make  string      `json:"make"`
+	Model string      `json:"model"`
+	Year  int         `json:"year"`
+	Value money.Money `json:"value"`
 }
 
 type OrderStatus string
@@ -57,17 +54,36 @@ const (
 	OrderStatusCancelled  OrderStatus = "cancelled"
 )
 
+// orderMachine is the statuses a purchase moves through. It can be
+// cancelled until the car is on its way.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	string(OrderStatusPending):    {string(OrderStatusApproved), string(OrderStatusCancelled)},
+	string(OrderStatusApproved):   {string(OrderStatusDelivering), string(OrderStatusCancelled)},
+	string(OrderStatusDelivering): {string(OrderStatusCompleted)},
+}}
+
+// orderLifecycle approves orders within the hour, puts the car on the road
+// the day before its delivery date and completes the sale on the day.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: string(OrderStatusPending), To: string(OrderStatusApproved), After: time.Hour,
+		Notify: server.Notice{Type: "order_approved", Message: "Your purchase {{id}} is approved."}},
+	{From: string(OrderStatusApproved), To: string(OrderStatusDelivering), At: "delivery_date", After: -24 * time.Hour,
+		Notify: server.Notice{Type: "order_out_for_delivery", Message: "Your car is on its way for delivery on your order {{id}}.", Text: "delivery_update"}},
+	{From: string(OrderStatusDelivering), To: string(OrderStatusCompleted), At: "delivery_date"},
+}, Sender: "Carvana", Machine: orderMachine}
+
 type Order struct {
-	ID               string            `json:"id"`
-	VehicleID        string            `json:"vehicle_id"`
-	UserEmail        string            `json:"user_email"`
-	Status           OrderStatus       `json:"status"`
-	DeliveryDate     time.Time         `json:"delivery_date"`
-	PaymentMethod    string            `json:"payment_method"`
-	FinancingDetails *FinancingDetails `json:"financing_details,omitempty"`
-	TradeIn          *TradeInDetails   `json:"trade_in,omitempty"`
-	CreatedAt        time.Time         `json:"created_at"`
-	UpdatedAt        time.Time         `json:"updated_at"`
+	ID               string                    `json:"id"`
+	VehicleID        string                    `json:"vehicle_id"`
+	UserEmail        string                    `json:"user_email"`
+	Status           OrderStatus               `json:"status"`
+	StatusHistory    []statemachine.Transition `json:"status_history,omitempty"`
+	DeliveryDate     time.Time                 `json:"delivery_date"`
+	PaymentMethod    string                    `json:"payment_method"`
+	FinancingDetails *FinancingDetails         `json:"financing_details,omitempty"`
+	TradeIn          *TradeInDetails           `json:"trade_in,omitempty"`
+	CreatedAt        time.Time                 `json:"created_at"`
+	UpdatedAt        time.Time                 `json:"updated_at"`
 }
 
 type User struct {
@@ -90,20 +106,41 @@ type PaymentMethod struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Vehicles map[string]Vehicle `json:"vehicles"`
-	Orders   map[string]Order   `json:"orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]    `json:"users"`
+	Vehicles server.Repository[Vehicle] `json:"vehicles"`
+	Orders   server.Repository[Order]   `json:"orders"`
 	mu       sync.RWMutex
 }
 
-var db *Database
+// PhoneNumber returns the user's phone number, for texts. Callers must hold
+// d.mu.
+func (d *Database) PhoneNumber(email string) string {
+	user, _ := d.Users.Get(email)
+	return user.Phone
+}
+
+// handlers sell Carvana's vehicles and estimate trade-ins, dating orders and
+// estimates by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the vehicles, users and orders in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetVehicle(id string) (Vehicle, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	vehicle, exists := d.Vehicles[id]
+	vehicle, exists := d.Vehicles.Get(id)
 	if !exists {
 		return Vehicle{}, errors.New("vehicle not found")
 	}
@@ -114,7 +151,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -125,12 +162,13 @@ func (d *Database) CreateOrder(order Order) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Orders[order.ID] = order
+	d.Orders.Upsert(order.ID, order)
 	return nil
 }
 
 // Handlers
-func searchVehicles(c *fiber.Ctx) error {
+func (h *handlers) searchVehicles(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	make := c.Query("make")
 	model := c.Query("model")
 	yearMin := c.QueryInt("year_min", 0)
@@ -141,7 +179,7 @@ func searchVehicles(c *fiber.Ctx) error {
 	var results []Vehicle
 
 	db.mu.RLock()
-	for _, vehicle := range db.Vehicles {
+	for _, vehicle := range db.Vehicles.List() {
 		if !vehicle.Available {
 			continue
 		}
@@ -158,10 +196,10 @@ func searchVehicles(c *fiber.Ctx) error {
 		if yearMax != 0 && vehicle.Year > yearMax {
 			continue
 		}
-		if priceMin != 0 && vehicle.Price < priceMin {
+		if priceMin != 0 && vehicle.Price.Float() < priceMin {
 			continue
 		}
-		if priceMax != 0 && vehicle.Price > priceMax {
+		if priceMax != 0 && vehicle.Price.Float() > priceMax {
 			continue
 		}
 
@@ -169,78 +207,69 @@ func searchVehicles(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(results)
+	return server.List(c, results, "make", "model")
 }
 
-func getVehicleDetails(c *fiber.Ctx) error {
+func (h *handlers) getVehicleDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	id := c.Params("vehicleId")
 
 	vehicle, err := db.GetVehicle(id)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Vehicle not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Vehicle not found")
 	}
 
 	return c.JSON(vehicle)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
 	var userOrders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
+	for _, order := range db.Orders.List() {
 		if order.UserEmail == email {
 			userOrders = append(userOrders, order)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return server.List(c, userOrders)
 }
 
 type NewOrderRequest struct {
-	VehicleID          string `json:"vehicle_id"`
-	UserEmail          string `json:"user_email"`
-	PaymentMethod      string `json:"payment_method"`
+	VehicleID          string `json:"vehicle_id" validate:"required"`
+	UserEmail          string `json:"user_email" validate:"required,email"`
+	PaymentMethod      string `json:"payment_method" validate:"required"`
 	FinancingRequested bool   `json:"financing_requested"`
 	TradeInID          string `json:"trade_in_id"`
 }
 
-func createOrder(c *fiber.Ctx) error {
+func (h *handlers) createOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewOrderRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Validate vehicle
 	vehicle, err := db.GetVehicle(req.VehicleID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Vehicle not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Vehicle not found")
 	}
 
 	if !vehicle.Available {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Vehicle is no longer available",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Vehicle is no longer available")
 	}
 
 	// Validate payment method
@@ -252,21 +281,19 @@ func createOrder(c *fiber.Ctx) error {
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Create new order
 	order := Order{
-		ID:            uuid.New().String(),
+		ID:            server.NewID("ORD"),
 		VehicleID:     req.VehicleID,
 		UserEmail:     req.UserEmail,
 		Status:        OrderStatusPending,
-		DeliveryDate:  time.Now().AddDate(0, 0, 7), // Default delivery in 7 days
+		DeliveryDate:  h.clock.Now().AddDate(0, 0, 7), // Default delivery in 7 days
 		PaymentMethod: req.PaymentMethod,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
+		CreatedAt:     h.clock.Now(),
+		UpdatedAt:     h.clock.Now(),
 	}
 
 	// If financing is requested, calculate details
@@ -275,41 +302,37 @@ func createOrder(c *fiber.Ctx) error {
 			TermMonths:     72,
 			APR:            4.99,
 			MonthlyPayment: calculateMonthlyPayment(vehicle.Price, 72, 4.99),
-			DownPayment:    vehicle.Price * 0.1, // 10% down payment
+			DownPayment:    vehicle.Price.Mul(0.1), // 10% down payment
 		}
 	}
 
 	// Save order
 	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create order")
 	}
 
 	// Mark vehicle as unavailable
 	db.mu.Lock()
 	vehicle.Available = false
-	db.Vehicles[vehicle.ID] = vehicle
+	db.Vehicles.Upsert(vehicle.ID, vehicle)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
 type TradeInRequest struct {
-	Make      string `json:"make"`
-	Model     string `json:"model"`
-	Year      int    `json:"year"`
-	Mileage   int    `json:"mileage"`
-	Condition string `json:"condition"`
+	Make      string `json:"make" validate:"required"`
+	Model     string `json:"model" validate:"required"`
+	Year      int    `json:"year" validate:"gte=1900"`
+	Mileage   int    `json:"mileage" validate:"gte=0"`
+	Condition string `json:"condition" validate:"omitempty,oneof=excellent good fair poor"`
 	ZipCode   string `json:"zip_code"`
 }
 
-func getTradeInEstimate(c *fiber.Ctx) error {
+func (h *handlers) getTradeInEstimate(c *fiber.Ctx) error {
 	var req TradeInRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Simple trade-in value calculation
@@ -325,23 +348,22 @@ func getTradeInEstimate(c *fiber.Ctx) error {
 	}
 
 	estimate := struct {
-		ID         string    `json:"id"`
-		Value      float64   `json:"value"`
-		ValidUntil time.Time `json:"valid_until"`
+		ID         string      `json:"id"`
+		Value      money.Money `json:"value"`
+		ValidUntil time.Time   `json:"valid_until"`
 	}{
-		ID:         uuid.New().String(),
-		Value:      value,
-		ValidUntil: time.Now().AddDate(0, 0, 7),
+		ID:         server.NewID("EST"),
+		Value:      money.Dollars(value),
+		ValidUntil: h.clock.Now().AddDate(0, 0, 7),
 	}
 
 	return c.JSON(estimate)
 }
 
-func calculateMonthlyPayment(principal float64, termMonths int, apr float64) float64 {
+func calculateMonthlyPayment(principal money.Money, termMonths int, apr float64) money.Money {
 	monthlyRate := apr / 12 / 100
-	payment := principal * monthlyRate * float64(pow(1+monthlyRate, termMonths)) /
-		float64(pow(1+monthlyRate, termMonths)-1)
-	return payment
+	return principal.Mul(monthlyRate * pow(1+monthlyRate, termMonths) /
+		(pow(1+monthlyRate, termMonths) - 1))
 }
 
 func pow(base float64, exp int) float64 {
@@ -352,64 +374,72 @@ func pow(base float64, exp int) float64 {
 	return result
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Vehicles: make(map[string]Vehicle),
-		Orders:   make(map[string]Order),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Vehicle routes
-	api.Get("/vehicles", searchVehicles)
-	api.Get("/vehicles/:vehicleId", getVehicleDetails)
+	api.Get("/vehicles", h.searchVehicles)
+	api.Get("/vehicles/:vehicleId", h.getVehicleDetails)
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", createOrder)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.createOrder)
 
 	// Trade-in routes
-	api.Post("/trade-in/estimate", getTradeInEstimate)
+	api.Post("/trade-in/estimate", h.getTradeInEstimate)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders"},
+			Search:  []string{"vehicles", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,21 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"log"
-	"os"
+	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/ledger"
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -34,25 +36,202 @@ const (
 	TransactionStatusFailed    TransactionStatus = "FAILED"
 )
 
+// transactionMachine is the statuses a pending transaction, such as a
+// wire's or a Zelle send's debit, settles into.
+var transactionMachine = &statemachine.Machine{Name: "transaction", Moves: map[string][]string{
+	string(TransactionStatusPending): {string(TransactionStatusCompleted), string(TransactionStatusFailed)},
+}}
+
 type Account struct {
-	ID        string      `json:"id"`
-	UserEmail string      `json:"user_email"`
-	Type      AccountType `json:"type"`
-	Name      string      `json:"name"`
-	Balance   float64     `json:"balance"`
-	Currency  string      `json:"currency"`
-	Last4     string      `json:"last4"`
-	Status    string      `json:"status"`
-	CreatedAt time.Time   `json:"created_at"`
-	UpdatedAt time.Time   `json:"updated_at"`
+	ID        string       `json:"id"`
+	UserEmail string       `json:"user_email"`
+	Type      AccountType  `json:"type"`
+	Name      string       `json:"name"`
+	Balance   money.Money  `json:"balance"`
+	Currency  string       `json:"currency"`
+	Last4     string       `json:"last4"`
+	Status    string       `json:"status"`
+	Credit    *CreditTerms `json:"credit,omitempty"` // Credit cards only
+
+	// Card controls, for accounts with a card
+	CardLocked    bool           `json:"card_locked"`
+	ReplacedCards []ReplacedCard `json:"replaced_cards,omitempty"`
+	TravelNotices []TravelNotice `json:"travel_notices,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CreditTerms are a credit card's terms. A card's balance is negative when
+// money is owed.
+type CreditTerms struct {
+	CreditLimit  money.Money `json:"credit_limit"`
+	APR          float64     `json:"apr"`           // Percent
+	StatementDay int         `json:"statement_day"` // Day of month the cycle closes
+	GraceDays    int         `json:"grace_days"`    // Statement close to payment due
+}
+
+type WireKind string
+
+const (
+	WireDomestic      WireKind = "DOMESTIC"
+	WireInternational WireKind = "INTERNATIONAL"
+)
+
+type WireStatus string
+
+const (
+	WireScheduled  WireStatus = "SCHEDULED"  // Waiting for its processing date
+	WireProcessing WireStatus = "PROCESSING" // Sent, awaiting the beneficiary bank
+	WireCompleted  WireStatus = "COMPLETED"
+	WireCancelled  WireStatus = "CANCELLED"
+)
+
+// wireMachine is the statuses a wire moves through. It can be cancelled
+// only until it is sent.
+var wireMachine = &statemachine.Machine{Name: "wire", Moves: map[string][]string{
+	string(WireScheduled):  {string(WireProcessing), string(WireCancelled)},
+	string(WireProcessing): {string(WireCompleted)},
+}}
+
+type Beneficiary struct {
+	Name          string `json:"name"`
+	Address       string `json:"address"`
+	BankName      string `json:"bank_name"`
+	AccountNumber string `json:"account_number"`           // Account number or IBAN
+	RoutingNumber string `json:"routing_number,omitempty"` // Domestic ABA number
+	SwiftCode     string `json:"swift_code,omitempty"`     // International
+	Country       string `json:"country"`
+}
+
+type WireEvent struct {
+	Status WireStatus `json:"status"`
+	At     time.Time  `json:"at"`
+	Note   string     `json:"note,omitempty"`
+}
+
+// Wire is a wire transfer out of a checking account. Unlike ordinary
+// transfers, wires are processed on business days and tracked through
+// their own statuses.
+type Wire struct {
+	ID             string      `json:"id"`
+	UserEmail      string      `json:"user_email"`
+	FromAccount    string      `json:"from_account"`
+	Kind           WireKind    `json:"kind"`
+	Beneficiary    Beneficiary `json:"beneficiary"`
+	Amount         money.Money `json:"amount"`
+	Fee            money.Money `json:"fee"`
+	Purpose        string      `json:"purpose,omitempty"`
+	Status         WireStatus  `json:"status"`
+	SubmittedAt    time.Time   `json:"submitted_at"`
+	ProcessOn      time.Time   `json:"process_on"` // When the wire is sent
+	CompletedAt    *time.Time  `json:"completed_at,omitempty"`
+	TransactionIDs []string    `json:"transaction_ids"`
+	History        []WireEvent `json:"history"`
+}
+
+// wireFees are what wires cost, which --fees wire_domestic=...,
+// wire_international=... override.
+var wireFees = map[WireKind]money.Money{
+	WireDomestic:      money.Cents(2500),
+	WireInternational: money.Cents(4000),
+}
+
+// Wires submitted after the cutoff, Eastern time, go out the next business
+// day. Sent wires complete after the delivery time.
+var (
+	wireCutoffHour = map[WireKind]int{
+		WireDomestic:      17,
+		WireInternational: 16,
+	}
+	wireDelivery = map[WireKind]time.Duration{
+		WireDomestic:      30 * time.Minute,
+		WireInternational: 24 * time.Hour,
+	}
+)
+
+const wireOpeningHour = 9
+
+var eastern = loadEastern()
+
+func loadEastern() *time.Location {
+	if loc, err := time.LoadLocation("America/New_York"); err == nil {
+		return loc
+	}
+	return time.FixedZone("EST", -5*60*60)
+}
+
+// ReplacedCard is a card number retired after being reported lost or
+// stolen.
+type ReplacedCard struct {
+	Last4      string    `json:"last4"`
+	Reason     string    `json:"reason"` // LOST or STOLEN
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// TravelNotice lets a card be used abroad. Dates are inclusive.
+type TravelNotice struct {
+	ID           string    `json:"id"`
+	Destinations []string  `json:"destinations"` // ISO country codes
+	StartDate    time.Time `json:"start_date"`
+	EndDate      time.Time `json:"end_date"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// covers reports whether a notice allows a purchase in country at t.
+func (n TravelNotice) covers(country string, t time.Time) bool {
+	if t.Before(n.StartDate) || !t.Before(n.EndDate.AddDate(0, 0, 1)) {
+		return false
+	}
+	for _, dest := range n.Destinations {
+		if dest == country {
+			return true
+		}
+	}
+	return false
+}
+
+// Replacement cards arrive within this many days of being issued.
+const replacementCardDays = 5
+
+type StatementStatus string
+
+const (
+	StatementOpen        StatementStatus = "OPEN"         // Before the due date, less than the minimum paid
+	StatementMinimumPaid StatementStatus = "MINIMUM_PAID" // At least the minimum paid
+	StatementPaidInFull  StatementStatus = "PAID_IN_FULL"
+	StatementPastDue     StatementStatus = "PAST_DUE"
+)
+
+type Statement struct {
+	ID              string          `json:"id"`
+	AccountID       string          `json:"account_id"`
+	PeriodStart     time.Time       `json:"period_start"`
+	PeriodEnd       time.Time       `json:"period_end"`
+	PreviousBalance money.Money     `json:"previous_balance"`
+	Purchases       money.Money     `json:"purchases"`
+	Payments        money.Money     `json:"payments"`
+	Interest        money.Money     `json:"interest"`
+	NewBalance      money.Money     `json:"new_balance"` // Owed at close
+	MinimumPayment  money.Money     `json:"minimum_payment"`
+	DueDate         time.Time       `json:"due_date"`
+	PaidAmount      money.Money     `json:"paid_amount"` // Paid since close
+	Status          StatementStatus `json:"status"`
 }
 
+// Minimum payment is the larger of a flat amount or 1% of the balance plus
+// interest, never more than the balance.
+var (
+	minimumPaymentFloor = money.Cents(4000)
+	minimumPaymentRate  = 0.01
+)
+
 type Transaction struct {
 	ID          string            `json:"id"`
 	AccountID   string            `json:"account_id"`
 	Date        time.Time         `json:"date"`
 	Description string            `json:"description"`
-	Amount      float64           `json:"amount"`
+	Amount      money.Money       `json:"amount"`
 	Type        TransactionType   `json:"type"`
 	Category    string            `json:"category"`
 	Status      TransactionStatus `json:"status"`
@@ -63,46 +242,210 @@ type Transfer struct {
 	ID          string            `json:"id"`
 	FromAccount string            `json:"from_account"`
 	ToAccount   string            `json:"to_account"`
-	Amount      float64           `json:"amount"`
+	Amount      money.Money       `json:"amount"`
 	Description string            `json:"description"`
 	Status      TransactionStatus `json:"status"`
 	CreatedAt   time.Time         `json:"created_at"`
 }
 
 type Bill struct {
+	ID        string      `json:"id"`
+	UserEmail string      `json:"user_email"`
+	Payee     string      `json:"payee"`
+	Amount    money.Money `json:"amount"`
+	DueDate   time.Time   `json:"due_date"`
+	Status    string      `json:"status"`
+	Autopay   bool        `json:"autopay"`
+}
+
+// ZelleProfile is a customer's Zelle enrollment. Payments move through the
+// linked checking account.
+type ZelleProfile struct {
+	UserEmail         string      `json:"user_email"`
+	Name              string      `json:"name"`   // Shown to people paying them
+	Tokens            []string    `json:"tokens"` // Enrolled emails and phone numbers
+	AccountID         string      `json:"account_id"`
+	DailySendLimit    money.Money `json:"daily_send_limit"`
+	DailyRequestLimit money.Money `json:"daily_request_limit"`
+	EnrolledAt        time.Time   `json:"enrolled_at"`
+}
+
+// ZelleMember is someone enrolled with Zelle at another bank.
+type ZelleMember struct {
+	Token string `json:"token"`
+	Name  string `json:"name"`
+	Bank  string `json:"bank"`
+}
+
+type ZelleRecipient struct {
 	ID        string    `json:"id"`
-	UserEmail string    `json:"user_email"`
-	Payee     string    `json:"payee"`
-	Amount    float64   `json:"amount"`
-	DueDate   time.Time `json:"due_date"`
-	Status    string    `json:"status"`
-	Autopay   bool      `json:"autopay"`
+	UserEmail string    `json:"user_email" validate:"required,email"`
+	Name      string    `json:"name" validate:"required"`
+	Email     string    `json:"email,omitempty" validate:"email"`
+	Phone     string    `json:"phone,omitempty"`
+	Enrolled  bool      `json:"enrolled"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
+type ZelleKind string
+
+const (
+	ZelleSend    ZelleKind = "SEND"
+	ZelleRequest ZelleKind = "REQUEST"
+)
+
+type ZelleStatus string
+
+const (
+	ZellePending   ZelleStatus = "PENDING"   // Sent, or request accepted, awaiting settlement
+	ZelleRequested ZelleStatus = "REQUESTED" // Waiting on the payer
+	ZelleCompleted ZelleStatus = "COMPLETED"
+	ZelleDeclined  ZelleStatus = "DECLINED"
+)
+
+// zelleMachine is the statuses a Zelle payment moves through. A request to
+// another bank's customer completes straight from requested, when they pay
+// it on their own.
+var zelleMachine = &statemachine.Machine{Name: "Zelle payment", Moves: map[string][]string{
+	string(ZelleRequested): {string(ZellePending), string(ZelleDeclined), string(ZelleCompleted)},
+	string(ZellePending):   {string(ZelleCompleted)},
+}}
+
+// ZellePayment is a send, or a request for money. Requests are from
+// UserEmail to the payer identified by Token.
+type ZellePayment struct {
+	ID            string      `json:"id"`
+	Kind          ZelleKind   `json:"kind"`
+	UserEmail     string      `json:"user_email"`
+	Token         string      `json:"token"`
+	Name          string      `json:"name"`
+	Amount        money.Money `json:"amount"`
+	Memo          string      `json:"memo,omitempty"`
+	Status        ZelleStatus `json:"status"`
+	TransactionID string      `json:"transaction_id,omitempty"`
+	RequestID     string      `json:"request_id,omitempty"` // The request a send pays
+	CreatedAt     time.Time   `json:"created_at"`
+	SettleAt      *time.Time  `json:"settle_at,omitempty"`
+	CompletedAt   *time.Time  `json:"completed_at,omitempty"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+}
+
+var (
+	zelleDailySendLimit    = money.Cents(200000)
+	zelleDailyRequestLimit = money.Cents(200000)
+)
+
+const zelleSettlementDelay = time.Minute
+
 // Database represents our in-memory database
 type Database struct {
-	Accounts     map[string]Account     `json:"accounts"`
-	Transactions map[string]Transaction `json:"transactions"`
-	Transfers    map[string]Transfer    `json:"transfers"`
-	Bills        map[string]Bill        `json:"bills"`
-	mu           sync.RWMutex
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Books
+
+	Accounts     server.Repository[Account]     `json:"accounts"`
+	Transactions server.Repository[Transaction] `json:"transactions"`
+	Transfers    server.Repository[Transfer]    `json:"transfers"`
+	Bills        server.Repository[Bill]        `json:"bills"`
+	Statements   server.Repository[Statement]   `json:"statements"`
+
+	ZelleProfiles   server.Repository[ZelleProfile]   `json:"zelle_profiles"` // By user email
+	ZelleNetwork    server.Repository[ZelleMember]    `json:"zelle_network"`  // By token
+	ZelleRecipients server.Repository[ZelleRecipient] `json:"zelle_recipients"`
+	ZellePayments   server.Repository[ZellePayment]   `json:"zelle_payments"`
+	Wires           server.Repository[Wire]           `json:"wires"`
+	mu              sync.RWMutex
+	locks           *ledger.Locks // Taken before mu by whatever changes an account's balance
+	clock           *server.Clock
 }
 
 var (
 	ErrAccountNotFound   = errors.New("account not found")
-	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrInsufficientFunds = server.NewError(server.CodeInsufficientFunds, "insufficient funds")
 	ErrInvalidAmount     = errors.New("invalid amount")
 	ErrUnauthorized      = errors.New("unauthorized")
+	ErrNotCreditCard     = errors.New("account is not a credit card")
+	ErrNotChecking       = errors.New("payments must come from a checking account")
+	ErrStatementNotFound = errors.New("statement not found")
+	ErrNoStatement       = errors.New("no statement has been issued yet")
+	ErrOverpayment       = errors.New("payment is more than the card balance")
+
+	ErrZelleNotEnrolled     = errors.New("not enrolled in Zelle")
+	ErrZelleAlreadyEnrolled = errors.New("already enrolled in Zelle")
+	ErrZelleTokenTaken      = errors.New("email or phone is already enrolled in Zelle")
+	ErrZelleInvalidToken    = errors.New("a valid email or U.S. phone number is required")
+	ErrRecipientNotEnrolled = errors.New("recipient is not enrolled in Zelle")
+	ErrRecipientNotFound    = errors.New("recipient not found")
+	ErrZelleSelf            = errors.New("cannot send to or request from yourself")
+	ErrZelleLimit           = errors.New("exceeds daily Zelle limit")
+	ErrZellePaymentNotFound = errors.New("Zelle payment not found")
+	ErrZelleNotRequested    = errors.New("request is no longer awaiting payment")
+
+	ErrNoCard               = errors.New("account has no card")
+	ErrCardLocked           = errors.New("card is locked")
+	ErrCardReported         = errors.New("card was reported lost or stolen")
+	ErrCardMismatch         = errors.New("card number does not match this account")
+	ErrNoTravelNotice       = errors.New("foreign purchase declined: no travel notice covers it")
+	ErrCreditLimit          = errors.New("purchase exceeds available credit")
+	ErrInvalidReason        = errors.New("reason must be LOST or STOLEN")
+	ErrInvalidDates         = errors.New("end date must not be before the start date or in the past")
+	ErrNoDestinations       = errors.New("at least one destination is required")
+	ErrTravelNoticeNotFound = errors.New("travel notice not found")
+
+	ErrWireNotFound       = errors.New("wire not found")
+	ErrWireAccount        = errors.New("wires must be sent from a checking account")
+	ErrInvalidWireKind    = errors.New("kind must be DOMESTIC or INTERNATIONAL")
+	ErrInvalidBeneficiary = errors.New("invalid beneficiary")
+	ErrWireNotCancellable = errors.New("only scheduled wires can be cancelled")
+)
+
+// handlers serve Chase accounts, cards, transfers, wires and Zelle from db.
+// clock dates transfers, and drives the statement cycle, bill reminders,
+// Zelle settlement and wire processing.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+	// accountLocks outlive reloads of the database, which shares them.
+	accountLocks ledger.Locks
+}
+
+// newHandlers loads the accounts and their Zelle network from store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+// Accounts outside the bank that money moves to and from.
+const (
+	zelleNetwork   = ledger.External + "zelle"
+	wireNetwork    = ledger.External + "wires"
+	feeIncome      = ledger.External + "fees"
+	interestIncome = ledger.External + "interest"
 )
 
-var db *Database
+// Balances returns each account's balance, by ID, for the books. The
+// caller holds d.mu.
+func (d *Database) Balances() map[string]money.Money {
+	balances := make(map[string]money.Money, d.Accounts.Len())
+	for _, id := range d.Accounts.Keys() {
+		account, _ := d.Accounts.Get(id)
+		balances[id] = account.balance()
+	}
+	return balances
+}
+
+// balance returns the account's balance in its currency.
+func (a Account) balance() money.Money {
+	return a.Balance.In(a.Currency)
+}
 
 // Database operations
 func (d *Database) GetAccount(id string) (Account, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	account, exists := d.Accounts[id]
+	account, exists := d.Accounts.Get(id)
 	if !exists {
 		return Account{}, ErrAccountNotFound
 	}
@@ -113,13 +456,7 @@ func (d *Database) GetUserAccounts(email string) []Account {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var accounts []Account
-	for _, account := range d.Accounts {
-		if account.UserEmail == email {
-			accounts = append(accounts, account)
-		}
-	}
-	return accounts
+	return d.Accounts.By("user_email", email)
 }
 
 func (d *Database) GetAccountTransactions(accountId string, startDate, endDate time.Time) []Transaction {
@@ -127,7 +464,7 @@ func (d *Database) GetAccountTransactions(accountId string, startDate, endDate t
 	defer d.mu.RUnlock()
 
 	var transactions []Transaction
-	for _, tx := range d.Transactions {
+	for _, tx := range d.Transactions.List() {
 		if tx.AccountID == accountId {
 			if (startDate.IsZero() || !tx.Date.Before(startDate)) &&
 				(endDate.IsZero() || !tx.Date.After(endDate)) {
@@ -138,50 +475,73 @@ func (d *Database) GetAccountTransactions(accountId string, startDate, endDate t
 	return transactions
 }
 
+// CreateTransfer moves a transfer's amount between its accounts. Both
+// stay locked from the check of funds to the move, so the database itself
+// is only locked for writing while the move is made.
 func (d *Database) CreateTransfer(transfer Transfer) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	unlock := d.locks.Lock(transfer.FromAccount, transfer.ToAccount)
+	defer unlock()
 
 	// Validate accounts
-	fromAccount, exists := d.Accounts[transfer.FromAccount]
-	if !exists {
+	d.mu.RLock()
+	fromAccount, fromExists := d.Accounts.Get(transfer.FromAccount)
+	toAccount, toExists := d.Accounts.Get(transfer.ToAccount)
+	d.mu.RUnlock()
+	if !fromExists || !toExists {
 		return ErrAccountNotFound
 	}
 
-	toAccount, exists := d.Accounts[transfer.ToAccount]
-	if !exists {
-		return ErrAccountNotFound
+	if fromAccount.CardLocked {
+		return ErrCardLocked
 	}
 
-	// Check sufficient funds
-	if fromAccount.Balance < transfer.Amount {
+	// Check sufficient funds, and that both accounts are in the currency
+	// moved, which a transfer can't change
+	amount := transfer.Amount.In(fromAccount.Currency)
+	from, err := fromAccount.balance().Sub(amount)
+	if err != nil {
+		return err
+	}
+	to, err := toAccount.balance().Add(amount)
+	if err != nil {
+		return err
+	}
+	if from.IsNegative() {
 		return ErrInsufficientFunds
 	}
 
-	// Update account balances
-	fromAccount.Balance -= transfer.Amount
-	toAccount.Balance += transfer.Amount
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.Post(ledger.Transfer(transfer.FromAccount, transfer.ToAccount, amount, transfer.Description, transfer.ID)); err != nil {
+		return err
+	}
 
-	// Save updated accounts
-	d.Accounts[transfer.FromAccount] = fromAccount
-	d.Accounts[transfer.ToAccount] = toAccount
+	// Update account balances; the accounts' locks have kept them as they
+	// were read
+	fromAccount, _ = d.Accounts.Get(transfer.FromAccount)
+	toAccount, _ = d.Accounts.Get(transfer.ToAccount)
+	fromAccount.Balance = from
+	d.Accounts.Upsert(transfer.FromAccount, fromAccount)
+	toAccount.Balance = to
+	d.Accounts.Upsert(transfer.ToAccount, toAccount)
 
 	// Create transactions
-	txId1 := uuid.New().String()
-	txId2 := uuid.New().String()
+	txId1 := server.NewID("TXN")
+	txId2 := server.NewID("TXN")
 
-	d.Transactions[txId1] = Transaction{
+	d.Transactions.Upsert(txId1, Transaction{
 		ID:          txId1,
 		AccountID:   transfer.FromAccount,
 		Date:        transfer.CreatedAt,
 		Description: transfer.Description,
-		Amount:      -transfer.Amount,
+		Amount:      transfer.Amount.Neg(),
 		Type:        TransactionTypeDebit,
 		Status:      TransactionStatusCompleted,
 		Reference:   transfer.ID,
-	}
+	})
 
-	d.Transactions[txId2] = Transaction{
+	d.Transactions.Upsert(txId2, Transaction{
 		ID:          txId2,
 		AccountID:   transfer.ToAccount,
 		Date:        transfer.CreatedAt,
@@ -190,215 +550,2093 @@ func (d *Database) CreateTransfer(transfer Transfer) error {
 		Type:        TransactionTypeCredit,
 		Status:      TransactionStatusCompleted,
 		Reference:   transfer.ID,
-	}
+	})
 
 	// Save transfer
-	d.Transfers[transfer.ID] = transfer
+	d.Transfers.Upsert(transfer.ID, transfer)
 
 	return nil
 }
 
-func (d *Database) GetUserBills(email string) []Bill {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+// owed is what's owed on a credit card, positive when there's a balance.
+func owed(account Account) money.Money {
+	return account.balance().Neg()
+}
 
-	var bills []Bill
-	for _, bill := range d.Bills {
-		if bill.UserEmail == email {
-			bills = append(bills, bill)
+// latestStatement returns a card's most recent statement. Callers must
+// hold d.mu.
+func (d *Database) latestStatement(accountID string) (Statement, bool) {
+	var latest Statement
+	found := false
+	for _, st := range d.Statements.List() {
+		if st.AccountID == accountID && (!found || st.PeriodEnd.After(latest.PeriodEnd)) {
+			latest, found = st, true
 		}
 	}
-	return bills
+	return latest, found
 }
 
-// HTTP Handlers
-func getUserAccounts(c *fiber.Ctx) error {
-	email := c.Query("email")
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+// withStatus fills in a statement's payment status as of now.
+func (st Statement) withStatus(now time.Time) (Statement, error) {
+	short, err := st.PaidAmount.Less(st.NewBalance)
+	if err != nil {
+		return Statement{}, err
 	}
-
-	accounts := db.GetUserAccounts(email)
-	return c.JSON(accounts)
+	belowMinimum, err := st.PaidAmount.Less(st.MinimumPayment)
+	if err != nil {
+		return Statement{}, err
+	}
+	switch {
+	case !short:
+		st.Status = StatementPaidInFull
+	case !belowMinimum:
+		st.Status = StatementMinimumPaid
+	case now.After(st.DueDate):
+		st.Status = StatementPastDue
+	default:
+		st.Status = StatementOpen
+	}
+	return st, nil
 }
 
-func getAccountTransactions(c *fiber.Ctx) error {
-	accountId := c.Params("accountId")
-	if accountId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "account ID is required",
-		})
+// nextClose is when a card's current cycle closes: a month after its last
+// statement, or the next statement day if it has none.
+func (d *Database) nextClose(account Account) time.Time {
+	if last, found := d.latestStatement(account.ID); found {
+		return last.PeriodEnd.AddDate(0, 1, 0)
 	}
+	t := account.CreatedAt.UTC()
+	close := time.Date(t.Year(), t.Month(), account.Credit.StatementDay, 0, 0, 0, 0, time.UTC)
+	if !close.After(t) {
+		close = close.AddDate(0, 1, 0)
+	}
+	return close
+}
 
-	startDateStr := c.Query("startDate")
-	endDateStr := c.Query("endDate")
-
-	var startDate, endDate time.Time
-	var err error
+// closeStatement ends a card's cycle at end. Interest is charged on the
+// cycle's average daily balance unless the previous statement was paid in
+// full by its due date. Callers must hold d.mu.
+func (d *Database) closeStatement(account Account, end time.Time) (Statement, error) {
+	st := Statement{
+		ID:          server.NewID("STMT"),
+		AccountID:   account.ID,
+		PeriodStart: end.AddDate(0, -1, 0),
+		PeriodEnd:   end,
+	}
+	prev, hasPrev := d.latestStatement(account.ID)
+	if hasPrev {
+		st.PeriodStart = prev.PeriodEnd
+		st.PreviousBalance = prev.NewBalance
+	}
 
-	if startDateStr != "" {
-		startDate, err = time.Parse("2006-01-02", startDateStr)
+	// Daily balances for the cycle, starting from what was owed at the
+	// previous close
+	days := int(st.PeriodEnd.Sub(st.PeriodStart).Hours() / 24)
+	daily := make([]money.Money, days)
+	for _, tx := range d.Transactions.List() {
+		if tx.AccountID != account.ID || tx.Date.Before(st.PeriodStart) || !tx.Date.Before(st.PeriodEnd) ||
+			tx.Status == TransactionStatusFailed {
+			continue
+		}
+		var err error
+		if tx.Amount.IsNegative() {
+			st.Purchases, err = st.Purchases.Sub(tx.Amount)
+		} else {
+			st.Payments, err = st.Payments.Add(tx.Amount)
+		}
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "invalid start date format",
-			})
+			return Statement{}, err
+		}
+		day := int(tx.Date.Sub(st.PeriodStart).Hours() / 24)
+		if daily[day], err = daily[day].Sub(tx.Amount); err != nil {
+			return Statement{}, err
+		}
+	}
+	running, total := st.PreviousBalance, money.Money{}
+	for _, change := range daily {
+		var err error
+		if running, err = running.Add(change); err != nil {
+			return Statement{}, err
+		}
+		if running.IsPositive() {
+			if total, err = total.Add(running); err != nil {
+				return Statement{}, err
+			}
 		}
 	}
 
-	if endDateStr != "" {
-		endDate, err = time.Parse("2006-01-02", endDateStr)
+	revolving := false
+	if hasPrev && prev.NewBalance.IsPositive() {
+		prev, err := prev.withStatus(st.PeriodEnd)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "invalid end date format",
-			})
+			return Statement{}, err
 		}
+		revolving = prev.Status != StatementPaidInFull
 	}
-
-	transactions := db.GetAccountTransactions(accountId, startDate, endDate)
-	return c.JSON(transactions)
-}
-
-type TransferRequest struct {
-	FromAccount string  `json:"from_account"`
-	ToAccount   string  `json:"to_account"`
-	Amount      float64 `json:"amount"`
-	Description string  `json:"description"`
-}
-
-func createTransfer(c *fiber.Ctx) error {
-	var req TransferRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if revolving && days > 0 {
+		// Average daily balance × daily rate × days in the cycle, which is
+		// the total of the daily balances × daily rate
+		st.Interest = total.Mul(account.Credit.APR / 100 / 365)
 	}
-
-	if req.Amount <= 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Amount must be positive",
+	if st.Interest.IsPositive() {
+		txID := server.NewID("TXN")
+		d.Transactions.Upsert(txID, Transaction{
+			ID:          txID,
+			AccountID:   account.ID,
+			Date:        st.PeriodEnd.Add(-time.Second),
+			Description: "PURCHASE INTEREST CHARGE",
+			Amount:      st.Interest.Neg(),
+			Type:        TransactionTypeDebit,
+			Category:    "INTEREST",
+			Status:      TransactionStatusCompleted,
+			Reference:   st.ID,
 		})
+		balance, err := account.Balance.Sub(st.Interest)
+		if err != nil {
+			return Statement{}, err
+		}
+		d.Post(ledger.Transfer(account.ID, interestIncome, st.Interest, "Purchase interest charge", st.ID))
+		account.Balance = balance
+		account.UpdatedAt = st.PeriodEnd
+		d.Accounts.Upsert(account.ID, account)
 	}
 
-	transfer := Transfer{
-		ID:          uuid.New().String(),
-		FromAccount: req.FromAccount,
-		ToAccount:   req.ToAccount,
-		Amount:      req.Amount,
-		Description: req.Description,
-		Status:      TransactionStatusCompleted,
-		CreatedAt:   time.Now(),
+	var err error
+	if st.NewBalance, err = money.Sum(st.PreviousBalance.Code(), st.PreviousBalance, st.Purchases, st.Payments.Neg(), st.Interest); err != nil {
+		return Statement{}, err
 	}
-
-	if err := db.CreateTransfer(transfer); err != nil {
-		switch err {
-		case ErrAccountNotFound:
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		case ErrInsufficientFunds:
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		default:
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to process transfer",
-			})
+	if st.NewBalance.IsPositive() {
+		minimum, err := st.NewBalance.Mul(minimumPaymentRate).Add(st.Interest)
+		if err != nil {
+			return Statement{}, err
+		}
+		if minimum, err = money.Max(minimumPaymentFloor, minimum); err != nil {
+			return Statement{}, err
+		}
+		if st.MinimumPayment, err = money.Min(st.NewBalance, minimum); err != nil {
+			return Statement{}, err
 		}
 	}
-
-	return c.Status(fiber.StatusCreated).JSON(transfer)
-}
-
-func getUserBills(c *fiber.Ctx) error {
-	email := c.Query("email")
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+	st.DueDate = st.PeriodEnd.AddDate(0, 0, account.Credit.GraceDays)
+	if st, err = st.withStatus(st.PeriodEnd); err != nil {
+		return Statement{}, err
 	}
-
-	bills := db.GetUserBills(email)
-	return c.JSON(bills)
+	d.Statements.Upsert(st.ID, st)
+	return st, nil
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+// GenerateStatements closes every credit card cycle that has ended by now.
+func (d *Database) GenerateStatements(now time.Time) int {
+	unlock := d.locks.LockAll()
+	defer unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	db = &Database{
-		Accounts:     make(map[string]Account),
-		Transactions: make(map[string]Transaction),
-		Transfers:    make(map[string]Transfer),
-		Bills:        make(map[string]Bill),
+	closed := 0
+	for _, id := range d.Accounts.Keys() {
+		for {
+			account, _ := d.Accounts.Get(id)
+			if account.Type != AccountTypeCredit || account.Credit == nil {
+				break
+			}
+			end := d.nextClose(account)
+			if end.After(now) {
+				break
+			}
+			if _, err := d.closeStatement(account, end); err != nil {
+				log.Printf("Closing statement of %s: %v", id, err)
+				break
+			}
+			closed++
+		}
 	}
-
-	return json.Unmarshal(data, db)
+	return closed
 }
 
-func setupRoutes(app *fiber.App) {
-	api := app.Group("/api/v1")
-
-	// Account routes
-	api.Get("/accounts", getUserAccounts)
-	api.Get("/accounts/:accountId", func(c *fiber.Ctx) error {
-		accountId := c.Params("accountId")
-		account, err := db.GetAccount(accountId)
-		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+func (h *handlers) runStatementCycle(interval time.Duration) {
+	db := h.db.Get()
+	if n := db.GenerateStatements(h.clock.Now()); n > 0 {
+		log.Printf("Closed %d credit card statement(s)", n)
+	}
+	h.clock.Every(interval, func(now time.Time) {
+		db := h.db.Get()
+		if n := db.GenerateStatements(now); n > 0 {
+			log.Printf("Closed %d credit card statement(s)", n)
 		}
-		return c.JSON(account)
 	})
-	api.Get("/accounts/:accountId/transactions", getAccountTransactions)
+}
 
-	// Transfer routes
-	api.Post("/transfers", createTransfer)
+func (d *Database) GetStatements(accountID string) ([]Statement, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	// Bill routes
-	api.Get("/bills", getUserBills)
+	account, exists := d.Accounts.Get(accountID)
+	if !exists {
+		return nil, ErrAccountNotFound
+	}
+	if account.Type != AccountTypeCredit {
+		return nil, ErrNotCreditCard
+	}
+	now := d.clock.Now()
+	statements := []Statement{}
+	for _, st := range d.Statements.List() {
+		if st.AccountID == account.ID {
+			st, err := st.withStatus(now)
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, st)
+		}
+	}
+	sort.Slice(statements, func(i, j int) bool { return statements[i].PeriodEnd.After(statements[j].PeriodEnd) })
+	return statements, nil
 }
 
-func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+// PayCard pays a credit card from the owner's checking account. amount may
+// be left at zero in favour of option: "minimum", "statement_balance" or
+// "current_balance". Payments count toward the latest statement.
+func (d *Database) PayCard(cardID, fromID string, amount money.Money, option string) (Transfer, Statement, error) {
+	unlock := d.locks.Lock(cardID, fromID)
+	defer unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	if err := loadDatabase(); err != nil {
-		log.Fatal(err)
+	card, exists := d.Accounts.Get(cardID)
+	if !exists {
+		return Transfer{}, Statement{}, ErrAccountNotFound
+	}
+	if card.Type != AccountTypeCredit {
+		return Transfer{}, Statement{}, ErrNotCreditCard
+	}
+	from, exists := d.Accounts.Get(fromID)
+	if !exists {
+		return Transfer{}, Statement{}, ErrAccountNotFound
+	}
+	if from.UserEmail != card.UserEmail {
+		return Transfer{}, Statement{}, ErrUnauthorized
+	}
+	if from.Type != AccountTypeChecking {
+		return Transfer{}, Statement{}, ErrNotChecking
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
+	st, hasStatement := d.latestStatement(card.ID)
+	if amount.IsZero() {
+		switch option {
+		case "minimum", "statement_balance":
+			if !hasStatement {
+				return Transfer{}, Statement{}, ErrNoStatement
 			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+			// Statements are in the card's currency
+			amount = st.MinimumPayment.In(card.Currency)
+			if option == "statement_balance" {
+				amount = st.NewBalance.In(card.Currency)
+			}
+			left, err := amount.Sub(st.PaidAmount.In(card.Currency))
+			if err != nil {
+				return Transfer{}, Statement{}, err
+			}
+			if amount, err = money.Min(left, owed(card)); err != nil {
+				return Transfer{}, Statement{}, err
+			}
+		case "current_balance":
+			amount = owed(card)
+		}
+	}
+	amount = amount.In(card.Currency)
+	if !amount.IsPositive() {
+		return Transfer{}, Statement{}, ErrInvalidAmount
+	}
+	over, err := owed(card).Less(amount)
+	if err != nil {
+		return Transfer{}, Statement{}, err
+	}
+	if over {
+		return Transfer{}, Statement{}, ErrOverpayment
+	}
+	if from.CardLocked {
+		return Transfer{}, Statement{}, ErrCardLocked
+	}
+	fromBalance, err := from.balance().Sub(amount)
+	if err != nil {
+		return Transfer{}, Statement{}, err
+	}
+	if fromBalance.IsNegative() {
+		return Transfer{}, Statement{}, ErrInsufficientFunds
+	}
+	cardBalance, err := card.balance().Add(amount)
+	if err != nil {
+		return Transfer{}, Statement{}, err
+	}
+
+	now := d.clock.Now()
+	transfer := Transfer{
+		ID:          server.NewID("TRF"),
+		FromAccount: from.ID,
+		ToAccount:   card.ID,
+		Amount:      amount,
+		Description: fmt.Sprintf("Payment to %s ...%s", card.Name, card.Last4),
+		Status:      TransactionStatusCompleted,
+		CreatedAt:   now,
+	}
+	if err := d.Post(ledger.Transfer(from.ID, card.ID, amount, transfer.Description, transfer.ID)); err != nil {
+		return Transfer{}, Statement{}, err
+	}
+	from.Balance = fromBalance
+	from.UpdatedAt = now
+	card.Balance = cardBalance
+	card.UpdatedAt = now
+	d.Accounts.Upsert(from.ID, from)
+	d.Accounts.Upsert(card.ID, card)
+
+	debitID, creditID := server.NewID("TXN"), server.NewID("TXN")
+	d.Transactions.Upsert(debitID, Transaction{
+		ID:          debitID,
+		AccountID:   from.ID,
+		Date:        now,
+		Description: transfer.Description,
+		Amount:      amount.Neg(),
+		Type:        TransactionTypeDebit,
+		Category:    "CREDIT_CARD_PAYMENT",
+		Status:      TransactionStatusCompleted,
+		Reference:   transfer.ID,
+	})
+	d.Transactions.Upsert(creditID, Transaction{
+		ID:          creditID,
+		AccountID:   card.ID,
+		Date:        now,
+		Description: "Payment Thank You",
+		Amount:      amount,
+		Type:        TransactionTypeCredit,
+		Category:    "PAYMENT",
+		Status:      TransactionStatusCompleted,
+		Reference:   transfer.ID,
+	})
+	d.Transfers.Upsert(transfer.ID, transfer)
+
+	if hasStatement {
+		if st.PaidAmount, err = st.PaidAmount.In(card.Currency).Add(amount); err != nil {
+			return Transfer{}, Statement{}, err
+		}
+		d.Statements.Upsert(st.ID, st)
+	}
+	if st, err = st.withStatus(now); err != nil {
+		return Transfer{}, Statement{}, err
+	}
+	return transfer, st, nil
+}
+
+func (d *Database) GetUserBills(email string) []Bill {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.Bills.By("user_email", email)
+}
+
+// billReminderLead is how long before a bill is due its owner is reminded.
+const billReminderLead = 3 * 24 * time.Hour
+
+// SendBillReminders notifies and emails customers of their pending bills
+// coming due, once a bill.
+func (d *Database) SendBillReminders(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	reminded := make(map[string]bool)
+	for _, n := range d.Notifications.List() {
+		if n.Type == "bill_due" {
+			reminded[n.EntityID] = true
+		}
+	}
+	sent := 0
+	for _, bill := range d.Bills.List() {
+		if bill.Status != "PENDING" || reminded[bill.ID] || !now.Before(bill.DueDate) || now.Before(bill.DueDate.Add(-billReminderLead)) {
+			continue
+		}
+		message := fmt.Sprintf("Your %s bill of %s is due %s.", bill.Payee, bill.Amount.Format(), bill.DueDate.Format("Mon Jan 2"))
+		if bill.Autopay {
+			message += " Autopay will pay it."
+		}
+		d.Notify(server.Notification{
+			UserEmail:  bill.UserEmail,
+			Type:       "bill_due",
+			Message:    message,
+			Collection: "bills",
+			EntityID:   bill.ID,
+			CreatedAt:  now,
+		})
+		d.SendEmail(server.Email{
+			From:       "no.reply.alerts@chase.com",
+			To:         bill.UserEmail,
+			Subject:    "Your " + bill.Payee + " bill is due soon",
+			Body:       message + "\n\nTo see your bills, sign in to chase.com.\n",
+			Collection: "bills",
+			EntityID:   bill.ID,
+			SentAt:     now,
+		})
+		sent++
+	}
+	return sent
+}
+
+func (h *handlers) runBillReminders(interval time.Duration) {
+	h.clock.Every(interval, func(now time.Time) {
+		db := h.db.Get()
+		if n := db.SendBillReminders(now); n > 0 {
+			log.Printf("Sent %d bill reminder(s)", n)
+		}
+	})
+}
+
+// normalizeToken canonicalizes a Zelle email or U.S. phone number.
+func normalizeToken(token string) (string, error) {
+	token = strings.ToLower(strings.TrimSpace(token))
+	if strings.Contains(token, "@") {
+		return token, nil
+	}
+	var digits strings.Builder
+	for _, r := range token {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+	phone := strings.TrimPrefix(digits.String(), "1")
+	if len(phone) != 10 || len(digits.String()) > 11 {
+		return "", ErrZelleInvalidToken
+	}
+	return phone, nil
+}
+
+// zelleOwner finds the Chase customer enrolled with a token. Callers must
+// hold d.mu.
+func (d *Database) zelleOwner(token string) (ZelleProfile, bool) {
+	for _, profile := range d.ZelleProfiles.List() {
+		for _, t := range profile.Tokens {
+			if t == token {
+				return profile, true
+			}
+		}
+	}
+	return ZelleProfile{}, false
+}
+
+// zelleName is the name a token is enrolled under, at Chase or elsewhere.
+// Callers must hold d.mu.
+func (d *Database) zelleName(token string) (string, bool) {
+	if profile, ok := d.zelleOwner(token); ok {
+		return profile.Name, true
+	}
+	if member, ok := d.ZelleNetwork.Get(token); ok {
+		return member.Name, true
+	}
+	return "", false
+}
+
+func (d *Database) EnrollZelle(email, name, accountID string, tokens []string) (ZelleProfile, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.ZelleProfiles.Get(email); exists {
+		return ZelleProfile{}, ErrZelleAlreadyEnrolled
+	}
+	account, exists := d.Accounts.Get(accountID)
+	if !exists {
+		return ZelleProfile{}, ErrAccountNotFound
+	}
+	if account.UserEmail != email {
+		return ZelleProfile{}, ErrUnauthorized
+	}
+	if account.Type != AccountTypeChecking {
+		return ZelleProfile{}, ErrNotChecking
+	}
+	if len(tokens) == 0 {
+		tokens = []string{email}
+	}
+
+	profile := ZelleProfile{
+		UserEmail:         email,
+		Name:              name,
+		AccountID:         account.ID,
+		DailySendLimit:    zelleDailySendLimit,
+		DailyRequestLimit: zelleDailyRequestLimit,
+		EnrolledAt:        d.clock.Now(),
+	}
+	for _, t := range tokens {
+		token, err := normalizeToken(t)
+		if err != nil {
+			return ZelleProfile{}, err
+		}
+		if _, taken := d.zelleName(token); taken {
+			return ZelleProfile{}, ErrZelleTokenTaken
+		}
+		profile.Tokens = append(profile.Tokens, token)
+	}
+	d.ZelleProfiles.Upsert(email, profile)
+	return profile, nil
+}
+
+func (d *Database) GetZelleProfile(email string) (ZelleProfile, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	profile, exists := d.ZelleProfiles.Get(email)
+	if !exists {
+		return ZelleProfile{}, ErrZelleNotEnrolled
+	}
+	return profile, nil
+}
+
+// LookupZelle reports whether an email or phone can receive Zelle
+// payments, and the name it's enrolled under.
+func (d *Database) LookupZelle(token string) (string, string, bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	token, err := normalizeToken(token)
+	if err != nil {
+		return "", "", false, err
+	}
+	name, enrolled := d.zelleName(token)
+	return token, name, enrolled, nil
+}
+
+func (d *Database) AddZelleRecipient(recipient ZelleRecipient) (ZelleRecipient, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if recipient.Email == "" && recipient.Phone == "" {
+		return ZelleRecipient{}, ErrZelleInvalidToken
+	}
+	recipient.Enrolled = false
+	for _, field := range []*string{&recipient.Email, &recipient.Phone} {
+		if *field == "" {
+			continue
+		}
+		token, err := normalizeToken(*field)
+		if err != nil {
+			return ZelleRecipient{}, err
+		}
+		*field = token
+		if _, ok := d.zelleName(token); ok {
+			recipient.Enrolled = true
+		}
+	}
+	recipient.ID = server.NewID("RCP")
+	recipient.CreatedAt = d.clock.Now()
+	d.ZelleRecipients.Upsert(recipient.ID, recipient)
+	return recipient, nil
+}
+
+func (d *Database) GetZelleRecipients(email string) []ZelleRecipient {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	recipients := []ZelleRecipient{}
+	for _, r := range d.ZelleRecipients.List() {
+		if r.UserEmail == email {
+			// Enrollment can change after the recipient was saved
+			r.Enrolled = false
+			for _, token := range []string{r.Email, r.Phone} {
+				if _, ok := d.zelleName(token); ok {
+					r.Enrolled = true
+				}
+			}
+			recipients = append(recipients, r)
+		}
+	}
+	sort.Slice(recipients, func(i, j int) bool { return recipients[i].Name < recipients[j].Name })
+	return recipients
+}
+
+func (d *Database) DeleteZelleRecipient(email, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	recipient, exists := d.ZelleRecipients.Get(id)
+	if !exists || recipient.UserEmail != email {
+		return ErrRecipientNotFound
+	}
+	d.ZelleRecipients.Delete(id)
+	return nil
+}
+
+// zelleTarget resolves who a send or request goes to: a saved recipient,
+// preferring their email, or a raw email or phone. Callers must hold d.mu.
+func (d *Database) zelleTarget(email, recipientID, token string) (string, string, error) {
+	if recipientID != "" {
+		recipient, exists := d.ZelleRecipients.Get(recipientID)
+		if !exists || recipient.UserEmail != email {
+			return "", "", ErrRecipientNotFound
+		}
+		for _, t := range []string{recipient.Email, recipient.Phone} {
+			if _, ok := d.zelleName(t); ok {
+				return t, recipient.Name, nil
+			}
+		}
+		return "", "", ErrRecipientNotEnrolled
+	}
+	token, err := normalizeToken(token)
+	if err != nil {
+		return "", "", err
+	}
+	name, ok := d.zelleName(token)
+	if !ok {
+		return "", "", ErrRecipientNotEnrolled
+	}
+	return token, name, nil
+}
+
+// zelleUsedToday totals a customer's sends or requests on now's day.
+// Declined requests don't count. Callers must hold d.mu.
+func (d *Database) zelleUsedToday(email string, kind ZelleKind, now time.Time) (money.Money, error) {
+	y, m, day := now.UTC().Date()
+	total := money.Money{}
+	for _, p := range d.ZellePayments.List() {
+		py, pm, pd := p.CreatedAt.UTC().Date()
+		if p.UserEmail == email && p.Kind == kind && p.Status != ZelleDeclined && py == y && pm == m && pd == day {
+			var err error
+			if total, err = total.Add(p.Amount); err != nil {
+				return money.Money{}, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// zelleCheckLimit checks that amount more fits in a daily limit of which
+// used is used, and says how much of it is left if not.
+func zelleCheckLimit(limit, used, amount money.Money) error {
+	after, err := used.Add(amount)
+	if err != nil {
+		return err
+	}
+	left, err := limit.Sub(used)
+	if err != nil {
+		return err
+	}
+	over, err := limit.Less(after)
+	if err != nil || !over {
+		return err
+	}
+	if left.IsNegative() {
+		left = money.New(0, left.Code())
+	}
+	return fmt.Errorf("%w of %s; %s remaining today", ErrZelleLimit, limit.Format(), left.Format())
+}
+
+// zellePrepare checks a send or request before it's recorded. Callers must
+// hold d.mu.
+func (d *Database) zellePrepare(email string, kind ZelleKind, recipientID, token string, amount money.Money, now time.Time) (ZelleProfile, ZellePayment, error) {
+	profile, exists := d.ZelleProfiles.Get(email)
+	if !exists {
+		return ZelleProfile{}, ZellePayment{}, ErrZelleNotEnrolled
+	}
+	if !amount.IsPositive() {
+		return ZelleProfile{}, ZellePayment{}, ErrInvalidAmount
+	}
+	token, name, err := d.zelleTarget(email, recipientID, token)
+	if err != nil {
+		return ZelleProfile{}, ZellePayment{}, err
+	}
+	if owner, ok := d.zelleOwner(token); ok && owner.UserEmail == email {
+		return ZelleProfile{}, ZellePayment{}, ErrZelleSelf
+	}
+
+	limit := profile.DailySendLimit
+	if kind == ZelleRequest {
+		limit = profile.DailyRequestLimit
+	}
+	used, err := d.zelleUsedToday(email, kind, now)
+	if err != nil {
+		return ZelleProfile{}, ZellePayment{}, err
+	}
+	if err := zelleCheckLimit(limit, used, amount); err != nil {
+		return ZelleProfile{}, ZellePayment{}, err
+	}
+
+	return profile, ZellePayment{
+		ID:        server.NewID("ZPAY"),
+		Kind:      kind,
+		UserEmail: email,
+		Token:     token,
+		Name:      name,
+		Amount:    amount,
+		Status:    ZellePending,
+		CreatedAt: now,
+	}, nil
+}
+
+// zelleDebit holds a send's funds with a pending debit, completed when the
+// payment settles. Callers must hold the linked account's lock and d.mu.
+func (d *Database) zelleDebit(profile ZelleProfile, payment *ZellePayment) error {
+	account, _ := d.Accounts.Get(profile.AccountID)
+	if account.CardLocked {
+		return ErrCardLocked
+	}
+	balance, err := account.balance().Sub(payment.Amount)
+	if err != nil {
+		return err
+	}
+	if balance.IsNegative() {
+		return ErrInsufficientFunds
+	}
+	if err := d.Post(ledger.Transfer(account.ID, zelleNetwork, payment.Amount, "Zelle payment to "+payment.Name, payment.ID)); err != nil {
+		return err
+	}
+	account.Balance = balance
+	account.UpdatedAt = payment.CreatedAt
+	d.Accounts.Upsert(account.ID, account)
+
+	txID := server.NewID("TXN")
+	d.Transactions.Upsert(txID, Transaction{
+		ID:          txID,
+		AccountID:   account.ID,
+		Date:        payment.CreatedAt,
+		Description: "Zelle payment to " + payment.Name,
+		Amount:      payment.Amount.Neg(),
+		Type:        TransactionTypeDebit,
+		Category:    "ZELLE",
+		Status:      TransactionStatusPending,
+		Reference:   payment.ID,
+	})
+	settleAt := payment.CreatedAt.Add(zelleSettlementDelay)
+	payment.TransactionID = txID
+	payment.SettleAt = &settleAt
+	return nil
+}
+
+// SendZelle sends money to an enrolled recipient. Funds leave the linked
+// account right away and settle shortly after.
+func (d *Database) SendZelle(email, recipientID, token string, amount money.Money, memo string) (ZellePayment, error) {
+	unlock := d.locks.Lock(d.zelleAccount(email))
+	defer unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	profile, payment, err := d.zellePrepare(email, ZelleSend, recipientID, token, amount, d.clock.Now())
+	if err != nil {
+		return ZellePayment{}, err
+	}
+	payment.Memo = memo
+	if err := d.zelleDebit(profile, &payment); err != nil {
+		return ZellePayment{}, err
+	}
+	d.ZellePayments.Upsert(payment.ID, payment)
+	return payment, nil
+}
+
+// RequestZelle asks an enrolled payer for money. Payers at other banks pay
+// on their own; Chase customers pay or decline it themselves.
+func (d *Database) RequestZelle(email, recipientID, token string, amount money.Money, memo string) (ZellePayment, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	_, payment, err := d.zellePrepare(email, ZelleRequest, recipientID, token, amount, now)
+	if err != nil {
+		return ZellePayment{}, err
+	}
+	payment.Memo = memo
+	payment.Status = ZelleRequested
+	if _, ok := d.zelleOwner(payment.Token); !ok {
+		settleAt := now.Add(zelleSettlementDelay)
+		payment.SettleAt = &settleAt
+	}
+	d.ZellePayments.Upsert(payment.ID, payment)
+	return payment, nil
+}
+
+// zelleAccount returns the account a customer's Zelle payments are linked
+// to, or "" if they aren't enrolled, for its lock to be taken before d.mu.
+func (d *Database) zelleAccount(email string) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	zelleProfile, _ := d.ZelleProfiles.Get(email)
+	return zelleProfile.AccountID
+}
+
+// zelleRequestFor returns a request addressed to one of email's tokens.
+// Callers must hold d.mu.
+func (d *Database) zelleRequestFor(email, id string) (ZelleProfile, ZellePayment, error) {
+	payment, exists := d.ZellePayments.Get(id)
+	if !exists || payment.Kind != ZelleRequest {
+		return ZelleProfile{}, ZellePayment{}, ErrZellePaymentNotFound
+	}
+	payer, ok := d.zelleOwner(payment.Token)
+	if !ok || payer.UserEmail != email {
+		return ZelleProfile{}, ZellePayment{}, ErrZellePaymentNotFound
+	}
+	if payment.Status != ZelleRequested {
+		return ZelleProfile{}, ZellePayment{}, ErrZelleNotRequested
+	}
+	return payer, payment, nil
+}
+
+// PayZelleRequest pays a request made to the customer. It counts against
+// the payer's daily send limit.
+func (d *Database) PayZelleRequest(email, id string) (ZellePayment, error) {
+	unlock := d.locks.Lock(d.zelleAccount(email))
+	defer unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	payer, request, err := d.zelleRequestFor(email, id)
+	if err != nil {
+		return ZellePayment{}, err
+	}
+	now := d.clock.Now()
+	used, err := d.zelleUsedToday(email, ZelleSend, now)
+	if err != nil {
+		return ZellePayment{}, err
+	}
+	if err := zelleCheckLimit(payer.DailySendLimit, used, request.Amount); err != nil {
+		return ZellePayment{}, err
+	}
+
+	requester, _ := d.ZelleProfiles.Get(request.UserEmail)
+	send := ZellePayment{
+		ID:        server.NewID("ZPAY"),
+		Kind:      ZelleSend,
+		UserEmail: email,
+		Token:     requester.Tokens[0],
+		Name:      requester.Name,
+		Amount:    request.Amount,
+		Memo:      request.Memo,
+		Status:    ZellePending,
+		RequestID: request.ID,
+		CreatedAt: now,
+	}
+	if err := d.zelleDebit(payer, &send); err != nil {
+		return ZellePayment{}, err
+	}
+	d.ZellePayments.Upsert(send.ID, send)
+
+	// The request completes when the payment that covers it settles
+	if err := statemachine.Move(zelleMachine, &request, &request.Status, &request.StatusHistory, ZellePending, now); err != nil {
+		return ZellePayment{}, err
+	}
+	d.ZellePayments.Upsert(request.ID, request)
+	return send, nil
+}
+
+func (d *Database) DeclineZelleRequest(email, id string) (ZellePayment, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, request, err := d.zelleRequestFor(email, id)
+	if err != nil {
+		return ZellePayment{}, err
+	}
+	now := d.clock.Now()
+	if err := statemachine.Move(zelleMachine, &request, &request.Status, &request.StatusHistory, ZelleDeclined, now); err != nil {
+		return ZellePayment{}, err
+	}
+	request.SettleAt = nil
+	request.CompletedAt = &now
+	d.ZellePayments.Upsert(request.ID, request)
+	return request, nil
+}
+
+// zelleCredit deposits settled Zelle money into a customer's linked
+// account. Callers must hold the account's lock and d.mu.
+func (d *Database) zelleCredit(profile ZelleProfile, amount money.Money, description, reference string, now time.Time) (string, error) {
+	account, _ := d.Accounts.Get(profile.AccountID)
+	balance, err := account.balance().Add(amount)
+	if err != nil {
+		return "", err
+	}
+	d.Post(ledger.Transfer(zelleNetwork, account.ID, amount, description, reference))
+	account.Balance = balance
+	account.UpdatedAt = now
+	d.Accounts.Upsert(account.ID, account)
+
+	txID := server.NewID("TXN")
+	d.Transactions.Upsert(txID, Transaction{
+		ID:          txID,
+		AccountID:   account.ID,
+		Date:        now,
+		Description: description,
+		Amount:      amount,
+		Type:        TransactionTypeCredit,
+		Category:    "ZELLE",
+		Status:      TransactionStatusCompleted,
+		Reference:   reference,
+	})
+	return txID, nil
+}
+
+// SettleZelle completes payments whose settlement time has passed. Sends
+// complete their pending debit and credit a Chase recipient; requests that
+// were paid credit the requester.
+func (d *Database) SettleZelle(now time.Time) int {
+	unlock := d.locks.LockAll()
+	defer unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	settled := 0
+	for _, id := range d.ZellePayments.Keys() {
+		p, _ := d.ZellePayments.Get(id)
+		if p.SettleAt == nil || p.SettleAt.After(now) || (p.Status != ZellePending && p.Status != ZelleRequested) {
+			continue
+		}
+		switch p.Kind {
+		case ZelleSend:
+			if recipient, ok := d.zelleOwner(p.Token); ok {
+				sender, _ := d.ZelleProfiles.Get(p.UserEmail)
+				creditID, err := d.zelleCredit(recipient, p.Amount, "Zelle payment from "+sender.Name, p.ID, now)
+				if err != nil {
+					log.Printf("Settling Zelle payment %s: %v", p.ID, err)
+					continue
+				}
+				request, ok := d.ZellePayments.Get(p.RequestID)
+				if ok && statemachine.Move(zelleMachine, &request, &request.Status, &request.StatusHistory, ZelleCompleted, now) == nil {
+					request.TransactionID = creditID
+					request.CompletedAt = &now
+					d.ZellePayments.Upsert(request.ID, request)
+				}
+			}
+			d.setTransaction(p.TransactionID, TransactionStatusCompleted, now)
+		case ZelleRequest:
+			profile, _ := d.ZelleProfiles.Get(p.UserEmail)
+			creditID, err := d.zelleCredit(profile, p.Amount, "Zelle payment from "+p.Name, p.ID, now)
+			if err != nil {
+				log.Printf("Settling Zelle payment %s: %v", p.ID, err)
+				continue
+			}
+			p.TransactionID = creditID
+		}
+		if err := statemachine.Move(zelleMachine, &p, &p.Status, &p.StatusHistory, ZelleCompleted, now); err != nil {
+			log.Printf("Settling Zelle payment %s: %v", p.ID, err)
+			continue
+		}
+		p.CompletedAt = &now
+		d.ZellePayments.Upsert(id, p)
+		settled++
+	}
+	return settled
+}
+
+func (h *handlers) runZelleSettlement(interval time.Duration) {
+	h.clock.Every(interval, func(now time.Time) {
+		db := h.db.Get()
+		if n := db.SettleZelle(now); n > 0 {
+			log.Printf("Settled %d Zelle payment(s)", n)
+		}
+	})
+}
+
+// GetZelleActivity lists a customer's sends and requests, plus requests
+// waiting on them to pay, newest first.
+func (d *Database) GetZelleActivity(email string) []ZellePayment {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	activity := []ZellePayment{}
+	for _, p := range d.ZellePayments.List() {
+		payer, ok := d.zelleOwner(p.Token)
+		if p.UserEmail == email || (p.Kind == ZelleRequest && ok && payer.UserEmail == email) {
+			activity = append(activity, p)
+		}
+	}
+	sort.Slice(activity, func(i, j int) bool { return activity[i].CreatedAt.After(activity[j].CreatedAt) })
+	return activity
+}
+
+// cardAccount returns an account that carries a card. Callers must hold
+// d.mu.
+func (d *Database) cardAccount(id string) (Account, error) {
+	account, exists := d.Accounts.Get(id)
+	if !exists {
+		return Account{}, ErrAccountNotFound
+	}
+	if account.Type == AccountTypeSavings {
+		return Account{}, ErrNoCard
+	}
+	return account, nil
+}
+
+// SetCardLock locks or unlocks a card. A locked account takes no new
+// debits: card purchases, transfers out, card payments or Zelle sends.
+func (d *Database) SetCardLock(id string, locked bool) (Account, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	account, err := d.cardAccount(id)
+	if err != nil {
+		return Account{}, err
+	}
+	account.CardLocked = locked
+	account.UpdatedAt = d.clock.Now()
+	d.Accounts.Upsert(account.ID, account)
+	return account, nil
+}
+
+// ReportCard retires a lost or stolen card and issues a replacement with a
+// new number. The replacement starts unlocked.
+func (d *Database) ReportCard(id, reason string) (Account, time.Time, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	account, err := d.cardAccount(id)
+	if err != nil {
+		return Account{}, time.Time{}, err
+	}
+	reason = strings.ToUpper(reason)
+	if reason != "LOST" && reason != "STOLEN" {
+		return Account{}, time.Time{}, ErrInvalidReason
+	}
+
+	now := d.clock.Now()
+	used := map[string]bool{account.Last4: true}
+	for _, card := range account.ReplacedCards {
+		used[card.Last4] = true
+	}
+	last4 := account.Last4
+	for used[last4] {
+		last4 = fmt.Sprintf("%04d", rand.Intn(10000))
+	}
+	account.ReplacedCards = append(account.ReplacedCards, ReplacedCard{
+		Last4:      account.Last4,
+		Reason:     reason,
+		ReportedAt: now,
+	})
+	account.Last4 = last4
+	account.CardLocked = false
+	account.UpdatedAt = now
+	d.Accounts.Upsert(account.ID, account)
+	return account, now.AddDate(0, 0, replacementCardDays), nil
+}
+
+func (d *Database) AddTravelNotice(id string, notice TravelNotice) (TravelNotice, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	account, err := d.cardAccount(id)
+	if err != nil {
+		return TravelNotice{}, err
+	}
+	if len(notice.Destinations) == 0 {
+		return TravelNotice{}, ErrNoDestinations
+	}
+	now := d.clock.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if notice.EndDate.Before(notice.StartDate) || notice.EndDate.Before(today) {
+		return TravelNotice{}, ErrInvalidDates
+	}
+	for i, dest := range notice.Destinations {
+		notice.Destinations[i] = strings.ToUpper(strings.TrimSpace(dest))
+	}
+
+	notice.ID = server.NewID("NOTICE")
+	notice.CreatedAt = now
+	account.TravelNotices = append(account.TravelNotices, notice)
+	account.UpdatedAt = now
+	d.Accounts.Upsert(account.ID, account)
+	return notice, nil
+}
+
+func (d *Database) DeleteTravelNotice(id, noticeID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	account, err := d.cardAccount(id)
+	if err != nil {
+		return err
+	}
+	for i, notice := range account.TravelNotices {
+		if notice.ID == noticeID {
+			account.TravelNotices = append(account.TravelNotices[:i:i], account.TravelNotices[i+1:]...)
+			account.UpdatedAt = d.clock.Now()
+			d.Accounts.Upsert(account.ID, account)
+			return nil
+		}
+	}
+	return ErrTravelNoticeNotFound
+}
+
+type CardPurchase struct {
+	Last4    string      `json:"last4"`
+	Merchant string      `json:"merchant"`
+	Amount   money.Money `json:"amount" validate:"gte=0"`
+	Category string      `json:"category"`
+	Country  string      `json:"country"` // ISO code; defaults to US
+}
+
+// authorize decides whether a card purchase goes through.
+func authorize(account Account, p CardPurchase, now time.Time) error {
+	if p.Last4 != account.Last4 {
+		for _, card := range account.ReplacedCards {
+			if card.Last4 == p.Last4 {
+				return ErrCardReported
+			}
+		}
+		return ErrCardMismatch
+	}
+	if account.CardLocked {
+		return ErrCardLocked
+	}
+	if p.Country != "US" {
+		covered := false
+		for _, notice := range account.TravelNotices {
+			covered = covered || notice.covers(p.Country, now)
+		}
+		if !covered {
+			return ErrNoTravelNotice
+		}
+	}
+	// Purchases are charged in the card's currency
+	amount := p.Amount.In(account.Currency)
+	if account.Type == AccountTypeCredit && account.Credit != nil {
+		after, err := owed(account).Add(amount)
+		if err != nil {
+			return err
+		}
+		over, err := account.Credit.CreditLimit.In(account.Currency).Less(after)
+		if err != nil {
+			return err
+		}
+		if over {
+			return ErrCreditLimit
+		}
+		return nil
+	}
+	short, err := account.balance().Less(amount)
+	if err != nil {
+		return err
+	}
+	if short {
+		return ErrInsufficientFunds
+	}
+	return nil
+}
+
+// ChargeCard runs a card purchase. Declined purchases are recorded as
+// failed transactions.
+func (d *Database) ChargeCard(id string, p CardPurchase) (Transaction, error) {
+	unlock := d.locks.Lock(id)
+	defer unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	account, err := d.cardAccount(id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if !p.Amount.IsPositive() {
+		return Transaction{}, ErrInvalidAmount
+	}
+	p.Country = strings.ToUpper(p.Country)
+	if p.Country == "" {
+		p.Country = "US"
+	}
+
+	now := d.clock.Now()
+	tx := Transaction{
+		ID:          server.NewID("TXN"),
+		AccountID:   account.ID,
+		Date:        now,
+		Description: strings.ToUpper(p.Merchant),
+		Amount:      p.Amount.Neg(),
+		Type:        TransactionTypeDebit,
+		Category:    p.Category,
+		Status:      TransactionStatusCompleted,
+		Reference:   "CARD_" + p.Last4,
+	}
+	if err := authorize(account, p, now); err != nil {
+		tx.Status = TransactionStatusFailed
+		d.Transactions.Upsert(tx.ID, tx)
+		return tx, err
+	}
+	balance, err := account.balance().Sub(p.Amount.In(account.Currency))
+	if err != nil {
+		return Transaction{}, err
+	}
+	if err := d.Post(ledger.Transfer(account.ID, ledger.External+tx.Description, p.Amount, tx.Description, tx.ID)); err != nil {
+		return Transaction{}, err
+	}
+	account.Balance = balance
+	account.UpdatedAt = now
+	d.Accounts.Upsert(account.ID, account)
+	d.Transactions.Upsert(tx.ID, tx)
+	return tx, nil
+}
+
+// wireSchedule is when a wire submitted at t is sent: right away before the
+// cutoff on a business day, otherwise at opening on the next business day.
+func wireSchedule(kind WireKind, t time.Time) time.Time {
+	local := t.In(eastern)
+	businessDay := func(d time.Time) bool {
+		return d.Weekday() != time.Saturday && d.Weekday() != time.Sunday
+	}
+	if businessDay(local) && local.Hour() < wireCutoffHour[kind] {
+		opening := time.Date(local.Year(), local.Month(), local.Day(), wireOpeningHour, 0, 0, 0, eastern)
+		if local.Before(opening) {
+			return opening
+		}
+		return t
+	}
+	next := time.Date(local.Year(), local.Month(), local.Day()+1, wireOpeningHour, 0, 0, 0, eastern)
+	for !businessDay(next) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// validABA checks a routing number's length and checksum.
+func validABA(routing string) bool {
+	if len(routing) != 9 {
+		return false
+	}
+	weights := []int{3, 7, 1}
+	sum := 0
+	for i, r := range routing {
+		if r < '0' || r > '9' {
+			return false
+		}
+		sum += int(r-'0') * weights[i%3]
+	}
+	return sum%10 == 0
+}
+
+func validateBeneficiary(kind WireKind, b *Beneficiary) error {
+	b.Country = strings.ToUpper(strings.TrimSpace(b.Country))
+	b.SwiftCode = strings.ToUpper(strings.TrimSpace(b.SwiftCode))
+	if b.Name == "" || b.AccountNumber == "" || b.BankName == "" {
+		return fmt.Errorf("%w: name, bank_name and account_number are required", ErrInvalidBeneficiary)
+	}
+	switch kind {
+	case WireDomestic:
+		if b.Country == "" {
+			b.Country = "US"
+		}
+		if b.Country != "US" {
+			return fmt.Errorf("%w: domestic wires go to U.S. banks", ErrInvalidBeneficiary)
+		}
+		if !validABA(b.RoutingNumber) {
+			return fmt.Errorf("%w: routing number is not valid", ErrInvalidBeneficiary)
+		}
+	case WireInternational:
+		if len(b.Country) != 2 || b.Country == "US" {
+			return fmt.Errorf("%w: country must be a non-U.S. ISO code", ErrInvalidBeneficiary)
+		}
+		if n := len(b.SwiftCode); n != 8 && n != 11 {
+			return fmt.Errorf("%w: SWIFT code must be 8 or 11 characters", ErrInvalidBeneficiary)
+		}
+		if b.Address == "" {
+			return fmt.Errorf("%w: address is required for international wires", ErrInvalidBeneficiary)
+		}
+	default:
+		return ErrInvalidWireKind
+	}
+	return nil
+}
+
+// CreateWire submits a wire. The amount and fee leave the account as
+// pending debits, completed once the wire is delivered.
+func (d *Database) CreateWire(wire Wire) (Wire, error) {
+	unlock := d.locks.Lock(wire.FromAccount)
+	defer unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	wire.Kind = WireKind(strings.ToUpper(string(wire.Kind)))
+	if err := validateBeneficiary(wire.Kind, &wire.Beneficiary); err != nil {
+		return Wire{}, err
+	}
+	account, exists := d.Accounts.Get(wire.FromAccount)
+	if !exists {
+		return Wire{}, ErrAccountNotFound
+	}
+	if account.UserEmail != wire.UserEmail {
+		return Wire{}, ErrUnauthorized
+	}
+	if account.Type != AccountTypeChecking {
+		return Wire{}, ErrWireAccount
+	}
+	if account.CardLocked {
+		return Wire{}, ErrCardLocked
+	}
+	if !wire.Amount.IsPositive() {
+		return Wire{}, ErrInvalidAmount
+	}
+	wire.Fee = wireFees[wire.Kind]
+	total, err := wire.Amount.Add(wire.Fee)
+	if err != nil {
+		return Wire{}, err
+	}
+	balance, err := account.balance().Sub(total.In(account.Currency))
+	if err != nil {
+		return Wire{}, err
+	}
+	if balance.IsNegative() {
+		return Wire{}, ErrInsufficientFunds
+	}
+
+	now := d.clock.Now()
+	wire.ID = server.NewID("WIRE")
+	wire.Status = WireScheduled
+	wire.SubmittedAt = now
+	wire.ProcessOn = wireSchedule(wire.Kind, now)
+	wire.History = []WireEvent{{Status: WireScheduled, At: now}}
+	wire.TransactionIDs = nil
+	for _, tx := range []Transaction{
+		{Description: fmt.Sprintf("%s WIRE TO %s", wire.Kind, strings.ToUpper(wire.Beneficiary.Name)), Amount: wire.Amount.Neg(), Category: "WIRE"},
+		{Description: fmt.Sprintf("%s WIRE FEE", wire.Kind), Amount: wire.Fee.Neg(), Category: "FEES"},
+	} {
+		tx.ID = server.NewID("TXN")
+		tx.AccountID = account.ID
+		tx.Date = now
+		tx.Type = TransactionTypeDebit
+		tx.Status = TransactionStatusPending
+		tx.Reference = wire.ID
+		d.Transactions.Upsert(tx.ID, tx)
+		wire.TransactionIDs = append(wire.TransactionIDs, tx.ID)
+	}
+	if err := d.Post(wireJournal(account.ID, wire, total, 1)); err != nil {
+		return Wire{}, err
+	}
+	account.Balance = balance
+	account.UpdatedAt = now
+	d.Accounts.Upsert(account.ID, account)
+	d.Wires.Upsert(wire.ID, wire)
+	return wire, nil
+}
+
+// wireJournal is the journal of a wire's amount and fee, total between
+// them, leaving account, for sign 1, or coming back to it, for sign -1, as
+// when it's cancelled.
+func wireJournal(account string, wire Wire, total money.Money, sign int) ledger.Journal {
+	memo := fmt.Sprintf("%s wire to %s", wire.Kind, wire.Beneficiary.Name)
+	if sign < 0 {
+		memo = "Cancelled " + memo
+	}
+	return ledger.Journal{
+		Memo:      memo,
+		Reference: wire.ID,
+		Legs: []ledger.Leg{
+			{Account: account, Amount: total.Times(-sign)},
+			{Account: wireNetwork, Amount: wire.Amount.Times(sign)},
+			{Account: feeIncome, Amount: wire.Fee.Times(sign)},
+		},
+	}
+}
+
+// setWireTransactions moves a wire's transactions to status. Callers must
+// hold d.mu.
+func (d *Database) setWireTransactions(wire Wire, status TransactionStatus, now time.Time) {
+	for _, id := range wire.TransactionIDs {
+		d.setTransaction(id, status, now)
+	}
+}
+
+// setTransaction settles a pending transaction into status, logging a
+// move transactionMachine refuses. Callers must hold d.mu.
+func (d *Database) setTransaction(id string, status TransactionStatus, now time.Time) {
+	tx, _ := d.Transactions.Get(id)
+	if err := statemachine.Move(transactionMachine, &tx, &tx.Status, nil, status, now); err != nil {
+		log.Printf("Settling transaction %s: %v", id, err)
+		return
+	}
+	d.Transactions.Upsert(id, tx)
+}
+
+// CancelWire cancels a wire that hasn't been sent yet and returns the
+// amount and fee.
+func (d *Database) CancelWire(email, id string) (Wire, error) {
+	d.mu.RLock()
+	wire, _ := d.Wires.Get(id)
+	from := wire.FromAccount
+	d.mu.RUnlock()
+	unlock := d.locks.Lock(from)
+	defer unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	wire, exists := d.Wires.Get(id)
+	if !exists || wire.UserEmail != email {
+		return Wire{}, ErrWireNotFound
+	}
+	now := d.clock.Now()
+	if err := statemachine.Move(wireMachine, &wire, &wire.Status, nil, WireCancelled, now); err != nil {
+		return Wire{}, ErrWireNotCancellable
+	}
+
+	account, _ := d.Accounts.Get(wire.FromAccount)
+	total, err := wire.Amount.Add(wire.Fee)
+	if err != nil {
+		return Wire{}, err
+	}
+	balance, err := account.balance().Add(total.In(account.Currency))
+	if err != nil {
+		return Wire{}, err
+	}
+	if err := d.Post(wireJournal(wire.FromAccount, wire, total, -1)); err != nil {
+		return Wire{}, err
+	}
+	account.Balance = balance
+	account.UpdatedAt = now
+	d.Accounts.Upsert(account.ID, account)
+	d.setWireTransactions(wire, TransactionStatusFailed, now)
+
+	wire.History = append(wire.History, WireEvent{Status: WireCancelled, At: now, Note: "Cancelled by customer"})
+	d.Wires.Upsert(wire.ID, wire)
+	return wire, nil
+}
+
+// ProcessWires sends scheduled wires whose processing time has come and
+// completes sent wires once delivered.
+func (d *Database) ProcessWires(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	advanced := 0
+	for _, id := range d.Wires.Keys() {
+		wire, _ := d.Wires.Get(id)
+		if !now.Before(wire.ProcessOn) && statemachine.Move(wireMachine, &wire, &wire.Status, nil, WireProcessing, now) == nil {
+			wire.History = append(wire.History, WireEvent{Status: WireProcessing, At: now})
+			advanced++
+		}
+		if !now.Before(wire.ProcessOn.Add(wireDelivery[wire.Kind])) && statemachine.Move(wireMachine, &wire, &wire.Status, nil, WireCompleted, now) == nil {
+			d.setWireTransactions(wire, TransactionStatusCompleted, now)
+			wire.CompletedAt = &now
+			wire.History = append(wire.History, WireEvent{
+				Status: WireCompleted,
+				At:     now,
+				Note:   "Received by " + wire.Beneficiary.BankName,
+			})
+			advanced++
+		}
+		d.Wires.Upsert(id, wire)
+	}
+	return advanced
+}
+
+func (h *handlers) runWireProcessing(interval time.Duration) {
+	h.clock.Every(interval, func(now time.Time) {
+		db := h.db.Get()
+		if n := db.ProcessWires(now); n > 0 {
+			log.Printf("Advanced %d wire(s)", n)
+		}
+	})
+}
+
+func (d *Database) GetUserWires(email string) []Wire {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	wires := d.Wires.By("user_email", email)
+	sort.Slice(wires, func(i, j int) bool { return wires[i].SubmittedAt.After(wires[j].SubmittedAt) })
+	return wires
+}
+
+func (d *Database) GetWire(email, id string) (Wire, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	wire, exists := d.Wires.Get(id)
+	if !exists || wire.UserEmail != email {
+		return Wire{}, ErrWireNotFound
+	}
+	return wire, nil
+}
+
+// HTTP Handlers
+func (h *handlers) getUserAccounts(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	accounts := db.GetUserAccounts(email)
+	return server.List(c, accounts)
+}
+
+func (h *handlers) getAccountTransactions(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	accountId := c.Params("accountId")
+	if accountId == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "account ID is required")
+	}
+
+	startDateStr := c.Query("startDate")
+	endDateStr := c.Query("endDate")
+
+	var startDate, endDate time.Time
+	var err error
+
+	if startDateStr != "" {
+		startDate, err = time.Parse("2006-01-02", startDateStr)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid start date format")
+		}
+	}
+
+	if endDateStr != "" {
+		endDate, err = time.Parse("2006-01-02", endDateStr)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid end date format")
+		}
+	}
+
+	transactions := db.GetAccountTransactions(accountId, startDate, endDate)
+	return server.List(c, transactions)
+}
+
+type TransferRequest struct {
+	FromAccount string      `json:"from_account"`
+	ToAccount   string      `json:"to_account"`
+	Amount      money.Money `json:"amount" validate:"gt=0"`
+	Description string      `json:"description"`
+}
+
+func (h *handlers) createTransfer(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req TransferRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	transfer := Transfer{
+		ID:          server.NewID("TRF"),
+		FromAccount: req.FromAccount,
+		ToAccount:   req.ToAccount,
+		Amount:      req.Amount,
+		Description: req.Description,
+		Status:      TransactionStatusCompleted,
+		CreatedAt:   h.clock.Now(),
+	}
+
+	if err := db.CreateTransfer(transfer); err != nil {
+		switch {
+		case errors.Is(err, ErrAccountNotFound):
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case errors.Is(err, ErrInsufficientFunds):
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		case errors.Is(err, ErrCardLocked):
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		case errors.Is(err, money.ErrMixedCurrencies):
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to process transfer")
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(transfer)
+}
+
+func (h *handlers) getUserBills(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	bills := db.GetUserBills(email)
+	return server.List(c, bills)
+}
+
+func (h *handlers) getStatements(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	statements, err := db.GetStatements(c.Params("accountId"))
+	if err != nil {
+		return creditError(c, err)
+	}
+	return server.List(c, statements)
+}
+
+func (h *handlers) payCard(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		FromAccount string      `json:"from_account"`
+		Amount      money.Money `json:"amount" validate:"gte=0"`
+		Option      string      `json:"option"` // minimum, statement_balance, current_balance
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	transfer, statement, err := db.PayCard(c.Params("accountId"), req.FromAccount, req.Amount, req.Option)
+	if err != nil {
+		return creditError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"payment":   transfer,
+		"statement": statement,
+	})
+}
+
+func creditError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, money.ErrMixedCurrencies) {
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	}
+	switch err {
+	case ErrAccountNotFound, ErrStatementNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrUnauthorized, ErrCardLocked:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrNotCreditCard, ErrNotChecking, ErrNoStatement, ErrInvalidAmount, ErrOverpayment, ErrInsufficientFunds:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) getZelleProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	profile, err := db.GetZelleProfile(email)
+	if err != nil {
+		return zelleError(c, err)
+	}
+	return c.JSON(profile)
+}
+
+func (h *handlers) enrollZelle(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Email     string   `json:"email" validate:"required,email"`
+		Name      string   `json:"name" validate:"required"`
+		AccountID string   `json:"account_id"`
+		Tokens    []string `json:"tokens"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	profile, err := db.EnrollZelle(req.Email, req.Name, req.AccountID, req.Tokens)
+	if err != nil {
+		return zelleError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(profile)
+}
+
+func (h *handlers) lookupZelle(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	token, name, enrolled, err := db.LookupZelle(c.Query("token"))
+	if err != nil {
+		return zelleError(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"token":    token,
+		"name":     name,
+		"enrolled": enrolled,
+	})
+}
+
+func (h *handlers) getZelleRecipients(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	return server.List(c, db.GetZelleRecipients(email))
+}
+
+func (h *handlers) addZelleRecipient(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var recipient ZelleRecipient
+	if err := server.Bind(c, &recipient); err != nil {
+		return err
+	}
+
+	recipient, err := db.AddZelleRecipient(recipient)
+	if err != nil {
+		return zelleError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(recipient)
+}
+
+func (h *handlers) deleteZelleRecipient(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	if err := db.DeleteZelleRecipient(email, c.Params("id")); err != nil {
+		return zelleError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type ZelleMoneyRequest struct {
+	Email       string      `json:"email" validate:"email"`
+	RecipientID string      `json:"recipient_id"`
+	Token       string      `json:"token"` // Email or phone, when not a saved recipient
+	Amount      money.Money `json:"amount" validate:"gte=0"`
+	Memo        string      `json:"memo"`
+}
+
+func (h *handlers) moveZelleMoney(move func(d *Database, email, recipientID, token string, amount money.Money, memo string) (ZellePayment, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		var req ZelleMoneyRequest
+		if err := server.Bind(c, &req); err != nil {
+			return err
+		}
+
+		payment, err := move(db, req.Email, req.RecipientID, req.Token, req.Amount, req.Memo)
+		if err != nil {
+			return zelleError(c, err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(payment)
+	}
+}
+
+func (h *handlers) answerZelleRequest(answer func(d *Database, email, id string) (ZellePayment, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		var req struct {
+			Email string `json:"email" validate:"email"`
+		}
+		if err := server.Bind(c, &req); err != nil {
+			return err
+		}
+
+		payment, err := answer(db, req.Email, c.Params("id"))
+		if err != nil {
+			return zelleError(c, err)
+		}
+		return c.JSON(payment)
+	}
+}
+
+func (h *handlers) getZelleActivity(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	return server.List(c, db.GetZelleActivity(email))
+}
+
+func zelleError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrAccountNotFound), errors.Is(err, ErrRecipientNotFound),
+		errors.Is(err, ErrZellePaymentNotFound), errors.Is(err, ErrZelleNotEnrolled):
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case errors.Is(err, ErrUnauthorized), errors.Is(err, ErrCardLocked):
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case errors.Is(err, ErrZelleAlreadyEnrolled), errors.Is(err, ErrZelleTokenTaken), errors.Is(err, ErrZelleNotRequested):
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case errors.Is(err, ErrZelleLimit), errors.Is(err, money.ErrMixedCurrencies):
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	case errors.Is(err, ErrInvalidAmount), errors.Is(err, ErrInsufficientFunds), errors.Is(err, ErrNotChecking),
+		errors.Is(err, ErrZelleInvalidToken), errors.Is(err, ErrRecipientNotEnrolled), errors.Is(err, ErrZelleSelf):
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) setCardLock(locked bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		account, err := db.SetCardLock(c.Params("accountId"), locked)
+		if err != nil {
+			return cardError(c, err)
+		}
+		return c.JSON(account)
+	}
+}
+
+func (h *handlers) reportCard(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	account, arrivesBy, err := db.ReportCard(c.Params("accountId"), req.Reason)
+	if err != nil {
+		return cardError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"account":    account,
+		"new_last4":  account.Last4,
+		"arrives_by": arrivesBy,
+	})
+}
+
+func (h *handlers) addTravelNotice(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Destinations []string `json:"destinations"`
+		StartDate    string   `json:"start_date" validate:"date"`
+		EndDate      string   `json:"end_date" validate:"date"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+	startDate, err := time.Parse("2006-01-02", req.StartDate)
+	if err != nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid start date format")
+	}
+	endDate, err := time.Parse("2006-01-02", req.EndDate)
+	if err != nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid end date format")
+	}
+
+	notice, err := db.AddTravelNotice(c.Params("accountId"), TravelNotice{
+		Destinations: req.Destinations,
+		StartDate:    startDate,
+		EndDate:      endDate,
+	})
+	if err != nil {
+		return cardError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(notice)
+}
+
+func (h *handlers) deleteTravelNotice(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	if err := db.DeleteTravelNotice(c.Params("accountId"), c.Params("noticeId")); err != nil {
+		return cardError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *handlers) chargeCard(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var purchase CardPurchase
+	if err := server.Bind(c, &purchase); err != nil {
+		return err
+	}
+
+	tx, err := db.ChargeCard(c.Params("accountId"), purchase)
+	if err != nil {
+		if tx.ID != "" {
+			// Declined; the failed transaction is on the account
+			return server.FailWith(c, fiber.StatusPaymentRequired,
+				server.NewError(server.CodePaymentDeclined, err.Error()).WithDetails(fiber.Map{"transaction": tx}))
+		}
+		return cardError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(tx)
+}
+
+func cardError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, money.ErrMixedCurrencies) {
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	}
+	switch err {
+	case ErrAccountNotFound, ErrTravelNoticeNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNoCard, ErrInvalidReason, ErrInvalidDates, ErrNoDestinations, ErrInvalidAmount:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+type WireRequest struct {
+	Email       string      `json:"email" validate:"email"`
+	FromAccount string      `json:"from_account"`
+	Kind        WireKind    `json:"kind"`
+	Beneficiary Beneficiary `json:"beneficiary"`
+	Amount      money.Money `json:"amount" validate:"gte=0"`
+	Purpose     string      `json:"purpose"`
+}
+
+func (h *handlers) createWire(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req WireRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	wire, err := db.CreateWire(Wire{
+		UserEmail:   req.Email,
+		FromAccount: req.FromAccount,
+		Kind:        req.Kind,
+		Beneficiary: req.Beneficiary,
+		Amount:      req.Amount,
+		Purpose:     req.Purpose,
+	})
+	if err != nil {
+		return wireError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(wire)
+}
+
+func (h *handlers) getUserWires(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	return server.List(c, db.GetUserWires(email))
+}
+
+func (h *handlers) getWire(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	wire, err := db.GetWire(email, c.Params("id"))
+	if err != nil {
+		return wireError(c, err)
+	}
+	return c.JSON(wire)
+}
+
+func (h *handlers) cancelWire(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Email string `json:"email" validate:"email"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	wire, err := db.CancelWire(req.Email, c.Params("id"))
+	if err != nil {
+		return wireError(c, err)
+	}
+	return c.JSON(wire)
+}
+
+func wireError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrAccountNotFound), errors.Is(err, ErrWireNotFound):
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case errors.Is(err, ErrUnauthorized), errors.Is(err, ErrCardLocked):
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case errors.Is(err, ErrWireNotCancellable):
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case errors.Is(err, money.ErrMixedCurrencies):
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	case errors.Is(err, ErrInvalidBeneficiary), errors.Is(err, ErrInvalidWireKind), errors.Is(err, ErrWireAccount),
+		errors.Is(err, ErrInvalidAmount), errors.Is(err, ErrInsufficientFunds):
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
+		locks: &h.accountLocks,
+	}
+
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	h.db.Set(db)
+	return nil
+}
+
+func setupRoutes(app *fiber.App, h *handlers) {
+	api := app.Group("/api/v1")
+
+	// Account routes
+	api.Get("/accounts", h.getUserAccounts)
+	api.Get("/accounts/:accountId", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		accountId := c.Params("accountId")
+		account, err := db.GetAccount(accountId)
+		if err != nil {
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		}
+		return c.JSON(account)
+	})
+	api.Get("/accounts/:accountId/transactions", h.getAccountTransactions)
+	api.Get("/accounts/:accountId/statements", h.getStatements)
+	api.Post("/accounts/:accountId/payments", h.payCard)
+
+	// Card control routes
+	api.Post("/accounts/:accountId/card/lock", h.setCardLock(true))
+	api.Post("/accounts/:accountId/card/unlock", h.setCardLock(false))
+	api.Post("/accounts/:accountId/card/report", h.reportCard)
+	api.Post("/accounts/:accountId/card/purchases", h.chargeCard)
+	api.Post("/accounts/:accountId/travel-notices", h.addTravelNotice)
+	api.Delete("/accounts/:accountId/travel-notices/:noticeId", h.deleteTravelNotice)
+
+	// Transfer routes
+	api.Post("/transfers", h.createTransfer)
+
+	// Wire routes
+	api.Post("/wires", h.createWire)
+	api.Get("/wires", h.getUserWires)
+	api.Get("/wires/:id", h.getWire)
+	api.Post("/wires/:id/cancel", h.cancelWire)
+
+	// Bill routes
+	api.Get("/bills", h.getUserBills)
+
+	// Zelle routes
+	api.Get("/zelle/enrollment", h.getZelleProfile)
+	api.Post("/zelle/enrollment", h.enrollZelle)
+	api.Get("/zelle/lookup", h.lookupZelle)
+	api.Get("/zelle/recipients", h.getZelleRecipients)
+	api.Post("/zelle/recipients", h.addZelleRecipient)
+	api.Delete("/zelle/recipients/:id", h.deleteZelleRecipient)
+	api.Post("/zelle/send", h.moveZelleMoney((*Database).SendZelle))
+	api.Post("/zelle/request", h.moveZelleMoney((*Database).RequestZelle))
+	api.Post("/zelle/requests/:id/pay", h.answerZelleRequest((*Database).PayZelleRequest))
+	api.Post("/zelle/requests/:id/decline", h.answerZelleRequest((*Database).DeclineZelleRequest))
+	api.Get("/zelle/activity", h.getZelleActivity)
+}
+
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
+func main() {
+	cfg := server.ParseFlags()
+	wireFees[WireDomestic] = money.Dollars(cfg.Fee("wire_domestic", wireFees[WireDomestic].Float()))
+	wireFees[WireInternational] = money.Dollars(cfg.Fee("wire_international", wireFees[WireInternational].Float()))
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"accounts", "bills", "zelle_profiles", "zelle_recipients", "wires", "zelle_payments"},
+			Search:  []string{"accounts", "transactions", "bills", "wires", "zelle_payments"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+	go h.runStatementCycle(time.Minute)
+	go h.runZelleSettlement(time.Minute)
+	go h.runWireProcessing(time.Minute)
+	go h.runBillReminders(time.Minute)
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
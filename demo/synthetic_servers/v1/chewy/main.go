@@ -1,54 +1,50 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
 type Pet struct {
 	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	Type      string    `json:"type"`
+	Name      string    `json:"name" validate:"required"`
+	Type      string    `json:"type" validate:"required"`
 	Breed     string    `json:"breed"`
-	Age       float64   `json:"age"`
-	Weight    float64   `json:"weight"`
+	Age       float64   `json:"age" validate:"gte=0"`
+	Weight    float64   `json:"weight" validate:"gte=0"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
 type Product struct {
-	ID            string    `json:"id"`
-	Name          string    `json:"name"`
-	Brand         string    `json:"brand"`
-	Category      string    `json:"category"`
-	Description   string    `json:"description"`
-	Price         float64   `json:"price"`
-	AutoshipPrice float64   `json:"autoship_price"`
-	InStock       bool      `json:"in_stock"`
-	Rating        float64   `json:"rating"`
-	PetTypes      []string  `json:"pet_types"`
-	ImageURL      string    `json:"image_url"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID            string      `json:"id"`
+	Name          string      `json:"name"`
+	Brand         string      `json:"brand"`
+	Category      string      `json:"category"`
+	Description   string      `json:"description"`
+	Price         money.Money `json:"price"`
+	AutoshipPrice money.Money `json:"autoship_price"`
+	InStock       bool        `json:"in_stock"`
+	Rating        float64     `json:"rating"`
+	PetTypes      []string    `json:"pet_types"`
+	ImageURL      string      `json:"image_url"`
+	CreatedAt     time.Time   `json:"created_at"`
 }
 
 type AutoshipSubscription struct {
 	ID             string    `json:"id"`
-	UserEmail      string    `json:"user_email"`
+	UserEmail      string    `json:"user_email" validate:"email"`
 	Product        Product   `json:"product"`
 	FrequencyWeeks int       `json:"frequency_weeks"`
 	NextDelivery   time.Time `json:"next_delivery"`
-	Quantity       int       `json:"quantity"`
+	Quantity       int       `json:"quantity" validate:"gte=0"`
 	Status         string    `json:"status"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
@@ -71,9 +67,12 @@ type Address struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User                 `json:"users"`
-	Products map[string]Product              `json:"products"`
-	Autoship map[string]AutoshipSubscription `json:"autoship"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]                 `json:"users"`
+	Products server.Repository[Product]              `json:"products"`
+	Autoship server.Repository[AutoshipSubscription] `json:"autoship"`
 	mu       sync.RWMutex
 }
 
@@ -84,15 +83,25 @@ var (
 	ErrInvalidInput    = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers sell Chewy's pet supplies and keep users' pets and autoship
+// schedules, dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the products, users and autoships in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -103,13 +112,13 @@ func (d *Database) AddPet(email string, pet Pet) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
 
 	user.Pets = append(user.Pets, pet)
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
@@ -117,35 +126,25 @@ func (d *Database) GetProducts(category, petType, brand string) []Product {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var filtered []Product
-	for _, product := range d.Products {
-		if (category == "" || product.Category == category) &&
+	return d.Products.Query(func(product Product) bool {
+		return (category == "" || product.Category == category) &&
 			(brand == "" || product.Brand == brand) &&
-			(petType == "" || contains(product.PetTypes, petType)) {
-			filtered = append(filtered, product)
-		}
-	}
-	return filtered
+			(petType == "" || contains(product.PetTypes, petType))
+	})
 }
 
 func (d *Database) GetAutoship(email string) []AutoshipSubscription {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var subscriptions []AutoshipSubscription
-	for _, sub := range d.Autoship {
-		if sub.UserEmail == email {
-			subscriptions = append(subscriptions, sub)
-		}
-	}
-	return subscriptions
+	return d.Autoship.By("user_email", email)
 }
 
 func (d *Database) CreateAutoship(sub AutoshipSubscription) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Autoship[sub.ID] = sub
+	d.Autoship.Upsert(sub.ID, sub)
 	return nil
 }
 
@@ -160,156 +159,148 @@ func contains(slice []string, item string) bool {
 }
 
 // HTTP Handlers
-func getPets(c *fiber.Ctx) error {
+func (h *handlers) getPets(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Pets)
+	return server.List(c, user.Pets)
 }
 
-func addPet(c *fiber.Ctx) error {
+func (h *handlers) addPet(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var pet Pet
-	if err := c.BodyParser(&pet); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &pet); err != nil {
+		return err
 	}
 
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
-	pet.ID = uuid.New().String()
-	pet.CreatedAt = time.Now()
+	pet.ID = server.NewID("PET")
+	pet.CreatedAt = h.clock.Now()
 
 	if err := db.AddPet(email, pet); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(pet)
 }
 
-func getProducts(c *fiber.Ctx) error {
+func (h *handlers) getProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	petType := c.Query("pet_type")
 	brand := c.Query("brand")
 
 	products := db.GetProducts(category, petType, brand)
-	return c.JSON(products)
+	return server.List(c, products, "brand", "category")
 }
 
-func getAutoship(c *fiber.Ctx) error {
+func (h *handlers) getAutoship(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	subscriptions := db.GetAutoship(email)
-	return c.JSON(subscriptions)
+	return server.List(c, subscriptions)
 }
 
-func createAutoship(c *fiber.Ctx) error {
+func (h *handlers) createAutoship(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var sub AutoshipSubscription
-	if err := c.BodyParser(&sub); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &sub); err != nil {
+		return err
 	}
 
-	sub.ID = uuid.New().String()
-	sub.CreatedAt = time.Now()
-	sub.UpdatedAt = time.Now()
+	sub.ID = server.NewID("SUB")
+	sub.CreatedAt = h.clock.Now()
+	sub.UpdatedAt = h.clock.Now()
 	sub.Status = "active"
 
 	if err := db.CreateAutoship(sub); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(sub)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Products: make(map[string]Product),
-		Autoship: make(map[string]AutoshipSubscription),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Pet routes
-	api.Get("/pets", getPets)
-	api.Post("/pets", addPet)
+	api.Get("/pets", h.getPets)
+	api.Post("/pets", h.addPet)
 
 	// Product routes
-	api.Get("/products", getProducts)
+	api.Get("/products", h.getProducts)
 
 	// Autoship routes
-	api.Get("/autoship", getAutoship)
-	api.Post("/autoship", createAutoship)
+	api.Get("/autoship", h.getAutoship)
+	api.Post("/autoship", h.createAutoship)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"autoship"},
+			Search:  []string{"products", "autoship"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,18 +1,25 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
-	"os"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/availability"
+	"pkg/geo"
+	"pkg/money"
+	"pkg/reviews"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -31,11 +38,18 @@ type Studio struct {
 	Categories  []string  `json:"categories"`
 	Rating      float64   `json:"rating"`
 	Location    Location  `json:"location"`
+	Timezone    string    `json:"timezone"` // IANA, such as America/Los_Angeles
 	Description string    `json:"description"`
 	Amenities   []string  `json:"amenities"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
+// location returns the time zone the studio keeps, which its classes meet
+// and are listed in.
+func (s Studio) location() *time.Location {
+	return geo.Location(s.Timezone)
+}
+
 type Instructor struct {
 	ID          string   `json:"id"`
 	Name        string   `json:"name"`
@@ -56,6 +70,73 @@ type Class struct {
 	SpotsTotal      int        `json:"spots_total"`
 	SpotsAvailable  int        `json:"spots_available"`
 	CreditsRequired int        `json:"credits_required"`
+	Cancelled       bool       `json:"cancelled,omitempty"`
+	TemplateID      string     `json:"template_id,omitempty"`
+}
+
+// RecurrenceRule describes when a recurring class meets, e.g. every Monday
+// and Wednesday at 18:00 in the studio's time zone, whether or not it is
+// keeping daylight saving time.
+type RecurrenceRule struct {
+	Days []string `json:"days"` // "mon", "tue", ...
+	Time string   `json:"time"` // "15:04", the studio's local time
+}
+
+// rule is r as a weekly rule of the availability package.
+func (r RecurrenceRule) rule() availability.Rule {
+	return availability.Rule{Days: r.Days, Start: r.Time}
+}
+
+func (r RecurrenceRule) Validate() error {
+	if err := r.rule().Validate(); err != nil {
+		return fmt.Errorf("recurrence: %w", err)
+	}
+	return nil
+}
+
+// ClassTemplate is a recurring class from which concrete Class rows are
+// materialized.
+type ClassTemplate struct {
+	ID              string         `json:"id"`
+	StudioID        string         `json:"studio_id"`
+	Name            string         `json:"name"`
+	Description     string         `json:"description"`
+	InstructorID    string         `json:"instructor_id"`
+	Category        string         `json:"category"`
+	Recurrence      RecurrenceRule `json:"recurrence"`
+	Duration        int            `json:"duration"` // in minutes
+	SpotsTotal      int            `json:"spots_total"`
+	CreditsRequired int            `json:"credits_required"`
+	Active          bool           `json:"active"`
+}
+
+// schedule is when the template's classes meet, where loc keeps time, and
+// how many each takes.
+func (t ClassTemplate) schedule(loc *time.Location) availability.Schedule {
+	return availability.Schedule{
+		Rules:    []availability.Rule{t.Recurrence.rule()},
+		Length:   time.Duration(t.Duration) * time.Minute,
+		Capacity: t.SpotsTotal,
+		Location: loc,
+	}
+}
+
+// Partner is a studio operator with API access to manage its own studios and
+// classes.
+type Partner struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Email     string   `json:"email"`
+	StudioIDs []string `json:"studio_ids"`
+}
+
+func (p Partner) OwnsStudio(studioID string) bool {
+	for _, id := range p.StudioIDs {
+		if id == studioID {
+			return true
+		}
+	}
+	return false
 }
 
 type MembershipPlan string
@@ -66,6 +147,25 @@ const (
 	PlanUnlimited MembershipPlan = "unlimited"
 )
 
+// PlanDetails describes what a membership plan costs and grants each cycle.
+type PlanDetails struct {
+	Plan           MembershipPlan `json:"plan"`
+	MonthlyPrice   money.Money    `json:"monthly_price"`
+	MonthlyCredits int            `json:"monthly_credits"`
+	RolloverCap    int            `json:"rollover_cap"`
+}
+
+var plans = map[MembershipPlan]PlanDetails{
+	PlanBasic:     {Plan: PlanBasic, MonthlyPrice: money.Cents(4900), MonthlyCredits: 25, RolloverCap: 10},
+	PlanPremium:   {Plan: PlanPremium, MonthlyPrice: money.Cents(8900), MonthlyCredits: 45, RolloverCap: 20},
+	PlanUnlimited: {Plan: PlanUnlimited, MonthlyPrice: money.Cents(15900), MonthlyCredits: 100, RolloverCap: 40},
+}
+
+// topUpCreditPrice is the per-credit price for mid-cycle purchases.
+var topUpCreditPrice = money.Cents(250)
+
+const maxTopUpCredits = 50
+
 type Membership struct {
 	UserEmail        string         `json:"user_email"`
 	Plan             MembershipPlan `json:"plan"`
@@ -79,18 +179,105 @@ type Membership struct {
 type BookingStatus string
 
 const (
-	BookingConfirmed BookingStatus = "confirmed"
-	BookingCancelled BookingStatus = "cancelled"
-	BookingCompleted BookingStatus = "completed"
+	BookingConfirmed     BookingStatus = "confirmed"
+	BookingCancelled     BookingStatus = "cancelled"
+	BookingCompleted     BookingStatus = "completed"
+	BookingCheckedIn     BookingStatus = "checked_in"
+	BookingNoShow        BookingStatus = "no_show"
+	BookingLateCancelled BookingStatus = "late_cancelled"
 )
 
+// bookingMachine is the statuses a booking moves through. Members check in
+// to or cancel a confirmed booking, the class's end settles it, and a
+// studio cancelling the class cancels it even once checked in.
+var bookingMachine = &statemachine.Machine{Name: "booking", Moves: map[string][]string{
+	string(BookingConfirmed): {string(BookingCheckedIn), string(BookingCancelled), string(BookingLateCancelled), string(BookingNoShow)},
+	string(BookingCheckedIn): {string(BookingCompleted), string(BookingCancelled)},
+}}
+
+// bookingLinks lead members from a confirmed booking to checking in and
+// cancelling, and from any to its calendar event.
+var bookingLinks = server.Links{Schema: "Booking", Links: []server.Link{
+	{Rel: "cancel", Href: "/api/v1/bookings/{{id}}/cancel", Method: fiber.MethodPost, Status: []string{string(BookingConfirmed)}},
+	{Rel: "check_in", Href: "/api/v1/bookings/{{id}}/check-in", Method: fiber.MethodPost, Status: []string{string(BookingConfirmed)}},
+	{Rel: "calendar", Href: "/api/v1/bookings/{{id}}/calendar.ics"},
+}}
+
 type Booking struct {
-	ID          string        `json:"id"`
-	UserEmail   string        `json:"user_email"`
-	Class       Class         `json:"class"`
-	Status      BookingStatus `json:"status"`
-	CreditsUsed int           `json:"credits_used"`
-	BookedAt    time.Time     `json:"booked_at"`
+	ID             string        `json:"id"`
+	UserEmail      string        `json:"user_email"`
+	Class          Class         `json:"class"`
+	Status         BookingStatus `json:"status"`
+	CreditsUsed    int           `json:"credits_used"`
+	PenaltyCredits int           `json:"penalty_credits,omitempty"`
+	BookedAt       time.Time     `json:"booked_at"`
+	CheckedInAt    *time.Time    `json:"checked_in_at,omitempty"`
+	CancelledAt    *time.Time    `json:"cancelled_at,omitempty"`
+	RemindersSent  []string      `json:"reminders_sent,omitempty"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+}
+
+// reminderOffsets are the lead times before class start at which booked
+// members receive a reminder notification, longest first.
+var reminderOffsets = []struct {
+	Key    string
+	Before time.Duration
+}{
+	{Key: "24h", Before: 24 * time.Hour},
+	{Key: "1h", Before: time.Hour},
+}
+
+func (b Booking) reminderSent(key string) bool {
+	for _, sent := range b.RemindersSent {
+		if sent == key {
+			return true
+		}
+	}
+	return false
+}
+
+// AttendancePolicy controls the check-in window and the credit penalties for
+// missing or late-cancelling a class. Booked credits are always forfeited on
+// a no-show or late cancel; penalties are deducted on top of that.
+type AttendancePolicy struct {
+	CheckInOpensBefore time.Duration
+	CheckInClosesAfter time.Duration
+	LateCancelWindow   time.Duration
+	NoShowPenalty      int
+	LateCancelPenalty  int
+}
+
+// scheduleHorizonDays is how far ahead recurring classes are materialized.
+var scheduleHorizonDays = 28
+
+var attendancePolicy = AttendancePolicy{
+	CheckInOpensBefore: 30 * time.Minute,
+	CheckInClosesAfter: 15 * time.Minute,
+	LateCancelWindow:   12 * time.Hour,
+	NoShowPenalty:      2,
+	LateCancelPenalty:  1,
+}
+
+type ChargeType string
+
+const (
+	ChargeTopUp      ChargeType = "credit_top_up"
+	ChargePlanChange ChargeType = "plan_change"
+	ChargeRenewal    ChargeType = "renewal"
+)
+
+// MembershipCharge records money moving for a membership. Negative amounts
+// are prorated credits back to the member, and a negative CreditChange is the
+// class credits a downgrade took away.
+type MembershipCharge struct {
+	ID           string      `json:"id"`
+	UserEmail    string      `json:"user_email"`
+	Type         ChargeType  `json:"type"`
+	Amount       money.Money `json:"amount"`
+	CreditChange int         `json:"credit_change"`
+	Description  string      `json:"description"`
+	CreatedAt    time.Time   `json:"created_at"`
 }
 
 type User struct {
@@ -101,16 +288,38 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users       map[string]User       `json:"users"`
-	Studios     map[string]Studio     `json:"studios"`
-	Classes     map[string]Class      `json:"classes"`
-	Bookings    map[string]Booking    `json:"bookings"`
-	Instructors map[string]Instructor `json:"instructors"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Reviews
+
+	Users          server.Repository[User]             `json:"users"`
+	Studios        server.Repository[Studio]           `json:"studios"`
+	Classes        server.Repository[Class]            `json:"classes"`
+	Bookings       server.Repository[Booking]          `json:"bookings"`
+	Instructors    server.Repository[Instructor]       `json:"instructors"`
+	Charges        server.Repository[MembershipCharge] `json:"charges"`
+	Partners       server.Repository[Partner]          `json:"partners"`
+	ClassTemplates server.Repository[ClassTemplate]    `json:"class_templates"`
+	// StudioIndex is where the studios are, for finding nearby ones. It is
+	// exported, if not saved, so that each sandbox's copy of the database
+	// has its own.
+	StudioIndex *geo.Index `json:"-"`
 	mu          sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers book ClassPass classes at partner studios. clock dates bookings
+// and runs the credit resets, settlements, class scheduling and reminders.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the studios, classes and bookings in store and indexes
+// the studios.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Error definitions
 var (
@@ -120,6 +329,18 @@ var (
 	ErrBookingNotFound     = errors.New("booking not found")
 	ErrInsufficientCredits = errors.New("insufficient credits")
 	ErrClassFull           = errors.New("class is full")
+	ErrDoubleBooked        = errors.New("you already have a class at that time")
+	ErrMembershipInactive  = errors.New("membership is not active")
+	ErrInvalidPlan         = errors.New("invalid membership plan")
+	ErrSamePlan            = errors.New("already on this plan")
+	ErrNotBookingOwner     = errors.New("booking does not belong to user")
+	ErrBookingNotActive    = errors.New("booking is not active")
+	ErrCheckInNotOpen      = errors.New("check-in is not open yet")
+	ErrCheckInClosed       = errors.New("check-in window has closed")
+	ErrClassCancelled      = errors.New("class has been cancelled")
+	ErrNotStudioPartner    = errors.New("studio is not managed by this partner")
+	ErrInstructorNotFound  = errors.New("instructor not found")
+	ErrSpotsBelowBooked    = errors.New("spots_total is below the number of booked spots")
 )
 
 // Database operations
@@ -127,7 +348,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -138,325 +359,1694 @@ func (d *Database) GetClass(id string) (Class, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	class, exists := d.Classes[id]
+	class, exists := d.Classes.Get(id)
 	if !exists {
 		return Class{}, ErrClassNotFound
 	}
 	return class, nil
 }
 
+// studioPolicy takes reviews of studios, in whole stars, from members who
+// have come to a class there.
+var studioPolicy = reviews.Policy{Kind: "studio", Scale: reviews.Stars, Verified: true}
+
+// CreateReview records a member's review of a studio, verified by a booking
+// there they checked in to.
+func (d *Database) CreateReview(review reviews.Review) (reviews.Review, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Studios.Get(review.Target.ID); !exists {
+		return reviews.Review{}, ErrStudioNotFound
+	}
+	bookingID := ""
+	for _, booking := range d.Bookings.List() {
+		attended := booking.Status == BookingCheckedIn || booking.Status == BookingCompleted
+		if attended && booking.Class.StudioID == review.Target.ID && strings.EqualFold(booking.UserEmail, review.UserEmail) {
+			bookingID = booking.ID
+			break
+		}
+	}
+	return d.AddReview(studioPolicy, review, bookingID)
+}
+
 func (d *Database) CreateBooking(booking Booking) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	// Update class spots
-	class := d.Classes[booking.Class.ID]
+	class, _ := d.Classes.Get(booking.Class.ID)
 	if class.SpotsAvailable <= 0 {
 		return ErrClassFull
 	}
 
+	// Members can't be in two classes at once
+	var theirs []availability.Reservation
+	for _, other := range d.Bookings.List() {
+		if other.UserEmail == booking.UserEmail && (other.Status == BookingConfirmed || other.Status == BookingCheckedIn) {
+			theirs = append(theirs, d.reservation(other))
+		}
+	}
+	if _, clash := availability.Conflict(d.reservation(booking), theirs, booking.BookedAt); clash {
+		return ErrDoubleBooked
+	}
+
 	class.SpotsAvailable--
-	d.Classes[class.ID] = class
+	d.Classes.Upsert(class.ID, class)
 
 	// Update user credits
-	user := d.Users[booking.UserEmail]
+	user, _ := d.Users.Get(booking.UserEmail)
 	user.Membership.CreditsRemaining -= booking.CreditsUsed
-	d.Users[booking.UserEmail] = user
+	d.Users.Upsert(booking.UserEmail, user)
 
 	// Save booking
-	d.Bookings[booking.ID] = booking
+	d.Bookings.Upsert(booking.ID, booking)
+	studio, _ := d.Studios.Get(class.StudioID)
+	message := fmt.Sprintf("You're booked for %s at %s, %s.",
+		class.Name, studio.Name, class.StartTime.Format("Mon Jan 2 3:04 PM"))
+	d.notify(booking.UserEmail, "booking_confirmed", message, booking.ID, booking.BookedAt)
+	d.SendEmail(server.Email{
+		From:    "no-reply@classpass.com",
+		To:      booking.UserEmail,
+		Subject: "You're booked: " + class.Name,
+		Body: fmt.Sprintf("%s\n\nCredits used: %d. You can cancel without a penalty up to %g hours before class.\n",
+			message, booking.CreditsUsed, attendancePolicy.LateCancelWindow.Hours()),
+		Collection: "bookings",
+		EntityID:   booking.ID,
+		SentAt:     booking.BookedAt,
+	})
 	return nil
 }
 
-// HTTP Handlers
-func getStudios(c *fiber.Ctx) error {
-	lat := c.QueryFloat("latitude", 0)
-	lon := c.QueryFloat("longitude", 0)
-	category := c.Query("category")
-
-	var studios []Studio
-	db.mu.RLock()
-	for _, studio := range db.Studios {
-		// Filter by category if specified
-		if category != "" {
-			categoryMatch := false
-			for _, cat := range studio.Categories {
-				if cat == category {
-					categoryMatch = true
-					break
-				}
-			}
-			if !categoryMatch {
-				continue
-			}
-		}
+// PurchaseCredits adds extra credits to the current cycle at the top-up rate.
+func (d *Database) PurchaseCredits(email string, credits int, now time.Time) (Membership, MembershipCharge, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-		// Filter by location if coordinates provided
-		if lat != 0 && lon != 0 {
-			distance := calculateDistance(lat, lon,
-				studio.Location.Latitude,
-				studio.Location.Longitude)
-			if distance > 10 { // 10km radius
-				continue
-			}
-		}
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return Membership{}, MembershipCharge{}, ErrUserNotFound
+	}
+	if !user.Membership.Active {
+		return Membership{}, MembershipCharge{}, ErrMembershipInactive
+	}
 
-		studios = append(studios, studio)
+	charge := MembershipCharge{
+		ID:           server.NewID("MCHG"),
+		UserEmail:    email,
+		Type:         ChargeTopUp,
+		Amount:       topUpCreditPrice.Times(credits),
+		CreditChange: credits,
+		Description:  fmt.Sprintf("%d credit top-up", credits),
+		CreatedAt:    now,
 	}
-	db.mu.RUnlock()
 
-	return c.JSON(studios)
+	user.Membership.CreditsRemaining += credits
+	d.Users.Upsert(email, user)
+	d.Charges.Upsert(charge.ID, charge)
+	return user.Membership, charge, nil
 }
 
-func getClasses(c *fiber.Ctx) error {
-	studioID := c.Query("studio_id")
-	dateStr := c.Query("date")
+// ChangePlan moves a member to a new plan immediately. The price and credit
+// difference is prorated over what is left of the current billing cycle, so
+// upgrades charge and grant the remainder while downgrades credit it back.
+func (d *Database) ChangePlan(email string, plan MembershipPlan, now time.Time) (Membership, MembershipCharge, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	var classes []Class
-	db.mu.RLock()
-	for _, class := range db.Classes {
-		// Filter by studio if specified
-		if studioID != "" && class.StudioID != studioID {
-			continue
-		}
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return Membership{}, MembershipCharge{}, ErrUserNotFound
+	}
+	if !user.Membership.Active {
+		return Membership{}, MembershipCharge{}, ErrMembershipInactive
+	}
+	next, ok := plans[plan]
+	if !ok {
+		return Membership{}, MembershipCharge{}, ErrInvalidPlan
+	}
+	if user.Membership.Plan == plan {
+		return Membership{}, MembershipCharge{}, ErrSamePlan
+	}
+	current := plans[user.Membership.Plan]
 
-		// Filter by date if specified
-		if dateStr != "" {
-			date, err := time.Parse("2006-01-02", dateStr)
-			if err != nil {
-				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-					"error": "Invalid date format",
-				})
-			}
+	fraction := cycleFractionRemaining(user.Membership.NextBillingDate, now)
+	credits := int(math.Round(float64(next.MonthlyCredits-current.MonthlyCredits) * fraction))
 
-			if !isSameDay(class.StartTime, date) {
-				continue
-			}
-		}
+	user.Membership.Plan = plan
+	user.Membership.CreditsRemaining += credits
+	if user.Membership.CreditsRemaining < 0 {
+		user.Membership.CreditsRemaining = 0
+	}
 
-		classes = append(classes, class)
+	charge := MembershipCharge{
+		ID:           server.NewID("MCHG"),
+		UserEmail:    email,
+		Type:         ChargePlanChange,
+		Amount:       money.Cents(next.MonthlyPrice.Minor - current.MonthlyPrice.Minor).Mul(fraction),
+		CreditChange: credits,
+		Description:  fmt.Sprintf("Prorated change from %s to %s", current.Plan, next.Plan),
+		CreatedAt:    now,
 	}
-	db.mu.RUnlock()
 
-	return c.JSON(classes)
+	d.Users.Upsert(email, user)
+	d.Charges.Upsert(charge.ID, charge)
+	return user.Membership, charge, nil
 }
 
-func getUserBookings(c *fiber.Ctx) error {
-	email := c.Query("email")
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
-	}
+// ResetDueCredits starts a new credit cycle for every active member whose
+// CreditsResetDate has passed: unused credits roll over up to the plan's cap,
+// the monthly allotment is granted, and the renewal is billed.
+func (d *Database) ResetDueCredits(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	var bookings []Booking
-	db.mu.RLock()
-	for _, booking := range db.Bookings {
-		if booking.UserEmail == email {
-			bookings = append(bookings, booking)
+	renewed := 0
+	for _, email := range d.Users.Keys() {
+		user, _ := d.Users.Get(email)
+		m := user.Membership
+		if !m.Active || m.CreditsResetDate.IsZero() {
+			continue
 		}
-	}
-	db.mu.RUnlock()
+		plan, ok := plans[m.Plan]
+		if !ok {
+			continue
+		}
+		for !m.CreditsResetDate.After(now) {
+			rollover := m.CreditsRemaining
+			if rollover > plan.RolloverCap {
+				rollover = plan.RolloverCap
+			}
+			m.CreditsRemaining = rollover + plan.MonthlyCredits
+
+			charge := MembershipCharge{
+				ID:           server.NewID("MCHG"),
+				UserEmail:    email,
+				Type:         ChargeRenewal,
+				Amount:       plan.MonthlyPrice,
+				CreditChange: plan.MonthlyCredits,
+				Description:  fmt.Sprintf("%s plan renewal for cycle starting %s", plan.Plan, m.CreditsResetDate.Format("2006-01-02")),
+				CreatedAt:    m.CreditsResetDate,
+			}
+			d.Charges.Upsert(charge.ID, charge)
 
-	return c.JSON(bookings)
+			m.CreditsResetDate = m.CreditsResetDate.AddDate(0, 1, 0)
+			m.NextBillingDate = m.CreditsResetDate
+			renewed++
+		}
+		user.Membership = m
+		d.Users.Upsert(email, user)
+	}
+	return renewed
 }
 
-type BookingRequest struct {
-	ClassID   string `json:"class_id"`
-	UserEmail string `json:"user_email"`
+func (d *Database) GetUserCharges(email string) []MembershipCharge {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	charges := d.Charges.By("user_email", email)
+	sort.Slice(charges, func(i, j int) bool {
+		return charges[i].CreatedAt.After(charges[j].CreatedAt)
+	})
+	return charges
 }
 
-func createBooking(c *fiber.Ctx) error {
-	var req BookingRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+// classWindow returns when the booked class starts and ends, preferring the
+// live class record over the snapshot stored on the booking. Callers must
+// hold d.mu.
+func (d *Database) classWindow(booking Booking) (time.Time, time.Time) {
+	class, exists := d.Classes.Get(booking.Class.ID)
+	if !exists {
+		class = booking.Class
 	}
+	return class.StartTime, class.StartTime.Add(time.Duration(class.Duration) * time.Minute)
+}
 
-	// Validate user and membership
-	user, err := db.GetUser(req.UserEmail)
-	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+// reservation is the time booking takes of its class, and of its member.
+// Callers must hold d.mu.
+func (d *Database) reservation(booking Booking) availability.Reservation {
+	start, end := d.classWindow(booking)
+	return availability.Reservation{
+		ID:       booking.ID,
+		Resource: booking.Class.ID,
+		Party:    booking.UserEmail,
+		Start:    start,
+		End:      end,
 	}
+}
 
-	if !user.Membership.Active {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Membership is not active",
-		})
+// deductPenalty removes penalty credits from a member, never going below
+// zero, and returns how many were actually taken. Callers must hold d.mu.
+func (d *Database) deductPenalty(email string, penalty int) int {
+	user, exists := d.Users.Get(email)
+	if !exists || penalty <= 0 {
+		return 0
 	}
-
-	// Get class details
-	class, err := db.GetClass(req.ClassID)
-	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	if penalty > user.Membership.CreditsRemaining {
+		penalty = user.Membership.CreditsRemaining
 	}
+	user.Membership.CreditsRemaining -= penalty
+	d.Users.Upsert(email, user)
+	return penalty
+}
 
-	// Validate credits
-	if user.Membership.CreditsRemaining < class.CreditsRequired {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Insufficient credits",
-		})
-	}
+// CheckIn marks the member as present if they arrive within the check-in
+// window around the class start.
+func (d *Database) CheckIn(bookingID, email string, now time.Time) (Booking, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	// Create booking
-	booking := Booking{
-		ID:          uuid.New().String(),
-		UserEmail:   req.UserEmail,
-		Class:       class,
-		Status:      BookingConfirmed,
-		CreditsUsed: class.CreditsRequired,
-		BookedAt:    time.Now(),
+	booking, exists := d.Bookings.Get(bookingID)
+	if !exists {
+		return Booking{}, ErrBookingNotFound
+	}
+	if booking.UserEmail != email {
+		return Booking{}, ErrNotBookingOwner
+	}
+	if err := statemachine.Move(bookingMachine, &booking, &booking.Status, &booking.StatusHistory, BookingCheckedIn, now); err != nil {
+		return Booking{}, ErrBookingNotActive
 	}
 
-	// Save booking
-	if err := db.CreateBooking(booking); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	start, _ := d.classWindow(booking)
+	if now.Before(start.Add(-attendancePolicy.CheckInOpensBefore)) {
+		return Booking{}, ErrCheckInNotOpen
+	}
+	if now.After(start.Add(attendancePolicy.CheckInClosesAfter)) {
+		return Booking{}, ErrCheckInClosed
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(booking)
+	booking.CheckedInAt = &now
+	d.Bookings.Upsert(booking.ID, booking)
+	return booking, nil
 }
 
-func cancelBooking(c *fiber.Ctx) error {
-	bookingID := c.Params("bookingId")
-	if bookingID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Booking ID is required",
-		})
+// SettleFinishedClasses closes out bookings for classes that have ended:
+// checked-in bookings complete, and confirmed bookings become no-shows and
+// incur the no-show penalty.
+func (d *Database) SettleFinishedClasses(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	settled := 0
+	for _, id := range d.Bookings.Keys() {
+		booking, _ := d.Bookings.Get(id)
+		if booking.Status != BookingConfirmed && booking.Status != BookingCheckedIn {
+			continue
+		}
+		if _, end := d.classWindow(booking); now.Before(end) {
+			continue
+		}
+		to := BookingNoShow
+		if booking.Status == BookingCheckedIn {
+			to = BookingCompleted
+		}
+		if err := statemachine.Move(bookingMachine, &booking, &booking.Status, &booking.StatusHistory, to, now); err != nil {
+			continue
+		}
+		if to == BookingNoShow {
+			booking.PenaltyCredits = d.deductPenalty(booking.UserEmail, attendancePolicy.NoShowPenalty)
+		}
+		d.Bookings.Upsert(id, booking)
+		settled++
 	}
+	return settled
+}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
+// CancelBooking cancels a confirmed booking. Outside the late-cancel window
+// the credits are refunded; inside it they are forfeited and the late-cancel
+// penalty applies. The spot is released either way.
+func (d *Database) CancelBooking(bookingID string, now time.Time) (Booking, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	booking, exists := db.Bookings[bookingID]
+	booking, exists := d.Bookings.Get(bookingID)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Booking not found",
-		})
+		return Booking{}, ErrBookingNotFound
 	}
-
-	// Validate cancellation time (e.g., must be at least 12 hours before class)
-	if time.Until(booking.Class.StartTime) < 12*time.Hour {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Cannot cancel class less than 12 hours before start time",
-		})
+	if booking.Status != BookingConfirmed {
+		return Booking{}, ErrBookingNotActive
 	}
 
-	// Refund credits
-	user := db.Users[booking.UserEmail]
-	user.Membership.CreditsRemaining += booking.CreditsUsed
-	db.Users[booking.UserEmail] = user
+	start, _ := d.classWindow(booking)
+	to := BookingCancelled
+	if start.Sub(now) < attendancePolicy.LateCancelWindow {
+		to = BookingLateCancelled
+	}
+	if err := statemachine.Move(bookingMachine, &booking, &booking.Status, &booking.StatusHistory, to, now); err != nil {
+		return Booking{}, err
+	}
+	if to == BookingLateCancelled {
+		booking.PenaltyCredits = d.deductPenalty(booking.UserEmail, attendancePolicy.LateCancelPenalty)
+	} else {
+		user, _ := d.Users.Get(booking.UserEmail)
+		user.Membership.CreditsRemaining += booking.CreditsUsed
+		d.Users.Upsert(booking.UserEmail, user)
+	}
 
-	// Update class spots
-	class := db.Classes[booking.Class.ID]
-	class.SpotsAvailable++
-	db.Classes[class.ID] = class
+	if class, exists := d.Classes.Get(booking.Class.ID); exists {
+		class.SpotsAvailable++
+		d.Classes.Upsert(class.ID, class)
+	}
 
-	// Update booking status
-	booking.Status = BookingCancelled
-	db.Bookings[bookingID] = booking
+	booking.CancelledAt = &now
+	d.Bookings.Upsert(booking.ID, booking)
+	return booking, nil
+}
 
-	return c.JSON(booking)
+type AttendanceSummary struct {
+	Attended       int       `json:"attended"`
+	NoShows        int       `json:"no_shows"`
+	LateCancels    int       `json:"late_cancels"`
+	Cancelled      int       `json:"cancelled"`
+	Upcoming       int       `json:"upcoming"`
+	PenaltyCredits int       `json:"penalty_credits"`
+	History        []Booking `json:"history"`
 }
 
-func getMembership(c *fiber.Ctx) error {
-	email := c.Query("email")
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
-	}
+func (d *Database) GetAttendance(email string) AttendanceSummary {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	user, err := db.GetUser(email)
-	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	summary := AttendanceSummary{History: []Booking{}}
+	for _, booking := range d.Bookings.List() {
+		if booking.UserEmail != email {
+			continue
+		}
+		switch booking.Status {
+		case BookingCompleted, BookingCheckedIn:
+			summary.Attended++
+		case BookingNoShow:
+			summary.NoShows++
+		case BookingLateCancelled:
+			summary.LateCancels++
+		case BookingCancelled:
+			summary.Cancelled++
+		case BookingConfirmed:
+			summary.Upcoming++
+		}
+		summary.PenaltyCredits += booking.PenaltyCredits
+		summary.History = append(summary.History, booking)
 	}
+	sort.Slice(summary.History, func(i, j int) bool {
+		return summary.History[i].Class.StartTime.After(summary.History[j].Class.StartTime)
+	})
+	return summary
+}
 
-	return c.JSON(user.Membership)
+// runMaintenance applies the time-driven membership and attendance rules on
+// a fixed interval, and whenever the clock is moved, for the lifetime of the
+// process.
+func (h *handlers) runMaintenance(interval time.Duration) {
+	h.clock.Every(interval, func(now time.Time) {
+		db := h.db.Get()
+		if n := db.ResetDueCredits(now); n > 0 {
+			log.Printf("Reset credits for %d membership cycle(s)", n)
+		}
+		if n := db.SettleFinishedClasses(now); n > 0 {
+			log.Printf("Settled %d booking(s) for finished classes", n)
+		}
+		if n := db.MaterializeClasses(now, scheduleHorizonDays); n > 0 {
+			log.Printf("Generated %d recurring class(es)", n)
+		}
+		if n := db.SendDueReminders(now); n > 0 {
+			log.Printf("Sent %d class reminder(s)", n)
+		}
+	})
 }
 
-// Helper functions
-func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+// GetPartnerByEmail returns the partner a studio operator signs in as.
+func (d *Database) GetPartnerByEmail(email string) (Partner, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	partners := d.Partners.By("email", email)
+	if len(partners) == 0 {
+		return Partner{}, false
+	}
+	return partners[0], true
 }
 
-func isSameDay(t1, t2 time.Time) bool {
-	y1, m1, d1 := t1.Date()
-	y2, m2, d2 := t2.Date()
-	return y1 == y2 && m1 == m2 && d1 == d2
+// CreateStudio adds a studio and grants the creating partner ownership of it.
+func (d *Database) CreateStudio(partnerID string, studio Studio) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	partner, _ := d.Partners.Get(partnerID)
+	partner.StudioIDs = append(partner.StudioIDs, studio.ID)
+	d.Partners.Upsert(partnerID, partner)
+	d.Studios.Upsert(studio.ID, studio)
+	d.locate(studio)
+	return nil
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+// localize gives studios without a time zone that of where they are, and
+// puts classes, and bookings' copies of them, in their studio's.
+func (d *Database) localize() {
+	for _, id := range d.Studios.Keys() {
+		studio, _ := d.Studios.Get(id)
+		d.Studios.Upsert(id, zoned(studio))
+	}
+	for _, id := range d.Classes.Keys() {
+		class, _ := d.Classes.Get(id)
+		d.Classes.Upsert(id, d.localClass(class))
 	}
+	for _, id := range d.Bookings.Keys() {
+		booking, _ := d.Bookings.Get(id)
+		booking.Class = d.localClass(booking.Class)
+		d.Bookings.Upsert(id, booking)
+	}
+}
 
-	db = &Database{
-		Users:       make(map[string]User),
-		Studios:     make(map[string]Studio),
-		Classes:     make(map[string]Class),
-		Bookings:    make(map[string]Booking),
-		Instructors: make(map[string]Instructor),
+// zoned returns studio with the time zone of where it is if it doesn't
+// name one.
+func zoned(studio Studio) Studio {
+	if studio.Timezone == "" && (studio.Location.Latitude != 0 || studio.Location.Longitude != 0) {
+		studio.Timezone = geo.ZoneAt(studioPoint(studio))
 	}
+	return studio
+}
 
-	return json.Unmarshal(data, db)
+// localClass returns class with its start time in its studio's zone.
+// Callers must hold d.mu.
+func (d *Database) localClass(class Class) Class {
+	studio, _ := d.Studios.Get(class.StudioID)
+	class.StartTime = class.StartTime.In(studio.location())
+	return class
 }
 
-func setupRoutes(app *fiber.App) {
-	api := app.Group("/api/v1")
+func (d *Database) UpdateStudio(partner Partner, studioID string, update func(*Studio)) (Studio, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	// Studio routes
-	api.Get("/studios", getStudios)
+	studio, exists := d.Studios.Get(studioID)
+	if !exists {
+		return Studio{}, ErrStudioNotFound
+	}
+	if !partner.OwnsStudio(studioID) {
+		return Studio{}, ErrNotStudioPartner
+	}
+	update(&studio)
+	d.Studios.Upsert(studio.ID, studio)
+	d.locate(studio)
+	for _, id := range d.Classes.Keys() {
+		class, _ := d.Classes.Get(id)
+		if class.StudioID == studio.ID {
+			d.Classes.Upsert(id, d.localClass(class))
+		}
+	}
+	return studio, nil
+}
 
-	// Class routes
-	api.Get("/classes", getClasses)
+// locate puts a new or moved studio in the index of studios' locations,
+// if the database has it made yet. Callers must hold d.mu.
+func (d *Database) locate(studio Studio) {
+	if d.StudioIndex != nil {
+		d.StudioIndex.Add(studio.ID, studioPoint(studio))
+	}
+}
 
-	// Booking routes
-	api.Get("/bookings", getUserBookings)
-	api.Post("/bookings", createBooking)
-	api.Post("/bookings/:bookingId/cancel", cancelBooking)
+// studioIndex returns the index of studios' locations, making it for a
+// database that hasn't one, such as a new sandbox's copy.
+func (d *Database) studioIndex() *geo.Index {
+	d.mu.RLock()
+	index := d.StudioIndex
+	d.mu.RUnlock()
+	if index != nil {
+		return index
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.StudioIndex == nil {
+		d.StudioIndex = indexStudios(&d.Studios)
+	}
+	return d.StudioIndex
+}
 
-	// Membership routes
-	api.Get("/membership", getMembership)
+func indexStudios(studios *server.Repository[Studio]) *geo.Index {
+	index := geo.NewIndex()
+	for _, id := range studios.Keys() {
+		studio, _ := studios.Get(id)
+		index.Add(id, studioPoint(studio))
+	}
+	return index
 }
 
-func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+func studioPoint(studio Studio) geo.Point {
+	return geo.Point{Lat: studio.Location.Latitude, Lon: studio.Location.Longitude}
+}
 
-	if err := loadDatabase(); err != nil {
-		log.Fatal(err)
+func (d *Database) PublishClass(partner Partner, class Class, instructorID string) (Class, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Studios.Get(class.StudioID); !exists {
+		return Class{}, ErrStudioNotFound
+	}
+	if !partner.OwnsStudio(class.StudioID) {
+		return Class{}, ErrNotStudioPartner
+	}
+	instructor, exists := d.Instructors.Get(instructorID)
+	if !exists {
+		return Class{}, ErrInstructorNotFound
+	}
+
+	class.Instructor = instructor
+	class.SpotsAvailable = class.SpotsTotal
+	class = d.localClass(class)
+	d.Classes.Upsert(class.ID, class)
+	return class, nil
+}
+
+// ClassUpdate carries the partner-editable fields of a class; nil fields are
+// left unchanged.
+type ClassUpdate struct {
+	Name            *string    `json:"name"`
+	Description     *string    `json:"description"`
+	InstructorID    *string    `json:"instructor_id"`
+	StartTime       *time.Time `json:"start_time"`
+	Duration        *int       `json:"duration"`
+	SpotsTotal      *int       `json:"spots_total"`
+	CreditsRequired *int       `json:"credits_required"`
+}
+
+func (d *Database) UpdateClass(partner Partner, classID string, update ClassUpdate) (Class, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	class, exists := d.Classes.Get(classID)
+	if !exists {
+		return Class{}, ErrClassNotFound
+	}
+	if !partner.OwnsStudio(class.StudioID) {
+		return Class{}, ErrNotStudioPartner
+	}
+	if class.Cancelled {
+		return Class{}, ErrClassCancelled
+	}
+
+	if update.InstructorID != nil {
+		instructor, exists := d.Instructors.Get(*update.InstructorID)
+		if !exists {
+			return Class{}, ErrInstructorNotFound
+		}
+		class.Instructor = instructor
+	}
+	if update.SpotsTotal != nil {
+		booked := class.SpotsTotal - class.SpotsAvailable
+		if *update.SpotsTotal < booked {
+			return Class{}, ErrSpotsBelowBooked
+		}
+		class.SpotsAvailable = *update.SpotsTotal - booked
+		class.SpotsTotal = *update.SpotsTotal
+	}
+	if update.Name != nil {
+		class.Name = *update.Name
+	}
+	if update.Description != nil {
+		class.Description = *update.Description
+	}
+	if update.StartTime != nil {
+		studio, _ := d.Studios.Get(class.StudioID)
+		class.StartTime = update.StartTime.In(studio.location())
+	}
+	if update.Duration != nil {
+		class.Duration = *update.Duration
+	}
+	if update.CreditsRequired != nil {
+		class.CreditsRequired = *update.CreditsRequired
+	}
+
+	d.Classes.Upsert(class.ID, class)
+	return class, nil
+}
+
+// CancelClass cancels a class on the studio's side. Every active booking is
+// cancelled with a full credit refund and the member is notified.
+func (d *Database) CancelClass(partner Partner, classID string, reason string, now time.Time) (Class, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	class, exists := d.Classes.Get(classID)
+	if !exists {
+		return Class{}, 0, ErrClassNotFound
+	}
+	if !partner.OwnsStudio(class.StudioID) {
+		return Class{}, 0, ErrNotStudioPartner
+	}
+	if class.Cancelled {
+		return Class{}, 0, ErrClassCancelled
+	}
+
+	message := fmt.Sprintf("%s on %s was cancelled by the studio. %d credits have been returned to your account.",
+		class.Name, class.StartTime.Format("Mon Jan 2 3:04 PM"), class.CreditsRequired)
+	if reason != "" {
+		message += " Reason: " + reason
+	}
+
+	refunded := 0
+	for _, id := range d.Bookings.Keys() {
+		booking, _ := d.Bookings.Get(id)
+		if booking.Class.ID != classID || (booking.Status != BookingConfirmed && booking.Status != BookingCheckedIn) {
+			continue
+		}
+		if err := statemachine.Move(bookingMachine, &booking, &booking.Status, &booking.StatusHistory, BookingCancelled, now); err != nil {
+			continue
+		}
+		user, _ := d.Users.Get(booking.UserEmail)
+		user.Membership.CreditsRemaining += booking.CreditsUsed
+		d.Users.Upsert(booking.UserEmail, user)
+
+		booking.CancelledAt = &now
+		d.Bookings.Upsert(id, booking)
+
+		d.notify(booking.UserEmail, "class_cancelled", message, id, now)
+		refunded++
+	}
+
+	class.Cancelled = true
+	class.SpotsAvailable = class.SpotsTotal
+	d.Classes.Upsert(class.ID, class)
+	return class, refunded, nil
+}
+
+func (d *Database) CreateClassTemplate(partner Partner, tmpl ClassTemplate) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Studios.Get(tmpl.StudioID); !exists {
+		return ErrStudioNotFound
+	}
+	if !partner.OwnsStudio(tmpl.StudioID) {
+		return ErrNotStudioPartner
+	}
+	if _, exists := d.Instructors.Get(tmpl.InstructorID); !exists {
+		return ErrInstructorNotFound
+	}
+
+	d.ClassTemplates.Upsert(tmpl.ID, tmpl)
+	return nil
+}
+
+func (d *Database) GetPartnerClassTemplates(partner Partner) []ClassTemplate {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	templates := d.ClassTemplates.Query(func(tmpl ClassTemplate) bool {
+		return partner.OwnsStudio(tmpl.StudioID)
+	})
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].ID < templates[j].ID
+	})
+	return templates
+}
+
+// MaterializeClasses creates concrete classes from every active template for
+// each day in [from, from+days). Occurrences are keyed by template and date,
+// so running the generator repeatedly never duplicates a class.
+func (d *Database) MaterializeClasses(from time.Time, days int) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	created := 0
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	for i := 0; i < days; i++ {
+		date := start.AddDate(0, 0, i)
+		for _, tmpl := range d.ClassTemplates.List() {
+			if !tmpl.Active {
+				continue
+			}
+			studio, _ := d.Studios.Get(tmpl.StudioID)
+			for _, slot := range tmpl.schedule(studio.location()).On(date) {
+				id := tmpl.ID + "-" + date.Format("20060102")
+				if _, exists := d.Classes.Get(id); exists {
+					continue
+				}
+				instructor, _ := d.Instructors.Get(tmpl.InstructorID)
+				d.Classes.Upsert(id, Class{
+					ID:              id,
+					StudioID:        tmpl.StudioID,
+					Name:            tmpl.Name,
+					Description:     tmpl.Description,
+					Instructor:      instructor,
+					Category:        tmpl.Category,
+					StartTime:       slot.Start,
+					Duration:        tmpl.Duration,
+					SpotsTotal:      tmpl.SpotsTotal,
+					SpotsAvailable:  tmpl.SpotsTotal,
+					CreditsRequired: tmpl.CreditsRequired,
+					TemplateID:      tmpl.ID,
+				})
+				created++
+			}
+		}
+	}
+	return created
+}
+
+// notify sends an in-app notification about a booking. Callers must hold
+// d.mu.
+func (d *Database) notify(email, kind, message, bookingID string, at time.Time) {
+	d.Notify(server.Notification{
+		UserEmail:  email,
+		Type:       kind,
+		Message:    message,
+		Collection: "bookings",
+		EntityID:   bookingID,
+		CreatedAt:  at,
+	})
+}
+
+// SendDueReminders creates reminder notifications for upcoming booked
+// classes. Each reminder fires once, and only while it is the most specific
+// one due, so a class booked 30 minutes out gets the 1h reminder only.
+func (d *Database) SendDueReminders(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sent := 0
+	for _, booking := range d.Bookings.List() {
+		if booking.Status != BookingConfirmed {
+			continue
+		}
+		start, _ := d.classWindow(booking)
+		if !now.Before(start) {
+			continue
+		}
+		for i, offset := range reminderOffsets {
+			if now.Before(start.Add(-offset.Before)) {
+				continue
+			}
+			if i+1 < len(reminderOffsets) && !now.Before(start.Add(-reminderOffsets[i+1].Before)) {
+				continue
+			}
+			if booking.reminderSent(offset.Key) {
+				continue
+			}
+			class, _ := d.Classes.Get(booking.Class.ID)
+			studio, _ := d.Studios.Get(class.StudioID)
+			message := fmt.Sprintf("Reminder: %s at %s starts %s (in %s).",
+				class.Name, studio.Name, start.Format("Mon Jan 2 3:04 PM"), offset.Key)
+			d.notify(booking.UserEmail, "reminder_"+offset.Key, message, booking.ID, now)
+			booking.RemindersSent = append(booking.RemindersSent, offset.Key)
+			d.Bookings.Upsert(booking.ID, booking)
+			sent++
+		}
+	}
+	return sent
+}
+
+// HTTP Handlers
+func (h *handlers) getStudios(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	lat := c.QueryFloat("latitude", 0)
+	lon := c.QueryFloat("longitude", 0)
+	category := c.Query("category")
+
+	// Near the coordinates, if given, nearest first
+	var ids []string
+	located := lat != 0 && lon != 0
+	if located {
+		for _, near := range db.studioIndex().Within(geo.Point{Lat: lat, Lon: lon}, c.QueryFloat("radius_km", 10)) {
+			ids = append(ids, near.ID)
+		}
+	}
+	var studios []Studio
+	db.mu.RLock()
+	if !located {
+		for _, id := range db.Studios.Keys() {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		studio, ok := db.Studios.Get(id)
+		if !ok {
+			continue
+		}
+		// Filter by category if specified
+		if category != "" {
+			categoryMatch := false
+			for _, cat := range studio.Categories {
+				if cat == category {
+					categoryMatch = true
+					break
+				}
+			}
+			if !categoryMatch {
+				continue
+			}
+		}
+
+		studios = append(studios, studio)
+	}
+	db.mu.RUnlock()
+
+	return server.List(c, studios)
+}
+
+func (h *handlers) getStudioReviews(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	studioID := c.Params("id")
+	target := reviews.Target{Kind: studioPolicy.Kind, ID: studioID}
+
+	db.mu.RLock()
+	_, exists := db.Studios.Get(studioID)
+	found := db.ReviewsOf(target, reviews.SortNewest)
+	db.mu.RUnlock()
+	if !exists {
+		return server.FailWith(c, fiber.StatusNotFound, ErrStudioNotFound)
+	}
+	return server.List(c, found)
+}
+
+// getStudioRating sums up a studio's reviews: how many there are, their
+// average and how many gave each number of stars.
+func (h *handlers) getStudioRating(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	studioID := c.Params("id")
+	target := reviews.Target{Kind: studioPolicy.Kind, ID: studioID}
+
+	db.mu.RLock()
+	_, exists := db.Studios.Get(studioID)
+	summary := db.ReviewSummary(target)
+	db.mu.RUnlock()
+	if !exists {
+		return server.FailWith(c, fiber.StatusNotFound, ErrStudioNotFound)
+	}
+	return c.JSON(summary)
+}
+
+type ReviewRequest struct {
+	UserEmail string `json:"user_email" validate:"email"`
+	Rating    int    `json:"rating" validate:"gte=1,max=5"`
+	Title     string `json:"title" validate:"max=120"`
+	Body      string `json:"body"`
+}
+
+func (h *handlers) createStudioReview(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ReviewRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	review, err := db.CreateReview(reviews.Review{
+		Target:    reviews.Target{ID: strings.Clone(c.Params("id"))},
+		UserEmail: req.UserEmail,
+		Rating:    float64(req.Rating),
+		Title:     strings.TrimSpace(req.Title),
+		Body:      strings.TrimSpace(req.Body),
+	})
+	if err != nil {
+		switch err {
+		case ErrStudioNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case reviews.ErrNotVerified:
+			return server.Fail(c, fiber.StatusForbidden, server.CodeForbidden, "only members who have checked in to a class at this studio may review it")
+		case reviews.ErrAlreadyReviewed:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to save review")
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(review)
+}
+
+func (h *handlers) getClasses(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	studioID := c.Query("studio_id")
+	dateStr := c.Query("date")
+
+	var date time.Time
+	if dateStr != "" {
+		var err error
+		date, err = time.Parse("2006-01-02", dateStr)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid date format")
+		}
+		// Make sure recurring classes exist for dates beyond the
+		// pre-generated horizon.
+		db.MaterializeClasses(date, 1)
+	}
+
+	var classes []Class
+	db.mu.RLock()
+	for _, class := range db.Classes.List() {
+		// Filter by studio if specified
+		if studioID != "" && class.StudioID != studioID {
+			continue
+		}
+
+		// Filter by date if specified, the studio's: a 9pm class in San
+		// Francisco is that day's, though it starts the next in UTC
+		studio, _ := db.Studios.Get(class.StudioID)
+		if dateStr != "" && !isSameDay(class.StartTime.In(studio.location()), date) {
+			continue
+		}
+
+		classes = append(classes, class)
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(classes, func(i, j int) bool {
+		return classes[i].StartTime.Before(classes[j].StartTime)
+	})
+
+	return server.List(c, classes, "studio_id")
+}
+
+func (h *handlers) getUserBookings(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	var bookings []Booking
+	db.mu.RLock()
+	for _, booking := range db.Bookings.List() {
+		if booking.UserEmail == email {
+			bookings = append(bookings, booking)
+		}
+	}
+	db.mu.RUnlock()
+
+	return server.List(c, bookings)
+}
+
+type BookingRequest struct {
+	ClassID   string `json:"class_id"`
+	UserEmail string `json:"user_email" validate:"email"`
+}
+
+func (h *handlers) createBooking(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req BookingRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	// Validate user and membership
+	user, err := db.GetUser(req.UserEmail)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	if !user.Membership.Active {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Membership is not active")
+	}
+
+	// Get class details
+	class, err := db.GetClass(req.ClassID)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	if class.Cancelled {
+		return server.FailWith(c, fiber.StatusBadRequest, ErrClassCancelled)
+	}
+
+	// Validate credits
+	if user.Membership.CreditsRemaining < class.CreditsRequired {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Insufficient credits")
+	}
+
+	// Create booking
+	booking := Booking{
+		ID:          server.NewID("BKG"),
+		UserEmail:   req.UserEmail,
+		Class:       class,
+		Status:      BookingConfirmed,
+		CreditsUsed: class.CreditsRequired,
+		BookedAt:    h.clock.Now(),
+	}
+
+	// Save booking
+	switch err := db.CreateBooking(booking); err {
+	case nil:
+	case ErrClassFull, ErrDoubleBooked:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(booking)
+}
+
+func (h *handlers) cancelBooking(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	bookingID := c.Params("bookingId")
+	if bookingID == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Booking ID is required")
+	}
+
+	booking, err := db.CancelBooking(bookingID, h.clock.Now())
+	if err != nil {
+		switch err {
+		case ErrBookingNotFound:
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Booking not found")
+		case ErrBookingNotActive:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to cancel booking")
+		}
+	}
+
+	return c.JSON(booking)
+}
+
+type CheckInRequest struct {
+	UserEmail string `json:"user_email" validate:"email"`
+}
+
+func (h *handlers) checkInBooking(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req CheckInRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	booking, err := db.CheckIn(c.Params("bookingId"), req.UserEmail, h.clock.Now())
+	if err != nil {
+		switch err {
+		case ErrBookingNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNotBookingOwner:
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		case ErrBookingNotActive, ErrCheckInNotOpen, ErrCheckInClosed:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to check in")
+		}
+	}
+
+	return c.JSON(booking)
+}
+
+// getBookingCalendar exports a booking as an iCalendar (RFC 5545) event.
+func (h *handlers) getBookingCalendar(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	db.mu.RLock()
+	booking, exists := db.Bookings.Get(c.Params("bookingId"))
+	if !exists {
+		db.mu.RUnlock()
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Booking not found")
+	}
+	class, exists := db.Classes.Get(booking.Class.ID)
+	if !exists {
+		class = booking.Class
+	}
+	studio, _ := db.Studios.Get(class.StudioID)
+	db.mu.RUnlock()
+
+	const stamp = "20060102T150405Z"
+	start := class.StartTime.UTC()
+	end := start.Add(time.Duration(class.Duration) * time.Minute)
+
+	status := "CONFIRMED"
+	switch booking.Status {
+	case BookingCancelled, BookingLateCancelled:
+		status = "CANCELLED"
+	}
+
+	location := studio.Name
+	if studio.Location.Address != "" {
+		location = fmt.Sprintf("%s, %s, %s, %s %s", studio.Name, studio.Location.Address,
+			studio.Location.City, studio.Location.State, studio.Location.ZipCode)
+	}
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//ClassPass//Bookings//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"BEGIN:VEVENT",
+		"UID:" + booking.ID + "@classpass",
+		"DTSTAMP:" + h.clock.Now().UTC().Format(stamp),
+		"DTSTART:" + start.Format(stamp),
+		"DTEND:" + end.Format(stamp),
+		"SUMMARY:" + icsEscape(class.Name),
+		"DESCRIPTION:" + icsEscape(fmt.Sprintf("%s with %s. %d credits.", class.Description, class.Instructor.Name, booking.CreditsUsed)),
+		"LOCATION:" + icsEscape(location),
+		"STATUS:" + status,
+	}
+	if studio.Location.Latitude != 0 || studio.Location.Longitude != 0 {
+		lines = append(lines, fmt.Sprintf("GEO:%.6f;%.6f", studio.Location.Latitude, studio.Location.Longitude))
+	}
+	lines = append(lines,
+		"BEGIN:VALARM",
+		"ACTION:DISPLAY",
+		"DESCRIPTION:"+icsEscape(class.Name+" starts in 1 hour"),
+		"TRIGGER:-PT1H",
+		"END:VALARM",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	)
+
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString(icsFold(line))
+		sb.WriteString("\r\n")
+	}
+
+	c.Set(fiber.HeaderContentType, "text/calendar; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="classpass-%s.ics"`, booking.ID))
+	return c.SendString(sb.String())
+}
+
+func (h *handlers) getAttendance(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	return c.JSON(db.GetAttendance(email))
+}
+
+func (h *handlers) getMembership(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	user, err := db.GetUser(email)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
+	return c.JSON(user.Membership)
+}
+
+func (h *handlers) getPlans(c *fiber.Ctx) error {
+	details := make([]PlanDetails, 0, len(plans))
+	for _, plan := range []MembershipPlan{PlanBasic, PlanPremium, PlanUnlimited} {
+		details = append(details, plans[plan])
+	}
+	return server.List(c, details)
+}
+
+type PurchaseCreditsRequest struct {
+	UserEmail string `json:"user_email" validate:"email"`
+	Credits   int    `json:"credits"`
+}
+
+func (h *handlers) purchaseCredits(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req PurchaseCreditsRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	if req.Credits <= 0 || req.Credits > maxTopUpCredits {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, fmt.Sprintf("credits must be between 1 and %d", maxTopUpCredits))
+	}
+
+	membership, charge, err := db.PurchaseCredits(req.UserEmail, req.Credits, h.clock.Now())
+	if err != nil {
+		switch err {
+		case ErrUserNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrMembershipInactive:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to purchase credits")
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"membership": membership,
+		"charge":     charge,
+	})
+}
+
+type ChangePlanRequest struct {
+	UserEmail string         `json:"user_email" validate:"email"`
+	Plan      MembershipPlan `json:"plan"`
+}
+
+func (h *handlers) changePlan(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ChangePlanRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	membership, charge, err := db.ChangePlan(req.UserEmail, req.Plan, h.clock.Now())
+	if err != nil {
+		switch err {
+		case ErrUserNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrMembershipInactive, ErrInvalidPlan, ErrSamePlan:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to change plan")
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"membership": membership,
+		"charge":     charge,
+	})
+}
+
+func (h *handlers) getMembershipCharges(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	return server.List(c, db.GetUserCharges(email))
+}
+
+// Partner handlers
+
+// requirePartner finds the partner the caller, who holds the partner role,
+// signs in as, and stores it in the request locals.
+func (h *handlers) requirePartner(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "authorization required")
+	}
+	partner, ok := db.GetPartnerByEmail(email)
+	if !ok {
+		return server.Fail(c, fiber.StatusForbidden, server.CodeForbidden, "not a studio partner")
+	}
+	c.Locals("partner", partner)
+	return c.Next()
+}
+
+func currentPartner(c *fiber.Ctx) Partner {
+	return c.Locals("partner").(Partner)
+}
+
+func partnerError(c *fiber.Ctx, err error, fallback string) error {
+	switch err {
+	case ErrStudioNotFound, ErrClassNotFound, ErrInstructorNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNotStudioPartner:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrClassCancelled, ErrSpotsBelowBooked:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, fallback)
+	}
+}
+
+func (h *handlers) getPartnerStudios(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	partner := currentPartner(c)
+
+	studios := []Studio{}
+	db.mu.RLock()
+	for _, id := range partner.StudioIDs {
+		if studio, exists := db.Studios.Get(id); exists {
+			studios = append(studios, studio)
+		}
+	}
+	db.mu.RUnlock()
+
+	return server.List(c, studios)
+}
+
+type StudioRequest struct {
+	Name        string   `json:"name"`
+	Categories  []string `json:"categories"`
+	Location    Location `json:"location"`
+	Timezone    string   `json:"timezone" validate:"timezone"` // IANA; that of the location if not given
+	Description string   `json:"description"`
+	Amenities   []string `json:"amenities"`
+}
+
+func (h *handlers) createPartnerStudio(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req StudioRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	if req.Name == "" || len(req.Categories) == 0 {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "name and categories are required")
+	}
+
+	studio := Studio{
+		ID:          server.NewID("STU"),
+		Name:        req.Name,
+		Categories:  req.Categories,
+		Location:    req.Location,
+		Timezone:    req.Timezone,
+		Description: req.Description,
+		Amenities:   req.Amenities,
+		CreatedAt:   h.clock.Now(),
+	}
+	studio = zoned(studio)
+
+	if err := db.CreateStudio(currentPartner(c).ID, studio); err != nil {
+		return partnerError(c, err, "Failed to create studio")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(studio)
+}
+
+func (h *handlers) updatePartnerStudio(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req StudioRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	studio, err := db.UpdateStudio(currentPartner(c), c.Params("id"), func(s *Studio) {
+		if req.Name != "" {
+			s.Name = req.Name
+		}
+		if len(req.Categories) > 0 {
+			s.Categories = req.Categories
+		}
+		if req.Location.Address != "" {
+			s.Location = req.Location
+			if req.Timezone == "" {
+				s.Timezone = ""
 			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
+		}
+		if req.Timezone != "" {
+			s.Timezone = req.Timezone
+		}
+		*s = zoned(*s)
+		if req.Description != "" {
+			s.Description = req.Description
+		}
+		if req.Amenities != nil {
+			s.Amenities = req.Amenities
+		}
+	})
+	if err != nil {
+		return partnerError(c, err, "Failed to update studio")
+	}
+
+	return c.JSON(studio)
+}
+
+type PublishClassRequest struct {
+	StudioID        string    `json:"studio_id"`
+	Name            string    `json:"name"`
+	Description     string    `json:"description"`
+	InstructorID    string    `json:"instructor_id"`
+	Category        string    `json:"category"`
+	StartTime       time.Time `json:"start_time"`
+	Duration        int       `json:"duration"`
+	SpotsTotal      int       `json:"spots_total"`
+	CreditsRequired int       `json:"credits_required"`
+}
+
+func (h *handlers) publishClass(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req PublishClassRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	if req.StudioID == "" || req.Name == "" || req.StartTime.IsZero() {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "studio_id, name, and start_time are required")
+	}
+	if req.Duration <= 0 || req.SpotsTotal <= 0 || req.CreditsRequired <= 0 {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "duration, spots_total, and credits_required must be positive")
+	}
+
+	class := Class{
+		ID:              server.NewID("CLS"),
+		StudioID:        req.StudioID,
+		Name:            req.Name,
+		Description:     req.Description,
+		Category:        req.Category,
+		StartTime:       req.StartTime,
+		Duration:        req.Duration,
+		SpotsTotal:      req.SpotsTotal,
+		CreditsRequired: req.CreditsRequired,
+	}
+
+	class, err := db.PublishClass(currentPartner(c), class, req.InstructorID)
+	if err != nil {
+		return partnerError(c, err, "Failed to publish class")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(class)
+}
+
+func (h *handlers) updatePartnerClass(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ClassUpdate
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	if (req.Duration != nil && *req.Duration <= 0) ||
+		(req.SpotsTotal != nil && *req.SpotsTotal <= 0) ||
+		(req.CreditsRequired != nil && *req.CreditsRequired <= 0) {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "duration, spots_total, and credits_required must be positive")
+	}
+
+	class, err := db.UpdateClass(currentPartner(c), c.Params("id"), req)
+	if err != nil {
+		return partnerError(c, err, "Failed to update class")
+	}
+
+	return c.JSON(class)
+}
+
+func (h *handlers) getPartnerClassTemplates(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	return server.List(c, db.GetPartnerClassTemplates(currentPartner(c)))
+}
+
+type ClassTemplateRequest struct {
+	StudioID        string         `json:"studio_id" validate:"required"`
+	Name            string         `json:"name" validate:"required"`
+	Description     string         `json:"description"`
+	InstructorID    string         `json:"instructor_id"`
+	Category        string         `json:"category"`
+	Recurrence      RecurrenceRule `json:"recurrence"`
+	Duration        int            `json:"duration" validate:"gt=0"`
+	SpotsTotal      int            `json:"spots_total" validate:"gt=0"`
+	CreditsRequired int            `json:"credits_required" validate:"gt=0"`
+}
+
+func (h *handlers) createClassTemplate(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ClassTemplateRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	if err := req.Recurrence.Validate(); err != nil {
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	}
+
+	tmpl := ClassTemplate{
+		ID:              server.NewID("CTPL"),
+		StudioID:        req.StudioID,
+		Name:            req.Name,
+		Description:     req.Description,
+		InstructorID:    req.InstructorID,
+		Category:        req.Category,
+		Recurrence:      req.Recurrence,
+		Duration:        req.Duration,
+		SpotsTotal:      req.SpotsTotal,
+		CreditsRequired: req.CreditsRequired,
+		Active:          true,
+	}
+
+	if err := db.CreateClassTemplate(currentPartner(c), tmpl); err != nil {
+		return partnerError(c, err, "Failed to create class template")
+	}
+	generated := db.MaterializeClasses(h.clock.Now(), scheduleHorizonDays)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"template":          tmpl,
+		"classes_generated": generated,
+	})
+}
+
+type CancelClassRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (h *handlers) cancelPartnerClass(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req CancelClassRequest
+	if len(c.Body()) > 0 {
+		if err := server.Bind(c, &req); err != nil {
+			return err
+		}
+	}
+
+	class, refunded, err := db.CancelClass(currentPartner(c), c.Params("id"), req.Reason, h.clock.Now())
+	if err != nil {
+		return partnerError(c, err, "Failed to cancel class")
+	}
+
+	return c.JSON(fiber.Map{
+		"class":             class,
+		"bookings_refunded": refunded,
 	})
+}
 
-	app.Use(logger.New())
-	app.Use(cors.New())
+// Helper functions
+// icsEscape escapes text values per RFC 5545 section 3.3.11.
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
 
-	setupRoutes(app)
+// icsFold splits content lines longer than 75 octets, continuing them on
+// lines that begin with a single space.
+func icsFold(line string) string {
+	const limit = 75
+	if len(line) <= limit {
+		return line
+	}
+	var sb strings.Builder
+	width := limit
+	for len(line) > width {
+		cut := width
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		sb.WriteString(line[:cut])
+		sb.WriteString("\r\n ")
+		line = line[cut:]
+		width = limit - 1
+	}
+	sb.WriteString(line)
+	return sb.String()
+}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+// cycleFractionRemaining returns how much of the monthly cycle ending at
+// nextBilling is still ahead of now, clamped to [0, 1].
+func cycleFractionRemaining(nextBilling, now time.Time) float64 {
+	start := nextBilling.AddDate(0, -1, 0)
+	total := nextBilling.Sub(start)
+	if total <= 0 {
+		return 0
+	}
+	fraction := float64(nextBilling.Sub(now)) / float64(total)
+	return math.Max(0, math.Min(1, fraction))
+}
+
+func isSameDay(t1, t2 time.Time) bool {
+	y1, m1, d1 := t1.Date()
+	y2, m2, d2 := t2.Date()
+	return y1 == y2 && m1 == m2 && d1 == d2
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
+
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	db.localize()
+	db.StudioIndex = indexStudios(&db.Studios)
+	h.db.Set(db)
+	return nil
+}
+
+func setupRoutes(app *fiber.App, h *handlers) {
+	api := app.Group("/api/v1")
+
+	// Studio routes
+	api.Get("/studios", h.getStudios)
+	api.Get("/studios/:id/reviews", h.getStudioReviews)
+	api.Post("/studios/:id/reviews", h.createStudioReview)
+	api.Get("/studios/:id/rating", h.getStudioRating)
+
+	// Class routes
+	api.Get("/classes", h.getClasses)
+
+	// Booking routes
+	api.Get("/bookings", h.getUserBookings)
+	api.Post("/bookings", h.createBooking)
+	api.Post("/bookings/:bookingId/cancel", h.cancelBooking)
+	api.Post("/bookings/:bookingId/check-in", h.checkInBooking)
+	api.Get("/bookings/:bookingId/calendar.ics", h.getBookingCalendar)
+
+	// Attendance routes
+	api.Get("/attendance", h.getAttendance)
+
+	// Studio partner routes
+	partner := api.Group("/partner", server.RequireRole(server.RolePartner), h.requirePartner)
+	partner.Get("/studios", h.getPartnerStudios)
+	partner.Post("/studios", h.createPartnerStudio)
+	partner.Put("/studios/:id", h.updatePartnerStudio)
+	partner.Post("/classes", h.publishClass)
+	partner.Put("/classes/:id", h.updatePartnerClass)
+	partner.Post("/classes/:id/cancel", h.cancelPartnerClass)
+	partner.Get("/class-templates", h.getPartnerClassTemplates)
+	partner.Post("/class-templates", h.createClassTemplate)
+
+	// Membership routes
+	api.Get("/membership", h.getMembership)
+	api.Get("/membership/plans", h.getPlans)
+	api.Get("/membership/charges", h.getMembershipCharges)
+	api.Post("/membership/credits", h.purchaseCredits)
+	api.Post("/membership/plan", h.changePlan)
+}
+
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
+func main() {
+	flag.IntVar(&attendancePolicy.NoShowPenalty, "no-show-penalty", attendancePolicy.NoShowPenalty, "Credits deducted for a no-show")
+	flag.IntVar(&attendancePolicy.LateCancelPenalty, "late-cancel-penalty", attendancePolicy.LateCancelPenalty, "Credits deducted for a late cancellation")
+	flag.DurationVar(&attendancePolicy.LateCancelWindow, "late-cancel-window", attendancePolicy.LateCancelWindow, "Cancellations closer than this to class start are late")
+	weeks := flag.Int("schedule-weeks", 4, "Weeks of recurring classes to generate ahead")
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scheduleHorizonDays = *weeks * 7
+
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
+	db := h.db.Get()
+	now := h.clock.Now()
+	db.ResetDueCredits(now)
+	db.SettleFinishedClasses(now)
+	db.MaterializeClasses(now, scheduleHorizonDays)
+	db.SendDueReminders(now)
+	go h.runMaintenance(time.Minute)
+
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"bookings"},
+			Search:  []string{"classes", "studios", "instructors", "bookings"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLinks(bookingLinks),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
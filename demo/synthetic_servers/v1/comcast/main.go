@@ -1,34 +1,30 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
 type InternetPlan struct {
-	Name        string  `json:"name"`
-	Speed       string  `json:"speed"`
-	DataLimit   int     `json:"data_limit"`
-	MonthlyCost float64 `json:"monthly_cost"`
+	Name        string      `json:"name"`
+	Speed       string      `json:"speed"`
+	DataLimit   int         `json:"data_limit"`
+	MonthlyCost money.Money `json:"monthly_cost"`
 }
 
 type TVPackage struct {
-	Name        string   `json:"name"`
-	Channels    int      `json:"channels"`
-	Features    []string `json:"features"`
-	MonthlyCost float64  `json:"monthly_cost"`
+	Name        string      `json:"name"`
+	Channels    int         `json:"channels"`
+	Features    []string    `json:"features"`
+	MonthlyCost money.Money `json:"monthly_cost"`
 }
 
 type User struct {
@@ -59,26 +55,29 @@ type UsagePeriod struct {
 }
 
 type BillingRecord struct {
-	ID       string    `json:"id"`
-	Date     time.Time `json:"date"`
-	Amount   float64   `json:"amount"`
-	Status   string    `json:"status"`
-	Services []Service `json:"services"`
+	ID       string      `json:"id"`
+	Date     time.Time   `json:"date"`
+	Amount   money.Money `json:"amount"`
+	Status   string      `json:"status"`
+	Services []Service   `json:"services"`
 }
 
 type Service struct {
-	Name string  `json:"name"`
-	Cost float64 `json:"cost"`
+	Name string      `json:"name"`
+	Cost money.Money `json:"cost"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users          map[string]User            `json:"users"`
-	InternetPlans  map[string]InternetPlan    `json:"internet_plans"`
-	TVPackages     map[string]TVPackage       `json:"tv_packages"`
-	Watchlists     map[string][]WatchlistItem `json:"watchlists"`
-	UsageHistory   map[string][]UsagePeriod   `json:"usage_history"`
-	BillingHistory map[string][]BillingRecord `json:"billing_history"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users          server.Repository[User]            `json:"users"`
+	InternetPlans  server.Repository[InternetPlan]    `json:"internet_plans"`
+	TVPackages     server.Repository[TVPackage]       `json:"tv_packages"`
+	Watchlists     server.Repository[[]WatchlistItem] `json:"watchlists"`
+	UsageHistory   server.Repository[[]UsagePeriod]   `json:"usage_history"`
+	BillingHistory server.Repository[[]BillingRecord] `json:"billing_history"`
 	mu             sync.RWMutex
 }
 
@@ -89,15 +88,25 @@ var (
 	ErrUnauthorized = errors.New("unauthorized")
 )
 
-// Global database instance
-var db *Database
+// handlers manage Comcast internet and TV service for the users in db,
+// dating watchlist additions by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the plans, packages and users' history in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -110,13 +119,17 @@ func (d *Database) GetUserServices(email string) (map[string]interface{}, error)
 		return nil, err
 	}
 
-	internetPlan := d.InternetPlans[user.InternetPlan]
-	tvPackage := d.TVPackages[user.TVPackage]
+	internetPlan, _ := d.InternetPlans.Get(user.InternetPlan)
+	tvPackage, _ := d.TVPackages.Get(user.TVPackage)
+	total, err := internetPlan.MonthlyCost.Add(tvPackage.MonthlyCost)
+	if err != nil {
+		return nil, err
+	}
 
 	return map[string]interface{}{
 		"internet":           internetPlan,
 		"tv":                 tvPackage,
-		"total_monthly_cost": internetPlan.MonthlyCost + tvPackage.MonthlyCost,
+		"total_monthly_cost": total,
 	}, nil
 }
 
@@ -124,7 +137,7 @@ func (d *Database) GetUserUsage(email string) ([]UsagePeriod, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	usage, exists := d.UsageHistory[email]
+	usage, exists := d.UsageHistory.Get(email)
 	if !exists {
 		return nil, ErrUserNotFound
 	}
@@ -135,7 +148,7 @@ func (d *Database) GetWatchlist(email string) ([]WatchlistItem, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	watchlist, exists := d.Watchlists[email]
+	watchlist, exists := d.Watchlists.Get(email)
 	if !exists {
 		return nil, ErrUserNotFound
 	}
@@ -146,11 +159,12 @@ func (d *Database) AddToWatchlist(email string, item WatchlistItem) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if _, exists := d.Users[email]; !exists {
+	if _, exists := d.Users.Get(email); !exists {
 		return ErrUserNotFound
 	}
 
-	d.Watchlists[email] = append(d.Watchlists[email], item)
+	watchlist, _ := d.Watchlists.Get(email)
+	d.Watchlists.Upsert(email, append(watchlist, item))
 	return nil
 }
 
@@ -158,7 +172,7 @@ func (d *Database) GetBillingHistory(email string) ([]BillingRecord, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	history, exists := d.BillingHistory[email]
+	history, exists := d.BillingHistory.Get(email)
 	if !exists {
 		return nil, ErrUserNotFound
 	}
@@ -166,179 +180,163 @@ func (d *Database) GetBillingHistory(email string) ([]BillingRecord, error) {
 }
 
 // HTTP Handlers
-func getServices(c *fiber.Ctx) error {
+func (h *handlers) getServices(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	services, err := db.GetUserServices(email)
+	if errors.Is(err, money.ErrMixedCurrencies) {
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	}
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(services)
 }
 
-func getUsage(c *fiber.Ctx) error {
+func (h *handlers) getUsage(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	usage, err := db.GetUserUsage(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(usage)
+	return server.List(c, usage)
 }
 
-func getWatchlist(c *fiber.Ctx) error {
+func (h *handlers) getWatchlist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	watchlist, err := db.GetWatchlist(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(watchlist)
+	return server.List(c, watchlist)
 }
 
 type AddWatchlistRequest struct {
 	ContentID string `json:"content_id"`
-	UserEmail string `json:"user_email"`
+	UserEmail string `json:"user_email" validate:"email"`
 }
 
-func addToWatchlist(c *fiber.Ctx) error {
+func (h *handlers) addToWatchlist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req AddWatchlistRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	item := WatchlistItem{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("WLI"),
 		Title:     "Sample Title", // In real implementation, would look up content details
 		Type:      "show",
-		AddedDate: time.Now(),
+		AddedDate: h.clock.Now(),
 	}
 
 	if err := db.AddToWatchlist(req.UserEmail, item); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(item)
 }
 
-func getBillingHistory(c *fiber.Ctx) error {
+func (h *handlers) getBillingHistory(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	history, err := db.GetBillingHistory(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(history)
+	return server.List(c, history)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:          make(map[string]User),
-		InternetPlans:  make(map[string]InternetPlan),
-		TVPackages:     make(map[string]TVPackage),
-		Watchlists:     make(map[string][]WatchlistItem),
-		UsageHistory:   make(map[string][]UsagePeriod),
-		BillingHistory: make(map[string][]BillingRecord),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Account routes
 	account := api.Group("/account")
-	account.Get("/services", getServices)
-	account.Get("/usage", getUsage)
+	account.Get("/services", h.getServices)
+	account.Get("/usage", h.getUsage)
 
 	// TV routes
 	tv := api.Group("/tv")
-	tv.Get("/watchlist", getWatchlist)
-	tv.Post("/watchlist", addToWatchlist)
+	tv.Get("/watchlist", h.getWatchlist)
+	tv.Post("/watchlist", h.addToWatchlist)
 
 	// Billing routes
 	billing := api.Group("/billing")
-	billing.Get("/history", getBillingHistory)
+	billing.Get("/history", h.getBillingHistory)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "watchlists", "usage_history", "billing_history"},
+			Search:  []string{"internet_plans", "tv_packages"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
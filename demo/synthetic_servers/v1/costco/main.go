@@ -1,21 +1,26 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
+	"hash/fnv"
 	"log"
-	"os"
-	"strings"
+	"math"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/geocode"
+	"pkg/money"
+	"pkg/payments"
+	"pkg/pricing"
+	"pkg/search"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -36,32 +41,81 @@ const (
 	ExecutiveGold MembershipType = "executive"
 )
 
+// Annual membership fees
+var membershipFees = map[MembershipType]money.Money{
+	GoldStar:      money.Cents(6500),
+	BusinessBasic: money.Cents(6500),
+	ExecutiveGold: money.Cents(13000),
+}
+
+const (
+	MembershipActive    = "active"
+	MembershipExpired   = "expired"
+	MembershipCancelled = "cancelled"
+)
+
+// membershipMachine is the statuses a membership moves through. A lapsed
+// or cancelled membership is active again once renewed.
+var membershipMachine = &statemachine.Machine{Name: "membership", Moves: map[string][]string{
+	MembershipActive:    {MembershipExpired, MembershipCancelled},
+	MembershipExpired:   {MembershipActive},
+	MembershipCancelled: {MembershipActive},
+}}
+
 type Membership struct {
-	ID             string         `json:"id"`
-	Type           MembershipType `json:"type"`
-	Status         string         `json:"status"`
-	ExpirationDate time.Time      `json:"expiration_date"`
-	MemberSince    time.Time      `json:"member_since"`
-	AutoRenewal    bool           `json:"auto_renewal"`
+	ID             string            `json:"id"`
+	Type           MembershipType    `json:"type"`
+	Status         string            `json:"status"`
+	ExpirationDate time.Time         `json:"expiration_date"`
+	MemberSince    time.Time         `json:"member_since"`
+	AutoRenewal    bool              `json:"auto_renewal"`
+	History        []MembershipEvent `json:"history"`
+}
+
+// MembershipEvent is a change to a membership. Amount is what the member
+// was charged, negative for refunds.
+type MembershipEvent struct {
+	Type   string      `json:"type"` // renewal, upgrade, cancellation, auto_renewal_on, auto_renewal_off
+	Amount money.Money `json:"amount"`
+	Note   string      `json:"note"`
+	At     time.Time   `json:"at"`
+}
+
+// termStart is when the current membership year began.
+func (m Membership) termStart() time.Time {
+	return m.ExpirationDate.AddDate(-1, 0, 0)
 }
 
 type User struct {
-	Email      string     `json:"email"`
-	Name       string     `json:"name"`
-	Phone      string     `json:"phone"`
-	Address    Address    `json:"address"`
-	Membership Membership `json:"membership"`
+	Email          string          `json:"email"`
+	Name           string          `json:"name"`
+	Phone          string          `json:"phone"`
+	Address        Address         `json:"address"`
+	Membership     Membership      `json:"membership"`
+	PaymentMethods []PaymentMethod `json:"payment_methods"`
+}
+
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Last4    string `json:"last4"`
+	ExpiryMM int    `json:"expiry_mm"`
+	ExpiryYY int    `json:"expiry_yy"`
+}
+
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
 }
 
 type Product struct {
-	ID           string  `json:"id"`
-	Name         string  `json:"name"`
-	Category     string  `json:"category"`
-	Price        float64 `json:"price"`
-	ItemNumber   string  `json:"item_number"`
-	Description  string  `json:"description"`
-	InStock      bool    `json:"in_stock"`
-	IsMemberOnly bool    `json:"is_member_only"`
+	ID           string      `json:"id"`
+	Name         string      `json:"name"`
+	Category     string      `json:"category"`
+	Price        money.Money `json:"price"`
+	ItemNumber   string      `json:"item_number"`
+	Description  string      `json:"description"`
+	InStock      bool        `json:"in_stock"` // At any warehouse
+	IsMemberOnly bool        `json:"is_member_only"`
 }
 
 type Warehouse struct {
@@ -73,10 +127,85 @@ type Warehouse struct {
 	Services []string `json:"services"`
 }
 
+type FuelGrade string
+
+const (
+	FuelRegular FuelGrade = "regular"
+	FuelPremium FuelGrade = "premium"
+	FuelDiesel  FuelGrade = "diesel"
+)
+
+// GasStation is a warehouse's gas station. Prices are per gallon and only
+// list the grades the station sells; they're reset once a day.
+type GasStation struct {
+	WarehouseID string                `json:"warehouse_id"`
+	Hours       string                `json:"hours"`
+	Prices      map[FuelGrade]float64 `json:"prices"`
+	UpdatedAt   time.Time             `json:"updated_at"`
+}
+
+type Prescription struct {
+	ID               string    `json:"id"`
+	UserEmail        string    `json:"user_email"`
+	RxNumber         string    `json:"rx_number"`
+	Medication       string    `json:"medication"`
+	Strength         string    `json:"strength"`
+	Quantity         int       `json:"quantity"`
+	DaysSupply       int       `json:"days_supply"`
+	Prescriber       string    `json:"prescriber"`
+	RefillsRemaining int       `json:"refills_remaining"`
+	LastFilledAt     time.Time `json:"last_filled_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	WarehouseID      string    `json:"warehouse_id"` // Preferred pharmacy
+}
+
+type RefillStatus string
+
+// Refills progress requested -> filling -> ready_for_pickup -> picked_up on
+// their own except for the pickup itself.
+const (
+	RefillRequested RefillStatus = "requested"
+	RefillFilling   RefillStatus = "filling"
+	RefillReady     RefillStatus = "ready_for_pickup"
+	RefillPickedUp  RefillStatus = "picked_up"
+	RefillCancelled RefillStatus = "cancelled"
+)
+
+// refillMachine is the statuses a refill moves through. Members cancel it
+// until it starts filling and pick it up once ready.
+var refillMachine = &statemachine.Machine{Name: "refill", Moves: map[string][]string{
+	string(RefillRequested): {string(RefillFilling), string(RefillCancelled)},
+	string(RefillFilling):   {string(RefillReady)},
+	string(RefillReady):     {string(RefillPickedUp)},
+}}
+
+const (
+	refillQueueTime = 5 * time.Minute  // requested until the pharmacist starts
+	refillFillTime  = 30 * time.Minute // filling until ready
+	// Insurance won't cover a refill until most of the last fill is used
+	refillEligibleFraction = 0.75
+)
+
+type Refill struct {
+	ID             string        `json:"id"`
+	PrescriptionID string        `json:"prescription_id"`
+	UserEmail      string        `json:"user_email"`
+	WarehouseID    string        `json:"warehouse_id"`
+	Status         RefillStatus  `json:"status"`
+	History        []RefillEvent `json:"history"`
+	RequestedAt    time.Time     `json:"requested_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+}
+
+type RefillEvent struct {
+	Status RefillStatus `json:"status"`
+	At     time.Time    `json:"at"`
+}
+
 type OrderItem struct {
-	ProductID string  `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ProductID string      `json:"product_id" validate:"required"`
+	Quantity  int         `json:"quantity" validate:"gt=0"`
+	Price     money.Money `json:"price"`
 }
 
 type OrderStatus string
@@ -89,339 +218,2113 @@ const (
 	OrderStatusCancelled OrderStatus = "cancelled"
 )
 
-type Order struct {
-	ID          string      `json:"id"`
-	UserEmail   string      `json:"user_email"`
-	Items       []OrderItem `json:"items"`
-	Total       float64     `json:"total"`
-	Tax         float64     `json:"tax"`
-	WarehouseID string      `json:"warehouse_id"`
-	Status      OrderStatus `json:"status"`
-	OrderDate   time.Time   `json:"order_date"`
-	UpdatedAt   time.Time   `json:"updated_at"`
+// orderMachine is the statuses an order moves through, to completed when
+// the member takes it home or it is delivered.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	string(OrderStatusPending): {string(OrderStatusPaid), string(OrderStatusReady), string(OrderStatusCompleted), string(OrderStatusCancelled)},
+	string(OrderStatusPaid):    {string(OrderStatusReady), string(OrderStatusCompleted), string(OrderStatusCancelled)},
+	string(OrderStatusReady):   {string(OrderStatusCompleted), string(OrderStatusCancelled)},
+}}
+
+type Order struct {
+	ID              string      `json:"id"`
+	UserEmail       string      `json:"user_email"`
+	Items           []OrderItem `json:"items"`
+	Total           money.Money `json:"total"`
+	Tax             money.Money `json:"tax"`
+	DeliveryFee     money.Money `json:"delivery_fee"`
+	Fulfillment     Fulfillment `json:"fulfillment,omitempty"`
+	DeliveryAddress *Address    `json:"delivery_address,omitempty"`
+	// Paid with an Executive reward certificate; the rest is charged
+	RewardCertificateID string      `json:"reward_certificate_id,omitempty"`
+	RewardApplied       money.Money `json:"reward_applied"`
+	AmountDue           money.Money `json:"amount_due"`
+	PaymentMethodID     string      `json:"payment_method_id,omitempty"`
+	ChargeID            string      `json:"charge_id,omitempty"` // The charge of the amount due
+	// 2% Executive reward, accrued when the order completes
+	RewardEarned money.Money `json:"reward_earned"`
+	CompletedAt  *time.Time  `json:"completed_at,omitempty"`
+	WarehouseID  string      `json:"warehouse_id"`
+	Status       OrderStatus `json:"status"`
+	OrderDate    time.Time   `json:"order_date"`
+	UpdatedAt    time.Time   `json:"updated_at"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+}
+
+// Executive members earn 2% back on purchases, up to a yearly cap, paid out
+// as a certificate when the membership renews.
+const executiveRewardRate = 0.02
+
+var executiveRewardCap = money.Cents(125000)
+
+// RewardCertificate is an annual Executive reward. It can be applied to
+// orders until its balance is used up.
+type RewardCertificate struct {
+	ID          string      `json:"id"`
+	UserEmail   string      `json:"user_email"`
+	Amount      money.Money `json:"amount"`
+	Balance     money.Money `json:"balance"`
+	PeriodStart time.Time   `json:"period_start"`
+	PeriodEnd   time.Time   `json:"period_end"`
+	IssuedAt    time.Time   `json:"issued_at"`
+	OrderIDs    []string    `json:"order_ids"` // Orders it was applied to
+}
+
+// RewardsSummary is a member's reward standing for the current membership
+// year.
+type RewardsSummary struct {
+	Eligible       bool                `json:"eligible"`
+	PeriodStart    time.Time           `json:"period_start"`
+	PeriodEnd      time.Time           `json:"period_end"`
+	Accrued        money.Money         `json:"accrued"`
+	Cap            money.Money         `json:"cap"`
+	CapRemaining   money.Money         `json:"cap_remaining"`
+	AvailableToUse money.Money         `json:"available_to_use"` // Unspent certificate balances
+	RunningBalance money.Money         `json:"running_balance"`  // Accrued plus available
+	Certificates   []RewardCertificate `json:"certificates"`
+}
+
+// Most merchandise can be returned at any time; these categories can't be
+// returned after the given number of days.
+var returnWindowDays = map[string]int{
+	"electronics": 90,
+	"appliances":  90,
+}
+
+type ReturnItem struct {
+	ProductID string      `json:"product_id"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Money `json:"price"`
+	Amount    money.Money `json:"amount"`
+}
+
+// Refund splits a return's refund between the order's original forms of
+// payment.
+type Refund struct {
+	Subtotal            money.Money `json:"subtotal"`
+	Tax                 money.Money `json:"tax"`
+	Total               money.Money `json:"total"`
+	ToPaymentMethod     money.Money `json:"to_payment_method"`
+	ToRewardCertificate money.Money `json:"to_reward_certificate"`
+}
+
+type Return struct {
+	ID             string       `json:"id"`
+	OrderID        string       `json:"order_id"`
+	UserEmail      string       `json:"user_email"`
+	WarehouseID    string       `json:"warehouse_id"` // Where it was returned and restocked
+	Items          []ReturnItem `json:"items"`
+	Reason         string       `json:"reason"`
+	Refund         Refund       `json:"refund"`
+	RewardReversed money.Money  `json:"reward_reversed"`
+	CreatedAt      time.Time    `json:"created_at"`
+}
+
+type Fulfillment string
+
+const (
+	FulfillmentPickup   Fulfillment = "pickup"
+	FulfillmentDelivery Fulfillment = "delivery"
+)
+
+// Same-day delivery terms for members below Executive, who get it free with
+// no minimum. --fees delivery=... and --tax-rate override the fee and tax.
+const deliveryMinimum = 35.00
+
+var (
+	deliveryFee  = 3.99
+	salesTaxRate = 0.0825
+)
+
+type CartItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+}
+
+type Cart struct {
+	UserEmail   string      `json:"user_email"`
+	Items       []CartItem  `json:"items"`
+	Fulfillment Fulfillment `json:"fulfillment"`
+	WarehouseID string      `json:"warehouse_id"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	server.SoftDelete
+}
+
+type CartLine struct {
+	ProductID string      `json:"product_id"`
+	Name      string      `json:"name"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Money `json:"price"`
+	Amount    money.Money `json:"amount"`
+}
+
+// CartSummary prices a cart for checkout.
+type CartSummary struct {
+	Cart
+	Lines        []CartLine  `json:"lines"`
+	Subtotal     money.Money `json:"subtotal"`
+	DeliveryFee  money.Money `json:"delivery_fee"`
+	Tax          money.Money `json:"tax"`
+	Total        money.Money `json:"total"`
+	Minimum      money.Money `json:"minimum"`
+	MeetsMinimum bool        `json:"meets_minimum"`
+}
+
+// Database represents our in-memory database
+type Database struct {
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+
+	Users              server.Repository[User]              `json:"users"`
+	Products           server.Repository[Product]           `json:"products"`
+	Warehouses         server.Repository[Warehouse]         `json:"warehouses"`
+	Orders             server.Repository[Order]             `json:"orders"`
+	Carts              server.Repository[Cart]              `json:"carts"`        // Keyed by user email
+	GasStations        server.Repository[GasStation]        `json:"gas_stations"` // Keyed by warehouse ID
+	Prescriptions      server.Repository[Prescription]      `json:"prescriptions"`
+	Refills            server.Repository[Refill]            `json:"refills"`
+	RewardCertificates server.Repository[RewardCertificate] `json:"reward_certificates"`
+	Inventory          server.Repository[map[string]int]    `json:"inventory"` // Warehouse ID -> product ID -> units
+	Returns            server.Repository[Return]            `json:"returns"`
+	// ProductIndex is the products' text, for ?search. It is exported, if
+	// not saved, so that each sandbox's copy of the database has its own.
+	ProductIndex *search.Index `json:"-"`
+	// WarehouseIndex is where the warehouses are, for finding nearby ones
+	// and their gas stations.
+	WarehouseIndex *geo.Index `json:"-"`
+	mu             sync.RWMutex
+	clock          *server.Clock
+}
+
+// handlers serve Costco members their warehouses, orders, pharmacy and
+// returns. clock dates orders and runs gas price updates and the pharmacy.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the database in store and indexes its products and
+// warehouses.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+var (
+	ErrUserNotFound         = errors.New("user not found")
+	ErrMembershipCancelled  = errors.New("membership is cancelled")
+	ErrMembershipInactive   = errors.New("membership is not active")
+	ErrAlreadyExecutive     = errors.New("membership is already Executive")
+	ErrMembershipNotRenewed = errors.New("membership must be renewed first")
+	ErrMembershipRequired   = errors.New("Active membership required")
+	ErrProductNotFound      = errors.New("product not found")
+	ErrWarehouseNotFound    = errors.New("warehouse not found")
+	ErrOutOfStock           = server.NewError(server.CodeOutOfStock, "out of stock")
+	ErrExecutiveOnly        = errors.New("for Executive members only")
+	ErrInvalidQuantity      = errors.New("quantity must be at least 1")
+	ErrNotInCart            = errors.New("product is not in the cart")
+	ErrCartEmpty            = errors.New("cart is empty")
+	ErrInvalidFulfillment   = errors.New("fulfillment must be pickup or delivery")
+	ErrNoWarehouse          = errors.New("select a warehouse for pickup or delivery")
+	ErrNoGasStation         = errors.New("warehouse has no gas station")
+	ErrInvalidFuelGrade     = errors.New("fuel must be regular, premium or diesel")
+	ErrPrescriptionNotFound = errors.New("prescription not found")
+	ErrRefillNotFound       = errors.New("refill not found")
+	ErrNoRefillsRemaining   = errors.New("no refills remaining; contact your prescriber")
+	ErrPrescriptionExpired  = errors.New("prescription has expired")
+	ErrRefillTooSoon        = errors.New("too soon to refill this prescription")
+	ErrRefillInProgress     = errors.New("a refill is already in progress for this prescription")
+	ErrNoPharmacy           = errors.New("warehouse does not have a pharmacy")
+	ErrRefillStatus         = errors.New("refill is not in a status that allows this action")
+	ErrOrderNotFound        = errors.New("order not found")
+	ErrOrderNotOpen         = errors.New("order is already completed or cancelled")
+	ErrCertificateNotFound  = errors.New("reward certificate not found")
+	ErrCertificateUsed      = errors.New("reward certificate has no balance left")
+	ErrPaymentRequired      = errors.New("payment_method_id is required to pay the amount due")
+	ErrPaymentNotFound      = errors.New("payment method not found")
+	ErrOrderNotReturnable   = errors.New("only completed orders can be returned")
+	ErrNotPurchased         = errors.New("item was not purchased on this order")
+	ErrReturnQuantity       = errors.New("return quantity exceeds what is left to return")
+	ErrReturnWindowClosed   = errors.New("return window has closed for this item")
+	ErrNoReturnItems        = errors.New("at least one item is required")
+	ErrBelowMinimum         = fmt.Errorf("same-day delivery requires a $%.2f minimum", deliveryMinimum)
+)
+
+// Database operations
+
+// refreshMembership brings a membership up to date as of now: lapsed
+// memberships renew automatically when auto-renewal is on and expire
+// otherwise. Callers must hold d.mu for writing.
+func (d *Database) refreshMembership(user *User, now time.Time) {
+	m := &user.Membership
+	if m.Status != MembershipActive || now.Before(m.ExpirationDate) {
+		return
+	}
+	if !m.AutoRenewal {
+		if err := statemachine.Move(membershipMachine, m, &m.Status, nil, MembershipExpired, now); err != nil {
+			log.Printf("Expiring membership %s: %v", m.ID, err)
+		}
+	} else {
+		for !now.Before(m.ExpirationDate) {
+			d.issueRewardCertificate(user.Email, *m, now)
+			m.ExpirationDate = m.ExpirationDate.AddDate(1, 0, 0)
+			m.History = append(m.History, MembershipEvent{
+				Type:   "renewal",
+				Amount: membershipFees[m.Type],
+				Note:   "Automatic renewal through " + m.ExpirationDate.Format("2006-01-02"),
+				At:     now,
+			})
+		}
+	}
+	d.Users.Upsert(user.Email, *user)
+}
+
+func (d *Database) GetUser(email string) (User, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return User{}, ErrUserNotFound
+	}
+	d.refreshMembership(&user, d.clock.Now())
+	return user, nil
+}
+
+// updateMembership applies change to a user's up-to-date membership and
+// saves it if change succeeds.
+func (d *Database) updateMembership(email string, change func(m *Membership, now time.Time) error) (Membership, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return Membership{}, ErrUserNotFound
+	}
+	now := d.clock.Now()
+	d.refreshMembership(&user, now)
+	if err := change(&user.Membership, now); err != nil {
+		return Membership{}, err
+	}
+	d.Users.Upsert(user.Email, user)
+	return user.Membership, nil
+}
+
+// RenewMembership charges the annual fee and extends the membership a year
+// from its expiration, or from today if it has already lapsed.
+func (d *Database) RenewMembership(email string) (Membership, error) {
+	return d.updateMembership(email, func(m *Membership, now time.Time) error {
+		if m.Status != MembershipCancelled {
+			d.issueRewardCertificate(email, *m, now)
+		}
+		start := m.ExpirationDate
+		if start.Before(now) {
+			start = now
+		}
+		m.ExpirationDate = start.AddDate(1, 0, 0)
+		if m.Status != MembershipActive {
+			if err := statemachine.Move(membershipMachine, m, &m.Status, nil, MembershipActive, now); err != nil {
+				return err
+			}
+		}
+		m.History = append(m.History, MembershipEvent{
+			Type:   "renewal",
+			Amount: membershipFees[m.Type],
+			Note:   "Renewed through " + m.ExpirationDate.Format("2006-01-02"),
+			At:     now,
+		})
+		return nil
+	})
+}
+
+// UpgradeMembership moves a Gold Star or Business member to Executive,
+// charging the fee difference prorated over what's left of the term.
+func (d *Database) UpgradeMembership(email string) (Membership, error) {
+	return d.updateMembership(email, func(m *Membership, now time.Time) error {
+		switch {
+		case m.Status == MembershipCancelled:
+			return ErrMembershipCancelled
+		case m.Status != MembershipActive:
+			return ErrMembershipNotRenewed
+		case m.Type == ExecutiveGold:
+			return ErrAlreadyExecutive
+		}
+
+		term := m.ExpirationDate.Sub(m.termStart())
+		remaining := m.ExpirationDate.Sub(now)
+		difference, err := membershipFees[ExecutiveGold].Sub(membershipFees[m.Type])
+		if err != nil {
+			return err
+		}
+		charge := difference.Mul(remaining.Hours() / term.Hours())
+		m.History = append(m.History, MembershipEvent{
+			Type:   "upgrade",
+			Amount: charge,
+			Note:   fmt.Sprintf("Upgraded to Executive with %d days left in the term", int(remaining.Hours()/24)),
+			At:     now,
+		})
+		m.Type = ExecutiveGold
+		return nil
+	})
+}
+
+func (d *Database) SetAutoRenewal(email string, enabled bool) (Membership, error) {
+	return d.updateMembership(email, func(m *Membership, now time.Time) error {
+		if m.Status == MembershipCancelled {
+			return ErrMembershipCancelled
+		}
+		if m.AutoRenewal != enabled {
+			m.AutoRenewal = enabled
+			event := MembershipEvent{Type: "auto_renewal_off", Note: "Auto-renewal turned off", At: now}
+			if enabled {
+				event = MembershipEvent{Type: "auto_renewal_on", Note: "Auto-renewal turned on", At: now}
+			}
+			m.History = append(m.History, event)
+		}
+		return nil
+	})
+}
+
+// CancelMembership ends an active membership. Under the satisfaction
+// guarantee everything charged since the last renewal is refunded, less any
+// Executive reward earned this membership year.
+func (d *Database) CancelMembership(email string) (Membership, error) {
+	return d.updateMembership(email, func(m *Membership, now time.Time) error {
+		if err := statemachine.Move(membershipMachine, m, &m.Status, nil, MembershipCancelled, now); err != nil {
+			return ErrMembershipInactive
+		}
+		var refund money.Money
+		for i := len(m.History) - 1; i >= 0; i-- {
+			if m.History[i].Amount.IsPositive() {
+				var err error
+				if refund, err = refund.Add(m.History[i].Amount); err != nil {
+					return err
+				}
+			}
+			if m.History[i].Type == "renewal" {
+				break
+			}
+		}
+		note := "Cancelled; current term fees refunded"
+		if accrued := d.accruedRewards(email, m.termStart(), m.ExpirationDate); accrued.IsPositive() {
+			var err error
+			if refund, err = refund.Sub(accrued); err != nil {
+				return err
+			}
+			if refund.IsNegative() {
+				refund = money.Money{}
+			}
+			note = fmt.Sprintf("%s less %s in rewards earned", note, accrued.Format())
+		}
+		m.History = append(m.History, MembershipEvent{
+			Type:   "cancellation",
+			Amount: refund.Neg(),
+			Note:   note,
+			At:     now,
+		})
+		m.AutoRenewal = false
+		m.ExpirationDate = now
+		return nil
+	})
+}
+
+func (d *Database) GetProduct(id string) (Product, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	product, exists := d.Products.Get(id)
+	if !exists {
+		return Product{}, ErrProductNotFound
+	}
+	return product, nil
+}
+
+func (d *Database) GetWarehouse(id string) (Warehouse, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	warehouse, exists := d.Warehouses.Get(id)
+	if !exists {
+		return Warehouse{}, ErrWarehouseNotFound
+	}
+	return warehouse, nil
+}
+
+// orderItems prices items at catalog prices for a member, returning the
+// merchandise subtotal. Callers must hold d.mu.
+func (d *Database) orderItems(user User, items []OrderItem) ([]OrderItem, error) {
+	priced := make([]OrderItem, 0, len(items))
+	for _, item := range items {
+		product, exists := d.Products.Get(item.ProductID)
+		if !exists {
+			return nil, fmt.Errorf("Product %s: %w", item.ProductID, ErrProductNotFound)
+		}
+		if item.Quantity < 1 {
+			return nil, fmt.Errorf("Product %s: %w", product.Name, ErrInvalidQuantity)
+		}
+		if product.IsMemberOnly && user.Membership.Type == GoldStar {
+			return nil, fmt.Errorf("Product %s is %w", product.Name, ErrExecutiveOnly)
+		}
+		priced = append(priced, OrderItem{ProductID: product.ID, Quantity: item.Quantity, Price: product.Price})
+	}
+	return priced, nil
+}
+
+// orderLines are priced items, for pricing.Price.
+func orderLines(items []OrderItem) []pricing.Line {
+	lines := make([]pricing.Line, len(items))
+	for i, item := range items {
+		lines[i] = pricing.Line{Price: item.Price, Quantity: item.Quantity}
+	}
+	return lines
+}
+
+func (d *Database) CreateOrder(order Order, certificateID, paymentMethodID string, pay server.Charger) (Order, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkStock(order.WarehouseID, order.Items); err != nil {
+		return Order{}, err
+	}
+	if err := d.placeOrder(&order, certificateID, paymentMethodID, pay); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// placeOrder pays for an order, with the reward certificate if one is given
+// and the rest charged to the payment method through pay, then takes its
+// stock and saves it. Callers must hold d.mu and have checked the stock.
+func (d *Database) placeOrder(order *Order, certificateID, paymentMethodID string, pay server.Charger) error {
+	cert, err := d.applyReward(order, certificateID)
+	if err != nil {
+		return err
+	}
+	if order.AmountDue.IsPositive() {
+		if paymentMethodID == "" {
+			return ErrPaymentRequired
+		}
+		user, _ := d.Users.Get(order.UserEmail)
+		i := slices.IndexFunc(user.PaymentMethods, func(pm PaymentMethod) bool { return pm.ID == paymentMethodID })
+		if i < 0 {
+			return ErrPaymentNotFound
+		}
+		method := user.PaymentMethods[i]
+		charge, err := pay(server.ChargeRequest{
+			UserEmail:       order.UserEmail,
+			PaymentMethodID: method.ID,
+			Card:            method.card(),
+			Amount:          order.AmountDue,
+			Description:     "Order " + order.ID,
+			Capture:         true,
+		})
+		if err != nil {
+			return err
+		}
+		order.PaymentMethodID, order.ChargeID = method.ID, charge.ID
+	}
+	if cert != nil {
+		d.RewardCertificates.Upsert(cert.ID, *cert)
+	}
+	d.takeStock(order.WarehouseID, order.Items)
+	d.Orders.Upsert(order.ID, *order)
+	return nil
+}
+
+// Return operations
+
+// refundCharge gives back amount of the charge id, or what is left of it if
+// that is less, as a return's tax share can round a cent over. Orders from
+// before charges were kept have none. Callers must hold d.mu.
+func (d *Database) refundCharge(id string, amount money.Money) error {
+	charge, exists := d.Charges.Get(id)
+	if !exists || !amount.IsPositive() {
+		return nil
+	}
+	left, err := charge.AmountCaptured.Sub(charge.AmountRefunded)
+	if err != nil {
+		return err
+	}
+	if amount, err = money.Min(amount, left); err != nil {
+		return err
+	}
+	if amount.IsPositive() {
+		_, err = d.Refund(id, amount)
+	}
+	return err
+}
+
+// CreateReturn refunds items from a completed order, checked against what
+// the member bought on it and has already returned. The refund goes back to
+// the order's payments in proportion, Executive rewards earned on the items
+// are reversed and the goods are restocked at the returning warehouse.
+func (d *Database) CreateReturn(email, orderID, warehouseID, reason string, items []CartItem) (Return, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	order, exists := d.Orders.Get(orderID)
+	if !exists || order.UserEmail != email {
+		return Return{}, ErrOrderNotFound
+	}
+	if order.Status != OrderStatusCompleted {
+		return Return{}, ErrOrderNotReturnable
+	}
+	if warehouseID == "" {
+		warehouseID = order.WarehouseID
+	}
+	if _, exists := d.Warehouses.Get(warehouseID); !exists {
+		return Return{}, ErrWarehouseNotFound
+	}
+	if len(items) == 0 {
+		return Return{}, ErrNoReturnItems
+	}
+
+	// What's still returnable on the order, by product
+	remaining := make(map[string]int)
+	prices := make(map[string]money.Money)
+	for _, item := range order.Items {
+		remaining[item.ProductID] += item.Quantity
+		prices[item.ProductID] = item.Price
+	}
+	for _, ret := range d.Returns.List() {
+		if ret.OrderID == order.ID {
+			for _, item := range ret.Items {
+				remaining[item.ProductID] -= item.Quantity
+			}
+		}
+	}
+
+	now := d.clock.Now()
+	purchased := order.OrderDate
+	if order.CompletedAt != nil {
+		purchased = *order.CompletedAt
+	}
+	ret := Return{
+		ID:          server.NewID("RTN"),
+		OrderID:     order.ID,
+		UserEmail:   order.UserEmail,
+		WarehouseID: warehouseID,
+		Items:       []ReturnItem{},
+		Reason:      reason,
+		CreatedAt:   now,
+	}
+	for _, item := range items {
+		price, bought := prices[item.ProductID]
+		if !bought {
+			return Return{}, ErrNotPurchased
+		}
+		if item.Quantity < 1 {
+			return Return{}, ErrInvalidQuantity
+		}
+		remaining[item.ProductID] -= item.Quantity
+		if remaining[item.ProductID] < 0 {
+			return Return{}, ErrReturnQuantity
+		}
+		product, _ := d.Products.Get(item.ProductID)
+		if days, limited := returnWindowDays[product.Category]; limited && now.After(purchased.AddDate(0, 0, days)) {
+			return Return{}, ErrReturnWindowClosed
+		}
+		amount := price.Times(item.Quantity)
+		ret.Items = append(ret.Items, ReturnItem{ProductID: item.ProductID, Quantity: item.Quantity, Price: price, Amount: amount})
+		var err error
+		if ret.Refund.Subtotal, err = ret.Refund.Subtotal.Add(amount); err != nil {
+			return Return{}, err
+		}
+	}
+
+	if order.Total.IsPositive() {
+		ret.Refund.Tax = order.Tax.Mul(ret.Refund.Subtotal.Float() / order.Total.Float())
+	}
+	total, err := ret.Refund.Subtotal.Add(ret.Refund.Tax)
+	if err != nil {
+		return Return{}, err
+	}
+	ret.Refund.Total = total
+	ret.Refund.ToPaymentMethod = total
+	paid, err := money.Sum(order.Total.Code(), order.Total, order.Tax, order.DeliveryFee)
+	if err != nil {
+		return Return{}, err
+	}
+	var credited *RewardCertificate
+	if order.RewardApplied.IsPositive() && paid.IsPositive() {
+		cert, exists := d.RewardCertificates.Get(order.RewardCertificateID)
+		if exists {
+			ret.Refund.ToRewardCertificate = total.Mul(order.RewardApplied.Float() / paid.Float())
+			if ret.Refund.ToPaymentMethod, err = total.Sub(ret.Refund.ToRewardCertificate); err != nil {
+				return Return{}, err
+			}
+			if cert.Balance, err = cert.Balance.Add(ret.Refund.ToRewardCertificate); err != nil {
+				return Return{}, err
+			}
+			credited = &cert
+		}
+	}
+	if err := d.refundCharge(order.ChargeID, ret.Refund.ToPaymentMethod); err != nil {
+		return Return{}, err
+	}
+	if credited != nil {
+		d.RewardCertificates.Upsert(credited.ID, *credited)
+	}
+
+	if order.RewardEarned.IsPositive() {
+		if ret.RewardReversed, err = money.Min(ret.Refund.Subtotal.Mul(executiveRewardRate), order.RewardEarned); err != nil {
+			return Return{}, err
+		}
+		if order.RewardEarned, err = order.RewardEarned.Sub(ret.RewardReversed); err != nil {
+			return Return{}, err
+		}
+		order.UpdatedAt = now
+		d.Orders.Upsert(order.ID, order)
+	}
+	for _, item := range ret.Items {
+		d.adjustStock(warehouseID, item.ProductID, item.Quantity)
+	}
+	d.Returns.Upsert(ret.ID, ret)
+	return ret, nil
+}
+
+// Inventory operations
+
+type WarehouseStock struct {
+	WarehouseID string `json:"warehouse_id"`
+	Warehouse   string `json:"warehouse"`
+	ProductID   string `json:"product_id"`
+	Product     string `json:"product"`
+	Quantity    int    `json:"quantity"`
+	InStock     bool   `json:"in_stock"`
+}
+
+// checkStock makes sure a warehouse can fill every item. Callers must hold
+// d.mu.
+func (d *Database) checkStock(warehouseID string, items []OrderItem) error {
+	needed := make(map[string]int)
+	for _, item := range items {
+		needed[item.ProductID] += item.Quantity
+	}
+	for _, item := range items {
+		stock, _ := d.Inventory.Get(warehouseID)
+		available := stock[item.ProductID]
+		if available < needed[item.ProductID] {
+			product, _ := d.Products.Get(item.ProductID)
+			name := product.Name
+			warehouse, _ := d.Warehouses.Get(warehouseID)
+			if available > 0 {
+				return fmt.Errorf("Product %s is %w at %s; only %d available", name, ErrOutOfStock, warehouse.Name, available)
+			}
+			return fmt.Errorf("Product %s is %w at %s", name, ErrOutOfStock, warehouse.Name)
+		}
+	}
+	return nil
+}
+
+// takeStock removes checked items from a warehouse and refreshes each
+// product's overall in-stock flag. Callers must hold d.mu.
+func (d *Database) takeStock(warehouseID string, items []OrderItem) {
+	for _, item := range items {
+		d.adjustStock(warehouseID, item.ProductID, -item.Quantity)
+	}
+}
+
+// adjustStock changes a warehouse's units of a product. Callers must hold
+// d.mu.
+func (d *Database) adjustStock(warehouseID, productID string, delta int) {
+	stock, exists := d.Inventory.Get(warehouseID)
+	if !exists {
+		stock = make(map[string]int)
+	}
+	stock[productID] += delta
+	d.Inventory.Upsert(warehouseID, stock)
+
+	product, exists := d.Products.Get(productID)
+	if !exists {
+		return
+	}
+	product.InStock = false
+	for _, units := range d.Inventory.List() {
+		if units[productID] > 0 {
+			product.InStock = true
+			break
+		}
+	}
+	d.Products.Upsert(product.ID, product)
+}
+
+// stockLevel describes a product's stock at a warehouse. Callers must hold
+// d.mu.
+func (d *Database) stockLevel(warehouse Warehouse, product Product) WarehouseStock {
+	stock, _ := d.Inventory.Get(warehouse.ID)
+	units := stock[product.ID]
+	return WarehouseStock{
+		WarehouseID: warehouse.ID,
+		Warehouse:   warehouse.Name,
+		ProductID:   product.ID,
+		Product:     product.Name,
+		Quantity:    units,
+		InStock:     units > 0,
+	}
+}
+
+// ProductDetail is a product with its stock at every warehouse.
+type ProductDetail struct {
+	Product
+	Availability []WarehouseStock `json:"availability"`
+}
+
+func (d *Database) GetProductDetail(id string) (ProductDetail, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	product, exists := d.Products.Get(id)
+	if !exists {
+		return ProductDetail{}, ErrProductNotFound
+	}
+	detail := ProductDetail{Product: product, Availability: []WarehouseStock{}}
+	for _, warehouse := range d.Warehouses.List() {
+		detail.Availability = append(detail.Availability, d.stockLevel(warehouse, product))
+	}
+	sort.Slice(detail.Availability, func(i, j int) bool {
+		return detail.Availability[i].WarehouseID < detail.Availability[j].WarehouseID
+	})
+	return detail, nil
+}
+
+// GetWarehouseStock lists a warehouse's stock of every product, or of one
+// product when productID is set.
+func (d *Database) GetWarehouseStock(warehouseID, productID string) ([]WarehouseStock, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	warehouse, exists := d.Warehouses.Get(warehouseID)
+	if !exists {
+		return nil, ErrWarehouseNotFound
+	}
+	if productID != "" {
+		product, exists := d.Products.Get(productID)
+		if !exists {
+			return nil, ErrProductNotFound
+		}
+		return []WarehouseStock{d.stockLevel(warehouse, product)}, nil
+	}
+	stock := []WarehouseStock{}
+	for _, product := range d.Products.List() {
+		stock = append(stock, d.stockLevel(warehouse, product))
+	}
+	sort.Slice(stock, func(i, j int) bool { return stock[i].ProductID < stock[j].ProductID })
+	return stock, nil
+}
+
+// Rewards operations
+
+// accruedRewards totals the rewards a member earned on orders completed in
+// [from, to). Callers must hold d.mu.
+// Rewards are earned in dollars, as everything at Costco is priced.
+func (d *Database) accruedRewards(email string, from, to time.Time) money.Money {
+	var total money.Money
+	for _, order := range d.Orders.List() {
+		if order.UserEmail == email && order.CompletedAt != nil &&
+			!order.CompletedAt.Before(from) && order.CompletedAt.Before(to) {
+			total.Minor += order.RewardEarned.Minor
+		}
+	}
+	return total
+}
+
+// issueRewardCertificate pays out what was earned in the membership year
+// ending at m's expiration, once. Callers must hold d.mu.
+func (d *Database) issueRewardCertificate(email string, m Membership, now time.Time) {
+	start, end := m.termStart(), m.ExpirationDate
+	for _, cert := range d.RewardCertificates.List() {
+		if cert.UserEmail == email && cert.PeriodEnd.Equal(end) {
+			return
+		}
+	}
+	amount := d.accruedRewards(email, start, end)
+	if !amount.IsPositive() {
+		return
+	}
+	cert := RewardCertificate{
+		ID:          server.NewID("RWD"),
+		UserEmail:   email,
+		Amount:      amount,
+		Balance:     amount,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		IssuedAt:    now,
+		OrderIDs:    []string{},
+	}
+	d.RewardCertificates.Upsert(cert.ID, cert)
+}
+
+// applyReward pays as much of an order as the certificate's balance covers
+// and sets what's left to pay. It returns the certificate with what it paid
+// taken off, for the caller to save once the order is placed, or nil
+// without one. Callers must hold d.mu.
+func (d *Database) applyReward(order *Order, certificateID string) (*RewardCertificate, error) {
+	due, err := money.Sum(order.Total.Code(), order.Total, order.Tax, order.DeliveryFee)
+	if err != nil {
+		return nil, err
+	}
+	order.AmountDue = due
+	if certificateID == "" {
+		return nil, nil
+	}
+	cert, exists := d.RewardCertificates.Get(certificateID)
+	if !exists || cert.UserEmail != order.UserEmail {
+		return nil, ErrCertificateNotFound
+	}
+	if !cert.Balance.IsPositive() {
+		return nil, ErrCertificateUsed
+	}
+	applied, err := money.Min(cert.Balance, order.AmountDue)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Balance, err = cert.Balance.Sub(applied); err != nil {
+		return nil, err
+	}
+	if order.AmountDue, err = order.AmountDue.Sub(applied); err != nil {
+		return nil, err
+	}
+	cert.OrderIDs = append(cert.OrderIDs, order.ID)
+
+	order.RewardCertificateID = cert.ID
+	order.RewardApplied = applied
+	return &cert, nil
+}
+
+// CompleteOrder closes out an order once it's been picked up or delivered,
+// crediting Executive members 2% of the merchandise total up to the yearly
+// cap.
+func (d *Database) CompleteOrder(id string) (Order, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	order, exists := d.Orders.Get(id)
+	if !exists {
+		return Order{}, ErrOrderNotFound
+	}
+	now := d.clock.Now()
+	if err := statemachine.Move(orderMachine, &order, &order.Status, &order.StatusHistory, OrderStatusCompleted, now); err != nil {
+		return Order{}, ErrOrderNotOpen
+	}
+	if user, exists := d.Users.Get(order.UserEmail); exists {
+		d.refreshMembership(&user, now)
+		m := user.Membership
+		if m.Type == ExecutiveGold && m.Status == MembershipActive {
+			remaining := executiveRewardCap.Minor - d.accruedRewards(user.Email, m.termStart(), m.ExpirationDate).Minor
+			order.RewardEarned = money.Cents(max(min(order.Total.Mul(executiveRewardRate).Minor, remaining), 0))
+		}
+	}
+	order.CompletedAt = &now
+	order.UpdatedAt = now
+	d.Orders.Upsert(order.ID, order)
+	return order, nil
+}
+
+func (d *Database) GetRewards(email string) (RewardsSummary, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return RewardsSummary{}, ErrUserNotFound
+	}
+	d.refreshMembership(&user, d.clock.Now())
+	m := user.Membership
+
+	summary := RewardsSummary{
+		Eligible:     m.Type == ExecutiveGold && m.Status == MembershipActive,
+		PeriodStart:  m.termStart(),
+		PeriodEnd:    m.ExpirationDate,
+		Accrued:      d.accruedRewards(user.Email, m.termStart(), m.ExpirationDate),
+		Cap:          executiveRewardCap,
+		Certificates: []RewardCertificate{},
+	}
+	summary.CapRemaining = money.Cents(max(executiveRewardCap.Minor-summary.Accrued.Minor, 0))
+	for _, cert := range d.RewardCertificates.List() {
+		if cert.UserEmail == user.Email {
+			summary.Certificates = append(summary.Certificates, cert)
+			summary.AvailableToUse.Minor += cert.Balance.Minor
+		}
+	}
+	sort.Slice(summary.Certificates, func(i, j int) bool {
+		return summary.Certificates[i].IssuedAt.After(summary.Certificates[j].IssuedAt)
+	})
+	summary.RunningBalance = money.Cents(summary.Accrued.Minor + summary.AvailableToUse.Minor)
+	return summary, nil
+}
+
+// HTTP Handlers
+// productIndex returns the index of products' text, making it for a
+// database that hasn't one, such as a new sandbox's copy.
+func (d *Database) productIndex() *search.Index {
+	d.mu.RLock()
+	index := d.ProductIndex
+	d.mu.RUnlock()
+	if index != nil {
+		return index
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ProductIndex == nil {
+		d.ProductIndex = indexProducts(&d.Products)
+	}
+	return d.ProductIndex
+}
+
+func indexProducts(products *server.Repository[Product]) *search.Index {
+	index := search.New()
+	for _, id := range products.Keys() {
+		product, _ := products.Get(id)
+		index.Add(id,
+			search.Field{Text: product.Name, Weight: 2},
+			search.Field{Text: product.ItemNumber, Weight: 2},
+			search.Field{Text: product.Description, Weight: 1})
+	}
+	return index
+}
+
+func (h *handlers) getProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	category := c.Query("category")
+	query := c.Query("search")
+
+	var ids []string
+	if query != "" {
+		ids = search.IDs(db.productIndex().Search(query))
+	}
+	var products []Product
+	db.mu.RLock()
+	if query == "" {
+		for _, id := range db.Products.Keys() {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		product, ok := db.Products.Get(id)
+		if !ok || category != "" && product.Category != category {
+			continue
+		}
+		products = append(products, product)
+	}
+	db.mu.RUnlock()
+
+	return server.List(c, products, "category")
+}
+
+func (h *handlers) getMembership(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	user, err := db.GetUser(email)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	return c.JSON(user.Membership)
+}
+
+// membershipHandler adapts a membership change that only needs the
+// member's email.
+func (h *handlers) membershipHandler(change func(d *Database, email string) (Membership, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		var req struct {
+			Email string `json:"email" validate:"required,email"`
+		}
+		if err := server.Bind(c, &req); err != nil {
+			return err
+		}
+
+		membership, err := change(db, req.Email)
+		if err != nil {
+			return membershipError(c, err)
+		}
+		return c.JSON(membership)
+	}
+}
+
+func (h *handlers) setAutoRenewal(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Email   string `json:"email" validate:"required,email"`
+		Enabled *bool  `json:"enabled" validate:"required"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	membership, err := db.SetAutoRenewal(req.Email, *req.Enabled)
+	if err != nil {
+		return membershipError(c, err)
+	}
+	return c.JSON(membership)
+}
+
+func (h *handlers) getCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	summary, err := db.GetCart(email)
+	if err != nil {
+		return cartError(c, err)
+	}
+	return c.JSON(summary)
+}
+
+type cartItemRequest struct {
+	Email     string `json:"email" validate:"email"`
+	ProductID string `json:"product_id"`
+	Quantity  *int   `json:"quantity" validate:"gte=0"`
+}
+
+func (h *handlers) addCartItem(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req cartItemRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	quantity := 1
+	if req.Quantity != nil {
+		quantity = *req.Quantity
+	}
+	summary, err := db.SetCartItem(req.Email, req.ProductID, quantity, false)
+	if err != nil {
+		return cartError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(summary)
+}
+
+func (h *handlers) updateCartItem(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req cartItemRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+	// Adding to the cart defaults the quantity; setting it doesn't.
+	if req.Quantity == nil {
+		return &server.ValidationError{Errors: []server.FieldError{{Field: "quantity", Message: "is required"}}}
+	}
+
+	summary, err := db.SetCartItem(req.Email, c.Params("productId"), *req.Quantity, true)
+	if err != nil {
+		return cartError(c, err)
+	}
+	return c.JSON(summary)
+}
+
+func (h *handlers) removeCartItem(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	summary, err := db.SetCartItem(email, c.Params("productId"), 0, true)
+	if err != nil {
+		return cartError(c, err)
+	}
+	return c.JSON(summary)
+}
+
+func (h *handlers) clearCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	summary, err := db.ClearCart(email)
+	if err != nil {
+		return cartError(c, err)
+	}
+	return c.JSON(summary)
+}
+
+func (h *handlers) setFulfillment(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Email       string      `json:"email" validate:"email"`
+		Method      Fulfillment `json:"method"`
+		WarehouseID string      `json:"warehouse_id"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	summary, err := db.SetFulfillment(req.Email, req.Method, req.WarehouseID)
+	if err != nil {
+		return cartError(c, err)
+	}
+	return c.JSON(summary)
+}
+
+func (h *handlers) checkout(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Email               string `json:"email" validate:"email"`
+		RewardCertificateID string `json:"reward_certificate_id"`
+		PaymentMethodID     string `json:"payment_method_id"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	order, err := db.Checkout(req.Email, req.RewardCertificateID, req.PaymentMethodID, db.Charger(c))
+	if err != nil {
+		return cartError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(order)
+}
+
+func cartError(c *fiber.Ctx, err error) error {
+	// Declined charges carry their own code
+	var declined *server.Error
+	if errors.As(err, &declined) {
+		return err
+	}
+	switch {
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrProductNotFound), errors.Is(err, ErrWarehouseNotFound),
+		errors.Is(err, ErrNotInCart), errors.Is(err, ErrCertificateNotFound):
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case errors.Is(err, ErrMembershipRequired), errors.Is(err, ErrExecutiveOnly):
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case errors.Is(err, ErrOutOfStock), errors.Is(err, ErrInvalidQuantity),
+		errors.Is(err, ErrCartEmpty), errors.Is(err, ErrInvalidFulfillment), errors.Is(err, ErrNoWarehouse),
+		errors.Is(err, ErrBelowMinimum), errors.Is(err, ErrCertificateUsed),
+		errors.Is(err, ErrPaymentRequired), errors.Is(err, ErrPaymentNotFound):
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) getWarehouseStock(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	stock, err := db.GetWarehouseStock(c.Params("id"), c.Query("product_id"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return server.List(c, stock, "product_id")
+}
+
+func (h *handlers) getWarehouseGas(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	station, err := db.GetGasStation(c.Params("id"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return c.JSON(station)
+}
+
+type NearbyGas struct {
+	Warehouse  Warehouse  `json:"warehouse"`
+	Station    GasStation `json:"station"`
+	Price      float64    `json:"price"` // Per gallon
+	DistanceKm float64    `json:"distance_km"`
+}
+
+// findCheapestGas lists stations within radius_km (default 25) that sell
+// the requested grade, cheapest first.
+func (h *handlers) findCheapestGas(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	origin, err := searchOrigin(c.Query("zip_code"), c.QueryFloat("latitude", 0), c.QueryFloat("longitude", 0))
+	if err != nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, err.Error())
+	}
+	grade := FuelGrade(c.Query("fuel", string(FuelRegular)))
+	if grade != FuelRegular && grade != FuelPremium && grade != FuelDiesel {
+		return server.FailWith(c, fiber.StatusBadRequest, ErrInvalidFuelGrade)
+	}
+	radius := c.QueryFloat("radius_km", 25)
+
+	nearby := db.warehouseIndex().Within(origin, radius)
+	results := []NearbyGas{}
+	db.mu.RLock()
+	for _, near := range nearby {
+		station, hasStation := db.GasStations.Get(near.ID)
+		price, sold := station.Prices[grade]
+		warehouse, exists := db.Warehouses.Get(near.ID)
+		if !hasStation || !sold || !exists {
+			continue
+		}
+		results = append(results, NearbyGas{
+			Warehouse:  warehouse,
+			Station:    station,
+			Price:      price,
+			DistanceKm: math.Round(near.DistanceKm*10) / 10,
+		})
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Price != results[j].Price {
+			return results[i].Price < results[j].Price
+		}
+		return results[i].DistanceKm < results[j].DistanceKm
+	})
+	return server.List(c, results)
+}
+
+// listForMember returns the records belonging to the member in the email
+// query parameter, by their user_email.
+func listForMember[T any](h *handlers, c *fiber.Ctx, records func(d *Database) *server.Repository[T], newer func(a, b T) bool) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	db.mu.RLock()
+	list := records(db).By("user_email", email)
+	db.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return newer(list[i], list[j]) })
+	return c.JSON(list)
 }
 
-// Database represents our in-memory database
-type Database struct {
-	Users      map[string]User      `json:"users"`
-	Products   map[string]Product   `json:"products"`
-	Warehouses map[string]Warehouse `json:"warehouses"`
-	Orders     map[string]Order     `json:"orders"`
-	mu         sync.RWMutex
+func (h *handlers) getPrescriptions(c *fiber.Ctx) error {
+	return listForMember(h, c,
+		func(d *Database) *server.Repository[Prescription] { return &d.Prescriptions },
+		func(a, b Prescription) bool { return a.LastFilledAt.After(b.LastFilledAt) })
 }
 
-var db *Database
+func (h *handlers) getRefills(c *fiber.Ctx) error {
+	return listForMember(h, c,
+		func(d *Database) *server.Repository[Refill] { return &d.Refills },
+		func(a, b Refill) bool { return a.RequestedAt.After(b.RequestedAt) })
+}
 
-// Database operations
-func (d *Database) GetUser(email string) (User, error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+func (h *handlers) requestRefill(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Email       string `json:"email" validate:"email"`
+		WarehouseID string `json:"warehouse_id"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
 
-	user, exists := d.Users[email]
-	if !exists {
-		return User{}, errors.New("user not found")
+	refill, err := db.RequestRefill(req.Email, c.Params("id"), req.WarehouseID)
+	if err != nil {
+		return pharmacyError(c, err)
 	}
-	return user, nil
+	return c.Status(fiber.StatusCreated).JSON(refill)
 }
 
-func (d *Database) GetProduct(id string) (Product, error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+// refillHandler moves a member's refill to status.
+func (h *handlers) refillHandler(status RefillStatus) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		var req struct {
+			Email string `json:"email" validate:"email"`
+		}
+		if err := server.Bind(c, &req); err != nil {
+			return err
+		}
 
-	product, exists := d.Products[id]
-	if !exists {
-		return Product{}, errors.New("product not found")
+		refill, err := db.UpdateRefill(req.Email, c.Params("id"), status)
+		if err != nil {
+			return pharmacyError(c, err)
+		}
+		return c.JSON(refill)
 	}
-	return product, nil
 }
 
-func (d *Database) GetWarehouse(id string) (Warehouse, error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-
-	warehouse, exists := d.Warehouses[id]
-	if !exists {
-		return Warehouse{}, errors.New("warehouse not found")
+func pharmacyError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrPrescriptionNotFound, ErrRefillNotFound, ErrWarehouseNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNoRefillsRemaining, ErrPrescriptionExpired, ErrRefillTooSoon, ErrRefillInProgress, ErrRefillStatus:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrNoPharmacy:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
-	return warehouse, nil
 }
 
-func (d *Database) CreateOrder(order Order) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+func (h *handlers) createReturn(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Email       string     `json:"email" validate:"email"`
+		WarehouseID string     `json:"warehouse_id"`
+		Reason      string     `json:"reason"`
+		Items       []CartItem `json:"items"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
 
-	d.Orders[order.ID] = order
-	return nil
+	ret, err := db.CreateReturn(req.Email, c.Params("id"), req.WarehouseID, req.Reason, req.Items)
+	if err != nil {
+		switch err {
+		case ErrOrderNotFound, ErrWarehouseNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrOrderNotReturnable, ErrReturnWindowClosed:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		}
+	}
+	return c.Status(fiber.StatusCreated).JSON(ret)
 }
 
-// HTTP Handlers
-func getProducts(c *fiber.Ctx) error {
-	category := c.Query("category")
-	search := c.Query("search")
+func (h *handlers) getReturns(c *fiber.Ctx) error {
+	return listForMember(h, c,
+		func(d *Database) *server.Repository[Return] { return &d.Returns },
+		func(a, b Return) bool { return a.CreatedAt.After(b.CreatedAt) })
+}
 
-	var products []Product
-	db.mu.RLock()
-	for _, product := range db.Products {
-		if category != "" && product.Category != category {
-			continue
-		}
-		if search != "" && !contains(product.Name, search) {
-			continue
+func (h *handlers) completeOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	order, err := db.CompleteOrder(c.Params("id"))
+	if err != nil {
+		switch err {
+		case ErrOrderNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		default:
+			return server.FailWith(c, fiber.StatusConflict, err)
 		}
-		products = append(products, product)
 	}
-	db.mu.RUnlock()
-
-	return c.JSON(products)
+	return c.JSON(order)
 }
 
-func getMembership(c *fiber.Ctx) error {
+func (h *handlers) getRewards(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
-	user, err := db.GetUser(email)
+	summary, err := db.GetRewards(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
+	return c.JSON(summary)
+}
 
-	return c.JSON(user.Membership)
+func membershipError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrUserNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrMembershipCancelled, ErrMembershipInactive, ErrAlreadyExecutive, ErrMembershipNotRenewed:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+// warehouseIndex returns the index of warehouses' locations, making it
+// for a database that hasn't one, such as a new sandbox's copy.
+func (d *Database) warehouseIndex() *geo.Index {
+	d.mu.RLock()
+	index := d.WarehouseIndex
+	d.mu.RUnlock()
+	if index != nil {
+		return index
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.WarehouseIndex == nil {
+		d.WarehouseIndex = indexWarehouses(&d.Warehouses)
+	}
+	return d.WarehouseIndex
 }
 
-func getWarehouses(c *fiber.Ctx) error {
-	lat := c.QueryFloat("latitude", 0)
-	lon := c.QueryFloat("longitude", 0)
+func indexWarehouses(warehouses *server.Repository[Warehouse]) *geo.Index {
+	index := geo.NewIndex()
+	for _, id := range warehouses.Keys() {
+		warehouse, _ := warehouses.Get(id)
+		index.Add(id, geo.Point{Lat: warehouse.Address.Latitude, Lon: warehouse.Address.Longitude})
+	}
+	return index
+}
 
+// searchOrigin returns where a search for warehouses is from: a zip code's
+// centroid, or else the coordinates given.
+func searchOrigin(zip string, lat, lon float64) (geo.Point, error) {
+	if zip != "" {
+		place, err := geocode.Lookup(zip)
+		return place.Point, err
+	}
 	if lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "latitude and longitude are required",
-		})
+		return geo.Point{}, errors.New("zip_code, or latitude and longitude, are required")
+	}
+	return geo.Point{Lat: lat, Lon: lon}, nil
+}
+
+func (h *handlers) getWarehouses(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	origin, err := searchOrigin(c.Query("zip_code"), c.QueryFloat("latitude", 0), c.QueryFloat("longitude", 0))
+	if err != nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, err.Error())
 	}
+	radius := c.QueryFloat("radius_km", 50)
 
+	// Nearest first
+	nearby := db.warehouseIndex().Within(origin, radius)
 	var nearbyWarehouses []Warehouse
-	maxDistance := 50.0 // Maximum radius in km
-
 	db.mu.RLock()
-	for _, warehouse := range db.Warehouses {
-		distance := calculateDistance(lat, lon,
-			warehouse.Address.Latitude,
-			warehouse.Address.Longitude)
-
-		if distance <= maxDistance {
+	for _, near := range nearby {
+		if warehouse, ok := db.Warehouses.Get(near.ID); ok {
 			nearbyWarehouses = append(nearbyWarehouses, warehouse)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(nearbyWarehouses)
+	return server.List(c, nearbyWarehouses)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userOrders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
+	for _, order := range db.Orders.List() {
 		if order.UserEmail == email {
 			userOrders = append(userOrders, order)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return server.List(c, userOrders)
 }
 
 type CreateOrderRequest struct {
-	UserEmail   string      `json:"user_email"`
-	WarehouseID string      `json:"warehouse_id"`
-	Items       []OrderItem `json:"items"`
+	UserEmail           string      `json:"user_email" validate:"required,email"`
+	WarehouseID         string      `json:"warehouse_id" validate:"required"`
+	Items               []OrderItem `json:"items" validate:"min=1"`
+	RewardCertificateID string      `json:"reward_certificate_id"`
+	PaymentMethodID     string      `json:"payment_method_id"`
 }
 
-func createOrder(c *fiber.Ctx) error {
+func (h *handlers) createOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateOrderRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user and membership
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	if user.Membership.Status != "active" {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "Active membership required",
-		})
+	// GetUser has already expired or auto-renewed a lapsed membership
+	if user.Membership.Status != MembershipActive {
+		return server.FailWith(c, fiber.StatusForbidden, ErrMembershipRequired)
 	}
 
 	// Validate warehouse
 	_, err = db.GetWarehouse(req.WarehouseID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Calculate order total
-	var total float64
-	for _, item := range req.Items {
-		product, err := db.GetProduct(item.ProductID)
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": fmt.Sprintf("Product %s not found", item.ProductID),
-			})
-		}
-
-		if !product.InStock {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": fmt.Sprintf("Product %s is out of stock", product.Name),
-			})
-		}
-
-		if product.IsMemberOnly && user.Membership.Type == GoldStar {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-				"error": fmt.Sprintf("Product %s is for Executive members only", product.Name),
-			})
+	db.mu.RLock()
+	items, err := db.orderItems(user, req.Items)
+	db.mu.RUnlock()
+	if err != nil {
+		if errors.Is(err, ErrExecutiveOnly) {
+			return server.FailWith(c, fiber.StatusForbidden, err)
 		}
-
-		total += product.Price * float64(item.Quantity)
+		return server.FailWith(c, fiber.StatusBadRequest, err)
 	}
 
-	tax := total * 0.0825 // 8.25% tax rate
+	quote, err := pricing.Price(money.USD, orderLines(items), pricing.Tax(salesTaxRate))
+	if err != nil {
+		return err
+	}
 
 	// Create new order
 	order := Order{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("ORD"),
 		UserEmail:   req.UserEmail,
-		Items:       req.Items,
-		Total:       total,
-		Tax:         tax,
+		Items:       items,
+		Total:       quote.Subtotal,
+		Tax:         quote.Tax,
 		WarehouseID: req.WarehouseID,
 		Status:      OrderStatusPending,
-		OrderDate:   time.Now(),
-		UpdatedAt:   time.Now(),
+		OrderDate:   h.clock.Now(),
+		UpdatedAt:   h.clock.Now(),
 	}
 
 	// Save order to database
-	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+	order, err = db.CreateOrder(order, req.RewardCertificateID, req.PaymentMethodID, db.Charger(c))
+	if err != nil {
+		var declined *server.Error
+		switch {
+		case errors.As(err, &declined):
+			return err
+		case errors.Is(err, ErrCertificateNotFound):
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case errors.Is(err, ErrCertificateUsed), errors.Is(err, ErrOutOfStock),
+			errors.Is(err, ErrPaymentRequired), errors.Is(err, ErrPaymentNotFound):
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		case errors.Is(err, money.ErrMixedCurrencies):
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create order")
+		}
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-// Helper functions
-func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+// Cart operations
+
+// cart returns a user's cart, creating an empty one for pickup if they have
+// none or cleared theirs. Callers must hold d.mu.
+func (d *Database) cart(email string) Cart {
+	cart, exists := d.Carts.Get(email)
+	if !exists || cart.Deleted() {
+		cart = Cart{UserEmail: email, Items: []CartItem{}, Fulfillment: FulfillmentPickup}
+	}
+	return cart
+}
+
+// summarize prices a cart. Callers must hold d.mu.
+func (d *Database) summarize(user User, cart Cart) (CartSummary, error) {
+	summary := CartSummary{Cart: cart, Lines: []CartLine{}}
+	lines := make([]pricing.Line, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		product, _ := d.Products.Get(item.ProductID)
+		line := pricing.Line{Price: product.Price, Quantity: item.Quantity}
+		summary.Lines = append(summary.Lines, CartLine{
+			ProductID: item.ProductID,
+			Name:      product.Name,
+			Quantity:  item.Quantity,
+			Price:     product.Price,
+			Amount:    line.Price.Times(line.Quantity),
+		})
+		lines = append(lines, line)
+	}
+	var delivery pricing.Rule
+	if cart.Fulfillment == FulfillmentDelivery && user.Membership.Type != ExecutiveGold {
+		delivery = pricing.Fee("delivery", money.Dollars(deliveryFee))
+		summary.Minimum = money.Dollars(deliveryMinimum)
+	}
+	quote, err := pricing.Price(money.USD, lines, delivery, pricing.Tax(salesTaxRate))
+	if err != nil {
+		return CartSummary{}, err
+	}
+	summary.Subtotal = quote.Subtotal
+	summary.DeliveryFee = quote.Fees
+	summary.Tax = quote.Tax
+	summary.Total = quote.Total
+	cmp, err := summary.Subtotal.Cmp(summary.Minimum)
+	if err != nil {
+		return CartSummary{}, err
+	}
+	summary.MeetsMinimum = cmp >= 0
+	return summary, nil
+}
+
+// updateCart applies change to a member's cart and returns the repriced
+// summary.
+func (d *Database) updateCart(email string, change func(cart *Cart) error) (CartSummary, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return CartSummary{}, ErrUserNotFound
+	}
+	cart := d.cart(user.Email)
+	if change != nil {
+		if err := change(&cart); err != nil {
+			return CartSummary{}, err
+		}
+		cart.UpdatedAt = d.clock.Now()
+		d.Carts.Upsert(user.Email, cart)
+	}
+	return d.summarize(user, cart)
+}
+
+func (d *Database) GetCart(email string) (CartSummary, error) {
+	return d.updateCart(email, nil)
+}
+
+// SetCartItem adds quantity of a product to the cart, or with replace sets
+// the quantity outright. Setting zero removes the item.
+func (d *Database) SetCartItem(email, productID string, quantity int, replace bool) (CartSummary, error) {
+	return d.updateCart(email, func(cart *Cart) error {
+		product, exists := d.Products.Get(productID)
+		if !exists {
+			return ErrProductNotFound
+		}
+		if quantity < 0 || (quantity == 0 && !replace) {
+			return ErrInvalidQuantity
+		}
+		for i, item := range cart.Items {
+			if item.ProductID == product.ID {
+				if !replace {
+					quantity += item.Quantity
+				}
+				if quantity == 0 {
+					cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
+				} else {
+					cart.Items[i].Quantity = quantity
+				}
+				return nil
+			}
+		}
+		if replace && quantity == 0 {
+			return ErrNotInCart
+		}
+		cart.Items = append(cart.Items, CartItem{ProductID: product.ID, Quantity: quantity})
+		return nil
+	})
+}
+
+// ClearCart empties a member's cart. The cart is only marked deleted, so an
+// admin can put it back, at least until the member starts a new one.
+func (d *Database) ClearCart(email string) (CartSummary, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return CartSummary{}, ErrUserNotFound
+	}
+	if cart, exists := d.Carts.Get(user.Email); exists && !cart.Deleted() && len(cart.Items) > 0 {
+		cart.MarkDeleted()
+		cart.UpdatedAt = *cart.DeletedAt
+		d.Carts.Upsert(user.Email, cart)
+	}
+	return d.summarize(user, d.cart(user.Email))
 }
 
-func contains(s, substr string) bool {
-	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+func (d *Database) SetFulfillment(email string, method Fulfillment, warehouseID string) (CartSummary, error) {
+	return d.updateCart(email, func(cart *Cart) error {
+		if method != FulfillmentPickup && method != FulfillmentDelivery {
+			return ErrInvalidFulfillment
+		}
+		if _, exists := d.Warehouses.Get(warehouseID); !exists {
+			return ErrWarehouseNotFound
+		}
+		cart.Fulfillment = method
+		cart.WarehouseID = warehouseID
+		return nil
+	})
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
+// Checkout turns a member's cart into an order and empties the cart.
+func (d *Database) Checkout(email, certificateID, paymentMethodID string, pay server.Charger) (Order, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return Order{}, ErrUserNotFound
+	}
+	now := d.clock.Now()
+	d.refreshMembership(&user, now)
+	if user.Membership.Status != MembershipActive {
+		return Order{}, ErrMembershipRequired
+	}
+
+	cart := d.cart(user.Email)
+	if len(cart.Items) == 0 {
+		return Order{}, ErrCartEmpty
+	}
+	if cart.WarehouseID == "" {
+		return Order{}, ErrNoWarehouse
+	}
+	requested := make([]OrderItem, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		requested = append(requested, OrderItem{ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+	items, err := d.orderItems(user, requested)
 	if err != nil {
-		return err
+		return Order{}, err
+	}
+	if err := d.checkStock(cart.WarehouseID, items); err != nil {
+		return Order{}, err
+	}
+	summary, err := d.summarize(user, cart)
+	if err != nil {
+		return Order{}, err
+	}
+	if !summary.MeetsMinimum {
+		return Order{}, ErrBelowMinimum
+	}
+
+	order := Order{
+		ID:          server.NewID("ORD"),
+		UserEmail:   user.Email,
+		Items:       items,
+		Total:       summary.Subtotal,
+		Tax:         summary.Tax,
+		DeliveryFee: summary.DeliveryFee,
+		Fulfillment: cart.Fulfillment,
+		WarehouseID: cart.WarehouseID,
+		Status:      OrderStatusPending,
+		OrderDate:   now,
+		UpdatedAt:   now,
+	}
+	if cart.Fulfillment == FulfillmentDelivery {
+		address := user.Address
+		order.DeliveryAddress = &address
+	}
+	if err := d.placeOrder(&order, certificateID, paymentMethodID, pay); err != nil {
+		return Order{}, err
+	}
+	d.Carts.Delete(user.Email)
+	return order, nil
+}
+
+// Gas operations
+
+func (d *Database) GetGasStation(warehouseID string) (GasStation, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, exists := d.Warehouses.Get(warehouseID); !exists {
+		return GasStation{}, ErrWarehouseNotFound
+	}
+	station, exists := d.GasStations.Get(warehouseID)
+	if !exists {
+		return GasStation{}, ErrNoGasStation
+	}
+	return station, nil
+}
+
+// UpdateGasPrices moves each station's prices by up to 4 cents a gallon
+// the first time it runs on a new day. The change is derived from the
+// station, grade and date so a restart on the same day agrees.
+func (d *Database) UpdateGasPrices(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	today := now.UTC().Format("2006-01-02")
+	updated := 0
+	for _, id := range d.GasStations.Keys() {
+		station, _ := d.GasStations.Get(id)
+		if station.UpdatedAt.UTC().Format("2006-01-02") == today {
+			continue
+		}
+		prices := make(map[FuelGrade]float64, len(station.Prices))
+		for grade, price := range station.Prices {
+			h := fnv.New32a()
+			h.Write([]byte(id + "|" + string(grade) + "|" + today))
+			cents := float64(int(h.Sum32()%9) - 4)
+			prices[grade] = roundCents(math.Max(price+cents/100, 0.99))
+		}
+		station.Prices = prices
+		station.UpdatedAt = now
+		d.GasStations.Upsert(id, station)
+		updated++
+	}
+	return updated
+}
+
+func (h *handlers) runGasPriceUpdates(interval time.Duration) {
+	h.clock.Every(interval, func(now time.Time) {
+		db := h.db.Get()
+		if n := db.UpdateGasPrices(now); n > 0 {
+			log.Printf("Updated gas prices at %d warehouse(s)", n)
+		}
+	})
+}
+
+// Pharmacy operations
+
+func (w Warehouse) offers(service string) bool {
+	for _, s := range w.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestRefill queues a refill at the chosen pharmacy, or the
+// prescription's preferred one when warehouseID is empty.
+func (d *Database) RequestRefill(email, prescriptionID, warehouseID string) (Refill, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rx, exists := d.Prescriptions.Get(prescriptionID)
+	if !exists || rx.UserEmail != email {
+		return Refill{}, ErrPrescriptionNotFound
+	}
+	if warehouseID == "" {
+		warehouseID = rx.WarehouseID
+	}
+	warehouse, exists := d.Warehouses.Get(warehouseID)
+	if !exists {
+		return Refill{}, ErrWarehouseNotFound
+	}
+	if !warehouse.offers("pharmacy") {
+		return Refill{}, ErrNoPharmacy
+	}
+
+	now := d.clock.Now()
+	switch {
+	case now.After(rx.ExpiresAt):
+		return Refill{}, ErrPrescriptionExpired
+	case rx.RefillsRemaining < 1:
+		return Refill{}, ErrNoRefillsRemaining
+	case now.Before(rx.LastFilledAt.Add(time.Duration(float64(rx.DaysSupply)*refillEligibleFraction*24) * time.Hour)):
+		return Refill{}, ErrRefillTooSoon
+	}
+	for _, refill := range d.Refills.List() {
+		if refill.PrescriptionID == rx.ID && (refill.Status == RefillRequested || refill.Status == RefillFilling || refill.Status == RefillReady) {
+			return Refill{}, ErrRefillInProgress
+		}
+	}
+
+	refill := Refill{
+		ID:             server.NewID("RFL"),
+		PrescriptionID: rx.ID,
+		UserEmail:      rx.UserEmail,
+		WarehouseID:    warehouse.ID,
+		Status:         RefillRequested,
+		History:        []RefillEvent{{Status: RefillRequested, At: now}},
+		RequestedAt:    now,
+		UpdatedAt:      now,
+	}
+	d.Refills.Upsert(refill.ID, refill)
+	rx.RefillsRemaining--
+	d.Prescriptions.Upsert(rx.ID, rx)
+	return refill, nil
+}
+
+// setRefillStatus records a refill's move to status, logging a move
+// refillMachine refuses. Callers must hold d.mu.
+func (d *Database) setRefillStatus(refill *Refill, status RefillStatus, now time.Time) {
+	if err := statemachine.Move(refillMachine, refill, &refill.Status, nil, status, now); err != nil {
+		log.Printf("Moving refill %s: %v", refill.ID, err)
+		return
+	}
+	refill.History = append(refill.History, RefillEvent{Status: status, At: now})
+	refill.UpdatedAt = now
+	d.Refills.Upsert(refill.ID, *refill)
+}
+
+// AdvanceRefills moves refills along the pharmacy queue and notifies
+// members when one is ready.
+func (d *Database) AdvanceRefills(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	advanced := 0
+	for _, refill := range d.Refills.List() {
+		switch {
+		case refill.Status == RefillRequested && !now.Before(refill.UpdatedAt.Add(refillQueueTime)):
+			d.setRefillStatus(&refill, RefillFilling, now)
+		case refill.Status == RefillFilling && !now.Before(refill.UpdatedAt.Add(refillFillTime)):
+			d.setRefillStatus(&refill, RefillReady, now)
+			rx, _ := d.Prescriptions.Get(refill.PrescriptionID)
+			rx.LastFilledAt = now
+			d.Prescriptions.Upsert(rx.ID, rx)
+			warehouse, _ := d.Warehouses.Get(refill.WarehouseID)
+			message := fmt.Sprintf("Your %s %s (Rx %s) is ready for pickup at %s.", rx.Medication, rx.Strength, rx.RxNumber, warehouse.Name)
+			d.Notify(server.Notification{
+				UserEmail:  refill.UserEmail,
+				Type:       "refill_ready",
+				Message:    message,
+				Collection: "refills",
+				EntityID:   refill.ID,
+				CreatedAt:  now,
+			})
+			d.SendEmail(server.Email{
+				From:       "pharmacy@costco.com",
+				To:         refill.UserEmail,
+				Subject:    "Your prescription is ready for pickup",
+				Body:       message + "\n\nPlease bring your membership card.\n",
+				Collection: "refills",
+				EntityID:   refill.ID,
+				SentAt:     now,
+			})
+		default:
+			continue
+		}
+		advanced++
+	}
+	return advanced
+}
+
+// UpdateRefill cancels a refill that hasn't started filling, returning the
+// refill to the prescription, or marks a ready refill picked up.
+func (d *Database) UpdateRefill(email, refillID string, status RefillStatus) (Refill, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	refill, exists := d.Refills.Get(refillID)
+	if !exists || refill.UserEmail != email {
+		return Refill{}, ErrRefillNotFound
+	}
+	// The pharmacy fills refills; members only cancel or pick them up
+	if (status != RefillCancelled && status != RefillPickedUp) || !refillMachine.Allows(string(refill.Status), string(status)) {
+		return Refill{}, ErrRefillStatus
 	}
+	if status == RefillCancelled {
+		rx, _ := d.Prescriptions.Get(refill.PrescriptionID)
+		rx.RefillsRemaining++
+		d.Prescriptions.Upsert(rx.ID, rx)
+	}
+	d.setRefillStatus(&refill, status, d.clock.Now())
+	return refill, nil
+}
 
-	db = &Database{
-		Users:      make(map[string]User),
-		Products:   make(map[string]Product),
-		Warehouses: make(map[string]Warehouse),
-		Orders:     make(map[string]Order),
+func (h *handlers) runPharmacy(interval time.Duration) {
+	h.clock.Every(interval, func(now time.Time) {
+		db := h.db.Get()
+		if n := db.AdvanceRefills(now); n > 0 {
+			log.Printf("Advanced %d refill(s)", n)
+		}
+	})
+}
+
+// Helper functions
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	return json.Unmarshal(data, db)
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	db.ProductIndex = indexProducts(&db.Products)
+	db.WarehouseIndex = indexWarehouses(&db.Warehouses)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Product routes
-	api.Get("/products", getProducts)
+	api.Get("/products", h.getProducts)
 	api.Get("/products/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
-		product, err := db.GetProduct(id)
+		product, err := db.GetProductDetail(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(product)
 	})
 
 	// Membership routes
-	api.Get("/membership", getMembership)
+	api.Get("/membership", h.getMembership)
+	api.Post("/membership/renew", h.membershipHandler((*Database).RenewMembership))
+	api.Post("/membership/upgrade", h.membershipHandler((*Database).UpgradeMembership))
+	api.Put("/membership/auto-renewal", h.setAutoRenewal)
+	api.Post("/membership/cancel", h.membershipHandler((*Database).CancelMembership))
 
 	// Warehouse routes
-	api.Get("/warehouses", getWarehouses)
+	api.Get("/warehouses", h.getWarehouses)
 	api.Get("/warehouses/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		warehouse, err := db.GetWarehouse(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(warehouse)
 	})
+	api.Get("/warehouses/:id/gas", h.getWarehouseGas)
+	api.Get("/warehouses/:id/stock", h.getWarehouseStock)
+
+	// Gas routes
+	api.Get("/gas/nearby", h.findCheapestGas)
+
+	// Pharmacy routes
+	api.Get("/pharmacy/prescriptions", h.getPrescriptions)
+	api.Post("/pharmacy/prescriptions/:id/refills", h.requestRefill)
+	api.Get("/pharmacy/refills", h.getRefills)
+	api.Post("/pharmacy/refills/:id/cancel", h.refillHandler(RefillCancelled))
+	api.Post("/pharmacy/refills/:id/pickup", h.refillHandler(RefillPickedUp))
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", createOrder)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.createOrder)
+	// Warehouse staff close out orders once they are picked up or delivered;
+	// members completing their own would accrue rewards on demand.
+	api.Post("/orders/:id/complete", server.RequireRole(server.RoleAdmin), h.completeOrder)
+	api.Post("/orders/:id/returns", h.createReturn)
+	api.Get("/returns", h.getReturns)
+
+	// Rewards routes
+	api.Get("/rewards", h.getRewards)
+
+	// Cart routes
+	api.Get("/cart", h.getCart)
+	api.Post("/cart/items", h.addCartItem)
+	api.Put("/cart/items/:productId", h.updateCartItem)
+	api.Delete("/cart/items/:productId", h.removeCartItem)
+	api.Delete("/cart", h.clearCart)
+	api.Put("/cart/fulfillment", h.setFulfillment)
+	api.Post("/cart/checkout", h.checkout)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	deliveryFee = cfg.Fee("delivery", deliveryFee)
+	salesTaxRate = cfg.TaxRate(salesTaxRate)
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders", "returns", "reward_certificates", "prescriptions", "refills", "notifications", "carts"},
+			Search:  []string{"products", "warehouses", "gas_stations", "orders", "returns", "prescriptions"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+	go h.runGasPriceUpdates(time.Minute)
+	go h.runPharmacy(time.Minute)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,32 +1,37 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/payments"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Course struct {
-	ID            string    `json:"id"`
-	Title         string    `json:"title"`
-	Description   string    `json:"description"`
-	Category      string    `json:"category"`
-	Difficulty    string    `json:"difficulty"`
-	Instructor    string    `json:"instructor"`
-	DurationWeeks int       `json:"duration_weeks"`
-	Rating        float64   `json:"rating"`
-	Modules       []Module  `json:"modules"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID              string      `json:"id"`
+	Title           string      `json:"title"`
+	Description     string      `json:"description"`
+	Category        string      `json:"category"`
+	Difficulty      string      `json:"difficulty"`
+	Instructor      string      `json:"instructor"`
+	InstructorEmail string      `json:"instructor_email"`
+	DurationWeeks   int         `json:"duration_weeks"`
+	Price           money.Money `json:"price"` // 0 for free courses
+	Rating          float64     `json:"rating"`
+	Modules         []Module    `json:"modules"`
+	CreatedAt       time.Time   `json:"created_at"`
 }
 
 type Module struct {
@@ -40,9 +45,53 @@ type Module struct {
 }
 
 type Quiz struct {
-	ID        string     `json:"id"`
-	Questions []Question `json:"questions"`
-	PassScore float64    `json:"pass_score"`
+	ID          string     `json:"id"`
+	Questions   []Question `json:"questions"`
+	PassScore   float64    `json:"pass_score"`
+	MaxAttempts int        `json:"max_attempts"`
+}
+
+// defaultMaxAttempts applies to quizzes that don't set their own limit.
+const defaultMaxAttempts = 3
+
+func (q Quiz) AttemptLimit() int {
+	if q.MaxAttempts > 0 {
+		return q.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+// PublicQuestion is a Question with the answer key removed.
+type PublicQuestion struct {
+	ID      string   `json:"id"`
+	Text    string   `json:"text"`
+	Options []string `json:"options"`
+	Points  int      `json:"points"`
+}
+
+type PublicQuiz struct {
+	ID          string           `json:"id"`
+	Questions   []PublicQuestion `json:"questions"`
+	PassScore   float64          `json:"pass_score"`
+	MaxAttempts int              `json:"max_attempts"`
+}
+
+func (q Quiz) Public() PublicQuiz {
+	questions := make([]PublicQuestion, len(q.Questions))
+	for i, question := range q.Questions {
+		questions[i] = PublicQuestion{
+			ID:      question.ID,
+			Text:    question.Text,
+			Options: question.Options,
+			Points:  question.Points,
+		}
+	}
+	return PublicQuiz{
+		ID:          q.ID,
+		Questions:   questions,
+		PassScore:   q.PassScore,
+		MaxAttempts: q.AttemptLimit(),
+	}
 }
 
 type Question struct {
@@ -54,11 +103,58 @@ type Question struct {
 }
 
 type User struct {
-	Email          string    `json:"email"`
-	Name           string    `json:"name"`
-	JoinDate       time.Time `json:"join_date"`
-	Interests      []string  `json:"interests"`
-	Certifications []string  `json:"certifications"`
+	Email          string          `json:"email"`
+	Name           string          `json:"name"`
+	JoinDate       time.Time       `json:"join_date"`
+	Interests      []string        `json:"interests"`
+	Certifications []string        `json:"certifications"`
+	PaymentMethods []PaymentMethod `json:"payment_methods"`
+}
+
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Last4    string `json:"last4"`
+	ExpiryMM int    `json:"expiry_mm"`
+	ExpiryYY int    `json:"expiry_yy"`
+}
+
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
+}
+
+// expired reports whether the card's expiry month has passed.
+func (pm PaymentMethod) expired(now time.Time) bool {
+	year := 2000 + pm.ExpiryYY
+	return year < now.Year() || (year == now.Year() && pm.ExpiryMM < int(now.Month()))
+}
+
+type FinancialAidStatus string
+
+const (
+	FinancialAidPending  FinancialAidStatus = "pending"
+	FinancialAidApproved FinancialAidStatus = "approved"
+	FinancialAidRejected FinancialAidStatus = "rejected"
+)
+
+// financialAidMachine is the statuses a financial aid application moves
+// through: the course's instructor reviews it once.
+var financialAidMachine = &statemachine.Machine{Name: "financial aid application", Moves: map[string][]string{
+	string(FinancialAidPending): {string(FinancialAidApproved), string(FinancialAidRejected)},
+}}
+
+type FinancialAidApplication struct {
+	ID           string             `json:"id"`
+	UserEmail    string             `json:"user_email"`
+	CourseID     string             `json:"course_id"`
+	Reason       string             `json:"reason"`
+	AnnualIncome money.Money        `json:"annual_income"`
+	Status       FinancialAidStatus `json:"status"`
+	ReviewerNote string             `json:"reviewer_note,omitempty"`
+	SubmittedAt  time.Time          `json:"submitted_at"`
+	ReviewedAt   *time.Time         `json:"reviewed_at,omitempty"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
 }
 
 type Enrollment struct {
@@ -66,9 +162,73 @@ type Enrollment struct {
 	CourseID     string    `json:"course_id"`
 	UserEmail    string    `json:"user_email"`
 	Status       string    `json:"status"` // active, completed, dropped
+	Mode         string    `json:"mode"`   // full, audit
+	SessionID    string    `json:"session_id,omitempty"`
+	ChargeID     string    `json:"charge_id,omitempty"`
+	AidID        string    `json:"financial_aid_id,omitempty"`
 	EnrolledAt   time.Time `json:"enrolled_at"`
 	LastAccessed time.Time `json:"last_accessed"`
 	Progress     Progress  `json:"progress"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+}
+
+// enrollmentMachine is the statuses a course enrollment moves through,
+// until the learner finishes every module or drops the course.
+var enrollmentMachine = &statemachine.Machine{Name: "enrollment", Moves: map[string][]string{
+	"active": {"completed", "dropped"},
+}}
+
+// Session is a scheduled run of a course. Module deadlines are spread evenly
+// across the course's duration and fall at the end of a week.
+type Session struct {
+	ID        string    `json:"id"`
+	CourseID  string    `json:"course_id"`
+	StartDate time.Time `json:"start_date"`
+	EndDate   time.Time `json:"end_date"`
+}
+
+type ModuleDeadline struct {
+	ModuleID string    `json:"module_id"`
+	Title    string    `json:"title"`
+	Week     int       `json:"week"`
+	DueAt    time.Time `json:"due_at"`
+}
+
+// PaceStatus compares an enrollment's progress with its session's deadlines.
+type PaceStatus struct {
+	SessionID        string          `json:"session_id"`
+	Status           string          `json:"status"` // not_started, on_track, behind, completed
+	CurrentWeek      int             `json:"current_week"`
+	ExpectedModules  int             `json:"expected_modules"`
+	CompletedModules int             `json:"completed_modules"`
+	ModulesBehind    int             `json:"modules_behind"`
+	ExpectedModule   string          `json:"expected_module,omitempty"`
+	NextDeadline     *ModuleDeadline `json:"next_deadline,omitempty"`
+}
+
+// EnrollmentView is an enrollment with its computed pace.
+type EnrollmentView struct {
+	Enrollment
+	Pace *PaceStatus `json:"pace,omitempty"`
+}
+
+type ScheduleItem struct {
+	ModuleDeadline
+	DurationMinutes int    `json:"duration_minutes"`
+	Status          string `json:"status"` // completed, overdue, due_this_week, upcoming
+	DaysRemaining   int    `json:"days_remaining"`
+}
+
+type Schedule struct {
+	EnrollmentID            string         `json:"enrollment_id"`
+	CourseID                string         `json:"course_id"`
+	Session                 Session        `json:"session"`
+	Pace                    PaceStatus     `json:"pace"`
+	Modules                 []ScheduleItem `json:"modules"`
+	RemainingMinutes        int            `json:"remaining_minutes"`
+	WeeksLeft               int            `json:"weeks_left"`
+	SuggestedMinutesPerWeek int            `json:"suggested_minutes_per_week"`
 }
 
 type Progress struct {
@@ -82,27 +242,160 @@ type Progress struct {
 type Attempt struct {
 	QuizID    string    `json:"quiz_id"`
 	Score     float64   `json:"score"`
+	Passed    bool      `json:"passed"`
 	Timestamp time.Time `json:"timestamp"`
 }
 
+// Thread is a forum discussion scoped to a course, and optionally to one of
+// its modules.
+type Thread struct {
+	ID                 string    `json:"id"`
+	CourseID           string    `json:"course_id"`
+	ModuleID           string    `json:"module_id,omitempty"`
+	AuthorEmail        string    `json:"author_email"`
+	Title              string    `json:"title"`
+	Body               string    `json:"body"`
+	Upvotes            int       `json:"upvotes"`
+	UpvotedBy          []string  `json:"upvoted_by,omitempty"`
+	ReplyCount         int       `json:"reply_count"`
+	HighlightedReplyID string    `json:"highlighted_reply_id,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+	LastActivityAt     time.Time `json:"last_activity_at"`
+}
+
+type Reply struct {
+	ID                    string    `json:"id"`
+	ThreadID              string    `json:"thread_id"`
+	AuthorEmail           string    `json:"author_email"`
+	Body                  string    `json:"body"`
+	Upvotes               int       `json:"upvotes"`
+	UpvotedBy             []string  `json:"upvoted_by,omitempty"`
+	InstructorHighlighted bool      `json:"instructor_highlighted"`
+	CreatedAt             time.Time `json:"created_at"`
+}
+
+// Specialization is an ordered bundle of courses completed by a capstone.
+type Specialization struct {
+	ID               string   `json:"id"`
+	Title            string   `json:"title"`
+	Description      string   `json:"description"`
+	CourseIDs        []string `json:"course_ids"`
+	CapstoneCourseID string   `json:"capstone_course_id"`
+}
+
+type SpecializationEnrollment struct {
+	ID               string     `json:"id"`
+	SpecializationID string     `json:"specialization_id"`
+	UserEmail        string     `json:"user_email"`
+	Status           string     `json:"status"` // active, completed
+	EnrolledAt       time.Time  `json:"enrolled_at"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+	CertificateID    string     `json:"certificate_id,omitempty"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+}
+
+// specializationMachine is the statuses a specialization enrollment moves
+// through, completed once its certificate is issued.
+var specializationMachine = &statemachine.Machine{Name: "specialization enrollment", Moves: map[string][]string{
+	"active": {"completed"},
+}}
+
+type CourseProgressSummary struct {
+	CourseID             string  `json:"course_id"`
+	Title                string  `json:"title"`
+	Order                int     `json:"order"`
+	EnrollmentID         string  `json:"enrollment_id,omitempty"`
+	Status               string  `json:"status"` // not_started, active, completed
+	CompletionPercentage float64 `json:"completion_percentage"`
+	Capstone             bool    `json:"capstone"`
+}
+
+type SpecializationProgress struct {
+	SpecializationEnrollment
+	CoursesCompleted     int                     `json:"courses_completed"`
+	CoursesTotal         int                     `json:"courses_total"`
+	CompletionPercentage float64                 `json:"completion_percentage"`
+	NextCourseID         string                  `json:"next_course_id,omitempty"`
+	Courses              []CourseProgressSummary `json:"courses"`
+}
+
+type Certificate struct {
+	ID               string    `json:"id"`
+	UserEmail        string    `json:"user_email"`
+	SpecializationID string    `json:"specialization_id"`
+	Title            string    `json:"title"`
+	VerificationCode string    `json:"verification_code"`
+	IssuedAt         time.Time `json:"issued_at"`
+}
+
 // Database represents our in-memory database
 type Database struct {
-	Users       map[string]User       `json:"users"`
-	Courses     map[string]Course     `json:"courses"`
-	Enrollments map[string]Enrollment `json:"enrollments"`
-	Quizzes     map[string]Quiz       `json:"quizzes"`
-	mu          sync.RWMutex
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+
+	Users                     server.Repository[User]                     `json:"users"`
+	Courses                   server.Repository[Course]                   `json:"courses"`
+	Enrollments               server.Repository[Enrollment]               `json:"enrollments"`
+	Sessions                  server.Repository[Session]                  `json:"sessions"`
+	Quizzes                   server.Repository[Quiz]                     `json:"quizzes"`
+	Threads                   server.Repository[Thread]                   `json:"threads"`
+	Replies                   server.Repository[Reply]                    `json:"replies"`
+	Specializations           server.Repository[Specialization]           `json:"specializations"`
+	SpecializationEnrollments server.Repository[SpecializationEnrollment] `json:"specialization_enrollments"`
+	Certificates              server.Repository[Certificate]              `json:"certificates"`
+	FinancialAid              server.Repository[FinancialAidApplication]  `json:"financial_aid"`
+	mu                        sync.RWMutex
+	clock                     *server.Clock
+}
+
+// handlers enroll Coursera learners in courses and specializations, grade
+// their quizzes and keep the forums, dating it all by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
 }
 
-// Global database instance
-var db *Database
+// newHandlers loads the courses and enrollments in store and schedules their
+// sessions as of clock.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Error definitions
 var (
-	ErrUserNotFound       = errors.New("user not found")
-	ErrCourseNotFound     = errors.New("course not found")
-	ErrEnrollmentNotFound = errors.New("enrollment not found")
-	ErrInvalidInput       = errors.New("invalid input")
+	ErrUserNotFound            = errors.New("user not found")
+	ErrCourseNotFound          = errors.New("course not found")
+	ErrEnrollmentNotFound      = errors.New("enrollment not found")
+	ErrInvalidInput            = errors.New("invalid input")
+	ErrQuizNotFound            = errors.New("quiz not found")
+	ErrQuizNotInCourse         = errors.New("quiz is not part of the enrolled course")
+	ErrEnrollmentInactive      = errors.New("enrollment is not active")
+	ErrAttemptLimit            = errors.New("quiz attempt limit reached")
+	ErrQuizNotPassed           = errors.New("module quiz has not been passed")
+	ErrModuleNotFound          = errors.New("module not found in course")
+	ErrThreadNotFound          = errors.New("thread not found")
+	ErrReplyNotFound           = errors.New("reply not found")
+	ErrNotEnrolled             = errors.New("user is not enrolled in this course")
+	ErrNotInstructor           = errors.New("only the course instructor can highlight answers")
+	ErrAlreadyUpvoted          = errors.New("already upvoted")
+	ErrSpecializationNotFound  = errors.New("specialization not found")
+	ErrAlreadyInSpecialization = errors.New("already enrolled in this specialization")
+	ErrSessionNotFound         = errors.New("session not found")
+	ErrSessionWrongCourse      = errors.New("session belongs to a different course")
+	ErrSessionClosed           = errors.New("session is no longer open for enrollment")
+	ErrPaymentRequired         = errors.New("payment_method_id is required for paid courses")
+	ErrPaymentMethodNotFound   = errors.New("payment method not found")
+	ErrPaymentMethodExpired    = errors.New("payment method has expired")
+	ErrAuditAccess             = errors.New("graded assignments require a full enrollment")
+	ErrAlreadyFullAccess       = errors.New("enrollment already has full access")
+	ErrCourseFree              = errors.New("course is free; financial aid is not needed")
+	ErrFinancialAidNotFound    = errors.New("financial aid application not found")
+	ErrFinancialAidExists      = errors.New("financial aid application already submitted for this course")
+	ErrFinancialAidFinal       = errors.New("financial aid application has already been reviewed")
+	ErrNotAidReviewer          = errors.New("only the course instructor can review financial aid")
 )
 
 // Database operations
@@ -110,7 +403,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -121,18 +414,37 @@ func (d *Database) GetCourse(id string) (Course, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	course, exists := d.Courses[id]
+	course, exists := d.Courses.Get(id)
 	if !exists {
 		return Course{}, ErrCourseNotFound
 	}
 	return course, nil
 }
 
-func (d *Database) CreateEnrollment(enrollment Enrollment) error {
+// CreateEnrollment stores a new enrollment in the requested session, or in
+// the next upcoming session of the course when none is given. Full
+// enrollments in paid courses are charged to the payment method unless the
+// user has approved financial aid, through pay; audit enrollments are
+// always free.
+func (d *Database) CreateEnrollment(enrollment *Enrollment, paymentMethodID string, pay server.Charger) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Enrollments[enrollment.ID] = enrollment
+	now := d.clock.Now()
+	if enrollment.SessionID == "" {
+		if session, ok := d.defaultSession(enrollment.CourseID, now); ok {
+			enrollment.SessionID = session.ID
+		}
+	} else if _, err := d.openSession(enrollment.SessionID, enrollment.CourseID, now); err != nil {
+		return err
+	}
+	if enrollment.Mode != "audit" {
+		if err := d.unlockFullAccess(enrollment, paymentMethodID, now, pay); err != nil {
+			return err
+		}
+	}
+
+	d.Enrollments.Upsert(enrollment.ID, *enrollment)
 	return nil
 }
 
@@ -140,291 +452,1807 @@ func (d *Database) UpdateProgress(enrollmentID string, progress Progress) error
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	enrollment, exists := d.Enrollments[enrollmentID]
+	enrollment, exists := d.Enrollments.Get(enrollmentID)
 	if !exists {
 		return ErrEnrollmentNotFound
 	}
 
 	enrollment.Progress = progress
-	enrollment.LastAccessed = time.Now()
-	d.Enrollments[enrollmentID] = enrollment
+	enrollment.LastAccessed = d.clock.Now()
+	d.Enrollments.Upsert(enrollmentID, enrollment)
 	return nil
 }
 
-// HTTP Handlers
-func getCourses(c *fiber.Ctx) error {
-	category := c.Query("category")
-	difficulty := c.Query("difficulty")
-
-	var filteredCourses []Course
+// unlockFullAccess gives an enrollment full access, through approved
+// financial aid or by charging the course price through pay. Callers must
+// hold d.mu.
+func (d *Database) unlockFullAccess(enrollment *Enrollment, paymentMethodID string, now time.Time, pay server.Charger) error {
+	course, _ := d.Courses.Get(enrollment.CourseID)
+	if !course.Price.IsPositive() {
+		enrollment.Mode = "full"
+		return nil
+	}
+	if aid, ok := d.approvedAid(enrollment.UserEmail, course.ID); ok {
+		enrollment.Mode = "full"
+		enrollment.AidID = aid.ID
+		return nil
+	}
+	if paymentMethodID == "" {
+		return ErrPaymentRequired
+	}
 
-	db.mu.RLock()
-	for _, course := range db.Courses {
-		if (category == "" || course.Category == category) &&
-			(difficulty == "" || course.Difficulty == difficulty) {
-			filteredCourses = append(filteredCourses, course)
+	user, _ := d.Users.Get(enrollment.UserEmail)
+	var method *PaymentMethod
+	for i := range user.PaymentMethods {
+		if user.PaymentMethods[i].ID == paymentMethodID {
+			method = &user.PaymentMethods[i]
+			break
 		}
 	}
-	db.mu.RUnlock()
-
-	return c.JSON(filteredCourses)
-}
+	if method == nil {
+		return ErrPaymentMethodNotFound
+	}
+	if method.expired(now) {
+		return ErrPaymentMethodExpired
+	}
 
-func getEnrollments(c *fiber.Ctx) error {
-	email := c.Query("email")
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+	charge, err := pay(server.ChargeRequest{
+		UserEmail:       enrollment.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          course.Price,
+		Description:     "Enrollment " + enrollment.ID + " in " + course.Title,
+		Capture:         true,
+	})
+	if err != nil {
+		return err
 	}
+	enrollment.Mode = "full"
+	enrollment.ChargeID = charge.ID
+	return nil
+}
 
-	var userEnrollments []Enrollment
-	db.mu.RLock()
-	for _, enrollment := range db.Enrollments {
-		if enrollment.UserEmail == email {
-			userEnrollments = append(userEnrollments, enrollment)
+// approvedAid finds the user's approved financial aid for a course. Callers
+// must hold d.mu.
+func (d *Database) approvedAid(email, courseID string) (FinancialAidApplication, bool) {
+	for _, aid := range d.FinancialAid.List() {
+		if aid.UserEmail == email && aid.CourseID == courseID && aid.Status == FinancialAidApproved {
+			return aid, true
 		}
 	}
-	db.mu.RUnlock()
-
-	return c.JSON(userEnrollments)
+	return FinancialAidApplication{}, false
 }
 
-func createEnrollment(c *fiber.Ctx) error {
-	var req struct {
-		CourseID  string `json:"course_id"`
-		UserEmail string `json:"user_email"`
-	}
+// UpgradeEnrollment turns an active audit enrollment into a full one,
+// keeping its progress.
+func (d *Database) UpgradeEnrollment(enrollmentID, paymentMethodID string, pay server.Charger) (Enrollment, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	enrollment, exists := d.Enrollments.Get(enrollmentID)
+	if !exists {
+		return Enrollment{}, ErrEnrollmentNotFound
 	}
-
-	// Verify user exists
-	if _, err := db.GetUser(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	if enrollment.Status != "active" {
+		return Enrollment{}, ErrEnrollmentInactive
 	}
-
-	// Verify course exists
-	course, err := db.GetCourse(req.CourseID)
-	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	if enrollment.Mode != "audit" {
+		return Enrollment{}, ErrAlreadyFullAccess
 	}
-
-	// Check if already enrolled
-	db.mu.RLock()
-	for _, enrollment := range db.Enrollments {
-		if enrollment.UserEmail == req.UserEmail &&
-			enrollment.CourseID == req.CourseID &&
-			enrollment.Status == "active" {
-			db.mu.RUnlock()
-			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-				"error": "Already enrolled in this course",
-			})
-		}
+	if err := d.unlockFullAccess(&enrollment, paymentMethodID, d.clock.Now(), pay); err != nil {
+		return Enrollment{}, err
 	}
-	db.mu.RUnlock()
+	d.Enrollments.Upsert(enrollment.ID, enrollment)
+	return enrollment, nil
+}
 
-	// Create new enrollment
-	enrollment := Enrollment{
-		ID:           uuid.New().String(),
-		CourseID:     req.CourseID,
-		UserEmail:    req.UserEmail,
-		Status:       "active",
-		EnrolledAt:   time.Now(),
-		LastAccessed: time.Now(),
-		Progress: Progress{
-			CompletedModules:     []string{},
-			CompletionPercentage: 0,
-			CurrentModule:        course.Modules[0].ID,
-			LastQuizScore:        0,
-			QuizAttempts:         []Attempt{},
-		},
-	}
+// ApplyForFinancialAid files an application for a paid course. A user can
+// have one pending or approved application per course.
+func (d *Database) ApplyForFinancialAid(application FinancialAidApplication) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	if err := db.CreateEnrollment(enrollment); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create enrollment",
-		})
+	if _, exists := d.Users.Get(application.UserEmail); !exists {
+		return ErrUserNotFound
+	}
+	course, exists := d.Courses.Get(application.CourseID)
+	if !exists {
+		return ErrCourseNotFound
+	}
+	if !course.Price.IsPositive() {
+		return ErrCourseFree
+	}
+	for _, aid := range d.FinancialAid.List() {
+		if aid.UserEmail == application.UserEmail && aid.CourseID == course.ID && aid.Status != FinancialAidRejected {
+			return ErrFinancialAidExists
+		}
+	}
+	if existing, found := d.latestEnrollment(application.UserEmail, course.ID); found &&
+		existing.Status != "dropped" && existing.Mode != "audit" {
+		return ErrAlreadyFullAccess
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(enrollment)
+	d.FinancialAid.Upsert(application.ID, application)
+	return nil
 }
 
-func getProgress(c *fiber.Ctx) error {
-	enrollmentID := c.Params("enrollmentId")
+func (d *Database) GetUserFinancialAid(email string) []FinancialAidApplication {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	db.mu.RLock()
-	enrollment, exists := db.Enrollments[enrollmentID]
-	db.mu.RUnlock()
+	applications := d.FinancialAid.By("user_email", email)
+	sort.Slice(applications, func(i, j int) bool {
+		return applications[i].SubmittedAt.After(applications[j].SubmittedAt)
+	})
+	return applications
+}
+
+// GetCourseFinancialAid lists a course's applications for its instructor,
+// oldest first so the review queue is worked in order.
+func (d *Database) GetCourseFinancialAid(courseID, reviewerEmail string) ([]FinancialAidApplication, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
+	course, exists := d.Courses.Get(courseID)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Enrollment not found",
-		})
+		return nil, ErrCourseNotFound
+	}
+	if reviewerEmail != course.InstructorEmail {
+		return nil, ErrNotAidReviewer
 	}
 
-	return c.JSON(enrollment.Progress)
+	applications := d.FinancialAid.By("course_id", courseID)
+	sort.Slice(applications, func(i, j int) bool {
+		return applications[i].SubmittedAt.Before(applications[j].SubmittedAt)
+	})
+	return applications, nil
 }
 
-func updateProgress(c *fiber.Ctx) error {
-	enrollmentID := c.Params("enrollmentId")
+// ReviewFinancialAid approves or rejects a pending application. Approval
+// upgrades the applicant's active audit enrollment to full access.
+func (d *Database) ReviewFinancialAid(id, reviewerEmail string, status FinancialAidStatus, note string) (FinancialAidApplication, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	var req struct {
-		CompletedModule string  `json:"completed_module"`
-		QuizScore       float64 `json:"quiz_score"`
+	aid, exists := d.FinancialAid.Get(id)
+	if !exists {
+		return FinancialAidApplication{}, ErrFinancialAidNotFound
 	}
-
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	course, _ := d.Courses.Get(aid.CourseID)
+	if reviewerEmail != course.InstructorEmail {
+		return FinancialAidApplication{}, ErrNotAidReviewer
 	}
-
-	db.mu.Lock()
-	enrollment, exists := db.Enrollments[enrollmentID]
-	if !exists {
-		db.mu.Unlock()
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Enrollment not found",
-		})
+	now := d.clock.Now()
+	if err := statemachine.Move(financialAidMachine, &aid, &aid.Status, &aid.StatusHistory, status, now); err != nil {
+		return FinancialAidApplication{}, ErrFinancialAidFinal
+	}
+	aid.ReviewerNote = note
+	aid.ReviewedAt = &now
+	d.FinancialAid.Upsert(aid.ID, aid)
+
+	if status == FinancialAidApproved {
+		if enrollment, found := d.latestEnrollment(aid.UserEmail, aid.CourseID); found &&
+			enrollment.Status == "active" && enrollment.Mode == "audit" {
+			enrollment.Mode = "full"
+			enrollment.AidID = aid.ID
+			d.Enrollments.Upsert(enrollment.ID, enrollment)
+		}
 	}
+	return aid, nil
+}
 
-	// Update progress
-	if req.CompletedModule != "" {
-		enrollment.Progress.CompletedModules = append(
-			enrollment.Progress.CompletedModules,
-			req.CompletedModule,
-		)
+func (d *Database) GetQuiz(id string) (Quiz, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-		// Calculate new completion percentage
-		course, _ := db.GetCourse(enrollment.CourseID)
-		completion := float64(len(enrollment.Progress.CompletedModules)) /
-			float64(len(course.Modules)) * 100
-		enrollment.Progress.CompletionPercentage = completion
+	quiz, exists := d.Quizzes.Get(id)
+	if !exists {
+		return Quiz{}, ErrQuizNotFound
+	}
+	return quiz, nil
+}
 
-		// Update current module if there are more modules
-		for i, module := range course.Modules {
-			if module.ID == req.CompletedModule && i < len(course.Modules)-1 {
-				enrollment.Progress.CurrentModule = course.Modules[i+1].ID
-				break
-			}
+func (p Progress) attemptsFor(quizID string) (count int, passed bool) {
+	for _, attempt := range p.QuizAttempts {
+		if attempt.QuizID == quizID {
+			count++
+			passed = passed || attempt.Passed
 		}
 	}
+	return count, passed
+}
 
-	if req.QuizScore > 0 {
-		enrollment.Progress.LastQuizScore = req.QuizScore
-		enrollment.Progress.QuizAttempts = append(
-			enrollment.Progress.QuizAttempts,
-			Attempt{
-				QuizID:    enrollment.Progress.CurrentModule,
-				Score:     req.QuizScore,
-				Timestamp: time.Now(),
-			},
-		)
+// completeModule marks a module done, recomputes completion percentage and
+// the current module, and completes the enrollment, as of now, once every
+// module is done.
+func completeModule(enrollment *Enrollment, course Course, moduleID string, now time.Time) {
+	for _, done := range enrollment.Progress.CompletedModules {
+		if done == moduleID {
+			return
+		}
+	}
+	enrollment.Progress.CompletedModules = append(enrollment.Progress.CompletedModules, moduleID)
+	if len(course.Modules) > 0 {
+		enrollment.Progress.CompletionPercentage =
+			float64(len(enrollment.Progress.CompletedModules)) / float64(len(course.Modules)) * 100
+	}
+	for i, module := range course.Modules {
+		if module.ID == moduleID && i < len(course.Modules)-1 {
+			enrollment.Progress.CurrentModule = course.Modules[i+1].ID
+			break
+		}
 	}
-
-	// Check if course is completed
 	if enrollment.Progress.CompletionPercentage >= 100 {
-		enrollment.Status = "completed"
+		// An enrollment already completed, or dropped, stays as it is
+		statemachine.Move(enrollmentMachine, enrollment, &enrollment.Status, &enrollment.StatusHistory, "completed", now)
 	}
+}
 
-	db.Enrollments[enrollmentID] = enrollment
-	db.mu.Unlock()
+type QuestionResult struct {
+	QuestionID string `json:"question_id"`
+	Correct    bool   `json:"correct"`
+	Points     int    `json:"points"`
+}
 
-	return c.JSON(enrollment.Progress)
+type QuizSubmissionResult struct {
+	QuizID            string           `json:"quiz_id"`
+	Score             float64          `json:"score"`
+	PassScore         float64          `json:"pass_score"`
+	Passed            bool             `json:"passed"`
+	PointsEarned      int              `json:"points_earned"`
+	PointsPossible    int              `json:"points_possible"`
+	Results           []QuestionResult `json:"results"`
+	AttemptsUsed      int              `json:"attempts_used"`
+	AttemptsRemaining int              `json:"attempts_remaining"`
+	Progress          Progress         `json:"progress"`
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+// SubmitQuiz grades answers (question ID -> option index) against the
+// stored key, records the attempt on the enrollment, and completes the
+// quiz's module when the score reaches the pass mark.
+func (d *Database) SubmitQuiz(enrollmentID, quizID string, answers map[string]int) (QuizSubmissionResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	db = &Database{
-		Users:       make(map[string]User),
-		Courses:     make(map[string]Course),
-		Enrollments: make(map[string]Enrollment),
-		Quizzes:     make(map[string]Quiz),
+	quiz, exists := d.Quizzes.Get(quizID)
+	if !exists {
+		return QuizSubmissionResult{}, ErrQuizNotFound
+	}
+	enrollment, exists := d.Enrollments.Get(enrollmentID)
+	if !exists {
+		return QuizSubmissionResult{}, ErrEnrollmentNotFound
+	}
+	if enrollment.Status != "active" {
+		return QuizSubmissionResult{}, ErrEnrollmentInactive
+	}
+	if enrollment.Mode == "audit" {
+		return QuizSubmissionResult{}, ErrAuditAccess
+	}
+	course, _ := d.Courses.Get(enrollment.CourseID)
+	moduleID := ""
+	for _, module := range course.Modules {
+		if module.QuizID == quizID {
+			moduleID = module.ID
+			break
+		}
+	}
+	if moduleID == "" {
+		return QuizSubmissionResult{}, ErrQuizNotInCourse
 	}
 
-	return json.Unmarshal(data, db)
-}
-
-func setupRoutes(app *fiber.App) {
-	api := app.Group("/api/v1")
+	used, _ := enrollment.Progress.attemptsFor(quizID)
+	if used >= quiz.AttemptLimit() {
+		return QuizSubmissionResult{}, ErrAttemptLimit
+	}
 
-	// Course routes
-	api.Get("/courses", getCourses)
-	api.Get("/courses/:id", func(c *fiber.Ctx) error {
-		id := c.Params("id")
-		course, err := db.GetCourse(id)
-		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+	result := QuizSubmissionResult{
+		QuizID:    quizID,
+		PassScore: quiz.PassScore,
+		Results:   make([]QuestionResult, 0, len(quiz.Questions)),
+	}
+	for _, question := range quiz.Questions {
+		answer, answered := answers[question.ID]
+		correct := answered && answer == question.Answer
+		earned := 0
+		if correct {
+			earned = question.Points
 		}
-		return c.JSON(course)
+		result.PointsEarned += earned
+		result.PointsPossible += question.Points
+		result.Results = append(result.Results, QuestionResult{
+			QuestionID: question.ID,
+			Correct:    correct,
+			Points:     earned,
+		})
+	}
+	if result.PointsPossible > 0 {
+		result.Score = math.Round(float64(result.PointsEarned)/float64(result.PointsPossible)*10000) / 100
+	}
+	result.Passed = result.Score >= quiz.PassScore
+
+	now := d.clock.Now()
+	enrollment.Progress.LastQuizScore = result.Score
+	enrollment.Progress.QuizAttempts = append(enrollment.Progress.QuizAttempts, Attempt{
+		QuizID:    quizID,
+		Score:     result.Score,
+		Passed:    result.Passed,
+		Timestamp: now,
 	})
+	if result.Passed {
+		completeModule(&enrollment, course, moduleID, now)
+	}
+	enrollment.LastAccessed = now
+	d.Enrollments.Upsert(enrollment.ID, enrollment)
+	if enrollment.Status == "completed" {
+		d.onCourseCompleted(enrollment.UserEmail, enrollment.CourseID)
+	}
 
-	// Enrollment routes
-	api.Get("/enrollments", getEnrollments)
-	api.Post("/enrollments", createEnrollment)
-
-	// Progress routes
-	api.Get("/progress/:enrollmentId", getProgress)
-	api.Put("/progress/:enrollmentId", updateProgress)
+	result.AttemptsUsed = used + 1
+	result.AttemptsRemaining = quiz.AttemptLimit() - result.AttemptsUsed
+	result.Progress = enrollment.Progress
+	return result, nil
+}
 
-	// User routes
-	api.Get("/users/:email", func(c *fiber.Ctx) error {
-		email := c.Params("email")
-		user, err := db.GetUser(email)
-		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+// isEnrolled reports whether the user has ever enrolled in the course.
+// Callers must hold d.mu.
+func (d *Database) isEnrolled(email, courseID string) bool {
+	for _, enrollment := range d.Enrollments.List() {
+		if enrollment.UserEmail == email && enrollment.CourseID == courseID {
+			return true
 		}
-		return c.JSON(user)
-	})
+	}
+	return false
 }
 
-func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+// canPost reports whether the user may participate in a course's forum:
+// enrolled learners and the course instructor. Callers must hold d.mu.
+func (d *Database) canPost(email string, course Course) bool {
+	return email == course.InstructorEmail || d.isEnrolled(email, course.ID)
+}
 
-	if err := loadDatabase(); err != nil {
-		log.Fatal(err)
-	}
+func (d *Database) CreateThread(thread Thread) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
+	course, exists := d.Courses.Get(thread.CourseID)
+	if !exists {
+		return ErrCourseNotFound
+	}
+	if thread.ModuleID != "" {
+		found := false
+		for _, module := range course.Modules {
+			if module.ID == thread.ModuleID {
+				found = true
+				break
 			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+		}
+		if !found {
+			return ErrModuleNotFound
+		}
+	}
+	if !d.canPost(thread.AuthorEmail, course) {
+		return ErrNotEnrolled
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(cors.New())
+	d.Threads.Upsert(thread.ID, thread)
+	return nil
+}
 
-	// Setup routes
-	setupRoutes(app)
+// ListThreads returns a course's threads, optionally narrowed to a module,
+// ordered by most recent activity or by upvotes.
+func (d *Database) ListThreads(courseID, moduleID, sortBy string) []Thread {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	threads := []Thread{}
+	for _, thread := range d.Threads.List() {
+		if thread.CourseID != courseID {
+			continue
+		}
+		if moduleID != "" && thread.ModuleID != moduleID {
+			continue
+		}
+		threads = append(threads, thread)
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		if sortBy == "top" && threads[i].Upvotes != threads[j].Upvotes {
+			return threads[i].Upvotes > threads[j].Upvotes
+		}
+		return threads[i].LastActivityAt.After(threads[j].LastActivityAt)
+	})
+	return threads
+}
+
+func (d *Database) GetThread(id string) (Thread, []Reply, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	thread, exists := d.Threads.Get(id)
+	if !exists {
+		return Thread{}, nil, ErrThreadNotFound
+	}
+	replies := d.Replies.By("thread_id", id)
+	// Highlighted answers first, then oldest first like a conversation.
+	sort.Slice(replies, func(i, j int) bool {
+		if replies[i].InstructorHighlighted != replies[j].InstructorHighlighted {
+			return replies[i].InstructorHighlighted
+		}
+		return replies[i].CreatedAt.Before(replies[j].CreatedAt)
+	})
+	return thread, replies, nil
+}
+
+func (d *Database) CreateReply(reply Reply) (Thread, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	thread, exists := d.Threads.Get(reply.ThreadID)
+	if !exists {
+		return Thread{}, ErrThreadNotFound
+	}
+	course, _ := d.Courses.Get(thread.CourseID)
+	if !d.canPost(reply.AuthorEmail, course) {
+		return Thread{}, ErrNotEnrolled
+	}
+
+	thread.ReplyCount++
+	thread.LastActivityAt = reply.CreatedAt
+	d.Threads.Upsert(thread.ID, thread)
+	d.Replies.Upsert(reply.ID, reply)
+	return thread, nil
+}
+
+func hasUpvoted(voters []string, email string) bool {
+	for _, voter := range voters {
+		if voter == email {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Database) UpvoteThread(id, email string) (Thread, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	thread, exists := d.Threads.Get(id)
+	if !exists {
+		return Thread{}, ErrThreadNotFound
+	}
+	course, _ := d.Courses.Get(thread.CourseID)
+	if !d.canPost(email, course) {
+		return Thread{}, ErrNotEnrolled
+	}
+	if hasUpvoted(thread.UpvotedBy, email) {
+		return Thread{}, ErrAlreadyUpvoted
+	}
+
+	thread.UpvotedBy = append(thread.UpvotedBy, email)
+	thread.Upvotes++
+	d.Threads.Upsert(thread.ID, thread)
+	return thread, nil
+}
+
+func (d *Database) UpvoteReply(id, email string) (Reply, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	reply, exists := d.Replies.Get(id)
+	if !exists {
+		return Reply{}, ErrReplyNotFound
+	}
+	thread, _ := d.Threads.Get(reply.ThreadID)
+	course, _ := d.Courses.Get(thread.CourseID)
+	if !d.canPost(email, course) {
+		return Reply{}, ErrNotEnrolled
+	}
+	if hasUpvoted(reply.UpvotedBy, email) {
+		return Reply{}, ErrAlreadyUpvoted
+	}
+
+	reply.UpvotedBy = append(reply.UpvotedBy, email)
+	reply.Upvotes++
+	d.Replies.Upsert(reply.ID, reply)
+	return reply, nil
+}
+
+// HighlightReply marks a reply as the instructor-endorsed answer for its
+// thread, replacing any previous highlight.
+func (d *Database) HighlightReply(id, email string) (Reply, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	reply, exists := d.Replies.Get(id)
+	if !exists {
+		return Reply{}, ErrReplyNotFound
+	}
+	thread, _ := d.Threads.Get(reply.ThreadID)
+	course, _ := d.Courses.Get(thread.CourseID)
+	if course.InstructorEmail != email {
+		return Reply{}, ErrNotInstructor
+	}
+
+	if previous, exists := d.Replies.Get(thread.HighlightedReplyID); exists {
+		previous.InstructorHighlighted = false
+		d.Replies.Upsert(previous.ID, previous)
+	}
+	reply.InstructorHighlighted = true
+	d.Replies.Upsert(reply.ID, reply)
+	thread.HighlightedReplyID = reply.ID
+	d.Threads.Upsert(thread.ID, thread)
+	return reply, nil
+}
+
+// newEnrollment builds a fresh active enrollment positioned at the course's
+// first module.
+func newEnrollment(course Course, email string, now time.Time) Enrollment {
+	enrollment := Enrollment{
+		ID:           server.NewID("ENR"),
+		CourseID:     course.ID,
+		UserEmail:    email,
+		Status:       "active",
+		Mode:         "full",
+		EnrolledAt:   now,
+		LastAccessed: now,
+		Progress: Progress{
+			CompletedModules: []string{},
+			QuizAttempts:     []Attempt{},
+		},
+	}
+	if len(course.Modules) > 0 {
+		enrollment.Progress.CurrentModule = course.Modules[0].ID
+	}
+	return enrollment
+}
+
+// latestEnrollment returns the user's most recent enrollment in a course.
+// Callers must hold d.mu.
+func (d *Database) latestEnrollment(email, courseID string) (Enrollment, bool) {
+	var latest Enrollment
+	found := false
+	for _, enrollment := range d.Enrollments.List() {
+		if enrollment.UserEmail != email || enrollment.CourseID != courseID {
+			continue
+		}
+		if !found || enrollment.EnrolledAt.After(latest.EnrolledAt) {
+			latest = enrollment
+			found = true
+		}
+	}
+	return latest, found
+}
+
+// ensureEnrolled enrolls the user in a course unless they already have an
+// active or completed enrollment. Callers must hold d.mu.
+func (d *Database) ensureEnrolled(email, courseID string) {
+	if existing, found := d.latestEnrollment(email, courseID); found && existing.Status != "dropped" {
+		return
+	}
+	course, exists := d.Courses.Get(courseID)
+	if !exists {
+		return
+	}
+	enrollment := newEnrollment(course, email, d.clock.Now())
+	if session, ok := d.defaultSession(courseID, enrollment.EnrolledAt); ok {
+		enrollment.SessionID = session.ID
+	}
+	d.Enrollments.Upsert(enrollment.ID, enrollment)
+}
+
+func (d *Database) GetSpecialization(id string) (Specialization, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	spec, exists := d.Specializations.Get(id)
+	if !exists {
+		return Specialization{}, ErrSpecializationNotFound
+	}
+	return spec, nil
+}
+
+// EnrollInSpecialization enrolls the user in the specialization and in its
+// first course.
+func (d *Database) EnrollInSpecialization(specID, email string) (SpecializationEnrollment, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Users.Get(email); !exists {
+		return SpecializationEnrollment{}, ErrUserNotFound
+	}
+	spec, exists := d.Specializations.Get(specID)
+	if !exists {
+		return SpecializationEnrollment{}, ErrSpecializationNotFound
+	}
+	for _, existing := range d.SpecializationEnrollments.List() {
+		if existing.UserEmail == email && existing.SpecializationID == specID {
+			return SpecializationEnrollment{}, ErrAlreadyInSpecialization
+		}
+	}
+
+	enrollment := SpecializationEnrollment{
+		ID:               server.NewID("SENR"),
+		SpecializationID: spec.ID,
+		UserEmail:        email,
+		Status:           "active",
+		EnrolledAt:       d.clock.Now(),
+	}
+	d.SpecializationEnrollments.Upsert(enrollment.ID, enrollment)
+	if len(spec.CourseIDs) > 0 {
+		d.ensureEnrolled(email, spec.CourseIDs[0])
+	}
+	// Courses finished before joining still count toward the bundle.
+	d.advanceSpecialization(&enrollment, spec)
+	d.SpecializationEnrollments.Upsert(enrollment.ID, enrollment)
+	return enrollment, nil
+}
+
+// specializationProgress aggregates progress across the member courses.
+// Callers must hold d.mu.
+func (d *Database) specializationProgress(enrollment SpecializationEnrollment) SpecializationProgress {
+	spec, _ := d.Specializations.Get(enrollment.SpecializationID)
+	progress := SpecializationProgress{
+		SpecializationEnrollment: enrollment,
+		CoursesTotal:             len(spec.CourseIDs),
+	}
+
+	total := 0.0
+	for i, courseID := range spec.CourseIDs {
+		course, _ := d.Courses.Get(courseID)
+		summary := CourseProgressSummary{
+			CourseID: courseID,
+			Title:    course.Title,
+			Order:    i + 1,
+			Status:   "not_started",
+			Capstone: courseID == spec.CapstoneCourseID,
+		}
+		if course, found := d.latestEnrollment(enrollment.UserEmail, courseID); found {
+			summary.EnrollmentID = course.ID
+			summary.Status = course.Status
+			summary.CompletionPercentage = course.Progress.CompletionPercentage
+		}
+		if summary.Status == "completed" {
+			summary.CompletionPercentage = 100
+			progress.CoursesCompleted++
+		} else if progress.NextCourseID == "" {
+			progress.NextCourseID = courseID
+		}
+		total += summary.CompletionPercentage
+		progress.Courses = append(progress.Courses, summary)
+	}
+	if len(spec.CourseIDs) > 0 {
+		progress.CompletionPercentage = math.Round(total/float64(len(spec.CourseIDs))*100) / 100
+	}
+	return progress
+}
+
+// advanceSpecialization enrolls the learner in the next unfinished course
+// and, once every course including the capstone is complete, issues the
+// specialization certificate. Callers must hold d.mu.
+func (d *Database) advanceSpecialization(enrollment *SpecializationEnrollment, spec Specialization) {
+	if enrollment.Status == "completed" {
+		return
+	}
+	progress := d.specializationProgress(*enrollment)
+	if progress.NextCourseID != "" {
+		d.ensureEnrolled(enrollment.UserEmail, progress.NextCourseID)
+		return
+	}
+
+	now := d.clock.Now()
+	if err := statemachine.Move(specializationMachine, enrollment, &enrollment.Status, &enrollment.StatusHistory, "completed", now); err != nil {
+		log.Printf("Completing specialization enrollment %s: %v", enrollment.ID, err)
+		return
+	}
+	cert := Certificate{
+		ID:               server.NewID("CERT"),
+		UserEmail:        enrollment.UserEmail,
+		SpecializationID: spec.ID,
+		Title:            spec.Title,
+		VerificationCode: strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:12]),
+		IssuedAt:         now,
+	}
+	d.Certificates.Upsert(cert.ID, cert)
+
+	user, _ := d.Users.Get(enrollment.UserEmail)
+	user.Certifications = append(user.Certifications, spec.Title)
+	d.Users.Upsert(user.Email, user)
+
+	enrollment.CompletedAt = &now
+	enrollment.CertificateID = cert.ID
+}
+
+// onCourseCompleted moves every active specialization containing the course
+// forward. Callers must hold d.mu.
+func (d *Database) onCourseCompleted(email, courseID string) {
+	for _, id := range d.SpecializationEnrollments.Keys() {
+		enrollment, _ := d.SpecializationEnrollments.Get(id)
+		if enrollment.UserEmail != email || enrollment.Status != "active" {
+			continue
+		}
+		spec, _ := d.Specializations.Get(enrollment.SpecializationID)
+		for _, member := range spec.CourseIDs {
+			if member == courseID {
+				d.advanceSpecialization(&enrollment, spec)
+				d.SpecializationEnrollments.Upsert(id, enrollment)
+				break
+			}
+		}
+	}
+}
+
+func (d *Database) GetSpecializationProgress(enrollmentID string) (SpecializationProgress, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	enrollment, exists := d.SpecializationEnrollments.Get(enrollmentID)
+	if !exists {
+		return SpecializationProgress{}, ErrEnrollmentNotFound
+	}
+	return d.specializationProgress(enrollment), nil
+}
+
+func (d *Database) GetUserSpecializations(email string) []SpecializationProgress {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	results := []SpecializationProgress{}
+	for _, enrollment := range d.SpecializationEnrollments.List() {
+		if enrollment.UserEmail == email {
+			results = append(results, d.specializationProgress(enrollment))
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].EnrolledAt.After(results[j].EnrolledAt)
+	})
+	return results
+}
+
+func (d *Database) GetUserCertificates(email string) []Certificate {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	certs := d.Certificates.By("user_email", email)
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].IssuedAt.After(certs[j].IssuedAt)
+	})
+	return certs
+}
+
+// Sessions start every sessionCadence on the anchor's weekday, and can be
+// joined until sessionJoinWindow after they begin.
+var (
+	sessionAnchor          = time.Date(2024, time.January, 8, 0, 0, 0, 0, time.UTC)
+	sessionCadence         = 14 * 24 * time.Hour
+	sessionJoinWindow      = 14 * 24 * time.Hour
+	upcomingSessionHorizon = 6 * 7 * 24 * time.Hour
+)
+
+const week = 7 * 24 * time.Hour
+
+func newSession(course Course, start time.Time) Session {
+	return Session{
+		ID:        course.ID + "-" + start.Format("20060102"),
+		CourseID:  course.ID,
+		StartDate: start,
+		EndDate:   start.Add(time.Duration(course.DurationWeeks) * week),
+	}
+}
+
+// ScheduleSessions makes sure every course has its joinable and upcoming
+// sessions on the cadence. It's idempotent. Callers must hold d.mu.
+func (d *Database) ScheduleSessions(now time.Time) {
+	from := now.Add(-sessionJoinWindow)
+	k := int64(from.Sub(sessionAnchor) / sessionCadence)
+	for start := sessionAnchor.Add(time.Duration(k) * sessionCadence); !start.After(now.Add(upcomingSessionHorizon)); start = start.Add(sessionCadence) {
+		if !start.After(from) {
+			continue
+		}
+		for _, course := range d.Courses.List() {
+			session := newSession(course, start)
+			if _, exists := d.Sessions.Get(session.ID); !exists {
+				d.Sessions.Upsert(session.ID, session)
+			}
+		}
+	}
+}
+
+func (s Session) open(now time.Time) bool {
+	return now.Before(s.StartDate.Add(sessionJoinWindow)) && now.Before(s.EndDate)
+}
+
+// openSession looks up a session of the given course that can still be
+// joined. Callers must hold d.mu.
+func (d *Database) openSession(sessionID, courseID string, now time.Time) (Session, error) {
+	session, exists := d.Sessions.Get(sessionID)
+	if !exists {
+		return Session{}, ErrSessionNotFound
+	}
+	if session.CourseID != courseID {
+		return Session{}, ErrSessionWrongCourse
+	}
+	if !session.open(now) {
+		return Session{}, ErrSessionClosed
+	}
+	return session, nil
+}
+
+// defaultSession picks the earliest session of the course that hasn't started
+// yet. Callers must hold d.mu.
+func (d *Database) defaultSession(courseID string, now time.Time) (Session, bool) {
+	d.ScheduleSessions(now)
+	var next Session
+	found := false
+	for _, session := range d.Sessions.List() {
+		if session.CourseID != courseID || session.StartDate.Before(now) {
+			continue
+		}
+		if !found || session.StartDate.Before(next.StartDate) {
+			next = session
+			found = true
+		}
+	}
+	return next, found
+}
+
+// GetCourseSessions returns the course's sessions that haven't ended yet,
+// soonest first.
+func (d *Database) GetCourseSessions(courseID string) ([]Session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Courses.Get(courseID); !exists {
+		return nil, ErrCourseNotFound
+	}
+	now := d.clock.Now()
+	d.ScheduleSessions(now)
+
+	sessions := d.Sessions.Query(func(session Session) bool {
+		return session.CourseID == courseID && session.EndDate.After(now)
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartDate.Before(sessions[j].StartDate)
+	})
+	return sessions, nil
+}
+
+// moduleDeadlines spreads a course's modules over the session's weeks; module
+// i of n is due at the end of week ceil((i+1) * weeks / n).
+func moduleDeadlines(course Course, session Session) []ModuleDeadline {
+	n := len(course.Modules)
+	weeks := course.DurationWeeks
+	if weeks < 1 {
+		weeks = 1
+	}
+	deadlines := make([]ModuleDeadline, n)
+	for i, module := range course.Modules {
+		dueWeek := ((i+1)*weeks + n - 1) / n
+		deadlines[i] = ModuleDeadline{
+			ModuleID: module.ID,
+			Title:    module.Title,
+			Week:     dueWeek,
+			DueAt:    session.StartDate.Add(time.Duration(dueWeek) * week),
+		}
+	}
+	return deadlines
+}
+
+func (p Progress) completed(moduleID string) bool {
+	for _, done := range p.CompletedModules {
+		if done == moduleID {
+			return true
+		}
+	}
+	return false
+}
+
+func computePace(enrollment Enrollment, course Course, session Session, now time.Time) PaceStatus {
+	deadlines := moduleDeadlines(course, session)
+	pace := PaceStatus{SessionID: session.ID}
+	for _, deadline := range deadlines {
+		if enrollment.Progress.completed(deadline.ModuleID) {
+			pace.CompletedModules++
+		}
+		if !deadline.DueAt.After(now) {
+			pace.ExpectedModules++
+		} else if pace.NextDeadline == nil {
+			next := deadline
+			pace.NextDeadline = &next
+		}
+	}
+	if pace.ExpectedModules < len(deadlines) {
+		pace.ExpectedModule = deadlines[pace.ExpectedModules].ModuleID
+	}
+	if now.After(session.StartDate) {
+		pace.CurrentWeek = int(now.Sub(session.StartDate)/week) + 1
+		if pace.CurrentWeek > course.DurationWeeks {
+			pace.CurrentWeek = course.DurationWeeks
+		}
+	}
+	if pace.ExpectedModules > pace.CompletedModules {
+		pace.ModulesBehind = pace.ExpectedModules - pace.CompletedModules
+	}
+
+	switch {
+	case enrollment.Status == "completed":
+		pace.Status = "completed"
+	case now.Before(session.StartDate):
+		pace.Status = "not_started"
+	case pace.ModulesBehind > 0:
+		pace.Status = "behind"
+	default:
+		pace.Status = "on_track"
+	}
+	return pace
+}
+
+// view attaches the computed pace to an enrollment that has a session.
+// Callers must hold d.mu.
+func (d *Database) view(enrollment Enrollment, now time.Time) EnrollmentView {
+	v := EnrollmentView{Enrollment: enrollment}
+	session, exists := d.Sessions.Get(enrollment.SessionID)
+	if !exists {
+		return v
+	}
+	course, _ := d.Courses.Get(enrollment.CourseID)
+	pace := computePace(enrollment, course, session, now)
+	v.Pace = &pace
+	return v
+}
+
+func (d *Database) GetUserEnrollments(email string) []EnrollmentView {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	now := d.clock.Now()
+	enrollments := []EnrollmentView{}
+	for _, enrollment := range d.Enrollments.List() {
+		if enrollment.UserEmail == email {
+			enrollments = append(enrollments, d.view(enrollment, now))
+		}
+	}
+	sort.Slice(enrollments, func(i, j int) bool {
+		return enrollments[i].EnrolledAt.After(enrollments[j].EnrolledAt)
+	})
+	return enrollments
+}
+
+// SwitchSession moves an active enrollment to another open session of the
+// same course, keeping its progress.
+func (d *Database) SwitchSession(enrollmentID, sessionID string) (EnrollmentView, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	enrollment, exists := d.Enrollments.Get(enrollmentID)
+	if !exists {
+		return EnrollmentView{}, ErrEnrollmentNotFound
+	}
+	if enrollment.Status != "active" {
+		return EnrollmentView{}, ErrEnrollmentInactive
+	}
+	now := d.clock.Now()
+	d.ScheduleSessions(now)
+	session, err := d.openSession(sessionID, enrollment.CourseID, now)
+	if err != nil {
+		return EnrollmentView{}, err
+	}
+
+	enrollment.SessionID = session.ID
+	enrollment.LastAccessed = now
+	d.Enrollments.Upsert(enrollment.ID, enrollment)
+	return d.view(enrollment, now), nil
+}
+
+// GetSchedule lays out an enrollment's module deadlines and how much weekly
+// study time remains to finish by the end of its session.
+func (d *Database) GetSchedule(enrollmentID string) (Schedule, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	enrollment, exists := d.Enrollments.Get(enrollmentID)
+	if !exists {
+		return Schedule{}, ErrEnrollmentNotFound
+	}
+	session, exists := d.Sessions.Get(enrollment.SessionID)
+	if !exists {
+		return Schedule{}, ErrSessionNotFound
+	}
+	course, _ := d.Courses.Get(enrollment.CourseID)
+	now := d.clock.Now()
+
+	schedule := Schedule{
+		EnrollmentID: enrollment.ID,
+		CourseID:     course.ID,
+		Session:      session,
+		Pace:         computePace(enrollment, course, session, now),
+		Modules:      []ScheduleItem{},
+	}
+	weekEnd := now.Add(week)
+	for i, deadline := range moduleDeadlines(course, session) {
+		item := ScheduleItem{
+			ModuleDeadline:  deadline,
+			DurationMinutes: course.Modules[i].Duration,
+			DaysRemaining:   int(math.Ceil(deadline.DueAt.Sub(now).Hours() / 24)),
+		}
+		switch {
+		case enrollment.Progress.completed(deadline.ModuleID):
+			item.Status = "completed"
+		case deadline.DueAt.Before(now):
+			item.Status = "overdue"
+		case deadline.DueAt.Before(weekEnd):
+			item.Status = "due_this_week"
+		default:
+			item.Status = "upcoming"
+		}
+		if item.Status != "completed" {
+			schedule.RemainingMinutes += item.DurationMinutes
+		}
+		schedule.Modules = append(schedule.Modules, item)
+	}
+
+	if session.EndDate.After(now) {
+		schedule.WeeksLeft = int(math.Ceil(session.EndDate.Sub(now).Hours() / (7 * 24)))
+	}
+	// Once the session is over, suggest catching up within a week.
+	weeks := schedule.WeeksLeft
+	if weeks < 1 {
+		weeks = 1
+	}
+	schedule.SuggestedMinutesPerWeek = int(math.Ceil(float64(schedule.RemainingMinutes) / float64(weeks)))
+	return schedule, nil
+}
+
+// HTTP Handlers
+func (h *handlers) getCourses(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	category := c.Query("category")
+	difficulty := c.Query("difficulty")
+
+	var filteredCourses []Course
+
+	db.mu.RLock()
+	for _, course := range db.Courses.List() {
+		if (category == "" || course.Category == category) &&
+			(difficulty == "" || course.Difficulty == difficulty) {
+			filteredCourses = append(filteredCourses, course)
+		}
+	}
+	db.mu.RUnlock()
+
+	return server.List(c, filteredCourses, "category", "difficulty")
+}
+
+func (h *handlers) getEnrollments(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	return server.List(c, db.GetUserEnrollments(email))
+}
+
+func (h *handlers) createEnrollment(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		CourseID        string `json:"course_id"`
+		UserEmail       string `json:"user_email" validate:"email"`
+		SessionID       string `json:"session_id"`
+		Mode            string `json:"mode"`
+		PaymentMethodID string `json:"payment_method_id"`
+	}
+
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	// Verify user exists
+	if _, err := db.GetUser(req.UserEmail); err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	// Verify course exists
+	course, err := db.GetCourse(req.CourseID)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	// Check if already enrolled
+	db.mu.RLock()
+	for _, enrollment := range db.Enrollments.List() {
+		if enrollment.UserEmail == req.UserEmail &&
+			enrollment.CourseID == req.CourseID &&
+			enrollment.Status == "active" {
+			db.mu.RUnlock()
+			return server.Fail(c, fiber.StatusConflict, server.CodeConflict, "Already enrolled in this course")
+		}
+	}
+	db.mu.RUnlock()
+
+	// Create new enrollment
+	enrollment := newEnrollment(course, req.UserEmail, h.clock.Now())
+	enrollment.SessionID = req.SessionID
+	switch req.Mode {
+	case "", "full":
+	case "audit":
+		enrollment.Mode = "audit"
+	default:
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "mode must be full or audit")
+	}
+
+	if err := db.CreateEnrollment(&enrollment, req.PaymentMethodID, db.Charger(c)); err != nil {
+		return enrollmentError(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(enrollment)
+}
+
+func (h *handlers) getProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	enrollmentID := c.Params("enrollmentId")
+
+	db.mu.RLock()
+	enrollment, exists := db.Enrollments.Get(enrollmentID)
+	db.mu.RUnlock()
+
+	if !exists {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Enrollment not found")
+	}
+
+	return c.JSON(enrollment.Progress)
+}
+
+func (h *handlers) updateProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	enrollmentID := c.Params("enrollmentId")
+
+	var req struct {
+		CompletedModule string  `json:"completed_module"`
+		QuizScore       float64 `json:"quiz_score"`
+	}
+
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	enrollment, exists := db.Enrollments.Get(enrollmentID)
+	if !exists {
+		db.mu.Unlock()
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Enrollment not found")
+	}
+
+	// Update progress
+	if req.CompletedModule != "" {
+		course, _ := db.Courses.Get(enrollment.CourseID)
+
+		var module *Module
+		for i := range course.Modules {
+			if course.Modules[i].ID == req.CompletedModule {
+				module = &course.Modules[i]
+				break
+			}
+		}
+		if module == nil {
+			db.mu.Unlock()
+			return server.FailWith(c, fiber.StatusBadRequest, ErrModuleNotFound)
+		}
+
+		// Modules with a quiz are only complete once the quiz is passed
+		// through the submissions endpoint.
+		if module.QuizID != "" {
+			if _, passed := enrollment.Progress.attemptsFor(module.QuizID); !passed {
+				db.mu.Unlock()
+				return server.FailWith(c, fiber.StatusForbidden, ErrQuizNotPassed)
+			}
+		}
+
+		completeModule(&enrollment, course, module.ID, h.clock.Now())
+	}
+
+	if req.QuizScore > 0 {
+		if enrollment.Mode == "audit" {
+			db.mu.Unlock()
+			return server.FailWith(c, fiber.StatusForbidden, ErrAuditAccess)
+		}
+		enrollment.Progress.LastQuizScore = req.QuizScore
+		enrollment.Progress.QuizAttempts = append(
+			enrollment.Progress.QuizAttempts,
+			Attempt{
+				QuizID:    enrollment.Progress.CurrentModule,
+				Score:     req.QuizScore,
+				Timestamp: h.clock.Now(),
+			},
+		)
+	}
+
+	enrollment.LastAccessed = h.clock.Now()
+	db.Enrollments.Upsert(enrollment.ID, enrollment)
+	if enrollment.Status == "completed" {
+		db.onCourseCompleted(enrollment.UserEmail, enrollment.CourseID)
+	}
+	db.mu.Unlock()
+
+	return c.JSON(enrollment.Progress)
+}
+
+func enrollmentError(c *fiber.Ctx, err error) error {
+	// Declined charges carry their own code
+	var declined *server.Error
+	if errors.As(err, &declined) {
+		return err
+	}
+	switch err {
+	case ErrPaymentRequired:
+		return server.FailWith(c, fiber.StatusPaymentRequired, err)
+	case ErrPaymentMethodNotFound, ErrPaymentMethodExpired:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	case ErrAlreadyFullAccess:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	default:
+		return sessionError(c, err)
+	}
+}
+
+type UpgradeEnrollmentRequest struct {
+	PaymentMethodID string `json:"payment_method_id"`
+}
+
+func (h *handlers) upgradeEnrollment(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req UpgradeEnrollmentRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	enrollment, err := db.UpgradeEnrollment(c.Params("id"), req.PaymentMethodID, db.Charger(c))
+	if err != nil {
+		return enrollmentError(c, err)
+	}
+	return c.JSON(enrollment)
+}
+
+func financialAidError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrUserNotFound, ErrCourseNotFound, ErrFinancialAidNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrCourseFree:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	case ErrNotAidReviewer:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrFinancialAidExists, ErrFinancialAidFinal, ErrAlreadyFullAccess:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+type FinancialAidRequest struct {
+	UserEmail    string      `json:"user_email" validate:"email"`
+	Reason       string      `json:"reason"`
+	AnnualIncome money.Money `json:"annual_income"`
+}
+
+func (h *handlers) applyForFinancialAid(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req FinancialAidRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+	if req.UserEmail == "" || strings.TrimSpace(req.Reason) == "" || req.AnnualIncome.IsNegative() {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "user_email and reason are required")
+	}
+
+	application := FinancialAidApplication{
+		ID:           server.NewID("AID"),
+		UserEmail:    req.UserEmail,
+		CourseID:     c.Params("id"),
+		Reason:       strings.TrimSpace(req.Reason),
+		AnnualIncome: req.AnnualIncome,
+		Status:       FinancialAidPending,
+		SubmittedAt:  h.clock.Now(),
+	}
+	if err := db.ApplyForFinancialAid(application); err != nil {
+		return financialAidError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(application)
+}
+
+func (h *handlers) getCourseFinancialAid(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	reviewerEmail := c.Query("reviewer_email")
+	if reviewerEmail == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "reviewer_email parameter is required")
+	}
+
+	applications, err := db.GetCourseFinancialAid(c.Params("id"), reviewerEmail)
+	if err != nil {
+		return financialAidError(c, err)
+	}
+	return server.List(c, applications)
+}
+
+func (h *handlers) getFinancialAid(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	return server.List(c, db.GetUserFinancialAid(email))
+}
+
+type ReviewFinancialAidRequest struct {
+	ReviewerEmail string             `json:"reviewer_email" validate:"email"`
+	Status        FinancialAidStatus `json:"status" validate:"oneof=approved rejected"`
+	Note          string             `json:"note"`
+}
+
+func (h *handlers) reviewFinancialAid(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ReviewFinancialAidRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	application, err := db.ReviewFinancialAid(c.Params("id"), req.ReviewerEmail, req.Status, req.Note)
+	if err != nil {
+		return financialAidError(c, err)
+	}
+	return c.JSON(application)
+}
+
+func sessionError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrEnrollmentNotFound, ErrSessionNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrSessionWrongCourse, ErrSessionClosed, ErrEnrollmentInactive:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) getCourseSessions(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	sessions, err := db.GetCourseSessions(c.Params("id"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return server.List(c, sessions)
+}
+
+type SwitchSessionRequest struct {
+	SessionID string `json:"session_id" validate:"required"`
+}
+
+func (h *handlers) switchSession(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req SwitchSessionRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	enrollment, err := db.SwitchSession(c.Params("id"), req.SessionID)
+	if err != nil {
+		return sessionError(c, err)
+	}
+	return c.JSON(enrollment)
+}
+
+func (h *handlers) getSchedule(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	schedule, err := db.GetSchedule(c.Params("id"))
+	if err != nil {
+		return sessionError(c, err)
+	}
+	return c.JSON(schedule)
+}
+
+func (h *handlers) getQuiz(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	quiz, err := db.GetQuiz(c.Params("id"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	return c.JSON(quiz.Public())
+}
+
+type QuizSubmissionRequest struct {
+	EnrollmentID string         `json:"enrollment_id" validate:"required"`
+	Answers      map[string]int `json:"answers" validate:"min=1"`
+}
+
+func (h *handlers) submitQuiz(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req QuizSubmissionRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	result, err := db.SubmitQuiz(req.EnrollmentID, c.Params("id"), req.Answers)
+	if err != nil {
+		switch err {
+		case ErrQuizNotFound, ErrEnrollmentNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrQuizNotInCourse, ErrEnrollmentInactive:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		case ErrAttemptLimit, ErrAuditAccess:
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to grade quiz")
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(result)
+}
+
+func forumError(c *fiber.Ctx, err error, fallback string) error {
+	switch err {
+	case ErrCourseNotFound, ErrThreadNotFound, ErrReplyNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNotEnrolled, ErrNotInstructor:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrModuleNotFound:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	case ErrAlreadyUpvoted:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	default:
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, fallback)
+	}
+}
+
+func (h *handlers) getThreads(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	courseID := c.Params("id")
+	if _, err := db.GetCourse(courseID); err != nil {
+		return forumError(c, err, "")
+	}
+
+	sortBy := c.Query("sort", "recent")
+	if sortBy != "recent" && sortBy != "top" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "sort must be recent or top")
+	}
+
+	threads := db.ListThreads(courseID, c.Query("module_id"), sortBy)
+	return server.List(c, threads, "module_id", "sort")
+}
+
+type CreateThreadRequest struct {
+	UserEmail string `json:"user_email" validate:"required,email"`
+	ModuleID  string `json:"module_id"`
+	Title     string `json:"title" validate:"required"`
+	Body      string `json:"body" validate:"required"`
+}
+
+func (h *handlers) createThread(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req CreateThreadRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	now := h.clock.Now()
+	thread := Thread{
+		ID:             server.NewID("THR"),
+		CourseID:       c.Params("id"),
+		ModuleID:       req.ModuleID,
+		AuthorEmail:    req.UserEmail,
+		Title:          req.Title,
+		Body:           req.Body,
+		CreatedAt:      now,
+		LastActivityAt: now,
+	}
+
+	if err := db.CreateThread(thread); err != nil {
+		return forumError(c, err, "Failed to create thread")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(thread)
+}
+
+func (h *handlers) getThread(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	thread, replies, err := db.GetThread(c.Params("id"))
+	if err != nil {
+		return forumError(c, err, "")
+	}
+	page, err := server.Paginate(c, replies)
+	if err != nil {
+		return err
+	}
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	return c.JSON(fiber.Map{
+		"thread":  thread,
+		"replies": page,
+	})
+}
+
+type CreateReplyRequest struct {
+	UserEmail string `json:"user_email" validate:"required,email"`
+	Body      string `json:"body" validate:"required"`
+}
+
+func (h *handlers) createReply(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req CreateReplyRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	reply := Reply{
+		ID:          server.NewID("RPL"),
+		ThreadID:    c.Params("id"),
+		AuthorEmail: req.UserEmail,
+		Body:        req.Body,
+		CreatedAt:   h.clock.Now(),
+	}
+
+	if _, err := db.CreateReply(reply); err != nil {
+		return forumError(c, err, "Failed to create reply")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(reply)
+}
+
+type ForumActionRequest struct {
+	UserEmail string `json:"user_email" validate:"required,email"`
+}
+
+func (h *handlers) upvoteThread(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ForumActionRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	thread, err := db.UpvoteThread(c.Params("id"), req.UserEmail)
+	if err != nil {
+		return forumError(c, err, "Failed to upvote thread")
+	}
+	return c.JSON(thread)
+}
+
+func (h *handlers) upvoteReply(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ForumActionRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	reply, err := db.UpvoteReply(c.Params("id"), req.UserEmail)
+	if err != nil {
+		return forumError(c, err, "Failed to upvote reply")
+	}
+	return c.JSON(reply)
+}
+
+func (h *handlers) highlightReply(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ForumActionRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	reply, err := db.HighlightReply(c.Params("id"), req.UserEmail)
+	if err != nil {
+		return forumError(c, err, "Failed to highlight reply")
+	}
+	return c.JSON(reply)
+}
+
+func (h *handlers) getSpecializations(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	specs := []Specialization{}
+	db.mu.RLock()
+	for _, spec := range db.Specializations.List() {
+		specs = append(specs, spec)
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Title < specs[j].Title
+	})
+	return server.List(c, specs)
+}
+
+func (h *handlers) getSpecialization(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	spec, err := db.GetSpecialization(c.Params("id"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	courses := make([]Course, 0, len(spec.CourseIDs))
+	db.mu.RLock()
+	for _, id := range spec.CourseIDs {
+		course, _ := db.Courses.Get(id)
+		courses = append(courses, course)
+	}
+	db.mu.RUnlock()
+
+	return c.JSON(fiber.Map{
+		"specialization": spec,
+		"courses":        courses,
+	})
+}
+
+func (h *handlers) enrollInSpecialization(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail string `json:"user_email" validate:"email"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	enrollment, err := db.EnrollInSpecialization(c.Params("id"), req.UserEmail)
+	if err != nil {
+		switch err {
+		case ErrUserNotFound, ErrSpecializationNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrAlreadyInSpecialization:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to enroll in specialization")
+		}
+	}
+
+	progress, _ := db.GetSpecializationProgress(enrollment.ID)
+	return c.Status(fiber.StatusCreated).JSON(progress)
+}
+
+func (h *handlers) getSpecializationEnrollments(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	return server.List(c, db.GetUserSpecializations(email))
+}
+
+func (h *handlers) getSpecializationProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	progress, err := db.GetSpecializationProgress(c.Params("id"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return c.JSON(progress)
+}
+
+func (h *handlers) getCertificates(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	return server.List(c, db.GetUserCertificates(email))
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
+	}
+
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	db.ScheduleSessions(h.clock.Now())
+	h.db.Set(db)
+	return nil
+}
+
+func setupRoutes(app *fiber.App, h *handlers) {
+	api := app.Group("/api/v1")
+
+	// Course routes
+	api.Get("/courses", h.getCourses)
+	api.Get("/courses/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		id := c.Params("id")
+		course, err := db.GetCourse(id)
+		if err != nil {
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		}
+		return c.JSON(course)
+	})
+
+	api.Get("/courses/:id/sessions", h.getCourseSessions)
+	api.Get("/courses/:id/threads", h.getThreads)
+	api.Post("/courses/:id/threads", h.createThread)
+
+	// Forum routes
+	api.Get("/threads/:id", h.getThread)
+	api.Post("/threads/:id/replies", h.createReply)
+	api.Post("/threads/:id/upvote", h.upvoteThread)
+	api.Post("/replies/:id/upvote", h.upvoteReply)
+	api.Post("/replies/:id/highlight", h.highlightReply)
+
+	// Specialization routes
+	api.Get("/specializations", h.getSpecializations)
+	api.Get("/specializations/:id", h.getSpecialization)
+	api.Post("/specializations/:id/enroll", h.enrollInSpecialization)
+	api.Get("/specialization-enrollments", h.getSpecializationEnrollments)
+	api.Get("/specialization-enrollments/:id", h.getSpecializationProgress)
+
+	// Certificate routes
+	api.Get("/certificates", h.getCertificates)
+
+	// Enrollment routes
+	api.Get("/enrollments", h.getEnrollments)
+	api.Post("/enrollments", h.createEnrollment)
+	api.Put("/enrollments/:id/session", h.switchSession)
+	api.Get("/enrollments/:id/schedule", h.getSchedule)
+	api.Post("/enrollments/:id/upgrade", h.upgradeEnrollment)
+
+	// Financial aid routes
+	api.Post("/courses/:id/financial-aid", h.applyForFinancialAid)
+	api.Get("/courses/:id/financial-aid", h.getCourseFinancialAid)
+	api.Get("/financial-aid", h.getFinancialAid)
+	api.Patch("/financial-aid/:id", h.reviewFinancialAid)
+
+	// Progress routes
+	api.Get("/progress/:enrollmentId", h.getProgress)
+	api.Put("/progress/:enrollmentId", h.updateProgress)
+
+	// Quiz routes
+	api.Get("/quizzes/:id", h.getQuiz)
+	api.Post("/quizzes/:id/submissions", h.submitQuiz)
+
+	// User routes
+	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		email := c.Params("email")
+		user, err := db.GetUser(email)
+		if err != nil {
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		}
+		return c.JSON(user)
+	})
+}
+
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
+func main() {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"enrollments", "charges"},
+			Search:  []string{"courses", "specializations", "enrollments", "certificates", "threads"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
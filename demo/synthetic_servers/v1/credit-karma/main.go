@@ -1,17 +1,14 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -43,16 +40,16 @@ type FinancialProduct struct {
 }
 
 type PaymentHistory struct {
-	Date   time.Time `json:"date"`
-	Status string    `json:"status"`
-	Amount float64   `json:"amount"`
+	Date   time.Time   `json:"date"`
+	Status string      `json:"status"`
+	Amount money.Money `json:"amount"`
 }
 
 type CreditAccount struct {
 	Name           string           `json:"name"`
 	Type           string           `json:"type"`
-	Balance        float64          `json:"balance"`
-	CreditLimit    float64          `json:"credit_limit"`
+	Balance        money.Money      `json:"balance"`
+	CreditLimit    money.Money      `json:"credit_limit"`
 	PaymentStatus  string           `json:"payment_status"`
 	PaymentHistory []PaymentHistory `json:"payment_history"`
 }
@@ -84,18 +81,32 @@ type UserProfile struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users map[string]UserProfile `json:"users"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users server.Repository[UserProfile] `json:"users"`
 	mu    sync.RWMutex
 }
 
-var db *Database
+// handlers serve Credit Karma users' scores, credit factors, report and
+// recommendations from db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (UserProfile, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return UserProfile{}, fiber.NewError(fiber.StatusNotFound, "User not found")
 	}
@@ -103,7 +114,8 @@ func (d *Database) GetUser(email string) (UserProfile, error) {
 }
 
 // HTTP Handlers
-func getCreditScores(c *fiber.Ctx) error {
+func (h *handlers) getCreditScores(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -117,7 +129,8 @@ func getCreditScores(c *fiber.Ctx) error {
 	return c.JSON(user.CreditScores)
 }
 
-func getCreditFactors(c *fiber.Ctx) error {
+func (h *handlers) getCreditFactors(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -128,10 +141,11 @@ func getCreditFactors(c *fiber.Ctx) error {
 		return err
 	}
 
-	return c.JSON(user.CreditFactors)
+	return server.List(c, user.CreditFactors)
 }
 
-func getRecommendations(c *fiber.Ctx) error {
+func (h *handlers) getRecommendations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -178,10 +192,11 @@ func getRecommendations(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(recommendations)
+	return server.List(c, recommendations)
 }
 
-func getCreditReport(c *fiber.Ctx) error {
+func (h *handlers) getCreditReport(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -195,56 +210,64 @@ func getCreditReport(c *fiber.Ctx) error {
 	return c.JSON(user.CreditReport)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users: make(map[string]UserProfile),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/credit-scores", getCreditScores)
-	api.Get("/credit-factors", getCreditFactors)
-	api.Get("/recommendations", getRecommendations)
-	api.Get("/credit-report", getCreditReport)
+	api.Get("/credit-scores", h.getCreditScores)
+	api.Get("/credit-factors", h.getCreditFactors)
+	api.Get("/recommendations", h.getRecommendations)
+	api.Get("/credit-report", h.getCreditReport)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
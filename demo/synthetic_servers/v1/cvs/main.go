@@ -1,19 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/server"
 )
 
 // Domain Models
@@ -93,11 +89,14 @@ type RefillRequest struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users          map[string]User          `json:"users"`
-	Prescriptions  map[string]Prescription  `json:"prescriptions"`
-	Stores         map[string]Store         `json:"stores"`
-	Appointments   map[string]Appointment   `json:"appointments"`
-	RefillRequests map[string]RefillRequest `json:"refill_requests"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users          server.Repository[User]          `json:"users"`
+	Prescriptions  server.Repository[Prescription]  `json:"prescriptions"`
+	Stores         server.Repository[Store]         `json:"stores"`
+	Appointments   server.Repository[Appointment]   `json:"appointments"`
+	RefillRequests server.Repository[RefillRequest] `json:"refill_requests"`
 	mu             sync.RWMutex
 }
 
@@ -108,14 +107,25 @@ var (
 	ErrInvalidInput         = errors.New("invalid input")
 )
 
-var db *Database
+// handlers take CVS refill requests and book store appointments, dated by
+// clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the prescriptions, stores and appointments in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -126,20 +136,14 @@ func (d *Database) GetUserPrescriptions(email string) []Prescription {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var prescriptions []Prescription
-	for _, p := range d.Prescriptions {
-		if p.UserEmail == email {
-			prescriptions = append(prescriptions, p)
-		}
-	}
-	return prescriptions
+	return d.Prescriptions.By("user_email", email)
 }
 
 func (d *Database) CreateRefillRequest(req RefillRequest) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.RefillRequests[req.ID] = req
+	d.RefillRequests.Upsert(req.ID, req)
 	return nil
 }
 
@@ -148,7 +152,7 @@ func (d *Database) GetNearbyStores(lat, lon float64, radius float64) []Store {
 	defer d.mu.RUnlock()
 
 	var stores []Store
-	for _, store := range d.Stores {
+	for _, store := range d.Stores.List() {
 		distance := calculateDistance(lat, lon,
 			store.Address.Latitude,
 			store.Address.Longitude)
@@ -160,216 +164,203 @@ func (d *Database) GetNearbyStores(lat, lon float64, radius float64) []Store {
 }
 
 // HTTP Handlers
-func getPrescriptions(c *fiber.Ctx) error {
+func (h *handlers) getPrescriptions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	// Verify user exists
 	if _, err := db.GetUser(email); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	prescriptions := db.GetUserPrescriptions(email)
-	return c.JSON(prescriptions)
+	return server.List(c, prescriptions)
 }
 
-func requestRefill(c *fiber.Ctx) error {
+func (h *handlers) requestRefill(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		PrescriptionID string    `json:"prescription_id"`
-		UserEmail      string    `json:"user_email"`
+		UserEmail      string    `json:"user_email" validate:"email"`
 		StoreID        string    `json:"pickup_store"`
 		PreferredDate  time.Time `json:"preferred_date"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user and prescription
 	if _, err := db.GetUser(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	refillRequest := RefillRequest{
-		ID:             uuid.New().String(),
+		ID:             server.NewID("RFR"),
 		PrescriptionID: req.PrescriptionID,
 		UserEmail:      req.UserEmail,
 		StoreID:        req.StoreID,
 		PreferredDate:  req.PreferredDate,
 		Status:         "pending",
-		CreatedAt:      time.Now(),
+		CreatedAt:      h.clock.Now(),
 	}
 
 	if err := db.CreateRefillRequest(refillRequest); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create refill request",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create refill request")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(refillRequest)
 }
 
-func getNearbyStores(c *fiber.Ctx) error {
+func (h *handlers) getNearbyStores(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	lat := c.QueryFloat("latitude", 0)
 	lon := c.QueryFloat("longitude", 0)
 
 	if lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "latitude and longitude are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "latitude and longitude are required")
 	}
 
 	radius := 10.0 // 10 mile radius
 	stores := db.GetNearbyStores(lat, lon, radius)
-	return c.JSON(stores)
+	return server.List(c, stores)
 }
 
-func scheduleAppointment(c *fiber.Ctx) error {
+func (h *handlers) scheduleAppointment(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		UserEmail         string          `json:"user_email"`
+		UserEmail         string          `json:"user_email" validate:"email"`
 		Type              AppointmentType `json:"type"`
 		PreferredDateTime time.Time       `json:"preferred_datetime"`
 		StoreID           string          `json:"store_id"`
 		Notes             string          `json:"notes"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	if _, err := db.GetUser(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	appointment := Appointment{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("APPT"),
 		UserEmail: req.UserEmail,
 		Type:      req.Type,
 		DateTime:  req.PreferredDateTime,
 		StoreID:   req.StoreID,
 		Status:    "scheduled",
 		Notes:     req.Notes,
-		CreatedAt: time.Now(),
+		CreatedAt: h.clock.Now(),
 	}
 
 	db.mu.Lock()
-	db.Appointments[appointment.ID] = appointment
+	db.Appointments.Upsert(appointment.ID, appointment)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(appointment)
 }
 
-func getUserAppointments(c *fiber.Ctx) error {
+func (h *handlers) getUserAppointments(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	// Verify user exists
 	if _, err := db.GetUser(email); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var appointments []Appointment
 	db.mu.RLock()
-	for _, apt := range db.Appointments {
+	for _, apt := range db.Appointments.List() {
 		if apt.UserEmail == email {
 			appointments = append(appointments, apt)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(appointments)
+	return server.List(c, appointments)
 }
 
+// calculateDistance returns the great-circle distance between two points
+// in miles.
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+	return geo.DistanceMiles(geo.Point{Lat: lat1, Lon: lon1}, geo.Point{Lat: lat2, Lon: lon2})
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:          make(map[string]User),
-		Prescriptions:  make(map[string]Prescription),
-		Stores:         make(map[string]Store),
-		Appointments:   make(map[string]Appointment),
-		RefillRequests: make(map[string]RefillRequest),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Prescription routes
-	api.Get("/prescriptions", getPrescriptions)
-	api.Post("/prescriptions/refill", requestRefill)
+	api.Get("/prescriptions", h.getPrescriptions)
+	api.Post("/prescriptions/refill", h.requestRefill)
 
 	// Store routes
-	api.Get("/stores", getNearbyStores)
+	api.Get("/stores", h.getNearbyStores)
 
 	// Appointment routes
-	api.Get("/appointments", getUserAppointments)
-	api.Post("/appointments", scheduleAppointment)
+	api.Get("/appointments", h.getUserAppointments)
+	api.Post("/appointments", h.scheduleAppointment)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"prescriptions", "appointments", "refill_requests"},
+			Search:  []string{"stores", "prescriptions", "appointments"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -76,10 +71,13 @@ type Message struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Servers  map[string]Server  `json:"servers"`
-	Channels map[string]Channel `json:"channels"`
-	Messages map[string]Message `json:"messages"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]    `json:"users"`
+	Servers  server.Repository[Server]  `json:"servers"`
+	Channels server.Repository[Channel] `json:"channels"`
+	Messages server.Repository[Message] `json:"messages"`
 	mu       sync.RWMutex
 }
 
@@ -91,15 +89,25 @@ var (
 	ErrMessageNotFound = errors.New("message not found")
 )
 
-// Global database instance
-var db *Database
+// handlers run Discord's servers, channels and messages, timestamping
+// messages by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the servers, channels and messages in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	for _, user := range d.Users {
+	for _, user := range d.Users.List() {
 		if user.Email == email {
 			return user, nil
 		}
@@ -111,19 +119,14 @@ func (d *Database) GetUserServers(userId string) []Server {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var servers []Server
-	for _, server := range d.Servers {
-		// In a real implementation, we would check server membership
-		servers = append(servers, server)
-	}
-	return servers
+	return d.Servers.List()
 }
 
 func (d *Database) GetServerChannels(serverId string) ([]Channel, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	server, exists := d.Servers[serverId]
+	server, exists := d.Servers.Get(serverId)
 	if !exists {
 		return nil, ErrServerNotFound
 	}
@@ -135,12 +138,7 @@ func (d *Database) GetChannelMessages(channelId string, limit int, before string
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var messages []Message
-	for _, msg := range d.Messages {
-		if msg.ChannelID == channelId {
-			messages = append(messages, msg)
-		}
-	}
+	messages := d.Messages.By("channel_id", channelId)
 
 	// In a real implementation, we would:
 	// 1. Sort messages by timestamp
@@ -154,72 +152,62 @@ func (d *Database) CreateMessage(msg Message) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Messages[msg.ID] = msg
+	d.Messages.Upsert(msg.ID, msg)
 	return nil
 }
 
 // HTTP Handlers
-func getCurrentUser(c *fiber.Ctx) error {
+func (h *handlers) getCurrentUser(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(user)
 }
 
-func getUserServers(c *fiber.Ctx) error {
+func (h *handlers) getUserServers(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	servers := db.GetUserServers(user.ID)
-	return c.JSON(servers)
+	return server.List(c, servers)
 }
 
-func getServerChannels(c *fiber.Ctx) error {
+func (h *handlers) getServerChannels(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	serverId := c.Params("serverId")
 	if serverId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "server ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "server ID is required")
 	}
 
 	channels, err := db.GetServerChannels(serverId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(channels)
+	return server.List(c, channels)
 }
 
-func getChannelMessages(c *fiber.Ctx) error {
+func (h *handlers) getChannelMessages(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	channelId := c.Params("channelId")
 	if channelId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "channel ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "channel ID is required")
 	}
 
 	limit := c.QueryInt("limit", 50)
@@ -227,126 +215,115 @@ func getChannelMessages(c *fiber.Ctx) error {
 
 	messages, err := db.GetChannelMessages(channelId, limit, before)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(messages)
+	return server.List(c, messages)
 }
 
 type NewMessageRequest struct {
-	Content     string   `json:"content"`
+	Content     string   `json:"content" validate:"required"`
 	Attachments []string `json:"attachments"`
 }
 
-func createMessage(c *fiber.Ctx) error {
+func (h *handlers) createMessage(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	channelId := c.Params("channelId")
 	if channelId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "channel ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "channel ID is required")
 	}
 
 	var req NewMessageRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// In a real implementation, we would get the user from the authentication token
 	user, err := db.GetUser("casey.wringer@email.com")
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized",
-		})
+		return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "Unauthorized")
 	}
 
 	msg := Message{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("MSG"),
 		ChannelID: channelId,
 		Author:    user,
 		Content:   req.Content,
-		CreatedAt: time.Now(),
+		CreatedAt: h.clock.Now(),
 	}
 
 	if err := db.CreateMessage(msg); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create message",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create message")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(msg)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Servers:  make(map[string]Server),
-		Channels: make(map[string]Channel),
-		Messages: make(map[string]Message),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// User routes
-	api.Get("/users/me", getCurrentUser)
+	api.Get("/users/me", h.getCurrentUser)
 
 	// Server routes
-	api.Get("/servers", getUserServers)
-	api.Get("/servers/:serverId/channels", getServerChannels)
+	api.Get("/servers", h.getUserServers)
+	api.Get("/servers/:serverId/channels", h.getServerChannels)
 
 	// Channel routes
-	api.Get("/channels/:channelId/messages", getChannelMessages)
-	api.Post("/channels/:channelId/messages", createMessage)
+	api.Get("/channels/:channelId/messages", h.getChannelMessages)
+	api.Post("/channels/:channelId/messages", h.createMessage)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+			Search:  []string{"servers", "messages"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -67,121 +63,118 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users         map[string]User          `json:"users"`
-	Content       map[string]Content       `json:"content"`
-	Profiles      map[string]Profile       `json:"profiles"`
-	WatchProgress map[string]WatchProgress `json:"watch_progress"`
-	Watchlist     map[string][]string      `json:"watchlist"` // profile_id -> []content_id
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users         server.Repository[User]          `json:"users"`
+	Content       server.Repository[Content]       `json:"content"`
+	Profiles      server.Repository[Profile]       `json:"profiles"`
+	WatchProgress server.Repository[WatchProgress] `json:"watch_progress"`
+	Watchlist     server.Repository[[]string]      `json:"watchlist"` // profile_id -> []content_id
 	mu            sync.RWMutex
 }
 
-var db *Database
+// handlers stream Disney+ content to users' profiles, keeping watch progress
+// by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the content, profiles and watch progress in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Handlers
-func getContent(c *fiber.Ctx) error {
+func (h *handlers) getContent(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
-	page := c.QueryInt("page", 1)
-	itemsPerPage := 20
 
 	var filteredContent []Content
 	db.mu.RLock()
-	for _, content := range db.Content {
+	for _, content := range db.Content.List() {
 		if category == "" || Category(category) == content.Category {
 			filteredContent = append(filteredContent, content)
 		}
 	}
 	db.mu.RUnlock()
 
-	// Calculate pagination
-	start := (page - 1) * itemsPerPage
-	end := start + itemsPerPage
-	if end > len(filteredContent) {
-		end = len(filteredContent)
-	}
-	if start >= len(filteredContent) {
-		return c.JSON([]Content{})
-	}
-
-	return c.JSON(filteredContent[start:end])
+	return server.List(c, filteredContent, "category")
 }
 
-func getProfiles(c *fiber.Ctx) error {
+func (h *handlers) getProfiles(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	var userProfiles []Profile
 	db.mu.RLock()
-	for _, profile := range db.Profiles {
+	for _, profile := range db.Profiles.List() {
 		if profile.UserEmail == email {
 			userProfiles = append(userProfiles, profile)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userProfiles)
+	return server.List(c, userProfiles)
 }
 
-func getWatchlist(c *fiber.Ctx) error {
+func (h *handlers) getWatchlist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	profileID := c.Query("profile_id")
 	if profileID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "profile_id is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "profile_id is required")
 	}
 
 	db.mu.RLock()
-	contentIDs, exists := db.Watchlist[profileID]
+	contentIDs, exists := db.Watchlist.Get(profileID)
 	if !exists {
 		db.mu.RUnlock()
-		return c.JSON([]Content{})
+		return server.List(c, []Content{})
 	}
 
 	var watchlist []Content
 	for _, contentID := range contentIDs {
-		if content, exists := db.Content[contentID]; exists {
+		if content, exists := db.Content.Get(contentID); exists {
 			watchlist = append(watchlist, content)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(watchlist)
+	return server.List(c, watchlist)
 }
 
-func addToWatchlist(c *fiber.Ctx) error {
+func (h *handlers) addToWatchlist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		ProfileID string `json:"profile_id"`
 		ContentID string `json:"content_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	// Verify content exists
-	if _, exists := db.Content[req.ContentID]; !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Content not found",
-		})
+	if _, exists := db.Content.Get(req.ContentID); !exists {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Content not found")
 	}
 
 	// Verify profile exists
-	if _, exists := db.Profiles[req.ProfileID]; !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Profile not found",
-		})
+	if _, exists := db.Profiles.Get(req.ProfileID); !exists {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Profile not found")
 	}
 
 	// Add to watchlist if not already present
-	for _, contentID := range db.Watchlist[req.ProfileID] {
+	watchlist, _ := db.Watchlist.Get(req.ProfileID)
+	for _, contentID := range watchlist {
 		if contentID == req.ContentID {
 			return c.Status(fiber.StatusOK).JSON(fiber.Map{
 				"message": "Content already in watchlist",
@@ -189,18 +182,17 @@ func addToWatchlist(c *fiber.Ctx) error {
 		}
 	}
 
-	db.Watchlist[req.ProfileID] = append(db.Watchlist[req.ProfileID], req.ContentID)
+	db.Watchlist.Upsert(req.ProfileID, append(watchlist, req.ContentID))
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"message": "Added to watchlist",
 	})
 }
 
-func getContinueWatching(c *fiber.Ctx) error {
+func (h *handlers) getContinueWatching(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	profileID := c.Query("profile_id")
 	if profileID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "profile_id is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "profile_id is required")
 	}
 
 	var progress []struct {
@@ -209,9 +201,9 @@ func getContinueWatching(c *fiber.Ctx) error {
 	}
 
 	db.mu.RLock()
-	for _, wp := range db.WatchProgress {
+	for _, wp := range db.WatchProgress.List() {
 		if wp.ProfileID == profileID {
-			if content, exists := db.Content[wp.ContentID]; exists {
+			if content, exists := db.Content.Get(wp.ContentID); exists {
 				progress = append(progress, struct {
 					Content       Content       `json:"content"`
 					WatchProgress WatchProgress `json:"progress"`
@@ -227,28 +219,25 @@ func getContinueWatching(c *fiber.Ctx) error {
 	return c.JSON(progress)
 }
 
-func updateWatchProgress(c *fiber.Ctx) error {
+func (h *handlers) updateWatchProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		ProfileID       string `json:"profile_id"`
 		ContentID       string `json:"content_id"`
 		ProgressSeconds int    `json:"progress_seconds"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	// Verify content exists
-	content, exists := db.Content[req.ContentID]
+	content, exists := db.Content.Get(req.ContentID)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Content not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Content not found")
 	}
 
 	progressKey := req.ProfileID + ":" + req.ContentID
@@ -257,79 +246,81 @@ func updateWatchProgress(c *fiber.Ctx) error {
 		ProfileID:       req.ProfileID,
 		ProgressSeconds: req.ProgressSeconds,
 		TotalSeconds:    content.Duration,
-		LastWatched:     time.Now(),
+		LastWatched:     h.clock.Now(),
 	}
 
-	db.WatchProgress[progressKey] = progress
+	db.WatchProgress.Upsert(progressKey, progress)
 	return c.JSON(progress)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:         make(map[string]User),
-		Content:       make(map[string]Content),
-		Profiles:      make(map[string]Profile),
-		WatchProgress: make(map[string]WatchProgress),
-		Watchlist:     make(map[string][]string),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Content routes
-	api.Get("/content", getContent)
+	api.Get("/content", h.getContent)
 
 	// Profile routes
-	api.Get("/profiles", getProfiles)
+	api.Get("/profiles", h.getProfiles)
 
 	// Watchlist routes
-	api.Get("/watchlist", getWatchlist)
-	api.Post("/watchlist", addToWatchlist)
+	api.Get("/watchlist", h.getWatchlist)
+	api.Post("/watchlist", h.addToWatchlist)
 
 	// Continue watching routes
-	api.Get("/continue-watching", getContinueWatching)
-	api.Post("/watch-progress", updateWatchProgress)
+	api.Get("/continue-watching", h.getContinueWatching)
+	api.Post("/watch-progress", h.updateWatchProgress)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"profiles"},
+			Search:  []string{"content", "watchlist"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,31 +1,28 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Product struct {
-	ID                string  `json:"id"`
-	Name              string  `json:"name"`
-	Description       string  `json:"description"`
-	Category          string  `json:"category"`
-	Price             float64 `json:"price"`
-	SubscriptionPrice float64 `json:"subscription_price"`
-	ImageURL          string  `json:"image_url"`
-	InStock           bool    `json:"in_stock"`
+	ID                string      `json:"id"`
+	Name              string      `json:"name"`
+	Description       string      `json:"description"`
+	Category          string      `json:"category"`
+	Price             money.Money `json:"price"`
+	SubscriptionPrice money.Money `json:"subscription_price"`
+	ImageURL          string      `json:"image_url"`
+	InStock           bool        `json:"in_stock"`
 }
 
 type SubscriptionFrequency string
@@ -44,14 +41,22 @@ const (
 	StatusCancelled SubscriptionStatus = "cancelled"
 )
 
+// subscriptionMachine is the statuses a subscriber can move their
+// subscription between. A cancelled one stays cancelled.
+var subscriptionMachine = &statemachine.Machine{Name: "subscription", Moves: map[string][]string{
+	string(StatusActive): {string(StatusPaused), string(StatusCancelled)},
+	string(StatusPaused): {string(StatusActive), string(StatusCancelled)},
+}}
+
 type Subscription struct {
-	ID           string                `json:"id"`
-	UserEmail    string                `json:"user_email"`
-	Product      Product               `json:"product"`
-	Frequency    SubscriptionFrequency `json:"frequency"`
-	NextDelivery time.Time             `json:"next_delivery"`
-	Status       SubscriptionStatus    `json:"status"`
-	CreatedAt    time.Time             `json:"created_at"`
+	ID            string                    `json:"id"`
+	UserEmail     string                    `json:"user_email"`
+	Product       Product                   `json:"product"`
+	Frequency     SubscriptionFrequency     `json:"frequency"`
+	NextDelivery  time.Time                 `json:"next_delivery"`
+	Status        SubscriptionStatus        `json:"status"`
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+	CreatedAt     time.Time                 `json:"created_at"`
 }
 
 type OrderStatus string
@@ -62,22 +67,38 @@ const (
 	OrderStatusDelivered  OrderStatus = "delivered"
 )
 
+// orderMachine is the statuses a subscription's order moves through.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	string(OrderStatusProcessing): {string(OrderStatusShipped)},
+	string(OrderStatusShipped):    {string(OrderStatusDelivered)},
+}}
+
+// orderLifecycle ships orders the day after they're placed and delivers
+// them a few days later.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: string(OrderStatusProcessing), To: string(OrderStatusShipped), After: 24 * time.Hour,
+		Notify: server.Notice{Type: "order_shipped", Message: "Your order {{id}} has shipped."}},
+	{From: string(OrderStatusShipped), To: string(OrderStatusDelivered), After: 72 * time.Hour,
+		Notify: server.Notice{Type: "order_delivered", Message: "Your order {{id}} was delivered."}},
+}, Machine: orderMachine}
+
 type Order struct {
-	ID              string      `json:"id"`
-	SubscriptionID  string      `json:"subscription_id"`
-	Items           []OrderItem `json:"items"`
-	Status          OrderStatus `json:"status"`
-	Total           float64     `json:"total"`
-	ShippingAddress string      `json:"shipping_address"`
-	TrackingNumber  string      `json:"tracking_number"`
-	CreatedAt       time.Time   `json:"created_at"`
+	ID              string                    `json:"id"`
+	SubscriptionID  string                    `json:"subscription_id"`
+	Items           []OrderItem               `json:"items"`
+	Status          OrderStatus               `json:"status"`
+	StatusHistory   []statemachine.Transition `json:"status_history,omitempty"`
+	Total           money.Money               `json:"total"`
+	ShippingAddress string                    `json:"shipping_address"`
+	TrackingNumber  string                    `json:"tracking_number"`
+	CreatedAt       time.Time                 `json:"created_at"`
 }
 
 type OrderItem struct {
-	ProductID string  `json:"product_id"`
-	Name      string  `json:"name"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ProductID string      `json:"product_id"`
+	Name      string      `json:"name"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Money `json:"price"`
 }
 
 type User struct {
@@ -90,21 +111,35 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users         map[string]User         `json:"users"`
-	Products      map[string]Product      `json:"products"`
-	Subscriptions map[string]Subscription `json:"subscriptions"`
-	Orders        map[string]Order        `json:"orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users         server.Repository[User]         `json:"users"`
+	Products      server.Repository[Product]      `json:"products"`
+	Subscriptions server.Repository[Subscription] `json:"subscriptions"`
+	Orders        server.Repository[Order]        `json:"orders"`
 	mu            sync.RWMutex
 }
 
-var db *Database
+// handlers run Dollar Shave Club's subscriptions and the orders they ship,
+// dating subscriptions by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the products, subscriptions and orders in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -115,7 +150,7 @@ func (d *Database) GetProduct(id string) (Product, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	product, exists := d.Products[id]
+	product, exists := d.Products.Get(id)
 	if !exists {
 		return Product{}, errors.New("product not found")
 	}
@@ -126,7 +161,7 @@ func (d *Database) GetSubscription(id string) (Subscription, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	sub, exists := d.Subscriptions[id]
+	sub, exists := d.Subscriptions.Get(id)
 	if !exists {
 		return Subscription{}, errors.New("subscription not found")
 	}
@@ -137,7 +172,7 @@ func (d *Database) CreateSubscription(sub Subscription) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Subscriptions[sub.ID] = sub
+	d.Subscriptions.Upsert(sub.ID, sub)
 	return nil
 }
 
@@ -145,106 +180,97 @@ func (d *Database) UpdateSubscription(sub Subscription) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Subscriptions[sub.ID] = sub
+	d.Subscriptions.Upsert(sub.ID, sub)
 	return nil
 }
 
 // HTTP Handlers
-func getProducts(c *fiber.Ctx) error {
+func (h *handlers) getProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 
 	var products []Product
 	db.mu.RLock()
-	for _, product := range db.Products {
+	for _, product := range db.Products.List() {
 		if category == "" || product.Category == category {
 			products = append(products, product)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(products)
+	return server.List(c, products, "category")
 }
 
-func getUserSubscriptions(c *fiber.Ctx) error {
+func (h *handlers) getUserSubscriptions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var subs []Subscription
 	db.mu.RLock()
-	for _, sub := range db.Subscriptions {
+	for _, sub := range db.Subscriptions.List() {
 		if sub.UserEmail == email {
 			subs = append(subs, sub)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(subs)
+	return server.List(c, subs)
 }
 
 type NewSubscriptionRequest struct {
-	UserEmail     string                `json:"user_email"`
-	ProductID     string                `json:"product_id"`
-	Frequency     SubscriptionFrequency `json:"frequency"`
-	PaymentMethod string                `json:"payment_method"`
+	UserEmail     string                `json:"user_email" validate:"required,email"`
+	ProductID     string                `json:"product_id" validate:"required"`
+	Frequency     SubscriptionFrequency `json:"frequency" validate:"required,oneof=monthly bimonthly quarterly"`
+	PaymentMethod string                `json:"payment_method" validate:"required"`
 }
 
-func createSubscription(c *fiber.Ctx) error {
+func (h *handlers) createSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewSubscriptionRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Validate product
 	product, err := db.GetProduct(req.ProductID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Product not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Product not found")
 	}
 
 	// Calculate next delivery date based on frequency
 	var nextDelivery time.Time
 	switch req.Frequency {
 	case FrequencyMonthly:
-		nextDelivery = time.Now().AddDate(0, 1, 0)
+		nextDelivery = h.clock.Now().AddDate(0, 1, 0)
 	case FrequencyBiMonthly:
-		nextDelivery = time.Now().AddDate(0, 2, 0)
+		nextDelivery = h.clock.Now().AddDate(0, 2, 0)
 	case FrequencyQuarterly:
-		nextDelivery = time.Now().AddDate(0, 3, 0)
+		nextDelivery = h.clock.Now().AddDate(0, 3, 0)
 	default:
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid frequency",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid frequency")
 	}
 
 	subscription := Subscription{
-		ID:           uuid.New().String(),
+		ID:           server.NewID("SUB"),
 		UserEmail:    user.Email,
 		Product:      product,
 		Frequency:    req.Frequency,
 		NextDelivery: nextDelivery,
 		Status:       StatusActive,
-		CreatedAt:    time.Now(),
+		CreatedAt:    h.clock.Now(),
 	}
 
 	if err := db.CreateSubscription(subscription); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create subscription",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create subscription")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(subscription)
@@ -256,21 +282,18 @@ type UpdateSubscriptionRequest struct {
 	PaymentMethod string                `json:"payment_method"`
 }
 
-func updateSubscription(c *fiber.Ctx) error {
+func (h *handlers) updateSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	subscriptionId := c.Params("subscriptionId")
 
 	var req UpdateSubscriptionRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	subscription, err := db.GetSubscription(subscriptionId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Subscription not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Subscription not found")
 	}
 
 	if req.Frequency != "" {
@@ -278,111 +301,115 @@ func updateSubscription(c *fiber.Ctx) error {
 		// Update next delivery date based on new frequency
 		switch req.Frequency {
 		case FrequencyMonthly:
-			subscription.NextDelivery = time.Now().AddDate(0, 1, 0)
+			subscription.NextDelivery = h.clock.Now().AddDate(0, 1, 0)
 		case FrequencyBiMonthly:
-			subscription.NextDelivery = time.Now().AddDate(0, 2, 0)
+			subscription.NextDelivery = h.clock.Now().AddDate(0, 2, 0)
 		case FrequencyQuarterly:
-			subscription.NextDelivery = time.Now().AddDate(0, 3, 0)
+			subscription.NextDelivery = h.clock.Now().AddDate(0, 3, 0)
 		default:
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Invalid frequency",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid frequency")
 		}
 	}
 
-	if req.Status != "" {
-		subscription.Status = req.Status
+	if req.Status != "" && req.Status != subscription.Status {
+		if err := statemachine.Move(subscriptionMachine, &subscription, &subscription.Status, &subscription.StatusHistory, req.Status, h.clock.Now()); err != nil {
+			return server.FailWith(c, fiber.StatusConflict, err)
+		}
 	}
 
 	if err := db.UpdateSubscription(subscription); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update subscription",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update subscription")
 	}
 
 	return c.JSON(subscription)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var orders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
-		sub, exists := db.Subscriptions[order.SubscriptionID]
+	for _, order := range db.Orders.List() {
+		sub, exists := db.Subscriptions.Get(order.SubscriptionID)
 		if exists && sub.UserEmail == email {
 			orders = append(orders, order)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(orders)
+	return server.List(c, orders)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:         make(map[string]User),
-		Products:      make(map[string]Product),
-		Subscriptions: make(map[string]Subscription),
-		Orders:        make(map[string]Order),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Product routes
-	api.Get("/products", getProducts)
+	api.Get("/products", h.getProducts)
 
 	// Subscription routes
-	api.Get("/subscriptions", getUserSubscriptions)
-	api.Post("/subscriptions", createSubscription)
-	api.Put("/subscriptions/:subscriptionId", updateSubscription)
+	api.Get("/subscriptions", h.getUserSubscriptions)
+	api.Post("/subscriptions", h.createSubscription)
+	api.Put("/subscriptions/:subscriptionId", h.updateSubscription)
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
+	api.Get("/orders", h.getUserOrders)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"subscriptions"},
+			Search:  []string{"products", "subscriptions", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,20 +1,16 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"fmt"
 	"log"
-	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -52,14 +48,28 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users      map[string]User         `json:"users"`
-	Files      map[string]FileMetadata `json:"files"`
-	ShareLinks map[string]ShareLink    `json:"share_links"`
-	FileData   map[string][]byte       `json:"file_data"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users      server.Repository[User]         `json:"users"`
+	Files      server.Repository[FileMetadata] `json:"files"`
+	ShareLinks server.Repository[ShareLink]    `json:"share_links"`
+	FileData   server.Repository[[]byte]       `json:"file_data"`
 	mu         sync.RWMutex
 }
 
-var db *Database
+// handlers keep Dropbox users' files and share links, with clock for uploads
+// and link expiry.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the files, their data and share links in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Error types
 var (
@@ -75,7 +85,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -86,7 +96,7 @@ func (d *Database) GetFile(fileId string) (FileMetadata, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	file, exists := d.Files[fileId]
+	file, exists := d.Files.Get(fileId)
 	if !exists {
 		return FileMetadata{}, ErrFileNotFound
 	}
@@ -98,7 +108,7 @@ func (d *Database) SaveFile(metadata FileMetadata, data []byte) error {
 	defer d.mu.Unlock()
 
 	// Check storage quota
-	user, exists := d.Users[metadata.Owner]
+	user, exists := d.Users.Get(metadata.Owner)
 	if !exists {
 		return ErrUserNotFound
 	}
@@ -110,11 +120,11 @@ func (d *Database) SaveFile(metadata FileMetadata, data []byte) error {
 
 	// Update storage usage
 	user.StorageUsed = newSize
-	d.Users[metadata.Owner] = user
+	d.Users.Upsert(metadata.Owner, user)
 
 	// Save file metadata and data
-	d.Files[metadata.ID] = metadata
-	d.FileData[metadata.ID] = data
+	d.Files.Upsert(metadata.ID, metadata)
+	d.FileData.Upsert(metadata.ID, data)
 
 	return nil
 }
@@ -123,19 +133,19 @@ func (d *Database) DeleteFile(fileId string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	file, exists := d.Files[fileId]
+	file, exists := d.Files.Get(fileId)
 	if !exists {
 		return ErrFileNotFound
 	}
 
 	// Update storage usage
-	user := d.Users[file.Owner]
+	user, _ := d.Users.Get(file.Owner)
 	user.StorageUsed -= file.Size
-	d.Users[file.Owner] = user
+	d.Users.Upsert(file.Owner, user)
 
 	// Delete file
-	delete(d.Files, fileId)
-	delete(d.FileData, fileId)
+	d.Files.Delete(fileId)
+	d.FileData.Delete(fileId)
 
 	return nil
 }
@@ -144,55 +154,49 @@ func (d *Database) CreateShareLink(link ShareLink) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.ShareLinks[link.ID] = link
+	d.ShareLinks.Upsert(link.ID, link)
 	return nil
 }
 
 // HTTP Handlers
-func listFiles(c *fiber.Ctx) error {
+func (h *handlers) listFiles(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	path := c.Query("path", "/")
 	email := c.Get("X-User-Email")
 
 	if email == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "User email is required",
-		})
+		return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "User email is required")
 	}
 
 	// Verify user exists
 	_, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusUnauthorized, err)
 	}
 
 	var files []FileMetadata
 	db.mu.RLock()
-	for _, file := range db.Files {
+	for _, file := range db.Files.List() {
 		if file.Owner == email && filepath.Dir(file.Path) == path {
 			files = append(files, file)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(files)
+	return server.List(c, files, "path")
 }
 
-func uploadFile(c *fiber.Ctx) error {
+func (h *handlers) uploadFile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Get("X-User-Email")
 	if email == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "User email is required",
-		})
+		return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "User email is required")
 	}
 
 	// Get the file from form
 	file, err := c.FormFile("file")
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "File is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "File is required")
 	}
 
 	path := c.FormValue("path", "/")
@@ -200,51 +204,44 @@ func uploadFile(c *fiber.Ctx) error {
 	// Read file content
 	fileContent, err := file.Open()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to read file",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to read file")
 	}
 	defer fileContent.Close()
 
 	// Create file metadata
 	metadata := FileMetadata{
-		ID:       uuid.New().String(),
+		ID:       server.NewID("FILE"),
 		Name:     file.Filename,
 		Path:     filepath.Join(path, file.Filename),
 		Type:     FileTypeFile,
 		Size:     file.Size,
-		Modified: time.Now(),
+		Modified: h.clock.Now(),
 		Owner:    email,
 	}
 
 	// Read file data
 	data := make([]byte, file.Size)
 	if _, err := fileContent.Read(data); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to read file content",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to read file content")
 	}
 
 	// Save file
 	if err := db.SaveFile(metadata, data); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusBadRequest, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(metadata)
 }
 
-func downloadFile(c *fiber.Ctx) error {
+func (h *handlers) downloadFile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	fileId := c.Params("fileId")
 	email := c.Get("X-User-Email")
 
 	// Get file metadata
 	file, err := db.GetFile(fileId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "File not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "File not found")
 	}
 
 	// Check ownership or shared access
@@ -252,8 +249,8 @@ func downloadFile(c *fiber.Ctx) error {
 		// Check if file is shared
 		hasAccess := false
 		db.mu.RLock()
-		for _, link := range db.ShareLinks {
-			if link.FileID == fileId && link.Expiration.After(time.Now()) {
+		for _, link := range db.ShareLinks.List() {
+			if link.FileID == fileId && link.Expiration.After(h.clock.Now()) {
 				hasAccess = true
 				break
 			}
@@ -261,65 +258,55 @@ func downloadFile(c *fiber.Ctx) error {
 		db.mu.RUnlock()
 
 		if !hasAccess {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Unauthorized access",
-			})
+			return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "Unauthorized access")
 		}
 	}
 
 	// Get file data
 	db.mu.RLock()
-	data, exists := db.FileData[fileId]
+	data, exists := db.FileData.Get(fileId)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "File data not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "File data not found")
 	}
 
 	return c.Send(data)
 }
 
-func deleteFile(c *fiber.Ctx) error {
+func (h *handlers) deleteFile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	fileId := c.Params("fileId")
 	email := c.Get("X-User-Email")
 
 	// Get file metadata
 	file, err := db.GetFile(fileId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "File not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "File not found")
 	}
 
 	// Check ownership
 	if file.Owner != email {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized access",
-		})
+		return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "Unauthorized access")
 	}
 
 	// Delete file
 	if err := db.DeleteFile(fileId); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete file",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to delete file")
 	}
 
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
-func createShareLink(c *fiber.Ctx) error {
+func (h *handlers) createShareLink(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		FileID     string    `json:"fileId"`
 		Expiration time.Time `json:"expiration"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	email := c.Get("X-User-Email")
@@ -327,101 +314,94 @@ func createShareLink(c *fiber.Ctx) error {
 	// Get file metadata
 	file, err := db.GetFile(req.FileID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "File not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "File not found")
 	}
 
 	// Check ownership
 	if file.Owner != email {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized access",
-		})
+		return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "Unauthorized access")
 	}
 
 	// Create share link
 	link := ShareLink{
-		ID:         uuid.New().String(),
+		ID:         server.NewID("LINK"),
 		URL:        fmt.Sprintf("https://dropbox.com/share/%s", uuid.New().String()),
 		FileID:     req.FileID,
 		Expiration: req.Expiration,
-		Created:    time.Now(),
+		Created:    h.clock.Now(),
 	}
 
 	if err := db.CreateShareLink(link); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create share link",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create share link")
 	}
 
 	return c.JSON(link)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:      make(map[string]User),
-		Files:      make(map[string]FileMetadata),
-		ShareLinks: make(map[string]ShareLink),
-		FileData:   make(map[string][]byte),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// File routes
-	api.Get("/files", listFiles)
-	api.Post("/files", uploadFile)
-	api.Get("/files/:fileId", downloadFile)
-	api.Delete("/files/:fileId", deleteFile)
+	api.Get("/files", h.listFiles)
+	api.Post("/files", h.uploadFile)
+	api.Get("/files/:fileId", h.downloadFile)
+	api.Delete("/files/:fileId", h.deleteFile)
 
 	// Share routes
-	api.Post("/shares", createShareLink)
+	api.Post("/shares", h.createShareLink)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept, X-User-Email",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithAllowHeaders("X-User-Email"),
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "files"},
+			Search:  []string{"files"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
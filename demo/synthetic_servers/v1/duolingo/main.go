@@ -1,18 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -66,8 +62,8 @@ type Question struct {
 }
 
 type LessonProgress struct {
-	UserEmail   string    `json:"user_email"`
-	LessonID    string    `json:"lesson_id"`
+	UserEmail   string    `json:"user_email" validate:"required,email"`
+	LessonID    string    `json:"lesson_id" validate:"required"`
 	Score       int       `json:"score"`
 	Mistakes    int       `json:"mistakes"`
 	Completed   bool      `json:"completed"`
@@ -76,15 +72,29 @@ type LessonProgress struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]UserProfile    `json:"users"`
-	Courses  map[string]Course         `json:"courses"`
-	Lessons  map[string]Lesson         `json:"lessons"`
-	Progress map[string]LessonProgress `json:"progress"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[UserProfile]    `json:"users"`
+	Courses  server.Repository[Course]         `json:"courses"`
+	Lessons  server.Repository[Lesson]         `json:"lessons"`
+	Progress server.Repository[LessonProgress] `json:"progress"`
 	mu       sync.RWMutex
+	clock    *server.Clock
 }
 
-// Global database instance
-var db *Database
+// handlers take Duolingo learners through courses and lessons, keeping their
+// progress in db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the courses, lessons and progress in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Error definitions
 var (
@@ -99,7 +109,7 @@ func (d *Database) GetUser(email string) (UserProfile, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return UserProfile{}, ErrUserNotFound
 	}
@@ -110,12 +120,12 @@ func (d *Database) UpdateUserProgress(email string, lessonProgress LessonProgres
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
 
-	lesson, exists := d.Lessons[lessonProgress.LessonID]
+	lesson, exists := d.Lessons.Get(lessonProgress.LessonID)
 	if !exists {
 		return ErrLessonNotFound
 	}
@@ -125,7 +135,7 @@ func (d *Database) UpdateUserProgress(email string, lessonProgress LessonProgres
 	user.TotalXP += xpEarned
 
 	// Update streak
-	if time.Since(user.LastPracticeDate) > 24*time.Hour {
+	if server.Since(user.LastPracticeDate) > 24*time.Hour {
 		if user.FreezeRemaining > 0 {
 			user.FreezeRemaining--
 		} else {
@@ -136,10 +146,10 @@ func (d *Database) UpdateUserProgress(email string, lessonProgress LessonProgres
 	if user.CurrentStreak > user.LongestStreak {
 		user.LongestStreak = user.CurrentStreak
 	}
-	user.LastPracticeDate = time.Now()
+	user.LastPracticeDate = d.clock.Now()
 
 	// Update language progress
-	course := d.Courses[lesson.CourseID]
+	course, _ := d.Courses.Get(lesson.CourseID)
 	for i, lang := range user.LearningLanguages {
 		if lang.Language == course.Language {
 			user.LearningLanguages[i].XP += xpEarned
@@ -148,8 +158,8 @@ func (d *Database) UpdateUserProgress(email string, lessonProgress LessonProgres
 		}
 	}
 
-	d.Users[email] = user
-	d.Progress[lessonProgress.LessonID] = lessonProgress
+	d.Users.Upsert(email, user)
+	d.Progress.Upsert(lessonProgress.LessonID, lessonProgress)
 	return nil
 }
 
@@ -165,55 +175,50 @@ func calculateLevel(xp int) int {
 }
 
 // HTTP Handlers
-func getUserProfile(c *fiber.Ctx) error {
+func (h *handlers) getUserProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(user)
 }
 
-func getCourses(c *fiber.Ctx) error {
+func (h *handlers) getCourses(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	fromLanguage := c.Query("from_language")
 	if fromLanguage == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "from_language parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "from_language parameter is required")
 	}
 
 	var availableCourses []Course
 	db.mu.RLock()
-	for _, course := range db.Courses {
+	for _, course := range db.Courses.List() {
 		if course.FromLanguage == fromLanguage {
 			availableCourses = append(availableCourses, course)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(availableCourses)
+	return server.List(c, availableCourses, "from_language")
 }
 
-func getLessons(c *fiber.Ctx) error {
+func (h *handlers) getLessons(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	courseID := c.Query("course_id")
 	if courseID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "course_id parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "course_id parameter is required")
 	}
 
 	var courseLessons []Lesson
 	db.mu.RLock()
-	for _, lesson := range db.Lessons {
+	for _, lesson := range db.Lessons.List() {
 		if lesson.CourseID == courseID {
 			// Remove answers from questions before sending to client
 			lessonCopy := lesson
@@ -225,27 +230,18 @@ func getLessons(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(courseLessons)
+	return server.List(c, courseLessons, "course_id")
 }
 
-func submitProgress(c *fiber.Ctx) error {
+func (h *handlers) submitProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var progress LessonProgress
-	if err := c.BodyParser(&progress); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	if progress.UserEmail == "" || progress.LessonID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "user_email and lesson_id are required",
-		})
+	if err := server.Bind(c, &progress); err != nil {
+		return err
 	}
 
 	if err := db.UpdateUserProgress(progress.UserEmail, progress); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
@@ -253,19 +249,16 @@ func submitProgress(c *fiber.Ctx) error {
 	})
 }
 
-func getStreak(c *fiber.Ctx) error {
+func (h *handlers) getStreak(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(fiber.Map{
@@ -276,77 +269,77 @@ func getStreak(c *fiber.Ctx) error {
 	})
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:    make(map[string]UserProfile),
-		Courses:  make(map[string]Course),
-		Lessons:  make(map[string]Lesson),
-		Progress: make(map[string]LessonProgress),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Profile routes
-	api.Get("/profile", getUserProfile)
+	api.Get("/profile", h.getUserProfile)
 
 	// Course routes
-	api.Get("/courses", getCourses)
+	api.Get("/courses", h.getCourses)
 
 	// Lesson routes
-	api.Get("/lessons", getLessons)
+	api.Get("/lessons", h.getLessons)
 
 	// Progress routes
-	api.Post("/progress", submitProgress)
+	api.Post("/progress", h.submitProgress)
 
 	// Streak routes
-	api.Get("/streaks", getStreak)
+	api.Get("/streaks", h.getStreak)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"progress"},
+			Search:  []string{"courses", "lessons"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
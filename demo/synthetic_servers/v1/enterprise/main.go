@@ -1,18 +1,20 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"log"
-	"os"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -27,15 +29,34 @@ type Location struct {
 }
 
 type Vehicle struct {
-	ID        string   `json:"id"`
-	Make      string   `json:"make"`
-	Model     string   `json:"model"`
-	Year      int      `json:"year"`
-	Category  string   `json:"category"`
-	DailyRate float64  `json:"daily_rate"`
-	Features  []string `json:"features"`
+	ID        string      `json:"id"`
+	Make      string      `json:"make"`
+	Model     string      `json:"model"`
+	Year      int         `json:"year"`
+	Category  string      `json:"category"`
+	DailyRate money.Money `json:"daily_rate"`
+	Features  []string    `json:"features"`
+	// Tracked between rentals; fuel level is a fraction of a full tank
+	Odometer    int           `json:"odometer"`
+	FuelLevel   float64       `json:"fuel_level"`
+	TankGallons float64       `json:"tank_gallons"`
+	Status      VehicleStatus `json:"status"`
 }
 
+type VehicleStatus string
+
+const (
+	VehicleAvailable VehicleStatus = "available"
+	VehicleRented    VehicleStatus = "rented"
+)
+
+// vehicleMachine is the statuses a vehicle moves between as it is picked
+// up and returned.
+var vehicleMachine = &statemachine.Machine{Name: "vehicle", Moves: map[string][]string{
+	string(VehicleAvailable): {string(VehicleRented)},
+	string(VehicleRented):    {string(VehicleAvailable)},
+}}
+
 type User struct {
 	Email           string    `json:"email"`
 	Name            string    `json:"name"`
@@ -64,28 +85,180 @@ const (
 	StatusCancelled ReservationStatus = "cancelled"
 )
 
+// reservationMachine is the statuses a reservation moves through: it is
+// active from pickup until the vehicle is returned.
+var reservationMachine = &statemachine.Machine{Name: "reservation", Moves: map[string][]string{
+	string(StatusPending):   {string(StatusConfirmed), string(StatusActive), string(StatusCancelled)},
+	string(StatusConfirmed): {string(StatusActive), string(StatusCancelled)},
+	string(StatusActive):    {string(StatusCompleted)},
+}}
+
 type Reservation struct {
-	ID             string            `json:"id"`
-	UserEmail      string            `json:"user_email"`
-	Vehicle        Vehicle           `json:"vehicle"`
-	PickupLocation Location          `json:"pickup_location"`
-	ReturnLocation Location          `json:"return_location"`
-	PickupDate     time.Time         `json:"pickup_date"`
-	ReturnDate     time.Time         `json:"return_date"`
-	Status         ReservationStatus `json:"status"`
-	TotalCost      float64           `json:"total_cost"`
-	PaymentMethod  string            `json:"payment_method"`
-	CreatedAt      time.Time         `json:"created_at"`
-	UpdatedAt      time.Time         `json:"updated_at"`
+	ID             string             `json:"id"`
+	UserEmail      string             `json:"user_email"`
+	Vehicle        Vehicle            `json:"vehicle"`
+	PickupLocation Location           `json:"pickup_location"`
+	ReturnLocation Location           `json:"return_location"`
+	PickupDate     time.Time          `json:"pickup_date"`
+	ReturnDate     time.Time          `json:"return_date"`
+	Status         ReservationStatus  `json:"status"`
+	TotalCost      money.Money        `json:"total_cost"`
+	PaymentMethod  string             `json:"payment_method"`
+	AddOns         []ReservationAddOn `json:"add_ons"`
+	PickupDetails  *Checkpoint        `json:"pickup_details,omitempty"`
+	ReturnDetails  *Checkpoint        `json:"return_details,omitempty"`
+	Invoice        *Invoice           `json:"invoice,omitempty"`
+	CreatedAt      time.Time          `json:"created_at"`
+	UpdatedAt      time.Time          `json:"updated_at"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+}
+
+// AddOn is an optional extra priced per day. Inventory caps how many units
+// each pickup location can have out at once; add-ons without inventory
+// (coverage, additional drivers) are unlimited.
+type AddOn struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	DailyRate   money.Money    `json:"daily_rate"`
+	MaxQuantity int            `json:"max_quantity"`
+	Inventory   map[string]int `json:"inventory,omitempty"` // Keyed by location ID
+}
+
+type AddOnSelection struct {
+	AddOnID  string `json:"add_on_id" validate:"required"`
+	Quantity int    `json:"quantity" validate:"gt=0"`
+}
+
+// ReservationAddOn is an add-on as priced on a reservation.
+type ReservationAddOn struct {
+	AddOnID   string      `json:"add_on_id"`
+	Name      string      `json:"name"`
+	Quantity  int         `json:"quantity"`
+	DailyRate money.Money `json:"daily_rate"`
+	Amount    money.Money `json:"amount"`
+}
+
+// Checkpoint is the vehicle's condition when it leaves or comes back.
+type Checkpoint struct {
+	Odometer  int       `json:"odometer"`
+	FuelLevel float64   `json:"fuel_level"`
+	At        time.Time `json:"at"`
+}
+
+type InvoiceLine struct {
+	Description string      `json:"description"`
+	Quantity    float64     `json:"quantity"`
+	UnitPrice   money.Money `json:"unit_price"`
+	Amount      money.Money `json:"amount"`
 }
 
+type Invoice struct {
+	ReservationID string        `json:"reservation_id"`
+	Lines         []InvoiceLine `json:"lines"`
+	Total         money.Money   `json:"total"`
+	IssuedAt      time.Time     `json:"issued_at"`
+}
+
+// IncidentReport is the renter's account of damage, filed at return.
+type IncidentReport struct {
+	ID            string      `json:"id"`
+	ReservationID string      `json:"reservation_id"`
+	UserEmail     string      `json:"user_email"`
+	Description   string      `json:"description"`
+	Photos        []PhotoMeta `json:"photos"`
+	ClaimID       string      `json:"claim_id"`
+	ReportedAt    time.Time   `json:"reported_at"`
+}
+
+// PhotoMeta describes an uploaded photo; the image itself lives elsewhere.
+type PhotoMeta struct {
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	SizeBytes   int64     `json:"size_bytes"`
+	TakenAt     time.Time `json:"taken_at"`
+	Caption     string    `json:"caption,omitempty"`
+}
+
+type ClaimStatus string
+
+// Claims move submitted -> assessed -> charged, or closed when nothing is
+// owed.
+const (
+	ClaimSubmitted ClaimStatus = "submitted"
+	ClaimAssessed  ClaimStatus = "assessed"
+	ClaimCharged   ClaimStatus = "charged"
+	ClaimClosed    ClaimStatus = "closed"
+)
+
+// claimMachine is the statuses a damage claim moves through. It can be
+// assessed again until it is charged or closed.
+var claimMachine = &statemachine.Machine{Name: "claim", Moves: map[string][]string{
+	string(ClaimSubmitted): {string(ClaimAssessed)},
+	string(ClaimAssessed):  {string(ClaimAssessed), string(ClaimCharged), string(ClaimClosed)},
+}}
+
+type DamageClaim struct {
+	ID            string       `json:"id"`
+	ReservationID string       `json:"reservation_id"`
+	IncidentID    string       `json:"incident_id"`
+	UserEmail     string       `json:"user_email"`
+	VehicleID     string       `json:"vehicle_id"`
+	Status        ClaimStatus  `json:"status"`
+	Assessment    *Assessment  `json:"assessment,omitempty"`
+	Charge        money.Money  `json:"charge"`
+	WaiverApplied bool         `json:"waiver_applied"`
+	PaymentMethod string       `json:"payment_method,omitempty"`
+	History       []ClaimEvent `json:"history"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+type Assessment struct {
+	Assessor       string      `json:"assessor"`
+	RepairEstimate money.Money `json:"repair_estimate"`
+	Notes          string      `json:"notes"`
+	AssessedAt     time.Time   `json:"assessed_at"`
+}
+
+type ClaimEvent struct {
+	Status ClaimStatus `json:"status"`
+	Note   string      `json:"note"`
+	At     time.Time   `json:"at"`
+}
+
+const (
+	damageWaiverAddOn = "addon_cdw"
+	maxIncidentPhotos = 20
+)
+
+// Rental charges applied at return
+const (
+	includedMilesPerDay = 200
+	defaultTankGallons  = 15.0
+	lateReturnGrace     = 29 * time.Minute
+)
+
+var (
+	mileageOverageRate = money.Cents(25)  // per mile
+	refuelRate         = money.Cents(999) // per gallon
+)
+
 // Database represents our in-memory database
 type Database struct {
-	Users        map[string]User        `json:"users"`
-	Vehicles     map[string]Vehicle     `json:"vehicles"`
-	Locations    map[string]Location    `json:"locations"`
-	Reservations map[string]Reservation `json:"reservations"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users        server.Repository[User]           `json:"users"`
+	Vehicles     server.Repository[Vehicle]        `json:"vehicles"`
+	Locations    server.Repository[Location]       `json:"locations"`
+	Reservations server.Repository[Reservation]    `json:"reservations"`
+	AddOns       server.Repository[AddOn]          `json:"add_ons"`
+	Incidents    server.Repository[IncidentReport] `json:"incidents"`
+	Claims       server.Repository[DamageClaim]    `json:"claims"`
 	mu           sync.RWMutex
+	clock        *server.Clock
 }
 
 // Custom errors
@@ -95,16 +268,40 @@ var (
 	ErrLocationNotFound    = errors.New("location not found")
 	ErrReservationNotFound = errors.New("reservation not found")
 	ErrVehicleUnavailable  = errors.New("vehicle unavailable for selected dates")
+	ErrNotPickupReady      = errors.New("only pending or confirmed reservations can be picked up")
+	ErrNotActive           = errors.New("only active reservations can be returned")
+	ErrInvalidOdometer     = errors.New("odometer reading is lower than the last recorded reading")
+	ErrInvalidFuelLevel    = errors.New("fuel_level must be between 0 and 1")
+	ErrAddOnNotFound       = errors.New("add-on not found")
+	ErrAddOnUnavailable    = errors.New("add-on is not available at this location for the selected dates")
+	ErrInvalidQuantity     = errors.New("add-on quantity must be between 1 and its maximum")
+	ErrAddOnsLocked        = errors.New("add-ons can only be changed before pickup")
+	ErrClaimNotFound       = errors.New("claim not found")
+	ErrIncidentNotAllowed  = errors.New("incidents can only be reported for active or completed rentals")
+	ErrInvalidIncident     = errors.New("a description is required, with up to 20 photos that each have a filename and image content type")
+	ErrInvalidEstimate     = errors.New("repair_estimate must be zero or more and assessor is required")
+	ErrClaimStatus         = errors.New("claim is not in a status that allows this action")
 )
 
-var db *Database
+// handlers rent Enterprise vehicles from its locations, with clock dating
+// each reservation.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the vehicles, locations and reservations in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -115,7 +312,7 @@ func (d *Database) GetVehicle(id string) (Vehicle, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	vehicle, exists := d.Vehicles[id]
+	vehicle, exists := d.Vehicles.Get(id)
 	if !exists {
 		return Vehicle{}, ErrVehicleNotFound
 	}
@@ -126,161 +323,511 @@ func (d *Database) GetLocation(id string) (Location, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	location, exists := d.Locations[id]
+	location, exists := d.Locations.Get(id)
 	if !exists {
 		return Location{}, ErrLocationNotFound
 	}
 	return location, nil
 }
 
-func (d *Database) CreateReservation(res Reservation) error {
+func (d *Database) CreateReservation(res Reservation, addOns []AddOnSelection) (Reservation, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	// Check if vehicle is available for the requested dates
 	if !d.isVehicleAvailable(res.Vehicle.ID, res.PickupDate, res.ReturnDate) {
-		return ErrVehicleUnavailable
+		return Reservation{}, ErrVehicleUnavailable
+	}
+	if err := d.applyAddOns(&res, addOns); err != nil {
+		return Reservation{}, err
 	}
 
-	d.Reservations[res.ID] = res
-	return nil
+	d.Reservations.Upsert(res.ID, res)
+	return res, nil
+}
+
+// overlaps reports whether an open reservation holds its vehicle and
+// add-ons at any point between start and end.
+func (res Reservation) overlaps(start, end, now time.Time) bool {
+	if res.Status == StatusCancelled || res.Status == StatusCompleted {
+		return false
+	}
+	// A rental that's out past its return date holds the vehicle until it
+	// comes back
+	resEnd := res.ReturnDate
+	if res.Status == StatusActive && now.After(resEnd) {
+		resEnd = now
+	}
+	return !(end.Before(res.PickupDate) || start.After(resEnd))
 }
 
 func (d *Database) isVehicleAvailable(vehicleID string, start, end time.Time) bool {
-	for _, res := range d.Reservations {
-		if res.Vehicle.ID == vehicleID &&
-			res.Status != StatusCancelled &&
-			res.Status != StatusCompleted {
-			// Check for date overlap
-			if !(end.Before(res.PickupDate) || start.After(res.ReturnDate)) {
-				return false
-			}
+	for _, res := range d.Reservations.List() {
+		if res.Vehicle.ID == vehicleID && res.overlaps(start, end, d.clock.Now()) {
+			return false
 		}
 	}
 	return true
 }
 
+// addOnsAvailable returns how many units of an add-on the location can
+// still hand out between start and end, ignoring the reservation being
+// edited. Callers must hold d.mu.
+func (d *Database) addOnsAvailable(addOn AddOn, locationID string, start, end time.Time, excludeID string) int {
+	available := addOn.Inventory[locationID]
+	for _, res := range d.Reservations.List() {
+		if res.ID == excludeID || res.PickupLocation.ID != locationID || !res.overlaps(start, end, d.clock.Now()) {
+			continue
+		}
+		for _, selected := range res.AddOns {
+			if selected.AddOnID == addOn.ID {
+				available -= selected.Quantity
+			}
+		}
+	}
+	return available
+}
+
+// applyAddOns replaces a reservation's add-ons and reprices it. Callers must
+// hold d.mu.
+func (d *Database) applyAddOns(res *Reservation, selections []AddOnSelection) error {
+	days := bookedDays(res.PickupDate, res.ReturnDate)
+	chosen := []ReservationAddOn{}
+	quantities := make(map[string]int)
+	for _, selection := range selections {
+		addOn, exists := d.AddOns.Get(selection.AddOnID)
+		if !exists {
+			return ErrAddOnNotFound
+		}
+		quantity := selection.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+		quantities[addOn.ID] += quantity
+		if quantity < 0 || quantities[addOn.ID] > addOn.MaxQuantity {
+			return ErrInvalidQuantity
+		}
+		if addOn.Inventory != nil &&
+			quantities[addOn.ID] > d.addOnsAvailable(addOn, res.PickupLocation.ID, res.PickupDate, res.ReturnDate, res.ID) {
+			return ErrAddOnUnavailable
+		}
+		chosen = append(chosen, ReservationAddOn{
+			AddOnID:   addOn.ID,
+			Name:      addOn.Name,
+			Quantity:  quantity,
+			DailyRate: addOn.DailyRate,
+			Amount:    addOn.DailyRate.Times(quantity * days),
+		})
+	}
+
+	res.AddOns = chosen
+	total := res.Vehicle.DailyRate.Times(days)
+	for _, addOn := range chosen {
+		var err error
+		if total, err = total.Add(addOn.Amount); err != nil {
+			return err
+		}
+	}
+	res.TotalCost = total
+	return nil
+}
+
+func (d *Database) UpdateAddOns(id string, selections []AddOnSelection) (Reservation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, exists := d.Reservations.Get(id)
+	if !exists {
+		return Reservation{}, ErrReservationNotFound
+	}
+	if res.Status != StatusPending && res.Status != StatusConfirmed {
+		return Reservation{}, ErrAddOnsLocked
+	}
+	if err := d.applyAddOns(&res, selections); err != nil {
+		return Reservation{}, err
+	}
+	res.UpdatedAt = d.clock.Now()
+	d.Reservations.Upsert(res.ID, res)
+	return res, nil
+}
+
+// bookedDays is the number of whole days a reservation is priced for.
+func bookedDays(start, end time.Time) int {
+	return int(end.Sub(start).Hours() / 24)
+}
+
+func (d *Database) PickupReservation(id string, odometer int, fuelLevel float64) (Reservation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, exists := d.Reservations.Get(id)
+	if !exists {
+		return Reservation{}, ErrReservationNotFound
+	}
+	now := d.clock.Now()
+	if err := statemachine.Move(reservationMachine, &res, &res.Status, &res.StatusHistory, StatusActive, now); err != nil {
+		return Reservation{}, ErrNotPickupReady
+	}
+	vehicle, exists := d.Vehicles.Get(res.Vehicle.ID)
+	if !exists {
+		return Reservation{}, ErrVehicleNotFound
+	}
+	if fuelLevel < 0 || fuelLevel > 1 {
+		return Reservation{}, ErrInvalidFuelLevel
+	}
+	if odometer < vehicle.Odometer {
+		return Reservation{}, ErrInvalidOdometer
+	}
+
+	if err := statemachine.Move(vehicleMachine, &vehicle, &vehicle.Status, nil, VehicleRented, now); err != nil {
+		return Reservation{}, ErrVehicleUnavailable
+	}
+	vehicle.Odometer = odometer
+	vehicle.FuelLevel = fuelLevel
+	d.Vehicles.Upsert(vehicle.ID, vehicle)
+
+	res.PickupDetails = &Checkpoint{Odometer: odometer, FuelLevel: fuelLevel, At: now}
+	res.UpdatedAt = now
+	d.Reservations.Upsert(res.ID, res)
+	return res, nil
+}
+
+// invoice itemizes a returned rental: the booked days, days past the
+// scheduled return beyond a short grace period, miles over the daily
+// allowance and fuel needed to refill to the pickup level.
+func invoice(res Reservation, vehicle Vehicle, now time.Time) (*Invoice, error) {
+	inv := &Invoice{ReservationID: res.ID, IssuedAt: now, Total: money.New(0, res.Vehicle.DailyRate.Code())}
+	var err error
+	add := func(description string, quantity float64, unitPrice money.Money) {
+		amount := unitPrice.Mul(quantity)
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			Description: description,
+			Quantity:    quantity,
+			UnitPrice:   unitPrice,
+			Amount:      amount,
+		})
+		if err == nil {
+			inv.Total, err = inv.Total.Add(amount)
+		}
+	}
+
+	days := bookedDays(res.PickupDate, res.ReturnDate)
+	add("Rental", float64(days), res.Vehicle.DailyRate)
+
+	returned := res.ReturnDetails.At
+	extraDays := 0
+	if returned.After(res.ReturnDate.Add(lateReturnGrace)) {
+		// Any part of a late day is charged as a full day
+		extraDays = int(math.Ceil(returned.Sub(res.ReturnDate).Hours() / 24))
+		add("Extra days", float64(extraDays), res.Vehicle.DailyRate)
+	}
+
+	// Add-ons stay on the bill for as long as the car is out
+	for _, addOn := range res.AddOns {
+		add(fmt.Sprintf("%s x%d", addOn.Name, addOn.Quantity), float64(addOn.Quantity*(days+extraDays)), addOn.DailyRate)
+	}
+
+	driven := res.ReturnDetails.Odometer - res.PickupDetails.Odometer
+	if over := driven - includedMilesPerDay*(days+extraDays); over > 0 {
+		add(fmt.Sprintf("Mileage over %d miles/day allowance", includedMilesPerDay), float64(over), mileageOverageRate)
+	}
+
+	if missing := res.PickupDetails.FuelLevel - res.ReturnDetails.FuelLevel; missing > 0 {
+		tank := vehicle.TankGallons
+		if tank <= 0 {
+			tank = defaultTankGallons
+		}
+		gallons := math.Round(missing*tank*10) / 10
+		add("Refueling", gallons, refuelRate)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func (d *Database) ReturnReservation(id string, odometer int, fuelLevel float64) (Reservation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, exists := d.Reservations.Get(id)
+	if !exists {
+		return Reservation{}, ErrReservationNotFound
+	}
+	now := d.clock.Now()
+	if err := statemachine.Move(reservationMachine, &res, &res.Status, &res.StatusHistory, StatusCompleted, now); err != nil || res.PickupDetails == nil {
+		return Reservation{}, ErrNotActive
+	}
+	if fuelLevel < 0 || fuelLevel > 1 {
+		return Reservation{}, ErrInvalidFuelLevel
+	}
+	if odometer < res.PickupDetails.Odometer {
+		return Reservation{}, ErrInvalidOdometer
+	}
+
+	vehicle, _ := d.Vehicles.Get(res.Vehicle.ID)
+	if err := statemachine.Move(vehicleMachine, &vehicle, &vehicle.Status, nil, VehicleAvailable, now); err != nil {
+		return Reservation{}, err
+	}
+	vehicle.Odometer = odometer
+	vehicle.FuelLevel = fuelLevel
+	d.Vehicles.Upsert(vehicle.ID, vehicle)
+
+	res.ReturnDetails = &Checkpoint{Odometer: odometer, FuelLevel: fuelLevel, At: now}
+	inv, err := invoice(res, vehicle, now)
+	if err != nil {
+		return Reservation{}, err
+	}
+	res.Invoice = inv
+	res.TotalCost = inv.Total
+	res.UpdatedAt = now
+	d.Reservations.Upsert(res.ID, res)
+	return res, nil
+}
+
+// ReportIncident files an incident for a rental and opens a damage claim
+// for it.
+func (d *Database) ReportIncident(reservationID, description string, photos []PhotoMeta) (IncidentReport, DamageClaim, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, exists := d.Reservations.Get(reservationID)
+	if !exists {
+		return IncidentReport{}, DamageClaim{}, ErrReservationNotFound
+	}
+	if res.Status != StatusActive && res.Status != StatusCompleted {
+		return IncidentReport{}, DamageClaim{}, ErrIncidentNotAllowed
+	}
+	if strings.TrimSpace(description) == "" || len(photos) > maxIncidentPhotos {
+		return IncidentReport{}, DamageClaim{}, ErrInvalidIncident
+	}
+	for _, photo := range photos {
+		if photo.Filename == "" || !strings.HasPrefix(photo.ContentType, "image/") || photo.SizeBytes < 0 {
+			return IncidentReport{}, DamageClaim{}, ErrInvalidIncident
+		}
+	}
+	if photos == nil {
+		photos = []PhotoMeta{}
+	}
+
+	now := d.clock.Now()
+	incident := IncidentReport{
+		ID:            server.NewID("INC"),
+		ReservationID: res.ID,
+		UserEmail:     res.UserEmail,
+		Description:   description,
+		Photos:        photos,
+		ReportedAt:    now,
+	}
+	claim := DamageClaim{
+		ID:            server.NewID("DCLM"),
+		ReservationID: res.ID,
+		IncidentID:    incident.ID,
+		UserEmail:     res.UserEmail,
+		VehicleID:     res.Vehicle.ID,
+		Status:        ClaimSubmitted,
+		History:       []ClaimEvent{{Status: ClaimSubmitted, Note: "Incident reported", At: now}},
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	incident.ClaimID = claim.ID
+	d.Incidents.Upsert(incident.ID, incident)
+	d.Claims.Upsert(claim.ID, claim)
+	return incident, claim, nil
+}
+
+func (d *Database) GetClaim(id string) (DamageClaim, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	claim, exists := d.Claims.Get(id)
+	if !exists {
+		return DamageClaim{}, ErrClaimNotFound
+	}
+	return claim, nil
+}
+
+// AssessClaim records the repair estimate. Renters who bought the damage
+// waiver owe nothing.
+func (d *Database) AssessClaim(id, assessor string, estimate money.Money, notes string) (DamageClaim, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	claim, exists := d.Claims.Get(id)
+	if !exists {
+		return DamageClaim{}, ErrClaimNotFound
+	}
+	now := d.clock.Now()
+	if err := statemachine.Move(claimMachine, &claim, &claim.Status, nil, ClaimAssessed, now); err != nil {
+		return DamageClaim{}, ErrClaimStatus
+	}
+	if assessor == "" || estimate.IsNegative() {
+		return DamageClaim{}, ErrInvalidEstimate
+	}
+
+	claim.Assessment = &Assessment{
+		Assessor:       assessor,
+		RepairEstimate: estimate,
+		Notes:          notes,
+		AssessedAt:     now,
+	}
+	claim.Charge = claim.Assessment.RepairEstimate
+	claim.WaiverApplied = false
+	res, _ := d.Reservations.Get(claim.ReservationID)
+	for _, addOn := range res.AddOns {
+		if addOn.AddOnID == damageWaiverAddOn {
+			claim.Charge = money.Money{}
+			claim.WaiverApplied = true
+		}
+	}
+	note := fmt.Sprintf("Repair estimated at %s", claim.Assessment.RepairEstimate.Format())
+	if claim.WaiverApplied {
+		note += "; covered by damage waiver"
+	}
+	claim.History = append(claim.History, ClaimEvent{Status: ClaimAssessed, Note: note, At: now})
+	claim.UpdatedAt = now
+	d.Claims.Upsert(claim.ID, claim)
+	return claim, nil
+}
+
+// ChargeClaim bills an assessed claim to the rental's payment method, or
+// closes it when nothing is owed.
+func (d *Database) ChargeClaim(id string) (DamageClaim, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	claim, exists := d.Claims.Get(id)
+	if !exists {
+		return DamageClaim{}, ErrClaimNotFound
+	}
+	now := d.clock.Now()
+	to := ClaimClosed
+	if claim.Charge.IsPositive() {
+		to = ClaimCharged
+	}
+	if err := statemachine.Move(claimMachine, &claim, &claim.Status, nil, to, now); err != nil {
+		return DamageClaim{}, ErrClaimStatus
+	}
+	if to == ClaimCharged {
+		res, _ := d.Reservations.Get(claim.ReservationID)
+		claim.PaymentMethod = res.PaymentMethod
+		claim.History = append(claim.History, ClaimEvent{
+			Status: ClaimCharged,
+			Note:   fmt.Sprintf("Charged %s to %s", claim.Charge.Format(), claim.PaymentMethod),
+			At:     now,
+		})
+	} else {
+		claim.History = append(claim.History, ClaimEvent{Status: ClaimClosed, Note: "Closed with no charge", At: now})
+	}
+	claim.UpdatedAt = now
+	d.Claims.Upsert(claim.ID, claim)
+	return claim, nil
+}
+
 // HTTP Handlers
-func getAvailableVehicles(c *fiber.Ctx) error {
+func (h *handlers) getAvailableVehicles(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	location := c.Query("location")
 	pickupDate := c.Query("pickup_date")
 	returnDate := c.Query("return_date")
 
 	if location == "" || pickupDate == "" || returnDate == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "location, pickup_date, and return_date are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "location, pickup_date, and return_date are required")
 	}
 
 	start, err := time.Parse(time.RFC3339, pickupDate)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid pickup_date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid pickup_date format")
 	}
 
 	end, err := time.Parse(time.RFC3339, returnDate)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid return_date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid return_date format")
 	}
 
 	var availableVehicles []Vehicle
 
 	db.mu.RLock()
-	for _, vehicle := range db.Vehicles {
+	for _, vehicle := range db.Vehicles.List() {
 		if db.isVehicleAvailable(vehicle.ID, start, end) {
 			availableVehicles = append(availableVehicles, vehicle)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(availableVehicles)
+	return server.List(c, availableVehicles)
 }
 
-func getUserReservations(c *fiber.Ctx) error {
+func (h *handlers) getUserReservations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userReservations []Reservation
 	db.mu.RLock()
-	for _, res := range db.Reservations {
+	for _, res := range db.Reservations.List() {
 		if res.UserEmail == email {
 			userReservations = append(userReservations, res)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userReservations)
+	return server.List(c, userReservations)
 }
 
 type CreateReservationRequest struct {
-	UserEmail        string    `json:"user_email"`
-	VehicleID        string    `json:"vehicle_id"`
-	PickupLocationID string    `json:"pickup_location_id"`
-	ReturnLocationID string    `json:"return_location_id"`
-	PickupDate       time.Time `json:"pickup_date"`
-	ReturnDate       time.Time `json:"return_date"`
-	PaymentMethod    string    `json:"payment_method"`
+	UserEmail        string           `json:"user_email" validate:"required,email"`
+	VehicleID        string           `json:"vehicle_id" validate:"required"`
+	PickupLocationID string           `json:"pickup_location_id" validate:"required"`
+	ReturnLocationID string           `json:"return_location_id" validate:"required"`
+	PickupDate       time.Time        `json:"pickup_date" validate:"required"`
+	ReturnDate       time.Time        `json:"return_date" validate:"required"`
+	PaymentMethod    string           `json:"payment_method" validate:"required"`
+	AddOns           []AddOnSelection `json:"add_ons"`
 }
 
-func createReservation(c *fiber.Ctx) error {
+func (h *handlers) createReservation(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateReservationRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate vehicle
 	vehicle, err := db.GetVehicle(req.VehicleID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate locations
 	pickupLocation, err := db.GetLocation(req.PickupLocationID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Invalid pickup location",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Invalid pickup location")
 	}
 
 	returnLocation, err := db.GetLocation(req.ReturnLocationID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Invalid return location",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Invalid return location")
 	}
 
 	// Calculate rental duration and total cost
-	days := int(req.ReturnDate.Sub(req.PickupDate).Hours() / 24)
+	days := bookedDays(req.PickupDate, req.ReturnDate)
 	if days < 1 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Minimum rental period is 1 day",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Minimum rental period is 1 day")
 	}
 
-	totalCost := vehicle.DailyRate * float64(days)
-
 	// Create reservation
 	reservation := Reservation{
-		ID:             uuid.New().String(),
+		ID:             server.NewID("RES"),
 		UserEmail:      req.UserEmail,
 		Vehicle:        vehicle,
 		PickupLocation: pickupLocation,
@@ -289,10 +836,9 @@ func createReservation(c *fiber.Ctx) error {
 
 		ReturnDate:    req.ReturnDate,
 		Status:        StatusPending,
-		TotalCost:     totalCost,
 		PaymentMethod: req.PaymentMethod,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
+		CreatedAt:     h.clock.Now(),
+		UpdatedAt:     h.clock.Now(),
 	}
 
 	// Validate payment method
@@ -304,28 +850,204 @@ func createReservation(c *fiber.Ctx) error {
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Save reservation
-	if err := db.CreateReservation(reservation); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	reservation, err = db.CreateReservation(reservation, req.AddOns)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrAddOnNotFound):
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case errors.Is(err, money.ErrMixedCurrencies):
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+		}
+		return server.FailWith(c, fiber.StatusBadRequest, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(reservation)
 }
 
-func getLocations(c *fiber.Ctx) error {
+func (h *handlers) getAddOns(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	addOns := db.AddOns.List()
+	sort.Slice(addOns, func(i, j int) bool { return addOns[i].ID < addOns[j].ID })
+	return server.List(c, addOns)
+}
+
+func (h *handlers) updateAddOns(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		AddOns []AddOnSelection `json:"add_ons"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	res, err := db.UpdateAddOns(c.Params("id"), req.AddOns)
+	if err != nil {
+		return rentalError(c, err)
+	}
+	return c.JSON(res)
+}
+
+func (h *handlers) reportIncident(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Description string      `json:"description"`
+		Photos      []PhotoMeta `json:"photos"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	incident, claim, err := db.ReportIncident(c.Params("id"), req.Description, req.Photos)
+	if err != nil {
+		return claimError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"incident": incident,
+		"claim":    claim,
+	})
+}
+
+func (h *handlers) getUserClaims(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	claims := []DamageClaim{}
+	db.mu.RLock()
+	for _, claim := range db.Claims.List() {
+		if claim.UserEmail == email {
+			claims = append(claims, claim)
+		}
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(claims, func(i, j int) bool { return claims[i].CreatedAt.After(claims[j].CreatedAt) })
+	return server.List(c, claims)
+}
+
+func (h *handlers) getClaim(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	claim, err := db.GetClaim(c.Params("id"))
+	if err != nil {
+		return claimError(c, err)
+	}
+
+	db.mu.RLock()
+	incident, _ := db.Incidents.Get(claim.IncidentID)
+	db.mu.RUnlock()
+
+	return c.JSON(fiber.Map{
+		"claim":    claim,
+		"incident": incident,
+	})
+}
+
+func (h *handlers) assessClaim(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Assessor       string      `json:"assessor"`
+		RepairEstimate money.Money `json:"repair_estimate"`
+		Notes          string      `json:"notes"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	claim, err := db.AssessClaim(c.Params("id"), req.Assessor, req.RepairEstimate, req.Notes)
+	if err != nil {
+		return claimError(c, err)
+	}
+	return c.JSON(claim)
+}
+
+func (h *handlers) chargeClaim(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	claim, err := db.ChargeClaim(c.Params("id"))
+	if err != nil {
+		return claimError(c, err)
+	}
+	return c.JSON(claim)
+}
+
+func claimError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrReservationNotFound, ErrClaimNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrIncidentNotAllowed, ErrClaimStatus:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrInvalidIncident, ErrInvalidEstimate:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+type checkpointRequest struct {
+	Odometer  int     `json:"odometer"`
+	FuelLevel float64 `json:"fuel_level"`
+}
+
+func (h *handlers) pickupReservation(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req checkpointRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	res, err := db.PickupReservation(c.Params("id"), req.Odometer, req.FuelLevel)
+	if err != nil {
+		return rentalError(c, err)
+	}
+	return c.JSON(res)
+}
+
+func (h *handlers) returnReservation(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req checkpointRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	res, err := db.ReturnReservation(c.Params("id"), req.Odometer, req.FuelLevel)
+	if err != nil {
+		return rentalError(c, err)
+	}
+	return c.JSON(res)
+}
+
+func rentalError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, money.ErrMixedCurrencies) {
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	}
+	switch err {
+	case ErrReservationNotFound, ErrVehicleNotFound, ErrAddOnNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNotPickupReady, ErrNotActive, ErrAddOnsLocked, ErrAddOnUnavailable, ErrVehicleUnavailable:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrInvalidOdometer, ErrInvalidFuelLevel, ErrInvalidQuantity:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) getLocations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	city := c.Query("city")
 	state := c.Query("state")
 
 	var filteredLocations []Location
 	db.mu.RLock()
-	for _, location := range db.Locations {
+	for _, location := range db.Locations.List() {
 		if (city == "" || location.City == city) &&
 			(state == "" || location.State == state) {
 			filteredLocations = append(filteredLocations, location)
@@ -333,70 +1055,88 @@ func getLocations(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(filteredLocations)
+	return server.List(c, filteredLocations, "city", "state")
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:        make(map[string]User),
-		Vehicles:     make(map[string]Vehicle),
-		Locations:    make(map[string]Location),
-		Reservations: make(map[string]Reservation),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Vehicle routes
-	api.Get("/vehicles", getAvailableVehicles)
+	api.Get("/vehicles", h.getAvailableVehicles)
 
 	// Reservation routes
-	api.Get("/reservations", getUserReservations)
-	api.Post("/reservations", createReservation)
+	api.Get("/reservations", h.getUserReservations)
+	api.Post("/reservations", h.createReservation)
+	api.Put("/reservations/:id/add-ons", h.updateAddOns)
+	api.Post("/reservations/:id/pickup", h.pickupReservation)
+	api.Post("/reservations/:id/return", h.returnReservation)
+	api.Post("/reservations/:id/incidents", h.reportIncident)
+
+	// Damage claim routes
+	api.Get("/claims", h.getUserClaims)
+	api.Get("/claims/:id", h.getClaim)
+	api.Post("/claims/:id/assess", server.RequireRole(server.RoleAdmin), h.assessClaim)
+	api.Post("/claims/:id/charge", server.RequireRole(server.RoleAdmin), h.chargeClaim)
+
+	// Add-on routes
+	api.Get("/add-ons", h.getAddOns)
 
 	// Location routes
-	api.Get("/locations", getLocations)
+	api.Get("/locations", h.getLocations)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(cors.New())
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Setup routes
-	setupRoutes(app)
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"reservations", "incidents", "claims"},
+			Search:  []string{"vehicles", "locations", "reservations"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
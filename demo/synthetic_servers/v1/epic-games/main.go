@@ -1,33 +1,29 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
 type Game struct {
-	ID          string    `json:"id"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	Price       float64   `json:"price"`
-	SalePrice   *float64  `json:"sale_price,omitempty"`
-	Publisher   string    `json:"publisher"`
-	ReleaseDate time.Time `json:"release_date"`
-	Categories  []string  `json:"categories"`
-	Rating      string    `json:"rating"`
-	Size        float64   `json:"size"` // In GB
+	ID          string       `json:"id"`
+	Title       string       `json:"title"`
+	Description string       `json:"description"`
+	Price       money.Money  `json:"price"`
+	SalePrice   *money.Money `json:"sale_price,omitempty"`
+	Publisher   string       `json:"publisher"`
+	ReleaseDate time.Time    `json:"release_date"`
+	Categories  []string     `json:"categories"`
+	Rating      string       `json:"rating"`
+	Size        float64      `json:"size"` // In GB
 }
 
 type LibraryGame struct {
@@ -75,31 +71,45 @@ type PaymentMethod struct {
 }
 
 type Purchase struct {
-	ID              string    `json:"id"`
-	UserEmail       string    `json:"user_email"`
-	GameID          string    `json:"game_id"`
-	Price           float64   `json:"price"`
-	PaymentMethodID string    `json:"payment_method_id"`
-	PurchaseDate    time.Time `json:"purchase_date"`
+	ID              string      `json:"id"`
+	UserEmail       string      `json:"user_email"`
+	GameID          string      `json:"game_id"`
+	Price           money.Money `json:"price"`
+	PaymentMethodID string      `json:"payment_method_id"`
+	PurchaseDate    time.Time   `json:"purchase_date"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users        map[string]User        `json:"users"`
-	Games        map[string]Game        `json:"games"`
-	Achievements map[string]Achievement `json:"achievements"`
-	Purchases    map[string]Purchase    `json:"purchases"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users        server.Repository[User]        `json:"users"`
+	Games        server.Repository[Game]        `json:"games"`
+	Achievements server.Repository[Achievement] `json:"achievements"`
+	Purchases    server.Repository[Purchase]    `json:"purchases"`
 	mu           sync.RWMutex
 }
 
-var db *Database
+// handlers sell Epic Games titles and keep players' achievements, dating
+// purchases by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the games, achievements and purchases in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -110,7 +120,7 @@ func (d *Database) GetGame(id string) (Game, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	game, exists := d.Games[id]
+	game, exists := d.Games.Get(id)
 	if !exists {
 		return Game{}, errors.New("game not found")
 	}
@@ -121,11 +131,11 @@ func (d *Database) AddPurchase(purchase Purchase) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Purchases[purchase.ID] = purchase
+	d.Purchases.Upsert(purchase.ID, purchase)
 
 	// Add game to user's library
-	user := d.Users[purchase.UserEmail]
-	game := d.Games[purchase.GameID]
+	user, _ := d.Users.Get(purchase.UserEmail)
+	game, _ := d.Games.Get(purchase.GameID)
 
 	libraryGame := LibraryGame{
 		Game:         game,
@@ -135,19 +145,20 @@ func (d *Database) AddPurchase(purchase Purchase) error {
 	}
 
 	user.Library = append(user.Library, libraryGame)
-	d.Users[purchase.UserEmail] = user
+	d.Users.Upsert(purchase.UserEmail, user)
 
 	return nil
 }
 
 // HTTP Handlers
-func getGames(c *fiber.Ctx) error {
+func (h *handlers) getGames(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	onSale := c.QueryBool("onSale", false)
 
 	var games []Game
 	db.mu.RLock()
-	for _, game := range db.Games {
+	for _, game := range db.Games.List() {
 		if category != "" {
 			categoryMatch := false
 			for _, cat := range game.Categories {
@@ -169,60 +180,51 @@ func getGames(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(games)
+	return server.List(c, games)
 }
 
-func getLibrary(c *fiber.Ctx) error {
+func (h *handlers) getLibrary(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Library)
+	return server.List(c, user.Library)
 }
 
-func getFriends(c *fiber.Ctx) error {
+func (h *handlers) getFriends(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Friends)
+	return server.List(c, user.Friends)
 }
 
-func getAchievements(c *fiber.Ctx) error {
+func (h *handlers) getAchievements(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	gameId := c.Params("gameId")
 
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var gameAchievements []Achievement
@@ -232,45 +234,38 @@ func getAchievements(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(gameAchievements)
+	return server.List(c, gameAchievements)
 }
 
 type PurchaseRequest struct {
 	GameID          string `json:"game_id"`
-	UserEmail       string `json:"user_email"`
+	UserEmail       string `json:"user_email" validate:"email"`
 	PaymentMethodID string `json:"payment_method_id"`
 }
 
-func purchaseGame(c *fiber.Ctx) error {
+func (h *handlers) purchaseGame(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req PurchaseRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate game
 	game, err := db.GetGame(req.GameID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Check if user already owns the game
 	for _, libraryGame := range user.Library {
 		if libraryGame.Game.ID == req.GameID {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "User already owns this game",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "User already owns this game")
 		}
 	}
 
@@ -283,112 +278,105 @@ func purchaseGame(c *fiber.Ctx) error {
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Create purchase record
 	purchase := Purchase{
-		ID:              uuid.New().String(),
+		ID:              server.NewID("PUR"),
 		UserEmail:       req.UserEmail,
 		GameID:          req.GameID,
 		Price:           game.Price,
 		PaymentMethodID: req.PaymentMethodID,
-		PurchaseDate:    time.Now(),
+		PurchaseDate:    h.clock.Now(),
 	}
 
 	// Add purchase and update user's library
 	if err := db.AddPurchase(purchase); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to process purchase",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to process purchase")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(purchase)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:        make(map[string]User),
-		Games:        make(map[string]Game),
-		Achievements: make(map[string]Achievement),
-		Purchases:    make(map[string]Purchase),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Games routes
-	api.Get("/games", getGames)
+	api.Get("/games", h.getGames)
 	api.Get("/games/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		game, err := db.GetGame(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(game)
 	})
 
 	// Library routes
-	api.Get("/library", getLibrary)
+	api.Get("/library", h.getLibrary)
 
 	// Friends routes
-	api.Get("/friends", getFriends)
+	api.Get("/friends", h.getFriends)
 
 	// Achievements routes
-	api.Get("/achievements/:gameId", getAchievements)
+	api.Get("/achievements/:gameId", h.getAchievements)
 
 	// Purchase routes
-	api.Post("/purchases", purchaseGame)
+	api.Post("/purchases", h.purchaseGame)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "purchases"},
+			Search:  []string{"games"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -40,55 +37,87 @@ type Seller struct {
 }
 
 type Listing struct {
-	ID            string   `json:"id"`
-	Title         string   `json:"title"`
-	Description   string   `json:"description"`
-	Price         float64  `json:"price"`
-	ShippingPrice float64  `json:"shipping_price"`
-	Seller        Seller   `json:"seller"`
-	Category      string   `json:"category"`
-	Tags          []string `json:"tags"`
-	Images        []string `json:"images"`
-	CreatedAt     string   `json:"created_at"`
+	ID            string      `json:"id"`
+	Title         string      `json:"title"`
+	Description   string      `json:"description"`
+	Price         money.Money `json:"price"`
+	ShippingPrice money.Money `json:"shipping_price"`
+	Seller        Seller      `json:"seller"`
+	Category      string      `json:"category"`
+	Tags          []string    `json:"tags"`
+	Images        []string    `json:"images"`
+	CreatedAt     string      `json:"created_at"`
 }
 
 type OrderItem struct {
-	ListingID string  `json:"listing_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ListingID string      `json:"listing_id"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Money `json:"price"`
 }
 
 type Order struct {
-	ID              string      `json:"id"`
-	UserEmail       string      `json:"user_email"`
-	Items           []OrderItem `json:"items"`
-	Total           float64     `json:"total"`
-	Status          string      `json:"status"`
-	ShippingAddress string      `json:"shipping_address"`
-	CreatedAt       time.Time   `json:"created_at"`
+	ID              string                    `json:"id"`
+	UserEmail       string                    `json:"user_email"`
+	Items           []OrderItem               `json:"items"`
+	Total           money.Money               `json:"total"`
+	Status          string                    `json:"status"`
+	StatusHistory   []statemachine.Transition `json:"status_history,omitempty"`
+	ShippingAddress string                    `json:"shipping_address"`
+	CreatedAt       time.Time                 `json:"created_at"`
 }
 
+// orderMachine is the statuses an order moves through.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	"pending":    {"processing"},
+	"processing": {"shipped"},
+	"shipped":    {"delivered"},
+}}
+
+// orderLifecycle processes orders, ships them the next day and delivers
+// them a few days later.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: "pending", To: "processing", After: 10 * time.Minute},
+	{From: "processing", To: "shipped", After: 24 * time.Hour,
+		Notify: server.Notice{Type: "order_shipped", Message: "Your order {{id}} has shipped."}},
+	{From: "shipped", To: "delivered", After: 72 * time.Hour,
+		Notify: server.Notice{Type: "order_delivered", Message: "Your order {{id}} was delivered."}},
+}, Machine: orderMachine}
+
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Listings map[string]Listing `json:"listings"`
-	Orders   map[string]Order   `json:"orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]    `json:"users"`
+	Listings server.Repository[Listing] `json:"listings"`
+	Orders   server.Repository[Order]   `json:"orders"`
 	mu       sync.RWMutex
 }
 
 var (
-	db                 *Database
 	ErrUserNotFound    = errors.New("user not found")
 	ErrListingNotFound = errors.New("listing not found")
 	ErrOrderNotFound   = errors.New("order not found")
 )
 
+// handlers sell Etsy listings and track their orders, dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the listings, orders and users in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -99,12 +128,12 @@ func (d *Database) AddToFavorites(email, listingID string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
 
-	_, exists = d.Listings[listingID]
+	_, exists = d.Listings.Get(listingID)
 	if !exists {
 		return ErrListingNotFound
 	}
@@ -117,12 +146,13 @@ func (d *Database) AddToFavorites(email, listingID string) error {
 	}
 
 	user.Favorites = append(user.Favorites, listingID)
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
 // HTTP Handlers
-func searchListings(c *fiber.Ctx) error {
+func (h *handlers) searchListings(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	query := c.Query("query")
 	category := c.Query("category")
 	maxPrice := c.QueryFloat("max_price", 0)
@@ -130,12 +160,12 @@ func searchListings(c *fiber.Ctx) error {
 	var results []Listing
 
 	db.mu.RLock()
-	for _, listing := range db.Listings {
+	for _, listing := range db.Listings.List() {
 		// Apply filters
 		if category != "" && listing.Category != category {
 			continue
 		}
-		if maxPrice > 0 && listing.Price > maxPrice {
+		if maxPrice > 0 && listing.Price.Float() > maxPrice {
 			continue
 		}
 		// Simple search in title and description
@@ -148,97 +178,87 @@ func searchListings(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(results)
+	return server.List(c, results, "category")
 }
 
-func getFavorites(c *fiber.Ctx) error {
+func (h *handlers) getFavorites(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var favorites []Listing
 	db.mu.RLock()
 	for _, id := range user.Favorites {
-		if listing, exists := db.Listings[id]; exists {
+		if listing, exists := db.Listings.Get(id); exists {
 			favorites = append(favorites, listing)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(favorites)
+	return server.List(c, favorites)
 }
 
-func addToFavorites(c *fiber.Ctx) error {
+func (h *handlers) addToFavorites(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		UserEmail string `json:"user_email"`
+		UserEmail string `json:"user_email" validate:"email"`
 		ListingID string `json:"listing_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	if err := db.AddToFavorites(req.UserEmail, req.ListingID); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusBadRequest, err)
 	}
 
 	return c.SendStatus(fiber.StatusCreated)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userOrders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
+	for _, order := range db.Orders.List() {
 		if order.UserEmail == email {
 			userOrders = append(userOrders, order)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return server.List(c, userOrders)
 }
 
-func createOrder(c *fiber.Ctx) error {
+func (h *handlers) createOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		UserEmail       string      `json:"user_email"`
+		UserEmail       string      `json:"user_email" validate:"email"`
 		Items           []OrderItem `json:"items"`
 		ShippingAddress string      `json:"shipping_address"`
 		PaymentMethod   string      `json:"payment_method"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate payment method
@@ -250,39 +270,41 @@ func createOrder(c *fiber.Ctx) error {
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Calculate total
-	var total float64
+	var total money.Money
 	db.mu.RLock()
 	for _, item := range req.Items {
-		listing, exists := db.Listings[item.ListingID]
+		listing, exists := db.Listings.Get(item.ListingID)
 		if !exists {
 			db.mu.RUnlock()
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Invalid listing ID",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid listing ID")
+		}
+		var err error
+		if total, err = total.Add(listing.Price.Times(item.Quantity)); err == nil {
+			total, err = total.Add(listing.ShippingPrice)
+		}
+		if err != nil {
+			db.mu.RUnlock()
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
 		}
-		total += listing.Price * float64(item.Quantity)
-		total += listing.ShippingPrice
 	}
 	db.mu.RUnlock()
 
 	order := Order{
-		ID:              uuid.New().String(),
+		ID:              server.NewID("ORD"),
 		UserEmail:       req.UserEmail,
 		Items:           req.Items,
 		Total:           total,
 		Status:          "pending",
 		ShippingAddress: req.ShippingAddress,
-		CreatedAt:       time.Now(),
+		CreatedAt:       h.clock.Now(),
 	}
 
 	db.mu.Lock()
-	db.Orders[order.ID] = order
+	db.Orders.Upsert(order.ID, order)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(order)
@@ -293,85 +315,84 @@ func contains(s, substr string) bool {
 	return true // Implement proper string search
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Listings: make(map[string]Listing),
-		Orders:   make(map[string]Order),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Listing routes
-	api.Get("/listings", searchListings)
+	api.Get("/listings", h.searchListings)
 	api.Get("/listings/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		db.mu.RLock()
-		listing, exists := db.Listings[id]
+		listing, exists := db.Listings.Get(id)
 		db.mu.RUnlock()
 
 		if !exists {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Listing not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Listing not found")
 		}
 		return c.JSON(listing)
 	})
 
 	// Favorites routes
-	api.Get("/favorites", getFavorites)
-	api.Post("/favorites", addToFavorites)
+	api.Get("/favorites", h.getFavorites)
+	api.Post("/favorites", h.addToFavorites)
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", createOrder)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.createOrder)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders"},
+			Search:  []string{"listings", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
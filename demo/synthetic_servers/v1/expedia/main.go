@@ -1,19 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/payments"
+	"pkg/server"
 )
 
 // Domain Models
@@ -36,6 +33,10 @@ type PaymentMethod struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
+}
+
 type User struct {
 	Email          string          `json:"email"`
 	Name           string          `json:"name"`
@@ -45,34 +46,73 @@ type User struct {
 }
 
 type Hotel struct {
-	ID            string   `json:"id"`
-	Name          string   `json:"name"`
-	Rating        float64  `json:"rating"`
-	Address       Address  `json:"address"`
-	PricePerNight float64  `json:"price_per_night"`
-	Amenities     []string `json:"amenities"`
-	RoomTypes     []Room   `json:"room_types"`
+	ID            string      `json:"id"`
+	Name          string      `json:"name"`
+	Rating        float64     `json:"rating"`
+	Address       Address     `json:"address"`
+	PricePerNight money.Money `json:"price_per_night"`
+	Amenities     []string    `json:"amenities"`
+	RoomTypes     []Room      `json:"room_types"`
+	Currency      string      `json:"currency,omitempty"` // Of the prices, when not USD
+}
+
+// in returns the hotel with its prices, its rooms' too, in currency,
+// which it leaves alone for USD.
+func (h Hotel) in(currency string) (Hotel, error) {
+	if currency == money.USD {
+		return h, nil
+	}
+	var err error
+	if h.PricePerNight, err = money.Convert(h.PricePerNight, currency); err != nil {
+		return Hotel{}, err
+	}
+	rooms := make([]Room, len(h.RoomTypes))
+	for i, room := range h.RoomTypes {
+		if room.Price, err = money.Convert(room.Price, currency); err != nil {
+			return Hotel{}, err
+		}
+		rooms[i] = room
+	}
+	h.RoomTypes = rooms
+	h.Currency = currency
+	return h, nil
 }
 
 type Room struct {
-	ID        string  `json:"id"`
-	Type      string  `json:"type"`
-	Price     float64 `json:"price"`
-	Capacity  int     `json:"capacity"`
-	Available bool    `json:"available"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Price     money.Money `json:"price"`
+	Capacity  int         `json:"capacity"`
+	Available bool        `json:"available"`
 }
 
 type Flight struct {
-	ID             string    `json:"id"`
-	Airline        string    `json:"airline"`
-	FlightNumber   string    `json:"flight_number"`
-	Origin         string    `json:"origin"`
-	Destination    string    `json:"destination"`
-	DepartureTime  time.Time `json:"departure_time"`
-	ArrivalTime    time.Time `json:"arrival_time"`
-	Price          float64   `json:"price"`
-	SeatsAvailable int       `json:"seats_available"`
-	Class          string    `json:"class"`
+	ID             string      `json:"id"`
+	Airline        string      `json:"airline"`
+	FlightNumber   string      `json:"flight_number"`
+	Origin         string      `json:"origin"`
+	Destination    string      `json:"destination"`
+	DepartureTime  time.Time   `json:"departure_time"`
+	ArrivalTime    time.Time   `json:"arrival_time"`
+	Price          money.Money `json:"price"`
+	SeatsAvailable int         `json:"seats_available"`
+	Class          string      `json:"class"`
+	Currency       string      `json:"currency,omitempty"` // Of the price, when not USD
+}
+
+// in returns the flight with its price in currency, which it leaves
+// alone for USD.
+func (f Flight) in(currency string) (Flight, error) {
+	if currency == money.USD {
+		return f, nil
+	}
+	price, err := money.Convert(f.Price, currency)
+	if err != nil {
+		return Flight{}, err
+	}
+	f.Price = price
+	f.Currency = currency
+	return f, nil
 }
 
 type BookingStatus string
@@ -101,18 +141,23 @@ type Booking struct {
 	CheckIn       *time.Time    `json:"check_in,omitempty"`
 	CheckOut      *time.Time    `json:"check_out,omitempty"`
 	Guests        int           `json:"guests,omitempty"`
-	TotalPrice    float64       `json:"total_price"`
+	TotalPrice    money.Money   `json:"total_price"`
 	PaymentMethod string        `json:"payment_method"`
+	ChargeID      string        `json:"charge_id,omitempty"` // The charge to the payment method
 	CreatedAt     time.Time     `json:"created_at"`
 	UpdatedAt     time.Time     `json:"updated_at"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Hotels   map[string]Hotel   `json:"hotels"`
-	Flights  map[string]Flight  `json:"flights"`
-	Bookings map[string]Booking `json:"bookings"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+
+	Users    server.Repository[User]    `json:"users"`
+	Hotels   server.Repository[Hotel]   `json:"hotels"`
+	Flights  server.Repository[Flight]  `json:"flights"`
+	Bookings server.Repository[Booking] `json:"bookings"`
 	mu       sync.RWMutex
 }
 
@@ -125,14 +170,24 @@ var (
 	ErrInvalidInput    = errors.New("invalid input")
 )
 
-var db *Database
+// handlers book Expedia hotels and flights, with clock dating each booking.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the hotels, flights and bookings in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -144,7 +199,7 @@ func (d *Database) SearchHotels(destination string, checkIn, checkOut time.Time,
 	defer d.mu.RUnlock()
 
 	var results []Hotel
-	for _, hotel := range d.Hotels {
+	for _, hotel := range d.Hotels.List() {
 		if hotel.Address.City == destination {
 			// Check room availability
 			for _, room := range hotel.RoomTypes {
@@ -162,115 +217,121 @@ func (d *Database) SearchFlights(origin, destination string, departureDate time.
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var results []Flight
-	for _, flight := range d.Flights {
-		if flight.Origin == origin &&
+	return d.Flights.Query(func(flight Flight) bool {
+		return flight.Origin == origin &&
 			flight.Destination == destination &&
 			flight.DepartureTime.Format("2006-01-02") == departureDate.Format("2006-01-02") &&
-			flight.SeatsAvailable > 0 {
-			results = append(results, flight)
-		}
-	}
-	return results
+			flight.SeatsAvailable > 0
+	})
 }
 
 func (d *Database) CreateBooking(booking Booking) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Bookings[booking.ID] = booking
+	d.Bookings.Upsert(booking.ID, booking)
 	return nil
 }
 
 // HTTP Handlers
-func searchHotels(c *fiber.Ctx) error {
+func (h *handlers) searchHotels(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	destination := c.Query("destination")
 	checkInStr := c.Query("check_in")
 	checkOutStr := c.Query("check_out")
 	guests := c.QueryInt("guests", 1)
 
 	if destination == "" || checkInStr == "" || checkOutStr == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Missing required parameters",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Missing required parameters")
 	}
 
 	checkIn, err := time.Parse("2006-01-02", checkInStr)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid check-in date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid check-in date format")
 	}
 
 	checkOut, err := time.Parse("2006-01-02", checkOutStr)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid check-out date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid check-out date format")
+	}
+
+	currency, err := server.Currency(c)
+	if err != nil {
+		return err
 	}
 
 	hotels := db.SearchHotels(destination, checkIn, checkOut, guests)
-	return c.JSON(hotels)
+	for i, hotel := range hotels {
+		if hotels[i], err = hotel.in(currency); err != nil {
+			return err
+		}
+	}
+	return server.List(c, hotels)
 }
 
-func searchFlights(c *fiber.Ctx) error {
+func (h *handlers) searchFlights(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	origin := c.Query("origin")
 	destination := c.Query("destination")
 	departureDateStr := c.Query("departure_date")
 
 	if origin == "" || destination == "" || departureDateStr == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Missing required parameters",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Missing required parameters")
 	}
 
 	departureDate, err := time.Parse("2006-01-02", departureDateStr)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid departure date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid departure date format")
+	}
+
+	currency, err := server.Currency(c)
+	if err != nil {
+		return err
 	}
 
 	flights := db.SearchFlights(origin, destination, departureDate)
-	return c.JSON(flights)
+	for i, flight := range flights {
+		if flights[i], err = flight.in(currency); err != nil {
+			return err
+		}
+	}
+	return server.List(c, flights, "origin", "destination")
 }
 
-func getUserBookings(c *fiber.Ctx) error {
+func (h *handlers) getUserBookings(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	var userBookings []Booking
 	db.mu.RLock()
-	for _, booking := range db.Bookings {
+	for _, booking := range db.Bookings.List() {
 		if booking.UserEmail == email {
 			userBookings = append(userBookings, booking)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userBookings)
+	return server.List(c, userBookings)
 }
 
 type CreateBookingRequest struct {
 	Type          BookingType `json:"type"`
-	UserEmail     string      `json:"user_email"`
+	UserEmail     string      `json:"user_email" validate:"email"`
 	ItemID        string      `json:"item_id"`
 	CheckIn       *string     `json:"check_in,omitempty"`
 	CheckOut      *string     `json:"check_out,omitempty"`
-	Guests        *int        `json:"guests,omitempty"`
+	Guests        *int        `json:"guests,omitempty" validate:"gte=0"`
 	PaymentMethod string      `json:"payment_method"`
 }
 
-func createBooking(c *fiber.Ctx) error {
+func (h *handlers) createBooking(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateBookingRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	//
@@ -278,61 +339,49 @@ func createBooking(c *fiber.Ctx) error {
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var booking Booking
-	booking.ID = uuid.New().String()
+	booking.ID = server.NewID("BKG")
 	booking.Type = req.Type
 	booking.UserEmail = req.UserEmail
 	booking.Status = BookingStatusPending
 	booking.PaymentMethod = req.PaymentMethod
-	booking.CreatedAt = time.Now()
-	booking.UpdatedAt = time.Now()
+	booking.CreatedAt = h.clock.Now()
+	booking.UpdatedAt = h.clock.Now()
 
 	// Validate payment method
-	validPayment := false
-	for _, pm := range user.PaymentMethods {
+	var method *PaymentMethod
+	for i, pm := range user.PaymentMethods {
 		if pm.ID == req.PaymentMethod {
-			validPayment = true
+			method = &user.PaymentMethods[i]
 			break
 		}
 	}
-	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+	if method == nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	switch req.Type {
 	case BookingTypeHotel:
 		if req.CheckIn == nil || req.CheckOut == nil || req.Guests == nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Check-in, check-out dates and guests are required for hotel bookings",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Check-in, check-out dates and guests are required for hotel bookings")
 		}
 
 		checkIn, err := time.Parse("2006-01-02", *req.CheckIn)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Invalid check-in date format",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid check-in date format")
 		}
 
 		checkOut, err := time.Parse("2006-01-02", *req.CheckOut)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Invalid check-out date format",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid check-out date format")
 		}
 
-		hotel, exists := db.Hotels[req.ItemID]
+		hotel, exists := db.Hotels.Get(req.ItemID)
 		if !exists {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Hotel not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Hotel not found")
 		}
 
 		booking.Hotel = &hotel
@@ -340,107 +389,112 @@ func createBooking(c *fiber.Ctx) error {
 		booking.CheckOut = &checkOut
 		booking.Guests = *req.Guests
 
-		nights := checkOut.Sub(checkIn).Hours() / 24
-		booking.TotalPrice = hotel.PricePerNight * float64(nights)
+		nights := int(checkOut.Sub(checkIn).Hours() / 24)
+		booking.TotalPrice = hotel.PricePerNight.Times(nights)
 
 	case BookingTypeFlight:
-		flight, exists := db.Flights[req.ItemID]
+		flight, exists := db.Flights.Get(req.ItemID)
 		if !exists {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Flight not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Flight not found")
 		}
 
 		if flight.SeatsAvailable <= 0 {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Flight is fully booked",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Flight is fully booked")
 		}
 
 		booking.Flight = &flight
 		booking.TotalPrice = flight.Price
 
 	default:
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid booking type",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid booking type")
+	}
+
+	db.mu.Lock()
+	charge, err := db.Authorize(c, server.ChargeRequest{
+		UserEmail:       req.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          booking.TotalPrice,
+		Description:     "Booking " + booking.ID,
+		Capture:         true,
+	})
+	db.mu.Unlock()
+	if err != nil {
+		return err
 	}
+	booking.ChargeID = charge.ID
 
 	if err := db.CreateBooking(booking); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create booking",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create booking")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(booking)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Hotels:   make(map[string]Hotel),
-		Flights:  make(map[string]Flight),
-		Bookings: make(map[string]Booking),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Hotel routes
-	api.Get("/hotels/search", searchHotels)
+	api.Get("/hotels/search", h.searchHotels)
 
 	// Flight routes
-	api.Get("/flights/search", searchFlights)
+	api.Get("/flights/search", h.searchFlights)
 
 	// Booking routes
-	api.Get("/bookings", getUserBookings)
-	api.Post("/bookings", createBooking)
+	api.Get("/bookings", h.getUserBookings)
+	api.Post("/bookings", h.createBooking)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"bookings"},
+			Search:  []string{"hotels", "flights", "bookings"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,17 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -36,36 +34,46 @@ type Theater struct {
 	City      string   `json:"city"`
 	State     string   `json:"state"`
 	ZipCode   string   `json:"zipCode"`
+	Timezone  string   `json:"timezone"` // IANA, such as America/New_York
 	Amenities []string `json:"amenities"`
 }
 
+// location returns the time zone the theater keeps, which its showtimes
+// are written and listed in: UTC if it doesn't name one.
+func (t Theater) location() *time.Location {
+	return geo.Location(t.Timezone)
+}
+
 type Showtime struct {
-	ID             string    `json:"id"`
-	MovieID        string    `json:"movieId"`
-	TheaterID      string    `json:"theaterId"`
-	DateTime       time.Time `json:"datetime"`
-	ScreenNumber   int       `json:"screenNumber"`
-	AvailableSeats int       `json:"availableSeats"`
-	Price          float64   `json:"price"`
+	ID             string      `json:"id"`
+	MovieID        string      `json:"movieId"`
+	TheaterID      string      `json:"theaterId"`
+	DateTime       time.Time   `json:"datetime"`
+	ScreenNumber   int         `json:"screenNumber"`
+	AvailableSeats int         `json:"availableSeats"`
+	Price          money.Money `json:"price"`
 }
 
 type Ticket struct {
-	ID           string    `json:"id"`
-	Movie        Movie     `json:"movie"`
-	Theater      Theater   `json:"theater"`
-	Showtime     Showtime  `json:"showtime"`
-	SeatNumbers  []string  `json:"seatNumbers"`
-	UserEmail    string    `json:"userEmail"`
-	PurchaseDate time.Time `json:"purchaseDate"`
-	TotalPrice   float64   `json:"totalPrice"`
-	QRCode       string    `json:"qrCode"`
+	ID           string      `json:"id"`
+	Movie        Movie       `json:"movie"`
+	Theater      Theater     `json:"theater"`
+	Showtime     Showtime    `json:"showtime"`
+	SeatNumbers  []string    `json:"seatNumbers"`
+	UserEmail    string      `json:"userEmail"`
+	PurchaseDate time.Time   `json:"purchaseDate"`
+	TotalPrice   money.Money `json:"totalPrice"`
+	QRCode       string      `json:"qrCode"`
 }
 
 type Database struct {
-	Movies    map[string]Movie    `json:"movies"`
-	Theaters  map[string]Theater  `json:"theaters"`
-	Showtimes map[string]Showtime `json:"showtimes"`
-	Tickets   map[string]Ticket   `json:"tickets"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Movies    server.Repository[Movie]    `json:"movies"`
+	Theaters  server.Repository[Theater]  `json:"theaters"`
+	Showtimes server.Repository[Showtime] `json:"showtimes"`
+	Tickets   server.Repository[Ticket]   `json:"tickets"`
 	mu        sync.RWMutex
 }
 
@@ -76,14 +84,25 @@ var (
 	ErrInvalidInput     = errors.New("invalid input")
 )
 
-var db *Database
+// handlers sell Fandango tickets to the showtimes in db, stamping each sale
+// with clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the movies, theaters and showtimes in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetMovie(id string) (Movie, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	movie, exists := d.Movies[id]
+	movie, exists := d.Movies.Get(id)
 	if !exists {
 		return Movie{}, ErrMovieNotFound
 	}
@@ -94,7 +113,7 @@ func (d *Database) GetTheater(id string) (Theater, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	theater, exists := d.Theaters[id]
+	theater, exists := d.Theaters.Get(id)
 	if !exists {
 		return Theater{}, ErrTheaterNotFound
 	}
@@ -105,7 +124,7 @@ func (d *Database) GetShowtime(id string) (Showtime, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	showtime, exists := d.Showtimes[id]
+	showtime, exists := d.Showtimes.Get(id)
 	if !exists {
 		return Showtime{}, ErrShowtimeNotFound
 	}
@@ -116,23 +135,22 @@ func (d *Database) CreateTicket(ticket Ticket) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Tickets[ticket.ID] = ticket
+	d.Tickets.Upsert(ticket.ID, ticket)
 
 	// Update available seats
-	showtime := d.Showtimes[ticket.Showtime.ID]
+	showtime, _ := d.Showtimes.Get(ticket.Showtime.ID)
 	showtime.AvailableSeats -= len(ticket.SeatNumbers)
-	d.Showtimes[ticket.Showtime.ID] = showtime
+	d.Showtimes.Upsert(ticket.Showtime.ID, showtime)
 
 	return nil
 }
 
 // HTTP Handlers
-func getMovies(c *fiber.Ctx) error {
+func (h *handlers) getMovies(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	zipCode := c.Query("zipCode")
 	if zipCode == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "zipCode is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "zipCode is required")
 	}
 
 	dateStr := c.Query("date")
@@ -141,15 +159,13 @@ func getMovies(c *fiber.Ctx) error {
 	if dateStr != "" {
 		filterDate, err = time.Parse("2006-01-02", dateStr)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "invalid date format",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid date format")
 		}
 	}
 
 	var movies []Movie
 	db.mu.RLock()
-	for _, movie := range db.Movies {
+	for _, movie := range db.Movies.List() {
 		if dateStr != "" {
 			if movie.ReleaseDate.After(filterDate) {
 				continue
@@ -159,156 +175,140 @@ func getMovies(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(movies)
+	return server.List(c, movies)
 }
 
-func getTheaters(c *fiber.Ctx) error {
+func (h *handlers) getTheaters(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	zipCode := c.Query("zipCode")
 	if zipCode == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "zipCode is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "zipCode is required")
 	}
 
 	var theaters []Theater
 	db.mu.RLock()
-	for _, theater := range db.Theaters {
+	for _, theater := range db.Theaters.List() {
 		if theater.ZipCode == zipCode {
 			theaters = append(theaters, theater)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(theaters)
+	return server.List(c, theaters, "zipCode")
 }
 
-func getShowtimes(c *fiber.Ctx) error {
+func (h *handlers) getShowtimes(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	movieId := c.Query("movieId")
 	theaterId := c.Query("theaterId")
 	dateStr := c.Query("date")
 
 	if movieId == "" || theaterId == "" || dateStr == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "movieId, theaterId, and date are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "movieId, theaterId, and date are required")
 	}
 
 	date, err := time.Parse("2006-01-02", dateStr)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid date format")
 	}
 
 	var showtimes []Showtime
 	db.mu.RLock()
-	for _, showtime := range db.Showtimes {
+	theater, _ := db.Theaters.Get(theaterId)
+	loc := theater.location()
+	for _, showtime := range db.Showtimes.List() {
 		if showtime.MovieID == movieId &&
 			showtime.TheaterID == theaterId &&
-			showtime.DateTime.Format("2006-01-02") == date.Format("2006-01-02") {
+			geo.LocalDate(showtime.DateTime, loc) == date.Format(time.DateOnly) {
 			showtimes = append(showtimes, showtime)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(showtimes)
+	return server.List(c, showtimes, "movieId", "theaterId")
 }
 
 type PurchaseTicketRequest struct {
 	ShowtimeID    string   `json:"showtimeId"`
-	Email         string   `json:"email"`
-	Quantity      int      `json:"quantity"`
+	Email         string   `json:"email" validate:"email"`
+	Quantity      int      `json:"quantity" validate:"gte=0"`
 	SeatNumbers   []string `json:"seatNumbers"`
 	PaymentMethod string   `json:"paymentMethod"`
 }
 
-func purchaseTickets(c *fiber.Ctx) error {
+func (h *handlers) purchaseTickets(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req PurchaseTicketRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate request
 	if req.ShowtimeID == "" || req.Email == "" || req.Quantity <= 0 ||
 		len(req.SeatNumbers) != req.Quantity {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request parameters",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid request parameters")
 	}
 
 	// Get showtime
 	showtime, err := db.GetShowtime(req.ShowtimeID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Check seat availability
 	if showtime.AvailableSeats < req.Quantity {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Not enough seats available",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Not enough seats available")
 	}
 
 	// Get movie and theater info
 	movie, err := db.GetMovie(showtime.MovieID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	theater, err := db.GetTheater(showtime.TheaterID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Create ticket
 	ticket := Ticket{
-		ID:           uuid.New().String(),
+		ID:           server.NewID("TKT"),
 		Movie:        movie,
 		Theater:      theater,
 		Showtime:     showtime,
 		SeatNumbers:  req.SeatNumbers,
 		UserEmail:    req.Email,
-		PurchaseDate: time.Now(),
-		TotalPrice:   float64(req.Quantity) * showtime.Price,
+		PurchaseDate: h.clock.Now(),
+		TotalPrice:   showtime.Price.Times(req.Quantity),
 		QRCode:       generateQRCode(),
 	}
 
 	// Save ticket
 	if err := db.CreateTicket(ticket); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create ticket",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create ticket")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(ticket)
 }
 
-func getUserTickets(c *fiber.Ctx) error {
+func (h *handlers) getUserTickets(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	var tickets []Ticket
 	db.mu.RLock()
-	for _, ticket := range db.Tickets {
+	for _, ticket := range db.Tickets.List() {
 		if ticket.UserEmail == email {
 			tickets = append(tickets, ticket)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(tickets)
+	return server.List(c, tickets)
 }
 
 func generateQRCode() string {
@@ -316,60 +316,85 @@ func generateQRCode() string {
 	return uuid.New().String()
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
+
+	if err := server.Load(store, db); err != nil {
 		return err
 	}
+	db.localize()
+	h.db.Set(db)
+	return nil
+}
 
-	db = &Database{
-		Movies:    make(map[string]Movie),
-		Theaters:  make(map[string]Theater),
-		Showtimes: make(map[string]Showtime),
-		Tickets:   make(map[string]Ticket),
+// localize puts showtimes, and tickets' copies of them, in their theater's
+// time zone.
+func (d *Database) localize() {
+	for _, id := range d.Showtimes.Keys() {
+		showtime, _ := d.Showtimes.Get(id)
+		theater, _ := d.Theaters.Get(showtime.TheaterID)
+		showtime.DateTime = showtime.DateTime.In(theater.location())
+		d.Showtimes.Upsert(id, showtime)
+	}
+	for _, id := range d.Tickets.Keys() {
+		ticket, _ := d.Tickets.Get(id)
+		theater, _ := d.Theaters.Get(ticket.Theater.ID)
+		ticket.Theater.Timezone = theater.Timezone
+		ticket.Showtime.DateTime = ticket.Showtime.DateTime.In(ticket.Theater.location())
+		d.Tickets.Upsert(id, ticket)
 	}
-
-	return json.Unmarshal(data, db)
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/movies", getMovies)
-	api.Get("/theaters", getTheaters)
-	api.Get("/showtimes", getShowtimes)
-	api.Post("/tickets", purchaseTickets)
-	api.Get("/tickets/:email", getUserTickets)
+	api.Get("/movies", h.getMovies)
+	api.Get("/theaters", h.getTheaters)
+	api.Get("/showtimes", h.getShowtimes)
+	api.Post("/tickets", h.purchaseTickets)
+	api.Get("/tickets/:email", h.getUserTickets)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"tickets"},
+			Search:  []string{"movies", "theaters", "showtimes", "tickets"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"pkg/money"
+	"pkg/server"
+	"pkg/servertest"
+)
+
+const fixture = `{
+  "movies": {
+    "mov_1": {"id": "mov_1", "title": "Dune: Part Two", "rating": "PG-13", "releaseDate": "2024-03-01T00:00:00Z"},
+    "mov_2": {"id": "mov_2", "title": "Sinners", "rating": "R", "releaseDate": "2025-04-18T00:00:00Z"}
+  },
+  "theaters": {
+    "th_la": {"id": "th_la", "name": "Vista", "city": "Los Angeles", "state": "CA", "zipCode": "90027", "timezone": "America/Los_Angeles"}
+  },
+  "showtimes": {
+    "st_late": {"id": "st_late", "movieId": "mov_1", "theaterId": "th_la", "datetime": "2025-05-03T05:30:00Z", "screenNumber": 1, "availableSeats": 2, "price": 14.5},
+    "st_noon": {"id": "st_noon", "movieId": "mov_1", "theaterId": "th_la", "datetime": "2025-05-03T19:00:00Z", "screenNumber": 1, "availableSeats": 80, "price": 12}
+  },
+  "tickets": {}
+}`
+
+var now = time.Date(2025, 5, 2, 18, 0, 0, 0, time.UTC)
+
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+	h, err := newHandlers(servertest.Store(fixture), servertest.Clock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := servertest.App()
+	setupRoutes(app, h)
+	return app
+}
+
+// Showtimes are listed by the date in the theater's time zone, so the
+// 10:30 pm show on May 2 in Los Angeles is on May 2 though it is May 3 in
+// UTC.
+func TestGetShowtimesByLocalDate(t *testing.T) {
+	app := newTestApp(t)
+	for date, want := range map[string]string{"2025-05-02": "st_late", "2025-05-03": "st_noon"} {
+		var page server.Page[Showtime]
+		servertest.Do(t, app, "GET", "/api/v1/showtimes?movieId=mov_1&theaterId=th_la&date="+date, "", &page)
+		if page.Total != 1 || page.Data[0].ID != want {
+			t.Errorf("%s: got %+v, want %s alone", date, page.Data, want)
+		}
+	}
+}
+
+func TestPurchaseTickets(t *testing.T) {
+	app := newTestApp(t)
+	var ticket Ticket
+	code := servertest.Do(t, app, "POST", "/api/v1/tickets",
+		`{"showtimeId": "st_noon", "email": "sam@example.com", "quantity": 2, "seatNumbers": ["F7", "F8"], "paymentMethod": "card"}`, &ticket)
+	if code != http.StatusCreated {
+		t.Fatalf("got %d, want %d", code, http.StatusCreated)
+	}
+	if ticket.TotalPrice != money.Cents(2400) || ticket.Movie.ID != "mov_1" || ticket.Theater.ID != "th_la" {
+		t.Errorf("got %s for %s at %s, want 24.00 USD for mov_1 at th_la", ticket.TotalPrice, ticket.Movie.ID, ticket.Theater.ID)
+	}
+	if !ticket.PurchaseDate.Equal(now) {
+		t.Errorf("bought at %v, want the clock's %v", ticket.PurchaseDate, now)
+	}
+
+	var page server.Page[Ticket]
+	servertest.Do(t, app, "GET", "/api/v1/tickets/sam@example.com", "", &page)
+	if page.Total != 1 || page.Data[0].ID != ticket.ID {
+		t.Errorf("got %d tickets, want the one bought", page.Total)
+	}
+}
+
+func TestPurchaseTicketsFails(t *testing.T) {
+	app := newTestApp(t)
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"seats don't match quantity", `{"showtimeId": "st_noon", "email": "sam@example.com", "quantity": 2, "seatNumbers": ["F7"]}`, http.StatusBadRequest},
+		{"sold out", `{"showtimeId": "st_late", "email": "sam@example.com", "quantity": 3, "seatNumbers": ["A1", "A2", "A3"]}`, http.StatusBadRequest},
+		{"unknown showtime", `{"showtimeId": "st_gone", "email": "sam@example.com", "quantity": 1, "seatNumbers": ["A1"]}`, http.StatusNotFound},
+		{"bad email", `{"showtimeId": "st_noon", "email": "sam", "quantity": 1, "seatNumbers": ["A1"]}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		if code := servertest.Do(t, app, "POST", "/api/v1/tickets", tt.body, nil); code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
@@ -1,45 +1,41 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
 type Position struct {
-	Symbol          string  `json:"symbol"`
-	Quantity        float64 `json:"quantity"`
-	CurrentPrice    float64 `json:"current_price"`
-	MarketValue     float64 `json:"market_value"`
-	CostBasis       float64 `json:"cost_basis"`
-	GainLoss        float64 `json:"gain_loss"`
-	GainLossPercent float64 `json:"gain_loss_percent"`
+	Symbol          string      `json:"symbol"`
+	Quantity        float64     `json:"quantity"`
+	CurrentPrice    money.Money `json:"current_price"`
+	MarketValue     money.Money `json:"market_value"`
+	CostBasis       money.Money `json:"cost_basis"`
+	GainLoss        money.Money `json:"gain_loss"`
+	GainLossPercent float64     `json:"gain_loss_percent"`
 }
 
 type Account struct {
-	ID        string     `json:"id"`
-	Type      string     `json:"type"`
-	Name      string     `json:"name"`
-	Balance   float64    `json:"balance"`
-	Positions []Position `json:"positions"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Name      string      `json:"name"`
+	Balance   money.Money `json:"balance"`
+	Positions []Position  `json:"positions"`
 }
 
 type Portfolio struct {
-	TotalValue           float64   `json:"total_value"`
-	TotalGainLoss        float64   `json:"total_gain_loss"`
-	TotalGainLossPercent float64   `json:"total_gain_loss_percent"`
-	Accounts             []Account `json:"accounts"`
+	TotalValue           money.Money `json:"total_value"`
+	TotalGainLoss        money.Money `json:"total_gain_loss"`
+	TotalGainLossPercent float64     `json:"total_gain_loss_percent"`
+	Accounts             []Account   `json:"accounts"`
 }
 
 type OrderType string
@@ -63,22 +59,22 @@ type TradeOrder struct {
 	AccountID   string      `json:"account_id"`
 	Symbol      string      `json:"symbol"`
 	OrderType   OrderType   `json:"order_type"`
-	Quantity    float64     `json:"quantity"`
-	Price       float64     `json:"price"`
+	Quantity    float64     `json:"quantity" validate:"gte=0"`
+	Price       money.Money `json:"price" validate:"gte=0"`
 	TimeInForce TimeInForce `json:"time_in_force"`
 	Status      string      `json:"status"`
 	CreatedAt   time.Time   `json:"created_at"`
 }
 
 type Transaction struct {
-	ID        string    `json:"id"`
-	AccountID string    `json:"account_id"`
-	Type      string    `json:"type"`
-	Symbol    string    `json:"symbol"`
-	Quantity  float64   `json:"quantity"`
-	Price     float64   `json:"price"`
-	Amount    float64   `json:"amount"`
-	Date      time.Time `json:"date"`
+	ID        string      `json:"id"`
+	AccountID string      `json:"account_id"`
+	Type      string      `json:"type"`
+	Symbol    string      `json:"symbol"`
+	Quantity  float64     `json:"quantity"`
+	Price     money.Money `json:"price"`
+	Amount    money.Money `json:"amount"`
+	Date      time.Time   `json:"date"`
 }
 
 type User struct {
@@ -89,21 +85,33 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users        map[string]User        `json:"users"`
-	Transactions map[string]Transaction `json:"transactions"`
-	TradeOrders  map[string]TradeOrder  `json:"trade_orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users        server.Repository[User]        `json:"users"`
+	Transactions server.Repository[Transaction] `json:"transactions"`
+	TradeOrders  server.Repository[TradeOrder]  `json:"trade_orders"`
 	mu           sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers trade and report on Fidelity accounts, dating trades by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users, transactions and trade orders in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Custom errors
 var (
 	ErrUserNotFound      = errors.New("user not found")
 	ErrAccountNotFound   = errors.New("account not found")
 	ErrInvalidOrder      = errors.New("invalid order")
-	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrInsufficientFunds = server.NewError(server.CodeInsufficientFunds, "insufficient funds")
 )
 
 // Database operations
@@ -111,7 +119,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -122,7 +130,7 @@ func (d *Database) GetAccount(accountID string) (Account, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	for _, user := range d.Users {
+	for _, user := range d.Users.List() {
 		for _, account := range user.Accounts {
 			if account.ID == accountID {
 				return account, nil
@@ -136,123 +144,113 @@ func (d *Database) CreateTradeOrder(order TradeOrder) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.TradeOrders[order.ID] = order
+	d.TradeOrders.Upsert(order.ID, order)
 	return nil
 }
 
 // HTTP Handlers
-func getPortfolio(c *fiber.Ctx) error {
+func (h *handlers) getPortfolio(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	var totalValue, totalGainLoss float64
+	var totalValue, totalGainLoss money.Money
 	for _, account := range user.Accounts {
 		for _, position := range account.Positions {
-			totalValue += position.MarketValue
-			totalGainLoss += position.GainLoss
+			if totalValue, err = totalValue.Add(position.MarketValue); err == nil {
+				totalGainLoss, err = totalGainLoss.Add(position.GainLoss)
+			}
+			if err != nil {
+				return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+			}
 		}
 	}
 
 	portfolio := Portfolio{
 		TotalValue:           totalValue,
 		TotalGainLoss:        totalGainLoss,
-		TotalGainLossPercent: (totalGainLoss / (totalValue - totalGainLoss)) * 100,
+		TotalGainLossPercent: (totalGainLoss.Float() / (totalValue.Float() - totalGainLoss.Float())) * 100,
 		Accounts:             user.Accounts,
 	}
 
 	return c.JSON(portfolio)
 }
 
-func getAccounts(c *fiber.Ctx) error {
+func (h *handlers) getAccounts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Accounts)
+	return server.List(c, user.Accounts)
 }
 
-func placeTrade(c *fiber.Ctx) error {
+func (h *handlers) placeTrade(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var order TradeOrder
-	if err := c.BodyParser(&order); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &order); err != nil {
+		return err
 	}
 
 	// Validate account exists
 	account, err := db.GetAccount(order.AccountID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate order
 	if order.Quantity <= 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Quantity must be positive",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Quantity must be positive")
 	}
 
 	// For market orders, validate sufficient funds
 	if order.OrderType == Market {
-		requiredFunds := order.Quantity * order.Price
-		if account.Balance < requiredFunds {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": ErrInsufficientFunds.Error(),
-			})
+		requiredFunds := order.Price.Mul(order.Quantity)
+		short, err := account.Balance.Less(requiredFunds)
+		if err != nil {
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+		}
+		if short {
+			return server.FailWith(c, fiber.StatusBadRequest, ErrInsufficientFunds)
 		}
 	}
 
 	// Generate order ID and set metadata
-	order.ID = uuid.New().String()
+	order.ID = server.NewID("ORD")
 	order.Status = "PENDING"
-	order.CreatedAt = time.Now()
+	order.CreatedAt = h.clock.Now()
 
 	// Save order
 	if err := db.CreateTradeOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create order")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-func getTransactions(c *fiber.Ctx) error {
+func (h *handlers) getTransactions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	accountID := c.Query("account_id")
 	if accountID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "account_id parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "account_id parameter is required")
 	}
 
 	// Validate account exists
 	if _, err := db.GetAccount(accountID); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	startDate := c.Query("start_date")
@@ -260,7 +258,7 @@ func getTransactions(c *fiber.Ctx) error {
 
 	var transactions []Transaction
 	db.mu.RLock()
-	for _, tx := range db.Transactions {
+	for _, tx := range db.Transactions.List() {
 		if tx.AccountID == accountID {
 			if startDate != "" {
 				start, _ := time.Parse("2006-01-02", startDate)
@@ -279,69 +277,68 @@ func getTransactions(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(transactions)
+	return server.List(c, transactions, "account_id")
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:        make(map[string]User),
-		Transactions: make(map[string]Transaction),
-		TradeOrders:  make(map[string]TradeOrder),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/portfolio", getPortfolio)
-	api.Get("/accounts", getAccounts)
-	api.Post("/trades", placeTrade)
-	api.Get("/transactions", getTransactions)
+	api.Get("/portfolio", h.getPortfolio)
+	api.Get("/accounts", h.getAccounts)
+	api.Post("/trades", h.placeTrade)
+	api.Get("/transactions", h.getTransactions)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "transactions", "trade_orders"},
+			Search:  []string{"transactions", "trade_orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
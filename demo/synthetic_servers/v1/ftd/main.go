@@ -1,18 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -31,13 +29,13 @@ type Person struct {
 }
 
 type Product struct {
-	ID          string   `json:"id"`
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Category    string   `json:"category"`
-	Price       float64  `json:"price"`
-	Occasions   []string `json:"occasions"`
-	ImageURL    string   `json:"image_url"`
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Category    string      `json:"category"`
+	Price       money.Money `json:"price"`
+	Occasions   []string    `json:"occasions"`
+	ImageURL    string      `json:"image_url"`
 }
 
 type OrderStatus string
@@ -49,23 +47,43 @@ const (
 	OrderStatusCancelled OrderStatus = "cancelled"
 )
 
+// orderMachine is the statuses an order moves through: confirmed, then
+// delivered, unless it is cancelled first.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	string(OrderStatusPending):   {string(OrderStatusConfirmed), string(OrderStatusCancelled)},
+	string(OrderStatusConfirmed): {string(OrderStatusDelivered), string(OrderStatusCancelled)},
+}}
+
+// orderLifecycle confirms orders shortly after they're placed and delivers
+// them on their delivery date.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: string(OrderStatusPending), To: string(OrderStatusConfirmed), After: 15 * time.Minute,
+		Notify: server.Notice{Type: "order_confirmed", Message: "Your order {{id}} is confirmed."}},
+	{From: string(OrderStatusConfirmed), To: string(OrderStatusDelivered), At: "delivery_date", After: 14 * time.Hour,
+		Notify: server.Notice{Type: "order_delivered", Message: "Your order {{id}} was delivered."}},
+}, Machine: orderMachine}
+
 type Order struct {
-	ID           string      `json:"id"`
-	Product      Product     `json:"product"`
-	Sender       Person      `json:"sender"`
-	Recipient    Person      `json:"recipient"`
-	DeliveryDate string      `json:"delivery_date"`
-	Message      string      `json:"message"`
-	Status       OrderStatus `json:"status"`
-	Total        float64     `json:"total"`
-	CreatedAt    time.Time   `json:"created_at"`
+	ID            string                    `json:"id"`
+	Product       Product                   `json:"product"`
+	Sender        Person                    `json:"sender"`
+	Recipient     Person                    `json:"recipient"`
+	DeliveryDate  string                    `json:"delivery_date"`
+	Message       string                    `json:"message"`
+	Status        OrderStatus               `json:"status"`
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+	Total         money.Money               `json:"total"`
+	CreatedAt     time.Time                 `json:"created_at"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]Person  `json:"users"`
-	Products map[string]Product `json:"products"`
-	Orders   map[string]Order   `json:"orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[Person]  `json:"users"`
+	Products server.Repository[Product] `json:"products"`
+	Orders   server.Repository[Order]   `json:"orders"`
 	mu       sync.RWMutex
 }
 
@@ -75,14 +93,24 @@ var (
 	ErrOrderNotFound   = errors.New("order not found")
 )
 
-var db *Database
+// handlers take FTD flower orders and schedule their delivery by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the products, users and orders in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (Person, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return Person{}, ErrUserNotFound
 	}
@@ -93,7 +121,7 @@ func (d *Database) GetProduct(id string) (Product, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	product, exists := d.Products[id]
+	product, exists := d.Products.Get(id)
 	if !exists {
 		return Product{}, ErrProductNotFound
 	}
@@ -104,18 +132,19 @@ func (d *Database) CreateOrder(order Order) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Orders[order.ID] = order
+	d.Orders.Upsert(order.ID, order)
 	return nil
 }
 
 // HTTP Handlers
-func getProducts(c *fiber.Ctx) error {
+func (h *handlers) getProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	occasion := c.Query("occasion")
 
 	var filteredProducts []Product
 	db.mu.RLock()
-	for _, product := range db.Products {
+	for _, product := range db.Products.List() {
 		if category != "" && product.Category != category {
 			continue
 		}
@@ -135,78 +164,68 @@ func getProducts(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(filteredProducts)
+	return server.List(c, filteredProducts, "category")
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userOrders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
+	for _, order := range db.Orders.List() {
 		if order.Sender.Email == email {
 			userOrders = append(userOrders, order)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return server.List(c, userOrders)
 }
 
 type CreateOrderRequest struct {
 	ProductID    string `json:"product_id"`
-	SenderEmail  string `json:"sender_email"`
+	SenderEmail  string `json:"sender_email" validate:"email"`
 	Recipient    Person `json:"recipient"`
-	DeliveryDate string `json:"delivery_date"`
+	DeliveryDate string `json:"delivery_date" validate:"date"`
 	Message      string `json:"message"`
 }
 
-func createOrder(c *fiber.Ctx) error {
+func (h *handlers) createOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateOrderRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate sender
 	sender, err := db.GetUser(req.SenderEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Sender not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Sender not found")
 	}
 
 	// Validate product
 	product, err := db.GetProduct(req.ProductID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Product not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Product not found")
 	}
 
 	// Validate delivery date
 	deliveryDate, err := time.Parse("2006-01-02", req.DeliveryDate)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid delivery date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid delivery date format")
 	}
 
-	if deliveryDate.Before(time.Now()) {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Delivery date must be in the future",
-		})
+	if deliveryDate.Before(h.clock.Now()) {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Delivery date must be in the future")
 	}
 
 	// Create new order
 	order := Order{
-		ID:           uuid.New().String(),
+		ID:           server.NewID("ORD"),
 		Product:      product,
 		Sender:       sender,
 		Recipient:    req.Recipient,
@@ -214,30 +233,26 @@ func createOrder(c *fiber.Ctx) error {
 		Message:      req.Message,
 		Status:       OrderStatusPending,
 		Total:        product.Price,
-		CreatedAt:    time.Now(),
+		CreatedAt:    h.clock.Now(),
 	}
 
 	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create order")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-func getDeliveryDates(c *fiber.Ctx) error {
+func (h *handlers) getDeliveryDates(c *fiber.Ctx) error {
 	zipCode := c.Query("zip_code")
 	if zipCode == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "zip_code parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "zip_code parameter is required")
 	}
 
 	// Calculate available delivery dates
 	// In a real implementation, this would check florist availability
 	var availableDates []string
-	now := time.Now()
+	now := h.clock.Now()
 	for i := 1; i <= 14; i++ {
 		date := now.AddDate(0, 0, i)
 		if date.Weekday() != time.Sunday { // No Sunday deliveries
@@ -248,57 +263,66 @@ func getDeliveryDates(c *fiber.Ctx) error {
 	return c.JSON(availableDates)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]Person),
-		Products: make(map[string]Product),
-		Orders:   make(map[string]Order),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/products", getProducts)
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", createOrder)
-	api.Get("/delivery-dates", getDeliveryDates)
+	api.Get("/products", h.getProducts)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.createOrder)
+	api.Get("/delivery-dates", h.getDeliveryDates)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "orders"},
+			Search:  []string{"products", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -25,23 +22,23 @@ type Vehicle struct {
 }
 
 type Coverage struct {
-	Type               string  `json:"type"`
-	LiabilityLimit     float64 `json:"liability_limit"`
-	Deductible         float64 `json:"deductible"`
-	CollisionCover     bool    `json:"collision_cover"`
-	ComprehensiveCover bool    `json:"comprehensive_cover"`
+	Type               string      `json:"type"`
+	LiabilityLimit     money.Money `json:"liability_limit" validate:"min=1,max=10000000"`
+	Deductible         money.Money `json:"deductible" validate:"min=1,max=100000"`
+	CollisionCover     bool        `json:"collision_cover"`
+	ComprehensiveCover bool        `json:"comprehensive_cover"`
 }
 
 type Policy struct {
-	PolicyNumber string    `json:"policy_number"`
-	UserEmail    string    `json:"user_email"`
-	Type         string    `json:"type"`
-	Status       string    `json:"status"`
-	Vehicle      Vehicle   `json:"vehicle"`
-	Coverage     Coverage  `json:"coverage"`
-	Premium      float64   `json:"premium"`
-	StartDate    time.Time `json:"start_date"`
-	EndDate      time.Time `json:"end_date"`
+	PolicyNumber string      `json:"policy_number"`
+	UserEmail    string      `json:"user_email"`
+	Type         string      `json:"type"`
+	Status       string      `json:"status"`
+	Vehicle      Vehicle     `json:"vehicle"`
+	Coverage     Coverage    `json:"coverage"`
+	Premium      money.Money `json:"premium"`
+	StartDate    time.Time   `json:"start_date"`
+	EndDate      time.Time   `json:"end_date"`
 }
 
 type ClaimStatus string
@@ -74,36 +71,50 @@ type Document struct {
 }
 
 type QuoteRequest struct {
-	Email    string   `json:"email"`
+	Email    string   `json:"email" validate:"email"`
 	Vehicle  Vehicle  `json:"vehicle"`
 	Coverage Coverage `json:"coverage"`
 }
 
 type Quote struct {
-	QuoteID        string    `json:"quote_id"`
-	UserEmail      string    `json:"user_email"`
-	Vehicle        Vehicle   `json:"vehicle"`
-	Coverage       Coverage  `json:"coverage"`
-	MonthlyPremium float64   `json:"monthly_premium"`
-	ExpiresAt      time.Time `json:"expires_at"`
+	QuoteID        string      `json:"quote_id"`
+	UserEmail      string      `json:"user_email"`
+	Vehicle        Vehicle     `json:"vehicle"`
+	Coverage       Coverage    `json:"coverage"`
+	MonthlyPremium money.Money `json:"monthly_premium"`
+	ExpiresAt      time.Time   `json:"expires_at"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Policies map[string]Policy `json:"policies"`
-	Claims   map[string]Claim  `json:"claims"`
-	Quotes   map[string]Quote  `json:"quotes"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Policies server.Repository[Policy] `json:"policies"`
+	Claims   server.Repository[Claim]  `json:"claims"`
+	Quotes   server.Repository[Quote]  `json:"quotes"`
 	mu       sync.RWMutex
 }
 
-var db *Database
+// handlers quote GEICO policies and file claims against them, dated by
+// clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the policies, claims and quotes in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetPolicy(policyNumber string) (Policy, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	policy, exists := d.Policies[policyNumber]
+	policy, exists := d.Policies.Get(policyNumber)
 	if !exists {
 		return Policy{}, errors.New("policy not found")
 	}
@@ -114,20 +125,14 @@ func (d *Database) GetUserPolicies(email string) []Policy {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var policies []Policy
-	for _, policy := range d.Policies {
-		if policy.UserEmail == email {
-			policies = append(policies, policy)
-		}
-	}
-	return policies
+	return d.Policies.By("user_email", email)
 }
 
 func (d *Database) CreateClaim(claim Claim) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Claims[claim.ClaimNumber] = claim
+	d.Claims.Upsert(claim.ClaimNumber, claim)
 	return nil
 }
 
@@ -135,59 +140,50 @@ func (d *Database) GetUserClaims(email string) []Claim {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var claims []Claim
-	for _, claim := range d.Claims {
-		if claim.UserEmail == email {
-			claims = append(claims, claim)
-		}
-	}
-	return claims
+	return d.Claims.By("user_email", email)
 }
 
 func (d *Database) SaveQuote(quote Quote) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Quotes[quote.QuoteID] = quote
+	d.Quotes.Upsert(quote.QuoteID, quote)
 	return nil
 }
 
 // Handlers
-func getAutoQuote(c *fiber.Ctx) error {
+func (h *handlers) getAutoQuote(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req QuoteRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Calculate premium based on vehicle and coverage
-	premium := calculatePremium(req.Vehicle, req.Coverage)
+	premium := calculatePremium(req.Vehicle, req.Coverage, h.clock.Now())
 
 	quote := Quote{
-		QuoteID:        uuid.New().String(),
+		QuoteID:        server.NewID("QUOTE"),
 		UserEmail:      req.Email,
 		Vehicle:        req.Vehicle,
 		Coverage:       req.Coverage,
 		MonthlyPremium: premium,
-		ExpiresAt:      time.Now().Add(30 * 24 * time.Hour), // Quote valid for 30 days
+		ExpiresAt:      h.clock.Now().Add(30 * 24 * time.Hour), // Quote valid for 30 days
 	}
 
 	if err := db.SaveQuote(quote); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to save quote",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to save quote")
 	}
 
 	return c.JSON(quote)
 }
 
-func calculatePremium(vehicle Vehicle, coverage Coverage) float64 {
+func calculatePremium(vehicle Vehicle, coverage Coverage, now time.Time) money.Money {
 	// Basic premium calculation logic
 	basePremium := 100.0
 
 	// Adjust for vehicle age
-	vehicleAge := time.Now().Year() - vehicle.Year
+	vehicleAge := now.Year() - vehicle.Year
 	if vehicleAge > 10 {
 		basePremium *= 1.2
 	} else if vehicleAge < 3 {
@@ -203,65 +199,58 @@ func calculatePremium(vehicle Vehicle, coverage Coverage) float64 {
 	}
 
 	// Adjust for liability limit
-	basePremium *= (coverage.LiabilityLimit / 50000.0)
+	basePremium *= (coverage.LiabilityLimit.Float() / 50000.0)
 
 	// Adjust for deductible
-	basePremium *= (1000.0 / coverage.Deductible)
+	basePremium *= (1000.0 / coverage.Deductible.Float())
 
-	return basePremium
+	return money.Dollars(basePremium)
 }
 
-func getUserPolicies(c *fiber.Ctx) error {
+func (h *handlers) getUserPolicies(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	policies := db.GetUserPolicies(email)
-	return c.JSON(policies)
+	return server.List(c, policies)
 }
 
-func getUserClaims(c *fiber.Ctx) error {
+func (h *handlers) getUserClaims(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	claims := db.GetUserClaims(email)
-	return c.JSON(claims)
+	return server.List(c, claims)
 }
 
-func fileClaim(c *fiber.Ctx) error {
+func (h *handlers) fileClaim(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var newClaim struct {
 		PolicyNumber string `json:"policy_number"`
 		Type         string `json:"type"`
 		Description  string `json:"description"`
-		IncidentDate string `json:"incident_date"`
+		IncidentDate string `json:"incident_date" validate:"datetime"`
 	}
 
-	if err := c.BodyParser(&newClaim); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &newClaim); err != nil {
+		return err
 	}
 
 	// Validate policy exists
 	policy, err := db.GetPolicy(newClaim.PolicyNumber)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Policy not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Policy not found")
 	}
 
 	incidentDate, err := time.Parse(time.RFC3339, newClaim.IncidentDate)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid incident date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid incident date format")
 	}
 
 	claim := Claim{
@@ -272,80 +261,81 @@ func fileClaim(c *fiber.Ctx) error {
 		Status:       ClaimStatusPending,
 		Description:  newClaim.Description,
 		IncidentDate: incidentDate,
-		FiledDate:    time.Now(),
+		FiledDate:    h.clock.Now(),
 		Documents:    []Document{},
 	}
 
 	if err := db.CreateClaim(claim); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create claim",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create claim")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(claim)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Policies: make(map[string]Policy),
-		Claims:   make(map[string]Claim),
-		Quotes:   make(map[string]Quote),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Quote routes
-	api.Post("/quotes/auto", getAutoQuote)
+	api.Post("/quotes/auto", h.getAutoQuote)
 
 	// Policy routes
-	api.Get("/policies", getUserPolicies)
+	api.Get("/policies", h.getUserPolicies)
 
 	// Claim routes
-	api.Get("/claims", getUserClaims)
-	api.Post("/claims", fileClaim)
+	api.Get("/claims", h.getUserClaims)
+	api.Post("/claims", h.fileClaim)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"policies", "claims", "quotes"},
+			Search:  []string{"policies", "claims", "quotes"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
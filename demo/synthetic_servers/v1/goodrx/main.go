@@ -1,20 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -38,11 +34,11 @@ type Pharmacy struct {
 }
 
 type DrugPrice struct {
-	Pharmacy        Pharmacy `json:"pharmacy"`
-	Price           float64  `json:"price"`
-	Quantity        int      `json:"quantity"`
-	DiscountPrice   float64  `json:"discountPrice"`
-	DiscountPercent float64  `json:"discountPercent"`
+	Pharmacy        Pharmacy    `json:"pharmacy"`
+	Price           money.Money `json:"price"`
+	Quantity        int         `json:"quantity"`
+	DiscountPrice   money.Money `json:"discountPrice"`
+	DiscountPercent float64     `json:"discountPercent"`
 }
 
 type Prescription struct {
@@ -57,13 +53,13 @@ type Prescription struct {
 }
 
 type Coupon struct {
-	ID             string    `json:"id"`
-	DrugID         string    `json:"drugId"`
-	PharmacyID     string    `json:"pharmacyId"`
-	DiscountPrice  float64   `json:"discountPrice"`
-	OriginalPrice  float64   `json:"originalPrice"`
-	ExpirationDate time.Time `json:"expirationDate"`
-	BarcodeData    string    `json:"barcodeData"`
+	ID             string      `json:"id"`
+	DrugID         string      `json:"drugId"`
+	PharmacyID     string      `json:"pharmacyId"`
+	DiscountPrice  money.Money `json:"discountPrice"`
+	OriginalPrice  money.Money `json:"originalPrice"`
+	ExpirationDate time.Time   `json:"expirationDate"`
+	BarcodeData    string      `json:"barcodeData"`
 }
 
 type User struct {
@@ -80,11 +76,14 @@ type SearchEntry struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users         map[string]User         `json:"users"`
-	Drugs         map[string]Drug         `json:"drugs"`
-	Pharmacies    map[string]Pharmacy     `json:"pharmacies"`
-	Prescriptions map[string]Prescription `json:"prescriptions"`
-	Coupons       map[string]Coupon       `json:"coupons"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users         server.Repository[User]         `json:"users"`
+	Drugs         server.Repository[Drug]         `json:"drugs"`
+	Pharmacies    server.Repository[Pharmacy]     `json:"pharmacies"`
+	Prescriptions server.Repository[Prescription] `json:"prescriptions"`
+	Coupons       server.Repository[Coupon]       `json:"coupons"`
 	mu            sync.RWMutex
 }
 
@@ -97,8 +96,18 @@ var (
 	ErrInvalidInput         = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers compare GoodRx drug prices across pharmacies, find coupons and
+// keep users' prescriptions, dating them by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the drugs, pharmacies and coupons in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) SearchDrugs(query string) []Drug {
@@ -108,7 +117,7 @@ func (d *Database) SearchDrugs(query string) []Drug {
 	var results []Drug
 	query = strings.ToLower(query)
 
-	for _, drug := range d.Drugs {
+	for _, drug := range d.Drugs.List() {
 		if strings.Contains(strings.ToLower(drug.Name), query) ||
 			strings.Contains(strings.ToLower(drug.GenericName), query) {
 			results = append(results, drug)
@@ -124,15 +133,15 @@ func (d *Database) GetDrugPrices(drugID string, zipCode string) []DrugPrice {
 
 	var prices []DrugPrice
 
-	for _, pharmacy := range d.Pharmacies {
+	for _, pharmacy := range d.Pharmacies.List() {
 		if pharmacy.ZipCode == zipCode {
 			// Simulate price calculation based on pharmacy
-			basePrice := 100.0 // Base price for simulation
+			basePrice := money.Cents(10000) // Base price for simulation
 			price := DrugPrice{
 				Pharmacy:        pharmacy,
 				Price:           basePrice,
 				Quantity:        30,
-				DiscountPrice:   basePrice * 0.7,
+				DiscountPrice:   basePrice.Mul(0.7),
 				DiscountPercent: 30,
 			}
 			prices = append(prices, price)
@@ -146,7 +155,7 @@ func (d *Database) GetUserPrescriptions(email string) ([]Prescription, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return nil, ErrUserNotFound
 	}
@@ -158,14 +167,14 @@ func (d *Database) AddPrescription(prescription Prescription) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[prescription.UserEmail]
+	user, exists := d.Users.Get(prescription.UserEmail)
 	if !exists {
 		return ErrUserNotFound
 	}
 
 	user.Prescriptions = append(user.Prescriptions, prescription)
-	d.Users[prescription.UserEmail] = user
-	d.Prescriptions[prescription.ID] = prescription
+	d.Users.Upsert(prescription.UserEmail, user)
+	d.Prescriptions.Upsert(prescription.ID, prescription)
 
 	return nil
 }
@@ -174,7 +183,7 @@ func (d *Database) GetCoupon(drugID string, pharmacyID string) (Coupon, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	for _, coupon := range d.Coupons {
+	for _, coupon := range d.Coupons.List() {
 		if coupon.DrugID == drugID && coupon.PharmacyID == pharmacyID {
 			return coupon, nil
 		}
@@ -184,181 +193,167 @@ func (d *Database) GetCoupon(drugID string, pharmacyID string) (Coupon, error) {
 }
 
 // HTTP Handlers
-func searchDrugs(c *fiber.Ctx) error {
+func (h *handlers) searchDrugs(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	query := c.Query("query")
 	if query == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "search query is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "search query is required")
 	}
 
 	results := db.SearchDrugs(query)
-	return c.JSON(results)
+	return server.List(c, results)
 }
 
-func getDrugPrices(c *fiber.Ctx) error {
+func (h *handlers) getDrugPrices(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	drugID := c.Params("drugId")
 	zipCode := c.Query("zipCode")
 
 	if zipCode == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "zipCode is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "zipCode is required")
 	}
 
 	prices := db.GetDrugPrices(drugID, zipCode)
-	return c.JSON(prices)
+	return server.List(c, prices)
 }
 
-func getUserPrescriptions(c *fiber.Ctx) error {
+func (h *handlers) getUserPrescriptions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	prescriptions, err := db.GetUserPrescriptions(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(prescriptions)
+	return server.List(c, prescriptions)
 }
 
 type NewPrescriptionRequest struct {
 	DrugID         string    `json:"drugId"`
-	UserEmail      string    `json:"userEmail"`
+	UserEmail      string    `json:"userEmail" validate:"email"`
 	Prescriber     string    `json:"prescriber"`
-	Quantity       int       `json:"quantity"`
+	Quantity       int       `json:"quantity" validate:"gte=0"`
 	Refills        int       `json:"refills"`
 	ExpirationDate time.Time `json:"expirationDate"`
 }
 
-func addPrescription(c *fiber.Ctx) error {
+func (h *handlers) addPrescription(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewPrescriptionRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
-	drug, exists := db.Drugs[req.DrugID]
+	drug, exists := db.Drugs.Get(req.DrugID)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Drug not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Drug not found")
 	}
 
 	prescription := Prescription{
-		ID:             uuid.New().String(),
+		ID:             server.NewID("RX"),
 		UserEmail:      req.UserEmail,
 		Drug:           drug,
 		Prescriber:     req.Prescriber,
 		Quantity:       req.Quantity,
 		Refills:        req.Refills,
 		ExpirationDate: req.ExpirationDate,
-		CreatedAt:      time.Now(),
+		CreatedAt:      h.clock.Now(),
 	}
 
 	if err := db.AddPrescription(prescription); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(prescription)
 }
 
-func getCoupon(c *fiber.Ctx) error {
+func (h *handlers) getCoupon(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	drugID := c.Params("drugId")
 	pharmacyID := c.Query("pharmacyId")
 
 	if pharmacyID == "" {
 
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "pharmacyId is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "pharmacyId is required")
 	}
 
 	coupon, err := db.GetCoupon(drugID, pharmacyID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(coupon)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:         make(map[string]User),
-		Drugs:         make(map[string]Drug),
-		Pharmacies:    make(map[string]Pharmacy),
-		Prescriptions: make(map[string]Prescription),
-		Coupons:       make(map[string]Coupon),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Drug routes
-	api.Get("/drugs/search", searchDrugs)
-	api.Get("/drugs/:drugId/prices", getDrugPrices)
+	api.Get("/drugs/search", h.searchDrugs)
+	api.Get("/drugs/:drugId/prices", h.getDrugPrices)
 
 	// Prescription routes
-	api.Get("/prescriptions", getUserPrescriptions)
-	api.Post("/prescriptions", addPrescription)
+	api.Get("/prescriptions", h.getUserPrescriptions)
+	api.Post("/prescriptions", h.addPrescription)
 
 	// Coupon routes
-	api.Get("/coupons/:drugId", getCoupon)
+	api.Get("/coupons/:drugId", h.getCoupon)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "prescriptions"},
+			Search:  []string{"drugs", "pharmacies", "coupons"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"pkg/money"
+	"pkg/server"
+	"pkg/servertest"
+)
+
+const fixture = `{
+  "users": {
+    "lee@example.com": {"email": "lee@example.com", "name": "Lee"}
+  },
+  "drugs": {
+    "drug_lipitor": {"id": "drug_lipitor", "name": "Lipitor", "genericName": "atorvastatin", "strength": "20mg"},
+    "drug_zoloft": {"id": "drug_zoloft", "name": "Zoloft", "genericName": "sertraline", "strength": "50mg"}
+  },
+  "pharmacies": {
+    "ph_1": {"id": "ph_1", "name": "Corner Drug", "zipCode": "10001"},
+    "ph_2": {"id": "ph_2", "name": "Uptown Rx", "zipCode": "10027"}
+  },
+  "prescriptions": {},
+  "coupons": {
+    "cp_1": {"id": "cp_1", "drugId": "drug_lipitor", "pharmacyId": "ph_1", "discountPrice": 11.4, "originalPrice": 38}
+  }
+}`
+
+var now = time.Date(2025, 1, 20, 15, 0, 0, 0, time.UTC)
+
+func newTestApp(t *testing.T) (*fiber.App, *handlers) {
+	t.Helper()
+	h, err := newHandlers(servertest.Store(fixture), servertest.Clock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := servertest.App()
+	setupRoutes(app, h)
+	return app, h
+}
+
+func TestSearchDrugs(t *testing.T) {
+	app, _ := newTestApp(t)
+	// Drugs are found by brand or generic name, in any case.
+	for _, query := range []string{"lipitor", "ATORVA"} {
+		var page server.Page[Drug]
+		servertest.Do(t, app, "GET", "/api/v1/drugs/search?query="+query, "", &page)
+		if page.Total != 1 || page.Data[0].ID != "drug_lipitor" {
+			t.Errorf("%s: got %+v, want Lipitor alone", query, page.Data)
+		}
+	}
+	if code := servertest.Do(t, app, "GET", "/api/v1/drugs/search", "", nil); code != http.StatusBadRequest {
+		t.Errorf("no query: got %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestGetDrugPrices(t *testing.T) {
+	app, _ := newTestApp(t)
+	var page server.Page[DrugPrice]
+	servertest.Do(t, app, "GET", "/api/v1/drugs/drug_zoloft/prices?zipCode=10027", "", &page)
+	if page.Total != 1 || page.Data[0].Pharmacy.ID != "ph_2" {
+		t.Fatalf("got %+v, want Uptown Rx's price alone", page.Data)
+	}
+	if got := page.Data[0].DiscountPrice; got != money.Cents(7000) {
+		t.Errorf("discounted to %s, want 70.00 USD", got)
+	}
+}
+
+func TestGetCoupon(t *testing.T) {
+	app, _ := newTestApp(t)
+	var coupon Coupon
+	if code := servertest.Do(t, app, "GET", "/api/v1/coupons/drug_lipitor?pharmacyId=ph_1", "", &coupon); code != http.StatusOK || coupon.ID != "cp_1" {
+		t.Errorf("got %d %+v, want cp_1", code, coupon)
+	}
+	if code := servertest.Do(t, app, "GET", "/api/v1/coupons/drug_lipitor?pharmacyId=ph_2", "", nil); code != http.StatusNotFound {
+		t.Errorf("at another pharmacy: got %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestAddPrescription(t *testing.T) {
+	app, h := newTestApp(t)
+	var rx Prescription
+	code := servertest.Do(t, app, "POST", "/api/v1/prescriptions",
+		`{"drugId": "drug_zoloft", "userEmail": "lee@example.com", "prescriber": "Dr. Okafor", "quantity": 30, "refills": 2}`, &rx)
+	if code != http.StatusCreated {
+		t.Fatalf("got %d, want %d", code, http.StatusCreated)
+	}
+	if rx.Drug.Name != "Zoloft" || !rx.CreatedAt.Equal(now) {
+		t.Errorf("got %s created %v, want Zoloft created at the clock's %v", rx.Drug.Name, rx.CreatedAt, now)
+	}
+	if got, _ := h.db.Get().GetUserPrescriptions("lee@example.com"); len(got) != 1 {
+		t.Errorf("Lee has %d prescriptions, want 1", len(got))
+	}
+
+	for body, want := range map[string]int{
+		`{"drugId": "drug_none", "userEmail": "lee@example.com", "quantity": 30}`:   http.StatusNotFound,
+		`{"drugId": "drug_zoloft", "userEmail": "kim@example.com", "quantity": 30}`: http.StatusNotFound,
+		`{"drugId": "drug_zoloft", "userEmail": "lee@example.com", "quantity": -1}`: http.StatusUnprocessableEntity,
+	} {
+		if code := servertest.Do(t, app, "POST", "/api/v1/prescriptions", body, nil); code != want {
+			t.Errorf("%s: got %d, want %d", body, code, want)
+		}
+	}
+}
@@ -1,35 +1,31 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
 type App struct {
-	ID              string    `json:"id"`
-	Name            string    `json:"name"`
-	Developer       string    `json:"developer"`
-	Category        string    `json:"category"`
-	Price           float64   `json:"price"`
-	Rating          float64   `json:"rating"`
-	Downloads       string    `json:"downloads"`
-	Description     string    `json:"description"`
-	Version         string    `json:"version"`
-	Size            string    `json:"size"`
-	LastUpdated     time.Time `json:"last_updated"`
-	RequiresAndroid string    `json:"requires_android"`
+	ID              string      `json:"id"`
+	Name            string      `json:"name"`
+	Developer       string      `json:"developer"`
+	Category        string      `json:"category"`
+	Price           money.Money `json:"price"`
+	Rating          float64     `json:"rating"`
+	Downloads       string      `json:"downloads"`
+	Description     string      `json:"description"`
+	Version         string      `json:"version"`
+	Size            string      `json:"size"`
+	LastUpdated     time.Time   `json:"last_updated"`
+	RequiresAndroid string      `json:"requires_android"`
 }
 
 type UserApp struct {
@@ -54,19 +50,23 @@ type Payment struct {
 }
 
 type Purchase struct {
-	ID          string    `json:"id"`
-	App         App       `json:"app"`
-	UserEmail   string    `json:"user_email"`
-	Amount      float64   `json:"amount"`
-	PurchasedAt time.Time `json:"purchased_at"`
+	ID          string      `json:"id"`
+	App         App         `json:"app"`
+	UserEmail   string      `json:"user_email"`
+	Amount      money.Money `json:"amount"`
+	PurchasedAt time.Time   `json:"purchased_at"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users     map[string]User     `json:"users"`
-	Apps      map[string]App      `json:"apps"`
-	Purchases map[string]Purchase `json:"purchases"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users     server.Repository[User]     `json:"users"`
+	Apps      server.Repository[App]      `json:"apps"`
+	Purchases server.Repository[Purchase] `json:"purchases"`
 	mu        sync.RWMutex
+	clock     *server.Clock
 }
 
 // Custom errors
@@ -76,15 +76,24 @@ var (
 	ErrInvalidInput = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers sell Google Play apps and keep users' purchases, dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the apps, users and purchases in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -95,7 +104,7 @@ func (d *Database) GetApp(id string) (App, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	app, exists := d.Apps[id]
+	app, exists := d.Apps.Get(id)
 	if !exists {
 		return App{}, ErrAppNotFound
 	}
@@ -107,31 +116,32 @@ func (d *Database) AddPurchase(purchase Purchase) error {
 	defer d.mu.Unlock()
 
 	// Add purchase record
-	d.Purchases[purchase.ID] = purchase
+	d.Purchases.Upsert(purchase.ID, purchase)
 
 	// Update user's library
-	user := d.Users[purchase.UserEmail]
+	user, _ := d.Users.Get(purchase.UserEmail)
 	userApp := UserApp{
 		App:         purchase.App,
 		PurchasedAt: purchase.PurchasedAt,
-		LastUsed:    time.Now(),
+		LastUsed:    d.clock.Now(),
 		AutoUpdate:  true,
 	}
 	user.Library = append(user.Library, userApp)
-	d.Users[purchase.UserEmail] = user
+	d.Users.Upsert(purchase.UserEmail, user)
 
 	return nil
 }
 
 // HTTP Handlers
-func getApps(c *fiber.Ctx) error {
+func (h *handlers) getApps(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	search := c.Query("search")
 
 	var filteredApps []App
 
 	db.mu.RLock()
-	for _, app := range db.Apps {
+	for _, app := range db.Apps.List() {
 		if category != "" && app.Category != category {
 			continue
 		}
@@ -142,63 +152,56 @@ func getApps(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(filteredApps)
+	return server.List(c, filteredApps, "category")
 }
 
-func getAppDetails(c *fiber.Ctx) error {
+func (h *handlers) getAppDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	appId := c.Params("appId")
 
 	app, err := db.GetApp(appId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(app)
 }
 
-func getUserLibrary(c *fiber.Ctx) error {
+func (h *handlers) getUserLibrary(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Library)
+	return server.List(c, user.Library)
 }
 
 type PurchaseRequest struct {
 	AppID         string `json:"app_id"`
-	UserEmail     string `json:"user_email"`
+	UserEmail     string `json:"user_email" validate:"email"`
 	PaymentMethod string `json:"payment_method"`
 }
 
-func purchaseApp(c *fiber.Ctx) error {
+func (h *handlers) purchaseApp(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req PurchaseRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate app
 	app, err := db.GetApp(req.AppID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate payment method
@@ -210,33 +213,27 @@ func purchaseApp(c *fiber.Ctx) error {
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Check if user already owns the app
 	for _, userApp := range user.Library {
 		if userApp.App.ID == app.ID {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "User already owns this app",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "User already owns this app")
 		}
 	}
 
 	// Create purchase record
 	purchase := Purchase{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("PUR"),
 		App:         app,
 		UserEmail:   req.UserEmail,
 		Amount:      app.Price,
-		PurchasedAt: time.Now(),
+		PurchasedAt: h.clock.Now(),
 	}
 
 	if err := db.AddPurchase(purchase); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to process purchase",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to process purchase")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(purchase)
@@ -247,67 +244,72 @@ func contains(s, substr string) bool {
 	return true // Implement proper string search
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:     make(map[string]User),
-		Apps:      make(map[string]App),
-		Purchases: make(map[string]Purchase),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// App routes
-	api.Get("/apps", getApps)
-	api.Get("/apps/:appId", getAppDetails)
+	api.Get("/apps", h.getApps)
+	api.Get("/apps/:appId", h.getAppDetails)
 
 	// User routes
-	api.Get("/users/:email/library", getUserLibrary)
+	api.Get("/users/:email/library", h.getUserLibrary)
 
 	// Purchase routes
-	api.Post("/purchases", purchaseApp)
+	api.Post("/purchases", h.purchaseApp)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"purchases"},
+			Search:  []string{"apps", "purchases"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,26 +1,30 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/messaging"
+	"pkg/money"
+	"pkg/payments"
+	"pkg/pricing"
+	"pkg/promotions"
+	"pkg/reviews"
+	"pkg/search"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type CustomizationChoice struct {
-	Name  string  `json:"name"`
-	Price float64 `json:"price"`
+	Name  string      `json:"name"`
+	Price money.Money `json:"price"`
 }
 
 type CustomizationOption struct {
@@ -32,25 +36,25 @@ type MenuItem struct {
 	ID                   string                `json:"id"`
 	Name                 string                `json:"name"`
 	Description          string                `json:"description"`
-	Price                float64               `json:"price"`
+	Price                money.Money           `json:"price"`
 	Category             string                `json:"category"`
 	CustomizationOptions []CustomizationOption `json:"customization_options"`
 	Available            bool                  `json:"available"`
 }
 
 type Restaurant struct {
-	ID                    string     `json:"id"`
-	Name                  string     `json:"name"`
-	CuisineType           string     `json:"cuisine_type"`
-	Rating                float64    `json:"rating"`
-	EstimatedDeliveryTime int        `json:"estimated_delivery_time"`
-	DeliveryFee           float64    `json:"delivery_fee"`
-	MinimumOrder          float64    `json:"minimum_order"`
-	Address               string     `json:"address"`
-	Latitude              float64    `json:"latitude"`
-	Longitude             float64    `json:"longitude"`
-	Menu                  []MenuItem `json:"menu"`
-	IsOpen                bool       `json:"is_open"`
+	ID                    string      `json:"id"`
+	Name                  string      `json:"name"`
+	CuisineType           string      `json:"cuisine_type"`
+	Rating                float64     `json:"rating"`
+	EstimatedDeliveryTime int         `json:"estimated_delivery_time"`
+	DeliveryFee           money.Money `json:"delivery_fee"`
+	MinimumOrder          money.Money `json:"minimum_order"`
+	Address               string      `json:"address"`
+	Latitude              float64     `json:"latitude"`
+	Longitude             float64     `json:"longitude"`
+	Menu                  []MenuItem  `json:"menu"`
+	IsOpen                bool        `json:"is_open"`
 }
 
 type CartItemCustomization struct {
@@ -63,54 +67,136 @@ type CartItem struct {
 	Quantity            int                     `json:"quantity"`
 	Customizations      []CartItemCustomization `json:"customizations"`
 	SpecialInstructions string                  `json:"special_instructions"`
-	Price               float64                 `json:"price"`
+	Price               money.Money             `json:"price"`
 }
 
 type Cart struct {
-	ID           string     `json:"id"`
-	UserEmail    string     `json:"user_email"`
-	RestaurantID string     `json:"restaurant_id"`
-	Items        []CartItem `json:"items"`
-	Subtotal     float64    `json:"subtotal"`
-	Tax          float64    `json:"tax"`
-	DeliveryFee  float64    `json:"delivery_fee"`
-	Total        float64    `json:"total"`
-	CreatedAt    time.Time  `json:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
+	ID           string      `json:"id"`
+	UserEmail    string      `json:"user_email"`
+	RestaurantID string      `json:"restaurant_id"`
+	Items        []CartItem  `json:"items"`
+	Subtotal     money.Money `json:"subtotal"`
+	Tax          money.Money `json:"tax"`
+	DeliveryFee  money.Money `json:"delivery_fee"`
+	Total        money.Money `json:"total"`
+	CreatedAt    time.Time   `json:"created_at"`
+	UpdatedAt    time.Time   `json:"updated_at"`
+}
+
+// User is a diner, with the cards they pay for orders with.
+type User struct {
+	Email          string          `json:"email"`
+	Name           string          `json:"name"`
+	PaymentMethods []PaymentMethod `json:"payment_methods"`
+}
+
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Last4    string `json:"last4"`
+	ExpiryMM int    `json:"expiry_mm"`
+	ExpiryYY int    `json:"expiry_yy"`
+}
+
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
+}
+
+// Courier delivers orders, and is who diners message about them.
+type Courier struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Phone   string `json:"phone"`
+	Vehicle string `json:"vehicle"` // Such as bicycle or car
 }
 
 type Order struct {
-	ID              string    `json:"id"`
-	UserEmail       string    `json:"user_email"`
-	Cart            Cart      `json:"cart"`
-	Status          string    `json:"status"`
-	DeliveryAddress string    `json:"delivery_address"`
-	PaymentMethodID string    `json:"payment_method_id"`
-	TipAmount       float64   `json:"tip_amount"`
-	CreatedAt       time.Time `json:"created_at"`
-	UpdatedAt       time.Time `json:"updated_at"`
+	ID              string                    `json:"id"`
+	UserEmail       string                    `json:"user_email"`
+	Cart            Cart                      `json:"cart"`
+	Status          string                    `json:"status"`
+	StatusHistory   []statemachine.Transition `json:"status_history,omitempty"`
+	DeliveryAddress string                    `json:"delivery_address"`
+	PaymentMethodID string                    `json:"payment_method_id"`
+	ChargeID        string                    `json:"charge_id,omitempty"` // The charge to the payment method
+	TipAmount       money.Money               `json:"tip_amount"`
+	PromoCodes      []string                  `json:"promo_codes,omitempty"`
+	Discount        money.Money               `json:"discount"`                  // Taken off by promo codes, and out of the cart's tax and total
+	Courier         *Courier                  `json:"courier,omitempty"`         // Once it is out for delivery
+	ConversationID  string                    `json:"conversation_id,omitempty"` // With the courier
+	CreatedAt       time.Time                 `json:"created_at"`
+	UpdatedAt       time.Time                 `json:"updated_at"`
 }
 
+// orderMachine is the statuses an order moves through, from the kitchen
+// to the door.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	"pending":          {"preparing"},
+	"preparing":        {"out_for_delivery"},
+	"out_for_delivery": {"delivered"},
+}}
+
+// orderLifecycle has the restaurant prepare each order and a driver
+// deliver it within the hour.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: "pending", To: "preparing", After: 5 * time.Minute},
+	{From: "preparing", To: "out_for_delivery", After: 20 * time.Minute,
+		Notify: server.Notice{Type: "order_out_for_delivery", Message: "Your order {{id}} is on its way."}},
+	{From: "out_for_delivery", To: "delivered", After: 25 * time.Minute,
+		Notify: server.Notice{Type: "order_delivered", Message: "Your order {{id}} was delivered."}},
+}, Machine: orderMachine}
+
 type Database struct {
-	Restaurants map[string]Restaurant `json:"restaurants"`
-	Carts       map[string]Cart       `json:"carts"`
-	Orders      map[string]Order      `json:"orders"`
-	mu          sync.RWMutex
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+	server.Promotions
+	server.Reviews
+	server.Messaging
+
+	Users       server.Repository[User]       `json:"users"`
+	Restaurants server.Repository[Restaurant] `json:"restaurants"`
+	Carts       server.Repository[Cart]       `json:"carts"`
+	Orders      server.Repository[Order]      `json:"orders"`
+	Couriers    server.Repository[Courier]    `json:"couriers"`
+	// RestaurantIndex is the restaurants' and their menus' text, for
+	// ?query. It is exported, if not saved, so that each sandbox's copy of
+	// the database has its own.
+	RestaurantIndex *search.Index `json:"-"`
+	// LocationIndex is where the restaurants are, for finding nearby ones.
+	LocationIndex *geo.Index `json:"-"`
+	mu            sync.RWMutex
 }
 
 var (
-	db                    *Database
 	ErrRestaurantNotFound = errors.New("restaurant not found")
 	ErrCartNotFound       = errors.New("cart not found")
 	ErrOrderNotFound      = errors.New("order not found")
 )
 
+// handlers take Grubhub orders from restaurants' menus, dating carts and
+// orders by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the database in store and indexes its restaurants by
+// name and location.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+// taxRate is the sales tax on food, which --tax-rate overrides.
+var taxRate = 0.0825
+
 // Database operations
 func (d *Database) GetRestaurant(id string) (Restaurant, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	restaurant, exists := d.Restaurants[id]
+	restaurant, exists := d.Restaurants.Get(id)
 	if !exists {
 		return Restaurant{}, ErrRestaurantNotFound
 	}
@@ -121,48 +207,260 @@ func (d *Database) GetCart(id string) (Cart, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	cart, exists := d.Carts[id]
+	cart, exists := d.Carts.Get(id)
 	if !exists {
 		return Cart{}, ErrCartNotFound
 	}
 	return cart, nil
 }
 
+// GetPaymentMethod returns the user's payment method with the ID id.
+func (d *Database) GetPaymentMethod(email, id string) (PaymentMethod, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	user, _ := d.Users.Get(email)
+	for _, pm := range user.PaymentMethods {
+		if pm.ID == id {
+			return pm, true
+		}
+	}
+	return PaymentMethod{}, false
+}
+
+// GetUserCart returns the user's cart, if they have one.
+func (d *Database) GetUserCart(email string) (Cart, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	carts := d.Carts.By("user_email", email)
+	if len(carts) == 0 {
+		return Cart{}, false
+	}
+	return carts[0], true
+}
+
 func (d *Database) UpdateCart(cart Cart) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Carts[cart.ID] = cart
+	d.Carts.Upsert(cart.ID, cart)
 	return nil
 }
 
-func (d *Database) CreateOrder(order Order) error {
+// CreateOrder saves order, taking promoCodes off its cart and holding its
+// total and tip on method through pay until it is delivered. A code that
+// can't be used fails it with a *server.ValidationError.
+func (d *Database) CreateOrder(order *Order, promoCodes []string, method PaymentMethod, pay server.Charger) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Orders[order.ID] = order
+	var quote pricing.Quote
+	if len(promoCodes) > 0 {
+		discounts, err := d.Discounts(promoCodes, promotions.Order{UserEmail: order.UserEmail, Subtotal: order.Cart.Subtotal})
+		if err != nil {
+			return err
+		}
+		if quote, err = priceCart(order.Cart.Items, order.Cart.DeliveryFee, discounts...); err != nil {
+			return err
+		}
+		order.Discount, order.Cart.Tax, order.Cart.Total = quote.Discount, quote.Tax, quote.Total
+	}
+	amount, err := order.Cart.Total.Add(order.TipAmount)
+	if err != nil {
+		return err
+	}
+	charge, err := pay(server.ChargeRequest{
+		UserEmail:       order.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          amount,
+		Description:     "Order " + order.ID,
+	})
+	if err != nil {
+		return err
+	}
+	order.ChargeID = charge.ID
+	if len(promoCodes) > 0 {
+		for _, r := range d.Redeem(promoCodes, order.UserEmail, order.ID, quote) {
+			order.PromoCodes = append(order.PromoCodes, r.Code)
+		}
+	}
+	d.Orders.Upsert(order.ID, *order)
 	return nil
 }
 
+// Stepped hands an order to a courier once it is out for delivery, putting
+// the diner in touch with them, and ends their chat and takes the payment
+// held for it once it is delivered. Callers must hold d.mu for writing.
+func (d *Database) Stepped(collection, key, from, to string) {
+	order, ok := d.Orders.Get(key)
+	if collection != "orders" || !ok {
+		return
+	}
+	about := messaging.About{Kind: "order", ID: order.ID}
+	switch to {
+	case "out_for_delivery":
+		courier, ok := d.nextCourier()
+		if !ok {
+			return
+		}
+		restaurant, _ := d.Restaurants.Get(order.Cart.RestaurantID)
+		chat := d.Open(about,
+			messaging.Participant{ID: order.UserEmail, Role: "customer"},
+			messaging.Participant{ID: courier.ID, Role: "courier", Name: courier.Name})
+		d.Send(chat.ID, courier.ID, "Hi, I'm "+courier.Name+". I've picked up your order from "+restaurant.Name+" and I'm on my way.")
+		d.Orders.Update(key, func(o *Order) {
+			o.Courier, o.ConversationID = &courier, chat.ID
+		})
+	case "delivered":
+		d.Close(about)
+		if order.ChargeID != "" {
+			d.Capture(order.ChargeID, money.Money{})
+		}
+	}
+}
+
+// nextCourier returns the courier with the fewest orders out for delivery,
+// if there are any couriers. Callers must hold d.mu.
+func (d *Database) nextCourier() (Courier, bool) {
+	couriers := d.Couriers.List()
+	if len(couriers) == 0 {
+		return Courier{}, false
+	}
+	load := make(map[string]int)
+	for _, order := range d.Orders.By("status", "out_for_delivery") {
+		if order.Courier != nil {
+			load[order.Courier.ID]++
+		}
+	}
+	next := couriers[0]
+	for _, courier := range couriers[1:] {
+		if load[courier.ID] < load[next.ID] {
+			next = courier
+		}
+	}
+	return next, true
+}
+
+// restaurantPolicy takes reviews of restaurants, in whole stars, from
+// customers who have had an order from them delivered.
+var restaurantPolicy = reviews.Policy{Kind: "restaurant", Scale: reviews.Stars, Verified: true}
+
+// CreateReview records a customer's review of a restaurant, verified by an
+// order from it that was delivered to them.
+func (d *Database) CreateReview(review reviews.Review) (reviews.Review, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Restaurants.Get(review.Target.ID); !exists {
+		return reviews.Review{}, ErrRestaurantNotFound
+	}
+	orderID := ""
+	for _, order := range d.Orders.By("user_email", review.UserEmail) {
+		if order.Cart.RestaurantID == review.Target.ID && order.Status == "delivered" {
+			orderID = order.ID
+			break
+		}
+	}
+	return d.AddReview(restaurantPolicy, review, orderID)
+}
+
+// restaurantIndex returns the index of restaurants' text, making it for a
+// database that hasn't one, such as a new sandbox's copy.
+func (d *Database) restaurantIndex() *search.Index {
+	d.mu.RLock()
+	index := d.RestaurantIndex
+	d.mu.RUnlock()
+	if index != nil {
+		return index
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.RestaurantIndex == nil {
+		d.RestaurantIndex = indexRestaurants(&d.Restaurants)
+	}
+	return d.RestaurantIndex
+}
+
+// indexRestaurants indexes restaurants by their names and their menu
+// items' names and descriptions.
+func indexRestaurants(restaurants *server.Repository[Restaurant]) *search.Index {
+	index := search.New()
+	for _, id := range restaurants.Keys() {
+		restaurant, _ := restaurants.Get(id)
+		fields := []search.Field{{Text: restaurant.Name, Weight: 3}}
+		for _, item := range restaurant.Menu {
+			fields = append(fields, search.Field{Text: item.Name, Weight: 2}, search.Field{Text: item.Description, Weight: 1})
+		}
+		index.Add(id, fields...)
+	}
+	return index
+}
+
+// locationIndex returns the index of restaurants' locations, making it
+// for a database that hasn't one, such as a new sandbox's copy.
+func (d *Database) locationIndex() *geo.Index {
+	d.mu.RLock()
+	index := d.LocationIndex
+	d.mu.RUnlock()
+	if index != nil {
+		return index
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.LocationIndex == nil {
+		d.LocationIndex = indexLocations(&d.Restaurants)
+	}
+	return d.LocationIndex
+}
+
+func indexLocations(restaurants *server.Repository[Restaurant]) *geo.Index {
+	index := geo.NewIndex()
+	for _, id := range restaurants.Keys() {
+		restaurant, _ := restaurants.Get(id)
+		index.Add(id, geo.Point{Lat: restaurant.Latitude, Lon: restaurant.Longitude})
+	}
+	return index
+}
+
 // Handlers
-func searchHandler(c *fiber.Ctx) error {
+func (h *handlers) searchHandler(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	query := c.Query("query")
 	lat := c.QueryFloat("latitude", 0)
 	lon := c.QueryFloat("longitude", 0)
 	cuisine := c.Query("cuisine")
 
 	if lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "latitude and longitude are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "latitude and longitude are required")
 	}
 
+	radius := c.QueryFloat("radius_km", 10)
+
+	// The nearest first, or with a query the best matches
+	nearby := db.locationIndex().Within(geo.Point{Lat: lat, Lon: lon}, radius)
+	var ids []string
+	if query != "" {
+		inRange := make(map[string]bool, len(nearby))
+		for _, near := range nearby {
+			inRange[near.ID] = true
+		}
+		for _, result := range db.restaurantIndex().Search(query) {
+			if inRange[result.ID] {
+				ids = append(ids, result.ID)
+			}
+		}
+	} else {
+		for _, near := range nearby {
+			ids = append(ids, near.ID)
+		}
+	}
 	var results []Restaurant
 	db.mu.RLock()
-	for _, restaurant := range db.Restaurants {
-		// Filter by location (simplified)
-		distance := calculateDistance(lat, lon, restaurant.Latitude, restaurant.Longitude)
-		if distance > 10 { // 10km radius
+	for _, id := range ids {
+		restaurant, ok := db.Restaurants.Get(id)
+		if !ok {
 			continue
 		}
 
@@ -171,25 +469,6 @@ func searchHandler(c *fiber.Ctx) error {
 			continue
 		}
 
-		// Filter by search query if specified
-		if query != "" {
-			matches := false
-			// Search in restaurant name
-			if contains(restaurant.Name, query) {
-				matches = true
-			}
-			// Search in menu items
-			for _, item := range restaurant.Menu {
-				if contains(item.Name, query) || contains(item.Description, query) {
-					matches = true
-					break
-				}
-			}
-			if !matches {
-				continue
-			}
-		}
-
 		results = append(results, restaurant)
 	}
 	db.mu.RUnlock()
@@ -199,96 +478,122 @@ func searchHandler(c *fiber.Ctx) error {
 	})
 }
 
-func getRestaurantMenu(c *fiber.Ctx) error {
+func (h *handlers) getRestaurantMenu(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	restaurantId := c.Params("restaurantId")
 
 	restaurant, err := db.GetRestaurant(restaurantId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Restaurant not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Restaurant not found")
 	}
 
-	return c.JSON(restaurant.Menu)
+	return server.List(c, restaurant.Menu)
 }
 
-func getCart(c *fiber.Ctx) error {
-	email := c.Query("email")
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+func (h *handlers) getRestaurantReviews(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	restaurantId := c.Params("restaurantId")
+	if _, err := db.GetRestaurant(restaurantId); err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	var userCart Cart
-	found := false
-
 	db.mu.RLock()
-	for _, cart := range db.Carts {
-		if cart.UserEmail == email {
-			userCart = cart
-			found = true
-			break
-		}
+	found := db.ReviewsOf(reviews.Target{Kind: restaurantPolicy.Kind, ID: restaurantId}, reviews.SortNewest)
+	db.mu.RUnlock()
+	return server.List(c, found)
+}
+
+// getRestaurantRating sums up a restaurant's reviews: how many there are,
+// their average and how many gave each number of stars.
+func (h *handlers) getRestaurantRating(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	restaurantId := c.Params("restaurantId")
+	if _, err := db.GetRestaurant(restaurantId); err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
+
+	db.mu.RLock()
+	summary := db.ReviewSummary(reviews.Target{Kind: restaurantPolicy.Kind, ID: restaurantId})
 	db.mu.RUnlock()
+	return c.JSON(summary)
+}
 
+func (h *handlers) createRestaurantReview(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Email  string `json:"email" validate:"email"`
+		Rating int    `json:"rating" validate:"gte=1,max=5"`
+		Body   string `json:"body"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	review, err := db.CreateReview(reviews.Review{
+		Target:    reviews.Target{ID: strings.Clone(c.Params("restaurantId"))},
+		UserEmail: req.Email,
+		Rating:    float64(req.Rating),
+		Body:      strings.TrimSpace(req.Body),
+	})
+	switch err {
+	case nil:
+	case ErrRestaurantNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case reviews.ErrNotVerified:
+		return server.Fail(c, fiber.StatusForbidden, server.CodeForbidden, "only customers who have had an order from this restaurant delivered may review it")
+	case reviews.ErrAlreadyReviewed:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(review)
+}
+
+func (h *handlers) getCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
+	}
+
+	userCart, found := db.GetUserCart(email)
 	if !found {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Cart not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Cart not found")
 	}
 
 	return c.JSON(userCart)
 }
 
-func addToCart(c *fiber.Ctx) error {
+func (h *handlers) addToCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		UserEmail    string   `json:"user_email"`
+		UserEmail    string   `json:"user_email" validate:"email"`
 		RestaurantID string   `json:"restaurant_id"`
 		Item         CartItem `json:"item"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Find or create cart
-	var cart Cart
-	found := false
-
-	db.mu.RLock()
-	for _, c := range db.Carts {
-		if c.UserEmail == req.UserEmail {
-			cart = c
-			found = true
-			break
-		}
-	}
-	db.mu.RUnlock()
-
+	cart, found := db.GetUserCart(req.UserEmail)
 	if !found {
 		cart = Cart{
-			ID:           uuid.New().String(),
+			ID:           server.NewID("CART"),
 			UserEmail:    req.UserEmail,
 			RestaurantID: req.RestaurantID,
 			Items:        []CartItem{},
-			CreatedAt:    time.Now(),
+			CreatedAt:    h.clock.Now(),
 		}
 	} else if cart.RestaurantID != req.RestaurantID {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Cannot add items from different restaurants to cart",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Cannot add items from different restaurants to cart")
 	}
 
 	// Validate menu item
 	restaurant, err := db.GetRestaurant(req.RestaurantID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Restaurant not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Restaurant not found")
 	}
 
 	var menuItem *MenuItem
@@ -300,152 +605,164 @@ func addToCart(c *fiber.Ctx) error {
 	}
 
 	if menuItem == nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Menu item not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Menu item not found")
 	}
 
 	// Add item to cart
 	cart.Items = append(cart.Items, req.Item)
-	cart.UpdatedAt = time.Now()
+	cart.UpdatedAt = h.clock.Now()
 
 	// Recalculate totals
-	cart.Subtotal = 0
-	for _, item := range cart.Items {
-		cart.Subtotal += item.Price * float64(item.Quantity)
+	quote, err := priceCart(cart.Items, restaurant.DeliveryFee)
+	if err != nil {
+		return err
 	}
-	cart.Tax = cart.Subtotal * 0.0825 // 8.25% tax
-	cart.DeliveryFee = restaurant.DeliveryFee
-	cart.Total = cart.Subtotal + cart.Tax + cart.DeliveryFee
+	cart.Subtotal = quote.Subtotal
+	cart.Tax = quote.Tax
+	cart.DeliveryFee = quote.Fees
+	cart.Total = quote.Total
 
 	// Save cart
 	if err := db.UpdateCart(cart); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update cart",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update cart")
 	}
 
 	return c.JSON(cart)
 }
 
-func placeOrder(c *fiber.Ctx) error {
+// priceCart prices a cart's items, delivered for deliveryFee, less
+// discounts, such as promo codes'.
+func priceCart(items []CartItem, deliveryFee money.Money, discounts ...pricing.Rule) (pricing.Quote, error) {
+	lines := make([]pricing.Line, len(items))
+	for i, item := range items {
+		lines[i] = pricing.Line{Price: item.Price, Quantity: item.Quantity}
+	}
+	rules := append(discounts, pricing.Fee("delivery", deliveryFee), pricing.Tax(taxRate))
+	return pricing.Price(money.USD, lines, rules...)
+}
+
+func (h *handlers) placeOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		Email           string  `json:"email"`
-		CartID          string  `json:"cart_id"`
-		DeliveryAddress string  `json:"delivery_address"`
-		PaymentMethodID string  `json:"payment_method_id"`
-		TipAmount       float64 `json:"tip_amount"`
+		Email           string      `json:"email" validate:"email"`
+		CartID          string      `json:"cart_id"`
+		DeliveryAddress string      `json:"delivery_address"`
+		PaymentMethodID string      `json:"payment_method_id"`
+		TipAmount       money.Money `json:"tip_amount" validate:"gte=0"`
+		// PromoCodes are taken off the order before delivery and tax.
+		PromoCodes []string `json:"promo_codes"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Get cart
 	cart, err := db.GetCart(req.CartID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Cart not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Cart not found")
 	}
 
 	// Validate cart belongs to user
 	if cart.UserEmail != req.Email {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized",
-		})
+		return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "Unauthorized")
+	}
+	method, ok := db.GetPaymentMethod(req.Email, req.PaymentMethodID)
+	if !ok {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Create order
 	order := Order{
-		ID:              uuid.New().String(),
+		ID:              server.NewID("ORD"),
 		UserEmail:       req.Email,
 		Cart:            cart,
 		Status:          "pending",
 		DeliveryAddress: req.DeliveryAddress,
 		PaymentMethodID: req.PaymentMethodID,
 		TipAmount:       req.TipAmount,
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
+		CreatedAt:       h.clock.Now(),
+		UpdatedAt:       h.clock.Now(),
 	}
 
-	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+	if err := db.CreateOrder(&order, req.PromoCodes, method, db.Charger(c)); err != nil {
+		return err
 	}
 
 	// Clear cart
-	delete(db.Carts, cart.ID)
+	db.mu.Lock()
+	db.Carts.Delete(cart.ID)
+	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-// Utility functions
-func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
-}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-func contains(s, substr string) bool {
-	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
-}
-
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
+	if err := server.Load(store, db); err != nil {
 		return err
 	}
-
-	db = &Database{
-		Restaurants: make(map[string]Restaurant),
-		Carts:       make(map[string]Cart),
-		Orders:      make(map[string]Order),
-	}
-
-	return json.Unmarshal(data, db)
+	db.RestaurantIndex = indexRestaurants(&db.Restaurants)
+	db.LocationIndex = indexLocations(&db.Restaurants)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/search", searchHandler)
-	api.Get("/restaurants/:restaurantId/menu", getRestaurantMenu)
-	api.Get("/cart", getCart)
-	api.Post("/cart", addToCart)
-	api.Post("/orders", placeOrder)
+	api.Get("/search", h.searchHandler)
+	api.Get("/restaurants/:restaurantId/menu", h.getRestaurantMenu)
+	api.Get("/restaurants/:restaurantId/reviews", h.getRestaurantReviews)
+	api.Post("/restaurants/:restaurantId/reviews", h.createRestaurantReview)
+	api.Get("/restaurants/:restaurantId/rating", h.getRestaurantRating)
+	api.Get("/cart", h.getCart)
+	api.Post("/cart", h.addToCart)
+	api.Post("/orders", h.placeOrder)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	taxRate = cfg.TaxRate(taxRate)
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "carts", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -28,12 +24,12 @@ const (
 )
 
 type MealPlan struct {
-	ID              string  `json:"id"`
-	Name            string  `json:"name"`
-	MealsPerWeek    int     `json:"meals_per_week"`
-	ServingsPerMeal int     `json:"servings_per_meal"`
-	PricePerServing float64 `json:"price_per_serving"`
-	Description     string  `json:"description"`
+	ID              string      `json:"id"`
+	Name            string      `json:"name"`
+	MealsPerWeek    int         `json:"meals_per_week"`
+	ServingsPerMeal int         `json:"servings_per_meal"`
+	PricePerServing money.Money `json:"price_per_serving"`
+	Description     string      `json:"description"`
 }
 
 type Recipe struct {
@@ -72,11 +68,15 @@ type WeeklySelection struct {
 
 // Database represents our in-memory database
 type Database struct {
-	MealPlans        map[string]MealPlan        `json:"meal_plans"`
-	Recipes          map[string]Recipe          `json:"recipes"`
-	Subscriptions    map[string]Subscription    `json:"subscriptions"`
-	WeeklySelections map[string]WeeklySelection `json:"weekly_selections"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	MealPlans        server.Repository[MealPlan]        `json:"meal_plans"`
+	Recipes          server.Repository[Recipe]          `json:"recipes"`
+	Subscriptions    server.Repository[Subscription]    `json:"subscriptions"`
+	WeeklySelections server.Repository[WeeklySelection] `json:"weekly_selections"`
 	mu               sync.RWMutex
+	clock            *server.Clock
 }
 
 // Custom errors
@@ -88,19 +88,25 @@ var (
 	ErrSubscriptionNotFound = errors.New("subscription not found")
 )
 
-// Global database instance
-var db *Database
+// handlers keep HelloFresh subscriptions and their weekly recipe selections,
+// with clock for the week.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the meal plans, recipes and subscriptions in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetMealPlans() []MealPlan {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	plans := make([]MealPlan, 0, len(d.MealPlans))
-	for _, plan := range d.MealPlans {
-		plans = append(plans, plan)
-	}
-	return plans
+	return d.MealPlans.List()
 }
 
 func (d *Database) GetWeeklyMenu(week time.Time) []Recipe {
@@ -108,18 +114,14 @@ func (d *Database) GetWeeklyMenu(week time.Time) []Recipe {
 	defer d.mu.RUnlock()
 
 	// In a real implementation, this would filter recipes based on the week
-	recipes := make([]Recipe, 0, len(d.Recipes))
-	for _, recipe := range d.Recipes {
-		recipes = append(recipes, recipe)
-	}
-	return recipes
+	return d.Recipes.List()
 }
 
 func (d *Database) GetSubscription(email string) (Subscription, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	for _, sub := range d.Subscriptions {
+	for _, sub := range d.Subscriptions.List() {
 		if sub.UserEmail == email {
 			return sub, nil
 		}
@@ -132,12 +134,12 @@ func (d *Database) CreateOrUpdateSubscription(sub Subscription) error {
 	defer d.mu.Unlock()
 
 	if sub.ID == "" {
-		sub.ID = uuid.New().String()
-		sub.CreatedAt = time.Now()
+		sub.ID = server.NewID("SUB")
+		sub.CreatedAt = d.clock.Now()
 	}
-	sub.UpdatedAt = time.Now()
+	sub.UpdatedAt = d.clock.Now()
 
-	d.Subscriptions[sub.ID] = sub
+	d.Subscriptions.Upsert(sub.ID, sub)
 	return nil
 }
 
@@ -145,7 +147,7 @@ func (d *Database) GetWeeklySelection(email string, week time.Time) (WeeklySelec
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	for _, selection := range d.WeeklySelections {
+	for _, selection := range d.WeeklySelections.List() {
 		if selection.UserEmail == email && selection.Week.Equal(week) {
 			return selection, nil
 		}
@@ -154,63 +156,57 @@ func (d *Database) GetWeeklySelection(email string, week time.Time) (WeeklySelec
 }
 
 // HTTP Handlers
-func getMealPlans(c *fiber.Ctx) error {
+func (h *handlers) getMealPlans(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	plans := db.GetMealPlans()
-	return c.JSON(plans)
+	return server.List(c, plans)
 }
 
-func getWeeklyMenu(c *fiber.Ctx) error {
+func (h *handlers) getWeeklyMenu(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	weekStr := c.Query("week")
 	week, err := time.Parse("2006-01-02", weekStr)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid week format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid week format")
 	}
 
 	recipes := db.GetWeeklyMenu(week)
-	return c.JSON(recipes)
+	return server.List(c, recipes)
 }
 
-func getSubscription(c *fiber.Ctx) error {
+func (h *handlers) getSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	subscription, err := db.GetSubscription(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(subscription)
 }
 
 type SubscriptionRequest struct {
-	UserEmail          string              `json:"user_email"`
+	UserEmail          string              `json:"user_email" validate:"email"`
 	MealPlanID         string              `json:"meal_plan_id"`
 	DeliveryDay        string              `json:"delivery_day"`
 	DietaryPreferences []DietaryPreference `json:"dietary_preferences"`
 }
 
-func createOrUpdateSubscription(c *fiber.Ctx) error {
+func (h *handlers) createOrUpdateSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req SubscriptionRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate meal plan
-	mealPlan, exists := db.MealPlans[req.MealPlanID]
+	mealPlan, exists := db.MealPlans.Get(req.MealPlanID)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "meal plan not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "meal plan not found")
 	}
 
 	// Create or update subscription
@@ -219,116 +215,99 @@ func createOrUpdateSubscription(c *fiber.Ctx) error {
 		MealPlan:           mealPlan,
 		DeliveryDay:        req.DeliveryDay,
 		Status:             "active",
-		NextDelivery:       calculateNextDelivery(req.DeliveryDay),
+		NextDelivery:       calculateNextDelivery(req.DeliveryDay, h.clock.Now()),
 		DietaryPreferences: req.DietaryPreferences,
 	}
 
 	if err := db.CreateOrUpdateSubscription(subscription); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create subscription",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create subscription")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(subscription)
 }
 
 type WeeklySelectionRequest struct {
-	UserEmail string   `json:"user_email"`
-	Week      string   `json:"week"`
+	UserEmail string   `json:"user_email" validate:"email"`
+	Week      string   `json:"week" validate:"date"`
 	RecipeIDs []string `json:"recipe_ids"`
 }
 
-func createWeeklySelection(c *fiber.Ctx) error {
+func (h *handlers) createWeeklySelection(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req WeeklySelectionRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Parse week
 	week, err := time.Parse("2006-01-02", req.Week)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid week format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid week format")
 	}
 
 	// Validate subscription exists
 	subscription, err := db.GetSubscription(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "subscription not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "subscription not found")
 	}
 
 	// Validate recipe count matches subscription
 	if len(req.RecipeIDs) != subscription.MealPlan.MealsPerWeek {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "number of recipes must match meal plan",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "number of recipes must match meal plan")
 	}
 
 	// Validate recipes and build recipe list
 	var recipes []Recipe
 	for _, recipeID := range req.RecipeIDs {
-		recipe, exists := db.Recipes[recipeID]
+		recipe, exists := db.Recipes.Get(recipeID)
 		if !exists {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "recipe not found: " + recipeID,
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "recipe not found: "+recipeID)
 		}
 		recipes = append(recipes, recipe)
 	}
 
 	// Create weekly selection
 	selection := WeeklySelection{
-		ID:             uuid.New().String(),
+		ID:             server.NewID("WSEL"),
 		UserEmail:      req.UserEmail,
 		Week:           week,
 		Recipes:        recipes,
 		DeliveryStatus: "scheduled",
 		DeliveryDate:   calculateDeliveryDate(week, subscription.DeliveryDay),
-		CreatedAt:      time.Now(),
+		CreatedAt:      h.clock.Now(),
 	}
 
 	db.mu.Lock()
-	db.WeeklySelections[selection.ID] = selection
+	db.WeeklySelections.Upsert(selection.ID, selection)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(selection)
 }
 
-func getWeeklySelection(c *fiber.Ctx) error {
+func (h *handlers) getWeeklySelection(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	weekStr := c.Query("week")
 
 	if email == "" || weekStr == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email and week parameters are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email and week parameters are required")
 	}
 
 	week, err := time.Parse("2006-01-02", weekStr)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid week format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid week format")
 	}
 
 	selection, err := db.GetWeeklySelection(email, week)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(selection)
 }
 
 // Helper functions
-func calculateNextDelivery(deliveryDay string) time.Time {
-	now := time.Now()
+func calculateNextDelivery(deliveryDay string, now time.Time) time.Time {
 	weekday := parseWeekday(deliveryDay)
 	daysUntilDelivery := (int(weekday) - int(now.Weekday()) + 7) % 7
 	if daysUntilDelivery == 0 {
@@ -356,61 +335,69 @@ func parseWeekday(day string) time.Weekday {
 	return weekdays[day]
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		MealPlans:        make(map[string]MealPlan),
-		Recipes:          make(map[string]Recipe),
-		Subscriptions:    make(map[string]Subscription),
-		WeeklySelections: make(map[string]WeeklySelection),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/meal-plans", getMealPlans)
-	api.Get("/weekly-menu", getWeeklyMenu)
-	api.Get("/subscriptions", getSubscription)
-	api.Post("/subscriptions", createOrUpdateSubscription)
-	api.Post("/weekly-selections", createWeeklySelection)
-	api.Get("/weekly-selections", getWeeklySelection)
+	api.Get("/meal-plans", h.getMealPlans)
+	api.Get("/weekly-menu", h.getWeeklyMenu)
+	api.Get("/subscriptions", h.getSubscription)
+	api.Post("/subscriptions", h.createOrUpdateSubscription)
+	api.Post("/weekly-selections", h.createWeeklySelection)
+	api.Get("/weekly-selections", h.getWeeklySelection)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"subscriptions", "weekly_selections"},
+			Search:  []string{"recipes", "meal_plans"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,17 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -28,12 +26,12 @@ type Address struct {
 }
 
 type Room struct {
-	Type         string   `json:"type"`
-	Price        float64  `json:"price"`
-	Beds         string   `json:"beds"`
-	MaxOccupancy int      `json:"max_occupancy"`
-	Description  string   `json:"description"`
-	Amenities    []string `json:"amenities"`
+	Type         string      `json:"type"`
+	Price        money.Money `json:"price"`
+	Beds         string      `json:"beds"`
+	MaxOccupancy int         `json:"max_occupancy"`
+	Description  string      `json:"description"`
+	Amenities    []string    `json:"amenities"`
 }
 
 type Hotel struct {
@@ -65,7 +63,7 @@ type Booking struct {
 	CheckOut   time.Time     `json:"check_out"`
 	Guests     int           `json:"guests"`
 	Status     BookingStatus `json:"status"`
-	TotalPrice float64       `json:"total_price"`
+	TotalPrice money.Money   `json:"total_price"`
 	CreatedAt  time.Time     `json:"created_at"`
 	UpdatedAt  time.Time     `json:"updated_at"`
 }
@@ -98,14 +96,26 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Hotels   map[string]Hotel   `json:"hotels"`
-	Bookings map[string]Booking `json:"bookings"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]    `json:"users"`
+	Hotels   server.Repository[Hotel]   `json:"hotels"`
+	Bookings server.Repository[Booking] `json:"bookings"`
 	mu       sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers book Hilton stays, pricing nights and dating bookings by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the hotels, users and bookings in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Error definitions
 var (
@@ -120,7 +130,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -131,7 +141,7 @@ func (d *Database) GetHotel(id string) (Hotel, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	hotel, exists := d.Hotels[id]
+	hotel, exists := d.Hotels.Get(id)
 	if !exists {
 		return Hotel{}, ErrHotelNotFound
 	}
@@ -142,46 +152,50 @@ func (d *Database) CreateBooking(booking Booking) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Bookings[booking.ID] = booking
+	d.Bookings.Upsert(booking.ID, booking)
+	d.SendEmail(server.Email{
+		From:    "reservations@hilton.com",
+		To:      booking.UserEmail,
+		Subject: "Your reservation at " + booking.Hotel.Name + " is confirmed",
+		Body: fmt.Sprintf("Your %s reservation at %s is confirmed.\n\nConfirmation: %s\nCheck-in: %s\nCheck-out: %s\nGuests: %d\nTotal: %s\n",
+			booking.RoomType, booking.Hotel.Name, booking.ID, booking.CheckIn.Format("Mon, Jan 2, 2006"),
+			booking.CheckOut.Format("Mon, Jan 2, 2006"), booking.Guests, booking.TotalPrice.Format()),
+		Collection: "bookings",
+		EntityID:   booking.ID,
+		SentAt:     booking.CreatedAt,
+	})
 	return nil
 }
 
 // HTTP Handlers
-func searchHotels(c *fiber.Ctx) error {
+func (h *handlers) searchHotels(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	location := c.Query("location")
 	checkIn := c.Query("check_in")
 	checkOut := c.Query("check_out")
 	guests := c.QueryInt("guests", 1)
 
 	if location == "" || checkIn == "" || checkOut == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Missing required parameters",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Missing required parameters")
 	}
 
 	checkInDate, err := time.Parse("2006-01-02", checkIn)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid check-in date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid check-in date format")
 	}
 
 	checkOutDate, err := time.Parse("2006-01-02", checkOut)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid check-out date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid check-out date format")
 	}
 
 	if checkOutDate.Before(checkInDate) {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Check-out date must be after check-in date",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Check-out date must be after check-in date")
 	}
 
 	var availableHotels []Hotel
 	db.mu.RLock()
-	for _, hotel := range db.Hotels {
+	for _, hotel := range db.Hotels.List() {
 		// Simple location-based filtering (in real implementation, use proper geo-search)
 		if containsIgnoreCase(hotel.Address.City, location) ||
 			containsIgnoreCase(hotel.Address.State, location) ||
@@ -197,74 +211,64 @@ func searchHotels(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(availableHotels)
+	return server.List(c, availableHotels)
 }
 
-func getUserBookings(c *fiber.Ctx) error {
+func (h *handlers) getUserBookings(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	var userBookings []Booking
 	db.mu.RLock()
-	for _, booking := range db.Bookings {
+	for _, booking := range db.Bookings.List() {
 		if booking.UserEmail == email {
 			userBookings = append(userBookings, booking)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userBookings)
+	return server.List(c, userBookings)
 }
 
-func createBooking(c *fiber.Ctx) error {
+func (h *handlers) createBooking(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		HotelID   string `json:"hotel_id"`
 		RoomType  string `json:"room_type"`
-		CheckIn   string `json:"check_in"`
-		CheckOut  string `json:"check_out"`
-		Guests    int    `json:"guests"`
-		UserEmail string `json:"user_email"`
+		CheckIn   string `json:"check_in" validate:"date"`
+		CheckOut  string `json:"check_out" validate:"date"`
+		Guests    int    `json:"guests" validate:"gte=0"`
+		UserEmail string `json:"user_email" validate:"email"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Validate hotel
 	hotel, err := db.GetHotel(req.HotelID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Hotel not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Hotel not found")
 	}
 
 	// Validate dates
 	checkIn, err := time.Parse("2006-01-02", req.CheckIn)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid check-in date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid check-in date format")
 	}
 
 	checkOut, err := time.Parse("2006-01-02", req.CheckOut)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid check-out date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid check-out date format")
 	}
 
 	// Find requested room
@@ -277,18 +281,16 @@ func createBooking(c *fiber.Ctx) error {
 	}
 
 	if selectedRoom == nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "No suitable room available",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "No suitable room available")
 	}
 
 	// Calculate total price
 	nights := checkOut.Sub(checkIn).Hours() / 24
-	totalPrice := selectedRoom.Price * float64(nights)
+	totalPrice := selectedRoom.Price.Mul(nights)
 
 	// Create booking
 	booking := Booking{
-		ID:         uuid.New().String(),
+		ID:         server.NewID("BKG"),
 		UserEmail:  req.UserEmail,
 		Hotel:      hotel,
 		RoomType:   req.RoomType,
@@ -297,38 +299,33 @@ func createBooking(c *fiber.Ctx) error {
 		Guests:     req.Guests,
 		Status:     BookingStatusConfirmed,
 		TotalPrice: totalPrice,
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+		CreatedAt:  h.clock.Now(),
+		UpdatedAt:  h.clock.Now(),
 	}
 
 	// Save booking
 	if err := db.CreateBooking(booking); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create booking",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create booking")
 	}
 
 	// Update user's rewards
-	user.Rewards.Points += int(totalPrice)
+	user.Rewards.Points += int(totalPrice.Float())
 	user.Rewards.NightsThisYear += int(nights)
-	db.Users[user.Email] = user
+	db.Users.Upsert(user.Email, user)
 
 	return c.Status(fiber.StatusCreated).JSON(booking)
 }
 
-func getRewardsStatus(c *fiber.Ctx) error {
+func (h *handlers) getRewardsStatus(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	return c.JSON(user.Rewards)
@@ -339,72 +336,79 @@ func containsIgnoreCase(s, substr string) bool {
 	return strings.Contains(s, substr)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Hotels:   make(map[string]Hotel),
-		Bookings: make(map[string]Booking),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Hotel routes
-	api.Get("/hotels", searchHotels)
+	api.Get("/hotels", h.searchHotels)
 	api.Get("/hotels/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		hotel, err := db.GetHotel(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(hotel)
 	})
 
 	// Booking routes
-	api.Get("/bookings", getUserBookings)
-	api.Post("/bookings", createBooking)
+	api.Get("/bookings", h.getUserBookings)
+	api.Post("/bookings", h.createBooking)
 
 	// Rewards routes
-	api.Get("/rewards", getRewardsStatus)
+	api.Get("/rewards", h.getRewardsStatus)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"bookings"},
+			Search:  []string{"hotels", "bookings"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,57 +1,76 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/payments"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Models
 type Product struct {
-	ID            string    `json:"id"`
-	Name          string    `json:"name"`
-	Description   string    `json:"description"`
-	Category      string    `json:"category"`
-	Price         float64   `json:"price"`
-	SalePrice     *float64  `json:"sale_price,omitempty"`
-	InStock       bool      `json:"in_stock"`
-	StockQuantity int       `json:"stock_quantity"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID            string       `json:"id"`
+	Name          string       `json:"name"`
+	Description   string       `json:"description"`
+	Category      string       `json:"category"`
+	Price         money.Money  `json:"price"`
+	SalePrice     *money.Money `json:"sale_price,omitempty"`
+	InStock       bool         `json:"in_stock"`
+	StockQuantity int          `json:"stock_quantity"`
+	CreatedAt     time.Time    `json:"created_at"`
 }
 
 type CartItem struct {
 	ProductID string  `json:"product_id"`
 	Product   Product `json:"product"`
-	Quantity  int     `json:"quantity"`
-	UserEmail string  `json:"user_email"`
+	Quantity  int     `json:"quantity" validate:"gte=0"`
+	UserEmail string  `json:"user_email" validate:"email"`
 }
 
 type Cart struct {
-	Items    []CartItem `json:"items"`
-	Subtotal float64    `json:"subtotal"`
-	Total    float64    `json:"total"`
+	Items    []CartItem  `json:"items"`
+	Subtotal money.Money `json:"subtotal"`
+	Total    money.Money `json:"total"`
 }
 
 type Order struct {
-	ID              string     `json:"id"`
-	UserEmail       string     `json:"user_email"`
-	Items           []CartItem `json:"items"`
-	Status          string     `json:"status"`
-	Total           float64    `json:"total"`
-	ShippingAddress string     `json:"shipping_address"`
-	PaymentMethod   string     `json:"payment_method"`
-	CreatedAt       time.Time  `json:"created_at"`
+	ID              string                    `json:"id"`
+	UserEmail       string                    `json:"user_email"`
+	Items           []CartItem                `json:"items"`
+	Status          string                    `json:"status"`
+	StatusHistory   []statemachine.Transition `json:"status_history,omitempty"`
+	Total           money.Money               `json:"total"`
+	ShippingAddress string                    `json:"shipping_address"`
+	PaymentMethod   string                    `json:"payment_method"`
+	ChargeID        string                    `json:"charge_id,omitempty"` // The charge to the payment method
+	CreatedAt       time.Time                 `json:"created_at"`
 }
 
+// orderMachine is the statuses an order moves through.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	"pending":    {"processing"},
+	"processing": {"shipped"},
+	"shipped":    {"delivered"},
+}}
+
+// orderLifecycle processes orders, ships them the next day and delivers
+// them a few days later.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: "pending", To: "processing", After: 10 * time.Minute},
+	{From: "processing", To: "shipped", After: 24 * time.Hour,
+		Notify: server.Notice{Type: "order_shipped", Message: "Your order {{id}} has shipped."}},
+	{From: "shipped", To: "delivered", After: 72 * time.Hour,
+		Notify: server.Notice{Type: "order_delivered", Message: "Your order {{id}} was delivered."}},
+}, Machine: orderMachine}
+
 type User struct {
 	Email          string          `json:"email"`
 	Name           string          `json:"name"`
@@ -68,23 +87,61 @@ type PaymentMethod struct {
 	ExpiryYY int    `json:"expiry_yy"`
 }
 
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
+}
+
 // Database
 type Database struct {
-	Products map[string]Product    `json:"products"`
-	Carts    map[string][]CartItem `json:"carts"` // key: user_email
-	Orders   map[string]Order      `json:"orders"`
-	Users    map[string]User       `json:"users"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+
+	Products server.Repository[Product]    `json:"products"`
+	Carts    server.Repository[[]CartItem] `json:"carts"` // key: user_email
+	Orders   server.Repository[Order]      `json:"orders"`
+	Users    server.Repository[User]       `json:"users"`
 	mu       sync.RWMutex
 }
 
-var db *Database
+// handlers sell Hobby Lobby's craft supplies through carts and orders, dated
+// by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the products, carts and orders in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+// taxRate is the sales tax, which --tax-rate overrides.
+var taxRate = 0.08
+
+// subtotal adds up a cart at its items' sale prices, where they have one.
+func subtotal(items []CartItem) (money.Money, error) {
+	var total money.Money
+	for _, item := range items {
+		price := item.Product.Price
+		if item.Product.SalePrice != nil {
+			price = *item.Product.SalePrice
+		}
+		var err error
+		if total, err = total.Add(price.Times(item.Quantity)); err != nil {
+			return money.Money{}, err
+		}
+	}
+	return total, nil
+}
 
 // Database operations
 func (d *Database) GetProduct(id string) (Product, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	if product, exists := d.Products[id]; exists {
+	if product, exists := d.Products.Get(id); exists {
 		return product, nil
 	}
 	return Product{}, fmt.Errorf("product not found")
@@ -94,281 +151,324 @@ func (d *Database) GetUserCart(email string) []CartItem {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	return d.Carts[email]
+	cart, _ := d.Carts.Get(email)
+	return cart
 }
 
+// GetPaymentMethod returns the user's payment method with the ID id.
+func (d *Database) GetPaymentMethod(email, id string) (PaymentMethod, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	user, _ := d.Users.Get(email)
+	for _, pm := range user.PaymentMethods {
+		if pm.ID == id {
+			return pm, true
+		}
+	}
+	return PaymentMethod{}, false
+}
+
+// ErrOutOfStock is returned for more of a product than is in stock.
+var ErrOutOfStock = server.NewError(server.CodeOutOfStock, "out of stock")
+
 func (d *Database) AddToCart(email string, item CartItem) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	// Validate product exists and is in stock
-	product, exists := d.Products[item.ProductID]
+	product, exists := d.Products.Get(item.ProductID)
 	if !exists {
 		return fmt.Errorf("product not found")
 	}
 
 	if !product.InStock || product.StockQuantity < item.Quantity {
-		return fmt.Errorf("product out of stock")
+		return fmt.Errorf("product %w", ErrOutOfStock)
 	}
 
 	// Add to cart
-	currentCart := d.Carts[email]
+	currentCart, _ := d.Carts.Get(email)
 
 	// Check if product already in cart
 	for i, cartItem := range currentCart {
 		if cartItem.ProductID == item.ProductID {
 			currentCart[i].Quantity += item.Quantity
-			d.Carts[email] = currentCart
+			d.Carts.Upsert(email, currentCart)
 			return nil
 		}
 	}
 
 	// Add new item
 	item.Product = product
-	d.Carts[email] = append(currentCart, item)
+	d.Carts.Upsert(email, append(currentCart, item))
 	return nil
 }
 
+// SellOut marks a product out of stock.
+func (d *Database) SellOut(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Products.Update(id, func(product *Product) {
+		product.StockQuantity = 0
+		product.InStock = false
+	})
+}
+
 func (d *Database) CreateOrder(order Order) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	// Validate all products and update stock
 	for _, item := range order.Items {
-		product, exists := d.Products[item.ProductID]
+		product, exists := d.Products.Get(item.ProductID)
 		if !exists {
 			return fmt.Errorf("product %s not found", item.ProductID)
 		}
 
 		if !product.InStock || product.StockQuantity < item.Quantity {
-			return fmt.Errorf("product %s out of stock", item.ProductID)
+			return fmt.Errorf("product %s %w", item.ProductID, ErrOutOfStock)
 		}
 
 		// Update stock
 		product.StockQuantity -= item.Quantity
 		product.InStock = product.StockQuantity > 0
-		d.Products[item.ProductID] = product
+		d.Products.Upsert(item.ProductID, product)
 	}
 
 	// Save order
-	d.Orders[order.ID] = order
+	d.Orders.Upsert(order.ID, order)
 
 	// Clear user's cart
-	delete(d.Carts, order.UserEmail)
+	d.Carts.Delete(order.UserEmail)
 
 	return nil
 }
 
 // Handlers
-func getProducts(c *fiber.Ctx) error {
+func (h *handlers) getProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	search := strings.ToLower(c.Query("search"))
 	onSale := c.QueryBool("onSale")
 
-	var products []Product
-
 	db.mu.RLock()
-	for _, product := range db.Products {
-		// Apply filters
-		if category != "" && product.Category != category {
-			continue
-		}
-
-		if search != "" && !strings.Contains(strings.ToLower(product.Name), search) {
-			continue
-		}
-
-		if onSale && product.SalePrice == nil {
-			continue
-		}
-
-		products = append(products, product)
-	}
+	products := db.Products.Query(func(product Product) bool {
+		return (category == "" || product.Category == category) &&
+			(search == "" || strings.Contains(strings.ToLower(product.Name), search)) &&
+			(!onSale || product.SalePrice != nil)
+	})
 	db.mu.RUnlock()
 
-	return c.JSON(products)
+	return server.List(c, products, "category")
 }
 
-func getCart(c *fiber.Ctx) error {
+func (h *handlers) getCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	items := db.GetUserCart(email)
 
 	// Calculate totals
-	var subtotal float64
-	for _, item := range items {
-		price := item.Product.Price
-		if item.Product.SalePrice != nil {
-			price = *item.Product.SalePrice
-		}
-		subtotal += price * float64(item.Quantity)
+	sub, err := subtotal(items)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
 	}
 
 	cart := Cart{
 		Items:    items,
-		Subtotal: subtotal,
-		Total:    subtotal * 1.08, // Adding 8% tax
+		Subtotal: sub,
+		Total:    sub.Mul(1 + taxRate),
 	}
 
 	return c.JSON(cart)
 }
 
-func addToCart(c *fiber.Ctx) error {
+func (h *handlers) addToCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var item CartItem
-	if err := c.BodyParser(&item); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &item); err != nil {
+		return err
 	}
 
 	if err := db.AddToCart(item.UserEmail, item); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusBadRequest, err)
 	}
 
 	return c.SendStatus(fiber.StatusCreated)
 }
 
-func getOrders(c *fiber.Ctx) error {
+func (h *handlers) getOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
-	var orders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
-		if order.UserEmail == email {
-			orders = append(orders, order)
-		}
-	}
+	orders := db.Orders.By("user_email", email)
 	db.mu.RUnlock()
 
-	return c.JSON(orders)
+	return server.List(c, orders)
 }
 
-func createOrder(c *fiber.Ctx) error {
+func (h *handlers) createOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		UserEmail       string `json:"user_email"`
+		UserEmail       string `json:"user_email" validate:"email"`
 		ShippingAddress string `json:"shipping_address"`
 		PaymentMethod   string `json:"payment_method"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Get user's cart
 	items := db.GetUserCart(req.UserEmail)
 	if len(items) == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Cart is empty",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Cart is empty")
+	}
+	method, ok := db.GetPaymentMethod(req.UserEmail, req.PaymentMethod)
+	if !ok {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
+	}
+	// In chaos mode, an item may sell out while the customer checks out;
+	// CreateOrder then turns the order down.
+	if server.Chaos(c, server.ChaosOutOfStock) {
+		db.SellOut(items[0].ProductID)
 	}
 
 	// Calculate total
-	var total float64
-	for _, item := range items {
-		price := item.Product.Price
-		if item.Product.SalePrice != nil {
-			price = *item.Product.SalePrice
-		}
-		total += price * float64(item.Quantity)
+	sub, err := subtotal(items)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	}
+	total := sub.Mul(1 + taxRate)
+	id := server.NewID("ORD")
+
+	// Hold the total on the card while the order is placed, and take it
+	// once it is
+	db.mu.Lock()
+	charge, err := db.Authorize(c, server.ChargeRequest{
+		UserEmail:       req.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          total,
+		Description:     "Order " + id,
+	})
+	db.mu.Unlock()
+	if err != nil {
+		return err
 	}
-	total *= 1.08 // Add 8% tax
 
 	order := Order{
-		ID:              uuid.New().String(),
+		ID:              id,
 		UserEmail:       req.UserEmail,
 		Items:           items,
 		Status:          "pending",
 		Total:           total,
 		ShippingAddress: req.ShippingAddress,
 		PaymentMethod:   req.PaymentMethod,
-		CreatedAt:       time.Now(),
+		ChargeID:        charge.ID,
+		CreatedAt:       h.clock.Now(),
 	}
 
-	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	err = db.CreateOrder(order)
+	db.mu.Lock()
+	if err != nil {
+		db.Void(charge.ID)
+	} else {
+		db.Capture(charge.ID, money.Money{})
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return server.FailWith(c, fiber.StatusBadRequest, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Products: make(map[string]Product),
-		Carts:    make(map[string][]CartItem),
-		Orders:   make(map[string]Order),
-		Users:    make(map[string]User),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Product routes
-	api.Get("/products", getProducts)
+	api.Get("/products", h.getProducts)
 	api.Get("/products/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		product, err := db.GetProduct(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(product)
 	})
 
 	// Cart routes
-	api.Get("/cart", getCart)
-	api.Post("/cart", addToCart)
+	api.Get("/cart", h.getCart)
+	api.Post("/cart", h.addToCart)
 
 	// Order routes
-	api.Get("/orders", getOrders)
-	api.Post("/orders", createOrder)
+	api.Get("/orders", h.getOrders)
+	api.Post("/orders", h.createOrder)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	taxRate = cfg.TaxRate(taxRate)
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Fatal(app.Listen(":3000"))
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders"},
+			Search:  []string{"products", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+		server.WithChaos(cfg),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
+		log.Fatal(err)
+	}
 }
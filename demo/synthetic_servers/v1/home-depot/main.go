@@ -1,20 +1,23 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/availability"
+	"pkg/geo"
+	"pkg/geocode"
+	"pkg/money"
+	"pkg/payments"
+	"pkg/pricing"
+	"pkg/promotions"
+	"pkg/search"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -27,6 +30,24 @@ type Address struct {
 	Longitude float64 `json:"longitude"`
 }
 
+// verify normalizes the address and checks its zip code, placing it at the
+// zip code's centroid if it has no coordinates of its own.
+func (a Address) verify() (Address, error) {
+	verified, place, err := geocode.Verify(geocode.Address{Street: a.Street, City: a.City, State: a.State, Zip: a.ZipCode})
+	if err != nil {
+		return a, err
+	}
+	a.Street, a.City, a.State, a.ZipCode = verified.Street, verified.City, verified.State, verified.Zip
+	if a.Latitude == 0 && a.Longitude == 0 {
+		a.Latitude, a.Longitude = place.Lat, place.Lon
+	}
+	return a, nil
+}
+
+func (a Address) point() geo.Point {
+	return geo.Point{Lat: a.Latitude, Lon: a.Longitude}
+}
+
 type Store struct {
 	ID      string  `json:"id"`
 	Name    string  `json:"name"`
@@ -36,11 +57,22 @@ type Store struct {
 	IsOpen  bool    `json:"is_open"`
 }
 
+// deliverySchedule is the windows the store delivers in, where it keeps
+// time.
+func (s Store) deliverySchedule() availability.Schedule {
+	return availability.Schedule{
+		Rules:    deliveryWindows,
+		Length:   deliveryWindowLength,
+		Capacity: deliveryCapacity,
+		Location: geo.Location(geo.ZoneAt(s.Address.point())),
+	}
+}
+
 type Product struct {
 	ID          string         `json:"id"`
 	Name        string         `json:"name"`
 	Description string         `json:"description"`
-	Price       float64        `json:"price"`
+	Price       money.Money    `json:"price"`
 	Category    string         `json:"category"`
 	Brand       string         `json:"brand"`
 	SKU         string         `json:"sku"`
@@ -49,25 +81,48 @@ type Product struct {
 }
 
 type User struct {
-	Email     string  `json:"email"`
-	Name      string  `json:"name"`
-	Phone     string  `json:"phone"`
-	Address   Address `json:"address"`
-	ProMember bool    `json:"pro_member"`
+	Email          string          `json:"email"`
+	Name           string          `json:"name"`
+	Phone          string          `json:"phone"`
+	Address        Address         `json:"address"`
+	ProMember      bool            `json:"pro_member"`
+	PaymentMethods []PaymentMethod `json:"payment_methods"`
+}
+
+// paymentMethod returns the user's payment method with the ID id.
+func (u User) paymentMethod(id string) (PaymentMethod, bool) {
+	for _, pm := range u.PaymentMethods {
+		if pm.ID == id {
+			return pm, true
+		}
+	}
+	return PaymentMethod{}, false
+}
+
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Last4    string `json:"last4"`
+	ExpiryMM int    `json:"expiry_mm"`
+	ExpiryYY int    `json:"expiry_yy"`
+}
+
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
 }
 
 type CartItem struct {
-	ProductID string  `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ProductID string      `json:"product_id"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Money `json:"price"`
 }
 
 type Cart struct {
-	UserEmail string     `json:"user_email"`
-	Items     []CartItem `json:"items"`
-	StoreID   string     `json:"store_id"`
-	Total     float64    `json:"total"`
-	UpdatedAt time.Time  `json:"updated_at"`
+	UserEmail string      `json:"user_email"`
+	Items     []CartItem  `json:"items"`
+	StoreID   string      `json:"store_id"`
+	Total     money.Money `json:"total"`
+	UpdatedAt time.Time   `json:"updated_at"`
 }
 
 type OrderStatus string
@@ -80,6 +135,24 @@ const (
 	OrderStatusCancelled OrderStatus = "cancelled"
 )
 
+// orderMachine is the statuses an order moves through. It can be
+// cancelled until it is ready.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	string(OrderStatusPending):   {string(OrderStatusConfirmed), string(OrderStatusCancelled)},
+	string(OrderStatusConfirmed): {string(OrderStatusReady), string(OrderStatusCancelled)},
+	string(OrderStatusReady):     {string(OrderStatusCompleted)},
+}}
+
+// orderLifecycle confirms orders, which Stepped takes payment for, has
+// them ready for pickup a few hours later and completes them once
+// collected.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: string(OrderStatusPending), To: string(OrderStatusConfirmed), After: 10 * time.Minute},
+	{From: string(OrderStatusConfirmed), To: string(OrderStatusReady), After: 4 * time.Hour,
+		Notify: server.Notice{Type: "order_ready", Message: "Your order {{id}} is ready for pickup.", Text: "delivery_update"}},
+	{From: string(OrderStatusReady), To: string(OrderStatusCompleted), After: 48 * time.Hour},
+}, Sender: "The Home Depot", Machine: orderMachine}
+
 type DeliveryMethod string
 
 const (
@@ -87,39 +160,138 @@ const (
 	DeliveryMethodDelivery DeliveryMethod = "delivery"
 )
 
+// DeliveryHold is a store's delivery window held for a user while they
+// check out, until ExpiresAt, or, once their order takes it, booked for
+// the order.
+type DeliveryHold struct {
+	ID        string     `json:"id"`
+	UserEmail string     `json:"user_email"`
+	StoreID   string     `json:"store_id"`
+	Start     time.Time  `json:"start"`
+	End       time.Time  `json:"end"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Nil once an order takes it
+	OrderID   string     `json:"order_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// reservation is the room h takes in its store's delivery window.
+func (h DeliveryHold) reservation() availability.Reservation {
+	return availability.Reservation{
+		ID:       h.ID,
+		Resource: h.StoreID,
+		Party:    h.UserEmail,
+		Start:    h.Start,
+		End:      h.End,
+		Expires:  h.ExpiresAt,
+	}
+}
+
 type Order struct {
-	ID             string         `json:"id"`
-	UserEmail      string         `json:"user_email"`
-	Items          []CartItem     `json:"items"`
-	Status         OrderStatus    `json:"status"`
-	StoreID        string         `json:"store_id"`
-	DeliveryMethod DeliveryMethod `json:"delivery_method"`
-	Subtotal       float64        `json:"subtotal"`
-	Tax            float64        `json:"tax"`
-	Total          float64        `json:"total"`
-	CreatedAt      time.Time      `json:"created_at"`
-	UpdatedAt      time.Time      `json:"updated_at"`
+	ID              string                    `json:"id"`
+	UserEmail       string                    `json:"user_email"`
+	Items           []CartItem                `json:"items"`
+	Status          OrderStatus               `json:"status"`
+	StatusHistory   []statemachine.Transition `json:"status_history,omitempty"`
+	StoreID         string                    `json:"store_id"`
+	DeliveryMethod  DeliveryMethod            `json:"delivery_method"`
+	DeliveryAddress *Address                  `json:"delivery_address,omitempty"`
+	// DeliveryWindow is when a delivery comes, if the user held one with
+	// DeliveryHoldID.
+	DeliveryWindow *availability.Slot `json:"delivery_window,omitempty"`
+	DeliveryHoldID string             `json:"delivery_hold_id,omitempty"`
+	Subtotal       money.Money        `json:"subtotal"`
+	PromoCodes     []string           `json:"promo_codes,omitempty"`
+	Discount       money.Money        `json:"discount"` // Taken off by promo codes
+	Tax            money.Money        `json:"tax"`
+	Total          money.Money        `json:"total"`
+	// PaymentMethodID is the card the total is charged to, by ChargeID.
+	PaymentMethodID string    `json:"payment_method_id,omitempty"`
+	ChargeID        string    `json:"charge_id,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Products map[string]Product `json:"products"`
-	Stores   map[string]Store   `json:"stores"`
-	Carts    map[string]Cart    `json:"carts"`
-	Orders   map[string]Order   `json:"orders"`
-	mu       sync.RWMutex
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+	server.Promotions
+
+	Users    server.Repository[User]    `json:"users"`
+	Products server.Repository[Product] `json:"products"`
+	Stores   server.Repository[Store]   `json:"stores"`
+	Carts    server.Repository[Cart]    `json:"carts"`
+	Orders   server.Repository[Order]   `json:"orders"`
+	// DeliveryHolds are the delivery windows users hold, and their orders
+	// have booked.
+	DeliveryHolds server.Repository[DeliveryHold] `json:"delivery_holds"`
+	// ProductIndex is the products' text, for ?query. It is exported, if
+	// not saved, so that each sandbox's copy of the database has its own.
+	ProductIndex *search.Index `json:"-"`
+	// StoreIndex is where the stores are, for finding nearby ones.
+	StoreIndex *geo.Index `json:"-"`
+	mu         sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// PhoneNumber returns the user's phone number, for texts. Callers must hold
+// d.mu.
+func (d *Database) PhoneNumber(email string) string {
+	user, _ := d.Users.Get(email)
+	return user.Phone
+}
+
+// handlers sell The Home Depot's products for pickup or delivery, with clock
+// for carts, orders and delivery holds.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the database in store and indexes its products and
+// stores.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+// Orders are taxed at the statewide rate of the state they are filled in,
+// or taxRate where that isn't known. --tax-rate sets a rate for everywhere
+// instead.
+var (
+	taxRate    = 0.0825
+	taxByState = true
+)
+
+// deliveryRadiusMiles is how far from a store it delivers, which --rules
+// delivery_radius_miles=... overrides.
+var deliveryRadiusMiles = 30.0
+
+// Stores deliver in two-hour windows from 8am to 8pm every day, each of
+// which takes deliveryCapacity orders, which --rules
+// delivery_window_capacity=... overrides. A window held at checkout is
+// kept for deliveryHoldTime.
+var (
+	deliveryWindows = []availability.Rule{
+		{Days: []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}, Start: "08:00", End: "20:00"},
+	}
+	deliveryWindowLength = 2 * time.Hour
+	deliveryCapacity     = 4
+	deliveryHoldTime     = 15 * time.Minute
+)
+
+var (
+	ErrHoldNotFound    = errors.New("delivery hold not found")
+	ErrHoldUsed        = errors.New("the delivery window is already booked for an order")
+	ErrPaymentNotFound = errors.New("invalid payment method")
+)
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -130,7 +302,7 @@ func (d *Database) GetProduct(id string) (Product, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	product, exists := d.Products[id]
+	product, exists := d.Products.Get(id)
 	if !exists {
 		return Product{}, errors.New("product not found")
 	}
@@ -141,7 +313,7 @@ func (d *Database) GetStore(id string) (Store, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	store, exists := d.Stores[id]
+	store, exists := d.Stores.Get(id)
 	if !exists {
 		return Store{}, errors.New("store not found")
 	}
@@ -152,7 +324,7 @@ func (d *Database) GetCart(userEmail string) (Cart, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	cart, exists := d.Carts[userEmail]
+	cart, exists := d.Carts.Get(userEmail)
 	if !exists {
 		return Cart{}, errors.New("cart not found")
 	}
@@ -163,32 +335,216 @@ func (d *Database) UpdateCart(cart Cart) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Carts[cart.UserEmail] = cart
+	d.Carts.Upsert(cart.UserEmail, cart)
+	return nil
+}
+
+// deliveryReservations are the room taken in the store's delivery
+// windows. Callers must hold d.mu.
+func (d *Database) deliveryReservations(storeID string) []availability.Reservation {
+	var reservations []availability.Reservation
+	for _, hold := range d.DeliveryHolds.By("store_id", storeID) {
+		reservations = append(reservations, hold.reservation())
+	}
+	return reservations
+}
+
+// DeliveryWindows lists the store's delivery windows with room left over
+// the given number of days starting at from.
+func (d *Database) DeliveryWindows(store Store, from time.Time, days int, now time.Time) []availability.Opening {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return store.deliverySchedule().Open(store.ID, from, days, d.deliveryReservations(store.ID), now)
+}
+
+// HoldDeliveryWindow holds the store's delivery window starting at start
+// for the user while they check out. Holds of the store's that have lapsed
+// are cleared.
+func (d *Database) HoldDeliveryWindow(store Store, email string, start, now time.Time) (DeliveryHold, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, hold := range d.DeliveryHolds.By("store_id", store.ID) {
+		if hold.reservation().Lapsed(now) {
+			d.DeliveryHolds.Delete(hold.ID)
+		}
+	}
+	schedule := store.deliverySchedule()
+	window, ok := schedule.Offers(start)
+	if !ok {
+		return DeliveryHold{}, availability.ErrUnavailable
+	}
+	hold := DeliveryHold{
+		ID:        server.NewID("HOLD"),
+		UserEmail: email,
+		StoreID:   store.ID,
+		Start:     window.Start,
+		End:       window.End,
+		CreatedAt: now,
+	}
+	held, err := schedule.Hold(hold.reservation(), d.deliveryReservations(store.ID), deliveryHoldTime, now)
+	if err != nil {
+		return DeliveryHold{}, err
+	}
+	hold.ExpiresAt = held.Expires
+	d.DeliveryHolds.Upsert(hold.ID, hold)
+	return hold, nil
+}
+
+// ReleaseDeliveryHold gives up the user's hold on a delivery window
+// before it lapses.
+func (d *Database) ReleaseDeliveryHold(id, email string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hold, exists := d.DeliveryHolds.Get(id)
+	if !exists || hold.UserEmail != email {
+		return ErrHoldNotFound
+	}
+	if hold.OrderID != "" {
+		return ErrHoldUsed
+	}
+	d.DeliveryHolds.Delete(id)
 	return nil
 }
 
-func (d *Database) CreateOrder(order Order) error {
+// CreateOrder prices order, for lines filled in state, less promoCodes,
+// and saves it, booking the delivery window it holds, if any. A code that
+// can't be used fails it with a *server.ValidationError, and a hold that
+// isn't the user's for the store with ErrHoldNotFound, ErrHoldUsed or
+// availability.ErrLapsed. The total is held on the order's payment method
+// through pay until the order is confirmed.
+func (d *Database) CreateOrder(order *Order, lines []pricing.Line, state string, promoCodes []string, pay server.Charger) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Orders[order.ID] = order
+	var hold DeliveryHold
+	if order.DeliveryHoldID != "" {
+		var exists bool
+		hold, exists = d.DeliveryHolds.Get(order.DeliveryHoldID)
+		switch {
+		case !exists || hold.UserEmail != order.UserEmail || hold.StoreID != order.StoreID:
+			return ErrHoldNotFound
+		case hold.OrderID != "":
+			return ErrHoldUsed
+		case hold.reservation().Lapsed(order.CreatedAt):
+			return availability.ErrLapsed
+		}
+	}
+
+	unpriced, err := pricing.Price(money.USD, lines)
+	if err != nil {
+		return err
+	}
+	discounts, err := d.Discounts(promoCodes, promotions.Order{UserEmail: order.UserEmail, Subtotal: unpriced.Subtotal})
+	if err != nil {
+		return err
+	}
+	quote, err := priceLines(lines, state, discounts...)
+	if err != nil {
+		return err
+	}
+	order.Subtotal, order.Discount, order.Tax, order.Total = quote.Subtotal, quote.Discount, quote.Tax, quote.Total
+
+	user, _ := d.Users.Get(order.UserEmail)
+	method, ok := user.paymentMethod(order.PaymentMethodID)
+	if !ok {
+		return ErrPaymentNotFound
+	}
+	charge, err := pay(server.ChargeRequest{
+		UserEmail:       order.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          order.Total,
+		Description:     "Order " + order.ID,
+	})
+	if err != nil {
+		return err
+	}
+	order.ChargeID = charge.ID
+
+	if hold.ID != "" {
+		hold.ExpiresAt, hold.OrderID = nil, order.ID
+		d.DeliveryHolds.Upsert(hold.ID, hold)
+		order.DeliveryWindow = &availability.Slot{Start: hold.Start, End: hold.End}
+	}
+	for _, r := range d.Redeem(promoCodes, order.UserEmail, order.ID, quote) {
+		order.PromoCodes = append(order.PromoCodes, r.Code)
+	}
+	d.Orders.Upsert(order.ID, *order)
 	return nil
 }
 
+// Stepped takes the payment held for an order once it is confirmed, and
+// releases or refunds it if the order is cancelled. Orders from before
+// charges were kept have none. Callers must hold d.mu for writing.
+func (d *Database) Stepped(collection, key, from, to string) {
+	order, ok := d.Orders.Get(key)
+	if collection != "orders" || !ok || order.ChargeID == "" {
+		return
+	}
+	switch OrderStatus(to) {
+	case OrderStatusConfirmed:
+		d.Capture(order.ChargeID, money.Money{})
+	case OrderStatusCancelled:
+		if charge, _ := d.Charges.Get(order.ChargeID); charge.Status == payments.StatusAuthorized {
+			d.Void(order.ChargeID)
+		} else {
+			d.Refund(order.ChargeID, money.Money{})
+		}
+	}
+}
+
 // HTTP Handlers
-func searchProducts(c *fiber.Ctx) error {
+// productIndex returns the index of products' text, making it for a
+// database that hasn't one, such as a new sandbox's copy.
+func (d *Database) productIndex() *search.Index {
+	d.mu.RLock()
+	index := d.ProductIndex
+	d.mu.RUnlock()
+	if index != nil {
+		return index
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ProductIndex == nil {
+		d.ProductIndex = indexProducts(&d.Products)
+	}
+	return d.ProductIndex
+}
+
+func indexProducts(products *server.Repository[Product]) *search.Index {
+	index := search.New()
+	for _, id := range products.Keys() {
+		product, _ := products.Get(id)
+		index.Add(id, search.Field{Text: product.Name, Weight: 2}, search.Field{Text: product.Description, Weight: 1})
+	}
+	return index
+}
+
+func (h *handlers) searchProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	query := c.Query("query")
 	category := c.Query("category")
 	storeID := c.Query("store_id")
 
+	var ids []string
+	if query != "" {
+		ids = search.IDs(db.productIndex().Search(query))
+	}
 	var products []Product
 
 	db.mu.RLock()
-	for _, product := range db.Products {
-		// Apply filters
-		if query != "" && !contains(product.Name, query) && !contains(product.Description, query) {
+	if query == "" {
+		ids = db.Products.Keys()
+	}
+	for _, id := range ids {
+		product, ok := db.Products.Get(id)
+		if !ok {
 			continue
 		}
+		// Apply filters
 		if category != "" && product.Category != category {
 			continue
 		}
@@ -201,90 +557,102 @@ func searchProducts(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(products)
+	return server.List(c, products, "category")
 }
 
-func getNearbyStores(c *fiber.Ctx) error {
+// storeIndex returns the index of stores' locations, making it for a
+// database that hasn't one, such as a new sandbox's copy.
+func (d *Database) storeIndex() *geo.Index {
+	d.mu.RLock()
+	index := d.StoreIndex
+	d.mu.RUnlock()
+	if index != nil {
+		return index
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.StoreIndex == nil {
+		d.StoreIndex = indexStores(&d.Stores)
+	}
+	return d.StoreIndex
+}
+
+func indexStores(stores *server.Repository[Store]) *geo.Index {
+	index := geo.NewIndex()
+	for _, id := range stores.Keys() {
+		store, _ := stores.Get(id)
+		index.Add(id, geo.Point{Lat: store.Address.Latitude, Lon: store.Address.Longitude})
+	}
+	return index
+}
+
+func (h *handlers) getNearbyStores(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	lat := c.QueryFloat("latitude", 0)
 	lon := c.QueryFloat("longitude", 0)
 
 	if lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "latitude and longitude are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "latitude and longitude are required")
 	}
+	radius := c.QueryFloat("radius_km", 50)
 
+	// Nearest first
+	nearby := db.storeIndex().Within(geo.Point{Lat: lat, Lon: lon}, radius)
 	var nearbyStores []Store
-	maxDistance := 50.0 // Maximum radius in km
-
 	db.mu.RLock()
-	for _, store := range db.Stores {
-		distance := calculateDistance(lat, lon,
-			store.Address.Latitude,
-			store.Address.Longitude)
-
-		if distance <= maxDistance {
+	for _, near := range nearby {
+		if store, ok := db.Stores.Get(near.ID); ok {
 			nearbyStores = append(nearbyStores, store)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(nearbyStores)
+	return server.List(c, nearbyStores)
 }
 
-func getUserCart(c *fiber.Ctx) error {
+func (h *handlers) getUserCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	cart, err := db.GetCart(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(cart)
 }
 
 type AddToCartRequest struct {
-	UserEmail string `json:"user_email"`
+	UserEmail string `json:"user_email" validate:"email"`
 	ProductID string `json:"product_id"`
-	Quantity  int    `json:"quantity"`
+	Quantity  int    `json:"quantity" validate:"gte=0"`
 	StoreID   string `json:"store_id"`
 }
 
-func addToCart(c *fiber.Ctx) error {
+func (h *handlers) addToCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req AddToCartRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	if _, err := db.GetUser(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Validate product
 	product, err := db.GetProduct(req.ProductID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Product not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Product not found")
 	}
 
 	// Check inventory
 	if quantity, exists := product.Inventory[req.StoreID]; !exists || quantity < req.Quantity {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Insufficient inventory",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeOutOfStock, "Insufficient inventory")
 	}
 
 	// Get or create cart
@@ -294,15 +662,13 @@ func addToCart(c *fiber.Ctx) error {
 			UserEmail: req.UserEmail,
 			StoreID:   req.StoreID,
 			Items:     []CartItem{},
-			UpdatedAt: time.Now(),
+			UpdatedAt: h.clock.Now(),
 		}
 	}
 
 	// Validate store consistency
 	if cart.StoreID != "" && cart.StoreID != req.StoreID {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Items must be from the same store",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Items must be from the same store")
 	}
 
 	// Add or update item
@@ -324,200 +690,331 @@ func addToCart(c *fiber.Ctx) error {
 	}
 
 	// Update cart total
-	var total float64
-	for _, item := range cart.Items {
-		product, _ := db.GetProduct(item.ProductID)
-		total += product.Price * float64(item.Quantity)
+	quote, err := priceLines(db.cartLines(cart.Items), "")
+	if err != nil {
+		return err
 	}
-	cart.Total = total
-	cart.UpdatedAt = time.Now()
+	cart.Total = quote.Subtotal
+	cart.UpdatedAt = h.clock.Now()
 
 	// Save cart
 	if err := db.UpdateCart(cart); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update cart",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update cart")
 	}
 
 	return c.JSON(cart)
 }
 
 type CreateOrderRequest struct {
-	UserEmail      string         `json:"user_email"`
-	DeliveryMethod DeliveryMethod `json:"delivery_method"`
+	UserEmail      string         `json:"user_email" validate:"required,email"`
+	DeliveryMethod DeliveryMethod `json:"delivery_method" validate:"required,oneof=pickup delivery"`
+	// DeliveryAddress is where to deliver to, for delivery; the user's
+	// address if not given.
+	DeliveryAddress *Address `json:"delivery_address"`
+	// DeliveryHoldID is the delivery window held for a delivery, if any.
+	DeliveryHoldID string `json:"delivery_hold_id"`
+	// PromoCodes are taken off the order before tax.
+	PromoCodes      []string `json:"promo_codes"`
+	PaymentMethodID string   `json:"payment_method_id"`
 }
 
-func createOrder(c *fiber.Ctx) error {
+func (h *handlers) createOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateOrderRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Get user's cart
 	cart, err := db.GetCart(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Cart not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Cart not found")
 	}
 
 	if len(cart.Items) == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Cart is empty",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Cart is empty")
 	}
 
-	// Calculate totals
-	subtotal := cart.Total
-	tax := subtotal * 0.0825 // 8.25% tax rate
-	total := subtotal + tax
+	// Deliveries go to an address we can place, near enough the store
+	var deliveryAddress *Address
+	if req.DeliveryMethod == DeliveryMethodDelivery {
+		address := req.DeliveryAddress
+		if address == nil {
+			user, err := db.GetUser(req.UserEmail)
+			if err != nil {
+				return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
+			}
+			address = &user.Address
+		}
+		verified, err := address.verify()
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "delivery_address: "+err.Error())
+		}
+		store, err := db.GetStore(cart.StoreID)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Select a store to deliver from")
+		}
+		if geo.DistanceMiles(store.Address.point(), verified.point()) > deliveryRadiusMiles {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, store.Name+" doesn't deliver to "+verified.City+", "+verified.State+" "+verified.ZipCode)
+		}
+		deliveryAddress = &verified
+	} else if req.DeliveryHoldID != "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "delivery_hold_id is only for deliveries")
+	}
+
+	// Orders are taxed where they are delivered or picked up
+	state := ""
+	if deliveryAddress != nil {
+		state = deliveryAddress.State
+	} else if store, err := db.GetStore(cart.StoreID); err == nil {
+		state = store.Address.State
+	}
 
 	// Create order
 	order := Order{
-		ID:             uuid.New().String(),
-		UserEmail:      req.UserEmail,
-		Items:          cart.Items,
-		Status:         OrderStatusPending,
-		StoreID:        cart.StoreID,
-		DeliveryMethod: req.DeliveryMethod,
-		Subtotal:       subtotal,
-		Tax:            tax,
-		Total:          total,
-		CreatedAt:      time.Now(),
-		UpdatedAt:      time.Now(),
-	}
-
-	// Save order
-	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+		ID:              server.NewID("ORD"),
+		UserEmail:       req.UserEmail,
+		Items:           cart.Items,
+		Status:          OrderStatusPending,
+		StoreID:         cart.StoreID,
+		DeliveryMethod:  req.DeliveryMethod,
+		DeliveryAddress: deliveryAddress,
+		DeliveryHoldID:  req.DeliveryHoldID,
+		PaymentMethodID: req.PaymentMethodID,
+		CreatedAt:       h.clock.Now(),
+		UpdatedAt:       h.clock.Now(),
+	}
+
+	// Price and save order, with its promo codes taken off
+	switch err := db.CreateOrder(&order, db.cartLines(cart.Items), state, req.PromoCodes, db.Charger(c)); err {
+	case nil:
+	case ErrPaymentNotFound:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	case ErrHoldNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrHoldUsed, availability.ErrLapsed:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	default:
+		return err
 	}
 
 	// Clear cart
 	cart.Items = []CartItem{}
-	cart.Total = 0
-	cart.UpdatedAt = time.Now()
+	cart.Total = money.Money{}
+	cart.UpdatedAt = h.clock.Now()
 	db.UpdateCart(cart)
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
-	email := c.Query("email")
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+// cartLines are a cart's items at their current prices.
+func (d *Database) cartLines(items []CartItem) []pricing.Line {
+	lines := make([]pricing.Line, len(items))
+	for i, item := range items {
+		product, _ := d.GetProduct(item.ProductID)
+		lines[i] = pricing.Line{Price: product.Price, Quantity: item.Quantity}
 	}
+	return lines
+}
 
-	var userOrders []Order
-	db.mu.RLock()
-	for _, order := range db.Orders {
-		if order.UserEmail == email {
-			userOrders = append(userOrders, order)
+// priceLines prices an order's lines, filled in state, less discounts, such
+// as promo codes'.
+func priceLines(lines []pricing.Line, state string, discounts ...pricing.Rule) (pricing.Quote, error) {
+	rate := taxRate
+	if taxByState {
+		rate = pricing.StateTaxRate(state, taxRate)
+	}
+	return pricing.Price(money.USD, lines, append(discounts, pricing.Tax(rate))...)
+}
+
+func (h *handlers) getDeliveryWindows(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	store, err := db.GetStore(c.Params("id"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	now := h.clock.Now()
+	from := now.In(store.deliverySchedule().Location)
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "from must be a date in YYYY-MM-DD format")
 		}
+		from = parsed
+	}
+	days := c.QueryInt("days", 7)
+	if days < 1 || days > 14 {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "days must be between 1 and 14")
 	}
-	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return c.JSON(fiber.Map{
+		"store_id": store.ID,
+		"from":     from.Format("2006-01-02"),
+		"days":     days,
+		"windows":  db.DeliveryWindows(store, from, days, now),
+	})
 }
 
-// Utility functions
-func contains(s, substr string) bool {
-	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+type HoldDeliveryWindowRequest struct {
+	UserEmail string    `json:"user_email" validate:"email"`
+	StoreID   string    `json:"store_id" validate:"required"`
+	Start     time.Time `json:"start" validate:"required"`
 }
 
-func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+func (h *handlers) holdDeliveryWindow(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req HoldDeliveryWindowRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+	if _, err := db.GetUser(req.UserEmail); err != nil {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
+	}
+	store, err := db.GetStore(req.StoreID)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	hold, err := db.HoldDeliveryWindow(store, req.UserEmail, req.Start, h.clock.Now())
+	switch err {
+	case nil:
+	case availability.ErrFull:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	default:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(hold)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) releaseDeliveryHold(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Products: make(map[string]Product),
-		Stores:   make(map[string]Store),
-		Carts:    make(map[string]Cart),
-		Orders:   make(map[string]Order),
+	switch err := db.ReleaseDeliveryHold(c.Params("id"), email); err {
+	case nil:
+		return c.SendStatus(fiber.StatusNoContent)
+	case ErrHoldUsed:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	default:
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
+}
 
-	return json.Unmarshal(data, db)
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
+	}
+
+	db.mu.RLock()
+	userOrders := db.Orders.By("user_email", email)
+	db.mu.RUnlock()
+
+	return server.List(c, userOrders)
 }
 
-func setupRoutes(app *fiber.App) {
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
+
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	db.ProductIndex = indexProducts(&db.Products)
+	db.StoreIndex = indexStores(&db.Stores)
+	h.db.Set(db)
+	return nil
+}
+
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Product routes
-	api.Get("/products", searchProducts)
+	api.Get("/products", h.searchProducts)
 	api.Get("/products/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		product, err := db.GetProduct(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(product)
 	})
 
 	// Store routes
-	api.Get("/stores", getNearbyStores)
+	api.Get("/stores", h.getNearbyStores)
 	api.Get("/stores/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		store, err := db.GetStore(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(store)
 	})
+	api.Get("/stores/:id/delivery-windows", h.getDeliveryWindows)
+
+	// Delivery window routes
+	api.Post("/delivery-holds", h.holdDeliveryWindow)
+	api.Delete("/delivery-holds/:id", h.releaseDeliveryHold)
 
 	// Cart routes
-	api.Get("/cart", getUserCart)
-	api.Post("/cart/items", addToCart)
+	api.Get("/cart", h.getUserCart)
+	api.Post("/cart/items", h.addToCart)
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", createOrder)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.createOrder)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	taxRate = cfg.TaxRate(taxRate)
+	taxByState = cfg.Tax == nil
+	deliveryRadiusMiles = cfg.Rule("delivery_radius_miles", deliveryRadiusMiles)
+	deliveryCapacity = int(cfg.Rule("delivery_window_capacity", float64(deliveryCapacity)))
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders", "carts", "delivery_holds"},
+			Search:  []string{"products", "stores", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,408 +1,2130 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"hash/fnv"
 	"log"
-	"os"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/availability"
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type FilingStatus string
 
-const (
-	FilingStatusSingle          FilingStatus = "single"
-	FilingStatusMarried         FilingStatus = "married_joint"
-	FilingStatusMarriedSeparate FilingStatus = "married_separate"
-	FilingStatusHeadOfHousehold FilingStatus = "head_of_household"
-)
+const (
+	FilingStatusSingle          FilingStatus = "single"
+	FilingStatusMarried         FilingStatus = "married_joint"
+	FilingStatusMarriedSeparate FilingStatus = "married_separate"
+	FilingStatusHeadOfHousehold FilingStatus = "head_of_household"
+)
+
+var filingStatuses = map[FilingStatus]bool{
+	FilingStatusSingle:          true,
+	FilingStatusMarried:         true,
+	FilingStatusMarriedSeparate: true,
+	FilingStatusHeadOfHousehold: true,
+}
+
+type TaxReturnStatus string
+
+const (
+	TaxReturnStatusDraft      TaxReturnStatus = "draft"
+	TaxReturnStatusInProgress TaxReturnStatus = "in_progress"
+	TaxReturnStatusReview     TaxReturnStatus = "under_review"
+	TaxReturnStatusComplete   TaxReturnStatus = "complete"
+	TaxReturnStatusFiled      TaxReturnStatus = "filed"
+	TaxReturnStatusRejected   TaxReturnStatus = "rejected"
+)
+
+// taxReturnMachine is the statuses a tax return moves through. It can be
+// filed from any status short of filed, and filed again once the IRS
+// rejects it.
+var taxReturnMachine = &statemachine.Machine{Name: "tax return", Moves: map[string][]string{
+	string(TaxReturnStatusDraft):      {string(TaxReturnStatusInProgress), string(TaxReturnStatusFiled)},
+	string(TaxReturnStatusInProgress): {string(TaxReturnStatusReview), string(TaxReturnStatusComplete), string(TaxReturnStatusFiled)},
+	string(TaxReturnStatusReview):     {string(TaxReturnStatusInProgress), string(TaxReturnStatusComplete), string(TaxReturnStatusFiled)},
+	string(TaxReturnStatusComplete):   {string(TaxReturnStatusInProgress), string(TaxReturnStatusFiled)},
+	string(TaxReturnStatusFiled):      {string(TaxReturnStatusRejected)},
+	string(TaxReturnStatusRejected):   {string(TaxReturnStatusFiled)},
+}}
+
+type User struct {
+	Email        string       `json:"email"`
+	Name         string       `json:"name"`
+	SSN          string       `json:"ssn"`
+	DateOfBirth  string       `json:"date_of_birth"`
+	FilingStatus FilingStatus `json:"filing_status"`
+	Address      Address      `json:"address"`
+	Phone        string       `json:"phone"`
+	Dependents   []Dependent  `json:"dependents"`
+}
+
+type Address struct {
+	Street  string `json:"street"`
+	City    string `json:"city"`
+	State   string `json:"state"`
+	ZipCode string `json:"zip_code"`
+}
+
+type Dependent struct {
+	Name         string `json:"name"`
+	SSN          string `json:"ssn"`
+	Relationship string `json:"relationship"`
+	DateOfBirth  string `json:"date_of_birth"`
+}
+
+type TaxDocument struct {
+	ID           string             `json:"id"`
+	Type         string             `json:"type"`
+	TaxYear      int                `json:"tax_year"`
+	FileName     string             `json:"file_name"`
+	UserEmail    string             `json:"user_email"`
+	UploadedAt   time.Time          `json:"uploaded_at"`
+	File         *server.StoredFile `json:"file,omitempty"` // The form as uploaded; none for documents on file without one
+	ParseStatus  ParseStatus        `json:"parse_status,omitempty"`
+	Extracted    *ExtractedData     `json:"extracted,omitempty"`
+	ImportedInto string             `json:"imported_into,omitempty"`
+}
+
+type ParseStatus string
+
+const (
+	ParseStatusParsed      ParseStatus = "parsed"
+	ParseStatusUnsupported ParseStatus = "unsupported"
+)
+
+// ExtractedData holds the fields read off an uploaded form. Exactly one of
+// W2 and Form1099 is set.
+type ExtractedData struct {
+	W2             *W2       `json:"w2,omitempty"`
+	Form1099       *Form1099 `json:"form_1099,omitempty"`
+	Confidence     float64   `json:"confidence"`
+	SourceRecordID string    `json:"source_record_id,omitempty"`
+}
+
+// PayerRecord is what an employer or payer reported for a user, standing in
+// for the contents of the forms a user uploads.
+type PayerRecord struct {
+	ID                 string      `json:"id"`
+	UserEmail          string      `json:"user_email"`
+	TaxYear            int         `json:"tax_year"`
+	FormType           string      `json:"form_type"` // W2, 1099-INT, 1099-NEC
+	PayerName          string      `json:"payer_name"`
+	PayerTIN           string      `json:"payer_tin"`
+	Amount             money.Money `json:"amount"`
+	FederalWithholding money.Money `json:"federal_withholding"`
+	StateWithholding   money.Money `json:"state_withholding"`
+}
+
+type TaxProfessional struct {
+	ID           string               `json:"id"`
+	Name         string               `json:"name"`
+	Expertise    string               `json:"expertise"`
+	Years        int                  `json:"years_experience"`
+	SlotMinutes  int                  `json:"slot_minutes,omitempty"`
+	Availability []AvailabilityWindow `json:"availability,omitempty"`
+	TimeOff      []string             `json:"time_off,omitempty"` // YYYY-MM-DD
+}
+
+// AvailabilityWindow is a weekly block of bookable time. Times are UTC.
+type AvailabilityWindow struct {
+	Weekday string `json:"weekday"` // monday ... sunday
+	Start   string `json:"start"`   // HH:MM
+	End     string `json:"end"`     // HH:MM
+}
+
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type AppointmentStatus string
+
+const (
+	AppointmentScheduled   AppointmentStatus = "scheduled"
+	AppointmentRescheduled AppointmentStatus = "rescheduled"
+	AppointmentCancelled   AppointmentStatus = "cancelled"
+	AppointmentCompleted   AppointmentStatus = "completed"
+)
+
+// appointmentMachine is the statuses an appointment moves through. It can
+// be moved as often as the client likes until it is cancelled or held.
+var appointmentMachine = &statemachine.Machine{Name: "appointment", Moves: map[string][]string{
+	string(AppointmentScheduled):   {string(AppointmentRescheduled), string(AppointmentCancelled), string(AppointmentCompleted)},
+	string(AppointmentRescheduled): {string(AppointmentRescheduled), string(AppointmentCancelled), string(AppointmentCompleted)},
+}}
+
+// appointmentLinks lead clients from an upcoming appointment to moving and
+// cancelling it.
+var appointmentLinks = server.Links{Schema: "Appointment", Links: []server.Link{
+	{Rel: "reschedule", Href: "/api/v1/appointments/{{id}}", Method: fiber.MethodPut,
+		Status: []string{string(AppointmentScheduled), string(AppointmentRescheduled)}},
+	{Rel: "cancel", Href: "/api/v1/appointments/{{id}}/cancel", Method: fiber.MethodPost,
+		Status: []string{string(AppointmentScheduled), string(AppointmentRescheduled)}},
+}}
+
+type Appointment struct {
+	ID              string             `json:"id"`
+	UserEmail       string             `json:"user_email"`
+	TaxProfessional TaxProfessional    `json:"tax_professional"`
+	DateTime        time.Time          `json:"datetime"`
+	DurationMinutes int                `json:"duration_minutes"`
+	Type            string             `json:"type"`
+	Status          AppointmentStatus  `json:"status"`
+	Notes           string             `json:"notes"`
+	History         []AppointmentEvent `json:"history,omitempty"`
+}
+
+type AppointmentEvent struct {
+	Status   AppointmentStatus `json:"status"`
+	DateTime time.Time         `json:"datetime"`
+	At       time.Time         `json:"at"`
+	Note     string            `json:"note,omitempty"`
+}
+
+type TaxReturn struct {
+	ID              string           `json:"id"`
+	UserEmail       string           `json:"user_email"`
+	TaxYear         int              `json:"tax_year"`
+	Status          TaxReturnStatus  `json:"status"`
+	FilingType      string           `json:"filing_type"`
+	FilingStatus    FilingStatus     `json:"filing_status,omitempty"`
+	TotalIncome     money.Money      `json:"total_income"`
+	TotalDeductions money.Money      `json:"total_deductions"`
+	TotalTax        money.Money      `json:"total_tax"`
+	RefundAmount    money.Money      `json:"refund_amount"`
+	AmountOwed      money.Money      `json:"amount_owed"`
+	W2s             []W2             `json:"w2s,omitempty"`
+	Form1099s       []Form1099       `json:"form_1099s,omitempty"`
+	Deductions      []Deduction      `json:"deductions,omitempty"`
+	Computation     *TaxComputation  `json:"computation,omitempty"`
+	EFile           *EFileSubmission `json:"efile,omitempty"`
+	Taxpayer        *TaxpayerInfo    `json:"taxpayer,omitempty"`
+	Dependents      []Dependent      `json:"dependents,omitempty"`
+	Carryovers      *Carryovers      `json:"carryovers,omitempty"`
+	ReviewFlags     []ReviewFlag     `json:"review_flags,omitempty"`
+	Documents       []TaxDocument    `json:"documents"`
+	CreatedAt       time.Time        `json:"created_at"`
+	UpdatedAt       time.Time        `json:"updated_at"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+}
+
+// TaxpayerInfo is the personal information as entered on a return, which
+// can drift from the user's profile between years.
+type TaxpayerInfo struct {
+	Name         string       `json:"name"`
+	SSN          string       `json:"ssn"`
+	DateOfBirth  string       `json:"date_of_birth"`
+	FilingStatus FilingStatus `json:"filing_status"`
+	Address      Address      `json:"address"`
+	Phone        string       `json:"phone"`
+}
+
+// Carryovers are the prior-year figures a return builds on.
+type Carryovers struct {
+	SourceReturnID       string      `json:"source_return_id"`
+	PriorYearAGI         money.Money `json:"prior_year_agi"`
+	PriorYearTax         money.Money `json:"prior_year_tax"`
+	PriorYearRefund      money.Money `json:"prior_year_refund"`
+	PriorYearAmountOwed  money.Money `json:"prior_year_amount_owed"`
+	PriorDeductionMethod string      `json:"prior_deduction_method,omitempty"`
+}
+
+// ReviewFlag marks an imported field the taxpayer should confirm.
+type ReviewFlag struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type EFileStatus string
+
+const (
+	EFileTransmitted EFileStatus = "transmitted"
+	EFileAccepted    EFileStatus = "accepted"
+	EFileRejected    EFileStatus = "rejected"
+)
+
+// eFileMachine is the statuses an e-file submission moves through, once
+// the IRS acknowledges it.
+var eFileMachine = &statemachine.Machine{Name: "e-file submission", Moves: map[string][]string{
+	string(EFileTransmitted): {string(EFileAccepted), string(EFileRejected)},
+}}
+
+// RejectionCode is an IRS business rule the return failed.
+type RejectionCode struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type EFileEvent struct {
+	Status EFileStatus `json:"status"`
+	At     time.Time   `json:"at"`
+}
+
+// EFileSubmission is the latest electronic filing of a return.
+type EFileSubmission struct {
+	SubmissionID   string          `json:"submission_id"`
+	Attempt        int             `json:"attempt"`
+	Status         EFileStatus     `json:"status"`
+	PriorYearAGI   money.Money     `json:"prior_year_agi"`
+	SubmittedAt    time.Time       `json:"submitted_at"`
+	AcknowledgedAt *time.Time      `json:"acknowledged_at,omitempty"`
+	Rejections     []RejectionCode `json:"rejections,omitempty"`
+	History        []EFileEvent    `json:"history"`
+}
+
+// W2 is a wage statement from an employer.
+type W2 struct {
+	ID                 string      `json:"id"`
+	EmployerName       string      `json:"employer_name"`
+	EmployerEIN        string      `json:"employer_ein"`
+	Wages              money.Money `json:"wages"`
+	FederalWithholding money.Money `json:"federal_withholding"`
+	StateWithholding   money.Money `json:"state_withholding"`
+}
+
+type Form1099Type string
+
+const (
+	Form1099INT Form1099Type = "1099-INT"
+	Form1099NEC Form1099Type = "1099-NEC"
+)
+
+// Form1099 reports interest (1099-INT) or nonemployee compensation
+// (1099-NEC) paid by a payer.
+type Form1099 struct {
+	ID                 string       `json:"id"`
+	Type               Form1099Type `json:"type"`
+	PayerName          string       `json:"payer_name"`
+	PayerTIN           string       `json:"payer_tin"`
+	Amount             money.Money  `json:"amount"`
+	FederalWithholding money.Money  `json:"federal_withholding"`
+}
+
+type DeductionCategory string
+
+const (
+	DeductionMortgageInterest    DeductionCategory = "mortgage_interest"
+	DeductionCharitable          DeductionCategory = "charitable"
+	DeductionStateLocalTaxes     DeductionCategory = "state_local_taxes"
+	DeductionMedical             DeductionCategory = "medical"
+	DeductionStudentLoanInterest DeductionCategory = "student_loan_interest"
+)
+
+var deductionCategories = map[DeductionCategory]bool{
+	DeductionMortgageInterest:    true,
+	DeductionCharitable:          true,
+	DeductionStateLocalTaxes:     true,
+	DeductionMedical:             true,
+	DeductionStudentLoanInterest: true,
+}
+
+type Deduction struct {
+	ID          string            `json:"id"`
+	Category    DeductionCategory `json:"category"`
+	Description string            `json:"description"`
+	Amount      money.Money       `json:"amount" validate:"gte=0"`
+}
+
+// Database represents our in-memory database
+type Database struct {
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users            server.Repository[User]            `json:"users"`
+	TaxReturns       server.Repository[TaxReturn]       `json:"tax_returns"`
+	TaxDocuments     server.Repository[TaxDocument]     `json:"tax_documents"`
+	Appointments     server.Repository[Appointment]     `json:"appointments"`
+	TaxProfessionals server.Repository[TaxProfessional] `json:"tax_professionals"`
+	PayerRecords     server.Repository[PayerRecord]     `json:"payer_records"`
+	mu               sync.RWMutex
+	clock            *server.Clock
+}
+
+// handlers prepare and file H&R Block tax returns and book tax pros. clock
+// dates them and moves e-files along.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the returns, documents and appointments in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+// Error definitions
+var (
+	ErrUserNotFound         = errors.New("user not found")
+	ErrTaxReturnNotFound    = errors.New("tax return not found")
+	ErrReturnLocked         = errors.New("tax return has been filed and can no longer be changed")
+	ErrEntryNotFound        = errors.New("entry not found on this tax return")
+	ErrInvalidEIN           = errors.New("EIN must be in the format XX-XXXXXXX")
+	ErrNegativeAmount       = errors.New("amounts must not be negative")
+	ErrInvalid1099Type      = errors.New("1099 type must be 1099-INT or 1099-NEC")
+	ErrInvalidCategory      = errors.New("unknown deduction category")
+	ErrMissingName          = errors.New("employer or payer name is required")
+	ErrWithholdingTooHigh   = errors.New("federal withholding cannot exceed the reported amount")
+	ErrAlreadyFiled         = errors.New("tax return has already been filed")
+	ErrIncompleteReturn     = errors.New("tax return is incomplete")
+	ErrDocumentNotFound     = errors.New("document not found")
+	ErrDocumentNotParsed    = errors.New("document has no extracted fields to import")
+	ErrAlreadyImported      = errors.New("document has already been imported into a return")
+	ErrDocumentMismatch     = errors.New("document belongs to a different user or tax year")
+	ErrProfessionalNotFound = errors.New("tax professional not found")
+	ErrAppointmentNotFound  = errors.New("appointment not found")
+	ErrNotAppointmentOwner  = errors.New("appointment belongs to another user")
+	ErrAppointmentClosed    = errors.New("appointment has been cancelled or completed")
+	ErrAppointmentInPast    = errors.New("appointment time has already passed")
+	ErrSlotUnavailable      = errors.New("the tax professional does not offer that time slot")
+	ErrSlotTaken            = errors.New("the tax professional is already booked at that time")
+	ErrUserDoubleBooked     = errors.New("you already have an appointment at that time")
+	ErrNoPriorYearReturn    = errors.New("no return on file for the previous tax year")
+	ErrPriorYearImported    = errors.New("prior-year information has already been imported into this return")
+	ErrInvalidFilingStatus  = errors.New("filing status must be single, married_joint, married_separate or head_of_household")
+)
+
+// Tax engine
+//
+// A simplified federal Form 1040 calculation: wages and 1099 income, the
+// larger of the standard or itemized deduction, ordinary brackets,
+// self-employment tax on 1099-NEC income, and the child / other dependent
+// credits.
+
+type bracket struct {
+	UpTo float64 // upper bound of the bracket; the last one is unbounded
+	Rate float64
+}
+
+type yearTable struct {
+	StandardDeduction map[FilingStatus]float64
+	Brackets          map[FilingStatus][]bracket
+}
+
+func brackets(bounds [6]float64) []bracket {
+	rates := []float64{0.10, 0.12, 0.22, 0.24, 0.32, 0.35}
+	out := make([]bracket, 0, 7)
+	for i, upTo := range bounds {
+		out = append(out, bracket{UpTo: upTo, Rate: rates[i]})
+	}
+	return append(out, bracket{UpTo: math.Inf(1), Rate: 0.37})
+}
+
+var taxTables = map[int]yearTable{
+	2022: {
+		StandardDeduction: map[FilingStatus]float64{
+			FilingStatusSingle:          12950,
+			FilingStatusMarried:         25900,
+			FilingStatusMarriedSeparate: 12950,
+			FilingStatusHeadOfHousehold: 19400,
+		},
+		Brackets: map[FilingStatus][]bracket{
+			FilingStatusSingle:          brackets([6]float64{10275, 41775, 89075, 170050, 215950, 539900}),
+			FilingStatusMarried:         brackets([6]float64{20550, 83550, 178150, 340100, 431900, 647850}),
+			FilingStatusMarriedSeparate: brackets([6]float64{10275, 41775, 89075, 170050, 215950, 323925}),
+			FilingStatusHeadOfHousehold: brackets([6]float64{14650, 55900, 89050, 170050, 215950, 539900}),
+		},
+	},
+	2023: {
+		StandardDeduction: map[FilingStatus]float64{
+			FilingStatusSingle:          13850,
+			FilingStatusMarried:         27700,
+			FilingStatusMarriedSeparate: 13850,
+			FilingStatusHeadOfHousehold: 20800,
+		},
+		Brackets: map[FilingStatus][]bracket{
+			FilingStatusSingle:          brackets([6]float64{11000, 44725, 95375, 182100, 231250, 578125}),
+			FilingStatusMarried:         brackets([6]float64{22000, 89450, 190750, 364200, 462500, 693750}),
+			FilingStatusMarriedSeparate: brackets([6]float64{11000, 44725, 95375, 182100, 231250, 346875}),
+			FilingStatusHeadOfHousehold: brackets([6]float64{15700, 59850, 95350, 182100, 231250, 578100}),
+		},
+	},
+	2024: {
+		StandardDeduction: map[FilingStatus]float64{
+			FilingStatusSingle:          14600,
+			FilingStatusMarried:         29200,
+			FilingStatusMarriedSeparate: 14600,
+			FilingStatusHeadOfHousehold: 21900,
+		},
+		Brackets: map[FilingStatus][]bracket{
+			FilingStatusSingle:          brackets([6]float64{11600, 47150, 100525, 191950, 243725, 609350}),
+			FilingStatusMarried:         brackets([6]float64{23200, 94300, 201050, 383900, 487450, 731200}),
+			FilingStatusMarriedSeparate: brackets([6]float64{11600, 47150, 100525, 191950, 243725, 365600}),
+			FilingStatusHeadOfHousehold: brackets([6]float64{16550, 63100, 100500, 191950, 243700, 609350}),
+		},
+	},
+}
+
+// tableFor returns the tables for a tax year, falling back to the nearest
+// year on file.
+func tableFor(year int) (yearTable, int) {
+	if table, ok := taxTables[year]; ok {
+		return table, year
+	}
+	years := make([]int, 0, len(taxTables))
+	for y := range taxTables {
+		years = append(years, y)
+	}
+	sort.Ints(years)
+	nearest := years[len(years)-1]
+	if year < years[0] {
+		nearest = years[0]
+	}
+	return taxTables[nearest], nearest
+}
+
+const (
+	saltCap                = 10000
+	studentLoanInterestCap = 2500
+	medicalFloorRate       = 0.075
+	seEarningsRate         = 0.9235
+	seTaxRate              = 0.153
+	childTaxCredit         = 2000
+	otherDependentCredit   = 500
+	childCreditMaxAge      = 16
+)
+
+// TaxInput is everything the engine needs to compute a return.
+type TaxInput struct {
+	TaxYear         int                               `json:"tax_year"`
+	FilingStatus    FilingStatus                      `json:"filing_status"`
+	Wages           money.Money                       `json:"wages"`
+	InterestIncome  money.Money                       `json:"interest_income"`
+	SelfEmployment  money.Money                       `json:"self_employment_income"`
+	Withholding     money.Money                       `json:"withholding"`
+	Deductions      map[DeductionCategory]money.Money `json:"deductions,omitempty"`
+	QualifyingKids  int                               `json:"qualifying_children"`
+	OtherDependents int                               `json:"other_dependents"`
+}
+
+type TaxComputation struct {
+	TaxYear            int          `json:"tax_year"`
+	TableYear          int          `json:"table_year"`
+	FilingStatus       FilingStatus `json:"filing_status"`
+	TotalIncome        money.Money  `json:"total_income"`
+	Adjustments        money.Money  `json:"adjustments"`
+	AdjustedGross      money.Money  `json:"adjusted_gross_income"`
+	StandardDeduction  money.Money  `json:"standard_deduction"`
+	ItemizedDeductions money.Money  `json:"itemized_deductions"`
+	DeductionMethod    string       `json:"deduction_method"` // standard, itemized
+	TotalDeductions    money.Money  `json:"total_deductions"`
+	TaxableIncome      money.Money  `json:"taxable_income"`
+	IncomeTax          money.Money  `json:"income_tax"`
+	SelfEmploymentTax  money.Money  `json:"self_employment_tax"`
+	Credits            money.Money  `json:"credits"`
+	TotalTax           money.Money  `json:"total_tax"`
+	Withholding        money.Money  `json:"withholding"`
+	RefundAmount       money.Money  `json:"refund_amount"`
+	AmountOwed         money.Money  `json:"amount_owed"`
+	EffectiveRate      float64      `json:"effective_rate"`
+	MarginalRate       float64      `json:"marginal_rate"`
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// ComputeTax runs the tax engine. It is pure so the same calculation backs
+// both full returns and quick estimates. The tax tables are in dollars, so
+// it works in dollars and rounds each figure to the cent.
+func ComputeTax(in TaxInput) TaxComputation {
+	table, tableYear := tableFor(in.TaxYear)
+	status := in.FilingStatus
+	if _, ok := table.Brackets[status]; !ok {
+		status = FilingStatusSingle
+	}
+	deduction := func(category DeductionCategory) float64 {
+		return in.Deductions[category].Float()
+	}
+
+	totalIncome := roundCents(in.Wages.Float() + in.InterestIncome.Float() + in.SelfEmployment.Float())
+	withholding := roundCents(in.Withholding.Float())
+
+	adjustments := math.Min(deduction(DeductionStudentLoanInterest), studentLoanInterestCap)
+	seTax := math.Max(in.SelfEmployment.Float(), 0) * seEarningsRate * seTaxRate
+	// Half of self-employment tax is an adjustment to income.
+	adjustments = roundCents(adjustments + seTax/2)
+	agi := roundCents(math.Max(totalIncome-adjustments, 0))
+
+	salt := math.Min(deduction(DeductionStateLocalTaxes), saltCap)
+	if status == FilingStatusMarriedSeparate {
+		salt = math.Min(salt, saltCap/2)
+	}
+	medical := math.Max(deduction(DeductionMedical)-agi*medicalFloorRate, 0)
+	itemized := roundCents(salt + medical +
+		deduction(DeductionMortgageInterest) + deduction(DeductionCharitable))
+	standard := table.StandardDeduction[status]
+	out := TaxComputation{
+		TaxYear:            in.TaxYear,
+		TableYear:          tableYear,
+		FilingStatus:       status,
+		TotalIncome:        money.Dollars(totalIncome),
+		Adjustments:        money.Dollars(adjustments),
+		AdjustedGross:      money.Dollars(agi),
+		StandardDeduction:  money.Dollars(standard),
+		ItemizedDeductions: money.Dollars(itemized),
+		DeductionMethod:    "standard",
+		SelfEmploymentTax:  money.Dollars(seTax),
+		Withholding:        money.Dollars(withholding),
+	}
+	deductions := standard
+	if itemized > standard {
+		out.DeductionMethod = "itemized"
+		deductions = itemized
+	}
+	out.TotalDeductions = money.Dollars(deductions)
+	taxable := roundCents(math.Max(agi-deductions, 0))
+	out.TaxableIncome = money.Dollars(taxable)
+
+	incomeTax, lower := 0.0, 0.0
+	for _, b := range table.Brackets[status] {
+		if taxable > lower {
+			incomeTax += (math.Min(taxable, b.UpTo) - lower) * b.Rate
+			out.MarginalRate = b.Rate
+		}
+		lower = b.UpTo
+	}
+	incomeTax = roundCents(incomeTax)
+	out.IncomeTax = money.Dollars(incomeTax)
+
+	// Dependent credits are nonrefundable here: they only offset income tax.
+	credits := roundCents(math.Min(float64(in.QualifyingKids*childTaxCredit+in.OtherDependents*otherDependentCredit), incomeTax))
+	out.Credits = money.Dollars(credits)
+	totalTax := roundCents(incomeTax - credits + roundCents(seTax))
+	out.TotalTax = money.Dollars(totalTax)
+
+	balance := roundCents(withholding - totalTax)
+	if balance >= 0 {
+		out.RefundAmount = money.Dollars(balance)
+	} else {
+		out.AmountOwed = money.Dollars(-balance)
+	}
+	if totalIncome > 0 {
+		out.EffectiveRate = math.Round(totalTax/totalIncome*10000) / 10000
+	}
+	return out
+}
+
+// countDependents splits dependents into children young enough for the child
+// tax credit at the end of the tax year and other dependents.
+func countDependents(dependents []Dependent, taxYear int) (children, others int) {
+	for _, dependent := range dependents {
+		born, err := time.Parse("2006-01-02", dependent.DateOfBirth)
+		if err == nil && taxYear-born.Year() <= childCreditMaxAge {
+			children++
+		} else {
+			others++
+		}
+	}
+	return children, others
+}
+
+// taxInput gathers a return's entries into engine input. Tax forms are all
+// in dollars, so their amounts add up as cents. Callers must hold d.mu.
+func (d *Database) taxInput(tr TaxReturn) TaxInput {
+	user, _ := d.Users.Get(tr.UserEmail)
+	in := TaxInput{
+		TaxYear:      tr.TaxYear,
+		FilingStatus: tr.FilingStatus,
+		Deductions:   make(map[DeductionCategory]money.Money),
+	}
+	if in.FilingStatus == "" {
+		in.FilingStatus = user.FilingStatus
+	}
+	for _, w2 := range tr.W2s {
+		in.Wages.Minor += w2.Wages.Minor
+		in.Withholding.Minor += w2.FederalWithholding.Minor
+	}
+	for _, form := range tr.Form1099s {
+		switch form.Type {
+		case Form1099INT:
+			in.InterestIncome.Minor += form.Amount.Minor
+		case Form1099NEC:
+			in.SelfEmployment.Minor += form.Amount.Minor
+		}
+		in.Withholding.Minor += form.FederalWithholding.Minor
+	}
+	for _, deduction := range tr.Deductions {
+		total := in.Deductions[deduction.Category]
+		total.Minor += deduction.Amount.Minor
+		in.Deductions[deduction.Category] = total
+	}
+	in.QualifyingKids, in.OtherDependents = countDependents(d.dependents(tr), tr.TaxYear)
+	return in
+}
+
+// dependents returns the dependents claimed on a return: those copied onto
+// it, or the user's current ones. Callers must hold d.mu.
+func (d *Database) dependents(tr TaxReturn) []Dependent {
+	if tr.Taxpayer != nil {
+		return tr.Dependents
+	}
+	user, _ := d.Users.Get(tr.UserEmail)
+	return user.Dependents
+}
+
+// recompute refreshes a return's totals from its entries. Callers must hold
+// d.mu.
+func (d *Database) recompute(tr *TaxReturn) {
+	result := ComputeTax(d.taxInput(*tr))
+	tr.Computation = &result
+	tr.TotalIncome = result.TotalIncome
+	tr.TotalDeductions = result.TotalDeductions
+	tr.TotalTax = result.TotalTax
+	tr.RefundAmount = result.RefundAmount
+	tr.AmountOwed = result.AmountOwed
+	tr.UpdatedAt = d.clock.Now()
+	if tr.Status == TaxReturnStatusDraft {
+		// Editing a draft starts it; other statuses stay as they are
+		statemachine.Move(taxReturnMachine, tr, &tr.Status, &tr.StatusHistory, TaxReturnStatusInProgress, tr.UpdatedAt)
+	}
+}
+
+// einPattern matches an employer identification number such as 12-3456789.
+var einPattern = regexp.MustCompile(`^\d{2}-\d{7}$`)
+
+func (w W2) Validate() error {
+	if w.EmployerName == "" {
+		return ErrMissingName
+	}
+	if !einPattern.MatchString(w.EmployerEIN) {
+		return ErrInvalidEIN
+	}
+	if w.Wages.IsNegative() || w.FederalWithholding.IsNegative() || w.StateWithholding.IsNegative() {
+		return ErrNegativeAmount
+	}
+	over, err := w.Wages.Less(w.FederalWithholding)
+	if err != nil {
+		return err
+	}
+	if over {
+		return ErrWithholdingTooHigh
+	}
+	return nil
+}
+
+func (f Form1099) Validate() error {
+	if f.Type != Form1099INT && f.Type != Form1099NEC {
+		return ErrInvalid1099Type
+	}
+	if f.PayerName == "" {
+		return ErrMissingName
+	}
+	if !einPattern.MatchString(f.PayerTIN) {
+		return ErrInvalidEIN
+	}
+	if f.Amount.IsNegative() || f.FederalWithholding.IsNegative() {
+		return ErrNegativeAmount
+	}
+	over, err := f.Amount.Less(f.FederalWithholding)
+	if err != nil {
+		return err
+	}
+	if over {
+		return ErrWithholdingTooHigh
+	}
+	return nil
+}
+
+func (ded Deduction) Validate() error {
+	if !deductionCategories[ded.Category] {
+		return ErrInvalidCategory
+	}
+	if ded.Amount.IsNegative() {
+		return ErrNegativeAmount
+	}
+	return nil
+}
+
+// Database operations
+func (d *Database) GetUser(email string) (User, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (d *Database) GetTaxReturns(email string) []TaxReturn {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.TaxReturns.By("user_email", email)
+}
+
+func (d *Database) GetTaxDocuments(email string) []TaxDocument {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.TaxDocuments.By("user_email", email)
+}
+
+func (d *Database) GetTaxDocument(id string) (TaxDocument, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	doc, exists := d.TaxDocuments.Get(id)
+	if !exists {
+		return TaxDocument{}, ErrDocumentNotFound
+	}
+	return doc, nil
+}
+
+func (d *Database) CreateTaxReturn(tr TaxReturn) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.TaxReturns.Upsert(tr.ID, tr)
+	return nil
+}
+
+// updateReturn applies a change to an unfiled return and recomputes its
+// totals.
+func (d *Database) updateReturn(id string, change func(tr *TaxReturn) error) (TaxReturn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tr, exists := d.TaxReturns.Get(id)
+	if !exists {
+		return TaxReturn{}, ErrTaxReturnNotFound
+	}
+	if tr.Status == TaxReturnStatusFiled {
+		return TaxReturn{}, ErrReturnLocked
+	}
+	if err := change(&tr); err != nil {
+		return TaxReturn{}, err
+	}
+	d.recompute(&tr)
+	d.TaxReturns.Upsert(tr.ID, tr)
+	return tr, nil
+}
+
+func (d *Database) AddW2(returnID string, w2 W2) (TaxReturn, error) {
+	if err := w2.Validate(); err != nil {
+		return TaxReturn{}, err
+	}
+	return d.updateReturn(returnID, func(tr *TaxReturn) error {
+		tr.W2s = append(tr.W2s, w2)
+		return nil
+	})
+}
+
+func (d *Database) Add1099(returnID string, form Form1099) (TaxReturn, error) {
+	if err := form.Validate(); err != nil {
+		return TaxReturn{}, err
+	}
+	return d.updateReturn(returnID, func(tr *TaxReturn) error {
+		tr.Form1099s = append(tr.Form1099s, form)
+		return nil
+	})
+}
+
+func (d *Database) AddDeduction(returnID string, deduction Deduction) (TaxReturn, error) {
+	if err := deduction.Validate(); err != nil {
+		return TaxReturn{}, err
+	}
+	return d.updateReturn(returnID, func(tr *TaxReturn) error {
+		tr.Deductions = append(tr.Deductions, deduction)
+		return nil
+	})
+}
+
+// RemoveEntry deletes a W-2, 1099 or deduction from a return by its ID.
+func (d *Database) RemoveEntry(returnID, kind, entryID string) (TaxReturn, error) {
+	return d.updateReturn(returnID, func(tr *TaxReturn) error {
+		removed := false
+		switch kind {
+		case "w2s":
+			tr.W2s, removed = removeByID(tr.W2s, entryID, func(w W2) string { return w.ID })
+		case "1099s":
+			tr.Form1099s, removed = removeByID(tr.Form1099s, entryID, func(f Form1099) string { return f.ID })
+		case "deductions":
+			tr.Deductions, removed = removeByID(tr.Deductions, entryID, func(ded Deduction) string { return ded.ID })
+		}
+		if !removed {
+			return ErrEntryNotFound
+		}
+		return nil
+	})
+}
+
+func removeByID[T any](items []T, id string, key func(T) string) ([]T, bool) {
+	for i, item := range items {
+		if key(item) == id {
+			return append(items[:i:i], items[i+1:]...), true
+		}
+	}
+	return items, false
+}
+
+// E-file simulation
+//
+// A filed return is "transmitted" until the IRS acknowledges it irsDelay
+// later, when it is accepted or rejected with error codes. Refunds on
+// accepted returns are approved and then sent after further delays.
+var irsDelay = time.Minute
+
+const (
+	refundApprovedAfter = 3 // multiples of irsDelay after acceptance
+	refundSentAfter     = 6
+)
+
+// completenessIssues lists what must be fixed before a return can be filed.
+// Callers must hold d.mu.
+func (d *Database) completenessIssues(tr TaxReturn, now time.Time) []string {
+	user, _ := d.Users.Get(tr.UserEmail)
+	var issues []string
+	if len(tr.W2s) == 0 && len(tr.Form1099s) == 0 {
+		issues = append(issues, "at least one W-2 or 1099 must be entered")
+	}
+	if tr.TaxYear <= 0 || tr.TaxYear >= now.Year() {
+		issues = append(issues, "tax year must be a completed calendar year")
+	}
+	if user.SSN == "" {
+		issues = append(issues, "taxpayer SSN is missing")
+	}
+	if user.DateOfBirth == "" {
+		issues = append(issues, "taxpayer date of birth is missing")
+	}
+	if user.Address.Street == "" || user.Address.City == "" || user.Address.State == "" || user.Address.ZipCode == "" {
+		issues = append(issues, "mailing address is incomplete")
+	}
+	if tr.FilingStatus == "" && user.FilingStatus == "" {
+		issues = append(issues, "filing status is not set")
+	}
+	return issues
+}
+
+// FileReturn submits a return electronically. The prior-year AGI signs the
+// submission and is checked by the IRS when it acknowledges the return.
+func (d *Database) FileReturn(id string, priorYearAGI money.Money) (TaxReturn, []string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tr, exists := d.TaxReturns.Get(id)
+	if !exists {
+		return TaxReturn{}, nil, ErrTaxReturnNotFound
+	}
+	now := d.clock.Now()
+	if err := statemachine.Move(taxReturnMachine, &tr, &tr.Status, &tr.StatusHistory, TaxReturnStatusFiled, now); err != nil {
+		return TaxReturn{}, nil, ErrAlreadyFiled
+	}
+	if issues := d.completenessIssues(tr, now); len(issues) > 0 {
+		return TaxReturn{}, issues, ErrIncompleteReturn
+	}
+
+	if priorYearAGI.IsZero() && tr.Carryovers != nil {
+		priorYearAGI = tr.Carryovers.PriorYearAGI
+	}
+
+	d.recompute(&tr)
+	attempt := 1
+	if tr.EFile != nil {
+		attempt = tr.EFile.Attempt + 1
+	}
+	tr.EFile = &EFileSubmission{
+		SubmissionID: strconv.Itoa(now.Year()) + strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:12]),
+		Attempt:      attempt,
+		Status:       EFileTransmitted,
+		PriorYearAGI: priorYearAGI,
+		SubmittedAt:  now,
+		History:      []EFileEvent{{Status: EFileTransmitted, At: now}},
+	}
+	tr.UpdatedAt = now
+	d.TaxReturns.Upsert(tr.ID, tr)
+	return tr, nil, nil
+}
+
+// irsRejections applies the simulated IRS business rules. Callers must hold
+// d.mu.
+func (d *Database) irsRejections(tr TaxReturn) []RejectionCode {
+	var codes []RejectionCode
+
+	var expectedAGI money.Money
+	for _, prior := range d.TaxReturns.List() {
+		if prior.UserEmail == tr.UserEmail && prior.TaxYear == tr.TaxYear-1 && prior.Status == TaxReturnStatusFiled {
+			expectedAGI = prior.TotalIncome
+			if prior.Computation != nil {
+				expectedAGI = prior.Computation.AdjustedGross
+			}
+			break
+		}
+	}
+	if math.Round(tr.EFile.PriorYearAGI.Float()) != math.Round(expectedAGI.Float()) {
+		codes = append(codes, RejectionCode{
+			Code:    "IND-031-04",
+			Message: "The prior-year AGI entered for the taxpayer does not match IRS records.",
+		})
+	}
+
+	for _, dependent := range d.dependents(tr) {
+		if !ssnPattern.MatchString(dependent.SSN) {
+			codes = append(codes, RejectionCode{
+				Code:    "R0000-504-02",
+				Message: "Dependent " + dependent.Name + " has a missing or invalid SSN.",
+			})
+		}
+	}
+	return codes
+}
+
+// ssnPattern accepts full or masked SSNs such as ***-**-1234.
+var ssnPattern = regexp.MustCompile(`^[\d*]{3}-[\d*]{2}-\d{4}$`)
+
+// ProcessEFiles acknowledges transmitted returns whose IRS delay has
+// elapsed. Rejected returns go back to the preparer for corrections.
+func (d *Database) ProcessEFiles(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, id := range d.TaxReturns.Keys() {
+		tr, _ := d.TaxReturns.Get(id)
+		if tr.EFile == nil || tr.EFile.Status != EFileTransmitted || now.Before(tr.EFile.SubmittedAt.Add(irsDelay)) {
+			continue
+		}
+		ackAt := tr.EFile.SubmittedAt.Add(irsDelay)
+		efile := *tr.EFile
+		efile.AcknowledgedAt = &ackAt
+		efile.Rejections = d.irsRejections(tr)
+		to := EFileAccepted
+		if len(efile.Rejections) > 0 {
+			to = EFileRejected
+			if err := statemachine.Move(taxReturnMachine, &tr, &tr.Status, &tr.StatusHistory, TaxReturnStatusRejected, ackAt); err != nil {
+				log.Printf("Rejecting tax return %s: %v", tr.ID, err)
+				continue
+			}
+		}
+		if err := statemachine.Move(eFileMachine, &efile, &efile.Status, nil, to, ackAt); err != nil {
+			log.Printf("Acknowledging e-file %s: %v", efile.SubmissionID, err)
+			continue
+		}
+		efile.History = append(append([]EFileEvent{}, efile.History...), EFileEvent{Status: efile.Status, At: ackAt})
+		tr.EFile = &efile
+		tr.UpdatedAt = ackAt
+		d.TaxReturns.Upsert(id, tr)
+	}
+}
+
+func (h *handlers) runEFileProcessor(interval time.Duration) {
+	h.clock.Every(interval, func(now time.Time) {
+		db := h.db.Get()
+		db.ProcessEFiles(now)
+	})
+}
+
+type RefundStatus struct {
+	ReturnID         string      `json:"return_id"`
+	TaxYear          int         `json:"tax_year"`
+	Stage            string      `json:"stage"` // not_filed, return_received, rejected, refund_approved, refund_sent, balance_due
+	RefundAmount     money.Money `json:"refund_amount"`
+	AmountOwed       money.Money `json:"amount_owed"`
+	EFileStatus      string      `json:"efile_status,omitempty"`
+	ExpectedRefundBy *time.Time  `json:"expected_refund_by,omitempty"`
+	Message          string      `json:"message"`
+}
+
+// TrackRefund reports where a return's refund is, "Where's My Refund" style.
+func (d *Database) TrackRefund(id string, now time.Time) (RefundStatus, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	tr, exists := d.TaxReturns.Get(id)
+	if !exists {
+		return RefundStatus{}, ErrTaxReturnNotFound
+	}
+	status := RefundStatus{
+		ReturnID:     tr.ID,
+		TaxYear:      tr.TaxYear,
+		RefundAmount: tr.RefundAmount,
+		AmountOwed:   tr.AmountOwed,
+	}
+	if tr.EFile == nil {
+		status.Stage = "not_filed"
+		status.Message = "This return has not been e-filed yet."
+		return status, nil
+	}
+	status.EFileStatus = string(tr.EFile.Status)
+
+	switch tr.EFile.Status {
+	case EFileTransmitted:
+		status.Stage = "return_received"
+		status.Message = "The IRS has received your return and is processing it."
+	case EFileRejected:
+		status.Stage = "rejected"
+		status.Message = "The IRS rejected your return. Correct the errors and file again."
+	case EFileAccepted:
+		if !tr.RefundAmount.IsPositive() {
+			status.Stage = "balance_due"
+			status.Message = "Your return was accepted. No refund is due."
+			break
+		}
+		accepted := *tr.EFile.AcknowledgedAt
+		approvedAt := accepted.Add(refundApprovedAfter * irsDelay)
+		sentAt := accepted.Add(refundSentAfter * irsDelay)
+		status.ExpectedRefundBy = &sentAt
+		switch {
+		case now.Before(approvedAt):
+			status.Stage = "return_received"
+			status.Message = "Your return was accepted and your refund is being reviewed."
+		case now.Before(sentAt):
+			status.Stage = "refund_approved"
+			status.Message = "Your refund has been approved."
+		default:
+			status.Stage = "refund_sent"
+			status.Message = "Your refund has been sent."
+		}
+	}
+	return status, nil
+}
+
+// Prior-year import
+
+// priorYearReturn finds the user's return for the year before tr, preferring
+// one that was filed. Callers must hold d.mu.
+func (d *Database) priorYearReturn(tr TaxReturn) (TaxReturn, bool) {
+	var found TaxReturn
+	ok := false
+	for _, prior := range d.TaxReturns.List() {
+		if prior.UserEmail != tr.UserEmail || prior.TaxYear != tr.TaxYear-1 {
+			continue
+		}
+		if !ok || (prior.Status == TaxReturnStatusFiled && found.Status != TaxReturnStatusFiled) ||
+			(prior.Status == found.Status && prior.UpdatedAt.After(found.UpdatedAt)) {
+			found, ok = prior, true
+		}
+	}
+	return found, ok
+}
+
+// ImportPriorYear copies personal information, dependents and carryover
+// amounts from last year's return, and flags what is likely to have changed.
+func (d *Database) ImportPriorYear(returnID string) (TaxReturn, error) {
+	return d.updateReturn(returnID, func(tr *TaxReturn) error {
+		if tr.Carryovers != nil {
+			return ErrPriorYearImported
+		}
+		prior, ok := d.priorYearReturn(*tr)
+		if !ok {
+			return ErrNoPriorYearReturn
+		}
+		user, _ := d.Users.Get(tr.UserEmail)
+		var flags []ReviewFlag
+
+		// Personal information
+		profile := TaxpayerInfo{
+			Name:         user.Name,
+			SSN:          user.SSN,
+			DateOfBirth:  user.DateOfBirth,
+			FilingStatus: user.FilingStatus,
+			Address:      user.Address,
+			Phone:        user.Phone,
+		}
+		info := profile
+		dependents := user.Dependents
+		if prior.Taxpayer != nil {
+			info = *prior.Taxpayer
+			dependents = prior.Dependents
+		}
+		if prior.FilingStatus != "" {
+			info.FilingStatus = prior.FilingStatus
+		}
+		if info.Address != profile.Address {
+			flags = append(flags, ReviewFlag{Field: "taxpayer.address", Message: "Last year's address differs from your profile; confirm where you live now."})
+		}
+		if info.Phone != profile.Phone {
+			flags = append(flags, ReviewFlag{Field: "taxpayer.phone", Message: "Last year's phone number differs from your profile."})
+		}
+		if info.FilingStatus != profile.FilingStatus && profile.FilingStatus != "" {
+			flags = append(flags, ReviewFlag{Field: "filing_status", Message: "You filed as " + string(info.FilingStatus) + " last year but your profile says " + string(profile.FilingStatus) + "."})
+		}
+		tr.Taxpayer = &info
+		tr.FilingStatus = info.FilingStatus
+
+		// Dependents
+		tr.Dependents = append([]Dependent{}, dependents...)
+		for _, dependent := range tr.Dependents {
+			if born, err := time.Parse("2006-01-02", dependent.DateOfBirth); err == nil && tr.TaxYear-born.Year() == childCreditMaxAge+1 {
+				flags = append(flags, ReviewFlag{Field: "dependents", Message: dependent.Name + " turns 17 this year and no longer qualifies for the child tax credit."})
+			}
+			if !ssnPattern.MatchString(dependent.SSN) {
+				flags = append(flags, ReviewFlag{Field: "dependents", Message: dependent.Name + " has a missing or invalid SSN."})
+			}
+		}
+		if len(user.Dependents) != len(tr.Dependents) {
+			flags = append(flags, ReviewFlag{Field: "dependents", Message: "The number of dependents on your profile has changed since last year."})
+		}
+
+		// Carryovers
+		agi := prior.TotalIncome
+		method := ""
+		if prior.Computation != nil {
+			agi = prior.Computation.AdjustedGross
+			method = prior.Computation.DeductionMethod
+		}
+		tr.Carryovers = &Carryovers{
+			SourceReturnID:       prior.ID,
+			PriorYearAGI:         agi,
+			PriorYearTax:         prior.TotalTax,
+			PriorYearRefund:      prior.RefundAmount,
+			PriorYearAmountOwed:  prior.AmountOwed,
+			PriorDeductionMethod: method,
+		}
+		if prior.Status != TaxReturnStatusFiled {
+			flags = append(flags, ReviewFlag{Field: "carryovers", Message: "Last year's return was never filed, so these amounts may not match IRS records."})
+		}
+		if method == "itemized" {
+			flags = append(flags, ReviewFlag{Field: "form_1099s", Message: "You itemized last year; a state or local refund received this year may be taxable."})
+		}
+
+		// Recurring income and deductions
+		for _, w2 := range prior.W2s {
+			flags = append(flags, ReviewFlag{Field: "w2s", Message: w2.EmployerName + " issued you a W-2 last year; add this year's if you still work there."})
+		}
+		for _, form := range prior.Form1099s {
+			flags = append(flags, ReviewFlag{Field: "form_1099s", Message: form.PayerName + " issued you a " + string(form.Type) + " last year."})
+		}
+		seen := make(map[DeductionCategory]bool)
+		for _, deduction := range prior.Deductions {
+			if !seen[deduction.Category] {
+				seen[deduction.Category] = true
+				flags = append(flags, ReviewFlag{Field: "deductions", Message: "You had a " + strings.ReplaceAll(string(deduction.Category), "_", " ") + " deduction last year; enter this year's amount if it still applies."})
+			}
+		}
+
+		tr.ReviewFlags = flags
+		return nil
+	})
+}
+
+// Document parsing
+//
+// There is no real OCR: a parsed form takes its fields from the matching
+// payer record on file, or, when there is none, from values derived from the
+// file name so repeated uploads parse the same way.
+
+const (
+	recordConfidence    = 0.98
+	syntheticConfidence = 0.72
+)
+
+// parseDocument fills in a document's extracted fields. Callers must hold
+// d.mu.
+func (d *Database) parseDocument(doc *TaxDocument) {
+	formType := normalizeFormType(doc.Type)
+	if formType == "" {
+		doc.ParseStatus = ParseStatusUnsupported
+		return
+	}
+	doc.Type = formType
+
+	record, found := d.unclaimedRecord(doc.UserEmail, doc.TaxYear, formType)
+	confidence := recordConfidence
+	if !found {
+		record = syntheticRecord(doc.FileName, formType)
+		confidence = syntheticConfidence
+	}
+
+	extracted := &ExtractedData{Confidence: confidence, SourceRecordID: record.ID}
+	if formType == "W2" {
+		extracted.W2 = &W2{
+			EmployerName:       record.PayerName,
+			EmployerEIN:        record.PayerTIN,
+			Wages:              record.Amount,
+			FederalWithholding: record.FederalWithholding,
+			StateWithholding:   record.StateWithholding,
+		}
+	} else {
+		extracted.Form1099 = &Form1099{
+			Type:               Form1099Type(formType),
+			PayerName:          record.PayerName,
+			PayerTIN:           record.PayerTIN,
+			Amount:             record.Amount,
+			FederalWithholding: record.FederalWithholding,
+		}
+	}
+	doc.ParseStatus = ParseStatusParsed
+	doc.Extracted = extracted
+}
+
+func normalizeFormType(docType string) string {
+	switch strings.ToUpper(strings.ReplaceAll(docType, " ", "")) {
+	case "W2", "W-2":
+		return "W2"
+	case "1099-INT", "1099INT":
+		return string(Form1099INT)
+	case "1099-NEC", "1099NEC":
+		return string(Form1099NEC)
+	}
+	return ""
+}
+
+// unclaimedRecord finds a payer record for the form that no other document
+// was parsed from. Callers must hold d.mu.
+func (d *Database) unclaimedRecord(email string, year int, formType string) (PayerRecord, bool) {
+	claimed := make(map[string]bool)
+	for _, doc := range d.TaxDocuments.List() {
+		if doc.Extracted != nil && doc.Extracted.SourceRecordID != "" {
+			claimed[doc.Extracted.SourceRecordID] = true
+		}
+	}
+	ids := make([]string, 0, d.PayerRecords.Len())
+	for _, id := range d.PayerRecords.Keys() {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		record, _ := d.PayerRecords.Get(id)
+		if record.UserEmail == email && record.TaxYear == year && record.FormType == formType && !claimed[id] {
+			return record, true
+		}
+	}
+	return PayerRecord{}, false
+}
+
+// syntheticRecord derives plausible form values from a file name.
+func syntheticRecord(fileName, formType string) PayerRecord {
+	h := fnv.New32a()
+	h.Write([]byte(fileName))
+	seed := float64(h.Sum32() % 1000)
+
+	record := PayerRecord{
+		FormType: formType,
+		PayerTIN: fmt.Sprintf("%02d-%07d", 10+int(seed)%89, int(h.Sum32())%10000000),
+	}
+	switch formType {
+	case "W2":
+		record.PayerName = "Employer on " + fileName
+		record.Amount = money.Dollars(40000 + seed*80)
+		record.FederalWithholding = record.Amount.Mul(0.14)
+		record.StateWithholding = record.Amount.Mul(0.05)
+	case string(Form1099INT):
+		record.PayerName = "Bank on " + fileName
+		record.Amount = money.Dollars(50 + seed*2.5)
+	case string(Form1099NEC):
+		record.PayerName = "Client on " + fileName
+		record.Amount = money.Dollars(2000 + seed*25)
+	}
+	return record
+}
+
+func (d *Database) CreateDocument(doc *TaxDocument) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.parseDocument(doc)
+	d.TaxDocuments.Upsert(doc.ID, *doc)
+}
+
+// ImportDocument adds a parsed document's fields to a return as a W-2 or
+// 1099 entry.
+func (d *Database) ImportDocument(returnID, documentID string) (TaxReturn, error) {
+	return d.updateReturn(returnID, func(tr *TaxReturn) error {
+		doc, exists := d.TaxDocuments.Get(documentID)
+		if !exists {
+			return ErrDocumentNotFound
+		}
+		if doc.UserEmail != tr.UserEmail || doc.TaxYear != tr.TaxYear {
+			return ErrDocumentMismatch
+		}
+		if doc.Extracted == nil {
+			return ErrDocumentNotParsed
+		}
+		if doc.ImportedInto != "" {
+			return ErrAlreadyImported
+		}
+
+		switch {
+		case doc.Extracted.W2 != nil:
+			w2 := *doc.Extracted.W2
+			w2.ID = server.NewID("W2")
+			if err := w2.Validate(); err != nil {
+				return err
+			}
+			tr.W2s = append(tr.W2s, w2)
+		case doc.Extracted.Form1099 != nil:
+			form := *doc.Extracted.Form1099
+			form.ID = server.NewID("FORM")
+			if err := form.Validate(); err != nil {
+				return err
+			}
+			tr.Form1099s = append(tr.Form1099s, form)
+		}
+
+		doc.ImportedInto = tr.ID
+		d.TaxDocuments.Upsert(doc.ID, doc)
+		tr.Documents = append(tr.Documents, doc)
+		return nil
+	})
+}
 
-type TaxReturnStatus string
+// Appointment scheduling
 
-const (
-	TaxReturnStatusDraft      TaxReturnStatus = "draft"
-	TaxReturnStatusInProgress TaxReturnStatus = "in_progress"
-	TaxReturnStatusReview     TaxReturnStatus = "under_review"
-	TaxReturnStatusComplete   TaxReturnStatus = "complete"
-	TaxReturnStatusFiled      TaxReturnStatus = "filed"
-)
+const defaultSlotMinutes = 60
 
-type User struct {
-	Email        string       `json:"email"`
-	Name         string       `json:"name"`
-	SSN          string       `json:"ssn"`
-	DateOfBirth  string       `json:"date_of_birth"`
-	FilingStatus FilingStatus `json:"filing_status"`
-	Address      Address      `json:"address"`
-	Phone        string       `json:"phone"`
-	Dependents   []Dependent  `json:"dependents"`
+func (tp TaxProfessional) slotLength() time.Duration {
+	if tp.SlotMinutes <= 0 {
+		return defaultSlotMinutes * time.Minute
+	}
+	return time.Duration(tp.SlotMinutes) * time.Minute
 }
 
-type Address struct {
-	Street  string `json:"street"`
-	City    string `json:"city"`
-	State   string `json:"state"`
-	ZipCode string `json:"zip_code"`
+// profile is the professional without their calendar, as embedded in
+// appointments.
+func (tp TaxProfessional) profile() TaxProfessional {
+	tp.SlotMinutes = 0
+	tp.Availability = nil
+	tp.TimeOff = nil
+	return tp
 }
 
-type Dependent struct {
-	Name         string `json:"name"`
-	SSN          string `json:"ssn"`
-	Relationship string `json:"relationship"`
-	DateOfBirth  string `json:"date_of_birth"`
+// schedule is the professional's calendar: their weekly windows, in UTC,
+// cut into slots, one appointment to each, less their time off.
+func (tp TaxProfessional) schedule() availability.Schedule {
+	rules := make([]availability.Rule, len(tp.Availability))
+	for i, window := range tp.Availability {
+		rules[i] = availability.Rule{Days: []string{window.Weekday}, Start: window.Start, End: window.End}
+	}
+	return availability.Schedule{Rules: rules, Length: tp.slotLength(), Closed: tp.TimeOff}
 }
 
-type TaxDocument struct {
-	ID         string    `json:"id"`
-	Type       string    `json:"type"`
-	TaxYear    int       `json:"tax_year"`
-	FileName   string    `json:"file_name"`
-	UserEmail  string    `json:"user_email"`
-	UploadedAt time.Time `json:"uploaded_at"`
+func (a Appointment) active() bool {
+	return a.Status == AppointmentScheduled || a.Status == AppointmentRescheduled
 }
 
-type TaxProfessional struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Expertise string `json:"expertise"`
-	Years     int    `json:"years_experience"`
+func (a Appointment) end() time.Time {
+	minutes := a.DurationMinutes
+	if minutes <= 0 {
+		minutes = defaultSlotMinutes
+	}
+	return a.DateTime.Add(time.Duration(minutes) * time.Minute)
 }
 
-type Appointment struct {
-	ID              string          `json:"id"`
-	UserEmail       string          `json:"user_email"`
-	TaxProfessional TaxProfessional `json:"tax_professional"`
-	DateTime        time.Time       `json:"datetime"`
-	Type            string          `json:"type"`
-	Status          string          `json:"status"`
-	Notes           string          `json:"notes"`
+// reservation is the time apt takes of its professional's calendar, and of
+// its user's.
+func (a Appointment) reservation() availability.Reservation {
+	return availability.Reservation{
+		ID:       a.ID,
+		Resource: a.TaxProfessional.ID,
+		Party:    a.UserEmail,
+		Start:    a.DateTime,
+		End:      a.end(),
+	}
 }
 
-type TaxReturn struct {
-	ID              string          `json:"id"`
-	UserEmail       string          `json:"user_email"`
-	TaxYear         int             `json:"tax_year"`
-	Status          TaxReturnStatus `json:"status"`
-	FilingType      string          `json:"filing_type"`
-	TotalIncome     float64         `json:"total_income"`
-	TotalDeductions float64         `json:"total_deductions"`
-	TotalTax        float64         `json:"total_tax"`
-	RefundAmount    float64         `json:"refund_amount"`
-	Documents       []TaxDocument   `json:"documents"`
-	CreatedAt       time.Time       `json:"created_at"`
-	UpdatedAt       time.Time       `json:"updated_at"`
+// reservations are the active appointments' times. Callers must hold d.mu.
+func (d *Database) reservations() []availability.Reservation {
+	var reservations []availability.Reservation
+	for _, apt := range d.Appointments.List() {
+		if apt.active() {
+			reservations = append(reservations, apt.reservation())
+		}
+	}
+	return reservations
 }
 
-// Database represents our in-memory database
-type Database struct {
-	Users            map[string]User            `json:"users"`
-	TaxReturns       map[string]TaxReturn       `json:"tax_returns"`
-	TaxDocuments     map[string]TaxDocument     `json:"tax_documents"`
-	Appointments     map[string]Appointment     `json:"appointments"`
-	TaxProfessionals map[string]TaxProfessional `json:"tax_professionals"`
-	mu               sync.RWMutex
+// checkBooking verifies that apt fits the professional's calendar and
+// clashes with no other active appointment for either party. Callers must
+// hold d.mu.
+func (d *Database) checkBooking(apt Appointment, professional TaxProfessional, now time.Time) error {
+	r, taken := apt.reservation(), d.reservations()
+	switch professional.schedule().Check(r, taken, now) {
+	case nil:
+	case availability.ErrPast:
+		return ErrAppointmentInPast
+	case availability.ErrFull:
+		return ErrSlotTaken
+	default:
+		return ErrSlotUnavailable
+	}
+	if _, clash := availability.Conflict(r, taken, now); clash {
+		return ErrUserDoubleBooked
+	}
+	return nil
 }
 
-// Global database instance
-var db *Database
-
-// Database operations
-func (d *Database) GetUser(email string) (User, error) {
+// GetAvailableSlots lists the open slots for a professional over the given
+// number of days starting at from.
+func (d *Database) GetAvailableSlots(professionalID string, from time.Time, days int, now time.Time) ([]Slot, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	professional, exists := d.TaxProfessionals.Get(professionalID)
 	if !exists {
-		return User{}, errors.New("user not found")
+		return nil, ErrProfessionalNotFound
 	}
-	return user, nil
+
+	slots := []Slot{}
+	for _, open := range professional.schedule().Open(professional.ID, from, days, d.reservations(), now) {
+		slots = append(slots, Slot{Start: open.Start, End: open.End})
+	}
+	return slots, nil
 }
 
-func (d *Database) GetTaxReturns(email string) []TaxReturn {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+func (d *Database) CreateAppointment(apt *Appointment, now time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	var returns []TaxReturn
-	for _, tr := range d.TaxReturns {
-		if tr.UserEmail == email {
-			returns = append(returns, tr)
-		}
+	if _, exists := d.Users.Get(apt.UserEmail); !exists {
+		return ErrUserNotFound
+	}
+	professional, exists := d.TaxProfessionals.Get(apt.TaxProfessional.ID)
+	if !exists {
+		return ErrProfessionalNotFound
 	}
-	return returns
-}
 
-func (d *Database) GetTaxDocuments(email string) []TaxDocument {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+	apt.DateTime = apt.DateTime.UTC()
+	apt.TaxProfessional = professional.profile()
+	apt.DurationMinutes = int(professional.slotLength() / time.Minute)
+	apt.Status = AppointmentScheduled
+	if err := d.checkBooking(*apt, professional, now); err != nil {
+		return err
+	}
+	apt.History = append(apt.History, AppointmentEvent{Status: apt.Status, DateTime: apt.DateTime, At: now})
 
-	var docs []TaxDocument
-	for _, doc := range d.TaxDocuments {
-		if doc.UserEmail == email {
-			docs = append(docs, doc)
-		}
+	d.Appointments.Upsert(apt.ID, *apt)
+	return nil
+}
+
+// openAppointment returns an active appointment owned by email. Callers must
+// hold d.mu.
+func (d *Database) openAppointment(id, email string) (Appointment, error) {
+	apt, exists := d.Appointments.Get(id)
+	if !exists {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	if apt.UserEmail != email {
+		return Appointment{}, ErrNotAppointmentOwner
 	}
-	return docs
+	if !apt.active() {
+		return Appointment{}, ErrAppointmentClosed
+	}
+	return apt, nil
 }
 
-func (d *Database) CreateTaxReturn(tr TaxReturn) error {
+func (d *Database) RescheduleAppointment(id, email string, newTime time.Time, now time.Time) (Appointment, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.TaxReturns[tr.ID] = tr
-	return nil
+	apt, err := d.openAppointment(id, email)
+	if err != nil {
+		return Appointment{}, err
+	}
+	if !apt.DateTime.After(now) {
+		return Appointment{}, ErrAppointmentInPast
+	}
+	professional, exists := d.TaxProfessionals.Get(apt.TaxProfessional.ID)
+	if !exists {
+		return Appointment{}, ErrProfessionalNotFound
+	}
+
+	previous := apt.DateTime
+	apt.DateTime = newTime.UTC()
+	apt.DurationMinutes = int(professional.slotLength() / time.Minute)
+	if err := d.checkBooking(apt, professional, now); err != nil {
+		return Appointment{}, err
+	}
+	if err := statemachine.Move(appointmentMachine, &apt, &apt.Status, nil, AppointmentRescheduled, now); err != nil {
+		return Appointment{}, ErrAppointmentClosed
+	}
+	apt.History = append(apt.History, AppointmentEvent{
+		Status:   apt.Status,
+		DateTime: apt.DateTime,
+		At:       now,
+		Note:     "moved from " + previous.Format(time.RFC3339),
+	})
+
+	d.Appointments.Upsert(apt.ID, apt)
+	return apt, nil
 }
 
-func (d *Database) CreateAppointment(apt Appointment) error {
+func (d *Database) CancelAppointment(id, email, reason string, now time.Time) (Appointment, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Appointments[apt.ID] = apt
-	return nil
+	apt, err := d.openAppointment(id, email)
+	if err != nil {
+		return Appointment{}, err
+	}
+	if !apt.DateTime.After(now) {
+		return Appointment{}, ErrAppointmentInPast
+	}
+
+	if err := statemachine.Move(appointmentMachine, &apt, &apt.Status, nil, AppointmentCancelled, now); err != nil {
+		return Appointment{}, ErrAppointmentClosed
+	}
+	apt.History = append(apt.History, AppointmentEvent{
+		Status:   apt.Status,
+		DateTime: apt.DateTime,
+		At:       now,
+		Note:     reason,
+	})
+
+	d.Appointments.Upsert(apt.ID, apt)
+	return apt, nil
 }
 
 // HTTP Handlers
-func getTaxReturns(c *fiber.Ctx) error {
+func (h *handlers) getTaxReturns(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	returns := db.GetTaxReturns(email)
-	return c.JSON(returns)
+	return server.List(c, returns)
 }
 
-func createTaxReturn(c *fiber.Ctx) error {
+func (h *handlers) createTaxReturn(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		TaxYear    int    `json:"tax_year"`
 		FilingType string `json:"filing_type"`
-		UserEmail  string `json:"user_email"`
+		UserEmail  string `json:"user_email" validate:"email"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user exists
-	if _, err := db.GetUser(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+	user, err := db.GetUser(req.UserEmail)
+	if err != nil {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	taxReturn := TaxReturn{
-		ID:         uuid.New().String(),
-		UserEmail:  req.UserEmail,
-		TaxYear:    req.TaxYear,
-		FilingType: req.FilingType,
-		Status:     TaxReturnStatusDraft,
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+		ID:           server.NewID("TRET"),
+		UserEmail:    req.UserEmail,
+		TaxYear:      req.TaxYear,
+		FilingType:   req.FilingType,
+		FilingStatus: user.FilingStatus,
+		Status:       TaxReturnStatusDraft,
+		CreatedAt:    h.clock.Now(),
+		UpdatedAt:    h.clock.Now(),
 	}
 
 	if err := db.CreateTaxReturn(taxReturn); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create tax return",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create tax return")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(taxReturn)
 }
 
-func getTaxDocuments(c *fiber.Ctx) error {
+func (h *handlers) getTaxDocuments(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	docs := db.GetTaxDocuments(email)
-	return c.JSON(docs)
+	return server.List(c, docs)
 }
 
-func uploadTaxDocument(c *fiber.Ctx) error {
-	file, err := c.FormFile("file")
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "No file uploaded",
-		})
-	}
-
+func (h *handlers) uploadTaxDocument(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.FormValue("email")
 	docType := c.FormValue("type")
+	if _, err := db.GetUser(email); err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	now := h.clock.Now()
+	taxYear := now.Year() - 1
+	if value := c.FormValue("tax_year"); value != "" {
+		year, err := strconv.Atoi(value)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "tax_year must be a year")
+		}
+		taxYear = year
+	}
+
+	file, err := server.Upload(c, "file")
+	if err != nil {
+		return err
+	}
 
 	doc := TaxDocument{
-		ID:         uuid.New().String(),
+		ID:         server.NewID("TDOC"),
 		Type:       docType,
-		FileName:   file.Filename,
+		TaxYear:    taxYear,
+		FileName:   file.Name,
 		UserEmail:  email,
-		UploadedAt: time.Now(),
+		UploadedAt: now,
+		File:       &file,
 	}
-
-	// In a real implementation, save the file to storage
-	// For this demo, we'll just save the metadata
-	db.mu.Lock()
-	db.TaxDocuments[doc.ID] = doc
-	db.mu.Unlock()
+	db.CreateDocument(&doc)
 
 	return c.Status(fiber.StatusCreated).JSON(doc)
 }
 
-func getAppointments(c *fiber.Ctx) error {
-	email := c.Query("email")
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+// downloadTaxDocument serves the form a document was uploaded as.
+func (h *handlers) downloadTaxDocument(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	doc, err := db.GetTaxDocument(c.Params("id"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	if doc.File == nil {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "document has no file on record")
 	}
+	return server.ServeFile(c, doc.File.ID, doc.FileName)
+}
 
-	db.mu.RLock()
-	var appointments []Appointment
-	for _, apt := range db.Appointments {
-		if apt.UserEmail == email {
-			appointments = append(appointments, apt)
+func (h *handlers) importPriorYear(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	tr, err := db.ImportPriorYear(c.Params("id"))
+	if err != nil {
+		switch err {
+		case ErrTaxReturnNotFound, ErrNoPriorYearReturn:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrReturnLocked, ErrPriorYearImported:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.FailWith(c, fiber.StatusInternalServerError, err)
 		}
 	}
-	db.mu.RUnlock()
+	return c.JSON(tr)
+}
 
-	return c.JSON(appointments)
+func (h *handlers) importDocument(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	tr, err := db.ImportDocument(c.Params("id"), c.Params("documentId"))
+	if err != nil {
+		return entryError(c, err)
+	}
+	return c.JSON(tr)
 }
 
-func scheduleAppointment(c *fiber.Ctx) error {
-	var req struct {
-		TaxProfessionalID string    `json:"tax_professional_id"`
-		DateTime          time.Time `json:"datetime"`
-		Type              string    `json:"type"`
-		UserEmail         string    `json:"user_email"`
+func entryError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrDocumentMismatch, ErrDocumentNotParsed:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	case ErrAlreadyImported:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrTaxReturnNotFound, ErrEntryNotFound, ErrDocumentNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrReturnLocked:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrInvalidEIN, ErrNegativeAmount, ErrInvalid1099Type, ErrInvalidCategory,
+		ErrMissingName, ErrWithholdingTooHigh:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) addW2(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var w2 W2
+	if err := server.Bind(c, &w2); err != nil {
+		return err
 	}
+	w2.ID = server.NewID("W2")
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	tr, err := db.AddW2(c.Params("id"), w2)
+	if err != nil {
+		return entryError(c, err)
 	}
+	return c.Status(fiber.StatusCreated).JSON(tr)
+}
 
-	// Validate user exists
-	if _, err := db.GetUser(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+func (h *handlers) add1099(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var form Form1099
+	if err := server.Bind(c, &form); err != nil {
+		return err
+	}
+	form.ID = server.NewID("FORM")
+
+	tr, err := db.Add1099(c.Params("id"), form)
+	if err != nil {
+		return entryError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(tr)
+}
+
+func (h *handlers) addDeduction(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var deduction Deduction
+	if err := server.Bind(c, &deduction); err != nil {
+		return err
+	}
+	deduction.ID = server.NewID("DED")
+
+	tr, err := db.AddDeduction(c.Params("id"), deduction)
+	if err != nil {
+		return entryError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(tr)
+}
+
+// removeEntry handles DELETE /tax-returns/:id/{w2s,1099s,deductions}/:entryId.
+func (h *handlers) removeEntry(kind string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		tr, err := db.RemoveEntry(c.Params("id"), kind, c.Params("entryId"))
+		if err != nil {
+			return entryError(c, err)
+		}
+		return c.JSON(tr)
+	}
+}
+
+// EstimateRequest is a quick quote outside of any return. Dependents may be
+// given as counts or as a list, in which case they are counted by age.
+type EstimateRequest struct {
+	TaxYear              int                               `json:"tax_year"`
+	FilingStatus         FilingStatus                      `json:"filing_status"`
+	Wages                money.Money                       `json:"wages"`
+	InterestIncome       money.Money                       `json:"interest_income"`
+	SelfEmploymentIncome money.Money                       `json:"self_employment_income"`
+	Withholding          money.Money                       `json:"withholding"`
+	Deductions           map[DeductionCategory]money.Money `json:"deductions"`
+	QualifyingChildren   int                               `json:"qualifying_children" validate:"gte=0"`
+	OtherDependents      int                               `json:"other_dependents"`
+	Dependents           []Dependent                       `json:"dependents"`
+}
+
+func (r EstimateRequest) taxInput(now time.Time) (TaxInput, error) {
+	in := TaxInput{
+		TaxYear:         r.TaxYear,
+		FilingStatus:    r.FilingStatus,
+		Wages:           r.Wages,
+		InterestIncome:  r.InterestIncome,
+		SelfEmployment:  r.SelfEmploymentIncome,
+		Withholding:     r.Withholding,
+		Deductions:      make(map[DeductionCategory]money.Money),
+		QualifyingKids:  r.QualifyingChildren,
+		OtherDependents: r.OtherDependents,
+	}
+	if in.TaxYear == 0 {
+		in.TaxYear = now.Year() - 1
+	}
+	if in.FilingStatus == "" {
+		in.FilingStatus = FilingStatusSingle
+	}
+	if !filingStatuses[in.FilingStatus] {
+		return TaxInput{}, ErrInvalidFilingStatus
+	}
+	if in.Wages.IsNegative() || in.InterestIncome.IsNegative() || in.SelfEmployment.IsNegative() || in.Withholding.IsNegative() ||
+		in.QualifyingKids < 0 || in.OtherDependents < 0 {
+		return TaxInput{}, ErrNegativeAmount
+	}
+	for category, amount := range r.Deductions {
+		if err := (Deduction{Category: category, Amount: amount}).Validate(); err != nil {
+			return TaxInput{}, err
+		}
+		in.Deductions[category] = amount
+	}
+	if len(r.Dependents) > 0 {
+		in.QualifyingKids, in.OtherDependents = countDependents(r.Dependents, in.TaxYear)
+	}
+	return in, nil
+}
+
+func (h *handlers) estimateTax(c *fiber.Ctx) error {
+	var req EstimateRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	in, err := req.taxInput(h.clock.Now())
+	if err != nil {
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	}
+	return c.JSON(fiber.Map{
+		"input":    in,
+		"estimate": ComputeTax(in),
+	})
+}
+
+type FileReturnRequest struct {
+	PriorYearAGI money.Money `json:"prior_year_agi"`
+}
+
+func (h *handlers) fileTaxReturn(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req FileReturnRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	tr, issues, err := db.FileReturn(c.Params("id"), req.PriorYearAGI)
+	if err != nil {
+		switch err {
+		case ErrTaxReturnNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrAlreadyFiled:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		case ErrIncompleteReturn:
+			return server.FailWith(c, fiber.StatusUnprocessableEntity,
+				server.NewError(server.CodeValidationFailed, err.Error()).WithDetails(fiber.Map{"issues": issues}))
+		default:
+			return server.FailWith(c, fiber.StatusInternalServerError, err)
+		}
+	}
+	return c.Status(fiber.StatusAccepted).JSON(tr)
+}
+
+func (h *handlers) getRefundStatus(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	status, err := db.TrackRefund(c.Params("id"), h.clock.Now())
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return c.JSON(status)
+}
+
+func (h *handlers) getAppointments(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
-	// Validate tax professional exists
 	db.mu.RLock()
-	professional, exists := db.TaxProfessionals[req.TaxProfessionalID]
+	appointments := db.Appointments.By("user_email", email)
 	db.mu.RUnlock()
-	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Tax professional not found",
-		})
+
+	return server.List(c, appointments)
+}
+
+func (h *handlers) scheduleAppointment(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		TaxProfessionalID string    `json:"tax_professional_id"`
+		DateTime          time.Time `json:"datetime"`
+		Type              string    `json:"type"`
+		UserEmail         string    `json:"user_email" validate:"email"`
+		Notes             string    `json:"notes"`
+	}
+
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	appointment := Appointment{
-		ID:              uuid.New().String(),
+		ID:              server.NewID("APPT"),
 		UserEmail:       req.UserEmail,
-		TaxProfessional: professional,
+		TaxProfessional: TaxProfessional{ID: req.TaxProfessionalID},
 		DateTime:        req.DateTime,
 		Type:            req.Type,
-		Status:          "scheduled",
+		Notes:           req.Notes,
 	}
 
-	if err := db.CreateAppointment(appointment); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create appointment",
-		})
+	if err := db.CreateAppointment(&appointment, h.clock.Now()); err != nil {
+		return appointmentError(c, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(appointment)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
+func (h *handlers) rescheduleAppointment(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail string    `json:"user_email" validate:"email"`
+		DateTime  time.Time `json:"datetime"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	appointment, err := db.RescheduleAppointment(c.Params("id"), req.UserEmail, req.DateTime, h.clock.Now())
 	if err != nil {
+		return appointmentError(c, err)
+	}
+	return c.JSON(appointment)
+}
+
+func (h *handlers) cancelAppointment(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail string `json:"user_email" validate:"email"`
+		Reason    string `json:"reason"`
+	}
+	if err := server.Bind(c, &req); err != nil {
 		return err
 	}
 
-	db = &Database{
-		Users:            make(map[string]User),
-		TaxReturns:       make(map[string]TaxReturn),
-		TaxDocuments:     make(map[string]TaxDocument),
-		Appointments:     make(map[string]Appointment),
-		TaxProfessionals: make(map[string]TaxProfessional),
+	appointment, err := db.CancelAppointment(c.Params("id"), req.UserEmail, req.Reason, h.clock.Now())
+	if err != nil {
+		return appointmentError(c, err)
+	}
+	return c.JSON(appointment)
+}
+
+func (h *handlers) getProfessionalSlots(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	now := h.clock.Now().UTC()
+	from := now
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "from must be a date in YYYY-MM-DD format")
+		}
+		from = parsed
+	}
+	days := c.QueryInt("days", 7)
+	if days < 1 || days > 31 {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "days must be between 1 and 31")
+	}
+
+	slots, err := db.GetAvailableSlots(c.Params("id"), from, days, now)
+	if err != nil {
+		return appointmentError(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"tax_professional_id": c.Params("id"),
+		"from":                from.Format("2006-01-02"),
+		"days":                days,
+		"slots":               slots,
+	})
+}
+
+func appointmentError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrUserNotFound, ErrProfessionalNotFound, ErrAppointmentNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNotAppointmentOwner:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrSlotTaken, ErrUserDoubleBooked, ErrAppointmentClosed:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrSlotUnavailable, ErrAppointmentInPast:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update appointment")
+	}
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	return json.Unmarshal(data, db)
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Tax returns routes
-	api.Get("/tax-returns", getTaxReturns)
-	api.Post("/tax-returns", createTaxReturn)
+	api.Get("/tax-returns", h.getTaxReturns)
+	api.Post("/tax-returns", h.createTaxReturn)
 	api.Get("/tax-returns/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		db.mu.RLock()
-		tr, exists := db.TaxReturns[id]
+		tr, exists := db.TaxReturns.Get(id)
 		db.mu.RUnlock()
 		if !exists {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Tax return not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Tax return not found")
 		}
 		return c.JSON(tr)
 	})
 
+	// Income and deduction entry routes
+	api.Post("/tax-returns/:id/w2s", h.addW2)
+	api.Delete("/tax-returns/:id/w2s/:entryId", h.removeEntry("w2s"))
+	api.Post("/tax-returns/:id/1099s", h.add1099)
+	api.Delete("/tax-returns/:id/1099s/:entryId", h.removeEntry("1099s"))
+	api.Post("/tax-returns/:id/deductions", h.addDeduction)
+	api.Delete("/tax-returns/:id/deductions/:entryId", h.removeEntry("deductions"))
+
+	api.Post("/tax-returns/:id/import-prior-year", h.importPriorYear)
+
+	// Estimate routes
+	api.Post("/estimate", h.estimateTax)
+
+	// E-file routes
+	api.Post("/tax-returns/:id/file", h.fileTaxReturn)
+	api.Get("/tax-returns/:id/refund", h.getRefundStatus)
+
 	// Tax documents routes
-	api.Get("/documents", getTaxDocuments)
-	api.Post("/documents", uploadTaxDocument)
+	api.Get("/documents", h.getTaxDocuments)
+	api.Post("/documents", h.uploadTaxDocument)
+	api.Get("/documents/:id/file", h.downloadTaxDocument)
+	api.Post("/tax-returns/:id/documents/:documentId/import", h.importDocument)
 
 	// Appointments routes
-	api.Get("/appointments", getAppointments)
-	api.Post("/appointments", scheduleAppointment)
+	api.Get("/appointments", h.getAppointments)
+	api.Post("/appointments", h.scheduleAppointment)
+	api.Put("/appointments/:id", h.rescheduleAppointment)
+	api.Post("/appointments/:id/cancel", h.cancelAppointment)
+	api.Get("/tax-professionals/:id/slots", h.getProfessionalSlots)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	flag.DurationVar(&irsDelay, "irs-delay", irsDelay, "Simulated time for the IRS to acknowledge an e-filed return")
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
+	db := h.db.Get()
+	db.ProcessEFiles(h.clock.Now())
+	go h.runEFileProcessor(5 * time.Second)
 
-	setupRoutes(app)
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"tax_returns", "tax_documents", "payer_records", "appointments"},
+			Search:  []string{"tax_professionals", "appointments", "tax_documents", "tax_returns"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLinks(appointmentLinks),
+		server.WithFiles(cfg, "application/pdf", "image/jpeg", "image/png"),
+	)
+	setupRoutes(app, h)
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,18 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -75,20 +71,32 @@ type WatchProgress struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users   map[string]User    `json:"users"`
-	Content map[string]Content `json:"content"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users   server.Repository[User]    `json:"users"`
+	Content server.Repository[Content] `json:"content"`
 	mu      sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers serve Hulu's catalog and users' watchlists out of db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users and content in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -99,7 +107,7 @@ func (d *Database) GetContent(id string) (Content, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	content, exists := d.Content[id]
+	content, exists := d.Content.Get(id)
 	if !exists {
 		return Content{}, errors.New("content not found")
 	}
@@ -110,13 +118,13 @@ func (d *Database) AddToWatchlist(email, contentId string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return errors.New("user not found")
 	}
 
 	// Check if content exists
-	if _, exists := d.Content[contentId]; !exists {
+	if _, exists := d.Content.Get(contentId); !exists {
 		return errors.New("content not found")
 	}
 
@@ -128,7 +136,7 @@ func (d *Database) AddToWatchlist(email, contentId string) error {
 	}
 
 	user.Watchlist = append(user.Watchlist, contentId)
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
@@ -136,7 +144,7 @@ func (d *Database) UpdateWatchProgress(email string, progress WatchProgress) err
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return errors.New("user not found")
 	}
@@ -155,20 +163,19 @@ func (d *Database) UpdateWatchProgress(email string, progress WatchProgress) err
 		user.WatchProgress = append(user.WatchProgress, progress)
 	}
 
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
 // HTTP Handlers
-func browseContent(c *fiber.Ctx) error {
+func (h *handlers) browseContent(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	genre := c.Query("genre")
-	page := c.QueryInt("page", 1)
-	pageSize := 20
 
 	var filteredContent []Content
 	db.mu.RLock()
-	for _, content := range db.Content {
+	for _, content := range db.Content.List() {
 		if (category == "" || string(content.Type) == category) &&
 			(genre == "" || content.Genre == genre) {
 			filteredContent = append(filteredContent, content)
@@ -176,45 +183,31 @@ func browseContent(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	// Simple pagination
-	start := (page - 1) * pageSize
-	end := start + pageSize
-	if end > len(filteredContent) {
-		end = len(filteredContent)
-	}
-	if start >= len(filteredContent) {
-		return c.JSON([]Content{})
-	}
-
-	return c.JSON(filteredContent[start:end])
+	return server.List(c, filteredContent, "category", "genre")
 }
 
-func getContentDetails(c *fiber.Ctx) error {
+func (h *handlers) getContentDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	contentId := c.Params("contentId")
 
 	content, err := db.GetContent(contentId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Content not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Content not found")
 	}
 
 	return c.JSON(content)
 }
 
-func getWatchlist(c *fiber.Ctx) error {
+func (h *handlers) getWatchlist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	var watchlistContent []Content
@@ -224,43 +217,37 @@ func getWatchlist(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(watchlistContent)
+	return server.List(c, watchlistContent)
 }
 
-func addToWatchlist(c *fiber.Ctx) error {
+func (h *handlers) addToWatchlist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		Email     string `json:"email"`
+		Email     string `json:"email" validate:"email"`
 		ContentID string `json:"contentId"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	if err := db.AddToWatchlist(req.Email, req.ContentID); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusBadRequest, err)
 	}
 
 	return c.SendStatus(fiber.StatusCreated)
 }
 
-func getContinueWatching(c *fiber.Ctx) error {
+func (h *handlers) getContinueWatching(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	var continueWatching []map[string]interface{}
@@ -289,72 +276,71 @@ func getContinueWatching(c *fiber.Ctx) error {
 	return c.JSON(continueWatching)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:   make(map[string]User),
-		Content: make(map[string]Content),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Content routes
-	api.Get("/content/browse", browseContent)
-	api.Get("/content/:contentId", getContentDetails)
+	api.Get("/content/browse", h.browseContent)
+	api.Get("/content/:contentId", h.getContentDetails)
 
 	// Watchlist routes
-	api.Get("/watchlist", getWatchlist)
-	api.Post("/watchlist", addToWatchlist)
+	api.Get("/watchlist", h.getWatchlist)
+	api.Post("/watchlist", h.addToWatchlist)
 
 	// Continue watching routes
-	api.Get("/continue-watching", getContinueWatching)
+	api.Get("/continue-watching", h.getContinueWatching)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+			Search:  []string{"content"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
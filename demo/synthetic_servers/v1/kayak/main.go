@@ -1,19 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -24,26 +20,26 @@ type Location struct {
 }
 
 type Flight struct {
-	ID             string    `json:"id"`
-	Airline        string    `json:"airline"`
-	FlightNumber   string    `json:"flight_number"`
-	Origin         Location  `json:"origin"`
-	Destination    Location  `json:"destination"`
-	DepartureTime  time.Time `json:"departure_time"`
-	ArrivalTime    time.Time `json:"arrival_time"`
-	Price          float64   `json:"price"`
-	SeatsAvailable int       `json:"seats_available"`
-	Class          string    `json:"class"`
+	ID             string      `json:"id"`
+	Airline        string      `json:"airline"`
+	FlightNumber   string      `json:"flight_number"`
+	Origin         Location    `json:"origin"`
+	Destination    Location    `json:"destination"`
+	DepartureTime  time.Time   `json:"departure_time"`
+	ArrivalTime    time.Time   `json:"arrival_time"`
+	Price          money.Money `json:"price"`
+	SeatsAvailable int         `json:"seats_available"`
+	Class          string      `json:"class"`
 }
 
 type Hotel struct {
-	ID            string   `json:"id"`
-	Name          string   `json:"name"`
-	Location      Location `json:"location"`
-	Rating        float64  `json:"rating"`
-	PricePerNight float64  `json:"price_per_night"`
-	Amenities     []string `json:"amenities"`
-	RoomTypes     []string `json:"room_types"`
+	ID            string      `json:"id"`
+	Name          string      `json:"name"`
+	Location      Location    `json:"location"`
+	Rating        float64     `json:"rating"`
+	PricePerNight money.Money `json:"price_per_night"`
+	Amenities     []string    `json:"amenities"`
+	RoomTypes     []string    `json:"room_types"`
 }
 
 type BookingStatus string
@@ -67,7 +63,7 @@ type Booking struct {
 	Type        BookingType   `json:"type"`
 	Status      BookingStatus `json:"status"`
 	Details     interface{}   `json:"details"`
-	TotalPrice  float64       `json:"total_price"`
+	TotalPrice  money.Money   `json:"total_price"`
 	BookingDate time.Time     `json:"booking_date"`
 }
 
@@ -90,14 +86,28 @@ type Payment struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Flights  map[string]Flight  `json:"flights"`
-	Hotels   map[string]Hotel   `json:"hotels"`
-	Bookings map[string]Booking `json:"bookings"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]    `json:"users"`
+	Flights  server.Repository[Flight]  `json:"flights"`
+	Hotels   server.Repository[Hotel]   `json:"hotels"`
+	Bookings server.Repository[Booking] `json:"bookings"`
 	mu       sync.RWMutex
 }
 
-var db *Database
+// handlers search Kayak flights and hotels and book them, dating bookings by
+// clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the flights, hotels and bookings in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Error definitions
 var (
@@ -113,7 +123,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -124,35 +134,27 @@ func (d *Database) SearchFlights(origin, destination string, departureDate time.
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var results []Flight
-	for _, flight := range d.Flights {
-		if flight.Origin.Airport == origin &&
+	return d.Flights.Query(func(flight Flight) bool {
+		return flight.Origin.Airport == origin &&
 			flight.Destination.Airport == destination &&
-			flight.DepartureTime.Format("2006-01-02") == departureDate.Format("2006-01-02") {
-			results = append(results, flight)
-		}
-	}
-	return results
+			flight.DepartureTime.Format("2006-01-02") == departureDate.Format("2006-01-02")
+	})
 }
 
 func (d *Database) SearchHotels(location string, checkIn, checkOut time.Time) []Hotel {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var results []Hotel
-	for _, hotel := range d.Hotels {
-		if hotel.Location.City == location {
-			results = append(results, hotel)
-		}
-	}
-	return results
+	return d.Hotels.Query(func(hotel Hotel) bool {
+		return hotel.Location.City == location
+	})
 }
 
 func (d *Database) CreateBooking(booking Booking) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Bookings[booking.ID] = booking
+	d.Bookings.Upsert(booking.ID, booking)
 	return nil
 }
 
@@ -160,88 +162,71 @@ func (d *Database) GetUserBookings(email string) []Booking {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var bookings []Booking
-	for _, booking := range d.Bookings {
-		if booking.UserEmail == email {
-			bookings = append(bookings, booking)
-		}
-	}
-	return bookings
+	return d.Bookings.By("user_email", email)
 }
 
 // HTTP Handlers
-func searchFlights(c *fiber.Ctx) error {
+func (h *handlers) searchFlights(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	origin := c.Query("origin")
 	destination := c.Query("destination")
 	departureDate := c.Query("departure_date")
 
 	if origin == "" || destination == "" || departureDate == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Missing required parameters",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Missing required parameters")
 	}
 
 	date, err := time.Parse("2006-01-02", departureDate)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid date format")
 	}
 
 	flights := db.SearchFlights(origin, destination, date)
-	return c.JSON(flights)
+	return server.List(c, flights, "origin", "destination")
 }
 
-func searchHotels(c *fiber.Ctx) error {
+func (h *handlers) searchHotels(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	location := c.Query("location")
 	checkIn := c.Query("check_in")
 	checkOut := c.Query("check_out")
 
 	if location == "" || checkIn == "" || checkOut == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Missing required parameters",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Missing required parameters")
 	}
 
 	checkInDate, err := time.Parse("2006-01-02", checkIn)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid check-in date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid check-in date format")
 	}
 
 	checkOutDate, err := time.Parse("2006-01-02", checkOut)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid check-out date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid check-out date format")
 	}
 
 	hotels := db.SearchHotels(location, checkInDate, checkOutDate)
-	return c.JSON(hotels)
+	return server.List(c, hotels, "location")
 }
 
 type CreateBookingRequest struct {
-	UserEmail     string      `json:"user_email"`
-	Type          BookingType `json:"type"`
-	ItemID        string      `json:"item_id"`
-	PaymentMethod string      `json:"payment_method"`
+	UserEmail     string      `json:"user_email" validate:"required,email"`
+	Type          BookingType `json:"type" validate:"required,oneof=flight hotel"`
+	ItemID        string      `json:"item_id" validate:"required"`
+	PaymentMethod string      `json:"payment_method" validate:"required"`
 }
 
-func createBooking(c *fiber.Ctx) error {
+func (h *handlers) createBooking(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateBookingRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate payment method
@@ -253,145 +238,130 @@ func createBooking(c *fiber.Ctx) error {
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	var details interface{}
-	var totalPrice float64
+	var totalPrice money.Money
 
 	switch req.Type {
 	case BookingTypeFlight:
-		flight, exists := db.Flights[req.ItemID]
+		flight, exists := db.Flights.Get(req.ItemID)
 		if !exists {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Flight not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Flight not found")
 		}
 		details = flight
 		totalPrice = flight.Price
 
 	case BookingTypeHotel:
-		hotel, exists := db.Hotels[req.ItemID]
+		hotel, exists := db.Hotels.Get(req.ItemID)
 		if !exists {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Hotel not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Hotel not found")
 		}
 		details = hotel
 		totalPrice = hotel.PricePerNight // Note: In real implementation, multiply by number of nights
 
 	default:
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid booking type",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid booking type")
 	}
 
 	booking := Booking{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("BKG"),
 		UserEmail:   req.UserEmail,
 		Type:        req.Type,
 		Status:      BookingStatusConfirmed,
 		Details:     details,
 		TotalPrice:  totalPrice,
-		BookingDate: time.Now(),
+		BookingDate: h.clock.Now(),
 	}
 
 	if err := db.CreateBooking(booking); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create booking",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create booking")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(booking)
 }
 
-func getUserBookings(c *fiber.Ctx) error {
+func (h *handlers) getUserBookings(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	// Verify user exists
 	if _, err := db.GetUser(email); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	bookings := db.GetUserBookings(email)
-	return c.JSON(bookings)
+	return server.List(c, bookings)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Flights:  make(map[string]Flight),
-		Hotels:   make(map[string]Hotel),
-		Bookings: make(map[string]Booking),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Flight routes
-	api.Get("/flights/search", searchFlights)
+	api.Get("/flights/search", h.searchFlights)
 
 	// Hotel routes
-	api.Get("/hotels/search", searchHotels)
+	api.Get("/hotels/search", h.searchHotels)
 
 	// Booking routes
-	api.Get("/bookings", getUserBookings)
-	api.Post("/bookings", createBooking)
+	api.Get("/bookings", h.getUserBookings)
+	api.Post("/bookings", h.createBooking)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"bookings"},
+			Search:  []string{"flights", "hotels", "bookings"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"pkg/money"
+	"pkg/server"
+	"pkg/servertest"
+)
+
+const fixture = `{
+  "users": {
+    "ana@example.com": {
+      "email": "ana@example.com",
+      "name": "Ana",
+      "payment_methods": [{"id": "pm_1", "type": "visa", "last4": "4242"}]
+    }
+  },
+  "flights": {
+    "fl_1": {
+      "id": "fl_1",
+      "airline": "Delta",
+      "origin": {"city": "New York", "country": "US", "airport": "JFK"},
+      "destination": {"city": "Los Angeles", "country": "US", "airport": "LAX"},
+      "departure_time": "2025-03-01T08:00:00Z",
+      "arrival_time": "2025-03-01T11:30:00Z",
+      "price": 249.5,
+      "seats_available": 12
+    },
+    "fl_2": {
+      "id": "fl_2",
+      "airline": "United",
+      "origin": {"city": "New York", "country": "US", "airport": "JFK"},
+      "destination": {"city": "Los Angeles", "country": "US", "airport": "LAX"},
+      "departure_time": "2025-03-02T08:00:00Z",
+      "arrival_time": "2025-03-02T11:30:00Z",
+      "price": 199,
+      "seats_available": 3
+    }
+  },
+  "hotels": {
+    "ht_1": {"id": "ht_1", "name": "The Standard", "location": {"city": "Los Angeles"}, "price_per_night": 310}
+  },
+  "bookings": {}
+}`
+
+var now = time.Date(2025, 2, 14, 9, 30, 0, 0, time.UTC)
+
+// newTestApp serves the fixture on a clock stopped at now.
+func newTestApp(t *testing.T) (*fiber.App, *handlers) {
+	t.Helper()
+	h, err := newHandlers(servertest.Store(fixture), servertest.Clock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := servertest.App()
+	setupRoutes(app, h)
+	return app, h
+}
+
+func TestSearchFlights(t *testing.T) {
+	app, _ := newTestApp(t)
+	tests := []struct {
+		query string
+		code  int
+		ids   []string
+	}{
+		{"origin=JFK&destination=LAX&departure_date=2025-03-01", http.StatusOK, []string{"fl_1"}},
+		{"origin=JFK&destination=LAX&departure_date=2025-03-03", http.StatusOK, nil},
+		{"origin=JFK&destination=LAX", http.StatusBadRequest, nil},
+		{"origin=JFK&destination=LAX&departure_date=03/01/2025", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		var page server.Page[Flight]
+		code := servertest.Do(t, app, "GET", "/api/v1/flights/search?"+tt.query, "", &page)
+		if code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.query, code, tt.code)
+			continue
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		var ids []string
+		for _, f := range page.Data {
+			ids = append(ids, f.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+			t.Errorf("%s: got flights %v, want %v", tt.query, ids, tt.ids)
+		}
+	}
+}
+
+func TestCreateBooking(t *testing.T) {
+	app, h := newTestApp(t)
+	var booking Booking
+	code := servertest.Do(t, app, "POST", "/api/v1/bookings",
+		`{"user_email": "ana@example.com", "type": "flight", "item_id": "fl_1", "payment_method": "pm_1"}`, &booking)
+	if code != http.StatusCreated {
+		t.Fatalf("got %d, want %d", code, http.StatusCreated)
+	}
+	if booking.TotalPrice != money.Cents(24950) || booking.Status != BookingStatusConfirmed {
+		t.Errorf("got %s %s, want 249.50 USD confirmed", booking.TotalPrice, booking.Status)
+	}
+	if !booking.BookingDate.Equal(now) {
+		t.Errorf("booked at %v, want the clock's %v", booking.BookingDate, now)
+	}
+	if _, ok := h.db.Get().Bookings.Get(booking.ID); !ok {
+		t.Errorf("booking %s wasn't saved", booking.ID)
+	}
+
+	var page server.Page[Booking]
+	if code := servertest.Do(t, app, "GET", "/api/v1/bookings?email=ana@example.com", "", &page); code != http.StatusOK || page.Total != 1 {
+		t.Errorf("got %d with %d bookings, want 200 with 1", code, page.Total)
+	}
+}
+
+func TestCreateBookingFails(t *testing.T) {
+	app, _ := newTestApp(t)
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"unknown user", `{"user_email": "bo@example.com", "type": "flight", "item_id": "fl_1", "payment_method": "pm_1"}`, http.StatusNotFound},
+		{"someone else's card", `{"user_email": "ana@example.com", "type": "flight", "item_id": "fl_1", "payment_method": "pm_9"}`, http.StatusBadRequest},
+		{"unknown hotel", `{"user_email": "ana@example.com", "type": "hotel", "item_id": "ht_9", "payment_method": "pm_1"}`, http.StatusNotFound},
+		{"bad type", `{"user_email": "ana@example.com", "type": "car", "item_id": "fl_1", "payment_method": "pm_1"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		if code := servertest.Do(t, app, "POST", "/api/v1/bookings", tt.body, nil); code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	app, h := newTestApp(t)
+	reloaded := strings.Replace(fixture, `"price": 199,`, `"price": 179,`, 1)
+	if err := h.loadDatabase(servertest.Store(reloaded)); err != nil {
+		t.Fatal(err)
+	}
+	var page server.Page[Flight]
+	servertest.Do(t, app, "GET", "/api/v1/flights/search?origin=JFK&destination=LAX&departure_date=2025-03-02", "", &page)
+	if len(page.Data) != 1 || page.Data[0].Price != money.Cents(17900) {
+		t.Errorf("got %+v, want fl_2 at the reloaded 179.00", page.Data)
+	}
+}
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 type Book struct {
@@ -41,43 +37,52 @@ type User struct {
 }
 
 type ReadingProgress struct {
-	Email     string    `json:"email"`
+	Email     string    `json:"email" validate:"email"`
 	BookID    string    `json:"book_id"`
 	Progress  int       `json:"progress"`
 	Timestamp time.Time `json:"timestamp"`
 }
 
 type Database struct {
-	Users map[string]User `json:"users"`
-	Books map[string]Book `json:"books"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users server.Repository[User] `json:"users"`
+	Books server.Repository[Book] `json:"books"`
 	mu    sync.RWMutex
 }
 
-var db *Database
+// handlers lend Kindle Unlimited books and track reading, with clock for
+// loans and progress.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+// newHandlers loads the books and users in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
-	db = &Database{
-		Users: make(map[string]User),
-		Books: make(map[string]Book),
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	return json.Unmarshal(data, db)
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	h.db.Set(db)
+	return nil
 }
 
-func getBooks(c *fiber.Ctx) error {
+func (h *handlers) getBooks(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	genre := c.Query("genre")
 	search := c.Query("search")
-	page := c.QueryInt("page", 1)
-	pageSize := 20
 
 	var filteredBooks []Book
 	db.mu.RLock()
-	for _, book := range db.Books {
+	for _, book := range db.Books.List() {
 		if genre != "" && book.Genre != genre {
 			continue
 		}
@@ -88,113 +93,86 @@ func getBooks(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	// Calculate pagination
-	start := (page - 1) * pageSize
-	end := start + pageSize
-	if end > len(filteredBooks) {
-		end = len(filteredBooks)
-	}
-	if start > len(filteredBooks) {
-		start = len(filteredBooks)
-	}
-
-	return c.JSON(fiber.Map{
-		"books": filteredBooks[start:end],
-		"total": len(filteredBooks),
-		"page":  page,
-	})
+	return server.List(c, filteredBooks, "genre")
 }
 
-func getUserLibrary(c *fiber.Ctx) error {
+func (h *handlers) getUserLibrary(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
 	db.mu.RLock()
-	user, exists := db.Users[email]
+	user, exists := db.Users.Get(email)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
-	return c.JSON(user.Library)
+	return server.List(c, user.Library)
 }
 
-func addToLibrary(c *fiber.Ctx) error {
+func (h *handlers) addToLibrary(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	bookID := c.Params("bookId")
 	var req struct {
-		Email string `json:"email"`
+		Email string `json:"email" validate:"email"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	user, exists := db.Users[req.Email]
+	user, exists := db.Users.Get(req.Email)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
-	book, exists := db.Books[bookID]
+	book, exists := db.Books.Get(bookID)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Book not found")
 	}
 
 	// Check if book is already in library
 	for _, lb := range user.Library {
 		if lb.Book.ID == bookID {
-			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-				"error": "Book already in library",
-			})
+			return server.Fail(c, fiber.StatusConflict, server.CodeConflict, "Book already in library")
 		}
 	}
 
 	libraryBook := LibraryBook{
 		Book:            book,
-		AddedDate:       time.Now(),
+		AddedDate:       h.clock.Now(),
 		ReadingProgress: 0,
-		LastRead:        time.Now(),
+		LastRead:        h.clock.Now(),
 	}
 
 	user.Library = append(user.Library, libraryBook)
-	db.Users[req.Email] = user
+	db.Users.Upsert(req.Email, user)
 
 	return c.Status(fiber.StatusCreated).JSON(libraryBook)
 }
 
-func removeFromLibrary(c *fiber.Ctx) error {
+func (h *handlers) removeFromLibrary(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	bookID := c.Params("bookId")
 	email := c.Query("email")
 
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	user, exists := db.Users[email]
+	user, exists := db.Users.Get(email)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	var newLibrary []LibraryBook
@@ -208,54 +186,47 @@ func removeFromLibrary(c *fiber.Ctx) error {
 	}
 
 	if !found {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found in library",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Book not found in library")
 	}
 
 	user.Library = newLibrary
-	db.Users[email] = user
+	db.Users.Upsert(email, user)
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func updateReadingProgress(c *fiber.Ctx) error {
+func (h *handlers) updateReadingProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var progress ReadingProgress
-	if err := c.BodyParser(&progress); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &progress); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	user, exists := db.Users[progress.Email]
+	user, exists := db.Users.Get(progress.Email)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	found := false
 	for i, book := range user.Library {
 		if book.Book.ID == progress.BookID {
 			user.Library[i].ReadingProgress = progress.Progress
-			user.Library[i].LastRead = time.Now()
+			user.Library[i].LastRead = h.clock.Now()
 			found = true
 			break
 		}
 	}
 
 	if !found {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found in library",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Book not found in library")
 	}
 
-	progress.Timestamp = time.Now()
+	progress.Timestamp = h.clock.Now()
 	user.ReadingHistory = append(user.ReadingHistory, progress)
-	db.Users[progress.Email] = user
+	db.Users.Upsert(progress.Email, user)
 
 	return c.JSON(progress)
 }
@@ -264,44 +235,56 @@ func contains(s, substr string) bool {
 	return len(s) >= len(substr) && s[0:len(substr)] == substr
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/books", getBooks)
-	api.Get("/library", getUserLibrary)
-	api.Post("/library/:bookId", addToLibrary)
-	api.Delete("/library/:bookId", removeFromLibrary)
-	api.Post("/reading-progress", updateReadingProgress)
+	api.Get("/books", h.getBooks)
+	api.Get("/library", h.getUserLibrary)
+	api.Post("/library/:bookId", h.addToLibrary)
+	api.Delete("/library/:bookId", h.removeFromLibrary)
+	api.Post("/reading-progress", h.updateReadingProgress)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+			Search:  []string{"books"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
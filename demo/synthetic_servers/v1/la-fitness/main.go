@@ -1,19 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/server"
 )
 
 // Domain Models
@@ -40,11 +36,18 @@ type Location struct {
 	ID        string   `json:"id"`
 	Name      string   `json:"name"`
 	Address   Address  `json:"address"`
+	Timezone  string   `json:"timezone"` // IANA, such as America/Los_Angeles
 	Phone     string   `json:"phone"`
 	Hours     Hours    `json:"hours"`
 	Amenities []string `json:"amenities"`
 }
 
+// location returns the time zone the club keeps, which its classes meet
+// and are listed in.
+func (l Location) location() *time.Location {
+	return geo.Location(l.Timezone)
+}
+
 type FitnessClass struct {
 	ID              string    `json:"id"`
 	Name            string    `json:"name"`
@@ -93,16 +96,29 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users       map[string]User         `json:"users"`
-	Locations   map[string]Location     `json:"locations"`
-	Classes     map[string]FitnessClass `json:"classes"`
-	Bookings    map[string]Booking      `json:"bookings"`
-	Memberships map[string]Membership   `json:"memberships"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users       server.Repository[User]         `json:"users"`
+	Locations   server.Repository[Location]     `json:"locations"`
+	Classes     server.Repository[FitnessClass] `json:"classes"`
+	Bookings    server.Repository[Booking]      `json:"bookings"`
+	Memberships server.Repository[Membership]   `json:"memberships"`
 	mu          sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers sign LA Fitness members up for classes at its locations, dating
+// bookings by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the locations, classes and memberships in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Error definitions
 var (
@@ -119,7 +135,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -130,18 +146,54 @@ func (d *Database) GetLocation(id string) (Location, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	location, exists := d.Locations[id]
+	location, exists := d.Locations.Get(id)
 	if !exists {
 		return Location{}, ErrLocationNotFound
 	}
 	return location, nil
 }
 
+// localize gives clubs without a time zone that of where they are, and puts
+// classes, and bookings' copies of them, in their club's.
+func (d *Database) localize() {
+	for _, id := range d.Locations.Keys() {
+		location, _ := d.Locations.Get(id)
+		if location.Timezone == "" {
+			location.Timezone = geo.ZoneAt(geo.Point{Lat: location.Address.Latitude, Lon: location.Address.Longitude})
+			d.Locations.Upsert(id, location)
+		}
+	}
+	for _, id := range d.Classes.Keys() {
+		class, _ := d.Classes.Get(id)
+		d.Classes.Upsert(id, d.localClass(class))
+	}
+	for _, id := range d.Bookings.Keys() {
+		booking, _ := d.Bookings.Get(id)
+		booking.Class = d.localClass(booking.Class)
+		d.Bookings.Upsert(id, booking)
+	}
+	for _, id := range d.Memberships.Keys() {
+		membership, _ := d.Memberships.Get(id)
+		location, _ := d.Locations.Get(membership.HomeLocation.ID)
+		membership.HomeLocation.Timezone = location.Timezone
+		d.Memberships.Upsert(id, membership)
+	}
+}
+
+// localClass returns class with its times in its club's zone.
+func (d *Database) localClass(class FitnessClass) FitnessClass {
+	location, _ := d.Locations.Get(class.LocationID)
+	loc := location.location()
+	class.StartTime = class.StartTime.In(loc)
+	class.EndTime = class.EndTime.In(loc)
+	return class
+}
+
 func (d *Database) GetClass(id string) (FitnessClass, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	class, exists := d.Classes[id]
+	class, exists := d.Classes.Get(id)
 	if !exists {
 		return FitnessClass{}, ErrClassNotFound
 	}
@@ -152,7 +204,7 @@ func (d *Database) CreateBooking(booking Booking) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	class, exists := d.Classes[booking.Class.ID]
+	class, exists := d.Classes.Get(booking.Class.ID)
 	if !exists {
 		return ErrClassNotFound
 	}
@@ -162,8 +214,8 @@ func (d *Database) CreateBooking(booking Booking) error {
 	}
 
 	class.BookedCount++
-	d.Classes[class.ID] = class
-	d.Bookings[booking.ID] = booking
+	d.Classes.Upsert(class.ID, class)
+	d.Bookings.Upsert(booking.ID, booking)
 	return nil
 }
 
@@ -171,7 +223,7 @@ func (d *Database) GetMembership(email string) (Membership, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	for _, membership := range d.Memberships {
+	for _, membership := range d.Memberships.List() {
 		if membership.UserEmail == email {
 			return membership, nil
 		}
@@ -180,12 +232,11 @@ func (d *Database) GetMembership(email string) (Membership, error) {
 }
 
 // Handlers
-func getClasses(c *fiber.Ctx) error {
+func (h *handlers) getClasses(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	locationID := c.Query("location_id")
 	if locationID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "location_id is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "location_id is required")
 	}
 
 	dateStr := c.Query("date")
@@ -194,112 +245,103 @@ func getClasses(c *fiber.Ctx) error {
 	if dateStr != "" {
 		filterDate, err = time.Parse("2006-01-02", dateStr)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "invalid date format",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid date format")
 		}
 	}
 
+	// The date is the club's: a 9pm class in San Francisco is that day's,
+	// though it starts the next in UTC.
 	var classes []FitnessClass
 	db.mu.RLock()
-	for _, class := range db.Classes {
+	location, _ := db.Locations.Get(locationID)
+	loc := location.location()
+	for _, class := range db.Classes.List() {
 		if class.LocationID == locationID {
-			if dateStr == "" || class.StartTime.Format("2006-01-02") == filterDate.Format("2006-01-02") {
+			if dateStr == "" || geo.LocalDate(class.StartTime, loc) == filterDate.Format(time.DateOnly) {
 				classes = append(classes, class)
 			}
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(classes)
+	return server.List(c, classes, "location_id")
 }
 
-func getBookings(c *fiber.Ctx) error {
+func (h *handlers) getBookings(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	var userBookings []Booking
 	db.mu.RLock()
-	for _, booking := range db.Bookings {
+	for _, booking := range db.Bookings.List() {
 		if booking.UserEmail == email {
 			userBookings = append(userBookings, booking)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userBookings)
+	return server.List(c, userBookings)
 }
 
-func createBooking(c *fiber.Ctx) error {
+func (h *handlers) createBooking(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		ClassID   string `json:"class_id"`
-		UserEmail string `json:"user_email"`
+		UserEmail string `json:"user_email" validate:"email"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Verify user and membership
 	membership, err := db.GetMembership(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusUnauthorized, err)
 	}
 
-	if membership.Status != "active" || membership.EndDate.Before(time.Now()) {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Membership is not active",
-		})
+	if membership.Status != "active" || membership.EndDate.Before(h.clock.Now()) {
+		return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "Membership is not active")
 	}
 
 	// Get class details
 	class, err := db.GetClass(req.ClassID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	booking := Booking{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("BKG"),
 		Class:     class,
 		UserEmail: req.UserEmail,
 		Status:    "confirmed",
-		CreatedAt: time.Now(),
+		CreatedAt: h.clock.Now(),
 	}
 
 	if err := db.CreateBooking(booking); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusBadRequest, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(booking)
 }
 
-func getLocations(c *fiber.Ctx) error {
+func (h *handlers) getLocations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	lat := c.QueryFloat("latitude", 0)
 	lon := c.QueryFloat("longitude", 0)
 
 	if lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "latitude and longitude are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "latitude and longitude are required")
 	}
 
 	var nearbyLocations []Location
 	maxDistance := 25.0 // Maximum radius in km
 
 	db.mu.RLock()
-	for _, location := range db.Locations {
+	for _, location := range db.Locations.List() {
 		distance := calculateDistance(lat, lon,
 			location.Address.Latitude,
 			location.Address.Longitude)
@@ -310,88 +352,91 @@ func getLocations(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(nearbyLocations)
+	return server.List(c, nearbyLocations)
 }
 
-func getMembership(c *fiber.Ctx) error {
+func (h *handlers) getMembership(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	membership, err := db.GetMembership(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(membership)
 }
 
-// Helper functions
+// calculateDistance returns the great-circle distance between two points
+// in km.
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+	return geo.DistanceKm(geo.Point{Lat: lat1, Lon: lon1}, geo.Point{Lat: lat2, Lon: lon2})
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:       make(map[string]User),
-		Locations:   make(map[string]Location),
-		Classes:     make(map[string]FitnessClass),
-		Bookings:    make(map[string]Booking),
-		Memberships: make(map[string]Membership),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	db.localize()
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/classes", getClasses)
-	api.Get("/bookings", getBookings)
-	api.Post("/bookings", createBooking)
-	api.Get("/locations", getLocations)
-	api.Get("/membership", getMembership)
+	api.Get("/classes", h.getClasses)
+	api.Get("/bookings", h.getBookings)
+	api.Post("/bookings", h.createBooking)
+	api.Get("/locations", h.getLocations)
+	api.Get("/membership", h.getMembership)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"bookings", "memberships"},
+			Search:  []string{"locations", "classes", "bookings"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -5,19 +5,14 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -32,8 +27,8 @@ const (
 
 type VaultItem struct {
 	ID            string    `json:"id"`
-	Type          ItemType  `json:"type"`
-	Name          string    `json:"name"`
+	Type          ItemType  `json:"type" validate:"required,oneof=login secure_note credit_card bank_account"`
+	Name          string    `json:"name" validate:"required"`
 	EncryptedData string    `json:"encrypted_data"`
 	LastModified  time.Time `json:"last_modified"`
 }
@@ -56,9 +51,13 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users  map[string]User  `json:"users"`
-	Vaults map[string]Vault `json:"vaults"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users  server.Repository[User]  `json:"users"`
+	Vaults server.Repository[Vault] `json:"vaults"`
 	mu     sync.RWMutex
+	clock  *server.Clock
 }
 
 // Custom errors
@@ -70,8 +69,18 @@ var (
 	ErrUnauthorized  = errors.New("unauthorized")
 )
 
-// Global database instance
-var db *Database
+// handlers guard LastPass vaults, with clock for when items are added and
+// changed.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users and vaults in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Encryption helpers (simplified for demo)
 func encrypt(data []byte, key []byte) (string, error) {
@@ -124,7 +133,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -135,7 +144,7 @@ func (d *Database) GetVault(email string) (Vault, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	vault, exists := d.Vaults[email]
+	vault, exists := d.Vaults.Get(email)
 	if !exists {
 		return Vault{}, ErrVaultNotFound
 	}
@@ -146,14 +155,14 @@ func (d *Database) AddVaultItem(email string, item VaultItem) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	vault, exists := d.Vaults[email]
+	vault, exists := d.Vaults.Get(email)
 	if !exists {
 		return ErrVaultNotFound
 	}
 
 	vault.VaultItems = append(vault.VaultItems, item)
-	vault.LastModified = time.Now()
-	d.Vaults[email] = vault
+	vault.LastModified = d.clock.Now()
+	d.Vaults.Upsert(email, vault)
 
 	return nil
 }
@@ -162,7 +171,7 @@ func (d *Database) UpdateVaultItem(email string, item VaultItem) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	vault, exists := d.Vaults[email]
+	vault, exists := d.Vaults.Get(email)
 	if !exists {
 		return ErrVaultNotFound
 	}
@@ -170,8 +179,8 @@ func (d *Database) UpdateVaultItem(email string, item VaultItem) error {
 	for i, existingItem := range vault.VaultItems {
 		if existingItem.ID == item.ID {
 			vault.VaultItems[i] = item
-			vault.LastModified = time.Now()
-			d.Vaults[email] = vault
+			vault.LastModified = d.clock.Now()
+			d.Vaults.Upsert(email, vault)
 			return nil
 		}
 	}
@@ -183,7 +192,7 @@ func (d *Database) DeleteVaultItem(email string, itemID string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	vault, exists := d.Vaults[email]
+	vault, exists := d.Vaults.Get(email)
 	if !exists {
 		return ErrVaultNotFound
 	}
@@ -191,8 +200,8 @@ func (d *Database) DeleteVaultItem(email string, itemID string) error {
 	for i, item := range vault.VaultItems {
 		if item.ID == itemID {
 			vault.VaultItems = append(vault.VaultItems[:i], vault.VaultItems[i+1:]...)
-			vault.LastModified = time.Now()
-			d.Vaults[email] = vault
+			vault.LastModified = d.clock.Now()
+			d.Vaults.Upsert(email, vault)
 			return nil
 		}
 	}
@@ -201,104 +210,84 @@ func (d *Database) DeleteVaultItem(email string, itemID string) error {
 }
 
 // HTTP Handlers
-func getVault(c *fiber.Ctx) error {
+func (h *handlers) getVault(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	vault, err := db.GetVault(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(vault)
 }
 
-func addVaultItem(c *fiber.Ctx) error {
+func (h *handlers) addVaultItem(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var item VaultItem
-	if err := c.BodyParser(&item); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &item); err != nil {
+		return err
 	}
 
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
-	item.ID = uuid.New().String()
-	item.LastModified = time.Now()
+	item.ID = server.NewID("ITEM")
+	item.LastModified = h.clock.Now()
 
 	if err := db.AddVaultItem(email, item); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(item)
 }
 
-func updateVaultItem(c *fiber.Ctx) error {
+func (h *handlers) updateVaultItem(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	itemID := c.Params("itemId")
 	if itemID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "itemId parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "itemId parameter is required")
 	}
 
 	var item VaultItem
-	if err := c.BodyParser(&item); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &item); err != nil {
+		return err
 	}
 
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	item.ID = itemID
-	item.LastModified = time.Now()
+	item.LastModified = h.clock.Now()
 
 	if err := db.UpdateVaultItem(email, item); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(item)
 }
 
-func deleteVaultItem(c *fiber.Ctx) error {
+func (h *handlers) deleteVaultItem(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	itemID := c.Params("itemId")
 	if itemID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "itemId parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "itemId parameter is required")
 	}
 
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	if err := db.DeleteVaultItem(email, itemID); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.SendStatus(fiber.StatusNoContent)
@@ -315,12 +304,10 @@ type SecurityCheckResponse struct {
 	Suggestions    []string `json:"suggestions"`
 }
 
-func securityCheck(c *fiber.Ctx) error {
+func (h *handlers) securityCheck(c *fiber.Ctx) error {
 	var req SecurityCheckRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Simplified password strength check
@@ -349,67 +336,70 @@ func securityCheck(c *fiber.Ctx) error {
 	return c.JSON(response)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:  make(map[string]User),
-		Vaults: make(map[string]Vault),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Vault routes
-	api.Get("/vault", getVault)
-	api.Post("/vault/items", addVaultItem)
-	api.Put("/vault/items/:itemId", updateVaultItem)
-	api.Delete("/vault/items/:itemId", deleteVaultItem)
+	api.Get("/vault", h.getVault)
+	api.Post("/vault/items", h.addVaultItem)
+	api.Put("/vault/items/:itemId", h.updateVaultItem)
+	api.Delete("/vault/items/:itemId", h.deleteVaultItem)
 
 	// Security routes
-	api.Post("/security-check", securityCheck)
+	api.Post("/security-check", h.securityCheck)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"vaults"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
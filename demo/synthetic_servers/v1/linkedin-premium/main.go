@@ -1,15 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
+
+	"pkg/server"
 )
 
 // Models
@@ -85,30 +83,41 @@ type User struct {
 
 // Database struct
 type Database struct {
-	Users           map[string]User            `json:"users"`
-	ProfileInsights map[string]ProfileInsights `json:"profile_insights"`
-	Jobs            []Job                      `json:"jobs"`
-	Courses         []Course                   `json:"courses"`
-	Leads           []Lead                     `json:"leads"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users           server.Repository[User]            `json:"users"`
+	ProfileInsights server.Repository[ProfileInsights] `json:"profile_insights"`
+	Jobs            []Job                              `json:"jobs"`
+	Courses         []Course                           `json:"courses"`
+	Leads           []Lead                             `json:"leads"`
+}
+
+// handlers show LinkedIn Premium members their insights, jobs, courses and
+// leads from db, which they only read.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
 }
 
-var db Database
+// newHandlers loads the members and their insights from store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Handlers
-func getProfileInsights(c *fiber.Ctx) error {
+func (h *handlers) getProfileInsights(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
 	timeRange := c.Query("timeRange", "30d")
-	insights, exists := db.ProfileInsights[email]
+	insights, exists := db.ProfileInsights.Get(email)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Adjust insights based on time range
@@ -126,19 +135,16 @@ func getProfileInsights(c *fiber.Ctx) error {
 	return c.JSON(insights)
 }
 
-func getJobRecommendations(c *fiber.Ctx) error {
+func (h *handlers) getJobRecommendations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
-	user, exists := db.Users[email]
+	user, exists := db.Users.Get(email)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Filter jobs based on user's skills and experience
@@ -150,22 +156,19 @@ func getJobRecommendations(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(recommendations)
+	return server.List(c, recommendations)
 }
 
-func getLearningCourses(c *fiber.Ctx) error {
+func (h *handlers) getLearningCourses(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
-	user, exists := db.Users[email]
+	user, exists := db.Users.Get(email)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Filter courses based on user's skills and industry
@@ -176,22 +179,19 @@ func getLearningCourses(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(recommendations)
+	return server.List(c, recommendations)
 }
 
-func getNetworkLeads(c *fiber.Ctx) error {
+func (h *handlers) getNetworkLeads(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
-	user, exists := db.Users[email]
+	user, exists := db.Users.Get(email)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Filter leads based on user's industry and company
@@ -202,7 +202,7 @@ func getNetworkLeads(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(relevantLeads)
+	return server.List(c, relevantLeads)
 }
 
 // Helper functions
@@ -226,63 +226,71 @@ func containsAny(slice1, slice2 []string) bool {
 	return false
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
+	if err := server.Load(store, db); err != nil {
 		return err
 	}
-
-	return json.Unmarshal(data, &db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Profile routes
-	api.Get("/profile/insights", getProfileInsights)
+	api.Get("/profile/insights", h.getProfileInsights)
 
 	// Jobs routes
-	api.Get("/jobs/recommendations", getJobRecommendations)
+	api.Get("/jobs/recommendations", h.getJobRecommendations)
 
 	// Learning routes
-	api.Get("/learning/courses", getLearningCourses)
+	api.Get("/learning/courses", h.getLearningCourses)
 
 	// Network routes
-	api.Get("/network/leads", getNetworkLeads)
+	api.Get("/network/leads", h.getNetworkLeads)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Load database
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, nil
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "profile_insights"},
+			Search:  []string{"jobs", "courses", "leads"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
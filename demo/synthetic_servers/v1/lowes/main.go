@@ -1,20 +1,18 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"math"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/geo"
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -23,7 +21,7 @@ type Product struct {
 	Name           string                 `json:"name"`
 	Description    string                 `json:"description"`
 	Category       string                 `json:"category"`
-	Price          float64                `json:"price"`
+	Price          money.Money            `json:"price"`
 	Inventory      int                    `json:"inventory"`
 	Brand          string                 `json:"brand"`
 	ModelNumber    string                 `json:"model_number"`
@@ -43,14 +41,14 @@ type Store struct {
 type CartItem struct {
 	ProductID string  `json:"product_id"`
 	Product   Product `json:"product"`
-	Quantity  int     `json:"quantity"`
+	Quantity  int     `json:"quantity" validate:"gte=0"`
 	StoreID   string  `json:"store_id"`
 }
 
 type Cart struct {
-	UserEmail string     `json:"user_email"`
-	Items     []CartItem `json:"items"`
-	Total     float64    `json:"total"`
+	UserEmail string      `json:"user_email"`
+	Items     []CartItem  `json:"items"`
+	Total     money.Money `json:"total"`
 }
 
 type OrderStatus string
@@ -63,14 +61,32 @@ const (
 	OrderStatusCancelled OrderStatus = "cancelled"
 )
 
+// orderMachine is the statuses a pickup order moves through. It can be
+// cancelled until it is ready.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	string(OrderStatusPending):   {string(OrderStatusConfirmed), string(OrderStatusCancelled)},
+	string(OrderStatusConfirmed): {string(OrderStatusReady), string(OrderStatusCancelled)},
+	string(OrderStatusReady):     {string(OrderStatusPickedUp)},
+}}
+
+// orderLifecycle confirms orders, has them ready for pickup a few hours
+// later and marks them picked up once collected.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: string(OrderStatusPending), To: string(OrderStatusConfirmed), After: 10 * time.Minute},
+	{From: string(OrderStatusConfirmed), To: string(OrderStatusReady), After: 4 * time.Hour,
+		Notify: server.Notice{Type: "order_ready", Message: "Your order {{id}} is ready for pickup.", Text: "delivery_update"}},
+	{From: string(OrderStatusReady), To: string(OrderStatusPickedUp), After: 48 * time.Hour},
+}, Sender: "Lowe's", Machine: orderMachine}
+
 type Order struct {
-	ID        string      `json:"id"`
-	UserEmail string      `json:"user_email"`
-	Items     []CartItem  `json:"items"`
-	Total     float64     `json:"total"`
-	Status    OrderStatus `json:"status"`
-	StoreID   string      `json:"store_id"`
-	CreatedAt time.Time   `json:"created_at"`
+	ID            string                    `json:"id"`
+	UserEmail     string                    `json:"user_email"`
+	Items         []CartItem                `json:"items"`
+	Total         money.Money               `json:"total"`
+	Status        OrderStatus               `json:"status"`
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+	StoreID       string                    `json:"store_id"`
+	CreatedAt     time.Time                 `json:"created_at"`
 }
 
 type User struct {
@@ -84,22 +100,42 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Products map[string]Product `json:"products"`
-	Stores   map[string]Store   `json:"stores"`
-	Carts    map[string]Cart    `json:"carts"`
-	Orders   map[string]Order   `json:"orders"`
-	Users    map[string]User    `json:"users"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Products server.Repository[Product] `json:"products"`
+	Stores   server.Repository[Store]   `json:"stores"`
+	Carts    server.Repository[Cart]    `json:"carts"`
+	Orders   server.Repository[Order]   `json:"orders"`
+	Users    server.Repository[User]    `json:"users"`
 	mu       sync.RWMutex
 }
 
-var db *Database
+// PhoneNumber returns the user's phone number, for texts. Callers must hold
+// d.mu.
+func (d *Database) PhoneNumber(email string) string {
+	user, _ := d.Users.Get(email)
+	return user.Phone
+}
+
+// handlers serve Lowe's products and stores, and users' carts and orders.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the products, stores and orders in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetProduct(id string) (Product, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	product, exists := d.Products[id]
+	product, exists := d.Products.Get(id)
 	if !exists {
 		return Product{}, errors.New("product not found")
 	}
@@ -110,7 +146,7 @@ func (d *Database) GetStore(id string) (Store, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	store, exists := d.Stores[id]
+	store, exists := d.Stores.Get(id)
 	if !exists {
 		return Store{}, errors.New("store not found")
 	}
@@ -121,7 +157,7 @@ func (d *Database) GetCart(email string) (Cart, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	cart, exists := d.Carts[email]
+	cart, exists := d.Carts.Get(email)
 	if !exists {
 		return Cart{UserEmail: email, Items: []CartItem{}}, nil
 	}
@@ -132,12 +168,13 @@ func (d *Database) UpdateCart(cart Cart) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Carts[cart.UserEmail] = cart
+	d.Carts.Upsert(cart.UserEmail, cart)
 	return nil
 }
 
 // HTTP Handlers
-func searchProducts(c *fiber.Ctx) error {
+func (h *handlers) searchProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	query := c.Query("query")
 	category := c.Query("category")
 	storeID := c.Query("store_id")
@@ -145,7 +182,7 @@ func searchProducts(c *fiber.Ctx) error {
 	var results []Product
 
 	db.mu.RLock()
-	for _, product := range db.Products {
+	for _, product := range db.Products.List() {
 		if (query == "" || containsIgnoreCase(product.Name, query) ||
 			containsIgnoreCase(product.Description, query)) &&
 			(category == "" || product.Category == category) {
@@ -165,24 +202,23 @@ func searchProducts(c *fiber.Ctx) error {
 		results = filteredResults
 	}
 
-	return c.JSON(results)
+	return server.List(c, results, "category")
 }
 
-func findNearbyStores(c *fiber.Ctx) error {
+func (h *handlers) findNearbyStores(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	lat := c.QueryFloat("latitude", 0)
 	lon := c.QueryFloat("longitude", 0)
 
 	if lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "latitude and longitude are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "latitude and longitude are required")
 	}
 
 	var nearbyStores []Store
 	maxDistance := 50.0 // Maximum radius in km
 
 	db.mu.RLock()
-	for _, store := range db.Stores {
+	for _, store := range db.Stores.List() {
 		distance := calculateDistance(lat, lon, store.Latitude, store.Longitude)
 		if distance <= maxDistance {
 			nearbyStores = append(nearbyStores, store)
@@ -190,56 +226,46 @@ func findNearbyStores(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(nearbyStores)
+	return server.List(c, nearbyStores)
 }
 
-func getCart(c *fiber.Ctx) error {
+func (h *handlers) getCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	cart, err := db.GetCart(email)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	return c.JSON(cart)
 }
 
-func addToCart(c *fiber.Ctx) error {
+func (h *handlers) addToCart(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var item CartItem
-	if err := c.BodyParser(&item); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &item); err != nil {
+		return err
 	}
 
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	// Get current cart
 	cart, err := db.GetCart(email)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	// Get product details
 	product, err := db.GetProduct(item.ProductID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Product not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Product not found")
 	}
 
 	// Add item to cart
@@ -247,40 +273,40 @@ func addToCart(c *fiber.Ctx) error {
 	cart.Items = append(cart.Items, item)
 
 	// Recalculate total
-	var total float64
+	var total money.Money
 	for _, cartItem := range cart.Items {
-		total += cartItem.Product.Price * float64(cartItem.Quantity)
+		var err error
+		if total, err = total.Add(cartItem.Product.Price.Times(cartItem.Quantity)); err != nil {
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+		}
 	}
 	cart.Total = total
 
 	// Update cart in database
 	if err := db.UpdateCart(cart); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	return c.JSON(cart)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	var userOrders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
+	for _, order := range db.Orders.List() {
 		if order.UserEmail == email {
 			userOrders = append(userOrders, order)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return server.List(c, userOrders)
 }
 
 // Utility functions
@@ -289,97 +315,98 @@ func containsIgnoreCase(s, substr string) bool {
 	return strings.Contains(s, substr)
 }
 
+// calculateDistance returns the great-circle distance between two points
+// in km.
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simple distance calculation (not actual haversine formula)
-	return math.Sqrt(math.Pow(lat2-lat1, 2) + math.Pow(lon2-lon1, 2))
+	return geo.DistanceKm(geo.Point{Lat: lat1, Lon: lon1}, geo.Point{Lat: lat2, Lon: lon2})
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Products: make(map[string]Product),
-		Stores:   make(map[string]Store),
-		Carts:    make(map[string]Cart),
-		Orders:   make(map[string]Order),
-		Users:    make(map[string]User),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Product routes
-	api.Get("/products", searchProducts)
+	api.Get("/products", h.searchProducts)
 	api.Get("/products/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		product, err := db.GetProduct(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(product)
 	})
 
 	// Store routes
-	api.Get("/stores", findNearbyStores)
+	api.Get("/stores", h.findNearbyStores)
 	api.Get("/stores/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
 		store, err := db.GetStore(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(store)
 	})
 
 	// Cart routes
-	api.Get("/cart", getCart)
-	api.Post("/cart", addToCart)
+	api.Get("/cart", h.getCart)
+	api.Post("/cart", h.addToCart)
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
+	api.Get("/orders", h.getUserOrders)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders", "carts"},
+			Search:  []string{"products", "stores", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
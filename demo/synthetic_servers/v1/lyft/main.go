@@ -1,20 +1,19 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
 	"math"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/messaging"
+	"pkg/money"
+	"pkg/payments"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -59,6 +58,10 @@ type PaymentMethod struct {
 	ExpiryYY int    `json:"expiry_yy"`
 }
 
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
+}
+
 type RideType string
 
 const (
@@ -78,19 +81,50 @@ const (
 	RideStatusCancelled  RideStatus = "cancelled"
 )
 
+// rideMachine is the statuses a ride moves through. It can be cancelled
+// until the driver arrives.
+var rideMachine = &statemachine.Machine{Name: "ride", Moves: map[string][]string{
+	string(RideStatusRequested):  {string(RideStatusAccepted), string(RideStatusCancelled)},
+	string(RideStatusAccepted):   {string(RideStatusArrived), string(RideStatusCancelled)},
+	string(RideStatusArrived):    {string(RideStatusInProgress)},
+	string(RideStatusInProgress): {string(RideStatusCompleted)},
+}}
+
+// rideLifecycle finds a driver for each ride, picks the passenger up and
+// drops them off.
+var rideLifecycle = server.Lifecycle{Collection: "rides", Steps: []server.Step{
+	{From: string(RideStatusRequested), To: string(RideStatusAccepted), After: time.Minute},
+	{From: string(RideStatusAccepted), To: string(RideStatusArrived), After: 5 * time.Minute,
+		Notify: server.Notice{Type: "driver_arrived", Message: "Your driver has arrived.", Text: "ride_arriving"}},
+	{From: string(RideStatusArrived), To: string(RideStatusInProgress), After: 2 * time.Minute},
+	{From: string(RideStatusInProgress), To: string(RideStatusCompleted), After: 20 * time.Minute,
+		Notify: server.Notice{Type: "ride_completed", Message: "Your ride {{id}} is complete."}},
+}, Sender: "Lyft", Machine: rideMachine}
+
+// rideLinks lead passengers from a ride to its live updates while it is
+// under way.
+var rideLinks = server.Links{Schema: "Ride", Links: []server.Link{
+	{Rel: "self", Href: "/api/v1/rides/{{id}}"},
+	{Rel: "tracking", Href: "/api/v1/events/stream?type=rides&key={{id}}",
+		Status: []string{string(RideStatusRequested), string(RideStatusAccepted), string(RideStatusArrived), string(RideStatusInProgress)}},
+}}
+
 type Ride struct {
-	ID              string     `json:"id"`
-	UserEmail       string     `json:"user_email"`
-	Driver          *Driver    `json:"driver,omitempty"`
-	PickupLocation  Location   `json:"pickup_location"`
-	DropoffLocation Location   `json:"dropoff_location"`
-	Status          RideStatus `json:"status"`
-	RideType        RideType   `json:"ride_type"`
-	Price           float64    `json:"price"`
-	Distance        float64    `json:"distance"`
-	Duration        int        `json:"duration"` // in minutes
-	CreatedAt       time.Time  `json:"created_at"`
-	UpdatedAt       time.Time  `json:"updated_at"`
+	ID              string                    `json:"id"`
+	UserEmail       string                    `json:"user_email"`
+	Driver          *Driver                   `json:"driver,omitempty"`
+	PickupLocation  Location                  `json:"pickup_location"`
+	DropoffLocation Location                  `json:"dropoff_location"`
+	Status          RideStatus                `json:"status"`
+	StatusHistory   []statemachine.Transition `json:"status_history,omitempty"`
+	RideType        RideType                  `json:"ride_type"`
+	Price           money.Money               `json:"price"`
+	Distance        float64                   `json:"distance"`
+	Duration        int                       `json:"duration"`                  // in minutes
+	ChargeID        string                    `json:"charge_id,omitempty"`       // Holds the top of the estimate until the ride is completed
+	ConversationID  string                    `json:"conversation_id,omitempty"` // With the driver, once the ride is accepted
+	CreatedAt       time.Time                 `json:"created_at"`
+	UpdatedAt       time.Time                 `json:"updated_at"`
 }
 
 type RideEstimate struct {
@@ -98,29 +132,108 @@ type RideEstimate struct {
 	EstimatedPrice    Price    `json:"estimated_price"`
 	EstimatedDuration int      `json:"estimated_duration"` // in minutes
 	EstimatedDistance float64  `json:"estimated_distance"` // in miles
+	SurgeMultiplier   float64  `json:"surge_multiplier,omitempty"`
 }
 
 type Price struct {
-	MinAmount float64 `json:"min_amount"`
-	MaxAmount float64 `json:"max_amount"`
-	Currency  string  `json:"currency"`
+	MinAmount money.Money `json:"min_amount"`
+	MaxAmount money.Money `json:"max_amount"`
+	Currency  string      `json:"currency"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users   map[string]User   `json:"users"`
-	Drivers map[string]Driver `json:"drivers"`
-	Rides   map[string]Ride   `json:"rides"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+	server.Messaging
+
+	Users   server.Repository[User]   `json:"users"`
+	Drivers server.Repository[Driver] `json:"drivers"`
+	Rides   server.Repository[Ride]   `json:"rides"`
 	mu      sync.RWMutex
 }
 
+// PhoneNumber returns the user's phone number, for texts. Callers must hold
+// d.mu.
+func (d *Database) PhoneNumber(email string) string {
+	user, _ := d.Users.Get(email)
+	return user.Phone
+}
+
+// Stepped puts the passenger in touch with their driver once a ride is
+// accepted, finding the nearest one if the ride hasn't one yet. It takes
+// the price of a ride once it is completed, or releases the hold if the
+// ride is cancelled, and frees its driver and ends the chat either way.
+// Callers must hold d.mu for writing.
+func (d *Database) Stepped(collection, key, from, to string) {
+	ride, ok := d.Rides.Get(key)
+	if collection != "rides" || !ok {
+		return
+	}
+	switch RideStatus(to) {
+	case RideStatusAccepted:
+		if ride.Driver == nil {
+			if nearby := d.nearbyDrivers(ride.PickupLocation); len(nearby) > 0 {
+				driver := nearestDriver(ride.PickupLocation, nearby)
+				ride.Driver = &driver
+			}
+		}
+		if ride.Driver != nil {
+			passenger, _ := d.Users.Get(ride.UserEmail)
+			chat := d.Open(messaging.About{Kind: "ride", ID: ride.ID},
+				messaging.Participant{ID: ride.UserEmail, Role: "passenger", Name: passenger.Name},
+				messaging.Participant{ID: ride.Driver.ID, Role: "driver", Name: ride.Driver.Name})
+			d.Send(chat.ID, ride.Driver.ID, "Hi, this is "+ride.Driver.Name+". I'm on my way to pick you up.")
+			ride.ConversationID = chat.ID
+		}
+		d.Rides.Upsert(key, ride)
+	case RideStatusCompleted:
+		d.Close(messaging.About{Kind: "ride", ID: ride.ID})
+		d.freeDriver(ride)
+		if ride.ChargeID != "" {
+			d.Capture(ride.ChargeID, ride.Price)
+		}
+	case RideStatusCancelled:
+		d.Close(messaging.About{Kind: "ride", ID: ride.ID})
+		d.freeDriver(ride)
+		if ride.ChargeID != "" {
+			d.Void(ride.ChargeID)
+		}
+	}
+}
+
+// freeDriver makes the driver the v2 profile assigned a ride available
+// again. Callers must hold d.mu for writing.
+func (d *Database) freeDriver(ride Ride) {
+	if ride.Driver == nil || server.Profile() != "v2" {
+		return
+	}
+	if driver, ok := d.Drivers.Get(ride.Driver.ID); ok {
+		driver.IsAvailable = true
+		d.Drivers.Upsert(driver.ID, driver)
+	}
+}
+
 var (
-	db                *Database
 	ErrUserNotFound   = errors.New("user not found")
 	ErrDriverNotFound = errors.New("driver not found")
 	ErrRideNotFound   = errors.New("ride not found")
 )
 
+// handlers request Lyft rides and match them to drivers, timing each ride by
+// clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users, drivers and rides in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
 // Helper functions
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
 	const earthRadius = 3959.0 // miles
@@ -139,7 +252,7 @@ func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
 	return earthRadius * c
 }
 
-func estimatePrice(distance float64, rideType RideType) Price {
+func estimatePrice(distance float64, rideType RideType, now time.Time) Price {
 	var baseRate, perMileRate float64
 
 	switch rideType {
@@ -154,23 +267,69 @@ func estimatePrice(distance float64, rideType RideType) Price {
 		perMileRate = 3.50
 	}
 
-	estimatedPrice := baseRate + (distance * perMileRate)
+	estimatedPrice := (baseRate + (distance * perMileRate)) * surgeMultiplier(now)
 	// Add 20% variance for min/max
 	return Price{
-		MinAmount: math.Floor(estimatedPrice*0.9*100) / 100,
-		MaxAmount: math.Ceil(estimatedPrice*1.1*100) / 100,
+		MinAmount: money.Dollars(math.Floor(estimatedPrice*0.9*100) / 100),
+		MaxAmount: money.Dollars(math.Ceil(estimatedPrice*1.1*100) / 100),
 		Currency:  "USD",
 	}
 }
 
-func findNearbyDrivers(location Location, rideType RideType) []Driver {
+// Surge pricing, which --rules surge_hours=... and surge_multiplier=...
+// override: in the v2 profile, fares are 1.5 times as much in the evening
+// rush, from 4 to 8pm, and late at night, from 10pm to 3am.
+var (
+	surgeHours server.Hours // Set from defaultSurgeHours in main
+	surge      = 1.5
+)
+
+// defaultSurgeHours are the surgeHours unless --rules say otherwise.
+const defaultSurgeHours = "16-20,22-3"
+
+// surgeMultiplier is what fares are multiplied by at a time: surge in the
+// v2 profile's surgeHours, and otherwise 1.
+func surgeMultiplier(t time.Time) float64 {
+	if server.Profile() != "v2" {
+		return 1
+	}
+	if surgeHours.Contain(t) {
+		return surge
+	}
+	return 1
+}
+
+// nearestDriver returns the one of drivers nearest to location.
+func nearestDriver(location Location, drivers []Driver) Driver {
+	nearest := drivers[0]
+	minDistance := math.MaxFloat64
+	for _, driver := range drivers {
+		distance := calculateDistance(
+			location.Latitude,
+			location.Longitude,
+			driver.CurrentLocation.Latitude,
+			driver.CurrentLocation.Longitude,
+		)
+		if distance < minDistance {
+			nearest, minDistance = driver, distance
+		}
+	}
+	return nearest
+}
+
+func (d *Database) findNearbyDrivers(location Location, rideType RideType) []Driver {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.nearbyDrivers(location)
+}
+
+// nearbyDrivers returns the available drivers within five miles of
+// location. Callers must hold d.mu.
+func (d *Database) nearbyDrivers(location Location) []Driver {
 	const maxDistance = 5.0 // miles
 	var nearbyDrivers []Driver
 
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
-	for _, driver := range db.Drivers {
+	for _, driver := range d.Drivers.List() {
 		if !driver.IsAvailable {
 			continue
 		}
@@ -191,7 +350,7 @@ func findNearbyDrivers(location Location, rideType RideType) []Driver {
 }
 
 // Handlers
-func getRideEstimate(c *fiber.Ctx) error {
+func (h *handlers) getRideEstimate(c *fiber.Ctx) error {
 	pickup := Location{
 		Latitude:  c.QueryFloat("pickup_latitude", 0),
 		Longitude: c.QueryFloat("pickup_longitude", 0),
@@ -202,9 +361,7 @@ func getRideEstimate(c *fiber.Ctx) error {
 	}
 
 	if pickup.Latitude == 0 || pickup.Longitude == 0 || dropoff.Latitude == 0 || dropoff.Longitude == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid coordinates",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid coordinates")
 	}
 
 	distance := calculateDistance(
@@ -218,69 +375,115 @@ func getRideEstimate(c *fiber.Ctx) error {
 	estimates := []RideEstimate{
 		{
 			RideType:          RideTypeStandard,
-			EstimatedPrice:    estimatePrice(distance, RideTypeStandard),
+			EstimatedPrice:    estimatePrice(distance, RideTypeStandard, h.clock.Now()),
 			EstimatedDuration: int(distance * 3), // Rough estimate: 20mph average
 			EstimatedDistance: math.Round(distance*100) / 100,
 		},
 		{
 			RideType:          RideTypeXL,
-			EstimatedPrice:    estimatePrice(distance, RideTypeXL),
+			EstimatedPrice:    estimatePrice(distance, RideTypeXL, h.clock.Now()),
 			EstimatedDuration: int(distance * 3),
 			EstimatedDistance: math.Round(distance*100) / 100,
 		},
 		{
 			RideType:          RideTypeLux,
-			EstimatedPrice:    estimatePrice(distance, RideTypeLux),
+			EstimatedPrice:    estimatePrice(distance, RideTypeLux, h.clock.Now()),
 			EstimatedDuration: int(distance * 3),
 			EstimatedDistance: math.Round(distance*100) / 100,
 		},
 	}
 
-	return c.JSON(estimates)
+	return server.List(c, estimates)
 }
 
-func requestRide(c *fiber.Ctx) error {
+// estimateRide estimates the fare of one ride type, with the surge
+// multiplier at the time, as Lyft's v2 API did.
+func (h *handlers) estimateRide(c *fiber.Ctx) error {
 	var req struct {
-		UserEmail       string   `json:"user_email"`
+		PickupLocation  Location `json:"pickup_location"`
+		DropoffLocation Location `json:"dropoff_location"`
+		RideType        RideType `json:"ride_type"`
+	}
+
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	distance := calculateDistance(
+		req.PickupLocation.Latitude,
+		req.PickupLocation.Longitude,
+		req.DropoffLocation.Latitude,
+		req.DropoffLocation.Longitude,
+	)
+
+	return c.JSON(RideEstimate{
+		RideType:          req.RideType,
+		EstimatedPrice:    estimatePrice(distance, req.RideType, h.clock.Now()),
+		EstimatedDuration: int(distance * 3),
+		EstimatedDistance: math.Round(distance*100) / 100,
+		SurgeMultiplier:   surgeMultiplier(h.clock.Now()),
+	})
+}
+
+// getNearbyDrivers lists the available drivers within five miles of a
+// place.
+func (h *handlers) getNearbyDrivers(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	location := Location{
+		Latitude:  c.QueryFloat("latitude", 0),
+		Longitude: c.QueryFloat("longitude", 0),
+	}
+
+	if location.Latitude == 0 || location.Longitude == 0 {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "latitude and longitude are required")
+	}
+
+	return server.List(c, db.findNearbyDrivers(location, ""))
+}
+
+func (h *handlers) requestRide(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail       string   `json:"user_email" validate:"email"`
 		PickupLocation  Location `json:"pickup_location"`
 		DropoffLocation Location `json:"dropoff_location"`
 		RideType        RideType `json:"ride_type"`
 		PaymentMethodID string   `json:"payment_method_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user and payment method
-	user, exists := db.Users[req.UserEmail]
+	user, exists := db.Users.Get(req.UserEmail)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
-	validPayment := false
-	for _, pm := range user.PaymentMethods {
+	var method *PaymentMethod
+	for i, pm := range user.PaymentMethods {
 		if pm.ID == req.PaymentMethodID {
-			validPayment = true
+			method = &user.PaymentMethods[i]
 			break
 		}
 	}
-	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+	if method == nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Find nearby drivers
-	nearbyDrivers := findNearbyDrivers(req.PickupLocation, req.RideType)
+	nearbyDrivers := db.findNearbyDrivers(req.PickupLocation, req.RideType)
 	if len(nearbyDrivers) == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "No available drivers nearby",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "No available drivers nearby")
+	}
+
+	// The v2 profile assigns the nearest of them up front
+	var driver *Driver
+	if server.Profile() == "v2" {
+		nearest := nearestDriver(req.PickupLocation, nearbyDrivers)
+		nearest.IsAvailable = false
+		driver = &nearest
 	}
 
 	// Calculate ride details
@@ -291,12 +494,34 @@ func requestRide(c *fiber.Ctx) error {
 		req.DropoffLocation.Longitude,
 	)
 
-	price := estimatePrice(distance, req.RideType)
+	price := estimatePrice(distance, req.RideType, h.clock.Now())
+	id := server.NewID("RIDE")
+
+	// Hold the top of the estimate on the card until the ride is completed
+	db.mu.Lock()
+	charge, err := db.Authorize(c, server.ChargeRequest{
+		UserEmail:       req.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          price.MaxAmount,
+		Description:     "Ride " + id,
+	})
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if server.Chaos(c, server.ChaosDriverDeclined) {
+		db.mu.Lock()
+		db.Void(charge.ID)
+		db.mu.Unlock()
+		return server.Fail(c, fiber.StatusConflict, server.CodeConflict, "The driver declined your ride; please request again")
+	}
 
 	// Create new ride
 	ride := Ride{
-		ID:              uuid.New().String(),
+		ID:              id,
 		UserEmail:       req.UserEmail,
+		Driver:          driver,
 		PickupLocation:  req.PickupLocation,
 		DropoffLocation: req.DropoffLocation,
 		Status:          RideStatusRequested,
@@ -304,109 +529,131 @@ func requestRide(c *fiber.Ctx) error {
 		Price:           price.MinAmount,
 		Distance:        distance,
 		Duration:        int(distance * 3),
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
+		ChargeID:        charge.ID,
+		CreatedAt:       h.clock.Now(),
+		UpdatedAt:       h.clock.Now(),
 	}
 
 	// Save ride to database
 	db.mu.Lock()
-	db.Rides[ride.ID] = ride
+	db.Rides.Upsert(ride.ID, ride)
+	if driver != nil {
+		db.Drivers.Upsert(driver.ID, *driver)
+	}
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(ride)
 }
 
-func getRideHistory(c *fiber.Ctx) error {
+func (h *handlers) getRideHistory(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
 	var userRides []Ride
 	db.mu.RLock()
-	for _, ride := range db.Rides {
+	for _, ride := range db.Rides.List() {
 		if ride.UserEmail == email {
 			userRides = append(userRides, ride)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userRides)
+	return server.List(c, userRides)
 }
 
-func getRideDetails(c *fiber.Ctx) error {
+func (h *handlers) getRideDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	rideID := c.Params("rideId")
 
 	db.mu.RLock()
-	ride, exists := db.Rides[rideID]
+	ride, exists := db.Rides.Get(rideID)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Ride not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Ride not found")
 	}
 
 	return c.JSON(ride)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:   make(map[string]User),
-		Drivers: make(map[string]Driver),
-		Rides:   make(map[string]Ride),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Ride estimation
-	api.Get("/rides/estimate", getRideEstimate)
+	api.Get("/rides/estimate", h.getRideEstimate)
 
 	// Ride management
-	api.Post("/rides", requestRide)
-	api.Get("/rides", getRideHistory)
-	api.Get("/rides/:rideId", getRideDetails)
+	api.Post("/rides", h.requestRide)
+	api.Get("/rides", h.getRideHistory)
+	api.Get("/rides/:rideId", h.getRideDetails)
+
+	// Lyft's v2 API estimates one ride type at a time, and finds drivers
+	if server.Profile() == "v2" {
+		api.Post("/rides/estimate", h.estimateRide)
+		api.Get("/drivers/nearby", h.getNearbyDrivers)
+	}
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/openapi -profile v2 -o openapi.v2.json
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	surgeHours = cfg.RuleHours("surge_hours", defaultSurgeHours)
+	surge = cfg.Rule("surge_multiplier", surge)
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	setupRoutes(app)
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"rides"},
+			Search:  []string{"rides"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, rideLifecycle),
+		server.WithLinks(rideLinks),
+		server.WithChaos(cfg),
+		server.WithProfiles("v2"),
+	)
+	setupRoutes(app, h)
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,18 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -27,18 +24,18 @@ type Lesson struct {
 }
 
 type Course struct {
-	ID          string    `json:"id"`
-	Title       string    `json:"title"`
-	Instructor  string    `json:"instructor"`
-	Category    string    `json:"category"`
-	Description string    `json:"description"`
-	Duration    int       `json:"duration"` // total minutes
-	Lessons     []Lesson  `json:"lessons"`
-	Price       float64   `json:"price"`
-	Rating      float64   `json:"rating"`
-	Students    int       `json:"students"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID          string      `json:"id"`
+	Title       string      `json:"title"`
+	Instructor  string      `json:"instructor"`
+	Category    string      `json:"category"`
+	Description string      `json:"description"`
+	Duration    int         `json:"duration"` // total minutes
+	Lessons     []Lesson    `json:"lessons"`
+	Price       money.Money `json:"price"`
+	Rating      float64     `json:"rating"`
+	Students    int         `json:"students"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
 }
 
 type User struct {
@@ -58,10 +55,14 @@ type CourseProgress struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users          map[string]User                      `json:"users"`
-	Courses        map[string]Course                    `json:"courses"`
-	CourseProgress map[string]map[string]CourseProgress `json:"course_progress"` // userEmail -> courseId -> progress
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users          server.Repository[User]                      `json:"users"`
+	Courses        server.Repository[Course]                    `json:"courses"`
+	CourseProgress server.Repository[map[string]CourseProgress] `json:"course_progress"` // userEmail -> courseId -> progress
 	mu             sync.RWMutex
+	clock          *server.Clock
 }
 
 // Custom errors
@@ -72,15 +73,25 @@ var (
 	ErrNotEnrolled    = errors.New("user not enrolled in course")
 )
 
-// Global database instance
-var db *Database
+// handlers serve MasterClass courses and each member's progress through
+// them.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the courses and progress in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -91,7 +102,7 @@ func (d *Database) GetCourse(id string) (Course, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	course, exists := d.Courses[id]
+	course, exists := d.Courses.Get(id)
 	if !exists {
 		return Course{}, ErrCourseNotFound
 	}
@@ -102,7 +113,7 @@ func (d *Database) GetUserProgress(email, courseId string) (CourseProgress, erro
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	userProgress, exists := d.CourseProgress[email]
+	userProgress, exists := d.CourseProgress.Get(email)
 	if !exists {
 		return CourseProgress{}, ErrUserNotFound
 	}
@@ -120,11 +131,12 @@ func (d *Database) UpdateProgress(email, courseId, lessonId string) error {
 	defer d.mu.Unlock()
 
 	// Initialize maps if they don't exist
-	if d.CourseProgress[email] == nil {
-		d.CourseProgress[email] = make(map[string]CourseProgress)
+	userProgress, _ := d.CourseProgress.Get(email)
+	if userProgress == nil {
+		userProgress = make(map[string]CourseProgress)
 	}
 
-	progress := d.CourseProgress[email][courseId]
+	progress := userProgress[courseId]
 
 	// Add lesson to completed lessons if not already completed
 	found := false
@@ -140,27 +152,29 @@ func (d *Database) UpdateProgress(email, courseId, lessonId string) error {
 	}
 
 	// Update progress percentage
-	course, exists := d.Courses[courseId]
+	course, exists := d.Courses.Get(courseId)
 	if !exists {
 		return ErrCourseNotFound
 	}
 
 	progress.Progress = float64(len(progress.CompletedLessons)) / float64(len(course.Lessons)) * 100
-	progress.LastAccessed = time.Now()
+	progress.LastAccessed = d.clock.Now()
 
-	d.CourseProgress[email][courseId] = progress
+	userProgress[courseId] = progress
+	d.CourseProgress.Upsert(email, userProgress)
 	return nil
 }
 
 // HTTP Handlers
-func getCourses(c *fiber.Ctx) error {
+func (h *handlers) getCourses(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	instructor := c.Query("instructor")
 
 	var filteredCourses []Course
 
 	db.mu.RLock()
-	for _, course := range db.Courses {
+	for _, course := range db.Courses.List() {
 		if (category == "" || course.Category == category) &&
 			(instructor == "" || course.Instructor == instructor) {
 			filteredCourses = append(filteredCourses, course)
@@ -168,78 +182,71 @@ func getCourses(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(filteredCourses)
+	return server.List(c, filteredCourses, "instructor", "category")
 }
 
-func getCourseDetails(c *fiber.Ctx) error {
+func (h *handlers) getCourseDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	courseId := c.Params("courseId")
 
 	course, err := db.GetCourse(courseId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(course)
 }
 
-func getUserProgress(c *fiber.Ctx) error {
+func (h *handlers) getUserProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var progress []CourseProgress
 	db.mu.RLock()
+	userProgress, _ := db.CourseProgress.Get(email)
 	for courseId := range user.EnrolledCourses {
-		if p, exists := db.CourseProgress[email][courseId]; exists {
+		if p, exists := userProgress[courseId]; exists {
+
 			progress = append(progress, p)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(progress)
+	return server.List(c, progress)
 }
 
 type CompleteLessonRequest struct {
-	Email    string `json:"email"`
+	Email    string `json:"email" validate:"email"`
 	CourseId string `json:"courseId"`
 }
 
-func completeLesson(c *fiber.Ctx) error {
+func (h *handlers) completeLesson(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	lessonId := c.Params("lessonId")
 
 	var req CompleteLessonRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Verify user exists and is enrolled in course
 	user, err := db.GetUser(req.Email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	if _, enrolled := user.EnrolledCourses[req.CourseId]; !enrolled {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": ErrNotEnrolled.Error(),
-		})
+		return server.FailWith(c, fiber.StatusForbidden, ErrNotEnrolled)
 	}
 
 	// Update progress
 	if err := db.UpdateProgress(req.Email, req.CourseId, lessonId); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	// Get updated progress
@@ -247,65 +254,70 @@ func completeLesson(c *fiber.Ctx) error {
 	return c.JSON(progress)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:          make(map[string]User),
-		Courses:        make(map[string]Course),
-		CourseProgress: make(map[string]map[string]CourseProgress),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Course routes
-	api.Get("/courses", getCourses)
-	api.Get("/courses/:courseId", getCourseDetails)
+	api.Get("/courses", h.getCourses)
+	api.Get("/courses/:courseId", h.getCourseDetails)
 
 	// Progress routes
-	api.Get("/users/:email/progress", getUserProgress)
-	api.Post("/lessons/:lessonId/complete", completeLesson)
+	api.Get("/users/:email/progress", h.getUserProgress)
+	api.Post("/lessons/:lessonId/complete", h.completeLesson)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "course_progress"},
+			Search:  []string{"courses"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,18 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/server"
 )
 
 // Domain Models
@@ -51,7 +48,7 @@ type Profile struct {
 
 type Like struct {
 	ID        string    `json:"id"`
-	FromEmail string    `json:"from_email"`
+	FromEmail string    `json:"from_email" validate:"email"`
 	ToID      string    `json:"to_profile_id"`
 	Action    string    `json:"action"` // "like" or "pass"
 	CreatedAt time.Time `json:"created_at"`
@@ -74,10 +71,14 @@ type Conversation struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Profiles      map[string]Profile      `json:"profiles"`
-	Likes         map[string]Like         `json:"likes"`
-	Conversations map[string]Conversation `json:"conversations"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Profiles      server.Repository[Profile]      `json:"profiles"`
+	Likes         server.Repository[Like]         `json:"likes"`
+	Conversations server.Repository[Conversation] `json:"conversations"`
 	mu            sync.RWMutex
+	clock         *server.Clock
 }
 
 var (
@@ -86,14 +87,28 @@ var (
 	ErrInvalidInput    = errors.New("invalid input")
 )
 
-var db *Database
+// handlers match Match.com profiles through likes and conversations in db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the profiles, likes and conversations in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetProfile(email string) (Profile, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
+	return d.profile(email)
+}
 
-	for _, profile := range d.Profiles {
+// profile finds the profile of email; the caller holds d.mu.
+func (d *Database) profile(email string) (Profile, error) {
+	for _, profile := range d.Profiles.List() {
 		if profile.Email == email {
 			return profile, nil
 		}
@@ -101,82 +116,75 @@ func (d *Database) GetProfile(email string) (Profile, error) {
 	return Profile{}, ErrProfileNotFound
 }
 
-func (d *Database) UpdateProfile(email string, updates map[string]interface{}) error {
+// ProfileUpdate is the fields of a profile PUT /profile changes; those
+// left out stay as they are.
+type ProfileUpdate struct {
+	Bio         *string      `json:"bio"`
+	Interests   []string     `json:"interests"`
+	Preferences *Preferences `json:"preferences"`
+}
+
+func (d *Database) UpdateProfile(email string, updates ProfileUpdate) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	profile, err := d.GetProfile(email)
+	profile, err := d.profile(email)
 	if err != nil {
 		return err
 	}
 
 	// Apply updates
-	if bio, ok := updates["bio"].(string); ok {
-		profile.Bio = bio
+	if updates.Bio != nil {
+		profile.Bio = *updates.Bio
 	}
-	if interests, ok := updates["interests"].([]string); ok {
-		profile.Interests = interests
+	if updates.Interests != nil {
+		profile.Interests = updates.Interests
 	}
-	if prefs, ok := updates["preferences"].(Preferences); ok {
-		profile.Preferences = prefs
+	if updates.Preferences != nil {
+		profile.Preferences = *updates.Preferences
 	}
 
-	profile.UpdatedAt = time.Now()
-	d.Profiles[profile.ID] = profile
+	profile.UpdatedAt = d.clock.Now()
+	d.Profiles.Upsert(profile.ID, profile)
 	return nil
 }
 
-func (d *Database) GetMatches(email string, page, limit int) ([]Profile, error) {
+func (d *Database) GetMatches(email string) ([]Profile, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	profile, err := d.GetProfile(email)
+	profile, err := d.profile(email)
 	if err != nil {
 		return nil, err
 	}
 
-	var matches []Profile
-	for _, p := range d.Profiles {
-		if isMatch(profile, p) {
-			matches = append(matches, p)
-		}
-	}
-
-	// Apply pagination
-	start := (page - 1) * limit
-	end := start + limit
-	if start >= len(matches) {
-		return []Profile{}, nil
-	}
-	if end > len(matches) {
-		end = len(matches)
-	}
-
-	return matches[start:end], nil
+	return d.Profiles.Query(func(p Profile) bool {
+		return isMatch(profile, p)
+	}), nil
 }
 
 func (d *Database) RecordLike(like Like) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	like.ID = uuid.New().String()
-	like.CreatedAt = time.Now()
-	d.Likes[like.ID] = like
+	like.ID = server.NewID("LIKE")
+	like.CreatedAt = d.clock.Now()
+	d.Likes.Upsert(like.ID, like)
 
 	// Check for mutual like and create conversation if needed
-	for _, existingLike := range d.Likes {
+	for _, existingLike := range d.Likes.List() {
 		if existingLike.FromEmail == like.ToID &&
 			existingLike.ToID == like.FromEmail &&
 			existingLike.Action == "like" {
 			// Create new conversation
 			conv := Conversation{
-				ID:           uuid.New().String(),
+				ID:           server.NewID("CONV"),
 				Participants: []string{like.FromEmail, like.ToID},
 				Messages:     []Message{},
-				CreatedAt:    time.Now(),
-				UpdatedAt:    time.Now(),
+				CreatedAt:    d.clock.Now(),
+				UpdatedAt:    d.clock.Now(),
 			}
-			d.Conversations[conv.ID] = conv
+			d.Conversations.Upsert(conv.ID, conv)
 			break
 		}
 	}
@@ -188,12 +196,9 @@ func (d *Database) GetLikes(email string) ([]Like, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var likes []Like
-	for _, like := range d.Likes {
-		if like.ToID == email && like.Action == "like" {
-			likes = append(likes, like)
-		}
-	}
+	likes := d.Likes.Query(func(like Like) bool {
+		return like.ToID == email && like.Action == "like"
+	})
 	return likes, nil
 }
 
@@ -202,7 +207,7 @@ func (d *Database) GetConversations(email string) ([]Conversation, error) {
 	defer d.mu.RUnlock()
 
 	var conversations []Conversation
-	for _, conv := range d.Conversations {
+	for _, conv := range d.Conversations.List() {
 		for _, participant := range conv.Participants {
 			if participant == email {
 				conversations = append(conversations, conv)
@@ -242,187 +247,175 @@ func isMatch(profile1, profile2 Profile) bool {
 	return distance <= float64(profile1.Preferences.Distance)
 }
 
+// calculateDistance returns the great-circle distance between two points
+// in miles.
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+	return geo.DistanceMiles(geo.Point{Lat: lat1, Lon: lon1}, geo.Point{Lat: lat2, Lon: lon2})
 }
 
 // HTTP Handlers
-func getProfile(c *fiber.Ctx) error {
+func (h *handlers) getProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	profile, err := db.GetProfile(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(profile)
 }
 
-func updateProfile(c *fiber.Ctx) error {
-	var updates map[string]interface{}
-	if err := c.BodyParser(&updates); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+func (h *handlers) updateProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var updates ProfileUpdate
+	if err := server.Bind(c, &updates); err != nil {
+		return err
 	}
 
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	if err := db.UpdateProfile(email, updates); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	profile, _ := db.GetProfile(email)
 	return c.JSON(profile)
 }
 
-func getMatches(c *fiber.Ctx) error {
+func (h *handlers) getMatches(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
-	page := c.QueryInt("page", 1)
-	limit := c.QueryInt("limit", 20)
-
-	matches, err := db.GetMatches(email, page, limit)
+	matches, err := db.GetMatches(email)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(matches)
+	return server.List(c, matches)
 }
 
-func recordLike(c *fiber.Ctx) error {
+func (h *handlers) recordLike(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var like Like
-	if err := c.BodyParser(&like); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &like); err != nil {
+		return err
 	}
 
 	if err := db.RecordLike(like); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(like)
 }
 
-func getLikes(c *fiber.Ctx) error {
+func (h *handlers) getLikes(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	likes, err := db.GetLikes(email)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
-	return c.JSON(likes)
+	return server.List(c, likes)
 }
 
-func getConversations(c *fiber.Ctx) error {
+func (h *handlers) getConversations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	conversations, err := db.GetConversations(email)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
-	return c.JSON(conversations)
+	return server.List(c, conversations)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Profiles:      make(map[string]Profile),
-		Likes:         make(map[string]Like),
-		Conversations: make(map[string]Conversation),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Profile routes
-	api.Get("/profile", getProfile)
-	api.Put("/profile", updateProfile)
+	api.Get("/profile", h.getProfile)
+	api.Put("/profile", h.updateProfile)
 
 	// Matching routes
-	api.Get("/matches", getMatches)
-	api.Post("/likes", recordLike)
-	api.Get("/likes", getLikes)
+	api.Get("/matches", h.getMatches)
+	api.Post("/likes", h.recordLike)
+	api.Get("/likes", h.getLikes)
 
 	// Conversation routes
-	api.Get("/conversations", getConversations)
+	api.Get("/conversations", h.getConversations)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(cors.New())
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	setupRoutes(app)
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"likes", "conversations"},
+			Search:  []string{"profiles"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,18 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -47,9 +43,12 @@ type Comment struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Articles map[string]Article `json:"articles"`
-	Comments map[string]Comment `json:"comments"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]    `json:"users"`
+	Articles server.Repository[Article] `json:"articles"`
+	Comments server.Repository[Comment] `json:"comments"`
 	mu       sync.RWMutex
 }
 
@@ -60,15 +59,24 @@ var (
 	ErrInvalidInput    = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers publish Medium articles and their comments, dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users, articles and comments in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -79,7 +87,7 @@ func (d *Database) GetArticle(id string) (Article, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	article, exists := d.Articles[id]
+	article, exists := d.Articles.Get(id)
 	if !exists {
 		return Article{}, ErrArticleNotFound
 	}
@@ -90,7 +98,7 @@ func (d *Database) CreateArticle(article Article) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Articles[article.ID] = article
+	d.Articles.Upsert(article.ID, article)
 	return nil
 }
 
@@ -98,13 +106,13 @@ func (d *Database) AddClap(articleId string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	article, exists := d.Articles[articleId]
+	article, exists := d.Articles.Get(articleId)
 	if !exists {
 		return ErrArticleNotFound
 	}
 
 	article.Claps++
-	d.Articles[articleId] = article
+	d.Articles.Upsert(articleId, article)
 	return nil
 }
 
@@ -112,17 +120,18 @@ func (d *Database) AddComment(comment Comment) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Comments[comment.ID] = comment
+	d.Comments.Upsert(comment.ID, comment)
 	return nil
 }
 
 // Handlers
-func getArticles(c *fiber.Ctx) error {
+func (h *handlers) getArticles(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	tag := c.Query("tag")
 
 	var articles []Article
 	db.mu.RLock()
-	for _, article := range db.Articles {
+	for _, article := range db.Articles.List() {
 		if tag == "" {
 			articles = append(articles, article)
 			continue
@@ -137,44 +146,42 @@ func getArticles(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(articles)
+	return server.List(c, articles)
 }
 
-func getUserArticles(c *fiber.Ctx) error {
+func (h *handlers) getUserArticles(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	var articles []Article
 	db.mu.RLock()
-	for _, article := range db.Articles {
+	for _, article := range db.Articles.List() {
 		if article.Author.Email == email {
 			articles = append(articles, article)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(articles)
+	return server.List(c, articles)
 }
 
 type NewArticleRequest struct {
-	Title   string   `json:"title"`
-	Content string   `json:"content"`
+	Title   string   `json:"title" validate:"required"`
+	Content string   `json:"content" validate:"required"`
 	Tags    []string `json:"tags"`
-	Email   string   `json:"email"`
+	Email   string   `json:"email" validate:"required,email"`
 }
 
-func createArticle(c *fiber.Ctx) error {
+func (h *handlers) createArticle(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewArticleRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	user, err := db.GetUser(req.Email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Calculate reading time (rough estimate: 200 words per minute)
@@ -182,33 +189,30 @@ func createArticle(c *fiber.Ctx) error {
 	readingTime := (wordCount + 199) / 200
 
 	article := Article{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("ART"),
 		Title:       req.Title,
 		Content:     req.Content,
 		Author:      user,
 		Tags:        req.Tags,
 		Claps:       0,
 		ReadingTime: readingTime,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		CreatedAt:   h.clock.Now(),
+		UpdatedAt:   h.clock.Now(),
 	}
 
 	if err := db.CreateArticle(article); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create article",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create article")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(article)
 }
 
-func clapArticle(c *fiber.Ctx) error {
+func (h *handlers) clapArticle(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	articleId := c.Params("articleId")
 
 	if err := db.AddClap(articleId); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Article not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Article not found")
 	}
 
 	article, _ := db.GetArticle(articleId)
@@ -217,136 +221,131 @@ func clapArticle(c *fiber.Ctx) error {
 	})
 }
 
-func getArticleComments(c *fiber.Ctx) error {
+func (h *handlers) getArticleComments(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	articleId := c.Params("articleId")
 
 	var comments []Comment
 	db.mu.RLock()
-	for _, comment := range db.Comments {
+	for _, comment := range db.Comments.List() {
 		if comment.ArticleID == articleId {
 			comments = append(comments, comment)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(comments)
+	return server.List(c, comments)
 }
 
 type NewCommentRequest struct {
 	Content string `json:"content"`
-	Email   string `json:"email"`
+	Email   string `json:"email" validate:"email"`
 }
 
-func createComment(c *fiber.Ctx) error {
+func (h *handlers) createComment(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	articleId := c.Params("articleId")
 
 	var req NewCommentRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	user, err := db.GetUser(req.Email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	comment := Comment{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("CMT"),
 		ArticleID: articleId,
 		Content:   req.Content,
 		Author:    user,
-		CreatedAt: time.Now(),
+		CreatedAt: h.clock.Now(),
 	}
 
 	if err := db.AddComment(comment); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create comment",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create comment")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(comment)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Articles: make(map[string]Article),
-		Comments: make(map[string]Comment),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Article routes
-	api.Get("/articles", getArticles)
-	api.Post("/articles", createArticle)
-	api.Get("/users/:email/articles", getUserArticles)
-	api.Post("/articles/:articleId/claps", clapArticle)
+	api.Get("/articles", h.getArticles)
+	api.Post("/articles", h.createArticle)
+	api.Get("/users/:email/articles", h.getUserArticles)
+	api.Post("/articles/:articleId/claps", h.clapArticle)
 
 	// Comment routes
-	api.Get("/articles/:articleId/comments", getArticleComments)
-	api.Post("/articles/:articleId/comments", createComment)
+	api.Get("/articles/:articleId/comments", h.getArticleComments)
+	api.Post("/articles/:articleId/comments", h.createComment)
 
 	// User routes
 	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		email := c.Params("email")
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(user)
 	})
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+			Search:  []string{"articles", "comments"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,20 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -71,10 +67,13 @@ type Meeting struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Chats    map[string]Chat    `json:"chats"`
-	Teams    map[string]Team    `json:"teams"`
-	Meetings map[string]Meeting `json:"meetings"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]    `json:"users"`
+	Chats    server.Repository[Chat]    `json:"chats"`
+	Teams    server.Repository[Team]    `json:"teams"`
+	Meetings server.Repository[Meeting] `json:"meetings"`
 	mu       sync.RWMutex
 }
 
@@ -86,15 +85,24 @@ var (
 	ErrMeetingNotFound = errors.New("meeting not found")
 )
 
-// Global database instance
-var db *Database
+// handlers run Teams chats, teams and meetings, dating new chats by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the chats, teams and meetings in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -106,7 +114,7 @@ func (d *Database) GetUserChats(email string) []Chat {
 	defer d.mu.RUnlock()
 
 	var userChats []Chat
-	for _, chat := range d.Chats {
+	for _, chat := range d.Chats.List() {
 		for _, participant := range chat.Participants {
 			if participant.Email == email {
 				userChats = append(userChats, chat)
@@ -122,7 +130,7 @@ func (d *Database) GetUserTeams(email string) []Team {
 	defer d.mu.RUnlock()
 
 	var userTeams []Team
-	for _, team := range d.Teams {
+	for _, team := range d.Teams.List() {
 		for _, member := range team.Members {
 			if member.Email == email {
 				userTeams = append(userTeams, team)
@@ -138,7 +146,7 @@ func (d *Database) GetUserMeetings(email string) []Meeting {
 	defer d.mu.RUnlock()
 
 	var userMeetings []Meeting
-	for _, meeting := range d.Meetings {
+	for _, meeting := range d.Meetings.List() {
 		if meeting.Organizer.Email == email {
 			userMeetings = append(userMeetings, meeting)
 			continue
@@ -154,51 +162,39 @@ func (d *Database) GetUserMeetings(email string) []Meeting {
 }
 
 // HTTP Handlers
-func getUserChats(c *fiber.Ctx) error {
+func (h *handlers) getUserChats(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	_, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	chats := db.GetUserChats(email)
-	return c.JSON(chats)
+	return server.List(c, chats)
 }
 
 type NewChatRequest struct {
-	Participants []string `json:"participants"`
+	Participants []string `json:"participants" validate:"min=2"`
 	Message      string   `json:"message"`
 }
 
-func createChat(c *fiber.Ctx) error {
+func (h *handlers) createChat(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewChatRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	if len(req.Participants) < 2 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "At least 2 participants are required",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	var participants []User
 	for _, email := range req.Participants {
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": fmt.Sprintf("User not found: %s", email),
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, fmt.Sprintf("User not found: %s", email))
 		}
 		participants = append(participants, user)
 	}
@@ -209,110 +205,100 @@ func createChat(c *fiber.Ctx) error {
 	}
 
 	message := Message{
-		ID:      uuid.New().String(),
+		ID:      server.NewID("MSG"),
 		Sender:  participants[0],
 		Content: req.Message,
-		SentAt:  time.Now(),
+		SentAt:  h.clock.Now(),
 		ReadBy:  []string{participants[0].Email},
 	}
 
 	chat := Chat{
-		ID:           uuid.New().String(),
+		ID:           server.NewID("CHAT"),
 		Type:         chatType,
 		Participants: participants,
 		Messages:     []Message{message},
 		LastMessage:  &message,
-		CreatedAt:    time.Now(),
+		CreatedAt:    h.clock.Now(),
 	}
 
 	db.mu.Lock()
-	db.Chats[chat.ID] = chat
+	db.Chats.Upsert(chat.ID, chat)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(chat)
 }
 
-func getUserTeams(c *fiber.Ctx) error {
+func (h *handlers) getUserTeams(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	_, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	teams := db.GetUserTeams(email)
-	return c.JSON(teams)
+	return server.List(c, teams)
 }
 
-func getUserMeetings(c *fiber.Ctx) error {
+func (h *handlers) getUserMeetings(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	_, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	meetings := db.GetUserMeetings(email)
-	return c.JSON(meetings)
+	return server.List(c, meetings)
 }
 
 type NewMeetingRequest struct {
-	Title        string    `json:"title"`
-	Participants []string  `json:"participants"`
-	StartTime    time.Time `json:"start_time"`
-	EndTime      time.Time `json:"end_time"`
+	Title        string    `json:"title" validate:"required"`
+	Participants []string  `json:"participants" validate:"min=1"`
+	StartTime    time.Time `json:"start_time" validate:"required"`
+	EndTime      time.Time `json:"end_time" validate:"required"`
 	Description  string    `json:"description"`
 }
 
-func createMeeting(c *fiber.Ctx) error {
+func (h *handlers) createMeeting(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewMeetingRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+	if !req.EndTime.After(req.StartTime) {
+		return &server.ValidationError{Errors: []server.FieldError{{Field: "end_time", Message: "must be after start_time"}}}
 	}
 
 	organizerEmail := c.Query("email")
 	if organizerEmail == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "organizer email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "organizer email is required")
 	}
 
 	organizer, err := db.GetUser(organizerEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var participants []User
 	for _, email := range req.Participants {
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": fmt.Sprintf("User not found: %s", email),
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, fmt.Sprintf("User not found: %s", email))
 		}
 		participants = append(participants, user)
 	}
 
 	meeting := Meeting{
-		ID:           uuid.New().String(),
+		ID:           server.NewID("MTG"),
 		Title:        req.Title,
 		Organizer:    organizer,
 		Participants: participants,
@@ -323,83 +309,88 @@ func createMeeting(c *fiber.Ctx) error {
 	}
 
 	db.mu.Lock()
-	db.Meetings[meeting.ID] = meeting
+	db.Meetings.Upsert(meeting.ID, meeting)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(meeting)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Chats:    make(map[string]Chat),
-		Teams:    make(map[string]Team),
-		Meetings: make(map[string]Meeting),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Chat routes
-	api.Get("/chats", getUserChats)
-	api.Post("/chats", createChat)
+	api.Get("/chats", h.getUserChats)
+	api.Post("/chats", h.createChat)
 
 	// Team routes
-	api.Get("/teams", getUserTeams)
+	api.Get("/teams", h.getUserTeams)
 
 	// Meeting routes
-	api.Get("/meetings", getUserMeetings)
-	api.Post("/meetings", createMeeting)
+	api.Get("/meetings", h.getUserMeetings)
+	api.Post("/meetings", h.createMeeting)
 
 	// User routes
 	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		email := c.Params("email")
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(user)
 	})
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"chats", "meetings"},
+			Search:  []string{"teams", "chats", "meetings"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
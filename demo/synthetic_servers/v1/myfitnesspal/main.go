@@ -1,19 +1,20 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"log"
-	"os"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -24,23 +25,38 @@ type User struct {
 	DateOfBirth   string    `json:"date_of_birth"`
 	Gender        string    `json:"gender"`
 	ActivityLevel string    `json:"activity_level"`
+	IsAdmin       bool      `json:"is_admin,omitempty"`
+	Privacy       Privacy   `json:"privacy,omitempty"`
 	CreatedAt     time.Time `json:"created_at"`
 }
 
+// Privacy controls what friends see in their feed. Users without a setting
+// share with friends.
+type Privacy string
+
+const (
+	PrivacyPublic  Privacy = "public"  // milestones include weights
+	PrivacyFriends Privacy = "friends" // milestones without weights
+	PrivacyPrivate Privacy = "private" // nothing is shared
+)
+
 type Food struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Brand       string  `json:"brand"`
-	ServingSize string  `json:"serving_size"`
-	Calories    int     `json:"calories"`
-	Protein     float64 `json:"protein"`
-	Carbs       float64 `json:"carbs"`
-	Fat         float64 `json:"fat"`
-	Fiber       float64 `json:"fiber"`
-	Sugar       float64 `json:"sugar"`
-	Sodium      float64 `json:"sodium"`
-	CreatedBy   string  `json:"created_by"`
-	IsVerified  bool    `json:"is_verified"`
+	ID          string     `json:"id"`
+	Name        string     `json:"name" validate:"required"`
+	Brand       string     `json:"brand"`
+	Barcode     string     `json:"barcode,omitempty"` // GTIN-13 or EAN-8
+	ServingSize string     `json:"serving_size"`
+	Calories    int        `json:"calories" validate:"gte=0"`
+	Protein     float64    `json:"protein" validate:"gte=0"`
+	Carbs       float64    `json:"carbs" validate:"gte=0"`
+	Fat         float64    `json:"fat" validate:"gte=0"`
+	Fiber       float64    `json:"fiber" validate:"gte=0"`
+	Sugar       float64    `json:"sugar" validate:"gte=0"`
+	Sodium      float64    `json:"sodium" validate:"gte=0"`
+	CreatedBy   string     `json:"created_by"`
+	IsVerified  bool       `json:"is_verified"`
+	VerifiedBy  string     `json:"verified_by,omitempty"`
+	VerifiedAt  *time.Time `json:"verified_at,omitempty"`
 }
 
 type MealType string
@@ -52,19 +68,133 @@ const (
 	MealTypeSnack     MealType = "snack"
 )
 
+// FoodEntry logs servings of exactly one of a food, a recipe or a saved meal.
 type FoodEntry struct {
 	ID        string    `json:"id"`
-	UserEmail string    `json:"user_email"`
-	FoodID    string    `json:"food_id"`
+	UserEmail string    `json:"user_email" validate:"email"`
+	FoodID    string    `json:"food_id,omitempty"`
+	RecipeID  string    `json:"recipe_id,omitempty"`
+	MealID    string    `json:"meal_id,omitempty"`
 	Date      string    `json:"date"`
 	MealType  MealType  `json:"meal_type"`
-	Servings  float64   `json:"servings"`
+	Servings  float64   `json:"servings" validate:"gte=0"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+type Nutrition struct {
+	Calories int     `json:"calories"`
+	Protein  float64 `json:"protein"`
+	Carbs    float64 `json:"carbs"`
+	Fat      float64 `json:"fat"`
+	Fiber    float64 `json:"fiber"`
+	Sugar    float64 `json:"sugar"`
+	Sodium   float64 `json:"sodium"`
+}
+
+func (f Food) nutrition() Nutrition {
+	return Nutrition{
+		Calories: f.Calories,
+		Protein:  f.Protein,
+		Carbs:    f.Carbs,
+		Fat:      f.Fat,
+		Fiber:    f.Fiber,
+		Sugar:    f.Sugar,
+		Sodium:   f.Sodium,
+	}
+}
+
+func (n Nutrition) add(other Nutrition) Nutrition {
+	return Nutrition{
+		Calories: n.Calories + other.Calories,
+		Protein:  n.Protein + other.Protein,
+		Carbs:    n.Carbs + other.Carbs,
+		Fat:      n.Fat + other.Fat,
+		Fiber:    n.Fiber + other.Fiber,
+		Sugar:    n.Sugar + other.Sugar,
+		Sodium:   n.Sodium + other.Sodium,
+	}
+}
+
+func (n Nutrition) scale(factor float64) Nutrition {
+	round := func(v float64) float64 { return math.Round(v*factor*10) / 10 }
+	return Nutrition{
+		Calories: int(math.Round(float64(n.Calories) * factor)),
+		Protein:  round(n.Protein),
+		Carbs:    round(n.Carbs),
+		Fat:      round(n.Fat),
+		Fiber:    round(n.Fiber),
+		Sugar:    round(n.Sugar),
+		Sodium:   round(n.Sodium),
+	}
+}
+
+// Ingredient is a quantity of a food, measured in the food's servings.
+type Ingredient struct {
+	FoodID   string  `json:"food_id"`
+	Servings float64 `json:"servings"`
+}
+
+// Recipe nutrition is computed from its ingredients when it is saved.
+type Recipe struct {
+	ID          string       `json:"id"`
+	UserEmail   string       `json:"user_email" validate:"email"`
+	Name        string       `json:"name"`
+	Servings    float64      `json:"servings" validate:"gte=0"`
+	Ingredients []Ingredient `json:"ingredients"`
+	Total       Nutrition    `json:"total"`
+	PerServing  Nutrition    `json:"per_serving"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// SavedMeal is a group of foods usually eaten together, logged as one entry.
+type SavedMeal struct {
+	ID        string       `json:"id"`
+	UserEmail string       `json:"user_email" validate:"email"`
+	Name      string       `json:"name"`
+	Items     []Ingredient `json:"items"`
+	Nutrition Nutrition    `json:"nutrition"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type ExerciseCategory string
+
+const (
+	ExerciseCardio   ExerciseCategory = "cardio"
+	ExerciseStrength ExerciseCategory = "strength"
+)
+
+// Exercise is a catalog activity. MET (metabolic equivalent) is used to
+// estimate calories burned when the user doesn't supply them.
+type Exercise struct {
+	ID       string           `json:"id"`
+	Name     string           `json:"name"`
+	Category ExerciseCategory `json:"category"`
+	MET      float64          `json:"met"`
+}
+
+type ExerciseEntry struct {
+	ID              string    `json:"id"`
+	UserEmail       string    `json:"user_email" validate:"email"`
+	ExerciseID      string    `json:"exercise_id"`
+	Date            string    `json:"date"`
+	DurationMinutes int       `json:"duration_minutes"`
+	CaloriesBurned  int       `json:"calories_burned"`
+	Sets            int       `json:"sets,omitempty"`
+	Reps            int       `json:"reps,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type WaterEntry struct {
+	ID          string    `json:"id"`
+	UserEmail   string    `json:"user_email"`
+	Date        string    `json:"date"`
+	Milliliters int       `json:"milliliters"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
 type ProgressEntry struct {
 	ID           string   `json:"id"`
-	UserEmail    string   `json:"user_email"`
+	UserEmail    string   `json:"user_email" validate:"email"`
 	Date         string   `json:"date"`
 	Weight       float64  `json:"weight"`
 	BodyFat      *float64 `json:"body_fat,omitempty"`
@@ -77,11 +207,12 @@ type ProgressEntry struct {
 }
 
 type Goals struct {
-	UserEmail     string  `json:"user_email"`
+	UserEmail     string  `json:"user_email" validate:"email"`
 	TargetWeight  float64 `json:"target_weight"`
 	WeeklyGoal    string  `json:"weekly_goal"` // e.g., "lose_0.5kg", "maintain", "gain_0.5kg"
 	ActivityLevel string  `json:"activity_level"`
 	DailyCalories int     `json:"daily_calories"`
+	WaterGoalMl   int     `json:"water_goal_ml,omitempty"`
 	Macros        struct {
 		Protein int `json:"protein"`
 		Carbs   int `json:"carbs"`
@@ -90,26 +221,127 @@ type Goals struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+type FriendRequestStatus string
+
+const (
+	FriendRequestPending  FriendRequestStatus = "pending"
+	FriendRequestAccepted FriendRequestStatus = "accepted"
+	FriendRequestDeclined FriendRequestStatus = "declined"
+)
+
+// friendRequestMachine is the statuses a friend request moves through: its
+// recipient answers it once.
+var friendRequestMachine = &statemachine.Machine{Name: "friend request", Moves: map[string][]string{
+	string(FriendRequestPending): {string(FriendRequestAccepted), string(FriendRequestDeclined)},
+}}
+
+type FriendRequest struct {
+	ID          string              `json:"id"`
+	FromEmail   string              `json:"from_email" validate:"email"`
+	ToEmail     string              `json:"to_email" validate:"email"`
+	Status      FriendRequestStatus `json:"status"`
+	CreatedAt   time.Time           `json:"created_at"`
+	RespondedAt *time.Time          `json:"responded_at,omitempty"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+}
+
+type Friend struct {
+	Email   string    `json:"email"`
+	Name    string    `json:"name"`
+	Privacy Privacy   `json:"privacy"`
+	Since   time.Time `json:"since"`
+}
+
+// FeedEvent is a milestone generated from a friend's logs.
+type FeedEvent struct {
+	Type      string `json:"type"` // weight_goal_reached, weight_lost, logging_streak
+	UserEmail string `json:"user_email"`
+	UserName  string `json:"user_name"`
+	Date      string `json:"date"`
+	Message   string `json:"message"`
+}
+
 // Database represents our in-memory database
 type Database struct {
-	Users           map[string]User            `json:"users"`
-	Foods           map[string]Food            `json:"foods"`
-	FoodEntries     map[string][]FoodEntry     `json:"food_entries"`     // Keyed by user_email
-	ProgressEntries map[string][]ProgressEntry `json:"progress_entries"` // Keyed by user_email
-	Goals           map[string]Goals           `json:"goals"`            // Keyed by user_email
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users           server.Repository[User]            `json:"users"`
+	Foods           server.Repository[Food]            `json:"foods"`
+	FoodEntries     server.Repository[[]FoodEntry]     `json:"food_entries"`     // Keyed by user_email
+	ProgressEntries server.Repository[[]ProgressEntry] `json:"progress_entries"` // Keyed by user_email
+	Goals           server.Repository[Goals]           `json:"goals"`            // Keyed by user_email
+	Exercises       server.Repository[Exercise]        `json:"exercises"`
+	ExerciseEntries server.Repository[[]ExerciseEntry] `json:"exercise_entries"` // Keyed by user_email
+	Recipes         server.Repository[Recipe]          `json:"recipes"`
+	SavedMeals      server.Repository[SavedMeal]       `json:"saved_meals"`
+	WaterEntries    server.Repository[[]WaterEntry]    `json:"water_entries"` // Keyed by user_email
+	FriendRequests  server.Repository[FriendRequest]   `json:"friend_requests"`
 	mu              sync.RWMutex
+	clock           *server.Clock
+}
+
+// handlers log MyFitnessPal users' food, exercise, water and progress
+// against their goals, each entry dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
 }
 
-var db *Database
+// newHandlers loads the foods, diaries and goals in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrExerciseNotFound = errors.New("exercise not found")
+	ErrInvalidDate      = errors.New("date must be in YYYY-MM-DD format")
+	ErrInvalidDuration  = errors.New("duration_minutes must be positive")
+	ErrInvalidCalories  = errors.New("calories_burned must not be negative")
+	ErrInvalidBarcode   = errors.New("barcode must be a valid UPC-A, EAN-13 or EAN-8 code")
+	ErrFoodNotFound     = errors.New("food not found")
+	ErrBarcodeExists    = errors.New("a food with this barcode already exists")
+	ErrInvalidFood      = errors.New("food name is required and nutrition values must not be negative")
+	ErrRecipeNotFound   = errors.New("recipe not found")
+	ErrMealNotFound     = errors.New("saved meal not found")
+	ErrNotOwner         = errors.New("recipe or meal belongs to another user")
+	ErrInvalidRecipe    = errors.New("a name, at least one ingredient and positive servings are required")
+	ErrEntrySource      = errors.New("exactly one of food_id, recipe_id or meal_id is required")
+	ErrInvalidServings  = errors.New("servings must be positive")
+	ErrInvalidMealType  = errors.New("meal_type must be breakfast, lunch, dinner or snack")
+	ErrRecipeInUse      = errors.New("recipe has been logged to the diary and cannot be deleted")
+	ErrInvalidWater     = errors.New("give a positive amount in either milliliters or cups")
+	ErrDuplicateFood    = errors.New("a food with this name and brand already exists")
+	ErrNotAdmin         = errors.New("only admins can verify foods")
+	ErrInvalidPrivacy   = errors.New("privacy must be public, friends or private")
+	ErrSelfFriend       = errors.New("you cannot send a friend request to yourself")
+	ErrAlreadyFriends   = errors.New("you are already friends")
+	ErrRequestPending   = errors.New("a friend request between these users is already pending")
+	ErrRequestNotFound  = errors.New("friend request not found")
+	ErrNotRecipient     = errors.New("only the recipient can respond to a friend request")
+	ErrRequestAnswered  = errors.New("friend request has already been answered")
+)
+
+// defaultWeightKg is used to estimate calories burned for users who have
+// never logged their weight.
+const defaultWeightKg = 70.0
+
+const (
+	mlPerCup           = 236.6 // US cup, 8 fl oz
+	defaultWaterGoalMl = 2000
+)
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
-		return User{}, errors.New("user not found")
+		return User{}, ErrUserNotFound
 	}
 	return user, nil
 }
@@ -118,7 +350,7 @@ func (d *Database) GetFoodDiary(email, date string) ([]FoodEntry, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	entries := d.FoodEntries[email]
+	entries, _ := d.FoodEntries.Get(email)
 	var dayEntries []FoodEntry
 
 	for _, entry := range entries {
@@ -130,288 +362,1707 @@ func (d *Database) GetFoodDiary(email, date string) ([]FoodEntry, error) {
 	return dayEntries, nil
 }
 
-func (d *Database) AddFoodEntry(entry FoodEntry) error {
+// entryNutrition is what one diary entry contributes. Callers must hold d.mu.
+func (d *Database) entryNutrition(entry FoodEntry) Nutrition {
+	switch {
+	case entry.RecipeID != "":
+		recipe, _ := d.Recipes.Get(entry.RecipeID)
+		return recipe.PerServing.scale(entry.Servings)
+	case entry.MealID != "":
+		savedMeal, _ := d.SavedMeals.Get(entry.MealID)
+		return savedMeal.Nutrition.scale(entry.Servings)
+	default:
+		food, _ := d.Foods.Get(entry.FoodID)
+		return food.nutrition().scale(entry.Servings)
+	}
+}
+
+// sumIngredients totals the nutrition of a list of foods. Callers must hold
+// d.mu.
+func (d *Database) sumIngredients(items []Ingredient) (Nutrition, error) {
+	var total Nutrition
+	for _, item := range items {
+		food, exists := d.Foods.Get(item.FoodID)
+		if !exists {
+			return Nutrition{}, ErrFoodNotFound
+		}
+		if item.Servings <= 0 {
+			return Nutrition{}, ErrInvalidServings
+		}
+		total = total.add(food.nutrition().scale(item.Servings))
+	}
+	return total, nil
+}
+
+func (d *Database) CreateRecipe(recipe *Recipe) error {
+	if strings.TrimSpace(recipe.Name) == "" || len(recipe.Ingredients) == 0 || recipe.Servings <= 0 {
+		return ErrInvalidRecipe
+	}
+
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	entries := d.FoodEntries[entry.UserEmail]
-	entries = append(entries, entry)
-	d.FoodEntries[entry.UserEmail] = entries
+	if _, exists := d.Users.Get(recipe.UserEmail); !exists {
+		return ErrUserNotFound
+	}
+	total, err := d.sumIngredients(recipe.Ingredients)
+	if err != nil {
+		return err
+	}
+	recipe.Total = total
+	recipe.PerServing = total.scale(1 / recipe.Servings)
+
+	d.Recipes.Upsert(recipe.ID, *recipe)
+	return nil
+}
+
+func (d *Database) CreateSavedMeal(meal *SavedMeal) error {
+	if strings.TrimSpace(meal.Name) == "" || len(meal.Items) == 0 {
+		return ErrInvalidRecipe
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Users.Get(meal.UserEmail); !exists {
+		return ErrUserNotFound
+	}
+	total, err := d.sumIngredients(meal.Items)
+	if err != nil {
+		return err
+	}
+	meal.Nutrition = total
 
+	d.SavedMeals.Upsert(meal.ID, *meal)
 	return nil
 }
 
-func (d *Database) SearchFoods(query string) []Food {
+func (d *Database) GetRecipes(email string) []Recipe {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var results []Food
-	for _, food := range d.Foods {
-		// Simple contains search - in production, use proper search indexing
-		if contains(food.Name, query) || contains(food.Brand, query) {
-			results = append(results, food)
-		}
-	}
-	return results
+	recipes := d.Recipes.By("user_email", email)
+	sort.Slice(recipes, func(i, j int) bool { return recipes[i].Name < recipes[j].Name })
+	return recipes
 }
 
-func contains(s, substr string) bool {
-	// Case-insensitive contains implementation
-	return true // Simplified for example
+func (d *Database) GetSavedMeals(email string) []SavedMeal {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	meals := d.SavedMeals.By("user_email", email)
+	sort.Slice(meals, func(i, j int) bool { return meals[i].Name < meals[j].Name })
+	return meals
 }
 
-// HTTP Handlers
-func getFoodDiary(c *fiber.Ctx) error {
-	email := c.Query("email")
-	date := c.Query("date")
+func (d *Database) DeleteRecipe(id, email string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	if email == "" || date == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email and date are required",
-		})
+	recipe, exists := d.Recipes.Get(id)
+	if !exists {
+		return ErrRecipeNotFound
 	}
-
-	entries, err := db.GetFoodDiary(email, date)
-	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	if recipe.UserEmail != email {
+		return ErrNotOwner
 	}
-
-	// Calculate nutrition totals
-	type MealTotals struct {
-		Calories int         `json:"calories"`
-		Protein  float64     `json:"protein"`
-		Carbs    float64     `json:"carbs"`
-		Fat      float64     `json:"fat"`
-		Entries  []FoodEntry `json:"entries"`
+	foodEntries, _ := d.FoodEntries.Get(email)
+	for _, entry := range foodEntries {
+		if entry.RecipeID == id {
+			// Keep logged entries meaningful by leaving the recipe in place.
+			return ErrRecipeInUse
+		}
 	}
+	d.Recipes.Delete(id)
+	return nil
+}
+
+func (d *Database) AddFoodEntry(entry FoodEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	meals := map[MealType]*MealTotals{
-		MealTypeBreakfast: {Entries: []FoodEntry{}},
-		MealTypeLunch:     {Entries: []FoodEntry{}},
-		MealTypeDinner:    {Entries: []FoodEntry{}},
-		MealTypeSnack:     {Entries: []FoodEntry{}},
+	if _, exists := d.Users.Get(entry.UserEmail); !exists {
+		return ErrUserNotFound
+	}
+	sources := 0
+	for _, id := range []string{entry.FoodID, entry.RecipeID, entry.MealID} {
+		if id != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return ErrEntrySource
+	}
+	if entry.Servings <= 0 {
+		return ErrInvalidServings
+	}
+	switch entry.MealType {
+	case MealTypeBreakfast, MealTypeLunch, MealTypeDinner, MealTypeSnack:
+	default:
+		return ErrInvalidMealType
+	}
+	if _, err := time.Parse("2006-01-02", entry.Date); err != nil {
+		return ErrInvalidDate
 	}
 
-	for _, entry := range entries {
-		food := db.Foods[entry.FoodID]
-		mealTotals := meals[entry.MealType]
-
-		multiplier := entry.Servings
-		mealTotals.Calories += int(float64(food.Calories) * multiplier)
-		mealTotals.Protein += food.Protein * multiplier
-		mealTotals.Carbs += food.Carbs * multiplier
-		mealTotals.Fat += food.Fat * multiplier
-		mealTotals.Entries = append(mealTotals.Entries, entry)
+	switch {
+	case entry.RecipeID != "":
+		recipe, exists := d.Recipes.Get(entry.RecipeID)
+		if !exists {
+			return ErrRecipeNotFound
+		}
+		if recipe.UserEmail != entry.UserEmail {
+			return ErrNotOwner
+		}
+	case entry.MealID != "":
+		meal, exists := d.SavedMeals.Get(entry.MealID)
+		if !exists {
+			return ErrMealNotFound
+		}
+		if meal.UserEmail != entry.UserEmail {
+			return ErrNotOwner
+		}
+	default:
+		if _, exists := d.Foods.Get(entry.FoodID); !exists {
+			return ErrFoodNotFound
+		}
 	}
 
-	return c.JSON(meals)
+	entries, _ := d.FoodEntries.Get(entry.UserEmail)
+	entries = append(entries, entry)
+	d.FoodEntries.Upsert(entry.UserEmail, entries)
+
+	return nil
 }
 
-func addFoodEntry(c *fiber.Ctx) error {
-	var entry FoodEntry
-	if err := c.BodyParser(&entry); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+// latestWeight returns the user's most recently logged weight in kg.
+// Callers must hold d.mu.
+func (d *Database) latestWeight(email string) float64 {
+	weight, latest := defaultWeightKg, ""
+	progressEntries, _ := d.ProgressEntries.Get(email)
+	for _, entry := range progressEntries {
+		if entry.Weight > 0 && entry.Date >= latest {
+			weight, latest = entry.Weight, entry.Date
+		}
 	}
+	return weight
+}
 
-	// Validate user exists
-	if _, err := db.GetUser(entry.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
-	}
+func (d *Database) SearchExercises(query string) []Exercise {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	// Validate food exists
-	if _, exists := db.Foods[entry.FoodID]; !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Food not found",
-		})
-	}
+	query = strings.ToLower(query)
+	results := d.Exercises.Query(func(exercise Exercise) bool {
+		return query == "" || strings.Contains(strings.ToLower(exercise.Name), query)
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
 
-	entry.ID = uuid.New().String()
-	entry.CreatedAt = time.Now()
+// AddExerciseEntry logs an exercise. When no calories are given they are
+// estimated as MET x body weight (kg) x hours.
+func (d *Database) AddExerciseEntry(entry *ExerciseEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	if err := db.AddFoodEntry(entry); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to add food entry",
-		})
+	if _, exists := d.Users.Get(entry.UserEmail); !exists {
+		return ErrUserNotFound
+	}
+	exercise, exists := d.Exercises.Get(entry.ExerciseID)
+	if !exists {
+		return ErrExerciseNotFound
+	}
+	if _, err := time.Parse("2006-01-02", entry.Date); err != nil {
+		return ErrInvalidDate
+	}
+	if entry.DurationMinutes <= 0 {
+		return ErrInvalidDuration
+	}
+	if entry.CaloriesBurned < 0 {
+		return ErrInvalidCalories
+	}
+	if entry.CaloriesBurned == 0 {
+		hours := float64(entry.DurationMinutes) / 60
+		entry.CaloriesBurned = int(math.Round(exercise.MET * d.latestWeight(entry.UserEmail) * hours))
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(entry)
+	exerciseEntries, _ := d.ExerciseEntries.Get(entry.UserEmail)
+	d.ExerciseEntries.Upsert(entry.UserEmail, append(exerciseEntries, *entry))
+	return nil
 }
 
-func searchFoods(c *fiber.Ctx) error {
-	query := c.Query("query")
-	if query == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "query parameter is required",
-		})
-	}
+// MealTotals is the nutrition logged for one meal.
+type MealTotals struct {
+	Calories int         `json:"calories"`
+	Protein  float64     `json:"protein"`
+	Carbs    float64     `json:"carbs"`
+	Fat      float64     `json:"fat"`
+	Entries  []FoodEntry `json:"entries"`
+}
 
-	results := db.SearchFoods(query)
-	return c.JSON(results)
+type ExerciseTotals struct {
+	CaloriesBurned int             `json:"calories_burned"`
+	Minutes        int             `json:"minutes"`
+	Entries        []ExerciseEntry `json:"entries"`
 }
 
-func getProgress(c *fiber.Ctx) error {
-	email := c.Query("email")
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
-	}
+// CalorieSummary follows the diary equation: net is food minus exercise, and
+// remaining is goal + exercise - food.
+type CalorieSummary struct {
+	Goal      int `json:"goal"`
+	Food      int `json:"food"`
+	Exercise  int `json:"exercise"`
+	Net       int `json:"net"`
+	Remaining int `json:"remaining"`
+}
 
-	entries := db.ProgressEntries[email]
-	if entries == nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "No progress entries found",
-		})
-	}
+type WaterTotals struct {
+	TotalMl     int          `json:"total_ml"`
+	TotalCups   float64      `json:"total_cups"`
+	GoalMl      int          `json:"goal_ml"`
+	RemainingMl int          `json:"remaining_ml"`
+	Entries     []WaterEntry `json:"entries"`
+}
 
-	return c.JSON(entries)
+type DiaryDay struct {
+	Date     string                   `json:"date"`
+	Meals    map[MealType]*MealTotals `json:"meals"`
+	Exercise ExerciseTotals           `json:"exercise"`
+	Water    WaterTotals              `json:"water"`
+	Totals   Nutrition                `json:"totals"`
+	Calories CalorieSummary           `json:"calories"`
 }
 
-func addProgress(c *fiber.Ctx) error {
-	var entry ProgressEntry
-	if err := c.BodyParser(&entry); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+// waterOn totals a user's water for one day against their goal. Callers must
+// hold d.mu.
+func (d *Database) waterOn(email, date string) WaterTotals {
+	goals, _ := d.Goals.Get(email)
+	totals := WaterTotals{GoalMl: goals.WaterGoalMl, Entries: []WaterEntry{}}
+	if totals.GoalMl <= 0 {
+		totals.GoalMl = defaultWaterGoalMl
+	}
+	waterEntries, _ := d.WaterEntries.Get(email)
+	for _, entry := range waterEntries {
+		if entry.Date == date {
+			totals.TotalMl += entry.Milliliters
+			totals.Entries = append(totals.Entries, entry)
+		}
 	}
+	totals.TotalCups = math.Round(float64(totals.TotalMl)/mlPerCup*10) / 10
+	totals.RemainingMl = max(totals.GoalMl-totals.TotalMl, 0)
+	return totals
+}
 
-	// Validate user exists
-	if _, err := db.GetUser(entry.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+func (d *Database) GetWater(email, date string) WaterTotals {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.waterOn(email, date)
+}
+
+func (d *Database) AddWaterEntry(entry WaterEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Users.Get(entry.UserEmail); !exists {
+		return ErrUserNotFound
+	}
+	if _, err := time.Parse("2006-01-02", entry.Date); err != nil {
+		return ErrInvalidDate
+	}
+	if entry.Milliliters <= 0 {
+		return ErrInvalidWater
 	}
 
-	entry.ID = uuid.New().String()
-	entry.CreatedAt = time.Now()
+	waterEntries, _ := d.WaterEntries.Get(entry.UserEmail)
+	d.WaterEntries.Upsert(entry.UserEmail, append(waterEntries, entry))
+	return nil
+}
 
-	db.mu.Lock()
-	entries := db.ProgressEntries[entry.UserEmail]
-	entries = append(entries, entry)
-	db.ProgressEntries[entry.UserEmail] = entries
-	db.mu.Unlock()
+// GetDiaryDay assembles a user's food and exercise for one day.
+func (d *Database) GetDiaryDay(email, date string) DiaryDay {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	return c.Status(fiber.StatusCreated).JSON(entry)
+	return d.diaryDay(email, date)
 }
 
-func getGoals(c *fiber.Ctx) error {
-	email := c.Query("email")
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+// diaryDay is GetDiaryDay for callers that already hold d.mu.
+func (d *Database) diaryDay(email, date string) DiaryDay {
+	day := DiaryDay{
+		Date: date,
+		Meals: map[MealType]*MealTotals{
+			MealTypeBreakfast: {Entries: []FoodEntry{}},
+			MealTypeLunch:     {Entries: []FoodEntry{}},
+			MealTypeDinner:    {Entries: []FoodEntry{}},
+			MealTypeSnack:     {Entries: []FoodEntry{}},
+		},
+		Exercise: ExerciseTotals{Entries: []ExerciseEntry{}},
 	}
 
-	db.mu.RLock()
-	goals, exists := db.Goals[email]
-	db.mu.RUnlock()
+	foodEntries, _ := d.FoodEntries.Get(email)
+	for _, entry := range foodEntries {
+		if entry.Date != date {
+			continue
+		}
+		mealTotals, ok := day.Meals[entry.MealType]
+		if !ok {
+			continue
+		}
+		nutrition := d.entryNutrition(entry)
+		mealTotals.Calories += nutrition.Calories
+		mealTotals.Protein += nutrition.Protein
+		mealTotals.Carbs += nutrition.Carbs
+		mealTotals.Fat += nutrition.Fat
+		mealTotals.Entries = append(mealTotals.Entries, entry)
+		day.Totals = day.Totals.add(nutrition)
+	}
 
-	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Goals not found",
-		})
+	exerciseEntries, _ := d.ExerciseEntries.Get(email)
+	for _, entry := range exerciseEntries {
+		if entry.Date != date {
+			continue
+		}
+		day.Exercise.CaloriesBurned += entry.CaloriesBurned
+		day.Exercise.Minutes += entry.DurationMinutes
+		day.Exercise.Entries = append(day.Exercise.Entries, entry)
 	}
 
-	return c.JSON(goals)
+	day.Water = d.waterOn(email, date)
+
+	goals, _ := d.Goals.Get(email)
+	day.Calories.Goal = goals.DailyCalories
+	day.Calories.Food = day.Totals.Calories
+	day.Calories.Exercise = day.Exercise.CaloriesBurned
+	day.Calories.Net = day.Calories.Food - day.Calories.Exercise
+	day.Calories.Remaining = day.Calories.Goal - day.Calories.Net
+	return day
 }
 
-func updateGoals(c *fiber.Ctx) error {
-	var goals Goals
-	if err := c.BodyParser(&goals); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
+// Daily summary and weekly report
 
-	// Validate user exists
-	if _, err := db.GetUser(goals.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
-	}
+// onTargetTolerance is how far intake may stray from a goal and still count
+// as on target.
+const onTargetTolerance = 0.10
 
-	goals.UpdatedAt = time.Now()
+type GoalStatus string
 
-	db.mu.Lock()
-	db.Goals[goals.UserEmail] = goals
-	db.mu.Unlock()
+const (
+	GoalUnder    GoalStatus = "under"
+	GoalOnTarget GoalStatus = "on_target"
+	GoalOver     GoalStatus = "over"
+	GoalNotSet   GoalStatus = "no_goal"
+)
 
-	return c.JSON(goals)
+func goalStatus(consumed, goal float64) GoalStatus {
+	switch {
+	case goal <= 0:
+		return GoalNotSet
+	case consumed > goal*(1+onTargetTolerance):
+		return GoalOver
+	case consumed < goal*(1-onTargetTolerance):
+		return GoalUnder
+	default:
+		return GoalOnTarget
+	}
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+type MacroProgress struct {
+	Consumed  float64    `json:"consumed"`
+	Goal      float64    `json:"goal"`
+	Remaining float64    `json:"remaining"`
+	Percent   float64    `json:"percent"`
+	Status    GoalStatus `json:"status"`
+}
+
+func macroProgress(consumed float64, goal int) MacroProgress {
+	progress := MacroProgress{
+		Consumed:  math.Round(consumed*10) / 10,
+		Goal:      float64(goal),
+		Remaining: math.Round((float64(goal)-consumed)*10) / 10,
+		Status:    goalStatus(consumed, float64(goal)),
 	}
+	if goal > 0 {
+		progress.Percent = math.Round(consumed / float64(goal) * 100)
+	}
+	return progress
+}
 
-	db = &Database{
-		Users:           make(map[string]User),
-		Foods:           make(map[string]Food),
-		FoodEntries:     make(map[string][]FoodEntry),
-		ProgressEntries: make(map[string][]ProgressEntry),
-		Goals:           make(map[string]Goals),
+type Streak struct {
+	Current     int  `json:"current"`
+	Longest     int  `json:"longest"`
+	LoggedToday bool `json:"logged_today"`
+}
+
+// streakOn counts consecutive logged days ending on date. A streak isn't
+// broken until a whole day passes unlogged, so when date itself has no
+// entries yet the count runs through the day before. Callers must hold d.mu.
+func (d *Database) streakOn(email string, date time.Time) Streak {
+	logged := make(map[string]bool)
+	var streak Streak
+	run, previous := 0, time.Time{}
+	for _, day := range d.loggedDays(email) {
+		logged[day] = true
+		parsed, err := time.Parse("2006-01-02", day)
+		if err != nil || parsed.After(date) {
+			continue
+		}
+		if run > 0 && parsed.Sub(previous) == 24*time.Hour {
+			run++
+		} else {
+			run = 1
+		}
+		previous = parsed
+		streak.Longest = max(streak.Longest, run)
 	}
 
-	return json.Unmarshal(data, db)
+	streak.LoggedToday = logged[date.Format("2006-01-02")]
+	day := date
+	if !streak.LoggedToday {
+		day = date.AddDate(0, 0, -1)
+	}
+	for logged[day.Format("2006-01-02")] {
+		streak.Current++
+		day = day.AddDate(0, 0, -1)
+	}
+	return streak
 }
 
-func setupRoutes(app *fiber.App) {
-	api := app.Group("/api/v1")
+type DailySummary struct {
+	Date            string                   `json:"date"`
+	Calories        CalorieSummary           `json:"calories"`
+	CalorieStatus   GoalStatus               `json:"calorie_status"`
+	Macros          map[string]MacroProgress `json:"macros"`
+	Water           WaterTotals              `json:"water"`
+	ExerciseMinutes int                      `json:"exercise_minutes"`
+	Streak          Streak                   `json:"streak"`
+}
 
-	// Food diary routes
-	api.Get("/food-diary", getFoodDiary)
-	api.Post("/food-diary", addFoodEntry)
+func (d *Database) GetDailySummary(email string, date time.Time) (DailySummary, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	// Food search routes
-	api.Get("/foods/search", searchFoods)
+	if _, exists := d.Users.Get(email); !exists {
+		return DailySummary{}, ErrUserNotFound
+	}
+	day := d.diaryDay(email, date.Format("2006-01-02"))
+	goals, _ := d.Goals.Get(email)
+	budget := day.Calories.Goal + day.Calories.Exercise
+
+	return DailySummary{
+		Date:          day.Date,
+		Calories:      day.Calories,
+		CalorieStatus: goalStatus(float64(day.Calories.Food), float64(budget)),
+		Macros: map[string]MacroProgress{
+			"protein": macroProgress(day.Totals.Protein, goals.Macros.Protein),
+			"carbs":   macroProgress(day.Totals.Carbs, goals.Macros.Carbs),
+			"fat":     macroProgress(day.Totals.Fat, goals.Macros.Fat),
+		},
+		Water:           day.Water,
+		ExerciseMinutes: day.Exercise.Minutes,
+		Streak:          d.streakOn(email, date),
+	}, nil
+}
 
-	// Progress routes
-	api.Get("/progress", getProgress)
-	api.Post("/progress", addProgress)
+type ReportDay struct {
+	Date     string     `json:"date"`
+	Logged   bool       `json:"logged"`
+	Food     int        `json:"food"`
+	Exercise int        `json:"exercise"`
+	Net      int        `json:"net"`
+	Goal     int        `json:"goal"`
+	Status   GoalStatus `json:"status"`
+}
 
-	// Goals routes
-	api.Get("/goals", getGoals)
-	api.Put("/goals", updateGoals)
+type WeeklyReport struct {
+	StartDate             string      `json:"start_date"`
+	EndDate               string      `json:"end_date"`
+	Days                  []ReportDay `json:"days"`
+	DaysLogged            int         `json:"days_logged"`
+	DaysOnTarget          int         `json:"days_on_target"`
+	AverageCalories       int         `json:"average_calories"`
+	AverageMacros         Nutrition   `json:"average_macros"`
+	TotalExerciseCalories int         `json:"total_exercise_calories"`
+	TotalExerciseMinutes  int         `json:"total_exercise_minutes"`
+	AverageWaterMl        int         `json:"average_water_ml"`
+	WeightChange          *float64    `json:"weight_change,omitempty"`
+	Streak                Streak      `json:"streak"`
 }
 
-func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+// GetWeeklyReport aggregates the seven days ending on end. Averages are over
+// the days that have food logged.
+func (d *Database) GetWeeklyReport(email string, end time.Time) (WeeklyReport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	if err := loadDatabase(); err != nil {
-		log.Fatal(err)
+	if _, exists := d.Users.Get(email); !exists {
+		return WeeklyReport{}, ErrUserNotFound
+	}
+	start := end.AddDate(0, 0, -6)
+	report := WeeklyReport{
+		StartDate: start.Format("2006-01-02"),
+		EndDate:   end.Format("2006-01-02"),
+		Days:      make([]ReportDay, 0, 7),
+		Streak:    d.streakOn(email, end),
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
+	var totals Nutrition
+	waterMl := 0
+	for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+		day := d.diaryDay(email, date.Format("2006-01-02"))
+		logged := len(day.Exercise.Entries) > 0
+		for _, meal := range day.Meals {
+			logged = logged || len(meal.Entries) > 0
+		}
+		status := GoalNotSet
+		if logged {
+			status = goalStatus(float64(day.Calories.Food), float64(day.Calories.Goal+day.Calories.Exercise))
+			report.DaysLogged++
+			totals = totals.add(day.Totals)
+			if status == GoalOnTarget {
+				report.DaysOnTarget++
 			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
+		}
+		report.Days = append(report.Days, ReportDay{
+			Date:     day.Date,
+			Logged:   logged,
+			Food:     day.Calories.Food,
+			Exercise: day.Calories.Exercise,
+			Net:      day.Calories.Net,
+			Goal:     day.Calories.Goal,
+			Status:   status,
+		})
+		report.TotalExerciseCalories += day.Exercise.CaloriesBurned
+		report.TotalExerciseMinutes += day.Exercise.Minutes
+		waterMl += day.Water.TotalMl
+	}
+
+	if report.DaysLogged > 0 {
+		average := totals.scale(1 / float64(report.DaysLogged))
+		report.AverageCalories = average.Calories
+		report.AverageMacros = average
+	}
+	report.AverageWaterMl = waterMl / 7
+
+	var first, last *ProgressEntry
+	progressEntries, _ := d.ProgressEntries.Get(email)
+	for i, entry := range progressEntries {
+		if entry.Date < report.StartDate || entry.Date > report.EndDate {
+			continue
+		}
+		if first == nil || entry.Date < first.Date {
+			first = &progressEntries[i]
+		}
+		if last == nil || entry.Date > last.Date {
+			last = &progressEntries[i]
+		}
+	}
+	if first != nil && last != first {
+		change := math.Round((last.Weight-first.Weight)*10) / 10
+		report.WeightChange = &change
+	}
+	return report, nil
+}
+
+// normalizeBarcode validates a scanned code's check digit and returns it in
+// the stored form: UPC-A codes are widened to EAN-13 with a leading zero.
+func normalizeBarcode(code string) (string, error) {
+	code = strings.NewReplacer(" ", "", "-", "").Replace(code)
+	switch len(code) {
+	case 8, 13:
+	case 12:
+		code = "0" + code
+	default:
+		return "", ErrInvalidBarcode
+	}
+
+	sum := 0
+	for i := len(code) - 2; i >= 0; i-- {
+		digit := int(code[i] - '0')
+		if digit < 0 || digit > 9 {
+			return "", ErrInvalidBarcode
+		}
+		if (len(code)-2-i)%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	if int(code[len(code)-1]-'0') != (10-sum%10)%10 {
+		return "", ErrInvalidBarcode
+	}
+	return code, nil
+}
+
+// GetFoodByBarcode resolves a scanned code to a food.
+func (d *Database) GetFoodByBarcode(code string) (Food, error) {
+	code, err := normalizeBarcode(code)
+	if err != nil {
+		return Food{}, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, food := range d.Foods.List() {
+		if food.Barcode == code {
+			return food, nil
+		}
+	}
+	return Food{}, ErrFoodNotFound
+}
+
+// CreateBarcodeFood adds a user-submitted food for a code that wasn't in the
+// database. It stays unverified until reviewed.
+func (d *Database) CreateBarcodeFood(code string, food *Food) error {
+	code, err := normalizeBarcode(code)
+	if err != nil {
+		return err
+	}
+	food.Barcode = code
+	return d.CreateFood(food)
+}
+
+// foodKey normalizes a name and brand for duplicate detection, ignoring
+// case, punctuation and spacing.
+func foodKey(name, brand string) string {
+	normalize := func(s string) string {
+		var b strings.Builder
+		for _, r := range strings.ToLower(s) {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				b.WriteRune(r)
+			}
+		}
+		return b.String()
+	}
+	return normalize(name) + "|" + normalize(brand)
+}
+
+// CreateFood adds a user-created food. User foods start unverified. When the
+// food duplicates an existing one, food is set to the existing entry.
+func (d *Database) CreateFood(food *Food) error {
+	if strings.TrimSpace(food.Name) == "" || food.Calories < 0 || food.Protein < 0 || food.Carbs < 0 ||
+		food.Fat < 0 || food.Fiber < 0 || food.Sugar < 0 || food.Sodium < 0 {
+		return ErrInvalidFood
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Users.Get(food.CreatedBy); !exists {
+		return ErrUserNotFound
+	}
+	key := foodKey(food.Name, food.Brand)
+	for _, existing := range d.Foods.List() {
+		if food.Barcode != "" && existing.Barcode == food.Barcode {
+			*food = existing
+			return ErrBarcodeExists
+		}
+		if foodKey(existing.Name, existing.Brand) == key {
+			*food = existing
+			return ErrDuplicateFood
+		}
+	}
+
+	food.IsVerified = false
+	food.VerifiedBy = ""
+	food.VerifiedAt = nil
+	d.Foods.Upsert(food.ID, *food)
+	return nil
+}
+
+// VerifyFood records an admin's review of a food's nutrition data.
+func (d *Database) VerifyFood(id, adminEmail string, verified bool) (Food, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, _ := d.Users.Get(adminEmail)
+	if !user.IsAdmin {
+		return Food{}, ErrNotAdmin
+	}
+	food, exists := d.Foods.Get(id)
+	if !exists {
+		return Food{}, ErrFoodNotFound
+	}
+
+	food.IsVerified = verified
+	food.VerifiedBy = adminEmail
+	now := d.clock.Now()
+	food.VerifiedAt = &now
+	d.Foods.Upsert(food.ID, food)
+	return food, nil
+}
+
+// SearchFoods matches foods by name or brand, listing verified foods first.
+func (d *Database) SearchFoods(query string, includeUnverified bool) []Food {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	results := []Food{}
+	for _, food := range d.Foods.List() {
+		if !food.IsVerified && !includeUnverified {
+			continue
+		}
+		// Simple contains search - in production, use proper search indexing
+		if contains(food.Name, query) || contains(food.Brand, query) {
+			results = append(results, food)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].IsVerified != results[j].IsVerified {
+			return results[i].IsVerified
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+func contains(s, substr string) bool {
+	// Case-insensitive contains implementation
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// Friends and feed
+
+func (u User) privacy() Privacy {
+	if u.Privacy == "" {
+		return PrivacyFriends
+	}
+	return u.Privacy
+}
+
+func (d *Database) SetPrivacy(email string, privacy Privacy) (User, error) {
+	switch privacy {
+	case PrivacyPublic, PrivacyFriends, PrivacyPrivate:
+	default:
+		return User{}, ErrInvalidPrivacy
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return User{}, ErrUserNotFound
+	}
+	user.Privacy = privacy
+	d.Users.Upsert(email, user)
+	return user, nil
+}
+
+// friendsOf lists accepted friendships. Callers must hold d.mu.
+func (d *Database) friendsOf(email string) []Friend {
+	friends := []Friend{}
+	for _, request := range d.FriendRequests.List() {
+		if request.Status != FriendRequestAccepted {
+			continue
+		}
+		other := ""
+		switch email {
+		case request.FromEmail:
+			other = request.ToEmail
+		case request.ToEmail:
+			other = request.FromEmail
+		default:
+			continue
+		}
+		user, _ := d.Users.Get(other)
+		since := request.CreatedAt
+		if request.RespondedAt != nil {
+			since = *request.RespondedAt
+		}
+		friends = append(friends, Friend{Email: other, Name: user.Name, Privacy: user.privacy(), Since: since})
+	}
+	sort.Slice(friends, func(i, j int) bool { return friends[i].Name < friends[j].Name })
+	return friends
+}
+
+func (d *Database) GetFriends(email string) []Friend {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.friendsOf(email)
+}
+
+// GetFriendRequests returns pending requests sent to and by a user.
+func (d *Database) GetFriendRequests(email string) (incoming, outgoing []FriendRequest) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	incoming, outgoing = []FriendRequest{}, []FriendRequest{}
+	for _, request := range d.FriendRequests.List() {
+		if request.Status != FriendRequestPending {
+			continue
+		}
+		if request.ToEmail == email {
+			incoming = append(incoming, request)
+		}
+		if request.FromEmail == email {
+			outgoing = append(outgoing, request)
+		}
+	}
+	byDate := func(requests []FriendRequest) func(i, j int) bool {
+		return func(i, j int) bool { return requests[i].CreatedAt.After(requests[j].CreatedAt) }
+	}
+	sort.Slice(incoming, byDate(incoming))
+	sort.Slice(outgoing, byDate(outgoing))
+	return incoming, outgoing
+}
+
+func (d *Database) SendFriendRequest(request FriendRequest) error {
+	if request.FromEmail == request.ToEmail {
+		return ErrSelfFriend
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Users.Get(request.FromEmail); !exists {
+		return ErrUserNotFound
+	}
+	if _, exists := d.Users.Get(request.ToEmail); !exists {
+		return ErrUserNotFound
+	}
+	for _, existing := range d.FriendRequests.List() {
+		between := (existing.FromEmail == request.FromEmail && existing.ToEmail == request.ToEmail) ||
+			(existing.FromEmail == request.ToEmail && existing.ToEmail == request.FromEmail)
+		if !between {
+			continue
+		}
+		switch existing.Status {
+		case FriendRequestAccepted:
+			return ErrAlreadyFriends
+		case FriendRequestPending:
+			return ErrRequestPending
+		}
+	}
+
+	request.Status = FriendRequestPending
+	d.FriendRequests.Upsert(request.ID, request)
+	return nil
+}
+
+// RespondToFriendRequest accepts or declines a pending request on behalf of
+// its recipient.
+func (d *Database) RespondToFriendRequest(id, email string, accept bool) (FriendRequest, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	request, exists := d.FriendRequests.Get(id)
+	if !exists {
+		return FriendRequest{}, ErrRequestNotFound
+	}
+	if request.ToEmail != email {
+		return FriendRequest{}, ErrNotRecipient
+	}
+	to := FriendRequestDeclined
+	if accept {
+		to = FriendRequestAccepted
+	}
+	now := d.clock.Now()
+	if err := statemachine.Move(friendRequestMachine, &request, &request.Status, &request.StatusHistory, to, now); err != nil {
+		return FriendRequest{}, ErrRequestAnswered
+	}
+	request.RespondedAt = &now
+	d.FriendRequests.Upsert(request.ID, request)
+	return request, nil
+}
+
+// loggedDays returns the sorted dates on which a user logged food or
+// exercise. Callers must hold d.mu.
+func (d *Database) loggedDays(email string) []string {
+	seen := make(map[string]bool)
+	foodEntries, _ := d.FoodEntries.Get(email)
+	for _, entry := range foodEntries {
+		seen[entry.Date] = true
+	}
+	exerciseEntries, _ := d.ExerciseEntries.Get(email)
+	for _, entry := range exerciseEntries {
+		seen[entry.Date] = true
+	}
+	days := make([]string, 0, len(seen))
+	for day := range seen {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days
+}
+
+const weightLostMilestoneKg = 5.0
+
+var streakMilestones = []int{7, 30, 100, 365}
+
+// milestones derives a user's feed events from their progress and diary
+// logs. Callers must hold d.mu.
+func (d *Database) milestones(user User) []FeedEvent {
+	showWeights := user.privacy() == PrivacyPublic
+	event := func(kind, date, message string) FeedEvent {
+		return FeedEvent{Type: kind, UserEmail: user.Email, UserName: user.Name, Date: date, Message: message}
+	}
+	var events []FeedEvent
+
+	progressEntries, _ := d.ProgressEntries.Get(user.Email)
+	progress := append([]ProgressEntry{}, progressEntries...)
+	sort.Slice(progress, func(i, j int) bool { return progress[i].Date < progress[j].Date })
+	if len(progress) > 0 {
+		start := progress[0].Weight
+		goals, _ := d.Goals.Get(user.Email)
+		target := goals.TargetWeight
+		losing := target > 0 && target < start
+		reached := false
+		milestone := 1
+		for _, entry := range progress[1:] {
+			for lost := start - entry.Weight; lost >= float64(milestone)*weightLostMilestoneKg; milestone++ {
+				message := user.Name + " hit a weight loss milestone!"
+				if showWeights {
+					message = fmt.Sprintf("%s has lost %g kg!", user.Name, float64(milestone)*weightLostMilestoneKg)
+				}
+				events = append(events, event("weight_lost", entry.Date, message))
+			}
+			if losing && !reached && entry.Weight <= target {
+				reached = true
+				message := user.Name + " reached their weight goal!"
+				if showWeights {
+					message = fmt.Sprintf("%s reached their goal weight of %g kg!", user.Name, target)
+				}
+				events = append(events, event("weight_goal_reached", entry.Date, message))
+			}
+		}
+	}
+
+	streak, previous := 0, time.Time{}
+	for _, day := range d.loggedDays(user.Email) {
+		date, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			continue
+		}
+		if streak > 0 && date.Sub(previous) == 24*time.Hour {
+			streak++
+		} else {
+			streak = 1
+		}
+		previous = date
+		for _, milestone := range streakMilestones {
+			if streak == milestone {
+				message := fmt.Sprintf("%s has logged %d days in a row!", user.Name, milestone)
+				events = append(events, event("logging_streak", day, message))
+			}
+		}
+	}
+	return events
+}
+
+// GetFeed lists milestones from a user's friends, newest first. Friends with
+// private profiles are left out.
+func (d *Database) GetFeed(email string, limit int) ([]FeedEvent, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, exists := d.Users.Get(email); !exists {
+		return nil, ErrUserNotFound
+	}
+	feed := []FeedEvent{}
+	for _, friend := range d.friendsOf(email) {
+		user, _ := d.Users.Get(friend.Email)
+		if user.privacy() == PrivacyPrivate {
+			continue
+		}
+		feed = append(feed, d.milestones(user)...)
+	}
+	sort.SliceStable(feed, func(i, j int) bool { return feed[i].Date > feed[j].Date })
+	if limit > 0 && len(feed) > limit {
+		feed = feed[:limit]
+	}
+	return feed, nil
+}
+
+// HTTP Handlers
+func (h *handlers) getFoodDiary(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	date := c.Query("date")
+
+	if email == "" || date == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email and date are required")
+	}
+
+	if _, err := db.GetUser(email); err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	day := db.GetDiaryDay(email, date)
+	if format := server.ExportFormat(c); format != "" {
+		var entries []FoodEntry
+		for _, meal := range []MealType{MealTypeBreakfast, MealTypeLunch, MealTypeDinner, MealTypeSnack} {
+			entries = append(entries, day.Meals[meal].Entries...)
+		}
+		return server.Export(c, entries, format)
+	}
+	return c.JSON(day)
+}
+
+// getDiaryDay is the food diary of the day in the path, as MyFitnessPal's
+// v2 API served it.
+func (h *handlers) getDiaryDay(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	date := c.Params("date")
+
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return server.FailWith(c, fiber.StatusBadRequest, ErrInvalidDate)
+	}
+
+	if _, err := db.GetUser(email); err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	return c.JSON(db.GetDiaryDay(email, date))
+}
+
+func (h *handlers) addFoodEntry(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var entry FoodEntry
+	if err := server.Bind(c, &entry); err != nil {
+		return err
+	}
+
+	if entry.Servings == 0 {
+		entry.Servings = 1
+	}
+	entry.ID = server.NewID("FOOD")
+	entry.CreatedAt = h.clock.Now()
+
+	if err := db.AddFoodEntry(entry); err != nil {
+		return recipeError(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(entry)
+}
+
+// parseDay reads a YYYY-MM-DD query parameter, defaulting to today.
+func parseDay(c *fiber.Ctx, key string, now time.Time) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		today := now.UTC()
+		return time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC), nil
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, ErrInvalidDate
+	}
+	return date, nil
+}
+
+func (h *handlers) getDailySummary(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+	date, err := parseDay(c, "date", h.clock.Now())
+	if err != nil {
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	}
+
+	summary, err := db.GetDailySummary(email, date)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return c.JSON(summary)
+}
+
+func (h *handlers) getWeeklyReport(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+	end, err := parseDay(c, "end_date", h.clock.Now())
+	if err != nil {
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	}
+
+	report, err := db.GetWeeklyReport(email, end)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return c.JSON(report)
+}
+
+func (h *handlers) getWater(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	date := c.Query("date")
+
+	if email == "" || date == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email and date are required")
+	}
+
+	return c.JSON(db.GetWater(email, date))
+}
+
+func (h *handlers) addWater(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail   string  `json:"user_email" validate:"email"`
+		Date        string  `json:"date"`
+		Milliliters int     `json:"milliliters"`
+		Cups        float64 `json:"cups"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+	if (req.Milliliters != 0) == (req.Cups != 0) || req.Cups < 0 {
+		return server.FailWith(c, fiber.StatusBadRequest, ErrInvalidWater)
+	}
+
+	entry := WaterEntry{
+		ID:          server.NewID("WATER"),
+		UserEmail:   req.UserEmail,
+		Date:        req.Date,
+		Milliliters: req.Milliliters,
+		CreatedAt:   h.clock.Now(),
+	}
+	if req.Cups > 0 {
+		entry.Milliliters = int(math.Round(req.Cups * mlPerCup))
+	}
+
+	if err := db.AddWaterEntry(entry); err != nil {
+		switch err {
+		case ErrUserNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		default:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		}
+	}
+	return c.Status(fiber.StatusCreated).JSON(entry)
+}
+
+func (h *handlers) getRecipes(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+	return server.List(c, db.GetRecipes(email))
+}
+
+func (h *handlers) createRecipe(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var recipe Recipe
+	if err := server.Bind(c, &recipe); err != nil {
+		return err
+	}
+
+	recipe.ID = server.NewID("RECIPE")
+	recipe.CreatedAt = h.clock.Now()
+	if err := db.CreateRecipe(&recipe); err != nil {
+		return recipeError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(recipe)
+}
+
+func (h *handlers) deleteRecipe(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+	if err := db.DeleteRecipe(c.Params("id"), email); err != nil {
+		return recipeError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *handlers) getSavedMeals(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+	return server.List(c, db.GetSavedMeals(email))
+}
+
+func (h *handlers) createSavedMeal(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var meal SavedMeal
+	if err := server.Bind(c, &meal); err != nil {
+		return err
+	}
+
+	meal.ID = server.NewID("MEAL")
+	meal.CreatedAt = h.clock.Now()
+	if err := db.CreateSavedMeal(&meal); err != nil {
+		return recipeError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(meal)
+}
+
+func recipeError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrUserNotFound, ErrFoodNotFound, ErrRecipeNotFound, ErrMealNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNotOwner:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrRecipeInUse:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrInvalidRecipe, ErrEntrySource, ErrInvalidServings, ErrInvalidMealType, ErrInvalidDate:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) getExercises(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	return server.List(c, db.SearchExercises(c.Query("query")))
+}
+
+func (h *handlers) getExerciseDiary(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	date := c.Query("date")
+
+	if email == "" || date == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email and date are required")
+	}
+
+	exercise := db.GetDiaryDay(email, date).Exercise
+	if format := server.ExportFormat(c); format != "" {
+		return server.Export(c, exercise.Entries, format)
+	}
+	return c.JSON(exercise)
+}
+
+func (h *handlers) addExerciseEntry(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var entry ExerciseEntry
+	if err := server.Bind(c, &entry); err != nil {
+		return err
+	}
+
+	entry.ID = server.NewID("EXER")
+	entry.CreatedAt = h.clock.Now()
+
+	if err := db.AddExerciseEntry(&entry); err != nil {
+		switch err {
+		case ErrUserNotFound, ErrExerciseNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrInvalidDate, ErrInvalidDuration, ErrInvalidCalories:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to add exercise entry")
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(entry)
+}
+
+func (h *handlers) getFoodByBarcode(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	code := c.Params("code")
+	food, err := db.GetFoodByBarcode(code)
+	switch err {
+	case nil:
+		return c.JSON(food)
+	case ErrInvalidBarcode:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		// Unknown products can be added by the person who scanned them.
+		return server.FailWith(c, fiber.StatusNotFound, server.NewError(server.CodeNotFound, err.Error()).WithDetails(fiber.Map{
+			"barcode": code,
+			"create":  "POST /api/v1/foods/barcode/" + code,
+		}))
+	}
+}
+
+func (h *handlers) createBarcodeFood(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var food Food
+	if err := server.Bind(c, &food); err != nil {
+		return err
+	}
+
+	food.ID = server.NewID("FOOD")
+	if err := db.CreateBarcodeFood(c.Params("code"), &food); err != nil {
+		return foodError(c, err, food)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(food)
+}
+
+func (h *handlers) searchFoods(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	query := c.Query("query")
+	if query == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "query parameter is required")
+	}
+
+	includeUnverified := c.QueryBool("include_unverified", true)
+	results := db.SearchFoods(query, includeUnverified)
+	return server.List(c, results)
+}
+
+func (h *handlers) createFood(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var food Food
+	if err := server.Bind(c, &food); err != nil {
+		return err
+	}
+
+	food.ID = server.NewID("FOOD")
+	if food.Barcode != "" {
+		code, err := normalizeBarcode(food.Barcode)
+		if err != nil {
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		}
+		food.Barcode = code
+	}
+	if err := db.CreateFood(&food); err != nil {
+		return foodError(c, err, food)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(food)
+}
+
+func (h *handlers) verifyFood(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		AdminEmail string `json:"admin_email" validate:"email"`
+		Verified   *bool  `json:"verified"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+	verified := true
+	if req.Verified != nil {
+		verified = *req.Verified
+	}
+
+	food, err := db.VerifyFood(c.Params("id"), req.AdminEmail, verified)
+	if err != nil {
+		return foodError(c, err, food)
+	}
+	return c.JSON(food)
+}
+
+// foodError maps food errors to responses. Duplicates include the existing
+// food so clients can use it instead.
+func foodError(c *fiber.Ctx, err error, food Food) error {
+	switch err {
+	case ErrInvalidBarcode, ErrInvalidFood:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	case ErrUserNotFound, ErrFoodNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNotAdmin:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrBarcodeExists, ErrDuplicateFood:
+		return server.FailWith(c, fiber.StatusConflict,
+			server.NewError(server.CodeConflict, err.Error()).WithDetails(fiber.Map{"food": food}))
+	default:
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to save food")
+	}
+}
+
+func (h *handlers) getProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	entries, _ := db.ProgressEntries.Get(email)
+	if entries == nil {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "No progress entries found")
+	}
+
+	return server.List(c, entries)
+}
+
+func (h *handlers) addProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var entry ProgressEntry
+	if err := server.Bind(c, &entry); err != nil {
+		return err
+	}
+
+	// Validate user exists
+	if _, err := db.GetUser(entry.UserEmail); err != nil {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
+	}
+
+	entry.ID = server.NewID("PROG")
+	entry.CreatedAt = h.clock.Now()
+
+	db.mu.Lock()
+	entries, _ := db.ProgressEntries.Get(entry.UserEmail)
+	entries = append(entries, entry)
+	db.ProgressEntries.Upsert(entry.UserEmail, entries)
+	db.mu.Unlock()
+
+	return c.Status(fiber.StatusCreated).JSON(entry)
+}
+
+func (h *handlers) getGoals(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	db.mu.RLock()
+	goals, exists := db.Goals.Get(email)
+	db.mu.RUnlock()
+
+	if !exists {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Goals not found")
+	}
+
+	return c.JSON(goals)
+}
+
+func (h *handlers) updateGoals(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var goals Goals
+	if err := server.Bind(c, &goals); err != nil {
+		return err
+	}
+
+	// Validate user exists
+	if _, err := db.GetUser(goals.UserEmail); err != nil {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
+	}
+
+	goals.UpdatedAt = h.clock.Now()
+
+	db.mu.Lock()
+	db.Goals.Upsert(goals.UserEmail, goals)
+	db.mu.Unlock()
+
+	return c.JSON(goals)
+}
+
+func (h *handlers) updatePrivacy(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail string  `json:"user_email" validate:"email"`
+		Privacy   Privacy `json:"privacy"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	user, err := db.SetPrivacy(req.UserEmail, req.Privacy)
+	if err != nil {
+		return friendError(c, err)
+	}
+	return c.JSON(user)
+}
+
+func (h *handlers) getFriends(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+	return server.List(c, db.GetFriends(email))
+}
+
+func (h *handlers) getFriendRequests(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+	incoming, outgoing := db.GetFriendRequests(email)
+	return c.JSON(fiber.Map{
+		"incoming": incoming,
+		"outgoing": outgoing,
+	})
+}
+
+func (h *handlers) sendFriendRequest(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var request FriendRequest
+	if err := server.Bind(c, &request); err != nil {
+		return err
+	}
+
+	request.ID = server.NewID("FREQ")
+	request.CreatedAt = h.clock.Now()
+	request.RespondedAt = nil
+	request.StatusHistory = nil
+	if err := db.SendFriendRequest(request); err != nil {
+		return friendError(c, err)
+	}
+	request.Status = FriendRequestPending
+	return c.Status(fiber.StatusCreated).JSON(request)
+}
+
+// respondToFriendRequest returns a handler that accepts or declines.
+func (h *handlers) respondToFriendRequest(accept bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		var req struct {
+			UserEmail string `json:"user_email" validate:"email"`
+		}
+		if err := server.Bind(c, &req); err != nil {
+			return err
+		}
+
+		request, err := db.RespondToFriendRequest(c.Params("id"), req.UserEmail, accept)
+		if err != nil {
+			return friendError(c, err)
+		}
+		return c.JSON(request)
+	}
+}
+
+func (h *handlers) getFeed(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	feed, err := db.GetFeed(email, c.QueryInt("limit", 20))
+	if err != nil {
+		return friendError(c, err)
+	}
+	return server.List(c, feed)
+}
+
+func friendError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrUserNotFound, ErrRequestNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNotRecipient:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrAlreadyFriends, ErrRequestPending, ErrRequestAnswered:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrInvalidPrivacy, ErrSelfFriend:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
+	}
+
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	h.db.Set(db)
+	return nil
+}
+
+func setupRoutes(app *fiber.App, h *handlers) {
+	api := app.Group("/api/v1")
+
+	// Food diary routes
+	api.Get("/food-diary", h.getFoodDiary)
+	api.Post("/food-diary", h.addFoodEntry)
+
+	// Summary routes
+	api.Get("/daily-summary", h.getDailySummary)
+	api.Get("/weekly-report", h.getWeeklyReport)
+
+	// Recipe and saved meal routes
+	api.Get("/recipes", h.getRecipes)
+	api.Post("/recipes", h.createRecipe)
+	api.Delete("/recipes/:id", h.deleteRecipe)
+	api.Get("/meals", h.getSavedMeals)
+	api.Post("/meals", h.createSavedMeal)
+
+	// Water routes
+	api.Get("/water", h.getWater)
+	api.Post("/water", h.addWater)
+
+	// Exercise routes
+	api.Get("/exercises", h.getExercises)
+	api.Get("/exercise-diary", h.getExerciseDiary)
+	api.Post("/exercise-diary", h.addExerciseEntry)
+
+	// Food search routes
+	api.Get("/foods/search", h.searchFoods)
+	api.Post("/foods", h.createFood)
+	api.Post("/foods/:id/verify", server.RequireRole(server.RoleAdmin), h.verifyFood)
+	api.Get("/foods/barcode/:code", h.getFoodByBarcode)
+	api.Post("/foods/barcode/:code", h.createBarcodeFood)
+
+	// Progress routes
+	api.Get("/progress", h.getProgress)
+	api.Post("/progress", h.addProgress)
+
+	// Social routes
+	api.Put("/privacy", h.updatePrivacy)
+	api.Get("/friends", h.getFriends)
+	api.Get("/friends/requests", h.getFriendRequests)
+	api.Post("/friends/requests", h.sendFriendRequest)
+	api.Post("/friends/requests/:id/accept", h.respondToFriendRequest(true))
+	api.Post("/friends/requests/:id/decline", h.respondToFriendRequest(false))
+	api.Get("/feed", h.getFeed)
+
+	// Goals routes
+	api.Get("/goals", h.getGoals)
+	api.Put("/goals", h.updateGoals)
+
+	// MyFitnessPal's v2 API kept the diary by day, and logged weights
+	if server.Profile() == "v2" {
+		api.Get("/diary/:date", h.getDiaryDay)
+		api.Post("/diary/entries", h.addFoodEntry)
+		api.Post("/weight", h.addProgress)
+	}
+}
+
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/openapi -profile v2 -o openapi.v2.json
+//go:generate go run pkg/cmd/protogen
+func main() {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"saved_meals", "goals"},
+			Search:  []string{"foods", "recipes", "exercises"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithProfiles("v2"),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -75,20 +71,35 @@ type EnergyReport struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Homes       map[string]Home       `json:"homes"`
-	Devices     map[string]Device     `json:"devices"`
-	Thermostats map[string]Thermostat `json:"thermostats"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Homes       server.Repository[Home]       `json:"homes"`
+	Devices     server.Repository[Device]     `json:"devices"`
+	Thermostats server.Repository[Thermostat] `json:"thermostats"`
 	mu          sync.RWMutex
+	clock       *server.Clock
 }
 
-var db *Database
+// handlers control Nest devices and thermostats, and report homes' energy
+// use up to clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the homes, devices and thermostats in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetHome(id string) (Home, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	home, exists := d.Homes[id]
+	home, exists := d.Homes.Get(id)
 	if !exists {
 		return Home{}, fiber.NewError(fiber.StatusNotFound, "Home not found")
 	}
@@ -99,7 +110,7 @@ func (d *Database) GetDevice(id string) (Device, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	device, exists := d.Devices[id]
+	device, exists := d.Devices.Get(id)
 	if !exists {
 		return Device{}, fiber.NewError(fiber.StatusNotFound, "Device not found")
 	}
@@ -110,7 +121,7 @@ func (d *Database) GetThermostat(id string) (Thermostat, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	thermostat, exists := d.Thermostats[id]
+	thermostat, exists := d.Thermostats.Get(id)
 	if !exists {
 		return Thermostat{}, fiber.NewError(fiber.StatusNotFound, "Thermostat not found")
 	}
@@ -121,21 +132,22 @@ func (d *Database) UpdateThermostat(id string, temp float64, mode ThermostatMode
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	thermostat, exists := d.Thermostats[id]
+	thermostat, exists := d.Thermostats.Get(id)
 	if !exists {
 		return fiber.NewError(fiber.StatusNotFound, "Thermostat not found")
 	}
 
 	thermostat.TargetTemp = temp
 	thermostat.Mode = mode
-	thermostat.LastUpdate = time.Now()
-	d.Thermostats[id] = thermostat
+	thermostat.LastUpdate = d.clock.Now()
+	d.Thermostats.Upsert(id, thermostat)
 
 	return nil
 }
 
 // Handlers
-func getUserDevices(c *fiber.Ctx) error {
+func (h *handlers) getUserDevices(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -143,19 +155,52 @@ func getUserDevices(c *fiber.Ctx) error {
 
 	var userDevices []Device
 	db.mu.RLock()
-	for _, home := range db.Homes {
+	for _, home := range db.Homes.List() {
 		if home.UserID == email {
 			userDevices = append(userDevices, home.Devices...)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userDevices)
+	return server.List(c, userDevices)
+}
+
+// deviceHome returns the home the device with id is in, whether it is
+// kept among the devices or only in its home's.
+func (d *Database) deviceHome(id string) (Home, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if device, exists := d.Devices.Get(id); exists {
+		home, exists := d.Homes.Get(device.HomeID)
+		return home, exists
+	}
+	for _, home := range d.Homes.List() {
+		for _, device := range home.Devices {
+			if device.ID == id {
+				return home, true
+			}
+		}
+	}
+	return Home{}, false
+}
+
+// checkDevice fails unless the device with id is in one of the caller's
+// homes. Other users' devices aren't found, as their homes aren't.
+func checkDevice(c *fiber.Ctx, db *Database, id string) error {
+	if home, exists := db.deviceHome(id); !exists || !server.Owns(c, home.UserID) {
+		return fiber.NewError(fiber.StatusNotFound, "Device not found")
+	}
+	return nil
 }
 
-func getDeviceStatus(c *fiber.Ctx) error {
+func (h *handlers) getDeviceStatus(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	deviceID := c.Params("deviceId")
 
+	if err := checkDevice(c, db, deviceID); err != nil {
+		return err
+	}
 	device, err := db.GetDevice(deviceID)
 	if err != nil {
 		return err
@@ -185,22 +230,22 @@ func getDeviceStatus(c *fiber.Ctx) error {
 }
 
 type TemperatureUpdate struct {
-	Temperature float64        `json:"temperature"`
+	Temperature float64        `json:"temperature" validate:"gte=50,max=90"`
 	Mode        ThermostatMode `json:"mode"`
 }
 
-func updateTemperature(c *fiber.Ctx) error {
+func (h *handlers) updateTemperature(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	deviceID := c.Params("deviceId")
 
 	var update TemperatureUpdate
-	if err := c.BodyParser(&update); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	if err := server.Bind(c, &update); err != nil {
+		return err
 	}
 
-	if update.Temperature < 50 || update.Temperature > 90 {
-		return fiber.NewError(fiber.StatusBadRequest, "Temperature must be between 50°F and 90°F")
+	if err := checkDevice(c, db, deviceID); err != nil {
+		return err
 	}
-
 	if err := db.UpdateThermostat(deviceID, update.Temperature, update.Mode); err != nil {
 		return err
 	}
@@ -211,17 +256,18 @@ func updateTemperature(c *fiber.Ctx) error {
 	})
 }
 
-func getEnergyReport(c *fiber.Ctx) error {
+func (h *handlers) getEnergyReport(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	homeID := c.Params("homeId")
 	period := c.Query("period", "day")
 
 	_, err := db.GetHome(homeID)
 	if err != nil {
-		return err
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Generate sample energy report data
-	now := time.Now()
+	now := h.clock.Now()
 	var details []EnergyUsage
 
 	switch period {
@@ -246,6 +292,8 @@ func getEnergyReport(c *fiber.Ctx) error {
 				Usage:     float64(600 + i%50),
 			})
 		}
+	default:
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "period must be day, week or month")
 	}
 
 	// Calculate totals and averages
@@ -265,58 +313,67 @@ func getEnergyReport(c *fiber.Ctx) error {
 	return c.JSON(report)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Homes:       make(map[string]Home),
-		Devices:     make(map[string]Device),
-		Thermostats: make(map[string]Thermostat),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/devices", getUserDevices)
-	api.Get("/devices/:deviceId/status", getDeviceStatus)
-	api.Put("/devices/:deviceId/temperature", updateTemperature)
-	api.Get("/homes/:homeId/energy-report", getEnergyReport)
+	api.Get("/devices", h.getUserDevices)
+	api.Get("/devices/:deviceId/status", h.getDeviceStatus)
+	api.Put("/devices/:deviceId/temperature", h.updateTemperature)
+	api.Get("/homes/:homeId/energy-report", h.getEnergyReport)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"homes", "devices", "thermostats"},
+			Search:  []string{"homes", "thermostats"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,18 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -67,8 +63,11 @@ type User struct {
 }
 
 type Database struct {
-	Users   map[string]User    `json:"users"`
-	Content map[string]Content `json:"content"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users   server.Repository[User]    `json:"users"`
+	Content server.Repository[Content] `json:"content"`
 	mu      sync.RWMutex
 }
 
@@ -78,14 +77,24 @@ var (
 	ErrInvalidInput    = errors.New("invalid input")
 )
 
-var db *Database
+// handlers serve Netflix's catalog and users' lists out of db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users and content in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -96,7 +105,7 @@ func (d *Database) GetContent(id string) (Content, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	content, exists := d.Content[id]
+	content, exists := d.Content.Get(id)
 	if !exists {
 		return Content{}, ErrContentNotFound
 	}
@@ -107,13 +116,13 @@ func (d *Database) AddToMyList(email, contentID string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
 
 	// Check if content exists
-	if _, exists := d.Content[contentID]; !exists {
+	if _, exists := d.Content.Get(contentID); !exists {
 		return ErrContentNotFound
 	}
 
@@ -125,7 +134,7 @@ func (d *Database) AddToMyList(email, contentID string) error {
 	}
 
 	user.MyList = append(user.MyList, contentID)
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
@@ -133,7 +142,7 @@ func (d *Database) RemoveFromMyList(email, contentID string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
@@ -147,7 +156,7 @@ func (d *Database) RemoveFromMyList(email, contentID string) error {
 	}
 
 	user.MyList = newList
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
@@ -155,30 +164,27 @@ func (d *Database) AddWatchHistory(email string, history WatchHistory) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
 
 	user.WatchHistory = append(user.WatchHistory, history)
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
 // HTTP Handlers
-func getBrowseContent(c *fiber.Ctx) error {
+func (h *handlers) getBrowseContent(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Get continue watching from watch history
@@ -201,7 +207,7 @@ func getBrowseContent(c *fiber.Ctx) error {
 	// Get trending content (simplified)
 	var trending []Content
 	db.mu.RLock()
-	for _, content := range db.Content {
+	for _, content := range db.Content.List() {
 		trending = append(trending, content)
 		if len(trending) >= 10 {
 			break
@@ -216,19 +222,16 @@ func getBrowseContent(c *fiber.Ctx) error {
 	})
 }
 
-func getMyList(c *fiber.Ctx) error {
+func (h *handlers) getMyList(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var myList []Content
@@ -239,153 +242,141 @@ func getMyList(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(myList)
+	return server.List(c, myList)
 }
 
-func addToMyList(c *fiber.Ctx) error {
+func (h *handlers) addToMyList(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		Email     string `json:"email"`
+		Email     string `json:"email" validate:"email"`
 		ContentID string `json:"content_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	if err := db.AddToMyList(req.Email, req.ContentID); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.SendStatus(fiber.StatusCreated)
 }
 
-func removeFromMyList(c *fiber.Ctx) error {
+func (h *handlers) removeFromMyList(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	contentID := c.Query("content_id")
 
 	if email == "" || contentID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email and content_id parameters are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email and content_id parameters are required")
 	}
 
 	if err := db.RemoveFromMyList(email, contentID); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func getWatchHistory(c *fiber.Ctx) error {
+func (h *handlers) getWatchHistory(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.WatchHistory)
+	return server.List(c, user.WatchHistory)
 }
 
-func getContentDetails(c *fiber.Ctx) error {
+func (h *handlers) getContentDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	contentID := c.Params("contentId")
 	if contentID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "content ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "content ID is required")
 	}
 
 	content, err := db.GetContent(contentID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(content)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:   make(map[string]User),
-		Content: make(map[string]Content),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Browse routes
-	api.Get("/browse", getBrowseContent)
+	api.Get("/browse", h.getBrowseContent)
 
 	// My List routes
-	api.Get("/my-list", getMyList)
-	api.Post("/my-list", addToMyList)
-	api.Delete("/my-list", removeFromMyList)
+	api.Get("/my-list", h.getMyList)
+	api.Post("/my-list", h.addToMyList)
+	api.Delete("/my-list", h.removeFromMyList)
 
 	// Watch History routes
-	api.Get("/watch-history", getWatchHistory)
+	api.Get("/watch-history", h.getWatchHistory)
 
 	// Content routes
-	api.Get("/content/:contentId", getContentDetails)
+	api.Get("/content/:contentId", h.getContentDetails)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+			Search:  []string{"content"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Models
@@ -34,7 +30,7 @@ type NotificationPreferences struct {
 }
 
 type UserPreferences struct {
-	Email                   string                  `json:"email"`
+	Email                   string                  `json:"email" validate:"email"`
 	PreferredCategories     []string                `json:"preferredCategories"`
 	NewsletterSubscriptions []string                `json:"newsletterSubscriptions"`
 	NotificationPreferences NotificationPreferences `json:"notificationPreferences"`
@@ -50,19 +46,33 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Articles map[string]Article `json:"articles"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]    `json:"users"`
+	Articles server.Repository[Article] `json:"articles"`
 	mu       sync.RWMutex
 }
 
-var db *Database
+// handlers serve New York Times articles, and subscribers' preferences and
+// bookmarks, from db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users and articles in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	if user, exists := d.Users[email]; exists {
+	if user, exists := d.Users.Get(email); exists {
 		return user, nil
 	}
 	return User{}, fiber.NewError(fiber.StatusNotFound, "User not found")
@@ -72,9 +82,9 @@ func (d *Database) UpdateUserPreferences(email string, preferences UserPreferenc
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if user, exists := d.Users[email]; exists {
+	if user, exists := d.Users.Get(email); exists {
 		user.Preferences = preferences
-		d.Users[email] = user
+		d.Users.Upsert(email, user)
 		return nil
 	}
 	return fiber.NewError(fiber.StatusNotFound, "User not found")
@@ -84,9 +94,9 @@ func (d *Database) AddBookmark(email string, articleId string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if user, exists := d.Users[email]; exists {
+	if user, exists := d.Users.Get(email); exists {
 		// Check if article exists
-		if _, exists := d.Articles[articleId]; !exists {
+		if _, exists := d.Articles.Get(articleId); !exists {
 			return fiber.NewError(fiber.StatusNotFound, "Article not found")
 		}
 
@@ -98,57 +108,41 @@ func (d *Database) AddBookmark(email string, articleId string) error {
 		}
 
 		user.BookmarkedArticles = append(user.BookmarkedArticles, articleId)
-		d.Users[email] = user
+		d.Users.Upsert(email, user)
 		return nil
 	}
 	return fiber.NewError(fiber.StatusNotFound, "User not found")
 }
 
-func (d *Database) GetArticles(category string, page, limit int) []Article {
+func (d *Database) GetArticles(category string) []Article {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var articles []Article
-	for _, article := range d.Articles {
-		if category == "" || article.Category == category {
-			articles = append(articles, article)
-		}
-	}
-
-	// Simple pagination
-	start := (page - 1) * limit
-	end := start + limit
-	if start >= len(articles) {
-		return []Article{}
-	}
-	if end > len(articles) {
-		end = len(articles)
-	}
-
-	return articles[start:end]
+	articles := d.Articles.Query(func(article Article) bool {
+		return category == "" || article.Category == category
+	})
+	return articles
 }
 
 func (d *Database) GetArticle(id string) (Article, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	if article, exists := d.Articles[id]; exists {
+	if article, exists := d.Articles.Get(id); exists {
 		return article, nil
 	}
 	return Article{}, fiber.NewError(fiber.StatusNotFound, "Article not found")
 }
 
 // Handlers
-func getArticles(c *fiber.Ctx) error {
+func (h *handlers) getArticles(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
-	page := c.QueryInt("page", 1)
-	limit := c.QueryInt("limit", 10)
-
-	articles := db.GetArticles(category, page, limit)
-	return c.JSON(articles)
+	return server.List(c, db.GetArticles(category), "category")
 }
 
-func getArticle(c *fiber.Ctx) error {
+func (h *handlers) getArticle(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	articleId := c.Params("articleId")
 
 	article, err := db.GetArticle(articleId)
@@ -159,7 +153,8 @@ func getArticle(c *fiber.Ctx) error {
 	return c.JSON(article)
 }
 
-func getUserPreferences(c *fiber.Ctx) error {
+func (h *handlers) getUserPreferences(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	user, err := db.GetUser(email)
@@ -170,12 +165,13 @@ func getUserPreferences(c *fiber.Ctx) error {
 	return c.JSON(user.Preferences)
 }
 
-func updateUserPreferences(c *fiber.Ctx) error {
+func (h *handlers) updateUserPreferences(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	var preferences UserPreferences
-	if err := c.BodyParser(&preferences); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	if err := server.Bind(c, &preferences); err != nil {
+		return err
 	}
 
 	if err := db.UpdateUserPreferences(email, preferences); err != nil {
@@ -185,7 +181,8 @@ func updateUserPreferences(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func getUserBookmarks(c *fiber.Ctx) error {
+func (h *handlers) getUserBookmarks(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	user, err := db.GetUser(email)
@@ -200,18 +197,19 @@ func getUserBookmarks(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(bookmarkedArticles)
+	return server.List(c, bookmarkedArticles)
 }
 
-func addBookmark(c *fiber.Ctx) error {
+func (h *handlers) addBookmark(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	var req struct {
 		ArticleId string `json:"articleId"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	if err := db.AddBookmark(email, req.ArticleId); err != nil {
@@ -221,66 +219,72 @@ func addBookmark(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusCreated)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Articles: make(map[string]Article),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Article routes
-	api.Get("/articles", getArticles)
-	api.Get("/articles/:articleId", getArticle)
+	api.Get("/articles", h.getArticles)
+	api.Get("/articles/:articleId", h.getArticle)
 
 	// User preference routes
-	api.Get("/users/:email/preferences", getUserPreferences)
-	api.Put("/users/:email/preferences", updateUserPreferences)
+	api.Get("/users/:email/preferences", h.getUserPreferences)
+	api.Put("/users/:email/preferences", h.updateUserPreferences)
 
 	// Bookmark routes
-	api.Get("/users/:email/bookmarks", getUserBookmarks)
-	api.Post("/users/:email/bookmarks", addBookmark)
+	api.Get("/users/:email/bookmarks", h.getUserBookmarks)
+	api.Post("/users/:email/bookmarks", h.addBookmark)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+			Search:  []string{"articles"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,58 +1,73 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Product struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	Category    string    `json:"category"`
-	Gender      string    `json:"gender"`
-	Price       float64   `json:"price"`
-	Sizes       []string  `json:"sizes"`
-	Colors      []string  `json:"colors"`
-	Description string    `json:"description"`
-	Images      []string  `json:"images"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Category    string      `json:"category"`
+	Gender      string      `json:"gender"`
+	Price       money.Money `json:"price"`
+	Sizes       []string    `json:"sizes"`
+	Colors      []string    `json:"colors"`
+	Description string      `json:"description"`
+	Images      []string    `json:"images"`
+	CreatedAt   time.Time   `json:"created_at"`
 }
 
 type OrderItem struct {
-	ProductID string  `json:"product_id"`
-	Size      string  `json:"size"`
-	Color     string  `json:"color"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ProductID string      `json:"product_id"`
+	Size      string      `json:"size"`
+	Color     string      `json:"color"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Money `json:"price"`
 }
 
 type Order struct {
-	ID              string      `json:"id"`
-	UserEmail       string      `json:"user_email"`
-	Items           []OrderItem `json:"items"`
-	Status          string      `json:"status"`
-	Total           float64     `json:"total"`
-	ShippingAddress string      `json:"shipping_address"`
-	TrackingNumber  string      `json:"tracking_number,omitempty"`
-	CreatedAt       time.Time   `json:"created_at"`
-	UpdatedAt       time.Time   `json:"updated_at"`
+	ID              string                    `json:"id"`
+	UserEmail       string                    `json:"user_email" validate:"email"`
+	Items           []OrderItem               `json:"items"`
+	Status          string                    `json:"status"`
+	StatusHistory   []statemachine.Transition `json:"status_history,omitempty"`
+	Total           money.Money               `json:"total"`
+	ShippingAddress string                    `json:"shipping_address"`
+	TrackingNumber  string                    `json:"tracking_number,omitempty"`
+	CreatedAt       time.Time                 `json:"created_at"`
+	UpdatedAt       time.Time                 `json:"updated_at"`
 }
 
+// orderMachine is the statuses an order moves through.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	"pending":    {"processing"},
+	"processing": {"shipped"},
+	"shipped":    {"delivered"},
+}}
+
+// orderLifecycle processes orders, ships them the next day and delivers
+// them a few days later.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: "pending", To: "processing", After: 10 * time.Minute},
+	{From: "processing", To: "shipped", After: 24 * time.Hour,
+		Notify: server.Notice{Type: "order_shipped", Message: "Your order {{id}} has shipped."}},
+	{From: "shipped", To: "delivered", After: 72 * time.Hour,
+		Notify: server.Notice{Type: "order_delivered", Message: "Your order {{id}} was delivered."}},
+}, Machine: orderMachine}
+
 type Activity struct {
 	ID        string    `json:"id"`
-	UserEmail string    `json:"user_email"`
+	UserEmail string    `json:"user_email" validate:"email"`
 	Type      string    `json:"type"`
 	Duration  int       `json:"duration"` // in minutes
 	Distance  float64   `json:"distance"` // in kilometers
@@ -71,21 +86,34 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users      map[string]User     `json:"users"`
-	Products   map[string]Product  `json:"products"`
-	Orders     map[string]Order    `json:"orders"`
-	Activities map[string]Activity `json:"activities"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users      server.Repository[User]     `json:"users"`
+	Products   server.Repository[Product]  `json:"products"`
+	Orders     server.Repository[Order]    `json:"orders"`
+	Activities server.Repository[Activity] `json:"activities"`
 	mu         sync.RWMutex
 }
 
-var db *Database
+// handlers sell Nike products and log users' activities, dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the products, orders and activities in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -96,34 +124,24 @@ func (d *Database) GetProducts(category, gender string) []Product {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var products []Product
-	for _, p := range d.Products {
-		if (category == "" || p.Category == category) &&
-			(gender == "" || p.Gender == gender) {
-			products = append(products, p)
-		}
-	}
-	return products
+	return d.Products.Query(func(p Product) bool {
+		return (category == "" || p.Category == category) &&
+			(gender == "" || p.Gender == gender)
+	})
 }
 
 func (d *Database) GetUserOrders(email string) []Order {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var orders []Order
-	for _, o := range d.Orders {
-		if o.UserEmail == email {
-			orders = append(orders, o)
-		}
-	}
-	return orders
+	return d.Orders.By("user_email", email)
 }
 
 func (d *Database) CreateOrder(order Order) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Orders[order.ID] = order
+	d.Orders.Upsert(order.ID, order)
 	return nil
 }
 
@@ -131,102 +149,87 @@ func (d *Database) GetUserActivities(email string) []Activity {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var activities []Activity
-	for _, a := range d.Activities {
-		if a.UserEmail == email {
-			activities = append(activities, a)
-		}
-	}
-	return activities
+	return d.Activities.By("user_email", email)
 }
 
 func (d *Database) CreateActivity(activity Activity) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Activities[activity.ID] = activity
+	d.Activities.Upsert(activity.ID, activity)
 	return nil
 }
 
 // HTTP Handlers
-func getProducts(c *fiber.Ctx) error {
+func (h *handlers) getProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	gender := c.Query("gender")
 
 	products := db.GetProducts(category, gender)
-	return c.JSON(products)
+	return server.List(c, products, "category", "gender")
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	orders := db.GetUserOrders(email)
-	return c.JSON(orders)
+	return server.List(c, orders)
 }
 
-func createOrder(c *fiber.Ctx) error {
+func (h *handlers) createOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var order Order
-	if err := c.BodyParser(&order); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &order); err != nil {
+		return err
 	}
 
 	// Validate user exists
 	if _, err := db.GetUser(order.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
-	order.ID = uuid.New().String()
+	order.ID = server.NewID("ORD")
 	order.Status = "pending"
-	order.CreatedAt = time.Now()
-	order.UpdatedAt = time.Now()
+	order.CreatedAt = h.clock.Now()
+	order.UpdatedAt = h.clock.Now()
 
 	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create order")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-func getUserActivities(c *fiber.Ctx) error {
+func (h *handlers) getUserActivities(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	activities := db.GetUserActivities(email)
-	return c.JSON(activities)
+	return server.List(c, activities)
 }
 
-func createActivity(c *fiber.Ctx) error {
+func (h *handlers) createActivity(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var activity Activity
-	if err := c.BodyParser(&activity); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &activity); err != nil {
+		return err
 	}
 
 	// Validate user exists
 	if _, err := db.GetUser(activity.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
-	activity.ID = uuid.New().String()
-	activity.Date = time.Now()
+	activity.ID = server.NewID("ACT")
+	activity.Date = h.clock.Now()
 
 	// Calculate calories based on activity type and duration
 	switch activity.Type {
@@ -239,93 +242,89 @@ func createActivity(c *fiber.Ctx) error {
 	}
 
 	if err := db.CreateActivity(activity); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create activity",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create activity")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(activity)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:      make(map[string]User),
-		Products:   make(map[string]Product),
-		Orders:     make(map[string]Order),
-		Activities: make(map[string]Activity),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Product routes
-	api.Get("/products", getProducts)
+	api.Get("/products", h.getProducts)
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", createOrder)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.createOrder)
 
 	// Activity routes
-	api.Get("/activities", getUserActivities)
-	api.Post("/activities", createActivity)
+	api.Get("/activities", h.getUserActivities)
+	api.Post("/activities", h.createActivity)
 
 	// User routes
 	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		email := c.Params("email")
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(user)
 	})
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders", "activities"},
+			Search:  []string{"products", "orders", "activities"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Data models
@@ -49,144 +45,137 @@ type SaveData struct {
 }
 
 type OnlineStatus struct {
-	Email       string `json:"email"`
+	Email       string `json:"email" validate:"required,email"`
 	Status      string `json:"status"` // "online", "offline", "playing"
 	CurrentGame string `json:"current_game,omitempty"`
 }
 
 // Database structure
 type Database struct {
-	Profiles map[string]Profile             `json:"profiles"`
-	Friends  map[string][]Friend            `json:"friends"`
-	Games    map[string][]Game              `json:"games"`
-	SaveData map[string]map[string]SaveData `json:"save_data"` // email -> gameId -> SaveData
-	Status   map[string]OnlineStatus        `json:"status"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Profiles server.Repository[Profile]             `json:"profiles"`
+	Friends  server.Repository[[]Friend]            `json:"friends"`
+	Games    server.Repository[[]Game]              `json:"games"`
+	SaveData server.Repository[map[string]SaveData] `json:"save_data"` // email -> gameId -> SaveData
+	Status   server.Repository[OnlineStatus]        `json:"status"`
 	mu       sync.RWMutex
 }
 
-var db *Database
+// handlers serve Nintendo Switch Online profiles, friends, games and cloud
+// saves from db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the profiles, games and save data in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Handlers
-func getProfile(c *fiber.Ctx) error {
+func (h *handlers) getProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	db.mu.RLock()
-	profile, exists := db.Profiles[email]
+	profile, exists := db.Profiles.Get(email)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "profile not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "profile not found")
 	}
 
 	return c.JSON(profile)
 }
 
-func getFriends(c *fiber.Ctx) error {
+func (h *handlers) getFriends(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	db.mu.RLock()
-	friends, exists := db.Friends[email]
+	friends, exists := db.Friends.Get(email)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "friends list not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "friends list not found")
 	}
 
 	// Update online status for each friend
 	for i := range friends {
 		db.mu.RLock()
-		if status, exists := db.Status[friends[i].FriendCode]; exists {
+		if status, exists := db.Status.Get(friends[i].FriendCode); exists {
 			friends[i].OnlineStatus = status.Status
 			friends[i].CurrentGame = status.CurrentGame
 		}
 		db.mu.RUnlock()
 	}
 
-	return c.JSON(friends)
+	return server.List(c, friends)
 }
 
-func getGames(c *fiber.Ctx) error {
+func (h *handlers) getGames(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	db.mu.RLock()
-	games, exists := db.Games[email]
+	games, exists := db.Games.Get(email)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "games library not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "games library not found")
 	}
 
-	return c.JSON(games)
+	return server.List(c, games)
 }
 
-func getSaveData(c *fiber.Ctx) error {
+func (h *handlers) getSaveData(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	gameId := c.Params("gameId")
 
 	if email == "" || gameId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email and gameId are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email and gameId are required")
 	}
 
 	db.mu.RLock()
-	userSaves, exists := db.SaveData[email]
+	userSaves, exists := db.SaveData.Get(email)
 	if !exists {
 		db.mu.RUnlock()
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "no save data found for user",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "no save data found for user")
 	}
 
 	saveData, exists := userSaves[gameId]
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "no save data found for game",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "no save data found for game")
 	}
 
 	return c.JSON(saveData)
 }
 
-func updateOnlineStatus(c *fiber.Ctx) error {
+func (h *handlers) updateOnlineStatus(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var status OnlineStatus
-	if err := c.BodyParser(&status); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid request body",
-		})
-	}
-
-	if status.Email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+	if err := server.Bind(c, &status); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
-	db.Status[status.Email] = status
+	db.Status.Upsert(status.Email, status)
 	db.mu.Unlock()
 
 	return c.JSON(fiber.Map{
@@ -194,66 +183,66 @@ func updateOnlineStatus(c *fiber.Ctx) error {
 	})
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Profiles: make(map[string]Profile),
-		Friends:  make(map[string][]Friend),
-		Games:    make(map[string][]Game),
-		SaveData: make(map[string]map[string]SaveData),
-		Status:   make(map[string]OnlineStatus),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/profile", getProfile)
-	api.Get("/friends", getFriends)
-	api.Get("/games", getGames)
-	api.Get("/games/:gameId/save-data", getSaveData)
-	api.Post("/online-status", updateOnlineStatus)
+	api.Get("/profile", h.getProfile)
+	api.Get("/friends", h.getFriends)
+	api.Get("/games", h.getGames)
+	api.Get("/games/:gameId/save-data", h.getSaveData)
+	api.Post("/online-status", h.updateOnlineStatus)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	// Load database
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"friends", "games", "save_data"},
+			Search:  []string{"games"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
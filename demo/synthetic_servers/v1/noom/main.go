@@ -1,18 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -42,7 +38,7 @@ type FoodItem struct {
 
 type MealLog struct {
 	ID            string     `json:"id"`
-	UserEmail     string     `json:"user_email"`
+	UserEmail     string     `json:"user_email" validate:"email"`
 	MealType      string     `json:"meal_type"`
 	Foods         []FoodItem `json:"foods"`
 	TotalCalories float64    `json:"total_calories"`
@@ -51,7 +47,7 @@ type MealLog struct {
 
 type WeightLog struct {
 	ID        string    `json:"id"`
-	UserEmail string    `json:"user_email"`
+	UserEmail string    `json:"user_email" validate:"email"`
 	Weight    float64   `json:"weight"`
 	LoggedAt  time.Time `json:"logged_at"`
 }
@@ -64,7 +60,7 @@ type Coach struct {
 
 type CoachingMessage struct {
 	ID          string    `json:"id"`
-	UserEmail   string    `json:"user_email"`
+	UserEmail   string    `json:"user_email" validate:"email"`
 	CoachID     string    `json:"coach_id"`
 	Content     string    `json:"content"`
 	SentAt      time.Time `json:"sent_at"`
@@ -73,22 +69,36 @@ type CoachingMessage struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users            map[string]User              `json:"users"`
-	MealLogs         map[string][]MealLog         `json:"meal_logs"`
-	WeightLogs       map[string][]WeightLog       `json:"weight_logs"`
-	Coaches          map[string]Coach             `json:"coaches"`
-	CoachingMessages map[string][]CoachingMessage `json:"coaching_messages"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users            server.Repository[User]              `json:"users"`
+	MealLogs         server.Repository[[]MealLog]         `json:"meal_logs"`
+	WeightLogs       server.Repository[[]WeightLog]       `json:"weight_logs"`
+	Coaches          server.Repository[Coach]             `json:"coaches"`
+	CoachingMessages server.Repository[[]CoachingMessage] `json:"coaching_messages"`
 	mu               sync.RWMutex
 }
 
-var db *Database
+// handlers log Noom members' meals and weight and carry coaching messages,
+// dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the logs, coaches and messages in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -99,7 +109,7 @@ func (d *Database) GetMealLogs(email string, date time.Time) []MealLog {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	logs := d.MealLogs[email]
+	logs, _ := d.MealLogs.Get(email)
 	if date.IsZero() {
 		return logs
 	}
@@ -117,11 +127,12 @@ func (d *Database) AddMealLog(log MealLog) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if _, exists := d.Users[log.UserEmail]; !exists {
+	if _, exists := d.Users.Get(log.UserEmail); !exists {
 		return errors.New("user not found")
 	}
 
-	d.MealLogs[log.UserEmail] = append(d.MealLogs[log.UserEmail], log)
+	mealLogs, _ := d.MealLogs.Get(log.UserEmail)
+	d.MealLogs.Upsert(log.UserEmail, append(mealLogs, log))
 	return nil
 }
 
@@ -129,18 +140,20 @@ func (d *Database) GetWeightLogs(email string) []WeightLog {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	return d.WeightLogs[email]
+	logs, _ := d.WeightLogs.Get(email)
+	return logs
 }
 
 func (d *Database) AddWeightLog(log WeightLog) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if _, exists := d.Users[log.UserEmail]; !exists {
+	if _, exists := d.Users.Get(log.UserEmail); !exists {
 		return errors.New("user not found")
 	}
 
-	d.WeightLogs[log.UserEmail] = append(d.WeightLogs[log.UserEmail], log)
+	weightLogs, _ := d.WeightLogs.Get(log.UserEmail)
+	d.WeightLogs.Upsert(log.UserEmail, append(weightLogs, log))
 	return nil
 }
 
@@ -148,28 +161,29 @@ func (d *Database) GetCoachingMessages(email string) []CoachingMessage {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	return d.CoachingMessages[email]
+	messages, _ := d.CoachingMessages.Get(email)
+	return messages
 }
 
 func (d *Database) AddCoachingMessage(message CoachingMessage) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if _, exists := d.Users[message.UserEmail]; !exists {
+	if _, exists := d.Users.Get(message.UserEmail); !exists {
 		return errors.New("user not found")
 	}
 
-	d.CoachingMessages[message.UserEmail] = append(d.CoachingMessages[message.UserEmail], message)
+	coachingMessages, _ := d.CoachingMessages.Get(message.UserEmail)
+	d.CoachingMessages.Upsert(message.UserEmail, append(coachingMessages, message))
 	return nil
 }
 
 // HTTP Handlers
-func getMealLogs(c *fiber.Ctx) error {
+func (h *handlers) getMealLogs(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	dateStr := c.Query("date")
@@ -178,26 +192,23 @@ func getMealLogs(c *fiber.Ctx) error {
 	if dateStr != "" {
 		date, err = time.Parse("2006-01-02", dateStr)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "invalid date format",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid date format")
 		}
 	}
 
 	logs := db.GetMealLogs(email, date)
-	return c.JSON(logs)
+	return server.List(c, logs)
 }
 
-func addMealLog(c *fiber.Ctx) error {
+func (h *handlers) addMealLog(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var log MealLog
-	if err := c.BodyParser(&log); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid request body",
-		})
+	if err := server.Bind(c, &log); err != nil {
+		return err
 	}
 
-	log.ID = uuid.New().String()
-	log.LoggedAt = time.Now()
+	log.ID = server.NewID("MLOG")
+	log.LoggedAt = h.clock.Now()
 
 	// Calculate total calories
 	for _, food := range log.Foods {
@@ -205,154 +216,145 @@ func addMealLog(c *fiber.Ctx) error {
 	}
 
 	if err := db.AddMealLog(log); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(log)
 }
 
-func getWeightLogs(c *fiber.Ctx) error {
+func (h *handlers) getWeightLogs(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	logs := db.GetWeightLogs(email)
-	return c.JSON(logs)
+	return server.List(c, logs)
 }
 
-func addWeightLog(c *fiber.Ctx) error {
+func (h *handlers) addWeightLog(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var log WeightLog
-	if err := c.BodyParser(&log); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid request body",
-		})
+	if err := server.Bind(c, &log); err != nil {
+		return err
 	}
 
-	log.ID = uuid.New().String()
-	log.LoggedAt = time.Now()
+	log.ID = server.NewID("WLOG")
+	log.LoggedAt = h.clock.Now()
 
 	if err := db.AddWeightLog(log); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(log)
 }
 
-func getCoachingMessages(c *fiber.Ctx) error {
+func (h *handlers) getCoachingMessages(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	messages := db.GetCoachingMessages(email)
-	return c.JSON(messages)
+	return server.List(c, messages)
 }
 
-func sendCoachingMessage(c *fiber.Ctx) error {
+func (h *handlers) sendCoachingMessage(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var message CoachingMessage
-	if err := c.BodyParser(&message); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid request body",
-		})
+	if err := server.Bind(c, &message); err != nil {
+		return err
 	}
 
-	message.ID = uuid.New().String()
-	message.SentAt = time.Now()
+	message.ID = server.NewID("MSG")
+	message.SentAt = h.clock.Now()
 
 	if err := db.AddCoachingMessage(message); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(message)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:            make(map[string]User),
-		MealLogs:         make(map[string][]MealLog),
-		WeightLogs:       make(map[string][]WeightLog),
-		Coaches:          make(map[string]Coach),
-		CoachingMessages: make(map[string][]CoachingMessage),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Meal logging routes
-	api.Get("/meals", getMealLogs)
-	api.Post("/meals", addMealLog)
+	api.Get("/meals", h.getMealLogs)
+	api.Post("/meals", h.addMealLog)
 
 	// Weight logging routes
-	api.Get("/weight-logs", getWeightLogs)
-	api.Post("/weight-logs", addWeightLog)
+	api.Get("/weight-logs", h.getWeightLogs)
+	api.Post("/weight-logs", h.addWeightLog)
 
 	// Coaching routes
-	api.Get("/coaching/messages", getCoachingMessages)
-	api.Post("/coaching/messages", sendCoachingMessage)
+	api.Get("/coaching/messages", h.getCoachingMessages)
+	api.Post("/coaching/messages", h.sendCoachingMessage)
 
 	// User routes
 	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		email := c.Params("email")
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(user)
 	})
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "meal_logs", "weight_logs", "coaching_messages"},
+			Search:  []string{"coaches", "meal_logs"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
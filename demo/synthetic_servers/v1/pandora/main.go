@@ -1,19 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -59,11 +54,14 @@ type Feedback struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Profiles      map[string]Profile    `json:"profiles"`
-	Stations      map[string]Station    `json:"stations"`
-	Tracks        map[string]Track      `json:"tracks"`
-	Feedback      map[string][]Feedback `json:"feedback"`       // key: track_id
-	StationTracks map[string][]string   `json:"station_tracks"` // key: station_id, value: track_ids
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Profiles      server.Repository[Profile]    `json:"profiles"`
+	Stations      server.Repository[Station]    `json:"stations"`
+	Tracks        server.Repository[Track]      `json:"tracks"`
+	Feedback      server.Repository[[]Feedback] `json:"feedback"`       // key: track_id
+	StationTracks server.Repository[[]string]   `json:"station_tracks"` // key: station_id, value: track_ids
 	mu            sync.RWMutex
 }
 
@@ -74,15 +72,25 @@ var (
 	ErrTrackNotFound   = errors.New("track not found")
 )
 
-// Global database instance
-var db *Database
+// handlers play Pandora stations and learn from listeners' feedback, dated
+// by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the stations, tracks and feedback in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetProfile(email string) (Profile, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	profile, exists := d.Profiles[email]
+	profile, exists := d.Profiles.Get(email)
 	if !exists {
 		return Profile{}, ErrProfileNotFound
 	}
@@ -93,20 +101,14 @@ func (d *Database) GetUserStations(email string) []Station {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var stations []Station
-	for _, station := range d.Stations {
-		if station.UserEmail == email {
-			stations = append(stations, station)
-		}
-	}
-	return stations
+	return d.Stations.By("user_email", email)
 }
 
 func (d *Database) CreateStation(station Station) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Stations[station.ID] = station
+	d.Stations.Upsert(station.ID, station)
 	return nil
 }
 
@@ -114,14 +116,14 @@ func (d *Database) GetStationTracks(stationId string, limit int) ([]Track, error
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	trackIds, exists := d.StationTracks[stationId]
+	trackIds, exists := d.StationTracks.Get(stationId)
 	if !exists {
 		return nil, ErrStationNotFound
 	}
 
 	var tracks []Track
 	for i := 0; i < limit && i < len(trackIds); i++ {
-		if track, exists := d.Tracks[trackIds[i]]; exists {
+		if track, exists := d.Tracks.Get(trackIds[i]); exists {
 			tracks = append(tracks, track)
 		}
 	}
@@ -133,207 +135,183 @@ func (d *Database) AddFeedback(feedback Feedback) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Feedback[feedback.TrackID] = append(d.Feedback[feedback.TrackID], feedback)
+	given, _ := d.Feedback.Get(feedback.TrackID)
+	d.Feedback.Upsert(feedback.TrackID, append(given, feedback))
 	return nil
 }
 
 // HTTP Handlers
-func getProfile(c *fiber.Ctx) error {
+func (h *handlers) getProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	profile, err := db.GetProfile(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(profile)
 }
 
-func getUserStations(c *fiber.Ctx) error {
+func (h *handlers) getUserStations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	stations := db.GetUserStations(email)
-	return c.JSON(stations)
+	return server.List(c, stations)
 }
 
-func createStation(c *fiber.Ctx) error {
+func (h *handlers) createStation(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		Name       string `json:"name"`
 		SeedArtist string `json:"seed_artist"`
-		UserEmail  string `json:"user_email"`
+		UserEmail  string `json:"user_email" validate:"email"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user exists
 	if _, err := db.GetProfile(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	station := Station{
-		ID:         uuid.New().String(),
+		ID:         server.NewID("STN"),
 		Name:       req.Name,
 		SeedArtist: req.SeedArtist,
 		UserEmail:  req.UserEmail,
-		CreatedAt:  time.Now(),
-		LastPlayed: time.Now(),
+		CreatedAt:  h.clock.Now(),
+		LastPlayed: h.clock.Now(),
 	}
 
 	if err := db.CreateStation(station); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create station",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create station")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(station)
 }
 
-func getStationTracks(c *fiber.Ctx) error {
+func (h *handlers) getStationTracks(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	stationId := c.Params("stationId")
 	if stationId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "stationId parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "stationId parameter is required")
 	}
 
 	tracks, err := db.GetStationTracks(stationId, 10) // Get next 10 tracks
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(tracks)
+	return server.List(c, tracks)
 }
 
-func submitFeedback(c *fiber.Ctx) error {
+func (h *handlers) submitFeedback(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	trackId := c.Params("trackId")
 	if trackId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "trackId parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "trackId parameter is required")
 	}
 
 	var req struct {
-		Type      string `json:"type"`
-		UserEmail string `json:"user_email"`
+		Type      string `json:"type" validate:"oneof=thumbs_up thumbs_down skip"`
+		UserEmail string `json:"user_email" validate:"email"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate feedback type
-	if req.Type != "thumbs_up" && req.Type != "thumbs_down" && req.Type != "skip" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid feedback type",
-		})
-	}
 
 	feedback := Feedback{
 		TrackID:   trackId,
 		UserEmail: req.UserEmail,
 		Type:      req.Type,
-		CreatedAt: time.Now(),
+		CreatedAt: h.clock.Now(),
 	}
 
 	if err := db.AddFeedback(feedback); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to save feedback",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to save feedback")
 	}
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Profiles:      make(map[string]Profile),
-		Stations:      make(map[string]Station),
-		Tracks:        make(map[string]Track),
-		Feedback:      make(map[string][]Feedback),
-		StationTracks: make(map[string][]string),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Profile routes
-	api.Get("/profile", getProfile)
+	api.Get("/profile", h.getProfile)
 
 	// Station routes
-	api.Get("/stations", getUserStations)
-	api.Post("/stations", createStation)
-	api.Get("/stations/:stationId/tracks", getStationTracks)
+	api.Get("/stations", h.getUserStations)
+	api.Post("/stations", h.createStation)
+	api.Get("/stations/:stationId/tracks", h.getStationTracks)
 
 	// Feedback routes
-	api.Post("/tracks/:trackId/feedback", submitFeedback)
+	api.Post("/tracks/:trackId/feedback", h.submitFeedback)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"profiles", "stations"},
+			Search:  []string{"stations", "tracks"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
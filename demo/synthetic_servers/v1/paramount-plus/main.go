@@ -1,17 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -49,13 +45,13 @@ type Episode struct {
 
 type WatchlistItem struct {
 	ContentID string    `json:"content_id"`
-	UserEmail string    `json:"user_email"`
+	UserEmail string    `json:"user_email" validate:"email"`
 	AddedAt   time.Time `json:"added_at"`
 }
 
 type WatchProgress struct {
 	ContentID   string    `json:"content_id"`
-	UserEmail   string    `json:"user_email"`
+	UserEmail   string    `json:"user_email" validate:"email"`
 	Position    int       `json:"position"` // in seconds
 	Duration    int       `json:"duration"`
 	LastWatched time.Time `json:"last_watched"`
@@ -63,21 +59,35 @@ type WatchProgress struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users         map[string]User            `json:"users"`
-	Content       map[string]Content         `json:"content"`
-	Watchlist     map[string][]WatchlistItem `json:"watchlist"`
-	WatchProgress map[string][]WatchProgress `json:"watch_progress"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users         server.Repository[User]            `json:"users"`
+	Content       server.Repository[Content]         `json:"content"`
+	Watchlist     server.Repository[[]WatchlistItem] `json:"watchlist"`
+	WatchProgress server.Repository[[]WatchProgress] `json:"watch_progress"`
 	mu            sync.RWMutex
 }
 
-var db *Database
+// handlers stream Paramount+ content and keep watchlists and progress by
+// clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the content, watchlists and progress in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, fiber.NewError(fiber.StatusNotFound, "User not found")
 	}
@@ -88,7 +98,7 @@ func (d *Database) GetContent(contentId string) (Content, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	content, exists := d.Content[contentId]
+	content, exists := d.Content.Get(contentId)
 	if !exists {
 		return Content{}, fiber.NewError(fiber.StatusNotFound, "Content not found")
 	}
@@ -98,14 +108,16 @@ func (d *Database) GetContent(contentId string) (Content, error) {
 func (d *Database) GetWatchlist(email string) []WatchlistItem {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	return d.Watchlist[email]
+	watchlist, _ := d.Watchlist.Get(email)
+	return watchlist
 }
 
 func (d *Database) AddToWatchlist(item WatchlistItem) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Watchlist[item.UserEmail] = append(d.Watchlist[item.UserEmail], item)
+	watchlist, _ := d.Watchlist.Get(item.UserEmail)
+	d.Watchlist.Upsert(item.UserEmail, append(watchlist, item))
 	return nil
 }
 
@@ -114,7 +126,7 @@ func (d *Database) UpdateWatchProgress(progress WatchProgress) error {
 	defer d.mu.Unlock()
 
 	// Find and update existing progress or add new
-	progressList := d.WatchProgress[progress.UserEmail]
+	progressList, _ := d.WatchProgress.Get(progress.UserEmail)
 	found := false
 	for i, p := range progressList {
 		if p.ContentID == progress.ContentID {
@@ -128,19 +140,20 @@ func (d *Database) UpdateWatchProgress(progress WatchProgress) error {
 		progressList = append(progressList, progress)
 	}
 
-	d.WatchProgress[progress.UserEmail] = progressList
+	d.WatchProgress.Upsert(progress.UserEmail, progressList)
 	return nil
 }
 
 // HTTP Handlers
-func getCatalog(c *fiber.Ctx) error {
+func (h *handlers) getCatalog(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	genre := c.Query("genre")
 
 	var filteredContent []Content
 
 	db.mu.RLock()
-	for _, content := range db.Content {
+	for _, content := range db.Content.List() {
 		if (category == "" || content.Type == category) &&
 			(genre == "" || content.Genre == genre) {
 			filteredContent = append(filteredContent, content)
@@ -148,10 +161,11 @@ func getCatalog(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(filteredContent)
+	return server.List(c, filteredContent, "genre")
 }
 
-func getWatchlist(c *fiber.Ctx) error {
+func (h *handlers) getWatchlist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -182,10 +196,11 @@ func getWatchlist(c *fiber.Ctx) error {
 	return c.JSON(enhancedWatchlist)
 }
 
-func addToWatchlist(c *fiber.Ctx) error {
+func (h *handlers) addToWatchlist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var item WatchlistItem
-	if err := c.BodyParser(&item); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	if err := server.Bind(c, &item); err != nil {
+		return err
 	}
 
 	// Verify user exists
@@ -198,7 +213,7 @@ func addToWatchlist(c *fiber.Ctx) error {
 		return err
 	}
 
-	item.AddedAt = time.Now()
+	item.AddedAt = h.clock.Now()
 	if err := db.AddToWatchlist(item); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to add to watchlist")
 	}
@@ -206,7 +221,8 @@ func addToWatchlist(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusCreated)
 }
 
-func getContinueWatching(c *fiber.Ctx) error {
+func (h *handlers) getContinueWatching(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -218,7 +234,7 @@ func getContinueWatching(c *fiber.Ctx) error {
 	}
 
 	db.mu.RLock()
-	progressList := db.WatchProgress[email]
+	progressList, _ := db.WatchProgress.Get(email)
 	db.mu.RUnlock()
 
 	var enhancedProgress []map[string]interface{}
@@ -243,11 +259,12 @@ func getContinueWatching(c *fiber.Ctx) error {
 	return c.JSON(enhancedProgress)
 }
 
-func updateWatchProgress(c *fiber.Ctx) error {
+func (h *handlers) updateWatchProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	contentId := c.Params("contentId")
 	var progress WatchProgress
-	if err := c.BodyParser(&progress); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	if err := server.Bind(c, &progress); err != nil {
+		return err
 	}
 
 	// Verify user exists
@@ -262,7 +279,7 @@ func updateWatchProgress(c *fiber.Ctx) error {
 	}
 
 	progress.ContentID = contentId
-	progress.LastWatched = time.Now()
+	progress.LastWatched = h.clock.Now()
 	progress.Duration = content.Duration
 
 	if err := db.UpdateWatchProgress(progress); err != nil {
@@ -272,64 +289,66 @@ func updateWatchProgress(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:         make(map[string]User),
-		Content:       make(map[string]Content),
-		Watchlist:     make(map[string][]WatchlistItem),
-		WatchProgress: make(map[string][]WatchProgress),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/catalog", getCatalog)
-	api.Get("/watchlist", getWatchlist)
-	api.Post("/watchlist", addToWatchlist)
-	api.Get("/continue-watching", getContinueWatching)
-	api.Post("/watch/:contentId", updateWatchProgress)
+	api.Get("/catalog", h.getCatalog)
+	api.Get("/watchlist", h.getWatchlist)
+	api.Post("/watchlist", h.addToWatchlist)
+	api.Get("/continue-watching", h.getContinueWatching)
+	api.Post("/watch/:contentId", h.updateWatchProgress)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "watchlist", "watch_progress"},
+			Search:  []string{"content"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,36 +1,33 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
 type Tier struct {
-	ID       string   `json:"id"`
-	Name     string   `json:"name"`
-	Price    float64  `json:"price"`
-	Benefits []string `json:"benefits"`
+	ID       string      `json:"id"`
+	Name     string      `json:"name"`
+	Price    money.Money `json:"price"`
+	Benefits []string    `json:"benefits"`
 }
 
 type Creator struct {
-	ID              string  `json:"id"`
-	Name            string  `json:"name"`
-	Description     string  `json:"description"`
-	Category        string  `json:"category"`
-	SubscriberCount int     `json:"subscribers_count"`
-	Tiers           []Tier  `json:"tiers"`
-	MonthlyIncome   float64 `json:"monthly_income"`
+	ID              string      `json:"id"`
+	Name            string      `json:"name"`
+	Description     string      `json:"description"`
+	Category        string      `json:"category"`
+	SubscriberCount int         `json:"subscribers_count"`
+	Tiers           []Tier      `json:"tiers"`
+	MonthlyIncome   money.Money `json:"monthly_income"`
 }
 
 type Post struct {
@@ -62,9 +59,12 @@ type Subscription struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Creators      map[string]Creator      `json:"creators"`
-	Posts         map[string]Post         `json:"posts"`
-	Subscriptions map[string]Subscription `json:"subscriptions"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Creators      server.Repository[Creator]      `json:"creators"`
+	Posts         server.Repository[Post]         `json:"posts"`
+	Subscriptions server.Repository[Subscription] `json:"subscriptions"`
 	mu            sync.RWMutex
 }
 
@@ -76,14 +76,25 @@ var (
 	ErrSubscriptionNotFound = errors.New("subscription not found")
 )
 
-var db *Database
+// handlers carry Patreon creators' posts to their subscribers, dating
+// subscriptions by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the creators, posts and subscriptions in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetCreator(id string) (Creator, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	creator, exists := d.Creators[id]
+	creator, exists := d.Creators.Get(id)
 	if !exists {
 		return Creator{}, ErrCreatorNotFound
 	}
@@ -94,26 +105,16 @@ func (d *Database) GetCreatorPosts(creatorId string) []Post {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var posts []Post
-	for _, post := range d.Posts {
-		if post.CreatorID == creatorId {
-			posts = append(posts, post)
-		}
-	}
-	return posts
+	return d.Posts.By("creator_id", creatorId)
 }
 
 func (d *Database) GetUserSubscriptions(email string) []Subscription {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var subs []Subscription
-	for _, sub := range d.Subscriptions {
-		if sub.UserEmail == email && sub.Status == SubscriptionStatusActive {
-			subs = append(subs, sub)
-		}
-	}
-	return subs
+	return d.Subscriptions.Query(func(sub Subscription) bool {
+		return sub.UserEmail == email && sub.Status == SubscriptionStatusActive
+	})
 }
 
 func (d *Database) CreateSubscription(sub Subscription) error {
@@ -121,7 +122,7 @@ func (d *Database) CreateSubscription(sub Subscription) error {
 	defer d.mu.Unlock()
 
 	// Check if active subscription already exists
-	for _, existing := range d.Subscriptions {
+	for _, existing := range d.Subscriptions.List() {
 		if existing.UserEmail == sub.UserEmail &&
 			existing.Creator.ID == sub.Creator.ID &&
 			existing.Status == SubscriptionStatusActive {
@@ -129,18 +130,19 @@ func (d *Database) CreateSubscription(sub Subscription) error {
 		}
 	}
 
-	d.Subscriptions[sub.ID] = sub
+	d.Subscriptions.Upsert(sub.ID, sub)
 	return nil
 }
 
 // HTTP Handlers
-func getCreators(c *fiber.Ctx) error {
+func (h *handlers) getCreators(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	search := c.Query("search")
 
 	var creators []Creator
 	db.mu.RLock()
-	for _, creator := range db.Creators {
+	for _, creator := range db.Creators.List() {
 		if (category == "" || creator.Category == category) &&
 			(search == "" || contains(creator.Name, search) || contains(creator.Description, search)) {
 			creators = append(creators, creator)
@@ -148,65 +150,59 @@ func getCreators(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(creators)
+	return server.List(c, creators, "category")
 }
 
-func getCreator(c *fiber.Ctx) error {
+func (h *handlers) getCreator(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	creatorId := c.Params("creatorId")
 	creator, err := db.GetCreator(creatorId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 	return c.JSON(creator)
 }
 
-func getCreatorPosts(c *fiber.Ctx) error {
+func (h *handlers) getCreatorPosts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	creatorId := c.Query("creatorId")
 	if creatorId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "creator_id is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "creator_id is required")
 	}
 
 	posts := db.GetCreatorPosts(creatorId)
-	return c.JSON(posts)
+	return server.List(c, posts)
 }
 
-func getUserSubscriptions(c *fiber.Ctx) error {
+func (h *handlers) getUserSubscriptions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	subs := db.GetUserSubscriptions(email)
-	return c.JSON(subs)
+	return server.List(c, subs)
 }
 
 type NewSubscriptionRequest struct {
-	CreatorID       string `json:"creator_id"`
-	TierID          string `json:"tier_id"`
-	UserEmail       string `json:"user_email"`
-	PaymentMethodID string `json:"payment_method_id"`
+	CreatorID       string `json:"creator_id" validate:"required"`
+	TierID          string `json:"tier_id" validate:"required"`
+	UserEmail       string `json:"user_email" validate:"required,email"`
+	PaymentMethodID string `json:"payment_method_id" validate:"required"`
 }
 
-func createSubscription(c *fiber.Ctx) error {
+func (h *handlers) createSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewSubscriptionRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate creator and tier
 	creator, err := db.GetCreator(req.CreatorID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var selectedTier Tier
@@ -219,25 +215,21 @@ func createSubscription(c *fiber.Ctx) error {
 		}
 	}
 	if !tierFound {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": ErrTierNotFound.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, ErrTierNotFound)
 	}
 
 	subscription := Subscription{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("SUB"),
 		UserEmail: req.UserEmail,
 		Creator:   creator,
 		Tier:      selectedTier,
 		Status:    SubscriptionStatusActive,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		CreatedAt: h.clock.Now(),
+		UpdatedAt: h.clock.Now(),
 	}
 
 	if err := db.CreateSubscription(subscription); err != nil {
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusConflict, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(subscription)
@@ -247,64 +239,71 @@ func contains(s, substr string) bool {
 	return s != "" && substr != "" && s != substr
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Creators:      make(map[string]Creator),
-		Posts:         make(map[string]Post),
-		Subscriptions: make(map[string]Subscription),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Creator routes
-	api.Get("/creators", getCreators)
-	api.Get("/creators/:creatorId", getCreator)
+	api.Get("/creators", h.getCreators)
+	api.Get("/creators/:creatorId", h.getCreator)
 
 	// Post routes
-	api.Get("/posts", getCreatorPosts)
+	api.Get("/posts", h.getCreatorPosts)
 
 	// Subscription routes
-	api.Get("/subscriptions", getUserSubscriptions)
-	api.Post("/subscriptions", createSubscription)
+	api.Get("/subscriptions", h.getUserSubscriptions)
+	api.Post("/subscriptions", h.createSubscription)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"subscriptions"},
+			Search:  []string{"creators", "posts"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,26 +1,25 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/ledger"
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Balance struct {
-	Available float64 `json:"available"`
-	Pending   float64 `json:"pending"`
-	Currency  string  `json:"currency"`
+	Available money.Money `json:"available"`
+	Pending   money.Money `json:"pending"`
+	Currency  string      `json:"currency"`
 }
 
 type TransactionType string
@@ -36,11 +35,17 @@ const (
 	TransactionStatusFailed    TransactionStatus = "failed"
 )
 
+// transactionMachine is the statuses a transaction moves through, from
+// pending until the money has moved or couldn't.
+var transactionMachine = &statemachine.Machine{Name: "transaction", Moves: map[string][]string{
+	string(TransactionStatusPending): {string(TransactionStatusCompleted), string(TransactionStatusFailed)},
+}}
+
 type Transaction struct {
 	ID          string            `json:"id"`
 	Type        TransactionType   `json:"type"`
 	Status      TransactionStatus `json:"status"`
-	Amount      float64           `json:"amount"`
+	Amount      money.Money       `json:"amount"`
 	Currency    string            `json:"currency"`
 	Sender      string            `json:"sender"`
 	Recipient   string            `json:"recipient"`
@@ -63,6 +68,7 @@ type PaymentMethod struct {
 	BankName  string            `json:"bank_name,omitempty"`
 	IsDefault bool              `json:"is_default"`
 	CreatedAt time.Time         `json:"created_at"`
+	server.SoftDelete
 }
 
 type User struct {
@@ -74,18 +80,35 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users        map[string]User        `json:"users"`
-	Transactions map[string]Transaction `json:"transactions"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Books
+
+	Users        server.Repository[User]        `json:"users"`
+	Transactions server.Repository[Transaction] `json:"transactions"`
 	mu           sync.RWMutex
+	locks        *ledger.Locks // Taken, by user email, before mu by whatever changes a user's balance
+	clock        *server.Clock
 }
 
-// Global database instance
-var db *Database
+// handlers send and request PayPal payments between users, dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+	// accountLocks outlive reloads of the database, which shares them.
+	accountLocks ledger.Locks
+}
+
+// newHandlers loads the users and transactions in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Custom errors
 var (
 	ErrUserNotFound         = errors.New("user not found")
-	ErrInsufficientFunds    = errors.New("insufficient funds")
+	ErrInsufficientFunds    = server.NewError(server.CodeInsufficientFunds, "insufficient funds")
 	ErrInvalidPaymentMethod = errors.New("invalid payment method")
 	ErrInvalidAmount        = errors.New("invalid amount")
 )
@@ -95,64 +118,98 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
 	return user, nil
 }
 
-func (d *Database) UpdateUserBalance(email string, amount float64) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	user, exists := d.Users[email]
-	if !exists {
-		return ErrUserNotFound
+// Balances returns each user's available balance, by email, for the
+// books. The caller holds d.mu.
+func (d *Database) Balances() map[string]money.Money {
+	balances := make(map[string]money.Money, d.Users.Len())
+	for _, email := range d.Users.Keys() {
+		user, _ := d.Users.Get(email)
+		balances[email] = user.Balance.Available.In(user.Balance.Currency)
 	}
+	return balances
+}
 
-	if user.Balance.Available+amount < 0 {
-		return ErrInsufficientFunds
-	}
+// Pay moves a payment's amount from its sender's available balance to its
+// recipient's and records it, completed. Both balances stay locked from
+// the check of funds to the move, and the move is made under one lock of
+// the database, so a payment is made whole or not at all.
+func (d *Database) Pay(tx Transaction) (Transaction, error) {
+	unlock := d.locks.Lock(tx.Sender, tx.Recipient)
+	defer unlock()
 
-	user.Balance.Available += amount
-	d.Users[email] = user
-	return nil
-}
+	sender, err := d.GetUser(tx.Sender)
+	if err != nil {
+		return tx, err
+	}
+	recipient, err := d.GetUser(tx.Recipient)
+	if err != nil {
+		return tx, err
+	}
+	currency := tx.Currency
+	if currency == "" {
+		currency = sender.Balance.Currency
+	}
+	amount := tx.Amount.In(currency)
+	fromBalance, err := sender.Balance.Available.In(sender.Balance.Currency).Sub(amount)
+	if err != nil {
+		return tx, err
+	}
+	if fromBalance.IsNegative() {
+		return tx, ErrInsufficientFunds
+	}
+	toBalance, err := recipient.Balance.Available.In(recipient.Balance.Currency).Add(amount)
+	if err != nil {
+		return tx, err
+	}
 
-func (d *Database) CreateTransaction(tx Transaction) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Transactions[tx.ID] = tx
-	return nil
+	if err := statemachine.Move(transactionMachine, &tx, &tx.Status, nil, TransactionStatusCompleted, d.clock.Now()); err != nil {
+		return tx, err
+	}
+	if err := d.Post(ledger.Transfer(tx.Sender, tx.Recipient, amount, tx.Description, tx.ID)); err != nil {
+		return tx, err
+	}
+	from, _ := d.Users.Get(tx.Sender)
+	from.Balance.Available = fromBalance
+	d.Users.Upsert(tx.Sender, from)
+	to, _ := d.Users.Get(tx.Recipient)
+	to.Balance.Available = toBalance
+	d.Users.Upsert(tx.Recipient, to)
+
+	d.Transactions.Upsert(tx.ID, tx)
+	return tx, nil
 }
 
 // HTTP Handlers
-func getBalance(c *fiber.Ctx) error {
+func (h *handlers) getBalance(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(user.Balance)
 }
 
-func getTransactions(c *fiber.Ctx) error {
+func (h *handlers) getTransactions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	startDate := c.Query("start_date")
@@ -160,7 +217,7 @@ func getTransactions(c *fiber.Ctx) error {
 
 	var transactions []Transaction
 	db.mu.RLock()
-	for _, tx := range db.Transactions {
+	for _, tx := range db.Transactions.List() {
 		if tx.Sender == email || tx.Recipient == email {
 			if startDate != "" && tx.CreatedAt.Format("2006-01-02") < startDate {
 				continue
@@ -173,65 +230,52 @@ func getTransactions(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(transactions)
+	return server.List(c, transactions)
 }
 
 type PaymentRequest struct {
-	SenderEmail     string  `json:"sender_email"`
-	RecipientEmail  string  `json:"recipient_email"`
-	Amount          float64 `json:"amount"`
-	Currency        string  `json:"currency"`
-	Description     string  `json:"description"`
-	PaymentMethodID string  `json:"payment_method_id"`
+	SenderEmail     string      `json:"sender_email" validate:"email"`
+	RecipientEmail  string      `json:"recipient_email" validate:"email"`
+	Amount          money.Money `json:"amount" validate:"gt=0"`
+	Currency        string      `json:"currency"`
+	Description     string      `json:"description"`
+	PaymentMethodID string      `json:"payment_method_id"`
 }
 
-func processPayment(c *fiber.Ctx) error {
+func (h *handlers) processPayment(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req PaymentRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	if req.Amount <= 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Amount must be positive",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Verify sender
 	sender, err := db.GetUser(req.SenderEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Sender not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Sender not found")
 	}
 
 	// Verify recipient
 	_, err = db.GetUser(req.RecipientEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Recipient not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Recipient not found")
 	}
 
 	// Verify payment method
 	validPayment := false
 	for _, pm := range sender.PaymentMethods {
-		if pm.ID == req.PaymentMethodID {
+		if pm.ID == req.PaymentMethodID && !pm.Deleted() {
 			validPayment = true
 			break
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Create transaction
 	tx := Transaction{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("TXN"),
 		Type:        TransactionTypePayment,
 		Status:      TransactionStatusPending,
 		Amount:      req.Amount,
@@ -239,54 +283,43 @@ func processPayment(c *fiber.Ctx) error {
 		Sender:      req.SenderEmail,
 		Recipient:   req.RecipientEmail,
 		Description: req.Description,
-		CreatedAt:   time.Now(),
+		CreatedAt:   h.clock.Now(),
 	}
 
 	// Update balances
-	if err := db.UpdateUserBalance(req.SenderEmail, -req.Amount); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
-	}
-
-	if err := db.UpdateUserBalance(req.RecipientEmail, req.Amount); err != nil {
-		// Rollback sender's balance
-		_ = db.UpdateUserBalance(req.SenderEmail, req.Amount)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to process payment",
-		})
-	}
-
-	tx.Status = TransactionStatusCompleted
-	if err := db.CreateTransaction(tx); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to record transaction",
-		})
+	tx, err = db.Pay(tx)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrInsufficientFunds):
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	case errors.Is(err, ErrUserNotFound):
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case errors.Is(err, money.ErrMixedCurrencies):
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	default:
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to process payment")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(tx)
 }
 
-func getPaymentMethods(c *fiber.Ctx) error {
+func (h *handlers) getPaymentMethods(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.PaymentMethods)
+	return server.List(c, user.PaymentMethods)
 }
 
 type NewPaymentMethod struct {
-	Type          PaymentMethodType `json:"type"`
+	Type          PaymentMethodType `json:"type" validate:"required,oneof=bank_account credit_card debit_card"`
 	AccountNumber string            `json:"account_number"`
 	RoutingNumber string            `json:"routing_number"`
 	CardNumber    string            `json:"card_number"`
@@ -295,118 +328,155 @@ type NewPaymentMethod struct {
 	CVV           string            `json:"cvv"`
 }
 
-func addPaymentMethod(c *fiber.Ctx) error {
+func (h *handlers) addPaymentMethod(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var req NewPaymentMethod
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
-	db.mu.Lock()
-	user, exists := db.Users[email]
-	if !exists {
-		db.mu.Unlock()
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+	// Payment methods are shown by the last four digits of their number
+	field, number := "card_number", req.CardNumber
+	if req.Type == PaymentMethodBank {
+		field, number = "account_number", req.AccountNumber
+	}
+	if len(number) < 4 {
+		return &server.ValidationError{Errors: []server.FieldError{{Field: field, Message: "must have at least 4 characters"}}}
 	}
+	last4 := number[len(number)-4:]
 
-	var last4 string
-	switch req.Type {
-	case PaymentMethodBank:
-		last4 = req.AccountNumber[len(req.AccountNumber)-4:]
-	case PaymentMethodCreditCard, PaymentMethodDebitCard:
-		last4 = req.CardNumber[len(req.CardNumber)-4:]
-	default:
+	db.mu.Lock()
+	user, exists := db.Users.Get(email)
+	if !exists {
 		db.mu.Unlock()
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method type",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	pm := PaymentMethod{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("PM"),
 		Type:      req.Type,
 		Last4:     last4,
-		IsDefault: len(user.PaymentMethods) == 0,
-		CreatedAt: time.Now(),
+		IsDefault: true,
+		CreatedAt: h.clock.Now(),
+	}
+	for _, other := range user.PaymentMethods {
+		if !other.Deleted() {
+			pm.IsDefault = false
+		}
 	}
 
 	user.PaymentMethods = append(user.PaymentMethods, pm)
-	db.Users[email] = user
+	db.Users.Upsert(email, user)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(pm)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) removePaymentMethod(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
-	db = &Database{
-		Users:        make(map[string]User),
-		Transactions: make(map[string]Transaction),
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, exists := db.Users.Get(email)
+	if !exists {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
+	}
+	methods := slices.Clone(user.PaymentMethods)
+	i := slices.IndexFunc(methods, func(pm PaymentMethod) bool {
+		return pm.ID == c.Params("id") && !pm.Deleted()
+	})
+	if i < 0 {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Payment method not found")
+	}
+	// The method is only marked deleted, so an admin can put it back; the
+	// oldest of the rest becomes the default if it was.
+	removed := &methods[i]
+	removed.MarkDeleted()
+	if removed.IsDefault {
+		removed.IsDefault = false
+		for j := range methods {
+			if !methods[j].Deleted() {
+				methods[j].IsDefault = true
+				break
+			}
+		}
 	}
 
-	return json.Unmarshal(data, db)
+	user.PaymentMethods = methods
+	db.Users.Upsert(email, user)
+	return c.JSON(methods[i])
 }
 
-func setupRoutes(app *fiber.App) {
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{locks: &h.accountLocks, clock: h.clock}
+
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	h.db.Set(db)
+	return nil
+}
+
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/balance", getBalance)
-	api.Get("/transactions", getTransactions)
-	api.Post("/transactions", processPayment)
-	api.Get("/payment-methods", getPaymentMethods)
-	api.Post("/payment-methods", addPaymentMethod)
+	api.Get("/balance", h.getBalance)
+	api.Get("/transactions", h.getTransactions)
+	api.Post("/transactions", h.processPayment)
+	api.Get("/payment-methods", h.getPaymentMethods)
+	api.Post("/payment-methods", h.addPaymentMethod)
+	api.Delete("/payment-methods/:id", h.removePaymentMethod)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "transactions"},
+			Search:  []string{"transactions"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,18 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -53,7 +49,7 @@ type Episode struct {
 type WatchProgress struct {
 	ContentID       string    `json:"content_id"`
 	EpisodeID       string    `json:"episode_id,omitempty"`
-	Email           string    `json:"email"`
+	Email           string    `json:"email" validate:"email"`
 	ProgressSeconds int       `json:"progress_seconds"`
 	TotalSeconds    int       `json:"total_seconds"`
 	LastWatched     time.Time `json:"last_watched"`
@@ -69,9 +65,12 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User          `json:"users"`
-	Content  map[string]Content       `json:"content"`
-	Progress map[string]WatchProgress `json:"progress"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]          `json:"users"`
+	Content  server.Repository[Content]       `json:"content"`
+	Progress server.Repository[WatchProgress] `json:"progress"`
 	mu       sync.RWMutex
 }
 
@@ -82,15 +81,24 @@ var (
 	ErrInvalidInput    = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers stream Peacock content and keep viewers' progress by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users, content and progress in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -101,7 +109,7 @@ func (d *Database) GetContent(id string) (Content, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	content, exists := d.Content[id]
+	content, exists := d.Content.Get(id)
 	if !exists {
 		return Content{}, ErrContentNotFound
 	}
@@ -112,13 +120,13 @@ func (d *Database) AddToWatchlist(email, contentID string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
 
 	// Check if content exists
-	if _, exists := d.Content[contentID]; !exists {
+	if _, exists := d.Content.Get(contentID); !exists {
 		return ErrContentNotFound
 	}
 
@@ -130,7 +138,7 @@ func (d *Database) AddToWatchlist(email, contentID string) error {
 	}
 
 	user.Watchlist = append(user.Watchlist, contentID)
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
@@ -143,19 +151,20 @@ func (d *Database) UpdateWatchProgress(progress WatchProgress) error {
 		key += ":" + progress.EpisodeID
 	}
 
-	d.Progress[key] = progress
+	d.Progress.Upsert(key, progress)
 	return nil
 }
 
 // HTTP Handlers
-func getCatalog(c *fiber.Ctx) error {
+func (h *handlers) getCatalog(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	genre := c.Query("genre")
 
 	var filtered []Content
 
 	db.mu.RLock()
-	for _, content := range db.Content {
+	for _, content := range db.Content.List() {
 		if category != "" && string(content.Type) != category {
 			continue
 		}
@@ -177,22 +186,19 @@ func getCatalog(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(filtered)
+	return server.List(c, filtered)
 }
 
-func getWatchlist(c *fiber.Ctx) error {
+func (h *handlers) getWatchlist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var watchlistContent []Content
@@ -203,124 +209,122 @@ func getWatchlist(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(watchlistContent)
+	return server.List(c, watchlistContent)
 }
 
-func addToWatchlist(c *fiber.Ctx) error {
+func (h *handlers) addToWatchlist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		Email     string `json:"email"`
+		Email     string `json:"email" validate:"email"`
 		ContentID string `json:"content_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	if err := db.AddToWatchlist(req.Email, req.ContentID); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusBadRequest, err)
 	}
 
 	return c.SendStatus(fiber.StatusCreated)
 }
 
-func getContinueWatching(c *fiber.Ctx) error {
+func (h *handlers) getContinueWatching(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var progress []WatchProgress
 	db.mu.RLock()
-	for _, p := range db.Progress {
+	for _, p := range db.Progress.List() {
 		if p.Email == email {
 			progress = append(progress, p)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(progress)
+	return server.List(c, progress)
 }
 
-func updateWatchProgress(c *fiber.Ctx) error {
+func (h *handlers) updateWatchProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var progress WatchProgress
-	if err := c.BodyParser(&progress); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &progress); err != nil {
+		return err
 	}
 
-	progress.LastWatched = time.Now()
+	progress.LastWatched = h.clock.Now()
 
 	if err := db.UpdateWatchProgress(progress); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Content:  make(map[string]Content),
-		Progress: make(map[string]WatchProgress),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/catalog", getCatalog)
-	api.Get("/watchlist", getWatchlist)
-	api.Post("/watchlist", addToWatchlist)
-	api.Get("/continue-watching", getContinueWatching)
-	api.Post("/watch-progress", updateWatchProgress)
+	api.Get("/catalog", h.getCatalog)
+	api.Get("/watchlist", h.getWatchlist)
+	api.Post("/watchlist", h.addToWatchlist)
+	api.Get("/continue-watching", h.getContinueWatching)
+	api.Post("/watch-progress", h.updateWatchProgress)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "progress"},
+			Search:  []string{"content"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
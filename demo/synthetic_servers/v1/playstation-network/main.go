@@ -1,17 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -77,21 +73,35 @@ type Friend struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Profiles map[string]Profile  `json:"profiles"`
-	Games    map[string][]Game   `json:"games"`    // email -> games
-	Trophies map[string][]Trophy `json:"trophies"` // email -> trophies
-	Friends  map[string][]Friend `json:"friends"`  // email -> friends
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Profiles server.Repository[Profile]  `json:"profiles"`
+	Games    server.Repository[[]Game]   `json:"games"`    // email -> games
+	Trophies server.Repository[[]Trophy] `json:"trophies"` // email -> trophies
+	Friends  server.Repository[[]Friend] `json:"friends"`  // email -> friends
 	mu       sync.RWMutex
 }
 
-var db *Database
+// handlers serve PlayStation Network profiles, games, trophies and friends
+// from db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the profiles, games and trophies in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetProfile(email string) (Profile, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	profile, exists := d.Profiles[email]
+	profile, exists := d.Profiles.Get(email)
 	if !exists {
 		return Profile{}, fiber.NewError(fiber.StatusNotFound, "Profile not found")
 	}
@@ -102,7 +112,7 @@ func (d *Database) GetGames(email string) ([]Game, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	games, exists := d.Games[email]
+	games, exists := d.Games.Get(email)
 	if !exists {
 		return []Game{}, nil
 	}
@@ -113,7 +123,7 @@ func (d *Database) GetTrophies(email string, gameID string) ([]Trophy, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	trophies, exists := d.Trophies[email]
+	trophies, exists := d.Trophies.Get(email)
 	if !exists {
 		return []Trophy{}, nil
 	}
@@ -135,7 +145,7 @@ func (d *Database) GetFriends(email string) ([]Friend, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	friends, exists := d.Friends[email]
+	friends, exists := d.Friends.Get(email)
 	if !exists {
 		return []Friend{}, nil
 	}
@@ -143,7 +153,8 @@ func (d *Database) GetFriends(email string) ([]Friend, error) {
 }
 
 // HTTP Handlers
-func getProfile(c *fiber.Ctx) error {
+func (h *handlers) getProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -157,7 +168,8 @@ func getProfile(c *fiber.Ctx) error {
 	return c.JSON(profile)
 }
 
-func getGames(c *fiber.Ctx) error {
+func (h *handlers) getGames(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -168,10 +180,11 @@ func getGames(c *fiber.Ctx) error {
 		return err
 	}
 
-	return c.JSON(games)
+	return server.List(c, games)
 }
 
-func getTrophies(c *fiber.Ctx) error {
+func (h *handlers) getTrophies(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -183,10 +196,11 @@ func getTrophies(c *fiber.Ctx) error {
 		return err
 	}
 
-	return c.JSON(trophies)
+	return server.List(c, trophies, "game_id")
 }
 
-func getFriends(c *fiber.Ctx) error {
+func (h *handlers) getFriends(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
@@ -197,62 +211,68 @@ func getFriends(c *fiber.Ctx) error {
 		return err
 	}
 
-	return c.JSON(friends)
+	return server.List(c, friends)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Profiles: make(map[string]Profile),
-		Games:    make(map[string][]Game),
-		Trophies: make(map[string][]Trophy),
-		Friends:  make(map[string][]Friend),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/profile", getProfile)
-	api.Get("/games/library", getGames)
-	api.Get("/trophies", getTrophies)
-	api.Get("/friends", getFriends)
+	api.Get("/profile", h.getProfile)
+	api.Get("/games/library", h.getGames)
+	api.Get("/trophies", h.getTrophies)
+	api.Get("/friends", h.getFriends)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"games", "trophies", "friends"},
+			Search:  []string{"games", "trophies"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
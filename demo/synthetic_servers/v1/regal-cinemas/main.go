@@ -1,19 +1,25 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/money"
+	"pkg/payments"
+	"pkg/pricing"
+	"pkg/reviews"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -26,9 +32,16 @@ type Theater struct {
 	ZIP       string   `json:"zip"`
 	Latitude  float64  `json:"latitude"`
 	Longitude float64  `json:"longitude"`
+	Timezone  string   `json:"timezone"` // IANA, such as America/Los_Angeles
 	Amenities []string `json:"amenities"`
 }
 
+// location returns the time zone the theater keeps, which its showtimes
+// are written and searched in.
+func (t Theater) location() *time.Location {
+	return geo.Location(t.Timezone)
+}
+
 type Movie struct {
 	ID          string    `json:"id"`
 	Title       string    `json:"title"`
@@ -39,30 +52,259 @@ type Movie struct {
 	PosterURL   string    `json:"poster_url"`
 	TrailerURL  string    `json:"trailer_url"`
 	ReleaseDate time.Time `json:"release_date"`
+	// Audience ratings, kept up to date as reviews come in.
+	AverageRating float64 `json:"average_rating"`
+	AudienceScore int     `json:"audience_score"` // % of reviews rated 3.5 stars or higher
+	ReviewCount   int     `json:"review_count"`
 }
 
+// moviePolicy takes reviews of movies from moviegoers holding a ticket to
+// one of their showtimes, rated in half stars.
+var moviePolicy = reviews.Policy{Kind: "movie", Scale: reviews.HalfStars, Verified: true}
+
+// positiveRating is the lowest star rating counted toward the audience score.
+const positiveRating = 3.5
+
 type Showtime struct {
-	ID             string    `json:"id"`
-	MovieID        string    `json:"movie_id"`
-	TheaterID      string    `json:"theater_id"`
-	StartTime      time.Time `json:"start_time"`
-	EndTime        time.Time `json:"end_time"`
-	Screen         string    `json:"screen"`
-	Format         string    `json:"format"`
-	Price          float64   `json:"price"`
-	AvailableSeats int       `json:"available_seats"`
+	ID             string      `json:"id"`
+	MovieID        string      `json:"movie_id"`
+	TheaterID      string      `json:"theater_id"`
+	StartTime      time.Time   `json:"start_time"`
+	EndTime        time.Time   `json:"end_time"`
+	Screen         string      `json:"screen"`
+	AuditoriumID   string      `json:"auditorium_id"`
+	Format         string      `json:"format"`
+	Price          money.Money `json:"price"`
+	AvailableSeats int         `json:"available_seats"`
 }
 
 type Ticket struct {
-	ID           string    `json:"id"`
-	Showtime     Showtime  `json:"showtime"`
-	Movie        Movie     `json:"movie"`
-	Theater      Theater   `json:"theater"`
-	UserEmail    string    `json:"user_email"`
-	SeatCount    int       `json:"seat_count"`
-	TotalPrice   float64   `json:"total_price"`
-	PurchaseDate time.Time `json:"purchase_date"`
-	QRCode       string    `json:"qr_code"`
+	ID              string           `json:"id"`
+	Showtime        Showtime         `json:"showtime"`
+	Movie           Movie            `json:"movie"`
+	Theater         Theater          `json:"theater"`
+	UserEmail       string           `json:"user_email"`
+	Seats           []string         `json:"seats"`
+	SeatCount       int              `json:"seat_count"`
+	Concessions     []ConcessionLine `json:"concessions,omitempty"`
+	Rewards         []string         `json:"rewards,omitempty"`
+	Discount        *money.Money     `json:"discount,omitempty"`
+	TotalPrice      money.Money      `json:"total_price"`
+	PointsEarned    int              `json:"points_earned"`
+	PointsRedeemed  int              `json:"points_redeemed,omitempty"`
+	PurchaseDate    time.Time        `json:"purchase_date"`
+	QRCode          string           `json:"qr_code"`
+	PaymentMethodID string           `json:"payment_method_id"`
+	ChargeID        string           `json:"charge_id,omitempty"` // The charge to the payment method
+	Status          TicketStatus     `json:"status"`
+	RefundAmount    *money.Money     `json:"refund_amount,omitempty"`
+	RefundedAt      *time.Time       `json:"refunded_at,omitempty"`
+	Exchanges       []TicketExchange `json:"exchanges,omitempty"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+}
+
+type TicketStatus string
+
+const (
+	TicketActive   TicketStatus = "active"
+	TicketRefunded TicketStatus = "refunded"
+)
+
+// ticketMachine is the statuses a ticket moves through: it can be refunded
+// once, before the showtime starts.
+var ticketMachine = &statemachine.Machine{Name: "ticket", Moves: map[string][]string{
+	string(TicketActive): {string(TicketRefunded)},
+}}
+
+// TicketExchange records a ticket moving from one showtime to another.
+// PriceDifference is positive when the customer paid more.
+type TicketExchange struct {
+	FromShowtimeID  string      `json:"from_showtime_id"`
+	ToShowtimeID    string      `json:"to_showtime_id"`
+	FromSeats       []string    `json:"from_seats"`
+	ToSeats         []string    `json:"to_seats"`
+	PriceDifference money.Money `json:"price_difference"`
+	PaymentMethodID string      `json:"payment_method_id,omitempty"`
+	ChargeID        string      `json:"charge_id,omitempty"` // The charge for a higher price
+	ExchangedAt     time.Time   `json:"exchanged_at"`
+}
+
+// Auditorium is a screen's physical seat layout. Seats are identified by row
+// label and number, e.g. "F7".
+type Auditorium struct {
+	ID        string    `json:"id"`
+	TheaterID string    `json:"theater_id"`
+	Screen    string    `json:"screen"`
+	Rows      []SeatRow `json:"rows"`
+}
+
+type SeatRow struct {
+	Row        string `json:"row"`
+	Seats      int    `json:"seats"`
+	Accessible []int  `json:"accessible,omitempty"`
+}
+
+func (a Auditorium) Capacity() int {
+	total := 0
+	for _, row := range a.Rows {
+		total += row.Seats
+	}
+	return total
+}
+
+// HasSeat reports whether a seat ID exists in the layout.
+func (a Auditorium) HasSeat(seatID string) bool {
+	for _, row := range a.Rows {
+		if !strings.HasPrefix(seatID, row.Row) {
+			continue
+		}
+		n, err := strconv.Atoi(seatID[len(row.Row):])
+		if err == nil && n >= 1 && n <= row.Seats && strconv.Itoa(n) == seatID[len(row.Row):] {
+			return true
+		}
+	}
+	return false
+}
+
+type SeatStatus string
+
+const (
+	SeatAvailable SeatStatus = "available"
+	SeatTaken     SeatStatus = "taken"
+)
+
+type Seat struct {
+	ID         string     `json:"id"`
+	Number     int        `json:"number"`
+	Status     SeatStatus `json:"status"`
+	Accessible bool       `json:"accessible"`
+}
+
+type SeatMapRow struct {
+	Row   string `json:"row"`
+	Seats []Seat `json:"seats"`
+}
+
+type SeatMap struct {
+	ShowtimeID     string       `json:"showtime_id"`
+	AuditoriumID   string       `json:"auditorium_id"`
+	Screen         string       `json:"screen"`
+	Capacity       int          `json:"capacity"`
+	AvailableSeats int          `json:"available_seats"`
+	Rows           []SeatMapRow `json:"rows"`
+}
+
+type ConcessionItem struct {
+	ID       string      `json:"id"`
+	Name     string      `json:"name"`
+	Category string      `json:"category"` // popcorn, drink, candy
+	Size     string      `json:"size,omitempty"`
+	Price    money.Money `json:"price"`
+	// UpgradeTo is the next size up, granted free to Gold and Diamond members.
+	UpgradeTo string `json:"upgrade_to,omitempty"`
+}
+
+type ConcessionOrder struct {
+	ItemID   string `json:"item_id"`
+	Quantity int    `json:"quantity"`
+}
+
+type ConcessionLine struct {
+	ItemID    string      `json:"item_id"`
+	Name      string      `json:"name"`
+	Quantity  int         `json:"quantity"`
+	UnitPrice money.Money `json:"unit_price"`
+	Upgraded  bool        `json:"upgraded,omitempty"`
+	Reward    string      `json:"reward,omitempty"`
+}
+
+// Crown Club loyalty
+type LoyaltyTier string
+
+const (
+	TierMember  LoyaltyTier = "member"
+	TierGold    LoyaltyTier = "gold"
+	TierDiamond LoyaltyTier = "diamond"
+)
+
+type TierBenefits struct {
+	Tier              LoyaltyTier `json:"tier"`
+	MinLifetimePoints int         `json:"min_lifetime_points"`
+	PointsPerDollar   float64     `json:"points_per_dollar"`
+	FreeSizeUpgrade   bool        `json:"free_size_upgrade"`
+}
+
+// tiers is ordered from lowest to highest.
+var tiers = []TierBenefits{
+	{Tier: TierMember, MinLifetimePoints: 0, PointsPerDollar: 10},
+	{Tier: TierGold, MinLifetimePoints: 2500, PointsPerDollar: 12.5, FreeSizeUpgrade: true},
+	{Tier: TierDiamond, MinLifetimePoints: 5000, PointsPerDollar: 15, FreeSizeUpgrade: true},
+}
+
+func tierFor(lifetimePoints int) TierBenefits {
+	current := tiers[0]
+	for _, tier := range tiers {
+		if lifetimePoints >= tier.MinLifetimePoints {
+			current = tier
+		}
+	}
+	return current
+}
+
+type Reward struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	PointsCost  int    `json:"points_cost"`
+}
+
+const (
+	RewardFreeTicket  = "free_ticket"
+	RewardFreePopcorn = "free_popcorn"
+
+	// freePopcornItemID is the concession added by the free popcorn reward.
+	freePopcornItemID = "con_popcorn_s"
+)
+
+var rewardCatalog = map[string]Reward{
+	RewardFreeTicket: {
+		ID:          RewardFreeTicket,
+		Name:        "Free Movie Ticket",
+		Description: "One seat at no charge, any format",
+		PointsCost:  1500,
+	},
+	RewardFreePopcorn: {
+		ID:          RewardFreePopcorn,
+		Name:        "Free Small Popcorn",
+		Description: "A small popcorn added to your order",
+		PointsCost:  500,
+	},
+}
+
+type LoyaltyTransaction struct {
+	TicketID    string    `json:"ticket_id,omitempty"`
+	Points      int       `json:"points"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type LoyaltyAccount struct {
+	UserEmail      string               `json:"user_email"`
+	MemberID       string               `json:"member_id"`
+	Points         int                  `json:"points"`
+	LifetimePoints int                  `json:"lifetime_points"`
+	Tier           LoyaltyTier          `json:"tier"`
+	JoinedAt       time.Time            `json:"joined_at"`
+	History        []LoyaltyTransaction `json:"history"`
+}
+
+type LoyaltySummary struct {
+	LoyaltyAccount
+	Benefits         TierBenefits `json:"benefits"`
+	NextTier         LoyaltyTier  `json:"next_tier,omitempty"`
+	PointsToNextTier int          `json:"points_to_next_tier,omitempty"`
+	AvailableRewards []Reward     `json:"available_rewards"`
 }
 
 type User struct {
@@ -77,26 +319,76 @@ type Payment struct {
 	Last4 string `json:"last4"`
 }
 
+func (pm Payment) card() payments.Card {
+	return payments.Card{Last4: pm.Last4}
+}
+
 // Database represents our in-memory database
 type Database struct {
-	Users     map[string]User     `json:"users"`
-	Theaters  map[string]Theater  `json:"theaters"`
-	Movies    map[string]Movie    `json:"movies"`
-	Showtimes map[string]Showtime `json:"showtimes"`
-	Tickets   map[string]Ticket   `json:"tickets"`
-	mu        sync.RWMutex
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+	server.Reviews
+
+	Users     server.Repository[User]     `json:"users"`
+	Theaters  server.Repository[Theater]  `json:"theaters"`
+	Movies    server.Repository[Movie]    `json:"movies"`
+	Showtimes server.Repository[Showtime] `json:"showtimes"`
+	Tickets   server.Repository[Ticket]   `json:"tickets"`
+
+	Auditoriums     server.Repository[Auditorium]     `json:"auditoriums"`
+	Concessions     server.Repository[ConcessionItem] `json:"concessions"`
+	LoyaltyAccounts server.Repository[LoyaltyAccount] `json:"loyalty_accounts"`
+	// SeatReservations maps showtime ID -> seat ID -> ticket ID.
+	SeatReservations server.Repository[map[string]string] `json:"seat_reservations"`
+	// TheaterIndex is where the theaters are, for finding nearby ones. It
+	// is exported, if not saved, so that each sandbox's copy of the
+	// database has its own.
+	TheaterIndex *geo.Index `json:"-"`
+
+	mu    sync.RWMutex
+	clock *server.Clock
 }
 
-// Global database instance
-var db *Database
+// handlers sell Regal tickets, seats and concessions and keep loyalty
+// accounts, dating purchases by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the theaters, showtimes and seat reservations in store
+// and indexes the theaters.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Error definitions
 var (
-	ErrUserNotFound     = errors.New("user not found")
-	ErrTheaterNotFound  = errors.New("theater not found")
-	ErrMovieNotFound    = errors.New("movie not found")
-	ErrShowtimeNotFound = errors.New("showtime not found")
-	ErrInvalidInput     = errors.New("invalid input")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrTheaterNotFound    = errors.New("theater not found")
+	ErrMovieNotFound      = errors.New("movie not found")
+	ErrShowtimeNotFound   = errors.New("showtime not found")
+	ErrInvalidInput       = errors.New("invalid input")
+	ErrNoSeatMap          = errors.New("showtime has no seat map")
+	ErrInvalidSeat        = errors.New("seat does not exist in this auditorium")
+	ErrDuplicateSeat      = errors.New("seat selected more than once")
+	ErrSeatsTaken         = errors.New("one or more seats are already taken")
+	ErrConcessionNotFound = errors.New("concession item not found")
+	ErrInvalidQuantity    = errors.New("quantity must be at least 1")
+	ErrRewardNotFound     = errors.New("reward not found")
+	ErrInsufficientPoints = errors.New("not enough Crown Club points")
+	ErrTooManyFreeTickets = errors.New("more free tickets than seats selected")
+	ErrTicketNotFound     = errors.New("ticket not found")
+	ErrNotTicketOwner     = errors.New("ticket belongs to another user")
+	ErrTicketRefunded     = errors.New("ticket has already been refunded")
+	ErrShowtimeStarted    = errors.New("showtime has already started")
+	ErrSeatCountMismatch  = errors.New("an exchange must keep the same number of seats")
+	ErrPaymentRequired    = errors.New("payment_method_id is required to pay the price difference")
+	ErrInvalidPayment     = errors.New("invalid payment method")
+	ErrNoAttendedShowtime = errors.New("reviews require a ticket for a showtime that has already started")
+	ErrAlreadyReviewed    = errors.New("you have already reviewed this movie")
 )
 
 // Database operations
@@ -104,7 +396,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -115,18 +407,50 @@ func (d *Database) GetTheater(id string) (Theater, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	theater, exists := d.Theaters[id]
+	theater, exists := d.Theaters.Get(id)
 	if !exists {
 		return Theater{}, ErrTheaterNotFound
 	}
 	return theater, nil
 }
 
+// localize gives theaters without a time zone that of where they are, and
+// puts showtimes, and tickets' copies of them, in their theater's.
+func (d *Database) localize() {
+	for _, id := range d.Theaters.Keys() {
+		theater, _ := d.Theaters.Get(id)
+		if theater.Timezone == "" {
+			theater.Timezone = geo.ZoneAt(geo.Point{Lat: theater.Latitude, Lon: theater.Longitude})
+			d.Theaters.Upsert(id, theater)
+		}
+	}
+	for _, id := range d.Showtimes.Keys() {
+		showtime, _ := d.Showtimes.Get(id)
+		d.Showtimes.Upsert(id, d.localShowtime(showtime))
+	}
+	for _, id := range d.Tickets.Keys() {
+		ticket, _ := d.Tickets.Get(id)
+		theater, _ := d.Theaters.Get(ticket.Theater.ID)
+		ticket.Theater.Timezone = theater.Timezone
+		ticket.Showtime = d.localShowtime(ticket.Showtime)
+		d.Tickets.Upsert(id, ticket)
+	}
+}
+
+// localShowtime returns showtime with its times in its theater's zone.
+func (d *Database) localShowtime(showtime Showtime) Showtime {
+	theater, _ := d.Theaters.Get(showtime.TheaterID)
+	loc := theater.location()
+	showtime.StartTime = showtime.StartTime.In(loc)
+	showtime.EndTime = showtime.EndTime.In(loc)
+	return showtime
+}
+
 func (d *Database) GetMovie(id string) (Movie, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	movie, exists := d.Movies[id]
+	movie, exists := d.Movies.Get(id)
 	if !exists {
 		return Movie{}, ErrMovieNotFound
 	}
@@ -137,48 +461,684 @@ func (d *Database) GetShowtime(id string) (Showtime, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	showtime, exists := d.Showtimes[id]
+	showtime, exists := d.Showtimes.Get(id)
 	if !exists {
 		return Showtime{}, ErrShowtimeNotFound
 	}
 	return showtime, nil
 }
 
-func (d *Database) CreateTicket(ticket Ticket) error {
+func (d *Database) GetSeatMap(showtimeID string) (SeatMap, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	showtime, exists := d.Showtimes.Get(showtimeID)
+	if !exists {
+		return SeatMap{}, ErrShowtimeNotFound
+	}
+	auditorium, exists := d.Auditoriums.Get(showtime.AuditoriumID)
+	if !exists {
+		return SeatMap{}, ErrNoSeatMap
+	}
+
+	reserved, _ := d.SeatReservations.Get(showtime.ID)
+	seatMap := SeatMap{
+		ShowtimeID:     showtime.ID,
+		AuditoriumID:   auditorium.ID,
+		Screen:         auditorium.Screen,
+		Capacity:       auditorium.Capacity(),
+		AvailableSeats: showtime.AvailableSeats,
+		Rows:           make([]SeatMapRow, 0, len(auditorium.Rows)),
+	}
+	for _, row := range auditorium.Rows {
+		accessible := make(map[int]bool, len(row.Accessible))
+		for _, n := range row.Accessible {
+			accessible[n] = true
+		}
+		mapRow := SeatMapRow{Row: row.Row, Seats: make([]Seat, 0, row.Seats)}
+		for n := 1; n <= row.Seats; n++ {
+			seat := Seat{
+				ID:         row.Row + strconv.Itoa(n),
+				Number:     n,
+				Status:     SeatAvailable,
+				Accessible: accessible[n],
+			}
+			if _, taken := reserved[seat.ID]; taken {
+				seat.Status = SeatTaken
+			}
+			mapRow.Seats = append(mapRow.Seats, seat)
+		}
+		seatMap.Rows = append(seatMap.Rows, mapRow)
+	}
+	return seatMap, nil
+}
+
+// loyaltyAccount returns the user's Crown Club account, or a fresh one if
+// they haven't earned anything yet. Callers must hold d.mu.
+func (d *Database) loyaltyAccount(email string, now time.Time) LoyaltyAccount {
+	if account, exists := d.LoyaltyAccounts.Get(email); exists {
+		return account
+	}
+	return LoyaltyAccount{
+		UserEmail: email,
+		MemberID:  "CC-" + strings.ToUpper(uuid.New().String()[:8]),
+		Tier:      TierMember,
+		JoinedAt:  now,
+		History:   []LoyaltyTransaction{},
+	}
+}
+
+func (d *Database) GetLoyaltySummary(email string) (LoyaltySummary, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, exists := d.Users.Get(email); !exists {
+		return LoyaltySummary{}, ErrUserNotFound
+	}
+	account := d.loyaltyAccount(email, d.clock.Now())
+	summary := LoyaltySummary{
+		LoyaltyAccount:   account,
+		Benefits:         tierFor(account.LifetimePoints),
+		AvailableRewards: []Reward{},
+	}
+	for _, tier := range tiers {
+		if tier.MinLifetimePoints > account.LifetimePoints {
+			summary.NextTier = tier.Tier
+			summary.PointsToNextTier = tier.MinLifetimePoints - account.LifetimePoints
+			break
+		}
+	}
+	for _, reward := range sortedRewards() {
+		if reward.PointsCost <= account.Points {
+			summary.AvailableRewards = append(summary.AvailableRewards, reward)
+		}
+	}
+	return summary, nil
+}
+
+func sortedRewards() []Reward {
+	rewards := make([]Reward, 0, len(rewardCatalog))
+	for _, reward := range rewardCatalog {
+		rewards = append(rewards, reward)
+	}
+	sort.Slice(rewards, func(i, j int) bool {
+		return rewards[i].PointsCost < rewards[j].PointsCost
+	})
+	return rewards
+}
+
+func (d *Database) GetConcessions() []ConcessionItem {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	items := d.Concessions.List()
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Category != items[j].Category {
+			return items[i].Category < items[j].Category
+		}
+		return items[i].Price.Minor < items[j].Price.Minor
+	})
+	return items
+}
+
+// priceOrder prices seats and concessions for a member, applying their
+// tier's free size upgrades and any redeemed rewards. It doesn't modify the
+// account. Callers must hold d.mu.
+func (d *Database) priceOrder(ticket *Ticket, account LoyaltyAccount, orders []ConcessionOrder, rewards []string) error {
+	benefits := tierFor(account.LifetimePoints)
+	lines := []pricing.Line{{Price: ticket.Showtime.Price, Quantity: len(ticket.Seats)}}
+
+	ticket.Concessions = []ConcessionLine{}
+	for _, order := range orders {
+		if order.Quantity < 1 {
+			return ErrInvalidQuantity
+		}
+		item, exists := d.Concessions.Get(order.ItemID)
+		if !exists {
+			return ErrConcessionNotFound
+		}
+		line := ConcessionLine{
+			ItemID:    item.ID,
+			Name:      item.Name,
+			Quantity:  order.Quantity,
+			UnitPrice: item.Price,
+		}
+		if upgrade, ok := d.Concessions.Get(item.UpgradeTo); ok && benefits.FreeSizeUpgrade {
+			line.ItemID = upgrade.ID
+			line.Name = upgrade.Name
+			line.Upgraded = true
+		}
+		lines = append(lines, pricing.Line{Price: line.UnitPrice, Quantity: line.Quantity})
+		ticket.Concessions = append(ticket.Concessions, line)
+	}
+
+	var discounts []pricing.Rule
+	ticket.PointsRedeemed = 0
+	freeTickets := 0
+	for _, id := range rewards {
+		reward, exists := rewardCatalog[id]
+		if !exists {
+			return ErrRewardNotFound
+		}
+		switch reward.ID {
+		case RewardFreeTicket:
+			freeTickets++
+			if freeTickets > len(ticket.Seats) {
+				return ErrTooManyFreeTickets
+			}
+			discounts = append(discounts, pricing.AmountOff(reward.ID, ticket.Showtime.Price))
+		case RewardFreePopcorn:
+			popcorn, exists := d.Concessions.Get(freePopcornItemID)
+			if !exists {
+				return ErrConcessionNotFound
+			}
+			ticket.Concessions = append(ticket.Concessions, ConcessionLine{
+				ItemID:   popcorn.ID,
+				Name:     popcorn.Name,
+				Quantity: 1,
+				Reward:   reward.ID,
+			})
+		}
+		ticket.PointsRedeemed += reward.PointsCost
+	}
+	if ticket.PointsRedeemed > account.Points {
+		return ErrInsufficientPoints
+	}
+	if len(ticket.Concessions) == 0 {
+		ticket.Concessions = nil
+	}
+
+	ticket.Rewards = rewards
+	quote, err := pricing.Price(money.USD, lines, discounts...)
+	if err != nil {
+		return err
+	}
+	ticket.Discount = nil
+	if !quote.Discount.IsZero() {
+		ticket.Discount = &quote.Discount
+	}
+	ticket.TotalPrice = quote.Total
+	ticket.PointsEarned = int(ticket.TotalPrice.Float() * benefits.PointsPerDollar)
+	return nil
+}
+
+// CreateTicket prices the order, reserves the ticket's seats and settles
+// Crown Club points in one step, so two purchases can never hold the same
+// seat, and charges the total to the ticket's payment method through pay.
+// When seats are already taken it returns ErrSeatsTaken along with the
+// conflicting seat IDs.
+func (d *Database) CreateTicket(ticket *Ticket, orders []ConcessionOrder, rewards []string, pay server.Charger) ([]string, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Tickets[ticket.ID] = ticket
+	showtime, exists := d.Showtimes.Get(ticket.Showtime.ID)
+	if !exists {
+		return nil, ErrShowtimeNotFound
+	}
+	if conflicts, err := d.checkSeats(showtime, ticket.Seats, ticket.ID); err != nil {
+		return conflicts, err
+	}
+
+	ticket.Showtime = showtime
+	account := d.loyaltyAccount(ticket.UserEmail, ticket.PurchaseDate)
+	if err := d.priceOrder(ticket, account, orders, rewards); err != nil {
+		return nil, err
+	}
+	if ticket.TotalPrice.IsPositive() {
+		charge, err := d.charge(pay, ticket.UserEmail, ticket.PaymentMethodID, ticket.TotalPrice, "Ticket "+ticket.ID)
+		if err != nil {
+			return nil, err
+		}
+		ticket.ChargeID = charge.ID
+	}
+
+	ticket.Status = TicketActive
+	ticket.Showtime = d.reserveSeats(showtime.ID, ticket.Seats, ticket.ID)
+	d.Tickets.Upsert(ticket.ID, *ticket)
+
+	d.adjustPoints(ticket.UserEmail, ticket.ID, -ticket.PointsRedeemed, false,
+		"Redeemed "+strings.Join(ticket.Rewards, ", "), ticket.PurchaseDate)
+	d.adjustPoints(ticket.UserEmail, ticket.ID, ticket.PointsEarned, true,
+		"Earned on purchase", ticket.PurchaseDate)
+	return nil, nil
+}
+
+// charge takes amount from one of the user's payment methods through pay.
+// Callers must hold d.mu.
+func (d *Database) charge(pay server.Charger, email, paymentMethodID string, amount money.Money, description string) (payments.Charge, error) {
+	user, _ := d.Users.Get(email)
+	for _, pm := range user.PaymentMethods {
+		if pm.ID == paymentMethodID {
+			return pay(server.ChargeRequest{
+				UserEmail:       email,
+				PaymentMethodID: pm.ID,
+				Card:            pm.card(),
+				Amount:          amount,
+				Description:     description,
+				Capture:         true,
+			})
+		}
+	}
+	return payments.Charge{}, ErrInvalidPayment
+}
+
+// refund gives back amount of what was charged for a ticket, or all of it
+// if amount is zero, from its latest charge back. Tickets bought before
+// charges were kept have none to refund. Callers must hold d.mu.
+func (d *Database) refund(ticket Ticket, amount money.Money) error {
+	ids := []string{ticket.ChargeID}
+	for _, exchange := range ticket.Exchanges {
+		ids = append(ids, exchange.ChargeID)
+	}
+	all := amount.IsZero()
+	for i := len(ids) - 1; i >= 0; i-- {
+		charge, ok := d.Charges.Get(ids[i])
+		if !ok || (charge.Status != payments.StatusCaptured && charge.Status != payments.StatusPartiallyRefunded) {
+			continue
+		}
+		left, err := charge.AmountCaptured.Sub(charge.AmountRefunded)
+		if err != nil {
+			return err
+		}
+		if !all {
+			if less, err := amount.Less(left); err != nil {
+				return err
+			} else if less {
+				left = amount
+			}
+		}
+		if _, err := d.Refund(charge.ID, left); err != nil {
+			return err
+		}
+		if !all {
+			if amount, err = amount.Sub(left); err != nil {
+				return err
+			}
+			if !amount.IsPositive() {
+				return nil
+			}
+		}
+	}
 	return nil
 }
 
+// checkSeats validates a seat selection against a showtime's seat map. Seats
+// already held by ticketID don't count as conflicts. Callers must hold d.mu.
+func (d *Database) checkSeats(showtime Showtime, seats []string, ticketID string) ([]string, error) {
+	auditorium, exists := d.Auditoriums.Get(showtime.AuditoriumID)
+	if !exists {
+		return nil, ErrNoSeatMap
+	}
+
+	reserved, _ := d.SeatReservations.Get(showtime.ID)
+	seen := make(map[string]bool, len(seats))
+	var conflicts []string
+	for _, seatID := range seats {
+		if !auditorium.HasSeat(seatID) {
+			return nil, ErrInvalidSeat
+		}
+		if seen[seatID] {
+			return nil, ErrDuplicateSeat
+		}
+		seen[seatID] = true
+		if holder, taken := reserved[seatID]; taken && holder != ticketID {
+			conflicts = append(conflicts, seatID)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return conflicts, ErrSeatsTaken
+	}
+	return nil, nil
+}
+
+// reserveSeats holds seats for a ticket and returns the showtime with its
+// availability updated. Callers must hold d.mu and have run checkSeats.
+func (d *Database) reserveSeats(showtimeID string, seats []string, ticketID string) Showtime {
+	reserved, _ := d.SeatReservations.Get(showtimeID)
+	if reserved == nil {
+		reserved = make(map[string]string)
+	}
+	for _, seatID := range seats {
+		reserved[seatID] = ticketID
+	}
+	d.SeatReservations.Upsert(showtimeID, reserved)
+	return d.syncAvailability(showtimeID)
+}
+
+// releaseSeats frees the seats a ticket holds. Callers must hold d.mu.
+func (d *Database) releaseSeats(showtimeID string, seats []string, ticketID string) Showtime {
+	reserved, _ := d.SeatReservations.Get(showtimeID)
+	for _, seatID := range seats {
+		if reserved[seatID] == ticketID {
+			delete(reserved, seatID)
+		}
+	}
+	if reserved != nil {
+		d.SeatReservations.Upsert(showtimeID, reserved)
+	}
+	return d.syncAvailability(showtimeID)
+}
+
+func (d *Database) syncAvailability(showtimeID string) Showtime {
+	showtime, _ := d.Showtimes.Get(showtimeID)
+	if auditorium, exists := d.Auditoriums.Get(showtime.AuditoriumID); exists {
+		reserved, _ := d.SeatReservations.Get(showtimeID)
+		showtime.AvailableSeats = auditorium.Capacity() - len(reserved)
+		d.Showtimes.Upsert(showtime.ID, showtime)
+	}
+	return showtime
+}
+
+// adjustPoints applies a signed points change to a member's balance and
+// history, never taking the balance below zero. Lifetime points only move
+// with earned points, not redemptions. Callers must hold d.mu.
+func (d *Database) adjustPoints(email, ticketID string, points int, lifetime bool, description string, at time.Time) {
+	if points == 0 {
+		return
+	}
+	account := d.loyaltyAccount(email, at)
+	account.Points += points
+	if account.Points < 0 {
+		account.Points = 0
+	}
+	if lifetime {
+		account.LifetimePoints += points
+		if account.LifetimePoints < 0 {
+			account.LifetimePoints = 0
+		}
+	}
+	account.Tier = tierFor(account.LifetimePoints).Tier
+	account.History = append(account.History, LoyaltyTransaction{
+		TicketID:    ticketID,
+		Points:      points,
+		Description: description,
+		CreatedAt:   at,
+	})
+	d.LoyaltyAccounts.Upsert(account.UserEmail, account)
+}
+
+// activeTicket looks up a ticket the user can still change. Callers must hold
+// d.mu.
+func (d *Database) activeTicket(ticketID, email string, now time.Time) (Ticket, error) {
+	ticket, exists := d.Tickets.Get(ticketID)
+	if !exists {
+		return Ticket{}, ErrTicketNotFound
+	}
+	if ticket.UserEmail != email {
+		return Ticket{}, ErrNotTicketOwner
+	}
+	if ticket.Status == TicketRefunded {
+		return Ticket{}, ErrTicketRefunded
+	}
+	showtime, _ := d.Showtimes.Get(ticket.Showtime.ID)
+	if !now.Before(showtime.StartTime) {
+		return Ticket{}, ErrShowtimeStarted
+	}
+	return ticket, nil
+}
+
+// RefundTicket refunds the full amount paid up until the showtime starts,
+// to the cards it was charged to, releasing the seats and reversing the
+// Crown Club points it moved.
+func (d *Database) RefundTicket(ticketID, email string) (Ticket, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	ticket, err := d.activeTicket(ticketID, email, now)
+	if err != nil {
+		return Ticket{}, err
+	}
+
+	if err := statemachine.Move(ticketMachine, &ticket, &ticket.Status, &ticket.StatusHistory, TicketRefunded, now); err != nil {
+		return Ticket{}, ErrTicketRefunded
+	}
+	if err := d.refund(ticket, money.Money{}); err != nil {
+		return Ticket{}, err
+	}
+	ticket.Showtime = d.releaseSeats(ticket.Showtime.ID, ticket.Seats, ticket.ID)
+	refund := ticket.TotalPrice
+	ticket.RefundAmount = &refund
+	ticket.RefundedAt = &now
+	d.Tickets.Upsert(ticket.ID, ticket)
+
+	d.adjustPoints(email, ticket.ID, -ticket.PointsEarned, true, "Reversed on refund", now)
+	d.adjustPoints(email, ticket.ID, ticket.PointsRedeemed, false, "Rewards returned on refund", now)
+	return ticket, nil
+}
+
+// ExchangeTicket moves a ticket to new seats in another (or the same)
+// showtime. The seat price difference is charged through pay to the given
+// payment method, or the ticket's original one, when positive and refunded
+// when negative.
+func (d *Database) ExchangeTicket(ticketID, email, showtimeID string, seats []string, paymentMethodID string, pay server.Charger) (Ticket, []string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	ticket, err := d.activeTicket(ticketID, email, now)
+	if err != nil {
+		return Ticket{}, nil, err
+	}
+	target, exists := d.Showtimes.Get(showtimeID)
+	if !exists {
+		return Ticket{}, nil, ErrShowtimeNotFound
+	}
+	if !now.Before(target.StartTime) {
+		return Ticket{}, nil, ErrShowtimeStarted
+	}
+	if len(seats) != len(ticket.Seats) {
+		return Ticket{}, nil, ErrSeatCountMismatch
+	}
+	if target.ID != ticket.Showtime.ID {
+		// Seats on the old showtime don't carry over.
+		ticketID = ""
+	}
+	if conflicts, err := d.checkSeats(target, seats, ticketID); err != nil {
+		return Ticket{}, conflicts, err
+	}
+
+	from, _ := d.Showtimes.Get(ticket.Showtime.ID)
+	difference, err := target.Price.Sub(from.Price)
+	if err != nil {
+		return Ticket{}, nil, err
+	}
+	difference = difference.Times(len(seats))
+	total, err := ticket.TotalPrice.Add(difference)
+	if err != nil {
+		return Ticket{}, nil, err
+	}
+	if paymentMethodID == "" {
+		paymentMethodID = ticket.PaymentMethodID
+	}
+	if difference.IsPositive() && paymentMethodID == "" {
+		return Ticket{}, nil, ErrPaymentRequired
+	}
+	var chargeID string
+	switch {
+	case difference.IsPositive():
+		charge, err := d.charge(pay, email, paymentMethodID, difference, "Exchange of ticket "+ticket.ID)
+		if err != nil {
+			return Ticket{}, nil, err
+		}
+		chargeID = charge.ID
+	case difference.IsNegative():
+		if err := d.refund(ticket, difference.Neg()); err != nil {
+			return Ticket{}, nil, err
+		}
+	}
+
+	d.releaseSeats(from.ID, ticket.Seats, ticket.ID)
+	ticket.Showtime = d.reserveSeats(target.ID, seats, ticket.ID)
+	ticket.Movie, _ = d.Movies.Get(target.MovieID)
+	ticket.Theater, _ = d.Theaters.Get(target.TheaterID)
+	ticket.Exchanges = append(ticket.Exchanges, TicketExchange{
+		FromShowtimeID:  from.ID,
+		ToShowtimeID:    target.ID,
+		FromSeats:       ticket.Seats,
+		ToSeats:         seats,
+		PriceDifference: difference,
+		PaymentMethodID: paymentMethodID,
+		ChargeID:        chargeID,
+		ExchangedAt:     now,
+	})
+	ticket.Seats = seats
+	ticket.TotalPrice = total
+	if ticket.TotalPrice.IsNegative() {
+		ticket.TotalPrice = money.Money{}
+	}
+
+	benefits := tierFor(d.loyaltyAccount(email, now).LifetimePoints)
+	points := int(difference.Float() * benefits.PointsPerDollar)
+	if ticket.PointsEarned+points < 0 {
+		points = -ticket.PointsEarned
+	}
+	ticket.PointsEarned += points
+	d.Tickets.Upsert(ticket.ID, ticket)
+	d.adjustPoints(email, ticket.ID, points, true, "Exchange adjustment", now)
+	return ticket, nil, nil
+}
+
+// CreateReview records a review from a moviegoer holding a ticket to a
+// showtime of the movie that has already started, and refreshes the movie's
+// audience ratings.
+func (d *Database) CreateReview(review reviews.Review) (reviews.Review, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	movie, exists := d.Movies.Get(review.Target.ID)
+	if !exists {
+		return reviews.Review{}, ErrMovieNotFound
+	}
+	if _, exists := d.Users.Get(review.UserEmail); !exists {
+		return reviews.Review{}, ErrUserNotFound
+	}
+	ticketID := ""
+	for _, ticket := range d.Tickets.List() {
+		if ticket.UserEmail != review.UserEmail || ticket.Status == TicketRefunded {
+			continue
+		}
+		showtime, _ := d.Showtimes.Get(ticket.Showtime.ID)
+		if showtime.MovieID == movie.ID && showtime.StartTime.Before(d.clock.Now()) {
+			ticketID = ticket.ID
+			break
+		}
+	}
+
+	review, err := d.AddReview(moviePolicy, review, ticketID)
+	switch err {
+	case nil:
+	case reviews.ErrAlreadyReviewed:
+		return reviews.Review{}, ErrAlreadyReviewed
+	case reviews.ErrNotVerified:
+		return reviews.Review{}, ErrNoAttendedShowtime
+	default:
+		return reviews.Review{}, err
+	}
+	d.refreshAudienceScore(movie.ID)
+	return review, nil
+}
+
+// Rerate refreshes a movie's audience ratings once moderation has hidden,
+// shown or removed one of its reviews.
+func (d *Database) Rerate(target reviews.Target) {
+	if target.Kind == moviePolicy.Kind {
+		d.refreshAudienceScore(target.ID)
+	}
+}
+
+// refreshAudienceScore recomputes a movie's ratings from its reviews.
+// Callers must hold d.mu.
+func (d *Database) refreshAudienceScore(movieID string) {
+	movie, exists := d.Movies.Get(movieID)
+	if !exists {
+		return
+	}
+	total, positive, count := 0.0, 0, 0
+	for _, review := range d.ReviewsOf(reviews.Target{Kind: moviePolicy.Kind, ID: movieID}, "") {
+		count++
+		total += review.Rating
+		if review.Rating >= positiveRating {
+			positive++
+		}
+	}
+	movie.ReviewCount = count
+	movie.AverageRating = 0
+	movie.AudienceScore = 0
+	if count > 0 {
+		movie.AverageRating = math.Round(total/float64(count)*10) / 10
+		movie.AudienceScore = int(math.Round(float64(positive) / float64(count) * 100))
+	}
+	d.Movies.Upsert(movie.ID, movie)
+}
+
+// GetMovieReviews returns a movie's reviews sorted by recency or rating, as
+// reviews.Sort takes it.
+func (d *Database) GetMovieReviews(movieID, sortBy string) (Movie, []reviews.Review, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	movie, exists := d.Movies.Get(movieID)
+	if !exists {
+		return Movie{}, nil, ErrMovieNotFound
+	}
+	return movie, d.ReviewsOf(reviews.Target{Kind: moviePolicy.Kind, ID: movieID}, sortBy), nil
+}
+
+// theaterIndex returns the index of theaters' locations, making it for a
+// database that hasn't one, such as a new sandbox's copy.
+func (d *Database) theaterIndex() *geo.Index {
+	d.mu.RLock()
+	index := d.TheaterIndex
+	d.mu.RUnlock()
+	if index != nil {
+		return index
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.TheaterIndex == nil {
+		d.TheaterIndex = indexTheaters(&d.Theaters)
+	}
+	return d.TheaterIndex
+}
+
+func indexTheaters(theaters *server.Repository[Theater]) *geo.Index {
+	index := geo.NewIndex()
+	for _, id := range theaters.Keys() {
+		theater, _ := theaters.Get(id)
+		index.Add(id, geo.Point{Lat: theater.Latitude, Lon: theater.Longitude})
+	}
+	return index
+}
+
 // Handlers
-func getTheaters(c *fiber.Ctx) error {
+func (h *handlers) getTheaters(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	lat := c.QueryFloat("latitude", 0)
 	lon := c.QueryFloat("longitude", 0)
 
 	if lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "latitude and longitude are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "latitude and longitude are required")
 	}
+	radius := c.QueryFloat("radius_km", 50)
 
+	// Nearest first
+	nearby := db.theaterIndex().Within(geo.Point{Lat: lat, Lon: lon}, radius)
 	var nearbyTheaters []Theater
-	maxDistance := 50.0 // Maximum radius in km
-
 	db.mu.RLock()
-	for _, theater := range db.Theaters {
-		distance := calculateDistance(lat, lon, theater.Latitude, theater.Longitude)
-		if distance <= maxDistance {
+	for _, near := range nearby {
+		if theater, ok := db.Theaters.Get(near.ID); ok {
 			nearbyTheaters = append(nearbyTheaters, theater)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(nearbyTheaters)
+	return server.List(c, nearbyTheaters)
 }
 
-func getMovies(c *fiber.Ctx) error {
+func (h *handlers) getMovies(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	theaterID := c.Query("theater_id")
 
 	db.mu.RLock()
@@ -188,80 +1148,190 @@ func getMovies(c *fiber.Ctx) error {
 	if theaterID != "" {
 		// Get movies showing at specific theater
 		movieIDs := make(map[string]bool)
-		for _, showtime := range db.Showtimes {
+		for _, showtime := range db.Showtimes.List() {
 			if showtime.TheaterID == theaterID {
 				movieIDs[showtime.MovieID] = true
 			}
 		}
 
 		for movieID := range movieIDs {
-			if movie, exists := db.Movies[movieID]; exists {
+			if movie, exists := db.Movies.Get(movieID); exists {
 				movies = append(movies, movie)
 			}
 		}
 	} else {
 		// Get all current movies
-		for _, movie := range db.Movies {
+		for _, movie := range db.Movies.List() {
 			movies = append(movies, movie)
 		}
 	}
 
+	if c.Query("sort") == "audience_score" {
+		sort.Slice(movies, func(i, j int) bool {
+			if movies[i].AudienceScore != movies[j].AudienceScore {
+				return movies[i].AudienceScore > movies[j].AudienceScore
+			}
+			return movies[i].ReviewCount > movies[j].ReviewCount
+		})
+	}
+
 	return c.JSON(movies)
 }
 
-func getShowtimes(c *fiber.Ctx) error {
-	movieID := c.Query("movie_id")
-	theaterID := c.Query("theater_id")
-	dateStr := c.Query("date")
+// timeOfDayWindows are the named start-time windows, in minutes after
+// midnight, half-open [from, to).
+var timeOfDayWindows = map[string][2]int{
+	"morning":   {0, 12 * 60},
+	"afternoon": {12 * 60, 17 * 60},
+	"evening":   {17 * 60, 21 * 60},
+	"late":      {21 * 60, 24 * 60},
+}
 
-	if movieID == "" || theaterID == "" || dateStr == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "movie_id, theater_id, and date are required",
-		})
-	}
+type ShowtimeFilter struct {
+	MovieID   string
+	TheaterID string
+	Date      string // YYYY-MM-DD
+	Format    string // case-insensitive substring, e.g. "IMAX" or "3D"
+	// FromMinute and ToMinute bound the start time of day, half-open.
+	FromMinute int
+	ToMinute   int
+	Descending bool
+}
 
-	date, err := time.Parse("2006-01-02", dateStr)
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid date format",
-		})
+		return 0, err
 	}
+	return t.Hour()*60 + t.Minute(), nil
+}
 
-	var showtimes []Showtime
-	db.mu.RLock()
-	for _, showtime := range db.Showtimes {
-		if showtime.MovieID == movieID &&
-			showtime.TheaterID == theaterID &&
-			showtime.StartTime.Format("2006-01-02") == date.Format("2006-01-02") {
-			showtimes = append(showtimes, showtime)
+func (d *Database) SearchShowtimes(filter ShowtimeFilter) []Showtime {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	format := strings.ToLower(filter.Format)
+	showtimes := []Showtime{}
+	for _, showtime := range d.Showtimes.List() {
+		if filter.MovieID != "" && showtime.MovieID != filter.MovieID {
+			continue
+		}
+		if filter.TheaterID != "" && showtime.TheaterID != filter.TheaterID {
+			continue
 		}
+		theater, _ := d.Theaters.Get(showtime.TheaterID)
+		local := showtime.StartTime.In(theater.location())
+		if filter.Date != "" && local.Format(time.DateOnly) != filter.Date {
+			continue
+		}
+		if format != "" && !strings.Contains(strings.ToLower(showtime.Format), format) {
+			continue
+		}
+		minute := local.Hour()*60 + local.Minute()
+		if minute < filter.FromMinute || minute >= filter.ToMinute {
+			continue
+		}
+		showtimes = append(showtimes, showtime)
+	}
+	sort.Slice(showtimes, func(i, j int) bool {
+		if !showtimes[i].StartTime.Equal(showtimes[j].StartTime) {
+			if filter.Descending {
+				return showtimes[i].StartTime.After(showtimes[j].StartTime)
+			}
+			return showtimes[i].StartTime.Before(showtimes[j].StartTime)
+		}
+		return showtimes[i].ID < showtimes[j].ID
+	})
+	return showtimes
+}
+
+// getShowtimes lists showtimes filtered by any combination of movie,
+// theater, date, format and start-time window. Dates and times of day are
+// the theater's, so "evening" is evening wherever the showtime is.
+func (h *handlers) getShowtimes(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	filter := ShowtimeFilter{
+		MovieID:   c.Query("movie_id"),
+		TheaterID: c.Query("theater_id"),
+		Format:    c.Query("format"),
+		ToMinute:  24 * 60,
+	}
+
+	if dateStr := c.Query("date"); dateStr != "" {
+		date, err := time.Parse("2006-01-02", dateStr)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid date format")
+		}
+		filter.Date = date.Format("2006-01-02")
 	}
-	db.mu.RUnlock()
 
-	return c.JSON(showtimes)
+	if timeOfDay := c.Query("time_of_day"); timeOfDay != "" {
+		window, ok := timeOfDayWindows[timeOfDay]
+		if !ok {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "time_of_day must be morning, afternoon, evening or late")
+		}
+		filter.FromMinute, filter.ToMinute = window[0], window[1]
+	}
+	if after := c.Query("start_after"); after != "" {
+		minute, err := parseClock(after)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "start_after must be HH:MM")
+		}
+		if minute > filter.FromMinute {
+			filter.FromMinute = minute
+		}
+	}
+	if before := c.Query("start_before"); before != "" {
+		minute, err := parseClock(before)
+		if err != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "start_before must be HH:MM")
+		}
+		if minute < filter.ToMinute {
+			filter.ToMinute = minute
+		}
+	}
+
+	switch c.Query("sort", "start_asc") {
+	case "start_asc":
+	case "start_desc":
+		filter.Descending = true
+	default:
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "sort must be start_asc or start_desc")
+	}
+
+	return server.List(c, db.SearchShowtimes(filter), "movie_id", "theater_id", "format", "sort")
+}
+
+func (h *handlers) getSeatMap(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	seatMap, err := db.GetSeatMap(c.Params("id"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return c.JSON(seatMap)
 }
 
 type PurchaseTicketRequest struct {
-	ShowtimeID      string `json:"showtime_id"`
-	UserEmail       string `json:"user_email"`
-	SeatCount       int    `json:"seat_count"`
-	PaymentMethodID string `json:"payment_method_id"`
+	ShowtimeID      string            `json:"showtime_id"`
+	UserEmail       string            `json:"user_email" validate:"email"`
+	Seats           []string          `json:"seats"`
+	Concessions     []ConcessionOrder `json:"concessions"`
+	Rewards         []string          `json:"rewards"`
+	PaymentMethodID string            `json:"payment_method_id"`
 }
 
-func purchaseTickets(c *fiber.Ctx) error {
+func (h *handlers) purchaseTickets(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req PurchaseTicketRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate payment method
@@ -273,161 +1343,344 @@ func purchaseTickets(c *fiber.Ctx) error {
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Get showtime
 	showtime, err := db.GetShowtime(req.ShowtimeID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	// Validate seat availability
-	if showtime.AvailableSeats < req.SeatCount {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Not enough seats available",
-		})
+	if len(req.Seats) == 0 {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "at least one seat is required")
+	}
+	seats := make([]string, len(req.Seats))
+	for i, seat := range req.Seats {
+		seats[i] = strings.ToUpper(strings.TrimSpace(seat))
 	}
 
 	// Get movie and theater info
 	movie, err := db.GetMovie(showtime.MovieID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get movie information",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to get movie information")
 	}
 
 	theater, err := db.GetTheater(showtime.TheaterID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get theater information",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to get theater information")
 	}
 
 	// Create ticket
 	ticket := Ticket{
-		ID:           uuid.New().String(),
-		Showtime:     showtime,
-		Movie:        movie,
-		Theater:      theater,
-		UserEmail:    req.UserEmail,
-		SeatCount:    req.SeatCount,
-		TotalPrice:   showtime.Price * float64(req.SeatCount),
-		PurchaseDate: time.Now(),
-		QRCode:       generateQRCode(),
-	}
-
-	if err := db.CreateTicket(ticket); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create ticket",
-		})
+		ID:              server.NewID("TKT"),
+		Showtime:        showtime,
+		Movie:           movie,
+		Theater:         theater,
+		UserEmail:       req.UserEmail,
+		Seats:           seats,
+		SeatCount:       len(seats),
+		PaymentMethodID: req.PaymentMethodID,
+		PurchaseDate:    h.clock.Now(),
+		QRCode:          generateQRCode(),
 	}
 
-	// Update available seats
-	db.mu.Lock()
-	showtime.AvailableSeats -= req.SeatCount
-	db.Showtimes[showtime.ID] = showtime
-	db.mu.Unlock()
-
+	conflicts, err := db.CreateTicket(&ticket, req.Concessions, req.Rewards, db.Charger(c))
+	if err != nil {
+		var declined *server.Error
+		if errors.As(err, &declined) {
+			return err
+		}
+		switch err {
+		case ErrInsufficientPoints:
+			return server.FailWith(c, fiber.StatusPaymentRequired, err)
+		case ErrSeatsTaken:
+			return server.FailWith(c, fiber.StatusConflict,
+				server.NewError(server.CodeConflict, err.Error()).WithDetails(fiber.Map{"seats": conflicts}))
+		case ErrInvalidSeat, ErrDuplicateSeat, ErrNoSeatMap, ErrConcessionNotFound,
+			ErrInvalidQuantity, ErrRewardNotFound, ErrTooManyFreeTickets:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		default:
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create ticket")
+		}
+	}
 	return c.Status(fiber.StatusCreated).JSON(ticket)
 }
 
-func getTicketHistory(c *fiber.Ctx) error {
+func ticketError(c *fiber.Ctx, err error, conflicts []string) error {
+	if errors.Is(err, money.ErrMixedCurrencies) {
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	}
+	// Declined charges carry their own code
+	var declined *server.Error
+	if errors.As(err, &declined) {
+		return err
+	}
+	switch err {
+	case ErrTicketNotFound, ErrShowtimeNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNotTicketOwner:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrSeatsTaken:
+		return server.FailWith(c, fiber.StatusConflict,
+			server.NewError(server.CodeConflict, err.Error()).WithDetails(fiber.Map{"seats": conflicts}))
+	case ErrTicketRefunded, ErrShowtimeStarted:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrPaymentRequired:
+		return server.FailWith(c, fiber.StatusPaymentRequired, err)
+	case ErrInvalidSeat, ErrDuplicateSeat, ErrNoSeatMap, ErrSeatCountMismatch, ErrInvalidPayment:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+type RefundTicketRequest struct {
+	UserEmail string `json:"user_email" validate:"required,email"`
+}
+
+func (h *handlers) refundTicket(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req RefundTicketRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ticket, err := db.RefundTicket(c.Params("id"), req.UserEmail)
+	if err != nil {
+		return ticketError(c, err, nil)
+	}
+	return c.JSON(ticket)
+}
+
+type ExchangeTicketRequest struct {
+	UserEmail       string   `json:"user_email" validate:"required,email"`
+	ShowtimeID      string   `json:"showtime_id" validate:"required"`
+	Seats           []string `json:"seats" validate:"min=1"`
+	PaymentMethodID string   `json:"payment_method_id"`
+}
+
+func (h *handlers) exchangeTicket(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ExchangeTicketRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	if req.PaymentMethodID != "" {
+		user, err := db.GetUser(req.UserEmail)
+		if err != nil {
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		}
+		validPayment := false
+		for _, pm := range user.PaymentMethods {
+			if pm.ID == req.PaymentMethodID {
+				validPayment = true
+				break
+			}
+		}
+		if !validPayment {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
+		}
+	}
+
+	seats := make([]string, len(req.Seats))
+	for i, seat := range req.Seats {
+		seats[i] = strings.ToUpper(strings.TrimSpace(seat))
+	}
+
+	ticket, conflicts, err := db.ExchangeTicket(c.Params("id"), req.UserEmail, req.ShowtimeID, seats, req.PaymentMethodID, db.Charger(c))
+	if err != nil {
+		return ticketError(c, err, conflicts)
+	}
+	return c.JSON(ticket)
+}
+
+func (h *handlers) getTicketHistory(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	// Verify user exists
 	if _, err := db.GetUser(email); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var userTickets []Ticket
 	db.mu.RLock()
-	for _, ticket := range db.Tickets {
+	for _, ticket := range db.Tickets.List() {
 		if ticket.UserEmail == email {
 			userTickets = append(userTickets, ticket)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userTickets)
+	return server.List(c, userTickets)
 }
 
-// Helper functions
-func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+func (h *handlers) getConcessions(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	return server.List(c, db.GetConcessions())
 }
 
-func generateQRCode() string {
-	return uuid.New().String() // Simplified QR code generation
+func (h *handlers) getLoyalty(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	summary, err := db.GetLoyaltySummary(email)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return c.JSON(summary)
+}
+
+func (h *handlers) getLoyaltyRewards(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"rewards": sortedRewards(),
+		"tiers":   tiers,
+	})
+}
+
+type CreateReviewRequest struct {
+	UserEmail string  `json:"user_email" validate:"required,email"`
+	Rating    float64 `json:"rating"`
+	Body      string  `json:"body"`
+}
+
+func (h *handlers) createReview(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req CreateReviewRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+	if err := moviePolicy.Scale.Check(req.Rating); err != nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, err.Error())
+	}
+
+	review, err := db.CreateReview(reviews.Review{
+		Target:    reviews.Target{ID: c.Params("id")},
+		UserEmail: req.UserEmail,
+		Rating:    req.Rating,
+		Body:      strings.TrimSpace(req.Body),
+	})
+	if err != nil {
+		switch err {
+		case ErrMovieNotFound, ErrUserNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNoAttendedShowtime:
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		case ErrAlreadyReviewed:
+			return server.FailWith(c, fiber.StatusConflict, err)
+		default:
+			return server.FailWith(c, fiber.StatusInternalServerError, err)
+		}
+	}
+	return c.Status(fiber.StatusCreated).JSON(review)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
+func (h *handlers) getMovieReviews(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	movie, reviews, err := db.GetMovieReviews(c.Params("id"), c.Query("sort"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	page, err := server.Paginate(c, reviews)
 	if err != nil {
 		return err
 	}
 
-	db = &Database{
-		Users:     make(map[string]User),
-		Theaters:  make(map[string]Theater),
-		Movies:    make(map[string]Movie),
-		Showtimes: make(map[string]Showtime),
-		Tickets:   make(map[string]Ticket),
+	return c.JSON(fiber.Map{
+		"movie_id":       movie.ID,
+		"average_rating": movie.AverageRating,
+		"audience_score": movie.AudienceScore,
+		"reviews":        page,
+	})
+}
+
+// Helper functions
+func generateQRCode() string {
+	return uuid.New().String() // Simplified QR code generation
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	return json.Unmarshal(data, db)
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	db.localize()
+	db.TheaterIndex = indexTheaters(&db.Theaters)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/theaters", getTheaters)
-	api.Get("/movies", getMovies)
-	api.Get("/showtimes", getShowtimes)
-	api.Post("/tickets", purchaseTickets)
-	api.Get("/tickets/history", getTicketHistory)
+	api.Get("/theaters", h.getTheaters)
+	api.Get("/movies", h.getMovies)
+	api.Get("/movies/:id/reviews", h.getMovieReviews)
+	api.Post("/movies/:id/reviews", h.createReview)
+	api.Get("/showtimes", h.getShowtimes)
+	api.Get("/showtimes/:id/seats", h.getSeatMap)
+	api.Post("/tickets", h.purchaseTickets)
+	api.Get("/tickets/history", h.getTicketHistory)
+	api.Post("/tickets/:id/refund", h.refundTicket)
+	api.Post("/tickets/:id/exchange", h.exchangeTicket)
+	api.Get("/concessions", h.getConcessions)
+
+	// Crown Club routes
+	api.Get("/loyalty", h.getLoyalty)
+	api.Get("/loyalty/rewards", h.getLoyaltyRewards)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"loyalty_accounts", "tickets"},
+			Search:  []string{"movies", "theaters", "showtimes", "concessions", "tickets"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
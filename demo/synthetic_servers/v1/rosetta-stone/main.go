@@ -1,19 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -54,7 +49,7 @@ type UserProgress struct {
 }
 
 type LessonCompletion struct {
-	UserEmail   string    `json:"user_email"`
+	UserEmail   string    `json:"user_email" validate:"email"`
 	LessonID    string    `json:"lesson_id"`
 	Score       int       `json:"score"`
 	TimeSpent   int       `json:"time_spent"`
@@ -63,7 +58,7 @@ type LessonCompletion struct {
 
 type PracticeSession struct {
 	ID           string    `json:"id"`
-	UserEmail    string    `json:"user_email"`
+	UserEmail    string    `json:"user_email" validate:"email"`
 	CourseID     string    `json:"course_id"`
 	LessonID     string    `json:"lesson_id"`
 	PracticeType string    `json:"practice_type"`
@@ -84,22 +79,35 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users            map[string]User            `json:"users"`
-	Courses          map[string]Course          `json:"courses"`
-	UserProgress     map[string][]UserProgress  `json:"user_progress"`
-	PracticeSessions map[string]PracticeSession `json:"practice_sessions"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users            server.Repository[User]            `json:"users"`
+	Courses          server.Repository[Course]          `json:"courses"`
+	UserProgress     server.Repository[[]UserProgress]  `json:"user_progress"`
+	PracticeSessions server.Repository[PracticeSession] `json:"practice_sessions"`
 	mu               sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers take Rosetta Stone learners through courses and practice
+// sessions, dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the courses, progress and sessions in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -110,7 +118,7 @@ func (d *Database) GetCourse(id string) (Course, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	course, exists := d.Courses[id]
+	course, exists := d.Courses.Get(id)
 	if !exists {
 		return Course{}, errors.New("course not found")
 	}
@@ -121,7 +129,7 @@ func (d *Database) GetUserProgress(email string) ([]UserProgress, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	progress, exists := d.UserProgress[email]
+	progress, exists := d.UserProgress.Get(email)
 	if !exists {
 		return nil, errors.New("no progress found")
 	}
@@ -132,72 +140,67 @@ func (d *Database) UpdateUserProgress(progress UserProgress) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	currentProgress := d.UserProgress[progress.UserEmail]
+	currentProgress, _ := d.UserProgress.Get(progress.UserEmail)
 	for i, p := range currentProgress {
 		if p.CourseID == progress.CourseID {
 			currentProgress[i] = progress
-			d.UserProgress[progress.UserEmail] = currentProgress
+			d.UserProgress.Upsert(progress.UserEmail, currentProgress)
 			return nil
 		}
 	}
 
-	d.UserProgress[progress.UserEmail] = append(d.UserProgress[progress.UserEmail], progress)
+	d.UserProgress.Upsert(progress.UserEmail, append(currentProgress, progress))
 	return nil
 }
 
 // HTTP Handlers
-func getCourses(c *fiber.Ctx) error {
+func (h *handlers) getCourses(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var courses []Course
 	db.mu.RLock()
-	for _, course := range db.Courses {
+	for _, course := range db.Courses.List() {
 		courses = append(courses, course)
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(courses)
+	return server.List(c, courses)
 }
 
-func getUserProgress(c *fiber.Ctx) error {
+func (h *handlers) getUserProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	progress, err := db.GetUserProgress(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(progress)
+	return server.List(c, progress)
 }
 
-func completedLesson(c *fiber.Ctx) error {
+func (h *handlers) completedLesson(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	lessonId := c.Params("lessonId")
 	var completion LessonCompletion
 
-	if err := c.BodyParser(&completion); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &completion); err != nil {
+		return err
 	}
 
 	// Validate user exists
 	user, err := db.GetUser(completion.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Find the course for this lesson
 	var targetCourse Course
 	var foundLesson bool
 	db.mu.RLock()
-	for _, course := range db.Courses {
+	for _, course := range db.Courses.List() {
 		for _, lesson := range course.Lessons {
 			if lesson.ID == lessonId {
 				targetCourse = course
@@ -212,9 +215,7 @@ func completedLesson(c *fiber.Ctx) error {
 	db.mu.RUnlock()
 
 	if !foundLesson {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Lesson not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Lesson not found")
 	}
 
 	// Update user progress
@@ -251,7 +252,7 @@ func completedLesson(c *fiber.Ctx) error {
 	if !lessonCompleted {
 		courseProgress.CompletedLessons = append(courseProgress.CompletedLessons, lessonId)
 		courseProgress.TotalPoints += completion.Score
-		courseProgress.LastActivity = time.Now()
+		courseProgress.LastActivity = h.clock.Now()
 
 		// Update proficiency level based on progress
 		completionPercentage := float64(len(courseProgress.CompletedLessons)) / float64(len(targetCourse.Lessons))
@@ -265,108 +266,99 @@ func completedLesson(c *fiber.Ctx) error {
 		}
 
 		if err := db.UpdateUserProgress(courseProgress); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to update progress",
-			})
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update progress")
 		}
 	}
 
 	return c.JSON(courseProgress)
 }
 
-func startPracticeSession(c *fiber.Ctx) error {
+func (h *handlers) startPracticeSession(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var session PracticeSession
-	if err := c.BodyParser(&session); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &session); err != nil {
+		return err
 	}
 
 	// Validate user exists
 	if _, err := db.GetUser(session.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Validate course exists
 	if _, err := db.GetCourse(session.CourseID); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Course not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Course not found")
 	}
 
-	session.ID = uuid.New().String()
-	session.StartedAt = time.Now()
+	session.ID = server.NewID("SESS")
+	session.StartedAt = h.clock.Now()
 
 	db.mu.Lock()
-	db.PracticeSessions[session.ID] = session
+	db.PracticeSessions.Upsert(session.ID, session)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(session)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:            make(map[string]User),
-		Courses:          make(map[string]Course),
-		UserProgress:     make(map[string][]UserProgress),
-		PracticeSessions: make(map[string]PracticeSession),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/courses", getCourses)
-	api.Get("/users/:email/progress", getUserProgress)
-	api.Post("/lessons/:lessonId/complete", completedLesson)
-	api.Post("/practice-sessions", startPracticeSession)
+	api.Get("/courses", h.getCourses)
+	api.Get("/users/:email/progress", h.getUserProgress)
+	api.Post("/lessons/:lessonId/complete", h.completedLesson)
+	api.Post("/practice-sessions", h.startPracticeSession)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"practice_sessions"},
+			Search:  []string{"courses"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,33 +1,31 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Product struct {
-	ID           string    `json:"id"`
-	Name         string    `json:"name"`
-	Brand        string    `json:"brand"`
-	Category     string    `json:"category"`
-	Price        float64   `json:"price"`
-	Size         string    `json:"size"`
-	Description  string    `json:"description"`
-	Ingredients  []string  `json:"ingredients"`
-	Rating       float64   `json:"rating"`
-	ReviewsCount int       `json:"reviews_count"`
-	InStock      bool      `json:"in_stock"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           string      `json:"id"`
+	Name         string      `json:"name"`
+	Brand        string      `json:"brand"`
+	Category     string      `json:"category"`
+	Price        money.Money `json:"price"`
+	Size         string      `json:"size"`
+	Description  string      `json:"description"`
+	Ingredients  []string    `json:"ingredients"`
+	Rating       float64     `json:"rating"`
+	ReviewsCount int         `json:"reviews_count"`
+	InStock      bool        `json:"in_stock"`
+	CreatedAt    time.Time   `json:"created_at"`
 }
 
 type BeautyProfile struct {
@@ -42,20 +40,38 @@ type BeautyProfile struct {
 }
 
 type OrderItem struct {
-	ProductID string  `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ProductID string      `json:"product_id"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Money `json:"price"`
 }
 
 type Order struct {
-	ID        string      `json:"id"`
-	UserEmail string      `json:"user_email"`
-	Items     []OrderItem `json:"items"`
-	Total     float64     `json:"total"`
-	Status    string      `json:"status"`
-	CreatedAt time.Time   `json:"created_at"`
+	ID            string                    `json:"id"`
+	UserEmail     string                    `json:"user_email"`
+	Items         []OrderItem               `json:"items"`
+	Total         money.Money               `json:"total"`
+	Status        string                    `json:"status"`
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+	CreatedAt     time.Time                 `json:"created_at"`
 }
 
+// orderMachine is the statuses an order moves through.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	"pending":    {"processing"},
+	"processing": {"shipped"},
+	"shipped":    {"delivered"},
+}}
+
+// orderLifecycle processes orders, ships them the next day and delivers
+// them a few days later.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: "pending", To: "processing", After: 10 * time.Minute},
+	{From: "processing", To: "shipped", After: 24 * time.Hour,
+		Notify: server.Notice{Type: "order_shipped", Message: "Your order {{id}} has shipped."}},
+	{From: "shipped", To: "delivered", After: 72 * time.Hour,
+		Notify: server.Notice{Type: "order_delivered", Message: "Your order {{id}} was delivered."}},
+}, Machine: orderMachine}
+
 type User struct {
 	Email         string        `json:"email"`
 	Name          string        `json:"name"`
@@ -65,20 +81,35 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users    map[string]User    `json:"users"`
-	Products map[string]Product `json:"products"`
-	Orders   map[string]Order   `json:"orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users    server.Repository[User]    `json:"users"`
+	Products server.Repository[Product] `json:"products"`
+	Orders   server.Repository[Order]   `json:"orders"`
 	mu       sync.RWMutex
+	clock    *server.Clock
 }
 
-var db *Database
+// handlers serve Sephora's products and users' beauty profiles, orders and
+// recommendations.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the products, users and orders in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, fiber.NewError(fiber.StatusNotFound, "User not found")
 	}
@@ -89,14 +120,14 @@ func (d *Database) UpdateBeautyProfile(email string, profile BeautyProfile) erro
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return fiber.NewError(fiber.StatusNotFound, "User not found")
 	}
 
 	user.BeautyProfile = profile
-	user.BeautyProfile.UpdatedAt = time.Now()
-	d.Users[email] = user
+	user.BeautyProfile.UpdatedAt = d.clock.Now()
+	d.Users.Upsert(email, user)
 	return nil
 }
 
@@ -104,41 +135,32 @@ func (d *Database) GetProducts(category, brand string, priceRange string) []Prod
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var filtered []Product
-	for _, product := range d.Products {
-		if (category == "" || product.Category == category) &&
-			(brand == "" || product.Brand == brand) {
-			// Add price range filtering logic here if needed
-			filtered = append(filtered, product)
-		}
-	}
-	return filtered
+	return d.Products.Query(func(product Product) bool {
+		return (category == "" || product.Category == category) &&
+			(brand == "" || product.Brand == brand)
+	})
 }
 
 func (d *Database) GetUserOrders(email string) []Order {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var userOrders []Order
-	for _, order := range d.Orders {
-		if order.UserEmail == email {
-			userOrders = append(userOrders, order)
-		}
-	}
-	return userOrders
+	return d.Orders.By("user_email", email)
 }
 
 // Handlers
-func getProducts(c *fiber.Ctx) error {
+func (h *handlers) getProducts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	brand := c.Query("brand")
 	priceRange := c.Query("price_range")
 
 	products := db.GetProducts(category, brand, priceRange)
-	return c.JSON(products)
+	return server.List(c, products, "brand", "category")
 }
 
-func getBeautyProfile(c *fiber.Ctx) error {
+func (h *handlers) getBeautyProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	user, err := db.GetUser(email)
@@ -149,12 +171,13 @@ func getBeautyProfile(c *fiber.Ctx) error {
 	return c.JSON(user.BeautyProfile)
 }
 
-func updateBeautyProfile(c *fiber.Ctx) error {
+func (h *handlers) updateBeautyProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	var profile BeautyProfile
-	if err := c.BodyParser(&profile); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	if err := server.Bind(c, &profile); err != nil {
+		return err
 	}
 
 	if err := db.UpdateBeautyProfile(email, profile); err != nil {
@@ -164,7 +187,8 @@ func updateBeautyProfile(c *fiber.Ctx) error {
 	return c.JSON(profile)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	if _, err := db.GetUser(email); err != nil {
@@ -172,10 +196,11 @@ func getUserOrders(c *fiber.Ctx) error {
 	}
 
 	orders := db.GetUserOrders(email)
-	return c.JSON(orders)
+	return server.List(c, orders)
 }
 
-func getRecommendations(c *fiber.Ctx) error {
+func (h *handlers) getRecommendations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	user, err := db.GetUser(email)
@@ -194,65 +219,75 @@ func getRecommendations(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(recommendations)
+	return server.List(c, recommendations)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:    make(map[string]User),
-		Products: make(map[string]Product),
-		Orders:   make(map[string]Order),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Product routes
-	api.Get("/products", getProducts)
+	api.Get("/products", h.getProducts)
 
 	// User routes
-	api.Get("/users/:email/beauty-profile", getBeautyProfile)
-	api.Put("/users/:email/beauty-profile", updateBeautyProfile)
-	api.Get("/users/:email/orders", getUserOrders)
-	api.Get("/users/:email/recommendations", getRecommendations)
+	api.Get("/users/:email/beauty-profile", h.getBeautyProfile)
+	api.Put("/users/:email/beauty-profile", h.updateBeautyProfile)
+	api.Get("/users/:email/orders", h.getUserOrders)
+	api.Get("/users/:email/recommendations", h.getRecommendations)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders"},
+			Search:  []string{"products", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,18 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -64,10 +60,13 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users      map[string]User       `json:"users"`
-	Stations   map[string]Station    `json:"stations"`
-	Shows      map[string]Show       `json:"shows"`
-	NowPlaying map[string]NowPlaying `json:"now_playing"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users      server.Repository[User]       `json:"users"`
+	Stations   server.Repository[Station]    `json:"stations"`
+	Shows      server.Repository[Show]       `json:"shows"`
+	NowPlaying server.Repository[NowPlaying] `json:"now_playing"`
 	mu         sync.RWMutex
 }
 
@@ -80,15 +79,25 @@ var (
 	ErrUnauthorized    = errors.New("unauthorized")
 )
 
-// Global database instance
-var db *Database
+// handlers serve SiriusXM stations, shows, what is playing on each and
+// listeners' favorites from db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the stations, shows and now-playing in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -99,7 +108,7 @@ func (d *Database) GetStation(id string) (Station, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	station, exists := d.Stations[id]
+	station, exists := d.Stations.Get(id)
 	if !exists {
 		return Station{}, ErrStationNotFound
 	}
@@ -110,7 +119,7 @@ func (d *Database) GetShow(id string) (Show, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	show, exists := d.Shows[id]
+	show, exists := d.Shows.Get(id)
 	if !exists {
 		return Show{}, ErrShowNotFound
 	}
@@ -121,19 +130,19 @@ func (d *Database) AddToFavorites(email string, contentID string, contentType st
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
 
 	switch contentType {
 	case "station":
-		if _, exists := d.Stations[contentID]; !exists {
+		if _, exists := d.Stations.Get(contentID); !exists {
 			return ErrStationNotFound
 		}
 		user.FavoriteStations = append(user.FavoriteStations, contentID)
 	case "show":
-		if _, exists := d.Shows[contentID]; !exists {
+		if _, exists := d.Shows.Get(contentID); !exists {
 			return ErrShowNotFound
 		}
 		user.FavoriteShows = append(user.FavoriteShows, contentID)
@@ -141,60 +150,55 @@ func (d *Database) AddToFavorites(email string, contentID string, contentType st
 		return ErrInvalidInput
 	}
 
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
 // HTTP Handlers
-func getStations(c *fiber.Ctx) error {
+func (h *handlers) getStations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 
 	var stations []Station
 	db.mu.RLock()
-	for _, station := range db.Stations {
+	for _, station := range db.Stations.List() {
 		if category == "" || station.Category == category {
 			stations = append(stations, station)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(stations)
+	return server.List(c, stations, "category")
 }
 
-func getNowPlaying(c *fiber.Ctx) error {
+func (h *handlers) getNowPlaying(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	stationId := c.Params("stationId")
 	if stationId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Station ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Station ID is required")
 	}
 
 	db.mu.RLock()
-	nowPlaying, exists := db.NowPlaying[stationId]
+	nowPlaying, exists := db.NowPlaying.Get(stationId)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Station not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Station not found")
 	}
 
 	return c.JSON(nowPlaying)
 }
 
-func getFavorites(c *fiber.Ctx) error {
+func (h *handlers) getFavorites(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var favoriteStations []Station
@@ -202,13 +206,13 @@ func getFavorites(c *fiber.Ctx) error {
 
 	db.mu.RLock()
 	for _, stationID := range user.FavoriteStations {
-		if station, exists := db.Stations[stationID]; exists {
+		if station, exists := db.Stations.Get(stationID); exists {
 			favoriteStations = append(favoriteStations, station)
 		}
 	}
 
 	for _, showID := range user.FavoriteShows {
-		if show, exists := db.Shows[showID]; exists {
+		if show, exists := db.Shows.Get(showID); exists {
 			favoriteShows = append(favoriteShows, show)
 		}
 	}
@@ -221,17 +225,16 @@ func getFavorites(c *fiber.Ctx) error {
 }
 
 type AddFavoriteRequest struct {
-	UserEmail   string `json:"user_email"`
+	UserEmail   string `json:"user_email" validate:"email"`
 	ContentID   string `json:"content_id"`
 	ContentType string `json:"content_type"`
 }
 
-func addToFavorites(c *fiber.Ctx) error {
+func (h *handlers) addToFavorites(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req AddFavoriteRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	if err := db.AddToFavorites(req.UserEmail, req.ContentID, req.ContentType); err != nil {
@@ -242,9 +245,7 @@ func addToFavorites(c *fiber.Ctx) error {
 			status = fiber.StatusBadRequest
 		}
 
-		return c.Status(status).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, status, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
@@ -252,120 +253,116 @@ func addToFavorites(c *fiber.Ctx) error {
 	})
 }
 
-func getShows(c *fiber.Ctx) error {
+func (h *handlers) getShows(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 
 	var shows []Show
 	db.mu.RLock()
-	for _, show := range db.Shows {
+	for _, show := range db.Shows.List() {
 		if category == "" || show.Category == category {
 			shows = append(shows, show)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(shows)
+	return server.List(c, shows, "category")
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:      make(map[string]User),
-		Stations:   make(map[string]Station),
-		Shows:      make(map[string]Show),
-		NowPlaying: make(map[string]NowPlaying),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Station routes
-	api.Get("/stations", getStations)
+	api.Get("/stations", h.getStations)
 	api.Get("/stations/:stationId", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("stationId")
 		station, err := db.GetStation(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(station)
 	})
-	api.Get("/stations/:stationId/now-playing", getNowPlaying)
+	api.Get("/stations/:stationId/now-playing", h.getNowPlaying)
 
 	// Show routes
-	api.Get("/shows", getShows)
+	api.Get("/shows", h.getShows)
 	api.Get("/shows/:showId", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("showId")
 		show, err := db.GetShow(id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(show)
 	})
 
 	// Favorites routes
-	api.Get("/favorites", getFavorites)
-	api.Post("/favorites", addToFavorites)
+	api.Get("/favorites", h.getFavorites)
+	api.Post("/favorites", h.addToFavorites)
 
 	// User routes
 	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		email := c.Params("email")
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(user)
 	})
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+			Search:  []string{"stations", "shows"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,20 +1,20 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"log"
-	"os"
+	"math"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -24,7 +24,96 @@ type User struct {
 	Bio              string    `json:"bio"`
 	JoinedAt         time.Time `json:"joined_at"`
 	Interests        []string  `json:"interests"`
-	SubscriptionTier string    `json:"subscription_tier"`
+	SubscriptionTier string    `json:"subscription_tier"` // free or premium
+}
+
+const (
+	TierFree    = "free"
+	TierPremium = "premium"
+)
+
+type BillingPlan string
+
+const (
+	PlanMonthly BillingPlan = "monthly"
+	PlanAnnual  BillingPlan = "annual"
+)
+
+var planPrices = map[BillingPlan]money.Money{
+	PlanMonthly: money.Cents(3200),
+	PlanAnnual:  money.Cents(16800),
+}
+
+// periodEnd is when a billing period for plan starting at start ends.
+func (p BillingPlan) periodEnd(start time.Time) time.Time {
+	if p == PlanAnnual {
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+type SubscriptionStatus string
+
+const (
+	SubscriptionActive   SubscriptionStatus = "active"
+	SubscriptionPastDue  SubscriptionStatus = "past_due" // Renewal failed, in the grace period
+	SubscriptionCanceled SubscriptionStatus = "canceled" // Premium until the period ends
+	SubscriptionExpired  SubscriptionStatus = "expired"
+)
+
+// subscriptionMachine is the statuses a Premium membership moves through.
+// A canceled one can be taken up again until it expires, and a past-due
+// one until its grace period ends.
+var subscriptionMachine = &statemachine.Machine{Name: "subscription", Moves: map[string][]string{
+	string(SubscriptionActive):   {string(SubscriptionPastDue), string(SubscriptionCanceled)},
+	string(SubscriptionPastDue):  {string(SubscriptionActive), string(SubscriptionExpired)},
+	string(SubscriptionCanceled): {string(SubscriptionActive), string(SubscriptionExpired)},
+}}
+
+// A failed renewal keeps Premium for this long while the member updates
+// their payment method; --rules renewal_grace_period=... overrides it.
+var renewalGracePeriod = 7 * 24 * time.Hour
+
+// PaymentMethod is a stored card. Only the brand and last four digits are
+// kept.
+type PaymentMethod struct {
+	Brand    string `json:"brand"`
+	Last4    string `json:"last4"`
+	ExpMonth int    `json:"exp_month"`
+	ExpYear  int    `json:"exp_year"`
+}
+
+// expired reports whether the card has expired by t.
+func (p PaymentMethod) expired(t time.Time) bool {
+	return !t.Before(time.Date(p.ExpYear, time.Month(p.ExpMonth)+1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+type Charge struct {
+	Amount      money.Money `json:"amount"`
+	Description string      `json:"description"`
+	At          time.Time   `json:"at"`
+}
+
+type Subscription struct {
+	UserEmail          string             `json:"user_email"`
+	Plan               BillingPlan        `json:"plan"`
+	Status             SubscriptionStatus `json:"status"`
+	PaymentMethod      PaymentMethod      `json:"payment_method"`
+	StartedAt          time.Time          `json:"started_at"`
+	CurrentPeriodStart time.Time          `json:"current_period_start"`
+	CurrentPeriodEnd   time.Time          `json:"current_period_end"`
+	NextBillingDate    *time.Time         `json:"next_billing_date"` // Nil once canceled or expired
+	Charges            []Charge           `json:"charges"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+}
+
+// setStatus moves sub to status, unless it is there already.
+func (sub *Subscription) setStatus(status SubscriptionStatus, now time.Time) error {
+	if sub.Status == status {
+		return nil
+	}
+	return statemachine.Move(subscriptionMachine, sub, &sub.Status, &sub.StatusHistory, status, now)
 }
 
 type Instructor struct {
@@ -57,19 +146,22 @@ type Course struct {
 	Duration      int        `json:"duration"` // total minutes
 	Lessons       []Lesson   `json:"lessons"`
 	Rating        float64    `json:"rating"`
+	PremiumOnly   bool       `json:"premium_only"`
 	EnrolledCount int        `json:"enrolled_count"`
+	ProjectCount  int        `json:"project_count"`
 	CreatedAt     time.Time  `json:"created_at"`
 	UpdatedAt     time.Time  `json:"updated_at"`
 }
 
 type Enrollment struct {
-	ID         string    `json:"id"`
-	UserEmail  string    `json:"user_email"`
-	CourseID   string    `json:"course_id"`
-	Progress   int       `json:"progress"` // percentage
-	Completed  bool      `json:"completed"`
-	EnrolledAt time.Time `json:"enrolled_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
+	ID          string     `json:"id"`
+	UserEmail   string     `json:"user_email"`
+	CourseID    string     `json:"course_id"`
+	Progress    int        `json:"progress"` // percentage
+	Completed   bool       `json:"completed"`
+	EnrolledAt  time.Time  `json:"enrolled_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
 }
 
 type LessonProgress struct {
@@ -80,13 +172,76 @@ type LessonProgress struct {
 	LastWatched  time.Time `json:"last_watched"`
 }
 
+// WatchEvent records minutes of a lesson watched, taken from the change in
+// lesson progress.
+type WatchEvent struct {
+	CourseID  string    `json:"course_id"`
+	LessonID  string    `json:"lesson_id"`
+	UserEmail string    `json:"user_email"`
+	Minutes   float64   `json:"minutes"`
+	Premium   bool      `json:"premium"` // Viewer was a Premium member, so it earns royalties
+	At        time.Time `json:"at"`
+}
+
+// Follow is a student following an instructor. Unfollows are kept so
+// follower growth can be reported over time.
+type Follow struct {
+	ID           string     `json:"id"`
+	UserEmail    string     `json:"user_email"`
+	InstructorID string     `json:"instructor_id"`
+	FollowedAt   time.Time  `json:"followed_at"`
+	UnfollowedAt *time.Time `json:"unfollowed_at,omitempty"`
+}
+
+// Estimated royalties: teachers earn from the royalty pool per minute their
+// classes are watched by Premium members.
+const royaltyPerMinute = 0.05
+
+// Time series are capped at this many buckets.
+const maxAnalyticsBuckets = 400
+
+// Project is a student's work shared to a class's project gallery.
+type Project struct {
+	ID           string    `json:"id"`
+	CourseID     string    `json:"course_id"`
+	UserEmail    string    `json:"user_email"`
+	Title        string    `json:"title"`
+	Description  string    `json:"description"`
+	ImageURLs    []string  `json:"image_urls"`
+	LikedBy      []string  `json:"liked_by"`
+	Likes        int       `json:"likes"`
+	CommentCount int       `json:"comment_count"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type ProjectComment struct {
+	ID        string    `json:"id"`
+	ProjectID string    `json:"project_id"`
+	UserEmail string    `json:"user_email"`
+	UserName  string    `json:"user_name"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const maxProjectImages = 10
+
 // Database represents our in-memory database
 type Database struct {
-	Users          map[string]User           `json:"users"`
-	Courses        map[string]Course         `json:"courses"`
-	Enrollments    map[string]Enrollment     `json:"enrollments"`
-	LessonProgress map[string]LessonProgress `json:"lesson_progress"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users          server.Repository[User]           `json:"users"`
+	Courses        server.Repository[Course]         `json:"courses"`
+	Enrollments    server.Repository[Enrollment]     `json:"enrollments"`
+	LessonProgress server.Repository[LessonProgress] `json:"lesson_progress"`
+	Projects       server.Repository[Project]        `json:"projects"`
+	Comments       server.Repository[ProjectComment] `json:"project_comments"`
+	Subscriptions  server.Repository[Subscription]   `json:"subscriptions"` // By user email
+	WatchEvents    []WatchEvent                      `json:"watch_events"`
+	Follows        server.Repository[Follow]         `json:"follows"`
 	mu             sync.RWMutex
+	clock          *server.Clock
 }
 
 // Custom errors
@@ -95,17 +250,50 @@ var (
 	ErrCourseNotFound     = errors.New("course not found")
 	ErrEnrollmentNotFound = errors.New("enrollment not found")
 	ErrInvalidInput       = errors.New("invalid input")
+	ErrProjectNotFound    = errors.New("project not found")
+	ErrNotEnrolled        = errors.New("you must be enrolled in this class")
+	ErrNotProjectOwner    = errors.New("only the project's author can do that")
+	ErrInvalidProject     = errors.New("a title and 1-10 http(s) image URLs are required")
+	ErrEmptyComment       = errors.New("comment body is required")
+
+	ErrPremiumRequired      = errors.New("this class requires a Premium membership")
+	ErrSubscriptionNotFound = errors.New("no Premium membership found")
+	ErrAlreadySubscribed    = errors.New("already a Premium member")
+	ErrInvalidPlan          = errors.New("plan must be monthly or annual")
+	ErrNotAnUpgrade         = errors.New("only monthly memberships can be upgraded to annual")
+	ErrAlreadyCanceled      = errors.New("membership is already canceled")
+	ErrInvalidCard          = errors.New("invalid card number")
+	ErrCardExpired          = errors.New("card has expired")
+	ErrInvalidCVC           = errors.New("invalid security code")
+
+	ErrInstructorNotFound = errors.New("instructor not found")
+	ErrAlreadyFollowing   = errors.New("already following this instructor")
+	ErrNotFollowing       = errors.New("not following this instructor")
+	ErrInvalidInterval    = errors.New("interval must be day, week or month")
+	ErrInvalidRange       = errors.New("from and to must be YYYY-MM-DD with from before to")
+	ErrRangeTooLarge      = errors.New("range has too many buckets; use a wider interval")
 )
 
-// Global database instance
-var db *Database
+// handlers enroll Skillshare members in classes and keep their projects and
+// follows. clock dates enrollments and progress and runs subscription
+// renewals.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the classes, enrollments and subscriptions in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -116,7 +304,7 @@ func (d *Database) GetCourse(id string) (Course, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	course, exists := d.Courses[id]
+	course, exists := d.Courses.Get(id)
 	if !exists {
 		return Course{}, ErrCourseNotFound
 	}
@@ -127,7 +315,7 @@ func (d *Database) CreateEnrollment(enrollment Enrollment) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Enrollments[enrollment.ID] = enrollment
+	d.Enrollments.Upsert(enrollment.ID, enrollment)
 	return nil
 }
 
@@ -135,18 +323,886 @@ func (d *Database) UpdateProgress(progress LessonProgress) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.LessonProgress[progress.EnrollmentID+":"+progress.LessonID] = progress
+	key := progress.EnrollmentID + ":" + progress.LessonID
+	before, _ := d.LessonProgress.Get(key)
+	d.recordWatch(before, progress)
+	d.LessonProgress.Upsert(key, progress)
+	return nil
+}
+
+// recordWatch logs the minutes watched between two progress updates for a
+// lesson. Rewinds log nothing. Callers must hold d.mu.
+func (d *Database) recordWatch(before, after LessonProgress) {
+	enrollment, exists := d.Enrollments.Get(after.EnrollmentID)
+	if !exists || after.Progress <= before.Progress {
+		return
+	}
+	course, _ := d.Courses.Get(enrollment.CourseID)
+	user, _ := d.Users.Get(enrollment.UserEmail)
+	for _, lesson := range course.Lessons {
+		if lesson.ID != after.LessonID {
+			continue
+		}
+		d.WatchEvents = append(d.WatchEvents, WatchEvent{
+			CourseID:  enrollment.CourseID,
+			LessonID:  lesson.ID,
+			UserEmail: enrollment.UserEmail,
+			Minutes:   float64(lesson.Duration*(after.Progress-before.Progress)) / 100,
+			Premium:   user.SubscriptionTier == TierPremium,
+			At:        after.LastWatched,
+		})
+	}
+}
+
+// isEnrolled reports whether a user is enrolled in a course. Callers must
+// hold d.mu.
+func (d *Database) isEnrolled(email, courseID string) bool {
+	for _, enrollment := range d.Enrollments.List() {
+		if enrollment.UserEmail == email && enrollment.CourseID == courseID {
+			return true
+		}
+	}
+	return false
+}
+
+func validImageURL(u string) bool {
+	return strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://")
+}
+
+func (d *Database) CreateProject(project Project) (Project, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.Users.Get(project.UserEmail); !exists {
+		return Project{}, ErrUserNotFound
+	}
+	course, exists := d.Courses.Get(project.CourseID)
+	if !exists {
+		return Project{}, ErrCourseNotFound
+	}
+	if !d.isEnrolled(project.UserEmail, course.ID) {
+		return Project{}, ErrNotEnrolled
+	}
+	if strings.TrimSpace(project.Title) == "" || len(project.ImageURLs) == 0 || len(project.ImageURLs) > maxProjectImages {
+		return Project{}, ErrInvalidProject
+	}
+	for _, u := range project.ImageURLs {
+		if !validImageURL(u) {
+			return Project{}, ErrInvalidProject
+		}
+	}
+
+	now := d.clock.Now()
+	project.ID = server.NewID("PROJ")
+	project.CourseID = course.ID
+	project.LikedBy = []string{}
+	project.Likes = 0
+	project.CommentCount = 0
+	project.CreatedAt = now
+	project.UpdatedAt = now
+	d.Projects.Upsert(project.ID, project)
+
+	course.ProjectCount++
+	d.Courses.Upsert(course.ID, course)
+	return project, nil
+}
+
+func (d *Database) DeleteProject(id, email string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	project, exists := d.Projects.Get(id)
+	if !exists {
+		return ErrProjectNotFound
+	}
+	if project.UserEmail != email {
+		return ErrNotProjectOwner
+	}
+	d.Projects.Delete(id)
+	for _, commentID := range d.Comments.Keys() {
+		comment, _ := d.Comments.Get(commentID)
+		if comment.ProjectID == id {
+			d.Comments.Delete(commentID)
+		}
+	}
+	if course, exists := d.Courses.Get(project.CourseID); exists && course.ProjectCount > 0 {
+		course.ProjectCount--
+		d.Courses.Upsert(course.ID, course)
+	}
+	return nil
+}
+
+// GetGallery returns a class's projects, newest first or, with
+// sort=popular, most liked first.
+func (d *Database) GetGallery(courseID, sortBy string) ([]Project, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, exists := d.Courses.Get(courseID); !exists {
+		return nil, ErrCourseNotFound
+	}
+	projects := d.Projects.By("course_id", courseID)
+	sort.Slice(projects, func(i, j int) bool {
+		if sortBy == "popular" && projects[i].Likes != projects[j].Likes {
+			return projects[i].Likes > projects[j].Likes
+		}
+		return projects[i].CreatedAt.After(projects[j].CreatedAt)
+	})
+	return projects, nil
+}
+
+func (d *Database) GetProject(id string) (Project, []ProjectComment, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	project, exists := d.Projects.Get(id)
+	if !exists {
+		return Project{}, nil, ErrProjectNotFound
+	}
+	comments := d.Comments.By("project_id", id)
+	sort.Slice(comments, func(i, j int) bool { return comments[i].CreatedAt.Before(comments[j].CreatedAt) })
+	return project, comments, nil
+}
+
+// SetLike likes or unlikes a project. Liking twice has no further effect.
+func (d *Database) SetLike(id, email string, liked bool) (Project, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	project, exists := d.Projects.Get(id)
+	if !exists {
+		return Project{}, ErrProjectNotFound
+	}
+	if _, exists := d.Users.Get(email); !exists {
+		return Project{}, ErrUserNotFound
+	}
+
+	likedBy := []string{}
+	for _, e := range project.LikedBy {
+		if e != email {
+			likedBy = append(likedBy, e)
+		}
+	}
+	if liked {
+		likedBy = append(likedBy, email)
+	}
+	project.LikedBy = likedBy
+	project.Likes = len(likedBy)
+	d.Projects.Upsert(project.ID, project)
+	return project, nil
+}
+
+func (d *Database) AddComment(comment ProjectComment) (ProjectComment, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	project, exists := d.Projects.Get(comment.ProjectID)
+	if !exists {
+		return ProjectComment{}, ErrProjectNotFound
+	}
+	user, exists := d.Users.Get(comment.UserEmail)
+	if !exists {
+		return ProjectComment{}, ErrUserNotFound
+	}
+	if strings.TrimSpace(comment.Body) == "" {
+		return ProjectComment{}, ErrEmptyComment
+	}
+
+	comment.ID = server.NewID("CMT")
+	comment.ProjectID = project.ID
+	comment.UserName = user.Name
+	comment.CreatedAt = d.clock.Now()
+	d.Comments.Upsert(comment.ID, comment)
+
+	project.CommentCount++
+	d.Projects.Upsert(project.ID, project)
+	return comment, nil
+}
+
+type CardInput struct {
+	Number   string `json:"card_number"`
+	ExpMonth int    `json:"exp_month"`
+	ExpYear  int    `json:"exp_year"`
+	CVC      string `json:"cvc"`
+}
+
+// validateCard checks a card's number (Luhn), expiry and CVC and returns the
+// details kept on file.
+func validateCard(card CardInput, now time.Time) (PaymentMethod, error) {
+	number := strings.NewReplacer(" ", "", "-", "").Replace(card.Number)
+	if len(number) < 13 || len(number) > 19 {
+		return PaymentMethod{}, ErrInvalidCard
+	}
+	sum := 0
+	for i := range number {
+		digit := int(number[len(number)-1-i] - '0')
+		if digit < 0 || digit > 9 {
+			return PaymentMethod{}, ErrInvalidCard
+		}
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	if sum%10 != 0 {
+		return PaymentMethod{}, ErrInvalidCard
+	}
+
+	method := PaymentMethod{Last4: number[len(number)-4:], ExpMonth: card.ExpMonth, ExpYear: card.ExpYear}
+	if card.ExpMonth < 1 || card.ExpMonth > 12 || method.expired(now) {
+		return PaymentMethod{}, ErrCardExpired
+	}
+	cvcLen := 3
+	switch {
+	case strings.HasPrefix(number, "4"):
+		method.Brand = "visa"
+	case strings.HasPrefix(number, "34"), strings.HasPrefix(number, "37"):
+		method.Brand = "amex"
+		cvcLen = 4
+	case number[0] == '5' || number[0] == '2':
+		method.Brand = "mastercard"
+	case strings.HasPrefix(number, "6"):
+		method.Brand = "discover"
+	default:
+		method.Brand = "card"
+	}
+	if len(card.CVC) != cvcLen || strings.Trim(card.CVC, "0123456789") != "" {
+		return PaymentMethod{}, ErrInvalidCVC
+	}
+	return method, nil
+}
+
+// setTier records a user's membership tier. Callers must hold d.mu.
+func (d *Database) setTier(email, tier string) {
+	user, _ := d.Users.Get(email)
+	user.SubscriptionTier = tier
+	d.Users.Upsert(user.Email, user)
+}
+
+// Subscribe starts a Premium membership, charging the first period now. A
+// member whose membership is canceled but not yet over resumes it instead,
+// keeping their plan and billing date.
+func (d *Database) Subscribe(email string, plan BillingPlan, card CardInput) (Subscription, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return Subscription{}, ErrUserNotFound
+	}
+	if _, ok := planPrices[plan]; !ok {
+		return Subscription{}, ErrInvalidPlan
+	}
+	now := d.clock.Now()
+	method, err := validateCard(card, now)
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	sub, exists := d.Subscriptions.Get(email)
+	switch {
+	case exists && (sub.Status == SubscriptionActive || sub.Status == SubscriptionPastDue):
+		return Subscription{}, ErrAlreadySubscribed
+	case exists && sub.Status == SubscriptionCanceled:
+		if err := sub.setStatus(SubscriptionActive, now); err != nil {
+			return Subscription{}, err
+		}
+		sub.PaymentMethod = method
+		next := sub.CurrentPeriodEnd
+		sub.NextBillingDate = &next
+		d.Subscriptions.Upsert(sub.UserEmail, sub)
+		return sub, nil
+	}
+
+	end := plan.periodEnd(now)
+	sub = Subscription{
+		UserEmail:          user.Email,
+		Plan:               plan,
+		Status:             SubscriptionActive,
+		PaymentMethod:      method,
+		StartedAt:          now,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   end,
+		NextBillingDate:    &end,
+		Charges: append(sub.Charges, Charge{
+			Amount:      planPrices[plan],
+			Description: fmt.Sprintf("Premium %s membership", plan),
+			At:          now,
+		}),
+	}
+	d.Subscriptions.Upsert(sub.UserEmail, sub)
+	d.setTier(email, TierPremium)
+	return sub, nil
+}
+
+func (d *Database) GetSubscription(email string) (Subscription, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	sub, exists := d.Subscriptions.Get(email)
+	if !exists {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+// liveSubscription returns a membership that can still be changed. Callers
+// must hold d.mu.
+func (d *Database) liveSubscription(email string) (Subscription, error) {
+	sub, exists := d.Subscriptions.Get(email)
+	if !exists || sub.Status == SubscriptionExpired {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+// Upgrade moves a monthly member to the annual plan. The unused part of
+// the current month is credited against the first year.
+func (d *Database) Upgrade(email string) (Subscription, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sub, err := d.liveSubscription(email)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if sub.Plan != PlanMonthly {
+		return Subscription{}, ErrNotAnUpgrade
+	}
+	now := d.clock.Now()
+	if sub.PaymentMethod.expired(now) {
+		return Subscription{}, ErrCardExpired
+	}
+
+	var credit money.Money
+	if sub.Status != SubscriptionPastDue {
+		period := sub.CurrentPeriodEnd.Sub(sub.CurrentPeriodStart)
+		unused := sub.CurrentPeriodEnd.Sub(now)
+		credit = planPrices[PlanMonthly].Mul(unused.Hours() / period.Hours())
+	}
+	amount, err := planPrices[PlanAnnual].Sub(credit)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if err := sub.setStatus(SubscriptionActive, now); err != nil {
+		return Subscription{}, err
+	}
+	end := PlanAnnual.periodEnd(now)
+	sub.Plan = PlanAnnual
+	sub.CurrentPeriodStart = now
+	sub.CurrentPeriodEnd = end
+	sub.NextBillingDate = &end
+	sub.Charges = append(sub.Charges, Charge{
+		Amount:      amount,
+		Description: fmt.Sprintf("Upgrade to annual, less %s unused monthly credit", credit.Format()),
+		At:          now,
+	})
+	d.Subscriptions.Upsert(sub.UserEmail, sub)
+	d.setTier(email, TierPremium)
+	return sub, nil
+}
+
+// Cancel stops renewal. The member keeps Premium until the period ends.
+func (d *Database) Cancel(email string) (Subscription, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sub, err := d.liveSubscription(email)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if sub.Status == SubscriptionCanceled {
+		return Subscription{}, ErrAlreadyCanceled
+	}
+	// Nothing was paid for the current period of a past-due membership
+	to := SubscriptionCanceled
+	if sub.Status == SubscriptionPastDue {
+		to = SubscriptionExpired
+	}
+	if err := sub.setStatus(to, d.clock.Now()); err != nil {
+		return Subscription{}, err
+	}
+	if to == SubscriptionExpired {
+		d.setTier(email, TierFree)
+	}
+	sub.NextBillingDate = nil
+	d.Subscriptions.Upsert(sub.UserEmail, sub)
+	return sub, nil
+}
+
+// UpdatePaymentMethod replaces the card on file. A past-due membership is
+// charged right away.
+func (d *Database) UpdatePaymentMethod(email string, card CardInput) (Subscription, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sub, err := d.liveSubscription(email)
+	if err != nil {
+		return Subscription{}, err
+	}
+	now := d.clock.Now()
+	method, err := validateCard(card, now)
+	if err != nil {
+		return Subscription{}, err
+	}
+	sub.PaymentMethod = method
+	if sub.Status == SubscriptionPastDue {
+		if err := sub.renew(now); err != nil {
+			return Subscription{}, err
+		}
+	}
+	d.Subscriptions.Upsert(sub.UserEmail, sub)
+	return sub, nil
+}
+
+// renew charges the next period, which starts where the last one ended.
+func (sub *Subscription) renew(now time.Time) error {
+	if err := sub.setStatus(SubscriptionActive, now); err != nil {
+		return err
+	}
+	sub.CurrentPeriodStart = sub.CurrentPeriodEnd
+	sub.CurrentPeriodEnd = sub.Plan.periodEnd(sub.CurrentPeriodStart)
+	next := sub.CurrentPeriodEnd
+	sub.NextBillingDate = &next
+	sub.Charges = append(sub.Charges, Charge{
+		Amount:      planPrices[sub.Plan],
+		Description: fmt.Sprintf("Premium %s renewal", sub.Plan),
+		At:          now,
+	})
+	return nil
+}
+
+// ProcessRenewals renews memberships whose period has ended, expires
+// canceled ones, and downgrades members whose renewal failed and whose
+// grace period is over.
+func (d *Database) ProcessRenewals(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	changed := 0
+	for _, email := range d.Subscriptions.Keys() {
+		sub, _ := d.Subscriptions.Get(email)
+		if now.Before(sub.CurrentPeriodEnd) {
+			continue
+		}
+		var err error
+		switch sub.Status {
+		case SubscriptionActive:
+			if sub.PaymentMethod.expired(sub.CurrentPeriodEnd) {
+				err = sub.setStatus(SubscriptionPastDue, now)
+			} else {
+				err = sub.renew(now)
+			}
+		case SubscriptionPastDue:
+			if now.Sub(sub.CurrentPeriodEnd) < renewalGracePeriod {
+				continue
+			}
+			err = sub.setStatus(SubscriptionExpired, now)
+			sub.NextBillingDate = nil
+		case SubscriptionCanceled:
+			err = sub.setStatus(SubscriptionExpired, now)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("Renewing %s's membership: %v", email, err)
+			continue
+		}
+		if sub.Status == SubscriptionExpired {
+			d.setTier(email, TierFree)
+		}
+		d.Subscriptions.Upsert(sub.UserEmail, sub)
+		changed++
+	}
+	return changed
+}
+
+func (h *handlers) runRenewals(interval time.Duration) {
+	h.clock.Every(interval, func(now time.Time) {
+		db := h.db.Get()
+		if n := db.ProcessRenewals(now); n > 0 {
+			log.Printf("Processed %d membership renewal(s)", n)
+		}
+	})
+}
+
+// instructorCourses returns an instructor's classes, sorted by title.
+// Callers must hold d.mu.
+func (d *Database) instructorCourses(id string) (Instructor, []Course, error) {
+	var instructor Instructor
+	courses := []Course{}
+	for _, course := range d.Courses.List() {
+		if course.Instructor.ID == id {
+			instructor = course.Instructor
+			courses = append(courses, course)
+		}
+	}
+	if len(courses) == 0 {
+		return Instructor{}, nil, ErrInstructorNotFound
+	}
+	sort.Slice(courses, func(i, j int) bool { return courses[i].Title < courses[j].Title })
+	return instructor, courses, nil
+}
+
+func (d *Database) Follow(email, instructorID string) (Follow, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return Follow{}, ErrUserNotFound
+	}
+	instructor, _, err := d.instructorCourses(instructorID)
+	if err != nil {
+		return Follow{}, err
+	}
+	if _, following := d.activeFollow(user.Email, instructor.ID); following {
+		return Follow{}, ErrAlreadyFollowing
+	}
+	follow := Follow{
+		ID:           server.NewID("FLW"),
+		UserEmail:    user.Email,
+		InstructorID: instructor.ID,
+		FollowedAt:   d.clock.Now(),
+	}
+	d.Follows.Upsert(follow.ID, follow)
+	return follow, nil
+}
+
+// activeFollow finds a user's current follow of an instructor. Callers
+// must hold d.mu.
+func (d *Database) activeFollow(email, instructorID string) (Follow, bool) {
+	for _, follow := range d.Follows.List() {
+		if follow.UserEmail == email && follow.InstructorID == instructorID && follow.UnfollowedAt == nil {
+			return follow, true
+		}
+	}
+	return Follow{}, false
+}
+
+func (d *Database) Unfollow(email, instructorID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	follow, following := d.activeFollow(email, instructorID)
+	if !following {
+		return ErrNotFollowing
+	}
+	now := d.clock.Now()
+	follow.UnfollowedAt = &now
+	d.Follows.Upsert(follow.ID, follow)
 	return nil
 }
 
+// AnalyticsRange is the window and bucket size for time-series analytics.
+// Buckets are UTC days, ISO weeks starting Monday, or calendar months.
+type AnalyticsRange struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"` // Exclusive
+	Interval string    `json:"interval"`
+}
+
+// bucketStart is the start of the bucket containing t.
+func (r AnalyticsRange) bucketStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch r.Interval {
+	case "week":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+func (r AnalyticsRange) next(start time.Time) time.Time {
+	switch r.Interval {
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// buckets lists the start of every bucket overlapping the range.
+func (r AnalyticsRange) buckets() []time.Time {
+	starts := []time.Time{}
+	for start := r.bucketStart(r.From); start.Before(r.To); start = r.next(start) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// index is the bucket t falls in, or -1 when it's outside the range.
+func (r AnalyticsRange) index(starts []time.Time, t time.Time) int {
+	if t.Before(r.From) || !t.Before(r.To) {
+		return -1
+	}
+	return sort.Search(len(starts), func(i int) bool { return starts[i].After(t) }) - 1
+}
+
+type SeriesPoint struct {
+	Start time.Time `json:"start"`
+	Value float64   `json:"value"`
+}
+
+func newSeries(starts []time.Time) []SeriesPoint {
+	series := make([]SeriesPoint, len(starts))
+	for i, start := range starts {
+		series[i].Start = start
+	}
+	return series
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+type ClassMinutes struct {
+	CourseID string        `json:"course_id"`
+	Title    string        `json:"title"`
+	Minutes  float64       `json:"minutes"`
+	Series   []SeriesPoint `json:"series"`
+}
+
+type MinutesReport struct {
+	Range   AnalyticsRange `json:"range"`
+	Minutes float64        `json:"minutes"`
+	Series  []SeriesPoint  `json:"series"`
+	Classes []ClassMinutes `json:"classes"`
+}
+
+// MinutesWatched totals minutes watched per class and bucket.
+func (d *Database) MinutesWatched(instructorID string, r AnalyticsRange) (MinutesReport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, courses, err := d.instructorCourses(instructorID)
+	if err != nil {
+		return MinutesReport{}, err
+	}
+	starts := r.buckets()
+	report := MinutesReport{Range: r, Series: newSeries(starts), Classes: []ClassMinutes{}}
+	byCourse := map[string]int{}
+	for _, course := range courses {
+		byCourse[course.ID] = len(report.Classes)
+		report.Classes = append(report.Classes, ClassMinutes{CourseID: course.ID, Title: course.Title, Series: newSeries(starts)})
+	}
+	for _, event := range d.WatchEvents {
+		ci, ok := byCourse[event.CourseID]
+		i := r.index(starts, event.At)
+		if !ok || i < 0 {
+			continue
+		}
+		class := &report.Classes[ci]
+		class.Series[i].Value += event.Minutes
+		class.Minutes += event.Minutes
+		report.Series[i].Value += event.Minutes
+		report.Minutes += event.Minutes
+	}
+	for ci := range report.Classes {
+		class := &report.Classes[ci]
+		class.Minutes = round2(class.Minutes)
+		for i := range class.Series {
+			class.Series[i].Value = round2(class.Series[i].Value)
+		}
+	}
+	for i := range report.Series {
+		report.Series[i].Value = round2(report.Series[i].Value)
+	}
+	report.Minutes = round2(report.Minutes)
+	return report, nil
+}
+
+type ClassEnrollment struct {
+	CourseID       string        `json:"course_id"`
+	Title          string        `json:"title"`
+	EnrolledCount  int           `json:"enrolled_count"`  // All-time, as shown on the class
+	Enrollments    int           `json:"enrollments"`     // New in the range
+	Completions    int           `json:"completions"`     // Of enrollments made in the range
+	CompletionRate float64       `json:"completion_rate"` // Percent
+	AvgProgress    float64       `json:"average_progress"`
+	Series         []SeriesPoint `json:"series"` // New enrollments
+}
+
+type EnrollmentReport struct {
+	Range          AnalyticsRange    `json:"range"`
+	Enrollments    int               `json:"enrollments"`
+	Completions    int               `json:"completions"`
+	CompletionRate float64           `json:"completion_rate"`
+	Classes        []ClassEnrollment `json:"classes"`
+}
+
+// EnrollmentStats reports new enrollments per bucket and how many of them
+// have been completed.
+func (d *Database) EnrollmentStats(instructorID string, r AnalyticsRange) (EnrollmentReport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, courses, err := d.instructorCourses(instructorID)
+	if err != nil {
+		return EnrollmentReport{}, err
+	}
+	starts := r.buckets()
+	report := EnrollmentReport{Range: r, Classes: []ClassEnrollment{}}
+	byCourse := map[string]int{}
+	for _, course := range courses {
+		byCourse[course.ID] = len(report.Classes)
+		report.Classes = append(report.Classes, ClassEnrollment{
+			CourseID:      course.ID,
+			Title:         course.Title,
+			EnrolledCount: course.EnrolledCount,
+			Series:        newSeries(starts),
+		})
+	}
+	progress := map[string]int{}
+	for _, enrollment := range d.Enrollments.List() {
+		ci, ok := byCourse[enrollment.CourseID]
+		i := r.index(starts, enrollment.EnrolledAt)
+		if !ok || i < 0 {
+			continue
+		}
+		class := &report.Classes[ci]
+		class.Series[i].Value++
+		class.Enrollments++
+		progress[class.CourseID] += enrollment.Progress
+		if enrollment.Completed {
+			class.Completions++
+		}
+	}
+	for i := range report.Classes {
+		class := &report.Classes[i]
+		if class.Enrollments > 0 {
+			class.CompletionRate = round2(float64(class.Completions) / float64(class.Enrollments) * 100)
+			class.AvgProgress = round2(float64(progress[class.CourseID]) / float64(class.Enrollments))
+		}
+		report.Enrollments += class.Enrollments
+		report.Completions += class.Completions
+	}
+	if report.Enrollments > 0 {
+		report.CompletionRate = round2(float64(report.Completions) / float64(report.Enrollments) * 100)
+	}
+	return report, nil
+}
+
+type FollowerPoint struct {
+	Start  time.Time `json:"start"`
+	Gained int       `json:"gained"`
+	Lost   int       `json:"lost"`
+	Total  int       `json:"total"` // At the end of the bucket
+}
+
+type FollowerReport struct {
+	Range     AnalyticsRange  `json:"range"`
+	Followers int             `json:"followers"` // Now
+	Series    []FollowerPoint `json:"series"`
+}
+
+func (d *Database) FollowerGrowth(instructorID string, r AnalyticsRange) (FollowerReport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, _, err := d.instructorCourses(instructorID); err != nil {
+		return FollowerReport{}, err
+	}
+	starts := r.buckets()
+	report := FollowerReport{Range: r, Series: make([]FollowerPoint, len(starts))}
+	before := 0 // Followers at the start of the range
+	for _, follow := range d.Follows.List() {
+		if follow.InstructorID != instructorID {
+			continue
+		}
+		if follow.UnfollowedAt == nil {
+			report.Followers++
+		}
+		if follow.FollowedAt.Before(r.From) && (follow.UnfollowedAt == nil || !follow.UnfollowedAt.Before(r.From)) {
+			before++
+		}
+		if i := r.index(starts, follow.FollowedAt); i >= 0 {
+			report.Series[i].Gained++
+		}
+		if follow.UnfollowedAt != nil {
+			if i := r.index(starts, *follow.UnfollowedAt); i >= 0 {
+				report.Series[i].Lost++
+			}
+		}
+	}
+	total := before
+	for i, start := range starts {
+		report.Series[i].Start = start
+		total += report.Series[i].Gained - report.Series[i].Lost
+		report.Series[i].Total = total
+	}
+	return report, nil
+}
+
+type ClassRoyalties struct {
+	CourseID       string      `json:"course_id"`
+	Title          string      `json:"title"`
+	PremiumMinutes float64     `json:"premium_minutes"`
+	Estimated      money.Money `json:"estimated"`
+}
+
+type RoyaltyReport struct {
+	Range          AnalyticsRange   `json:"range"`
+	RatePerMinute  float64          `json:"rate_per_minute"`
+	PremiumMinutes float64          `json:"premium_minutes"`
+	Estimated      money.Money      `json:"estimated"`
+	Series         []SeriesPoint    `json:"series"` // Estimated royalties
+	Classes        []ClassRoyalties `json:"classes"`
+}
+
+// Royalties estimates earnings from minutes watched by Premium members.
+func (d *Database) Royalties(instructorID string, r AnalyticsRange) (RoyaltyReport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, courses, err := d.instructorCourses(instructorID)
+	if err != nil {
+		return RoyaltyReport{}, err
+	}
+	starts := r.buckets()
+	report := RoyaltyReport{Range: r, RatePerMinute: royaltyPerMinute, Series: newSeries(starts), Classes: []ClassRoyalties{}}
+	byCourse := map[string]int{}
+	for _, course := range courses {
+		byCourse[course.ID] = len(report.Classes)
+		report.Classes = append(report.Classes, ClassRoyalties{CourseID: course.ID, Title: course.Title})
+	}
+	for _, event := range d.WatchEvents {
+		ci, ok := byCourse[event.CourseID]
+		i := r.index(starts, event.At)
+		if !ok || i < 0 || !event.Premium {
+			continue
+		}
+		report.Classes[ci].PremiumMinutes += event.Minutes
+		report.Series[i].Value += event.Minutes * royaltyPerMinute
+		report.PremiumMinutes += event.Minutes
+	}
+	for i := range report.Classes {
+		report.Classes[i].Estimated = money.Dollars(report.Classes[i].PremiumMinutes * royaltyPerMinute)
+	}
+	for i := range report.Series {
+		report.Series[i].Value = round2(report.Series[i].Value)
+	}
+	report.Estimated = money.Dollars(report.PremiumMinutes * royaltyPerMinute)
+	return report, nil
+}
+
 // HTTP Handlers
-func getCourses(c *fiber.Ctx) error {
+func (h *handlers) getCourses(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	search := c.Query("search")
 
 	var courses []Course
 	db.mu.RLock()
-	for _, course := range db.Courses {
+	for _, course := range db.Courses.List() {
 		if category != "" && course.Category != category {
 			continue
 		}
@@ -158,152 +1214,137 @@ func getCourses(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(courses)
+	return server.List(c, courses, "category")
 }
 
-func getCourseDetails(c *fiber.Ctx) error {
+func (h *handlers) getCourseDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	courseId := c.Params("courseId")
 
 	course, err := db.GetCourse(courseId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(course)
 }
 
-func getEnrollments(c *fiber.Ctx) error {
+func (h *handlers) getEnrollments(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var enrollments []Enrollment
 	db.mu.RLock()
-	for _, enrollment := range db.Enrollments {
+	for _, enrollment := range db.Enrollments.List() {
 		if enrollment.UserEmail == email {
 			enrollments = append(enrollments, enrollment)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(enrollments)
+	return server.List(c, enrollments)
 }
 
-func createEnrollment(c *fiber.Ctx) error {
+func (h *handlers) createEnrollment(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		CourseID  string `json:"course_id"`
-		UserEmail string `json:"user_email"`
+		UserEmail string `json:"user_email" validate:"email"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Verify user exists
-	_, err := db.GetUser(req.UserEmail)
+	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Verify course exists
 	course, err := db.GetCourse(req.CourseID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	if course.PremiumOnly && user.SubscriptionTier != TierPremium {
+		return server.FailWith(c, fiber.StatusForbidden, ErrPremiumRequired)
 	}
 
 	// Check if already enrolled
 	db.mu.RLock()
-	for _, enrollment := range db.Enrollments {
+	for _, enrollment := range db.Enrollments.List() {
 		if enrollment.UserEmail == req.UserEmail && enrollment.CourseID == req.CourseID {
 			db.mu.RUnlock()
-			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-				"error": "Already enrolled in this course",
-			})
+			return server.Fail(c, fiber.StatusConflict, server.CodeConflict, "Already enrolled in this course")
 		}
 	}
 	db.mu.RUnlock()
 
 	enrollment := Enrollment{
-		ID:         uuid.New().String(),
+		ID:         server.NewID("ENR"),
 		UserEmail:  req.UserEmail,
 		CourseID:   req.CourseID,
 		Progress:   0,
 		Completed:  false,
-		EnrolledAt: time.Now(),
-		UpdatedAt:  time.Now(),
+		EnrolledAt: h.clock.Now(),
+		UpdatedAt:  h.clock.Now(),
 	}
 
 	if err := db.CreateEnrollment(enrollment); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create enrollment",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create enrollment")
 	}
 
 	// Update course enrollment count
 	course.EnrolledCount++
 	db.mu.Lock()
-	db.Courses[course.ID] = course
+	db.Courses.Upsert(course.ID, course)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(enrollment)
 }
 
-func updateProgress(c *fiber.Ctx) error {
+func (h *handlers) updateProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		EnrollmentID string `json:"enrollment_id"`
 		LessonID     string `json:"lesson_id"`
-		Progress     int    `json:"progress"`
+		Progress     int    `json:"progress" validate:"gte=0,max=100"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate progress value
-	if req.Progress < 0 || req.Progress > 100 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Progress must be between 0 and 100",
-		})
-	}
 
 	progress := LessonProgress{
 		EnrollmentID: req.EnrollmentID,
 		LessonID:     req.LessonID,
 		Progress:     req.Progress,
 		Completed:    req.Progress == 100,
-		LastWatched:  time.Now(),
+		LastWatched:  h.clock.Now(),
 	}
 
 	if err := db.UpdateProgress(progress); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update progress",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update progress")
 	}
 
 	// Update overall course progress
 	db.mu.Lock()
-	enrollment, exists := db.Enrollments[req.EnrollmentID]
+	enrollment, exists := db.Enrollments.Get(req.EnrollmentID)
 	if exists {
 		var totalProgress int
 		var completedLessons int
-		course, _ := db.GetCourse(enrollment.CourseID)
+		course, _ := db.Courses.Get(enrollment.CourseID)
 
 		for _, lesson := range course.Lessons {
 			key := req.EnrollmentID + ":" + lesson.ID
-			if progress, exists := db.LessonProgress[key]; exists {
+			if progress, exists := db.LessonProgress.Get(key); exists {
 				totalProgress += progress.Progress
 				if progress.Completed {
 					completedLessons++
@@ -312,95 +1353,414 @@ func updateProgress(c *fiber.Ctx) error {
 		}
 
 		enrollment.Progress = totalProgress / len(course.Lessons)
-		enrollment.Completed = completedLessons == len(course.Lessons)
-		enrollment.UpdatedAt = time.Now()
-		db.Enrollments[req.EnrollmentID] = enrollment
+		completed := completedLessons == len(course.Lessons)
+		if completed && !enrollment.Completed {
+			enrollment.CompletedAt = &progress.LastWatched
+		} else if !completed {
+			enrollment.CompletedAt = nil
+		}
+		enrollment.Completed = completed
+		enrollment.UpdatedAt = h.clock.Now()
+		db.Enrollments.Upsert(req.EnrollmentID, enrollment)
 	}
 	db.mu.Unlock()
 
 	return c.JSON(progress)
 }
 
-// Utility functions
-func contains(s, substr string) bool {
-	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+func (h *handlers) createProject(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail   string   `json:"user_email" validate:"email"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		ImageURLs   []string `json:"image_urls"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	project, err := db.CreateProject(Project{
+		CourseID:    c.Params("courseId"),
+		UserEmail:   req.UserEmail,
+		Title:       req.Title,
+		Description: req.Description,
+		ImageURLs:   req.ImageURLs,
+	})
+	if err != nil {
+		return projectError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(project)
+}
+
+func (h *handlers) getGallery(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	projects, err := db.GetGallery(c.Params("courseId"), c.Query("sort"))
+	if err != nil {
+		return projectError(c, err)
+	}
+	return server.List(c, projects, "sort")
+}
+
+func (h *handlers) getProject(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	project, comments, err := db.GetProject(c.Params("projectId"))
+	if err != nil {
+		return projectError(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"project":  project,
+		"comments": comments,
+	})
+}
+
+func (h *handlers) deleteProject(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	if err := db.DeleteProject(c.Params("projectId"), email); err != nil {
+		return projectError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *handlers) setLike(liked bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		var req struct {
+			UserEmail string `json:"user_email" validate:"email"`
+		}
+		if err := server.Bind(c, &req); err != nil {
+			return err
+		}
+
+		project, err := db.SetLike(c.Params("projectId"), req.UserEmail, liked)
+		if err != nil {
+			return projectError(c, err)
+		}
+		return c.JSON(project)
+	}
+}
+
+func (h *handlers) addComment(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail string `json:"user_email" validate:"email"`
+		Body      string `json:"body"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	comment, err := db.AddComment(ProjectComment{
+		ProjectID: c.Params("projectId"),
+		UserEmail: req.UserEmail,
+		Body:      req.Body,
+	})
+	if err != nil {
+		return projectError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(comment)
+}
+
+func projectError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrUserNotFound, ErrCourseNotFound, ErrProjectNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNotEnrolled, ErrNotProjectOwner:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrInvalidProject, ErrEmptyComment:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) getSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	sub, err := db.GetSubscription(c.Params("email"))
+	if err != nil {
+		return subscriptionError(c, err)
+	}
+	return c.JSON(sub)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
+func (h *handlers) subscribe(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Plan          BillingPlan `json:"plan"`
+		PaymentMethod CardInput   `json:"payment_method"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	sub, err := db.Subscribe(c.Params("email"), req.Plan, req.PaymentMethod)
+	if err != nil {
+		return subscriptionError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(sub)
+}
+
+func (h *handlers) upgradeSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	sub, err := db.Upgrade(c.Params("email"))
+	if err != nil {
+		return subscriptionError(c, err)
+	}
+	return c.JSON(sub)
+}
+
+func (h *handlers) cancelSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	sub, err := db.Cancel(c.Params("email"))
+	if err != nil {
+		return subscriptionError(c, err)
+	}
+	return c.JSON(sub)
+}
+
+func (h *handlers) updatePaymentMethod(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var card CardInput
+	if err := server.Bind(c, &card); err != nil {
+		return err
+	}
+
+	sub, err := db.UpdatePaymentMethod(c.Params("email"), card)
 	if err != nil {
+		return subscriptionError(c, err)
+	}
+	return c.JSON(sub)
+}
+
+func subscriptionError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrUserNotFound, ErrSubscriptionNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrAlreadySubscribed, ErrAlreadyCanceled, ErrNotAnUpgrade:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrInvalidPlan, ErrInvalidCard, ErrCardExpired, ErrInvalidCVC:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) followInstructor(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail string `json:"user_email" validate:"email"`
+	}
+	if err := server.Bind(c, &req); err != nil {
 		return err
 	}
 
-	db = &Database{
-		Users:          make(map[string]User),
-		Courses:        make(map[string]Course),
-		Enrollments:    make(map[string]Enrollment),
-		LessonProgress: make(map[string]LessonProgress),
+	follow, err := db.Follow(req.UserEmail, c.Params("instructorId"))
+	if err != nil {
+		return analyticsError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(follow)
+}
+
+func (h *handlers) unfollowInstructor(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	if err := db.Unfollow(email, c.Params("instructorId")); err != nil {
+		return analyticsError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// parseRange reads interval, from and to (YYYY-MM-DD, to inclusive). The
+// default window is the last 30 days, 12 weeks or 12 months.
+func parseRange(c *fiber.Ctx, now time.Time) (AnalyticsRange, error) {
+	r := AnalyticsRange{Interval: c.Query("interval", "day")}
+	var lookback time.Time
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch r.Interval {
+	case "day":
+		lookback = today.AddDate(0, 0, -29)
+	case "week":
+		lookback = today.AddDate(0, 0, -7*11)
+	case "month":
+		lookback = today.AddDate(0, -11, 0)
+	default:
+		return AnalyticsRange{}, ErrInvalidInterval
+	}
+
+	r.To = today.AddDate(0, 0, 1)
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return AnalyticsRange{}, ErrInvalidRange
+		}
+		r.To = t.AddDate(0, 0, 1)
+	}
+	r.From = r.bucketStart(lookback)
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return AnalyticsRange{}, ErrInvalidRange
+		}
+		r.From = t
+	}
+	if !r.From.Before(r.To) {
+		return AnalyticsRange{}, ErrInvalidRange
+	}
+	if len(r.buckets()) > maxAnalyticsBuckets {
+		return AnalyticsRange{}, ErrRangeTooLarge
+	}
+	return r, nil
+}
+
+// analyticsHandler serves one of the instructor reports over the
+// requested range.
+func analyticsHandler[T any](h *handlers, report func(d *Database, instructorID string, r AnalyticsRange) (T, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		r, err := parseRange(c, h.clock.Now())
+		if err != nil {
+			return analyticsError(c, err)
+		}
+		result, err := report(db, c.Params("instructorId"), r)
+		if err != nil {
+			return analyticsError(c, err)
+		}
+		return c.JSON(result)
+	}
+}
+
+func analyticsError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrUserNotFound, ErrInstructorNotFound, ErrNotFollowing:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrAlreadyFollowing:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrInvalidInterval, ErrInvalidRange, ErrRangeTooLarge:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
 	}
+}
 
-	return json.Unmarshal(data, db)
+// Utility functions
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
 }
 
-func setupRoutes(app *fiber.App) {
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
+	}
+
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	h.db.Set(db)
+	return nil
+}
+
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Course routes
-	api.Get("/courses", getCourses)
-	api.Get("/courses/:courseId", getCourseDetails)
+	api.Get("/courses", h.getCourses)
+	api.Get("/courses/:courseId", h.getCourseDetails)
 
 	// Enrollment routes
-	api.Get("/enrollments", getEnrollments)
-	api.Post("/enrollments", createEnrollment)
+	api.Get("/enrollments", h.getEnrollments)
+	api.Post("/enrollments", h.createEnrollment)
+
+	// Project routes
+	api.Get("/courses/:courseId/projects", h.getGallery)
+	api.Post("/courses/:courseId/projects", h.createProject)
+	api.Get("/projects/:projectId", h.getProject)
+	api.Delete("/projects/:projectId", h.deleteProject)
+	api.Post("/projects/:projectId/like", h.setLike(true))
+	api.Delete("/projects/:projectId/like", h.setLike(false))
+	api.Post("/projects/:projectId/comments", h.addComment)
 
 	// Progress routes
-	api.Post("/progress", updateProgress)
+	api.Post("/progress", h.updateProgress)
 
 	// User routes
 	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		email := c.Params("email")
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(user)
 	})
+
+	// Instructor routes
+	api.Post("/instructors/:instructorId/follow", h.followInstructor)
+	api.Delete("/instructors/:instructorId/follow", h.unfollowInstructor)
+	api.Get("/instructors/:instructorId/analytics/minutes", analyticsHandler(h, (*Database).MinutesWatched))
+	api.Get("/instructors/:instructorId/analytics/enrollments", analyticsHandler(h, (*Database).EnrollmentStats))
+	api.Get("/instructors/:instructorId/analytics/followers", analyticsHandler(h, (*Database).FollowerGrowth))
+	api.Get("/instructors/:instructorId/analytics/royalties", analyticsHandler(h, (*Database).Royalties))
+
+	// Membership routes
+	api.Get("/users/:email/subscription", h.getSubscription)
+	api.Post("/users/:email/subscription", h.subscribe)
+	api.Post("/users/:email/subscription/upgrade", h.upgradeSubscription)
+	api.Post("/users/:email/subscription/cancel", h.cancelSubscription)
+	api.Put("/users/:email/subscription/payment-method", h.updatePaymentMethod)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	renewalGracePeriod = cfg.RuleDuration("renewal_grace_period", renewalGracePeriod)
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Setup routes
-	setupRoutes(app)
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"enrollments", "subscriptions", "watch_events"},
+			Search:  []string{"courses", "projects"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+	go h.runRenewals(time.Minute)
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
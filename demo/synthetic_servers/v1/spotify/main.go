@@ -1,20 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -54,10 +49,14 @@ type PlayHistory struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users     map[string]User     `json:"users"`
-	Tracks    map[string]Track    `json:"tracks"`
-	Playlists map[string]Playlist `json:"playlists"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users     server.Repository[User]     `json:"users"`
+	Tracks    server.Repository[Track]    `json:"tracks"`
+	Playlists server.Repository[Playlist] `json:"playlists"`
 	mu        sync.RWMutex
+	clock     *server.Clock
 }
 
 // Custom errors
@@ -68,15 +67,25 @@ var (
 	ErrUnauthorized     = errors.New("unauthorized")
 )
 
-// Global database instance
-var db *Database
+// handlers serve Spotify's tracks and users' playlists, dating new playlists
+// by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users, tracks and playlists in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -87,7 +96,7 @@ func (d *Database) GetTrack(id string) (Track, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	track, exists := d.Tracks[id]
+	track, exists := d.Tracks.Get(id)
 	if !exists {
 		return Track{}, ErrTrackNotFound
 	}
@@ -98,7 +107,7 @@ func (d *Database) GetPlaylist(id string) (Playlist, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	playlist, exists := d.Playlists[id]
+	playlist, exists := d.Playlists.Get(id)
 	if !exists {
 		return Playlist{}, ErrPlaylistNotFound
 	}
@@ -109,7 +118,7 @@ func (d *Database) CreatePlaylist(playlist Playlist) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Playlists[playlist.ID] = playlist
+	d.Playlists.Upsert(playlist.ID, playlist)
 	return nil
 }
 
@@ -117,14 +126,14 @@ func (d *Database) AddTrackToPlaylist(playlistId string, track Track) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	playlist, exists := d.Playlists[playlistId]
+	playlist, exists := d.Playlists.Get(playlistId)
 	if !exists {
 		return ErrPlaylistNotFound
 	}
 
 	playlist.Tracks = append(playlist.Tracks, track)
-	playlist.UpdatedAt = time.Now()
-	d.Playlists[playlistId] = playlist
+	playlist.UpdatedAt = d.clock.Now()
+	d.Playlists.Upsert(playlistId, playlist)
 	return nil
 }
 
@@ -132,7 +141,7 @@ func (d *Database) RemoveTrackFromPlaylist(playlistId string, trackId string) er
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	playlist, exists := d.Playlists[playlistId]
+	playlist, exists := d.Playlists.Get(playlistId)
 	if !exists {
 		return ErrPlaylistNotFound
 	}
@@ -145,8 +154,8 @@ func (d *Database) RemoveTrackFromPlaylist(playlistId string, trackId string) er
 	}
 
 	playlist.Tracks = newTracks
-	playlist.UpdatedAt = time.Now()
-	d.Playlists[playlistId] = playlist
+	playlist.UpdatedAt = d.clock.Now()
+	d.Playlists.Upsert(playlistId, playlist)
 	return nil
 }
 
@@ -154,14 +163,14 @@ func (d *Database) AddToRecentlyPlayed(email string, track Track) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
 
 	playHistory := PlayHistory{
 		Track:    track,
-		PlayedAt: time.Now(),
+		PlayedAt: d.clock.Now(),
 	}
 
 	// Keep only last 50 recently played tracks
@@ -170,130 +179,115 @@ func (d *Database) AddToRecentlyPlayed(email string, track Track) error {
 	}
 
 	user.RecentlyPlayed = append(user.RecentlyPlayed, playHistory)
-	d.Users[email] = user
+	d.Users.Upsert(email, user)
 	return nil
 }
 
 // HTTP Handlers
-func getUserPlaylists(c *fiber.Ctx) error {
+func (h *handlers) getUserPlaylists(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userPlaylists []Playlist
 	db.mu.RLock()
-	for _, playlist := range db.Playlists {
+	for _, playlist := range db.Playlists.List() {
 		if playlist.OwnerEmail == email {
 			userPlaylists = append(userPlaylists, playlist)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userPlaylists)
+	return server.List(c, userPlaylists)
 }
 
-func createPlaylist(c *fiber.Ctx) error {
+func (h *handlers) createPlaylist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		Name        string `json:"name"`
 		Description string `json:"description"`
-		OwnerEmail  string `json:"owner_email"`
+		OwnerEmail  string `json:"owner_email" validate:"email"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user exists
 	if _, err := db.GetUser(req.OwnerEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	playlist := Playlist{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("PLST"),
 		Name:        req.Name,
 		Description: req.Description,
 		OwnerEmail:  req.OwnerEmail,
 		Tracks:      []Track{},
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		CreatedAt:   h.clock.Now(),
+		UpdatedAt:   h.clock.Now(),
 	}
 
 	if err := db.CreatePlaylist(playlist); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create playlist",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create playlist")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(playlist)
 }
 
-func addTrackToPlaylist(c *fiber.Ctx) error {
+func (h *handlers) addTrackToPlaylist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	playlistId := c.Params("playlistId")
 	var req struct {
 		TrackID string `json:"track_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	track, err := db.GetTrack(req.TrackID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	if err := db.AddTrackToPlaylist(playlistId, track); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to add track to playlist",
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func removeTrackFromPlaylist(c *fiber.Ctx) error {
+func (h *handlers) removeTrackFromPlaylist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	playlistId := c.Params("playlistId")
 	var req struct {
 		TrackID string `json:"track_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	if err := db.RemoveTrackFromPlaylist(playlistId, req.TrackID); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to remove track from playlist",
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func searchTracks(c *fiber.Ctx) error {
+func (h *handlers) searchTracks(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	query := c.Query("query")
 	if query == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "query parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "query parameter is required")
 	}
 
 	var matchingTracks []Track
 	db.mu.RLock()
-	for _, track := range db.Tracks {
+	for _, track := range db.Tracks.List() {
 		// Simple case-insensitive search in title, artist, or album
 		if strings.Contains(strings.ToLower(track.Title), strings.ToLower(query)) ||
 			strings.Contains(strings.ToLower(track.Artist), strings.ToLower(query)) ||
@@ -303,94 +297,92 @@ func searchTracks(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(matchingTracks)
+	return server.List(c, matchingTracks)
 }
 
-func getRecentlyPlayed(c *fiber.Ctx) error {
+func (h *handlers) getRecentlyPlayed(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.RecentlyPlayed)
+	return server.List(c, user.RecentlyPlayed)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:     make(map[string]User),
-		Tracks:    make(map[string]Track),
-		Playlists: make(map[string]Playlist),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Playlist routes
-	api.Get("/playlists", getUserPlaylists)
-	api.Post("/playlists", createPlaylist)
-	api.Post("/playlists/:playlistId/tracks", addTrackToPlaylist)
-	api.Delete("/playlists/:playlistId/tracks", removeTrackFromPlaylist)
+	api.Get("/playlists", h.getUserPlaylists)
+	api.Post("/playlists", h.createPlaylist)
+	api.Post("/playlists/:playlistId/tracks", h.addTrackToPlaylist)
+	api.Delete("/playlists/:playlistId/tracks", h.removeTrackFromPlaylist)
 
 	// Track routes
-	api.Get("/tracks/search", searchTracks)
+	api.Get("/tracks/search", h.searchTracks)
 
 	// User routes
-	api.Get("/me/recently-played", getRecentlyPlayed)
+	api.Get("/me/recently-played", h.getRecentlyPlayed)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "playlists"},
+			Search:  []string{"tracks", "playlists"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,20 +1,18 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -40,7 +38,7 @@ type MenuItem struct {
 	Name                 string                `json:"name"`
 	Category             string                `json:"category"`
 	Description          string                `json:"description"`
-	Price                float64               `json:"price"`
+	Price                money.Money           `json:"price"`
 	Calories             int                   `json:"calories"`
 	CustomizationOptions []CustomizationOption `json:"customization_options"`
 }
@@ -60,41 +58,72 @@ type UserRewards struct {
 }
 
 type OrderItem struct {
-	MenuItemID     string                 `json:"menu_item_id"`
-	Quantity       int                    `json:"quantity"`
+	MenuItemID     string                 `json:"menu_item_id" validate:"required"`
+	Quantity       int                    `json:"quantity" validate:"gt=0"`
 	Customizations map[string]interface{} `json:"customizations"`
 }
 
 type Order struct {
-	ID          string      `json:"id"`
-	UserEmail   string      `json:"user_email"`
-	Store       Store       `json:"store"`
-	Items       []OrderItem `json:"items"`
-	Status      string      `json:"status"`
-	Total       float64     `json:"total"`
-	StarsEarned int         `json:"stars_earned"`
-	RewardUsed  *Reward     `json:"reward_used,omitempty"`
-	CreatedAt   time.Time   `json:"created_at"`
+	ID            string                    `json:"id"`
+	UserEmail     string                    `json:"user_email"`
+	Store         Store                     `json:"store"`
+	Items         []OrderItem               `json:"items"`
+	Status        string                    `json:"status"`
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+	Total         money.Money               `json:"total"`
+	StarsEarned   int                       `json:"stars_earned"`
+	RewardUsed    *Reward                   `json:"reward_used,omitempty"`
+	CreatedAt     time.Time                 `json:"created_at"`
 }
 
+// orderMachine is the statuses a mobile order moves through, from the
+// counter to pickup.
+var orderMachine = &statemachine.Machine{Name: "order", Moves: map[string][]string{
+	"pending":   {"preparing"},
+	"preparing": {"ready"},
+	"ready":     {"completed"},
+}}
+
+// orderLifecycle has the barista prepare each order and the customer
+// collect it.
+var orderLifecycle = server.Lifecycle{Collection: "orders", Steps: []server.Step{
+	{From: "pending", To: "preparing", After: 2 * time.Minute},
+	{From: "preparing", To: "ready", After: 5 * time.Minute,
+		Notify: server.Notice{Type: "order_ready", Message: "Your order {{id}} is ready for pickup."}},
+	{From: "ready", To: "completed", After: 30 * time.Minute},
+}, Machine: orderMachine}
+
 // Database represents our in-memory database
 type Database struct {
-	Stores      map[string]Store       `json:"stores"`
-	Menu        map[string]MenuItem    `json:"menu"`
-	UserRewards map[string]UserRewards `json:"user_rewards"`
-	Orders      map[string]Order       `json:"orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Stores      server.Repository[Store]       `json:"stores"`
+	Menu        server.Repository[MenuItem]    `json:"menu"`
+	UserRewards server.Repository[UserRewards] `json:"user_rewards"` // By email
+	Orders      server.Repository[Order]       `json:"orders"`
 	mu          sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers take Starbucks orders from stores' menus and credit rewards,
+// dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the stores, menu and rewards in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetStore(id string) (Store, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	store, exists := d.Stores[id]
+	store, exists := d.Stores.Get(id)
 	if !exists {
 		return Store{}, errors.New("store not found")
 	}
@@ -105,24 +134,17 @@ func (d *Database) GetNearbyStores(lat, lon float64) []Store {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var nearby []Store
 	maxDistance := 10.0 // km
-
-	for _, store := range d.Stores {
-		distance := calculateDistance(lat, lon, store.Latitude, store.Longitude)
-		if distance <= maxDistance {
-			nearby = append(nearby, store)
-		}
-	}
-
-	return nearby
+	return d.Stores.Query(func(store Store) bool {
+		return calculateDistance(lat, lon, store.Latitude, store.Longitude) <= maxDistance
+	})
 }
 
 func (d *Database) GetUserRewards(email string) (UserRewards, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	rewards, exists := d.UserRewards[email]
+	rewards, exists := d.UserRewards.Get(email)
 	if !exists {
 		return UserRewards{}, errors.New("user not found")
 	}
@@ -133,7 +155,7 @@ func (d *Database) UpdateUserRewards(email string, rewards UserRewards) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.UserRewards[email] = rewards
+	d.UserRewards.Upsert(email, rewards)
 	return nil
 }
 
@@ -141,7 +163,7 @@ func (d *Database) CreateOrder(order Order) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Orders[order.ID] = order
+	d.Orders.Upsert(order.ID, order)
 	return nil
 }
 
@@ -149,108 +171,95 @@ func (d *Database) GetUserOrders(email string) []Order {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var userOrders []Order
-	for _, order := range d.Orders {
-		if order.UserEmail == email {
-			userOrders = append(userOrders, order)
-		}
-	}
-	return userOrders
+	return d.Orders.By("user_email", email)
 }
 
-// Utility functions
+// calculateDistance returns the great-circle distance between two points
+// in km.
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+	return geo.DistanceKm(geo.Point{Lat: lat1, Lon: lon1}, geo.Point{Lat: lat2, Lon: lon2})
 }
 
-func calculateStarsEarned(total float64) int {
+func calculateStarsEarned(total money.Money) int {
 	// Basic calculation: 2 stars per dollar spent
-	return int(total * 2)
+	return int(total.Float() * 2)
 }
 
 // HTTP Handlers
-func getNearbyStores(c *fiber.Ctx) error {
+func (h *handlers) getNearbyStores(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	lat := c.QueryFloat("latitude", 0)
 	lon := c.QueryFloat("longitude", 0)
 
 	if lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "latitude and longitude are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "latitude and longitude are required")
 	}
 
 	stores := db.GetNearbyStores(lat, lon)
-	return c.JSON(stores)
+	return server.List(c, stores)
 }
 
-func getMenu(c *fiber.Ctx) error {
+func (h *handlers) getMenu(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 
-	var menuItems []MenuItem
 	db.mu.RLock()
-	for _, item := range db.Menu {
-		if category == "" || item.Category == category {
-			menuItems = append(menuItems, item)
-		}
-	}
+	menuItems := db.Menu.Query(func(item MenuItem) bool {
+		return category == "" || item.Category == category
+	})
 	db.mu.RUnlock()
 
-	return c.JSON(menuItems)
+	return server.List(c, menuItems, "category")
 }
 
-func getUserRewards(c *fiber.Ctx) error {
+func (h *handlers) getUserRewards(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	rewards, err := db.GetUserRewards(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(rewards)
 }
 
 type CreateOrderRequest struct {
-	StoreID        string      `json:"store_id"`
-	UserEmail      string      `json:"user_email"`
-	Items          []OrderItem `json:"items"`
+	StoreID        string      `json:"store_id" validate:"required"`
+	UserEmail      string      `json:"user_email" validate:"required,email"`
+	Items          []OrderItem `json:"items" validate:"min=1"`
 	PaymentMethod  string      `json:"payment_method"`
 	RedeemRewardID string      `json:"redeem_reward_id"`
 }
 
-func createOrder(c *fiber.Ctx) error {
+func (h *handlers) createOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateOrderRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate store
 	store, err := db.GetStore(req.StoreID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Store not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Store not found")
 	}
 
 	// Calculate total and validate items
-	var total float64
+	var total money.Money
 	for _, item := range req.Items {
-		menuItem, exists := db.Menu[item.MenuItemID]
+		db.mu.RLock()
+		menuItem, exists := db.Menu.Get(item.MenuItemID)
+		db.mu.RUnlock()
 		if !exists {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": fmt.Sprintf("Menu item %s not found", item.MenuItemID),
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, fmt.Sprintf("Menu item %s not found", item.MenuItemID))
+		}
+		if total, err = total.Add(menuItem.Price.Times(item.Quantity)); err != nil {
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
 		}
-		total += menuItem.Price * float64(item.Quantity)
 	}
 
 	// Handle reward redemption
@@ -258,18 +267,14 @@ func createOrder(c *fiber.Ctx) error {
 	if req.RedeemRewardID != "" {
 		rewards, err := db.GetUserRewards(req.UserEmail)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "User rewards not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User rewards not found")
 		}
 
 		// Find and validate reward
 		for _, reward := range rewards.RewardsAvailable {
 			if reward.ID == req.RedeemRewardID {
-				if reward.ExpiresAt.Before(time.Now()) {
-					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-						"error": "Reward has expired",
-					})
+				if reward.ExpiresAt.Before(h.clock.Now()) {
+					return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Reward has expired")
 				}
 				usedReward = &reward
 				break
@@ -277,15 +282,13 @@ func createOrder(c *fiber.Ctx) error {
 		}
 
 		if usedReward == nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Invalid reward ID",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid reward ID")
 		}
 	}
 
 	// Create order
 	order := Order{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("ORD"),
 		UserEmail:   req.UserEmail,
 		Store:       store,
 		Items:       req.Items,
@@ -293,14 +296,12 @@ func createOrder(c *fiber.Ctx) error {
 		Total:       total,
 		StarsEarned: calculateStarsEarned(total),
 		RewardUsed:  usedReward,
-		CreatedAt:   time.Now(),
+		CreatedAt:   h.clock.Now(),
 	}
 
 	// Save order
 	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create order")
 	}
 
 	// Update user rewards
@@ -322,76 +323,78 @@ func createOrder(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email is required")
 	}
 
 	orders := db.GetUserOrders(email)
-	return c.JSON(orders)
+	return server.List(c, orders)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Stores:      make(map[string]Store),
-		Menu:        make(map[string]MenuItem),
-		UserRewards: make(map[string]UserRewards),
-		Orders:      make(map[string]Order),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/stores", getNearbyStores)
-	api.Get("/menu", getMenu)
-	api.Get("/rewards", getUserRewards)
-	api.Post("/orders", createOrder)
-	api.Get("/orders", getUserOrders)
+	api.Get("/stores", h.getNearbyStores)
+	api.Get("/menu", h.getMenu)
+	api.Get("/rewards", h.getUserRewards)
+	api.Post("/orders", h.createOrder)
+	api.Get("/orders", h.getUserOrders)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders"},
+			Search:  []string{"menu", "stores", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, orderLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
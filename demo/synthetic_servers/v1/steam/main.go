@@ -1,20 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -27,7 +23,7 @@ type Game struct {
 	ID          string             `json:"id"`
 	Title       string             `json:"title"`
 	Description string             `json:"description"`
-	Price       float64            `json:"price"`
+	Price       money.Money        `json:"price"`
 	Publisher   string             `json:"publisher"`
 	Developer   string             `json:"developer"`
 	ReleaseDate time.Time          `json:"release_date"`
@@ -72,35 +68,50 @@ type PaymentMethod struct {
 }
 
 type Purchase struct {
-	ID              string    `json:"id"`
-	UserEmail       string    `json:"user_email"`
-	GameID          string    `json:"game_id"`
-	Price           float64   `json:"price"`
-	PaymentMethodID string    `json:"payment_method_id"`
-	PurchaseDate    time.Time `json:"purchase_date"`
+	ID              string      `json:"id"`
+	UserEmail       string      `json:"user_email"`
+	GameID          string      `json:"game_id"`
+	Price           money.Money `json:"price"`
+	PaymentMethodID string      `json:"payment_method_id"`
+	PurchaseDate    time.Time   `json:"purchase_date"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users     map[string]User     `json:"users"`
-	Games     map[string]Game     `json:"games"`
-	Purchases map[string]Purchase `json:"purchases"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users     server.Repository[User]     `json:"users"`
+	Games     server.Repository[Game]     `json:"games"`
+	Purchases server.Repository[Purchase] `json:"purchases"`
 	mu        sync.RWMutex
 }
 
 var (
-	db                *Database
 	ErrUserNotFound   = errors.New("user not found")
 	ErrGameNotFound   = errors.New("game not found")
 	ErrInvalidPayment = errors.New("invalid payment method")
 )
 
+// handlers sell Steam games into users' libraries, stamping purchases with
+// clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users, games and purchases in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -111,7 +122,7 @@ func (d *Database) GetGame(id string) (Game, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	game, exists := d.Games[id]
+	game, exists := d.Games.Get(id)
 	if !exists {
 		return Game{}, ErrGameNotFound
 	}
@@ -123,11 +134,11 @@ func (d *Database) AddPurchase(purchase Purchase) error {
 	defer d.mu.Unlock()
 
 	// Add purchase record
-	d.Purchases[purchase.ID] = purchase
+	d.Purchases.Upsert(purchase.ID, purchase)
 
 	// Update user's library
-	user := d.Users[purchase.UserEmail]
-	game := d.Games[purchase.GameID]
+	user, _ := d.Users.Get(purchase.UserEmail)
+	game, _ := d.Games.Get(purchase.GameID)
 
 	userGame := UserGame{
 		Game:         game,
@@ -137,37 +148,35 @@ func (d *Database) AddPurchase(purchase Purchase) error {
 	}
 
 	user.Library = append(user.Library, userGame)
-	d.Users[purchase.UserEmail] = user
+	d.Users.Upsert(purchase.UserEmail, user)
 
 	return nil
 }
 
 // HTTP Handlers
-func getUserLibrary(c *fiber.Ctx) error {
+func (h *handlers) getUserLibrary(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Library)
+	return server.List(c, user.Library)
 }
 
-func getStoreGames(c *fiber.Ctx) error {
+func (h *handlers) getStoreGames(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	search := c.Query("search")
 
 	var games []Game
 	db.mu.RLock()
-	for _, game := range db.Games {
+	for _, game := range db.Games.List() {
 		if category != "" {
 			categoryMatch := false
 			for _, cat := range game.Categories {
@@ -192,60 +201,53 @@ func getStoreGames(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(games)
+	return server.List(c, games)
 }
 
-func getGameDetails(c *fiber.Ctx) error {
+func (h *handlers) getGameDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	gameId := c.Params("gameId")
 
 	game, err := db.GetGame(gameId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(game)
 }
 
-func getFriends(c *fiber.Ctx) error {
+func (h *handlers) getFriends(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Friends)
+	return server.List(c, user.Friends)
 }
 
 type PurchaseRequest struct {
 	GameID          string `json:"game_id"`
-	UserEmail       string `json:"user_email"`
+	UserEmail       string `json:"user_email" validate:"email"`
 	PaymentMethodID string `json:"payment_method_id"`
 }
 
-func purchaseGame(c *fiber.Ctx) error {
+func (h *handlers) purchaseGame(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req PurchaseRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user and payment method
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	validPayment := false
@@ -256,115 +258,106 @@ func purchaseGame(c *fiber.Ctx) error {
 		}
 	}
 	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": ErrInvalidPayment.Error(),
-		})
+		return server.FailWith(c, fiber.StatusBadRequest, ErrInvalidPayment)
 	}
 
 	// Validate game
 	game, err := db.GetGame(req.GameID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Check if user already owns the game
 	for _, userGame := range user.Library {
 		if userGame.Game.ID == req.GameID {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "User already owns this game",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "User already owns this game")
 		}
 	}
 
 	// Create purchase record
 	purchase := Purchase{
-		ID:              uuid.New().String(),
+		ID:              server.NewID("PUR"),
 		UserEmail:       req.UserEmail,
 		GameID:          req.GameID,
 		Price:           game.Price,
 		PaymentMethodID: req.PaymentMethodID,
-		PurchaseDate:    time.Now(),
+		PurchaseDate:    h.clock.Now(),
 	}
 
 	if err := db.AddPurchase(purchase); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to process purchase",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to process purchase")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(purchase)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:     make(map[string]User),
-		Games:     make(map[string]Game),
-		Purchases: make(map[string]Purchase),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Library routes
-	api.Get("/library", getUserLibrary)
+	api.Get("/library", h.getUserLibrary)
 
 	// Store routes
-	api.Get("/store/games", getStoreGames)
-	api.Get("/store/games/:gameId", getGameDetails)
+	api.Get("/store/games", h.getStoreGames)
+	api.Get("/store/games/:gameId", h.getGameDetails)
 
 	// Friends routes
-	api.Get("/friends", getFriends)
+	api.Get("/friends", h.getFriends)
 
 	// Purchase routes
-	api.Post("/purchases", purchaseGame)
+	api.Post("/purchases", h.purchaseGame)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"purchases"},
+			Search:  []string{"games", "purchases"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
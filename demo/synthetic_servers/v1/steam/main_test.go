@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"pkg/server"
+	"pkg/servertest"
+)
+
+const fixture = `{
+  "users": {
+    "gabe@example.com": {
+      "email": "gabe@example.com",
+      "username": "gabe",
+      "library": [{"game": {"id": "g_portal", "title": "Portal", "price": 9.99}}],
+      "friends": [{"id": "f_1", "username": "chell", "status": "online"}],
+      "payment_methods": [{"id": "pm_1", "type": "visa", "last4": "1111"}]
+    }
+  },
+  "games": {
+    "g_portal": {"id": "g_portal", "title": "Portal", "price": 9.99, "categories": ["Puzzle"]},
+    "g_hl2": {"id": "g_hl2", "title": "Half-Life 2", "price": 9.99, "categories": ["Shooter"]},
+    "g_hades": {"id": "g_hades", "title": "Hades", "price": 24.99, "categories": ["Roguelike"]}
+  },
+  "purchases": {}
+}`
+
+var now = time.Date(2025, 6, 26, 17, 0, 0, 0, time.UTC)
+
+func newTestApp(t *testing.T) (*fiber.App, *handlers) {
+	t.Helper()
+	h, err := newHandlers(servertest.Store(fixture), servertest.Clock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := servertest.App()
+	setupRoutes(app, h)
+	return app, h
+}
+
+func TestGetStoreGames(t *testing.T) {
+	app, _ := newTestApp(t)
+	tests := []struct {
+		query string
+		total int
+	}{
+		{"", 3},
+		{"category=Puzzle", 1},
+		{"search=half", 1},
+		{"category=Puzzle&search=hades", 0},
+	}
+	for _, tt := range tests {
+		var page server.Page[Game]
+		if code := servertest.Do(t, app, "GET", "/api/v1/store/games?"+tt.query, "", &page); code != http.StatusOK {
+			t.Fatalf("%q: got %d", tt.query, code)
+		}
+		if page.Total != tt.total {
+			t.Errorf("%q: got %d games, want %d", tt.query, page.Total, tt.total)
+		}
+	}
+}
+
+func TestPurchaseGame(t *testing.T) {
+	app, h := newTestApp(t)
+	var purchase Purchase
+	code := servertest.Do(t, app, "POST", "/api/v1/purchases",
+		`{"game_id": "g_hades", "user_email": "gabe@example.com", "payment_method_id": "pm_1"}`, &purchase)
+	if code != http.StatusCreated {
+		t.Fatalf("got %d, want %d", code, http.StatusCreated)
+	}
+	if !purchase.PurchaseDate.Equal(now) {
+		t.Errorf("bought at %v, want the clock's %v", purchase.PurchaseDate, now)
+	}
+
+	user, _ := h.db.Get().GetUser("gabe@example.com")
+	if n := len(user.Library); n != 2 || user.Library[1].Game.ID != "g_hades" {
+		t.Errorf("library has %d games, want Portal and Hades", n)
+	}
+
+	// Buying it again is refused.
+	code = servertest.Do(t, app, "POST", "/api/v1/purchases",
+		`{"game_id": "g_hades", "user_email": "gabe@example.com", "payment_method_id": "pm_1"}`, nil)
+	if code != http.StatusBadRequest {
+		t.Errorf("buying it again: got %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestPurchaseGameFails(t *testing.T) {
+	app, h := newTestApp(t)
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"owned already", `{"game_id": "g_portal", "user_email": "gabe@example.com", "payment_method_id": "pm_1"}`, http.StatusBadRequest},
+		{"unknown card", `{"game_id": "g_hl2", "user_email": "gabe@example.com", "payment_method_id": "pm_2"}`, http.StatusBadRequest},
+		{"unknown game", `{"game_id": "g_hl3", "user_email": "gabe@example.com", "payment_method_id": "pm_1"}`, http.StatusNotFound},
+		{"unknown user", `{"game_id": "g_hl2", "user_email": "alyx@example.com", "payment_method_id": "pm_1"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code := servertest.Do(t, app, "POST", "/api/v1/purchases", tt.body, nil); code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.code)
+		}
+	}
+	if n := h.db.Get().Purchases.Len(); n != 0 {
+		t.Errorf("%d purchases saved, want none", n)
+	}
+}
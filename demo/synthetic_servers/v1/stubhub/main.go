@@ -1,20 +1,18 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/payments"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -28,28 +26,35 @@ type Venue struct {
 }
 
 type Event struct {
-	ID               string    `json:"id"`
-	Name             string    `json:"name"`
-	Category         string    `json:"category"`
-	Venue            Venue     `json:"venue"`
-	Date             time.Time `json:"date"`
-	MinPrice         float64   `json:"min_price"`
-	MaxPrice         float64   `json:"max_price"`
-	AvailableTickets int       `json:"available_tickets"`
+	ID               string      `json:"id"`
+	Name             string      `json:"name"`
+	Category         string      `json:"category"`
+	Venue            Venue       `json:"venue"`
+	Date             time.Time   `json:"date"`
+	MinPrice         money.Money `json:"min_price"`
+	MaxPrice         money.Money `json:"max_price"`
+	AvailableTickets int         `json:"available_tickets"`
 }
 
 type Ticket struct {
-	ID             string  `json:"id"`
-	EventID        string  `json:"event_id"`
-	Section        string  `json:"section"`
-	Row            string  `json:"row"`
-	Seat           string  `json:"seat"`
-	Price          float64 `json:"price"`
-	ServiceFee     float64 `json:"service_fee"`
-	DeliveryMethod string  `json:"delivery_method"`
-	Status         string  `json:"status"` // available, sold, reserved
+	ID             string      `json:"id"`
+	EventID        string      `json:"event_id"`
+	Section        string      `json:"section"`
+	Row            string      `json:"row"`
+	Seat           string      `json:"seat"`
+	Price          money.Money `json:"price"`
+	ServiceFee     money.Money `json:"service_fee"`
+	DeliveryMethod string      `json:"delivery_method"`
+	Status         string      `json:"status"` // available, sold, reserved
 }
 
+// ticketMachine is the statuses a listed ticket moves through: a reserved
+// one is held for a buyer until it sells or is released.
+var ticketMachine = &statemachine.Machine{Name: "ticket", Moves: map[string][]string{
+	"available": {"sold", "reserved"},
+	"reserved":  {"sold", "available"},
+}}
+
 type User struct {
 	Email          string          `json:"email"`
 	Name           string          `json:"name"`
@@ -65,22 +70,31 @@ type PaymentMethod struct {
 	ExpiryYY int    `json:"expiry_yy"`
 }
 
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
+}
+
 type Order struct {
-	ID        string    `json:"id"`
-	UserEmail string    `json:"user_email"`
-	Event     Event     `json:"event"`
-	Tickets   []Ticket  `json:"tickets"`
-	Total     float64   `json:"total"`
-	Status    string    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        string      `json:"id"`
+	UserEmail string      `json:"user_email"`
+	Event     Event       `json:"event"`
+	Tickets   []Ticket    `json:"tickets"`
+	Total     money.Money `json:"total"`
+	Status    string      `json:"status"`
+	ChargeID  string      `json:"charge_id,omitempty"` // The charge to the payment method
+	CreatedAt time.Time   `json:"created_at"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users   map[string]User   `json:"users"`
-	Events  map[string]Event  `json:"events"`
-	Tickets map[string]Ticket `json:"tickets"`
-	Orders  map[string]Order  `json:"orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+
+	Users   server.Repository[User]   `json:"users"`
+	Events  server.Repository[Event]  `json:"events"`
+	Tickets server.Repository[Ticket] `json:"tickets"`
+	Orders  server.Repository[Order]  `json:"orders"`
 	mu      sync.RWMutex
 }
 
@@ -92,14 +106,24 @@ var (
 	ErrInvalidPayment = errors.New("invalid payment method")
 )
 
-var db *Database
+// handlers list and sell StubHub tickets to events, dating orders by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the events, tickets and orders in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -110,7 +134,7 @@ func (d *Database) GetEvent(id string) (Event, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	event, exists := d.Events[id]
+	event, exists := d.Events.Get(id)
 	if !exists {
 		return Event{}, ErrEventNotFound
 	}
@@ -121,36 +145,30 @@ func (d *Database) GetTicket(id string) (Ticket, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	ticket, exists := d.Tickets[id]
+	ticket, exists := d.Tickets.Get(id)
 	if !exists {
 		return Ticket{}, ErrTicketNotFound
 	}
 	return ticket, nil
 }
 
-func (d *Database) CreateOrder(order Order) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	d.Orders[order.ID] = order
-
-	// Update ticket status
+// createOrder saves an order for tickets it has sold. Callers must hold
+// d.mu.
+func (d *Database) createOrder(order Order) {
+	d.Orders.Upsert(order.ID, order)
 	for _, ticket := range order.Tickets {
-		t := d.Tickets[ticket.ID]
-		t.Status = "sold"
-		d.Tickets[ticket.ID] = t
+		d.Tickets.Upsert(ticket.ID, ticket)
 	}
 
 	// Update event available tickets
-	event := d.Events[order.Event.ID]
+	event, _ := d.Events.Get(order.Event.ID)
 	event.AvailableTickets -= len(order.Tickets)
-	d.Events[order.Event.ID] = event
-
-	return nil
+	d.Events.Upsert(order.Event.ID, event)
 }
 
 // HTTP Handlers
-func searchEvents(c *fiber.Ctx) error {
+func (h *handlers) searchEvents(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	query := c.Query("query")
 	category := c.Query("category")
 	city := c.Query("city")
@@ -160,7 +178,7 @@ func searchEvents(c *fiber.Ctx) error {
 	var filteredEvents []Event
 
 	db.mu.RLock()
-	for _, event := range db.Events {
+	for _, event := range db.Events.List() {
 		// Apply filters
 		if query != "" && !contains(event.Name, query) {
 			continue
@@ -188,137 +206,143 @@ func searchEvents(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(filteredEvents)
+	return server.List(c, filteredEvents, "category")
 }
 
-func getEventDetails(c *fiber.Ctx) error {
+func (h *handlers) getEventDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	eventId := c.Params("eventId")
 
 	event, err := db.GetEvent(eventId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(event)
 }
 
-func getEventTickets(c *fiber.Ctx) error {
+func (h *handlers) getEventTickets(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	eventId := c.Params("eventId")
 
 	var availableTickets []Ticket
 
 	db.mu.RLock()
-	for _, ticket := range db.Tickets {
+	for _, ticket := range db.Tickets.List() {
 		if ticket.EventID == eventId && ticket.Status == "available" {
 			availableTickets = append(availableTickets, ticket)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(availableTickets)
+	return server.List(c, availableTickets)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userOrders []Order
 
 	db.mu.RLock()
-	for _, order := range db.Orders {
+	for _, order := range db.Orders.List() {
 		if order.UserEmail == email {
 			userOrders = append(userOrders, order)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return server.List(c, userOrders)
 }
 
 type PurchaseRequest struct {
 	EventID       string   `json:"event_id"`
-	UserEmail     string   `json:"user_email"`
+	UserEmail     string   `json:"user_email" validate:"email"`
 	TicketIDs     []string `json:"ticket_ids"`
 	PaymentMethod string   `json:"payment_method_id"`
 }
 
-func purchaseTickets(c *fiber.Ctx) error {
+func (h *handlers) purchaseTickets(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req PurchaseRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate payment method
-	validPayment := false
-	for _, pm := range user.PaymentMethods {
+	var method *PaymentMethod
+	for i, pm := range user.PaymentMethods {
 		if pm.ID == req.PaymentMethod {
-			validPayment = true
+			method = &user.PaymentMethods[i]
 			break
 		}
 	}
-	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+	if method == nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Validate event and tickets
 	event, err := db.GetEvent(req.EventID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var tickets []Ticket
-	var total float64
+	var total money.Money
 
-	db.mu.RLock()
+	// The tickets are sold, and paid for, under one lock, so no one else
+	// buys them in between
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := h.clock.Now()
 	for _, ticketID := range req.TicketIDs {
-		ticket, exists := db.Tickets[ticketID]
-		if !exists || ticket.Status != "available" {
-			db.mu.RUnlock()
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "One or more tickets are not available",
-			})
+		ticket, exists := db.Tickets.Get(ticketID)
+		if !exists || ticket.Status != "available" || statemachine.Move(ticketMachine, &ticket, &ticket.Status, nil, "sold", now) != nil {
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "One or more tickets are not available")
 		}
 		tickets = append(tickets, ticket)
-		total += ticket.Price + ticket.ServiceFee
+		if total, err = total.Add(ticket.Price); err == nil {
+			total, err = total.Add(ticket.ServiceFee)
+		}
+		if err != nil {
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+		}
+	}
+	id := server.NewID("ORD")
+
+	charge, err := db.Authorize(c, server.ChargeRequest{
+		UserEmail:       req.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          total,
+		Description:     "Order " + id,
+		Capture:         true,
+	})
+	if err != nil {
+		return err
 	}
-	db.mu.RUnlock()
 
 	// Create order
 	order := Order{
-		ID:        uuid.New().String(),
+		ID:        id,
 		UserEmail: req.UserEmail,
 		Event:     event,
 		Tickets:   tickets,
 		Total:     total,
 		Status:    "confirmed",
-		CreatedAt: time.Now(),
-	}
-
-	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+		ChargeID:  charge.ID,
+		CreatedAt: now,
 	}
+	db.createOrder(order)
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
@@ -327,71 +351,69 @@ func contains(s, substr string) bool {
 	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:   make(map[string]User),
-		Events:  make(map[string]Event),
-		Tickets: make(map[string]Ticket),
-		Orders:  make(map[string]Order),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Event routes
-	api.Get("/events", searchEvents)
-	api.Get("/events/:eventId", getEventDetails)
-	api.Get("/events/:eventId/tickets", getEventTickets)
+	api.Get("/events", h.searchEvents)
+	api.Get("/events/:eventId", h.getEventDetails)
+	api.Get("/events/:eventId/tickets", h.getEventTickets)
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", purchaseTickets)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.purchaseTickets)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders"},
+			Search:  []string{"events", "tickets", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
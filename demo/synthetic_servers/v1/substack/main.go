@@ -1,18 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -25,14 +22,14 @@ type User struct {
 }
 
 type Publication struct {
-	ID               string    `json:"id"`
-	Name             string    `json:"name"`
-	Description      string    `json:"description"`
-	Author           string    `json:"author"`
-	Subscribers      int       `json:"subscribers"`
-	SubscriptionTier string    `json:"subscription_tier"`
-	Price            float64   `json:"price"`
-	CreatedAt        time.Time `json:"created_at"`
+	ID               string      `json:"id"`
+	Name             string      `json:"name"`
+	Description      string      `json:"description"`
+	Author           string      `json:"author"`
+	Subscribers      int         `json:"subscribers"`
+	SubscriptionTier string      `json:"subscription_tier"`
+	Price            money.Money `json:"price"`
+	CreatedAt        time.Time   `json:"created_at"`
 }
 
 type Post struct {
@@ -68,11 +65,14 @@ type Subscription struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users         map[string]User         `json:"users"`
-	Publications  map[string]Publication  `json:"publications"`
-	Posts         map[string]Post         `json:"posts"`
-	Comments      map[string]Comment      `json:"comments"`
-	Subscriptions map[string]Subscription `json:"subscriptions"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users         server.Repository[User]         `json:"users"`
+	Publications  server.Repository[Publication]  `json:"publications"`
+	Posts         server.Repository[Post]         `json:"posts"`
+	Comments      server.Repository[Comment]      `json:"comments"`
+	Subscriptions server.Repository[Subscription] `json:"subscriptions"`
 	mu            sync.RWMutex
 }
 
@@ -83,14 +83,25 @@ var (
 	ErrUnauthorized        = errors.New("unauthorized")
 )
 
-var db *Database
+// handlers publish Substack posts to subscribers and keep the comments on
+// them, dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the publications, posts and subscriptions in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -101,7 +112,7 @@ func (d *Database) GetPublication(id string) (Publication, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	pub, exists := d.Publications[id]
+	pub, exists := d.Publications.Get(id)
 	if !exists {
 		return Publication{}, ErrPublicationNotFound
 	}
@@ -112,7 +123,7 @@ func (d *Database) GetPost(id string) (Post, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	post, exists := d.Posts[id]
+	post, exists := d.Posts.Get(id)
 	if !exists {
 		return Post{}, ErrPostNotFound
 	}
@@ -123,7 +134,7 @@ func (d *Database) CreateSubscription(sub Subscription) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Subscriptions[sub.ID] = sub
+	d.Subscriptions.Upsert(sub.ID, sub)
 	return nil
 }
 
@@ -131,154 +142,126 @@ func (d *Database) AddComment(comment Comment) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Comments[comment.ID] = comment
+	d.Comments.Upsert(comment.ID, comment)
 
 	// Add comment to post
-	post := d.Posts[comment.PostID]
+	post, _ := d.Posts.Get(comment.PostID)
 	post.Comments = append(post.Comments, comment)
-	d.Posts[comment.PostID] = post
+	d.Posts.Upsert(comment.PostID, post)
 
 	return nil
 }
 
 // HTTP Handlers
-func getUserPublications(c *fiber.Ctx) error {
+func (h *handlers) getUserPublications(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	// Verify user exists
 	_, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var subscribed []Publication
 	db.mu.RLock()
-	for _, sub := range db.Subscriptions {
+	for _, sub := range db.Subscriptions.List() {
 		if sub.UserEmail == email && sub.Active {
-			if pub, exists := db.Publications[sub.PublicationID]; exists {
+			if pub, exists := db.Publications.Get(sub.PublicationID); exists {
 				subscribed = append(subscribed, pub)
 			}
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(subscribed)
+	return server.List(c, subscribed)
 }
 
-func getPublicationPosts(c *fiber.Ctx) error {
+func (h *handlers) getPublicationPosts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	pubID := c.Params("publicationId")
-	page := c.QueryInt("page", 1)
-	limit := c.QueryInt("limit", 10)
-
 	// Verify publication exists
 	_, err := db.GetPublication(pubID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var posts []Post
 	db.mu.RLock()
-	for _, post := range db.Posts {
+	for _, post := range db.Posts.List() {
 		if post.PublicationID == pubID {
 			posts = append(posts, post)
 		}
 	}
 	db.mu.RUnlock()
 
-	// Simple pagination
-	start := (page - 1) * limit
-	end := start + limit
-	if start >= len(posts) {
-		posts = []Post{}
-	} else if end > len(posts) {
-		posts = posts[start:]
-	} else {
-		posts = posts[start:end]
-	}
-
-	return c.JSON(posts)
+	return server.List(c, posts)
 }
 
-func getPost(c *fiber.Ctx) error {
+func (h *handlers) getPost(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	postID := c.Params("postId")
 
 	post, err := db.GetPost(postID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(post)
 }
 
 type NewSubscriptionRequest struct {
-	PublicationID   string `json:"publication_id"`
-	UserEmail       string `json:"user_email"`
-	Plan            string `json:"plan"`
+	PublicationID   string `json:"publication_id" validate:"required"`
+	UserEmail       string `json:"user_email" validate:"required,email"`
+	Plan            string `json:"plan" validate:"required"`
 	PaymentMethodID string `json:"payment_method_id"`
 }
 
-func createSubscription(c *fiber.Ctx) error {
+func (h *handlers) createSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewSubscriptionRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Verify user exists
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Verify publication exists
 	pub, err := db.GetPublication(req.PublicationID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Check if already subscribed
 	db.mu.RLock()
-	for _, sub := range db.Subscriptions {
+	for _, sub := range db.Subscriptions.List() {
 		if sub.UserEmail == user.Email && sub.PublicationID == pub.ID && sub.Active {
 			db.mu.RUnlock()
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Already subscribed to this publication",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Already subscribed to this publication")
 		}
 	}
 	db.mu.RUnlock()
 
 	// Create new subscription
 	subscription := Subscription{
-		ID:            uuid.New().String(),
+		ID:            server.NewID("SUB"),
 		UserEmail:     user.Email,
 		PublicationID: pub.ID,
 		Plan:          req.Plan,
 		Active:        true,
-		CreatedAt:     time.Now(),
-		RenewedAt:     time.Now(),
+		CreatedAt:     h.clock.Now(),
+		RenewedAt:     h.clock.Now(),
 	}
 
 	if err := db.CreateSubscription(subscription); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create subscription",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create subscription")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(subscription)
@@ -286,113 +269,112 @@ func createSubscription(c *fiber.Ctx) error {
 
 type NewCommentRequest struct {
 	PostID    string `json:"post_id"`
-	UserEmail string `json:"user_email"`
+	UserEmail string `json:"user_email" validate:"email"`
 	Content   string `json:"content"`
 }
 
-func createComment(c *fiber.Ctx) error {
+func (h *handlers) createComment(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewCommentRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Verify user exists
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Verify post exists
 	post, err := db.GetPost(req.PostID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Create new comment
 	comment := Comment{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("CMT"),
 		PostID:    post.ID,
 		Content:   req.Content,
 		Author:    user.Name,
-		CreatedAt: time.Now(),
+		CreatedAt: h.clock.Now(),
 	}
 
 	if err := db.AddComment(comment); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create comment",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create comment")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(comment)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:         make(map[string]User),
-		Publications:  make(map[string]Publication),
-		Posts:         make(map[string]Post),
-		Comments:      make(map[string]Comment),
-		Subscriptions: make(map[string]Subscription),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Publication routes
-	api.Get("/publications", getUserPublications)
-	api.Get("/publications/:publicationId/posts", getPublicationPosts)
+	api.Get("/publications", h.getUserPublications)
+	api.Get("/publications/:publicationId/posts", h.getPublicationPosts)
 
 	// Post routes
-	api.Get("/posts/:postId", getPost)
+	api.Get("/posts/:postId", h.getPost)
 
 	// Subscription routes
-	api.Post("/subscriptions", createSubscription)
+	api.Post("/subscriptions", h.createSubscription)
 
 	// Comment routes
-	api.Post("/comments", createComment)
+	api.Post("/comments", h.createComment)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"subscriptions"},
+			Search:  []string{"publications", "posts"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
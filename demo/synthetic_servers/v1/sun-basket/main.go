@@ -1,19 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -33,7 +30,7 @@ type MealPlan struct {
 	Name               string              `json:"name"`
 	MealsPerWeek       int                 `json:"meals_per_week"`
 	ServingsPerMeal    int                 `json:"servings_per_meal"`
-	PricePerServing    float64             `json:"price_per_serving"`
+	PricePerServing    money.Money         `json:"price_per_serving"`
 	Description        string              `json:"description"`
 	DietaryPreferences []DietaryPreference `json:"dietary_preferences"`
 }
@@ -67,13 +64,30 @@ const (
 	Cancelled  DeliveryStatus = "cancelled"
 )
 
+// deliveryMachine is the statuses a delivery moves through. It can be
+// cancelled until its box is packed.
+var deliveryMachine = &statemachine.Machine{Name: "delivery", Moves: map[string][]string{
+	string(Scheduled):  {string(Processing), string(Cancelled)},
+	string(Processing): {string(Shipped)},
+	string(Shipped):    {string(Delivered)},
+}}
+
+// deliveryLifecycle packs each box two days before its delivery date,
+// ships it the day before and delivers it on the day.
+var deliveryLifecycle = server.Lifecycle{Collection: "deliveries", Steps: []server.Step{
+	{From: string(Scheduled), To: string(Processing), At: "delivery_date", After: -48 * time.Hour},
+	{From: string(Processing), To: string(Shipped), At: "delivery_date", After: -24 * time.Hour},
+	{From: string(Shipped), To: string(Delivered), At: "delivery_date"},
+}, Machine: deliveryMachine}
+
 type Delivery struct {
-	ID             string         `json:"id"`
-	SubscriptionID string         `json:"subscription_id"`
-	DeliveryDate   time.Time      `json:"delivery_date"`
-	Status         DeliveryStatus `json:"status"`
-	TrackingNumber string         `json:"tracking_number"`
-	Recipes        []Recipe       `json:"recipes"`
+	ID             string                    `json:"id"`
+	SubscriptionID string                    `json:"subscription_id"`
+	DeliveryDate   time.Time                 `json:"delivery_date"`
+	Status         DeliveryStatus            `json:"status"`
+	StatusHistory  []statemachine.Transition `json:"status_history,omitempty"`
+	TrackingNumber string                    `json:"tracking_number"`
+	Recipes        []Recipe                  `json:"recipes"`
 }
 
 type Subscription struct {
@@ -89,36 +103,47 @@ type Subscription struct {
 
 // Database represents our in-memory database
 type Database struct {
-	MealPlans     map[string]MealPlan     `json:"meal_plans"`
-	Recipes       map[string]Recipe       `json:"recipes"`
-	WeeklyMenus   map[string]WeeklyMenu   `json:"weekly_menus"`
-	Subscriptions map[string]Subscription `json:"subscriptions"`
-	Deliveries    map[string]Delivery     `json:"deliveries"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	MealPlans     server.Repository[MealPlan]     `json:"meal_plans"`
+	Recipes       server.Repository[Recipe]       `json:"recipes"`
+	WeeklyMenus   server.Repository[WeeklyMenu]   `json:"weekly_menus"`
+	Subscriptions server.Repository[Subscription] `json:"subscriptions"`
+	Deliveries    server.Repository[Delivery]     `json:"deliveries"`
 	mu            sync.RWMutex
 }
 
 var (
-	db          *Database
 	ErrNotFound = errors.New("not found")
 )
 
+// handlers plan Sun Basket weekly menus and deliveries for subscribers, by
+// clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the meal plans, menus and deliveries in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
 // Database operations
 func (d *Database) GetMealPlans() []MealPlan {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	plans := make([]MealPlan, 0, len(d.MealPlans))
-	for _, plan := range d.MealPlans {
-		plans = append(plans, plan)
-	}
-	return plans
+	return d.MealPlans.List()
 }
 
 func (d *Database) GetWeeklyMenu(weekOf time.Time) (WeeklyMenu, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	for _, menu := range d.WeeklyMenus {
+	for _, menu := range d.WeeklyMenus.List() {
 		if menu.WeekOf.Equal(weekOf) {
 			return menu, nil
 		}
@@ -130,7 +155,7 @@ func (d *Database) GetSubscription(email string) (Subscription, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	for _, sub := range d.Subscriptions {
+	for _, sub := range d.Subscriptions.List() {
 		if sub.UserEmail == email {
 			return sub, nil
 		}
@@ -142,7 +167,7 @@ func (d *Database) CreateSubscription(sub Subscription) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Subscriptions[sub.ID] = sub
+	d.Subscriptions.Upsert(sub.ID, sub)
 	return nil
 }
 
@@ -151,8 +176,8 @@ func (d *Database) GetDeliveries(email string) []Delivery {
 	defer d.mu.RUnlock()
 
 	var userDeliveries []Delivery
-	for _, delivery := range d.Deliveries {
-		sub := d.Subscriptions[delivery.SubscriptionID]
+	for _, delivery := range d.Deliveries.List() {
+		sub, _ := d.Subscriptions.Get(delivery.SubscriptionID)
 		if sub.UserEmail == email {
 			userDeliveries = append(userDeliveries, delivery)
 		}
@@ -161,81 +186,73 @@ func (d *Database) GetDeliveries(email string) []Delivery {
 }
 
 // HTTP Handlers
-func getMealPlans(c *fiber.Ctx) error {
+func (h *handlers) getMealPlans(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	plans := db.GetMealPlans()
-	return c.JSON(plans)
+	return server.List(c, plans)
 }
 
-func getWeeklyMenu(c *fiber.Ctx) error {
+func (h *handlers) getWeeklyMenu(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	weekStr := c.Query("week")
 	var weekOf time.Time
 	var err error
 
 	if weekStr == "" {
 		// Default to next Monday
-		weekOf = time.Now()
+		weekOf = h.clock.Now()
 		for weekOf.Weekday() != time.Monday {
 			weekOf = weekOf.AddDate(0, 0, 1)
 		}
 	} else {
 		weekOf, err = time.Parse("2006-01-02", weekStr)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Invalid date format. Use YYYY-MM-DD",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid date format. Use YYYY-MM-DD")
 		}
 	}
 
 	menu, err := db.GetWeeklyMenu(weekOf)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Menu not found for specified week",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Menu not found for specified week")
 	}
 
 	return c.JSON(menu)
 }
 
-func getSubscription(c *fiber.Ctx) error {
+func (h *handlers) getSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	sub, err := db.GetSubscription(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Subscription not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Subscription not found")
 	}
 
 	return c.JSON(sub)
 }
 
 type SubscriptionRequest struct {
-	UserEmail          string              `json:"user_email"`
+	UserEmail          string              `json:"user_email" validate:"email"`
 	MealPlanID         string              `json:"meal_plan_id"`
 	DietaryPreferences []DietaryPreference `json:"dietary_preferences"`
 	DeliveryDay        string              `json:"delivery_day"`
 	PaymentMethod      string              `json:"payment_method"`
 }
 
-func createSubscription(c *fiber.Ctx) error {
+func (h *handlers) createSubscription(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req SubscriptionRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate meal plan
-	mealPlan, exists := db.MealPlans[req.MealPlanID]
+	mealPlan, exists := db.MealPlans.Get(req.MealPlanID)
 	if !exists {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid meal plan ID",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid meal plan ID")
 	}
 
 	// Validate delivery day
@@ -244,20 +261,18 @@ func createSubscription(c *fiber.Ctx) error {
 		"Thursday": true, "Friday": true,
 	}
 	if !validDays[req.DeliveryDay] {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid delivery day",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid delivery day")
 	}
 
 	// Calculate next delivery
-	nextDelivery := time.Now()
+	nextDelivery := h.clock.Now()
 	for nextDelivery.Weekday().String() != req.DeliveryDay {
 		nextDelivery = nextDelivery.AddDate(0, 0, 1)
 	}
 
 	// Create new subscription
 	subscription := Subscription{
-		ID:                 uuid.New().String(),
+		ID:                 server.NewID("SUB"),
 		UserEmail:          req.UserEmail,
 		MealPlan:           mealPlan,
 		DietaryPreferences: req.DietaryPreferences,
@@ -268,81 +283,84 @@ func createSubscription(c *fiber.Ctx) error {
 	}
 
 	if err := db.CreateSubscription(subscription); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create subscription",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create subscription")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(subscription)
 }
 
-func getDeliveries(c *fiber.Ctx) error {
+func (h *handlers) getDeliveries(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email parameter is required")
 	}
 
 	deliveries := db.GetDeliveries(email)
-	return c.JSON(deliveries)
+	return server.List(c, deliveries)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		MealPlans:     make(map[string]MealPlan),
-		Recipes:       make(map[string]Recipe),
-		WeeklyMenus:   make(map[string]WeeklyMenu),
-		Subscriptions: make(map[string]Subscription),
-		Deliveries:    make(map[string]Delivery),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/meal-plans", getMealPlans)
-	api.Get("/weekly-menu", getWeeklyMenu)
-	api.Get("/subscriptions", getSubscription)
-	api.Post("/subscriptions", createSubscription)
-	api.Get("/deliveries", getDeliveries)
+	api.Get("/meal-plans", h.getMealPlans)
+	api.Get("/weekly-menu", h.getWeeklyMenu)
+	api.Get("/subscriptions", h.getSubscription)
+	api.Post("/subscriptions", h.createSubscription)
+	api.Get("/deliveries", h.getDeliveries)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"subscriptions"},
+			Search:  []string{"recipes", "meal_plans"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, deliveryLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,17 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -32,23 +30,23 @@ type User struct {
 }
 
 type Category struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	BaseRate    float64 `json:"base_rate"`
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	BaseRate    money.Money `json:"base_rate"`
 }
 
 type Tasker struct {
-	ID             string    `json:"id"`
-	Name           string    `json:"name"`
-	Categories     []string  `json:"categories"`
-	HourlyRate     float64   `json:"hourly_rate"`
-	Rating         float64   `json:"rating"`
-	ReviewsCount   int       `json:"reviews_count"`
-	CompletedTasks int       `json:"completed_tasks"`
-	Location       Location  `json:"location"`
-	Available      bool      `json:"available"`
-	JoinedAt       time.Time `json:"joined_at"`
+	ID             string      `json:"id"`
+	Name           string      `json:"name"`
+	Categories     []string    `json:"categories"`
+	HourlyRate     money.Money `json:"hourly_rate"`
+	Rating         float64     `json:"rating"`
+	ReviewsCount   int         `json:"reviews_count"`
+	CompletedTasks int         `json:"completed_tasks"`
+	Location       Location    `json:"location"`
+	Available      bool        `json:"available"`
+	JoinedAt       time.Time   `json:"joined_at"`
 }
 
 type TaskStatus string
@@ -61,40 +59,72 @@ const (
 	TaskStatusCancelled  TaskStatus = "cancelled"
 )
 
+// taskMachine is the statuses a task moves through. It can be cancelled
+// until the Tasker starts.
+var taskMachine = &statemachine.Machine{Name: "task", Moves: map[string][]string{
+	string(TaskStatusPending):    {string(TaskStatusAccepted), string(TaskStatusCancelled)},
+	string(TaskStatusAccepted):   {string(TaskStatusInProgress), string(TaskStatusCancelled)},
+	string(TaskStatusInProgress): {string(TaskStatusCompleted)},
+}}
+
+// taskLifecycle has a tasker accept each task, start it at its scheduled
+// time and finish a couple of hours later.
+var taskLifecycle = server.Lifecycle{Collection: "tasks", Steps: []server.Step{
+	{From: string(TaskStatusPending), To: string(TaskStatusAccepted), After: 30 * time.Minute,
+		Notify: server.Notice{Type: "task_accepted", Message: "A Tasker accepted your task {{id}}."}},
+	{From: string(TaskStatusAccepted), To: string(TaskStatusInProgress), At: "scheduled_time"},
+	{From: string(TaskStatusInProgress), To: string(TaskStatusCompleted), After: 2 * time.Hour,
+		Notify: server.Notice{Type: "task_completed", Message: "Your task {{id}} is complete."}},
+}, Machine: taskMachine}
+
 type Task struct {
-	ID             string     `json:"id"`
-	Category       string     `json:"category"`
-	Description    string     `json:"description"`
-	Status         TaskStatus `json:"status"`
-	ClientEmail    string     `json:"client_email"`
-	TaskerID       string     `json:"tasker_id"`
-	Location       Location   `json:"location"`
-	ScheduledTime  time.Time  `json:"scheduled_time"`
-	EstimatedHours float64    `json:"estimated_hours"`
-	HourlyRate     float64    `json:"hourly_rate"`
-	TotalCost      float64    `json:"total_cost"`
-	CreatedAt      time.Time  `json:"created_at"`
-	UpdatedAt      time.Time  `json:"updated_at"`
+	ID             string                    `json:"id"`
+	Category       string                    `json:"category"`
+	Description    string                    `json:"description"`
+	Status         TaskStatus                `json:"status"`
+	StatusHistory  []statemachine.Transition `json:"status_history,omitempty"`
+	ClientEmail    string                    `json:"client_email"`
+	TaskerID       string                    `json:"tasker_id"`
+	Location       Location                  `json:"location"`
+	ScheduledTime  time.Time                 `json:"scheduled_time"`
+	EstimatedHours float64                   `json:"estimated_hours"`
+	HourlyRate     money.Money               `json:"hourly_rate"`
+	TotalCost      money.Money               `json:"total_cost"`
+	CreatedAt      time.Time                 `json:"created_at"`
+	UpdatedAt      time.Time                 `json:"updated_at"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users      map[string]User     `json:"users"`
-	Taskers    map[string]Tasker   `json:"taskers"`
-	Tasks      map[string]Task     `json:"tasks"`
-	Categories map[string]Category `json:"categories"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users      server.Repository[User]     `json:"users"`
+	Taskers    server.Repository[Tasker]   `json:"taskers"`
+	Tasks      server.Repository[Task]     `json:"tasks"`
+	Categories server.Repository[Category] `json:"categories"`
 	mu         sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers post TaskRabbit tasks and assign taskers to them, dating tasks by
+// clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the taskers, tasks and categories in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -105,7 +135,7 @@ func (d *Database) GetTasker(id string) (Tasker, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	tasker, exists := d.Taskers[id]
+	tasker, exists := d.Taskers.Get(id)
 	if !exists {
 		return Tasker{}, errors.New("tasker not found")
 	}
@@ -116,7 +146,7 @@ func (d *Database) GetTask(id string) (Task, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	task, exists := d.Tasks[id]
+	task, exists := d.Tasks.Get(id)
 	if !exists {
 		return Task{}, errors.New("task not found")
 	}
@@ -127,27 +157,26 @@ func (d *Database) CreateTask(task Task) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Tasks[task.ID] = task
+	d.Tasks.Upsert(task.ID, task)
 	return nil
 }
 
 // HTTP Handlers
-func getAvailableTaskers(c *fiber.Ctx) error {
+func (h *handlers) getAvailableTaskers(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	lat := c.QueryFloat("latitude", 0)
 	lon := c.QueryFloat("longitude", 0)
 
 	if category == "" || lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "category, latitude, and longitude are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "category, latitude, and longitude are required")
 	}
 
 	var availableTaskers []Tasker
 	maxDistance := 20.0 // Maximum distance in km
 
 	db.mu.RLock()
-	for _, tasker := range db.Taskers {
+	for _, tasker := range db.Taskers.List() {
 		if !tasker.Available {
 			continue
 		}
@@ -175,84 +204,74 @@ func getAvailableTaskers(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(availableTaskers)
+	return server.List(c, availableTaskers)
 }
 
-func getUserTasks(c *fiber.Ctx) error {
+func (h *handlers) getUserTasks(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userTasks []Task
 	db.mu.RLock()
-	for _, task := range db.Tasks {
+	for _, task := range db.Tasks.List() {
 		if task.ClientEmail == email {
 			userTasks = append(userTasks, task)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userTasks)
+	return server.List(c, userTasks)
 }
 
 type CreateTaskRequest struct {
 	CategoryID     string   `json:"category_id"`
 	Description    string   `json:"description"`
 	Location       Location `json:"location"`
-	ScheduledTime  string   `json:"scheduled_time"`
+	ScheduledTime  string   `json:"scheduled_time" validate:"datetime"`
 	EstimatedHours float64  `json:"estimated_hours"`
 	TaskerID       string   `json:"tasker_id"`
-	UserEmail      string   `json:"user_email"`
+	UserEmail      string   `json:"user_email" validate:"email"`
 }
 
-func createTask(c *fiber.Ctx) error {
+func (h *handlers) createTask(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateTaskRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Validate tasker
 	tasker, err := db.GetTasker(req.TaskerID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Tasker not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Tasker not found")
 	}
 
 	// Validate category
-	category, exists := db.Categories[req.CategoryID]
+	category, exists := db.Categories.Get(req.CategoryID)
 	if !exists {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid category",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid category")
 	}
 
 	// Parse scheduled time
 	scheduledTime, err := time.Parse(time.RFC3339, req.ScheduledTime)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid scheduled time format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid scheduled time format")
 	}
 
 	// Calculate total cost
-	totalCost := tasker.HourlyRate * req.EstimatedHours
+	totalCost := tasker.HourlyRate.Mul(req.EstimatedHours)
 
 	task := Task{
-		ID:             uuid.New().String(),
+		ID:             server.NewID("TASK"),
 		Category:       category.Name,
 		Description:    req.Description,
 		Status:         TaskStatusPending,
@@ -263,120 +282,116 @@ func createTask(c *fiber.Ctx) error {
 		EstimatedHours: req.EstimatedHours,
 		HourlyRate:     tasker.HourlyRate,
 		TotalCost:      totalCost,
-		CreatedAt:      time.Now(),
-		UpdatedAt:      time.Now(),
+		CreatedAt:      h.clock.Now(),
+		UpdatedAt:      h.clock.Now(),
 	}
 
 	if err := db.CreateTask(task); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create task",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create task")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(task)
 }
 
-func getCategories(c *fiber.Ctx) error {
+func (h *handlers) getCategories(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var categories []Category
 	db.mu.RLock()
-	for _, category := range db.Categories {
+	for _, category := range db.Categories.List() {
 		categories = append(categories, category)
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(categories)
+	return server.List(c, categories)
 }
 
-func getTaskDetails(c *fiber.Ctx) error {
+func (h *handlers) getTaskDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	taskId := c.Params("taskId")
 	if taskId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Task ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Task ID is required")
 	}
 
 	task, err := db.GetTask(taskId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Task not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Task not found")
 	}
 
 	return c.JSON(task)
 }
 
-// Helper functions
+// calculateDistance returns the great-circle distance between two points
+// in km.
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+	return geo.DistanceKm(geo.Point{Lat: lat1, Lon: lon1}, geo.Point{Lat: lat2, Lon: lon2})
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:      make(map[string]User),
-		Taskers:    make(map[string]Tasker),
-		Tasks:      make(map[string]Task),
-		Categories: make(map[string]Category),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Tasker routes
-	api.Get("/taskers", getAvailableTaskers)
+	api.Get("/taskers", h.getAvailableTaskers)
 
 	// Task routes
-	api.Get("/tasks", getUserTasks)
-	api.Post("/tasks", createTask)
-	api.Get("/tasks/:taskId", getTaskDetails)
+	api.Get("/tasks", h.getUserTasks)
+	api.Post("/tasks", h.createTask)
+	api.Get("/tasks/:taskId", h.getTaskDetails)
 
 	// Category routes
-	api.Get("/categories", getCategories)
+	api.Get("/categories", h.getCategories)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"tasks"},
+			Search:  []string{"categories", "taskers", "tasks"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, taskLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,18 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -74,10 +70,13 @@ type User struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users             map[string]User             `json:"users"`
-	Vehicles          map[string]Vehicle          `json:"vehicles"`
-	VehicleStates     map[string]VehicleState     `json:"vehicle_states"`
-	ChargingSchedules map[string]ChargingSchedule `json:"charging_schedules"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users             server.Repository[User]             `json:"users"`
+	Vehicles          server.Repository[Vehicle]          `json:"vehicles"`
+	VehicleStates     server.Repository[VehicleState]     `json:"vehicle_states"`
+	ChargingSchedules server.Repository[ChargingSchedule] `json:"charging_schedules"`
 	mu                sync.RWMutex
 }
 
@@ -89,15 +88,25 @@ var (
 	ErrInvalidCommand  = errors.New("invalid command")
 )
 
-// Global database instance
-var db *Database
+// handlers report on Tesla vehicles and send them commands and charging
+// schedules through db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the vehicles, their states and schedules in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -108,7 +117,7 @@ func (d *Database) GetVehicle(id string) (Vehicle, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	vehicle, exists := d.Vehicles[id]
+	vehicle, exists := d.Vehicles.Get(id)
 	if !exists {
 		return Vehicle{}, ErrVehicleNotFound
 	}
@@ -119,7 +128,7 @@ func (d *Database) GetVehicleState(id string) (VehicleState, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	state, exists := d.VehicleStates[id]
+	state, exists := d.VehicleStates.Get(id)
 	if !exists {
 		return VehicleState{}, ErrVehicleNotFound
 	}
@@ -130,28 +139,25 @@ func (d *Database) UpdateVehicleState(id string, state VehicleState) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if _, exists := d.Vehicles[id]; !exists {
+	if _, exists := d.Vehicles.Get(id); !exists {
 		return ErrVehicleNotFound
 	}
 
-	d.VehicleStates[id] = state
+	d.VehicleStates.Upsert(id, state)
 	return nil
 }
 
 // HTTP Handlers
-func getUserVehicles(c *fiber.Ctx) error {
+func (h *handlers) getUserVehicles(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var vehicles []Vehicle
@@ -161,22 +167,19 @@ func getUserVehicles(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(vehicles)
+	return server.List(c, vehicles)
 }
 
-func getVehicleState(c *fiber.Ctx) error {
+func (h *handlers) getVehicleState(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	vehicleId := c.Params("vehicleId")
 	if vehicleId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "vehicle ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "vehicle ID is required")
 	}
 
 	state, err := db.GetVehicleState(vehicleId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(state)
@@ -187,27 +190,22 @@ type CommandRequest struct {
 	Parameters map[string]interface{} `json:"parameters"`
 }
 
-func sendCommand(c *fiber.Ctx) error {
+func (h *handlers) sendCommand(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	vehicleId := c.Params("vehicleId")
 	if vehicleId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "vehicle ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "vehicle ID is required")
 	}
 
 	var cmd CommandRequest
-	if err := c.BodyParser(&cmd); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &cmd); err != nil {
+		return err
 	}
 
 	// Get current vehicle state
 	state, err := db.GetVehicleState(vehicleId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Process command
@@ -215,9 +213,7 @@ func sendCommand(c *fiber.Ctx) error {
 
 	// Update vehicle state
 	if err := db.UpdateVehicleState(vehicleId, state); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update vehicle state",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update vehicle state")
 	}
 
 	return c.JSON(result)
@@ -253,128 +249,116 @@ func processCommand(state *VehicleState, cmd CommandRequest) map[string]interfac
 	return result
 }
 
-func getChargingSchedule(c *fiber.Ctx) error {
+func (h *handlers) getChargingSchedule(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	vehicleId := c.Params("vehicleId")
 	if vehicleId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "vehicle ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "vehicle ID is required")
 	}
 
 	db.mu.RLock()
-	schedule, exists := db.ChargingSchedules[vehicleId]
+	schedule, exists := db.ChargingSchedules.Get(vehicleId)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Charging schedule not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Charging schedule not found")
 	}
 
 	return c.JSON(schedule)
 }
 
-func updateChargingSchedule(c *fiber.Ctx) error {
+func (h *handlers) updateChargingSchedule(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	vehicleId := c.Params("vehicleId")
 	if vehicleId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "vehicle ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "vehicle ID is required")
 	}
 
 	var schedule ChargingSchedule
-	if err := c.BodyParser(&schedule); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &schedule); err != nil {
+		return err
 	}
 
 	// Validate schedule
 	for _, day := range schedule.WeeklySchedule {
 		if day.Day < 0 || day.Day > 6 {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Invalid day in schedule",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid day in schedule")
 		}
 		if day.ChargeLimit < 0 || day.ChargeLimit > 100 {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Invalid charge limit",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid charge limit")
 		}
 	}
 
 	db.mu.Lock()
-	db.ChargingSchedules[vehicleId] = schedule
+	db.ChargingSchedules.Upsert(vehicleId, schedule)
 	db.mu.Unlock()
 
 	return c.JSON(schedule)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:             make(map[string]User),
-		Vehicles:          make(map[string]Vehicle),
-		VehicleStates:     make(map[string]VehicleState),
-		ChargingSchedules: make(map[string]ChargingSchedule),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Vehicle routes
-	api.Get("/vehicles", getUserVehicles)
-	api.Get("/vehicles/:vehicleId/state", getVehicleState)
-	api.Post("/vehicles/:vehicleId/command", sendCommand)
+	api.Get("/vehicles", h.getUserVehicles)
+	api.Get("/vehicles/:vehicleId/state", h.getVehicleState)
+	api.Post("/vehicles/:vehicleId/command", h.sendCommand)
 
 	// Charging schedule routes
-	api.Get("/vehicles/:vehicleId/charging/schedule", getChargingSchedule)
-	api.Put("/vehicles/:vehicleId/charging/schedule", updateChargingSchedule)
+	api.Get("/vehicles/:vehicleId/charging/schedule", h.getChargingSchedule)
+	api.Put("/vehicles/:vehicleId/charging/schedule", h.updateChargingSchedule)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"vehicles"},
+			Search:  []string{"vehicles"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
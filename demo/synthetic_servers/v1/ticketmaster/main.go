@@ -1,19 +1,17 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/payments"
+	"pkg/server"
 )
 
 // Domain Models
@@ -27,9 +25,9 @@ type Venue struct {
 }
 
 type PriceRange struct {
-	Category  string  `json:"category"`
-	Price     float64 `json:"price"`
-	Available int     `json:"available"`
+	Category  string      `json:"category"`
+	Price     money.Money `json:"price"`
+	Available int         `json:"available"`
 }
 
 type Event struct {
@@ -45,22 +43,23 @@ type Event struct {
 }
 
 type Ticket struct {
-	ID      string  `json:"id"`
-	Section string  `json:"section"`
-	Row     string  `json:"row"`
-	Seat    string  `json:"seat"`
-	Price   float64 `json:"price"`
-	Barcode string  `json:"barcode"`
+	ID      string      `json:"id"`
+	Section string      `json:"section"`
+	Row     string      `json:"row"`
+	Seat    string      `json:"seat"`
+	Price   money.Money `json:"price"`
+	Barcode string      `json:"barcode"`
 }
 
 type Order struct {
-	ID        string    `json:"id"`
-	UserEmail string    `json:"user_email"`
-	Event     Event     `json:"event"`
-	Tickets   []Ticket  `json:"tickets"`
-	Total     float64   `json:"total"`
-	Status    string    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        string      `json:"id"`
+	UserEmail string      `json:"user_email"`
+	Event     Event       `json:"event"`
+	Tickets   []Ticket    `json:"tickets"`
+	Total     money.Money `json:"total"`
+	Status    string      `json:"status"`
+	ChargeID  string      `json:"charge_id,omitempty"` // The charge to the payment method
+	CreatedAt time.Time   `json:"created_at"`
 }
 
 type User struct {
@@ -71,21 +70,40 @@ type User struct {
 }
 
 type PaymentMethod struct {
-	ID    string `json:"id"`
-	Type  string `json:"type"`
-	Last4 string `json:"last4"`
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Last4    string `json:"last4"`
+	ExpiryMM int    `json:"expiry_mm"`
+	ExpiryYY int    `json:"expiry_yy"`
+}
+
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users  map[string]User  `json:"users"`
-	Events map[string]Event `json:"events"`
-	Orders map[string]Order `json:"orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+
+	Users  server.Repository[User]  `json:"users"`
+	Events server.Repository[Event] `json:"events"`
+	Orders server.Repository[Order] `json:"orders"`
 	mu     sync.RWMutex
 }
 
-// Global database instance
-var db *Database
+// handlers sell Ticketmaster tickets to events, dating orders by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the events, users and orders in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Custom errors
 var (
@@ -101,7 +119,7 @@ func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -112,7 +130,7 @@ func (d *Database) GetEvent(id string) (Event, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	event, exists := d.Events[id]
+	event, exists := d.Events.Get(id)
 	if !exists {
 		return Event{}, ErrEventNotFound
 	}
@@ -124,16 +142,17 @@ func (d *Database) CreateOrder(order Order) error {
 	defer d.mu.Unlock()
 
 	// Update available tickets
-	event := d.Events[order.Event.ID]
+	event, _ := d.Events.Get(order.Event.ID)
 	event.AvailableTickets -= len(order.Tickets)
-	d.Events[order.Event.ID] = event
+	d.Events.Upsert(order.Event.ID, event)
 
-	d.Orders[order.ID] = order
+	d.Orders.Upsert(order.ID, order)
 	return nil
 }
 
 // HTTP Handlers
-func searchEvents(c *fiber.Ctx) error {
+func (h *handlers) searchEvents(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	city := c.Query("city")
 	category := c.Query("category")
 	dateFrom := c.Query("date_from")
@@ -141,7 +160,7 @@ func searchEvents(c *fiber.Ctx) error {
 
 	var filteredEvents []Event
 	db.mu.RLock()
-	for _, event := range db.Events {
+	for _, event := range db.Events.List() {
 		if (city == "" || event.Venue.City == city) &&
 			(category == "" || event.Category == category) {
 
@@ -166,96 +185,85 @@ func searchEvents(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(filteredEvents)
+	return server.List(c, filteredEvents, "category")
 }
 
-func getEventDetails(c *fiber.Ctx) error {
+func (h *handlers) getEventDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	eventID := c.Params("eventId")
 	event, err := db.GetEvent(eventID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(event)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userOrders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
+	for _, order := range db.Orders.List() {
 		if order.UserEmail == email {
 			userOrders = append(userOrders, order)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return server.List(c, userOrders)
 }
 
 type PurchaseRequest struct {
 	EventID         string `json:"event_id"`
-	UserEmail       string `json:"user_email"`
+	UserEmail       string `json:"user_email" validate:"email"`
 	TicketCategory  string `json:"ticket_category"`
-	Quantity        int    `json:"quantity"`
+	Quantity        int    `json:"quantity" validate:"gte=0"`
 	PaymentMethodID string `json:"payment_method_id"`
 }
 
-func purchaseTickets(c *fiber.Ctx) error {
+func (h *handlers) purchaseTickets(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req PurchaseRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate payment method
-	validPayment := false
-	for _, pm := range user.PaymentMethods {
+	var method *PaymentMethod
+	for i, pm := range user.PaymentMethods {
 		if pm.ID == req.PaymentMethodID {
-			validPayment = true
+			method = &user.PaymentMethods[i]
 			break
 		}
 	}
-	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+	if method == nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
 	}
 
 	// Get event
 	event, err := db.GetEvent(req.EventID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Check ticket availability
 	if event.AvailableTickets < req.Quantity {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Not enough tickets available",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Not enough tickets available")
 	}
 
 	// Find ticket price
-	var ticketPrice float64
+	var ticketPrice money.Money
 	for _, pr := range event.PriceRanges {
 		if pr.Category == req.TicketCategory {
 			ticketPrice = pr.Price
@@ -267,7 +275,7 @@ func purchaseTickets(c *fiber.Ctx) error {
 	var tickets []Ticket
 	for i := 0; i < req.Quantity; i++ {
 		tickets = append(tickets, Ticket{
-			ID:      uuid.New().String(),
+			ID:      server.NewID("TKT"),
 			Section: req.TicketCategory,
 			Row:     "TBD",
 			Seat:    "TBD",
@@ -277,91 +285,104 @@ func purchaseTickets(c *fiber.Ctx) error {
 	}
 
 	// Calculate total
-	total := ticketPrice * float64(req.Quantity)
+	total := ticketPrice.Times(req.Quantity)
+	id := server.NewID("ORD")
+
+	db.mu.Lock()
+	charge, err := db.Authorize(c, server.ChargeRequest{
+		UserEmail:       req.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          total,
+		Description:     "Order " + id,
+		Capture:         true,
+	})
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
 	// Create order
 	order := Order{
-		ID:        uuid.New().String(),
+		ID:        id,
 		UserEmail: req.UserEmail,
 		Event:     event,
 		Tickets:   tickets,
 		Total:     total,
 		Status:    "confirmed",
-		CreatedAt: time.Now(),
+		ChargeID:  charge.ID,
+		CreatedAt: h.clock.Now(),
 	}
 
 	if err := db.CreateOrder(order); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create order",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create order")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	db = &Database{
-		Users:  make(map[string]User),
-		Events: make(map[string]Event),
-		Orders: make(map[string]Order),
-	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Event routes
-	api.Get("/events", searchEvents)
-	api.Get("/events/:eventId", getEventDetails)
+	api.Get("/events", h.searchEvents)
+	api.Get("/events/:eventId", h.getEventDetails)
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", purchaseTickets)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.purchaseTickets)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"orders"},
+			Search:  []string{"events", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -50,7 +45,7 @@ type Stream struct {
 type ChatMessage struct {
 	ID        string    `json:"id"`
 	ChannelID string    `json:"channel_id"`
-	UserEmail string    `json:"user_email"`
+	UserEmail string    `json:"user_email" validate:"email"`
 	Message   string    `json:"message"`
 	Emotes    []string  `json:"emotes"`
 	CreatedAt time.Time `json:"created_at"`
@@ -64,12 +59,16 @@ type Follow struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users        map[string]User        `json:"users"`
-	Channels     map[string]Channel     `json:"channels"`
-	Streams      map[string]Stream      `json:"streams"`
-	ChatMessages map[string]ChatMessage `json:"chat_messages"`
-	Follows      map[string][]Follow    `json:"follows"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users        server.Repository[User]        `json:"users"`
+	Channels     server.Repository[Channel]     `json:"channels"`
+	Streams      server.Repository[Stream]      `json:"streams"`
+	ChatMessages server.Repository[ChatMessage] `json:"chat_messages"`
+	Follows      server.Repository[[]Follow]    `json:"follows"`
 	mu           sync.RWMutex
+	clock        *server.Clock
 }
 
 // Custom errors
@@ -81,15 +80,25 @@ var (
 	ErrNotFollowing     = errors.New("not following this channel")
 )
 
-// Global database instance
-var db *Database
+// handlers run Twitch channels, streams, chat and follows, timestamped by
+// clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the channels, streams and chat in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -100,7 +109,7 @@ func (d *Database) GetChannel(id string) (Channel, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	channel, exists := d.Channels[id]
+	channel, exists := d.Channels.Get(id)
 	if !exists {
 		return Channel{}, ErrChannelNotFound
 	}
@@ -111,7 +120,7 @@ func (d *Database) GetStream(id string) (Stream, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	stream, exists := d.Streams[id]
+	stream, exists := d.Streams.Get(id)
 	if !exists {
 		return Stream{}, ErrStreamNotFound
 	}
@@ -123,7 +132,7 @@ func (d *Database) AddFollow(userEmail, channelID string) error {
 	defer d.mu.Unlock()
 
 	// Check if already following
-	follows := d.Follows[userEmail]
+	follows, _ := d.Follows.Get(userEmail)
 	for _, f := range follows {
 		if f.ChannelID == channelID {
 			return ErrAlreadyFollowing
@@ -134,14 +143,14 @@ func (d *Database) AddFollow(userEmail, channelID string) error {
 	follow := Follow{
 		UserEmail: userEmail,
 		ChannelID: channelID,
-		CreatedAt: time.Now(),
+		CreatedAt: d.clock.Now(),
 	}
-	d.Follows[userEmail] = append(d.Follows[userEmail], follow)
+	d.Follows.Upsert(userEmail, append(follows, follow))
 
 	// Update channel followers count
-	channel := d.Channels[channelID]
+	channel, _ := d.Channels.Get(channelID)
 	channel.FollowersCount++
-	d.Channels[channelID] = channel
+	d.Channels.Upsert(channelID, channel)
 
 	return nil
 }
@@ -150,7 +159,7 @@ func (d *Database) RemoveFollow(userEmail, channelID string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	follows := d.Follows[userEmail]
+	follows, _ := d.Follows.Get(userEmail)
 	found := false
 	newFollows := make([]Follow, 0)
 
@@ -166,24 +175,25 @@ func (d *Database) RemoveFollow(userEmail, channelID string) error {
 		return ErrNotFollowing
 	}
 
-	d.Follows[userEmail] = newFollows
+	d.Follows.Upsert(userEmail, newFollows)
 
 	// Update channel followers count
-	channel := d.Channels[channelID]
+	channel, _ := d.Channels.Get(channelID)
 	channel.FollowersCount--
-	d.Channels[channelID] = channel
+	d.Channels.Upsert(channelID, channel)
 
 	return nil
 }
 
 // HTTP Handlers
-func getStreams(c *fiber.Ctx) error {
+func (h *handlers) getStreams(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
 	limit := c.QueryInt("limit", 20)
 
 	var streams []Stream
 	db.mu.RLock()
-	for _, stream := range db.Streams {
+	for _, stream := range db.Streams.List() {
 		if category != "" && stream.Game != category {
 			continue
 		}
@@ -194,43 +204,34 @@ func getStreams(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(streams)
+	return server.List(c, streams)
 }
 
-func followChannel(c *fiber.Ctx) error {
+func (h *handlers) followChannel(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	channelID := c.Params("channelId")
 
 	var req struct {
-		UserEmail string `json:"user_email"`
+		UserEmail string `json:"user_email" validate:"email"`
 	}
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Verify user and channel exist
 	if _, err := db.GetUser(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	if _, err := db.GetChannel(channelID); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	if err := db.AddFollow(req.UserEmail, channelID); err != nil {
 		if err == ErrAlreadyFollowing {
-			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusConflict, err)
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to follow channel",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to follow channel")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
@@ -238,19 +239,16 @@ func followChannel(c *fiber.Ctx) error {
 	})
 }
 
-func unfollowChannel(c *fiber.Ctx) error {
+func (h *handlers) unfollowChannel(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	channelID := c.Params("channelId")
 	userEmail := c.Query("user_email")
 
 	if err := db.RemoveFollow(userEmail, channelID); err != nil {
 		if err == ErrNotFollowing {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to unfollow channel",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to unfollow channel")
 	}
 
 	return c.JSON(fiber.Map{
@@ -258,131 +256,124 @@ func unfollowChannel(c *fiber.Ctx) error {
 	})
 }
 
-func getUserFollowing(c *fiber.Ctx) error {
+func (h *handlers) getUserFollowing(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	// Verify user exists
 	if _, err := db.GetUser(email); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	db.mu.RLock()
-	follows := db.Follows[email]
+	follows, _ := db.Follows.Get(email)
 	var channels []Channel
 	for _, follow := range follows {
-		if channel, exists := db.Channels[follow.ChannelID]; exists {
+		if channel, exists := db.Channels.Get(follow.ChannelID); exists {
 			channels = append(channels, channel)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(channels)
+	return server.List(c, channels)
 }
 
-func sendChatMessage(c *fiber.Ctx) error {
+func (h *handlers) sendChatMessage(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	channelID := c.Params("channelId")
 
 	var msg ChatMessage
-	if err := c.BodyParser(&msg); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &msg); err != nil {
+		return err
 	}
 
 	// Verify user and channel exist
 	if _, err := db.GetUser(msg.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	if _, err := db.GetChannel(channelID); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	msg.ID = uuid.New().String()
+	msg.ID = server.NewID("MSG")
 	msg.ChannelID = channelID
-	msg.CreatedAt = time.Now()
+	msg.CreatedAt = h.clock.Now()
 
 	db.mu.Lock()
-	db.ChatMessages[msg.ID] = msg
+	db.ChatMessages.Upsert(msg.ID, msg)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(msg)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:        make(map[string]User),
-		Channels:     make(map[string]Channel),
-		Streams:      make(map[string]Stream),
-		ChatMessages: make(map[string]ChatMessage),
-		Follows:      make(map[string][]Follow),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Stream routes
-	api.Get("/streams", getStreams)
+	api.Get("/streams", h.getStreams)
 
 	// Channel routes
-	api.Post("/channels/:channelId/follow", followChannel)
-	api.Delete("/channels/:channelId/follow", unfollowChannel)
-	api.Post("/channels/:channelId/chat", sendChatMessage)
+	api.Post("/channels/:channelId/follow", h.followChannel)
+	api.Delete("/channels/:channelId/follow", h.unfollowChannel)
+	api.Post("/channels/:channelId/chat", h.sendChatMessage)
 
 	// User routes
-	api.Get("/users/:email/following", getUserFollowing)
+	api.Get("/users/:email/following", h.getUserFollowing)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "follows"},
+			Search:  []string{"channels", "streams"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,25 +1,23 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
 	"math"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/payments"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Location struct {
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude" validate:"min=-90,max=90"`
+	Longitude float64 `json:"longitude" validate:"min=-180,max=180"`
 	Address   string  `json:"address"`
 }
 
@@ -39,6 +37,10 @@ type PaymentMethod struct {
 	ExpiryYY int    `json:"expiry_yy"`
 }
 
+func (pm PaymentMethod) card() payments.Card {
+	return payments.Card{Last4: pm.Last4, ExpiryMM: pm.ExpiryMM, ExpiryYY: pm.ExpiryYY}
+}
+
 type Car struct {
 	Make         string `json:"make"`
 	Model        string `json:"model"`
@@ -52,6 +54,10 @@ type Driver struct {
 	Phone  string  `json:"phone"`
 	Rating float64 `json:"rating"`
 	Car    Car     `json:"car"`
+	// Where the driver is, and whether they can take a ride, for the v2
+	// profile to match riders with the nearest driver
+	Location  *Location `json:"location,omitempty"`
+	Available bool      `json:"available,omitempty"`
 }
 
 type ServiceType string
@@ -74,35 +80,123 @@ const (
 	RideStatusCancelled RideStatus = "cancelled"
 )
 
+// rideMachine is the statuses a ride moves through. It can be cancelled
+// until the driver arrives.
+var rideMachine = &statemachine.Machine{Name: "ride", Moves: map[string][]string{
+	string(RideStatusRequested): {string(RideStatusAccepted), string(RideStatusCancelled)},
+	string(RideStatusAccepted):  {string(RideStatusArrived), string(RideStatusCancelled)},
+	string(RideStatusArrived):   {string(RideStatusStarted)},
+	string(RideStatusStarted):   {string(RideStatusCompleted)},
+}}
+
+// rideLifecycle finds a driver for each ride, picks the rider up and drops
+// them off.
+var rideLifecycle = server.Lifecycle{Collection: "rides", Steps: []server.Step{
+	{From: string(RideStatusRequested), To: string(RideStatusAccepted), After: time.Minute},
+	{From: string(RideStatusAccepted), To: string(RideStatusArrived), After: 5 * time.Minute,
+		Notify: server.Notice{Type: "driver_arrived", Message: "Your driver has arrived.", Text: "ride_arriving"}},
+	{From: string(RideStatusArrived), To: string(RideStatusStarted), After: 2 * time.Minute},
+	{From: string(RideStatusStarted), To: string(RideStatusCompleted), After: 20 * time.Minute,
+		Notify: server.Notice{Type: "ride_completed", Message: "Your ride {{id}} is complete."}},
+}, Sender: "Uber", Machine: rideMachine}
+
+// rideLinks lead riders from a ride to its live updates while it is under
+// way and, in v2, to cancelling it while it can be.
+var rideLinks = server.Links{Schema: "Ride", Links: []server.Link{
+	{Rel: "self", Href: "/api/v1/rides/{{id}}"},
+	{Rel: "tracking", Href: "/api/v1/events/stream?type=rides&key={{id}}",
+		Status: []string{string(RideStatusRequested), string(RideStatusAccepted), string(RideStatusArrived), string(RideStatusStarted)}},
+	{Rel: "cancel", Href: "/api/v1/rides/{{id}}", Method: fiber.MethodDelete,
+		Status: []string{string(RideStatusRequested), string(RideStatusAccepted)}},
+}}
+
 type Ride struct {
-	ID          string      `json:"id"`
-	UserEmail   string      `json:"user_email"`
-	Driver      *Driver     `json:"driver,omitempty"`
-	ServiceType ServiceType `json:"service_type"`
-	Status      RideStatus  `json:"status"`
-	Pickup      Location    `json:"pickup"`
-	Destination Location    `json:"destination"`
-	Price       float64     `json:"price"`
-	CreatedAt   time.Time   `json:"created_at"`
-	UpdatedAt   time.Time   `json:"updated_at"`
+	ID            string                    `json:"id"`
+	UserEmail     string                    `json:"user_email"`
+	Driver        *Driver                   `json:"driver,omitempty"`
+	ServiceType   ServiceType               `json:"service_type"`
+	Status        RideStatus                `json:"status"`
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
+	Pickup        Location                  `json:"pickup"`
+	Destination   Location                  `json:"destination"`
+	Price         money.Money               `json:"price"`
+	ChargeID      string                    `json:"charge_id,omitempty"` // Holds the fare until the ride is completed
+	CreatedAt     time.Time                 `json:"created_at"`
+	UpdatedAt     time.Time                 `json:"updated_at"`
 }
 
 type RideEstimate struct {
 	ServiceType       ServiceType `json:"service_type"`
-	EstimatedPrice    float64     `json:"estimated_price"`
+	EstimatedPrice    money.Money `json:"estimated_price"`
 	EstimatedDuration int         `json:"estimated_duration"` // in minutes
 	EstimatedDistance float64     `json:"estimated_distance"` // in miles
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users   map[string]User   `json:"users"`
-	Drivers map[string]Driver `json:"drivers"`
-	Rides   map[string]Ride   `json:"rides"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Payments
+
+	Users   server.Repository[User]   `json:"users"`
+	Drivers server.Repository[Driver] `json:"drivers"`
+	Rides   server.Repository[Ride]   `json:"rides"`
 	mu      sync.RWMutex
 }
 
-var db *Database
+// PhoneNumber returns the user's phone number, for texts. Callers must hold
+// d.mu.
+func (d *Database) PhoneNumber(email string) string {
+	user, _ := d.Users.Get(email)
+	return user.Phone
+}
+
+// Stepped takes the fare of a ride once it is completed, or releases it if
+// the ride is cancelled, and frees its driver either way. Callers must hold
+// d.mu for writing.
+func (d *Database) Stepped(collection, key, from, to string) {
+	ride, ok := d.Rides.Get(key)
+	if collection != "rides" || !ok {
+		return
+	}
+	switch RideStatus(to) {
+	case RideStatusCompleted:
+		d.freeDriver(ride)
+		if ride.ChargeID != "" {
+			d.Capture(ride.ChargeID, ride.Price)
+		}
+	case RideStatusCancelled:
+		d.freeDriver(ride)
+		if ride.ChargeID != "" {
+			d.Void(ride.ChargeID)
+		}
+	}
+}
+
+// freeDriver makes the driver the v2 profile assigned a ride available
+// again. Callers must hold d.mu for writing.
+func (d *Database) freeDriver(ride Ride) {
+	if ride.Driver == nil || server.Profile() != "v2" {
+		return
+	}
+	if driver, ok := d.Drivers.Get(ride.Driver.ID); ok {
+		driver.Available = true
+		d.Drivers.Upsert(driver.ID, driver)
+	}
+}
+
+// handlers request Uber rides, assign drivers and price trips, timing each
+// by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users, drivers and rides in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Helper functions
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
@@ -121,38 +215,70 @@ func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
 	return R * c * 0.621371 // Convert to miles
 }
 
-func calculatePrice(distance float64, serviceType ServiceType) float64 {
-	basePrices := map[ServiceType]float64{
-		UberX:       2.55,
-		UberXL:      3.85,
-		UberBlack:   7.00,
-		UberComfort: 3.25,
-	}
+// fare is what a ride of a service type costs: a base price, and a price
+// per mile.
+type fare struct {
+	base, perMile float64
+}
 
-	perMilePrices := map[ServiceType]float64{
-		UberX:       1.75,
-		UberXL:      2.85,
-		UberBlack:   4.50,
-		UberComfort: 2.25,
-	}
+// fares are the fares of each service type, by profile. The v2 profile
+// charges what Uber's v2 API did.
+var fares = map[string]map[ServiceType]fare{
+	server.ProfileDefault: {
+		UberX:       {2.55, 1.75},
+		UberXL:      {3.85, 2.85},
+		UberBlack:   {7.00, 4.50},
+		UberComfort: {3.25, 2.25},
+	},
+	"v2": {
+		UberX:       {2.50, 1.50},
+		UberXL:      {5.00, 2.50},
+		UberBlack:   {7.00, 3.50},
+		UberComfort: {3.50, 2.00},
+	},
+}
 
-	basePrice := basePrices[serviceType]
-	perMilePrice := perMilePrices[serviceType]
+func calculatePrice(distance float64, serviceType ServiceType) money.Money {
+	f := fares[server.Profile()][serviceType]
+	return money.Dollars(f.base + (distance * f.perMile))
+}
 
-	return basePrice + (distance * perMilePrice)
+// maxPickupDistance is how far away, in miles, the v2 profile looks for a
+// driver.
+const maxPickupDistance = 5.0
+
+// nearestDriver returns the available driver nearest to pickup, if any is
+// within maxPickupDistance. Callers must hold d.mu.
+func (d *Database) nearestDriver(pickup Location) (Driver, bool) {
+	var nearest Driver
+	found := false
+	minDistance := math.MaxFloat64
+	for _, driver := range d.Drivers.List() {
+		if !driver.Available || driver.Location == nil {
+			continue
+		}
+		distance := calculateDistance(
+			pickup.Latitude,
+			pickup.Longitude,
+			driver.Location.Latitude,
+			driver.Location.Longitude,
+		)
+		if distance <= maxPickupDistance && distance < minDistance {
+			nearest, found, minDistance = driver, true, distance
+		}
+	}
+	return nearest, found
 }
 
 // Handlers
-func getRideEstimate(c *fiber.Ctx) error {
+func (h *handlers) getRideEstimate(c *fiber.Ctx) error {
 	var req struct {
 		Pickup      Location `json:"pickup"`
 		Destination Location `json:"destination"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	distance := calculateDistance(
@@ -192,44 +318,53 @@ func getRideEstimate(c *fiber.Ctx) error {
 	return c.JSON(estimates)
 }
 
-func requestRide(c *fiber.Ctx) error {
+func (h *handlers) requestRide(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		UserEmail       string      `json:"user_email"`
+		UserEmail       string      `json:"user_email" validate:"email"`
 		ServiceType     ServiceType `json:"service_type"`
 		Pickup          Location    `json:"pickup"`
 		Destination     Location    `json:"destination"`
 		PaymentMethodID string      `json:"payment_method_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Verify user exists
 	db.mu.RLock()
-	user, exists := db.Users[req.UserEmail]
+	user, exists := db.Users.Get(req.UserEmail)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	// Verify payment method
-	validPayment := false
-	for _, pm := range user.PaymentMethods {
+	var method *PaymentMethod
+	for i, pm := range user.PaymentMethods {
 		if pm.ID == req.PaymentMethodID {
-			validPayment = true
+			method = &user.PaymentMethods[i]
 			break
 		}
 	}
-	if !validPayment {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payment method",
-		})
+	if method == nil {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid payment method")
+	}
+
+	// The v2 profile assigns the nearest driver up front, and turns the
+	// ride down if there is none
+	var driver *Driver
+	if server.Profile() == "v2" {
+		db.mu.RLock()
+		nearest, ok := db.nearestDriver(req.Pickup)
+		db.mu.RUnlock()
+		if !ok {
+			return server.Fail(c, fiber.StatusServiceUnavailable, server.CodeUnavailable, "No drivers available nearby")
+		}
+		nearest.Available = false
+		driver = &nearest
 	}
 
 	// Calculate price
@@ -240,23 +375,49 @@ func requestRide(c *fiber.Ctx) error {
 		req.Destination.Longitude,
 	)
 	price := calculatePrice(distance, req.ServiceType)
+	id := server.NewID("RIDE")
+
+	// Hold the fare on the card until the ride is completed
+	db.mu.Lock()
+	charge, err := db.Authorize(c, server.ChargeRequest{
+		UserEmail:       req.UserEmail,
+		PaymentMethodID: method.ID,
+		Card:            method.card(),
+		Amount:          price,
+		Description:     "Ride " + id,
+	})
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if server.Chaos(c, server.ChaosDriverDeclined) {
+		db.mu.Lock()
+		db.Void(charge.ID)
+		db.mu.Unlock()
+		return server.Fail(c, fiber.StatusConflict, server.CodeConflict, "The driver declined your ride; please request again")
+	}
 
 	// Create new ride
 	ride := Ride{
-		ID:          uuid.New().String(),
+		ID:          id,
 		UserEmail:   req.UserEmail,
+		Driver:      driver,
 		ServiceType: req.ServiceType,
 		Status:      RideStatusRequested,
 		Pickup:      req.Pickup,
 		Destination: req.Destination,
 		Price:       price,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		ChargeID:    charge.ID,
+		CreatedAt:   h.clock.Now(),
+		UpdatedAt:   h.clock.Now(),
 	}
 
 	// Save ride
 	db.mu.Lock()
-	db.Rides[ride.ID] = ride
+	db.Rides.Upsert(ride.ID, ride)
+	if driver != nil {
+		db.Drivers.Upsert(driver.ID, *driver)
+	}
 	db.mu.Unlock()
 
 	// In a real implementation, we would now:
@@ -267,108 +428,138 @@ func requestRide(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusCreated).JSON(ride)
 }
 
-func getRideHistory(c *fiber.Ctx) error {
+func (h *handlers) getRideHistory(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userRides []Ride
 	db.mu.RLock()
-	for _, ride := range db.Rides {
+	for _, ride := range db.Rides.List() {
 		if ride.UserEmail == email {
 			userRides = append(userRides, ride)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userRides)
+	return server.List(c, userRides)
 }
 
-func getRideStatus(c *fiber.Ctx) error {
+func (h *handlers) getRideStatus(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	rideID := c.Params("rideId")
 	if rideID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "ride ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "ride ID is required")
 
 	}
 
 	db.mu.RLock()
-	ride, exists := db.Rides[rideID]
+	ride, exists := db.Rides.Get(rideID)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Ride not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Ride not found")
 	}
 
 	return c.JSON(ride)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+// cancelRide cancels a ride no driver has picked up yet, releasing the
+// hold on its fare and its driver.
+func (h *handlers) cancelRide(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	rideID := c.Params("rideId")
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	db = &Database{
-		Users:   make(map[string]User),
-		Drivers: make(map[string]Driver),
-		Rides:   make(map[string]Ride),
+	ride, exists := db.Rides.Get(rideID)
+	if !exists {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Ride not found")
+	}
+	from := ride.Status
+	if err := statemachine.Move(rideMachine, &ride, &ride.Status, &ride.StatusHistory, RideStatusCancelled, h.clock.Now()); err != nil {
+		return server.FailWith(c, fiber.StatusConflict, err)
 	}
+	ride.UpdatedAt = h.clock.Now()
+	db.Rides.Upsert(rideID, ride)
+	db.Stepped("rides", rideID, string(from), string(ride.Status))
+
+	return c.JSON(ride)
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	return json.Unmarshal(data, db)
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Ride routes
-	api.Post("/rides/estimate", getRideEstimate)
-	api.Post("/rides", requestRide)
-	api.Get("/rides", getRideHistory)
-	api.Get("/rides/:rideId", getRideStatus)
+	api.Post("/rides/estimate", h.getRideEstimate)
+	api.Post("/rides", h.requestRide)
+	api.Get("/rides", h.getRideHistory)
+	api.Get("/rides/:rideId", h.getRideStatus)
+
+	// Uber's v2 API lets riders cancel, too
+	if server.Profile() == "v2" {
+		api.Delete("/rides/:rideId", h.cancelRide)
+	}
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/openapi -profile v2 -o openapi.v2.json
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"rides"},
+			Search:  []string{"rides"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, rideLifecycle),
+		server.WithLinks(rideLinks),
+		server.WithChaos(cfg),
+		server.WithProfiles("v2"),
+	)
+	setupRoutes(app, h)
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"pkg/server"
+	"pkg/servertest"
+)
+
+const fixture = `{
+  "users": {
+    "rae@example.com": {
+      "email": "rae@example.com",
+      "name": "Rae",
+      "payment_methods": [{"id": "pm_1", "type": "visa", "last4": "4242", "expiry_mm": 12, "expiry_yy": 2030}]
+    }
+  },
+  "drivers": {},
+  "rides": {}
+}`
+
+var now = time.Date(2025, 9, 12, 22, 15, 0, 0, time.UTC)
+
+// The trip is along a meridian, a tenth of a degree, or about 6.9 miles.
+const trip = `"pickup": {"latitude": 40.7, "longitude": -74.0}, "destination": {"latitude": 40.8, "longitude": -74.0}`
+
+func newTestApp(t *testing.T) (*fiber.App, *handlers) {
+	t.Helper()
+	h, err := newHandlers(servertest.Store(fixture), servertest.Clock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := servertest.App()
+	setupRoutes(app, h)
+	return app, h
+}
+
+func TestGetRideEstimate(t *testing.T) {
+	app, _ := newTestApp(t)
+	var estimates []RideEstimate
+	servertest.Do(t, app, "POST", "/api/v1/rides/estimate", "{"+trip+"}", &estimates)
+	if len(estimates) != 4 {
+		t.Fatalf("got %d estimates, want one per service type", len(estimates))
+	}
+	x := estimates[0]
+	if x.ServiceType != UberX || x.EstimatedDistance < 6.8 || x.EstimatedDistance > 7 {
+		t.Errorf("got %s over %.2f miles, want UberX over about 6.9", x.ServiceType, x.EstimatedDistance)
+	}
+	if want := calculatePrice(x.EstimatedDistance, UberX); x.EstimatedPrice.Decimal() != want.Decimal() {
+		t.Errorf("priced at %s, want %s", x.EstimatedPrice, want)
+	}
+	for _, e := range estimates[1:] {
+		if less, _ := x.EstimatedPrice.Less(e.EstimatedPrice); !less {
+			t.Errorf("%s at %s is no dearer than UberX at %s", e.ServiceType, e.EstimatedPrice, x.EstimatedPrice)
+		}
+	}
+}
+
+func TestRequestRide(t *testing.T) {
+	app, h := newTestApp(t)
+	var ride Ride
+	code := servertest.Do(t, app, "POST", "/api/v1/rides",
+		`{"user_email": "rae@example.com", "service_type": "UberX", "payment_method_id": "pm_1", `+trip+`}`, &ride)
+	if code != http.StatusCreated {
+		t.Fatalf("got %d, want %d", code, http.StatusCreated)
+	}
+	if ride.Status != RideStatusRequested || !ride.CreatedAt.Equal(now) {
+		t.Errorf("got %s at %v, want requested at the clock's %v", ride.Status, ride.CreatedAt, now)
+	}
+	if ride.Price.IsZero() || ride.ChargeID == "" {
+		t.Errorf("got price %s and charge %q, want the fare held", ride.Price, ride.ChargeID)
+	}
+	if _, ok := h.db.Get().Rides.Get(ride.ID); !ok {
+		t.Errorf("ride %s wasn't saved", ride.ID)
+	}
+
+	var status Ride
+	if code := servertest.Do(t, app, "GET", "/api/v1/rides/"+ride.ID, "", &status); code != http.StatusOK || status.ID != ride.ID {
+		t.Errorf("got %d %q, want ride %s", code, status.ID, ride.ID)
+	}
+	var page server.Page[Ride]
+	servertest.Do(t, app, "GET", "/api/v1/rides?email=rae@example.com", "", &page)
+	if page.Total != 1 {
+		t.Errorf("got %d rides, want the one requested", page.Total)
+	}
+}
+
+func TestRequestRideFails(t *testing.T) {
+	app, h := newTestApp(t)
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"unknown rider", `{"user_email": "max@example.com", "service_type": "UberX", "payment_method_id": "pm_1", ` + trip + `}`, http.StatusNotFound},
+		{"unknown card", `{"user_email": "rae@example.com", "service_type": "UberX", "payment_method_id": "pm_2", ` + trip + `}`, http.StatusBadRequest},
+		{"bad email", `{"user_email": "rae", "service_type": "UberX", "payment_method_id": "pm_1", ` + trip + `}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		if code := servertest.Do(t, app, "POST", "/api/v1/rides", tt.body, nil); code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.code)
+		}
+	}
+	if n := h.db.Get().Rides.Len(); n != 0 {
+		t.Errorf("%d rides saved, want none", n)
+	}
+	if code := servertest.Do(t, app, "GET", "/api/v1/rides/RIDE-none", "", nil); code != http.StatusNotFound {
+		t.Errorf("unknown ride: got %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
+	"errors"
+	"fmt"
 	"log"
-	"os"
+	"math"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/pdf"
+	"pkg/search"
+	"pkg/server"
 )
 
 // Domain Models
@@ -23,6 +26,39 @@ type Lecture struct {
 	Duration int    `json:"duration"` // in minutes
 	Type     string `json:"type"`     // video, article, quiz
 	Content  string `json:"content"`  // URL or content text
+	Quiz     *Quiz  `json:"quiz,omitempty"`
+}
+
+// Quiz is the content of a quiz lecture. Answers never leave the server;
+// submissions are graded here.
+type Quiz struct {
+	PassingScore float64        `json:"passing_score"` // percent
+	Questions    []QuizQuestion `json:"questions"`
+}
+
+type QuizQuestion struct {
+	ID          string   `json:"id"`
+	Prompt      string   `json:"prompt"`
+	Options     []string `json:"options"`
+	Answer      *int     `json:"answer,omitempty"` // index into Options
+	Explanation string   `json:"explanation,omitempty"`
+}
+
+type QuestionResult struct {
+	QuestionID  string `json:"question_id"`
+	Selected    *int   `json:"selected"`
+	Correct     bool   `json:"correct"`
+	Answer      int    `json:"answer"`
+	Explanation string `json:"explanation,omitempty"`
+}
+
+type QuizAttempt struct {
+	ID          string           `json:"id"`
+	LectureID   string           `json:"lecture_id"`
+	Score       float64          `json:"score"`
+	Passed      bool             `json:"passed"`
+	Results     []QuestionResult `json:"results"`
+	SubmittedAt time.Time        `json:"submitted_at"`
 }
 
 type Section struct {
@@ -32,58 +68,242 @@ type Section struct {
 }
 
 type Course struct {
-	ID            string    `json:"id"`
-	Title         string    `json:"title"`
-	Description   string    `json:"description"`
-	Instructor    string    `json:"instructor"`
-	Category      string    `json:"category"`
-	Price         float64   `json:"price"`
-	Rating        float64   `json:"rating"`
-	StudentsCount int       `json:"students_count"`
-	Sections      []Section `json:"sections"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	ID            string      `json:"id"`
+	Title         string      `json:"title"`
+	Description   string      `json:"description"`
+	Instructor    string      `json:"instructor"`
+	Category      string      `json:"category"`
+	Price         money.Money `json:"price"`
+	Rating        float64     `json:"rating"`
+	StudentsCount int         `json:"students_count"`
+	Sections      []Section   `json:"sections"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
 }
 
 type User struct {
-	Email             string    `json:"email"`
-	Name              string    `json:"name"`
-	EnrolledCourses   []string  `json:"enrolled_courses"`   // Course IDs
-	CompletedLectures []string  `json:"completed_lectures"` // Lecture IDs
-	Certificates      []string  `json:"certificates"`
-	CreatedAt         time.Time `json:"created_at"`
+	Email             string          `json:"email"`
+	Name              string          `json:"name"`
+	EnrolledCourses   []string        `json:"enrolled_courses"`   // Course IDs
+	CompletedLectures []string        `json:"completed_lectures"` // Lecture IDs
+	Certificates      []string        `json:"certificates"`
+	Wishlist          []string        `json:"wishlist"` // Course IDs
+	Cart              []string        `json:"cart"`     // Course IDs
+	PaymentMethods    []PaymentMethod `json:"payment_methods,omitempty"`
+	LearningGoal      *LearningGoal   `json:"learning_goal,omitempty"`
+	CreatedAt         time.Time       `json:"created_at"`
 }
 
-type Progress struct {
-	UserEmail         string    `json:"user_email"`
-	CourseID          string    `json:"course_id"`
-	CompletedLectures []string  `json:"completed_lectures"`
-	LastAccessed      time.Time `json:"last_accessed"`
-	Progress          float64   `json:"progress"` // 0-100
+// LearningGoal is a weekly study target: at least DailyMinutes of lectures
+// on DaysPerWeek days. Users who fall behind are reminded once a day after
+// ReminderHour (UTC).
+type LearningGoal struct {
+	DailyMinutes int       `json:"daily_minutes"`
+	DaysPerWeek  int       `json:"days_per_week"`
+	ReminderHour int       `json:"reminder_hour"`
+	Reminders    bool      `json:"reminders"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
-type Certificate struct {
+// WatchEvent is time spent on a lecture.
+type WatchEvent struct {
 	ID        string    `json:"id"`
 	UserEmail string    `json:"user_email"`
 	CourseID  string    `json:"course_id"`
-	IssuedAt  time.Time `json:"issued_at"`
-	URL       string    `json:"url"`
+	LectureID string    `json:"lecture_id"`
+	Minutes   int       `json:"minutes"`
+	WatchedAt time.Time `json:"watched_at"`
+}
+
+type Reminder struct {
+	ID        string    `json:"id"`
+	UserEmail string    `json:"user_email"`
+	Date      string    `json:"date"` // YYYY-MM-DD the reminder is for
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type DayActivity struct {
+	Date    string `json:"date"`
+	Minutes int    `json:"minutes"`
+	GoalMet bool   `json:"goal_met"`
+}
+
+type WeekProgress struct {
+	Start      string        `json:"start"` // Monday
+	Days       []DayActivity `json:"days"`
+	Minutes    int           `json:"minutes"`
+	ActiveDays int           `json:"active_days"` // days meeting the daily goal
+	DaysGoal   int           `json:"days_goal"`
+	Expected   int           `json:"expected"` // active days needed by the end of today to keep pace
+	OnTrack    bool          `json:"on_track"`
+}
+
+type LearningStats struct {
+	Goal          *LearningGoal `json:"goal"`
+	Today         DayActivity   `json:"today"`
+	Week          WeekProgress  `json:"week"`
+	CurrentStreak int           `json:"current_streak"` // consecutive days meeting the daily goal
+	LongestStreak int           `json:"longest_streak"`
+	WeeklyStreak  int           `json:"weekly_streak"` // consecutive weeks meeting the weekly goal
+	TotalMinutes  int           `json:"total_minutes"`
+}
+
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"` // visa, mastercard, paypal
+	Last4    string `json:"last4,omitempty"`
+	ExpiryMM int    `json:"expiry_month,omitempty"`
+	ExpiryYY int    `json:"expiry_year,omitempty"`
+}
+
+// expired reports whether a card is past its expiry month. Methods without
+// an expiry, like PayPal, never expire.
+func (p PaymentMethod) expired(now time.Time) bool {
+	if p.ExpiryYY == 0 {
+		return false
+	}
+	return now.After(time.Date(p.ExpiryYY, time.Month(p.ExpiryMM)+1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// Coupon takes a percentage off eligible courses. An empty CourseIDs list
+// makes it sitewide; a zero MaxUses means unlimited.
+type Coupon struct {
+	Code       string    `json:"code"`
+	PercentOff float64   `json:"percent_off"`
+	CourseIDs  []string  `json:"course_ids,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	MaxUses    int       `json:"max_uses,omitempty"`
+	Uses       int       `json:"uses"`
+}
+
+func (c Coupon) appliesTo(courseID string) bool {
+	if len(c.CourseIDs) == 0 {
+		return true
+	}
+	for _, id := range c.CourseIDs {
+		if id == courseID {
+			return true
+		}
+	}
+	return false
+}
+
+type LineItem struct {
+	CourseID  string      `json:"course_id"`
+	Title     string      `json:"title"`
+	ListPrice money.Money `json:"list_price"`
+	Discount  money.Money `json:"discount"`
+	Price     money.Money `json:"price"`
+}
+
+type CartSummary struct {
+	Items      []LineItem  `json:"items"`
+	CouponCode string      `json:"coupon_code,omitempty"`
+	Subtotal   money.Money `json:"subtotal"`
+	Discount   money.Money `json:"discount"`
+	Total      money.Money `json:"total"`
+}
+
+type Purchase struct {
+	ID              string `json:"id"`
+	UserEmail       string `json:"user_email"`
+	PaymentMethodID string `json:"payment_method_id,omitempty"`
+	CartSummary
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Progress struct {
+	UserEmail         string        `json:"user_email"`
+	CourseID          string        `json:"course_id"`
+	CompletedLectures []string      `json:"completed_lectures"`
+	LastAccessed      time.Time     `json:"last_accessed"`
+	Progress          float64       `json:"progress"` // 0-100
+	QuizAttempts      []QuizAttempt `json:"quiz_attempts,omitempty"`
+}
+
+type Certificate struct {
+	ID               string    `json:"id"`
+	UserEmail        string    `json:"user_email"`
+	CourseID         string    `json:"course_id"`
+	IssuedAt         time.Time `json:"issued_at"`
+	URL              string    `json:"url"`
+	VerificationCode string    `json:"verification_code"`
+}
+
+// CertificateDocument is everything printed on a certificate.
+type CertificateDocument struct {
+	CertificateID    string    `json:"certificate_id"`
+	VerificationCode string    `json:"verification_code"`
+	RecipientName    string    `json:"recipient_name"`
+	CourseTitle      string    `json:"course_title"`
+	Instructor       string    `json:"instructor"`
+	CourseHours      float64   `json:"course_hours"`
+	CompletedAt      time.Time `json:"completed_at"`
+	VerifyURL        string    `json:"verify_url"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users        map[string]User        `json:"users"`
-	Courses      map[string]Course      `json:"courses"`
-	Progress     map[string]Progress    `json:"progress"`
-	Certificates map[string]Certificate `json:"certificates"`
-	mu           sync.RWMutex
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users        server.Repository[User]        `json:"users"`
+	Courses      server.Repository[Course]      `json:"courses"`
+	Progress     server.Repository[Progress]    `json:"progress"`
+	Certificates server.Repository[Certificate] `json:"certificates"`
+	Coupons      server.Repository[Coupon]      `json:"coupons"` // Keyed by code
+	Purchases    server.Repository[Purchase]    `json:"purchases"`
+	Activity     server.Repository[WatchEvent]  `json:"activity"`
+	Reminders    server.Repository[Reminder]    `json:"reminders"`
+	// CourseIndex is the courses' text, for ?search. It is exported, if
+	// not saved, so that each sandbox's copy of the database has its own.
+	CourseIndex *search.Index `json:"-"`
+	mu          sync.RWMutex
+	clock       *server.Clock
 }
 
-var db *Database
+// handlers enroll Udemy students, track lectures watched and issue
+// certificates. clock dates enrollments and sends study reminders.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the courses, progress and purchases in store and indexes
+// the courses.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+var (
+	ErrUserNotFound          = errors.New("user not found")
+	ErrCourseNotFound        = errors.New("course not found")
+	ErrAlreadyEnrolled       = errors.New("already enrolled in this course")
+	ErrAlreadyInCart         = errors.New("course is already in the cart")
+	ErrAlreadyWishlisted     = errors.New("course is already on the wishlist")
+	ErrNotInList             = errors.New("course is not in the list")
+	ErrCartEmpty             = errors.New("cart is empty")
+	ErrCouponNotFound        = errors.New("coupon code is not valid")
+	ErrCouponExpired         = errors.New("coupon has expired")
+	ErrCouponExhausted       = errors.New("coupon has reached its usage limit")
+	ErrCouponNotApplicable   = errors.New("coupon does not apply to any course in the cart")
+	ErrPaymentMethodNotFound = errors.New("payment method not found")
+	ErrPaymentMethodExpired  = errors.New("payment method has expired")
+	ErrPaymentRequired       = errors.New("paid courses must be purchased through checkout")
+	ErrLectureNotFound       = errors.New("lecture not found")
+	ErrNotEnrolled           = errors.New("not enrolled in this course")
+	ErrNotQuiz               = errors.New("lecture is not a quiz")
+	ErrQuizNotPassed         = errors.New("pass the quiz to complete this lecture")
+	ErrCertificateNotFound   = errors.New("certificate not found")
+	ErrInvalidGoal           = errors.New("daily_minutes must be 1-1440, days_per_week 1-7 and reminder_hour 0-23")
+	ErrInvalidWatchMinutes   = errors.New("minutes must be between 1 and the lecture length")
+)
 
 // Helper functions
-func calculateProgress(courseID string, completedLectures []string) float64 {
-	course, exists := db.Courses[courseID]
+func (d *Database) calculateProgress(courseID string, completedLectures []string) float64 {
+	course, exists := d.Courses.Get(courseID)
 	if !exists {
 		return 0
 	}
@@ -100,74 +320,825 @@ func calculateProgress(courseID string, completedLectures []string) float64 {
 	return float64(len(completedLectures)) / float64(totalLectures) * 100
 }
 
-func generateCertificate(userEmail, courseID string) Certificate {
+// defaultPassingScore applies to quizzes that don't set one.
+const defaultPassingScore = 70
+
+func findLecture(course Course, lectureID string) (Lecture, bool) {
+	for _, section := range course.Sections {
+		for _, lecture := range section.Lectures {
+			if lecture.ID == lectureID {
+				return lecture, true
+			}
+		}
+	}
+	return Lecture{}, false
+}
+
+// withoutAnswers returns a copy of the course that is safe to send to
+// students.
+func (c Course) withoutAnswers() Course {
+	sections := make([]Section, len(c.Sections))
+	for i, section := range c.Sections {
+		lectures := make([]Lecture, len(section.Lectures))
+		for j, lecture := range section.Lectures {
+			if lecture.Quiz != nil {
+				quiz := *lecture.Quiz
+				quiz.Questions = make([]QuizQuestion, len(lecture.Quiz.Questions))
+				for k, question := range lecture.Quiz.Questions {
+					question.Answer = nil
+					question.Explanation = ""
+					quiz.Questions[k] = question
+				}
+				lecture.Quiz = &quiz
+			}
+			lectures[j] = lecture
+		}
+		section.Lectures = lectures
+		sections[i] = section
+	}
+	c.Sections = sections
+	return c
+}
+
+func (p Progress) passedQuiz(lectureID string) bool {
+	for _, attempt := range p.QuizAttempts {
+		if attempt.LectureID == lectureID && attempt.Passed {
+			return true
+		}
+	}
+	return false
+}
+
+// markComplete records a finished lecture, refreshes the course percentage
+// and issues the certificate on completion. Callers must hold d.mu.
+func (d *Database) markComplete(progress *Progress, lectureID string) {
+	found := false
+	for _, id := range progress.CompletedLectures {
+		if id == lectureID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		progress.CompletedLectures = append(progress.CompletedLectures, lectureID)
+		// Count whatever part of the lecture wasn't already logged as watched
+		course, _ := d.Courses.Get(progress.CourseID)
+		if lecture, exists := findLecture(course, lectureID); exists {
+			remaining := lecture.Duration
+			for _, event := range d.Activity.List() {
+				if event.UserEmail == progress.UserEmail && event.LectureID == lectureID {
+					remaining -= event.Minutes
+				}
+			}
+			if remaining > 0 {
+				d.recordWatch(progress.UserEmail, progress.CourseID, lectureID, remaining, d.clock.Now())
+			}
+		}
+	}
+	d.saveProgress(progress)
+}
+
+// saveProgress stores progress with a recomputed percentage, issuing a
+// certificate the first time a course reaches 100%. Callers must hold d.mu.
+func (d *Database) saveProgress(progress *Progress) {
+	progress.LastAccessed = d.clock.Now()
+	progress.Progress = d.calculateProgress(progress.CourseID, progress.CompletedLectures)
+	d.Progress.Upsert(progress.UserEmail+"-"+progress.CourseID, *progress)
+
+	if progress.Progress == 100 {
+		for _, cert := range d.Certificates.List() {
+			if cert.UserEmail == progress.UserEmail && cert.CourseID == progress.CourseID {
+				return
+			}
+		}
+		certificate := generateCertificate(progress.UserEmail, progress.CourseID, d.clock.Now())
+		d.Certificates.Upsert(certificate.ID, certificate)
+		if user, exists := d.Users.Get(progress.UserEmail); exists {
+			user.Certificates = append(user.Certificates, certificate.ID)
+			d.Users.Upsert(user.Email, user)
+		}
+	}
+}
+
+// SubmitQuiz grades a quiz attempt. answers maps question IDs to the index
+// of the chosen option; unanswered questions count as wrong. A passing
+// attempt completes the lecture.
+func (d *Database) SubmitQuiz(email, courseID, lectureID string, answers map[string]int) (QuizAttempt, Progress, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return QuizAttempt{}, Progress{}, ErrUserNotFound
+	}
+	course, exists := d.Courses.Get(courseID)
+	if !exists {
+		return QuizAttempt{}, Progress{}, ErrCourseNotFound
+	}
+	if !isEnrolled(user, course.ID) {
+		return QuizAttempt{}, Progress{}, ErrNotEnrolled
+	}
+	lecture, exists := findLecture(course, lectureID)
+	if !exists {
+		return QuizAttempt{}, Progress{}, ErrLectureNotFound
+	}
+	if lecture.Type != "quiz" || lecture.Quiz == nil || len(lecture.Quiz.Questions) == 0 {
+		return QuizAttempt{}, Progress{}, ErrNotQuiz
+	}
+
+	attempt := QuizAttempt{
+		ID:          server.NewID("QATT"),
+		LectureID:   lecture.ID,
+		Results:     make([]QuestionResult, 0, len(lecture.Quiz.Questions)),
+		SubmittedAt: d.clock.Now(),
+	}
+	correct := 0
+	for _, question := range lecture.Quiz.Questions {
+		result := QuestionResult{QuestionID: question.ID, Explanation: question.Explanation}
+		if question.Answer != nil {
+			result.Answer = *question.Answer
+		}
+		if selected, answered := answers[question.ID]; answered {
+			result.Selected = &selected
+			result.Correct = question.Answer != nil && selected == *question.Answer
+		}
+		if result.Correct {
+			correct++
+		}
+		attempt.Results = append(attempt.Results, result)
+	}
+	passing := lecture.Quiz.PassingScore
+	if passing <= 0 {
+		passing = defaultPassingScore
+	}
+	attempt.Score = math.Round(float64(correct)/float64(len(lecture.Quiz.Questions))*1000) / 10
+	attempt.Passed = attempt.Score >= passing
+
+	progress, exists := d.Progress.Get(user.Email + "-" + course.ID)
+	if !exists {
+		progress = Progress{UserEmail: user.Email, CourseID: course.ID}
+	}
+	progress.QuizAttempts = append(progress.QuizAttempts, attempt)
+	if attempt.Passed {
+		d.markComplete(&progress, lecture.ID)
+	} else {
+		d.saveProgress(&progress)
+	}
+	return attempt, progress, nil
+}
+
+const certificateVerifyBase = "https://udemy.com/certificate/"
+
+func generateCertificate(userEmail, courseID string, now time.Time) Certificate {
+	code := "UC-" + strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:12])
 	return Certificate{
-		ID:        uuid.New().String(),
-		UserEmail: userEmail,
+		ID:               server.NewID("CERT"),
+		UserEmail:        userEmail,
+		CourseID:         courseID,
+		IssuedAt:         now,
+		URL:              certificateVerifyBase + code,
+		VerificationCode: code,
+	}
+}
+
+// certificateDocument fills in a certificate's printable details. Callers
+// must hold d.mu.
+func (d *Database) certificateDocument(cert Certificate) CertificateDocument {
+	course, _ := d.Courses.Get(cert.CourseID)
+	recipient, _ := d.Users.Get(cert.UserEmail)
+	minutes := 0
+	for _, section := range course.Sections {
+		for _, lecture := range section.Lectures {
+			minutes += lecture.Duration
+		}
+	}
+	return CertificateDocument{
+		CertificateID:    cert.ID,
+		VerificationCode: cert.VerificationCode,
+		RecipientName:    recipient.Name,
+		CourseTitle:      course.Title,
+		Instructor:       course.Instructor,
+		CourseHours:      math.Round(float64(minutes)/60*10) / 10,
+		CompletedAt:      cert.IssuedAt,
+		VerifyURL:        certificateVerifyBase + cert.VerificationCode,
+	}
+}
+
+func (d *Database) GetCertificates(email string) ([]CertificateDocument, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, exists := d.Users.Get(email); !exists {
+		return nil, ErrUserNotFound
+	}
+	docs := []CertificateDocument{}
+	for _, cert := range d.Certificates.List() {
+		if cert.UserEmail == email {
+			docs = append(docs, d.certificateDocument(cert))
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].CompletedAt.After(docs[j].CompletedAt) })
+	return docs, nil
+}
+
+func (d *Database) GetCertificateDocument(id string) (CertificateDocument, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	cert, exists := d.Certificates.Get(id)
+	if !exists {
+		return CertificateDocument{}, ErrCertificateNotFound
+	}
+	return d.certificateDocument(cert), nil
+}
+
+func (d *Database) VerifyCertificate(code string) (CertificateDocument, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, cert := range d.Certificates.List() {
+		if strings.EqualFold(cert.VerificationCode, code) {
+			return d.certificateDocument(cert), nil
+		}
+	}
+	return CertificateDocument{}, ErrCertificateNotFound
+}
+
+// certificatePage lays out a one-page landscape certificate.
+func certificatePage(doc CertificateDocument) pdf.Page {
+	return pdf.Page{Width: pdf.LetterHeight, Height: pdf.LetterWidth, Lines: []pdf.Line{
+		{Bold: true, Size: 30, X: 72, Y: 470, Text: "Certificate of Completion"},
+		{Size: 14, X: 72, Y: 420, Text: "This is to certify that"},
+		{Bold: true, Size: 26, X: 72, Y: 380, Text: doc.RecipientName},
+		{Size: 14, X: 72, Y: 340, Text: "has successfully completed"},
+		{Bold: true, Size: 20, X: 72, Y: 305, Text: doc.CourseTitle},
+		{Size: 12, X: 72, Y: 270, Text: fmt.Sprintf("Instructor: %s  |  %.1f total hours", doc.Instructor, doc.CourseHours)},
+		{Size: 12, X: 72, Y: 250, Text: "Completed on " + doc.CompletedAt.Format("January 2, 2006")},
+		{Size: 10, X: 72, Y: 120, Text: "Certificate no: " + doc.VerificationCode},
+		{Size: 10, X: 72, Y: 104, Text: "Verify at " + doc.VerifyURL},
+	}}
+}
+
+const (
+	dayLayout           = "2006-01-02"
+	defaultReminderHour = 18
+)
+
+// recordWatch logs lecture time. Callers must hold d.mu.
+func (d *Database) recordWatch(email, courseID, lectureID string, minutes int, now time.Time) WatchEvent {
+	event := WatchEvent{
+		ID:        server.NewID("WEV"),
+		UserEmail: email,
 		CourseID:  courseID,
-		IssuedAt:  time.Now(),
-		URL:       "https://udemy.com/certificates/" + uuid.New().String(),
+		LectureID: lectureID,
+		Minutes:   minutes,
+		WatchedAt: now,
+	}
+	d.Activity.Upsert(event.ID, event)
+	return event
+}
+
+// RecordWatch logs partial viewing of a lecture; completing it later only
+// counts the minutes not already logged.
+func (d *Database) RecordWatch(email, courseID, lectureID string, minutes int) (WatchEvent, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return WatchEvent{}, ErrUserNotFound
+	}
+	course, exists := d.Courses.Get(courseID)
+	if !exists {
+		return WatchEvent{}, ErrCourseNotFound
+	}
+	if !isEnrolled(user, course.ID) {
+		return WatchEvent{}, ErrNotEnrolled
+	}
+	lecture, exists := findLecture(course, lectureID)
+	if !exists {
+		return WatchEvent{}, ErrLectureNotFound
+	}
+	if minutes < 1 || minutes > lecture.Duration {
+		return WatchEvent{}, ErrInvalidWatchMinutes
+	}
+	return d.recordWatch(user.Email, course.ID, lecture.ID, minutes, d.clock.Now()), nil
+}
+
+func (d *Database) SetLearningGoal(email string, goal LearningGoal) (LearningGoal, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return LearningGoal{}, ErrUserNotFound
+	}
+	if goal.DailyMinutes < 1 || goal.DailyMinutes > 1440 || goal.DaysPerWeek < 1 || goal.DaysPerWeek > 7 ||
+		goal.ReminderHour < 0 || goal.ReminderHour > 23 {
+		return LearningGoal{}, ErrInvalidGoal
+	}
+	goal.UpdatedAt = d.clock.Now()
+	user.LearningGoal = &goal
+	d.Users.Upsert(user.Email, user)
+	return goal, nil
+}
+
+// minutesByDay totals a user's watch time per UTC day. Callers must hold
+// d.mu.
+func (d *Database) minutesByDay(email string) map[string]int {
+	days := make(map[string]int)
+	for _, event := range d.Activity.List() {
+		if event.UserEmail == email {
+			days[event.WatchedAt.UTC().Format(dayLayout)] += event.Minutes
+		}
+	}
+	return days
+}
+
+func goalMet(minutes int, goal *LearningGoal) bool {
+	if goal == nil {
+		return minutes > 0
+	}
+	return minutes >= goal.DailyMinutes
+}
+
+func startOfWeek(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// learningStats measures activity against the user's goal as of now.
+// Without a goal any watch time counts as an active day. Callers must hold
+// d.mu.
+func (d *Database) learningStats(user User, now time.Time) LearningStats {
+	now = now.UTC()
+	goal := user.LearningGoal
+	days := d.minutesByDay(user.Email)
+	met := func(day time.Time) bool { return goalMet(days[day.Format(dayLayout)], goal) }
+
+	stats := LearningStats{Goal: goal}
+	for _, minutes := range days {
+		stats.TotalMinutes += minutes
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	stats.Today = DayActivity{Date: today.Format(dayLayout), Minutes: days[today.Format(dayLayout)], GoalMet: met(today)}
+
+	weekStart := startOfWeek(today)
+	stats.Week = WeekProgress{Start: weekStart.Format(dayLayout), Days: []DayActivity{}}
+	for day := weekStart; !day.After(today); day = day.AddDate(0, 0, 1) {
+		activity := DayActivity{Date: day.Format(dayLayout), Minutes: days[day.Format(dayLayout)], GoalMet: met(day)}
+		stats.Week.Days = append(stats.Week.Days, activity)
+		stats.Week.Minutes += activity.Minutes
+		if activity.GoalMet {
+			stats.Week.ActiveDays++
+		}
+	}
+	if goal != nil {
+		stats.Week.DaysGoal = goal.DaysPerWeek
+		stats.Week.Expected = goal.DaysPerWeek * len(stats.Week.Days) / 7
+	}
+	stats.Week.OnTrack = stats.Week.ActiveDays >= stats.Week.Expected
+
+	// Today still counts toward the streak until it's over
+	day := today
+	if !met(day) {
+		day = day.AddDate(0, 0, -1)
+	}
+	for ; met(day); day = day.AddDate(0, 0, -1) {
+		stats.CurrentStreak++
+	}
+
+	var dates []string
+	for date, minutes := range days {
+		if goalMet(minutes, goal) {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+	run := 0
+	var prev time.Time
+	for _, date := range dates {
+		day, _ := time.Parse(dayLayout, date)
+		if run > 0 && day.Equal(prev.AddDate(0, 0, 1)) {
+			run++
+		} else {
+			run = 1
+		}
+		prev = day
+		if run > stats.LongestStreak {
+			stats.LongestStreak = run
+		}
+	}
+
+	if goal != nil {
+		// The current week only counts once it has met the goal
+		week := weekStart
+		if stats.Week.ActiveDays < goal.DaysPerWeek {
+			week = week.AddDate(0, 0, -7)
+		}
+		for {
+			active := 0
+			for i := 0; i < 7; i++ {
+				if met(week.AddDate(0, 0, i)) {
+					active++
+				}
+			}
+			if active < goal.DaysPerWeek {
+				break
+			}
+			stats.WeeklyStreak++
+			week = week.AddDate(0, 0, -7)
+		}
+	}
+	return stats
+}
+
+func (d *Database) GetLearningStats(email string) (LearningStats, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return LearningStats{}, ErrUserNotFound
+	}
+	return d.learningStats(user, d.clock.Now()), nil
+}
+
+// SendDueReminders records a reminder for each user who is behind pace on
+// their weekly goal, hasn't met today's goal and is past their reminder
+// hour. Users get at most one reminder a day.
+func (d *Database) SendDueReminders(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now = now.UTC()
+	today := now.Format(dayLayout)
+	reminded := make(map[string]bool)
+	for _, reminder := range d.Reminders.List() {
+		if reminder.Date == today {
+			reminded[reminder.UserEmail] = true
+		}
+	}
+
+	sent := 0
+	for _, user := range d.Users.List() {
+		goal := user.LearningGoal
+		if goal == nil || !goal.Reminders || now.Hour() < goal.ReminderHour || reminded[user.Email] {
+			continue
+		}
+		stats := d.learningStats(user, now)
+		if stats.Week.OnTrack || stats.Today.GoalMet {
+			continue
+		}
+		reminder := Reminder{
+			ID:        server.NewID("RMD"),
+			UserEmail: user.Email,
+			Date:      today,
+			Message: fmt.Sprintf("You've hit your goal on %d of %d days this week. A %d-minute session today gets you back on track.",
+				stats.Week.ActiveDays, goal.DaysPerWeek, goal.DailyMinutes-stats.Today.Minutes),
+			CreatedAt: now,
+		}
+		d.Reminders.Upsert(reminder.ID, reminder)
+		sent++
+	}
+	return sent
+}
+
+func (d *Database) GetReminders(email string) ([]Reminder, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, exists := d.Users.Get(email); !exists {
+		return nil, ErrUserNotFound
+	}
+	reminders := d.Reminders.By("user_email", email)
+	sort.Slice(reminders, func(i, j int) bool { return reminders[i].CreatedAt.After(reminders[j].CreatedAt) })
+	return reminders, nil
+}
+
+func (h *handlers) runReminders(interval time.Duration) {
+	h.clock.Every(interval, func(now time.Time) {
+		db := h.db.Get()
+		if n := db.SendDueReminders(now); n > 0 {
+			log.Printf("Sent %d learning reminder(s)", n)
+		}
+	})
+}
+
+func isEnrolled(user User, courseID string) bool {
+	for _, id := range user.EnrolledCourses {
+		if id == courseID {
+			return true
+		}
+	}
+	return false
+}
+
+func removeID(ids []string, id string) ([]string, bool) {
+	for i, existing := range ids {
+		if existing == id {
+			return append(ids[:i:i], ids[i+1:]...), true
+		}
+	}
+	return ids, false
+}
+
+// enroll adds a course to a user's library and starts their progress.
+// Callers must hold d.mu.
+func (d *Database) enroll(user *User, course *Course, now time.Time) {
+	user.EnrolledCourses = append(user.EnrolledCourses, course.ID)
+	d.Progress.Upsert(user.Email+"-"+course.ID, Progress{
+		UserEmail:    user.Email,
+		CourseID:     course.ID,
+		LastAccessed: now,
+		Progress:     0,
+	})
+	course.StudentsCount++
+	d.Courses.Upsert(course.ID, *course)
+}
+
+// AddToList puts a course on a user's wishlist or in their cart. Moving a
+// course into the cart takes it off the wishlist.
+func (d *Database) AddToList(email, courseID string, cart bool) (User, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return User{}, ErrUserNotFound
+	}
+	course, exists := d.Courses.Get(courseID)
+	if !exists {
+		return User{}, ErrCourseNotFound
+	}
+	if isEnrolled(user, course.ID) {
+		return User{}, ErrAlreadyEnrolled
+	}
+
+	if cart {
+		if _, found := removeID(user.Cart, course.ID); found {
+			return User{}, ErrAlreadyInCart
+		}
+		user.Cart = append(user.Cart, course.ID)
+		user.Wishlist, _ = removeID(user.Wishlist, course.ID)
+	} else {
+		if _, found := removeID(user.Wishlist, course.ID); found {
+			return User{}, ErrAlreadyWishlisted
+		}
+		user.Wishlist = append(user.Wishlist, course.ID)
+	}
+	d.Users.Upsert(user.Email, user)
+	return user, nil
+}
+
+func (d *Database) RemoveFromList(email, courseID string, cart bool) (User, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return User{}, ErrUserNotFound
+	}
+	found := false
+	if cart {
+		user.Cart, found = removeID(user.Cart, courseID)
+	} else {
+		user.Wishlist, found = removeID(user.Wishlist, courseID)
+	}
+	if !found {
+		return User{}, ErrNotInList
+	}
+	d.Users.Upsert(user.Email, user)
+	return user, nil
+}
+
+// priceCart prices a user's cart with an optional coupon. Callers must hold
+// d.mu.
+func (d *Database) priceCart(user User, couponCode string, now time.Time) (CartSummary, error) {
+	summary := CartSummary{Items: []LineItem{}}
+	var coupon *Coupon
+	if couponCode != "" {
+		found, exists := d.Coupons.Get(strings.ToUpper(couponCode))
+		if !exists {
+			return CartSummary{}, ErrCouponNotFound
+		}
+		if now.After(found.ExpiresAt) {
+			return CartSummary{}, ErrCouponExpired
+		}
+		if found.MaxUses > 0 && found.Uses >= found.MaxUses {
+			return CartSummary{}, ErrCouponExhausted
+		}
+		coupon = &found
+		summary.CouponCode = found.Code
+	}
+
+	applied := false
+	for _, courseID := range user.Cart {
+		course, exists := d.Courses.Get(courseID)
+		if !exists {
+			continue
+		}
+		item := LineItem{CourseID: course.ID, Title: course.Title, ListPrice: course.Price}
+		if coupon != nil && coupon.appliesTo(course.ID) {
+			item.Discount = course.Price.Mul(coupon.PercentOff / 100)
+			applied = true
+		}
+		var err error
+		if item.Price, err = item.ListPrice.Sub(item.Discount); err != nil {
+			return CartSummary{}, err
+		}
+		summary.Items = append(summary.Items, item)
+		if summary.Subtotal, err = summary.Subtotal.Add(item.ListPrice); err != nil {
+			return CartSummary{}, err
+		}
+		if summary.Discount, err = summary.Discount.Add(item.Discount); err != nil {
+			return CartSummary{}, err
+		}
+	}
+	if coupon != nil && !applied && len(summary.Items) > 0 {
+		return CartSummary{}, ErrCouponNotApplicable
+	}
+	total, err := summary.Subtotal.Sub(summary.Discount)
+	if err != nil {
+		return CartSummary{}, err
+	}
+	summary.Total = total
+	return summary, nil
+}
+
+func (d *Database) GetCart(email, couponCode string) (CartSummary, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return CartSummary{}, ErrUserNotFound
 	}
+	return d.priceCart(user, couponCode, d.clock.Now())
+}
+
+// Checkout charges the cart to a payment method, records the purchase and
+// enrolls the user in every course bought. A cart that comes to nothing
+// after discounts needs no payment method.
+func (d *Database) Checkout(email, paymentMethodID, couponCode string) (Purchase, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	user, exists := d.Users.Get(email)
+	if !exists {
+		return Purchase{}, ErrUserNotFound
+	}
+	if len(user.Cart) == 0 {
+		return Purchase{}, ErrCartEmpty
+	}
+	summary, err := d.priceCart(user, couponCode, now)
+	if err != nil {
+		return Purchase{}, err
+	}
+	if summary.Total.IsPositive() {
+		var method *PaymentMethod
+		for i := range user.PaymentMethods {
+			if user.PaymentMethods[i].ID == paymentMethodID {
+				method = &user.PaymentMethods[i]
+			}
+		}
+		if method == nil {
+			return Purchase{}, ErrPaymentMethodNotFound
+		}
+		if method.expired(now) {
+			return Purchase{}, ErrPaymentMethodExpired
+		}
+	} else {
+		paymentMethodID = ""
+	}
+
+	purchase := Purchase{
+		ID:              server.NewID("PUR"),
+		UserEmail:       user.Email,
+		PaymentMethodID: paymentMethodID,
+		CartSummary:     summary,
+		CreatedAt:       now,
+	}
+	for _, item := range summary.Items {
+		course, _ := d.Courses.Get(item.CourseID)
+		d.enroll(&user, &course, now)
+		user.Wishlist, _ = removeID(user.Wishlist, course.ID)
+	}
+	user.Cart = []string{}
+	if summary.CouponCode != "" {
+		coupon, _ := d.Coupons.Get(summary.CouponCode)
+		coupon.Uses++
+		d.Coupons.Upsert(coupon.Code, coupon)
+	}
+
+	d.Users.Upsert(user.Email, user)
+	d.Purchases.Upsert(purchase.ID, purchase)
+	return purchase, nil
+}
+
+func (d *Database) GetPurchases(email string) []Purchase {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	purchases := d.Purchases.By("user_email", email)
+	sort.Slice(purchases, func(i, j int) bool { return purchases[i].CreatedAt.After(purchases[j].CreatedAt) })
+	return purchases
 }
 
 // HTTP Handlers
-func getCourses(c *fiber.Ctx) error {
+// courseIndex returns the index of courses' text, making it for a
+// database that hasn't one, such as a new sandbox's copy.
+func (d *Database) courseIndex() *search.Index {
+	d.mu.RLock()
+	index := d.CourseIndex
+	d.mu.RUnlock()
+	if index != nil {
+		return index
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.CourseIndex == nil {
+		d.CourseIndex = indexCourses(&d.Courses)
+	}
+	return d.CourseIndex
+}
+
+func indexCourses(courses *server.Repository[Course]) *search.Index {
+	index := search.New()
+	for _, id := range courses.Keys() {
+		course, _ := courses.Get(id)
+		index.Add(id,
+			search.Field{Text: course.Title, Weight: 3},
+			search.Field{Text: course.Instructor, Weight: 2},
+			search.Field{Text: course.Description, Weight: 1})
+	}
+	return index
+}
+
+func (h *handlers) getCourses(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	category := c.Query("category")
-	search := c.Query("search")
+	query := c.Query("search")
 
+	var ids []string
+	if query != "" {
+		ids = search.IDs(db.courseIndex().Search(query))
+	}
 	var courses []Course
 	db.mu.RLock()
-	for _, course := range db.Courses {
-		if category != "" && course.Category != category {
-			continue
+	if query == "" {
+		for _, id := range db.Courses.Keys() {
+			ids = append(ids, id)
 		}
-		// Simple search implementation
-		if search != "" && !strings.Contains(strings.ToLower(course.Title), strings.ToLower(search)) {
+	}
+	for _, id := range ids {
+		course, ok := db.Courses.Get(id)
+		if !ok || category != "" && course.Category != category {
 			continue
 		}
-		courses = append(courses, course)
+		courses = append(courses, course.withoutAnswers())
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(courses)
+	return server.List(c, courses, "category")
 }
 
-func getCourseDetails(c *fiber.Ctx) error {
+func (h *handlers) getCourseDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	courseID := c.Params("courseId")
 
 	db.mu.RLock()
-	course, exists := db.Courses[courseID]
+	course, exists := db.Courses.Get(courseID)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Course not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Course not found")
 	}
 
-	return c.JSON(course)
+	return c.JSON(course.withoutAnswers())
 }
 
-func getUserCourses(c *fiber.Ctx) error {
+func (h *handlers) getUserCourses(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Params("email")
 
 	db.mu.RLock()
-	user, exists := db.Users[email]
+	user, exists := db.Users.Get(email)
 	if !exists {
 		db.mu.RUnlock()
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	var enrolledCourses []map[string]interface{}
 	for _, courseID := range user.EnrolledCourses {
-		course, exists := db.Courses[courseID]
+		course, exists := db.Courses.Get(courseID)
 		if !exists {
 			continue
 		}
 
-		progress, exists := db.Progress[email+"-"+courseID]
+		progress, exists := db.Progress.Get(email + "-" + courseID)
 		if !exists {
 			progress = Progress{
 				UserEmail: email,
@@ -177,14 +1148,14 @@ func getUserCourses(c *fiber.Ctx) error {
 		}
 
 		enrolledCourse := map[string]interface{}{
-			"course":        course,
+			"course":        course.withoutAnswers(),
 			"progress":      progress.Progress,
 			"last_accessed": progress.LastAccessed,
 		}
 
 		// Add certificate if course is completed
 		if progress.Progress == 100 {
-			for _, cert := range db.Certificates {
+			for _, cert := range db.Certificates.List() {
 				if cert.UserEmail == email && cert.CourseID == courseID {
 					enrolledCourse["completion_certificate"] = cert.URL
 					break
@@ -199,91 +1170,73 @@ func getUserCourses(c *fiber.Ctx) error {
 	return c.JSON(enrolledCourses)
 }
 
-func enrollInCourse(c *fiber.Ctx) error {
+func (h *handlers) enrollInCourse(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	courseID := c.Params("courseId")
 
 	var req struct {
-		UserEmail     string `json:"user_email"`
+		UserEmail     string `json:"user_email" validate:"email"`
 		PaymentMethod string `json:"payment_method"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	user, exists := db.Users[req.UserEmail]
+	user, exists := db.Users.Get(req.UserEmail)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
-	course, exists := db.Courses[courseID]
+	course, exists := db.Courses.Get(courseID)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Course not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Course not found")
 	}
 
 	// Check if already enrolled
-	for _, enrolledCourseID := range user.EnrolledCourses {
-		if enrolledCourseID == courseID {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Already enrolled in this course",
-			})
-		}
+	if isEnrolled(user, course.ID) {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Already enrolled in this course")
 	}
 
-	// Update user's enrolled courses
-	user.EnrolledCourses = append(user.EnrolledCourses, courseID)
-	db.Users[req.UserEmail] = user
-
-	// Initialize progress
-	db.Progress[req.UserEmail+"-"+courseID] = Progress{
-		UserEmail:    req.UserEmail,
-		CourseID:     courseID,
-		LastAccessed: time.Now(),
-		Progress:     0,
+	// Paid courses go through the cart
+	if course.Price.IsPositive() {
+		return server.FailWith(c, fiber.StatusPaymentRequired, ErrPaymentRequired)
 	}
 
-	// Update course statistics
-	course.StudentsCount++
-	db.Courses[courseID] = course
+	db.enroll(&user, &course, h.clock.Now())
+	user.Cart, _ = removeID(user.Cart, course.ID)
+	user.Wishlist, _ = removeID(user.Wishlist, course.ID)
+	db.Users.Upsert(user.Email, user)
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"message": "Successfully enrolled in course",
 	})
 }
 
-func updateProgress(c *fiber.Ctx) error {
+func (h *handlers) updateProgress(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	courseID := c.Params("courseId")
 
 	var req struct {
-		UserEmail string `json:"user_email"`
+		UserEmail string `json:"user_email" validate:"email"`
 		LectureID string `json:"lecture_id"`
 		Completed bool   `json:"completed"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	// Verify user is enrolled
-	user, exists := db.Users[req.UserEmail]
+	user, exists := db.Users.Get(req.UserEmail)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "User not found")
 	}
 
 	isEnrolled := false
@@ -295,125 +1248,405 @@ func updateProgress(c *fiber.Ctx) error {
 	}
 
 	if !isEnrolled {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "Not enrolled in this course",
-		})
+		return server.Fail(c, fiber.StatusForbidden, server.CodeForbidden, "Not enrolled in this course")
 	}
 
 	// Update progress
 	progressKey := req.UserEmail + "-" + courseID
-	progress, exists := db.Progress[progressKey]
+	progress, exists := db.Progress.Get(progressKey)
 	if !exists {
 		progress = Progress{
-			UserEmail: req.UserEmail,
+			UserEmail: user.Email,
 			CourseID:  courseID,
 		}
 	}
 
 	if req.Completed {
-		// Add lecture to completed lectures if not already present
-		found := false
-		for _, lectureID := range progress.CompletedLectures {
-			if lectureID == req.LectureID {
-				found = true
-				break
-			}
+		// Quizzes are completed by passing them
+		course, _ := db.Courses.Get(courseID)
+		lecture, _ := findLecture(course, req.LectureID)
+		if lecture.Type == "quiz" && lecture.Quiz != nil && !progress.passedQuiz(lecture.ID) {
+			return server.FailWith(c, fiber.StatusConflict, ErrQuizNotPassed)
 		}
-		if !found {
-			progress.CompletedLectures = append(progress.CompletedLectures, req.LectureID)
+		db.markComplete(&progress, req.LectureID)
+		return c.JSON(progress)
+	}
+
+	// Remove lecture from completed lectures
+	var updatedLectures []string
+	for _, lectureID := range progress.CompletedLectures {
+		if lectureID != req.LectureID {
+			updatedLectures = append(updatedLectures, lectureID)
 		}
-	} else {
-		// Remove lecture from completed lectures
-		var updatedLectures []string
-		for _, lectureID := range progress.CompletedLectures {
-			if lectureID != req.LectureID {
-				updatedLectures = append(updatedLectures, lectureID)
-			}
+	}
+	progress.CompletedLectures = updatedLectures
+
+	// saveProgress issues the certificate if the course is now complete
+	db.saveProgress(&progress)
+
+	return c.JSON(progress)
+}
+
+func (h *handlers) submitQuiz(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail string         `json:"user_email" validate:"email"`
+		Answers   map[string]int `json:"answers"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	attempt, progress, err := db.SubmitQuiz(req.UserEmail, c.Params("courseId"), c.Params("lectureId"), req.Answers)
+	if err != nil {
+		switch err {
+		case ErrUserNotFound, ErrCourseNotFound, ErrLectureNotFound:
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case ErrNotEnrolled:
+			return server.FailWith(c, fiber.StatusForbidden, err)
+		case ErrNotQuiz:
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		default:
+			return server.FailWith(c, fiber.StatusInternalServerError, err)
 		}
-		progress.CompletedLectures = updatedLectures
 	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"attempt":  attempt,
+		"progress": progress,
+	})
+}
 
-	progress.LastAccessed = time.Now()
-	progress.Progress = calculateProgress(courseID, progress.CompletedLectures)
-	db.Progress[progressKey] = progress
+func (h *handlers) recordWatch(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		UserEmail string `json:"user_email" validate:"email"`
+		Minutes   int    `json:"minutes"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
 
-	// If course is completed (100%), generate certificate if not already issued
-	if progress.Progress == 100 {
-		certificateExists := false
-		for _, cert := range db.Certificates {
-			if cert.UserEmail == req.UserEmail && cert.CourseID == courseID {
-				certificateExists = true
-				break
+	event, err := db.RecordWatch(req.UserEmail, c.Params("courseId"), c.Params("lectureId"), req.Minutes)
+	if err != nil {
+		return learningError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(event)
+}
+
+func (h *handlers) getLearningGoal(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	user, exists := db.Users.Get(c.Params("email"))
+	if !exists {
+		return learningError(c, ErrUserNotFound)
+	}
+	if user.LearningGoal == nil {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "no learning goal set")
+	}
+	return c.JSON(user.LearningGoal)
+}
+
+func (h *handlers) setLearningGoal(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		DailyMinutes int   `json:"daily_minutes"`
+		DaysPerWeek  int   `json:"days_per_week"`
+		ReminderHour *int  `json:"reminder_hour"`
+		Reminders    *bool `json:"reminders"`
+	}
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	goal := LearningGoal{
+		DailyMinutes: req.DailyMinutes,
+		DaysPerWeek:  req.DaysPerWeek,
+		ReminderHour: defaultReminderHour,
+		Reminders:    true,
+	}
+	if req.ReminderHour != nil {
+		goal.ReminderHour = *req.ReminderHour
+	}
+	if req.Reminders != nil {
+		goal.Reminders = *req.Reminders
+	}
+	goal, err := db.SetLearningGoal(c.Params("email"), goal)
+	if err != nil {
+		return learningError(c, err)
+	}
+	return c.JSON(goal)
+}
+
+func (h *handlers) getLearningStats(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	stats, err := db.GetLearningStats(email)
+	if err != nil {
+		return learningError(c, err)
+	}
+	return c.JSON(stats)
+}
+
+func (h *handlers) getReminders(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	reminders, err := db.GetReminders(c.Params("email"))
+	if err != nil {
+		return learningError(c, err)
+	}
+	return server.List(c, reminders)
+}
+
+func learningError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrUserNotFound, ErrCourseNotFound, ErrLectureNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrNotEnrolled:
+		return server.FailWith(c, fiber.StatusForbidden, err)
+	case ErrInvalidGoal, ErrInvalidWatchMinutes:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) getCertificates(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	email := c.Query("email")
+	if email == "" {
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
+	}
+
+	docs, err := db.GetCertificates(email)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+	return server.List(c, docs)
+}
+
+// downloadCertificate renders a certificate as a PDF, or as JSON with
+// ?format=json.
+func (h *handlers) downloadCertificate(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	doc, err := db.GetCertificateDocument(c.Params("id"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	}
+
+	switch c.Query("format", "pdf") {
+	case "pdf":
+		file, err := server.StoreFile(certificatePage(doc).Render(), pdf.MIMEApplicationPDF, "certificate-"+doc.VerificationCode+".pdf")
+		if err != nil {
+			return err
+		}
+		return server.ServeFile(c, file.ID, file.Name)
+	case "json":
+		return c.JSON(doc)
+	default:
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "format must be pdf or json")
+	}
+}
+
+func (h *handlers) verifyCertificate(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	doc, err := db.VerifyCertificate(c.Params("code"))
+	if err != nil {
+		return server.FailWith(c, fiber.StatusNotFound,
+			server.NewError(server.CodeNotFound, err.Error()).WithDetails(fiber.Map{"valid": false}))
+	}
+	return c.JSON(fiber.Map{
+		"valid":       true,
+		"certificate": doc,
+	})
+}
+
+// listHandlers returns the get/add/remove handlers for the wishlist or cart.
+func (h *handlers) listHandlers(cart bool) (get, add, remove fiber.Handler) {
+	get = func(c *fiber.Ctx) error {
+		db := h.db.In(c)
+		if cart {
+			summary, err := db.GetCart(c.Params("email"), c.Query("coupon"))
+			if err != nil {
+				return commerceError(c, err)
 			}
+			return c.JSON(summary)
 		}
-		if !certificateExists {
-			certificate := generateCertificate(req.UserEmail, courseID)
-			db.Certificates[certificate.ID] = certificate
+
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		user, exists := db.Users.Get(c.Params("email"))
+		if !exists {
+			return commerceError(c, ErrUserNotFound)
+		}
+		courses := []Course{}
+		for _, id := range user.Wishlist {
+			if course, exists := db.Courses.Get(id); exists {
+				courses = append(courses, course.withoutAnswers())
+			}
 		}
+		return c.JSON(courses)
 	}
-
-	return c.JSON(progress)
+	add = func(c *fiber.Ctx) error {
+		var req struct {
+			CourseID string `json:"course_id"`
+		}
+		if err := server.Bind(c, &req); err != nil {
+			return err
+		}
+		user, err := h.db.In(c).AddToList(c.Params("email"), req.CourseID, cart)
+		if err != nil {
+			return commerceError(c, err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(user)
+	}
+	remove = func(c *fiber.Ctx) error {
+		user, err := h.db.In(c).RemoveFromList(c.Params("email"), c.Params("courseId"), cart)
+		if err != nil {
+			return commerceError(c, err)
+		}
+		return c.JSON(user)
+	}
+	return get, add, remove
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
+func (h *handlers) checkout(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		PaymentMethodID string `json:"payment_method_id"`
+		CouponCode      string `json:"coupon_code"`
+	}
+	if err := server.Bind(c, &req); err != nil {
 		return err
 	}
 
-	db = &Database{
-		Users:        make(map[string]User),
-		Courses:      make(map[string]Course),
-		Progress:     make(map[string]Progress),
-		Certificates: make(map[string]Certificate),
+	purchase, err := db.Checkout(c.Params("email"), req.PaymentMethodID, req.CouponCode)
+	if err != nil {
+		return commerceError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(purchase)
+}
+
+func (h *handlers) getPurchases(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	return server.List(c, db.GetPurchases(c.Params("email")))
+}
+
+func commerceError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, money.ErrMixedCurrencies) {
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	}
+	switch err {
+	case ErrUserNotFound, ErrCourseNotFound, ErrNotInList, ErrCouponNotFound, ErrPaymentMethodNotFound:
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case ErrAlreadyEnrolled, ErrAlreadyInCart, ErrAlreadyWishlisted:
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case ErrPaymentMethodExpired:
+		return server.FailWith(c, fiber.StatusPaymentRequired, err)
+	case ErrCartEmpty, ErrCouponExpired, ErrCouponExhausted, ErrCouponNotApplicable:
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	default:
+		return server.FailWith(c, fiber.StatusInternalServerError, err)
+	}
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	return json.Unmarshal(data, db)
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	db.CourseIndex = indexCourses(&db.Courses)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Course routes
-	api.Get("/courses", getCourses)
-	api.Get("/courses/:courseId", getCourseDetails)
-	api.Post("/courses/:courseId/enroll", enrollInCourse)
-	api.Put("/courses/:courseId/progress", updateProgress)
+	api.Get("/courses", h.getCourses)
+	api.Get("/courses/:courseId", h.getCourseDetails)
+	api.Post("/courses/:courseId/enroll", h.enrollInCourse)
+	api.Put("/courses/:courseId/progress", h.updateProgress)
+	api.Post("/courses/:courseId/lectures/:lectureId/quiz", h.submitQuiz)
+	api.Post("/courses/:courseId/lectures/:lectureId/watch", h.recordWatch)
 
 	// User routes
-	api.Get("/users/:email/courses", getUserCourses)
+	api.Get("/users/:email/courses", h.getUserCourses)
+
+	// Learning goal routes
+	api.Get("/users/:email/learning-goal", h.getLearningGoal)
+	api.Put("/users/:email/learning-goal", h.setLearningGoal)
+	api.Get("/users/:email/reminders", h.getReminders)
+	api.Get("/learning-stats", h.getLearningStats)
+
+	// Certificate routes
+	api.Get("/certificates", h.getCertificates)
+	api.Get("/certificates/verify/:code", h.verifyCertificate)
+	api.Get("/certificates/:id/download", h.downloadCertificate)
+
+	// Wishlist, cart and checkout routes
+	getWishlist, addToWishlist, removeFromWishlist := h.listHandlers(false)
+	api.Get("/users/:email/wishlist", getWishlist)
+	api.Post("/users/:email/wishlist", addToWishlist)
+	api.Delete("/users/:email/wishlist/:courseId", removeFromWishlist)
+	getCart, addToCart, removeFromCart := h.listHandlers(true)
+	api.Get("/users/:email/cart", getCart)
+	api.Post("/users/:email/cart", addToCart)
+	api.Delete("/users/:email/cart/:courseId", removeFromCart)
+	api.Post("/users/:email/checkout", h.checkout)
+	api.Get("/users/:email/purchases", h.getPurchases)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"purchases", "progress", "certificates", "activity", "reminders"},
+			Search:  []string{"courses"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithFiles(cfg),
+	)
+	setupRoutes(app, h)
+	go h.runReminders(time.Minute)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,29 +1,37 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/money"
+	"pkg/pdf"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Airport struct {
-	Code    string  `json:"code"`
-	Name    string  `json:"name"`
-	City    string  `json:"city"`
-	Country string  `json:"country"`
-	Lat     float64 `json:"latitude"`
-	Lon     float64 `json:"longitude"`
+	Code     string  `json:"code"`
+	Name     string  `json:"name"`
+	City     string  `json:"city"`
+	Country  string  `json:"country"`
+	Lat      float64 `json:"latitude"`
+	Lon      float64 `json:"longitude"`
+	Timezone string  `json:"timezone"` // IANA, such as America/New_York
+}
+
+// location returns the time zone the airport keeps: UTC if it doesn't
+// name one.
+func (a Airport) location() *time.Location {
+	return geo.Location(a.Timezone)
 }
 
 type Passenger struct {
@@ -38,15 +46,29 @@ type Passenger struct {
 }
 
 type Flight struct {
-	FlightNumber   string    `json:"flight_number"`
-	Origin         Airport   `json:"origin"`
-	Destination    Airport   `json:"destination"`
-	DepartureTime  time.Time `json:"departure_time"`
-	ArrivalTime    time.Time `json:"arrival_time"`
-	AircraftType   string    `json:"aircraft_type"`
-	AvailableSeats int       `json:"available_seats"`
-	Price          float64   `json:"price"`
-	Status         string    `json:"status"`
+	FlightNumber   string      `json:"flight_number"`
+	Origin         Airport     `json:"origin"`
+	Destination    Airport     `json:"destination"`
+	DepartureTime  time.Time   `json:"departure_time"`
+	ArrivalTime    time.Time   `json:"arrival_time"`
+	AircraftType   string      `json:"aircraft_type"`
+	AvailableSeats int         `json:"available_seats"`
+	Price          money.Money `json:"price"`
+	Status         string      `json:"status"`
+}
+
+// localize gives the flight's airports without a time zone that of where
+// they are, and puts its departure in its origin's and its arrival in its
+// destination's, as boards and tickets show them.
+func (f Flight) localize() Flight {
+	for _, a := range []*Airport{&f.Origin, &f.Destination} {
+		if a.Timezone == "" && (a.Lat != 0 || a.Lon != 0) {
+			a.Timezone = geo.ZoneAt(geo.Point{Lat: a.Lat, Lon: a.Lon})
+		}
+	}
+	f.DepartureTime = f.DepartureTime.In(f.Origin.location())
+	f.ArrivalTime = f.ArrivalTime.In(f.Destination.location())
+	return f
 }
 
 type Seat struct {
@@ -65,16 +87,24 @@ const (
 	ReservationCheckedIn ReservationStatus = "checked_in"
 )
 
+// reservationMachine is the statuses a reservation moves through; a
+// checked-in one can no longer be cancelled.
+var reservationMachine = &statemachine.Machine{Name: "reservation", Moves: map[string][]string{
+	string(ReservationConfirmed): {string(ReservationCheckedIn), string(ReservationCancelled)},
+}}
+
 type Reservation struct {
 	ReservationNumber string            `json:"reservation_number"`
 	Passenger         Passenger         `json:"passenger"`
 	Flights           []Flight          `json:"flights"`
 	Seats             []Seat            `json:"seats"`
 	Status            ReservationStatus `json:"status"`
-	TotalPrice        float64           `json:"total_price"`
+	TotalPrice        money.Money       `json:"total_price"`
 	PaymentMethodID   string            `json:"payment_method_id"`
 	CreatedAt         time.Time         `json:"created_at"`
 	UpdatedAt         time.Time         `json:"updated_at"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
 }
 
 type BoardingPass struct {
@@ -85,18 +115,47 @@ type BoardingPass struct {
 	Gate          string    `json:"gate"`
 	BoardingTime  time.Time `json:"boarding_time"`
 	QRCode        string    `json:"qr_code"`
+
+	// The pass as a PDF, to print or show at the gate
+	Document *server.StoredFile `json:"document,omitempty"`
+}
+
+// boardingPassPage lays out a boarding pass for flight.
+func boardingPassPage(pass BoardingPass, flight Flight) pdf.Page {
+	return pdf.Page{Width: pdf.LetterWidth, Height: pdf.LetterHeight, Lines: []pdf.Line{
+		{Bold: true, Size: 24, X: 72, Y: 700, Text: "United Airlines Boarding Pass"},
+		{Bold: true, Size: 18, X: 72, Y: 660, Text: pass.PassengerName},
+		{Size: 14, X: 72, Y: 625, Text: fmt.Sprintf("Flight %s  %s to %s", pass.FlightNumber, flight.Origin.Code, flight.Destination.Code)},
+		{Size: 12, X: 72, Y: 600, Text: "Departs " + flight.DepartureTime.Format("Mon Jan 2, 2006 3:04 PM MST")},
+		{Size: 12, X: 72, Y: 570, Text: fmt.Sprintf("Gate %s  |  Boarding %s  |  Group %s  |  Seat %s", pass.Gate, pass.BoardingTime.Format("3:04 PM"), pass.BoardingGroup, pass.Seat)},
+		{Size: 10, X: 72, Y: 530, Text: pass.QRCode},
+	}}
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Passengers     map[string]Passenger    `json:"passengers"`
-	Flights        map[string]Flight       `json:"flights"`
-	Reservations   map[string]Reservation  `json:"reservations"`
-	BoardingPasses map[string]BoardingPass `json:"boarding_passes"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Passengers     server.Repository[Passenger]    `json:"passengers"`
+	Flights        server.Repository[Flight]       `json:"flights"`
+	Reservations   server.Repository[Reservation]  `json:"reservations"`
+	BoardingPasses server.Repository[BoardingPass] `json:"boarding_passes"`
 	mu             sync.RWMutex
 }
 
-var db *Database
+// handlers book United flights and issue boarding passes, checking in by
+// clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the flights, reservations and passengers in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Error definitions
 var (
@@ -111,130 +170,173 @@ func (d *Database) GetFlight(flightNumber string) (Flight, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	flight, exists := d.Flights[flightNumber]
+	flight, exists := d.Flights.Get(flightNumber)
 	if !exists {
 		return Flight{}, ErrFlightNotFound
 	}
 	return flight, nil
 }
 
+// localize puts flights, and reservations' copies of them, in their
+// airports' time zones, and boarding passes in their flight's origin's.
+func (d *Database) localize() {
+	for _, number := range d.Flights.Keys() {
+		flight, _ := d.Flights.Get(number)
+		d.Flights.Upsert(number, flight.localize())
+	}
+	for _, number := range d.Reservations.Keys() {
+		reservation, _ := d.Reservations.Get(number)
+		for i, flight := range reservation.Flights {
+			if known, ok := d.Flights.Get(flight.FlightNumber); ok {
+				flight.Origin.Timezone = known.Origin.Timezone
+				flight.Destination.Timezone = known.Destination.Timezone
+			}
+			reservation.Flights[i] = flight.localize()
+		}
+		d.Reservations.Upsert(number, reservation)
+	}
+	for _, number := range d.BoardingPasses.Keys() {
+		pass, _ := d.BoardingPasses.Get(number)
+		flight, _ := d.Flights.Get(pass.FlightNumber)
+		pass.BoardingTime = pass.BoardingTime.In(flight.Origin.location())
+		d.BoardingPasses.Upsert(number, pass)
+	}
+}
+
 func (d *Database) GetPassenger(email string) (Passenger, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	passenger, exists := d.Passengers[email]
+	passenger, exists := d.Passengers.Get(email)
 	if !exists {
 		return Passenger{}, ErrPassengerNotFound
 	}
 	return passenger, nil
 }
 
+// CancelFlight cancels a flight, releasing its seats.
+func (d *Database) CancelFlight(flightNumber string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if flight, exists := d.Flights.Get(flightNumber); exists {
+		flight.Status = "cancelled"
+		flight.AvailableSeats = 0
+		d.Flights.Upsert(flightNumber, flight)
+	}
+}
+
 func (d *Database) CreateReservation(res Reservation) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Reservations[res.ReservationNumber] = res
+	d.Reservations.Upsert(res.ReservationNumber, res)
 	return nil
 }
 
 // HTTP Handlers
-func searchFlights(c *fiber.Ctx) error {
+func (h *handlers) searchFlights(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	origin := c.Query("origin")
 	destination := c.Query("destination")
 	departureDate := c.Query("departure_date")
 
 	if origin == "" || destination == "" || departureDate == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Missing required parameters",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Missing required parameters")
 	}
 
-	// Parse departure date
+	// Parse departure date, which is the origin's: a red-eye leaving at
+	// 11pm in Los Angeles departs that day, not the next one in UTC.
 	depDate, err := time.Parse("2006-01-02", departureDate)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid date format",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Invalid date format")
 	}
 
 	var availableFlights []Flight
 	db.mu.RLock()
-	for _, flight := range db.Flights {
+	for _, flight := range db.Flights.List() {
 		if flight.Origin.Code == origin &&
 			flight.Destination.Code == destination &&
-			flight.DepartureTime.Format("2006-01-02") == depDate.Format("2006-01-02") &&
+			geo.LocalDate(flight.DepartureTime, flight.Origin.location()) == depDate.Format(time.DateOnly) &&
 			flight.AvailableSeats > 0 {
 			availableFlights = append(availableFlights, flight)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(availableFlights)
+	return server.List(c, availableFlights, "origin", "destination")
 }
 
-func getReservations(c *fiber.Ctx) error {
+func (h *handlers) getReservations(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
 	var userReservations []Reservation
 	db.mu.RLock()
-	for _, res := range db.Reservations {
+	for _, res := range db.Reservations.List() {
 		if res.Passenger.Email == email {
 			userReservations = append(userReservations, res)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userReservations)
+	return server.List(c, userReservations)
 }
 
 type NewReservationRequest struct {
-	FlightNumbers   []string `json:"flight_numbers"`
-	PassengerEmail  string   `json:"passenger_email"`
-	PaymentMethodID string   `json:"payment_method_id"`
+	FlightNumbers   []string `json:"flight_numbers" validate:"min=1"`
+	PassengerEmail  string   `json:"passenger_email" validate:"required,email"`
+	PaymentMethodID string   `json:"payment_method_id" validate:"required"`
 	SeatPreferences []string `json:"seat_preferences"`
 }
 
-func createReservation(c *fiber.Ctx) error {
+func (h *handlers) createReservation(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewReservationRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate passenger
 	passenger, err := db.GetPassenger(req.PassengerEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Passenger not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Passenger not found")
 	}
 
 	// Validate and collect flights
 	var flights []Flight
-	var totalPrice float64
+	var totalPrice money.Money
 
 	for _, flightNum := range req.FlightNumbers {
 		flight, err := db.GetFlight(flightNum)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Flight not found: " + flightNum,
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Flight not found: "+flightNum)
+		}
+
+		// In chaos mode, the flight may be cancelled while it is booked.
+		if server.Chaos(c, server.ChaosFlightCancelled) {
+			db.CancelFlight(flightNum)
+			flight.Status = "cancelled"
+		}
+		if flight.Status == "cancelled" {
+			return server.Fail(c, fiber.StatusConflict, server.CodeConflict, "Flight has been cancelled: "+flightNum)
 		}
 
 		if flight.AvailableSeats <= 0 {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "No available seats on flight: " + flightNum,
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "No available seats on flight: "+flightNum)
 		}
 
 		flights = append(flights, flight)
-		totalPrice += flight.Price
+		if totalPrice, err = totalPrice.Add(flight.Price); err != nil {
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+		}
+	}
+
+	if server.Chaos(c, server.ChaosPaymentDeclined) {
+		return server.Fail(c, fiber.StatusPaymentRequired, server.CodePaymentDeclined, "Payment declined")
 	}
 
 	// Create reservation
@@ -245,14 +347,12 @@ func createReservation(c *fiber.Ctx) error {
 		Status:            ReservationConfirmed,
 		TotalPrice:        totalPrice,
 		PaymentMethodID:   req.PaymentMethodID,
-		CreatedAt:         time.Now(),
-		UpdatedAt:         time.Now(),
+		CreatedAt:         h.clock.Now(),
+		UpdatedAt:         h.clock.Now(),
 	}
 
 	if err := db.CreateReservation(reservation); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create reservation",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create reservation")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(reservation)
@@ -260,43 +360,38 @@ func createReservation(c *fiber.Ctx) error {
 
 type CheckInRequest struct {
 	ReservationNumber string `json:"reservation_number"`
-	Email             string `json:"email"`
+	Email             string `json:"email" validate:"email"`
 }
 
-func checkIn(c *fiber.Ctx) error {
+func (h *handlers) checkIn(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CheckInRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	reservation, exists := db.Reservations[req.ReservationNumber]
+	reservation, exists := db.Reservations.Get(req.ReservationNumber)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Reservation not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Reservation not found")
 	}
 
 	if reservation.Passenger.Email != req.Email {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized access to reservation",
-		})
+		return server.Fail(c, fiber.StatusUnauthorized, server.CodeUnauthorized, "Unauthorized access to reservation")
 	}
 
 	if reservation.Status == ReservationCancelled {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Cannot check in for cancelled reservation",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Cannot check in for cancelled reservation")
 	}
 
 	if reservation.Status == ReservationCheckedIn {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Already checked in",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, "Already checked in")
+	}
+	now := h.clock.Now()
+	if err := statemachine.Move(reservationMachine, &reservation, &reservation.Status, &reservation.StatusHistory, ReservationCheckedIn, now); err != nil {
+		return server.FailWith(c, fiber.StatusConflict, err)
 	}
 
 	// Generate boarding pass
@@ -309,14 +404,17 @@ func checkIn(c *fiber.Ctx) error {
 		BoardingTime:  reservation.Flights[0].DepartureTime.Add(-30 * time.Minute),
 		QRCode:        generateQRCode(reservation.ReservationNumber),
 	}
+	file, err := server.StoreFile(boardingPassPage(boardingPass, reservation.Flights[0]).Render(), pdf.MIMEApplicationPDF, "boarding-pass-"+reservation.ReservationNumber+".pdf")
+	if err != nil {
+		return err
+	}
+	boardingPass.Document = &file
 
-	// Update reservation status
-	reservation.Status = ReservationCheckedIn
-	reservation.UpdatedAt = time.Now()
-	db.Reservations[reservation.ReservationNumber] = reservation
+	reservation.UpdatedAt = now
+	db.Reservations.Upsert(reservation.ReservationNumber, reservation)
 
 	// Store boarding pass
-	db.BoardingPasses[reservation.ReservationNumber] = boardingPass
+	db.BoardingPasses.Upsert(reservation.ReservationNumber, boardingPass)
 
 	return c.JSON(boardingPass)
 }
@@ -326,64 +424,73 @@ func generateQRCode(reservationNumber string) string {
 	return "QR_" + reservationNumber
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Passengers:     make(map[string]Passenger),
-		Flights:        make(map[string]Flight),
-		Reservations:   make(map[string]Reservation),
-		BoardingPasses: make(map[string]BoardingPass),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	db.localize()
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Flight routes
-	api.Get("/flights/search", searchFlights)
+	api.Get("/flights/search", h.searchFlights)
 
 	// Reservation routes
-	api.Get("/reservations", getReservations)
-	api.Post("/reservations", createReservation)
+	api.Get("/reservations", h.getReservations)
+	api.Post("/reservations", h.createReservation)
 
 	// Check-in routes
-	api.Post("/check-in", checkIn)
+	api.Post("/check-in", h.checkIn)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"passengers", "reservations", "boarding_passes"},
+			Search:  []string{"flights", "reservations"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithChaos(cfg),
+		server.WithFiles(cfg),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
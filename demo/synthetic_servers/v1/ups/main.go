@@ -1,40 +1,38 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
 type Address struct {
-	Street     string `json:"street"`
-	City       string `json:"city"`
+	Street     string `json:"street" validate:"required"`
+	City       string `json:"city" validate:"required"`
 	State      string `json:"state"`
-	PostalCode string `json:"postal_code"`
-	Country    string `json:"country"`
+	PostalCode string `json:"postal_code" validate:"required"`
+	Country    string `json:"country" validate:"required"`
 }
 
 type Dimensions struct {
-	Length float64 `json:"length"`
-	Width  float64 `json:"width"`
-	Height float64 `json:"height"`
+	Length float64 `json:"length" validate:"gt=0"`
+	Width  float64 `json:"width" validate:"gt=0"`
+	Height float64 `json:"height" validate:"gt=0"`
 }
 
 type Package struct {
-	Weight        float64    `json:"weight"`
-	Dimensions    Dimensions `json:"dimensions"`
-	DeclaredValue float64    `json:"declared_value"`
+	Weight        float64     `json:"weight" validate:"gt=0"`
+	Dimensions    Dimensions  `json:"dimensions"`
+	DeclaredValue money.Money `json:"declared_value" validate:"gte=0"`
 }
 
 type TrackingEvent struct {
@@ -54,29 +52,51 @@ const (
 	ShipmentStatusException ShipmentStatus = "exception"
 )
 
+// shipmentMachine is the statuses a shipment moves through. One held up
+// in transit is an exception until it moves on again.
+var shipmentMachine = &statemachine.Machine{Name: "shipment", Moves: map[string][]string{
+	string(ShipmentStatusCreated):   {string(ShipmentStatusPickedUp)},
+	string(ShipmentStatusPickedUp):  {string(ShipmentStatusInTransit), string(ShipmentStatusException)},
+	string(ShipmentStatusInTransit): {string(ShipmentStatusDelivered), string(ShipmentStatusException)},
+	string(ShipmentStatusException): {string(ShipmentStatusInTransit)},
+}}
+
+// shipmentLifecycle picks shipments up the same day and delivers them a
+// couple of days later. Exceptions stay until resolved.
+var shipmentLifecycle = server.Lifecycle{Collection: "shipments", Steps: []server.Step{
+	{From: string(ShipmentStatusCreated), To: string(ShipmentStatusPickedUp), After: 4 * time.Hour},
+	{From: string(ShipmentStatusPickedUp), To: string(ShipmentStatusInTransit), After: 2 * time.Hour},
+	{From: string(ShipmentStatusInTransit), To: string(ShipmentStatusDelivered), After: 48 * time.Hour,
+		Notify: server.Notice{Type: "shipment_delivered", Message: "Your shipment {{tracking_number}} was delivered."}},
+}, Machine: shipmentMachine}
+
 type Shipment struct {
-	ID             string          `json:"id"`
-	TrackingNumber string          `json:"tracking_number"`
-	UserEmail      string          `json:"user_email"`
-	FromAddress    Address         `json:"from_address"`
-	ToAddress      Address         `json:"to_address"`
-	ServiceLevel   string          `json:"service_level"`
-	PackageDetails Package         `json:"package_details"`
-	Status         ShipmentStatus  `json:"status"`
-	CreatedAt      time.Time       `json:"created_at"`
-	TrackingEvents []TrackingEvent `json:"tracking_events"`
+	ID             string                    `json:"id"`
+	TrackingNumber string                    `json:"tracking_number"`
+	UserEmail      string                    `json:"user_email"`
+	FromAddress    Address                   `json:"from_address"`
+	ToAddress      Address                   `json:"to_address"`
+	ServiceLevel   string                    `json:"service_level"`
+	PackageDetails Package                   `json:"package_details"`
+	Status         ShipmentStatus            `json:"status"`
+	StatusHistory  []statemachine.Transition `json:"status_history,omitempty"`
+	CreatedAt      time.Time                 `json:"created_at"`
+	TrackingEvents []TrackingEvent           `json:"tracking_events"`
 }
 
 type Rate struct {
-	ServiceLevel string    `json:"service_level"`
-	Rate         float64   `json:"rate"`
-	DeliveryDate time.Time `json:"delivery_date"`
-	Guaranteed   bool      `json:"guaranteed"`
+	ServiceLevel string      `json:"service_level"`
+	Rate         money.Money `json:"rate"`
+	DeliveryDate time.Time   `json:"delivery_date"`
+	Guaranteed   bool        `json:"guaranteed"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Shipments map[string]Shipment `json:"shipments"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Shipments server.Repository[Shipment] `json:"shipments"`
 	mu        sync.RWMutex
 }
 
@@ -86,15 +106,25 @@ var (
 	ErrInvalidInput     = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers create and track UPS shipments and quote rates, dating shipments
+// and delivery estimates by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the shipments in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetShipment(id string) (Shipment, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	shipment, exists := d.Shipments[id]
+	shipment, exists := d.Shipments.Get(id)
 	if !exists {
 		return Shipment{}, ErrShipmentNotFound
 	}
@@ -105,7 +135,7 @@ func (d *Database) CreateShipment(shipment Shipment) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Shipments[shipment.ID] = shipment
+	d.Shipments.Upsert(shipment.ID, shipment)
 	return nil
 }
 
@@ -113,7 +143,7 @@ func (d *Database) GetShipmentByTracking(trackingNumber string) (Shipment, error
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	for _, shipment := range d.Shipments {
+	for _, shipment := range d.Shipments.List() {
 		if shipment.TrackingNumber == trackingNumber {
 			return shipment, nil
 		}
@@ -125,13 +155,7 @@ func (d *Database) GetUserShipments(email string) []Shipment {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var shipments []Shipment
-	for _, shipment := range d.Shipments {
-		if shipment.UserEmail == email {
-			shipments = append(shipments, shipment)
-		}
-	}
-	return shipments
+	return d.Shipments.By("user_email", email)
 }
 
 // Business logic helpers
@@ -139,38 +163,34 @@ func generateTrackingNumber() string {
 	return "1Z" + uuid.New().String()[:16]
 }
 
-func calculateShippingRate(from, to Address, pkg Package, serviceLevel string) float64 {
+func calculateShippingRate(from, to Address, pkg Package, serviceLevel string) money.Money {
 	// Simplified rate calculation
 	baseRate := 10.0
 	weightRate := pkg.Weight * 0.5
 	volumeRate := (pkg.Dimensions.Length * pkg.Dimensions.Width * pkg.Dimensions.Height) * 0.001
+	rate := money.Dollars(baseRate + weightRate + volumeRate)
 
 	switch serviceLevel {
-	case "ground":
-		return baseRate + weightRate + volumeRate
 	case "2day":
-		return (baseRate + weightRate + volumeRate) * 1.5
+		return rate.Mul(1.5)
 	case "nextday":
-		return (baseRate + weightRate + volumeRate) * 2.0
+		return rate.Mul(2.0)
 	default:
-		return baseRate + weightRate + volumeRate
+		return rate
 	}
 }
 
 // HTTP Handlers
-func trackPackage(c *fiber.Ctx) error {
+func (h *handlers) trackPackage(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	trackingNumber := c.Params("trackingNumber")
 	if trackingNumber == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Tracking number is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Tracking number is required")
 	}
 
 	shipment, err := db.GetShipmentByTracking(trackingNumber)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Package not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Package not found")
 	}
 
 	return c.JSON(fiber.Map{
@@ -183,44 +203,37 @@ func trackPackage(c *fiber.Ctx) error {
 	})
 }
 
-func getUserShipments(c *fiber.Ctx) error {
+func (h *handlers) getUserShipments(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Email is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "Email is required")
 	}
 
 	shipments := db.GetUserShipments(email)
-	return c.JSON(shipments)
+	return server.List(c, shipments)
 }
 
 type CreateShipmentRequest struct {
-	UserEmail    string  `json:"user_email"`
+	UserEmail    string  `json:"user_email" validate:"required,email"`
 	FromAddress  Address `json:"from_address"`
 	ToAddress    Address `json:"to_address"`
-	ServiceLevel string  `json:"service_level"`
+	ServiceLevel string  `json:"service_level" validate:"required,oneof=ground 2day nextday"`
 	Package      Package `json:"package"`
 }
 
-func createShipment(c *fiber.Ctx) error {
+func (h *handlers) createShipment(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateShipmentRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate input
-	if req.UserEmail == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "User email is required",
-		})
-	}
 
 	// Create new shipment
 	shipment := Shipment{
-		ID:             uuid.New().String(),
+		ID:             server.NewID("SHP"),
 		TrackingNumber: generateTrackingNumber(),
 		UserEmail:      req.UserEmail,
 		FromAddress:    req.FromAddress,
@@ -228,10 +241,10 @@ func createShipment(c *fiber.Ctx) error {
 		ServiceLevel:   req.ServiceLevel,
 		PackageDetails: req.Package,
 		Status:         ShipmentStatusCreated,
-		CreatedAt:      time.Now(),
+		CreatedAt:      h.clock.Now(),
 		TrackingEvents: []TrackingEvent{
 			{
-				Timestamp:   time.Now(),
+				Timestamp:   h.clock.Now(),
 				Location:    req.FromAddress.City,
 				Status:      string(ShipmentStatusCreated),
 				Description: "Shipping label created",
@@ -240,9 +253,7 @@ func createShipment(c *fiber.Ctx) error {
 	}
 
 	if err := db.CreateShipment(shipment); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create shipment",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create shipment")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(shipment)
@@ -254,12 +265,10 @@ type RateRequest struct {
 	Package     Package `json:"package"`
 }
 
-func calculateRates(c *fiber.Ctx) error {
+func (h *handlers) calculateRates(c *fiber.Ctx) error {
 	var req RateRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Calculate rates for different service levels
@@ -267,19 +276,19 @@ func calculateRates(c *fiber.Ctx) error {
 		{
 			ServiceLevel: "ground",
 			Rate:         calculateShippingRate(req.FromAddress, req.ToAddress, req.Package, "ground"),
-			DeliveryDate: time.Now().AddDate(0, 0, 5),
+			DeliveryDate: h.clock.Now().AddDate(0, 0, 5),
 			Guaranteed:   false,
 		},
 		{
 			ServiceLevel: "2day",
 			Rate:         calculateShippingRate(req.FromAddress, req.ToAddress, req.Package, "2day"),
-			DeliveryDate: time.Now().AddDate(0, 0, 2),
+			DeliveryDate: h.clock.Now().AddDate(0, 0, 2),
 			Guaranteed:   true,
 		},
 		{
 			ServiceLevel: "nextday",
 			Rate:         calculateShippingRate(req.FromAddress, req.ToAddress, req.Package, "nextday"),
-			DeliveryDate: time.Now().AddDate(0, 0, 1),
+			DeliveryDate: h.clock.Now().AddDate(0, 0, 1),
 			Guaranteed:   true,
 		},
 	}
@@ -287,69 +296,71 @@ func calculateRates(c *fiber.Ctx) error {
 	return c.JSON(rates)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Shipments: make(map[string]Shipment),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Tracking routes
-	api.Get("/tracking/:trackingNumber", trackPackage)
+	api.Get("/tracking/:trackingNumber", h.trackPackage)
 
 	// Shipment routes
-	api.Get("/shipments", getUserShipments)
-	api.Post("/shipments", createShipment)
+	api.Get("/shipments", h.getUserShipments)
+	api.Post("/shipments", h.createShipment)
 
 	// Rate calculation
-	api.Post("/rates", calculateRates)
+	api.Post("/rates", h.calculateRates)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"shipments"},
+			Search:  []string{"shipments"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, shipmentLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"pkg/money"
+	"pkg/server"
+	"pkg/servertest"
+)
+
+const fixture = `{"shipments": {}}`
+
+var now = time.Date(2025, 8, 4, 13, 0, 0, 0, time.UTC)
+
+const shipment = `{
+  "user_email": "ivy@example.com",
+  "from_address": {"street": "1 Main St", "city": "Atlanta", "postal_code": "30301", "country": "US"},
+  "to_address": {"street": "9 Elm St", "city": "Denver", "postal_code": "80202", "country": "US"},
+  "service_level": "2day",
+  "package": {"weight": 2, "dimensions": {"length": 10, "width": 10, "height": 10}, "declared_value": 40}
+}`
+
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+	h, err := newHandlers(servertest.Store(fixture), servertest.Clock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := servertest.App()
+	setupRoutes(app, h)
+	return app
+}
+
+func TestCreateShipment(t *testing.T) {
+	app := newTestApp(t)
+	var created Shipment
+	if code := servertest.Do(t, app, "POST", "/api/v1/shipments", shipment, &created); code != http.StatusCreated {
+		t.Fatalf("got %d, want %d", code, http.StatusCreated)
+	}
+	if created.Status != ShipmentStatusCreated || !created.CreatedAt.Equal(now) {
+		t.Errorf("got %s at %v, want created at the clock's %v", created.Status, created.CreatedAt, now)
+	}
+
+	var tracked struct {
+		Status         ShipmentStatus  `json:"status"`
+		TrackingEvents []TrackingEvent `json:"tracking_events"`
+	}
+	servertest.Do(t, app, "GET", "/api/v1/tracking/"+created.TrackingNumber, "", &tracked)
+	if len(tracked.TrackingEvents) != 1 || tracked.TrackingEvents[0].Location != "Atlanta" {
+		t.Errorf("got events %+v, want the label created in Atlanta", tracked.TrackingEvents)
+	}
+
+	var page server.Page[Shipment]
+	servertest.Do(t, app, "GET", "/api/v1/shipments?email=ivy@example.com", "", &page)
+	if page.Total != 1 || page.Data[0].ID != created.ID {
+		t.Errorf("got %d shipments, want the one created", page.Total)
+	}
+}
+
+func TestCreateShipmentFails(t *testing.T) {
+	app := newTestApp(t)
+	for target, want := range map[string]int{
+		"/api/v1/tracking/1Znothing": http.StatusNotFound,
+		"/api/v1/shipments":          http.StatusBadRequest,
+	} {
+		if code := servertest.Do(t, app, "GET", target, "", nil); code != want {
+			t.Errorf("%s: got %d, want %d", target, code, want)
+		}
+	}
+	if code := servertest.Do(t, app, "POST", "/api/v1/shipments", `{"user_email": "ivy@example.com", "service_level": "overnight"}`, nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("unknown service level: got %d, want %d", code, http.StatusUnprocessableEntity)
+	}
+}
+
+// Rates grow with the service level, and each is delivered some days from
+// the clock.
+func TestCalculateRates(t *testing.T) {
+	app := newTestApp(t)
+	var rates []Rate
+	servertest.Do(t, app, "POST", "/api/v1/rates", shipment, &rates)
+	want := []struct {
+		level string
+		rate  money.Money
+		days  int
+	}{
+		{"ground", money.Cents(1200), 5},
+		{"2day", money.Cents(1800), 2},
+		{"nextday", money.Cents(2400), 1},
+	}
+	if len(rates) != len(want) {
+		t.Fatalf("got %d rates, want %d", len(rates), len(want))
+	}
+	for i, w := range want {
+		r := rates[i]
+		if r.ServiceLevel != w.level || r.Rate != w.rate || !r.DeliveryDate.Equal(now.AddDate(0, 0, w.days)) {
+			t.Errorf("got %s at %s by %v, want %s at %s in %d days", r.ServiceLevel, r.Rate, r.DeliveryDate, w.level, w.rate, w.days)
+		}
+	}
+}
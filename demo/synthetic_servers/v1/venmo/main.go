@@ -1,31 +1,27 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
 type User struct {
-	Email          string    `json:"email"`
-	Name           string    `json:"name"`
-	Username       string    `json:"username"`
-	ProfilePicture string    `json:"profile_picture"`
-	Balance        float64   `json:"balance"`
-	PendingBalance float64   `json:"pending_balance"`
-	Friends        []string  `json:"friends"` // List of friend emails
-	CreatedAt      time.Time `json:"created_at"`
+	Email          string      `json:"email"`
+	Name           string      `json:"name"`
+	Username       string      `json:"username"`
+	ProfilePicture string      `json:"profile_picture"`
+	Balance        money.Money `json:"balance"`
+	PendingBalance money.Money `json:"pending_balance"`
+	Friends        []string    `json:"friends"` // List of friend emails
+	CreatedAt      time.Time   `json:"created_at"`
 }
 
 type TransactionStatus string
@@ -48,7 +44,7 @@ type Transaction struct {
 	ID         string                `json:"id"`
 	Sender     User                  `json:"sender"`
 	Recipient  User                  `json:"recipient"`
-	Amount     float64               `json:"amount"`
+	Amount     money.Money           `json:"amount"`
 	Note       string                `json:"note"`
 	Visibility TransactionVisibility `json:"visibility"`
 	Status     TransactionStatus     `json:"status"`
@@ -57,45 +53,61 @@ type Transaction struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users        map[string]User        `json:"users"`
-	Transactions map[string]Transaction `json:"transactions"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users        server.Repository[User]        `json:"users"`
+	Transactions server.Repository[Transaction] `json:"transactions"`
 	mu           sync.RWMutex
 }
 
 // Custom errors
 var (
 	ErrUserNotFound        = errors.New("user not found")
-	ErrInsufficientFunds   = errors.New("insufficient funds")
+	ErrInsufficientFunds   = server.NewError(server.CodeInsufficientFunds, "insufficient funds")
 	ErrInvalidAmount       = errors.New("invalid amount")
 	ErrTransactionNotFound = errors.New("transaction not found")
 )
 
-// Global database instance
-var db *Database
+// handlers send and request Venmo payments between users, dated by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the users and transactions in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
 	return user, nil
 }
 
-func (d *Database) UpdateUserBalance(email string, amount float64) error {
+func (d *Database) UpdateUserBalance(email string, amount money.Money) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return ErrUserNotFound
 	}
 
-	user.Balance += amount
-	d.Users[email] = user
+	balance, err := user.Balance.Add(amount)
+	if err != nil {
+		return err
+	}
+	user.Balance = balance
+	d.Users.Upsert(email, user)
 	return nil
 }
 
@@ -103,24 +115,23 @@ func (d *Database) CreateTransaction(tx Transaction) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Transactions[tx.ID] = tx
+	d.Transactions.Upsert(tx.ID, tx)
 	return nil
 }
 
 // HTTP Handlers
-func getUserTransactions(c *fiber.Ctx) error {
+func (h *handlers) getUserTransactions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	limit := c.QueryInt("limit", 20)
 
 	var userTransactions []Transaction
 	db.mu.RLock()
-	for _, tx := range db.Transactions {
+	for _, tx := range db.Transactions.List() {
 		if tx.Sender.Email == email || tx.Recipient.Email == email {
 			userTransactions = append(userTransactions, tx)
 		}
@@ -130,106 +141,88 @@ func getUserTransactions(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userTransactions)
+	return server.List(c, userTransactions)
 }
 
 type CreateTransactionRequest struct {
-	SenderEmail    string                `json:"sender_email"`
-	RecipientEmail string                `json:"recipient_email"`
-	Amount         float64               `json:"amount"`
+	SenderEmail    string                `json:"sender_email" validate:"email"`
+	RecipientEmail string                `json:"recipient_email" validate:"email"`
+	Amount         money.Money           `json:"amount" validate:"gt=0"`
 	Note           string                `json:"note"`
 	Visibility     TransactionVisibility `json:"visibility"`
 }
 
-func createTransaction(c *fiber.Ctx) error {
+func (h *handlers) createTransaction(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreateTransactionRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	if req.Amount <= 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": ErrInvalidAmount.Error(),
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Get sender and recipient
 	sender, err := db.GetUser(req.SenderEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Sender " + err.Error(),
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Sender "+err.Error())
 	}
 
 	recipient, err := db.GetUser(req.RecipientEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Recipient " + err.Error(),
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Recipient "+err.Error())
 	}
 
 	// Check sender has sufficient funds
-	if sender.Balance < req.Amount {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": ErrInsufficientFunds.Error(),
-		})
+	short, err := sender.Balance.Less(req.Amount)
+	if err != nil {
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	}
+	if short {
+		return server.FailWith(c, fiber.StatusBadRequest, ErrInsufficientFunds)
 	}
 
 	// Create transaction
 	tx := Transaction{
-		ID:         uuid.New().String(),
+		ID:         server.NewID("TXN"),
 		Sender:     sender,
 		Recipient:  recipient,
 		Amount:     req.Amount,
 		Note:       req.Note,
 		Visibility: req.Visibility,
 		Status:     TransactionStatusComplete,
-		CreatedAt:  time.Now(),
+		CreatedAt:  h.clock.Now(),
 	}
 
 	// Update balances
-	if err := db.UpdateUserBalance(req.SenderEmail, -req.Amount); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update sender balance",
-		})
+	if err := db.UpdateUserBalance(req.SenderEmail, req.Amount.Neg()); err != nil {
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update sender balance")
 	}
 
 	if err := db.UpdateUserBalance(req.RecipientEmail, req.Amount); err != nil {
 		// Rollback sender's balance
 		db.UpdateUserBalance(req.SenderEmail, req.Amount)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update recipient balance",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to update recipient balance")
 	}
 
 	// Save transaction
 	if err := db.CreateTransaction(tx); err != nil {
 		// Rollback balances
 		db.UpdateUserBalance(req.SenderEmail, req.Amount)
-		db.UpdateUserBalance(req.RecipientEmail, -req.Amount)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create transaction",
-		})
+		db.UpdateUserBalance(req.RecipientEmail, req.Amount.Neg())
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create transaction")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(tx)
 }
 
-func getUserBalance(c *fiber.Ctx) error {
+func (h *handlers) getUserBalance(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(fiber.Map{
@@ -238,91 +231,94 @@ func getUserBalance(c *fiber.Ctx) error {
 	})
 }
 
-func getUserFriends(c *fiber.Ctx) error {
+func (h *handlers) getUserFriends(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	var friends []User
 	db.mu.RLock()
 	for _, friendEmail := range user.Friends {
-		if friend, exists := db.Users[friendEmail]; exists {
+		if friend, exists := db.Users.Get(friendEmail); exists {
 			friends = append(friends, friend)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(friends)
+	return server.List(c, friends)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:        make(map[string]User),
-		Transactions: make(map[string]Transaction),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Transaction routes
-	api.Get("/transactions", getUserTransactions)
-	api.Post("/transactions", createTransaction)
+	api.Get("/transactions", h.getUserTransactions)
+	api.Post("/transactions", h.createTransaction)
 
 	// Balance routes
-	api.Get("/balance", getUserBalance)
+	api.Get("/balance", h.getUserBalance)
 
 	// Friend routes
-	api.Get("/friends", getUserFriends)
+	api.Get("/friends", h.getUserFriends)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users", "transactions"},
+			Search:  []string{"transactions"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
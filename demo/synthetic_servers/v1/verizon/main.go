@@ -1,17 +1,14 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/money"
+	"pkg/server"
 )
 
 // Domain Models
@@ -31,13 +28,13 @@ type PhoneLine struct {
 }
 
 type Plan struct {
-	ID           string   `json:"id"`
-	Name         string   `json:"name"`
-	DataLimit    int      `json:"data_limit"`
-	TalkMinutes  int      `json:"talk_minutes"`
-	TextMessages int      `json:"text_messages"`
-	Price        float64  `json:"price"`
-	Features     []string `json:"features"`
+	ID           string      `json:"id"`
+	Name         string      `json:"name"`
+	DataLimit    int         `json:"data_limit"`
+	TalkMinutes  int         `json:"talk_minutes"`
+	TextMessages int         `json:"text_messages"`
+	Price        money.Money `json:"price"`
+	Features     []string    `json:"features"`
 }
 
 type Device struct {
@@ -58,19 +55,19 @@ type Usage struct {
 }
 
 type Bill struct {
-	ID            string     `json:"id"`
-	AccountID     string     `json:"account_id"`
-	Amount        float64    `json:"amount"`
-	DueDate       time.Time  `json:"due_date"`
-	Status        string     `json:"status"`
-	StatementDate time.Time  `json:"statement_date"`
-	Items         []BillItem `json:"items"`
+	ID            string      `json:"id"`
+	AccountID     string      `json:"account_id"`
+	Amount        money.Money `json:"amount"`
+	DueDate       time.Time   `json:"due_date"`
+	Status        string      `json:"status"`
+	StatementDate time.Time   `json:"statement_date"`
+	Items         []BillItem  `json:"items"`
 }
 
 type BillItem struct {
-	Description string  `json:"description"`
-	Amount      float64 `json:"amount"`
-	Type        string  `json:"type"`
+	Description string      `json:"description"`
+	Amount      money.Money `json:"amount"`
+	Type        string      `json:"type"`
 }
 
 type PaymentMethod struct {
@@ -83,150 +80,159 @@ type PaymentMethod struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Accounts map[string]Account `json:"accounts"`
-	Usage    map[string]Usage   `json:"usage"`
-	Bills    map[string][]Bill  `json:"bills"`
-	Plans    []Plan             `json:"plans"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Accounts server.Repository[Account] `json:"accounts"`
+	Usage    server.Repository[Usage]   `json:"usage"`
+	Bills    server.Repository[[]Bill]  `json:"bills"`
+	Plans    []Plan                     `json:"plans"`
 	mu       sync.RWMutex
 }
 
-var db *Database
+// handlers look after Verizon accounts, their usage, bills and plans, from
+// db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the accounts, bills and plans in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Handlers
-func getAccount(c *fiber.Ctx) error {
+func (h *handlers) getAccount(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	for _, account := range db.Accounts {
+	for _, account := range db.Accounts.List() {
 		if account.Email == email {
 			return c.JSON(account)
 		}
 	}
 
-	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-		"error": "account not found",
-	})
+	return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "account not found")
 }
 
-func getPlans(c *fiber.Ctx) error {
+func (h *handlers) getPlans(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	return c.JSON(db.Plans)
+	return server.List(c, db.Plans)
 }
 
-func getUsage(c *fiber.Ctx) error {
+func (h *handlers) getUsage(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	phoneNumber := c.Query("phone_number")
 	if phoneNumber == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "phone_number parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "phone_number parameter is required")
 	}
 
 	db.mu.RLock()
-	usage, exists := db.Usage[phoneNumber]
+	usage, exists := db.Usage.Get(phoneNumber)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "usage data not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "usage data not found")
 	}
 
 	return c.JSON(usage)
 }
 
-func getBills(c *fiber.Ctx) error {
+func (h *handlers) getBills(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	accountID := c.Query("account_id")
 	if accountID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "account_id parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "account_id parameter is required")
 	}
 
 	db.mu.RLock()
-	bills, exists := db.Bills[accountID]
+	bills, exists := db.Bills.Get(accountID)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "bills not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "bills not found")
 	}
 
-	return c.JSON(bills)
+	return server.List(c, bills, "account_id")
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Accounts: make(map[string]Account),
-		Usage:    make(map[string]Usage),
-		Bills:    make(map[string][]Bill),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Account routes
-	api.Get("/account", getAccount)
+	api.Get("/account", h.getAccount)
 
 	// Plans routes
-	api.Get("/plans", getPlans)
+	api.Get("/plans", h.getPlans)
 
 	// Usage routes
-	api.Get("/usage", getUsage)
+	api.Get("/usage", h.getUsage)
 
 	// Bills routes
-	api.Get("/bills", getBills)
+	api.Get("/bills", h.getBills)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"accounts", "usage", "bills"},
+			Search:  []string{"accounts", "plans", "bills"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
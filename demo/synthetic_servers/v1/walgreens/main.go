@@ -1,19 +1,17 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/geo"
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -48,8 +46,24 @@ type Prescription struct {
 	NextRefillDate   time.Time `json:"next_refill_date"`
 	Status           string    `json:"status"`
 	Instructions     string    `json:"instructions"`
+
+	StatusHistory []statemachine.Transition `json:"status_history,omitempty"`
 }
 
+// prescriptionMachine is the statuses a prescription moves between: it is
+// processing while a refill is filled, and active again once it's ready.
+var prescriptionMachine = &statemachine.Machine{Name: "prescription", Moves: map[string][]string{
+	"active":     {"processing"},
+	"processing": {"active"},
+}}
+
+// prescriptionLifecycle fills each refill and tells the patient it's
+// ready.
+var prescriptionLifecycle = server.Lifecycle{Collection: "prescriptions", Steps: []server.Step{
+	{From: "processing", To: "active", After: 30 * time.Minute,
+		Notify: server.Notice{Type: "refill_ready", Message: "Your refill of {{name}} is ready for pickup."}},
+}, Sender: "Walgreens", Machine: prescriptionMachine}
+
 type Store struct {
 	ID           string  `json:"id"`
 	Name         string  `json:"name"`
@@ -62,19 +76,19 @@ type Store struct {
 }
 
 type Product struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Category    string  `json:"category"`
-	InStock     bool    `json:"in_stock"`
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Price       money.Money `json:"price"`
+	Category    string      `json:"category"`
+	InStock     bool        `json:"in_stock"`
 }
 
 type OrderItem struct {
-	ProductID string  `json:"product_id"`
-	Name      string  `json:"name"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ProductID string      `json:"product_id"`
+	Name      string      `json:"name"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Money `json:"price"`
 }
 
 type Order struct {
@@ -82,29 +96,44 @@ type Order struct {
 	UserEmail string      `json:"user_email"`
 	StoreID   string      `json:"store_id"`
 	Items     []OrderItem `json:"items"`
-	Total     float64     `json:"total"`
+	Total     money.Money `json:"total"`
 	Status    string      `json:"status"`
 	CreatedAt time.Time   `json:"created_at"`
 }
 
 // Database represents our in-memory database
 type Database struct {
-	Users         map[string]User         `json:"users"`
-	Prescriptions map[string]Prescription `json:"prescriptions"`
-	Stores        map[string]Store        `json:"stores"`
-	Products      map[string]Product      `json:"products"`
-	Orders        map[string]Order        `json:"orders"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users         server.Repository[User]         `json:"users"`
+	Prescriptions server.Repository[Prescription] `json:"prescriptions"`
+	Stores        server.Repository[Store]        `json:"stores"`
+	Products      server.Repository[Product]      `json:"products"`
+	Orders        server.Repository[Order]        `json:"orders"`
 	mu            sync.RWMutex
+	clock         *server.Clock
 }
 
-var db *Database
+// handlers fill Walgreens prescriptions and sell its products, dating orders
+// by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the prescriptions, stores and products in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, errors.New("user not found")
 	}
@@ -115,20 +144,14 @@ func (d *Database) GetUserPrescriptions(email string) []Prescription {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var prescriptions []Prescription
-	for _, p := range d.Prescriptions {
-		if p.UserEmail == email {
-			prescriptions = append(prescriptions, p)
-		}
-	}
-	return prescriptions
+	return d.Prescriptions.By("user_email", email)
 }
 
 func (d *Database) RequestRefill(prescriptionID string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	prescription, exists := d.Prescriptions[prescriptionID]
+	prescription, exists := d.Prescriptions.Get(prescriptionID)
 	if !exists {
 		return errors.New("prescription not found")
 	}
@@ -137,45 +160,43 @@ func (d *Database) RequestRefill(prescriptionID string) error {
 		return errors.New("no refills remaining")
 	}
 
+	if err := statemachine.Move(prescriptionMachine, &prescription, &prescription.Status, &prescription.StatusHistory, "processing", d.clock.Now()); err != nil {
+		return errors.New("a refill is already being filled")
+	}
 	prescription.RefillsRemaining--
-	prescription.Status = "processing"
-	prescription.LastFilled = time.Now()
-	prescription.NextRefillDate = time.Now().AddDate(0, 1, 0)
+	prescription.LastFilled = d.clock.Now()
+	prescription.NextRefillDate = d.clock.Now().AddDate(0, 1, 0)
 
-	d.Prescriptions[prescriptionID] = prescription
+	d.Prescriptions.Upsert(prescriptionID, prescription)
 	return nil
 }
 
 // HTTP Handlers
-func getPrescriptions(c *fiber.Ctx) error {
+func (h *handlers) getPrescriptions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	prescriptions := db.GetUserPrescriptions(email)
-	return c.JSON(prescriptions)
+	return server.List(c, prescriptions)
 }
 
-func requestRefill(c *fiber.Ctx) error {
+func (h *handlers) requestRefill(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
 		PrescriptionID string `json:"prescription_id"`
-		UserEmail      string `json:"user_email"`
+		UserEmail      string `json:"user_email" validate:"email"`
 		StoreID        string `json:"store_id"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	if err := db.RequestRefill(req.PrescriptionID); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusBadRequest, err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
@@ -183,21 +204,20 @@ func requestRefill(c *fiber.Ctx) error {
 	})
 }
 
-func getNearbyStores(c *fiber.Ctx) error {
+func (h *handlers) getNearbyStores(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	lat := c.QueryFloat("latitude", 0)
 	lon := c.QueryFloat("longitude", 0)
 
 	if lat == 0 || lon == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "latitude and longitude are required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "latitude and longitude are required")
 	}
 
 	var nearbyStores []Store
 	maxDistance := 20.0 // Maximum radius in km
 
 	db.mu.RLock()
-	for _, store := range db.Stores {
+	for _, store := range db.Stores.List() {
 		distance := calculateDistance(lat, lon,
 			store.Address.Latitude,
 			store.Address.Longitude)
@@ -208,152 +228,160 @@ func getNearbyStores(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(nearbyStores)
+	return server.List(c, nearbyStores)
 }
 
+// calculateDistance returns the great-circle distance between two points
+// in km.
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	// Simplified distance calculation
-	return ((lat2 - lat1) * (lat2 - lat1)) + ((lon2 - lon1) * (lon2 - lon1))
+	return geo.DistanceKm(geo.Point{Lat: lat1, Lon: lon1}, geo.Point{Lat: lat2, Lon: lon2})
 }
 
-func placeOrder(c *fiber.Ctx) error {
+func (h *handlers) placeOrder(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req struct {
-		UserEmail string      `json:"user_email"`
+		UserEmail string      `json:"user_email" validate:"email"`
 		StoreID   string      `json:"store_id"`
 		Items     []OrderItem `json:"items"`
 	}
 
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Calculate total
-	var total float64
+	var total money.Money
 	for _, item := range req.Items {
-		total += item.Price * float64(item.Quantity)
+		var err error
+		if total, err = total.Add(item.Price.Times(item.Quantity)); err != nil {
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+		}
 	}
 
 	order := Order{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("ORD"),
 		UserEmail: req.UserEmail,
 		StoreID:   req.StoreID,
 		Items:     req.Items,
 		Total:     total,
 		Status:    "pending",
-		CreatedAt: time.Now(),
+		CreatedAt: h.clock.Now(),
 	}
 
 	db.mu.Lock()
-	db.Orders[order.ID] = order
+	db.Orders.Upsert(order.ID, order)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(order)
 }
 
-func getUserOrders(c *fiber.Ctx) error {
+func (h *handlers) getUserOrders(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	var userOrders []Order
 	db.mu.RLock()
-	for _, order := range db.Orders {
+	for _, order := range db.Orders.List() {
 		if order.UserEmail == email {
 			userOrders = append(userOrders, order)
 		}
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(userOrders)
+	return server.List(c, userOrders)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	db = &Database{
-		Users:         make(map[string]User),
-		Prescriptions: make(map[string]Prescription),
-		Stores:        make(map[string]Store),
-		Products:      make(map[string]Product),
-		Orders:        make(map[string]Order),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Prescription routes
-	api.Get("/prescriptions", getPrescriptions)
-	api.Post("/prescriptions/refill", requestRefill)
+	api.Get("/prescriptions", h.getPrescriptions)
+	api.Post("/prescriptions/refill", h.requestRefill)
 
 	// Store routes
-	api.Get("/stores", getNearbyStores)
+	api.Get("/stores", h.getNearbyStores)
 	api.Get("/stores/:id", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		id := c.Params("id")
-		store, exists := db.Stores[id]
+		store, exists := db.Stores.Get(id)
 		if !exists {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Store not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "Store not found")
 		}
 		return c.JSON(store)
 	})
 
 	// Order routes
-	api.Get("/orders", getUserOrders)
-	api.Post("/orders", placeOrder)
+	api.Get("/orders", h.getUserOrders)
+	api.Post("/orders", h.placeOrder)
 
 	// User routes
 	api.Get("/users/:email", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		email := c.Params("email")
 		user, err := db.GetUser(email)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(user)
 	})
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"prescriptions", "orders"},
+			Search:  []string{"products", "stores", "prescriptions", "orders"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+		server.WithLifecycles(cfg, prescriptionLifecycle),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
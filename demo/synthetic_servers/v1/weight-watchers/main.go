@@ -1,20 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -63,10 +58,13 @@ type WeightLogEntry struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Profiles   map[string]Profile          `json:"profiles"`
-	Foods      map[string]Food             `json:"foods"`
-	FoodLogs   map[string][]FoodLogEntry   `json:"food_logs"`
-	WeightLogs map[string][]WeightLogEntry `json:"weight_logs"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Profiles   server.Repository[Profile]          `json:"profiles"`
+	Foods      server.Repository[Food]             `json:"foods"`
+	FoodLogs   server.Repository[[]FoodLogEntry]   `json:"food_logs"`
+	WeightLogs server.Repository[[]WeightLogEntry] `json:"weight_logs"`
 	mu         sync.RWMutex
 }
 
@@ -77,15 +75,24 @@ var (
 	ErrInvalidInput = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers keep WW members' food and weight logs in db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the profiles, foods and logs in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetProfile(email string) (Profile, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	profile, exists := d.Profiles[email]
+	profile, exists := d.Profiles.Get(email)
 	if !exists {
 		return Profile{}, ErrUserNotFound
 	}
@@ -96,7 +103,7 @@ func (d *Database) GetFood(id string) (Food, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	food, exists := d.Foods[id]
+	food, exists := d.Foods.Get(id)
 	if !exists {
 		return Food{}, ErrFoodNotFound
 	}
@@ -107,7 +114,8 @@ func (d *Database) AddFoodLogEntry(entry FoodLogEntry) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.FoodLogs[entry.UserEmail] = append(d.FoodLogs[entry.UserEmail], entry)
+	foodLogs, _ := d.FoodLogs.Get(entry.UserEmail)
+	d.FoodLogs.Upsert(entry.UserEmail, append(foodLogs, entry))
 	return nil
 }
 
@@ -115,47 +123,44 @@ func (d *Database) AddWeightLogEntry(entry WeightLogEntry) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.WeightLogs[entry.UserEmail] = append(d.WeightLogs[entry.UserEmail], entry)
+	weightLogs, _ := d.WeightLogs.Get(entry.UserEmail)
+	d.WeightLogs.Upsert(entry.UserEmail, append(weightLogs, entry))
 
 	// Update current weight in profile
-	if profile, exists := d.Profiles[entry.UserEmail]; exists {
+	if profile, exists := d.Profiles.Get(entry.UserEmail); exists {
 		profile.CurrentWeight = entry.Weight
-		d.Profiles[entry.UserEmail] = profile
+		d.Profiles.Upsert(entry.UserEmail, profile)
 	}
 
 	return nil
 }
 
 // HTTP Handlers
-func getProfile(c *fiber.Ctx) error {
+func (h *handlers) getProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	profile, err := db.GetProfile(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	return c.JSON(profile)
 }
 
-func searchFoods(c *fiber.Ctx) error {
+func (h *handlers) searchFoods(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	query := c.Query("query")
 	if query == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "query parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "query parameter is required")
 	}
 
 	var matchingFoods []Food
 	db.mu.RLock()
-	for _, food := range db.Foods {
+	for _, food := range db.Foods.List() {
 		// Simple case-insensitive substring search
 		if strings.Contains(strings.ToLower(food.Name), strings.ToLower(query)) {
 			matchingFoods = append(matchingFoods, food)
@@ -163,29 +168,26 @@ func searchFoods(c *fiber.Ctx) error {
 	}
 	db.mu.RUnlock()
 
-	return c.JSON(matchingFoods)
+	return server.List(c, matchingFoods)
 }
 
-func getFoodLog(c *fiber.Ctx) error {
+func (h *handlers) getFoodLog(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	dateStr := c.Query("date")
 
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	db.mu.RLock()
-	entries := db.FoodLogs[email]
+	entries, _ := db.FoodLogs.Get(email)
 	db.mu.RUnlock()
 
 	if dateStr != "" {
 		date, err := time.Parse("2006-01-02", dateStr)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "invalid date format",
-			})
+			return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "invalid date format")
 		}
 
 		var filteredEntries []FoodLogEntry
@@ -197,43 +199,38 @@ func getFoodLog(c *fiber.Ctx) error {
 		entries = filteredEntries
 	}
 
-	return c.JSON(entries)
+	return server.List(c, entries, "date")
 }
 
 type NewFoodLogEntryRequest struct {
 	FoodID    string    `json:"food_id"`
-	UserEmail string    `json:"user_email"`
-	Servings  float64   `json:"servings"`
+	UserEmail string    `json:"user_email" validate:"email"`
+	Servings  float64   `json:"servings" validate:"gte=0"`
 	MealType  string    `json:"meal_type"`
 	Date      time.Time `json:"date"`
 	Time      time.Time `json:"time"`
 }
 
-func addFoodLogEntry(c *fiber.Ctx) error {
+func (h *handlers) addFoodLogEntry(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewFoodLogEntryRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	if _, err := db.GetProfile(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Validate food
 	food, err := db.GetFood(req.FoodID)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	entry := FoodLogEntry{
-		ID:         uuid.New().String(),
+		ID:         server.NewID("FLOG"),
 		UserEmail:  req.UserEmail,
 		Food:       food,
 		Servings:   req.Servings,
@@ -244,53 +241,47 @@ func addFoodLogEntry(c *fiber.Ctx) error {
 	}
 
 	if err := db.AddFoodLogEntry(entry); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to add food log entry",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to add food log entry")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(entry)
 }
 
-func getWeightLog(c *fiber.Ctx) error {
+func (h *handlers) getWeightLog(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	db.mu.RLock()
-	entries := db.WeightLogs[email]
+	entries, _ := db.WeightLogs.Get(email)
 	db.mu.RUnlock()
 
-	return c.JSON(entries)
+	return server.List(c, entries)
 }
 
 type NewWeightLogEntryRequest struct {
-	UserEmail string    `json:"user_email"`
-	Weight    float64   `json:"weight"`
+	UserEmail string    `json:"user_email" validate:"required,email"`
+	Weight    float64   `json:"weight" validate:"gt=0"`
 	Date      time.Time `json:"date"`
 	Notes     string    `json:"notes"`
 }
 
-func addWeightLogEntry(c *fiber.Ctx) error {
+func (h *handlers) addWeightLogEntry(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewWeightLogEntryRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	// Validate user
 	if _, err := db.GetProfile(req.UserEmail); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	entry := WeightLogEntry{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("WLOG"),
 		UserEmail: req.UserEmail,
 		Weight:    req.Weight,
 		Date:      req.Date,
@@ -298,84 +289,80 @@ func addWeightLogEntry(c *fiber.Ctx) error {
 	}
 
 	if err := db.AddWeightLogEntry(entry); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to add weight log entry",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to add weight log entry")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(entry)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Profiles:   make(map[string]Profile),
-		Foods:      make(map[string]Food),
-		FoodLogs:   make(map[string][]FoodLogEntry),
-		WeightLogs: make(map[string][]WeightLogEntry),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Profile routes
-	api.Get("/profile", getProfile)
+	api.Get("/profile", h.getProfile)
 
 	// Food routes
-	api.Get("/foods/search", searchFoods)
+	api.Get("/foods/search", h.searchFoods)
 
 	// Food log routes
-	api.Get("/food-log", getFoodLog)
-	api.Post("/food-log", addFoodLogEntry)
+	api.Get("/food-log", h.getFoodLog)
+	api.Post("/food-log", h.addFoodLogEntry)
 
 	// Weight log routes
-	api.Get("/weight-log", getWeightLog)
-	api.Post("/weight-log", addWeightLogEntry)
+	api.Get("/weight-log", h.getWeightLog)
+	api.Post("/weight-log", h.addWeightLogEntry)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"profiles", "food_logs", "weight_logs"},
+			Search:  []string{"foods", "food_logs"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,18 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/ledger"
+	"pkg/money"
+	"pkg/server"
+	"pkg/statemachine"
 )
 
 // Domain Models
@@ -53,7 +52,7 @@ type Account struct {
 	UserEmail   string        `json:"user_email"`
 	Type        AccountType   `json:"type"`
 	Name        string        `json:"name"`
-	Balance     float64       `json:"balance"`
+	Balance     money.Money   `json:"balance"`
 	Currency    string        `json:"currency"`
 	Status      AccountStatus `json:"status"`
 	CreatedAt   time.Time     `json:"created_at"`
@@ -65,7 +64,7 @@ type Transaction struct {
 	AccountID   string            `json:"account_id"`
 	Date        time.Time         `json:"date"`
 	Description string            `json:"description"`
-	Amount      float64           `json:"amount"`
+	Amount      money.Money       `json:"amount"`
 	Type        TransactionType   `json:"type"`
 	Category    string            `json:"category"`
 	Status      TransactionStatus `json:"status"`
@@ -76,49 +75,106 @@ type Transfer struct {
 	ID            string            `json:"id"`
 	FromAccountID string            `json:"from_account_id"`
 	ToAccountID   string            `json:"to_account_id"`
-	Amount        float64           `json:"amount"`
+	Amount        money.Money       `json:"amount"`
 	Description   string            `json:"description"`
 	Status        TransactionStatus `json:"status"`
 	CreatedAt     time.Time         `json:"created_at"`
 }
 
 type Bill struct {
-	ID        string    `json:"id"`
-	UserEmail string    `json:"user_email"`
-	Payee     string    `json:"payee"`
-	Amount    float64   `json:"amount"`
-	DueDate   time.Time `json:"due_date"`
-	Status    string    `json:"status"`
-	AutoPay   bool      `json:"autopay"`
-	AccountID string    `json:"account_id"`
+	ID        string      `json:"id"`
+	UserEmail string      `json:"user_email"`
+	Payee     string      `json:"payee"`
+	Amount    money.Money `json:"amount"`
+	DueDate   time.Time   `json:"due_date"`
+	Status    string      `json:"status"`
+	AutoPay   bool        `json:"autopay"`
+	AccountID string      `json:"account_id"`
 }
 
+// billMachine is the statuses a bill moves through: it is paid once.
+var billMachine = &statemachine.Machine{Name: "bill", Moves: map[string][]string{
+	"PENDING": {"PAID"},
+}}
+
 // Database represents our in-memory database
 type Database struct {
-	Accounts     map[string]Account     `json:"accounts"`
-	Transactions map[string]Transaction `json:"transactions"`
-	Transfers    map[string]Transfer    `json:"transfers"`
-	Bills        map[string]Bill        `json:"bills"`
+	server.Auth `json:"auth"`
+	server.Inbox
+	server.Books
+
+	Accounts     server.Repository[Account]     `json:"accounts"`
+	Transactions server.Repository[Transaction] `json:"transactions"`
+	Transfers    server.Repository[Transfer]    `json:"transfers"`
+	Bills        server.Repository[Bill]        `json:"bills"`
 	mu           sync.RWMutex
+	locks        *ledger.Locks // Taken before mu by whatever changes an account's balance
+	clock        *server.Clock
 }
 
 // Custom errors
 var (
 	ErrAccountNotFound   = errors.New("account not found")
-	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrBillNotFound      = errors.New("bill not found")
+	ErrBillPaid          = errors.New("bill has already been paid")
+	ErrInsufficientFunds = server.NewError(server.CodeInsufficientFunds, "insufficient funds")
 	ErrInvalidAmount     = errors.New("invalid amount")
 	ErrInvalidTransfer   = errors.New("invalid transfer")
 )
 
-// Global database instance
-var db *Database
+// handlers serve Wells Fargo accounts, transfers and bills, dating transfers
+// by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+	// accountLocks outlive reloads of the database, which shares them.
+	accountLocks ledger.Locks
+}
+
+// newHandlers loads the accounts, transactions and bills in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
+
+// Balances returns each account's balance, by ID, for the books. The
+// caller holds d.mu.
+func (d *Database) Balances() map[string]money.Money {
+	balances := make(map[string]money.Money, d.Accounts.Len())
+	for _, id := range d.Accounts.Keys() {
+		account, _ := d.Accounts.Get(id)
+		balances[id] = account.balance()
+	}
+	return balances
+}
+
+// balance returns the account's balance in its currency.
+func (a Account) balance() money.Money {
+	return a.Balance.In(a.Currency)
+}
+
+// adjust adds amount to an account's balance as it stands. The caller
+// holds the account's lock and d.mu for writing.
+func (d *Database) adjust(id string, amount money.Money) error {
+	account, exists := d.Accounts.Get(id)
+	if !exists {
+		return ErrAccountNotFound
+	}
+	balance, err := account.balance().Add(amount)
+	if err != nil {
+		return err
+	}
+	account.Balance = balance
+	d.Accounts.Upsert(id, account)
+	return nil
+}
 
 // Database operations
 func (d *Database) GetAccount(id string) (Account, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	account, exists := d.Accounts[id]
+	account, exists := d.Accounts.Get(id)
 	if !exists {
 		return Account{}, ErrAccountNotFound
 	}
@@ -129,72 +185,77 @@ func (d *Database) GetUserAccounts(email string) []Account {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var accounts []Account
-	for _, account := range d.Accounts {
-		if account.UserEmail == email {
-			accounts = append(accounts, account)
-		}
-	}
-	return accounts
+	return d.Accounts.By("user_email", email)
 }
 
 func (d *Database) GetAccountTransactions(accountID string) []Transaction {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var transactions []Transaction
-	for _, tx := range d.Transactions {
-		if tx.AccountID == accountID {
-			transactions = append(transactions, tx)
-		}
-	}
-	return transactions
+	return d.Transactions.By("account_id", accountID)
 }
 
+// CreateTransfer moves a transfer's amount between its accounts. Both
+// stay locked from the check of funds to the move, so the database itself
+// is only locked for writing while the move is made.
 func (d *Database) CreateTransfer(transfer Transfer) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	unlock := d.locks.Lock(transfer.FromAccountID, transfer.ToAccountID)
+	defer unlock()
 
 	// Validate accounts exist
-	fromAccount, exists := d.Accounts[transfer.FromAccountID]
-	if !exists {
+	d.mu.RLock()
+	fromAccount, fromExists := d.Accounts.Get(transfer.FromAccountID)
+	toAccount, toExists := d.Accounts.Get(transfer.ToAccountID)
+	d.mu.RUnlock()
+	if !fromExists || !toExists {
 		return ErrAccountNotFound
 	}
 
-	toAccount, exists := d.Accounts[transfer.ToAccountID]
-	if !exists {
-		return ErrAccountNotFound
+	// Check sufficient funds, in the accounts' currency, which a transfer
+	// can't mix
+	amount := transfer.Amount.In(fromAccount.Currency)
+	if _, err := toAccount.balance().Add(amount); err != nil {
+		return err
 	}
-
-	// Check sufficient funds
-	if fromAccount.Balance < transfer.Amount {
+	short, err := fromAccount.balance().Less(amount)
+	if err != nil {
+		return err
+	}
+	if short {
 		return ErrInsufficientFunds
 	}
 
-	// Update account balances
-	fromAccount.Balance -= transfer.Amount
-	toAccount.Balance += transfer.Amount
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	// Update accounts
-	d.Accounts[fromAccount.ID] = fromAccount
-	d.Accounts[toAccount.ID] = toAccount
+	if err := d.Post(ledger.Transfer(fromAccount.ID, toAccount.ID, amount, transfer.Description, transfer.ID)); err != nil {
+		return err
+	}
+
+	// Update account balances
+	if err := d.adjust(fromAccount.ID, amount.Neg()); err != nil {
+		return err
+	}
+	if err := d.adjust(toAccount.ID, amount); err != nil {
+		return err
+	}
 
 	// Create transactions
 	debitTx := Transaction{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("TXN"),
 		AccountID:   fromAccount.ID,
-		Date:        time.Now(),
+		Date:        d.clock.Now(),
 		Description: transfer.Description,
-		Amount:      -transfer.Amount,
+		Amount:      transfer.Amount.Neg(),
 		Type:        TransactionTypeDebit,
 		Status:      TransactionStatusCompleted,
 		Reference:   transfer.ID,
 	}
 
 	creditTx := Transaction{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("TXN"),
 		AccountID:   toAccount.ID,
-		Date:        time.Now(),
+		Date:        d.clock.Now(),
 		Description: transfer.Description,
 		Amount:      transfer.Amount,
 		Type:        TransactionTypeCredit,
@@ -203,262 +264,327 @@ func (d *Database) CreateTransfer(transfer Transfer) error {
 	}
 
 	// Save transactions
-	d.Transactions[debitTx.ID] = debitTx
-	d.Transactions[creditTx.ID] = creditTx
+	d.Transactions.Upsert(debitTx.ID, debitTx)
+	d.Transactions.Upsert(creditTx.ID, creditTx)
 
 	// Save transfer
-	d.Transfers[transfer.ID] = transfer
+	d.Transfers.Upsert(transfer.ID, transfer)
 
 	return nil
 }
 
+// PayBills makes each payment, from its account to its bill, and returns
+// their transactions. It makes all of them or, if a bill or account doesn't
+// exist or an account can't cover its payments between them, none.
+func (d *Database) PayBills(payments []BillPaymentRequest) ([]Transaction, error) {
+	accounts := make([]string, len(payments))
+	for i, p := range payments {
+		accounts[i] = p.AccountID
+	}
+	unlock := d.locks.Lock(accounts...)
+	defer unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Check every payment before making any
+	owed := make(map[string]money.Money)
+	for _, p := range payments {
+		bill, exists := d.Bills.Get(p.BillID)
+		if !exists {
+			return nil, ErrBillNotFound
+		}
+		if !billMachine.Allows(bill.Status, "PAID") {
+			return nil, ErrBillPaid
+		}
+		account, exists := d.Accounts.Get(p.AccountID)
+		if !exists {
+			return nil, ErrAccountNotFound
+		}
+		sum, err := owed[p.AccountID].In(account.Currency).Add(p.Amount.In(account.Currency))
+		if err != nil {
+			return nil, err
+		}
+		owed[p.AccountID] = sum
+	}
+	for id, amount := range owed {
+		account, _ := d.Accounts.Get(id)
+		short, err := account.balance().Less(amount)
+		if err != nil {
+			return nil, err
+		}
+		if short {
+			return nil, ErrInsufficientFunds
+		}
+	}
+
+	// Each payment goes to its payee, outside the bank
+	journal := ledger.Journal{Memo: "Bill Payment"}
+	for _, p := range payments {
+		account, _ := d.Accounts.Get(p.AccountID)
+		bill, _ := d.Bills.Get(p.BillID)
+		amount := p.Amount.In(account.Currency)
+		journal.Legs = append(journal.Legs,
+			ledger.Leg{Account: p.AccountID, Amount: amount.Neg()},
+			ledger.Leg{Account: ledger.External + bill.Payee, Amount: amount})
+	}
+	if err := d.Post(journal); err != nil {
+		return nil, err
+	}
+
+	txs := make([]Transaction, 0, len(payments))
+	for _, p := range payments {
+		account, _ := d.Accounts.Get(p.AccountID)
+		if err := d.adjust(p.AccountID, p.Amount.In(account.Currency).Neg()); err != nil {
+			return nil, err
+		}
+		account, _ = d.Accounts.Get(p.AccountID)
+		bill, _ := d.Bills.Get(p.BillID)
+		if err := statemachine.Move(billMachine, &bill, &bill.Status, nil, "PAID", d.clock.Now()); err != nil {
+			return nil, err
+		}
+
+		tx := Transaction{
+			ID:          server.NewID("TXN"),
+			AccountID:   account.ID,
+			Date:        d.clock.Now(),
+			Description: "Bill Payment - " + bill.Payee,
+			Amount:      p.Amount.Neg(),
+			Type:        TransactionTypeDebit,
+			Category:    "BILL_PAYMENT",
+			Status:      TransactionStatusCompleted,
+		}
+
+		d.Accounts.Upsert(account.ID, account)
+		d.Bills.Upsert(bill.ID, bill)
+		d.Transactions.Upsert(tx.ID, tx)
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
+
 // HTTP Handlers
-func getUserAccounts(c *fiber.Ctx) error {
+func (h *handlers) getUserAccounts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	accounts := db.GetUserAccounts(email)
-	return c.JSON(accounts)
+	return server.List(c, accounts)
 }
 
-func getAccountTransactions(c *fiber.Ctx) error {
+func (h *handlers) getAccountTransactions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	accountID := c.Params("accountId")
 	if accountID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "account ID is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "account ID is required")
 	}
 
 	// Verify account exists
 	if _, err := db.GetAccount(accountID); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	transactions := db.GetAccountTransactions(accountID)
-	return c.JSON(transactions)
+	return server.List(c, transactions)
 }
 
 type TransferRequest struct {
-	FromAccountID string  `json:"from_account_id"`
-	ToAccountID   string  `json:"to_account_id"`
-	Amount        float64 `json:"amount"`
-	Description   string  `json:"description"`
+	FromAccountID string      `json:"from_account_id"`
+	ToAccountID   string      `json:"to_account_id"`
+	Amount        money.Money `json:"amount" validate:"gt=0"`
+	Description   string      `json:"description"`
 }
 
-func createTransfer(c *fiber.Ctx) error {
+func (h *handlers) createTransfer(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req TransferRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	if req.Amount <= 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Amount must be positive",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	transfer := Transfer{
-		ID:            uuid.New().String(),
+		ID:            server.NewID("TRF"),
 		FromAccountID: req.FromAccountID,
 		ToAccountID:   req.ToAccountID,
 		Amount:        req.Amount,
 		Description:   req.Description,
 		Status:        TransactionStatusCompleted,
-		CreatedAt:     time.Now(),
+		CreatedAt:     h.clock.Now(),
 	}
 
 	if err := db.CreateTransfer(transfer); err != nil {
-		switch err {
-		case ErrAccountNotFound:
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		case ErrInsufficientFunds:
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+		switch {
+		case errors.Is(err, ErrAccountNotFound):
+			return server.FailWith(c, fiber.StatusNotFound, err)
+		case errors.Is(err, ErrInsufficientFunds):
+			return server.FailWith(c, fiber.StatusBadRequest, err)
+		case errors.Is(err, money.ErrMixedCurrencies):
+			return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
 		default:
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to process transfer",
-			})
+			return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to process transfer")
 		}
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(transfer)
 }
 
-func getUserBills(c *fiber.Ctx) error {
+func (h *handlers) getUserBills(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	db.mu.RLock()
-	var bills []Bill
-	for _, bill := range db.Bills {
-		if bill.UserEmail == email {
-			bills = append(bills, bill)
-		}
-	}
+	bills := db.Bills.By("user_email", email)
 	db.mu.RUnlock()
 
-	return c.JSON(bills)
+	return server.List(c, bills)
 }
 
 type BillPaymentRequest struct {
-	BillID        string    `json:"bill_id"`
-	AccountID     string    `json:"account_id"`
-	Amount        float64   `json:"amount"`
-	ScheduledDate time.Time `json:"scheduled_date"`
+	BillID        string      `json:"bill_id"`
+	AccountID     string      `json:"account_id"`
+	Amount        money.Money `json:"amount" validate:"gte=0"`
+	ScheduledDate time.Time   `json:"scheduled_date"`
 }
 
-func payBill(c *fiber.Ctx) error {
+func (h *handlers) payBill(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req BillPaymentRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	// Verify bill exists
-	bill, exists := db.Bills[req.BillID]
-	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Bill not found",
-		})
+	txs, err := db.PayBills([]BillPaymentRequest{req})
+	if err != nil {
+		return billPaymentFailed(c, err)
 	}
 
-	// Verify account exists and has sufficient funds
-	account, exists := db.Accounts[req.AccountID]
-	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Account not found",
-		})
-	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":        "Bill payment successful",
+		"transaction_id": txs[0].ID,
+	})
+}
 
-	if account.Balance < req.Amount {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Insufficient funds",
-		})
+func (h *handlers) payBills(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req struct {
+		Payments []BillPaymentRequest `json:"payments" validate:"min=1,max=50"`
 	}
-
-	// Process payment
-	account.Balance -= req.Amount
-	bill.Status = "PAID"
-
-	// Create transaction
-	tx := Transaction{
-		ID:          uuid.New().String(),
-		AccountID:   account.ID,
-		Date:        time.Now(),
-		Description: "Bill Payment - " + bill.Payee,
-		Amount:      -req.Amount,
-		Type:        TransactionTypeDebit,
-		Category:    "BILL_PAYMENT",
-		Status:      TransactionStatusCompleted,
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
-	// Update database
-	db.Accounts[account.ID] = account
-	db.Bills[bill.ID] = bill
-	db.Transactions[tx.ID] = tx
+	// The payments are made together, or not at all
+	txs, err := db.PayBills(req.Payments)
+	if err != nil {
+		return billPaymentFailed(c, err)
+	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"message":        "Bill payment successful",
-		"transaction_id": tx.ID,
+		"message":      fmt.Sprintf("%d bill payments successful", len(txs)),
+		"transactions": txs,
 	})
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
+// billPaymentFailed responds to a failed bill payment.
+func billPaymentFailed(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrBillNotFound), errors.Is(err, ErrAccountNotFound):
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case errors.Is(err, ErrInsufficientFunds):
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	case errors.Is(err, ErrBillPaid):
+		return server.FailWith(c, fiber.StatusConflict, err)
+	case errors.Is(err, money.ErrMixedCurrencies):
+		return server.FailWith(c, fiber.StatusUnprocessableEntity, err)
+	default:
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to pay bill")
 	}
+}
 
-	db = &Database{
-		Accounts:     make(map[string]Account),
-		Transactions: make(map[string]Transaction),
-		Transfers:    make(map[string]Transfer),
-		Bills:        make(map[string]Bill),
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
+		locks: &h.accountLocks,
 	}
 
-	return json.Unmarshal(data, db)
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Account routes
-	api.Get("/accounts", getUserAccounts)
+	api.Get("/accounts", h.getUserAccounts)
 	api.Get("/accounts/:accountId", func(c *fiber.Ctx) error {
+		db := h.db.In(c)
 		accountId := c.Params("accountId")
 		account, err := db.GetAccount(accountId)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+			return server.FailWith(c, fiber.StatusNotFound, err)
 		}
 		return c.JSON(account)
 	})
-	api.Get("/accounts/:accountId/transactions", getAccountTransactions)
+	api.Get("/accounts/:accountId/transactions", h.getAccountTransactions)
 
 	// Transfer routes
-	api.Post("/transfers", createTransfer)
+	api.Post("/transfers", h.createTransfer)
 
 	// Bill routes
-	api.Get("/bills", getUserBills)
-	api.Post("/bills/pay", payBill)
+	api.Get("/bills", h.getUserBills)
+	api.Post("/bills/pay", h.payBill)
+	api.Post("/bills/pay/bulk", h.payBills)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept",
-	}))
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"accounts", "bills"},
+			Search:  []string{"accounts", "transactions", "bills"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,17 +1,22 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
-	"os"
+	"math/big"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -45,29 +50,71 @@ type Chat struct {
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
+// Verification is a code texted to a user's phone to prove it's theirs, as
+// when registering WhatsApp on a new phone. Only the code's hash is kept.
+type Verification struct {
+	Email      string     `json:"email"`
+	Phone      string     `json:"phone"`
+	CodeHash   string     `json:"code_hash"`
+	Attempts   int        `json:"attempts"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+const (
+	verificationTTL         = 10 * time.Minute
+	maxVerificationAttempts = 5
+)
+
 // Database represents our in-memory database
 type Database struct {
-	Contacts  map[string]Contact   `json:"contacts"`
-	Chats     map[string]Chat      `json:"chats"`
-	Messages  map[string][]Message `json:"messages"`
-	UserChats map[string][]string  `json:"user_chats"` // email -> chat IDs
-	mu        sync.RWMutex
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Contacts      server.Repository[Contact]      `json:"contacts"`
+	Chats         server.Repository[Chat]         `json:"chats"`
+	Messages      server.Repository[[]Message]    `json:"messages"`
+	UserChats     server.Repository[[]string]     `json:"user_chats"`    // email -> chat IDs
+	Verifications server.Repository[Verification] `json:"verifications"` // email -> latest
+	mu            sync.RWMutex
+	clock         *server.Clock
+}
+
+var (
+	ErrContactNotFound = errors.New("user not found")
+	ErrNoPhone         = errors.New("user has no phone number")
+	ErrNoVerification  = errors.New("no verification code was sent")
+	ErrCodeExpired     = errors.New("verification code has expired; request a new one")
+	ErrTooManyAttempts = errors.New("too many attempts; request a new code")
+	ErrWrongCode       = errors.New("incorrect verification code")
+)
+
+// handlers carry WhatsApp chats and messages between contacts and verify
+// their numbers, by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
 }
 
-var db *Database
+// newHandlers loads the contacts, chats and messages in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetContact(email string) (Contact, bool) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	contact, exists := d.Contacts[email]
+	contact, exists := d.Contacts.Get(email)
 	return contact, exists
 }
 
 func (d *Database) GetChat(chatID string) (Chat, bool) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	chat, exists := d.Chats[chatID]
+	chat, exists := d.Chats.Get(chatID)
 	return chat, exists
 }
 
@@ -76,9 +123,9 @@ func (d *Database) GetUserChats(email string) []Chat {
 	defer d.mu.RUnlock()
 
 	var chats []Chat
-	chatIDs := d.UserChats[email]
+	chatIDs, _ := d.UserChats.Get(email)
 	for _, id := range chatIDs {
-		if chat, exists := d.Chats[id]; exists {
+		if chat, exists := d.Chats.Get(id); exists {
 			chats = append(chats, chat)
 		}
 	}
@@ -89,87 +136,146 @@ func (d *Database) AddMessage(msg Message) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if _, exists := d.Messages[msg.ChatID]; !exists {
-		d.Messages[msg.ChatID] = []Message{}
-	}
-	d.Messages[msg.ChatID] = append(d.Messages[msg.ChatID], msg)
+	messages, _ := d.Messages.Get(msg.ChatID)
+	d.Messages.Upsert(msg.ChatID, append(messages, msg))
 
 	// Update chat's last message
-	if chat, exists := d.Chats[msg.ChatID]; exists {
-		chat.UpdatedAt = time.Now()
-		d.Chats[msg.ChatID] = chat
+	if chat, exists := d.Chats.Get(msg.ChatID); exists {
+		chat.UpdatedAt = d.clock.Now()
+		d.Chats.Upsert(msg.ChatID, chat)
 	}
 
 	return nil
 }
 
+// StartVerification texts the contact a new code, replacing any they were
+// sent before.
+func (d *Database) StartVerification(email string, now time.Time) (Verification, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	contact, exists := d.Contacts.Get(email)
+	if !exists {
+		return Verification{}, ErrContactNotFound
+	}
+	if contact.Phone == "" {
+		return Verification{}, ErrNoPhone
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return Verification{}, err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	v := Verification{
+		Email:     email,
+		Phone:     contact.Phone,
+		CodeHash:  hashCode(code),
+		ExpiresAt: now.Add(verificationTTL),
+		CreatedAt: now,
+	}
+	d.Verifications.Upsert(email, v)
+	d.SendText(server.Text{
+		From:       "WhatsApp",
+		To:         contact.Phone,
+		UserEmail:  email,
+		Template:   "verification_code",
+		Collection: "verifications",
+		EntityID:   email,
+		SentAt:     now,
+	}, map[string]string{"code": code, "minutes": strconv.Itoa(int(verificationTTL.Minutes()))})
+	return v, nil
+}
+
+// ConfirmVerification checks code against the contact's latest one.
+func (d *Database) ConfirmVerification(email, code string, now time.Time) (Verification, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.Verifications.Get(email)
+	switch {
+	case !exists:
+		return Verification{}, ErrNoVerification
+	case v.VerifiedAt != nil:
+		return v, nil
+	case !now.Before(v.ExpiresAt):
+		return Verification{}, ErrCodeExpired
+	case v.Attempts >= maxVerificationAttempts:
+		return Verification{}, ErrTooManyAttempts
+	}
+	if subtle.ConstantTimeCompare([]byte(hashCode(code)), []byte(v.CodeHash)) != 1 {
+		v.Attempts++
+		d.Verifications.Upsert(email, v)
+		return Verification{}, ErrWrongCode
+	}
+	v.VerifiedAt = &now
+	d.Verifications.Upsert(email, v)
+	return v, nil
+}
+
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
 // HTTP Handlers
-func getUserChats(c *fiber.Ctx) error {
+func (h *handlers) getUserChats(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	if _, exists := db.GetContact(email); !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "user not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "user not found")
 	}
 
 	chats := db.GetUserChats(email)
-	return c.JSON(chats)
+	return server.List(c, chats)
 }
 
-func getChatMessages(c *fiber.Ctx) error {
+func (h *handlers) getChatMessages(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	chatID := c.Query("chat_id")
 	if chatID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "chat_id parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "chat_id parameter is required")
 	}
 
 	db.mu.RLock()
-	messages, exists := db.Messages[chatID]
+	messages, exists := db.Messages.Get(chatID)
 	db.mu.RUnlock()
 
-	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "chat not found",
-		})
+	// Only the chat's participants may read it; to anyone else it isn't
+	// there.
+	chat, _ := db.GetChat(chatID)
+	if !exists || !slices.ContainsFunc(chat.Participants, func(p Contact) bool { return server.Owns(c, p.Email) }) {
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "chat not found")
 	}
 
-	return c.JSON(messages)
+	return server.List(c, messages, "chat_id")
 }
 
 type NewMessageRequest struct {
-	ChatID      string `json:"chat_id"`
-	SenderEmail string `json:"sender_email"`
-	Content     string `json:"content"`
-	Type        string `json:"type"`
+	ChatID      string `json:"chat_id" validate:"required"`
+	SenderEmail string `json:"sender_email" validate:"required,email"`
+	Content     string `json:"content" validate:"required"`
+	Type        string `json:"type" validate:"omitempty,oneof=text image video audio"`
 }
 
-func sendMessage(c *fiber.Ctx) error {
+func (h *handlers) sendMessage(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req NewMessageRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	sender, exists := db.GetContact(req.SenderEmail)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "sender not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "sender not found")
 	}
 
 	chat, exists := db.GetChat(req.ChatID)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "chat not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "chat not found")
 	}
 
 	// Verify sender is participant in chat
@@ -181,69 +287,56 @@ func sendMessage(c *fiber.Ctx) error {
 		}
 	}
 	if !senderIsParticipant {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "sender is not a participant in this chat",
-		})
+		return server.Fail(c, fiber.StatusForbidden, server.CodeForbidden, "sender is not a participant in this chat")
 	}
 
 	msg := Message{
-		ID:        uuid.New().String(),
+		ID:        server.NewID("MSG"),
 		ChatID:    req.ChatID,
 		Sender:    sender,
 		Content:   req.Content,
 		Type:      req.Type,
-		Timestamp: time.Now(),
+		Timestamp: h.clock.Now(),
 		Read:      false,
 	}
 
 	if err := db.AddMessage(msg); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to send message",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "failed to send message")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(msg)
 }
 
-func getUserContacts(c *fiber.Ctx) error {
+func (h *handlers) getUserContacts(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	if _, exists := db.GetContact(email); !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "user not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "user not found")
 	}
 
 	db.mu.RLock()
-	var contacts []Contact
-	for _, contact := range db.Contacts {
-		if contact.Email != email {
-			contacts = append(contacts, contact)
-		}
-	}
+	contacts := db.Contacts.Query(func(contact Contact) bool {
+		return contact.Email != email
+	})
 	db.mu.RUnlock()
 
-	return c.JSON(contacts)
+	return server.List(c, contacts)
 }
 
-func getUserStatus(c *fiber.Ctx) error {
+func (h *handlers) getUserStatus(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	contact, exists := db.GetContact(email)
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "user not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "user not found")
 	}
 
 	return c.JSON(fiber.Map{
@@ -253,64 +346,147 @@ func getUserStatus(c *fiber.Ctx) error {
 	})
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
+type VerificationRequest struct {
+	Email string `json:"email" validate:"email"`
+}
+
+func (h *handlers) requestVerification(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req VerificationRequest
+	if err := server.Bind(c, &req); err != nil {
 		return err
 	}
 
-	db = &Database{
-		Contacts:  make(map[string]Contact),
-		Chats:     make(map[string]Chat),
-		Messages:  make(map[string][]Message),
-		UserChats: make(map[string][]string),
+	v, err := db.StartVerification(req.Email, h.clock.Now())
+	switch {
+	case errors.Is(err, ErrContactNotFound):
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case errors.Is(err, ErrNoPhone):
+		return server.FailWith(c, fiber.StatusBadRequest, err)
+	case err != nil:
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(v.response())
+}
+
+type ConfirmVerificationRequest struct {
+	Email string `json:"email" validate:"email"`
+	Code  string `json:"code"`
+}
+
+func (h *handlers) confirmVerification(c *fiber.Ctx) error {
+	db := h.db.In(c)
+	var req ConfirmVerificationRequest
+	if err := server.Bind(c, &req); err != nil {
+		return err
+	}
+
+	v, err := db.ConfirmVerification(req.Email, req.Code, h.clock.Now())
+	switch {
+	case errors.Is(err, ErrNoVerification):
+		return server.FailWith(c, fiber.StatusNotFound, err)
+	case errors.Is(err, ErrCodeExpired):
+		return server.Fail(c, fiber.StatusGone, server.CodeGone, err.Error())
+	case errors.Is(err, ErrTooManyAttempts):
+		return server.Fail(c, fiber.StatusTooManyRequests, server.CodeRateLimited, err.Error())
+	case errors.Is(err, ErrWrongCode):
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeBadRequest, err.Error())
+	case err != nil:
+		return err
+	}
+	return c.JSON(v.response())
+}
+
+// VerificationResponse is a verification without its code's hash.
+type VerificationResponse struct {
+	Email      string     `json:"email"`
+	Phone      string     `json:"phone"`
+	Verified   bool       `json:"verified"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+func (v Verification) response() VerificationResponse {
+	return VerificationResponse{
+		Email:      v.Email,
+		Phone:      v.Phone,
+		Verified:   v.VerifiedAt != nil,
+		ExpiresAt:  v.ExpiresAt,
+		VerifiedAt: v.VerifiedAt,
+	}
+}
+
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{
+		clock: h.clock,
 	}
 
-	return json.Unmarshal(data, db)
+	if err := server.Load(store, db); err != nil {
+		return err
+	}
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Chat routes
-	api.Get("/chats", getUserChats)
-	api.Get("/messages", getChatMessages)
-	api.Post("/messages", sendMessage)
+	api.Get("/chats", h.getUserChats)
+	api.Get("/messages", h.getChatMessages)
+	api.Post("/messages", h.sendMessage)
 
 	// Contact routes
-	api.Get("/contacts", getUserContacts)
+	api.Get("/contacts", h.getUserContacts)
 
 	// Status routes
-	api.Get("/status", getUserStatus)
+	api.Get("/status", h.getUserStatus)
+
+	// Phone verification routes
+	api.Post("/verification", h.requestVerification)
+	api.Post("/verification/confirm", h.confirmVerification)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
-
-	if err := loadDatabase(); err != nil {
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"chats", "messages", "user_chats", "verifications"},
+			Search:  []string{"contacts", "chats", "messages"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+
+	"pkg/server"
 )
 
 // Data models
@@ -64,108 +60,108 @@ type Achievement struct {
 
 // Database structure
 type Database struct {
-	Profiles     map[string]Profile                  `json:"profiles"`
-	Friends      map[string][]Friend                 `json:"friends"`
-	Games        map[string][]Game                   `json:"games"`
-	Achievements map[string]map[string][]Achievement `json:"achievements"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Profiles     server.Repository[Profile]                  `json:"profiles"`
+	Friends      server.Repository[[]Friend]                 `json:"friends"`
+	Games        server.Repository[[]Game]                   `json:"games"`
+	Achievements server.Repository[map[string][]Achievement] `json:"achievements"`
 	mu           sync.RWMutex
 }
 
-var db *Database
+// handlers serve Xbox Live profiles, friends, games and achievements from
+// db.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the profiles, games and achievements in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Handler functions
-func getProfile(c *fiber.Ctx) error {
+func (h *handlers) getProfile(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	db.mu.RLock()
-	profile, exists := db.Profiles[email]
+	profile, exists := db.Profiles.Get(email)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "profile not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "profile not found")
 	}
 
 	return c.JSON(profile)
 }
 
-func getFriends(c *fiber.Ctx) error {
+func (h *handlers) getFriends(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	db.mu.RLock()
-	friends, exists := db.Friends[email]
+	friends, exists := db.Friends.Get(email)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "user not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "user not found")
 	}
 
-	return c.JSON(friends)
+	return server.List(c, friends)
 }
 
-func getGames(c *fiber.Ctx) error {
+func (h *handlers) getGames(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	db.mu.RLock()
-	games, exists := db.Games[email]
+	games, exists := db.Games.Get(email)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "user not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "user not found")
 	}
 
-	return c.JSON(games)
+	return server.List(c, games)
 }
 
-func getAchievements(c *fiber.Ctx) error {
+func (h *handlers) getAchievements(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	gameID := c.Query("game_id")
 
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	db.mu.RLock()
-	userAchievements, exists := db.Achievements[email]
+	userAchievements, exists := db.Achievements.Get(email)
 	db.mu.RUnlock()
 
 	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "user not found",
-		})
+		return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "user not found")
 	}
 
 	if gameID != "" {
 		// Return achievements for specific game
 		achievements, exists := userAchievements[gameID]
 		if !exists {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "game not found",
-			})
+			return server.Fail(c, fiber.StatusNotFound, server.CodeNotFound, "game not found")
 		}
-		return c.JSON(achievements)
+		return server.List(c, achievements, "game_id")
 	}
 
 	// Return all achievements
@@ -174,62 +170,68 @@ func getAchievements(c *fiber.Ctx) error {
 		allAchievements = append(allAchievements, gameAchievements...)
 	}
 
-	return c.JSON(allAchievements)
+	return server.List(c, allAchievements, "game_id")
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Profiles:     make(map[string]Profile),
-		Friends:      make(map[string][]Friend),
-		Games:        make(map[string][]Game),
-		Achievements: make(map[string]map[string][]Achievement),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
-	api.Get("/profile", getProfile)
-	api.Get("/friends", getFriends)
-	api.Get("/games", getGames)
-	api.Get("/achievements", getAchievements)
+	api.Get("/profile", h.getProfile)
+	api.Get("/friends", h.getFriends)
+	api.Get("/games", h.getGames)
+	api.Get("/achievements", h.getAchievements)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	setupRoutes(app)
-
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"friends", "games", "achievements"},
+			Search:  []string{"games", "achievements"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,19 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/google/uuid"
+
+	"pkg/server"
 )
 
 // Domain Models
@@ -62,10 +57,13 @@ type Playlist struct {
 
 // Database represents our in-memory database
 type Database struct {
-	Users     map[string]User     `json:"users"`
-	Videos    map[string]Video    `json:"videos"`
-	Channels  map[string]Channel  `json:"channels"`
-	Playlists map[string]Playlist `json:"playlists"`
+	server.Auth `json:"auth"`
+	server.Inbox
+
+	Users     server.Repository[User]     `json:"users"`
+	Videos    server.Repository[Video]    `json:"videos"`
+	Channels  server.Repository[Channel]  `json:"channels"`
+	Playlists server.Repository[Playlist] `json:"playlists"`
 	mu        sync.RWMutex
 }
 
@@ -78,15 +76,25 @@ var (
 	ErrInvalidInput     = errors.New("invalid input")
 )
 
-// Global database instance
-var db *Database
+// handlers serve YouTube's videos, channels and playlists, dating new
+// playlists by clock.
+type handlers struct {
+	db    server.Ref[Database]
+	clock *server.Clock
+}
+
+// newHandlers loads the videos, channels and playlists in store.
+func newHandlers(store server.Store, clock *server.Clock) (*handlers, error) {
+	h := &handlers{clock: clock}
+	return h, h.loadDatabase(store)
+}
 
 // Database operations
 func (d *Database) GetUser(email string) (User, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	user, exists := d.Users[email]
+	user, exists := d.Users.Get(email)
 	if !exists {
 		return User{}, ErrUserNotFound
 	}
@@ -97,7 +105,7 @@ func (d *Database) GetVideo(id string) (Video, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	video, exists := d.Videos[id]
+	video, exists := d.Videos.Get(id)
 	if !exists {
 		return Video{}, ErrVideoNotFound
 	}
@@ -108,206 +116,178 @@ func (d *Database) CreatePlaylist(playlist Playlist) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.Playlists[playlist.ID] = playlist
+	d.Playlists.Upsert(playlist.ID, playlist)
 	return nil
 }
 
 // HTTP Handlers
-func getRecommendedVideos(c *fiber.Ctx) error {
-	page := c.QueryInt("page", 1)
-	limit := c.QueryInt("limit", 20)
-
+func (h *handlers) getRecommendedVideos(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var videos []Video
 	db.mu.RLock()
-	for _, video := range db.Videos {
+	for _, video := range db.Videos.List() {
 		videos = append(videos, video)
 	}
 	db.mu.RUnlock()
 
-	// Simple pagination
-	start := (page - 1) * limit
-	end := start + limit
-	if start >= len(videos) {
-		return c.JSON([]Video{})
-	}
-	if end > len(videos) {
-		end = len(videos)
-	}
-
-	return c.JSON(videos[start:end])
+	return server.List(c, videos)
 }
 
-func getVideoDetails(c *fiber.Ctx) error {
+func (h *handlers) getVideoDetails(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	videoId := c.Params("videoId")
 
 	video, err := db.GetVideo(videoId)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	// Increment views
 	db.mu.Lock()
 	video.Views++
-	db.Videos[videoId] = video
+	db.Videos.Upsert(videoId, video)
 	db.mu.Unlock()
 
 	return c.JSON(video)
 }
 
-func getUserPlaylists(c *fiber.Ctx) error {
+func (h *handlers) getUserPlaylists(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Playlists)
+	return server.List(c, user.Playlists)
 }
 
 type CreatePlaylistRequest struct {
-	Title       string `json:"title"`
+	Title       string `json:"title" validate:"required"`
 	Description string `json:"description"`
 	Visibility  string `json:"visibility"`
-	UserEmail   string `json:"user_email"`
+	UserEmail   string `json:"user_email" validate:"required,email"`
 }
 
-func createPlaylist(c *fiber.Ctx) error {
+func (h *handlers) createPlaylist(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	var req CreatePlaylistRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	if req.Title == "" || req.UserEmail == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Title and user_email are required",
-		})
+	if err := server.Bind(c, &req); err != nil {
+		return err
 	}
 
 	user, err := db.GetUser(req.UserEmail)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
 	playlist := Playlist{
-		ID:          uuid.New().String(),
+		ID:          server.NewID("PLST"),
 		Title:       req.Title,
 		Description: req.Description,
 		Visibility:  req.Visibility,
 		Videos:      []Video{},
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		CreatedAt:   h.clock.Now(),
+		UpdatedAt:   h.clock.Now(),
 	}
 
 	if err := db.CreatePlaylist(playlist); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create playlist",
-		})
+		return server.Fail(c, fiber.StatusInternalServerError, server.CodeInternal, "Failed to create playlist")
 	}
 
 	// Update user's playlists
 	db.mu.Lock()
 	user.Playlists = append(user.Playlists, playlist)
-	db.Users[req.UserEmail] = user
+	db.Users.Upsert(req.UserEmail, user)
 	db.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(playlist)
 }
 
-func getUserSubscriptions(c *fiber.Ctx) error {
+func (h *handlers) getUserSubscriptions(c *fiber.Ctx) error {
+	db := h.db.In(c)
 	email := c.Query("email")
 	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "email parameter is required",
-		})
+		return server.Fail(c, fiber.StatusBadRequest, server.CodeValidationFailed, "email parameter is required")
 	}
 
 	user, err := db.GetUser(email)
 	if err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return server.FailWith(c, fiber.StatusNotFound, err)
 	}
 
-	return c.JSON(user.Subscriptions)
+	return server.List(c, user.Subscriptions)
 }
 
-func loadDatabase() error {
-	data, err := os.ReadFile("database.json")
-	if err != nil {
-		return err
-	}
+func (h *handlers) loadDatabase(store server.Store) error {
+	db := &Database{}
 
-	db = &Database{
-		Users:     make(map[string]User),
-		Videos:    make(map[string]Video),
-		Channels:  make(map[string]Channel),
-		Playlists: make(map[string]Playlist),
+	if err := server.Load(store, db); err != nil {
+		return err
 	}
-
-	return json.Unmarshal(data, db)
+	h.db.Set(db)
+	return nil
 }
 
-func setupRoutes(app *fiber.App) {
+func setupRoutes(app *fiber.App, h *handlers) {
 	api := app.Group("/api/v1")
 
 	// Video routes
-	api.Get("/videos", getRecommendedVideos)
-	api.Get("/videos/:videoId", getVideoDetails)
+	api.Get("/videos", h.getRecommendedVideos)
+	api.Get("/videos/:videoId", h.getVideoDetails)
 
 	// Playlist routes
-	api.Get("/playlists", getUserPlaylists)
-	api.Post("/playlists", createPlaylist)
+	api.Get("/playlists", h.getUserPlaylists)
+	api.Post("/playlists", h.createPlaylist)
 
 	// Subscription routes
-	api.Get("/subscriptions", getUserSubscriptions)
+	api.Get("/subscriptions", h.getUserSubscriptions)
 }
 
+//go:generate go run pkg/cmd/openapi
+//go:generate go run pkg/cmd/protogen
 func main() {
-	// Command line flags
-	port := flag.String("port", "3000", "Port to run the server on")
-	flag.Parse()
+	cfg := server.ParseFlags()
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := loadDatabase(); err != nil {
+	h, err := newHandlers(store, server.DefaultClock())
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: func(c *fiber.Ctx, err error) error {
-			code := fiber.StatusInternalServerError
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			}
-			return c.Status(code).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		},
-	})
-
-	// Middleware
-	app.Use(logger.New())
-	app.Use(recover.New())
-	app.Use(cors.New())
-
-	// Setup routes
-	setupRoutes(app)
-
-	// Start server
-	log.Printf("Server starting on port %s", *port)
-	if err := app.Listen(":" + *port); err != nil {
+	app := server.New(
+		server.WithDatabase(cfg, store, server.Database{
+			Current: func() (any, *sync.RWMutex) {
+				db := h.db.Get()
+				return db, &db.mu
+			},
+			Load:    h.loadDatabase,
+			Private: []string{"users"},
+			Search:  []string{"videos"},
+		}),
+		server.WithSpec(cfg),
+		server.WithRateLimit(cfg),
+		server.WithLatency(cfg),
+		server.WithGRPC(cfg),
+		server.WithGraphQL(cfg),
+		server.WithRecording(cfg),
+		server.WithCORS(cfg),
+		server.WithCompression(cfg),
+		server.WithBodyLimit(cfg),
+		server.WithRequestTimeout(cfg),
+		server.WithIDs(cfg),
+		server.WithVersions(cfg, server.V2),
+	)
+	setupRoutes(app, h)
+
+	if err := server.Listen(app, cfg); err != nil {
 		log.Fatal(err)
 	}
 }